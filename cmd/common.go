@@ -18,9 +18,13 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/sorintlab/stolon/internal/common"
+	slog "github.com/sorintlab/stolon/internal/log"
 	"github.com/sorintlab/stolon/internal/store"
+	"github.com/sorintlab/stolon/internal/tracing"
 	"github.com/sorintlab/stolon/internal/util"
 	"k8s.io/client-go/kubernetes"
 
@@ -42,28 +46,68 @@ type CommonConfig struct {
 	MetricsListenAddress string
 	LogColor             bool
 	LogLevel             string
+	LogFormat            string
+	LogSyslog            bool
+	LogSyslogAddress     string
 	Debug                bool
 	KubeResourceKind     string
+	KubeUseLeases        bool
 	KubeConfig           string
 	KubeContext          string
 	KubeNamespace        string
+	StoreTimeout         time.Duration
+	StoreDialTimeout     time.Duration
+
+	LogSpans bool
+
+	StoreConsulNamespace           string
+	StoreConsulTokenFile           string
+	StoreConsulTokenReloadInterval time.Duration
+
+	StoreClusterDataCompression bool
+	StoreClusterDataChunkSize   int
+
+	// StoreElectionTTL is defined only by the sentinel
+	StoreElectionTTL time.Duration
+
+	VaultAddress             string
+	VaultCAFile              string
+	VaultTokenFile           string
+	VaultKubeAuthRole        string
+	VaultKubeAuthMount       string
+	VaultStorePKIPath        string
+	VaultStoreCertCommonName string
+	VaultStoreCertTTL        time.Duration
 }
 
 func AddCommonFlags(cmd *cobra.Command, cfg *CommonConfig) {
 	cmd.PersistentFlags().StringVar(&cfg.ClusterName, "cluster-name", "", "cluster name")
-	cmd.PersistentFlags().StringVar(&cfg.StoreBackend, "store-backend", "", "store backend type (etcdv2/etcd, etcdv3, consul or kubernetes)")
-	cmd.PersistentFlags().StringVar(&cfg.StoreEndpoints, "store-endpoints", "", "a comma-delimited list of store endpoints (use https scheme for tls communication) (defaults: http://127.0.0.1:2379 for etcd, http://127.0.0.1:8500 for consul)")
+	cmd.PersistentFlags().StringVar(&cfg.StoreBackend, "store-backend", "", "store backend type (etcdv2/etcd, etcdv3, consul, zookeeper or kubernetes)")
+	cmd.PersistentFlags().StringVar(&cfg.StoreEndpoints, "store-endpoints", "", "a comma-delimited list of store endpoints (use https scheme for tls communication) or a dns SRV record, as srv:[scheme://]name (i.e. srv:_etcd-client._tcp.example.com), whose targets are the store endpoints (defaults: http://127.0.0.1:2379 for etcd, http://127.0.0.1:8500 for consul, 127.0.0.1:2181 for zookeeper)")
 	cmd.PersistentFlags().StringVar(&cfg.StorePrefix, "store-prefix", common.StorePrefix, "the store base prefix")
-	cmd.PersistentFlags().StringVar(&cfg.StoreCertFile, "store-cert-file", "", "certificate file for client identification to the store")
+	cmd.PersistentFlags().StringVar(&cfg.StoreCertFile, "store-cert-file", "", "certificate file for client identification to the store (reloaded when modified)")
 	cmd.PersistentFlags().StringVar(&cfg.StoreKeyFile, "store-key", "", "private key file for client identification to the store")
 	cmd.PersistentFlags().BoolVar(&cfg.StoreSkipTlsVerify, "store-skip-tls-verify", false, "skip store certificate verification (insecure!!!)")
-	cmd.PersistentFlags().StringVar(&cfg.StoreCAFile, "store-ca-file", "", "verify certificates of HTTPS-enabled store servers using this CA bundle")
+	cmd.PersistentFlags().StringVar(&cfg.StoreCAFile, "store-ca-file", "", "verify certificates of HTTPS-enabled store servers using this CA bundle (reloaded when modified)")
+	cmd.PersistentFlags().DurationVar(&cfg.StoreTimeout, "store-timeout", 0, "timeout of the store requests. 0 uses the default (5s for etcd and consul, no timeout for kubernetes)")
+	cmd.PersistentFlags().DurationVar(&cfg.StoreDialTimeout, "store-dial-timeout", 0, "timeout for establishing a connection to the store (etcdv3 only). 0 means no timeout")
+	cmd.PersistentFlags().StringVar(&cfg.StoreConsulNamespace, "store-consul-namespace", "", "consul namespace (consul enterprise) of the stolon keys (consul only)")
+	cmd.PersistentFlags().StringVar(&cfg.StoreConsulTokenFile, "store-consul-token-file", "", "file containing the consul acl token (consul only). It's reloaded on SIGHUP and every --store-consul-token-reload-interval so tokens with a ttl can be rotated without restarting")
+	cmd.PersistentFlags().DurationVar(&cfg.StoreConsulTokenReloadInterval, "store-consul-token-reload-interval", 0, "interval to reload the --store-consul-token-file. 0 means reload only on SIGHUP")
+	cmd.PersistentFlags().BoolVar(&cfg.StoreClusterDataCompression, "store-cluster-data-compression", false, "write the cluster data gzip compressed (etcd, consul and zookeeper only). The compressed cluster data can be read only by the components supporting it")
+	cmd.PersistentFlags().IntVar(&cfg.StoreClusterDataChunkSize, "store-cluster-data-chunk-size", 0, "max size (bytes) of the cluster data store value, bigger cluster data is split in multiple keys (etcd, consul and zookeeper only). The chunked cluster data can be read only by the components supporting it. 0 disables chunking")
 	cmd.PersistentFlags().StringVar(&cfg.MetricsListenAddress, "metrics-listen-address", "", "metrics listen address i.e \"0.0.0.0:8080\" (disabled by default)")
+	addVaultFlags(cmd, cfg)
 	cmd.PersistentFlags().StringVar(&cfg.KubeResourceKind, "kube-resource-kind", "", `the k8s resource kind to be used to store stolon clusterdata and do sentinel leader election (only "configmap" is currently supported)`)
+	cmd.PersistentFlags().BoolVar(&cfg.KubeUseLeases, "kube-use-leases", false, "use coordination.k8s.io leases for the sentinel leader election and the components liveness (kubernetes only). It must be set on all the components")
 
 	if !cfg.IsStolonCtl {
 		cmd.PersistentFlags().BoolVar(&cfg.LogColor, "log-color", false, "enable color in log output (default if attached to a terminal)")
 		cmd.PersistentFlags().StringVar(&cfg.LogLevel, "log-level", "info", "debug, info (default), warn or error")
+		cmd.PersistentFlags().StringVar(&cfg.LogFormat, "log-format", "text", "log output format: text (default) or json")
+		cmd.PersistentFlags().BoolVar(&cfg.LogSyslog, "log-syslog", false, "send the log entries also to syslog (in the --log-format format)")
+		cmd.PersistentFlags().StringVar(&cfg.LogSyslogAddress, "log-syslog-address", "", "remote syslog address as network://address (i.e. udp://syslog:514). Defaults to the local syslog daemon")
+		cmd.PersistentFlags().BoolVar(&cfg.LogSpans, "log-spans", false, "log the spans of the convergence and failover flows, with a trace id shared by all the components for the same cluster data generation (disabled by default)")
 	}
 
 	if cfg.IsStolonCtl {
@@ -89,6 +133,10 @@ func CheckCommonConfig(cfg *CommonConfig) error {
 		cfg.StoreBackend = "etcdv2"
 	case "etcdv2":
 	case "etcdv3":
+	case "zookeeper":
+		if cfg.StoreCertFile != "" || cfg.StoreKeyFile != "" || cfg.StoreCAFile != "" {
+			return fmt.Errorf("tls isn't supported with the zookeeper store")
+		}
 	case "kubernetes":
 		if cfg.KubeResourceKind == "" {
 			return fmt.Errorf("unspecified kubernetes resource kind")
@@ -100,7 +148,77 @@ func CheckCommonConfig(cfg *CommonConfig) error {
 		return fmt.Errorf("Unknown store backend: %q", cfg.StoreBackend)
 	}
 
-	return nil
+	if cfg.StoreTimeout < 0 {
+		return fmt.Errorf("store timeout must be positive")
+	}
+	if cfg.StoreDialTimeout < 0 {
+		return fmt.Errorf("store dial timeout must be positive")
+	}
+	if cfg.StoreBackend != "consul" && (cfg.StoreConsulNamespace != "" || cfg.StoreConsulTokenFile != "" || cfg.StoreConsulTokenReloadInterval != 0) {
+		return fmt.Errorf("store consul namespace and token file can be defined only with the consul store")
+	}
+	if cfg.StoreClusterDataChunkSize < 0 {
+		return fmt.Errorf("store cluster data chunk size must be positive")
+	}
+	if cfg.StoreBackend == "kubernetes" && (cfg.StoreClusterDataCompression || cfg.StoreClusterDataChunkSize != 0) {
+		return fmt.Errorf("store cluster data compression and chunking cannot be used with the kubernetes store")
+	}
+	if cfg.StoreConsulTokenReloadInterval < 0 {
+		return fmt.Errorf("store consul token reload interval must be positive")
+	}
+	if cfg.StoreConsulTokenReloadInterval > 0 && cfg.StoreConsulTokenFile == "" {
+		return fmt.Errorf("store consul token reload interval requires a store consul token file")
+	}
+	if cfg.StoreElectionTTL != 0 {
+		if cfg.StoreElectionTTL < time.Second {
+			return fmt.Errorf("store election ttl must be at least 1s")
+		}
+		// consul min ttl is 10s and libkv divides the election ttl by 2
+		if cfg.StoreBackend == "consul" && cfg.StoreElectionTTL < store.MinTTL {
+			return fmt.Errorf("store election ttl must be at least %s with the consul store", store.MinTTL)
+		}
+		// the zookeeper election lease is the zookeeper session
+		if cfg.StoreBackend == "zookeeper" {
+			return fmt.Errorf("store election ttl cannot be defined with the zookeeper store (the election lease is the %s zookeeper session timeout)", store.ZookeeperSessionTimeout)
+		}
+	}
+
+	return checkVaultConfig(cfg)
+}
+
+// NewTracer returns the tracer logging the spans or nil when the spans
+// logging is disabled
+func NewTracer(cfg *CommonConfig) *tracing.Tracer {
+	if !cfg.LogSpans {
+		return nil
+	}
+	return tracing.NewTracer()
+}
+
+// EnableSyslog sends the log entries also to syslog, using the provided tag,
+// when requested by the config. The loggers must be retrieved again after
+// enabling it.
+func EnableSyslog(cfg *CommonConfig, tag string) error {
+	if cfg.LogSyslogAddress != "" && !cfg.LogSyslog {
+		return fmt.Errorf("--log-syslog-address requires --log-syslog")
+	}
+	if !cfg.LogSyslog {
+		return nil
+	}
+	var network, raddr string
+	if cfg.LogSyslogAddress != "" {
+		parts := strings.SplitN(cfg.LogSyslogAddress, "://", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return fmt.Errorf("wrong syslog address %q, must be in the form network://address", cfg.LogSyslogAddress)
+		}
+		network, raddr = parts[0], parts[1]
+		switch network {
+		case "udp", "tcp", "unix", "unixgram":
+		default:
+			return fmt.Errorf("wrong syslog address network %q, must be udp, tcp, unix or unixgram", network)
+		}
+	}
+	return slog.EnableSyslog(network, raddr, tag)
 }
 
 func IsColorLoggerEnable(cmd *cobra.Command, cfg *CommonConfig) bool {
@@ -119,11 +237,28 @@ func NewKVStore(cfg *CommonConfig) (store.KVStore, error) {
 		KeyFile:       cfg.StoreKeyFile,
 		CAFile:        cfg.StoreCAFile,
 		SkipTLSVerify: cfg.StoreSkipTlsVerify,
+
+		RequestTimeout: cfg.StoreTimeout,
+		DialTimeout:    cfg.StoreDialTimeout,
+
+		ConsulNamespace:           cfg.StoreConsulNamespace,
+		ConsulTokenFile:           cfg.StoreConsulTokenFile,
+		ConsulTokenReloadInterval: cfg.StoreConsulTokenReloadInterval,
 	})
 }
 
 func NewStore(cfg *CommonConfig) (store.Store, error) {
-	var s store.Store
+	stores, err := NewStores(cfg, []string{cfg.ClusterName})
+	if err != nil || len(stores) == 0 {
+		return nil, err
+	}
+	return stores[0], nil
+}
+
+// NewStores returns the stores of the provided clusters. The stores share the
+// same store connection (or kubernetes client).
+func NewStores(cfg *CommonConfig, clusterNames []string) ([]store.Store, error) {
+	stores := []store.Store{}
 
 	switch cfg.StoreBackend {
 	case "consul":
@@ -131,19 +266,30 @@ func NewStore(cfg *CommonConfig) (store.Store, error) {
 	case "etcdv2":
 		fallthrough
 	case "etcdv3":
-		storePath := filepath.Join(cfg.StorePrefix, cfg.ClusterName)
-
+		fallthrough
+	case "zookeeper":
 		kvstore, err := NewKVStore(cfg)
 		if err != nil {
 			return nil, fmt.Errorf("cannot create kv store: %v", err)
 		}
-		s = store.NewKVBackedStore(kvstore, storePath)
+		for _, clusterName := range clusterNames {
+			storePath := filepath.Join(cfg.StorePrefix, clusterName)
+			s := store.NewKVBackedStore(kvstore, storePath)
+			s.SetClusterDataEncoding(store.ClusterDataEncoding{
+				Compress:  cfg.StoreClusterDataCompression,
+				ChunkSize: cfg.StoreClusterDataChunkSize,
+			})
+			stores = append(stores, s)
+		}
 	case "kubernetes":
 		kubeClientConfig := util.NewKubeClientConfig(cfg.KubeConfig, cfg.KubeContext, cfg.KubeNamespace)
 		kubecfg, err := kubeClientConfig.ClientConfig()
 		if err != nil {
 			return nil, err
 		}
+		if cfg.StoreTimeout > 0 {
+			kubecfg.Timeout = cfg.StoreTimeout
+		}
 		kubecli, err := kubernetes.NewForConfig(kubecfg)
 		if err != nil {
 			return nil, fmt.Errorf("cannot create kubernetes client: %v", err)
@@ -159,13 +305,16 @@ func NewStore(cfg *CommonConfig) (store.Store, error) {
 		if err != nil {
 			return nil, err
 		}
-		s, err = store.NewKubeStore(kubecli, podName, namespace, cfg.ClusterName)
-		if err != nil {
-			return nil, fmt.Errorf("cannot create store: %v", err)
+		for _, clusterName := range clusterNames {
+			s, err := store.NewKubeStore(kubecli, podName, namespace, clusterName, cfg.KubeUseLeases)
+			if err != nil {
+				return nil, fmt.Errorf("cannot create store: %v", err)
+			}
+			stores = append(stores, s)
 		}
 	}
 
-	return s, nil
+	return stores, nil
 }
 
 func NewElection(cfg *CommonConfig, uid string) (store.Election, error) {
@@ -177,19 +326,24 @@ func NewElection(cfg *CommonConfig, uid string) (store.Election, error) {
 	case "etcdv2":
 		fallthrough
 	case "etcdv3":
+		fallthrough
+	case "zookeeper":
 		storePath := filepath.Join(cfg.StorePrefix, cfg.ClusterName)
 
 		kvstore, err := NewKVStore(cfg)
 		if err != nil {
 			return nil, fmt.Errorf("cannot create kv store: %v", err)
 		}
-		election = store.NewKVBackedElection(kvstore, filepath.Join(storePath, common.SentinelLeaderKey), uid)
+		election = store.NewKVBackedElection(kvstore, filepath.Join(storePath, common.SentinelLeaderKey), uid, cfg.StoreElectionTTL)
 	case "kubernetes":
 		kubeClientConfig := util.NewKubeClientConfig(cfg.KubeConfig, cfg.KubeContext, cfg.KubeNamespace)
 		kubecfg, err := kubeClientConfig.ClientConfig()
 		if err != nil {
 			return nil, err
 		}
+		if cfg.StoreTimeout > 0 {
+			kubecfg.Timeout = cfg.StoreTimeout
+		}
 		kubecli, err := kubernetes.NewForConfig(kubecfg)
 		if err != nil {
 			return nil, fmt.Errorf("cannot create kubernetes client: %v", err)
@@ -205,7 +359,7 @@ func NewElection(cfg *CommonConfig, uid string) (store.Election, error) {
 		if err != nil {
 			return nil, err
 		}
-		election, err = store.NewKubeElection(kubecli, podName, namespace, cfg.ClusterName, uid)
+		election, err = store.NewKubeElection(kubecli, podName, namespace, cfg.ClusterName, uid, cfg.StoreElectionTTL, cfg.KubeUseLeases)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,149 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+
+	"go.uber.org/zap"
+)
+
+// backupCommand returns the command, with its arguments, taking a base backup
+// of the data dir with the backup method
+func backupCommand(method cluster.BackupMethod, spec *cluster.ClusterSpec, dataDir string) ([]string, error) {
+	switch method {
+	case cluster.BackupMethodPgBackRest:
+		if spec.PgBackRestConfig == nil || spec.PgBackRestConfig.Stanza == "" {
+			return nil, fmt.Errorf("pgBackRestConfig.stanza not defined")
+		}
+		args := []string{"pgbackrest", "--stanza=" + spec.PgBackRestConfig.Stanza}
+		if spec.PgBackRestConfig.ConfigPath != "" {
+			args = append(args, "--config="+spec.PgBackRestConfig.ConfigPath)
+		}
+		return append(args, "--pg1-path="+dataDir, "backup"), nil
+	case cluster.BackupMethodWalG:
+		command, _ := walgCommand(spec.WalGConfig)
+		return append(command, "backup-push", dataDir), nil
+	case cluster.BackupMethodCommand:
+		if spec.BackupConfig == nil || spec.BackupConfig.Command == "" {
+			return nil, fmt.Errorf("backupConfig.command not defined")
+		}
+		return []string{"/bin/sh", "-c", spec.BackupConfig.Command}, nil
+	}
+	return nil, fmt.Errorf("unknown backup method %q", method)
+}
+
+// backupCommandEnv returns the backup command environment. The PG* variables
+// are the local connection parameters (without the password) used by the
+// backup tools.
+func backupCommandEnv(db *cluster.DB, dataDir, pgPort, pgSUUsername string) []string {
+	return append(validationCommandEnv(db),
+		"STOLON_DATA_DIR="+dataDir,
+		"STOLON_DB_ROLE="+string(db.Spec.Role),
+		"PGHOST="+common.PgUnixSocketDirectories,
+		"PGPORT="+pgPort,
+		"PGUSER="+pgSUUsername,
+	)
+}
+
+func (p *PostgresKeeper) getBackup() *cluster.Backup {
+	p.backupMutex.Lock()
+	defer p.backupMutex.Unlock()
+	if p.backup == nil {
+		return nil
+	}
+	b := *p.backup
+	return &b
+}
+
+// handleBackup starts the scheduled backup requested by the sentinel to our
+// db. The backup is restarted if requested again after a keeper restart. A
+// running backup no more requested (i.e. failed by the sentinel after the
+// keeper was unhealthy) is canceled.
+func (p *PostgresKeeper) handleBackup(ctx context.Context, cd *cluster.ClusterData, db *cluster.DB) {
+	req := cd.Cluster.Status.Backup
+
+	p.backupMutex.Lock()
+	defer p.backupMutex.Unlock()
+
+	if p.backup != nil && p.backup.Phase == cluster.BackupPhaseRunning && (req == nil || req.UID != p.backup.UID) {
+		log.Infow("canceling the scheduled backup since it's no more requested", "backup", p.backup.UID)
+		p.backupCancel()
+	}
+	if req == nil || req.Finished() || req.DBUID != db.UID || req.KeeperUID != db.Spec.KeeperUID {
+		return
+	}
+	if p.backup != nil && p.backup.UID == req.UID {
+		return
+	}
+
+	spec := cd.Cluster.DefSpec()
+	b := &cluster.Backup{
+		UID:       req.UID,
+		Method:    req.Method,
+		KeeperUID: req.KeeperUID,
+		DBUID:     req.DBUID,
+		Phase:     cluster.BackupPhaseRunning,
+		StartTime: time.Now(),
+	}
+	p.backup = b
+	args, err := backupCommand(req.Method, spec, p.dataDir)
+	if err != nil {
+		log.Errorw("cannot start the scheduled backup", "backup", b.UID, zap.Error(err))
+		b.Phase = cluster.BackupPhaseFailed
+		b.EndTime = time.Now()
+		b.Error = err.Error()
+		return
+	}
+	timeout := cluster.DefaultBackupTimeout
+	if spec.BackupConfig != nil {
+		timeout = spec.BackupConfig.Timeout.Duration
+	}
+	bctx, cancel := context.WithTimeout(ctx, timeout)
+	p.backupCancel = cancel
+	env := backupCommandEnv(db, p.dataDir, p.pgPort, p.pgSUUsername)
+	go p.runBackup(bctx, cancel, b.UID, args, env, timeout)
+}
+
+// runBackup executes the backup command reporting its result
+func (p *PostgresKeeper) runBackup(ctx context.Context, cancel context.CancelFunc, uid string, args, env []string, timeout time.Duration) {
+	defer cancel()
+	log.Infow("starting scheduled backup", "backup", uid, "cmd", args)
+	err := runCommand(ctx, args, env, os.Stderr)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timeout after %s", timeout)
+	}
+
+	p.backupMutex.Lock()
+	defer p.backupMutex.Unlock()
+	if p.backup == nil || p.backup.UID != uid {
+		return
+	}
+	p.backup.EndTime = time.Now()
+	if err != nil {
+		log.Errorw("scheduled backup failed", "backup", uid, zap.Error(err))
+		p.backup.Phase = cluster.BackupPhaseFailed
+		p.backup.Error = err.Error()
+		return
+	}
+	log.Infow("scheduled backup completed", "backup", uid)
+	p.backup.Phase = cluster.BackupPhaseCompleted
+}
@@ -0,0 +1,166 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+)
+
+func TestBackupCommand(t *testing.T) {
+	tests := []struct {
+		method cluster.BackupMethod
+		spec   *cluster.ClusterSpec
+		out    []string
+		err    bool
+	}{
+		{
+			method: cluster.BackupMethodPgBackRest,
+			spec:   &cluster.ClusterSpec{PgBackRestConfig: &cluster.PgBackRestConfig{Stanza: "main"}},
+			out:    []string{"pgbackrest", "--stanza=main", "--pg1-path=/data", "backup"},
+		},
+		{
+			method: cluster.BackupMethodPgBackRest,
+			spec:   &cluster.ClusterSpec{PgBackRestConfig: &cluster.PgBackRestConfig{Stanza: "main", ConfigPath: "/etc/pgbackrest.conf"}},
+			out:    []string{"pgbackrest", "--stanza=main", "--config=/etc/pgbackrest.conf", "--pg1-path=/data", "backup"},
+		},
+		{
+			method: cluster.BackupMethodPgBackRest,
+			spec:   &cluster.ClusterSpec{},
+			err:    true,
+		},
+		{
+			method: cluster.BackupMethodWalG,
+			spec:   &cluster.ClusterSpec{},
+			out:    []string{"wal-g", "backup-push", "/data"},
+		},
+		{
+			method: cluster.BackupMethodWalG,
+			spec:   &cluster.ClusterSpec{WalGConfig: &cluster.WalGConfig{Command: "envdir /etc/wal-e.d/env wal-e"}},
+			out:    []string{"envdir", "/etc/wal-e.d/env", "wal-e", "backup-push", "/data"},
+		},
+		{
+			method: cluster.BackupMethodCommand,
+			spec:   &cluster.ClusterSpec{BackupConfig: &cluster.BackupConfig{Command: "backup.sh"}},
+			out:    []string{"/bin/sh", "-c", "backup.sh"},
+		},
+		{
+			method: cluster.BackupMethodCommand,
+			spec:   &cluster.ClusterSpec{},
+			err:    true,
+		},
+	}
+
+	for i, tt := range tests {
+		out, err := backupCommand(tt.method, tt.spec, "/data")
+		if tt.err {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: wrong command: got: %v, want: %v", i, out, tt.out)
+		}
+	}
+}
+
+func testBackupKeeperClusterData(command string, backup *cluster.Backup) (*cluster.ClusterData, *cluster.DB) {
+	db := &cluster.DB{
+		UID:  "db1",
+		Spec: &cluster.DBSpec{KeeperUID: "keeper1", Role: common.RoleStandby},
+	}
+	cd := &cluster.ClusterData{
+		Cluster: &cluster.Cluster{
+			Spec: &cluster.ClusterSpec{
+				BackupConfig: &cluster.BackupConfig{
+					Method:   cluster.BackupMethodCommand,
+					Command:  command,
+					Interval: &cluster.Duration{Duration: time.Hour},
+				},
+			},
+			Status: cluster.ClusterStatus{Backup: backup},
+		},
+		DBs: cluster.DBs{"db1": db},
+	}
+	return cd, db
+}
+
+// waitBackupFinished waits for the keeper backup to complete or fail
+func waitBackupFinished(t *testing.T, p *PostgresKeeper) *cluster.Backup {
+	for i := 0; i < 100; i++ {
+		if b := p.getBackup(); b != nil && b.Finished() {
+			return b
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("backup not finished")
+	return nil
+}
+
+func TestHandleBackup(t *testing.T) {
+	tests := []struct {
+		command string
+		phase   cluster.BackupPhase
+	}{
+		{command: `test "$STOLON_DATA_DIR" = /data -a "$STOLON_DB_ROLE" = standby`, phase: cluster.BackupPhaseCompleted},
+		{command: "exit 1", phase: cluster.BackupPhaseFailed},
+	}
+
+	for i, tt := range tests {
+		p := &PostgresKeeper{dataDir: "/data"}
+		cd, db := testBackupKeeperClusterData(tt.command, &cluster.Backup{UID: "backup1", Method: cluster.BackupMethodCommand, KeeperUID: "keeper1", DBUID: "db1", Phase: cluster.BackupPhaseRequested})
+		p.handleBackup(context.Background(), cd, db)
+		b := waitBackupFinished(t, p)
+		if b.UID != "backup1" || b.Phase != tt.phase {
+			t.Errorf("#%d: got backup %q phase: %q, want backup %q phase: %q", i, b.UID, b.Phase, "backup1", tt.phase)
+		}
+
+		// the same backup isn't executed again
+		p.handleBackup(context.Background(), cd, db)
+		if b := p.getBackup(); b.Phase != tt.phase {
+			t.Errorf("#%d: backup executed again", i)
+		}
+	}
+
+	// a backup requested to another keeper isn't executed
+	p := &PostgresKeeper{dataDir: "/data"}
+	cd, db := testBackupKeeperClusterData("true", &cluster.Backup{UID: "backup1", KeeperUID: "keeper2", DBUID: "db2", Phase: cluster.BackupPhaseRequested})
+	p.handleBackup(context.Background(), cd, db)
+	if b := p.getBackup(); b != nil {
+		t.Errorf("got backup: %+v, wanted no backup", b)
+	}
+
+	// a running backup no more requested is canceled
+	cd, db = testBackupKeeperClusterData("sleep 60", &cluster.Backup{UID: "backup1", Method: cluster.BackupMethodCommand, KeeperUID: "keeper1", DBUID: "db1", Phase: cluster.BackupPhaseRequested})
+	p.handleBackup(context.Background(), cd, db)
+	if b := p.getBackup(); b == nil || b.Phase != cluster.BackupPhaseRunning {
+		t.Fatalf("got backup: %+v, wanted running backup", b)
+	}
+	cd.Cluster.Status.Backup = nil
+	p.handleBackup(context.Background(), cd, db)
+	if b := waitBackupFinished(t, p); b.Phase != cluster.BackupPhaseFailed {
+		t.Errorf("got backup phase: %q, want: %q", b.Phase, cluster.BackupPhaseFailed)
+	}
+}
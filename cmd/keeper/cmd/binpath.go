@@ -0,0 +1,148 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+	"github.com/sorintlab/stolon/internal/postgresql"
+)
+
+// keeperPGBinPath returns the path of the postgres binaries to use: the one
+// set in the keeper spec or, when not defined, the --pg-bin-path one.
+func keeperPGBinPath(k *cluster.Keeper, defaultPGBinPath string) string {
+	if k.Spec != nil && k.Spec.PGBinPath != "" {
+		return k.Spec.PGBinPath
+	}
+	return defaultPGBinPath
+}
+
+// checkPGBinPathVersion checks that the postgres binaries can use the data
+// dir: a data dir can only be used by binaries of its same major version, a
+// major upgrade requires pg_upgrade or a dump and restore.
+func checkPGBinPathVersion(pgBinPath string, binVersion, dataVersion cluster.PostgresBinaryVersion) error {
+	if !binVersion.SameMajor(dataVersion) {
+		return fmt.Errorf("postgres binaries in %q have version %s with a major version different than the data dir one (%s)", pgBinPath, binVersion, dataVersion)
+	}
+	return nil
+}
+
+// pgUpgradeRequested reports if the sentinel requested to upgrade the db data
+// dir to the newer major version of the postgres binaries
+func pgUpgradeRequested(db *cluster.DB, binVersion, dataVersion cluster.PostgresBinaryVersion) bool {
+	if db == nil || !db.Spec.PGUpgrade || db.Spec.Role != common.RoleMaster {
+		return false
+	}
+	if binVersion.Maj != dataVersion.Maj {
+		return binVersion.Maj > dataVersion.Maj
+	}
+	return binVersion.Min > dataVersion.Min
+}
+
+// resyncRequested reports if the db assigned to the keeper is a new db to be
+// resynced, replacing the current data dir
+func resyncRequested(db *cluster.DB, localDBUID string) bool {
+	return db != nil && db.UID != localDBUID && db.Spec.InitMode == cluster.DBInitModeResync
+}
+
+// switchPGBinPath switches the postgres binaries to the ones defined for the
+// keeper, stopping the instance that will then be started with the new
+// binaries. When the new binaries cannot be used the current ones are kept.
+// Binaries with a major version different than the data dir one are used
+// only to upgrade the master data dir, when requested by the sentinel, or when
+// the data dir will be replaced by a resync.
+func (p *PostgresKeeper) switchPGBinPath(ctx context.Context, k *cluster.Keeper, db *cluster.DB) error {
+	if err := p.pgm.CleanupUpgrade(); err != nil {
+		return fmt.Errorf("failed to clean up the postgres upgrade: %v", err)
+	}
+
+	pgBinPath := keeperPGBinPath(k, p.pgBinPath)
+	curPGBinPath := p.pgm.BinPath()
+	if pgBinPath == curPGBinPath {
+		return nil
+	}
+
+	maj, min, err := postgresql.BinPathVersion(pgBinPath)
+	if err != nil {
+		return fmt.Errorf("failed to get the version of the postgres binaries in %q: %v", pgBinPath, err)
+	}
+	initialized, err := p.pgm.IsInitialized()
+	if err != nil {
+		return fmt.Errorf("failed to detect if instance is initialized: %v", err)
+	}
+	if initialized {
+		dataMaj, dataMin, err := p.pgm.PGDataVersion()
+		if err != nil {
+			return err
+		}
+		binVersion := cluster.PostgresBinaryVersion{Maj: maj, Min: min}
+		dataVersion := cluster.PostgresBinaryVersion{Maj: dataMaj, Min: dataMin}
+		if err := checkPGBinPathVersion(pgBinPath, binVersion, dataVersion); err != nil {
+			switch {
+			case pgUpgradeRequested(db, binVersion, dataVersion):
+				return p.pgUpgrade(ctx, pgBinPath)
+			case resyncRequested(db, p.dbLocalStateCopy().UID):
+				log.Infow("removing the data dir of the previous postgres major version since the db will be resynced", "pgBinPath", pgBinPath)
+				if err := p.pgm.StopIfStarted(true); err != nil {
+					return fmt.Errorf("failed to stop pg instance: %v", err)
+				}
+				if err := p.pgm.RemoveAll(); err != nil {
+					return fmt.Errorf("failed to remove the postgres data dir: %v", err)
+				}
+			default:
+				return err
+			}
+		}
+	}
+
+	log.Infow("switching the postgres binaries", "pgBinPath", pgBinPath, "previousPGBinPath", curPGBinPath)
+	if err := p.pgm.StopIfStarted(true); err != nil {
+		return fmt.Errorf("failed to stop pg instance: %v", err)
+	}
+	p.pgm.SetBinPath(pgBinPath)
+	return nil
+}
+
+// pgUpgrade upgrades the master data dir to the major version of the postgres
+// binaries in pgBinPath, with pg_upgrade in link mode, and switches to them.
+// The instance must be running since the configuration of the new data dir is
+// read from it.
+func (p *PostgresKeeper) pgUpgrade(ctx context.Context, pgBinPath string) error {
+	started, err := p.pgm.IsStarted()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve instance state: %v", err)
+	}
+	if !started {
+		return fmt.Errorf("the instance must be running to upgrade its data dir")
+	}
+	cfg, err := p.pgm.GetUpgradeConfig()
+	if err != nil {
+		return fmt.Errorf("failed to get the instance configuration: %v", err)
+	}
+
+	log.Infow("upgrading the data dir to the postgres binaries major version", "pgBinPath", pgBinPath, "previousPGBinPath", p.pgm.BinPath())
+	if err := p.pgm.StopIfStarted(true); err != nil {
+		return fmt.Errorf("failed to stop pg instance: %v", err)
+	}
+	if err := p.pgm.Upgrade(ctx, pgBinPath, cfg); err != nil {
+		return fmt.Errorf("failed to upgrade the data dir: %v", err)
+	}
+	log.Infow("data dir upgraded", "pgBinPath", pgBinPath)
+	p.pgm.SetBinPath(pgBinPath)
+	return nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+)
+
+func TestKeeperPGBinPath(t *testing.T) {
+	tests := []struct {
+		spec *cluster.KeeperSpec
+		out  string
+	}{
+		{
+			out: "/usr/lib/postgresql/12/bin",
+		},
+		{
+			spec: &cluster.KeeperSpec{},
+			out:  "/usr/lib/postgresql/12/bin",
+		},
+		{
+			spec: &cluster.KeeperSpec{PGBinPath: "/opt/postgresql-12.6/bin"},
+			out:  "/opt/postgresql-12.6/bin",
+		},
+	}
+
+	for i, tt := range tests {
+		k := &cluster.Keeper{UID: "keeper01", Spec: tt.spec}
+		if out := keeperPGBinPath(k, "/usr/lib/postgresql/12/bin"); out != tt.out {
+			t.Errorf("#%d: got: %q, want: %q", i, out, tt.out)
+		}
+	}
+}
+
+func TestCheckPGBinPathVersion(t *testing.T) {
+	tests := []struct {
+		binVersion  cluster.PostgresBinaryVersion
+		dataVersion cluster.PostgresBinaryVersion
+		err         error
+	}{
+		{
+			binVersion:  cluster.PostgresBinaryVersion{Maj: 12, Min: 6},
+			dataVersion: cluster.PostgresBinaryVersion{Maj: 12},
+		},
+		{
+			binVersion:  cluster.PostgresBinaryVersion{Maj: 9, Min: 6},
+			dataVersion: cluster.PostgresBinaryVersion{Maj: 9, Min: 6},
+		},
+		{
+			binVersion:  cluster.PostgresBinaryVersion{Maj: 13, Min: 2},
+			dataVersion: cluster.PostgresBinaryVersion{Maj: 12},
+			err:         fmt.Errorf(`postgres binaries in "/opt/pg/bin" have version 13.2 with a major version different than the data dir one (12.0)`),
+		},
+	}
+
+	for i, tt := range tests {
+		err := checkPGBinPathVersion("/opt/pg/bin", tt.binVersion, tt.dataVersion)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestPGUpgradeRequested(t *testing.T) {
+	pg12 := cluster.PostgresBinaryVersion{Maj: 12, Min: 4}
+	pg13 := cluster.PostgresBinaryVersion{Maj: 13, Min: 2}
+	tests := []struct {
+		name        string
+		db          *cluster.DB
+		binVersion  cluster.PostgresBinaryVersion
+		dataVersion cluster.PostgresBinaryVersion
+		out         bool
+	}{
+		{
+			name:        "no db",
+			binVersion:  pg13,
+			dataVersion: pg12,
+		},
+		{
+			name:        "upgrade not requested",
+			db:          &cluster.DB{Spec: &cluster.DBSpec{Role: common.RoleMaster}},
+			binVersion:  pg13,
+			dataVersion: pg12,
+		},
+		{
+			name:        "standby",
+			db:          &cluster.DB{Spec: &cluster.DBSpec{Role: common.RoleStandby, PGUpgrade: true}},
+			binVersion:  pg13,
+			dataVersion: pg12,
+		},
+		{
+			name:        "downgrade",
+			db:          &cluster.DB{Spec: &cluster.DBSpec{Role: common.RoleMaster, PGUpgrade: true}},
+			binVersion:  pg12,
+			dataVersion: pg13,
+		},
+		{
+			name:        "upgrade",
+			db:          &cluster.DB{Spec: &cluster.DBSpec{Role: common.RoleMaster, PGUpgrade: true}},
+			binVersion:  pg13,
+			dataVersion: pg12,
+			out:         true,
+		},
+		// postgres 9.x major versions have a minor part
+		{
+			name:        "upgrade from 9.6",
+			db:          &cluster.DB{Spec: &cluster.DBSpec{Role: common.RoleMaster, PGUpgrade: true}},
+			binVersion:  cluster.PostgresBinaryVersion{Maj: 9, Min: 6},
+			dataVersion: cluster.PostgresBinaryVersion{Maj: 9, Min: 5},
+			out:         true,
+		},
+	}
+
+	for i, tt := range tests {
+		if out := pgUpgradeRequested(tt.db, tt.binVersion, tt.dataVersion); out != tt.out {
+			t.Errorf("#%d (%s): got: %t, want: %t", i, tt.name, out, tt.out)
+		}
+	}
+}
+
+func TestResyncRequested(t *testing.T) {
+	tests := []struct {
+		db  *cluster.DB
+		out bool
+	}{
+		{},
+		{
+			db: &cluster.DB{UID: "db01", Spec: &cluster.DBSpec{InitMode: cluster.DBInitModeResync}},
+		},
+		{
+			db: &cluster.DB{UID: "db02", Spec: &cluster.DBSpec{InitMode: cluster.DBInitModeNone}},
+		},
+		{
+			db:  &cluster.DB{UID: "db02", Spec: &cluster.DBSpec{InitMode: cluster.DBInitModeResync}},
+			out: true,
+		},
+	}
+
+	for i, tt := range tests {
+		if out := resyncRequested(tt.db, "db01"); out != tt.out {
+			t.Errorf("#%d: got: %t, want: %t", i, out, tt.out)
+		}
+	}
+}
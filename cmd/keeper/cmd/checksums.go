@@ -0,0 +1,143 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+	"github.com/sorintlab/stolon/internal/util"
+
+	"go.uber.org/zap"
+)
+
+// checksumsVerificationCommand returns the command verifying the data
+// checksums of the (stopped) data dir: pg_checksums for postgres >= 12,
+// pg_verify_checksums for postgres 11
+func checksumsVerificationCommand(pgBinPath string, maj int, dataDir string) ([]string, error) {
+	switch {
+	case maj >= 12:
+		return []string{filepath.Join(pgBinPath, "pg_checksums"), "--check", "-D", dataDir}, nil
+	case maj == 11:
+		return []string{filepath.Join(pgBinPath, "pg_verify_checksums"), "-D", dataDir}, nil
+	}
+	return nil, fmt.Errorf("data checksums verification requires postgres 11 or later")
+}
+
+func (p *PostgresKeeper) getChecksumsVerification() *cluster.ChecksumsVerification {
+	p.checksumsMutex.Lock()
+	defer p.checksumsMutex.Unlock()
+	if p.checksumsVerification == nil {
+		return nil
+	}
+	v := *p.checksumsVerification
+	return &v
+}
+
+func (p *PostgresKeeper) setChecksumsVerification(v *cluster.ChecksumsVerification) {
+	p.checksumsMutex.Lock()
+	defer p.checksumsMutex.Unlock()
+	p.checksumsVerification = v
+}
+
+// checksumsVerificationDue reports if the data checksums of the db must be
+// verified at now: the verification is configured, the cluster has data
+// checksums enabled, the db is an asynchronous standby following the master,
+// no other db is being verified and the verification interval has elapsed
+// since the last verification (or, without one, since the keeper start).
+func (p *PostgresKeeper) checksumsVerificationDue(cd *cluster.ClusterData, db *cluster.DB, now time.Time) bool {
+	c := cd.Cluster.DefSpec().ChecksumsVerificationConfig
+	if c == nil || !cd.Cluster.Status.DataChecksums {
+		return false
+	}
+	if db.Spec.Role != common.RoleStandby || db.Spec.FollowConfig == nil || db.Spec.FollowConfig.Type != cluster.FollowTypeInternal {
+		return false
+	}
+	masterDB, ok := cd.DBs[cd.Cluster.Status.Master]
+	if !ok || util.StringInSlice(masterDB.Spec.SynchronousStandbys, db.UID) {
+		return false
+	}
+	for _, odb := range cd.DBs {
+		if odb.UID != db.UID && odb.Status.ChecksumsVerification != nil && odb.Status.ChecksumsVerification.Running {
+			return false
+		}
+	}
+
+	p.checksumsMutex.Lock()
+	defer p.checksumsMutex.Unlock()
+	if p.checksumsBaseTime.IsZero() {
+		p.checksumsBaseTime = now
+	}
+	last := p.checksumsBaseTime
+	if v := p.checksumsVerification; v != nil && v.DBUID == db.UID {
+		last = v.EndTime
+	} else if v := db.Status.ChecksumsVerification; v != nil && !v.EndTime.IsZero() {
+		last = v.EndTime
+	}
+	return now.Sub(last) >= c.Interval.Duration
+}
+
+// verifyChecksums stops the db and verifies its data checksums. The
+// verification is reported as running before stopping the db so the
+// sentinel won't consider it failed. The db will be started again by the next
+// state machine execution.
+func (p *PostgresKeeper) verifyChecksums(ctx context.Context, cd *cluster.ClusterData, db *cluster.DB) {
+	timeout := cd.Cluster.DefSpec().ChecksumsVerificationConfig.Timeout.Duration
+	startTime := time.Now()
+	p.setChecksumsVerification(&cluster.ChecksumsVerification{DBUID: db.UID, Running: true, StartTime: startTime})
+	if err := p.updateKeeperInfo(); err != nil {
+		log.Errorw("failed to update keeper info", zap.Error(err))
+	}
+
+	maj, _, err := p.pgm.BinaryVersion()
+	var args []string
+	if err == nil {
+		args, err = checksumsVerificationCommand(p.pgm.BinPath(), maj, filepath.Join(p.dataDir, "postgres"))
+	}
+	if err == nil {
+		log.Infow("stopping the db to verify its data checksums", "db", db.UID)
+		err = p.pgm.StopIfStarted(true)
+	}
+	output := &limitedBuffer{max: maxHookStderrSize}
+	if err == nil {
+		vctx, cancel := context.WithTimeout(ctx, timeout)
+		err = runCommand(vctx, args, nil, io.MultiWriter(os.Stderr, output))
+		if err != nil && vctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timeout after %s", timeout)
+		}
+		cancel()
+	}
+
+	v := &cluster.ChecksumsVerification{
+		DBUID:     db.UID,
+		StartTime: startTime,
+		EndTime:   time.Now(),
+		Success:   err == nil,
+		Output:    output.String(),
+	}
+	if err != nil {
+		log.Errorw("data checksums verification failed", "db", db.UID, zap.Error(err))
+		v.Error = err.Error()
+	} else {
+		log.Infow("data checksums verification completed", "db", db.UID)
+	}
+	p.setChecksumsVerification(v)
+}
@@ -0,0 +1,160 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+)
+
+func TestChecksumsVerificationCommand(t *testing.T) {
+	tests := []struct {
+		maj int
+		out []string
+		err error
+	}{
+		{maj: 13, out: []string{"/usr/lib/postgresql/bin/pg_checksums", "--check", "-D", "/data/postgres"}},
+		{maj: 11, out: []string{"/usr/lib/postgresql/bin/pg_verify_checksums", "-D", "/data/postgres"}},
+		{maj: 10, err: fmt.Errorf("data checksums verification requires postgres 11 or later")},
+	}
+
+	for i, tt := range tests {
+		out, err := checksumsVerificationCommand("/usr/lib/postgresql/bin", tt.maj, "/data/postgres")
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: wrong command: got: %v, want: %v", i, out, tt.out)
+		}
+	}
+}
+
+func testChecksumsClusterData() *cluster.ClusterData {
+	cd := &cluster.ClusterData{
+		Cluster: &cluster.Cluster{
+			Spec: &cluster.ClusterSpec{
+				ChecksumsVerificationConfig: &cluster.ChecksumsVerificationConfig{Interval: &cluster.Duration{Duration: time.Hour}},
+			},
+			Status: cluster.ClusterStatus{Master: "db1", DataChecksums: true},
+		},
+		DBs: cluster.DBs{
+			"db1": &cluster.DB{UID: "db1", Spec: &cluster.DBSpec{KeeperUID: "keeper1", Role: common.RoleMaster}},
+			"db3": &cluster.DB{UID: "db3", Spec: &cluster.DBSpec{KeeperUID: "keeper3", Role: common.RoleStandby, FollowConfig: &cluster.FollowConfig{Type: cluster.FollowTypeInternal, DBUID: "db1"}}},
+		},
+	}
+	cd.DBs["db2"] = &cluster.DB{UID: "db2", Spec: &cluster.DBSpec{KeeperUID: "keeper2", Role: common.RoleStandby, FollowConfig: &cluster.FollowConfig{Type: cluster.FollowTypeInternal, DBUID: "db1"}}}
+	return cd
+}
+
+func TestChecksumsVerificationDue(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		dbUID    string
+		baseTime time.Time
+		local    *cluster.ChecksumsVerification
+		update   func(cd *cluster.ClusterData)
+		out      bool
+	}{
+		{
+			name:     "interval elapsed since the keeper start",
+			dbUID:    "db2",
+			baseTime: now.Add(-2 * time.Hour),
+			out:      true,
+		},
+		{
+			name:  "first check",
+			dbUID: "db2",
+			out:   false,
+		},
+		{
+			name:     "recent verification reported in the cluster data",
+			dbUID:    "db2",
+			baseTime: now.Add(-2 * time.Hour),
+			update: func(cd *cluster.ClusterData) {
+				cd.DBs["db2"].Status.ChecksumsVerification = &cluster.ChecksumsVerification{DBUID: "db2", EndTime: now.Add(-10 * time.Minute)}
+			},
+			out: false,
+		},
+		{
+			name:     "old local verification",
+			dbUID:    "db2",
+			baseTime: now,
+			local:    &cluster.ChecksumsVerification{DBUID: "db2", EndTime: now.Add(-time.Hour)},
+			out:      true,
+		},
+		{
+			name:     "master",
+			dbUID:    "db1",
+			baseTime: now.Add(-2 * time.Hour),
+			out:      false,
+		},
+		{
+			name:     "synchronous standby",
+			dbUID:    "db2",
+			baseTime: now.Add(-2 * time.Hour),
+			update:   func(cd *cluster.ClusterData) { cd.DBs["db1"].Spec.SynchronousStandbys = []string{"db2"} },
+			out:      false,
+		},
+		{
+			name:     "another db being verified",
+			dbUID:    "db2",
+			baseTime: now.Add(-2 * time.Hour),
+			update: func(cd *cluster.ClusterData) {
+				cd.DBs["db3"].Status.ChecksumsVerification = &cluster.ChecksumsVerification{DBUID: "db3", Running: true}
+			},
+			out: false,
+		},
+		{
+			name:     "data checksums disabled",
+			dbUID:    "db2",
+			baseTime: now.Add(-2 * time.Hour),
+			update:   func(cd *cluster.ClusterData) { cd.Cluster.Status.DataChecksums = false },
+			out:      false,
+		},
+		{
+			name:     "verification not configured",
+			dbUID:    "db2",
+			baseTime: now.Add(-2 * time.Hour),
+			update:   func(cd *cluster.ClusterData) { cd.Cluster.Spec.ChecksumsVerificationConfig = nil },
+			out:      false,
+		},
+	}
+
+	for i, tt := range tests {
+		cd := testChecksumsClusterData()
+		if tt.update != nil {
+			tt.update(cd)
+		}
+		p := &PostgresKeeper{checksumsBaseTime: tt.baseTime, checksumsVerification: tt.local}
+		if out := p.checksumsVerificationDue(cd, cd.DBs[tt.dbUID], now); out != tt.out {
+			t.Errorf("#%d (%s): got: %t, want: %t", i, tt.name, out, tt.out)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/common"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// consulAgent is the subset of the consul agent api used to register the
+// keeper db service
+type consulAgent interface {
+	ServiceRegister(service *consulapi.AgentServiceRegistration) error
+	ServiceDeregister(serviceID string) error
+	UpdateTTL(checkID, output, status string) error
+}
+
+// consulRegistrar registers the keeper db in the local consul agent as a
+// service tagged with its role (master or standby), so the current master and
+// the standbys can be resolved using the consul dns (i.e.
+// master.postgres.service.consul). The service has a ttl check, passing while
+// the db is ready for its role, so a db is removed from the dns answers also
+// when its keeper dies.
+type consulRegistrar struct {
+	agent       consulAgent
+	serviceName string
+	serviceID   string
+	address     string
+	port        int
+	checkTTL    time.Duration
+
+	mutex sync.Mutex
+	// role of the registered service, RoleUndefined when not registered
+	role common.Role
+}
+
+func newConsulRegistrar(agentURL, serviceName, keeperUID, address, port string, checkTTL time.Duration) (*consulRegistrar, error) {
+	u, err := url.Parse(agentURL)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse consul agent url %q: %v", agentURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("consul agent url %q must have an http or https scheme", agentURL)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("wrong pg port %q: %v", port, err)
+	}
+	config := consulapi.DefaultConfig()
+	config.Address = u.Host
+	config.Scheme = u.Scheme
+	client, err := consulapi.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create consul client: %v", err)
+	}
+	return &consulRegistrar{
+		agent:       client.Agent(),
+		serviceName: serviceName,
+		serviceID:   consulServiceID(serviceName, keeperUID),
+		address:     address,
+		port:        p,
+		checkTTL:    checkTTL,
+		role:        common.RoleUndefined,
+	}, nil
+}
+
+// consulServiceID returns the id of the keeper db service, unique in the
+// consul agent also when it's shared by multiple keepers
+func consulServiceID(serviceName, keeperUID string) string {
+	return fmt.Sprintf("%s-%s", serviceName, keeperUID)
+}
+
+// checkID returns the id of the service ttl check, assigned by consul to the
+// check defined in the service registration
+func (r *consulRegistrar) checkID() string {
+	return "service:" + r.serviceID
+}
+
+// setRole registers the service, tagged with the role, when the role differs
+// from the registered one. The service is deregistered when the db has no
+// role.
+func (r *consulRegistrar) setRole(role common.Role) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if role != common.RoleMaster && role != common.RoleStandby {
+		role = common.RoleUndefined
+	}
+	if r.role == role {
+		return nil
+	}
+	if role == common.RoleUndefined {
+		if err := r.agent.ServiceDeregister(r.serviceID); err != nil {
+			return fmt.Errorf("failed to deregister consul service: %v", err)
+		}
+		r.role = role
+		return nil
+	}
+	service := &consulapi.AgentServiceRegistration{
+		ID:      r.serviceID,
+		Name:    r.serviceName,
+		Tags:    []string{string(role)},
+		Address: r.address,
+		Port:    r.port,
+		Check: &consulapi.AgentServiceCheck{
+			TTL:    r.checkTTL.String(),
+			Status: consulapi.HealthCritical,
+		},
+	}
+	if err := r.agent.ServiceRegister(service); err != nil {
+		return fmt.Errorf("failed to register consul service: %v", err)
+	}
+	r.role = role
+	return nil
+}
+
+// updateHealth updates the service check, passing when the db is ready for
+// its registered role
+func (r *consulRegistrar) updateHealth(h *keeperHealth) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.role == common.RoleUndefined {
+		return nil
+	}
+	status := consulapi.HealthCritical
+	if h.Ready && h.Role == r.role {
+		status = consulapi.HealthPassing
+	}
+	output := fmt.Sprintf("role: %s, pgUp: %t", h.Role, h.PGUp)
+	if err := r.agent.UpdateTTL(r.checkID(), output, status); err != nil {
+		return fmt.Errorf("failed to update consul service check: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/common"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+type fakeConsulAgent struct {
+	services map[string]*consulapi.AgentServiceRegistration
+	checks   map[string]string
+	calls    int
+}
+
+func (a *fakeConsulAgent) ServiceRegister(service *consulapi.AgentServiceRegistration) error {
+	a.calls++
+	a.services[service.ID] = service
+	a.checks["service:"+service.ID] = service.Check.Status
+	return nil
+}
+
+func (a *fakeConsulAgent) ServiceDeregister(serviceID string) error {
+	a.calls++
+	delete(a.services, serviceID)
+	delete(a.checks, "service:"+serviceID)
+	return nil
+}
+
+func (a *fakeConsulAgent) UpdateTTL(checkID, output, status string) error {
+	a.calls++
+	a.checks[checkID] = status
+	return nil
+}
+
+func TestConsulRegistrar(t *testing.T) {
+	agent := &fakeConsulAgent{services: map[string]*consulapi.AgentServiceRegistration{}, checks: map[string]string{}}
+	r := &consulRegistrar{
+		agent:       agent,
+		serviceName: "postgres",
+		serviceID:   consulServiceID("postgres", "keeper01"),
+		address:     "10.0.0.1",
+		port:        5432,
+		checkTTL:    30 * time.Second,
+		role:        common.RoleUndefined,
+	}
+	const checkID = "service:postgres-keeper01"
+
+	// no registration without a role
+	if err := r.updateHealth(&keeperHealth{Role: common.RoleUndefined}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := r.setRole(common.RoleUndefined); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if agent.calls != 0 {
+		t.Fatalf("got %d agent calls, want: 0", agent.calls)
+	}
+
+	if err := r.setRole(common.RoleMaster); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	service, ok := agent.services["postgres-keeper01"]
+	if !ok {
+		t.Fatalf("service not registered")
+	}
+	if service.Name != "postgres" || service.Address != "10.0.0.1" || service.Port != 5432 || service.Check.TTL != "30s" {
+		t.Errorf("wrong service registration: %+v", service)
+	}
+	if !reflect.DeepEqual(service.Tags, []string{"master"}) {
+		t.Errorf("got tags: %v, want: %v", service.Tags, []string{"master"})
+	}
+	if agent.checks[checkID] != consulapi.HealthCritical {
+		t.Errorf("got check status: %q, want: %q", agent.checks[checkID], consulapi.HealthCritical)
+	}
+
+	// the same role doesn't register the service again
+	calls := agent.calls
+	if err := r.setRole(common.RoleMaster); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if agent.calls != calls {
+		t.Errorf("service registered again with the same role")
+	}
+
+	tests := []struct {
+		h      *keeperHealth
+		status string
+	}{
+		{h: &keeperHealth{Role: common.RoleMaster, PGUp: true, Ready: true}, status: consulapi.HealthPassing},
+		{h: &keeperHealth{Role: common.RoleMaster}, status: consulapi.HealthCritical},
+		// the db role differs from the registered one
+		{h: &keeperHealth{Role: common.RoleStandby, PGUp: true, Ready: true}, status: consulapi.HealthCritical},
+	}
+	for i, tt := range tests {
+		if err := r.updateHealth(tt.h); err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if agent.checks[checkID] != tt.status {
+			t.Errorf("#%d: got check status: %q, want: %q", i, agent.checks[checkID], tt.status)
+		}
+	}
+
+	if err := r.setRole(common.RoleStandby); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tags := agent.services["postgres-keeper01"].Tags; !reflect.DeepEqual(tags, []string{"standby"}) {
+		t.Errorf("got tags: %v, want: %v", tags, []string{"standby"})
+	}
+
+	if err := r.setRole(common.RoleUndefined); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(agent.services) != 0 {
+		t.Errorf("service not deregistered")
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+	pg "github.com/sorintlab/stolon/internal/postgresql"
+
+	"go.uber.org/zap"
+)
+
+func (p *PostgresKeeper) getGracefulDemotion() *cluster.GracefulDemotionStatus {
+	p.gracefulDemotionMutex.Lock()
+	defer p.gracefulDemotionMutex.Unlock()
+	if p.gracefulDemotion == nil {
+		return nil
+	}
+	s := *p.gracefulDemotion
+	return &s
+}
+
+func (p *PostgresKeeper) setGracefulDemotion(s *cluster.GracefulDemotionStatus) {
+	p.gracefulDemotionMutex.Lock()
+	p.gracefulDemotion = s
+	p.gracefulDemotionMutex.Unlock()
+}
+
+// handleGracefulDemotion advances, at every state machine execution, the
+// master db drain requested by the sentinel during a switchover. The status
+// is reset when the request is removed (the switchover completed or has
+// been aborted).
+func (p *PostgresKeeper) handleGracefulDemotion(db *cluster.DB) {
+	req := db.Spec.GracefulDemotion
+	if req == nil || !IsMaster(db) {
+		p.setGracefulDemotion(nil)
+		return
+	}
+	status := p.getGracefulDemotion()
+	if status == nil || status.DBUID != db.UID || status.TargetDBUID != req.TargetDBUID {
+		log.Infow("draining the master before the switchover", "targetDB", req.TargetDBUID, "rejectConnections", req.RejectConnections, "drainTimeout", req.DrainTimeout.Duration)
+		status = &cluster.GracefulDemotionStatus{DBUID: db.UID, TargetDBUID: req.TargetDBUID, StartTime: time.Now()}
+	}
+	if status.Completed {
+		return
+	}
+
+	status.Error = ""
+	if err := drainMaster(p.pgm, req, status, time.Now()); err != nil {
+		log.Errorw("failed to drain the master", zap.Error(err))
+		status.Error = err.Error()
+	}
+	p.setGracefulDemotion(status)
+}
+
+// drainMaster waits for the active client transactions to complete, up to
+// the drain timeout, and then terminates the client connections, issues a
+// checkpoint and records the master wal position. The drain is completed
+// when the target db has flushed it. It doesn't block: it returns when
+// waiting and it's called again at the next state machine execution.
+func drainMaster(pgm *pg.Manager, req *cluster.GracefulDemotionRequest, status *cluster.GracefulDemotionStatus, now time.Time) error {
+	if status.LSN == 0 {
+		backends, transactions, err := pgm.GetClientBackends()
+		if err != nil {
+			return fmt.Errorf("cannot get the client backends: %v", err)
+		}
+		if transactions > 0 && now.Sub(status.StartTime) < req.DrainTimeout.Duration {
+			log.Infow("waiting for the active transactions to complete", "transactions", transactions)
+			return nil
+		}
+		if backends > 0 {
+			terminated, err := pgm.TerminateClientBackends()
+			if err != nil {
+				return fmt.Errorf("cannot terminate the client backends: %v", err)
+			}
+			log.Infow("terminated the client connections", "terminated", terminated, "transactions", transactions)
+			status.TerminatedBackends += terminated
+		}
+		if err := pgm.Checkpoint(); err != nil {
+			return fmt.Errorf("cannot checkpoint: %v", err)
+		}
+		lsn, err := pgm.GetCurrentWalLsn()
+		if err != nil {
+			return fmt.Errorf("cannot get the current wal position: %v", err)
+		}
+		status.LSN = lsn
+	}
+
+	flushLsn, ok, err := pgm.GetStandbyFlushLsn(common.StolonName(req.TargetDBUID))
+	if err != nil {
+		return fmt.Errorf("cannot get the target db flushed wal position: %v", err)
+	}
+	if !ok || flushLsn < status.LSN {
+		log.Infow("waiting for the target db to receive the final master wal", "targetDB", req.TargetDBUID, "lsn", pg.PGLsn(status.LSN), "flushLsn", pg.PGLsn(flushLsn))
+		return nil
+	}
+	log.Infow("the target db received the final master wal", "targetDB", req.TargetDBUID, "lsn", pg.PGLsn(status.LSN))
+	status.Completed = true
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+	pg "github.com/sorintlab/stolon/internal/postgresql"
+	"github.com/sorintlab/stolon/internal/util"
+)
+
+// extensionsState is the state of the extensions last set up on the master
+// db
+type extensionsState struct {
+	extensions             []cluster.Extension
+	databases              []string
+	sharedPreloadLibraries []string
+}
+
+// addSharedPreloadLibraries adds to the shared_preload_libraries parameter
+// the libraries not already defined, keeping the order of the defined ones
+func addSharedPreloadLibraries(parameters common.Parameters, libs []string) {
+	if len(libs) == 0 {
+		return
+	}
+	cur := pg.ParseSharedPreloadLibraries(parameters["shared_preload_libraries"])
+	missing := util.Difference(libs, cur)
+	if len(missing) == 0 {
+		return
+	}
+	parameters["shared_preload_libraries"] = strings.Join(append(cur, missing...), ",")
+}
+
+// extensionDatabases returns the databases where the extension must be
+// created: the existing databases in the extension spec or, when not
+// defined, all of them
+func extensionDatabases(ext cluster.Extension, databases []string) []string {
+	if len(ext.Databases) == 0 {
+		return databases
+	}
+	extDatabases := []string{}
+	for _, database := range ext.Databases {
+		if !util.StringInSlice(databases, database) {
+			log.Warnw("database of defined extension doesn't exist", "extension", ext.Name, "database", database)
+			continue
+		}
+		extDatabases = append(extDatabases, database)
+	}
+	return extDatabases
+}
+
+// refreshExtensions creates, or updates, the extensions defined in the db
+// spec. An extension is created only when its shared preload libraries have
+// been loaded by the instance. The extensions are set up again only when
+// their spec, the databases or the loaded libraries change. The extensions
+// removed from the spec aren't dropped.
+func (p *PostgresKeeper) refreshExtensions(db *cluster.DB) error {
+	if len(db.Spec.Extensions) == 0 {
+		p.extensionsState = nil
+		return nil
+	}
+
+	databases, err := p.pgm.GetDatabases()
+	if err != nil {
+		return err
+	}
+	sort.Strings(databases)
+	libs, err := p.pgm.GetSharedPreloadLibraries()
+	if err != nil {
+		return err
+	}
+	state := extensionsState{
+		extensions:             db.Spec.Extensions,
+		databases:              databases,
+		sharedPreloadLibraries: libs,
+	}
+	if p.extensionsState != nil && reflect.DeepEqual(*p.extensionsState, state) {
+		return nil
+	}
+
+	for _, ext := range db.Spec.Extensions {
+		if missing := util.Difference(ext.SharedPreloadLibraries, libs); len(missing) > 0 {
+			log.Infow("waiting for the instance restart loading the extension shared preload libraries", "extension", ext.Name, "sharedPreloadLibraries", missing)
+			continue
+		}
+		for _, database := range extensionDatabases(ext, databases) {
+			changed, err := p.pgm.SetupExtension(database, &pg.Extension{Name: ext.Name, Schema: ext.Schema, Version: ext.Version})
+			if err != nil {
+				return err
+			}
+			if changed {
+				log.Infow("extension set up", "extension", ext.Name, "version", ext.Version, "database", database)
+			}
+		}
+	}
+	p.extensionsState = &state
+	return nil
+}
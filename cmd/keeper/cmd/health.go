@@ -0,0 +1,164 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+	"github.com/sorintlab/stolon/internal/util"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// keeperHealth is the keeper state reported by the health endpoints
+type keeperHealth struct {
+	// Role is the role of the keeper db in the cluster data
+	Role common.Role `json:"role"`
+	// PGUp reports if the local postgres instance is up and healthy
+	PGUp bool `json:"pgUp"`
+	// Ready reports if the db can serve connections for its role
+	Ready bool `json:"ready"`
+}
+
+// newKeeperHealth returns the keeper health. A standby is ready only when
+// also reported as ready in the cluster data, so a standby lagging more than
+// maxReadyStandbyLag isn't ready.
+func newKeeperHealth(role common.Role, dbReady bool, pgState *cluster.PostgresState) *keeperHealth {
+	h := &keeperHealth{Role: role}
+	if h.Role == "" {
+		h.Role = common.RoleUndefined
+	}
+	h.PGUp = pgState != nil && pgState.Healthy
+	h.Ready = h.PGUp && (h.Role == common.RoleMaster || (h.Role == common.RoleStandby && dbReady))
+	return h
+}
+
+func (p *PostgresKeeper) health() *keeperHealth {
+	m := p.metricsCopy()
+	return newKeeperHealth(m.role, m.dbReady, p.getLastPGState())
+}
+
+func writeHealth(w http.ResponseWriter, h *keeperHealth, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(h)
+}
+
+// healthzHandler is the liveness endpoint. It always succeeds while the keeper
+// is running, since postgres can be down for a long time (i.e. during a
+// resync) without the keeper needing a restart, and reports the keeper db
+// role and the postgres state.
+func (p *PostgresKeeper) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, p.health(), true)
+}
+
+// readyzHandler is the readiness endpoint. It succeeds when postgres is up and
+// healthy and the keeper db has a role (a standby must also not lag more than
+// maxReadyStandbyLag). When the role query parameter is
+// provided (master or standby) it also requires the db to have that role, so
+// it can be used to make ready only the master (or the standbys) pods.
+func (p *PostgresKeeper) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	h := p.health()
+	ok, err := healthReady(h, r.URL.Query().Get("role"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeHealth(w, h, ok)
+}
+
+func healthReady(h *keeperHealth, role string) (bool, error) {
+	switch common.Role(role) {
+	case "":
+		return h.Ready, nil
+	case common.RoleMaster, common.RoleStandby:
+		return h.Ready && h.Role == common.Role(role), nil
+	}
+	return false, fmt.Errorf("unknown role %q", role)
+}
+
+// podRoleLabeler publishes the keeper db role as a label of the keeper pod
+type podRoleLabeler struct {
+	client    kubernetes.Interface
+	namespace string
+	podName   string
+	label     string
+
+	mutex sync.Mutex
+	// last published role
+	role common.Role
+}
+
+func newPodRoleLabeler(label string) (*podRoleLabeler, error) {
+	kubeClientConfig := util.NewKubeClientConfig("", "", "")
+	kubecfg, err := kubeClientConfig.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	kubecli, err := kubernetes.NewForConfig(kubecfg)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create kubernetes client: %v", err)
+	}
+	podName, err := util.PodName()
+	if err != nil {
+		return nil, err
+	}
+	namespace, _, err := kubeClientConfig.Namespace()
+	if err != nil {
+		return nil, err
+	}
+	return &podRoleLabeler{client: kubecli, namespace: namespace, podName: podName, label: label}, nil
+}
+
+// roleLabelPatch returns the pod merge patch setting the label to the role. The
+// label is removed when the db has no role.
+func roleLabelPatch(label string, role common.Role) ([]byte, error) {
+	var value interface{}
+	if role == common.RoleMaster || role == common.RoleStandby {
+		value = string(role)
+	}
+	return json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]interface{}{label: value},
+		},
+	})
+}
+
+// setRole updates the pod label when the role differs from the last
+// published one
+func (l *podRoleLabeler) setRole(role common.Role) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.role == role {
+		return nil
+	}
+	patch, err := roleLabelPatch(l.label, role)
+	if err != nil {
+		return err
+	}
+	if _, err := l.client.CoreV1().Pods(l.namespace).Patch(l.podName, types.MergePatchType, patch); err != nil {
+		return fmt.Errorf("failed to update pod label: %v", err)
+	}
+	l.role = role
+	return nil
+}
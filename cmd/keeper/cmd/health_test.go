@@ -0,0 +1,88 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+)
+
+func TestHealthReady(t *testing.T) {
+	healthy := &cluster.PostgresState{Healthy: true}
+	tests := []struct {
+		role    common.Role
+		dbReady bool
+		pgState *cluster.PostgresState
+		qrole   string
+		ready   bool
+		err     error
+	}{
+		{role: common.RoleMaster, dbReady: true, pgState: healthy, ready: true},
+		{role: common.RoleStandby, dbReady: true, pgState: healthy, ready: true},
+		{role: common.RoleMaster, dbReady: true, pgState: &cluster.PostgresState{}, ready: false},
+		{role: common.RoleMaster, dbReady: true, ready: false},
+		{role: common.RoleUndefined, pgState: healthy, ready: false},
+		{pgState: healthy, ready: false},
+		{role: common.RoleMaster, dbReady: true, pgState: healthy, qrole: "master", ready: true},
+		{role: common.RoleStandby, dbReady: true, pgState: healthy, qrole: "master", ready: false},
+		{role: common.RoleStandby, dbReady: true, pgState: healthy, qrole: "standby", ready: true},
+		{role: common.RoleMaster, dbReady: true, pgState: healthy, qrole: "unknown", err: fmt.Errorf(`unknown role "unknown"`)},
+		// standby lagging more than maxReadyStandbyLag
+		{role: common.RoleStandby, dbReady: false, pgState: healthy, ready: false},
+		{role: common.RoleStandby, dbReady: false, pgState: healthy, qrole: "standby", ready: false},
+		// the master readiness doesn't depend on the cluster data ready state
+		{role: common.RoleMaster, dbReady: false, pgState: healthy, ready: true},
+	}
+
+	for i, tt := range tests {
+		ready, err := healthReady(newKeeperHealth(tt.role, tt.dbReady, tt.pgState), tt.qrole)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		} else if ready != tt.ready {
+			t.Errorf("#%d: got ready: %t, want: %t", i, ready, tt.ready)
+		}
+	}
+}
+
+func TestRoleLabelPatch(t *testing.T) {
+	tests := []struct {
+		role  common.Role
+		patch string
+	}{
+		{role: common.RoleMaster, patch: `{"metadata":{"labels":{"stolon-role":"master"}}}`},
+		{role: common.RoleStandby, patch: `{"metadata":{"labels":{"stolon-role":"standby"}}}`},
+		{role: common.RoleUndefined, patch: `{"metadata":{"labels":{"stolon-role":null}}}`},
+	}
+
+	for i, tt := range tests {
+		patch, err := roleLabelPatch("stolon-role", tt.role)
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		} else if string(patch) != tt.patch {
+			t.Errorf("#%d: got patch: %s, want: %s", i, patch, tt.patch)
+		}
+	}
+}
@@ -15,13 +15,16 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"reflect"
@@ -41,9 +44,12 @@ import (
 	"github.com/sorintlab/stolon/internal/postgresql"
 	pg "github.com/sorintlab/stolon/internal/postgresql"
 	"github.com/sorintlab/stolon/internal/store"
+	"github.com/sorintlab/stolon/internal/tracing"
 	"github.com/sorintlab/stolon/internal/util"
+	"github.com/sorintlab/stolon/internal/vault"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
@@ -71,6 +77,8 @@ type DBLocalState struct {
 	// InitPGParameters contains the postgres parameter after the
 	// initialization
 	InitPGParameters common.Parameters
+	// RestartRequest is the last db spec restart request handled
+	RestartRequest int64
 }
 
 func (s *DBLocalState) DeepCopy() *DBLocalState {
@@ -96,17 +104,63 @@ type config struct {
 	debug                   bool
 	pgListenAddress         string
 	pgPort                  string
+	pgAdvertiseAddress      string
+	pgAdvertisePort         string
 	pgBinPath               string
 	pgReplAuthMethod        string
 	pgReplUsername          string
 	pgReplPassword          string
 	pgReplPasswordFile      string
 	pgSUAuthMethod          string
+	pgSULocalAuthMethod     string
 	pgSUUsername            string
 	pgSUPassword            string
 	pgSUPasswordFile        string
 	pgInitialSUUsername     string
 	pgInitialSUPasswordFile string
+
+	pgAdditionalAdvertiseAddresses []string
+
+	reportPGParametersHash bool
+
+	pgMonitoringPasswordFile string
+	pgMonitoringPassword     string
+
+	preMasterValidationCommand string
+	preMasterValidationTimeout int
+
+	roleChangeHook        string
+	roleChangeHookURL     string
+	roleChangeHookTimeout int
+
+	tagsString string
+	tags       cluster.Tags
+
+	recoveryMinApplyDelay time.Duration
+
+	tablespaceMapString string
+	tablespaceMap       map[string]string
+
+	externalFollowResolveInterval time.Duration
+
+	fencingFile string
+
+	kubeRoleLabel string
+
+	consulServiceName string
+	consulAgentURL    string
+	consulCheckTTL    time.Duration
+
+	pgSUPasswordVaultSecret   string
+	pgReplPasswordVaultSecret string
+	vaultRefreshInterval      time.Duration
+
+	coordinatedPasswordRotation bool
+
+	configFile string
+	// reloadable options defined by the flags, overridden by the config
+	// file ones
+	flagsConfig reloadableConfig
 }
 
 var cfg config
@@ -124,15 +178,40 @@ func init() {
 	CmdKeeper.PersistentFlags().StringVar(&cfg.dataDir, "data-dir", "", "data directory")
 	CmdKeeper.PersistentFlags().StringVar(&cfg.pgListenAddress, "pg-listen-address", "", "postgresql instance listening address")
 	CmdKeeper.PersistentFlags().StringVar(&cfg.pgPort, "pg-port", "5432", "postgresql instance listening port")
+	CmdKeeper.PersistentFlags().StringVar(&cfg.pgAdvertiseAddress, "pg-advertise-address", "", "postgresql instance address advertised to the other components (i.e. when behind a nat). Defaults to --pg-listen-address")
+	CmdKeeper.PersistentFlags().StringVar(&cfg.pgAdvertisePort, "pg-advertise-port", "", "postgresql instance port advertised to the other components. Defaults to --pg-port")
+	CmdKeeper.PersistentFlags().StringSliceVar(&cfg.pgAdditionalAdvertiseAddresses, "pg-additional-advertise-addresses", []string{}, "postgresql instance addresses advertised in addition to the advertise address (i.e. the address of the other ip family in a dual-stack network, or an external address). The address used by the other components is chosen by the cluster spec preferredAddressFamily. Postgres must be reachable on them")
+	CmdKeeper.PersistentFlags().StringVar(&cfg.configFile, "config-file", "", "path of a yaml config file defining the keeper options reloaded on SIGHUP without restarting postgres: pgAdvertiseAddress, pgAdvertisePort, pgSUPasswordFile, pgReplPasswordFile and storeEndpoints. They override the corresponding flags. On SIGHUP the password files are also read again")
 	CmdKeeper.PersistentFlags().StringVar(&cfg.pgBinPath, "pg-bin-path", "", "absolute path to postgresql binaries. If empty they will be searched in the current PATH")
-	CmdKeeper.PersistentFlags().StringVar(&cfg.pgReplAuthMethod, "pg-repl-auth-method", "md5", "postgres replication user auth method. Default is md5.")
+	CmdKeeper.PersistentFlags().StringVar(&cfg.pgReplAuthMethod, "pg-repl-auth-method", "md5", "postgres replication user auth method (md5, scram-sha-256 or trust). Default is md5.")
 	CmdKeeper.PersistentFlags().StringVar(&cfg.pgReplUsername, "pg-repl-username", "", "postgres replication user name. Required. It'll be created on db initialization. Must be the same for all keepers.")
 	CmdKeeper.PersistentFlags().StringVar(&cfg.pgReplPassword, "pg-repl-password", "", "postgres replication user password. Only one of --pg-repl-password or --pg-repl-passwordfile must be provided. Must be the same for all keepers.")
 	CmdKeeper.PersistentFlags().StringVar(&cfg.pgReplPasswordFile, "pg-repl-passwordfile", "", "postgres replication user password file. Only one of --pg-repl-password or --pg-repl-passwordfile must be provided. Must be the same for all keepers.")
-	CmdKeeper.PersistentFlags().StringVar(&cfg.pgSUAuthMethod, "pg-su-auth-method", "md5", "postgres superuser auth method. Default is md5.")
+	CmdKeeper.PersistentFlags().StringVar(&cfg.pgReplPasswordVaultSecret, "pg-repl-password-vault-secret", "", "vault secret, as path#field (the field defaults to password), containing the postgres replication user password (i.e. secret/data/stolon#repl-password with the kv version 2 secrets engine). Requires --vault-address. Only one of --pg-repl-password, --pg-repl-passwordfile or --pg-repl-password-vault-secret must be provided. Must be the same for all keepers.")
+	CmdKeeper.PersistentFlags().StringVar(&cfg.pgSUAuthMethod, "pg-su-auth-method", "md5", "postgres superuser auth method (md5, scram-sha-256 or trust). Default is md5.")
+	CmdKeeper.PersistentFlags().StringVar(&cfg.pgSULocalAuthMethod, "pg-su-local-auth-method", "", "postgres superuser auth method used by the keeper for its local unix socket connections (md5, scram-sha-256, trust or peer). With peer or trust the superuser password isn't used for local connections and, if pg_rewind is disabled, the superuser host entries aren't generated in strict access mode. Defaults to --pg-su-auth-method.")
 	CmdKeeper.PersistentFlags().StringVar(&cfg.pgSUUsername, "pg-su-username", user, "postgres superuser user name. Used for keeper managed instance access and pg_rewind based synchronization. It'll be created on db initialization. Defaults to the name of the effective user running stolon-keeper. Must be the same for all keepers.")
 	CmdKeeper.PersistentFlags().StringVar(&cfg.pgSUPassword, "pg-su-password", "", "postgres superuser password. Only one of --pg-su-password or --pg-su-passwordfile must be provided. Must be the same for all keepers.")
 	CmdKeeper.PersistentFlags().StringVar(&cfg.pgSUPasswordFile, "pg-su-passwordfile", "", "postgres superuser password file. Only one of --pg-su-password or --pg-su-passwordfile must be provided. Must be the same for all keepers)")
+	CmdKeeper.PersistentFlags().StringVar(&cfg.pgSUPasswordVaultSecret, "pg-su-password-vault-secret", "", "vault secret, as path#field (the field defaults to password), containing the postgres superuser password. Requires --vault-address. Only one of --pg-su-password, --pg-su-passwordfile or --pg-su-password-vault-secret must be provided. Must be the same for all keepers.")
+	CmdKeeper.PersistentFlags().DurationVar(&cfg.vaultRefreshInterval, "vault-refresh-interval", 1*time.Minute, "interval between the reads of the vault password secrets. When a password is rotated the master keeper changes the role password and the standby keepers reconnect with the new one. 0 disables the refresh")
+	CmdKeeper.PersistentFlags().BoolVar(&cfg.coordinatedPasswordRotation, "coordinated-password-rotation", false, "when the superuser or replication passwords are rotated in their source (password files or vault) keep using the current ones until they're applied by stolonctl rotatecredentials, that changes the roles passwords on the master before the standbys start using them. Must be the same for all keepers.")
+	CmdKeeper.PersistentFlags().StringVar(&cfg.pgMonitoringPasswordFile, "pg-monitoring-passwordfile", "", "password file of the monitoring role defined by the cluster spec monitoringUser option. Required when the option is defined. Must be the same for all keepers.")
+	CmdKeeper.PersistentFlags().BoolVar(&cfg.reportPGParametersHash, "report-pg-parameters-hash", false, "report the hash of the pg parameters configured in the instance and of the expected ones to detect configuration drifts")
+	CmdKeeper.PersistentFlags().StringVar(&cfg.preMasterValidationCommand, "pre-master-validation-command", "", "command executed (using /bin/sh -c) before making the db the master. If it fails or times out the keeper declines the master role and the sentinel will choose another master")
+	CmdKeeper.PersistentFlags().IntVar(&cfg.preMasterValidationTimeout, "pre-master-validation-timeout", 10, "timeout in seconds of the pre master validation command. When expired the validation is considered failed")
+	CmdKeeper.PersistentFlags().StringVar(&cfg.roleChangeHook, "role-change-hook", "", "command executed (using /bin/sh -c) on the promote, demote, resync-start and resync-complete events. The event, the new role and the cluster, keeper and db uids are provided in the STOLON_EVENT, STOLON_ROLE, STOLON_CLUSTER_UID, STOLON_KEEPER_UID and STOLON_DB_UID environment variables. Its failures are only logged")
+	CmdKeeper.PersistentFlags().StringVar(&cfg.roleChangeHookURL, "role-change-hook-url", "", "url where the keeper POSTs a json payload (with the event, role, clusterUID, keeperUID and dbUID fields) on the promote, demote, resync-start and resync-complete events. Its failures (also a non 2xx response status) are only logged")
+	CmdKeeper.PersistentFlags().IntVar(&cfg.roleChangeHookTimeout, "role-change-hook-timeout", 10, "timeout in seconds of the role change hook command and of the role change hook url request")
+	CmdKeeper.PersistentFlags().StringVar(&cfg.tagsString, "tags", "", "comma separated list of key=value keeper tags (i.e. zone=zone1,rack=rack1). They can be used by the cluster spec masterPreferredTags and masterAntiAffinityTag options to influence the master election")
+	CmdKeeper.PersistentFlags().DurationVar(&cfg.recoveryMinApplyDelay, "recovery-min-apply-delay", 0, "make the keeper db, when it's a standby, a delayed standby applying the master changes after the provided delay (recovery_min_apply_delay), i.e. 1h. A delayed standby is never elected as the new master unless it's the only available standby and the cluster spec allowDelayedStandbyPromotion option is true, and never chosen as a synchronous standby")
+	CmdKeeper.PersistentFlags().StringVar(&cfg.tablespaceMapString, "tablespace-map", "", "comma separated list of olddir=newdir tablespace directories relocations (pg_basebackup --tablespace-mapping) used when resyncing with pg_basebackup, i.e. /pg/ts1=/data/ts1. The olddir is the tablespace location on the followed db, the newdir contents are removed before the resync")
+	CmdKeeper.PersistentFlags().StringVar(&cfg.fencingFile, "fencing-file", "", "path of a file whose existence fences the keeper (i.e. created by an external fencing system). When it appears the keeper stops postgres and then reports itself as fenced so the sentinel will consider it failed and elect a new master. When it's removed the keeper will manage again its db (rejoining as a standby if a new master has been elected)")
+	CmdKeeper.PersistentFlags().DurationVar(&cfg.externalFollowResolveInterval, "external-follow-resolve-interval", 30*time.Second, "when following an external instance (standby cluster) whose primary conninfo host is a host name, interval between its resolutions. The resolved address is set as the primary conninfo hostaddr, so the instance will follow the new address when it changes. 0 disables it, leaving the host resolution to libpq")
+	CmdKeeper.PersistentFlags().StringVar(&cfg.kubeRoleLabel, "kube-role-label", "", "when running inside kubernetes, name of a keeper pod label (i.e. stolon-role) set to the keeper db role (master or standby), so it can be used by service selectors. The label is removed when the keeper has no db assigned")
+	CmdKeeper.PersistentFlags().StringVar(&cfg.consulServiceName, "consul-service-name", "", "name of a consul service (i.e. postgres) where the keeper registers its db, tagged with its role (master or standby), in the local consul agent, so the master can be resolved with the consul dns (i.e. master.postgres.service.consul). The service has a ttl check passing only when the db is ready for its role. The service is deregistered when the keeper has no db assigned")
+	CmdKeeper.PersistentFlags().StringVar(&cfg.consulAgentURL, "consul-agent-url", "http://127.0.0.1:8500", "url of the local consul agent where the --consul-service-name service is registered")
+	CmdKeeper.PersistentFlags().DurationVar(&cfg.consulCheckTTL, "consul-check-ttl", 30*time.Second, "ttl of the --consul-service-name service check. The keeper updates the check at every postgres state check, if the keeper stops updating it (i.e. it died) the check becomes critical after the ttl")
 	CmdKeeper.PersistentFlags().BoolVar(&cfg.debug, "debug", false, "enable debug logging")
 
 	CmdKeeper.PersistentFlags().MarkDeprecated("id", "please use --uid")
@@ -142,6 +221,7 @@ func init() {
 var managedPGParameters = []string{
 	"unix_socket_directories",
 	"wal_keep_segments",
+	"wal_keep_size",
 	"hot_standby",
 	"listen_addresses",
 	"port",
@@ -172,7 +252,8 @@ func readPasswordFromFile(filepath string) (string, error) {
 // walLevel returns the wal_level value to use.
 // if there's an user provided wal_level pg parameters and if its value is
 // "logical" then returns it, otherwise returns the default ("hot_standby" for
-// pg < 9.6 or "replica" for pg >= 9.6).
+// pg < 9.6 or "replica" for pg >= 9.6). When logical replication slots are
+// defined it's always "logical".
 func (p *PostgresKeeper) walLevel(db *cluster.DB) string {
 	var additionalValidWalLevels = []string{
 		"logical", // pg >= 10
@@ -203,16 +284,79 @@ func (p *PostgresKeeper) walLevel(db *cluster.DB) string {
 		}
 	}
 
+	// logical replication slots require the logical wal level
+	if maj >= 10 && len(db.Spec.LogicalReplicationSlots) > 0 {
+		walLevel = "logical"
+	}
+
 	return walLevel
 }
 
+// default wal retained for the standbys when using the wal_keep wal retention
+// strategy
+const (
+	defaultWalKeepSegments = "8"
+	defaultWalKeepSize     = "128MB"
+)
+
+// walKeepParameters returns the parameter defining the wal retained for the
+// standbys. When the wal retention strategy doesn't retain a fixed amount of
+// wal it's disabled, otherwise the user defined value is used (if any).
+func walKeepParameters(db *cluster.DB, maj int) common.Parameters {
+	name := cluster.WalKeepParameterName(maj)
+	value := defaultWalKeepSegments
+	if maj >= 13 {
+		value = defaultWalKeepSize
+	}
+	if !db.Spec.WalRetentionStrategy.UseWalKeep() {
+		value = "0"
+	} else if v, ok := db.Spec.PGParameters[name]; ok {
+		value = v
+	}
+	return common.Parameters{name: value}
+}
+
+// synchronousCommit returns the synchronous_commit value for the requested
+// level. remote_apply isn't available on postgres < 9.6, "on" is used.
+func synchronousCommit(level cluster.SynchronousCommitLevel, maj, min int) string {
+	if level == cluster.SynchronousCommitRemoteApply && maj == 9 && min < 6 {
+		log.Warnw("synchronous_commit remote_apply is not supported on postgres < 9.6, using on")
+		return string(cluster.SynchronousCommitOn)
+	}
+	return string(level)
+}
+
 func (p *PostgresKeeper) mandatoryPGParameters(db *cluster.DB) common.Parameters {
-	return common.Parameters{
+	maj, min, err := p.pgm.BinaryVersion()
+	if err != nil {
+		// in case we fail to parse the binary version then log it and just use wal_keep_segments
+		log.Warnf("failed to get postgres binary version: %v", err)
+	}
+
+	parameters := common.Parameters{
 		"unix_socket_directories": common.PgUnixSocketDirectories,
 		"wal_level":               p.walLevel(db),
-		"wal_keep_segments":       "8",
 		"hot_standby":             "on",
 	}
+	for k, v := range walKeepParameters(db, maj) {
+		parameters[k] = v
+	}
+	if db.Spec.Role == common.RoleMaster && db.Spec.SynchronousCommit != "" {
+		parameters["synchronous_commit"] = synchronousCommit(db.Spec.SynchronousCommit, maj, min)
+	}
+	// the logical replication slots on a standby require it to avoid their
+	// invalidation. The user defined value is kept.
+	if maj >= 16 && db.Spec.Role == common.RoleStandby && len(db.Spec.LogicalReplicationSlots) > 0 {
+		if _, ok := db.Spec.PGParameters["hot_standby_feedback"]; !ok {
+			parameters["hot_standby_feedback"] = "on"
+		}
+	}
+	if db.Spec.Role == common.RoleStandby {
+		for k, v := range db.Spec.StandbyConflicts.Parameters() {
+			parameters[k] = v
+		}
+	}
+	return parameters
 }
 
 func (p *PostgresKeeper) getSUConnParams(db, followedDB *cluster.DB) pg.ConnParams {
@@ -228,6 +372,7 @@ func (p *PostgresKeeper) getSUConnParams(db, followedDB *cluster.DB) pg.ConnPara
 	if p.pgSUAuthMethod != "trust" {
 		cp.Set("password", p.pgSUPassword)
 	}
+	setChannelBindingConnParams(db, cp)
 	return cp
 }
 
@@ -243,9 +388,59 @@ func (p *PostgresKeeper) getReplConnParams(db, followedDB *cluster.DB) pg.ConnPa
 	if p.pgReplAuthMethod != "trust" {
 		cp.Set("password", p.pgReplPassword)
 	}
+	setChannelBindingConnParams(db, cp)
 	return cp
 }
 
+// setChannelBindingConnParams requires ssl and scram channel binding on the
+// connection when the db spec requires it
+func setChannelBindingConnParams(db *cluster.DB, cp pg.ConnParams) {
+	if !db.Spec.RequireChannelBinding {
+		return
+	}
+	cp.Set("sslmode", "require")
+	cp.Set("channel_binding", "require")
+}
+
+// checkChannelBinding checks that the channel binding required by the db
+// spec can be used by this keeper
+func (p *PostgresKeeper) checkChannelBinding(db *cluster.DB) error {
+	if !db.Spec.RequireChannelBinding {
+		return nil
+	}
+	if p.pgSUAuthMethod == "trust" || p.pgReplAuthMethod == "trust" {
+		return fmt.Errorf("channel binding requires password based superuser and replication auth methods")
+	}
+	maj, min, err := p.pgm.BinaryVersion()
+	if err != nil {
+		return fmt.Errorf("failed to get postgres binary version: %v", err)
+	}
+	if maj < 13 {
+		return fmt.Errorf("channel binding requires postgres 13 or later, current postgres version is %d.%d", maj, min)
+	}
+	return nil
+}
+
+// suLocalAuthMethod returns the superuser auth method to use for local unix
+// socket connections
+func (p *PostgresKeeper) suLocalAuthMethod() string {
+	if p.pgSULocalAuthMethod != "" {
+		return p.pgSULocalAuthMethod
+	}
+	return p.pgSUAuthMethod
+}
+
+// isPasswordAuthMethod reports if the auth method requires a password
+func isPasswordAuthMethod(method string) bool {
+	return method == "md5" || method == "scram-sha-256"
+}
+
+// useScramAuth reports if the superuser or replication user use the
+// scram-sha-256 auth method
+func (p *PostgresKeeper) useScramAuth() bool {
+	return p.pgSUAuthMethod == "scram-sha-256" || p.pgReplAuthMethod == "scram-sha-256" || p.pgSULocalAuthMethod == "scram-sha-256"
+}
+
 func (p *PostgresKeeper) getLocalConnParams() pg.ConnParams {
 	cp := pg.ConnParams{
 		"user":   p.pgSUUsername,
@@ -254,7 +449,7 @@ func (p *PostgresKeeper) getLocalConnParams() pg.ConnParams {
 		"dbname": "postgres",
 		// no sslmode defined since it's not needed and supported over unix sockets
 	}
-	if p.pgSUAuthMethod != "trust" {
+	if isPasswordAuthMethod(p.suLocalAuthMethod()) {
 		cp.Set("password", p.pgSUPassword)
 	}
 	return cp
@@ -290,14 +485,40 @@ func (p *PostgresKeeper) createPGParameters(db *cluster.DB) common.Parameters {
 		parameters[k] = v
 	}
 
+	addSharedPreloadLibraries(parameters, cluster.ExtensionsSharedPreloadLibraries(db.Spec.Extensions))
+
+	if ignored := filterUnsafeDurabilityParameters(parameters, db.Spec.AllowUnsafeDurability); len(ignored) > 0 {
+		log.Warnw("ignoring disabled durability pg parameters since allowUnsafeDurability is false", "parameters", ignored)
+	}
+
+	mandatoryParameters := p.mandatoryPGParameters(db)
+
+	// the wal keep parameter is defined by the mandatory parameters, remove
+	// the one not supported by the postgres version or the instance won't
+	// start
+	for _, k := range []string{"wal_keep_segments", "wal_keep_size"} {
+		if _, ok := parameters[k]; !ok {
+			continue
+		}
+		if _, ok := mandatoryParameters[k]; !ok {
+			log.Warnw("ignoring pg parameter not supported by the postgres version", "parameter", k)
+		}
+		delete(parameters, k)
+	}
+
 	// Add/Replace mandatory PGParameters
-	for k, v := range p.mandatoryPGParameters(db) {
+	for k, v := range mandatoryParameters {
 		parameters[k] = v
 	}
 
 	parameters["listen_addresses"] = fmt.Sprintf("127.0.0.1,%s", p.pgListenAddress)
 
 	parameters["port"] = p.pgPort
+	// channel binding is available only with scram authentication and the
+	// scram-sha-256 auth method requires scram password hashes
+	if db.Spec.RequireChannelBinding || p.useScramAuth() {
+		parameters["password_encryption"] = "scram-sha-256"
+	}
 	// TODO(sgotti) max_replication_slots needs to be at least the
 	// number of existing replication slots or startup will
 	// fail.
@@ -323,20 +544,7 @@ func (p *PostgresKeeper) createPGParameters(db *cluster.DB) common.Parameters {
 			synchronousStandbys = append(synchronousStandbys, synchronousStandby)
 		}
 
-		// We deliberately don't use postgres FIRST or ANY methods with N
-		// different than len(synchronousStandbys) because we need that all the
-		// defined standbys are synchronous (so just only one failed standby
-		// will block the primary).
-		// This is needed for consistency. If we have 3 standbys and we use
-		// FIRST 2 (a, b, c), the sentinel, when the master fails, won't be able to know
-		// which of the 3 standbys is really synchronous and in sync with the
-		// master. And choosing the non synchronous one will cause the loss of
-		// the transactions contained in the wal records not transmitted.
-		if len(synchronousStandbys) > 1 {
-			parameters["synchronous_standby_names"] = fmt.Sprintf("%d (%s)", len(synchronousStandbys), strings.Join(synchronousStandbys, ","))
-		} else {
-			parameters["synchronous_standby_names"] = strings.Join(synchronousStandbys, ",")
-		}
+		parameters["synchronous_standby_names"] = formatSynchronousStandbyNames(synchronousStandbys, int(db.Spec.SynchronousStandbysQuorum))
 	} else {
 		parameters["synchronous_standby_names"] = ""
 	}
@@ -344,6 +552,125 @@ func (p *PostgresKeeper) createPGParameters(db *cluster.DB) common.Parameters {
 	return parameters
 }
 
+// filterUnsafeDurabilityParameters removes from parameters the disabled
+// durability parameters when not explicitly allowed. It returns the names of
+// the removed parameters.
+func filterUnsafeDurabilityParameters(parameters common.Parameters, allowUnsafeDurability bool) []string {
+	if allowUnsafeDurability {
+		return nil
+	}
+	disabled := parameters.DisabledDurabilityParameters()
+	for _, k := range disabled {
+		delete(parameters, k)
+	}
+	return disabled
+}
+
+// hostResolver resolves a host name caching its address for an interval
+type hostResolver struct {
+	mutex    sync.Mutex
+	interval time.Duration
+	lookupFn func(host string) ([]string, error)
+	nowFn    func() time.Time
+
+	host        string
+	addr        string
+	resolveTime time.Time
+}
+
+func newHostResolver(interval time.Duration) *hostResolver {
+	return &hostResolver{
+		interval: interval,
+		lookupFn: net.LookupHost,
+		nowFn:    time.Now,
+	}
+}
+
+// hostAddr returns the address of host, resolving it again when the interval
+// since the last resolution has elapsed. The current address is kept while
+// it's still one of the resolved addresses to avoid changing it when the
+// name has multiple (i.e. round robin) addresses. When the resolution fails
+// the last resolved address is returned.
+func (r *hostResolver) hostAddr(host string) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if host != r.host {
+		r.host = host
+		r.addr = ""
+		r.resolveTime = time.Time{}
+	}
+	now := r.nowFn()
+	if r.addr != "" && now.Sub(r.resolveTime) < r.interval {
+		return r.addr
+	}
+	addrs, err := r.lookupFn(host)
+	if err != nil || len(addrs) == 0 {
+		log.Errorw("failed to resolve host, keeping the last resolved address", "host", host, "addr", r.addr, zap.Error(err))
+		return r.addr
+	}
+	r.resolveTime = now
+	if util.StringInSlice(addrs, r.addr) {
+		return r.addr
+	}
+	sort.Strings(addrs)
+	if r.addr != "" {
+		log.Infow("host address changed", "host", host, "prevAddr", r.addr, "addr", addrs[0])
+	}
+	r.addr = addrs[0]
+	return r.addr
+}
+
+// externalStandbySettings returns the standby settings used to follow an
+// external instance. When the primary conninfo host is a host name (and no
+// hostaddr is provided) its resolved address is set as the hostaddr: libpq
+// will connect to it (using the host name for the authentication and ssl
+// checks) and, when the address changes, the recovery parameters are changed
+// so the instance will follow the new address.
+func (p *PostgresKeeper) externalStandbySettings(standbySettings *cluster.StandbySettings) *cluster.StandbySettings {
+	if standbySettings == nil || p.externalHostResolver == nil {
+		return standbySettings
+	}
+	var connParams pg.ConnParams
+	var err error
+	if strings.HasPrefix(standbySettings.PrimaryConninfo, "postgres://") || strings.HasPrefix(standbySettings.PrimaryConninfo, "postgresql://") {
+		connParams, err = pg.URLToConnParams(standbySettings.PrimaryConninfo)
+	} else {
+		connParams, err = pg.ParseConnString(standbySettings.PrimaryConninfo)
+	}
+	if err != nil {
+		log.Errorw("failed to parse primary conninfo, not resolving its host", zap.Error(err))
+		return standbySettings
+	}
+	host := connParams.Get("host")
+	// ignore ip addresses, unix sockets and multiple hosts
+	if host == "" || connParams.Isset("hostaddr") || net.ParseIP(host) != nil || strings.HasPrefix(host, "/") || strings.Contains(host, ",") {
+		return standbySettings
+	}
+	addr := p.externalHostResolver.hostAddr(host)
+	if addr == "" {
+		return standbySettings
+	}
+	connParams.Set("hostaddr", addr)
+	ns := *standbySettings
+	ns.PrimaryConninfo = connParams.ConnString()
+	return &ns
+}
+
+// internalStandbySettings returns the standby settings of a db following
+// another db in the cluster. When the db is a delayed standby its
+// recovery_min_apply_delay is always set, so it's kept across keeper
+// restarts and recovery parameters updates.
+func internalStandbySettings(db *cluster.DB, replConnParams pg.ConnParams) *cluster.StandbySettings {
+	standbySettings := &cluster.StandbySettings{PrimaryConninfo: replConnParams.ConnString()}
+	if db.Spec.WalRetentionStrategy.UseSlots() {
+		standbySettings.PrimarySlotName = common.StolonName(db.UID)
+	}
+	if db.Spec.RecoveryMinApplyDelay != nil && db.Spec.RecoveryMinApplyDelay.Duration > 0 {
+		standbySettings.RecoveryMinApplyDelay = fmt.Sprintf("%dms", int64(db.Spec.RecoveryMinApplyDelay.Duration/time.Millisecond))
+	}
+	return standbySettings
+}
+
 func (p *PostgresKeeper) createRecoveryParameters(standbyMode bool, standbySettings *cluster.StandbySettings, archiveRecoverySettings *cluster.ArchiveRecoverySettings, recoveryTargetSettings *cluster.RecoveryTargetSettings) common.Parameters {
 	parameters := common.Parameters{}
 
@@ -409,6 +736,7 @@ type PostgresKeeper struct {
 	pgReplUsername      string
 	pgReplPassword      string
 	pgSUAuthMethod      string
+	pgSULocalAuthMethod string
 	pgSUUsername        string
 	pgSUPassword        string
 	pgInitialSUUsername string
@@ -416,10 +744,19 @@ type PostgresKeeper struct {
 	sleepInterval  time.Duration
 	requestTimeout time.Duration
 
+	pgAdditionalAdvertiseAddresses []string
+
 	e   store.Store
 	pgm *postgresql.Manager
 	end chan error
 
+	// configMutex protects the reloaded config and the store
+	configMutex sync.Mutex
+	// options reloaded on SIGHUP
+	reloadable reloadableConfig
+	// storeChangedCh notifies that the store has been replaced
+	storeChangedCh chan struct{}
+
 	localStateMutex  sync.Mutex
 	keeperLocalState *KeeperLocalState
 	dbLocalState     *DBLocalState
@@ -427,6 +764,232 @@ type PostgresKeeper struct {
 	pgStateMutex    sync.Mutex
 	getPGStateMutex sync.Mutex
 	lastPGState     *cluster.PostgresState
+	// prevPGState is the last healthy state returned by GetPGState,
+	// protected by getPGStateMutex
+	prevPGState *cluster.PostgresState
+
+	// stateMutex protects the states set by the state machine and reported
+	// in the keeper info
+	stateMutex             sync.Mutex
+	declinedMasterDBUID    string
+	prePromotionHookResult *cluster.PrePromotionHookResult
+	postInitHookResult     *cluster.PostInitHookResult
+	timelineDivergence     *cluster.TimelineDivergence
+	walRetention           *cluster.WalRetentionStatus
+	logicalReplSlots       bool
+
+	backupMutex sync.Mutex
+	// last scheduled backup requested by the sentinel
+	backup       *cluster.Backup
+	backupCancel context.CancelFunc
+
+	checksumsMutex sync.Mutex
+	// last data checksums verification
+	checksumsVerification *cluster.ChecksumsVerification
+	// time from which the first verification interval is computed
+	checksumsBaseTime time.Time
+
+	resyncVerificationMutex sync.Mutex
+	// verification of the last resync
+	resyncVerification *cluster.ResyncVerification
+
+	removalMutex sync.Mutex
+	// status of the last removal request
+	removal *cluster.KeeperRemovalStatus
+
+	gracefulDemotionMutex sync.Mutex
+	// status of the master db drain requested during a switchover
+	gracefulDemotion *cluster.GracefulDemotionStatus
+
+	// detects the postgres server certificate renewals
+	sslCertWatcher sslCertWatcher
+
+	externalHostResolver *hostResolver
+
+	// smMutex is held during a state machine execution
+	smMutex sync.Mutex
+	tracer  *tracing.Tracer
+	// span of the current state machine execution converging the db, held
+	// with the smMutex
+	smSpan *tracing.Span
+
+	fencingMutex sync.Mutex
+	// fencing is true when the fencing file exists. The state machine
+	// won't manage the db.
+	fencing bool
+	// fenced is true when, after the fencing, postgres has been stopped
+	// and the keeper reports itself as fenced
+	fenced bool
+
+	// db spec generation of the last handled replication slots drop request
+	droppedReplSlotsGeneration int64
+
+	// monitoring role last set up on the master db
+	monitoringRole *monitoringRole
+
+	// extensions last set up on the master db
+	extensionsState *extensionsState
+
+	// databases of the publications last set up on the master db. nil until
+	// all the databases have been checked for stolon publications to drop
+	publicationsDatabases []string
+
+	roleLabeler *podRoleLabeler
+	consul      *consulRegistrar
+
+	vault *vault.Client
+	// passwordsMutex protects the pending passwords and the passwords
+	// updates
+	passwordsMutex sync.Mutex
+	// rotated passwords not yet applied by the state machine
+	pendingPasswords *keeperPasswords
+	// uid of the last credentials rotation applied
+	appliedPasswordsRotation string
+
+	metricsMutex sync.Mutex
+	metrics      keeperMetrics
+}
+
+// keeperMetrics is the keeper state, not available in the postgres state,
+// reported by the keeper metrics
+type keeperMetrics struct {
+	// role of our db in the cluster data
+	role common.Role
+	// master db xlog position in the cluster data
+	masterXLogPos uint64
+	// ready state of our db in the cluster data, a standby lagging more
+	// than maxReadyStandbyLag isn't ready
+	dbReady bool
+	// replay lag of our standby db
+	replayLag      float64
+	replayLagValid bool
+
+	resyncs            uint64
+	lastResyncDuration time.Duration
+	pgRewindAttempts   uint64
+	pgRewindFailures   uint64
+	// state machine executions that didn't converge our db to its spec
+	convergenceErrors uint64
+}
+
+// publishRole publishes the db role in the keeper pod label and in the consul
+// service, if enabled
+func (p *PostgresKeeper) publishRole(role common.Role) {
+	if p.roleLabeler != nil {
+		if err := p.roleLabeler.setRole(role); err != nil {
+			log.Errorw("failed to publish role in the pod label", "role", role, zap.Error(err))
+		}
+	}
+	if p.consul != nil {
+		if err := p.consul.setRole(role); err != nil {
+			log.Errorw("failed to publish role in the consul service", "role", role, zap.Error(err))
+		}
+	}
+}
+
+// publishHealth updates the consul service check, if enabled
+func (p *PostgresKeeper) publishHealth() {
+	if p.consul == nil {
+		return
+	}
+	if err := p.consul.updateHealth(p.health()); err != nil {
+		log.Errorw("failed to publish health in the consul service", zap.Error(err))
+	}
+}
+
+func (p *PostgresKeeper) updateMetrics(fn func(m *keeperMetrics)) {
+	p.metricsMutex.Lock()
+	defer p.metricsMutex.Unlock()
+	fn(&p.metrics)
+}
+
+func (p *PostgresKeeper) metricsCopy() keeperMetrics {
+	p.metricsMutex.Lock()
+	defer p.metricsMutex.Unlock()
+	return p.metrics
+}
+
+// keeperCollector reports the keeper and its postgres instance state
+type keeperCollector struct {
+	p                  *PostgresKeeper
+	pgUp               *prometheus.Desc
+	role               *prometheus.Desc
+	timelineID         *prometheus.Desc
+	replicationLag     *prometheus.Desc
+	replayLag          *prometheus.Desc
+	resyncs            *prometheus.Desc
+	lastResyncDuration *prometheus.Desc
+	pgRewindAttempts   *prometheus.Desc
+	pgRewindFailures   *prometheus.Desc
+	convergenceErrors  *prometheus.Desc
+}
+
+func newKeeperCollector(p *PostgresKeeper) *keeperCollector {
+	return &keeperCollector{
+		p:                  p,
+		pgUp:               prometheus.NewDesc("stolon_keeper_postgres_up", "Whether the local postgres instance is up and healthy (1) or not (0).", nil, nil),
+		role:               prometheus.NewDesc("stolon_keeper_role", "Role of the keeper db in the cluster data (1 for the current role, 0 for the others).", []string{"role"}, nil),
+		timelineID:         prometheus.NewDesc("stolon_keeper_timeline_id", "Timeline of the local postgres instance.", nil, nil),
+		replicationLag:     prometheus.NewDesc("stolon_keeper_replication_lag_bytes", "Bytes between the master xlog position, as last reported in the cluster data, and the standby one. Reported only for standby dbs.", nil, nil),
+		replayLag:          prometheus.NewDesc("stolon_keeper_replication_lag_seconds", "Seconds since the commit on the master of the last transaction replayed by the standby. It also increases when there're no writes on the master. Reported only for standby dbs.", nil, nil),
+		resyncs:            prometheus.NewDesc("stolon_keeper_resyncs_total", "Number of completed db resyncs from the followed db.", nil, nil),
+		lastResyncDuration: prometheus.NewDesc("stolon_keeper_last_resync_duration_seconds", "Duration of the last completed db resync. Not reported until the first resync.", nil, nil),
+		pgRewindAttempts:   prometheus.NewDesc("stolon_keeper_pg_rewind_attempts_total", "Number of db resyncs attempted with pg_rewind.", nil, nil),
+		pgRewindFailures:   prometheus.NewDesc("stolon_keeper_pg_rewind_failures_total", "Number of failed pg_rewind executions (the resync falls back to a full resync).", nil, nil),
+		convergenceErrors:  prometheus.NewDesc("stolon_keeper_convergence_errors_total", "Number of keeper checks that failed to converge the db to its cluster data spec.", nil, nil),
+	}
+}
+
+func (kc *keeperCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- kc.pgUp
+	ch <- kc.role
+	ch <- kc.timelineID
+	ch <- kc.replicationLag
+	ch <- kc.replayLag
+	ch <- kc.resyncs
+	ch <- kc.lastResyncDuration
+	ch <- kc.pgRewindAttempts
+	ch <- kc.pgRewindFailures
+	ch <- kc.convergenceErrors
+}
+
+func (kc *keeperCollector) Collect(ch chan<- prometheus.Metric) {
+	m := kc.p.metricsCopy()
+	pgState := kc.p.getLastPGState()
+
+	pgUp := 0.0
+	if pgState != nil && pgState.Healthy {
+		pgUp = 1
+		ch <- prometheus.MustNewConstMetric(kc.timelineID, prometheus.GaugeValue, float64(pgState.TimelineID))
+	}
+	ch <- prometheus.MustNewConstMetric(kc.pgUp, prometheus.GaugeValue, pgUp)
+
+	for _, role := range []common.Role{common.RoleMaster, common.RoleStandby} {
+		v := 0.0
+		if m.role == role {
+			v = 1
+		}
+		ch <- prometheus.MustNewConstMetric(kc.role, prometheus.GaugeValue, v, string(role))
+	}
+
+	if m.role == common.RoleStandby && pgUp == 1 {
+		lag := 0.0
+		if m.masterXLogPos > pgState.XLogPos {
+			lag = float64(m.masterXLogPos - pgState.XLogPos)
+		}
+		ch <- prometheus.MustNewConstMetric(kc.replicationLag, prometheus.GaugeValue, lag)
+		if m.replayLagValid {
+			ch <- prometheus.MustNewConstMetric(kc.replayLag, prometheus.GaugeValue, m.replayLag)
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(kc.resyncs, prometheus.CounterValue, float64(m.resyncs))
+	if m.resyncs > 0 {
+		ch <- prometheus.MustNewConstMetric(kc.lastResyncDuration, prometheus.GaugeValue, m.lastResyncDuration.Seconds())
+	}
+	ch <- prometheus.MustNewConstMetric(kc.pgRewindAttempts, prometheus.CounterValue, float64(m.pgRewindAttempts))
+	ch <- prometheus.MustNewConstMetric(kc.pgRewindFailures, prometheus.CounterValue, float64(m.pgRewindFailures))
+	ch <- prometheus.MustNewConstMetric(kc.convergenceErrors, prometheus.CounterValue, float64(m.convergenceErrors))
 }
 
 func NewPostgresKeeper(cfg *config, end chan error) (*PostgresKeeper, error) {
@@ -455,6 +1018,7 @@ func NewPostgresKeeper(cfg *config, end chan error) (*PostgresKeeper, error) {
 		pgReplUsername:      cfg.pgReplUsername,
 		pgReplPassword:      cfg.pgReplPassword,
 		pgSUAuthMethod:      cfg.pgSUAuthMethod,
+		pgSULocalAuthMethod: cfg.pgSULocalAuthMethod,
 		pgSUUsername:        cfg.pgSUUsername,
 		pgSUPassword:        cfg.pgSUPassword,
 		pgInitialSUUsername: cfg.pgInitialSUUsername,
@@ -462,11 +1026,31 @@ func NewPostgresKeeper(cfg *config, end chan error) (*PostgresKeeper, error) {
 		sleepInterval:  cluster.DefaultSleepInterval,
 		requestTimeout: cluster.DefaultRequestTimeout,
 
+		pgAdditionalAdvertiseAddresses: cfg.pgAdditionalAdvertiseAddresses,
+
 		keeperLocalState: &KeeperLocalState{},
 		dbLocalState:     &DBLocalState{},
 
 		e:   e,
 		end: end,
+
+		reloadable:     cfg.reloadableConfig(),
+		storeChangedCh: make(chan struct{}, 1),
+	}
+	if cfg.externalFollowResolveInterval > 0 {
+		p.externalHostResolver = newHostResolver(cfg.externalFollowResolveInterval)
+	}
+	if cfg.pgSUPasswordVaultSecret != "" || cfg.pgReplPasswordVaultSecret != "" {
+		p.vault, err = cmd.NewVaultClient(&cfg.CommonConfig)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create vault client: %v", err)
+		}
+	}
+	if cfg.kubeRoleLabel != "" {
+		p.roleLabeler, err = newPodRoleLabeler(cfg.kubeRoleLabel)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create pod role labeler: %v", err)
+		}
 	}
 
 	err = p.loadKeeperLocalState()
@@ -488,11 +1072,22 @@ func NewPostgresKeeper(cfg *config, end chan error) (*PostgresKeeper, error) {
 	}
 
 	log.Infow("keeper uid", "uid", p.keeperLocalState.UID)
+	if cfg.consulServiceName != "" {
+		address, port := p.advertiseAddress()
+		p.consul, err = newConsulRegistrar(cfg.consulAgentURL, cfg.consulServiceName, p.keeperLocalState.UID, address, port, cfg.consulCheckTTL)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create consul service registrar: %v", err)
+		}
+	}
+	if p.keeperLocalState.ClusterUID != "" {
+		slog.SetClusterUID(p.keeperLocalState.ClusterUID)
+	}
 
 	err = p.loadDBLocalState()
 	if err != nil && !os.IsNotExist(err) {
 		return nil, fmt.Errorf("failed to load db local state file: %v", err)
 	}
+	p.tracer = cmd.NewTracer(&cfg.CommonConfig)
 	return p, nil
 }
 
@@ -516,12 +1111,18 @@ func (p *PostgresKeeper) updateKeeperInfo() error {
 		return nil
 	}
 
-	maj, min, err := p.pgm.BinaryVersion()
+	var maj, min int
+	version, err := p.pgm.ServerVersion()
+	if err == nil {
+		maj, min, err = postgresql.ParseVersion(version)
+	}
 	if err != nil {
 		// in case we fail to parse the binary version then log it and just report maj and min as 0
 		log.Warnf("failed to get postgres binary version: %v", err)
 	}
 
+	_, fenced := p.getFencingState()
+
 	keeperInfo := &cluster.KeeperInfo{
 		InfoUID:    common.UID(),
 		UID:        keeperUID,
@@ -531,113 +1132,767 @@ func (p *PostgresKeeper) updateKeeperInfo() error {
 			Maj: maj,
 			Min: min,
 		},
-		PostgresState: p.getLastPGState(),
+		PostgresVersion:        version,
+		PGBinPath:              p.pgm.BinPath(),
+		PostgresState:          p.getLastPGState(),
+		DeclinedMasterDBUID:    p.getDeclinedMasterDBUID(),
+		PrePromotionHookResult: p.getPrePromotionHookResult(),
+		PostInitHookResult:     p.getPostInitHookResult(),
+		TimelineDivergence:     p.getTimelineDivergence(),
+		Backup:                 p.getBackup(),
+		ChecksumsVerification:  p.getChecksumsVerification(),
+		ResyncVerification:     p.getResyncVerification(),
+		Tags:                   p.cfg.tags,
+		Fenced:                 fenced,
+		Removal:                p.getRemoval(),
+		GracefulDemotion:       p.getGracefulDemotion(),
+		Time:                   time.Now(),
+		Passwords:              p.getPasswordsStatus(),
+	}
+	if p.cfg.recoveryMinApplyDelay > 0 {
+		keeperInfo.RecoveryMinApplyDelay = &cluster.Duration{Duration: p.cfg.recoveryMinApplyDelay}
 	}
 
 	// The time to live is just to automatically remove old entries, it's
 	// not used to determine if the keeper info has been updated.
-	if err := p.e.SetKeeperInfo(context.TODO(), keeperUID, keeperInfo, p.sleepInterval); err != nil {
+	if err := p.store().SetKeeperInfo(context.TODO(), keeperUID, keeperInfo, p.sleepInterval); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (p *PostgresKeeper) updatePGState(pctx context.Context) {
-	p.pgStateMutex.Lock()
-	defer p.pgStateMutex.Unlock()
-	pgState, err := p.GetPGState(pctx)
-	if err != nil {
-		log.Errorw("failed to get pg state", zap.Error(err))
-		return
-	}
-	p.lastPGState = pgState
+// fencingCheckInterval is the interval between the fencing file checks
+const fencingCheckInterval = 1 * time.Second
+
+func (p *PostgresKeeper) getFencingState() (fencing, fenced bool) {
+	p.fencingMutex.Lock()
+	defer p.fencingMutex.Unlock()
+	return p.fencing, p.fenced
 }
 
-// parseSynchronousStandbyNames extracts the standby names from the
-// "synchronous_standby_names" postgres parameter.
-//
-// Since postgres 9.6 (https://www.postgresql.org/docs/9.6/static/runtime-config-replication.html)
-// `synchronous_standby_names` can be in one of two formats:
-//   num_sync ( standby_name [, ...] )
-//   standby_name [, ...]
-// two examples for this:
-//   2 (node1,node2)
-//   node1,node2
-// TODO(sgotti) since postgres 10 (https://www.postgresql.org/docs/10/static/runtime-config-replication.html)
-// `synchronous_standby_names` can be in one of three formats:
-//   [FIRST] num_sync ( standby_name [, ...] )
-//   ANY num_sync ( standby_name [, ...] )
-//   standby_name [, ...]
-// since we are writing ourself the synchronous_standby_names we don't handle this case.
-// If needed, to better handle all the cases with also a better validation of
-// standby names we could use something like the parser used by postgres
-func parseSynchronousStandbyNames(s string) ([]string, error) {
-	var spacesSplit []string = strings.Split(s, " ")
-	var entries []string
-	if len(spacesSplit) < 2 {
-		// We're parsing format: standby_name [, ...]
-		entries = strings.Split(s, ",")
-	} else {
-		// We don't know yet which of the 2 formats we're parsing
-		_, err := strconv.Atoi(spacesSplit[0])
-		if err == nil {
-			// We're parsing format: num_sync ( standby_name [, ...] )
-			rest := strings.Join(spacesSplit[1:], " ")
-			inBrackets := strings.TrimSpace(rest)
-			if !strings.HasPrefix(inBrackets, "(") || !strings.HasSuffix(inBrackets, ")") {
-				return nil, fmt.Errorf("synchronous standby string has number but lacks brackets")
-			}
-			withoutBrackets := strings.TrimRight(strings.TrimLeft(inBrackets, "("), ")")
-			entries = strings.Split(withoutBrackets, ",")
-		} else {
-			// We're parsing format: standby_name [, ...]
-			entries = strings.Split(s, ",")
+func (p *PostgresKeeper) setFencingState(fencing, fenced bool) {
+	p.fencingMutex.Lock()
+	defer p.fencingMutex.Unlock()
+	p.fencing = fencing
+	p.fenced = fenced
+}
+
+func fencingFileExists(path string) (bool, error) {
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
 		}
+		return false, err
 	}
-	for i, e := range entries {
-		entries[i] = strings.TrimSpace(e)
-	}
-	return entries, nil
+	return true, nil
 }
 
-func (p *PostgresKeeper) GetInSyncStandbys() ([]string, error) {
-	inSyncStandbysFullName, err := p.pgm.GetSyncStandbys()
+// checkFencing fences or unfences the keeper when the fencing file has been
+// created or removed.
+func (p *PostgresKeeper) checkFencing() {
+	exists, err := fencingFileExists(p.cfg.fencingFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve current sync standbys status from instance: %v", err)
+		// keep the current state
+		log.Errorw("failed to check fencing file", "file", p.cfg.fencingFile, zap.Error(err))
+		return
 	}
-
-	inSyncStandbys := []string{}
-	for _, s := range inSyncStandbysFullName {
-		if common.IsStolonName(s) {
-			inSyncStandbys = append(inSyncStandbys, common.NameFromStolonName(s))
+	fencing, fenced := p.getFencingState()
+	switch {
+	case exists && !fenced:
+		p.fence()
+	case !exists && fencing:
+		log.Infow("fencing file removed, unfencing the keeper", "file", p.cfg.fencingFile)
+		p.setFencingState(false, false)
+		if err := p.updateKeeperInfo(); err != nil {
+			log.Errorw("failed to update keeper info", zap.Error(err))
 		}
 	}
-
-	return inSyncStandbys, nil
 }
 
-func (p *PostgresKeeper) GetPGState(pctx context.Context) (*cluster.PostgresState, error) {
-	p.getPGStateMutex.Lock()
-	defer p.getPGStateMutex.Unlock()
-	// Just get one pgstate at a time to avoid exausting available connections
-	pgState := &cluster.PostgresState{}
-
-	dbls := p.dbLocalStateCopy()
-	pgState.UID = dbls.UID
-	pgState.Generation = dbls.Generation
+// fence stops postgres and, only when it has been stopped, reports the keeper
+// as fenced. In this way a fenced master stops serving writes before the
+// sentinel elects a new master.
+func (p *PostgresKeeper) fence() {
+	log.Warnw("fencing file found, fencing the keeper", "file", p.cfg.fencingFile)
+	// from now the state machine won't manage the db
+	p.setFencingState(true, false)
+	// immediately stop the instance without waiting for the current state
+	// machine execution
+	if err := p.pgm.StopIfStarted(true); err != nil {
+		log.Errorw("failed to stop pg instance", zap.Error(err))
+	}
+	// the current state machine execution could have restarted the
+	// instance, wait for it and stop the instance again
+	p.smMutex.Lock()
+	defer p.smMutex.Unlock()
+	if err := p.pgm.StopIfStarted(true); err != nil {
+		log.Errorw("failed to stop pg instance, the keeper will not be reported as fenced", zap.Error(err))
+		return
+	}
+	p.setFencingState(true, true)
+	log.Warnw("keeper fenced, postgres instance stopped")
+	if err := p.updateKeeperInfo(); err != nil {
+		log.Errorw("failed to update keeper info", zap.Error(err))
+	}
+}
 
-	pgState.ListenAddress = p.pgListenAddress
-	pgState.Port = p.pgPort
+// watchFencing checks the fencing file every fencingCheckInterval
+func (p *PostgresKeeper) watchFencing(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(fencingCheckInterval):
+			p.checkFencing()
+		}
+	}
+}
 
-	initialized, err := p.pgm.IsInitialized()
-	if err != nil {
-		return nil, err
+// keeperUIDInUse reports if another keeper process (with a different boot
+// UUID) is updating the keeper info of our keeper uid. prevKI and curKI are
+// the keeper infos of our keeper uid read at more than a keeper info update
+// interval of distance.
+func keeperUIDInUse(prevKI, curKI *cluster.KeeperInfo, bootUUID string) bool {
+	if curKI == nil || curKI.BootUUID == bootUUID {
+		return false
 	}
-	if initialized {
-		pgParameters, err := p.pgm.GetConfigFilePGParameters()
+	return prevKI == nil || prevKI.InfoUID != curKI.InfoUID
+}
+
+// waitKeeperUIDAvailable waits until no other live keeper process is using
+// our keeper uid, to avoid two keepers managing the same db. It returns false
+// if the context has been canceled.
+func (p *PostgresKeeper) waitKeeperUIDAvailable(ctx context.Context) bool {
+	uid := p.keeperLocalState.UID
+	var prevKI *cluster.KeeperInfo
+	for {
+		keepersInfo, err := p.store().GetKeepersInfo(ctx)
 		if err != nil {
-			log.Errorw("cannot get configured pg parameters", zap.Error(err))
-			return pgState, nil
+			log.Errorw("failed to get keepers info", zap.Error(err))
+		} else {
+			curKI := keepersInfo[uid]
+			if curKI == nil || curKI.BootUUID == p.bootUUID {
+				return true
+			}
+			// a keeper info of another keeper process is in use only if it's
+			// being updated
+			if prevKI != nil {
+				if !keeperUIDInUse(prevKI, curKI, p.bootUUID) {
+					return true
+				}
+				log.Errorw("another keeper process is using our keeper uid, waiting for it to stop", "uid", uid, "bootUUID", curKI.BootUUID)
+			}
+			prevKI = curKI
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		// wait more than the keeper info update interval
+		case <-time.After(2 * p.sleepInterval):
+		}
+	}
+}
+
+// roleChangeEvent returns the role change event fields when the db requested
+// role differs from its current role
+func roleChangeEvent(db *cluster.DB, localRole common.Role) []interface{} {
+	if db.Spec.Role == localRole {
+		return nil
+	}
+	return []interface{}{slog.Event(slog.EventRoleChange, "db", db.UID, "role", string(db.Spec.Role), "previousRole", string(localRole))}
+}
+
+func (p *PostgresKeeper) getDeclinedMasterDBUID() string {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	return p.declinedMasterDBUID
+}
+
+func (p *PostgresKeeper) setDeclinedMasterDBUID(dbUID string) {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	p.declinedMasterDBUID = dbUID
+}
+
+func (p *PostgresKeeper) getPrePromotionHookResult() *cluster.PrePromotionHookResult {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	return p.prePromotionHookResult
+}
+
+func (p *PostgresKeeper) setPrePromotionHookResult(result *cluster.PrePromotionHookResult) {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	p.prePromotionHookResult = result
+}
+
+func (p *PostgresKeeper) getPostInitHookResult() *cluster.PostInitHookResult {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	return p.postInitHookResult
+}
+
+func (p *PostgresKeeper) setPostInitHookResult(result *cluster.PostInitHookResult) {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	p.postInitHookResult = result
+}
+
+func (p *PostgresKeeper) getTimelineDivergence() *cluster.TimelineDivergence {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	return p.timelineDivergence
+}
+
+func (p *PostgresKeeper) setTimelineDivergence(d *cluster.TimelineDivergence) {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	p.timelineDivergence = d
+}
+
+func (p *PostgresKeeper) getWalRetention() *cluster.WalRetentionStatus {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	return p.walRetention
+}
+
+// hasLogicalReplSlots reports if the db spec, at the last logical
+// replication slots refresh, defined logical replication slots
+func (p *PostgresKeeper) hasLogicalReplSlots() bool {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	return p.logicalReplSlots
+}
+
+func (p *PostgresKeeper) setLogicalReplSlots(ok bool) {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	p.logicalReplSlots = ok
+}
+
+func (p *PostgresKeeper) setWalRetention(s *cluster.WalRetentionStatus) {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	p.walRetention = s
+}
+
+// checkTimelineDivergence checks if our db, requested as master, is an old
+// primary: another db is the cluster master and it's on a newer timeline
+// than our timeline and xlog position.
+func checkTimelineDivergence(cd *cluster.ClusterData, db *cluster.DB, timelineID, xLogPos uint64) *cluster.TimelineDivergence {
+	masterDB, ok := cd.DBs[cd.Cluster.Status.Master]
+	if !ok || masterDB.UID == db.UID {
+		return nil
+	}
+	if masterDB.Status.TimelineID <= timelineID {
+		return nil
+	}
+	// the master timeline history contains the timelines it comes from with
+	// the xlog position where it switched to the next one
+	tlh := masterDB.Status.TimelinesHistory.GetTimelineHistory(timelineID)
+	return &cluster.TimelineDivergence{
+		DBUID:            db.UID,
+		Time:             time.Now(),
+		MasterDBUID:      masterDB.UID,
+		MasterTimelineID: masterDB.Status.TimelineID,
+		TimelineID:       timelineID,
+		XLogPos:          xLogPos,
+		Diverged:         tlh == nil || tlh.SwitchPoint < xLogPos,
+	}
+}
+
+// localTimeline returns the instance current timeline and xlog position. When
+// the instance isn't started they are the latest checkpoint ones.
+func localTimeline(pgm *postgresql.Manager, started bool) (uint64, uint64, error) {
+	if started {
+		sd, err := pgm.GetSystemData()
+		if err != nil {
+			return 0, 0, err
+		}
+		return sd.TimelineID, sd.XLogPos, nil
+	}
+	cd, err := pgm.GetControlData()
+	if err != nil {
+		return 0, 0, err
+	}
+	return cd.TimelineID, cd.CheckpointXLogPos, nil
+}
+
+// refuseOldPrimary checks, before starting or keeping running our db as
+// master, if it's an old primary. In this case the instance is stopped, so it
+// won't accept writes, and the divergence is reported in the keeper info
+// until the sentinel changes our db.
+func (p *PostgresKeeper) refuseOldPrimary(cd *cluster.ClusterData, db *cluster.DB, pgm *postgresql.Manager, started bool) bool {
+	if cd.Cluster.Status.Master == db.UID {
+		p.setTimelineDivergence(nil)
+		return false
+	}
+	timelineID, xLogPos, err := localTimeline(pgm, started)
+	if err != nil {
+		log.Warnw("cannot get our db timeline, not checking the timeline divergence", zap.Error(err))
+		return false
+	}
+	d := checkTimelineDivergence(cd, db, timelineID, xLogPos)
+	p.setTimelineDivergence(d)
+	if d == nil {
+		return false
+	}
+	log.Errorw("our db is an old primary since the cluster master is on a newer timeline, refusing to run it as master", "masterDB", d.MasterDBUID, "masterTimeline", d.MasterTimelineID, "timeline", d.TimelineID, "xlogPos", d.XLogPos, "diverged", d.Diverged)
+	if err := pgm.StopIfStarted(true); err != nil {
+		log.Errorw("failed to stop pg instance", zap.Error(err))
+	}
+	return true
+}
+
+// runValidationCommand executes a validation command (the pre master
+// validation command or the pre promotion hook) writing its standard error
+// to stderr. The command (with all its children processes) is killed and the
+// validation considered failed if it doesn't complete before timeout.
+func runValidationCommand(command string, timeout time.Duration, env []string, stderr io.Writer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := runShellCommand(ctx, command, env, stderr); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("timeout after %s", timeout)
+		}
+		return err
+	}
+	return nil
+}
+
+// runShellCommand executes command using /bin/sh -c writing its standard
+// error to stderr. The command, with all its children processes, is killed
+// when ctx is done.
+func runShellCommand(ctx context.Context, command string, env []string, stderr io.Writer) error {
+	return runCommand(ctx, []string{"/bin/sh", "-c", command}, env, stderr)
+}
+
+// runCommand executes the command, provided with its arguments, writing its
+// standard error to stderr. The command, with all its children processes, is
+// killed when ctx is done.
+func runCommand(ctx context.Context, args []string, env []string, stderr io.Writer) error {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), env...)
+	// Run the command in its own process group so all its children can be
+	// killed on timeout
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	log.Debugw("execing cmd", "cmd", cmd)
+
+	// Pipe command's std[err|out] to parent.
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-errCh
+		return ctx.Err()
+	}
+}
+
+// validateMasterRole runs the pre master validation command (if defined)
+// before making the db the master. When the validation fails the master role
+// is declined, reporting it in the keeper info so the sentinel can choose
+// another master, and false is returned.
+func (p *PostgresKeeper) validateMasterRole(db *cluster.DB) bool {
+	if p.cfg.preMasterValidationCommand == "" {
+		return true
+	}
+	timeout := time.Duration(p.cfg.preMasterValidationTimeout) * time.Second
+	log.Infow("executing pre master validation command", "db", db.UID)
+	if err := runValidationCommand(p.cfg.preMasterValidationCommand, timeout, validationCommandEnv(db), os.Stderr); err != nil {
+		log.Errorw("pre master validation failed, declining the master role", "db", db.UID, zap.Error(err))
+		p.setDeclinedMasterDBUID(db.UID)
+		return false
+	}
+	p.setDeclinedMasterDBUID("")
+	return true
+}
+
+func validationCommandEnv(db *cluster.DB) []string {
+	return []string{
+		"STOLON_KEEPER_UID=" + db.Spec.KeeperUID,
+		"STOLON_DB_UID=" + db.UID,
+	}
+}
+
+// maxHookStderrSize is the max size of the pre promotion hook standard error
+// reported in the keeper info
+const maxHookStderrSize = 4096
+
+// limitedBuffer is a bytes.Buffer ignoring the data written after max bytes
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if n := b.max - b.Len(); n > 0 {
+		if len(p) > n {
+			b.Buffer.Write(p[:n])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// connParamsEnv returns the libpq environment variables defining the
+// connection parameters
+func connParamsEnv(cp pg.ConnParams) []string {
+	env := []string{}
+	for _, v := range []struct{ param, name string }{
+		{"host", "PGHOST"},
+		{"port", "PGPORT"},
+		{"user", "PGUSER"},
+		{"password", "PGPASSWORD"},
+		{"dbname", "PGDATABASE"},
+	} {
+		if cp.Isset(v.param) {
+			env = append(env, v.name+"="+cp.Get(v.param))
+		}
+	}
+	return env
+}
+
+// runPostInitHook executes the newConfig post init statements and command on
+// the just initialized db. The result is reported in the keeper info. The hook
+// is skipped when the cluster init config already records its result.
+func (p *PostgresKeeper) runPostInitHook(cd *cluster.ClusterData, db *cluster.DB, pgm *postgresql.Manager) error {
+	nc := db.Spec.NewConfig
+	if !nc.HasPostInitHook() {
+		return nil
+	}
+	if ic := cd.Cluster.Status.InitConfig; ic != nil && ic.PostInitHookResult != nil {
+		log.Infow("post init hook already executed, skipping it", "db", ic.PostInitHookResult.DBUID)
+		return nil
+	}
+	timeout := cd.Cluster.DefSpec().InitTimeout.Duration
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	stderr := &limitedBuffer{max: maxHookStderrSize}
+	log.Infow("executing post init hook", "db", db.UID)
+	err := pgm.ExecStatements(ctx, nc.PostInitSQL)
+	if err == nil && nc.PostInitCommand != "" {
+		env := append(validationCommandEnv(db), connParamsEnv(p.getLocalConnParams())...)
+		err = runShellCommand(ctx, nc.PostInitCommand, env, io.MultiWriter(os.Stderr, stderr))
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timeout after %s", timeout)
+	}
+	result := &cluster.PostInitHookResult{
+		DBUID:   db.UID,
+		Time:    time.Now(),
+		Success: err == nil,
+		Stderr:  stderr.String(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	p.setPostInitHookResult(result)
+	return err
+}
+
+// runPrePromotionHook runs the cluster spec pre promotion hook (if defined)
+// before promoting the db to master. The result is reported in the keeper
+// info. When the hook fails the master role is declined and false is
+// returned.
+func (p *PostgresKeeper) runPrePromotionHook(cd *cluster.ClusterData, db *cluster.DB) bool {
+	clusterSpec := cd.Cluster.DefSpec()
+	if clusterSpec.PrePromotionHook == nil || *clusterSpec.PrePromotionHook == "" {
+		return true
+	}
+	stderr := &limitedBuffer{max: maxHookStderrSize}
+	log.Infow("executing pre promotion hook", "db", db.UID)
+	err := runValidationCommand(*clusterSpec.PrePromotionHook, clusterSpec.PrePromotionHookTimeout.Duration, validationCommandEnv(db), io.MultiWriter(os.Stderr, stderr))
+	result := &cluster.PrePromotionHookResult{
+		DBUID:   db.UID,
+		Time:    time.Now(),
+		Success: err == nil,
+		Stderr:  stderr.String(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	p.setPrePromotionHookResult(result)
+	if err != nil {
+		log.Errorw("pre promotion hook failed, declining the master role", "db", db.UID, zap.Error(err))
+		p.setDeclinedMasterDBUID(db.UID)
+		return false
+	}
+	return true
+}
+
+// role change hook events
+const (
+	roleChangeEventPromote        = "promote"
+	roleChangeEventDemote         = "demote"
+	roleChangeEventResyncStart    = "resync-start"
+	roleChangeEventResyncComplete = "resync-complete"
+)
+
+// roleChangeHookPayload describes a role change event. It's provided to the
+// role change hook command as environment variables and posted as json to
+// the role change hook url.
+type roleChangeHookPayload struct {
+	Event      string `json:"event"`
+	Role       string `json:"role"`
+	ClusterUID string `json:"clusterUID"`
+	KeeperUID  string `json:"keeperUID"`
+	DBUID      string `json:"dbUID"`
+}
+
+func (pl *roleChangeHookPayload) env() []string {
+	return []string{
+		"STOLON_EVENT=" + pl.Event,
+		"STOLON_ROLE=" + pl.Role,
+		"STOLON_CLUSTER_UID=" + pl.ClusterUID,
+		"STOLON_KEEPER_UID=" + pl.KeeperUID,
+		"STOLON_DB_UID=" + pl.DBUID,
+	}
+}
+
+// postRoleChangeHook posts the payload to the role change hook url. A non
+// 2xx response status is reported as an error.
+func postRoleChangeHook(url string, timeout time.Duration, pl *roleChangeHookPayload) error {
+	data, err := json.Marshal(pl)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return nil
+}
+
+// runRoleChangeHooks executes the role change hook command and posts to the
+// role change hook url (when defined) the provided event. They're executed
+// synchronously (bounded by the role change hook timeout) so they observe the
+// events in order. Their failures are only logged.
+func (p *PostgresKeeper) runRoleChangeHooks(event string, db *cluster.DB, role common.Role) {
+	if p.cfg.roleChangeHook == "" && p.cfg.roleChangeHookURL == "" {
+		return
+	}
+	pl := &roleChangeHookPayload{
+		Event:      event,
+		Role:       string(role),
+		ClusterUID: p.keeperLocalState.ClusterUID,
+		KeeperUID:  p.keeperLocalState.UID,
+		DBUID:      db.UID,
+	}
+	timeout := time.Duration(p.cfg.roleChangeHookTimeout) * time.Second
+	if p.cfg.roleChangeHook != "" {
+		log.Infow("executing role change hook", "event", event, "db", db.UID)
+		if err := runValidationCommand(p.cfg.roleChangeHook, timeout, pl.env(), os.Stderr); err != nil {
+			log.Errorw("role change hook failed", "event", event, "db", db.UID, zap.Error(err))
+		}
+	}
+	if p.cfg.roleChangeHookURL != "" {
+		log.Infow("posting role change event to the role change hook url", "event", event, "db", db.UID)
+		if err := postRoleChangeHook(p.cfg.roleChangeHookURL, timeout, pl); err != nil {
+			log.Errorw("role change hook url request failed", "event", event, "db", db.UID, zap.Error(err))
+		}
+	}
+}
+
+func (p *PostgresKeeper) updatePGState(pctx context.Context) {
+	p.pgStateMutex.Lock()
+	defer p.pgStateMutex.Unlock()
+	pgState, err := p.GetPGState(pctx)
+	if err != nil {
+		log.Errorw("failed to get pg state", zap.Error(err))
+		return
+	}
+	p.lastPGState = pgState
+
+	var replayLag float64
+	var replayLagValid bool
+	if pgState.Healthy {
+		replayLag, replayLagValid, err = p.pgm.GetReplayLag()
+		if err != nil {
+			log.Warnw("failed to get replay lag", zap.Error(err))
+		}
+	}
+	p.updateMetrics(func(m *keeperMetrics) {
+		m.replayLag = replayLag
+		m.replayLagValid = replayLagValid
+	})
+}
+
+// formatSynchronousStandbyNames generates the "synchronous_standby_names"
+// postgres parameter value for the provided standbys. The generated value can
+// be parsed back by parseSynchronousStandbyNames.
+//
+// We deliberately don't use postgres FIRST or ANY methods with N different
+// than len(synchronousStandbys) because we need that all the defined standbys
+// are synchronous (so just only one failed standby will block the primary).
+// This is needed for consistency. If we have 3 standbys and we use FIRST 2 (a,
+// b, c), the sentinel, when the master fails, won't be able to know which of
+// the 3 standbys is really synchronous and in sync with the master. And
+// choosing the non synchronous one will cause the loss of the transactions
+// contained in the wal records not transmitted.
+// So the sentinel handles MinSynchronousStandbys/MaxSynchronousStandbys
+// changing the defined standbys and not the required number of them.
+//
+// The exception is quorum synchronous replication: when quorum is greater than
+// 0 and lower than the number of standbys the ANY method is used and the
+// master waits only for quorum of them. The sentinel then knows that, to find
+// a standby with all the committed transactions, it needs to compare the
+// xlog positions of at least len(synchronousStandbys) - quorum + 1 of them.
+func formatSynchronousStandbyNames(synchronousStandbys []string, quorum int) string {
+	if quorum > 0 && quorum < len(synchronousStandbys) {
+		return fmt.Sprintf("ANY %d (%s)", quorum, strings.Join(synchronousStandbys, ","))
+	}
+	if len(synchronousStandbys) > 1 {
+		return fmt.Sprintf("%d (%s)", len(synchronousStandbys), strings.Join(synchronousStandbys, ","))
+	}
+	return strings.Join(synchronousStandbys, ",")
+}
+
+// parseTablespaceMap parses a comma separated list of olddir=newdir
+// tablespace directories relocations
+func parseTablespaceMap(s string) (map[string]string, error) {
+	tablespaceMap := map[string]string{}
+	if strings.TrimSpace(s) == "" {
+		return tablespaceMap, nil
+	}
+	for _, m := range strings.Split(s, ",") {
+		parts := strings.Split(m, "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("wrong relocation %q, must be in the form olddir=newdir", m)
+		}
+		oldDir := filepath.Clean(strings.TrimSpace(parts[0]))
+		newDir := filepath.Clean(strings.TrimSpace(parts[1]))
+		if !filepath.IsAbs(oldDir) || !filepath.IsAbs(newDir) {
+			return nil, fmt.Errorf("wrong relocation %q, directories must be absolute paths", m)
+		}
+		if _, ok := tablespaceMap[oldDir]; ok {
+			return nil, fmt.Errorf("duplicated directory %q", oldDir)
+		}
+		tablespaceMap[oldDir] = newDir
+	}
+	return tablespaceMap, nil
+}
+
+// parseSynchronousStandbyNames extracts the standby names from the
+// "synchronous_standby_names" postgres parameter.
+//
+// Since postgres 9.6 (https://www.postgresql.org/docs/9.6/static/runtime-config-replication.html)
+// `synchronous_standby_names` can be in one of two formats:
+//   num_sync ( standby_name [, ...] )
+//   standby_name [, ...]
+// two examples for this:
+//   2 (node1,node2)
+//   node1,node2
+// Since postgres 10 (https://www.postgresql.org/docs/10/static/runtime-config-replication.html)
+// `synchronous_standby_names` can be in one of three formats:
+//   [FIRST] num_sync ( standby_name [, ...] )
+//   ANY num_sync ( standby_name [, ...] )
+//   standby_name [, ...]
+// The FIRST and ANY methods are ignored since only the standby names are
+// returned.
+// If needed, to better handle all the cases with also a better validation of
+// standby names we could use something like the parser used by postgres
+func parseSynchronousStandbyNames(s string) ([]string, error) {
+	var spacesSplit []string = strings.Split(s, " ")
+	var entries []string
+	if len(spacesSplit) > 2 && (strings.EqualFold(spacesSplit[0], "FIRST") || strings.EqualFold(spacesSplit[0], "ANY")) {
+		if _, err := strconv.Atoi(spacesSplit[1]); err == nil {
+			// Remove the method, we're parsing format: num_sync ( standby_name [, ...] )
+			spacesSplit = spacesSplit[1:]
+		}
+	}
+	if len(spacesSplit) < 2 {
+		// We're parsing format: standby_name [, ...]
+		entries = strings.Split(s, ",")
+	} else {
+		// We don't know yet which of the 2 formats we're parsing
+		_, err := strconv.Atoi(spacesSplit[0])
+		if err == nil {
+			// We're parsing format: num_sync ( standby_name [, ...] )
+			rest := strings.Join(spacesSplit[1:], " ")
+			inBrackets := strings.TrimSpace(rest)
+			if !strings.HasPrefix(inBrackets, "(") || !strings.HasSuffix(inBrackets, ")") {
+				return nil, fmt.Errorf("synchronous standby string has number but lacks brackets")
+			}
+			withoutBrackets := strings.TrimRight(strings.TrimLeft(inBrackets, "("), ")")
+			entries = strings.Split(withoutBrackets, ",")
+		} else {
+			// We're parsing format: standby_name [, ...]
+			entries = strings.Split(s, ",")
+		}
+	}
+	for i, e := range entries {
+		entries[i] = strings.TrimSpace(e)
+	}
+	return entries, nil
+}
+
+func (p *PostgresKeeper) GetInSyncStandbys() ([]string, error) {
+	inSyncStandbysFullName, err := p.pgm.GetSyncStandbys()
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve current sync standbys status from instance: %v", err)
+	}
+
+	inSyncStandbys := []string{}
+	for _, s := range inSyncStandbysFullName {
+		if common.IsStolonName(s) {
+			inSyncStandbys = append(inSyncStandbys, common.NameFromStolonName(s))
+		}
+	}
+
+	return inSyncStandbys, nil
+}
+
+func (p *PostgresKeeper) GetPGState(pctx context.Context) (*cluster.PostgresState, error) {
+	p.getPGStateMutex.Lock()
+	defer p.getPGStateMutex.Unlock()
+	// Just get one pgstate at a time to avoid exausting available connections
+	pgState := &cluster.PostgresState{}
+
+	dbls := p.dbLocalStateCopy()
+	pgState.UID = dbls.UID
+	pgState.Generation = dbls.Generation
+	pgState.RestartRequest = dbls.RestartRequest
+
+	pgState.ListenAddress, pgState.Port = p.advertiseAddress()
+	pgState.AdditionalListenAddresses = p.pgAdditionalAdvertiseAddresses
+
+	// the failures of the informational queries don't make the instance
+	// unhealthy, the values of the previous state of the same db are
+	// reported instead
+	prevPGState := p.prevPGState
+	if prevPGState == nil || prevPGState.UID != pgState.UID {
+		prevPGState = &cluster.PostgresState{}
+	}
+
+	initialized, err := p.pgm.IsInitialized()
+	if err != nil {
+		return nil, err
+	}
+	if initialized {
+		pgParameters, err := p.pgm.GetConfigFilePGParameters()
+		if err != nil {
+			log.Errorw("cannot get configured pg parameters", zap.Error(err))
+			return pgState, nil
 		}
 		log.Debugw("got configured pg parameters", "pgParameters", pgParameters)
 		filteredPGParameters := common.Parameters{}
@@ -649,6 +1904,17 @@ func (p *PostgresKeeper) GetPGState(pctx context.Context) (*cluster.PostgresStat
 		log.Debugw("filtered out managed pg parameters", "filteredPGParameters", filteredPGParameters)
 		pgState.PGParameters = filteredPGParameters
 
+		if p.cfg.reportPGParametersHash {
+			// the hashes are computed on all the parameters, also on the
+			// managed ones
+			pgState.PGParametersHash = pgParameters.Hash()
+			// the keeper hasn't yet applied any parameter, don't report an
+			// expected hash to avoid reporting a false drift
+			if curParameters := p.pgm.CurParameters(); len(curParameters) > 0 {
+				pgState.ExpectedPGParametersHash = curParameters.Hash()
+			}
+		}
+
 		inSyncStandbys, err := p.GetInSyncStandbys()
 		if err != nil {
 			log.Errorw("failed to retrieve current in sync standbys from instance", zap.Error(err))
@@ -657,6 +1923,78 @@ func (p *PostgresKeeper) GetPGState(pctx context.Context) (*cluster.PostgresStat
 
 		pgState.SynchronousStandbys = inSyncStandbys
 
+		dataChecksums, err := p.pgm.GetDataChecksums()
+		if err != nil {
+			log.Errorw("failed to retrieve data checksums state from instance", zap.Error(err))
+			dataChecksums = prevPGState.DataChecksums
+		}
+		pgState.DataChecksums = dataChecksums
+
+		sharedPreloadLibraries, err := p.pgm.GetSharedPreloadLibraries()
+		if err != nil {
+			log.Errorw("failed to retrieve shared preload libraries from instance", zap.Error(err))
+			sharedPreloadLibraries = prevPGState.SharedPreloadLibraries
+		}
+		pgState.SharedPreloadLibraries = sharedPreloadLibraries
+
+		if certFile, _, ok := sslCertFiles(pgParameters, filepath.Join(p.dataDir, "postgres")); ok {
+			notAfter, err := sslCertNotAfter(certFile)
+			if err != nil {
+				log.Warnw("cannot get postgres server certificate expiration", zap.Error(err))
+			} else {
+				pgState.SSLCertNotAfter = notAfter
+			}
+		}
+
+		replSlots, err := p.pgm.GetPhysicalReplicationSlots()
+		if err != nil {
+			log.Errorw("failed to retrieve replication slots from instance", zap.Error(err))
+			pgState.ReplicationSlots = prevPGState.ReplicationSlots
+		} else {
+			pgState.ReplicationSlots = []*cluster.ReplicationSlotStatus{}
+			for _, rs := range replSlots {
+				pgState.ReplicationSlots = append(pgState.ReplicationSlots, &cluster.ReplicationSlotStatus{
+					Name:       rs.Name,
+					Active:     rs.Active,
+					RestartLSN: rs.RestartLSN,
+				})
+			}
+		}
+		pgState.WalRetention = p.getWalRetention()
+
+		// the logical replication slots are reported only when defined
+		if p.hasLogicalReplSlots() {
+			logicalReplSlots, err := p.pgm.GetLogicalReplicationSlots()
+			if err != nil {
+				log.Errorw("failed to retrieve logical replication slots from instance", zap.Error(err))
+				pgState.LogicalReplicationSlots = prevPGState.LogicalReplicationSlots
+			} else {
+				pgState.LogicalReplicationSlots = []*cluster.LogicalReplicationSlotStatus{}
+				for _, rs := range logicalReplSlots {
+					pgState.LogicalReplicationSlots = append(pgState.LogicalReplicationSlots, &cluster.LogicalReplicationSlotStatus{
+						Name:              rs.Name,
+						Database:          rs.Database,
+						Plugin:            rs.Plugin,
+						ConfirmedFlushLSN: rs.ConfirmedFlushLSN,
+					})
+				}
+			}
+		}
+
+		tablespaces, err := p.pgm.GetTablespaces()
+		if err != nil {
+			log.Errorw("failed to retrieve tablespaces from instance", zap.Error(err))
+			pgState.Tablespaces = prevPGState.Tablespaces
+		} else {
+			pgState.Tablespaces = []*cluster.TablespaceStatus{}
+			for _, ts := range tablespaces {
+				pgState.Tablespaces = append(pgState.Tablespaces, &cluster.TablespaceStatus{
+					Name:     ts.Name,
+					Location: ts.Location,
+				})
+			}
+		}
+
 		sd, err := p.pgm.GetSystemData()
 		if err != nil {
 			log.Errorw("error getting pg state", zap.Error(err))
@@ -666,6 +2004,19 @@ func (p *PostgresKeeper) GetPGState(pctx context.Context) (*cluster.PostgresStat
 		pgState.TimelineID = sd.TimelineID
 		pgState.XLogPos = sd.XLogPos
 
+		replayXLogPos, isStandby, err := p.pgm.GetReplayXLogPos()
+		if err != nil {
+			log.Warnw("failed to get the replayed xlog position", zap.Error(err))
+		} else if isStandby {
+			pgState.ReplayXLogPos = replayXLogPos
+			replayDelay, ok, err := p.pgm.GetReplayLag()
+			if err != nil {
+				log.Warnw("failed to get replay lag", zap.Error(err))
+			} else if ok {
+				pgState.ReplayDelay = &cluster.Duration{Duration: time.Duration(replayDelay * float64(time.Second))}
+			}
+		}
+
 		// if timeline <= 1 then no timeline history file exists.
 		pgState.TimelinesHistory = cluster.PostgresTimelinesHistory{}
 		if pgState.TimelineID > 1 {
@@ -696,6 +2047,7 @@ func (p *PostgresKeeper) GetPGState(pctx context.Context) (*cluster.PostgresStat
 			pgState.OlderWalFile = ow
 		}
 		pgState.Healthy = true
+		p.prevPGState = pgState.DeepCopy()
 	}
 
 	return pgState, nil
@@ -716,7 +2068,7 @@ func (p *PostgresKeeper) Start(ctx context.Context) {
 
 	var err error
 	var cd *cluster.ClusterData
-	cd, _, err = p.e.GetClusterData(context.TODO())
+	cd, _, err = p.store().GetClusterData(context.TODO())
 	if err != nil {
 		log.Errorw("error retrieving cluster data", zap.Error(err))
 	} else if cd != nil {
@@ -737,7 +2089,42 @@ func (p *PostgresKeeper) Start(ctx context.Context) {
 
 	p.pgm.StopIfStarted(true)
 
-	smTimerCh := time.NewTimer(0).C
+	if !p.waitKeeperUIDAvailable(ctx) {
+		p.end <- nil
+		return
+	}
+
+	if p.vault != nil && p.cfg.vaultRefreshInterval > 0 {
+		go p.watchVaultPasswords(ctx)
+	}
+
+	go p.watchReload(ctx)
+
+	if p.cfg.fencingFile != "" {
+		// check the fencing file before the first state machine execution
+		p.checkFencing()
+		go p.watchFencing(ctx)
+	}
+
+	smTimer := time.NewTimer(0)
+	// the cluster data watch triggers a new state machine execution
+	// without waiting for the sleep interval
+	// the watch is restarted when the store is replaced
+	watch := func() (<-chan *store.KVPair, context.CancelFunc) {
+		watchCtx, cancel := context.WithCancel(ctx)
+		return p.store().Watch(watchCtx), cancel
+	}
+	watchCh, watchCancel := watch()
+	defer func() { watchCancel() }()
+	smRunning := false
+	smPending := false
+	runSM := func() {
+		smRunning = true
+		go func() {
+			p.postgresKeeperSM(ctx)
+			endSMCh <- struct{}{}
+		}()
+	}
 	updatePGStateTimerCh := time.NewTimer(0).C
 	updateKeeperInfoTimerCh := time.NewTimer(0).C
 	for true {
@@ -747,22 +2134,50 @@ func (p *PostgresKeeper) Start(ctx context.Context) {
 			if err = p.pgm.StopIfStarted(true); err != nil {
 				log.Errorw("failed to stop pg instance", zap.Error(err))
 			}
+			if p.consul != nil {
+				if err := p.consul.setRole(common.RoleUndefined); err != nil {
+					log.Errorw("failed to deregister the consul service", zap.Error(err))
+				}
+			}
 			p.end <- nil
 			return
 
-		case <-smTimerCh:
-			go func() {
-				p.postgresKeeperSM(ctx)
-				endSMCh <- struct{}{}
-			}()
+		case <-smTimer.C:
+			runSM()
+
+		case <-p.storeChangedCh:
+			watchCancel()
+			watchCh, watchCancel = watch()
+
+		case _, ok := <-watchCh:
+			if !ok {
+				watchCh = nil
+				continue
+			}
+			log.Debugw("cluster data changed")
+			if smRunning {
+				smPending = true
+				continue
+			}
+			if !smTimer.Stop() {
+				<-smTimer.C
+			}
+			runSM()
 
 		case <-endSMCh:
-			smTimerCh = time.NewTimer(p.sleepInterval).C
+			smRunning = false
+			if smPending {
+				smPending = false
+				runSM()
+				continue
+			}
+			smTimer.Reset(p.sleepInterval)
 
 		case <-updatePGStateTimerCh:
 			// updateKeeperInfo two times faster than the sleep interval
 			go func() {
 				p.updatePGState(ctx)
+				p.publishHealth()
 				endPgStatecheckerCh <- struct{}{}
 			}()
 
@@ -773,7 +2188,7 @@ func (p *PostgresKeeper) Start(ctx context.Context) {
 		case <-updateKeeperInfoTimerCh:
 			go func() {
 				if err := p.updateKeeperInfo(); err != nil {
-					log.Errorw("failed to update keeper info", zap.Error(err))
+					log.Errorw("failed to update keeper info", zap.Error(err), slog.Event(slog.EventStoreConnectionLost))
 				}
 				endUpdateKeeperInfo <- struct{}{}
 			}()
@@ -784,162 +2199,575 @@ func (p *PostgresKeeper) Start(ctx context.Context) {
 	}
 }
 
-func (p *PostgresKeeper) resync(db, followedDB *cluster.DB, tryPgrewind bool) error {
-	pgm := p.pgm
-	replConnParams := p.getReplConnParams(db, followedDB)
-	standbySettings := &cluster.StandbySettings{PrimaryConninfo: replConnParams.ConnString(), PrimarySlotName: common.StolonName(db.UID)}
-
-	// TODO(sgotti) Actually we don't check if pg_rewind is installed or if
-	// postgresql version is > 9.5 since someone can also use an externally
-	// installed pg_rewind for postgres 9.4. If a pg_rewind executable
-	// doesn't exists pgm.SyncFromFollowedPGRewind will return an error and
-	// fallback to pg_basebackup
-	if tryPgrewind && p.usePgrewind(db) {
-		connParams := p.getSUConnParams(db, followedDB)
-		log.Infow("syncing using pg_rewind", "followedDB", followedDB.UID, "keeper", followedDB.Spec.KeeperUID)
-		if err := pgm.SyncFromFollowedPGRewind(connParams, p.pgSUPassword); err != nil {
-			// log pg_rewind error and fallback to pg_basebackup
-			log.Errorw("error syncing with pg_rewind", zap.Error(err))
+// default WAL-G command and fetched backup
+const (
+	defaultWalGCommand    = "wal-g"
+	defaultWalGBackupName = "LATEST"
+)
+
+// walgCommand returns the WAL-G command, with its arguments, and the backup
+// to fetch for the provided WAL-G config
+func walgCommand(c *cluster.WalGConfig) ([]string, string) {
+	command := []string{defaultWalGCommand}
+	backupName := defaultWalGBackupName
+	if c != nil {
+		if fields := strings.Fields(c.Command); len(fields) > 0 {
+			command = fields
+		}
+		if c.BackupName != "" {
+			backupName = c.BackupName
+		}
+	}
+	return command, backupName
+}
+
+// internalArchiveRecoverySettings returns the archive recovery settings of a
+// standby following another db in the cluster. With the walg resync strategy
+// the wal not available from the followed db is restored from the WAL-G
+// archive.
+func internalArchiveRecoverySettings(db *cluster.DB) *cluster.ArchiveRecoverySettings {
+	if !hasResyncStrategy(dbResyncStrategies(db, false), cluster.ResyncStrategyWalG) {
+		return nil
+	}
+	if db.Spec.FollowConfig == nil || db.Spec.FollowConfig.Type != cluster.FollowTypeInternal {
+		return nil
+	}
+	command, _ := walgCommand(db.Spec.WalGConfig)
+	return &cluster.ArchiveRecoverySettings{
+		RestoreCommand: strings.Join(command, " ") + ` wal-fetch "%f" "%p"`,
+	}
+}
+
+// pgBackRestOptions returns the pgBackRest options for the provided
+// pgBackRest config
+func pgBackRestOptions(c *cluster.PgBackRestConfig) *postgresql.PgBackRestOptions {
+	if c == nil {
+		return &postgresql.PgBackRestOptions{}
+	}
+	return &postgresql.PgBackRestOptions{
+		Stanza:     c.Stanza,
+		ConfigPath: c.ConfigPath,
+	}
+}
+
+// basebackupOptions returns the pg_basebackup options for the provided
+// basebackup config. When pg_basebackup doesn't support parallel transfers a
+// single worker is used and when it doesn't support server side compression
+// the backup isn't compressed. The resync max rate is used when the basebackup
+// config doesn't define one.
+func basebackupOptions(c *cluster.BasebackupConfig, features postgresql.BasebackupFeatures, tablespaceMap map[string]string, resyncMaxRate string) *postgresql.BasebackupOptions {
+	if c == nil && len(tablespaceMap) == 0 && resyncMaxRate == "" {
+		return nil
+	}
+	opts := &postgresql.BasebackupOptions{}
+	if len(tablespaceMap) > 0 {
+		opts.TablespaceMap = tablespaceMap
+	}
+	opts.MaxRate = resyncMaxRate
+	if c == nil {
+		return opts
+	}
+	if c.MaxRate != "" {
+		opts.MaxRate = c.MaxRate
+	}
+	opts.CheckpointMode = string(c.CheckpointMode)
+	opts.WalMethod = string(c.WalMethod)
+	if c.ParallelWorkers > 1 {
+		if features.Jobs {
+			opts.Jobs = c.ParallelWorkers
 		} else {
-			pgm.SetRecoveryParameters(p.createRecoveryParameters(true, standbySettings, nil, nil))
-			return nil
+			log.Warnw("pg_basebackup doesn't support parallel transfers, using a single worker", "parallelWorkers", c.ParallelWorkers)
 		}
 	}
+	if c.Compression != "" {
+		if features.ServerCompression {
+			opts.Compression = string(c.Compression)
+			opts.CompressionLevel = c.CompressionLevel
+		} else {
+			log.Warnw("pg_basebackup doesn't support server side compression, not compressing the backup", "compression", c.Compression)
+		}
+	}
+	return opts
+}
 
-	maj, min, err := p.pgm.BinaryVersion()
+// resync resyncs the db from the followed db executing the resync-start and
+// resync-complete role change hooks. It's refused when blocked by the followed
+// db wal retention limits.
+func (p *PostgresKeeper) resync(db, followedDB *cluster.DB, tryPgrewind bool) error {
+	if err := checkResyncAllowed(followedDB); err != nil {
+		return err
+	}
+	span := p.smSpan.Child("keeper.resync", tracing.String("stolon.followed.db", followedDB.UID))
+	defer span.End()
+	p.runRoleChangeHooks(roleChangeEventResyncStart, db, common.RoleStandby)
+	start := time.Now()
+	if err := p.syncFromFollowed(db, followedDB, tryPgrewind); err != nil {
+		span.SetError(err)
+		return err
+	}
+	p.updateMetrics(func(m *keeperMetrics) {
+		m.resyncs++
+		m.lastResyncDuration = time.Since(start)
+	})
+	p.runRoleChangeHooks(roleChangeEventResyncComplete, db, common.RoleStandby)
+	return nil
+}
+
+// TODO(sgotti) unify this with the sentinel one. They have the same logic but one uses *cluster.PostgresState while the other *cluster.DB
+func (p *PostgresKeeper) isDifferentTimelineBranch(followedDB *cluster.DB, pgState *cluster.PostgresState) bool {
+	if followedDB.Status.TimelineID < pgState.TimelineID {
+		log.Infow("followed instance timeline < than our timeline", "followedTimeline", followedDB.Status.TimelineID, "timeline", pgState.TimelineID)
+		return true
+	}
+
+	// if the timelines are the same check that also the switchpoints are the same.
+	if followedDB.Status.TimelineID == pgState.TimelineID {
+		if pgState.TimelineID <= 1 {
+			// if timeline <= 1 then no timeline history file exists.
+			return false
+		}
+		ftlh := followedDB.Status.TimelinesHistory.GetTimelineHistory(pgState.TimelineID - 1)
+		tlh := pgState.TimelinesHistory.GetTimelineHistory(pgState.TimelineID - 1)
+		if ftlh == nil || tlh == nil {
+			// No timeline history to check
+			return false
+		}
+		if ftlh.SwitchPoint == tlh.SwitchPoint {
+			return false
+		}
+		log.Infow("followed instance timeline forked at a different xlog pos than our timeline", "followedTimeline", followedDB.Status.TimelineID, "followedXlogpos", ftlh.SwitchPoint, "timeline", pgState.TimelineID, "xlogpos", tlh.SwitchPoint)
+		return true
+	}
+
+	// followedDB.Status.TimelineID > pgState.TimelineID
+	ftlh := followedDB.Status.TimelinesHistory.GetTimelineHistory(pgState.TimelineID)
+	if ftlh != nil {
+		if ftlh.SwitchPoint < pgState.XLogPos {
+			log.Infow("followed instance timeline forked before our current state", "followedTimeline", followedDB.Status.TimelineID, "followedXlogpos", ftlh.SwitchPoint, "timeline", pgState.TimelineID, "xlogpos", pgState.XLogPos)
+			return true
+		}
+	}
+	return false
+}
+
+func (p *PostgresKeeper) updateReplSlots(curReplSlots []string, uid string, followersUIDs, additionalReplSlots []string) error {
+	// the wanted internal replication slots, the value reports if the slot
+	// is an additional one
+	internalReplSlots := map[string]bool{}
+
+	// Create a list of the wanted internal replication slots
+	for _, followerUID := range followersUIDs {
+		if followerUID == uid {
+			continue
+		}
+		internalReplSlots[common.StolonName(followerUID)] = false
+	}
+
+	// Add AdditionalReplicationSlots
+	for _, slot := range additionalReplSlots {
+		internalReplSlots[common.StolonName(slot)] = true
+	}
+
+	// Drop internal replication slots
+	for _, slot := range curReplSlots {
+		if !common.IsStolonName(slot) {
+			continue
+		}
+		if _, ok := internalReplSlots[slot]; !ok {
+			log.Infow("dropping replication slot", "slot", slot)
+			if err := p.pgm.DropReplicationSlot(slot); err != nil {
+				log.Errorw("failed to drop replication slot", "slot", slot, "err", err)
+				// don't return the error but continue also if drop failed (standby still connected)
+			}
+		}
+	}
+
+	// Create internal replication slots
+	for slot, additional := range internalReplSlots {
+		if !util.StringInSlice(curReplSlots, slot) {
+			log.Infow("creating replication slot", "slot", slot)
+			// additional slots are used by external consumers that, after
+			// a failover, could reconnect to the new master after some
+			// time, so they reserve the wal since their creation
+			if err := p.pgm.CreateReplicationSlot(slot, additional); err != nil {
+				log.Errorw("failed to create replication slot", "slot", slot, zap.Error(err))
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dropRequestedReplSlots drops the replication slots requested in the db
+// spec (by stolonctl drop-slot) and returns the remaining current replication
+// slots. The requested slots are dropped only once for every db spec
+// generation, or an internal slot recreated by updateReplSlots will be dropped
+// again until the sentinel removes the request.
+func (p *PostgresKeeper) dropRequestedReplSlots(db *cluster.DB, curReplSlots []string) []string {
+	if len(db.Spec.DropReplicationSlots) == 0 || p.droppedReplSlotsGeneration == db.Generation {
+		return curReplSlots
+	}
+	replSlots := []string{}
+	for _, slot := range curReplSlots {
+		if !util.StringInSlice(db.Spec.DropReplicationSlots, slot) {
+			replSlots = append(replSlots, slot)
+			continue
+		}
+		log.Infow("dropping requested replication slot", "slot", slot)
+		if err := p.pgm.DropReplicationSlot(slot); err != nil {
+			log.Errorw("failed to drop requested replication slot", "slot", slot, zap.Error(err))
+			replSlots = append(replSlots, slot)
+		}
+	}
+	p.droppedReplSlotsGeneration = db.Generation
+	return replSlots
+}
+
+func (p *PostgresKeeper) refreshReplicationSlots(cd *cluster.ClusterData, db *cluster.DB) error {
+	var currentReplicationSlots []string
+	currentReplicationSlots, err := p.pgm.GetReplicationSlots()
 	if err != nil {
-		// in case we fail to parse the binary version then log it and just don't use replSlot
-		log.Warnf("failed to get postgres binary version: %v", err)
+		log.Errorw("failed to get replication slots", zap.Error(err))
+		return err
 	}
-	replSlot := ""
-	if (maj == 9 && min >= 6) || maj > 10 {
-		replSlot = common.StolonName(db.UID)
+
+	currentReplicationSlots = p.dropRequestedReplSlots(db, currentReplicationSlots)
+	currentReplicationSlots = p.checkWalRetention(db, currentReplicationSlots)
+
+	followersUIDs := db.Spec.Followers
+	// without replication slots for the standbys drop the existing ones
+	if !db.Spec.WalRetentionStrategy.UseSlots() {
+		followersUIDs = nil
 	}
 
-	if err := pgm.RemoveAll(); err != nil {
-		return fmt.Errorf("failed to remove the postgres data dir: %v", err)
+	if err = p.updateReplSlots(currentReplicationSlots, db.UID, followersUIDs, db.Spec.AdditionalReplicationSlots); err != nil {
+		log.Errorw("error updating replication slots", zap.Error(err))
+		return err
 	}
-	if slog.IsDebug() {
-		log.Debugw("syncing from followed db", "followedDB", followedDB.UID, "keeper", followedDB.Spec.KeeperUID, "replConnParams", fmt.Sprintf("%v", replConnParams))
-	} else {
-		log.Infow("syncing from followed db", "followedDB", followedDB.UID, "keeper", followedDB.Spec.KeeperUID)
+
+	return nil
+}
+
+type publicationsActions struct {
+	drop      []string
+	create    []*pg.Publication
+	setTables []*pg.Publication
+}
+
+// normalizeTableName adds the default "public" schema to table names without
+// a schema
+func normalizeTableName(name string) string {
+	if !strings.Contains(name, ".") {
+		return "public." + name
+	}
+	return name
+}
+
+// diffPublications returns the actions needed to converge the current
+// publications to the wanted ones. Publications not created by stolon are
+// never dropped or altered.
+func diffPublications(curPubs []*pg.Publication, wantedPubs []cluster.Publication) *publicationsActions {
+	actions := &publicationsActions{}
+
+	wanted := map[string]*pg.Publication{}
+	for _, wp := range wantedPubs {
+		pub := &pg.Publication{Name: wp.Name, AllTables: wp.AllTables}
+		for _, t := range wp.Tables {
+			pub.Tables = append(pub.Tables, normalizeTableName(t))
+		}
+		sort.Strings(pub.Tables)
+		wanted[wp.Name] = pub
+	}
+
+	cur := map[string]*pg.Publication{}
+	for _, cp := range curPubs {
+		cur[cp.Name] = cp
+		wp, ok := wanted[cp.Name]
+		if !ok {
+			if cp.Managed {
+				actions.drop = append(actions.drop, cp.Name)
+			}
+			continue
+		}
+		if !cp.Managed {
+			// keep user created publications with the same name
+			continue
+		}
+		if cp.AllTables != wp.AllTables {
+			actions.drop = append(actions.drop, cp.Name)
+			actions.create = append(actions.create, wp)
+			continue
+		}
+		if !wp.AllTables && !util.CompareStringSliceNoOrder(cp.Tables, wp.Tables) {
+			actions.setTables = append(actions.setTables, wp)
+		}
+	}
+
+	for _, wp := range wantedPubs {
+		if _, ok := cur[wp.Name]; !ok {
+			actions.create = append(actions.create, wanted[wp.Name])
+		}
+	}
+
+	sort.Strings(actions.drop)
+	sort.Slice(actions.create, func(i, j int) bool { return actions.create[i].Name < actions.create[j].Name })
+	sort.Slice(actions.setTables, func(i, j int) bool { return actions.setTables[i].Name < actions.setTables[j].Name })
+
+	return actions
+}
+
+func (p *PostgresKeeper) refreshPublications(db *cluster.DB) error {
+	// publications are available only on postgres >= 10
+	maj, _, err := p.pgm.PGDataVersion()
+	if err != nil {
+		return err
+	}
+	if maj < 10 {
+		if len(db.Spec.Publications) > 0 {
+			log.Warnw("publications are not supported on postgres < 10, ignoring them")
+		}
+		return nil
+	}
+
+	wantedPubs := map[string][]cluster.Publication{}
+	for _, pub := range db.Spec.Publications {
+		wantedPubs[pub.DefDatabase()] = append(wantedPubs[pub.DefDatabase()], pub)
+	}
+	// no publications defined and no stolon publications left to drop
+	if len(wantedPubs) == 0 && p.publicationsDatabases != nil && len(p.publicationsDatabases) == 0 {
+		return nil
+	}
+
+	databases, err := p.pgm.GetDatabases()
+	if err != nil {
+		return err
+	}
+	pubsDatabases := []string{}
+	for database := range wantedPubs {
+		if !util.StringInSlice(databases, database) {
+			log.Warnw("database of defined publications doesn't exist", "database", database)
+			continue
+		}
+		pubsDatabases = append(pubsDatabases, database)
+	}
+	sort.Strings(pubsDatabases)
+
+	// after the first check of all the databases only the databases with
+	// defined publications or with stolon publications to drop are checked
+	checkDatabases := databases
+	if p.publicationsDatabases != nil {
+		checkDatabases = []string{}
+		for _, database := range databases {
+			if util.StringInSlice(pubsDatabases, database) || util.StringInSlice(p.publicationsDatabases, database) {
+				checkDatabases = append(checkDatabases, database)
+			}
+		}
 	}
 
-	if err := pgm.SyncFromFollowed(replConnParams, replSlot); err != nil {
-		return fmt.Errorf("sync error: %v", err)
+	for _, database := range checkDatabases {
+		curPubs, err := p.pgm.GetPublications(database)
+		if err != nil {
+			return err
+		}
+		actions := diffPublications(curPubs, wantedPubs[database])
+		for _, name := range actions.drop {
+			log.Infow("dropping publication", "database", database, "publication", name)
+			if err := p.pgm.DropPublication(database, name); err != nil {
+				return err
+			}
+		}
+		for _, pub := range actions.create {
+			log.Infow("creating publication", "database", database, "publication", pub.Name)
+			if err := p.pgm.CreatePublication(database, pub); err != nil {
+				return err
+			}
+		}
+		for _, pub := range actions.setTables {
+			log.Infow("updating publication tables", "database", database, "publication", pub.Name, "tables", pub.Tables)
+			if err := p.pgm.SetPublicationTables(database, pub.Name, pub.Tables); err != nil {
+				return err
+			}
+		}
 	}
-	log.Infow("sync succeeded")
-
-	pgm.SetRecoveryParameters(p.createRecoveryParameters(true, standbySettings, nil, nil))
-
+	p.publicationsDatabases = pubsDatabases
 	return nil
 }
 
-// TODO(sgotti) unify this with the sentinel one. They have the same logic but one uses *cluster.PostgresState while the other *cluster.DB
-func (p *PostgresKeeper) isDifferentTimelineBranch(followedDB *cluster.DB, pgState *cluster.PostgresState) bool {
-	if followedDB.Status.TimelineID < pgState.TimelineID {
-		log.Infow("followed instance timeline < than our timeline", "followedTimeline", followedDB.Status.TimelineID, "timeline", pgState.TimelineID)
-		return true
+type logicalReplSlotsActions struct {
+	drop   []*pg.LogicalReplicationSlotStatus
+	create []cluster.LogicalReplicationSlot
+}
+
+// diffLogicalReplSlots returns the actions needed to converge the current
+// logical replication slots to the wanted ones. Slots not starting with
+// "stolon_" are never dropped. A slot with a different database or plugin is
+// recreated.
+func diffLogicalReplSlots(curSlots []*pg.LogicalReplicationSlotStatus, wantedSlots []cluster.LogicalReplicationSlot) *logicalReplSlotsActions {
+	actions := &logicalReplSlotsActions{}
+
+	wanted := map[string]cluster.LogicalReplicationSlot{}
+	for _, ws := range wantedSlots {
+		wanted[common.StolonName(ws.Name)] = ws
 	}
 
-	// if the timelines are the same check that also the switchpoints are the same.
-	if followedDB.Status.TimelineID == pgState.TimelineID {
-		if pgState.TimelineID <= 1 {
-			// if timeline <= 1 then no timeline history file exists.
-			return false
+	cur := map[string]struct{}{}
+	for _, cs := range curSlots {
+		if !common.IsStolonName(cs.Name) {
+			continue
 		}
-		ftlh := followedDB.Status.TimelinesHistory.GetTimelineHistory(pgState.TimelineID - 1)
-		tlh := pgState.TimelinesHistory.GetTimelineHistory(pgState.TimelineID - 1)
-		if ftlh == nil || tlh == nil {
-			// No timeline history to check
-			return false
+		cur[cs.Name] = struct{}{}
+		ws, ok := wanted[cs.Name]
+		if !ok {
+			actions.drop = append(actions.drop, cs)
+			continue
 		}
-		if ftlh.SwitchPoint == tlh.SwitchPoint {
-			return false
+		if cs.Database != ws.DefDatabase() || cs.Plugin != ws.DefPlugin() {
+			actions.drop = append(actions.drop, cs)
+			actions.create = append(actions.create, ws)
 		}
-		log.Infow("followed instance timeline forked at a different xlog pos than our timeline", "followedTimeline", followedDB.Status.TimelineID, "followedXlogpos", ftlh.SwitchPoint, "timeline", pgState.TimelineID, "xlogpos", tlh.SwitchPoint)
-		return true
 	}
 
-	// followedDB.Status.TimelineID > pgState.TimelineID
-	ftlh := followedDB.Status.TimelinesHistory.GetTimelineHistory(pgState.TimelineID)
-	if ftlh != nil {
-		if ftlh.SwitchPoint < pgState.XLogPos {
-			log.Infow("followed instance timeline forked before our current state", "followedTimeline", followedDB.Status.TimelineID, "followedXlogpos", ftlh.SwitchPoint, "timeline", pgState.TimelineID, "xlogpos", pgState.XLogPos)
-			return true
+	for _, ws := range wantedSlots {
+		if _, ok := cur[common.StolonName(ws.Name)]; !ok {
+			actions.create = append(actions.create, ws)
 		}
 	}
-	return false
-}
-
-func (p *PostgresKeeper) updateReplSlots(curReplSlots []string, uid string, followersUIDs, additionalReplSlots []string) error {
-	internalReplSlots := map[string]struct{}{}
 
-	// Create a list of the wanted internal replication slots
-	for _, followerUID := range followersUIDs {
-		if followerUID == uid {
-			continue
-		}
-		internalReplSlots[common.StolonName(followerUID)] = struct{}{}
-	}
+	sort.Slice(actions.drop, func(i, j int) bool { return actions.drop[i].Name < actions.drop[j].Name })
+	sort.Slice(actions.create, func(i, j int) bool { return actions.create[i].Name < actions.create[j].Name })
 
-	// Add AdditionalReplicationSlots
-	for _, slot := range additionalReplSlots {
-		internalReplSlots[common.StolonName(slot)] = struct{}{}
-	}
+	return actions
+}
 
-	// Drop internal replication slots
-	for _, slot := range curReplSlots {
-		if !common.IsStolonName(slot) {
+// logicalReplSlotsAdvances returns, for every current stolon logical
+// replication slot, the position to advance it to: the position confirmed
+// on the master when greater than the current one.
+func logicalReplSlotsAdvances(curSlots []*pg.LogicalReplicationSlotStatus, masterSlots []*cluster.LogicalReplicationSlotStatus) map[string]uint64 {
+	advances := map[string]uint64{}
+	for _, cs := range curSlots {
+		if !common.IsStolonName(cs.Name) {
 			continue
 		}
-		if _, ok := internalReplSlots[slot]; !ok {
-			log.Infow("dropping replication slot", "slot", slot)
-			if err := p.pgm.DropReplicationSlot(slot); err != nil {
-				log.Errorw("failed to drop replication slot", "slot", slot, "err", err)
-				// don't return the error but continue also if drop failed (standby still connected)
+		for _, ms := range masterSlots {
+			if ms.Name == cs.Name && ms.Database == cs.Database && ms.Plugin == cs.Plugin && ms.ConfirmedFlushLSN > cs.ConfirmedFlushLSN {
+				advances[cs.Name] = ms.ConfirmedFlushLSN
 			}
 		}
 	}
+	return advances
+}
 
-	// Create internal replication slots
-	for slot := range internalReplSlots {
-		if !util.StringInSlice(curReplSlots, slot) {
-			log.Infow("creating replication slot", "slot", slot)
-			if err := p.pgm.CreateReplicationSlot(slot); err != nil {
-				log.Errorw("failed to create replication slot", "slot", slot, zap.Error(err))
-				return err
+// refreshLogicalReplSlots converges the instance logical replication slots
+// to the db spec ones. On a standby, since logical decoding on standbys
+// requires postgres >= 16, they're managed only on these versions and
+// advanced to the position confirmed by their consumers on the master, so
+// after a promotion the consumers can continue from there (receiving again
+// the changes after the last position reported by the master keeper).
+func (p *PostgresKeeper) refreshLogicalReplSlots(cd *cluster.ClusterData, db *cluster.DB) error {
+	p.setLogicalReplSlots(len(db.Spec.LogicalReplicationSlots) > 0)
+	maj, _, err := p.pgm.PGDataVersion()
+	if err != nil {
+		return err
+	}
+	standby := db.Spec.Role == common.RoleStandby
+	if maj < 10 || (standby && maj < 16) {
+		if len(db.Spec.LogicalReplicationSlots) > 0 {
+			if standby {
+				log.Warnw("logical replication slots on standbys are not supported on postgres < 16, ignoring them")
+			} else {
+				log.Warnw("logical replication slots are not supported on postgres < 10, ignoring them")
 			}
 		}
+		return nil
 	}
-	return nil
-}
 
-func (p *PostgresKeeper) refreshReplicationSlots(cd *cluster.ClusterData, db *cluster.DB) error {
-	var currentReplicationSlots []string
-	currentReplicationSlots, err := p.pgm.GetReplicationSlots()
+	curSlots, err := p.pgm.GetLogicalReplicationSlots()
 	if err != nil {
-		log.Errorw("failed to get replication slots", zap.Error(err))
 		return err
 	}
+	actions := diffLogicalReplSlots(curSlots, db.Spec.LogicalReplicationSlots)
 
-	followersUIDs := db.Spec.Followers
+	for _, s := range actions.drop {
+		log.Infow("dropping logical replication slot", "slot", s.Name, "database", s.Database)
+		if err := p.pgm.DropLogicalReplicationSlot(s.Database, s.Name); err != nil {
+			log.Errorw("failed to drop logical replication slot", "slot", s.Name, zap.Error(err))
+			// continue also if drop failed (consumer still connected)
+		}
+	}
 
-	if err = p.updateReplSlots(currentReplicationSlots, db.UID, followersUIDs, db.Spec.AdditionalReplicationSlots); err != nil {
-		log.Errorw("error updating replication slots", zap.Error(err))
-		return err
+	var masterDB *cluster.DB
+	if standby {
+		masterDB = cd.DBs[cd.Cluster.Status.Master]
+	}
+	if len(actions.create) > 0 && masterDB != nil {
+		// creating a logical slot on a standby waits for a snapshot of the
+		// master running transactions, write it now
+		ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+		err := pg.LogStandbySnapshot(ctx, p.getSUConnParams(db, masterDB))
+		cancel()
+		if err != nil {
+			log.Warnw("failed to write standby snapshot on master", zap.Error(err))
+		}
+	}
+	for _, s := range actions.create {
+		name := common.StolonName(s.Name)
+		log.Infow("creating logical replication slot", "slot", name, "database", s.DefDatabase(), "plugin", s.DefPlugin())
+		if err := p.pgm.CreateLogicalReplicationSlot(s.DefDatabase(), name, s.DefPlugin()); err != nil {
+			return fmt.Errorf("failed to create logical replication slot %q: %v", name, err)
+		}
 	}
 
+	if masterDB == nil {
+		return nil
+	}
+	if len(actions.create) > 0 {
+		if curSlots, err = p.pgm.GetLogicalReplicationSlots(); err != nil {
+			return err
+		}
+	}
+	advances := logicalReplSlotsAdvances(curSlots, masterDB.Status.LogicalReplicationSlots)
+	for _, s := range curSlots {
+		lsn, ok := advances[s.Name]
+		if !ok {
+			continue
+		}
+		log.Debugw("advancing logical replication slot", "slot", s.Name, "lsn", pg.PGLsn(lsn))
+		if err := p.pgm.AdvanceReplicationSlot(s.Database, s.Name, lsn); err != nil {
+			return fmt.Errorf("failed to advance logical replication slot %q: %v", s.Name, err)
+		}
+	}
 	return nil
 }
 
 func (p *PostgresKeeper) postgresKeeperSM(pctx context.Context) {
-	e := p.e
+	e := p.store()
 	pgm := p.pgm
 
+	p.smMutex.Lock()
+	defer p.smMutex.Unlock()
+
+	// an execution, with an assigned db, returning before saving the db
+	// generation hasn't converged the db to its spec
+	dbAssigned := false
+	converged := false
+	defer func() {
+		if dbAssigned && !converged {
+			p.updateMetrics(func(m *keeperMetrics) { m.convergenceErrors++ })
+		}
+	}()
+
+	if fencing, _ := p.getFencingState(); fencing {
+		log.Infow("keeper fenced, not managing the db")
+		return
+	}
+	if r := p.getRemoval(); r != nil && r.Completed {
+		log.Infow("keeper removed from the cluster, not managing any db")
+		return
+	}
+
 	cd, _, err := e.GetClusterData(pctx)
 	if err != nil {
-		log.Errorw("error retrieving cluster data", zap.Error(err))
+		log.Errorw("error retrieving cluster data", zap.Error(err), slog.Event(slog.EventStoreConnectionLost))
 		return
 	}
 	log.Debugf("cd dump: %s", spew.Sdump(cd))
@@ -959,6 +2787,9 @@ func (p *PostgresKeeper) postgresKeeperSM(pctx context.Context) {
 	if cd.Cluster != nil {
 		p.sleepInterval = cd.Cluster.DefSpec().SleepInterval.Duration
 		p.requestTimeout = cd.Cluster.DefSpec().RequestTimeout.Duration
+		slog.SetClusterUID(cd.Cluster.UID)
+		spec := cd.Cluster.DefSpec()
+		pgm.SetPGCtlOptions(string(*spec.PGStopMode), spec.PGStopTimeout.Duration, spec.PGPromoteTimeout.Duration)
 
 		if p.keeperLocalState.ClusterUID != cd.Cluster.UID {
 			p.keeperLocalState.ClusterUID = cd.Cluster.UID
@@ -975,9 +2806,30 @@ func (p *PostgresKeeper) postgresKeeperSM(pctx context.Context) {
 		return
 	}
 
+	if k.Spec != nil && k.Spec.Removal != nil {
+		p.handleRemoval(k.Spec.Removal)
+		return
+	}
+
+	// in maintenance mode postgres is left as it is (also if stopped or
+	// changed by the operator)
+	if k.Spec != nil && k.Spec.Maintenance {
+		log.Infow("keeper in maintenance mode, skipping db convergence")
+		return
+	}
+
+	if err := p.switchPGBinPath(pctx, k, cd.FindDB(k)); err != nil {
+		log.Errorw("cannot switch the postgres binaries, keeping the current ones", zap.Error(err))
+	}
+
 	db := cd.FindDB(k)
 	if db == nil {
 		log.Infow("no db assigned")
+		p.updateMetrics(func(m *keeperMetrics) {
+			m.role = common.RoleUndefined
+			m.dbReady = false
+		})
+		p.publishRole(common.RoleUndefined)
 		if err = pgm.StopIfStarted(true); err != nil {
 			log.Errorw("failed to stop pg instance", zap.Error(err))
 		}
@@ -992,8 +2844,48 @@ func (p *PostgresKeeper) postgresKeeperSM(pctx context.Context) {
 		return
 	}
 
+	// after the unfencing wait for the sentinel to update the cluster data
+	// (i.e. electing a new master) or we could start the db with its
+	// previous master role
+	if k.Status.Fenced {
+		log.Infow("our keeper is still fenced in the cluster data, waiting for it to be updated")
+		if err = pgm.StopIfStarted(true); err != nil {
+			log.Errorw("failed to stop pg instance", zap.Error(err))
+		}
+		return
+	}
+
+	if p.checksumsVerificationDue(cd, db, time.Now()) {
+		p.verifyChecksums(pctx, cd, db)
+		return
+	}
+
+	dbAssigned = true
+	p.smSpan = p.startConvergenceSpan(cd, db)
+	defer func() {
+		p.smSpan.SetAttributes(tracing.Bool("stolon.db.converged", converged))
+		p.smSpan.End()
+		p.smSpan = nil
+	}()
+	p.updateMetrics(func(m *keeperMetrics) {
+		m.role = db.Spec.Role
+		m.dbReady = db.Status.Ready
+		m.masterXLogPos = 0
+		if masterDB, ok := cd.DBs[cd.Cluster.Status.Master]; ok {
+			m.masterXLogPos = masterDB.Status.XLogPos
+		}
+	})
+	p.publishRole(db.Spec.Role)
+
+	p.handleBackup(pctx, cd, db)
+
+	if err := p.applyPendingPasswords(cd, db.Spec.Role); err != nil {
+		log.Errorw("failed to apply the rotated passwords", zap.Error(err))
+	}
+
 	// Dynamicly generate hba auth from clusterData
 	pgm.SetHba(p.generateHBA(cd, db))
+	pgm.SetIdent(generateIdent(db))
 
 	var pgParameters common.Parameters
 
@@ -1036,6 +2928,15 @@ func (p *PostgresKeeper) postgresKeeperSM(pctx context.Context) {
 
 		pgm.SetRecoveryParameters(nil)
 
+		if db.Spec.Role == common.RoleMaster {
+			switch db.Spec.InitMode {
+			case cluster.DBInitModeNew, cluster.DBInitModeExisting, cluster.DBInitModePITR:
+				if !p.validateMasterRole(db) {
+					return
+				}
+			}
+		}
+
 		switch db.Spec.InitMode {
 		case cluster.DBInitModeNew:
 			log.Infow("initializing the database cluster")
@@ -1061,6 +2962,7 @@ func (p *PostgresKeeper) postgresKeeperSM(pctx context.Context) {
 				initConfig.Locale = db.Spec.NewConfig.Locale
 				initConfig.Encoding = db.Spec.NewConfig.Encoding
 				initConfig.DataChecksums = db.Spec.NewConfig.DataChecksums
+				initConfig.WalDir = db.Spec.NewConfig.WalDir
 			}
 
 			if err = pgm.StopIfStarted(true); err != nil {
@@ -1103,6 +3005,11 @@ func (p *PostgresKeeper) postgresKeeperSM(pctx context.Context) {
 				return
 			}
 
+			if err = p.runPostInitHook(cd, db, pgm); err != nil {
+				log.Errorw("post init hook failed", zap.Error(err))
+				return
+			}
+
 			if err = pgm.StopIfStarted(true); err != nil {
 				log.Errorw("failed to stop pg instance", zap.Error(err))
 				return
@@ -1143,7 +3050,7 @@ func (p *PostgresKeeper) postgresKeeperSM(pctx context.Context) {
 			var standbySettings *cluster.StandbySettings
 			if db.Spec.FollowConfig != nil && db.Spec.FollowConfig.Type == cluster.FollowTypeExternal {
 				standbyMode = true
-				standbySettings = db.Spec.FollowConfig.StandbySettings
+				standbySettings = p.externalStandbySettings(db.Spec.FollowConfig.StandbySettings)
 			}
 
 			// if we are initializing a standby cluster then enable standby_mode to not stop recovery
@@ -1202,6 +3109,16 @@ func (p *PostgresKeeper) postgresKeeperSM(pctx context.Context) {
 				return
 			}
 
+			// an initialized master instance resynced as a standby (i.e. an
+			// old master rejoining the cluster) has been demoted
+			if initialized {
+				if localRole, err := pgm.GetRole(); err != nil {
+					log.Errorw("error retrieving current pg role", zap.Error(err))
+				} else if localRole == common.RoleMaster {
+					p.runRoleChangeHooks(roleChangeEventDemote, db, common.RoleStandby)
+				}
+			}
+
 			// create postgres parameteres with empty InitPGParameters
 			pgParameters = p.createPGParameters(db)
 			// update pgm postgres parameters
@@ -1233,6 +3150,12 @@ func (p *PostgresKeeper) postgresKeeperSM(pctx context.Context) {
 				tryPgrewind = false
 			}
 
+			// An initialized instance without a db local state (a data dir
+			// prepared ahead of time or taken over from a replaced keeper)
+			// of the same cluster of the followed db is adopted as is. If
+			// it cannot follow the followed db it'll be fully resynced.
+			adopt := dbls.UID == "" && initialized && systemID == followedDB.Status.SystemID
+
 			// TODO(sgotti) pg_rewind considers databases on the same timeline
 			// as in sync and doesn't check if they diverged at different
 			// position in previous timelines.
@@ -1246,21 +3169,27 @@ func (p *PostgresKeeper) postgresKeeperSM(pctx context.Context) {
 			// wals and we'll force a full resync.
 			// We have to find a better way to detect if a standby is waiting
 			// for unavailable wals.
-			if err = p.resync(db, followedDB, tryPgrewind); err != nil {
+			if adopt {
+				log.Infow("adopting the existing database cluster without resyncing it", "followedDB", followedDB.UID, "keeper", followedDB.Spec.KeeperUID)
+				standbySettings := internalStandbySettings(db, p.getReplConnParams(db, followedDB))
+				pgm.SetRecoveryParameters(p.createRecoveryParameters(true, standbySettings, internalArchiveRecoverySettings(db), nil))
+			} else if err = p.resync(db, followedDB, tryPgrewind); err != nil {
 				log.Errorw("failed to resync from followed instance", zap.Error(err))
 				return
 			}
 			if err = pgm.Start(); err != nil {
+				// the db local state is still initializing so the data dir will
+				// be removed and fully resynced at the next check
 				log.Errorw("failed to start instance", zap.Error(err))
 				return
 			}
 
-			if tryPgrewind {
+			if tryPgrewind || adopt {
 				fullResync := false
 				// if not accepting connection assume that it's blocked waiting for missing wal
 				// (see above TODO), so do a full resync using pg_basebackup.
 				if err = pgm.WaitReady(cluster.DefaultDBWaitReadyTimeout); err != nil {
-					log.Errorw("pg_rewinded standby is not accepting connection. it's probably waiting for unavailable wals. Forcing a full resync")
+					log.Errorw("pg_rewinded or adopted standby is not accepting connection. it's probably waiting for unavailable wals. Forcing a full resync")
 					fullResync = true
 				} else {
 					// Check again if it was really synced
@@ -1377,13 +3306,17 @@ func (p *PostgresKeeper) postgresKeeperSM(pctx context.Context) {
 		}
 	}
 
+	if err := p.checkChannelBinding(db); err != nil {
+		log.Errorw("cannot require channel binding", zap.Error(err))
+	}
+
 	targetRole := db.Spec.Role
 	log.Debugw("target role", "targetRole", string(targetRole))
 
 	switch targetRole {
 	case common.RoleMaster:
 		// We are the elected master
-		log.Infow("our db requested role is master")
+		log.Infow("our db requested role is master", roleChangeEvent(db, localRole)...)
 		if localRole == common.RoleUndefined {
 			log.Errorw("database cluster not initialized but requested role is master. This shouldn't happen!")
 			return
@@ -1393,6 +3326,9 @@ func (p *PostgresKeeper) postgresKeeperSM(pctx context.Context) {
 			log.Errorw("failed to retrieve instance status", zap.Error(err))
 			return
 		}
+		if p.refuseOldPrimary(cd, db, pgm, started) {
+			return
+		}
 		if !started {
 			if err = pgm.Start(); err != nil {
 				log.Errorw("failed to start postgres", zap.Error(err))
@@ -1405,12 +3341,20 @@ func (p *PostgresKeeper) postgresKeeperSM(pctx context.Context) {
 		}
 
 		if localRole == common.RoleStandby {
-			log.Infow("promoting to master")
+			if !p.validateMasterRole(db) || !p.runPrePromotionHook(cd, db) {
+				return
+			}
+			log.Infow("promoting to master", slog.Event(slog.EventPromotion, "db", db.UID))
 			pgm.SetRecoveryParameters(nil)
-			if err = pgm.Promote(); err != nil {
+			promoteSpan := p.smSpan.Child("keeper.promote")
+			err = pgm.Promote()
+			promoteSpan.SetError(err)
+			promoteSpan.End()
+			if err != nil {
 				log.Errorw("failed to promote instance", zap.Error(err))
 				return
 			}
+			p.runRoleChangeHooks(roleChangeEventPromote, db, common.RoleMaster)
 		} else {
 			log.Infow("already master")
 		}
@@ -1420,22 +3364,47 @@ func (p *PostgresKeeper) postgresKeeperSM(pctx context.Context) {
 			return
 		}
 
+		if err := p.refreshPublications(db); err != nil {
+			log.Errorw("error updating publications", zap.Error(err))
+		}
+
+		if err := p.refreshLogicalReplSlots(cd, db); err != nil {
+			log.Errorw("error updating logical replication slots", zap.Error(err))
+		}
+
+		if err := p.refreshMonitoringRole(db); err != nil {
+			log.Errorw("error updating monitoring role", zap.Error(err))
+		}
+
+		if err := p.refreshExtensions(db); err != nil {
+			log.Errorw("error updating extensions", zap.Error(err))
+		}
+
+		if db.Spec.RequireChannelBinding || p.useScramAuth() {
+			if err := pgm.SetupScramPasswords(); err != nil {
+				log.Errorw("error setting up scram passwords", zap.Error(err))
+			}
+		}
+
 	case common.RoleStandby:
 		// We are a standby
+		// a previously declined master role isn't requested anymore
+		p.setDeclinedMasterDBUID("")
+		p.setTimelineDivergence(nil)
 		var standbySettings *cluster.StandbySettings
 		switch db.Spec.FollowConfig.Type {
 		case cluster.FollowTypeInternal:
 			followedUID := db.Spec.FollowConfig.DBUID
-			log.Infow("our db requested role is standby", "followedDB", followedUID)
+			log.Infow("our db requested role is standby", append([]interface{}{"followedDB", followedUID}, roleChangeEvent(db, localRole)...)...)
 			followedDB, ok := cd.DBs[followedUID]
 			if !ok {
 				log.Errorw("no db data available for followed db", "followedDB", followedUID)
 				return
 			}
 			replConnParams := p.getReplConnParams(db, followedDB)
-			standbySettings = &cluster.StandbySettings{PrimaryConninfo: replConnParams.ConnString(), PrimarySlotName: common.StolonName(db.UID)}
+			standbySettings = internalStandbySettings(db, replConnParams)
 		case cluster.FollowTypeExternal:
-			standbySettings = db.Spec.FollowConfig.StandbySettings
+			standbySettings = p.externalStandbySettings(db.Spec.FollowConfig.StandbySettings)
 		default:
 			log.Errorw("unknown follow type", "followType", string(db.Spec.FollowConfig.Type))
 			return
@@ -1452,7 +3421,7 @@ func (p *PostgresKeeper) postgresKeeperSM(pctx context.Context) {
 				return
 			}
 			if !started {
-				pgm.SetRecoveryParameters(p.createRecoveryParameters(true, standbySettings, nil, nil))
+				pgm.SetRecoveryParameters(p.createRecoveryParameters(true, standbySettings, internalArchiveRecoverySettings(db), nil))
 				if err = pgm.Start(); err != nil {
 					log.Errorw("failed to start postgres", zap.Error(err))
 					return
@@ -1471,10 +3440,10 @@ func (p *PostgresKeeper) postgresKeeperSM(pctx context.Context) {
 				newReplConnParams := p.getReplConnParams(db, followedDB)
 				log.Debugw("newReplConnParams", "newReplConnParams", newReplConnParams)
 
-				standbySettings := &cluster.StandbySettings{PrimaryConninfo: newReplConnParams.ConnString(), PrimarySlotName: common.StolonName(db.UID)}
+				standbySettings := internalStandbySettings(db, newReplConnParams)
 
 				curRecoveryParameters := pgm.CurRecoveryParameters()
-				newRecoveryParameters := p.createRecoveryParameters(true, standbySettings, nil, nil)
+				newRecoveryParameters := p.createRecoveryParameters(true, standbySettings, internalArchiveRecoverySettings(db), nil)
 
 				// Update recovery conf if parameters has changed
 				if !curRecoveryParameters.Equals(newRecoveryParameters) {
@@ -1491,9 +3460,13 @@ func (p *PostgresKeeper) postgresKeeperSM(pctx context.Context) {
 					log.Errorw("error updating replication slots", zap.Error(err))
 				}
 
+				if err = p.refreshLogicalReplSlots(cd, db); err != nil {
+					log.Errorw("error updating logical replication slots", zap.Error(err))
+				}
+
 			case cluster.FollowTypeExternal:
 				curRecoveryParameters := pgm.CurRecoveryParameters()
-				newRecoveryParameters := p.createRecoveryParameters(true, db.Spec.FollowConfig.StandbySettings, db.Spec.FollowConfig.ArchiveRecoverySettings, nil)
+				newRecoveryParameters := p.createRecoveryParameters(true, standbySettings, db.Spec.FollowConfig.ArchiveRecoverySettings, nil)
 
 				// Update recovery conf if parameters has changed
 				if !curRecoveryParameters.Equals(newRecoveryParameters) {
@@ -1516,7 +3489,7 @@ func (p *PostgresKeeper) postgresKeeperSM(pctx context.Context) {
 			return
 		}
 	case common.RoleUndefined:
-		log.Infow("our db requested role is none")
+		log.Infow("our db requested role is none", roleChangeEvent(db, localRole)...)
 		return
 	}
 
@@ -1558,20 +3531,77 @@ func (p *PostgresKeeper) postgresKeeperSM(pctx context.Context) {
 		log.Infow("postgres hba entries not changed")
 	}
 
+	newIdent := generateIdent(db)
+	if !reflect.DeepEqual(newIdent, pgm.CurIdent()) {
+		log.Infow("postgres ident entries changed, reloading postgres instance")
+		pgm.SetIdent(newIdent)
+		needsReload = true
+	}
+
+	// postgres reads its server certificate only at start and reload
+	if certFile, keyFile, ok := sslCertFiles(pgParameters, filepath.Join(p.dataDir, "postgres")); ok {
+		changed, err := p.sslCertWatcher.changed(certFile, keyFile)
+		if err != nil {
+			log.Errorw("cannot check postgres server certificate files", zap.Error(err))
+		} else if changed {
+			log.Infow("postgres server certificate changed, reloading postgres instance", "certFile", certFile, "keyFile", keyFile)
+			needsReload = true
+		}
+	}
+
 	if needsReload {
 		if err := pgm.Reload(); err != nil {
 			log.Errorw("failed to reload postgres instance", err)
 		}
 	}
 
+	// drain the master, after rejecting the new connections with the
+	// reloaded hba, when requested during a switchover
+	p.handleGracefulDemotion(db)
+
+	// restart after applying the parameters so the ones requiring a restart
+	// are also applied
+	if db.Spec.RestartRequest > p.dbLocalStateCopy().RestartRequest {
+		log.Infow("restarting postgres instance as requested", "restartRequest", db.Spec.RestartRequest)
+		if err := pgm.Restart(true); err != nil {
+			log.Errorw("failed to restart postgres instance", zap.Error(err))
+			return
+		}
+	}
+
 	// If we are here, then all went well and we can update the db generation and save it locally
 	ndbls := p.dbLocalStateCopy()
 	ndbls.Generation = db.Generation
+	ndbls.RestartRequest = db.Spec.RestartRequest
 	ndbls.Initializing = false
 	if err := p.saveDBLocalState(ndbls); err != nil {
 		log.Errorw("failed to save db local state", zap.Error(err))
 		return
 	}
+	converged = true
+}
+
+// startConvergenceSpan starts the span of a state machine execution when the
+// db hasn't converged to its spec generation. It's in the trace of the
+// cluster data proxy generation.
+func (p *PostgresKeeper) startConvergenceSpan(cd *cluster.ClusterData, db *cluster.DB) *tracing.Span {
+	if p.tracer == nil || p.dbLocalStateCopy().Generation == db.Generation {
+		return nil
+	}
+	var generation int64
+	if cd.Proxy != nil {
+		generation = cd.Proxy.Generation
+	}
+	span := p.tracer.Start("keeper.converge",
+		tracing.String("stolon.cluster.uid", cd.Cluster.UID),
+		tracing.Int64("stolon.proxy.generation", generation),
+		tracing.String("stolon.keeper.uid", p.keeperLocalState.UID),
+		tracing.String("stolon.db.uid", db.UID),
+		tracing.Int64("stolon.db.generation", db.Generation),
+		tracing.String("stolon.db.role", string(db.Spec.Role)),
+	)
+	span.SetTraceID(tracing.GenerationTraceID(cd.Cluster.UID, generation))
+	return span
 }
 
 func (p *PostgresKeeper) keeperLocalStateFilePath() string {
@@ -1653,13 +3683,56 @@ func IsMaster(db *cluster.DB) bool {
 	}
 }
 
+// generateIdent generates the instance pg_ident.conf entries. It returns nil,
+// leaving pg_ident.conf untouched, when the db spec doesn't define them.
+func generateIdent(db *cluster.DB) []string {
+	if db.Spec.PGIdent == nil {
+		return nil
+	}
+	ident := []string{}
+	for _, m := range db.Spec.PGIdent {
+		ident = append(ident, m.String())
+	}
+	return ident
+}
+
+// hbaAddress returns the pg_hba address field matching only the provided
+// address: a single host CIDR (/32 for IPv4 and /128 for IPv6) when it's an IP
+// address, or the address itself when it's an host name.
+func hbaAddress(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return address
+	}
+	if ip.To4() != nil {
+		return address + "/32"
+	}
+	return address + "/128"
+}
+
+// hostHBAEntry returns the pg_hba.conf host entry for the superuser or
+// replication user. When the db spec requires channel binding the entry
+// matches only ssl connections and uses scram-sha-256 authentication.
+func hostHBAEntry(db *cluster.DB, database, user, address, method string) string {
+	connType := "host"
+	if db.Spec.RequireChannelBinding {
+		connType = "hostssl"
+		if method != "trust" {
+			method = "scram-sha-256"
+		}
+	}
+	return fmt.Sprintf("%s %s %s %s %s", connType, database, user, address, method)
+}
+
 // generateHBA generates the instance hba entries depending on the value of DefaultSUReplAccessMode.
 func (p *PostgresKeeper) generateHBA(cd *cluster.ClusterData, db *cluster.DB) []string {
 	// Minimal entries for local normal and replication connections needed by the stolon keeper
-	// Matched local connections are for postgres database and suUsername user with md5 auth
+	// Matched local connections are for all the databases (the keeper also manages
+	// publications, logical replication slots and extensions in the app databases)
+	// and suUsername user with md5 auth
 	// Matched local replication connections are for replUsername user with md5 auth
 	computedHBA := []string{
-		fmt.Sprintf("local postgres %s %s", p.pgSUUsername, p.pgSUAuthMethod),
+		fmt.Sprintf("local all %s %s", p.pgSUUsername, p.suLocalAuthMethod()),
 		fmt.Sprintf("local replication %s %s", p.pgReplUsername, p.pgReplAuthMethod),
 	}
 
@@ -1668,34 +3741,60 @@ func (p *PostgresKeeper) generateHBA(cd *cluster.ClusterData, db *cluster.DB) []
 		// all the keepers will accept connections from every host
 		computedHBA = append(
 			computedHBA,
-			fmt.Sprintf("host all %s %s %s", p.pgSUUsername, "0.0.0.0/0", p.pgSUAuthMethod),
-			fmt.Sprintf("host all %s %s %s", p.pgSUUsername, "::0/0", p.pgSUAuthMethod),
-			fmt.Sprintf("host replication %s %s %s", p.pgReplUsername, "0.0.0.0/0", p.pgReplAuthMethod),
-			fmt.Sprintf("host replication %s %s %s", p.pgReplUsername, "::0/0", p.pgReplAuthMethod),
+			hostHBAEntry(db, "all", p.pgSUUsername, "0.0.0.0/0", p.pgSUAuthMethod),
+			hostHBAEntry(db, "all", p.pgSUUsername, "::0/0", p.pgSUAuthMethod),
+			hostHBAEntry(db, "replication", p.pgReplUsername, "0.0.0.0/0", p.pgReplAuthMethod),
+			hostHBAEntry(db, "replication", p.pgReplUsername, "::0/0", p.pgReplAuthMethod),
 		)
 	case cluster.SUReplAccessStrict:
 		// only the master keeper (primary instance or standby of a remote primary when in standby cluster mode) will accept connections only from the other standby keepers IPs
 		if IsMaster(db) {
 			addresses := []string{}
 			for _, dbElt := range cd.DBs {
-				if dbElt.UID != db.UID {
-					addresses = append(addresses, dbElt.Status.ListenAddress)
+				if dbElt.UID == db.UID {
+					continue
+				}
+				// dbs without a reported listen address are skipped or
+				// we'll generate a malformed hba entry. All the advertised
+				// addresses are accepted since the standby could connect
+				// from any of them.
+				for _, address := range dbElt.Status.AdvertisedAddresses() {
+					addresses = append(addresses, hbaAddress(address))
 				}
 			}
 			sort.Sort(sort.StringSlice(addresses))
+			// the superuser host entries are needed only by pg_rewind. When
+			// the keeper uses password-less local connections and pg_rewind
+			// is disabled don't generate them.
+			suHostAccess := isPasswordAuthMethod(p.suLocalAuthMethod()) || *cd.Cluster.DefSpec().UsePgrewind
 			for _, address := range addresses {
-				computedHBA = append(
-					computedHBA,
-					fmt.Sprintf("host all %s %s/32 %s", p.pgSUUsername, address, p.pgReplAuthMethod),
-					fmt.Sprintf("host replication %s %s/32 %s", p.pgReplUsername, address, p.pgReplAuthMethod),
-				)
+				if suHostAccess {
+					computedHBA = append(computedHBA, hostHBAEntry(db, "all", p.pgSUUsername, address, p.pgSUAuthMethod))
+				}
+				computedHBA = append(computedHBA, hostHBAEntry(db, "replication", p.pgReplUsername, address, p.pgReplAuthMethod))
 			}
 		}
 	}
 
+	// while draining the master before a switchover only the stolon
+	// superuser and replication connections are accepted
+	if gd := db.Spec.GracefulDemotion; gd != nil && gd.RejectConnections && IsMaster(db) {
+		return computedHBA
+	}
+
+	// the monitoring role can connect to all the databases of every keeper
+	if mu := db.Spec.MonitoringUser; mu != nil {
+		for _, address := range mu.DefAddresses() {
+			computedHBA = append(computedHBA, hostHBAEntry(db, "all", mu.Username, address, "md5"))
+		}
+	}
+
 	// By default, if no custom pg_hba entries are provided, accept
 	// connections for all databases and users with md5 auth
-	if db.Spec.PGHBA != nil {
+	for _, r := range db.Spec.PGHBARules {
+		computedHBA = append(computedHBA, r.String())
+	}
+	if db.Spec.PGHBA != nil || db.Spec.PGHBARules != nil {
 		computedHBA = append(computedHBA, db.Spec.PGHBA...)
 	} else {
 		computedHBA = append(
@@ -1726,6 +3825,7 @@ func keeper(c *cobra.Command, args []string) {
 	validAuthMethods := make(map[string]struct{})
 	validAuthMethods["trust"] = struct{}{}
 	validAuthMethods["md5"] = struct{}{}
+	validAuthMethods["scram-sha-256"] = struct{}{}
 	switch cfg.LogLevel {
 	case "error":
 		slog.SetLevel(zap.ErrorLevel)
@@ -1741,18 +3841,46 @@ func keeper(c *cobra.Command, args []string) {
 	if cfg.debug {
 		slog.SetDebug()
 	}
-	if cmd.IsColorLoggerEnable(c, &cfg.CommonConfig) {
-		log = slog.SColor()
+	if err = cmd.EnableSyslog(&cfg.CommonConfig, "stolon-keeper"); err != nil {
+		log.Fatalf("%v", err)
+	}
+	switch cfg.LogFormat {
+	case "text":
+		log = slog.S()
+		if cmd.IsColorLoggerEnable(c, &cfg.CommonConfig) {
+			log = slog.SColor()
+		}
+		postgresql.SetLogger(log)
+	case "json":
+		log = slog.SJSON().With("component", "keeper", "cluster", cfg.ClusterName)
 		postgresql.SetLogger(log)
+	default:
+		log.Fatalf("invalid log format: %v", cfg.LogFormat)
 	}
 
 	if cfg.dataDir == "" {
 		log.Fatalf("data dir required")
 	}
 
+	cfg.flagsConfig = cfg.reloadableConfig()
+	if cfg.configFile != "" {
+		rc, err := readConfigFile(cfg.configFile)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		cfg.applyReloadableConfig(cfg.flagsConfig.override(rc))
+	}
+	rc := cfg.reloadableConfig()
+	if err := rc.validate(); err != nil {
+		log.Fatalf("%v", err)
+	}
+
 	if err = cmd.CheckCommonConfig(&cfg.CommonConfig); err != nil {
 		log.Fatalf(err.Error())
 	}
+	if err := cmd.SetupVaultStoreCert(&cfg.CommonConfig, log); err != nil {
+		log.Fatalf("cannot setup the vault store certificate: %v", err)
+	}
 
 	if err = os.MkdirAll(cfg.dataDir, 0700); err != nil {
 		log.Fatalf("cannot create data dir: %v", err)
@@ -1777,9 +3905,18 @@ func keeper(c *cobra.Command, args []string) {
 	if cfg.pgListenAddress == "" {
 		log.Fatalf("--pg-listen-address is required")
 	}
+	for _, address := range cfg.pgAdditionalAdvertiseAddresses {
+		if address == "" {
+			log.Fatalf("--pg-additional-advertise-addresses contains an empty address")
+		}
+	}
+
+	if cfg.consulServiceName != "" && cfg.consulCheckTTL <= 0 {
+		log.Fatalf("--consul-check-ttl must be greater than 0")
+	}
 
 	if _, ok := validAuthMethods[cfg.pgReplAuthMethod]; !ok {
-		log.Fatalf("--pg-repl-auth-method must be one of: md5, trust")
+		log.Fatalf("--pg-repl-auth-method must be one of: md5, scram-sha-256, trust")
 	}
 	if cfg.pgReplUsername == "" {
 		log.Fatalf("--pg-repl-username is required")
@@ -1792,24 +3929,67 @@ func keeper(c *cobra.Command, args []string) {
 	}
 	if cfg.pgSUAuthMethod == "trust" {
 		log.Warn("not utilizing a password for superuser is extremely dangerous")
-		if cfg.pgSUPassword != "" || cfg.pgSUPasswordFile != "" {
-			log.Fatalf("can not utilize --pg-su-auth-method trust together with --pg-su-password or --pg-su-passwordfile")
+		if cfg.pgSUPassword != "" || cfg.pgSUPasswordFile != "" || cfg.pgSUPasswordVaultSecret != "" {
+			log.Fatalf("can not utilize --pg-su-auth-method trust together with --pg-su-password, --pg-su-passwordfile or --pg-su-password-vault-secret")
 		}
 	}
-	if cfg.pgReplAuthMethod != "trust" && cfg.pgReplPassword == "" && cfg.pgReplPasswordFile == "" {
-		log.Fatalf("one of --pg-repl-password or --pg-repl-passwordfile is required")
+	if cfg.pgReplAuthMethod != "trust" && cfg.pgReplPassword == "" && cfg.pgReplPasswordFile == "" && cfg.pgReplPasswordVaultSecret == "" {
+		log.Fatalf("one of --pg-repl-password, --pg-repl-passwordfile or --pg-repl-password-vault-secret is required")
 	}
-	if cfg.pgReplAuthMethod != "trust" && cfg.pgReplPassword != "" && cfg.pgReplPasswordFile != "" {
-		log.Fatalf("only one of --pg-repl-password or --pg-repl-passwordfile must be provided")
+	if cfg.pgReplAuthMethod != "trust" && countNotEmpty(cfg.pgReplPassword, cfg.pgReplPasswordFile, cfg.pgReplPasswordVaultSecret) > 1 {
+		log.Fatalf("only one of --pg-repl-password, --pg-repl-passwordfile or --pg-repl-password-vault-secret must be provided")
 	}
 	if _, ok := validAuthMethods[cfg.pgSUAuthMethod]; !ok {
-		log.Fatalf("--pg-su-auth-method must be one of: md5, password, trust")
+		log.Fatalf("--pg-su-auth-method must be one of: md5, scram-sha-256, trust")
+	}
+	validLocalAuthMethods := map[string]struct{}{
+		"md5":           struct{}{},
+		"scram-sha-256": struct{}{},
+		"trust":         struct{}{},
+		"peer":          struct{}{},
+	}
+	if cfg.pgSULocalAuthMethod != "" {
+		if _, ok := validLocalAuthMethods[cfg.pgSULocalAuthMethod]; !ok {
+			log.Fatalf("--pg-su-local-auth-method must be one of: md5, scram-sha-256, trust, peer")
+		}
+		if isPasswordAuthMethod(cfg.pgSULocalAuthMethod) && cfg.pgSUAuthMethod == "trust" {
+			log.Fatalf("can not utilize --pg-su-local-auth-method %s together with --pg-su-auth-method trust", cfg.pgSULocalAuthMethod)
+		}
+	}
+	if cfg.pgSUAuthMethod != "trust" && cfg.pgSUPassword == "" && cfg.pgSUPasswordFile == "" && cfg.pgSUPasswordVaultSecret == "" {
+		log.Fatalf("one of --pg-su-password, --pg-su-passwordfile or --pg-su-password-vault-secret is required")
+	}
+	if cfg.pgSUAuthMethod != "trust" && countNotEmpty(cfg.pgSUPassword, cfg.pgSUPasswordFile, cfg.pgSUPasswordVaultSecret) > 1 {
+		log.Fatalf("only one of --pg-su-password, --pg-su-passwordfile or --pg-su-password-vault-secret must be provided")
+	}
+	if (cfg.pgSUPasswordVaultSecret != "" || cfg.pgReplPasswordVaultSecret != "") && cfg.VaultAddress == "" {
+		log.Fatalf("the vault password secrets require --vault-address")
 	}
-	if cfg.pgSUAuthMethod != "trust" && cfg.pgSUPassword == "" && cfg.pgSUPasswordFile == "" {
-		log.Fatalf("one of --pg-su-password or --pg-su-passwordfile is required")
+	if cfg.vaultRefreshInterval < 0 {
+		log.Fatalf("--vault-refresh-interval must be positive")
 	}
-	if cfg.pgSUAuthMethod != "trust" && cfg.pgSUPassword != "" && cfg.pgSUPasswordFile != "" {
-		log.Fatalf("only one of --pg-su-password or --pg-su-passwordfile must be provided")
+
+	if cfg.preMasterValidationTimeout <= 0 {
+		log.Fatalf("--pre-master-validation-timeout must be greater than 0")
+	}
+	if cfg.roleChangeHookTimeout <= 0 {
+		log.Fatalf("--role-change-hook-timeout must be greater than 0")
+	}
+
+	cfg.tags, err = cluster.ParseTags(cfg.tagsString)
+	if err != nil {
+		log.Fatalf("wrong --tags: %v", err)
+	}
+
+	if cfg.recoveryMinApplyDelay < 0 {
+		log.Fatalf("--recovery-min-apply-delay must be positive")
+	}
+	cfg.tablespaceMap, err = parseTablespaceMap(cfg.tablespaceMapString)
+	if err != nil {
+		log.Fatalf("wrong --tablespace-map: %v", err)
+	}
+	if cfg.externalFollowResolveInterval < 0 {
+		log.Fatalf("--external-follow-resolve-interval must be positive")
 	}
 
 	if cfg.pgReplPasswordFile != "" {
@@ -1824,6 +4004,32 @@ func keeper(c *cobra.Command, args []string) {
 			log.Fatalf("cannot read pg superuser password: %v", err)
 		}
 	}
+	if cfg.pgMonitoringPasswordFile != "" {
+		cfg.pgMonitoringPassword, err = readPasswordFromFile(cfg.pgMonitoringPasswordFile)
+		if err != nil {
+			log.Fatalf("cannot read pg monitoring user password: %v", err)
+		}
+		cfg.pgMonitoringPassword = strings.TrimRight(cfg.pgMonitoringPassword, "\r\n")
+		if cfg.pgMonitoringPassword == "" {
+			log.Fatalf("monitoring user password is empty")
+		}
+	}
+	if cfg.pgSUPasswordVaultSecret != "" || cfg.pgReplPasswordVaultSecret != "" {
+		vc, err := cmd.NewVaultClient(&cfg.CommonConfig)
+		if err != nil {
+			log.Fatalf("cannot create vault client: %v", err)
+		}
+		passwords, err := readVaultPasswords(context.Background(), vc, &cfg)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if cfg.pgSUPasswordVaultSecret != "" {
+			cfg.pgSUPassword = passwords.su
+		}
+		if cfg.pgReplPasswordVaultSecret != "" {
+			cfg.pgReplPassword = passwords.repl
+		}
+	}
 
 	// Trim trailing new lines from passwords
 	tp := strings.TrimRight(cfg.pgSUPassword, "\r\n")
@@ -1878,6 +4084,27 @@ func keeper(c *cobra.Command, args []string) {
 
 	log.Infow("exclusive lock on data dir taken")
 
+	removed, err := readKeeperRemoved(cfg.dataDir)
+	if err != nil {
+		log.Fatalf("cannot read the keeper removal status: %v", err)
+	}
+	if removed != nil {
+		log.Fatalf("the keeper has been removed from the cluster at %s, remove %q to reuse the data dir", removed.RequestTime.Format(time.RFC3339), keeperRemovedFilePath(cfg.dataDir))
+	}
+
+	// when multiple keepers run on the same host their instances must use
+	// different ports, or they would also share the same unix socket
+	pgDataDir, err := filepath.Abs(filepath.Join(cfg.dataDir, "postgres"))
+	if err != nil {
+		log.Fatalf("cannot get the postgres data dir absolute path: %v", err)
+	}
+	socketOwner, err := pg.SocketOwner(common.PgUnixSocketDirectories, cfg.pgPort)
+	if err != nil {
+		log.Warnw("cannot check the postgres port unix socket owner", zap.Error(err))
+	} else if socketOwner != "" && filepath.Clean(socketOwner) != pgDataDir {
+		log.Fatalf("postgres port %s already used by the instance with data dir %q, use a different --pg-port for every keeper on the same host", cfg.pgPort, socketOwner)
+	}
+
 	if cfg.uid != "" {
 		if !pg.IsValidReplSlotName(cfg.uid) {
 			log.Fatalf("keeper uid %q not valid. It can contain only lower-case letters, numbers and the underscore character", cfg.uid)
@@ -1905,6 +4132,13 @@ func keeper(c *cobra.Command, args []string) {
 	if err != nil {
 		log.Fatalf("cannot create keeper: %v", err)
 	}
+	prometheus.MustRegister(newKeeperCollector(p))
+	http.HandleFunc("/healthz", p.healthzHandler)
+	http.HandleFunc("/readyz", p.readyzHandler)
+	if cfg.LogFormat == "json" {
+		log = log.With("keeperUID", p.keeperLocalState.UID)
+		postgresql.SetLogger(log)
+	}
 	go p.Start(ctx)
 
 	<-end
@@ -16,13 +16,25 @@ package cmd
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/sorintlab/stolon/internal/cluster"
 	"github.com/sorintlab/stolon/internal/common"
+	pg "github.com/sorintlab/stolon/internal/postgresql"
+
+	"github.com/davecgh/go-spew/spew"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var curUID int
@@ -53,6 +65,22 @@ func TestParseSynchronousStandbyNames(t *testing.T) {
 			in:  "node1",
 			out: []string{"node1"},
 		},
+		{
+			in:  "FIRST 2 (stolon_2c3870f3,stolon_c874a3cb)",
+			out: []string{"stolon_2c3870f3", "stolon_c874a3cb"},
+		},
+		{
+			in:  "ANY 1 (stolon_2c3870f3, stolon_c874a3cb)",
+			out: []string{"stolon_2c3870f3", "stolon_c874a3cb"},
+		},
+		{
+			in:  "any 2 (stolon_2c3870f3,stolon_c874a3cb,stolon_f2a9e1b0)",
+			out: []string{"stolon_2c3870f3", "stolon_c874a3cb", "stolon_f2a9e1b0"},
+		},
+		{
+			in:  "ANY 2 (node1,",
+			err: errors.New("synchronous standby string has number but lacks brackets"),
+		},
 		{
 			in:  "2 (node1,",
 			out: []string{"node1"},
@@ -79,6 +107,115 @@ func TestParseSynchronousStandbyNames(t *testing.T) {
 	}
 }
 
+func TestFormatSynchronousStandbyNames(t *testing.T) {
+	tests := []struct {
+		in     []string
+		quorum int
+		out    string
+	}{
+		{
+			in:  []string{},
+			out: "",
+		},
+		{
+			in:  []string{"stolon_2c3870f3"},
+			out: "stolon_2c3870f3",
+		},
+		{
+			in:  []string{"stolon_2c3870f3", "stolon_c874a3cb"},
+			out: "2 (stolon_2c3870f3,stolon_c874a3cb)",
+		},
+		{
+			in:  []string{"stolon_2c3870f3", "stolon_c874a3cb", "stolonfakestandby"},
+			out: "3 (stolon_2c3870f3,stolon_c874a3cb,stolonfakestandby)",
+		},
+		{
+			in:     []string{"stolon_2c3870f3", "stolon_c874a3cb", "stolon_f2a9e1b0"},
+			quorum: 2,
+			out:    "ANY 2 (stolon_2c3870f3,stolon_c874a3cb,stolon_f2a9e1b0)",
+		},
+		{
+			in:     []string{"stolon_2c3870f3", "stolon_c874a3cb"},
+			quorum: 1,
+			out:    "ANY 1 (stolon_2c3870f3,stolon_c874a3cb)",
+		},
+		// a quorum not lower than the number of standbys means waiting for
+		// all of them
+		{
+			in:     []string{"stolon_2c3870f3", "stolon_c874a3cb"},
+			quorum: 2,
+			out:    "2 (stolon_2c3870f3,stolon_c874a3cb)",
+		},
+		{
+			in:     []string{"stolon_2c3870f3"},
+			quorum: 1,
+			out:    "stolon_2c3870f3",
+		},
+	}
+
+	for i, tt := range tests {
+		out := formatSynchronousStandbyNames(tt.in, tt.quorum)
+		if out != tt.out {
+			t.Errorf("%d: wrong output: got: %q, want: %q", i, out, tt.out)
+		}
+		if len(tt.in) == 0 {
+			continue
+		}
+		// the generated value must be parsed back to the same standbys
+		standbys, err := parseSynchronousStandbyNames(out)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", i, err)
+		} else if !reflect.DeepEqual(standbys, tt.in) {
+			t.Errorf("%d: wrong parsed standbys: got: %v, want: %v", i, standbys, tt.in)
+		}
+	}
+}
+
+func TestFilterUnsafeDurabilityParameters(t *testing.T) {
+	tests := []struct {
+		in                    common.Parameters
+		allowUnsafeDurability bool
+		out                   common.Parameters
+		ignored               []string
+	}{
+		{
+			in:      common.Parameters{"max_connections": "100"},
+			out:     common.Parameters{"max_connections": "100"},
+			ignored: []string{},
+		},
+		{
+			in:      common.Parameters{"fsync": "on", "full_page_writes": "on"},
+			out:     common.Parameters{"fsync": "on", "full_page_writes": "on"},
+			ignored: []string{},
+		},
+		{
+			in:      common.Parameters{"fsync": "off", "full_page_writes": "false", "max_connections": "100"},
+			out:     common.Parameters{"max_connections": "100"},
+			ignored: []string{"fsync", "full_page_writes"},
+		},
+		{
+			in:      common.Parameters{"fsync": "on", "full_page_writes": "off"},
+			out:     common.Parameters{"fsync": "on"},
+			ignored: []string{"full_page_writes"},
+		},
+		{
+			in:                    common.Parameters{"fsync": "off", "full_page_writes": "off"},
+			allowUnsafeDurability: true,
+			out:                   common.Parameters{"fsync": "off", "full_page_writes": "off"},
+		},
+	}
+
+	for i, tt := range tests {
+		ignored := filterUnsafeDurabilityParameters(tt.in, tt.allowUnsafeDurability)
+		if !reflect.DeepEqual(tt.in, tt.out) {
+			t.Errorf("#%d: wrong parameters: got: %v, want: %v", i, tt.in, tt.out)
+		}
+		if !reflect.DeepEqual(ignored, tt.ignored) {
+			t.Errorf("#%d: wrong ignored parameters: got: %v, want: %v", i, ignored, tt.ignored)
+		}
+	}
+}
+
 func TestGenerateHBA(t *testing.T) {
 	// minimal clusterdata with only the fields used by generateHBA
 	cd := &cluster.ClusterData{
@@ -127,17 +264,125 @@ func TestGenerateHBA(t *testing.T) {
 		Proxy: &cluster.Proxy{},
 	}
 
+	defaultListenAddresses := map[string]string{}
+	for _, db := range cd.DBs {
+		defaultListenAddresses[db.UID] = db.Status.ListenAddress
+	}
+
 	tests := []struct {
 		DefaultSUReplAccessMode cluster.SUReplAccessMode
 		dbUID                   string
 		pgHBA                   []string
-		out                     []string
+		pgHBARules              []cluster.HBARule
+		// overrides the default dbs listen addresses
+		listenAddresses map[string]string
+		// all the dbs advertised addresses
+		advertisedAddresses   map[string][]string
+		pgSUAuthMethod        string
+		pgReplAuthMethod      string
+		pgSULocalAuthMethod   string
+		usePgrewind           *bool
+		requireChannelBinding bool
+		monitoringUser        *cluster.MonitoringUser
+		gracefulDemotion      *cluster.GracefulDemotionRequest
+		out                   []string
 	}{
+		// only the superuser and replication entries are generated on a
+		// master rejecting the connections while drained
+		{
+			DefaultSUReplAccessMode: cluster.SUReplAccessAll,
+			dbUID:                   "db1",
+			monitoringUser:          &cluster.MonitoringUser{Username: "monitor"},
+			gracefulDemotion:        &cluster.GracefulDemotionRequest{TargetDBUID: "db2", RejectConnections: true},
+			out: []string{
+				"local all superuser md5",
+				"local replication repluser md5",
+				"host all superuser 0.0.0.0/0 md5",
+				"host all superuser ::0/0 md5",
+				"host replication repluser 0.0.0.0/0 md5",
+				"host replication repluser ::0/0 md5",
+			},
+		},
+		{
+			DefaultSUReplAccessMode: cluster.SUReplAccessAll,
+			dbUID:                   "db1",
+			gracefulDemotion:        &cluster.GracefulDemotionRequest{TargetDBUID: "db2"},
+			out: []string{
+				"local all superuser md5",
+				"local replication repluser md5",
+				"host all superuser 0.0.0.0/0 md5",
+				"host all superuser ::0/0 md5",
+				"host replication repluser 0.0.0.0/0 md5",
+				"host replication repluser ::0/0 md5",
+				"host all all 0.0.0.0/0 md5",
+				"host all all ::0/0 md5",
+			},
+		},
+		// the monitoring user entries are generated also on the standbys
+		{
+			DefaultSUReplAccessMode: cluster.SUReplAccessStrict,
+			dbUID:                   "db2",
+			monitoringUser:          &cluster.MonitoringUser{Username: "monitor"},
+			out: []string{
+				"local all superuser md5",
+				"local replication repluser md5",
+				"host all monitor 0.0.0.0/0 md5",
+				"host all monitor ::0/0 md5",
+				"host all all 0.0.0.0/0 md5",
+				"host all all ::0/0 md5",
+			},
+		},
+		{
+			DefaultSUReplAccessMode: cluster.SUReplAccessAll,
+			dbUID:                   "db1",
+			requireChannelBinding:   true,
+			monitoringUser:          &cluster.MonitoringUser{Username: "monitor", Addresses: []string{"10.0.0.0/8"}},
+			pgHBA:                   []string{},
+			out: []string{
+				"local all superuser md5",
+				"local replication repluser md5",
+				"hostssl all superuser 0.0.0.0/0 scram-sha-256",
+				"hostssl all superuser ::0/0 scram-sha-256",
+				"hostssl replication repluser 0.0.0.0/0 scram-sha-256",
+				"hostssl replication repluser ::0/0 scram-sha-256",
+				"hostssl all monitor 10.0.0.0/8 scram-sha-256",
+			},
+		},
+		{
+			DefaultSUReplAccessMode: cluster.SUReplAccessAll,
+			dbUID:                   "db1",
+			requireChannelBinding:   true,
+			out: []string{
+				"local all superuser md5",
+				"local replication repluser md5",
+				"hostssl all superuser 0.0.0.0/0 scram-sha-256",
+				"hostssl all superuser ::0/0 scram-sha-256",
+				"hostssl replication repluser 0.0.0.0/0 scram-sha-256",
+				"hostssl replication repluser ::0/0 scram-sha-256",
+				"host all all 0.0.0.0/0 md5",
+				"host all all ::0/0 md5",
+			},
+		},
+		{
+			DefaultSUReplAccessMode: cluster.SUReplAccessStrict,
+			dbUID:                   "db1",
+			requireChannelBinding:   true,
+			out: []string{
+				"local all superuser md5",
+				"local replication repluser md5",
+				"hostssl all superuser 192.168.0.2/32 scram-sha-256",
+				"hostssl replication repluser 192.168.0.2/32 scram-sha-256",
+				"hostssl all superuser 192.168.0.3/32 scram-sha-256",
+				"hostssl replication repluser 192.168.0.3/32 scram-sha-256",
+				"host all all 0.0.0.0/0 md5",
+				"host all all ::0/0 md5",
+			},
+		},
 		{
 			DefaultSUReplAccessMode: cluster.SUReplAccessAll,
 			dbUID:                   "db1",
 			out: []string{
-				"local postgres superuser md5",
+				"local all superuser md5",
 				"local replication repluser md5",
 				"host all superuser 0.0.0.0/0 md5",
 				"host all superuser ::0/0 md5",
@@ -151,7 +396,7 @@ func TestGenerateHBA(t *testing.T) {
 			DefaultSUReplAccessMode: cluster.SUReplAccessAll,
 			dbUID:                   "db2",
 			out: []string{
-				"local postgres superuser md5",
+				"local all superuser md5",
 				"local replication repluser md5",
 				"host all superuser 0.0.0.0/0 md5",
 				"host all superuser ::0/0 md5",
@@ -168,15 +413,54 @@ func TestGenerateHBA(t *testing.T) {
 				"host all all 192.168.0.0/24 md5",
 			},
 			out: []string{
-				"local postgres superuser md5",
+				"local all superuser md5",
+				"local replication repluser md5",
+				"host all superuser 0.0.0.0/0 md5",
+				"host all superuser ::0/0 md5",
+				"host replication repluser 0.0.0.0/0 md5",
+				"host replication repluser ::0/0 md5",
+				"host all all 192.168.0.0/24 md5",
+			},
+		},
+		{
+			DefaultSUReplAccessMode: cluster.SUReplAccessAll,
+			dbUID:                   "db1",
+			pgHBARules: []cluster.HBARule{
+				{Type: "hostssl", Database: "app", User: "app", Address: "10.0.0.0/8", Method: "scram-sha-256"},
+				{Type: "host", Database: "all", User: "all", Address: "192.168.0.0/24", Method: "ldap", Options: map[string]string{"ldapserver": "ldap.example.com", "ldapprefix": "cn=", "ldapsuffix": ", dc=example, dc=com"}},
+			},
+			pgHBA: []string{
+				"host all all 192.168.0.0/24 md5",
+			},
+			out: []string{
+				"local all superuser md5",
 				"local replication repluser md5",
 				"host all superuser 0.0.0.0/0 md5",
 				"host all superuser ::0/0 md5",
 				"host replication repluser 0.0.0.0/0 md5",
 				"host replication repluser ::0/0 md5",
+				"hostssl app app 10.0.0.0/8 scram-sha-256",
+				`host all all 192.168.0.0/24 ldap ldapprefix=cn= ldapserver=ldap.example.com ldapsuffix=", dc=example, dc=com"`,
 				"host all all 192.168.0.0/24 md5",
 			},
 		},
+		// with only structured rules no default entries are added
+		{
+			DefaultSUReplAccessMode: cluster.SUReplAccessAll,
+			dbUID:                   "db1",
+			pgHBARules: []cluster.HBARule{
+				{Type: "local", Database: "all", User: "all", Method: "peer"},
+			},
+			out: []string{
+				"local all superuser md5",
+				"local replication repluser md5",
+				"host all superuser 0.0.0.0/0 md5",
+				"host all superuser ::0/0 md5",
+				"host replication repluser 0.0.0.0/0 md5",
+				"host replication repluser ::0/0 md5",
+				"local all all peer",
+			},
+		},
 		{
 			DefaultSUReplAccessMode: cluster.SUReplAccessAll,
 			dbUID:                   "db2",
@@ -184,7 +468,7 @@ func TestGenerateHBA(t *testing.T) {
 				"host all all 192.168.0.0/24 md5",
 			},
 			out: []string{
-				"local postgres superuser md5",
+				"local all superuser md5",
 				"local replication repluser md5",
 				"host all superuser 0.0.0.0/0 md5",
 				"host all superuser ::0/0 md5",
@@ -197,7 +481,7 @@ func TestGenerateHBA(t *testing.T) {
 			DefaultSUReplAccessMode: cluster.SUReplAccessStrict,
 			dbUID:                   "db1",
 			out: []string{
-				"local postgres superuser md5",
+				"local all superuser md5",
 				"local replication repluser md5",
 				"host all superuser 192.168.0.2/32 md5",
 				"host replication repluser 192.168.0.2/32 md5",
@@ -211,8 +495,166 @@ func TestGenerateHBA(t *testing.T) {
 			DefaultSUReplAccessMode: cluster.SUReplAccessStrict,
 			dbUID:                   "db2",
 			out: []string{
-				"local postgres superuser md5",
+				"local all superuser md5",
+				"local replication repluser md5",
+				"host all all 0.0.0.0/0 md5",
+				"host all all ::0/0 md5",
+			},
+		},
+		// IPv6 standby addresses
+		{
+			DefaultSUReplAccessMode: cluster.SUReplAccessStrict,
+			dbUID:                   "db1",
+			listenAddresses: map[string]string{
+				"db1": "fd00::1",
+				"db2": "fd00::2",
+				"db3": "fd00::3",
+			},
+			out: []string{
+				"local all superuser md5",
+				"local replication repluser md5",
+				"host all superuser fd00::2/128 md5",
+				"host replication repluser fd00::2/128 md5",
+				"host all superuser fd00::3/128 md5",
+				"host replication repluser fd00::3/128 md5",
+				"host all all 0.0.0.0/0 md5",
+				"host all all ::0/0 md5",
+			},
+		},
+		// mixed IPv4 and IPv6 standby addresses
+		{
+			DefaultSUReplAccessMode: cluster.SUReplAccessStrict,
+			dbUID:                   "db1",
+			listenAddresses: map[string]string{
+				"db1": "192.168.0.1",
+				"db2": "192.168.0.2",
+				"db3": "fd00::3",
+			},
+			out: []string{
+				"local all superuser md5",
+				"local replication repluser md5",
+				"host all superuser 192.168.0.2/32 md5",
+				"host replication repluser 192.168.0.2/32 md5",
+				"host all superuser fd00::3/128 md5",
+				"host replication repluser fd00::3/128 md5",
+				"host all all 0.0.0.0/0 md5",
+				"host all all ::0/0 md5",
+			},
+		},
+		// standby without a listen address must be skipped
+		{
+			DefaultSUReplAccessMode: cluster.SUReplAccessStrict,
+			dbUID:                   "db1",
+			listenAddresses: map[string]string{
+				"db1": "192.168.0.1",
+				"db2": "",
+				"db3": "192.168.0.3",
+			},
+			out: []string{
+				"local all superuser md5",
+				"local replication repluser md5",
+				"host all superuser 192.168.0.3/32 md5",
+				"host replication repluser 192.168.0.3/32 md5",
+				"host all all 0.0.0.0/0 md5",
+				"host all all ::0/0 md5",
+			},
+		},
+		// standby advertising addresses of both the ip families
+		{
+			DefaultSUReplAccessMode: cluster.SUReplAccessStrict,
+			dbUID:                   "db1",
+			advertisedAddresses: map[string][]string{
+				"db2": {"192.168.0.2", "fd00::2"},
+			},
+			out: []string{
+				"local all superuser md5",
+				"local replication repluser md5",
+				"host all superuser 192.168.0.2/32 md5",
+				"host replication repluser 192.168.0.2/32 md5",
+				"host all superuser 192.168.0.3/32 md5",
+				"host replication repluser 192.168.0.3/32 md5",
+				"host all superuser fd00::2/128 md5",
+				"host replication repluser fd00::2/128 md5",
+				"host all all 0.0.0.0/0 md5",
+				"host all all ::0/0 md5",
+			},
+		},
+		// password-less local superuser connections
+		{
+			DefaultSUReplAccessMode: cluster.SUReplAccessAll,
+			dbUID:                   "db1",
+			pgSULocalAuthMethod:     "trust",
+			out: []string{
+				"local all superuser trust",
+				"local replication repluser md5",
+				"host all superuser 0.0.0.0/0 md5",
+				"host all superuser ::0/0 md5",
+				"host replication repluser 0.0.0.0/0 md5",
+				"host replication repluser ::0/0 md5",
+				"host all all 0.0.0.0/0 md5",
+				"host all all ::0/0 md5",
+			},
+		},
+		// password-less local superuser connections without pg_rewind don't
+		// need the superuser host entries
+		{
+			DefaultSUReplAccessMode: cluster.SUReplAccessStrict,
+			dbUID:                   "db1",
+			pgSULocalAuthMethod:     "peer",
+			out: []string{
+				"local all superuser peer",
+				"local replication repluser md5",
+				"host replication repluser 192.168.0.2/32 md5",
+				"host replication repluser 192.168.0.3/32 md5",
+				"host all all 0.0.0.0/0 md5",
+				"host all all ::0/0 md5",
+			},
+		},
+		{
+			DefaultSUReplAccessMode: cluster.SUReplAccessStrict,
+			dbUID:                   "db1",
+			pgSULocalAuthMethod:     "peer",
+			usePgrewind:             cluster.BoolP(true),
+			out: []string{
+				"local all superuser peer",
+				"local replication repluser md5",
+				"host all superuser 192.168.0.2/32 md5",
+				"host replication repluser 192.168.0.2/32 md5",
+				"host all superuser 192.168.0.3/32 md5",
+				"host replication repluser 192.168.0.3/32 md5",
+				"host all all 0.0.0.0/0 md5",
+				"host all all ::0/0 md5",
+			},
+		},
+		{
+			DefaultSUReplAccessMode: cluster.SUReplAccessAll,
+			dbUID:                   "db1",
+			pgSUAuthMethod:          "scram-sha-256",
+			pgReplAuthMethod:        "scram-sha-256",
+			out: []string{
+				"local all superuser scram-sha-256",
+				"local replication repluser scram-sha-256",
+				"host all superuser 0.0.0.0/0 scram-sha-256",
+				"host all superuser ::0/0 scram-sha-256",
+				"host replication repluser 0.0.0.0/0 scram-sha-256",
+				"host replication repluser ::0/0 scram-sha-256",
+				"host all all 0.0.0.0/0 md5",
+				"host all all ::0/0 md5",
+			},
+		},
+		{
+			DefaultSUReplAccessMode: cluster.SUReplAccessStrict,
+			dbUID:                   "db1",
+			pgSUAuthMethod:          "scram-sha-256",
+			pgSULocalAuthMethod:     "peer",
+			usePgrewind:             cluster.BoolP(true),
+			out: []string{
+				"local all superuser peer",
 				"local replication repluser md5",
+				"host all superuser 192.168.0.2/32 scram-sha-256",
+				"host replication repluser 192.168.0.2/32 md5",
+				"host all superuser 192.168.0.3/32 scram-sha-256",
+				"host replication repluser 192.168.0.3/32 md5",
 				"host all all 0.0.0.0/0 md5",
 				"host all all ::0/0 md5",
 			},
@@ -221,16 +663,36 @@ func TestGenerateHBA(t *testing.T) {
 
 	for i, tt := range tests {
 		p := &PostgresKeeper{
-			pgSUAuthMethod:   "md5",
-			pgSUUsername:     "superuser",
-			pgReplAuthMethod: "md5",
-			pgReplUsername:   "repluser",
+			pgSUAuthMethod:      "md5",
+			pgSULocalAuthMethod: tt.pgSULocalAuthMethod,
+			pgSUUsername:        "superuser",
+			pgReplAuthMethod:    "md5",
+			pgReplUsername:      "repluser",
+		}
+		if tt.pgSUAuthMethod != "" {
+			p.pgSUAuthMethod = tt.pgSUAuthMethod
+		}
+		if tt.pgReplAuthMethod != "" {
+			p.pgReplAuthMethod = tt.pgReplAuthMethod
 		}
 
 		cd.Cluster.Spec.DefaultSUReplAccessMode = &tt.DefaultSUReplAccessMode
+		cd.Cluster.Spec.UsePgrewind = tt.usePgrewind
+
+		for _, db := range cd.DBs {
+			db.Status.ListenAddress = defaultListenAddresses[db.UID]
+			if address, ok := tt.listenAddresses[db.UID]; ok {
+				db.Status.ListenAddress = address
+			}
+			db.Status.ListenAddresses = tt.advertisedAddresses[db.UID]
+		}
 
 		db := cd.DBs[tt.dbUID]
 		db.Spec.PGHBA = tt.pgHBA
+		db.Spec.PGHBARules = tt.pgHBARules
+		db.Spec.RequireChannelBinding = tt.requireChannelBinding
+		db.Spec.MonitoringUser = tt.monitoringUser
+		db.Spec.GracefulDemotion = tt.gracefulDemotion
 
 		out := p.generateHBA(cd, db)
 
@@ -248,3 +710,1284 @@ func TestGenerateHBA(t *testing.T) {
 		}
 	}
 }
+
+func TestGenerateIdent(t *testing.T) {
+	tests := []struct {
+		pgIdent []cluster.IdentMapping
+		out     []string
+	}{
+		{
+			pgIdent: nil,
+			out:     nil,
+		},
+		{
+			pgIdent: []cluster.IdentMapping{},
+			out:     []string{},
+		},
+		{
+			pgIdent: []cluster.IdentMapping{
+				{MapName: "certmap", SystemUsername: "app.example.com", PGUsername: "app"},
+				{MapName: "krb", SystemUsername: `/^(.*)@EXAMPLE\.COM$`, PGUsername: `\1`},
+			},
+			out: []string{
+				"certmap app.example.com app",
+				`krb /^(.*)@EXAMPLE\.COM$ \1`,
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		db := &cluster.DB{Spec: &cluster.DBSpec{PGIdent: tt.pgIdent}}
+		out := generateIdent(db)
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: got: %#v, want: %#v", i, out, tt.out)
+		}
+	}
+}
+
+func TestDiffPublications(t *testing.T) {
+	tests := []struct {
+		cur     []*pg.Publication
+		wanted  []cluster.Publication
+		actions *publicationsActions
+	}{
+		// nothing defined
+		{
+			actions: &publicationsActions{},
+		},
+		// create missing publications
+		{
+			wanted: []cluster.Publication{
+				{Name: "pub2", Tables: []string{"t2", "s1.t1"}},
+				{Name: "pub1", AllTables: true},
+			},
+			actions: &publicationsActions{
+				create: []*pg.Publication{
+					{Name: "pub1", AllTables: true},
+					{Name: "pub2", Tables: []string{"public.t2", "s1.t1"}},
+				},
+			},
+		},
+		// existing publications already in the wanted state
+		{
+			cur: []*pg.Publication{
+				{Name: "pub1", AllTables: true, Managed: true},
+				{Name: "pub2", Tables: []string{"public.t2", "s1.t1"}, Managed: true},
+			},
+			wanted: []cluster.Publication{
+				{Name: "pub1", AllTables: true},
+				{Name: "pub2", Tables: []string{"s1.t1", "t2"}},
+			},
+			actions: &publicationsActions{},
+		},
+		// drop only stolon managed publications
+		{
+			cur: []*pg.Publication{
+				{Name: "pub1", AllTables: true, Managed: true},
+				{Name: "userpub", AllTables: true},
+			},
+			actions: &publicationsActions{
+				drop: []string{"pub1"},
+			},
+		},
+		// don't alter user created publications with a wanted name
+		{
+			cur: []*pg.Publication{
+				{Name: "pub1", Tables: []string{"public.t1"}},
+			},
+			wanted: []cluster.Publication{
+				{Name: "pub1", AllTables: true},
+			},
+			actions: &publicationsActions{},
+		},
+		// update managed publications
+		{
+			cur: []*pg.Publication{
+				{Name: "pub1", Tables: []string{"public.t1"}, Managed: true},
+				{Name: "pub2", Tables: []string{"public.t1"}, Managed: true},
+			},
+			wanted: []cluster.Publication{
+				{Name: "pub1", Tables: []string{"t1", "t2"}},
+				{Name: "pub2", AllTables: true},
+			},
+			actions: &publicationsActions{
+				drop: []string{"pub2"},
+				create: []*pg.Publication{
+					{Name: "pub2", AllTables: true},
+				},
+				setTables: []*pg.Publication{
+					{Name: "pub1", Tables: []string{"public.t1", "public.t2"}},
+				},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		actions := diffPublications(tt.cur, tt.wanted)
+		if !reflect.DeepEqual(actions, tt.actions) {
+			t.Errorf("#%d: wrong actions: got: %s, want: %s", i, spew.Sdump(actions), spew.Sdump(tt.actions))
+		}
+	}
+}
+
+func TestDiffLogicalReplSlots(t *testing.T) {
+	tests := []struct {
+		cur     []*pg.LogicalReplicationSlotStatus
+		wanted  []cluster.LogicalReplicationSlot
+		actions *logicalReplSlotsActions
+	}{
+		{
+			cur:     []*pg.LogicalReplicationSlotStatus{},
+			actions: &logicalReplSlotsActions{},
+		},
+		// create the missing slots
+		{
+			cur: []*pg.LogicalReplicationSlotStatus{
+				{Name: "stolon_slot1", Database: "postgres", Plugin: "pgoutput"},
+			},
+			wanted: []cluster.LogicalReplicationSlot{
+				{Name: "slot2", Database: "db1", Plugin: "wal2json"},
+				{Name: "slot1"},
+			},
+			actions: &logicalReplSlotsActions{
+				create: []cluster.LogicalReplicationSlot{
+					{Name: "slot2", Database: "db1", Plugin: "wal2json"},
+				},
+			},
+		},
+		// drop only the not wanted stolon slots
+		{
+			cur: []*pg.LogicalReplicationSlotStatus{
+				{Name: "stolon_slot1", Database: "postgres", Plugin: "pgoutput"},
+				{Name: "userslot", Database: "postgres", Plugin: "pgoutput"},
+			},
+			actions: &logicalReplSlotsActions{
+				drop: []*pg.LogicalReplicationSlotStatus{
+					{Name: "stolon_slot1", Database: "postgres", Plugin: "pgoutput"},
+				},
+			},
+		},
+		// recreate the slots with a different database or plugin
+		{
+			cur: []*pg.LogicalReplicationSlotStatus{
+				{Name: "stolon_slot1", Database: "postgres", Plugin: "pgoutput"},
+				{Name: "stolon_slot2", Database: "postgres", Plugin: "pgoutput"},
+			},
+			wanted: []cluster.LogicalReplicationSlot{
+				{Name: "slot1", Database: "db1"},
+				{Name: "slot2", Plugin: "wal2json"},
+			},
+			actions: &logicalReplSlotsActions{
+				drop: []*pg.LogicalReplicationSlotStatus{
+					{Name: "stolon_slot1", Database: "postgres", Plugin: "pgoutput"},
+					{Name: "stolon_slot2", Database: "postgres", Plugin: "pgoutput"},
+				},
+				create: []cluster.LogicalReplicationSlot{
+					{Name: "slot1", Database: "db1"},
+					{Name: "slot2", Plugin: "wal2json"},
+				},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		actions := diffLogicalReplSlots(tt.cur, tt.wanted)
+		if !reflect.DeepEqual(actions, tt.actions) {
+			t.Errorf("#%d: wrong actions: got: %s, want: %s", i, spew.Sdump(actions), spew.Sdump(tt.actions))
+		}
+	}
+}
+
+func TestLogicalReplSlotsAdvances(t *testing.T) {
+	cur := []*pg.LogicalReplicationSlotStatus{
+		{Name: "stolon_slot1", Database: "postgres", Plugin: "pgoutput", ConfirmedFlushLSN: 100},
+		{Name: "stolon_slot2", Database: "postgres", Plugin: "pgoutput", ConfirmedFlushLSN: 300},
+		{Name: "stolon_slot3", Database: "postgres", Plugin: "pgoutput", ConfirmedFlushLSN: 100},
+		{Name: "userslot", Database: "postgres", Plugin: "pgoutput", ConfirmedFlushLSN: 100},
+	}
+	master := []*cluster.LogicalReplicationSlotStatus{
+		{Name: "stolon_slot1", Database: "postgres", Plugin: "pgoutput", ConfirmedFlushLSN: 200},
+		// never moved backwards
+		{Name: "stolon_slot2", Database: "postgres", Plugin: "pgoutput", ConfirmedFlushLSN: 200},
+		// a different slot with the same name
+		{Name: "stolon_slot3", Database: "db1", Plugin: "pgoutput", ConfirmedFlushLSN: 200},
+		{Name: "userslot", Database: "postgres", Plugin: "pgoutput", ConfirmedFlushLSN: 200},
+	}
+
+	advances := logicalReplSlotsAdvances(cur, master)
+	expected := map[string]uint64{"stolon_slot1": 200}
+	if !reflect.DeepEqual(advances, expected) {
+		t.Errorf("wrong advances: got: %v, want: %v", advances, expected)
+	}
+}
+
+func TestValidateMasterRole(t *testing.T) {
+	tests := []struct {
+		command             string
+		timeout             int
+		declinedMasterDBUID string
+		ok                  bool
+		outDeclinedDBUID    string
+	}{
+		// no validation command
+		{
+			command: "",
+			timeout: 1,
+			ok:      true,
+		},
+		{
+			command: "true",
+			timeout: 1,
+			ok:      true,
+		},
+		// a succeeding validation clears a previous decline
+		{
+			command:             `test "$STOLON_DB_UID" = db1 -a "$STOLON_KEEPER_UID" = keeper1`,
+			timeout:             1,
+			declinedMasterDBUID: "db1",
+			ok:                  true,
+		},
+		{
+			command:          "exit 1",
+			timeout:          1,
+			ok:               false,
+			outDeclinedDBUID: "db1",
+		},
+		// the command doesn't complete before the timeout
+		{
+			command:          "sleep 10",
+			timeout:          1,
+			ok:               false,
+			outDeclinedDBUID: "db1",
+		},
+	}
+
+	db := &cluster.DB{
+		UID: "db1",
+		Spec: &cluster.DBSpec{
+			KeeperUID: "keeper1",
+			Role:      common.RoleMaster,
+		},
+	}
+	for i, tt := range tests {
+		p := &PostgresKeeper{
+			cfg: &config{
+				preMasterValidationCommand: tt.command,
+				preMasterValidationTimeout: tt.timeout,
+			},
+			declinedMasterDBUID: tt.declinedMasterDBUID,
+		}
+		start := time.Now()
+		ok := p.validateMasterRole(db)
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("#%d: validation took too long: %s", i, elapsed)
+		}
+		if ok != tt.ok {
+			t.Errorf("#%d: got ok: %t, want: %t", i, ok, tt.ok)
+		}
+		if declined := p.getDeclinedMasterDBUID(); declined != tt.outDeclinedDBUID {
+			t.Errorf("#%d: got declined master db uid: %q, want: %q", i, declined, tt.outDeclinedDBUID)
+		}
+	}
+}
+
+func TestRunPrePromotionHook(t *testing.T) {
+	tests := []struct {
+		hook    *string
+		timeout time.Duration
+		ok      bool
+		result  *cluster.PrePromotionHookResult
+	}{
+		// no hook
+		{
+			ok: true,
+		},
+		{
+			hook: cluster.StringP(""),
+			ok:   true,
+		},
+		{
+			hook:   cluster.StringP(`test "$STOLON_DB_UID" = db1 -a "$STOLON_KEEPER_UID" = keeper1`),
+			ok:     true,
+			result: &cluster.PrePromotionHookResult{DBUID: "db1", Success: true},
+		},
+		{
+			hook:   cluster.StringP("echo storage not writable >&2; exit 2"),
+			ok:     false,
+			result: &cluster.PrePromotionHookResult{DBUID: "db1", Error: "exit status 2", Stderr: "storage not writable\n"},
+		},
+		// the standard error is truncated
+		{
+			hook:   cluster.StringP("printf '%5000s' | tr ' ' a >&2; exit 1"),
+			ok:     false,
+			result: &cluster.PrePromotionHookResult{DBUID: "db1", Error: "exit status 1", Stderr: strings.Repeat("a", maxHookStderrSize)},
+		},
+		// the hook doesn't complete before the timeout
+		{
+			hook:    cluster.StringP("sleep 10"),
+			timeout: 100 * time.Millisecond,
+			ok:      false,
+			result:  &cluster.PrePromotionHookResult{DBUID: "db1", Error: "timeout after 100ms"},
+		},
+	}
+
+	db := &cluster.DB{
+		UID: "db1",
+		Spec: &cluster.DBSpec{
+			KeeperUID: "keeper1",
+			Role:      common.RoleMaster,
+		},
+	}
+	for i, tt := range tests {
+		cd := &cluster.ClusterData{
+			Cluster: &cluster.Cluster{
+				Spec: &cluster.ClusterSpec{
+					PrePromotionHook: tt.hook,
+				},
+			},
+		}
+		if tt.timeout != 0 {
+			cd.Cluster.Spec.PrePromotionHookTimeout = &cluster.Duration{Duration: tt.timeout}
+		}
+		p := &PostgresKeeper{cfg: &config{}}
+		ok := p.runPrePromotionHook(cd, db)
+		if ok != tt.ok {
+			t.Errorf("#%d: got ok: %t, want: %t", i, ok, tt.ok)
+		}
+		declined := ""
+		if !tt.ok {
+			declined = "db1"
+		}
+		if d := p.getDeclinedMasterDBUID(); d != declined {
+			t.Errorf("#%d: got declined master db uid: %q, want: %q", i, d, declined)
+		}
+		result := p.getPrePromotionHookResult()
+		if result != nil {
+			if result.Time.IsZero() {
+				t.Errorf("#%d: empty result time", i)
+			}
+			result.Time = time.Time{}
+		}
+		if !reflect.DeepEqual(result, tt.result) {
+			t.Errorf("#%d: wrong result: got: %s, want: %s", i, spew.Sdump(result), spew.Sdump(tt.result))
+		}
+	}
+}
+
+func TestRunPostInitHook(t *testing.T) {
+	tests := []struct {
+		nc         *cluster.NewConfig
+		initConfig *cluster.InitConfig
+		timeout    time.Duration
+		ok         bool
+		result     *cluster.PostInitHookResult
+	}{
+		// no hook
+		{
+			ok: true,
+		},
+		{
+			nc: &cluster.NewConfig{Locale: "C"},
+			ok: true,
+		},
+		{
+			nc:     &cluster.NewConfig{PostInitCommand: `test "$STOLON_DB_UID" = db1 -a "$PGUSER" = stolon -a "$PGPASSWORD" = supass -a "$PGPORT" = 5432 -a "$PGDATABASE" = postgres`},
+			ok:     true,
+			result: &cluster.PostInitHookResult{DBUID: "db1", Success: true},
+		},
+		{
+			nc:     &cluster.NewConfig{PostInitCommand: "echo cannot create role >&2; exit 3"},
+			ok:     false,
+			result: &cluster.PostInitHookResult{DBUID: "db1", Error: "exit status 3", Stderr: "cannot create role\n"},
+		},
+		// the hook doesn't complete before the init timeout
+		{
+			nc:      &cluster.NewConfig{PostInitCommand: "sleep 10"},
+			timeout: 100 * time.Millisecond,
+			ok:      false,
+			result:  &cluster.PostInitHookResult{DBUID: "db1", Error: "timeout after 100ms"},
+		},
+		// already executed
+		{
+			nc:         &cluster.NewConfig{PostInitCommand: "exit 1"},
+			initConfig: &cluster.InitConfig{PostInitHookResult: &cluster.PostInitHookResult{DBUID: "db0", Success: true}},
+			ok:         true,
+		},
+	}
+
+	for i, tt := range tests {
+		db := &cluster.DB{
+			UID: "db1",
+			Spec: &cluster.DBSpec{
+				KeeperUID: "keeper1",
+				Role:      common.RoleMaster,
+				NewConfig: tt.nc,
+			},
+		}
+		cd := &cluster.ClusterData{
+			Cluster: &cluster.Cluster{
+				Spec:   &cluster.ClusterSpec{},
+				Status: cluster.ClusterStatus{InitConfig: tt.initConfig},
+			},
+		}
+		if tt.timeout != 0 {
+			cd.Cluster.Spec.InitTimeout = &cluster.Duration{Duration: tt.timeout}
+		}
+		p := &PostgresKeeper{cfg: &config{}, pgSUUsername: "stolon", pgSUPassword: "supass", pgSUAuthMethod: "md5", pgPort: "5432"}
+		pgm := pg.NewManager("", "", p.getLocalConnParams(), nil, "md5", "stolon", "supass", "md5", "repl", "replpass", time.Second)
+		err := p.runPostInitHook(cd, db, pgm)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("#%d: got ok: %t, want: %t (err: %v)", i, ok, tt.ok, err)
+		}
+		result := p.getPostInitHookResult()
+		if result != nil {
+			if result.Time.IsZero() {
+				t.Errorf("#%d: empty result time", i)
+			}
+			result.Time = time.Time{}
+		}
+		if !reflect.DeepEqual(result, tt.result) {
+			t.Errorf("#%d: wrong result: got: %s, want: %s", i, spew.Sdump(result), spew.Sdump(tt.result))
+		}
+	}
+}
+
+func TestBasebackupOptions(t *testing.T) {
+	tests := []struct {
+		c             *cluster.BasebackupConfig
+		features      pg.BasebackupFeatures
+		tablespaceMap map[string]string
+		resyncMaxRate string
+		out           *pg.BasebackupOptions
+	}{
+		{
+			c:   nil,
+			out: nil,
+		},
+		{
+			c:   &cluster.BasebackupConfig{MaxRate: "100M", CheckpointMode: cluster.BasebackupCheckpointSpread},
+			out: &pg.BasebackupOptions{MaxRate: "100M", CheckpointMode: "spread"},
+		},
+		{
+			c:        &cluster.BasebackupConfig{ParallelWorkers: 4},
+			features: pg.BasebackupFeatures{Jobs: true},
+			out:      &pg.BasebackupOptions{Jobs: 4},
+		},
+		// parallel transfers not supported: fall back to a single worker
+		{
+			c:   &cluster.BasebackupConfig{MaxRate: "1024k", ParallelWorkers: 4},
+			out: &pg.BasebackupOptions{MaxRate: "1024k"},
+		},
+		{
+			c:        &cluster.BasebackupConfig{WalMethod: cluster.BasebackupWalMethodFetch, Compression: cluster.BasebackupCompressionZstd, CompressionLevel: 3},
+			features: pg.BasebackupFeatures{ServerCompression: true},
+			out:      &pg.BasebackupOptions{WalMethod: "fetch", Compression: "zstd", CompressionLevel: 3},
+		},
+		// server side compression not supported: don't compress
+		{
+			c:   &cluster.BasebackupConfig{Compression: cluster.BasebackupCompressionGzip, CompressionLevel: 5},
+			out: &pg.BasebackupOptions{},
+		},
+		{
+			tablespaceMap: map[string]string{"/pg/ts1": "/data/ts1"},
+			out:           &pg.BasebackupOptions{TablespaceMap: map[string]string{"/pg/ts1": "/data/ts1"}},
+		},
+		{
+			c:             &cluster.BasebackupConfig{MaxRate: "100M"},
+			tablespaceMap: map[string]string{"/pg/ts1": "/data/ts1"},
+			out:           &pg.BasebackupOptions{MaxRate: "100M", TablespaceMap: map[string]string{"/pg/ts1": "/data/ts1"}},
+		},
+		{
+			resyncMaxRate: "10M",
+			out:           &pg.BasebackupOptions{MaxRate: "10M"},
+		},
+		{
+			c:             &cluster.BasebackupConfig{CheckpointMode: cluster.BasebackupCheckpointFast},
+			resyncMaxRate: "10M",
+			out:           &pg.BasebackupOptions{MaxRate: "10M", CheckpointMode: "fast"},
+		},
+		// the basebackup config max rate has precedence
+		{
+			c:             &cluster.BasebackupConfig{MaxRate: "100M"},
+			resyncMaxRate: "10M",
+			out:           &pg.BasebackupOptions{MaxRate: "100M"},
+		},
+	}
+
+	for i, tt := range tests {
+		out := basebackupOptions(tt.c, tt.features, tt.tablespaceMap, tt.resyncMaxRate)
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: wrong options: got: %s, want: %s", i, spew.Sdump(out), spew.Sdump(tt.out))
+		}
+	}
+}
+
+func TestParseTablespaceMap(t *testing.T) {
+	tests := []struct {
+		in  string
+		out map[string]string
+		err error
+	}{
+		{
+			in:  "",
+			out: map[string]string{},
+		},
+		{
+			in:  "/pg/ts1=/data/ts1, /pg/ts2/=/data/ts2",
+			out: map[string]string{"/pg/ts1": "/data/ts1", "/pg/ts2": "/data/ts2"},
+		},
+		{
+			in:  "/pg/ts1",
+			err: fmt.Errorf(`wrong relocation "/pg/ts1", must be in the form olddir=newdir`),
+		},
+		{
+			in:  "/pg/ts1=/data/ts=1",
+			err: fmt.Errorf(`wrong relocation "/pg/ts1=/data/ts=1", must be in the form olddir=newdir`),
+		},
+		{
+			in:  "/pg/ts1=data/ts1",
+			err: fmt.Errorf(`wrong relocation "/pg/ts1=data/ts1", directories must be absolute paths`),
+		},
+		{
+			in:  "/pg/ts1=/data/ts1,/pg/ts1=/data/ts2",
+			err: fmt.Errorf(`duplicated directory "/pg/ts1"`),
+		},
+	}
+
+	for i, tt := range tests {
+		out, err := parseTablespaceMap(tt.in)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		} else if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: wrong tablespace map: got: %v, want: %v", i, out, tt.out)
+		}
+	}
+}
+
+func TestChannelBindingConnParams(t *testing.T) {
+	p := &PostgresKeeper{
+		pgSUAuthMethod:   "md5",
+		pgSUUsername:     "superuser",
+		pgSUPassword:     "supass",
+		pgReplAuthMethod: "md5",
+		pgReplUsername:   "repluser",
+		pgReplPassword:   "replpass",
+	}
+	followedDB := &cluster.DB{UID: "db2", Status: cluster.DBStatus{ListenAddress: "10.0.0.2", Port: "5432"}}
+
+	tests := []struct {
+		requireChannelBinding bool
+		sslmode               string
+		channelBinding        string
+	}{
+		{
+			sslmode: "prefer",
+		},
+		{
+			requireChannelBinding: true,
+			sslmode:               "require",
+			channelBinding:        "require",
+		},
+	}
+
+	for i, tt := range tests {
+		db := &cluster.DB{UID: "db1", Spec: &cluster.DBSpec{RequireChannelBinding: tt.requireChannelBinding}}
+		for _, cp := range []pg.ConnParams{p.getSUConnParams(db, followedDB), p.getReplConnParams(db, followedDB)} {
+			if cp.Get("sslmode") != tt.sslmode {
+				t.Errorf("#%d: wrong sslmode: got: %q, want: %q", i, cp.Get("sslmode"), tt.sslmode)
+			}
+			if cp.Get("channel_binding") != tt.channelBinding {
+				t.Errorf("#%d: wrong channel_binding: got: %q, want: %q", i, cp.Get("channel_binding"), tt.channelBinding)
+			}
+		}
+	}
+}
+
+func TestInternalStandbySettings(t *testing.T) {
+	replConnParams := pg.ConnParams{"host": "10.0.0.1", "port": "5432"}
+	tests := []struct {
+		delay    *cluster.Duration
+		strategy cluster.WalRetentionStrategy
+		out      *cluster.StandbySettings
+	}{
+		{
+			out: &cluster.StandbySettings{PrimaryConninfo: replConnParams.ConnString(), PrimarySlotName: "stolon_db1"},
+		},
+		{
+			strategy: cluster.WalRetentionStrategySlots,
+			out:      &cluster.StandbySettings{PrimaryConninfo: replConnParams.ConnString(), PrimarySlotName: "stolon_db1"},
+		},
+		{
+			strategy: cluster.WalRetentionStrategyWalKeep,
+			out:      &cluster.StandbySettings{PrimaryConninfo: replConnParams.ConnString()},
+		},
+		{
+			delay: &cluster.Duration{Duration: time.Hour},
+			out:   &cluster.StandbySettings{PrimaryConninfo: replConnParams.ConnString(), PrimarySlotName: "stolon_db1", RecoveryMinApplyDelay: "3600000ms"},
+		},
+		{
+			delay: &cluster.Duration{Duration: 1500 * time.Millisecond},
+			out:   &cluster.StandbySettings{PrimaryConninfo: replConnParams.ConnString(), PrimarySlotName: "stolon_db1", RecoveryMinApplyDelay: "1500ms"},
+		},
+	}
+
+	for i, tt := range tests {
+		db := &cluster.DB{UID: "db1", Spec: &cluster.DBSpec{RecoveryMinApplyDelay: tt.delay, WalRetentionStrategy: tt.strategy}}
+		out := internalStandbySettings(db, replConnParams)
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: wrong standby settings: got: %s, want: %s", i, spew.Sdump(out), spew.Sdump(tt.out))
+		}
+	}
+}
+
+func TestInternalArchiveRecoverySettings(t *testing.T) {
+	internalFollow := &cluster.FollowConfig{Type: cluster.FollowTypeInternal, DBUID: "db2"}
+	tests := []struct {
+		resyncMethod cluster.ResyncMethod
+		walgConfig   *cluster.WalGConfig
+		followConfig *cluster.FollowConfig
+		out          *cluster.ArchiveRecoverySettings
+	}{
+		{
+			followConfig: internalFollow,
+		},
+		{
+			resyncMethod: cluster.ResyncMethodPgBackRest,
+			followConfig: internalFollow,
+		},
+		{
+			resyncMethod: cluster.ResyncMethodWalG,
+			followConfig: internalFollow,
+			out:          &cluster.ArchiveRecoverySettings{RestoreCommand: `wal-g wal-fetch "%f" "%p"`},
+		},
+		{
+			resyncMethod: cluster.ResyncMethodWalG,
+			walgConfig:   &cluster.WalGConfig{Command: "envdir /etc/wal-e.d/env  wal-e", BackupName: "base_000000010000000000000002"},
+			followConfig: internalFollow,
+			out:          &cluster.ArchiveRecoverySettings{RestoreCommand: `envdir /etc/wal-e.d/env wal-e wal-fetch "%f" "%p"`},
+		},
+		{
+			resyncMethod: cluster.ResyncMethodWalG,
+			followConfig: &cluster.FollowConfig{Type: cluster.FollowTypeExternal},
+		},
+	}
+
+	for i, tt := range tests {
+		db := &cluster.DB{UID: "db1", Spec: &cluster.DBSpec{ResyncMethod: tt.resyncMethod, WalGConfig: tt.walgConfig, FollowConfig: tt.followConfig}}
+		out := internalArchiveRecoverySettings(db)
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: wrong archive recovery settings: got: %s, want: %s", i, spew.Sdump(out), spew.Sdump(tt.out))
+		}
+	}
+}
+
+func TestWalgCommand(t *testing.T) {
+	tests := []struct {
+		walgConfig *cluster.WalGConfig
+		command    []string
+		backupName string
+	}{
+		{
+			command:    []string{"wal-g"},
+			backupName: "LATEST",
+		},
+		{
+			walgConfig: &cluster.WalGConfig{BackupName: "base_000000010000000000000002"},
+			command:    []string{"wal-g"},
+			backupName: "base_000000010000000000000002",
+		},
+		{
+			walgConfig: &cluster.WalGConfig{Command: "envdir /etc/wal-e.d/env wal-e"},
+			command:    []string{"envdir", "/etc/wal-e.d/env", "wal-e"},
+			backupName: "LATEST",
+		},
+	}
+
+	for i, tt := range tests {
+		command, backupName := walgCommand(tt.walgConfig)
+		if !reflect.DeepEqual(command, tt.command) {
+			t.Errorf("#%d: wrong command: got: %v, want: %v", i, command, tt.command)
+		}
+		if backupName != tt.backupName {
+			t.Errorf("#%d: wrong backup name: got: %q, want: %q", i, backupName, tt.backupName)
+		}
+	}
+}
+
+func TestWalKeepParameters(t *testing.T) {
+	tests := []struct {
+		maj          int
+		strategy     cluster.WalRetentionStrategy
+		pgParameters cluster.PGParameters
+		out          common.Parameters
+	}{
+		{
+			maj: 12,
+			out: common.Parameters{"wal_keep_segments": "8"},
+		},
+		{
+			maj: 13,
+			out: common.Parameters{"wal_keep_size": "128MB"},
+		},
+		{
+			maj:          12,
+			strategy:     cluster.WalRetentionStrategyWalKeep,
+			pgParameters: cluster.PGParameters{"wal_keep_segments": "64"},
+			out:          common.Parameters{"wal_keep_segments": "64"},
+		},
+		{
+			maj:          13,
+			strategy:     cluster.WalRetentionStrategyBoth,
+			pgParameters: cluster.PGParameters{"wal_keep_size": "1GB"},
+			out:          common.Parameters{"wal_keep_size": "1GB"},
+		},
+		// the parameter not supported by the postgres version is ignored
+		{
+			maj:          13,
+			pgParameters: cluster.PGParameters{"wal_keep_segments": "64"},
+			out:          common.Parameters{"wal_keep_size": "128MB"},
+		},
+		{
+			maj:      12,
+			strategy: cluster.WalRetentionStrategySlots,
+			out:      common.Parameters{"wal_keep_segments": "0"},
+		},
+		{
+			maj:      13,
+			strategy: cluster.WalRetentionStrategySlots,
+			out:      common.Parameters{"wal_keep_size": "0"},
+		},
+	}
+
+	for i, tt := range tests {
+		db := &cluster.DB{UID: "db1", Spec: &cluster.DBSpec{WalRetentionStrategy: tt.strategy, PGParameters: tt.pgParameters}}
+		out := walKeepParameters(db, tt.maj)
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: wrong parameters: got: %v, want: %v", i, out, tt.out)
+		}
+	}
+}
+
+func TestHostResolver(t *testing.T) {
+	now := time.Now()
+	var addrs []string
+	var lookupErr error
+	lookups := 0
+	r := newHostResolver(30 * time.Second)
+	r.nowFn = func() time.Time { return now }
+	r.lookupFn = func(host string) ([]string, error) {
+		lookups++
+		return addrs, lookupErr
+	}
+
+	addrs = []string{"10.0.0.2", "10.0.0.1"}
+	if addr := r.hostAddr("primary.example.com"); addr != "10.0.0.1" {
+		t.Fatalf("wrong address: got: %q, want: %q", addr, "10.0.0.1")
+	}
+	// cached until the interval elapses
+	addrs = []string{"10.0.0.3"}
+	now = now.Add(10 * time.Second)
+	if addr := r.hostAddr("primary.example.com"); addr != "10.0.0.1" {
+		t.Fatalf("wrong address: got: %q, want: %q", addr, "10.0.0.1")
+	}
+	if lookups != 1 {
+		t.Fatalf("expected 1 lookup, got %d", lookups)
+	}
+	// the current address is kept while it's still resolved
+	addrs = []string{"10.0.0.3", "10.0.0.1"}
+	now = now.Add(30 * time.Second)
+	if addr := r.hostAddr("primary.example.com"); addr != "10.0.0.1" {
+		t.Fatalf("wrong address: got: %q, want: %q", addr, "10.0.0.1")
+	}
+	// address changed
+	addrs = []string{"10.0.0.3"}
+	now = now.Add(30 * time.Second)
+	if addr := r.hostAddr("primary.example.com"); addr != "10.0.0.3" {
+		t.Fatalf("wrong address: got: %q, want: %q", addr, "10.0.0.3")
+	}
+	// resolution failure: the last resolved address is kept
+	lookupErr = fmt.Errorf("no such host")
+	now = now.Add(30 * time.Second)
+	if addr := r.hostAddr("primary.example.com"); addr != "10.0.0.3" {
+		t.Fatalf("wrong address: got: %q, want: %q", addr, "10.0.0.3")
+	}
+	// the address of the previous host isn't used for a different host
+	if addr := r.hostAddr("other.example.com"); addr != "" {
+		t.Fatalf("wrong address: got: %q, want: %q", addr, "")
+	}
+}
+
+func TestExternalStandbySettings(t *testing.T) {
+	tests := []struct {
+		primaryConninfo string
+		out             string
+	}{
+		{
+			primaryConninfo: "host=primary.example.com port=5432 user=repluser",
+			out:             "host=primary.example.com hostaddr=10.0.0.1 port=5432 user=repluser",
+		},
+		{
+			primaryConninfo: "postgres://repluser@primary.example.com:5432",
+			out:             "host=primary.example.com hostaddr=10.0.0.1 port=5432 user=repluser",
+		},
+		// ip literals, provided hostaddr, unix sockets and multiple hosts
+		// aren't changed
+		{
+			primaryConninfo: "host=192.168.1.1 port=5432 user=repluser",
+			out:             "host=192.168.1.1 port=5432 user=repluser",
+		},
+		{
+			primaryConninfo: "host=primary.example.com hostaddr=192.168.1.1 user=repluser",
+			out:             "host=primary.example.com hostaddr=192.168.1.1 user=repluser",
+		},
+		{
+			primaryConninfo: "host=/var/run/postgresql user=repluser",
+			out:             "host=/var/run/postgresql user=repluser",
+		},
+		{
+			primaryConninfo: "host=primary1.example.com,primary2.example.com user=repluser",
+			out:             "host=primary1.example.com,primary2.example.com user=repluser",
+		},
+	}
+
+	for i, tt := range tests {
+		p := &PostgresKeeper{externalHostResolver: newHostResolver(30 * time.Second)}
+		p.externalHostResolver.lookupFn = func(host string) ([]string, error) {
+			return []string{"10.0.0.1"}, nil
+		}
+		standbySettings := &cluster.StandbySettings{PrimaryConninfo: tt.primaryConninfo, PrimarySlotName: "slot1"}
+		out := p.externalStandbySettings(standbySettings)
+		if out.PrimaryConninfo != tt.out {
+			t.Errorf("#%d: wrong primary conninfo: got: %q, want: %q", i, out.PrimaryConninfo, tt.out)
+		}
+		if out.PrimarySlotName != "slot1" {
+			t.Errorf("#%d: wrong primary slot name: %q", i, out.PrimarySlotName)
+		}
+		if standbySettings.PrimaryConninfo != tt.primaryConninfo {
+			t.Errorf("#%d: provided standby settings changed", i)
+		}
+	}
+}
+
+func TestFencingFileExists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stolon-keeper")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fencingFile := filepath.Join(dir, "fenced")
+	exists, err := fencingFileExists(fencingFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exists {
+		t.Errorf("got fencing file existing, want not existing")
+	}
+
+	if err := ioutil.WriteFile(fencingFile, []byte{}, 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	exists, err = fencingFileExists(fencingFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !exists {
+		t.Errorf("got fencing file not existing, want existing")
+	}
+}
+
+func TestRunRoleChangeHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stolon-keeper")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var posted []roleChangeHookPayload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var pl roleChangeHookPayload
+		if err := json.NewDecoder(r.Body).Decode(&pl); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		posted = append(posted, pl)
+	}))
+	defer ts.Close()
+
+	outFile := filepath.Join(dir, "out")
+	p := &PostgresKeeper{
+		cfg: &config{
+			roleChangeHook:        fmt.Sprintf(`echo "$STOLON_EVENT $STOLON_ROLE $STOLON_CLUSTER_UID $STOLON_KEEPER_UID $STOLON_DB_UID" >> %s`, outFile),
+			roleChangeHookURL:     ts.URL,
+			roleChangeHookTimeout: 1,
+		},
+		keeperLocalState: &KeeperLocalState{UID: "keeper1", ClusterUID: "cluster1"},
+	}
+	db := &cluster.DB{UID: "db1"}
+	p.runRoleChangeHooks(roleChangeEventPromote, db, common.RoleMaster)
+	p.runRoleChangeHooks(roleChangeEventResyncStart, db, common.RoleStandby)
+
+	out, err := ioutil.ReadFile(outFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedOut := "promote master cluster1 keeper1 db1\nresync-start standby cluster1 keeper1 db1\n"
+	if string(out) != expectedOut {
+		t.Errorf("got hook output: %q, want: %q", out, expectedOut)
+	}
+	expectedPosted := []roleChangeHookPayload{
+		{Event: "promote", Role: "master", ClusterUID: "cluster1", KeeperUID: "keeper1", DBUID: "db1"},
+		{Event: "resync-start", Role: "standby", ClusterUID: "cluster1", KeeperUID: "keeper1", DBUID: "db1"},
+	}
+	if !reflect.DeepEqual(posted, expectedPosted) {
+		t.Errorf("got posted payloads: %v, want: %v", posted, expectedPosted)
+	}
+}
+
+func TestPostRoleChangeHook(t *testing.T) {
+	tests := []struct {
+		status int
+		err    bool
+	}{
+		{status: http.StatusOK},
+		{status: http.StatusNoContent},
+		{status: http.StatusNotFound, err: true},
+		{status: http.StatusInternalServerError, err: true},
+	}
+
+	for i, tt := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("#%d: got content type: %q, want: application/json", i, ct)
+			}
+			w.WriteHeader(tt.status)
+		}))
+		err := postRoleChangeHook(ts.URL, time.Second, &roleChangeHookPayload{Event: "promote"})
+		ts.Close()
+		if tt.err && err == nil {
+			t.Errorf("#%d: got no error, wanted error", i)
+		} else if !tt.err && err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestKeeperUIDInUse(t *testing.T) {
+	tests := []struct {
+		prevKI *cluster.KeeperInfo
+		curKI  *cluster.KeeperInfo
+		inUse  bool
+	}{
+		{},
+		// our keeper info
+		{
+			prevKI: &cluster.KeeperInfo{InfoUID: "info1", BootUUID: "boot1"},
+			curKI:  &cluster.KeeperInfo{InfoUID: "info2", BootUUID: "boot1"},
+		},
+		// not updated keeper info of a previous keeper process
+		{
+			prevKI: &cluster.KeeperInfo{InfoUID: "info1", BootUUID: "boot2"},
+			curKI:  &cluster.KeeperInfo{InfoUID: "info1", BootUUID: "boot2"},
+		},
+		// updated keeper info of another keeper process
+		{
+			prevKI: &cluster.KeeperInfo{InfoUID: "info1", BootUUID: "boot2"},
+			curKI:  &cluster.KeeperInfo{InfoUID: "info2", BootUUID: "boot2"},
+			inUse:  true,
+		},
+		// keeper info of another keeper process just started
+		{
+			curKI: &cluster.KeeperInfo{InfoUID: "info1", BootUUID: "boot2"},
+			inUse: true,
+		},
+	}
+
+	for i, tt := range tests {
+		inUse := keeperUIDInUse(tt.prevKI, tt.curKI, "boot1")
+		if inUse != tt.inUse {
+			t.Errorf("#%d: got inUse: %t, want: %t", i, inUse, tt.inUse)
+		}
+	}
+}
+
+func TestKeeperCollector(t *testing.T) {
+	gather := func(p *PostgresKeeper) map[string]float64 {
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(newKeeperCollector(p))
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		values := map[string]float64{}
+		for _, mf := range mfs {
+			for _, m := range mf.Metric {
+				name := mf.GetName()
+				for _, l := range m.Label {
+					name += fmt.Sprintf("{%s=%s}", l.GetName(), l.GetValue())
+				}
+				switch {
+				case m.Gauge != nil:
+					values[name] = m.Gauge.GetValue()
+				case m.Counter != nil:
+					values[name] = m.Counter.GetValue()
+				}
+			}
+		}
+		return values
+	}
+
+	tests := []struct {
+		name     string
+		pgState  *cluster.PostgresState
+		metrics  keeperMetrics
+		expected map[string]float64
+	}{
+		{
+			name: "postgres down",
+			expected: map[string]float64{
+				"stolon_keeper_postgres_up":              0,
+				"stolon_keeper_role{role=master}":        0,
+				"stolon_keeper_role{role=standby}":       0,
+				"stolon_keeper_resyncs_total":            0,
+				"stolon_keeper_pg_rewind_attempts_total": 0,
+				"stolon_keeper_pg_rewind_failures_total": 0,
+				"stolon_keeper_convergence_errors_total": 0,
+			},
+		},
+		{
+			name:    "master",
+			pgState: &cluster.PostgresState{Healthy: true, TimelineID: 3, XLogPos: 1000},
+			metrics: keeperMetrics{role: common.RoleMaster, masterXLogPos: 1000, convergenceErrors: 2},
+			expected: map[string]float64{
+				"stolon_keeper_postgres_up":              1,
+				"stolon_keeper_timeline_id":              3,
+				"stolon_keeper_role{role=master}":        1,
+				"stolon_keeper_role{role=standby}":       0,
+				"stolon_keeper_resyncs_total":            0,
+				"stolon_keeper_pg_rewind_attempts_total": 0,
+				"stolon_keeper_pg_rewind_failures_total": 0,
+				"stolon_keeper_convergence_errors_total": 2,
+			},
+		},
+		{
+			name:    "resynced standby",
+			pgState: &cluster.PostgresState{Healthy: true, TimelineID: 2, XLogPos: 900},
+			metrics: keeperMetrics{
+				role:               common.RoleStandby,
+				masterXLogPos:      1000,
+				replayLag:          1.5,
+				replayLagValid:     true,
+				resyncs:            1,
+				lastResyncDuration: 10 * time.Second,
+				pgRewindAttempts:   1,
+				pgRewindFailures:   1,
+			},
+			expected: map[string]float64{
+				"stolon_keeper_postgres_up":                  1,
+				"stolon_keeper_timeline_id":                  2,
+				"stolon_keeper_role{role=master}":            0,
+				"stolon_keeper_role{role=standby}":           1,
+				"stolon_keeper_replication_lag_bytes":        100,
+				"stolon_keeper_replication_lag_seconds":      1.5,
+				"stolon_keeper_resyncs_total":                1,
+				"stolon_keeper_last_resync_duration_seconds": 10,
+				"stolon_keeper_pg_rewind_attempts_total":     1,
+				"stolon_keeper_pg_rewind_failures_total":     1,
+				"stolon_keeper_convergence_errors_total":     0,
+			},
+		},
+		{
+			name:    "standby ahead of the reported master xlog position",
+			pgState: &cluster.PostgresState{Healthy: true, TimelineID: 2, XLogPos: 1100},
+			metrics: keeperMetrics{role: common.RoleStandby, masterXLogPos: 1000},
+			expected: map[string]float64{
+				"stolon_keeper_postgres_up":              1,
+				"stolon_keeper_timeline_id":              2,
+				"stolon_keeper_role{role=master}":        0,
+				"stolon_keeper_role{role=standby}":       1,
+				"stolon_keeper_replication_lag_bytes":    0,
+				"stolon_keeper_resyncs_total":            0,
+				"stolon_keeper_pg_rewind_attempts_total": 0,
+				"stolon_keeper_pg_rewind_failures_total": 0,
+				"stolon_keeper_convergence_errors_total": 0,
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		p := &PostgresKeeper{lastPGState: tt.pgState, metrics: tt.metrics}
+		values := gather(p)
+		if !reflect.DeepEqual(values, tt.expected) {
+			t.Errorf("#%d (%s): got metrics: %v, want: %v", i, tt.name, values, tt.expected)
+		}
+	}
+}
+
+func TestCheckTimelineDivergence(t *testing.T) {
+	newcd := func(master string) *cluster.ClusterData {
+		return &cluster.ClusterData{
+			Cluster: &cluster.Cluster{Status: cluster.ClusterStatus{Master: master}},
+			DBs: cluster.DBs{
+				"db1": &cluster.DB{UID: "db1", Status: cluster.DBStatus{TimelineID: 1}},
+				"db2": &cluster.DB{UID: "db2", Status: cluster.DBStatus{
+					TimelineID: 3,
+					TimelinesHistory: cluster.PostgresTimelinesHistory{
+						{TimelineID: 1, SwitchPoint: 1000},
+						{TimelineID: 2, SwitchPoint: 2000},
+					},
+				}},
+			},
+		}
+	}
+
+	tests := []struct {
+		master     string
+		timelineID uint64
+		xLogPos    uint64
+		noHistory  bool
+		divergence bool
+		diverged   bool
+	}{
+		// we are the cluster master
+		{master: "db1", timelineID: 1, xLogPos: 1500},
+		// the cluster master isn't on a newer timeline
+		{master: "db2", timelineID: 3, xLogPos: 2500},
+		// the master forked from our timeline after our xlog position
+		{master: "db2", timelineID: 1, xLogPos: 900, divergence: true},
+		{master: "db2", timelineID: 1, xLogPos: 1000, divergence: true},
+		// the master forked from our timeline before our xlog position
+		{master: "db2", timelineID: 1, xLogPos: 1500, divergence: true, diverged: true},
+		{master: "db2", timelineID: 2, xLogPos: 2100, divergence: true, diverged: true},
+		// our timeline isn't in the master timeline history
+		{master: "db2", timelineID: 1, xLogPos: 500, noHistory: true, divergence: true, diverged: true},
+	}
+
+	for i, tt := range tests {
+		cd := newcd(tt.master)
+		if tt.noHistory {
+			cd.DBs["db2"].Status.TimelinesHistory = nil
+		}
+		d := checkTimelineDivergence(cd, cd.DBs["db1"], tt.timelineID, tt.xLogPos)
+		if (d != nil) != tt.divergence {
+			t.Errorf("#%d: got divergence: %t, want: %t", i, d != nil, tt.divergence)
+			continue
+		}
+		if d == nil {
+			continue
+		}
+		if d.Diverged != tt.diverged {
+			t.Errorf("#%d: got diverged: %t, want: %t", i, d.Diverged, tt.diverged)
+		}
+		if d.DBUID != "db1" || d.MasterDBUID != "db2" || d.MasterTimelineID != 3 || d.TimelineID != tt.timelineID || d.XLogPos != tt.xLogPos {
+			t.Errorf("#%d: wrong divergence: %+v", i, d)
+		}
+	}
+}
+
+func TestAddSharedPreloadLibraries(t *testing.T) {
+	tests := []struct {
+		cur  string
+		libs []string
+		out  string
+	}{
+		{libs: []string{}, out: ""},
+		{libs: []string{"pg_stat_statements"}, out: "pg_stat_statements"},
+		{cur: "auto_explain", libs: []string{"pg_stat_statements", "pgaudit"}, out: "auto_explain,pg_stat_statements,pgaudit"},
+		{cur: "pgaudit, auto_explain", libs: []string{"pgaudit"}, out: "pgaudit, auto_explain"},
+	}
+
+	for i, tt := range tests {
+		parameters := common.Parameters{}
+		if tt.cur != "" {
+			parameters["shared_preload_libraries"] = tt.cur
+		}
+		addSharedPreloadLibraries(parameters, tt.libs)
+		if out := parameters["shared_preload_libraries"]; out != tt.out {
+			t.Errorf("#%d: got shared_preload_libraries: %q, want: %q", i, out, tt.out)
+		}
+	}
+}
+
+func TestExtensionDatabases(t *testing.T) {
+	databases := []string{"app", "postgres"}
+	tests := []struct {
+		ext cluster.Extension
+		out []string
+	}{
+		{ext: cluster.Extension{Name: "pg_stat_statements"}, out: []string{"app", "postgres"}},
+		{ext: cluster.Extension{Name: "postgis", Databases: []string{"app"}}, out: []string{"app"}},
+		{ext: cluster.Extension{Name: "postgis", Databases: []string{"app", "notexisting"}}, out: []string{"app"}},
+	}
+
+	for i, tt := range tests {
+		out := extensionDatabases(tt.ext, databases)
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: got databases: %v, want: %v", i, out, tt.out)
+		}
+	}
+}
+
+func TestApplyPendingPasswordsCoordinated(t *testing.T) {
+	cur := &keeperPasswords{su: "supass", repl: "replpass"}
+	next := &keeperPasswords{su: "newsupass", repl: "newreplpass"}
+	fingerprint := passwordsFingerprint(cur, next)
+	if other := passwordsFingerprint(cur, &keeperPasswords{su: "newsupass", repl: "replpass"}); other == fingerprint {
+		t.Fatalf("got the same fingerprint for different passwords")
+	}
+
+	p := &PostgresKeeper{
+		cfg:              &config{coordinatedPasswordRotation: true},
+		pgSUUsername:     "stolon",
+		pgSUPassword:     cur.su,
+		pgReplUsername:   "repl",
+		pgReplPassword:   cur.repl,
+		pgSUAuthMethod:   "md5",
+		pgReplAuthMethod: "md5",
+	}
+	p.pgm = pg.NewManager("", "", p.getLocalConnParams(), nil, "md5", "stolon", cur.su, "md5", "repl", cur.repl, time.Second)
+	p.rotatePasswords(next)
+	if s := p.getPasswordsStatus(); s.PendingFingerprint != fingerprint {
+		t.Fatalf("got pending fingerprint %q, want %q", s.PendingFingerprint, fingerprint)
+	}
+
+	cd := &cluster.ClusterData{Cluster: &cluster.Cluster{}}
+	// without a credentials rotation the passwords aren't applied
+	if err := p.applyPendingPasswords(cd, common.RoleStandby); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.pgSUPassword != cur.su {
+		t.Fatalf("passwords applied without a credentials rotation")
+	}
+
+	// a standby waits for the master phase to complete
+	cd.Cluster.Status.CredentialsRotation = &cluster.CredentialsRotation{UID: "rotation1", Phase: cluster.CredentialsRotationPhaseMaster, Fingerprint: fingerprint}
+	if err := p.applyPendingPasswords(cd, common.RoleStandby); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.pgSUPassword != cur.su {
+		t.Fatalf("passwords applied by a standby in the master phase")
+	}
+
+	// the passwords of another rotation aren't applied
+	cd.Cluster.Status.CredentialsRotation = &cluster.CredentialsRotation{UID: "rotation1", Phase: cluster.CredentialsRotationPhaseStandbys, Fingerprint: "other"}
+	if err := p.applyPendingPasswords(cd, common.RoleStandby); err == nil {
+		t.Fatalf("got no error applying the passwords of another rotation")
+	}
+
+	cd.Cluster.Status.CredentialsRotation.Fingerprint = fingerprint
+	if err := p.applyPendingPasswords(cd, common.RoleStandby); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.pgSUPassword != next.su || p.pgReplPassword != next.repl {
+		t.Fatalf("passwords not applied in the standbys phase")
+	}
+	if s := p.getPasswordsStatus(); s.PendingFingerprint != "" || s.AppliedRotation != "rotation1" {
+		t.Fatalf("got passwords status %+v, want the rotation1 applied", s)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+// monitoringRole is the monitoring role set up on the master db
+type monitoringRole struct {
+	username string
+	password string
+	scram    bool
+}
+
+// refreshMonitoringRole creates, or updates, the monitoring role defined in
+// the db spec. The role is only set up when it differs from the last one set
+// up by the keeper. The role isn't dropped when it's removed from the spec.
+func (p *PostgresKeeper) refreshMonitoringRole(db *cluster.DB) error {
+	mu := db.Spec.MonitoringUser
+	if mu == nil {
+		p.monitoringRole = nil
+		return nil
+	}
+	if mu.Username == p.pgSUUsername || mu.Username == p.pgReplUsername {
+		return fmt.Errorf("monitoring user %q cannot be the superuser or the replication user", mu.Username)
+	}
+	if p.cfg.pgMonitoringPassword == "" {
+		return fmt.Errorf("monitoring user defined but no --pg-monitoring-passwordfile provided")
+	}
+
+	role := monitoringRole{
+		username: mu.Username,
+		password: p.cfg.pgMonitoringPassword,
+		scram:    db.Spec.RequireChannelBinding || p.useScramAuth(),
+	}
+	if p.monitoringRole != nil && *p.monitoringRole == role {
+		return nil
+	}
+
+	// the pg_monitor role is available only on postgres >= 10
+	maj, _, err := p.pgm.PGDataVersion()
+	if err != nil {
+		return err
+	}
+	if maj < 10 {
+		log.Warnw("pg_monitor role not available on postgres < 10, the monitoring role won't be granted it")
+	}
+	log.Infow("setting up monitoring role", "role", role.username)
+	if err := p.pgm.SetupMonitoringRole(role.username, role.password, maj >= 10, role.scram); err != nil {
+		return err
+	}
+	p.monitoringRole = &role
+	return nil
+}
@@ -0,0 +1,264 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/sorintlab/stolon/cmd"
+	"github.com/sorintlab/stolon/internal/store"
+
+	"github.com/ghodss/yaml"
+	"go.uber.org/zap"
+)
+
+// reloadableConfig are the keeper options that can be defined in the config
+// file and are reloaded on SIGHUP without restarting postgres
+type reloadableConfig struct {
+	// PGAdvertiseAddress is the postgres address advertised to the other
+	// components, defaults to the pg listen address
+	PGAdvertiseAddress string `json:"pgAdvertiseAddress,omitempty"`
+	// PGAdvertisePort is the postgres port advertised to the other
+	// components, defaults to the pg port
+	PGAdvertisePort    string `json:"pgAdvertisePort,omitempty"`
+	PGSUPasswordFile   string `json:"pgSUPasswordFile,omitempty"`
+	PGReplPasswordFile string `json:"pgReplPasswordFile,omitempty"`
+	StoreEndpoints     string `json:"storeEndpoints,omitempty"`
+}
+
+// reloadableConfig returns the reloadable options of the config
+func (c *config) reloadableConfig() reloadableConfig {
+	return reloadableConfig{
+		PGAdvertiseAddress: c.pgAdvertiseAddress,
+		PGAdvertisePort:    c.pgAdvertisePort,
+		PGSUPasswordFile:   c.pgSUPasswordFile,
+		PGReplPasswordFile: c.pgReplPasswordFile,
+		StoreEndpoints:     c.StoreEndpoints,
+	}
+}
+
+// applyReloadableConfig sets the config options to the reloadable ones
+func (c *config) applyReloadableConfig(rc reloadableConfig) {
+	c.pgAdvertiseAddress = rc.PGAdvertiseAddress
+	c.pgAdvertisePort = rc.PGAdvertisePort
+	c.pgSUPasswordFile = rc.PGSUPasswordFile
+	c.pgReplPasswordFile = rc.PGReplPasswordFile
+	c.StoreEndpoints = rc.StoreEndpoints
+}
+
+// override returns the config with the options defined in o replacing the
+// ones of c
+func (c reloadableConfig) override(o *reloadableConfig) reloadableConfig {
+	for _, f := range []struct {
+		dest  *string
+		value string
+	}{
+		{&c.PGAdvertiseAddress, o.PGAdvertiseAddress},
+		{&c.PGAdvertisePort, o.PGAdvertisePort},
+		{&c.PGSUPasswordFile, o.PGSUPasswordFile},
+		{&c.PGReplPasswordFile, o.PGReplPasswordFile},
+		{&c.StoreEndpoints, o.StoreEndpoints},
+	} {
+		if f.value != "" {
+			*f.dest = f.value
+		}
+	}
+	return c
+}
+
+func (c *reloadableConfig) validate() error {
+	if c.PGAdvertisePort != "" {
+		port, err := strconv.Atoi(c.PGAdvertisePort)
+		if err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("wrong pg advertise port %q", c.PGAdvertisePort)
+		}
+	}
+	return nil
+}
+
+// readConfigFile reads the yaml (or json) keeper config file
+func readConfigFile(path string) (*reloadableConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read config file %q: %v", path, err)
+	}
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse config file %q: %v", path, err)
+	}
+	rc := &reloadableConfig{}
+	// an empty file is converted to null
+	if bytes.Equal(jsonData, []byte("null")) {
+		return rc, nil
+	}
+	d := json.NewDecoder(bytes.NewReader(jsonData))
+	d.DisallowUnknownFields()
+	if err := d.Decode(rc); err != nil {
+		return nil, fmt.Errorf("cannot parse config file %q: %v", path, err)
+	}
+	return rc, nil
+}
+
+// readPasswordFiles reads the passwords defined as password files. The
+// passwords not defined as password files are empty.
+func readPasswordFiles(rc *reloadableConfig) (*keeperPasswords, error) {
+	passwords := &keeperPasswords{}
+	for _, s := range []struct {
+		name string
+		file string
+		dest *string
+	}{
+		{"superuser", rc.PGSUPasswordFile, &passwords.su},
+		{"replication user", rc.PGReplPasswordFile, &passwords.repl},
+	} {
+		if s.file == "" {
+			continue
+		}
+		password, err := readPasswordFromFile(s.file)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read pg %s password: %v", s.name, err)
+		}
+		password = strings.TrimRight(password, "\r\n")
+		if password == "" {
+			return nil, fmt.Errorf("pg %s password file %q is empty", s.name, s.file)
+		}
+		*s.dest = password
+	}
+	return passwords, nil
+}
+
+// advertiseAddress returns the postgres address and port advertised to the
+// other components
+func (p *PostgresKeeper) advertiseAddress() (string, string) {
+	p.configMutex.Lock()
+	defer p.configMutex.Unlock()
+	address, port := p.reloadable.PGAdvertiseAddress, p.reloadable.PGAdvertisePort
+	if address == "" {
+		address = p.pgListenAddress
+	}
+	if port == "" {
+		port = p.pgPort
+	}
+	return address, port
+}
+
+// store returns the current store, replaced when the store endpoints are
+// reloaded
+func (p *PostgresKeeper) store() store.Store {
+	p.configMutex.Lock()
+	defer p.configMutex.Unlock()
+	return p.e
+}
+
+// watchReload reloads the config on SIGHUP
+func (p *PostgresKeeper) watchReload(ctx context.Context) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	defer signal.Stop(sigCh)
+	for {
+		select {
+		case <-sigCh:
+		case <-ctx.Done():
+			return
+		}
+		log.Infow("reloading config")
+		if err := p.reload(); err != nil {
+			log.Errorw("failed to reload config, keeping the current one", zap.Error(err))
+		}
+	}
+}
+
+// reload reads the config file and the password files and applies the
+// changed options. When an error happens nothing is applied.
+func (p *PostgresKeeper) reload() error {
+	rc := p.cfg.flagsConfig
+	if p.cfg.configFile != "" {
+		frc, err := readConfigFile(p.cfg.configFile)
+		if err != nil {
+			return err
+		}
+		rc = rc.override(frc)
+	}
+	if err := rc.validate(); err != nil {
+		return err
+	}
+
+	p.configMutex.Lock()
+	cur := p.reloadable
+	p.configMutex.Unlock()
+
+	// the passwords can be changed only when the keeper has been started
+	// reading them from a file, since the other sources (the flags, vault)
+	// would be used at the next restart
+	if (rc.PGSUPasswordFile == "") != (cur.PGSUPasswordFile == "") {
+		return fmt.Errorf("the pg superuser password file can be changed only if the keeper has been started with a pg superuser password file")
+	}
+	if (rc.PGReplPasswordFile == "") != (cur.PGReplPasswordFile == "") {
+		return fmt.Errorf("the pg replication user password file can be changed only if the keeper has been started with a pg replication user password file")
+	}
+	passwords, err := readPasswordFiles(&rc)
+	if err != nil {
+		return err
+	}
+
+	var newStore store.Store
+	if rc.StoreEndpoints != cur.StoreEndpoints {
+		commonCfg := p.cfg.CommonConfig
+		commonCfg.StoreEndpoints = rc.StoreEndpoints
+		newStore, err = cmd.NewStore(&commonCfg)
+		if err != nil {
+			return fmt.Errorf("cannot create store: %v", err)
+		}
+	}
+
+	p.configMutex.Lock()
+	p.reloadable = rc
+	oldStore := p.e
+	if newStore != nil {
+		p.e = newStore
+	}
+	p.configMutex.Unlock()
+
+	if rc.PGAdvertiseAddress != cur.PGAdvertiseAddress || rc.PGAdvertisePort != cur.PGAdvertisePort {
+		address, port := p.advertiseAddress()
+		log.Infow("pg advertise address changed", "address", address, "port", port)
+	}
+	if newStore != nil {
+		log.Infow("store endpoints changed", "endpoints", rc.StoreEndpoints)
+		// the requests in progress on the old store will fail and will be
+		// retried on the new one
+		if c, ok := oldStore.(io.Closer); ok {
+			c.Close()
+		}
+		select {
+		case p.storeChangedCh <- struct{}{}:
+		default:
+		}
+	}
+	if p.rotatePasswords(passwords) {
+		log.Infow("password files passwords rotated")
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stolon")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		data     string
+		expected *reloadableConfig
+		err      bool
+	}{
+		{
+			data:     "",
+			expected: &reloadableConfig{},
+		},
+		{
+			data:     "pgAdvertiseAddress: 10.0.0.1\npgAdvertisePort: \"5433\"\nstoreEndpoints: http://etcd1:2379,http://etcd2:2379\n",
+			expected: &reloadableConfig{PGAdvertiseAddress: "10.0.0.1", PGAdvertisePort: "5433", StoreEndpoints: "http://etcd1:2379,http://etcd2:2379"},
+		},
+		{
+			data:     `{"pgSUPasswordFile": "/etc/stolon/su", "pgReplPasswordFile": "/etc/stolon/repl"}`,
+			expected: &reloadableConfig{PGSUPasswordFile: "/etc/stolon/su", PGReplPasswordFile: "/etc/stolon/repl"},
+		},
+		{
+			// unknown options
+			data: "pgListenAddress: 10.0.0.1\n",
+			err:  true,
+		},
+		{
+			data: "pgAdvertiseAddress: [\n",
+			err:  true,
+		},
+	}
+
+	path := filepath.Join(dir, "keeper.yaml")
+	for i, tt := range tests {
+		if err := ioutil.WriteFile(path, []byte(tt.data), 0600); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		rc, err := readConfigFile(path)
+		if tt.err {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		} else if *rc != *tt.expected {
+			t.Errorf("#%d: got config: %+v, want: %+v", i, rc, tt.expected)
+		}
+	}
+
+	if _, err := readConfigFile(filepath.Join(dir, "notexisting")); err == nil {
+		t.Errorf("got no error for a not existing config file")
+	}
+}
+
+func TestReloadableConfigOverride(t *testing.T) {
+	flags := reloadableConfig{PGAdvertisePort: "5432", PGSUPasswordFile: "/su", StoreEndpoints: "http://etcd1:2379"}
+	rc := flags.override(&reloadableConfig{PGAdvertiseAddress: "10.0.0.1", StoreEndpoints: "http://etcd2:2379"})
+	expected := reloadableConfig{PGAdvertiseAddress: "10.0.0.1", PGAdvertisePort: "5432", PGSUPasswordFile: "/su", StoreEndpoints: "http://etcd2:2379"}
+	if rc != expected {
+		t.Errorf("got config: %+v, want: %+v", rc, expected)
+	}
+	// the overridden config isn't changed
+	if flags.StoreEndpoints != "http://etcd1:2379" {
+		t.Errorf("got store endpoints: %q, want: %q", flags.StoreEndpoints, "http://etcd1:2379")
+	}
+}
+
+func TestReloadableConfigValidate(t *testing.T) {
+	tests := []struct {
+		port string
+		err  bool
+	}{
+		{port: ""},
+		{port: "5433"},
+		{port: "0", err: true},
+		{port: "65536", err: true},
+		{port: "pg", err: true},
+	}
+	for i, tt := range tests {
+		rc := &reloadableConfig{PGAdvertisePort: tt.port}
+		err := rc.validate()
+		if tt.err && err == nil {
+			t.Errorf("#%d: got no error, wanted error", i)
+		} else if !tt.err && err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stolon")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	suPasswordFile := filepath.Join(dir, "su")
+	newSUPasswordFile := filepath.Join(dir, "newsu")
+	configFile := filepath.Join(dir, "keeper.yaml")
+	for _, f := range []struct{ path, data string }{
+		{suPasswordFile, "supassword\n"},
+		{newSUPasswordFile, "newsupassword\n"},
+		{configFile, "pgAdvertiseAddress: 10.0.0.2\npgSUPasswordFile: " + newSUPasswordFile + "\n"},
+	} {
+		if err := ioutil.WriteFile(f.path, []byte(f.data), 0600); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	c := &config{configFile: configFile, flagsConfig: reloadableConfig{PGSUPasswordFile: suPasswordFile}}
+	p := &PostgresKeeper{
+		cfg:             c,
+		pgListenAddress: "10.0.0.1",
+		pgPort:          "5432",
+		pgSUPassword:    "supassword",
+		pgReplPassword:  "replpassword",
+		reloadable:      c.flagsConfig,
+		storeChangedCh:  make(chan struct{}, 1),
+	}
+	if address, port := p.advertiseAddress(); address != "10.0.0.1" || port != "5432" {
+		t.Errorf("got advertise address: %s:%s, want: %s:%s", address, port, "10.0.0.1", "5432")
+	}
+
+	if err := p.reload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if address, port := p.advertiseAddress(); address != "10.0.0.2" || port != "5432" {
+		t.Errorf("got advertise address: %s:%s, want: %s:%s", address, port, "10.0.0.2", "5432")
+	}
+	expected := keeperPasswords{su: "newsupassword", repl: "replpassword"}
+	if p.pendingPasswords == nil || *p.pendingPasswords != expected {
+		t.Errorf("got pending passwords: %+v, want: %+v", p.pendingPasswords, expected)
+	}
+
+	// a replication password file cannot be added since the keeper has
+	// been started without it
+	if err := ioutil.WriteFile(configFile, []byte("pgReplPasswordFile: "+suPasswordFile+"\n"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := p.reload(); err == nil {
+		t.Errorf("got no error adding a replication password file")
+	}
+	if address, _ := p.advertiseAddress(); address != "10.0.0.2" {
+		t.Errorf("got advertise address: %s, want: %s", address, "10.0.0.2")
+	}
+}
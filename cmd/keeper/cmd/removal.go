@@ -0,0 +1,148 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+
+	"go.uber.org/zap"
+)
+
+// keeperRemovedFile is the file, in the keeper data dir, written when the
+// keeper has been removed from the cluster. Its existence prevents the keeper
+// from starting again.
+const keeperRemovedFile = "removed"
+
+func keeperRemovedFilePath(dataDir string) string {
+	return filepath.Join(dataDir, keeperRemovedFile)
+}
+
+// readKeeperRemoved returns the removal status saved in the keeper data dir
+// when the keeper has been removed, nil otherwise
+func readKeeperRemoved(dataDir string) (*cluster.KeeperRemovalStatus, error) {
+	data, err := ioutil.ReadFile(keeperRemovedFilePath(dataDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var s *cluster.KeeperRemovalStatus
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// disposeDataDir disposes of the postgres data dir inside the keeper data
+// dir. It returns the archived data dir path when archived.
+func disposeDataDir(dataDir string, disposal cluster.DataDirDisposal, now time.Time) (string, error) {
+	pgDataDir := filepath.Join(dataDir, "postgres")
+	switch disposal {
+	case cluster.DataDirDisposalKeep, "":
+		return "", nil
+	case cluster.DataDirDisposalWipe:
+		if err := os.RemoveAll(pgDataDir); err != nil {
+			return "", fmt.Errorf("cannot remove data dir %q: %v", pgDataDir, err)
+		}
+		return "", nil
+	case cluster.DataDirDisposalArchive:
+		if _, err := os.Stat(pgDataDir); err != nil {
+			if os.IsNotExist(err) {
+				return "", nil
+			}
+			return "", err
+		}
+		archivePath := filepath.Join(dataDir, fmt.Sprintf("postgres.removed-%s", now.UTC().Format("20060102T150405Z")))
+		if err := os.Rename(pgDataDir, archivePath); err != nil {
+			return "", fmt.Errorf("cannot archive data dir %q: %v", pgDataDir, err)
+		}
+		return archivePath, nil
+	default:
+		return "", fmt.Errorf("unknown data dir disposal %q", disposal)
+	}
+}
+
+func (p *PostgresKeeper) getRemoval() *cluster.KeeperRemovalStatus {
+	p.removalMutex.Lock()
+	defer p.removalMutex.Unlock()
+	if p.removal == nil {
+		return nil
+	}
+	r := *p.removal
+	return &r
+}
+
+func (p *PostgresKeeper) setRemoval(r *cluster.KeeperRemovalStatus) {
+	p.removalMutex.Lock()
+	p.removal = r
+	p.removalMutex.Unlock()
+}
+
+// handleRemoval stops postgres and disposes of its data dir as requested
+// before the keeper removal. When completed the keeper won't manage a db
+// anymore and the removal status is saved in the keeper data dir.
+func (p *PostgresKeeper) handleRemoval(req *cluster.KeeperRemoval) {
+	if r := p.getRemoval(); r != nil && r.RequestTime.Equal(req.RequestTime) && r.Completed {
+		return
+	}
+	log.Infow("keeper removal requested, stopping postgres", "dataDirDisposal", req.DataDirDisposal)
+
+	status := &cluster.KeeperRemovalStatus{RequestTime: req.RequestTime}
+	defer func() {
+		p.setRemoval(status)
+		if err := p.updateKeeperInfo(); err != nil {
+			log.Errorw("failed to update keeper info", zap.Error(err))
+		}
+	}()
+
+	p.updateMetrics(func(m *keeperMetrics) { m.role = common.RoleUndefined })
+	p.publishRole(common.RoleUndefined)
+	if err := p.pgm.StopIfStarted(true); err != nil {
+		log.Errorw("failed to stop pg instance", zap.Error(err))
+		status.Error = fmt.Sprintf("cannot stop postgres: %v", err)
+		return
+	}
+	archivePath, err := disposeDataDir(p.dataDir, req.DataDirDisposal, time.Now())
+	if err != nil {
+		log.Errorw("failed to dispose of the data dir", zap.Error(err))
+		status.Error = err.Error()
+		return
+	}
+	status.ArchivePath = archivePath
+	status.Completed = true
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		status.Error = err.Error()
+		status.Completed = false
+		return
+	}
+	if err := common.WriteFileAtomic(keeperRemovedFilePath(p.dataDir), 0600, data); err != nil {
+		log.Errorw("failed to save the keeper removal status", zap.Error(err))
+		status.Error = fmt.Sprintf("cannot save the removal status: %v", err)
+		status.Completed = false
+		return
+	}
+	log.Infow("keeper removal completed, the keeper won't manage a db anymore", "archivePath", archivePath)
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+func TestDisposeDataDir(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		disposal    cluster.DataDirDisposal
+		noDataDir   bool
+		archivePath string
+		exists      bool
+		err         bool
+	}{
+		{disposal: cluster.DataDirDisposalKeep, exists: true},
+		{disposal: cluster.DataDirDisposalWipe},
+		{disposal: cluster.DataDirDisposalArchive, archivePath: "postgres.removed-20200102T030405Z"},
+		{disposal: cluster.DataDirDisposalArchive, noDataDir: true},
+		{disposal: "unknown", exists: true, err: true},
+	}
+
+	for i, tt := range tests {
+		dir, err := ioutil.TempDir("", "stolon-keeper")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		pgDataDir := filepath.Join(dir, "postgres")
+		if !tt.noDataDir {
+			if err := os.Mkdir(pgDataDir, 0700); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(pgDataDir, "PG_VERSION"), []byte("12\n"), 0600); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+
+		archivePath, err := disposeDataDir(dir, tt.disposal, now)
+		if tt.err != (err != nil) {
+			t.Errorf("#%d: got error: %v, wanted error: %t", i, err, tt.err)
+			continue
+		}
+		if tt.archivePath != "" {
+			if archivePath != filepath.Join(dir, tt.archivePath) {
+				t.Errorf("#%d: got archive path %q, want %q", i, archivePath, filepath.Join(dir, tt.archivePath))
+			}
+			if _, err := os.Stat(filepath.Join(archivePath, "PG_VERSION")); err != nil {
+				t.Errorf("#%d: archived data dir: %v", i, err)
+			}
+		} else if archivePath != "" {
+			t.Errorf("#%d: got archive path %q, want no archive path", i, archivePath)
+		}
+		_, err = os.Stat(pgDataDir)
+		if exists := err == nil; exists != tt.exists {
+			t.Errorf("#%d: got data dir existing: %t, want: %t", i, exists, tt.exists)
+		}
+	}
+}
+
+func TestReadKeeperRemoved(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stolon-keeper")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := readKeeperRemoved(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s != nil {
+		t.Fatalf("got removal status %+v for a not removed keeper", s)
+	}
+
+	requestTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	data, err := json.Marshal(&cluster.KeeperRemovalStatus{RequestTime: requestTime, Completed: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(keeperRemovedFilePath(dir), data, 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s, err = readKeeperRemoved(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s == nil || !s.Completed || !s.RequestTime.Equal(requestTime) {
+		t.Fatalf("got removal status %+v, want a completed removal requested at %s", s, requestTime)
+	}
+}
@@ -0,0 +1,421 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+	slog "github.com/sorintlab/stolon/internal/log"
+	"github.com/sorintlab/stolon/internal/postgresql"
+
+	"go.uber.org/zap"
+)
+
+// resyncStrategy is a method used to resync a standby db from its followed db
+type resyncStrategy interface {
+	// name returns the strategy name reported in the logs
+	name() string
+	// needsEmptyDataDir reports if the data dir must be removed before
+	// executing the strategy
+	needsEmptyDataDir() bool
+	sync(ctx context.Context) error
+}
+
+// resyncStep is a resync strategy with its timeout (0 means no timeout)
+type resyncStep struct {
+	strategy resyncStrategy
+	timeout  time.Duration
+}
+
+// dbResyncStrategies returns the resync strategies of the db in the order
+// they must be tried. When the cluster spec doesn't define them they're
+// derived from the usePgrewind and resyncMethod options, ending with
+// pg_basebackup. The pgrewind strategy is removed when pgrewind is false.
+func dbResyncStrategies(db *cluster.DB, pgrewind bool) []cluster.ResyncStrategy {
+	strategies := db.Spec.ResyncStrategies
+	if len(strategies) == 0 {
+		strategies = []cluster.ResyncStrategy{{Type: cluster.ResyncStrategyPgRewind}}
+		switch db.Spec.ResyncMethod {
+		case cluster.ResyncMethodPgBackRest:
+			strategies = append(strategies, cluster.ResyncStrategy{Type: cluster.ResyncStrategyPgBackRest})
+		case cluster.ResyncMethodWalG:
+			strategies = append(strategies, cluster.ResyncStrategy{Type: cluster.ResyncStrategyWalG})
+		}
+		strategies = append(strategies, cluster.ResyncStrategy{Type: cluster.ResyncStrategyBasebackup})
+	}
+	res := []cluster.ResyncStrategy{}
+	for _, rs := range strategies {
+		if rs.Type == cluster.ResyncStrategyPgRewind && !pgrewind {
+			continue
+		}
+		res = append(res, rs)
+	}
+	return res
+}
+
+func hasResyncStrategy(strategies []cluster.ResyncStrategy, t cluster.ResyncStrategyType) bool {
+	for _, rs := range strategies {
+		if rs.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// runResyncSteps executes the resync steps in order until one succeeds. Before
+// the strategies requiring an empty data dir removeAll is called. When verify
+// isn't nil it's called after a successful step, with the strategy name, and
+// when it fails the next step is tried.
+func runResyncSteps(pctx context.Context, steps []resyncStep, removeAll func() error, verify func(ctx context.Context, strategy string) error) error {
+	if len(steps) == 0 {
+		return fmt.Errorf("no resync strategies available")
+	}
+	var err error
+	for _, step := range steps {
+		name := step.strategy.name()
+		if step.strategy.needsEmptyDataDir() {
+			if err := removeAll(); err != nil {
+				return fmt.Errorf("failed to remove the postgres data dir: %v", err)
+			}
+		}
+		ctx, cancel := context.WithCancel(pctx)
+		if step.timeout > 0 {
+			ctx, cancel = context.WithTimeout(pctx, step.timeout)
+		}
+		log.Infow("syncing", "strategy", name, "timeout", step.timeout)
+		err = step.strategy.sync(ctx)
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timeout after %s", step.timeout)
+		}
+		cancel()
+		if err != nil {
+			log.Errorw("error syncing", "strategy", name, zap.Error(err))
+			continue
+		}
+		if verify != nil {
+			if err = verify(pctx, name); err != nil {
+				err = fmt.Errorf("verification failed: %v", err)
+				log.Errorw("sync verification failed", "strategy", name, zap.Error(err))
+				continue
+			}
+		}
+		log.Infow("sync succeeded", "strategy", name)
+		return nil
+	}
+	return fmt.Errorf("sync error: %v", err)
+}
+
+func (p *PostgresKeeper) syncFromFollowed(db, followedDB *cluster.DB, tryPgrewind bool) error {
+	steps := []resyncStep{}
+	for _, rs := range dbResyncStrategies(db, tryPgrewind && p.usePgrewind(db)) {
+		step := resyncStep{strategy: p.newResyncStrategy(rs, db, followedDB)}
+		if rs.Timeout != nil {
+			step.timeout = rs.Timeout.Duration
+		}
+		steps = append(steps, step)
+	}
+
+	var verify func(ctx context.Context, strategy string) error
+	if db.Spec.VerifyResync {
+		verify = func(ctx context.Context, strategy string) error {
+			return p.verifyResync(ctx, db, followedDB, cluster.ResyncStrategyType(strategy))
+		}
+	}
+
+	log.Infow("syncing from followed db", "followedDB", followedDB.UID, "keeper", followedDB.Spec.KeeperUID)
+	if err := runResyncSteps(context.Background(), steps, p.pgm.RemoveAll, verify); err != nil {
+		return err
+	}
+
+	replConnParams := p.getReplConnParams(db, followedDB)
+	p.pgm.SetRecoveryParameters(p.createRecoveryParameters(true, internalStandbySettings(db, replConnParams), internalArchiveRecoverySettings(db), nil))
+	return nil
+}
+
+func (p *PostgresKeeper) newResyncStrategy(rs cluster.ResyncStrategy, db, followedDB *cluster.DB) resyncStrategy {
+	switch rs.Type {
+	case cluster.ResyncStrategyPgRewind:
+		return &pgRewindResync{p: p, db: db, followedDB: followedDB}
+	case cluster.ResyncStrategyPgBackRest:
+		return &pgBackRestResync{p: p, db: db}
+	case cluster.ResyncStrategyWalG:
+		return &walgResync{p: p, db: db}
+	case cluster.ResyncStrategyCommand:
+		return &commandResync{p: p, command: rs.Command, db: db, followedDB: followedDB}
+	case cluster.ResyncStrategyRsync:
+		return &rsyncResync{p: p, source: rs.RsyncSource, db: db, followedDB: followedDB}
+	default:
+		return &basebackupResync{p: p, db: db, followedDB: followedDB}
+	}
+}
+
+// pgRewindResync resyncs the current data dir with pg_rewind
+type pgRewindResync struct {
+	p          *PostgresKeeper
+	db         *cluster.DB
+	followedDB *cluster.DB
+}
+
+func (r *pgRewindResync) name() string { return string(cluster.ResyncStrategyPgRewind) }
+
+func (r *pgRewindResync) needsEmptyDataDir() bool { return false }
+
+func (r *pgRewindResync) sync(ctx context.Context) error {
+	// TODO(sgotti) Actually we don't check if pg_rewind is installed or if
+	// postgresql version is > 9.5 since someone can also use an externally
+	// installed pg_rewind for postgres 9.4. If a pg_rewind executable
+	// doesn't exists pgm.SyncFromFollowedPGRewind will return an error and
+	// the next strategy is tried
+	connParams := r.p.getSUConnParams(r.db, r.followedDB)
+	r.p.updateMetrics(func(m *keeperMetrics) { m.pgRewindAttempts++ })
+	if err := r.p.pgm.SyncFromFollowedPGRewind(ctx, connParams, r.p.pgSUPassword); err != nil {
+		r.p.updateMetrics(func(m *keeperMetrics) { m.pgRewindFailures++ })
+		return err
+	}
+	return nil
+}
+
+// pgBackRestResync resyncs the data dir with a pgBackRest delta restore
+type pgBackRestResync struct {
+	p  *PostgresKeeper
+	db *cluster.DB
+}
+
+func (r *pgBackRestResync) name() string { return string(cluster.ResyncStrategyPgBackRest) }
+
+func (r *pgBackRestResync) needsEmptyDataDir() bool { return false }
+
+func (r *pgBackRestResync) sync(ctx context.Context) error {
+	return r.p.pgm.SyncFromPgBackRest(ctx, pgBackRestOptions(r.db.Spec.PgBackRestConfig))
+}
+
+// walgResync fetches a WAL-G backup in the data dir
+type walgResync struct {
+	p  *PostgresKeeper
+	db *cluster.DB
+}
+
+func (r *walgResync) name() string { return string(cluster.ResyncStrategyWalG) }
+
+func (r *walgResync) needsEmptyDataDir() bool { return true }
+
+func (r *walgResync) sync(ctx context.Context) error {
+	command, backupName := walgCommand(r.db.Spec.WalGConfig)
+	log.Infow("fetching wal-g backup", "backup", backupName)
+	return r.p.pgm.SyncFromWalG(ctx, command, backupName)
+}
+
+// commandResync fills the data dir executing a custom command
+type commandResync struct {
+	p          *PostgresKeeper
+	command    string
+	db         *cluster.DB
+	followedDB *cluster.DB
+}
+
+func (r *commandResync) name() string { return string(cluster.ResyncStrategyCommand) }
+
+func (r *commandResync) needsEmptyDataDir() bool { return true }
+
+func (r *commandResync) sync(ctx context.Context) error {
+	return runShellCommand(ctx, r.command, resyncCommandEnv(r.db, r.followedDB, filepath.Join(r.p.dataDir, "postgres"), r.p.pgReplUsername), os.Stderr)
+}
+
+// resyncCommandEnv returns the environment of the command resync strategy.
+// The repl password isn't provided, the command environment must provide
+// the credentials it needs.
+func resyncCommandEnv(db, followedDB *cluster.DB, dataDir, replUsername string) []string {
+	return append(validationCommandEnv(db),
+		"STOLON_DATA_DIR="+dataDir,
+		"STOLON_FOLLOWED_DB_UID="+followedDB.UID,
+		"STOLON_FOLLOWED_HOST="+followedDB.Status.ListenAddress,
+		"STOLON_FOLLOWED_PORT="+followedDB.Status.Port,
+		"STOLON_REPL_USERNAME="+replUsername,
+	)
+}
+
+// rsyncBwLimit returns the rsync bandwidth limit, in kilobytes per second, of
+// the resync max rate. An empty string means no limit.
+func rsyncBwLimit(maxRate string) string {
+	if maxRate == "" {
+		return ""
+	}
+	rate, err := cluster.ParseMaxRate(maxRate)
+	if err != nil {
+		log.Warnw("wrong resync max rate, not limiting the rsync bandwidth", "maxRate", maxRate, zap.Error(err))
+		return ""
+	}
+	return strconv.FormatUint(rate, 10)
+}
+
+// rsyncResync updates the current data dir copying with rsync the followed db
+// data dir files changed or missing
+type rsyncResync struct {
+	p          *PostgresKeeper
+	source     string
+	db         *cluster.DB
+	followedDB *cluster.DB
+}
+
+func (r *rsyncResync) name() string { return string(cluster.ResyncStrategyRsync) }
+
+func (r *rsyncResync) needsEmptyDataDir() bool { return false }
+
+func (r *rsyncResync) sync(ctx context.Context) error {
+	env := resyncCommandEnv(r.db, r.followedDB, filepath.Join(r.p.dataDir, "postgres"), r.p.pgReplUsername)
+	connParams := r.p.getSUConnParams(r.db, r.followedDB)
+	return r.p.pgm.SyncFromFollowedRsync(ctx, connParams, expandEnv(r.source, env), rsyncBwLimit(r.db.Spec.ResyncMaxRate))
+}
+
+// expandEnv replaces the ${var} or $var in s with the values of the provided
+// environment. Undefined variables are replaced with an empty string.
+func expandEnv(s string, env []string) string {
+	vars := map[string]string{}
+	for _, e := range env {
+		if i := strings.Index(e, "="); i >= 0 {
+			vars[e[:i]] = e[i+1:]
+		}
+	}
+	return os.Expand(s, func(name string) string { return vars[name] })
+}
+
+// resyncWalFromArchive reports if the db resynced with the strategy fetches
+// the wal from the archive
+func resyncWalFromArchive(strategy cluster.ResyncStrategyType) bool {
+	return strategy == cluster.ResyncStrategyPgBackRest || strategy == cluster.ResyncStrategyWalG
+}
+
+func (p *PostgresKeeper) getResyncVerification() *cluster.ResyncVerification {
+	p.resyncVerificationMutex.Lock()
+	defer p.resyncVerificationMutex.Unlock()
+	if p.resyncVerification == nil {
+		return nil
+	}
+	v := *p.resyncVerification
+	return &v
+}
+
+func (p *PostgresKeeper) setResyncVerification(v *cluster.ResyncVerification) {
+	p.resyncVerificationMutex.Lock()
+	defer p.resyncVerificationMutex.Unlock()
+	p.resyncVerification = v
+}
+
+// verifyResync verifies the data dir resynced with the provided strategy,
+// recording the verification result
+func (p *PostgresKeeper) verifyResync(ctx context.Context, db, followedDB *cluster.DB, strategy cluster.ResyncStrategyType) error {
+	v := &cluster.ResyncVerification{DBUID: db.UID, Strategy: strategy, Time: time.Now()}
+	err := p.doVerifyResync(ctx, db, followedDB, v)
+	v.Success = err == nil
+	if err != nil {
+		v.Error = err.Error()
+	} else {
+		log.Infow("resync verification completed", "strategy", strategy, "manifestVerified", v.ManifestVerified, "walFile", v.WalFile, "walAvailable", v.WalAvailable)
+	}
+	p.setResyncVerification(v)
+	return err
+}
+
+// doVerifyResync verifies the backup manifest left by pg_basebackup (postgres
+// >= 13) and that the first wal file required to start the db is in the data
+// dir or in the followed db wal directory (unless fetched from the archive)
+func (p *PostgresKeeper) doVerifyResync(ctx context.Context, db, followedDB *cluster.DB, v *cluster.ResyncVerification) error {
+	dataDir := filepath.Join(p.dataDir, "postgres")
+	// the files of the other strategies could contain the backup manifest
+	// of the followed db data dir
+	if v.Strategy == cluster.ResyncStrategyBasebackup {
+		if _, err := os.Stat(filepath.Join(dataDir, "backup_manifest")); err == nil {
+			log.Infow("verifying the backup manifest")
+			output := &limitedBuffer{max: maxHookStderrSize}
+			err := runCommand(ctx, []string{filepath.Join(p.pgm.BinPath(), "pg_verifybackup"), dataDir}, nil, io.MultiWriter(os.Stderr, output))
+			v.Output = output.String()
+			if err != nil {
+				return fmt.Errorf("pg_verifybackup failed: %v", err)
+			}
+			v.ManifestVerified = true
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	walFile, err := p.pgm.RequiredWalFile()
+	if err != nil {
+		return fmt.Errorf("cannot get the required wal file: %v", err)
+	}
+	v.WalFile = walFile
+	if resyncWalFromArchive(v.Strategy) {
+		return nil
+	}
+	if v.WalAvailable, err = p.pgm.HasWalFile(walFile); err != nil {
+		return err
+	}
+	if !v.WalAvailable {
+		if v.WalAvailable, err = p.pgm.HasRemoteWalFile(p.getSUConnParams(db, followedDB), walFile); err != nil {
+			return fmt.Errorf("cannot check the required wal file on the followed db: %v", err)
+		}
+	}
+	if !v.WalAvailable {
+		return fmt.Errorf("required wal file %s isn't available in the data dir or on the followed db", walFile)
+	}
+	return nil
+}
+
+// basebackupResync fills the data dir with pg_basebackup
+type basebackupResync struct {
+	p          *PostgresKeeper
+	db         *cluster.DB
+	followedDB *cluster.DB
+}
+
+func (r *basebackupResync) name() string { return string(cluster.ResyncStrategyBasebackup) }
+
+func (r *basebackupResync) needsEmptyDataDir() bool { return true }
+
+func (r *basebackupResync) sync(ctx context.Context) error {
+	pgm := r.p.pgm
+	replConnParams := r.p.getReplConnParams(r.db, r.followedDB)
+
+	maj, min, err := pgm.BinaryVersion()
+	if err != nil {
+		// in case we fail to parse the binary version then log it and just don't use replSlot
+		log.Warnf("failed to get postgres binary version: %v", err)
+	}
+	replSlot := ""
+	if ((maj == 9 && min >= 6) || maj > 10) && r.db.Spec.WalRetentionStrategy.UseSlots() {
+		replSlot = common.StolonName(r.db.UID)
+	}
+
+	if slog.IsDebug() {
+		log.Debugw("running pg_basebackup", "replConnParams", fmt.Sprintf("%v", replConnParams))
+	}
+
+	var features postgresql.BasebackupFeatures
+	if c := r.db.Spec.BasebackupConfig; c != nil && (c.ParallelWorkers > 1 || c.Compression != "") {
+		features, err = pgm.BasebackupFeatures()
+		if err != nil {
+			log.Warnw("failed to detect the pg_basebackup supported features", zap.Error(err))
+		}
+	}
+	return pgm.SyncFromFollowed(ctx, replConnParams, replSlot, basebackupOptions(r.db.Spec.BasebackupConfig, features, r.p.cfg.tablespaceMap, r.db.Spec.ResyncMaxRate))
+}
@@ -0,0 +1,255 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+func TestDBResyncStrategies(t *testing.T) {
+	tests := []struct {
+		resyncMethod cluster.ResyncMethod
+		strategies   []cluster.ResyncStrategy
+		pgrewind     bool
+		out          []cluster.ResyncStrategyType
+	}{
+		{
+			out: []cluster.ResyncStrategyType{cluster.ResyncStrategyBasebackup},
+		},
+		{
+			pgrewind: true,
+			out:      []cluster.ResyncStrategyType{cluster.ResyncStrategyPgRewind, cluster.ResyncStrategyBasebackup},
+		},
+		{
+			resyncMethod: cluster.ResyncMethodPgBackRest,
+			pgrewind:     true,
+			out:          []cluster.ResyncStrategyType{cluster.ResyncStrategyPgRewind, cluster.ResyncStrategyPgBackRest, cluster.ResyncStrategyBasebackup},
+		},
+		{
+			resyncMethod: cluster.ResyncMethodWalG,
+			out:          []cluster.ResyncStrategyType{cluster.ResyncStrategyWalG, cluster.ResyncStrategyBasebackup},
+		},
+		// the defined strategies are used ignoring the resync method
+		{
+			resyncMethod: cluster.ResyncMethodWalG,
+			strategies: []cluster.ResyncStrategy{
+				{Type: cluster.ResyncStrategyPgRewind},
+				{Type: cluster.ResyncStrategyCommand, Command: "restore.sh"},
+			},
+			out: []cluster.ResyncStrategyType{cluster.ResyncStrategyCommand},
+		},
+		{
+			strategies: []cluster.ResyncStrategy{
+				{Type: cluster.ResyncStrategyPgRewind},
+				{Type: cluster.ResyncStrategyBasebackup},
+				{Type: cluster.ResyncStrategyPgBackRest},
+			},
+			pgrewind: true,
+			out:      []cluster.ResyncStrategyType{cluster.ResyncStrategyPgRewind, cluster.ResyncStrategyBasebackup, cluster.ResyncStrategyPgBackRest},
+		},
+	}
+
+	for i, tt := range tests {
+		db := &cluster.DB{UID: "db1", Spec: &cluster.DBSpec{ResyncMethod: tt.resyncMethod, ResyncStrategies: tt.strategies}}
+		out := []cluster.ResyncStrategyType{}
+		for _, rs := range dbResyncStrategies(db, tt.pgrewind) {
+			out = append(out, rs.Type)
+		}
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: got: %v, want: %v", i, out, tt.out)
+		}
+	}
+}
+
+// fakeResync is a resync strategy recording its executions
+type fakeResync struct {
+	n          string
+	emptyDir   bool
+	err        error
+	wait       bool
+	executions *[]string
+}
+
+func (r *fakeResync) name() string { return r.n }
+
+func (r *fakeResync) needsEmptyDataDir() bool { return r.emptyDir }
+
+func (r *fakeResync) sync(ctx context.Context) error {
+	*r.executions = append(*r.executions, r.n)
+	if r.wait {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return r.err
+}
+
+func TestRunResyncSteps(t *testing.T) {
+	failed := errors.New("failed")
+	tests := []struct {
+		steps     []*fakeResync
+		timeouts  []time.Duration
+		removeErr error
+		// verification errors by strategy, when nil no verification is
+		// done
+		verifyErrs    map[string]error
+		executions    []string
+		verifications []string
+		removes       int
+		err           error
+	}{
+		{
+			err: fmt.Errorf("no resync strategies available"),
+		},
+		{
+			steps:      []*fakeResync{{n: "pgrewind", err: failed}, {n: "pgbackrest"}, {n: "basebackup", emptyDir: true}},
+			executions: []string{"pgrewind", "pgbackrest"},
+		},
+		{
+			steps:      []*fakeResync{{n: "pgrewind", err: failed}, {n: "walg", emptyDir: true, err: failed}, {n: "basebackup", emptyDir: true}},
+			executions: []string{"pgrewind", "walg", "basebackup"},
+			removes:    2,
+		},
+		{
+			steps:      []*fakeResync{{n: "command", emptyDir: true, wait: true}, {n: "basebackup", emptyDir: true, err: failed}},
+			timeouts:   []time.Duration{10 * time.Millisecond, 0},
+			executions: []string{"command", "basebackup"},
+			removes:    2,
+			err:        fmt.Errorf("sync error: failed"),
+		},
+		{
+			steps:      []*fakeResync{{n: "command", emptyDir: true, wait: true}},
+			timeouts:   []time.Duration{10 * time.Millisecond},
+			executions: []string{"command"},
+			removes:    1,
+			err:        fmt.Errorf("sync error: timeout after 10ms"),
+		},
+		{
+			steps:         []*fakeResync{{n: "pgrewind"}, {n: "basebackup", emptyDir: true}},
+			verifyErrs:    map[string]error{"pgrewind": errors.New("wal missing")},
+			executions:    []string{"pgrewind", "basebackup"},
+			verifications: []string{"pgrewind", "basebackup"},
+			removes:       1,
+		},
+		{
+			steps:         []*fakeResync{{n: "pgrewind", err: failed}, {n: "basebackup", emptyDir: true}},
+			verifyErrs:    map[string]error{"basebackup": errors.New("manifest mismatch")},
+			executions:    []string{"pgrewind", "basebackup"},
+			verifications: []string{"basebackup"},
+			removes:       1,
+			err:           fmt.Errorf("sync error: verification failed: manifest mismatch"),
+		},
+		{
+			steps:     []*fakeResync{{n: "basebackup", emptyDir: true}},
+			removeErr: failed,
+			removes:   1,
+			err:       fmt.Errorf("failed to remove the postgres data dir: failed"),
+		},
+	}
+
+	for i, tt := range tests {
+		executions := []string{}
+		steps := []resyncStep{}
+		for j, s := range tt.steps {
+			s.executions = &executions
+			step := resyncStep{strategy: s}
+			if tt.timeouts != nil {
+				step.timeout = tt.timeouts[j]
+			}
+			steps = append(steps, step)
+		}
+		removes := 0
+		removeAll := func() error {
+			removes++
+			return tt.removeErr
+		}
+		verifications := []string{}
+		var verify func(ctx context.Context, strategy string) error
+		if tt.verifyErrs != nil {
+			verify = func(ctx context.Context, strategy string) error {
+				verifications = append(verifications, strategy)
+				return tt.verifyErrs[strategy]
+			}
+		}
+		err := runResyncSteps(context.Background(), steps, removeAll, verify)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+		if tt.executions == nil {
+			tt.executions = []string{}
+		}
+		if !reflect.DeepEqual(executions, tt.executions) {
+			t.Errorf("#%d: got executions: %v, want: %v", i, executions, tt.executions)
+		}
+		if tt.verifications == nil {
+			tt.verifications = []string{}
+		}
+		if !reflect.DeepEqual(verifications, tt.verifications) {
+			t.Errorf("#%d: got verifications: %v, want: %v", i, verifications, tt.verifications)
+		}
+		if removes != tt.removes {
+			t.Errorf("#%d: got %d data dir removals, want: %d", i, removes, tt.removes)
+		}
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	env := []string{"STOLON_FOLLOWED_HOST=10.0.0.1", "STOLON_FOLLOWED_PORT=5432", "EMPTY="}
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{in: "rsync://${STOLON_FOLLOWED_HOST}/pgdata/", out: "rsync://10.0.0.1/pgdata/"},
+		{in: "postgres@$STOLON_FOLLOWED_HOST:/data/postgres/", out: "postgres@10.0.0.1:/data/postgres/"},
+		{in: "rsync://host$EMPTY${UNDEFINED}/pgdata/", out: "rsync://host/pgdata/"},
+	}
+
+	for i, tt := range tests {
+		if out := expandEnv(tt.in, env); out != tt.out {
+			t.Errorf("#%d: got: %q, want: %q", i, out, tt.out)
+		}
+	}
+}
+
+func TestRsyncBwLimit(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{in: "", out: ""},
+		{in: "512", out: "512"},
+		{in: "512k", out: "512"},
+		{in: "10M", out: "10240"},
+		{in: "10MB", out: ""},
+	}
+
+	for i, tt := range tests {
+		if out := rsyncBwLimit(tt.in); out != tt.out {
+			t.Errorf("#%d: got: %q, want: %q", i, out, tt.out)
+		}
+	}
+}
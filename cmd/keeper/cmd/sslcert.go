@@ -0,0 +1,132 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/common"
+)
+
+const (
+	// postgres default server certificate and key files, relative to the
+	// data directory
+	defaultSSLCertFile = "server.crt"
+	defaultSSLKeyFile  = "server.key"
+)
+
+// isPGBoolOn reports if the provided value is a postgres boolean true value
+// (case insensitive unique prefixes of "on", "true" and "yes" and "1")
+func isPGBoolOn(v string) bool {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if v == "" {
+		return false
+	}
+	// "o" is ambiguous between "on" and "off"
+	if len(v) >= 2 && strings.HasPrefix("on", v) {
+		return true
+	}
+	return strings.HasPrefix("true", v) || strings.HasPrefix("yes", v) || v == "1"
+}
+
+// sslCertFiles returns the server certificate and key files defined by the pg
+// parameters. Like postgres, relative paths are relative to the data
+// directory. It returns false when ssl isn't enabled.
+func sslCertFiles(parameters common.Parameters, pgDataDir string) (string, string, bool) {
+	if !isPGBoolOn(parameters["ssl"]) {
+		return "", "", false
+	}
+	certFile := parameters["ssl_cert_file"]
+	if certFile == "" {
+		certFile = defaultSSLCertFile
+	}
+	keyFile := parameters["ssl_key_file"]
+	if keyFile == "" {
+		keyFile = defaultSSLKeyFile
+	}
+	if !filepath.IsAbs(certFile) {
+		certFile = filepath.Join(pgDataDir, certFile)
+	}
+	if !filepath.IsAbs(keyFile) {
+		keyFile = filepath.Join(pgDataDir, keyFile)
+	}
+	return certFile, keyFile, true
+}
+
+// sslCertWatcher detects the changes of the postgres server certificate and
+// key files, since postgres reads them only at start and reload.
+type sslCertWatcher struct {
+	certFile, keyFile string
+	modTime           time.Time
+}
+
+// changed reports if the files have been modified since the last check. The
+// first check, or a check of different files, only records their
+// modification time since they're read by postgres when it's started or
+// reloaded for the parameters change.
+func (w *sslCertWatcher) changed(certFile, keyFile string) (bool, error) {
+	var modTime time.Time
+	for _, f := range []string{certFile, keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return false, err
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	if certFile != w.certFile || keyFile != w.keyFile {
+		w.certFile, w.keyFile = certFile, keyFile
+		w.modTime = modTime
+		return false, nil
+	}
+	if !modTime.After(w.modTime) {
+		return false, nil
+	}
+	w.modTime = modTime
+	return true, nil
+}
+
+// sslCertNotAfter returns the expiration time of the first certificate of the
+// certificate file
+func sslCertNotAfter(certFile string) (*time.Time, error) {
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no certificate in file %q", certFile)
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse certificate file %q: %v", certFile, err)
+		}
+		notAfter := cert.NotAfter
+		return &notAfter, nil
+	}
+}
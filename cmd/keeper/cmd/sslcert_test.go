@@ -0,0 +1,176 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/common"
+)
+
+func TestIsPGBoolOn(t *testing.T) {
+	tests := []struct {
+		v  string
+		on bool
+	}{
+		{v: "on", on: true},
+		{v: "ON", on: true},
+		{v: "true", on: true},
+		{v: "t", on: true},
+		{v: "yes", on: true},
+		{v: "1", on: true},
+		{v: "o", on: false},
+		{v: "off", on: false},
+		{v: "false", on: false},
+		{v: "0", on: false},
+		{v: "", on: false},
+	}
+	for i, tt := range tests {
+		if on := isPGBoolOn(tt.v); on != tt.on {
+			t.Errorf("#%d (%q): got: %t, want: %t", i, tt.v, on, tt.on)
+		}
+	}
+}
+
+func TestSSLCertFiles(t *testing.T) {
+	tests := []struct {
+		parameters common.Parameters
+		certFile   string
+		keyFile    string
+		ok         bool
+	}{
+		{parameters: common.Parameters{}},
+		{parameters: common.Parameters{"ssl": "off", "ssl_cert_file": "/certs/server.crt"}},
+		{
+			parameters: common.Parameters{"ssl": "on"},
+			certFile:   "/data/postgres/server.crt",
+			keyFile:    "/data/postgres/server.key",
+			ok:         true,
+		},
+		{
+			parameters: common.Parameters{"ssl": "on", "ssl_cert_file": "/certs/tls.crt", "ssl_key_file": "certs/tls.key"},
+			certFile:   "/certs/tls.crt",
+			keyFile:    "/data/postgres/certs/tls.key",
+			ok:         true,
+		},
+	}
+	for i, tt := range tests {
+		certFile, keyFile, ok := sslCertFiles(tt.parameters, "/data/postgres")
+		if certFile != tt.certFile || keyFile != tt.keyFile || ok != tt.ok {
+			t.Errorf("#%d: got: %q, %q, %t, want: %q, %q, %t", i, certFile, keyFile, ok, tt.certFile, tt.keyFile, tt.ok)
+		}
+	}
+}
+
+func writeTestServerCert(t *testing.T, certFile, keyFile string, notAfter, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "postgres"},
+		NotBefore:    notAfter.Add(-24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, modTime, modTime); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestSSLCertWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stolon-keeper")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+
+	now := time.Now().Truncate(time.Second)
+	notAfter := now.Add(24 * time.Hour)
+	writeTestServerCert(t, certFile, keyFile, notAfter, now.Add(-time.Minute))
+
+	w := &sslCertWatcher{}
+	check := func(expected bool) {
+		t.Helper()
+		changed, err := w.changed(certFile, keyFile)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if changed != expected {
+			t.Errorf("got changed: %t, want: %t", changed, expected)
+		}
+	}
+	// the first check only records the files modification time
+	check(false)
+	check(false)
+
+	got, err := sslCertNotAfter(certFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !got.Equal(notAfter) {
+		t.Errorf("got not after: %s, want: %s", got, notAfter)
+	}
+
+	// renewed certificate
+	renewedNotAfter := notAfter.Add(24 * time.Hour)
+	writeTestServerCert(t, certFile, keyFile, renewedNotAfter, now)
+	check(true)
+	check(false)
+
+	got, err = sslCertNotAfter(certFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !got.Equal(renewedNotAfter) {
+		t.Errorf("got not after: %s, want: %s", got, renewedNotAfter)
+	}
+
+	if _, err := w.changed(filepath.Join(dir, "notexisting"), keyFile); err == nil {
+		t.Errorf("got no error for a not existing certificate file")
+	}
+	if _, err := sslCertNotAfter(keyFile); err == nil {
+		t.Errorf("got no error for a file without certificates")
+	}
+}
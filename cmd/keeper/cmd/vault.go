@@ -0,0 +1,196 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+	"github.com/sorintlab/stolon/internal/vault"
+
+	"go.uber.org/zap"
+)
+
+func countNotEmpty(values ...string) int {
+	n := 0
+	for _, v := range values {
+		if v != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// keeperPasswords are the superuser and replication passwords
+type keeperPasswords struct {
+	su   string
+	repl string
+}
+
+// readVaultPasswords reads the passwords defined as vault secrets. The
+// passwords not defined as vault secrets are empty.
+func readVaultPasswords(ctx context.Context, vc *vault.Client, cfg *config) (*keeperPasswords, error) {
+	passwords := &keeperPasswords{}
+	for _, s := range []struct {
+		name   string
+		secret string
+		dest   *string
+	}{
+		{"superuser", cfg.pgSUPasswordVaultSecret, &passwords.su},
+		{"replication user", cfg.pgReplPasswordVaultSecret, &passwords.repl},
+	} {
+		if s.secret == "" {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		password, err := vc.ReadSecret(ctx, s.secret)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read pg %s password from vault: %v", s.name, err)
+		}
+		password = strings.TrimRight(password, "\r\n")
+		if password == "" {
+			return nil, fmt.Errorf("pg %s password read from vault is empty", s.name)
+		}
+		*s.dest = password
+	}
+	return passwords, nil
+}
+
+// watchVaultPasswords periodically reads the vault password secrets and,
+// when a password has been rotated, requests the state machine to apply
+// the new passwords
+func (p *PostgresKeeper) watchVaultPasswords(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(p.cfg.vaultRefreshInterval):
+		case <-ctx.Done():
+			return
+		}
+		passwords, err := readVaultPasswords(ctx, p.vault, p.cfg)
+		if err != nil {
+			log.Errorw("failed to refresh the vault passwords", zap.Error(err))
+			continue
+		}
+		if p.rotatePasswords(passwords) {
+			log.Infow("vault passwords rotated")
+		}
+	}
+}
+
+// rotatePasswords requests the state machine to apply the provided passwords
+// when they differ from the current ones. The empty passwords aren't changed.
+// It returns true if a password has been rotated.
+func (p *PostgresKeeper) rotatePasswords(passwords *keeperPasswords) bool {
+	p.passwordsMutex.Lock()
+	defer p.passwordsMutex.Unlock()
+	cur := p.pendingPasswords
+	if cur == nil {
+		cur = &keeperPasswords{su: p.pgSUPassword, repl: p.pgReplPassword}
+	}
+	np := *passwords
+	if np.su == "" {
+		np.su = cur.su
+	}
+	if np.repl == "" {
+		np.repl = cur.repl
+	}
+	if np == *cur {
+		return false
+	}
+	p.pendingPasswords = &np
+	return true
+}
+
+// passwordsFingerprint returns the hmac of the new passwords keyed by the
+// current ones. It identifies the new passwords without exposing them.
+func passwordsFingerprint(cur, next *keeperPasswords) string {
+	mac := hmac.New(sha256.New, []byte(cur.su+"\x00"+cur.repl))
+	mac.Write([]byte(next.su + "\x00" + next.repl))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// getPasswordsStatus returns the passwords rotation state when the
+// coordinated password rotation is enabled
+func (p *PostgresKeeper) getPasswordsStatus() *cluster.KeeperPasswordsStatus {
+	if !p.cfg.coordinatedPasswordRotation {
+		return nil
+	}
+	p.passwordsMutex.Lock()
+	defer p.passwordsMutex.Unlock()
+	s := &cluster.KeeperPasswordsStatus{AppliedRotation: p.appliedPasswordsRotation}
+	if p.pendingPasswords != nil {
+		s.PendingFingerprint = passwordsFingerprint(&keeperPasswords{su: p.pgSUPassword, repl: p.pgReplPassword}, p.pendingPasswords)
+	}
+	return s
+}
+
+// applyPendingPasswords starts using the rotated passwords. On the master,
+// started, db the roles passwords are changed before using them. It must be
+// called by the state machine, the only user of the passwords.
+// With the coordinated password rotation the passwords are applied only
+// when they're the ones of the credentials rotation in progress: by the
+// master in every phase and by the standbys after the master phase.
+func (p *PostgresKeeper) applyPendingPasswords(cd *cluster.ClusterData, role common.Role) error {
+	p.passwordsMutex.Lock()
+	defer p.passwordsMutex.Unlock()
+	passwords := p.pendingPasswords
+	if passwords == nil {
+		return nil
+	}
+	var rotation *cluster.CredentialsRotation
+	if p.cfg.coordinatedPasswordRotation {
+		rotation = cd.Cluster.Status.CredentialsRotation
+		if rotation == nil || rotation.UID == p.appliedPasswordsRotation {
+			return nil
+		}
+		if passwordsFingerprint(&keeperPasswords{su: p.pgSUPassword, repl: p.pgReplPassword}, passwords) != rotation.Fingerprint {
+			return fmt.Errorf("pending passwords aren't the ones of the credentials rotation %q", rotation.UID)
+		}
+		if role != common.RoleMaster && rotation.Phase == cluster.CredentialsRotationPhaseMaster {
+			return nil
+		}
+	}
+	if role == common.RoleMaster {
+		started, err := p.pgm.IsStarted()
+		if err != nil {
+			return err
+		}
+		// retry when started
+		if !started {
+			return nil
+		}
+		if err := p.pgm.AlterRolesPasswords(passwords.su, passwords.repl); err != nil {
+			return err
+		}
+		log.Infow("roles passwords changed")
+	}
+	p.pgSUPassword = passwords.su
+	p.pgReplPassword = passwords.repl
+	p.pgm.SetCredentials(p.pgSUPassword, p.pgReplPassword, p.getLocalConnParams(), p.getLocalReplConnParams())
+	p.pendingPasswords = nil
+	if rotation != nil {
+		log.Infow("credentials rotation applied", "rotation", rotation.UID)
+		p.appliedPasswordsRotation = rotation.UID
+	}
+	return nil
+}
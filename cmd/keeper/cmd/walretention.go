@@ -0,0 +1,147 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/postgresql"
+	"github.com/sorintlab/stolon/internal/util"
+
+	"go.uber.org/zap"
+)
+
+// slotRetainedWal returns the wal bytes retained by the replication slot
+func slotRetainedWal(rs *postgresql.ReplicationSlotStatus, xLogPos uint64) uint64 {
+	if rs.RestartLSN == 0 || rs.RestartLSN >= xLogPos {
+		return 0
+	}
+	return xLogPos - rs.RestartLSN
+}
+
+// exceedingReplSlots returns, sorted by name, the inactive replication slots
+// exceeding the wal retention limits: the ones retaining more than
+// MaxSlotRetainedWal and, when the wal dir size is greater than MaxWalSize,
+// the one retaining the most wal. Active slots are never reported since their
+// consumers are streaming and the retained wal will be released.
+func exceedingReplSlots(limits *cluster.WalRetentionLimits, slots []*postgresql.ReplicationSlotStatus, xLogPos, walSize uint64) []string {
+	exceeding := []string{}
+	var biggest *postgresql.ReplicationSlotStatus
+	for _, rs := range slots {
+		if rs.Active {
+			continue
+		}
+		retained := slotRetainedWal(rs, xLogPos)
+		if retained == 0 {
+			continue
+		}
+		if limits.MaxSlotRetainedWal > 0 && retained > limits.MaxSlotRetainedWal {
+			exceeding = append(exceeding, rs.Name)
+		}
+		if biggest == nil || retained > slotRetainedWal(biggest, xLogPos) {
+			biggest = rs
+		}
+	}
+	if limits.MaxWalSize > 0 && walSize > limits.MaxWalSize && biggest != nil && !util.StringInSlice(exceeding, biggest.Name) {
+		exceeding = append(exceeding, biggest.Name)
+	}
+	sort.Strings(exceeding)
+	return exceeding
+}
+
+// checkWalRetention checks the db wal retention against the db spec limits,
+// saving the status reported to the sentinel. With the dropSlot policy the
+// exceeding replication slots are dropped and the remaining current
+// replication slots are returned (the internal ones will be recreated without
+// the retained wal).
+func (p *PostgresKeeper) checkWalRetention(db *cluster.DB, curReplSlots []string) []string {
+	limits := db.Spec.WalRetentionLimits
+	if limits == nil {
+		p.setWalRetention(nil)
+		return curReplSlots
+	}
+
+	walSize, err := p.pgm.WalSize()
+	if err != nil {
+		log.Errorw("failed to get the wal dir size", zap.Error(err))
+		return curReplSlots
+	}
+	slots, err := p.pgm.GetPhysicalReplicationSlots()
+	if err != nil {
+		log.Errorw("failed to get the replication slots", zap.Error(err))
+		return curReplSlots
+	}
+	sd, err := p.pgm.GetSystemData()
+	if err != nil {
+		log.Errorw("failed to get the current xlog position", zap.Error(err))
+		return curReplSlots
+	}
+
+	status := &cluster.WalRetentionStatus{
+		WalSize:            walSize,
+		MaxWalSizeExceeded: limits.MaxWalSize > 0 && walSize > limits.MaxWalSize,
+		ExceedingSlots:     exceedingReplSlots(limits, slots, sd.XLogPos, walSize),
+	}
+	if !status.Exceeded() {
+		p.setWalRetention(status)
+		return curReplSlots
+	}
+	log.Warnw("wal retention limits exceeded", "walSize", walSize, "maxWalSize", limits.MaxWalSize, "exceedingSlots", status.ExceedingSlots, "policy", limits.DefPolicy())
+
+	if limits.DefPolicy() != cluster.WalRetentionLimitPolicyDropSlot || len(status.ExceedingSlots) == 0 {
+		p.setWalRetention(status)
+		return curReplSlots
+	}
+
+	replSlots := []string{}
+	for _, slot := range curReplSlots {
+		if !util.StringInSlice(status.ExceedingSlots, slot) {
+			replSlots = append(replSlots, slot)
+			continue
+		}
+		log.Warnw("dropping replication slot exceeding the wal retention limits", "slot", slot)
+		if err := p.pgm.DropReplicationSlot(slot); err != nil {
+			log.Errorw("failed to drop replication slot", "slot", slot, zap.Error(err))
+			replSlots = append(replSlots, slot)
+			continue
+		}
+		status.DroppedSlots = append(status.DroppedSlots, slot)
+	}
+	// recycle the released wal now or, until the next checkpoint, the wal
+	// dir size will still exceed the limit and another slot will be dropped
+	if len(status.DroppedSlots) > 0 {
+		if err := p.pgm.Checkpoint(); err != nil {
+			log.Errorw("failed to execute a checkpoint", zap.Error(err))
+		}
+	}
+	p.setWalRetention(status)
+	return replSlots
+}
+
+// checkResyncAllowed returns an error when the resync from the followed db is
+// blocked by the blockResync wal retention limits policy: a resync retains
+// the followed db wal since its start and would fill its disk.
+func checkResyncAllowed(followedDB *cluster.DB) error {
+	limits := followedDB.Spec.WalRetentionLimits
+	if limits == nil || limits.DefPolicy() != cluster.WalRetentionLimitPolicyBlockResync {
+		return nil
+	}
+	if s := followedDB.Status.WalRetention; s != nil && s.Exceeded() {
+		return fmt.Errorf("resync blocked since the followed db %q wal retention limits are exceeded", followedDB.UID)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/postgresql"
+)
+
+func TestExceedingReplSlots(t *testing.T) {
+	slots := []*postgresql.ReplicationSlotStatus{
+		{Name: "stolon_db2", Active: true, RestartLSN: 100},
+		{Name: "stolon_db3", RestartLSN: 200},
+		{Name: "stolon_db4", RestartLSN: 700},
+		{Name: "stolon_backup", RestartLSN: 600},
+		// never used
+		{Name: "stolon_db5"},
+	}
+	xLogPos := uint64(1000)
+
+	tests := []struct {
+		limits  *cluster.WalRetentionLimits
+		walSize uint64
+		out     []string
+	}{
+		{
+			limits:  &cluster.WalRetentionLimits{MaxSlotRetainedWal: 500},
+			walSize: 2000,
+			out:     []string{"stolon_db3"},
+		},
+		{
+			limits:  &cluster.WalRetentionLimits{MaxSlotRetainedWal: 350},
+			walSize: 2000,
+			out:     []string{"stolon_backup", "stolon_db3"},
+		},
+		{
+			limits:  &cluster.WalRetentionLimits{MaxSlotRetainedWal: 1000},
+			walSize: 2000,
+			out:     []string{},
+		},
+		{
+			limits:  &cluster.WalRetentionLimits{MaxWalSize: 1500},
+			walSize: 2000,
+			out:     []string{"stolon_db3"},
+		},
+		{
+			limits:  &cluster.WalRetentionLimits{MaxWalSize: 3000},
+			walSize: 2000,
+			out:     []string{},
+		},
+		{
+			limits:  &cluster.WalRetentionLimits{MaxWalSize: 1500, MaxSlotRetainedWal: 350},
+			walSize: 2000,
+			out:     []string{"stolon_backup", "stolon_db3"},
+		},
+	}
+
+	for i, tt := range tests {
+		out := exceedingReplSlots(tt.limits, slots, xLogPos, tt.walSize)
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: got exceeding slots: %v, want: %v", i, out, tt.out)
+		}
+	}
+
+	// only active slots
+	out := exceedingReplSlots(&cluster.WalRetentionLimits{MaxWalSize: 1500}, slots[:1], xLogPos, 2000)
+	if len(out) != 0 {
+		t.Errorf("got exceeding slots: %v, want no slots", out)
+	}
+}
+
+func TestCheckResyncAllowed(t *testing.T) {
+	exceeded := &cluster.WalRetentionStatus{WalSize: 2000, ExceedingSlots: []string{"stolon_db2"}}
+	tests := []struct {
+		limits *cluster.WalRetentionLimits
+		status *cluster.WalRetentionStatus
+		err    error
+	}{
+		{},
+		{
+			limits: &cluster.WalRetentionLimits{MaxWalSize: 1500},
+			status: exceeded,
+		},
+		{
+			limits: &cluster.WalRetentionLimits{MaxWalSize: 1500, Policy: cluster.WalRetentionLimitPolicyDropSlot},
+			status: exceeded,
+		},
+		{
+			limits: &cluster.WalRetentionLimits{MaxWalSize: 3000, Policy: cluster.WalRetentionLimitPolicyBlockResync},
+			status: &cluster.WalRetentionStatus{WalSize: 2000},
+		},
+		{
+			limits: &cluster.WalRetentionLimits{MaxWalSize: 3000, Policy: cluster.WalRetentionLimitPolicyBlockResync},
+		},
+		{
+			limits: &cluster.WalRetentionLimits{MaxWalSize: 1500, Policy: cluster.WalRetentionLimitPolicyBlockResync},
+			status: exceeded,
+			err:    fmt.Errorf(`resync blocked since the followed db "db1" wal retention limits are exceeded`),
+		},
+	}
+
+	for i, tt := range tests {
+		followedDB := &cluster.DB{
+			UID:    "db1",
+			Spec:   &cluster.DBSpec{WalRetentionLimits: tt.limits},
+			Status: cluster.DBStatus{WalRetention: tt.status},
+		}
+		err := checkResyncAllowed(followedDB)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
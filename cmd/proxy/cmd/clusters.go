@@ -0,0 +1,84 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// proxyCluster is a cluster served by a multi cluster proxy and its listening
+// port
+type proxyCluster struct {
+	name string
+	port string
+}
+
+// parseProxyClusters parses the clusters defined as name=port
+func parseProxyClusters(entries []string) ([]proxyCluster, error) {
+	clusters := []proxyCluster{}
+	names := map[string]struct{}{}
+	ports := map[string]struct{}{}
+	for _, e := range entries {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("wrong cluster %q, must be name=port", e)
+		}
+		name, port := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if name == "" {
+			return nil, fmt.Errorf("wrong cluster %q: empty cluster name", e)
+		}
+		if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+			return nil, fmt.Errorf("wrong cluster %q: invalid port %q", e, port)
+		}
+		if _, ok := names[name]; ok {
+			return nil, fmt.Errorf("duplicated cluster %q", name)
+		}
+		if _, ok := ports[port]; ok {
+			return nil, fmt.Errorf("port %s used by multiple clusters", port)
+		}
+		names[name] = struct{}{}
+		ports[port] = struct{}{}
+		clusters = append(clusters, proxyCluster{name: name, port: port})
+	}
+	return clusters, nil
+}
+
+// readProxyClustersFile reads the clusters defined in the provided file, one
+// name=port for every line. Empty lines and lines starting with # are ignored.
+func readProxyClustersFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseProxyClusters(t *testing.T) {
+	tests := []struct {
+		entries []string
+		out     []proxyCluster
+		err     error
+	}{
+		{
+			entries: []string{},
+			out:     []proxyCluster{},
+		},
+		{
+			entries: []string{"cluster1=25432", " cluster2 = 25433 "},
+			out:     []proxyCluster{{name: "cluster1", port: "25432"}, {name: "cluster2", port: "25433"}},
+		},
+		{
+			entries: []string{"cluster1"},
+			err:     fmt.Errorf(`wrong cluster "cluster1", must be name=port`),
+		},
+		{
+			entries: []string{"=25432"},
+			err:     fmt.Errorf(`wrong cluster "=25432": empty cluster name`),
+		},
+		{
+			entries: []string{"cluster1=port"},
+			err:     fmt.Errorf(`wrong cluster "cluster1=port": invalid port "port"`),
+		},
+		{
+			entries: []string{"cluster1=0"},
+			err:     fmt.Errorf(`wrong cluster "cluster1=0": invalid port "0"`),
+		},
+		{
+			entries: []string{"cluster1=25432", "cluster1=25433"},
+			err:     fmt.Errorf(`duplicated cluster "cluster1"`),
+		},
+		{
+			entries: []string{"cluster1=25432", "cluster2=25432"},
+			err:     fmt.Errorf("port 25432 used by multiple clusters"),
+		},
+	}
+
+	for i, tt := range tests {
+		out, err := parseProxyClusters(tt.entries)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: wrong clusters: got: %v, want: %v", i, out, tt.out)
+		}
+	}
+}
+
+func TestReadProxyClustersFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stolon-proxy")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "clusters")
+	data := "# clusters served by the proxy\ncluster1=25432\n\n  cluster2=25433  \n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries, err := readProxyClustersFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"cluster1=25432", "cluster2=25433"}; !reflect.DeepEqual(entries, expected) {
+		t.Errorf("got entries: %v, want: %v", entries, expected)
+	}
+
+	if _, err := readProxyClustersFile(filepath.Join(dir, "notexisting")); err == nil {
+		t.Errorf("got no error reading a not existing file")
+	}
+}
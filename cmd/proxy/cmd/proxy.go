@@ -16,23 +16,31 @@ package cmd
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sorintlab/stolon/cmd"
 	"github.com/sorintlab/stolon/internal/cluster"
 	"github.com/sorintlab/stolon/internal/common"
 	"github.com/sorintlab/stolon/internal/flagutil"
 	slog "github.com/sorintlab/stolon/internal/log"
+	tcpproxy "github.com/sorintlab/stolon/internal/proxy"
 	"github.com/sorintlab/stolon/internal/store"
+	"github.com/sorintlab/stolon/internal/tracing"
 	"github.com/sorintlab/stolon/internal/util"
 
 	"github.com/davecgh/go-spew/spew"
-	"github.com/sorintlab/pollon"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 )
@@ -53,11 +61,68 @@ type config struct {
 	stopListening bool
 	debug         bool
 
+	unixSocketPath string
+	unixSocketMode string
+
+	addressFamily string
+
 	keepAliveIdle     int
 	keepAliveCount    int
 	keepAliveInterval int
+	userTimeout       int
+
+	backendKeepAliveIdle     int
+	backendKeepAliveCount    int
+	backendKeepAliveInterval int
+	backendUserTimeout       int
+
+	idleTimeout int
+
+	sendProxyProtocol        bool
+	sendProxyProtocolVersion int
+	acceptProxyProtocol      bool
+
+	tlsCertFile        string
+	tlsKeyFile         string
+	tlsClientCAFile    string
+	backendTLS         bool
+	backendTLSCAFile   string
+	backendTLSCertFile string
+	backendTLSKeyFile  string
+
+	warmupInterval       int
+	warmupMaxConnections int
+
+	drainTimeout int
+
+	maxClientConnections          int
+	maxClientConnectionsPerSource int
+
+	readOnlyListenAddress string
+	readOnlyPort          string
+	readOnlyMaxLag        uint32
+
+	poolMode        string
+	poolAuthFile    string
+	poolSize        int
+	poolSizes       []string
+	poolWaitTimeout int
+
+	clusters     []string
+	clustersFile string
+
+	mirrorAddress    string
+	mirrorKeeper     string
+	mirrorSampleRate float64
+	mirrorBufferSize int
 }
 
+// pool modes
+const (
+	poolModeSession     = "session"
+	poolModeTransaction = "transaction"
+)
+
 var cfg config
 
 func init() {
@@ -65,11 +130,51 @@ func init() {
 
 	CmdProxy.PersistentFlags().StringVar(&cfg.listenAddress, "listen-address", "127.0.0.1", "proxy listening address")
 	CmdProxy.PersistentFlags().StringVar(&cfg.port, "port", "5432", "proxy listening port")
+	CmdProxy.PersistentFlags().StringVar(&cfg.unixSocketPath, "unix-socket-path", "", "unix socket file where the proxy also listens for master connections, in addition to the tcp port. A stale socket file is replaced. Disabled if empty")
+	CmdProxy.PersistentFlags().StringVar(&cfg.addressFamily, "address-family", string(cluster.AddressFamilyAny), "family (any, ipv4 or ipv6) of the db address, between the ones advertised by its keeper, the proxy connects to. With any, or when the keeper doesn't advertise an address of the family, the address chosen by the cluster spec preferredAddressFamily is used")
+	CmdProxy.PersistentFlags().StringVar(&cfg.unixSocketMode, "unix-socket-mode", "0660", "permissions (octal) of the unix socket file, used to restrict the clients allowed to connect")
 	CmdProxy.PersistentFlags().BoolVar(&cfg.stopListening, "stop-listening", true, "stop listening on store error")
 	CmdProxy.PersistentFlags().BoolVar(&cfg.debug, "debug", false, "enable debug logging")
 	CmdProxy.PersistentFlags().IntVar(&cfg.keepAliveIdle, "tcp-keepalive-idle", 0, "set tcp keepalive idle (seconds)")
 	CmdProxy.PersistentFlags().IntVar(&cfg.keepAliveCount, "tcp-keepalive-count", 0, "set tcp keepalive probe count number")
 	CmdProxy.PersistentFlags().IntVar(&cfg.keepAliveInterval, "tcp-keepalive-interval", 0, "set tcp keepalive interval (seconds)")
+	CmdProxy.PersistentFlags().IntVar(&cfg.userTimeout, "tcp-user-timeout", 0, "set the client connections tcp user timeout (seconds): the max time transmitted data can remain unacknowledged before the connection is closed (linux only). 0 keeps the system default")
+	CmdProxy.PersistentFlags().IntVar(&cfg.backendKeepAliveIdle, "backend-tcp-keepalive-idle", 0, "set the connections to the db tcp keepalive idle (seconds)")
+	CmdProxy.PersistentFlags().IntVar(&cfg.backendKeepAliveCount, "backend-tcp-keepalive-count", 0, "set the connections to the db tcp keepalive probe count number")
+	CmdProxy.PersistentFlags().IntVar(&cfg.backendKeepAliveInterval, "backend-tcp-keepalive-interval", 0, "set the connections to the db tcp keepalive interval (seconds)")
+	CmdProxy.PersistentFlags().IntVar(&cfg.backendUserTimeout, "backend-tcp-user-timeout", 0, "set the connections to the db tcp user timeout (seconds) (linux only). 0 keeps the system default")
+	CmdProxy.PersistentFlags().IntVar(&cfg.idleTimeout, "idle-timeout", 0, "close the proxied connections when no data has been exchanged with the client and the db for this timeout (seconds). It doesn't apply to the pooled client connections. 0 disables it")
+	CmdProxy.PersistentFlags().IntVar(&cfg.warmupInterval, "warmup-interval", 0, "after a new master is elected, limit the concurrent proxied connections for this interval (seconds) linearly increasing the limit up to --warmup-max-connections. 0 disables it")
+	CmdProxy.PersistentFlags().IntVar(&cfg.warmupMaxConnections, "warmup-max-connections", 100, "max concurrent proxied connections at the end of the warm up interval")
+	CmdProxy.PersistentFlags().IntVar(&cfg.drainTimeout, "drain-timeout", 0, "when the master changes, stop proxying new connections and wait up to this timeout (seconds) for the connections to the previous master to be closed by the clients before closing them. Must be lower than the proxy timeout (15 seconds). 0 disables it")
+	CmdProxy.PersistentFlags().IntVar(&cfg.maxClientConnections, "max-client-connections", 0, "max concurrent client connections for every listening port. The exceeding connections receive a postgres \"too many connections\" error. 0 means no limit")
+	CmdProxy.PersistentFlags().IntVar(&cfg.maxClientConnectionsPerSource, "max-client-connections-per-source", 0, "max concurrent client connections from the same source ip for every listening port (with --accept-proxy-protocol the source ip is the one in the PROXY protocol header). 0 means no limit")
+	CmdProxy.PersistentFlags().StringVar(&cfg.readOnlyListenAddress, "read-only-listen-address", "", "proxy listening address for read only connections. Defaults to --listen-address")
+	CmdProxy.PersistentFlags().StringVar(&cfg.readOnlyPort, "read-only-port", "", "proxy listening port for read only connections, balanced between the ready standbys (the master is used when there're no ready standbys). Disabled if empty")
+	CmdProxy.PersistentFlags().Uint32Var(&cfg.readOnlyMaxLag, "read-only-max-lag", 0, "max replication lag (bytes) of a standby to receive new read only connections. Connections already established to a standby exceeding it aren't closed. 0 means no limit")
+	CmdProxy.PersistentFlags().StringVar(&cfg.mirrorAddress, "mirror-address", "", "address (host:port) of an external postgres instance receiving a copy of the traffic of the master connections. Its responses are discarded. Disabled if empty")
+	CmdProxy.PersistentFlags().StringVar(&cfg.mirrorKeeper, "mirror-keeper", "", "uid of the keeper whose standby db receives a copy of the traffic of the master connections. Its responses are discarded. Disabled if empty")
+	CmdProxy.PersistentFlags().Float64Var(&cfg.mirrorSampleRate, "mirror-sample-rate", 1, "fraction (between 0 and 1) of the master connections mirrored")
+	CmdProxy.PersistentFlags().IntVar(&cfg.mirrorBufferSize, "mirror-buffer-size", tcpproxy.DefaultMirrorBufferSize, "max client data (bytes) queued for a mirror connection. When exceeded, since the mirror destination is too slow, the mirror connection is closed")
+	CmdProxy.PersistentFlags().BoolVar(&cfg.sendProxyProtocol, "send-proxy-protocol", false, "send a PROXY protocol (v1) header with the client address to the master db. Enable it only if connections to the master pass through something accepting the PROXY protocol or they will fail")
+	CmdProxy.PersistentFlags().IntVar(&cfg.sendProxyProtocolVersion, "send-proxy-protocol-version", 1, "version (1 or 2) of the PROXY protocol headers sent with --send-proxy-protocol")
+	CmdProxy.PersistentFlags().BoolVar(&cfg.acceptProxyProtocol, "accept-proxy-protocol", false, "accept a PROXY protocol (v1 or v2) header at the start of every client connection, as sent by an upstream load balancer. The client address it contains is the one sent with --send-proxy-protocol. Connections without a valid header are closed")
+	CmdProxy.PersistentFlags().StringVar(&cfg.tlsCertFile, "tls-cert-file", "", "certificate file used to terminate the client tls connections. When provided (with --tls-key-file) the clients must request a tls connection or they're refused")
+	CmdProxy.PersistentFlags().StringVar(&cfg.tlsKeyFile, "tls-key-file", "", "private key file of --tls-cert-file")
+	CmdProxy.PersistentFlags().StringVar(&cfg.tlsClientCAFile, "tls-client-ca-file", "", "ca file used to verify the client certificates. When provided the clients must present a valid certificate")
+	CmdProxy.PersistentFlags().BoolVar(&cfg.backendTLS, "backend-tls", false, "open tls connections to the dbs")
+	CmdProxy.PersistentFlags().StringVar(&cfg.backendTLSCAFile, "backend-tls-ca-file", "", "ca file used to verify the db certificates (their host name isn't verified). When empty the db certificates aren't verified")
+	CmdProxy.PersistentFlags().StringVar(&cfg.backendTLSCertFile, "backend-tls-cert-file", "", "client certificate file presented to the dbs")
+	CmdProxy.PersistentFlags().StringVar(&cfg.backendTLSKeyFile, "backend-tls-key-file", "", "private key file of --backend-tls-cert-file")
+
+	CmdProxy.PersistentFlags().StringVar(&cfg.poolMode, "pool-mode", poolModeSession, "connections pool mode: session (every client connection is proxied to its own master db connection) or transaction (the client connections are authenticated by the proxy and share a pool of master db connections, assigned to a client only for the duration of a transaction). Doesn't apply to the read only port")
+	CmdProxy.PersistentFlags().StringVar(&cfg.poolAuthFile, "pool-auth-file", "", "file with the users, and their passwords, authenticated by the proxy in transaction pool mode. Every line contains the double quoted user name and password (like the pgbouncer auth_file). The passwords are also used to connect to the master db")
+	CmdProxy.PersistentFlags().IntVar(&cfg.poolSize, "pool-size", 20, "max master db connections of every database and user pair in transaction pool mode")
+	CmdProxy.PersistentFlags().StringSliceVar(&cfg.poolSizes, "pool-sizes", []string{}, "max master db connections of specific database and user pairs in transaction pool mode, as database/user=size (i.e. app/appuser=50)")
+	CmdProxy.PersistentFlags().IntVar(&cfg.poolWaitTimeout, "pool-wait-timeout", 30, "max time (seconds) a transaction waits for a master db connection in transaction pool mode (i.e. when all the pool connections are used or there's no master). When expired the client receives an error and is disconnected")
+
+	CmdProxy.PersistentFlags().StringSliceVar(&cfg.clusters, "clusters", []string{}, "clusters served by the proxy, as name=port (i.e. cluster1=25432,cluster2=25433). Every cluster is proxied on its own port of --listen-address, sharing the store connection. Replaces --cluster-name and --port")
+	CmdProxy.PersistentFlags().StringVar(&cfg.clustersFile, "clusters-file", "", "file with the clusters served by the proxy, one name=port for every line (empty lines and lines starting with # are ignored). Can be used with --clusters")
 
 	CmdProxy.PersistentFlags().MarkDeprecated("debug", "use --log-level=debug instead")
 }
@@ -78,66 +183,450 @@ type ClusterChecker struct {
 	uid           string
 	listenAddress string
 	port          string
+	// clusterName is the name of the cluster when the proxy serves multiple
+	// clusters, empty otherwise
+	clusterName string
+
+	log *zap.SugaredLogger
 
 	stopListening bool
 
 	listener         *net.TCPListener
-	pp               *pollon.Proxy
+	pp               *tcpproxy.Proxy
 	e                store.Store
 	endPollonProxyCh chan error
 
+	clientTLSConfig *tls.Config
+	destTLSConfig   *tls.Config
+
+	// poolConfig is the transaction pooling configuration, nil in session
+	// pool mode
+	poolConfig *tcpproxy.PoolConfig
+
+	// addressFamily is the family of the db addresses proxied to
+	addressFamily cluster.AddressFamily
+
+	readOnlyPort     string
+	readOnlyMaxLag   uint32
+	readOnlyListener *net.TCPListener
+	readOnlyPP       *tcpproxy.Proxy
+
+	// unix socket proxying to the master, disabled when unixSocketPath is
+	// empty
+	unixSocketPath     string
+	unixSocketMode     os.FileMode
+	unixSocketListener net.Listener
+	unixSocketPP       *tcpproxy.Proxy
+
+	// traffic mirroring of the master connections, disabled when
+	// mirrorConfig is nil
+	mirrorConfig  *tcpproxy.MirrorConfig
+	mirrorAddress string
+	mirrorKeeper  string
+
+	// connections statistics kept across proxy restarts
+	connStats           *tcpproxy.ConnStats
+	readOnlyConnStats   *tcpproxy.ConnStats
+	unixSocketConnStats *tcpproxy.ConnStats
+
+	// masterAvailable reports if the proxy is currently proxying to a
+	// master
+	masterAvailable bool
+	// masterDBUID is the uid of the last master db the proxy has proxied to
+	masterDBUID string
+	// masterAddress is the address of the master db the proxy is currently
+	// proxying to
+	masterAddress string
+	// proxyGeneration is the generation of the last cluster data proxy spec
+	// read
+	proxyGeneration int64
+	// lastDropReason is the reason of the last time all the connections to
+	// the master have been closed
+	lastDropReason connDropReason
+	// lastClusterDataRead is the time of the last successful cluster data
+	// read
+	lastClusterDataRead time.Time
+	// lastCheckOk is the time of the last successful check
+	lastCheckOk time.Time
+	// connDrops counts, by reason, the times the connections to the master
+	// have been closed since the cluster data wasn't usable
+	connDrops map[connDropReason]uint64
+
+	tracer *tracing.Tracer
+	// tracedGeneration is the last proxy generation traced
+	tracedGeneration int64
+
 	pollonMutex sync.Mutex
 }
 
-func NewClusterChecker(uid string, cfg config) (*ClusterChecker, error) {
-	e, err := cmd.NewStore(&cfg.CommonConfig)
-	if err != nil {
-		return nil, fmt.Errorf("cannot create store: %v", err)
+// connDropReason is the reason why the proxy closed all the connections to the
+// master
+type connDropReason string
+
+const (
+	connDropNoClusterData      connDropReason = "no_cluster_data"
+	connDropInvalidClusterData connDropReason = "invalid_cluster_data"
+	connDropNoMaster           connDropReason = "no_master"
+	connDropNotEnabled         connDropReason = "not_enabled"
+	connDropCheckTimeout       connDropReason = "check_timeout"
+)
+
+var connDropReasons = []connDropReason{connDropNoClusterData, connDropInvalidClusterData, connDropNoMaster, connDropNotEnabled, connDropCheckTimeout}
+
+// NewClusterChecker returns a cluster checker using the provided store. When
+// clusterName isn't empty the proxy serves multiple clusters and the checker
+// logs and metrics report it.
+func NewClusterChecker(uid string, cfg config, e store.Store, clusterName string) (*ClusterChecker, error) {
+	var err error
+	var clientTLSConfig, destTLSConfig *tls.Config
+	if cfg.tlsCertFile != "" {
+		clientTLSConfig, err = newClientTLSConfig(cfg.tlsCertFile, cfg.tlsKeyFile, cfg.tlsClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create client tls config: %v", err)
+		}
+	}
+	if cfg.backendTLS {
+		destTLSConfig, err = newBackendTLSConfig(cfg.backendTLSCertFile, cfg.backendTLSKeyFile, cfg.backendTLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create backend tls config: %v", err)
+		}
+	}
+
+	var poolConfig *tcpproxy.PoolConfig
+	if cfg.poolMode == poolModeTransaction {
+		poolConfig, err = newPoolConfig(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create pool config: %v", err)
+		}
+	}
+
+	var unixSocketMode os.FileMode
+	if cfg.unixSocketPath != "" {
+		unixSocketMode, err = parseUnixSocketMode(cfg.unixSocketMode)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var mirrorConfig *tcpproxy.MirrorConfig
+	if cfg.mirrorAddress != "" || cfg.mirrorKeeper != "" {
+		mirrorConfig = &tcpproxy.MirrorConfig{
+			SampleRate: cfg.mirrorSampleRate,
+			BufferSize: cfg.mirrorBufferSize,
+		}
+	}
+
+	checkerLog := log
+	if clusterName != "" {
+		checkerLog = log.With("cluster", clusterName)
 	}
 
 	return &ClusterChecker{
 		uid:              uid,
 		listenAddress:    cfg.listenAddress,
 		port:             cfg.port,
+		clusterName:      clusterName,
+		log:              checkerLog,
 		stopListening:    cfg.stopListening,
 		e:                e,
 		endPollonProxyCh: make(chan error),
+		readOnlyPort:     cfg.readOnlyPort,
+		readOnlyMaxLag:   cfg.readOnlyMaxLag,
+		unixSocketPath:   cfg.unixSocketPath,
+		addressFamily:    cluster.AddressFamily(cfg.addressFamily),
+		unixSocketMode:   unixSocketMode,
+
+		clientTLSConfig: clientTLSConfig,
+		destTLSConfig:   destTLSConfig,
+		poolConfig:      poolConfig,
+
+		mirrorConfig:  mirrorConfig,
+		mirrorAddress: cfg.mirrorAddress,
+		mirrorKeeper:  cfg.mirrorKeeper,
+
+		connStats:           tcpproxy.NewConnStats(),
+		readOnlyConnStats:   tcpproxy.NewConnStats(),
+		unixSocketConnStats: tcpproxy.NewConnStats(),
+
+		tracer:           cmd.NewTracer(&cfg.CommonConfig),
+		tracedGeneration: cluster.NoGeneration,
 	}, nil
 }
 
-func (c *ClusterChecker) startPollonProxy() error {
-	c.pollonMutex.Lock()
-	defer c.pollonMutex.Unlock()
-	if c.pp != nil {
-		return nil
+// newPoolConfig returns the transaction pooling configuration
+func newPoolConfig(cfg config) (*tcpproxy.PoolConfig, error) {
+	f, err := os.Open(cfg.poolAuthFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users, err := tcpproxy.ReadPoolUsers(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read pool auth file %q: %v", cfg.poolAuthFile, err)
+	}
+	sizes, err := parsePoolSizes(cfg.poolSizes)
+	if err != nil {
+		return nil, err
 	}
+	return &tcpproxy.PoolConfig{
+		Users:       users,
+		DefaultSize: cfg.poolSize,
+		Sizes:       sizes,
+		WaitTimeout: time.Duration(cfg.poolWaitTimeout) * time.Second,
+	}, nil
+}
+
+// parsePoolSizes parses the database/user=size pool sizes
+func parsePoolSizes(s []string) (map[string]int, error) {
+	sizes := map[string]int{}
+	for _, e := range s {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("wrong pool size %q, must be database/user=size", e)
+		}
+		parts := strings.SplitN(kv[0], "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("wrong pool size %q, must be database/user=size", e)
+		}
+		size, err := strconv.Atoi(kv[1])
+		if err != nil || size < 1 {
+			return nil, fmt.Errorf("wrong pool size %q, size must be at least 1", e)
+		}
+		sizes[kv[0]] = size
+	}
+	return sizes, nil
+}
 
-	log.Infow("Starting proxying")
-	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(cfg.listenAddress, cfg.port))
+func newTCPProxy(listenAddress, port string) (*net.TCPListener, *tcpproxy.Proxy, error) {
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(listenAddress, port))
 	if err != nil {
-		return fmt.Errorf("error resolving tcp addr %q: %v", addr.String(), err)
+		return nil, nil, fmt.Errorf("error resolving tcp addr %q: %v", addr.String(), err)
 	}
 
 	listener, err := net.ListenTCP("tcp", addr)
 	if err != nil {
-		return fmt.Errorf("error listening on tcp addr %q: %v", addr.String(), err)
+		return nil, nil, fmt.Errorf("error listening on tcp addr %q: %v", addr.String(), err)
 	}
 
-	pp, err := pollon.NewProxy(listener)
+	pp, err := tcpproxy.NewProxy(listener)
 	if err != nil {
-		return fmt.Errorf("error creating pollon proxy: %v", err)
+		listener.Close()
+		return nil, nil, fmt.Errorf("error creating pollon proxy: %v", err)
 	}
 	pp.SetKeepAlive(true)
 	pp.SetKeepAliveIdle(time.Duration(cfg.keepAliveIdle) * time.Second)
 	pp.SetKeepAliveCount(cfg.keepAliveCount)
 	pp.SetKeepAliveInterval(time.Duration(cfg.keepAliveInterval) * time.Second)
+	pp.SetUserTimeout(time.Duration(cfg.userTimeout) * time.Second)
+	pp.SetDestKeepAlive(time.Duration(cfg.backendKeepAliveIdle)*time.Second, cfg.backendKeepAliveCount, time.Duration(cfg.backendKeepAliveInterval)*time.Second)
+	pp.SetDestUserTimeout(time.Duration(cfg.backendUserTimeout) * time.Second)
+	pp.SetIdleTimeout(time.Duration(cfg.idleTimeout) * time.Second)
+
+	return listener, pp, nil
+}
+
+// parseUnixSocketMode parses the octal permissions of the unix socket file
+func parseUnixSocketMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid unix socket mode %q", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// listenUnixSocket listens on the unix socket file, replacing a stale socket
+// file left by a previous proxy instance, and sets its permissions
+func listenUnixSocket(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("file %q exists and isn't a unix socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("cannot remove stale unix socket %q: %v", path, err)
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on unix socket %q: %v", path, err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("cannot set unix socket %q permissions: %v", path, err)
+	}
+	return listener, nil
+}
+
+func newUnixSocketProxy(path string, mode os.FileMode) (net.Listener, *tcpproxy.Proxy, error) {
+	listener, err := listenUnixSocket(path, mode)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pp, err := tcpproxy.NewProxy(listener)
+	if err != nil {
+		listener.Close()
+		return nil, nil, fmt.Errorf("error creating pollon proxy: %v", err)
+	}
+	pp.SetDestKeepAlive(time.Duration(cfg.backendKeepAliveIdle)*time.Second, cfg.backendKeepAliveCount, time.Duration(cfg.backendKeepAliveInterval)*time.Second)
+	pp.SetDestUserTimeout(time.Duration(cfg.backendUserTimeout) * time.Second)
+	pp.SetIdleTimeout(time.Duration(cfg.idleTimeout) * time.Second)
+
+	return listener, pp, nil
+}
+
+// newClientTLSConfig returns the tls config used to terminate the client tls
+// connections. When clientCAFile is provided the clients must present a
+// certificate signed by it.
+func newClientTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	tlsConfig, err := common.NewTLSConfig(certFile, keyFile, clientCAFile, false)
+	if err != nil {
+		return nil, err
+	}
+	if clientCAFile != "" {
+		tlsConfig.ClientCAs = tlsConfig.RootCAs
+		tlsConfig.RootCAs = nil
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// newBackendTLSConfig returns the tls config used for the connections to the
+// dbs. When caFile is provided the db certificate chain is verified but not
+// its host name (like the postgres sslmode verify-ca) since the dbs are
+// addressed by their ip.
+func newBackendTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	tlsConfig, err := common.NewTLSConfig(certFile, keyFile, caFile, true)
+	if err != nil {
+		return nil, err
+	}
+	if caFile != "" {
+		roots := tlsConfig.RootCAs
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyCertChain(rawCerts, roots)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// verifyCertChain verifies that the first certificate is signed by one of the
+// roots, using the other certificates as intermediates
+func verifyCertChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no certificate provided")
+	}
+	certs := []*x509.Certificate{}
+	for _, rawCert := range rawCerts {
+		cert, err := x509.ParseCertificate(rawCert)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+	return err
+}
+
+func (c *ClusterChecker) startPollonProxy() error {
+	c.pollonMutex.Lock()
+	defer c.pollonMutex.Unlock()
+	if c.pp != nil {
+		return nil
+	}
+
+	c.log.Infow("Starting proxying")
+	listener, pp, err := newTCPProxy(c.listenAddress, c.port)
+	if err != nil {
+		return err
+	}
+	pp.SetProxyProtocol(cfg.sendProxyProtocol)
+	pp.SetProxyProtocolVersion(cfg.sendProxyProtocolVersion)
+	pp.SetAcceptProxyProtocol(cfg.acceptProxyProtocol)
+	pp.SetClientTLSConfig(c.clientTLSConfig)
+	pp.SetDestTLSConfig(c.destTLSConfig)
+	pp.SetConnStats(c.connStats)
+	pp.SetWarmup(time.Duration(cfg.warmupInterval)*time.Second, cfg.warmupMaxConnections)
+	pp.SetDrainTimeout(time.Duration(cfg.drainTimeout) * time.Second)
+	pp.SetConnLimits(cfg.maxClientConnections, cfg.maxClientConnectionsPerSource)
+	if c.poolConfig != nil {
+		pp.SetTransactionPool(c.poolConfig)
+	}
+	if c.mirrorConfig != nil {
+		pp.SetMirror(c.mirrorConfig)
+	}
+
+	var readOnlyListener *net.TCPListener
+	var readOnlyPP *tcpproxy.Proxy
+	if c.readOnlyPort != "" {
+		c.log.Infow("Starting read only proxying")
+		readOnlyListenAddress := c.listenAddress
+		if cfg.readOnlyListenAddress != "" {
+			readOnlyListenAddress = cfg.readOnlyListenAddress
+		}
+		readOnlyListener, readOnlyPP, err = newTCPProxy(readOnlyListenAddress, c.readOnlyPort)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		readOnlyPP.SetConnStats(c.readOnlyConnStats)
+		readOnlyPP.SetAcceptProxyProtocol(cfg.acceptProxyProtocol)
+		readOnlyPP.SetClientTLSConfig(c.clientTLSConfig)
+		readOnlyPP.SetDestTLSConfig(c.destTLSConfig)
+		readOnlyPP.SetConnLimits(cfg.maxClientConnections, cfg.maxClientConnectionsPerSource)
+	}
+
+	var unixSocketListener net.Listener
+	var unixSocketPP *tcpproxy.Proxy
+	if c.unixSocketPath != "" {
+		c.log.Infow("Starting unix socket proxying", "path", c.unixSocketPath)
+		unixSocketListener, unixSocketPP, err = newUnixSocketProxy(c.unixSocketPath, c.unixSocketMode)
+		if err != nil {
+			listener.Close()
+			if readOnlyListener != nil {
+				readOnlyListener.Close()
+			}
+			return err
+		}
+		// the clients don't use tls or the PROXY protocol on a unix socket
+		// and they have no source address to limit the connections for
+		unixSocketPP.SetProxyProtocol(cfg.sendProxyProtocol)
+		unixSocketPP.SetProxyProtocolVersion(cfg.sendProxyProtocolVersion)
+		unixSocketPP.SetDestTLSConfig(c.destTLSConfig)
+		unixSocketPP.SetConnStats(c.unixSocketConnStats)
+		unixSocketPP.SetWarmup(time.Duration(cfg.warmupInterval)*time.Second, cfg.warmupMaxConnections)
+		unixSocketPP.SetDrainTimeout(time.Duration(cfg.drainTimeout) * time.Second)
+		unixSocketPP.SetConnLimits(cfg.maxClientConnections, 0)
+		if c.poolConfig != nil {
+			unixSocketPP.SetTransactionPool(c.poolConfig)
+		}
+		if c.mirrorConfig != nil {
+			unixSocketPP.SetMirror(c.mirrorConfig)
+		}
+	}
 
 	c.pp = pp
 	c.listener = listener
+	c.readOnlyPP = readOnlyPP
+	c.readOnlyListener = readOnlyListener
+	c.unixSocketPP = unixSocketPP
+	c.unixSocketListener = unixSocketListener
 
 	go func() {
-		c.endPollonProxyCh <- c.pp.Start()
+		c.endPollonProxyCh <- pp.Start()
 	}()
+	if readOnlyPP != nil {
+		go func() {
+			c.endPollonProxyCh <- readOnlyPP.Start()
+		}()
+	}
+	if unixSocketPP != nil {
+		go func() {
+			c.endPollonProxyCh <- unixSocketPP.Start()
+		}()
+	}
 
 	return nil
 }
@@ -146,20 +635,356 @@ func (c *ClusterChecker) stopPollonProxy() {
 	c.pollonMutex.Lock()
 	defer c.pollonMutex.Unlock()
 	if c.pp != nil {
-		log.Infow("Stopping listening")
+		c.log.Infow("Stopping listening")
 		c.pp.Stop()
 		c.pp = nil
 		c.listener.Close()
 		c.listener = nil
 	}
+	c.masterAvailable = false
+	if c.readOnlyPP != nil {
+		c.readOnlyPP.Stop()
+		c.readOnlyPP = nil
+		c.readOnlyListener.Close()
+		c.readOnlyListener = nil
+	}
+	if c.unixSocketPP != nil {
+		c.unixSocketPP.Stop()
+		c.unixSocketPP = nil
+		c.unixSocketListener.Close()
+		c.unixSocketListener = nil
+	}
 }
 
-func (c *ClusterChecker) sendPollonConfData(confData pollon.ConfData) {
+func (c *ClusterChecker) sendPollonConfData(confData tcpproxy.ConfData) {
 	c.pollonMutex.Lock()
 	defer c.pollonMutex.Unlock()
 	if c.pp != nil {
 		c.pp.C <- confData
 	}
+	if c.unixSocketPP != nil {
+		c.unixSocketPP.C <- confData
+	}
+	c.masterAvailable = c.pp != nil && confData.DestAddr != nil
+	c.masterAddress = ""
+	if c.masterAvailable {
+		c.masterAddress = confData.DestAddr.String()
+		c.lastDropReason = ""
+	}
+}
+
+func (c *ClusterChecker) setMirrorAddr(addr *net.TCPAddr) {
+	c.pollonMutex.Lock()
+	defer c.pollonMutex.Unlock()
+	if c.pp != nil {
+		c.pp.SetMirrorAddr(addr)
+	}
+	if c.unixSocketPP != nil {
+		c.unixSocketPP.SetMirrorAddr(addr)
+	}
+}
+
+func (c *ClusterChecker) sendReadOnlyConfData(confData tcpproxy.ConfData) {
+	c.pollonMutex.Lock()
+	defer c.pollonMutex.Unlock()
+	if c.readOnlyPP != nil {
+		c.readOnlyPP.C <- confData
+	}
+}
+
+// closeAllConns closes all the connections to the master and to the read
+// only destinations. When the proxy was proxying to a master the drop is
+// accounted for the provided reason.
+func (c *ClusterChecker) closeAllConns(reason connDropReason) {
+	c.pollonMutex.Lock()
+	if c.masterAvailable {
+		if c.connDrops == nil {
+			c.connDrops = map[connDropReason]uint64{}
+		}
+		c.connDrops[reason]++
+	}
+	c.lastDropReason = reason
+	c.pollonMutex.Unlock()
+	c.sendPollonConfData(tcpproxy.ConfData{DestAddr: nil})
+	c.sendReadOnlyConfData(tcpproxy.ConfData{})
+}
+
+func (c *ClusterChecker) readOnlyChosenConns() map[string]uint64 {
+	c.pollonMutex.Lock()
+	defer c.pollonMutex.Unlock()
+	if c.readOnlyPP == nil {
+		return nil
+	}
+	return c.readOnlyPP.ChosenConns()
+}
+
+// readOnlyDBs returns the dbs that should receive new read only connections:
+// the ready standbys following the master with a replication lag not greater
+// than maxLag (0 means no limit). Delayed standbys are excluded since they
+// serve stale data by design. If there're no such standbys the master is
+// returned.
+func readOnlyDBs(cd *cluster.ClusterData, masterDB *cluster.DB, maxLag uint32) []*cluster.DB {
+	dbs := []*cluster.DB{}
+	for _, db := range cd.DBs {
+		if db.UID == masterDB.UID {
+			continue
+		}
+		if db.Spec.FollowConfig == nil || db.Spec.FollowConfig.Type != cluster.FollowTypeInternal || db.Spec.FollowConfig.DBUID != masterDB.UID {
+			continue
+		}
+		if !db.Status.Ready {
+			continue
+		}
+		if db.Spec.RecoveryMinApplyDelay != nil {
+			log.Debugw("excluding delayed standby from read only destinations", "db", db.UID)
+			continue
+		}
+		if maxLag > 0 && db.Status.ReplicationLag > uint64(maxLag) {
+			log.Debugw("excluding standby from read only destinations since its replication lag is greater than the read only max lag", "db", db.UID, "lag", db.Status.ReplicationLag, "maxLag", maxLag)
+			continue
+		}
+		dbs = append(dbs, db)
+	}
+	if len(dbs) == 0 {
+		return []*cluster.DB{masterDB}
+	}
+	sort.Slice(dbs, func(i, j int) bool { return dbs[i].UID < dbs[j].UID })
+	return dbs
+}
+
+// mirrorDB returns the db of the mirror keeper when it's a healthy standby. The
+// master db is never a mirror destination since it would execute twice the
+// mirrored statements.
+func mirrorDB(cd *cluster.ClusterData, masterDB *cluster.DB, keeperUID string) *cluster.DB {
+	for _, db := range cd.DBs {
+		if db.Spec.KeeperUID != keeperUID {
+			continue
+		}
+		if db.UID == masterDB.UID || db.Spec.Role != common.RoleStandby || !db.Status.Healthy {
+			return nil
+		}
+		return db
+	}
+	return nil
+}
+
+// checkMirror sets the mirror destination of the master connections
+func (c *ClusterChecker) checkMirror(cd *cluster.ClusterData, masterDB *cluster.DB) {
+	if c.mirrorConfig == nil {
+		return
+	}
+	address := c.mirrorAddress
+	if c.mirrorKeeper != "" {
+		db := mirrorDB(cd, masterDB, c.mirrorKeeper)
+		if db == nil {
+			c.log.Infow("mirror keeper has no healthy standby db, not mirroring connections", "keeper", c.mirrorKeeper)
+			c.setMirrorAddr(nil)
+			return
+		}
+		address = net.JoinHostPort(c.dbAddress(db), db.Status.Port)
+	}
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		c.log.Errorw("cannot resolve mirror address", zap.Error(err))
+		c.setMirrorAddr(nil)
+		return
+	}
+	c.log.Debugw("mirror address", "address", addr)
+	c.setMirrorAddr(addr)
+}
+
+// dbAddress returns the db address, of the proxy address family, to proxy to
+func (c *ClusterChecker) dbAddress(db *cluster.DB) string {
+	return cluster.SelectListenAddress(db.Status.ListenAddress, db.Status.ListenAddresses, c.addressFamily)
+}
+
+// checkReadOnly applies the read only proxy configuration
+func (c *ClusterChecker) checkReadOnly(cd *cluster.ClusterData, masterDB *cluster.DB) {
+	if c.readOnlyPort == "" {
+		return
+	}
+	dbs := readOnlyDBs(cd, masterDB, c.readOnlyMaxLag)
+	if len(dbs) == 1 && dbs[0].UID == masterDB.UID {
+		c.log.Infow("no ready standbys available, proxying read only connections to master")
+	}
+	addrs := []*net.TCPAddr{}
+	for _, db := range dbs {
+		addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(c.dbAddress(db), db.Status.Port))
+		if err != nil {
+			c.log.Errorw("cannot resolve db address", "db", db.UID, zap.Error(err))
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	c.log.Infow("read only addresses", "addresses", addrs)
+	c.sendReadOnlyConfData(tcpproxy.ConfData{DestAddrs: addrs})
+}
+
+// readOnlyChosenConnsCollector reports the connections balanced to every read
+// only destination
+type readOnlyChosenConnsCollector struct {
+	c    *ClusterChecker
+	desc *prometheus.Desc
+}
+
+func newReadOnlyChosenConnsCollector(c *ClusterChecker) *readOnlyChosenConnsCollector {
+	return &readOnlyChosenConnsCollector{
+		c:    c,
+		desc: prometheus.NewDesc("stolon_proxy_read_only_chosen_connections_total", "Number of read only connections balanced to a destination db.", []string{"destination"}, c.metricsLabels()),
+	}
+}
+
+func (rc *readOnlyChosenConnsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rc.desc
+}
+
+func (rc *readOnlyChosenConnsCollector) Collect(ch chan<- prometheus.Metric) {
+	for addr, n := range rc.c.readOnlyChosenConns() {
+		ch <- prometheus.MustNewConstMetric(rc.desc, prometheus.CounterValue, float64(n), addr)
+	}
+}
+
+// metricsLabels returns the constant labels of the proxy metrics: the cluster
+// name when the proxy serves multiple clusters
+func (c *ClusterChecker) metricsLabels() prometheus.Labels {
+	if c.clusterName == "" {
+		return nil
+	}
+	return prometheus.Labels{"cluster": c.clusterName}
+}
+
+// proxyMetricsState is the proxy state reported by the proxy metrics
+type proxyMetricsState struct {
+	masterAvailable     bool
+	lastClusterDataRead time.Time
+	lastCheckOk         time.Time
+	connDrops           map[connDropReason]uint64
+}
+
+// metricsState returns the state reported by the proxy metrics
+func (c *ClusterChecker) metricsState() proxyMetricsState {
+	c.pollonMutex.Lock()
+	defer c.pollonMutex.Unlock()
+	connDrops := make(map[connDropReason]uint64, len(c.connDrops))
+	for reason, n := range c.connDrops {
+		connDrops[reason] = n
+	}
+	return proxyMetricsState{
+		masterAvailable:     c.masterAvailable,
+		lastClusterDataRead: c.lastClusterDataRead,
+		lastCheckOk:         c.lastCheckOk,
+		connDrops:           connDrops,
+	}
+}
+
+func (c *ClusterChecker) setLastCheckOk(t time.Time) {
+	c.pollonMutex.Lock()
+	defer c.pollonMutex.Unlock()
+	c.lastCheckOk = t
+}
+
+// proxyCollector reports the proxied connections statistics and the proxy
+// state
+type proxyCollector struct {
+	c               *ClusterChecker
+	nowFn           func() time.Time
+	readOnly        bool
+	active          *prometheus.Desc
+	clients         *prometheus.Desc
+	accepted        *prometheus.Desc
+	closed          *prometheus.Desc
+	teardowns       *prometheus.Desc
+	idleTimeouts    *prometheus.Desc
+	refused         *prometheus.Desc
+	mirrors         *prometheus.Desc
+	mirrorFailures  *prometheus.Desc
+	drops           *prometheus.Desc
+	lastRead        *prometheus.Desc
+	lastCheckOk     *prometheus.Desc
+	masterAvailable *prometheus.Desc
+}
+
+func newProxyCollector(c *ClusterChecker, readOnly bool) *proxyCollector {
+	labels := c.metricsLabels()
+	return &proxyCollector{
+		c:               c,
+		nowFn:           time.Now,
+		readOnly:        readOnly,
+		active:          prometheus.NewDesc("stolon_proxy_active_connections", "Number of currently proxied connections to a destination db.", []string{"listener", "destination"}, labels),
+		clients:         prometheus.NewDesc("stolon_proxy_client_connections", "Number of currently open client connections (also the ones not yet or not proxied).", []string{"listener"}, labels),
+		accepted:        prometheus.NewDesc("stolon_proxy_accepted_connections_total", "Number of accepted client connections.", []string{"listener"}, labels),
+		closed:          prometheus.NewDesc("stolon_proxy_closed_connections_total", "Number of closed client connections.", []string{"listener"}, labels),
+		teardowns:       prometheus.NewDesc("stolon_proxy_destination_change_teardowns_total", "Number of times all the connections have been closed since the destination changed (i.e. a new master has been elected or there's no master).", []string{"listener"}, labels),
+		idleTimeouts:    prometheus.NewDesc("stolon_proxy_idle_timeout_closed_connections_total", "Number of proxied connections closed since idle for the idle timeout.", []string{"listener"}, labels),
+		refused:         prometheus.NewDesc("stolon_proxy_refused_connections_total", "Number of client connections refused since a connections limit was reached.", []string{"listener", "reason"}, labels),
+		mirrors:         prometheus.NewDesc("stolon_proxy_mirrored_connections_total", "Number of client connections mirrored to the mirror destination.", []string{"listener"}, labels),
+		mirrorFailures:  prometheus.NewDesc("stolon_proxy_mirror_failures_total", "Number of mirror connections that couldn't be opened or have been closed since their buffer was full.", []string{"listener"}, labels),
+		drops:           prometheus.NewDesc("stolon_proxy_unhealthy_cluster_data_drops_total", "Number of times all the connections to the master have been closed since the cluster data wasn't usable.", []string{"reason"}, labels),
+		lastRead:        prometheus.NewDesc("stolon_proxy_cluster_data_last_read_seconds", "Seconds since the last successful cluster data read. Not reported until the first successful read.", nil, labels),
+		lastCheckOk:     prometheus.NewDesc("stolon_proxy_last_successful_check_seconds", "Seconds since the last successful proxy check. Not reported until the first successful check.", nil, labels),
+		masterAvailable: prometheus.NewDesc("stolon_proxy_master_available", "Whether the proxy currently has a master to proxy connections to (1) or not (0).", nil, labels),
+	}
+}
+
+func (pc *proxyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pc.active
+	ch <- pc.clients
+	ch <- pc.accepted
+	ch <- pc.closed
+	ch <- pc.teardowns
+	ch <- pc.idleTimeouts
+	ch <- pc.refused
+	ch <- pc.mirrors
+	ch <- pc.mirrorFailures
+	ch <- pc.drops
+	ch <- pc.lastRead
+	ch <- pc.lastCheckOk
+	ch <- pc.masterAvailable
+}
+
+func (pc *proxyCollector) collectConnStats(ch chan<- prometheus.Metric, listener string, stats tcpproxy.ConnStatsSnapshot) {
+	for dest, n := range stats.Active {
+		ch <- prometheus.MustNewConstMetric(pc.active, prometheus.GaugeValue, float64(n), listener, dest)
+	}
+	var clients uint64
+	if stats.Accepted > stats.Closed {
+		clients = stats.Accepted - stats.Closed
+	}
+	ch <- prometheus.MustNewConstMetric(pc.clients, prometheus.GaugeValue, float64(clients), listener)
+	ch <- prometheus.MustNewConstMetric(pc.accepted, prometheus.CounterValue, float64(stats.Accepted), listener)
+	ch <- prometheus.MustNewConstMetric(pc.closed, prometheus.CounterValue, float64(stats.Closed), listener)
+	ch <- prometheus.MustNewConstMetric(pc.teardowns, prometheus.CounterValue, float64(stats.Teardowns), listener)
+	ch <- prometheus.MustNewConstMetric(pc.idleTimeouts, prometheus.CounterValue, float64(stats.IdleTimeouts), listener)
+	ch <- prometheus.MustNewConstMetric(pc.refused, prometheus.CounterValue, float64(stats.RefusedMaxConns), listener, "max_connections")
+	ch <- prometheus.MustNewConstMetric(pc.refused, prometheus.CounterValue, float64(stats.RefusedMaxSourceConns), listener, "max_connections_per_source")
+	ch <- prometheus.MustNewConstMetric(pc.mirrors, prometheus.CounterValue, float64(stats.Mirrors), listener)
+	ch <- prometheus.MustNewConstMetric(pc.mirrorFailures, prometheus.CounterValue, float64(stats.MirrorFailures), listener)
+}
+
+func (pc *proxyCollector) Collect(ch chan<- prometheus.Metric) {
+	pc.collectConnStats(ch, "master", pc.c.connStats.Snapshot())
+	if pc.readOnly {
+		pc.collectConnStats(ch, "read_only", pc.c.readOnlyConnStats.Snapshot())
+	}
+	if pc.c.unixSocketPath != "" {
+		pc.collectConnStats(ch, "unix_socket", pc.c.unixSocketConnStats.Snapshot())
+	}
+
+	state := pc.c.metricsState()
+	if !state.lastClusterDataRead.IsZero() {
+		ch <- prometheus.MustNewConstMetric(pc.lastRead, prometheus.GaugeValue, pc.nowFn().Sub(state.lastClusterDataRead).Seconds())
+	}
+	if !state.lastCheckOk.IsZero() {
+		ch <- prometheus.MustNewConstMetric(pc.lastCheckOk, prometheus.GaugeValue, pc.nowFn().Sub(state.lastCheckOk).Seconds())
+	}
+	for _, reason := range connDropReasons {
+		ch <- prometheus.MustNewConstMetric(pc.drops, prometheus.CounterValue, float64(state.connDrops[reason]), string(reason))
+	}
+	v := 0.0
+	if state.masterAvailable {
+		v = 1
+	}
+	ch <- prometheus.MustNewConstMetric(pc.masterAvailable, prometheus.GaugeValue, v)
 }
 
 func (c *ClusterChecker) SetProxyInfo(e store.Store, generation int64, ttl time.Duration) error {
@@ -167,8 +992,13 @@ func (c *ClusterChecker) SetProxyInfo(e store.Store, generation int64, ttl time.
 		InfoUID:    common.UID(),
 		UID:        c.uid,
 		Generation: generation,
+		Time:       time.Now(),
 	}
-	log.Debugf("proxyInfo dump: %s", spew.Sdump(proxyInfo))
+	c.log.Debugf("proxyInfo dump: %s", spew.Sdump(proxyInfo))
+
+	c.pollonMutex.Lock()
+	c.proxyGeneration = generation
+	c.pollonMutex.Unlock()
 
 	if err := c.e.SetProxyInfo(context.TODO(), proxyInfo, ttl); err != nil {
 		return err
@@ -176,62 +1006,80 @@ func (c *ClusterChecker) SetProxyInfo(e store.Store, generation int64, ttl time.
 	return nil
 }
 
+// storeError is an error accessing the store
+type storeError struct {
+	err error
+}
+
+func (e *storeError) Error() string {
+	return e.err.Error()
+}
+
 // Check reads the cluster data and applies the right pollon configuration.
 func (c *ClusterChecker) Check() error {
 	cd, _, err := c.e.GetClusterData(context.TODO())
 	if err != nil {
-		return fmt.Errorf("cannot get cluster data: %v", err)
+		return &storeError{fmt.Errorf("cannot get cluster data: %v", err)}
 	}
+	c.pollonMutex.Lock()
+	c.lastClusterDataRead = time.Now()
+	c.pollonMutex.Unlock()
 
 	// Start pollon if not active
 	if err = c.startPollonProxy(); err != nil {
 		return fmt.Errorf("failed to start proxy: %v", err)
 	}
 
-	log.Debugf("cd dump: %s", spew.Sdump(cd))
+	c.log.Debugf("cd dump: %s", spew.Sdump(cd))
 	if cd == nil {
-		log.Infow("no clusterdata available, closing connections to master")
-		c.sendPollonConfData(pollon.ConfData{DestAddr: nil})
+		c.log.Infow("no clusterdata available, closing connections to master")
+		c.closeAllConns(connDropNoClusterData)
 		return nil
 	}
 	if cd.FormatVersion != cluster.CurrentCDFormatVersion {
-		c.sendPollonConfData(pollon.ConfData{DestAddr: nil})
+		c.closeAllConns(connDropInvalidClusterData)
 		return fmt.Errorf("unsupported clusterdata format version: %d", cd.FormatVersion)
 	}
 	if err = cd.Cluster.Spec.Validate(); err != nil {
-		c.sendPollonConfData(pollon.ConfData{DestAddr: nil})
+		c.closeAllConns(connDropInvalidClusterData)
 		return fmt.Errorf("clusterdata validation failed: %v", err)
 	}
+	// the cluster uid is a global log field so it's set only when serving
+	// a single cluster
+	if cd.Cluster != nil && c.clusterName == "" {
+		slog.SetClusterUID(cd.Cluster.UID)
+	}
 
 	proxy := cd.Proxy
 	if proxy == nil {
-		log.Infow("no proxy object available, closing connections to master")
-		c.sendPollonConfData(pollon.ConfData{DestAddr: nil})
+		c.log.Infow("no proxy object available, closing connections to master")
+		c.closeAllConns(connDropNoMaster)
 		// ignore errors on setting proxy info
 		if err = c.SetProxyInfo(c.e, cluster.NoGeneration, 2*cluster.DefaultProxyTimeoutInterval); err != nil {
-			log.Errorw("failed to update proxyInfo", zap.Error(err))
+			c.log.Errorw("failed to update proxyInfo", zap.Error(err))
 		}
 		return nil
 	}
 
 	db, ok := cd.DBs[proxy.Spec.MasterDBUID]
 	if !ok {
-		log.Infow("no db object available, closing connections to master", "db", proxy.Spec.MasterDBUID)
-		c.sendPollonConfData(pollon.ConfData{DestAddr: nil})
+		c.log.Infow("no db object available, closing connections to master", "db", proxy.Spec.MasterDBUID)
+		c.closeAllConns(connDropNoMaster)
+		c.traceRouting(cd, proxy.Generation, proxy.Spec.MasterDBUID, "", routingNoMaster)
 		// ignore errors on setting proxy info
 		if err = c.SetProxyInfo(c.e, proxy.Generation, 2*cluster.DefaultProxyTimeoutInterval); err != nil {
-			log.Errorw("failed to update proxyInfo", zap.Error(err))
+			c.log.Errorw("failed to update proxyInfo", zap.Error(err))
 		}
 		return nil
 	}
 
-	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(db.Status.ListenAddress, db.Status.Port))
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(c.dbAddress(db), db.Status.Port))
 	if err != nil {
-		log.Errorw("cannot resolve db address", zap.Error(err))
-		c.sendPollonConfData(pollon.ConfData{DestAddr: nil})
+		c.log.Errorw("cannot resolve db address", zap.Error(err))
+		c.closeAllConns(connDropNoMaster)
 		return nil
 	}
-	log.Infow("master address", "address", addr)
+	c.log.Infow("master address", "address", addr)
 	if err = c.SetProxyInfo(c.e, proxy.Generation, 2*cluster.DefaultProxyTimeoutInterval); err != nil {
 		// if we failed to update our proxy info when a master is defined we
 		// cannot ignore this error since the sentinel won't know that we exist
@@ -243,11 +1091,22 @@ func (c *ClusterChecker) Check() error {
 	// start proxing only if we are inside enabledProxies, this ensures that the
 	// sentinel has read our proxyinfo and knows we are alive
 	if util.StringInSlice(proxy.Spec.EnabledProxies, c.uid) {
-		log.Infow("proxying to master address", "address", addr)
-		c.sendPollonConfData(pollon.ConfData{DestAddr: addr})
+		fields := []interface{}{"address", addr}
+		if db.UID != c.masterDBUID {
+			fields = append(fields, slog.Event(slog.EventProxyMasterSwitch, "db", db.UID, "address", addr.String(), "previousMasterDB", c.masterDBUID))
+			c.pollonMutex.Lock()
+			c.masterDBUID = db.UID
+			c.pollonMutex.Unlock()
+		}
+		c.log.Infow("proxying to master address", fields...)
+		c.sendPollonConfData(tcpproxy.ConfData{DestAddr: addr})
+		c.checkMirror(cd, db)
+		c.checkReadOnly(cd, db)
+		c.traceRouting(cd, proxy.Generation, db.UID, addr.String(), routingProxy)
 	} else {
-		log.Infow("not proxying to master address since we aren't in the enabled proxies list", "address", addr)
-		c.sendPollonConfData(pollon.ConfData{DestAddr: nil})
+		c.log.Infow("not proxying to master address since we aren't in the enabled proxies list", "address", addr)
+		c.closeAllConns(connDropNotEnabled)
+		c.traceRouting(cd, proxy.Generation, db.UID, addr.String(), routingNotEnabled)
 	}
 
 	return nil
@@ -259,17 +1118,17 @@ func (c *ClusterChecker) TimeoutChecker(checkOkCh chan struct{}) error {
 	for true {
 		select {
 		case <-timeoutTimer.C:
-			log.Infow("check timeout timer fired")
+			c.log.Infow("check timeout timer fired")
 			// if the check timeouts close all connections and stop listening
 			// (for example to avoid load balancers forward connections to us
 			// since we aren't ready or in a bad state)
-			c.sendPollonConfData(pollon.ConfData{DestAddr: nil})
+			c.closeAllConns(connDropCheckTimeout)
 			if c.stopListening {
 				c.stopPollonProxy()
 			}
 
 		case <-checkOkCh:
-			log.Debugw("check ok message received")
+			c.log.Debugw("check ok message received")
 
 			// ignore if stop succeeded or not due to timer already expired
 			timeoutTimer.Stop()
@@ -282,7 +1141,18 @@ func (c *ClusterChecker) TimeoutChecker(checkOkCh chan struct{}) error {
 func (c *ClusterChecker) Start() error {
 	checkOkCh := make(chan struct{})
 	checkCh := make(chan error)
-	timerCh := time.NewTimer(0).C
+	timer := time.NewTimer(0)
+	// the cluster data watch triggers a new check without waiting for the
+	// check interval
+	watchCh := c.e.Watch(context.TODO())
+	checking := false
+	checkPending := false
+	check := func() {
+		checking = true
+		go func() {
+			checkCh <- c.Check()
+		}()
+	}
 
 	// TODO(sgotti) TimeoutCecker is needed to forcefully close connection also
 	// if the Check method is blocked somewhere.
@@ -292,19 +1162,42 @@ func (c *ClusterChecker) Start() error {
 
 	for {
 		select {
-		case <-timerCh:
-			go func() {
-				checkCh <- c.Check()
-			}()
+		case <-timer.C:
+			check()
+		case _, ok := <-watchCh:
+			if !ok {
+				watchCh = nil
+				continue
+			}
+			c.log.Debugw("cluster data changed")
+			if checking {
+				checkPending = true
+				continue
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+			check()
 		case err := <-checkCh:
+			checking = false
 			if err != nil {
 				// don't report check ok since it returned an error
-				log.Infow("check function error", zap.Error(err))
+				if _, ok := err.(*storeError); ok {
+					c.log.Infow("check function error", zap.Error(err), slog.Event(slog.EventStoreConnectionLost))
+				} else {
+					c.log.Infow("check function error", zap.Error(err))
+				}
 			} else {
 				// report that check was ok
+				c.setLastCheckOk(time.Now())
 				checkOkCh <- struct{}{}
 			}
-			timerCh = time.NewTimer(cluster.DefaultProxyCheckInterval).C
+			if checkPending {
+				checkPending = false
+				check()
+				continue
+			}
+			timer.Reset(cluster.DefaultProxyCheckInterval)
 		case err := <-c.endPollonProxyCh:
 			if err != nil {
 				return fmt.Errorf("proxy error: %v", err)
@@ -335,21 +1228,65 @@ func proxy(c *cobra.Command, args []string) {
 	if cfg.debug {
 		slog.SetDebug()
 	}
-	if cmd.IsColorLoggerEnable(c, &cfg.CommonConfig) {
-		log = slog.SColor()
+	if err := cmd.EnableSyslog(&cfg.CommonConfig, "stolon-proxy"); err != nil {
+		log.Fatalf("%v", err)
 	}
-	if slog.IsDebug() {
+	switch cfg.LogFormat {
+	case "text":
+		log = slog.S()
 		if cmd.IsColorLoggerEnable(c, &cfg.CommonConfig) {
-			stdlog := slog.StdLogColor()
-			pollon.SetLogger(stdlog)
-		} else {
-			stdlog := slog.StdLog()
-			pollon.SetLogger(stdlog)
+			log = slog.SColor()
+		}
+		tcpproxy.SetLogger(log)
+	case "json":
+		log = slog.SJSON().With("component", "proxy")
+		if cfg.ClusterName != "" {
+			log = log.With("cluster", cfg.ClusterName)
 		}
+		tcpproxy.SetLogger(log)
+	default:
+		log.Fatalf("invalid log format: %v", cfg.LogFormat)
 	}
 
-	if err := cmd.CheckCommonConfig(&cfg.CommonConfig); err != nil {
-		log.Fatalf(err.Error())
+	clusterEntries := cfg.clusters
+	if cfg.clustersFile != "" {
+		entries, err := readProxyClustersFile(cfg.clustersFile)
+		if err != nil {
+			log.Fatalf("cannot read clusters file: %v", err)
+		}
+		clusterEntries = append(clusterEntries, entries...)
+	}
+	clusters, err := parseProxyClusters(clusterEntries)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	multiCluster := len(clusters) > 0
+	if multiCluster {
+		if cfg.ClusterName != "" || c.PersistentFlags().Changed("port") {
+			log.Fatalf("cluster name and port cannot be used with clusters or clusters file")
+		}
+		if cfg.readOnlyPort != "" {
+			log.Fatalf("read only port cannot be used when serving multiple clusters")
+		}
+		if cfg.unixSocketPath != "" {
+			log.Fatalf("unix socket path cannot be used when serving multiple clusters")
+		}
+		if cfg.mirrorAddress != "" || cfg.mirrorKeeper != "" {
+			log.Fatalf("mirroring cannot be used when serving multiple clusters")
+		}
+	} else {
+		clusters = []proxyCluster{{name: cfg.ClusterName, port: cfg.port}}
+	}
+
+	for _, pc := range clusters {
+		clusterCfg := cfg.CommonConfig
+		clusterCfg.ClusterName = pc.name
+		if err := cmd.CheckCommonConfig(&clusterCfg); err != nil {
+			log.Fatalf(err.Error())
+		}
+	}
+	if err := cmd.SetupVaultStoreCert(&cfg.CommonConfig, log); err != nil {
+		log.Fatalf("cannot setup the vault store certificate: %v", err)
 	}
 
 	if cfg.keepAliveIdle < 0 {
@@ -361,8 +1298,125 @@ func proxy(c *cobra.Command, args []string) {
 	if cfg.keepAliveInterval < 0 {
 		log.Fatalf("tcp keepalive idle value must be greater or equal to 0")
 	}
+	if cfg.userTimeout < 0 {
+		log.Fatalf("tcp user timeout must be greater or equal to 0")
+	}
+	if cfg.backendKeepAliveIdle < 0 {
+		log.Fatalf("backend tcp keepalive idle value must be greater or equal to 0")
+	}
+	if cfg.backendKeepAliveCount < 0 {
+		log.Fatalf("backend tcp keepalive count value must be greater or equal to 0")
+	}
+	if cfg.backendKeepAliveInterval < 0 {
+		log.Fatalf("backend tcp keepalive interval value must be greater or equal to 0")
+	}
+	if cfg.backendUserTimeout < 0 {
+		log.Fatalf("backend tcp user timeout must be greater or equal to 0")
+	}
+	if cfg.idleTimeout < 0 {
+		log.Fatalf("idle timeout must be greater or equal to 0")
+	}
+	if cfg.warmupInterval < 0 {
+		log.Fatalf("warmup interval must be greater or equal to 0")
+	}
+	if cfg.warmupMaxConnections < 1 {
+		log.Fatalf("warmup max connections must be at least 1")
+	}
+	if cfg.maxClientConnections < 0 {
+		log.Fatalf("max client connections must be greater or equal to 0")
+	}
+	if cfg.maxClientConnectionsPerSource < 0 {
+		log.Fatalf("max client connections per source must be greater or equal to 0")
+	}
+	if cfg.drainTimeout < 0 {
+		log.Fatalf("drain timeout must be greater or equal to 0")
+	}
+	// the sentinel waits for the proxies to close the connections to the
+	// old master only up to the proxy timeout
+	if time.Duration(cfg.drainTimeout)*time.Second >= cluster.DefaultProxyTimeoutInterval {
+		log.Fatalf("drain timeout must be lower than %s", cluster.DefaultProxyTimeoutInterval)
+	}
+	if cfg.readOnlyPort != "" && cfg.readOnlyPort == cfg.port && (cfg.readOnlyListenAddress == "" || cfg.readOnlyListenAddress == cfg.listenAddress) {
+		log.Fatalf("read only port must be different from the port when listening on the same address")
+	}
+	switch cluster.AddressFamily(cfg.addressFamily) {
+	case cluster.AddressFamilyAny:
+	case cluster.AddressFamilyIPv4:
+	case cluster.AddressFamilyIPv6:
+	default:
+		log.Fatalf("address family must be one of: any, ipv4, ipv6")
+	}
+	if cfg.unixSocketPath != "" {
+		if _, err := parseUnixSocketMode(cfg.unixSocketMode); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	if cfg.mirrorAddress != "" && cfg.mirrorKeeper != "" {
+		log.Fatalf("only one of mirror address and mirror keeper can be provided")
+	}
+	if cfg.mirrorSampleRate < 0 || cfg.mirrorSampleRate > 1 {
+		log.Fatalf("mirror sample rate must be between 0 and 1")
+	}
+	if cfg.mirrorBufferSize < 1 {
+		log.Fatalf("mirror buffer size must be at least 1")
+	}
+	if (cfg.mirrorAddress != "" || cfg.mirrorKeeper != "") && cfg.poolMode == poolModeTransaction {
+		log.Fatalf("mirroring cannot be used with the transaction pool mode")
+	}
+	if cfg.readOnlyListenAddress != "" && cfg.readOnlyPort == "" {
+		log.Fatalf("read only listen address requires a read only port")
+	}
+	if (cfg.tlsCertFile == "") != (cfg.tlsKeyFile == "") {
+		log.Fatalf("tls cert file and tls key file must be provided together")
+	}
+	if cfg.tlsClientCAFile != "" && cfg.tlsCertFile == "" {
+		log.Fatalf("tls client ca file requires a tls cert file")
+	}
+	if (cfg.backendTLSCertFile == "") != (cfg.backendTLSKeyFile == "") {
+		log.Fatalf("backend tls cert file and backend tls key file must be provided together")
+	}
+	if !cfg.backendTLS && (cfg.backendTLSCAFile != "" || cfg.backendTLSCertFile != "") {
+		log.Fatalf("backend tls options require --backend-tls")
+	}
+	if cfg.backendTLS && cfg.backendTLSCAFile == "" {
+		log.Warnw("backend tls ca file not provided, the db certificates won't be verified")
+	}
+	if cfg.sendProxyProtocolVersion != 1 && cfg.sendProxyProtocolVersion != 2 {
+		log.Fatalf("send proxy protocol version must be 1 or 2")
+	}
+	switch cfg.poolMode {
+	case poolModeSession:
+	case poolModeTransaction:
+		if cfg.poolAuthFile == "" {
+			log.Fatalf("transaction pool mode requires a pool auth file")
+		}
+		if cfg.sendProxyProtocol {
+			log.Fatalf("transaction pool mode cannot be used with --send-proxy-protocol")
+		}
+		if cfg.drainTimeout > 0 {
+			log.Fatalf("transaction pool mode cannot be used with --drain-timeout")
+		}
+	default:
+		log.Fatalf("invalid pool mode: %q", cfg.poolMode)
+	}
+	if cfg.poolSize < 1 {
+		log.Fatalf("pool size must be at least 1")
+	}
+	if cfg.poolWaitTimeout < 1 {
+		log.Fatalf("pool wait timeout must be at least 1")
+	}
+	if _, err := parsePoolSizes(cfg.poolSizes); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if cfg.sendProxyProtocol {
+		log.Warnw("sending PROXY protocol headers to the master db, connections will fail if the PROXY protocol isn't accepted")
+	}
 
 	uid := common.UID()
+	if cfg.LogFormat == "json" {
+		log = log.With("proxyUID", uid)
+		tcpproxy.SetLogger(log)
+	}
 	log.Infow("proxy uid", "uid", uid)
 
 	if cfg.MetricsListenAddress != "" {
@@ -375,11 +1429,44 @@ func proxy(c *cobra.Command, args []string) {
 		}()
 	}
 
-	clusterChecker, err := NewClusterChecker(uid, cfg)
+	// all the clusters stores share the same store connection
+	clusterNames := []string{}
+	for _, pc := range clusters {
+		clusterNames = append(clusterNames, pc.name)
+	}
+	stores, err := cmd.NewStores(&cfg.CommonConfig, clusterNames)
 	if err != nil {
-		log.Fatalf("cannot create cluster checker: %v", err)
+		log.Fatalf("cannot create store: %v", err)
+	}
+
+	clusterCheckers := []*ClusterChecker{}
+	for i, pc := range clusters {
+		clusterCfg := cfg
+		clusterCfg.ClusterName = pc.name
+		clusterCfg.port = pc.port
+		clusterName := ""
+		if multiCluster {
+			clusterName = pc.name
+		}
+		clusterChecker, err := NewClusterChecker(uid, clusterCfg, stores[i], clusterName)
+		if err != nil {
+			log.Fatalf("cannot create cluster checker: %v", err)
+		}
+		prometheus.MustRegister(newProxyCollector(clusterChecker, cfg.readOnlyPort != ""))
+		if cfg.readOnlyPort != "" {
+			prometheus.MustRegister(newReadOnlyChosenConnsCollector(clusterChecker))
+		}
+		clusterCheckers = append(clusterCheckers, clusterChecker)
+	}
+	http.Handle("/status", &statusHandler{checkers: clusterCheckers})
+
+	errCh := make(chan error, len(clusterCheckers))
+	for _, clusterChecker := range clusterCheckers {
+		go func(clusterChecker *ClusterChecker) {
+			errCh <- clusterChecker.Start()
+		}(clusterChecker)
 	}
-	if err = clusterChecker.Start(); err != nil {
+	if err = <-errCh; err != nil {
 		log.Fatalf("cluster checker ended with error: %v", err)
 	}
 }
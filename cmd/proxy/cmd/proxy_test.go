@@ -0,0 +1,416 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+)
+
+func TestReadOnlyDBs(t *testing.T) {
+	newStandby := func(uid, followed string, ready bool, lag uint64) *cluster.DB {
+		return &cluster.DB{
+			UID: uid,
+			Spec: &cluster.DBSpec{
+				Role:         common.RoleStandby,
+				FollowConfig: &cluster.FollowConfig{Type: cluster.FollowTypeInternal, DBUID: followed},
+			},
+			Status: cluster.DBStatus{Healthy: ready, Ready: ready, ReplicationLag: lag},
+		}
+	}
+	newDelayedStandby := func(uid, followed string) *cluster.DB {
+		db := newStandby(uid, followed, true, 0)
+		db.Spec.RecoveryMinApplyDelay = &cluster.Duration{Duration: time.Hour}
+		return db
+	}
+	master := &cluster.DB{
+		UID:    "db1",
+		Spec:   &cluster.DBSpec{Role: common.RoleMaster},
+		Status: cluster.DBStatus{Healthy: true, Ready: true},
+	}
+
+	tests := []struct {
+		dbs    []*cluster.DB
+		maxLag uint32
+		out    []string
+	}{
+		// only the master
+		{
+			out: []string{"db1"},
+		},
+		{
+			dbs: []*cluster.DB{newStandby("db3", "db1", true, 0), newStandby("db2", "db1", true, 10000)},
+			out: []string{"db2", "db3"},
+		},
+		// lagging standby excluded
+		{
+			dbs:    []*cluster.DB{newStandby("db3", "db1", true, 0), newStandby("db2", "db1", true, 10000)},
+			maxLag: 1000,
+			out:    []string{"db3"},
+		},
+		{
+			dbs:    []*cluster.DB{newStandby("db3", "db1", true, 1000), newStandby("db2", "db1", true, 1000)},
+			maxLag: 1000,
+			out:    []string{"db2", "db3"},
+		},
+		// not ready standby and standby not following the master excluded
+		{
+			dbs: []*cluster.DB{newStandby("db2", "db1", false, 0), newStandby("db3", "db4", true, 0), newStandby("db4", "db1", true, 0)},
+			out: []string{"db4"},
+		},
+		// delayed standby excluded
+		{
+			dbs: []*cluster.DB{newStandby("db2", "db1", true, 0), newDelayedStandby("db3", "db1")},
+			out: []string{"db2"},
+		},
+		// all the standbys over the max lag: fall back to the master
+		{
+			dbs:    []*cluster.DB{newStandby("db2", "db1", true, 2000), newStandby("db3", "db1", true, 3000)},
+			maxLag: 1000,
+			out:    []string{"db1"},
+		},
+	}
+
+	for i, tt := range tests {
+		cd := &cluster.ClusterData{DBs: cluster.DBs{master.UID: master}}
+		for _, db := range tt.dbs {
+			cd.DBs[db.UID] = db
+		}
+		out := []string{}
+		for _, db := range readOnlyDBs(cd, master, tt.maxLag) {
+			out = append(out, db.UID)
+		}
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: wrong read only dbs: got: %v, want: %v", i, out, tt.out)
+		}
+	}
+}
+
+func TestMirrorDB(t *testing.T) {
+	newDB := func(uid, keeperUID string, role common.Role, healthy bool) *cluster.DB {
+		return &cluster.DB{
+			UID:    uid,
+			Spec:   &cluster.DBSpec{KeeperUID: keeperUID, Role: role},
+			Status: cluster.DBStatus{Healthy: healthy},
+		}
+	}
+	master := newDB("db1", "keeper1", common.RoleMaster, true)
+
+	tests := []struct {
+		name   string
+		dbs    []*cluster.DB
+		keeper string
+		out    string
+	}{
+		{
+			name:   "healthy standby",
+			dbs:    []*cluster.DB{newDB("db2", "keeper2", common.RoleStandby, true)},
+			keeper: "keeper2",
+			out:    "db2",
+		},
+		{
+			name:   "not healthy standby",
+			dbs:    []*cluster.DB{newDB("db2", "keeper2", common.RoleStandby, false)},
+			keeper: "keeper2",
+		},
+		{
+			name:   "master keeper",
+			dbs:    []*cluster.DB{newDB("db2", "keeper2", common.RoleStandby, true)},
+			keeper: "keeper1",
+		},
+		{
+			name:   "not existing keeper",
+			dbs:    []*cluster.DB{newDB("db2", "keeper2", common.RoleStandby, true)},
+			keeper: "keeper3",
+		},
+	}
+
+	for i, tt := range tests {
+		cd := &cluster.ClusterData{DBs: cluster.DBs{master.UID: master}}
+		for _, db := range tt.dbs {
+			cd.DBs[db.UID] = db
+		}
+		out := ""
+		if db := mirrorDB(cd, master, tt.keeper); db != nil {
+			out = db.UID
+		}
+		if out != tt.out {
+			t.Errorf("#%d (%s): wrong mirror db: got: %q, want: %q", i, tt.name, out, tt.out)
+		}
+	}
+}
+
+func TestParsePoolSizes(t *testing.T) {
+	tests := []struct {
+		in    []string
+		sizes map[string]int
+		err   string
+	}{
+		{
+			in:    []string{},
+			sizes: map[string]int{},
+		},
+		{
+			in:    []string{"app/appuser=50", "reports/reader=5"},
+			sizes: map[string]int{"app/appuser": 50, "reports/reader": 5},
+		},
+		{
+			in:  []string{"app=50"},
+			err: `wrong pool size "app=50", must be database/user=size`,
+		},
+		{
+			in:  []string{"app/appuser"},
+			err: `wrong pool size "app/appuser", must be database/user=size`,
+		},
+		{
+			in:  []string{"app/appuser=0"},
+			err: `wrong pool size "app/appuser=0", size must be at least 1`,
+		},
+	}
+
+	for i, tt := range tests {
+		sizes, err := parsePoolSizes(tt.in)
+		if tt.err != "" {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		} else if !reflect.DeepEqual(sizes, tt.sizes) {
+			t.Errorf("#%d: got: %v, want: %v", i, sizes, tt.sizes)
+		}
+	}
+}
+
+func TestVerifyCertChain(t *testing.T) {
+	// newCert returns a certificate signed by the parent (self signed when
+	// parent is nil) and its key
+	newCert := func(cn string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(time.Now().UnixNano()),
+			Subject:               pkix.Name{CommonName: cn},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  isCA,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		if parent == nil {
+			parent, parentKey = template, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return cert, key
+	}
+
+	ca, caKey := newCert("ca", true, nil, nil)
+	intermediate, intermediateKey := newCert("intermediate", true, ca, caKey)
+	db, _ := newCert("db", false, ca, caKey)
+	intermediateDB, _ := newCert("db", false, intermediate, intermediateKey)
+	other, _ := newCert("other", false, nil, nil)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	tests := []struct {
+		certs []*x509.Certificate
+		ok    bool
+	}{
+		{certs: []*x509.Certificate{db}, ok: true},
+		{certs: []*x509.Certificate{intermediateDB, intermediate}, ok: true},
+		{certs: []*x509.Certificate{intermediateDB}, ok: false},
+		{certs: []*x509.Certificate{other}, ok: false},
+		{certs: []*x509.Certificate{}, ok: false},
+	}
+
+	for i, tt := range tests {
+		rawCerts := [][]byte{}
+		for _, cert := range tt.certs {
+			rawCerts = append(rawCerts, cert.Raw)
+		}
+		err := verifyCertChain(rawCerts, roots)
+		if tt.ok && err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("#%d: got no error", i)
+		}
+	}
+}
+
+func TestCloseAllConnsDrops(t *testing.T) {
+	c := &ClusterChecker{}
+
+	// not proxying to a master, nothing is dropped
+	c.closeAllConns(connDropNoClusterData)
+	if drops := c.metricsState().connDrops; len(drops) != 0 {
+		t.Errorf("got drops: %v, want no drops", drops)
+	}
+
+	c.masterAvailable = true
+	c.closeAllConns(connDropCheckTimeout)
+	c.closeAllConns(connDropNoMaster)
+	expected := map[connDropReason]uint64{connDropCheckTimeout: 1}
+	if drops := c.metricsState().connDrops; !reflect.DeepEqual(drops, expected) {
+		t.Errorf("got drops: %v, want: %v", drops, expected)
+	}
+	if c.metricsState().masterAvailable {
+		t.Errorf("master still available after closing all the connections")
+	}
+}
+
+func TestMetricsLabels(t *testing.T) {
+	c := &ClusterChecker{}
+	if labels := c.metricsLabels(); labels != nil {
+		t.Errorf("got labels: %v, want no labels when serving a single cluster", labels)
+	}
+
+	c = &ClusterChecker{clusterName: "cluster1"}
+	if labels, expected := c.metricsLabels(), (prometheus.Labels{"cluster": "cluster1"}); !reflect.DeepEqual(labels, expected) {
+		t.Errorf("got labels: %v, want: %v", labels, expected)
+	}
+}
+
+func TestParseUnixSocketMode(t *testing.T) {
+	tests := []struct {
+		in   string
+		mode os.FileMode
+		err  bool
+	}{
+		{in: "0660", mode: 0660},
+		{in: "777", mode: 0777},
+		{in: "0600", mode: 0600},
+		{in: "1777", err: true},
+		{in: "0680", err: true},
+		{in: "rw", err: true},
+		{in: "", err: true},
+	}
+
+	for i, tt := range tests {
+		mode, err := parseUnixSocketMode(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error", i)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		} else if mode != tt.mode {
+			t.Errorf("#%d: got mode: %o, want: %o", i, mode, tt.mode)
+		}
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stolon-proxy")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a stale socket file, left by a proxy not removing it, is replaced
+	socketPath := filepath.Join(dir, "proxy.sock")
+	stale, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenUnixSocket(socketPath, 0600)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer listener.Close()
+	fi, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0600 {
+		t.Errorf("got mode: %o, want: %o", mode, 0600)
+	}
+
+	// a file that isn't a socket isn't removed
+	filePath := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(filePath, []byte{}, 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := listenUnixSocket(filePath, 0600); err == nil {
+		t.Errorf("got no error listening on a regular file")
+	}
+	if _, err := os.Stat(filePath); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestDBAddress(t *testing.T) {
+	db := &cluster.DB{
+		UID: "db1",
+		Status: cluster.DBStatus{
+			ListenAddress:   "192.168.0.1",
+			ListenAddresses: []string{"192.168.0.1", "fd00::1"},
+			Port:            "5432",
+		},
+	}
+	tests := []struct {
+		family cluster.AddressFamily
+		out    string
+	}{
+		{family: cluster.AddressFamilyAny, out: "192.168.0.1"},
+		{family: cluster.AddressFamilyIPv4, out: "192.168.0.1"},
+		{family: cluster.AddressFamilyIPv6, out: "fd00::1"},
+	}
+
+	for i, tt := range tests {
+		c := &ClusterChecker{addressFamily: tt.family}
+		if out := c.dbAddress(db); out != tt.out {
+			t.Errorf("#%d: got address: %q, want: %q", i, out, tt.out)
+		}
+	}
+
+	// a db advertising a single address
+	db.Status.ListenAddresses = nil
+	c := &ClusterChecker{addressFamily: cluster.AddressFamilyIPv6}
+	if out := c.dbAddress(db); out != "192.168.0.1" {
+		t.Errorf("got address: %q, want: %q", out, "192.168.0.1")
+	}
+}
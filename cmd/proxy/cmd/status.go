@@ -0,0 +1,105 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// proxyStatus is the proxy state of a cluster reported by the status endpoint
+type proxyStatus struct {
+	// Cluster is the cluster name when the proxy serves multiple clusters
+	Cluster string `json:"cluster,omitempty"`
+	// ConnectionsEnabled reports if the proxy is currently proxying the
+	// connections to a master db. When false the connections are dropped.
+	ConnectionsEnabled bool `json:"connectionsEnabled"`
+	// MasterDB and MasterAddress are the master db the connections are
+	// currently proxied to
+	MasterDB      string `json:"masterDB,omitempty"`
+	MasterAddress string `json:"masterAddress,omitempty"`
+	// Generation is the generation of the last cluster data proxy spec read
+	Generation int64 `json:"generation"`
+	// DropReason is the reason why the connections are dropped
+	DropReason connDropReason `json:"dropReason,omitempty"`
+	// LastClusterDataRead and LastCheckOk are the times of the last
+	// successful cluster data read and proxy check
+	LastClusterDataRead *time.Time `json:"lastClusterDataRead,omitempty"`
+	LastCheckOk         *time.Time `json:"lastCheckOk,omitempty"`
+}
+
+func timeP(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// status returns the current proxy status of the checker cluster
+func (c *ClusterChecker) status() *proxyStatus {
+	c.pollonMutex.Lock()
+	defer c.pollonMutex.Unlock()
+	s := &proxyStatus{
+		Cluster:             c.clusterName,
+		ConnectionsEnabled:  c.masterAvailable,
+		Generation:          c.proxyGeneration,
+		LastClusterDataRead: timeP(c.lastClusterDataRead),
+		LastCheckOk:         timeP(c.lastCheckOk),
+	}
+	if c.masterAvailable {
+		s.MasterDB = c.masterDBUID
+		s.MasterAddress = c.masterAddress
+	} else {
+		s.DropReason = c.lastDropReason
+	}
+	return s
+}
+
+// statusHandler serves the proxy status as json. It fails with a 503 status
+// when the connections aren't proxied to a master. When the proxy serves
+// multiple clusters the cluster query parameter is required.
+type statusHandler struct {
+	checkers []*ClusterChecker
+}
+
+func (h *statusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var checker *ClusterChecker
+	name := r.URL.Query().Get("cluster")
+	switch {
+	case len(h.checkers) == 1 && (name == "" || name == h.checkers[0].clusterName):
+		checker = h.checkers[0]
+	case name == "":
+		http.Error(w, "the cluster query parameter is required when serving multiple clusters", http.StatusBadRequest)
+		return
+	default:
+		for _, c := range h.checkers {
+			if c.clusterName == name {
+				checker = c
+			}
+		}
+	}
+	if checker == nil {
+		http.Error(w, "unknown cluster "+name, http.StatusNotFound)
+		return
+	}
+
+	s := checker.status()
+	w.Header().Set("Content-Type", "application/json")
+	if !s.ConnectionsEnabled {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,76 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestProxyStatus(t *testing.T) {
+	c := &ClusterChecker{masterDBUID: "db1", masterAddress: "10.0.0.1:5432", proxyGeneration: 3, masterAvailable: true}
+	expected := &proxyStatus{ConnectionsEnabled: true, MasterDB: "db1", MasterAddress: "10.0.0.1:5432", Generation: 3}
+	if s := c.status(); !reflect.DeepEqual(s, expected) {
+		t.Errorf("got status: %+v, want: %+v", s, expected)
+	}
+
+	c.closeAllConns(connDropNotEnabled)
+	expected = &proxyStatus{Generation: 3, DropReason: connDropNotEnabled}
+	if s := c.status(); !reflect.DeepEqual(s, expected) {
+		t.Errorf("got status: %+v, want: %+v", s, expected)
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	enabled := &ClusterChecker{clusterName: "cluster1", masterDBUID: "db1", masterAddress: "10.0.0.1:5432", masterAvailable: true}
+	dropped := &ClusterChecker{clusterName: "cluster2", lastDropReason: connDropNoMaster}
+
+	tests := []struct {
+		checkers   []*ClusterChecker
+		url        string
+		code       int
+		masterDB   string
+		dropReason connDropReason
+	}{
+		{checkers: []*ClusterChecker{{masterDBUID: "db1", masterAvailable: true}}, url: "/status", code: http.StatusOK, masterDB: "db1"},
+		{checkers: []*ClusterChecker{{lastDropReason: connDropCheckTimeout}}, url: "/status", code: http.StatusServiceUnavailable, dropReason: connDropCheckTimeout},
+		{checkers: []*ClusterChecker{enabled, dropped}, url: "/status?cluster=cluster1", code: http.StatusOK, masterDB: "db1"},
+		{checkers: []*ClusterChecker{enabled, dropped}, url: "/status?cluster=cluster2", code: http.StatusServiceUnavailable, dropReason: connDropNoMaster},
+		{checkers: []*ClusterChecker{enabled, dropped}, url: "/status", code: http.StatusBadRequest},
+		{checkers: []*ClusterChecker{enabled, dropped}, url: "/status?cluster=cluster3", code: http.StatusNotFound},
+	}
+
+	for i, tt := range tests {
+		w := httptest.NewRecorder()
+		h := &statusHandler{checkers: tt.checkers}
+		h.ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+		if w.Code != tt.code {
+			t.Errorf("#%d: got status code %d, want: %d", i, w.Code, tt.code)
+		}
+		if tt.code != http.StatusOK && tt.code != http.StatusServiceUnavailable {
+			continue
+		}
+		s := &proxyStatus{}
+		if err := json.NewDecoder(w.Body).Decode(s); err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if s.MasterDB != tt.masterDB || s.DropReason != tt.dropReason {
+			t.Errorf("#%d: got master db %q and drop reason %q, want: %q, %q", i, s.MasterDB, s.DropReason, tt.masterDB, tt.dropReason)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/tracing"
+)
+
+// routingAction is what the proxy does for a proxy generation
+type routingAction string
+
+const (
+	routingProxy      routingAction = "proxy"
+	routingNoMaster   routingAction = "noMaster"
+	routingNotEnabled routingAction = "notEnabled"
+)
+
+// traceRouting logs a span, in the trace of the proxy generation, the first
+// time the proxy applies a proxy generation.
+func (c *ClusterChecker) traceRouting(cd *cluster.ClusterData, generation int64, masterDB, address string, action routingAction) {
+	if c.tracer == nil || generation == c.tracedGeneration {
+		return
+	}
+	c.tracedGeneration = generation
+	span := c.tracer.Start("proxy.routing",
+		tracing.String("stolon.cluster.uid", cd.Cluster.UID),
+		tracing.Int64("stolon.proxy.generation", generation),
+		tracing.String("stolon.proxy.uid", c.uid),
+		tracing.String("stolon.master.db", masterDB),
+		tracing.String("stolon.master.address", address),
+		tracing.String("stolon.proxy.action", string(action)),
+	)
+	span.SetTraceID(tracing.GenerationTraceID(cd.Cluster.UID, generation))
+	span.End()
+}
@@ -0,0 +1,43 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/tracing"
+)
+
+func TestTraceRouting(t *testing.T) {
+	cd := &cluster.ClusterData{Cluster: &cluster.Cluster{UID: "cluster1"}}
+	c := &ClusterChecker{uid: "proxy1", tracer: tracing.NewTracer(), tracedGeneration: cluster.NoGeneration}
+	// only the first check applying a proxy generation is traced
+	c.traceRouting(cd, 1, "db1", "10.0.0.1:5432", routingProxy)
+	if c.tracedGeneration != 1 {
+		t.Errorf("got traced generation: %d, want: %d", c.tracedGeneration, 1)
+	}
+	c.traceRouting(cd, 2, "db2", "", routingNoMaster)
+	if c.tracedGeneration != 2 {
+		t.Errorf("got traced generation: %d, want: %d", c.tracedGeneration, 2)
+	}
+
+	// a checker without tracer doesn't trace
+	c = &ClusterChecker{uid: "proxy1"}
+	c.traceRouting(cd, 1, "db1", "10.0.0.1:5432", routingProxy)
+	if c.tracedGeneration != cluster.NoGeneration {
+		t.Errorf("got traced generation: %d, want: %d", c.tracedGeneration, cluster.NoGeneration)
+	}
+}
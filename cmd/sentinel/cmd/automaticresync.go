@@ -0,0 +1,97 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/postgresql"
+)
+
+// invalidDBError returns the details of why the standby db data is invalid
+func invalidDBError(cd *cluster.ClusterData, db *cluster.DB) string {
+	masterDB := cd.DBs[cd.Cluster.Status.Master]
+	if db.Status.SystemID != "" && db.Status.SystemID != masterDB.Status.SystemID {
+		return fmt.Sprintf("postgres system id %s is different than the master system id %s", db.Status.SystemID, masterDB.Status.SystemID)
+	}
+	return fmt.Sprintf("timeline %d history diverged from the master timeline %d history", db.Status.TimelineID, masterDB.Status.TimelineID)
+}
+
+// missingWalDBError returns the details of the wal required by the standby db
+// and missing on the master
+func missingWalDBError(cd *cluster.ClusterData, db *cluster.DB) string {
+	masterDB := cd.DBs[cd.Cluster.Status.Master]
+	required := postgresql.XlogPosToWalFileNameNoTimeline(db.Status.XLogPos)
+	return fmt.Sprintf("required wal %s is missing on the master, older master wal is %s", required, masterDB.Status.OlderWalFile)
+}
+
+// automaticResync applies the cluster spec automaticResync policy to a
+// standby db requiring an automatic full resync. It returns true when the db
+// must be resynced (removed so a new db will be created on its keeper),
+// otherwise the decision is recorded in the db status.
+func automaticResync(cd *cluster.ClusterData, db *cluster.DB, reason cluster.AutomaticResyncReason, details string, now time.Time) bool {
+	c := cd.Cluster.DefSpec().AutomaticResync
+	status := &cluster.AutomaticResyncStatus{
+		Reason: reason,
+		Error:  details,
+		Time:   now,
+	}
+
+	switch c.DefPolicy() {
+	case cluster.AutomaticResyncPolicyResync:
+		return true
+
+	case cluster.AutomaticResyncPolicyHalt:
+		status.Decision = cluster.AutomaticResyncDecisionHalted
+
+	case cluster.AutomaticResyncPolicyRetryWithBackoff:
+		k, ok := cd.Keepers[db.Spec.KeeperUID]
+		if !ok {
+			return true
+		}
+		// the resyncs are consecutive if the previous one has been done
+		// in the last two max backoffs
+		attempts := 0
+		last := k.Status.LastAutomaticResync
+		if last != nil && now.Sub(last.Time) < 2*c.DefMaxBackoff() {
+			attempts = last.Attempts
+		}
+		if attempts > 0 {
+			next := last.Time.Add(c.Backoff(attempts))
+			if now.Before(next) {
+				status.Decision = cluster.AutomaticResyncDecisionWaitingBackoff
+				status.Attempts = attempts
+				status.NextResyncTime = &next
+				break
+			}
+		}
+		status.Decision = cluster.AutomaticResyncDecisionResync
+		status.Attempts = attempts + 1
+		k.Status.LastAutomaticResync = status
+		log.Infow("resyncing db", "db", db.UID, "keeper", db.Spec.KeeperUID, "reason", reason, "attempts", status.Attempts)
+		return true
+	}
+
+	// keep the time of the first decision
+	if prev := db.Status.AutomaticResync; prev != nil && prev.Reason == status.Reason && prev.Decision == status.Decision {
+		status.Time = prev.Time
+	} else {
+		log.Warnw("db requires a full resync", "db", db.UID, "keeper", db.Spec.KeeperUID, "reason", reason, "error", details, "decision", status.Decision)
+	}
+	db.Status.AutomaticResync = status
+	return false
+}
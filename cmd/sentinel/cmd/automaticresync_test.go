@@ -0,0 +1,136 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+func TestAutomaticResync(t *testing.T) {
+	now := time.Now()
+	backoff := func(initial, max time.Duration) *cluster.AutomaticResyncConfig {
+		return &cluster.AutomaticResyncConfig{
+			Policy:         cluster.AutomaticResyncPolicyRetryWithBackoff,
+			InitialBackoff: &cluster.Duration{Duration: initial},
+			MaxBackoff:     &cluster.Duration{Duration: max},
+		}
+	}
+	lastResync := func(attempts int, t time.Time) *cluster.AutomaticResyncStatus {
+		return &cluster.AutomaticResyncStatus{Reason: cluster.AutomaticResyncReasonMissingWal, Decision: cluster.AutomaticResyncDecisionResync, Time: t, Attempts: attempts}
+	}
+	tests := []struct {
+		name         string
+		c            *cluster.AutomaticResyncConfig
+		lastResync   *cluster.AutomaticResyncStatus
+		prevStatus   *cluster.AutomaticResyncStatus
+		resync       bool
+		decision     cluster.AutomaticResyncDecision
+		attempts     int
+		decisionTime time.Time
+	}{
+		{
+			name:   "default policy",
+			resync: true,
+		},
+		{
+			name:         "halt",
+			c:            &cluster.AutomaticResyncConfig{Policy: cluster.AutomaticResyncPolicyHalt},
+			decision:     cluster.AutomaticResyncDecisionHalted,
+			decisionTime: now,
+		},
+		{
+			name:         "halt keeping the first decision time",
+			c:            &cluster.AutomaticResyncConfig{Policy: cluster.AutomaticResyncPolicyHalt},
+			prevStatus:   &cluster.AutomaticResyncStatus{Reason: cluster.AutomaticResyncReasonMissingWal, Decision: cluster.AutomaticResyncDecisionHalted, Time: now.Add(-time.Hour)},
+			decision:     cluster.AutomaticResyncDecisionHalted,
+			decisionTime: now.Add(-time.Hour),
+		},
+		{
+			name:     "backoff first resync",
+			c:        backoff(time.Minute, time.Hour),
+			resync:   true,
+			decision: cluster.AutomaticResyncDecisionResync,
+			attempts: 1,
+		},
+		{
+			name:         "backoff not expired",
+			c:            backoff(time.Minute, time.Hour),
+			lastResync:   lastResync(2, now.Add(-time.Minute)),
+			decision:     cluster.AutomaticResyncDecisionWaitingBackoff,
+			attempts:     2,
+			decisionTime: now,
+		},
+		{
+			name:       "backoff expired",
+			c:          backoff(time.Minute, time.Hour),
+			lastResync: lastResync(2, now.Add(-3*time.Minute)),
+			resync:     true,
+			decision:   cluster.AutomaticResyncDecisionResync,
+			attempts:   3,
+		},
+		{
+			name:       "last resync not consecutive",
+			c:          backoff(time.Minute, time.Hour),
+			lastResync: lastResync(10, now.Add(-3*time.Hour)),
+			resync:     true,
+			decision:   cluster.AutomaticResyncDecisionResync,
+			attempts:   1,
+		},
+	}
+
+	for i, tt := range tests {
+		cd := testRollingRestartClusterData(1)
+		cd.Cluster.Spec.AutomaticResync = tt.c
+		db := cd.DBs["db2"]
+		k := cd.Keepers[db.Spec.KeeperUID]
+		k.Status.LastAutomaticResync = tt.lastResync
+		db.Status.AutomaticResync = tt.prevStatus
+
+		resync := automaticResync(cd, db, cluster.AutomaticResyncReasonMissingWal, "missing wal", now)
+		if resync != tt.resync {
+			t.Errorf("#%d (%s): got resync: %t, want: %t", i, tt.name, resync, tt.resync)
+			continue
+		}
+		if resync {
+			if tt.decision == "" {
+				if k.Status.LastAutomaticResync != nil {
+					t.Errorf("#%d (%s): unexpected keeper last automatic resync: %+v", i, tt.name, k.Status.LastAutomaticResync)
+				}
+				continue
+			}
+			last := k.Status.LastAutomaticResync
+			if last == nil || last.Decision != tt.decision || last.Attempts != tt.attempts || !last.Time.Equal(now) {
+				t.Errorf("#%d (%s): wrong keeper last automatic resync: %+v", i, tt.name, last)
+			}
+			continue
+		}
+		status := db.Status.AutomaticResync
+		if status == nil {
+			t.Errorf("#%d (%s): got no db automatic resync status", i, tt.name)
+			continue
+		}
+		if status.Decision != tt.decision || status.Attempts != tt.attempts || !status.Time.Equal(tt.decisionTime) || status.Error != "missing wal" {
+			t.Errorf("#%d (%s): wrong db automatic resync status: %+v", i, tt.name, status)
+		}
+		if tt.decision == cluster.AutomaticResyncDecisionWaitingBackoff {
+			if status.NextResyncTime == nil || !status.NextResyncTime.Equal(tt.lastResync.Time.Add(2*time.Minute)) {
+				t.Errorf("#%d (%s): wrong next resync time: %v", i, tt.name, status.NextResyncTime)
+			}
+		}
+	}
+}
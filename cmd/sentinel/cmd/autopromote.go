@@ -0,0 +1,109 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/postgresql"
+
+	"go.uber.org/zap"
+)
+
+// upstreamAddress returns the address (host:port) of the standby cluster
+// upstream primary defined in its primary conninfo
+func upstreamAddress(primaryConninfo string) (string, error) {
+	var connParams postgresql.ConnParams
+	var err error
+	if strings.HasPrefix(primaryConninfo, "postgres://") || strings.HasPrefix(primaryConninfo, "postgresql://") {
+		connParams, err = postgresql.URLToConnParams(primaryConninfo)
+	} else {
+		connParams, err = postgresql.ParseConnString(primaryConninfo)
+	}
+	if err != nil {
+		return "", fmt.Errorf("cannot parse primary conninfo: %v", err)
+	}
+	host := connParams.Get("hostaddr")
+	if host == "" {
+		host = connParams.Get("host")
+	}
+	if host == "" || strings.HasPrefix(host, "/") {
+		return "", fmt.Errorf("primary conninfo doesn't define a tcp host")
+	}
+	if strings.Contains(host, ",") {
+		return "", fmt.Errorf("primary conninfo defines multiple hosts")
+	}
+	port := connParams.Get("port")
+	if port == "" {
+		port = "5432"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// checkStandbyAutoPromote, when standbyAutoPromote is enabled, checks that the
+// upstream primary of a standby cluster is reachable. When it's continuously
+// unreachable for standbyAutoPromoteTimeout the cluster spec role is changed
+// to master promoting the standby cluster (as done by stolonctl promote). The
+// cluster is promoted only when its master db is healthy.
+func (s *Sentinel) checkStandbyAutoPromote(cd *cluster.ClusterData, now time.Time) {
+	spec := cd.Cluster.DefSpec()
+	if *spec.Role != cluster.ClusterRoleStandby || !*spec.StandbyAutoPromote {
+		s.upstreamUnreachableSince = time.Time{}
+		return
+	}
+
+	addr, err := upstreamAddress(spec.StandbyConfig.StandbySettings.PrimaryConninfo)
+	if err != nil {
+		log.Errorw("cannot check the standby cluster upstream primary", zap.Error(err))
+		return
+	}
+	if err := s.ProbeDBFn(addr, spec.DBProbeTimeout.Duration); err == nil {
+		if !s.upstreamUnreachableSince.IsZero() {
+			log.Infow("standby cluster upstream primary is reachable again", "address", addr)
+		}
+		s.upstreamUnreachableSince = time.Time{}
+		return
+	} else if s.upstreamUnreachableSince.IsZero() {
+		log.Warnw("standby cluster upstream primary unreachable", "address", addr, zap.Error(err))
+		s.upstreamUnreachableSince = now
+		return
+	}
+
+	unreachable := now.Sub(s.upstreamUnreachableSince)
+	timeout := spec.StandbyAutoPromoteTimeout.Duration
+	if unreachable < timeout {
+		log.Warnw("standby cluster upstream primary still unreachable", "address", addr, "unreachableTime", unreachable, "autoPromoteTimeout", timeout)
+		return
+	}
+
+	masterDB, ok := cd.DBs[cd.Cluster.Status.Master]
+	if !ok || !masterDB.Status.Healthy {
+		log.Warnw("standby cluster upstream primary unreachable but the standby cluster master db isn't healthy, not promoting the standby cluster", "address", addr, "unreachableTime", unreachable)
+		return
+	}
+
+	ns := cd.Cluster.DeepCopy().Spec
+	ns.Role = cluster.ClusterRoleP(cluster.ClusterRoleMaster)
+	if err := cd.Cluster.UpdateSpec(ns); err != nil {
+		log.Errorw("failed to promote the standby cluster", zap.Error(err))
+		return
+	}
+	log.Warnw("standby cluster upstream primary unreachable for the auto promote timeout, promoting the standby cluster to a primary cluster", "address", addr, "unreachableTime", unreachable, "db", masterDB.UID, "keeper", masterDB.Spec.KeeperUID)
+	s.upstreamUnreachableSince = time.Time{}
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+func TestUpstreamAddress(t *testing.T) {
+	tests := []struct {
+		conninfo string
+		addr     string
+		err      error
+	}{
+		{conninfo: "host=primary.example.com port=6432 user=repluser", addr: "primary.example.com:6432"},
+		{conninfo: "host=primary.example.com hostaddr=10.0.0.1", addr: "10.0.0.1:5432"},
+		{conninfo: "postgres://repluser@primary.example.com:6432/postgres", addr: "primary.example.com:6432"},
+		{conninfo: "host=/tmp", err: fmt.Errorf("primary conninfo doesn't define a tcp host")},
+		{conninfo: "user=repluser", err: fmt.Errorf("primary conninfo doesn't define a tcp host")},
+		{conninfo: "host=primary1,primary2", err: fmt.Errorf("primary conninfo defines multiple hosts")},
+	}
+
+	for i, tt := range tests {
+		addr, err := upstreamAddress(tt.conninfo)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		} else if addr != tt.addr {
+			t.Errorf("#%d: got address: %s, want: %s", i, addr, tt.addr)
+		}
+	}
+}
+
+func TestCheckStandbyAutoPromote(t *testing.T) {
+	newcd := func(autoPromote bool) *cluster.ClusterData {
+		cd := testDryRunClusterData()
+		cd.Cluster.Spec = &cluster.ClusterSpec{
+			InitMode: cluster.ClusterInitModeP(cluster.ClusterInitModeExisting),
+			ExistingConfig: &cluster.ExistingConfig{
+				KeeperUID: "keeper1",
+			},
+			Role: cluster.ClusterRoleP(cluster.ClusterRoleStandby),
+			StandbyConfig: &cluster.StandbyConfig{
+				StandbySettings: &cluster.StandbySettings{PrimaryConninfo: "host=primary port=5432"},
+			},
+			StandbyAutoPromote:        cluster.BoolP(autoPromote),
+			StandbyAutoPromoteTimeout: &cluster.Duration{Duration: time.Minute},
+		}
+		cd.DBs["db1"].Status.Healthy = true
+		return cd
+	}
+
+	start := time.Now()
+	tests := []struct {
+		autoPromote bool
+		// the upstream probes results, done at every minute
+		probes       []bool
+		unhealthy    bool
+		promoted     bool
+		probedAddr   string
+		probesCalled int
+	}{
+		// disabled: the upstream isn't probed
+		{probes: []bool{false, false, false}},
+		// reachable
+		{autoPromote: true, probes: []bool{true, true, true}, probedAddr: "primary:5432", probesCalled: 3},
+		// unreachable for less than the timeout
+		{autoPromote: true, probes: []bool{false, true, false}, probedAddr: "primary:5432", probesCalled: 3},
+		// unreachable for the timeout
+		{autoPromote: true, probes: []bool{true, false, false}, promoted: true, probedAddr: "primary:5432", probesCalled: 3},
+		// unreachable for the timeout but the master db isn't healthy
+		{autoPromote: true, probes: []bool{false, false, false}, unhealthy: true, probedAddr: "primary:5432", probesCalled: 3},
+	}
+
+	for i, tt := range tests {
+		cd := newcd(tt.autoPromote)
+		if tt.unhealthy {
+			cd.DBs["db1"].Status.Healthy = false
+		}
+		var probesCalled int
+		var probedAddr string
+		var probe int
+		s := &Sentinel{
+			ProbeDBFn: func(address string, timeout time.Duration) error {
+				probesCalled++
+				probedAddr = address
+				if tt.probes[probe] {
+					return nil
+				}
+				return fmt.Errorf("connection refused")
+			},
+		}
+		for probe = range tt.probes {
+			s.checkStandbyAutoPromote(cd, start.Add(time.Duration(probe)*time.Minute))
+		}
+		promoted := *cd.Cluster.DefSpec().Role == cluster.ClusterRoleMaster
+		if promoted != tt.promoted {
+			t.Errorf("#%d: got promoted: %t, want: %t", i, promoted, tt.promoted)
+		}
+		if probesCalled != tt.probesCalled || probedAddr != tt.probedAddr {
+			t.Errorf("#%d: got %d probes of %q, want: %d probes of %q", i, probesCalled, probedAddr, tt.probesCalled, tt.probedAddr)
+		}
+	}
+}
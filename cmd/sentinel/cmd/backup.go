@@ -0,0 +1,151 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+)
+
+// updateBackupStatus updates the scheduled backup in progress with the state
+// reported by the keeper running it
+func updateBackupStatus(cd *cluster.ClusterData, keepersInfo cluster.KeepersInfo) {
+	if cd.Cluster == nil || cd.Cluster.Status.Backup == nil {
+		return
+	}
+	b := cd.Cluster.Status.Backup
+	ki, ok := keepersInfo[b.KeeperUID]
+	if !ok || ki.Backup == nil || ki.Backup.UID != b.UID {
+		return
+	}
+	b.Phase = ki.Backup.Phase
+	b.StartTime = ki.Backup.StartTime
+	b.EndTime = ki.Backup.EndTime
+	b.Error = ki.Backup.Error
+}
+
+// backupDB returns the db where the scheduled backup will be taken: the
+// ready standby with the greatest xlog position or, when there isn't a ready
+// standby, the master if healthy. The dbs of drained or in maintenance
+// keepers aren't used.
+func (s *Sentinel) backupDB(cd *cluster.ClusterData) *cluster.DB {
+	dbUIDs := []string{}
+	for uid := range cd.DBs {
+		dbUIDs = append(dbUIDs, uid)
+	}
+	sort.Strings(dbUIDs)
+
+	var bestDB *cluster.DB
+	for _, uid := range dbUIDs {
+		db := cd.DBs[uid]
+		if s.dbType(cd, db.UID) != dbTypeStandby || !db.Status.Ready {
+			continue
+		}
+		k, ok := cd.Keepers[db.Spec.KeeperUID]
+		if !ok || !k.Status.Healthy || isDrainedKeeper(cd, k.UID) || isMaintenanceKeeper(cd, k.UID) {
+			continue
+		}
+		if bestDB == nil || db.Status.XLogPos > bestDB.Status.XLogPos {
+			bestDB = db
+		}
+	}
+	if bestDB != nil {
+		return bestDB
+	}
+	if masterDB, ok := cd.DBs[cd.Cluster.Status.Master]; ok && masterDB.Status.Healthy && !isMaintenanceKeeper(cd, masterDB.Spec.KeeperUID) {
+		return masterDB
+	}
+	return nil
+}
+
+// backupFailure returns why the scheduled backup in progress cannot complete
+// (its db or keeper isn't available or it's taking more than the backup
+// timeout), or an empty string
+func backupFailure(cd *cluster.ClusterData, b *cluster.Backup, now time.Time) string {
+	spec := cd.Cluster.DefSpec()
+	db, ok := cd.DBs[b.DBUID]
+	if !ok || db.Spec.KeeperUID != b.KeeperUID {
+		return fmt.Sprintf("db %q of keeper %q not available", b.DBUID, b.KeeperUID)
+	}
+	if k, ok := cd.Keepers[b.KeeperUID]; !ok || !k.Status.Healthy {
+		return fmt.Sprintf("keeper %q not healthy", b.KeeperUID)
+	}
+	timeout := cluster.DefaultBackupTimeout
+	if spec.BackupConfig != nil {
+		timeout = spec.BackupConfig.Timeout.Duration
+	}
+	// give the keeper the time to report the backup failed by its own
+	// timeout
+	if now.Sub(b.RequestTime) > timeout+spec.FailInterval.Duration {
+		return fmt.Sprintf("timeout after %s", timeout)
+	}
+	return ""
+}
+
+// updateBackups advances the scheduled backups: the backup in progress is
+// recorded in the backup history when completed or failed, and a new backup
+// is requested when the backup interval from the last requested one has
+// elapsed
+func (s *Sentinel) updateBackups(cd *cluster.ClusterData, now time.Time) {
+	status := &cd.Cluster.Status
+	if b := status.Backup; b != nil {
+		if !b.Finished() {
+			if reason := backupFailure(cd, b, now); reason != "" {
+				b.Phase = cluster.BackupPhaseFailed
+				b.EndTime = now
+				b.Error = reason
+			}
+		}
+		if !b.Finished() {
+			return
+		}
+		if b.Phase == cluster.BackupPhaseCompleted {
+			log.Infow("scheduled backup completed", "backup", b.UID, "db", b.DBUID, "keeper", b.KeeperUID)
+		} else {
+			log.Errorw("scheduled backup failed", "backup", b.UID, "db", b.DBUID, "keeper", b.KeeperUID, "error", b.Error)
+		}
+		status.BackupHistory = append(status.BackupHistory, b)
+		if len(status.BackupHistory) > cluster.MaxBackupHistory {
+			status.BackupHistory = status.BackupHistory[len(status.BackupHistory)-cluster.MaxBackupHistory:]
+		}
+		status.Backup = nil
+	}
+
+	config := cd.Cluster.DefSpec().BackupConfig
+	if config == nil {
+		return
+	}
+	if n := len(status.BackupHistory); n > 0 && now.Sub(status.BackupHistory[n-1].RequestTime) < config.Interval.Duration {
+		return
+	}
+	db := s.backupDB(cd)
+	if db == nil {
+		log.Debugw("no db available for the scheduled backup")
+		return
+	}
+	status.Backup = &cluster.Backup{
+		UID:         common.UID(),
+		Method:      config.Method,
+		KeeperUID:   db.Spec.KeeperUID,
+		DBUID:       db.UID,
+		Phase:       cluster.BackupPhaseRequested,
+		RequestTime: now,
+	}
+	log.Infow("requesting scheduled backup", "backup", status.Backup.UID, "method", config.Method, "db", db.UID, "keeper", db.Spec.KeeperUID)
+}
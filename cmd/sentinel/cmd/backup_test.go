@@ -0,0 +1,266 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+)
+
+// testBackupClusterData returns a cluster data with the master db1 and the
+// ready standbys db2 and db3, db3 with the greatest xlog position
+func testBackupClusterData(config *cluster.BackupConfig) *cluster.ClusterData {
+	cd := &cluster.ClusterData{
+		Cluster: &cluster.Cluster{
+			Spec: &cluster.ClusterSpec{BackupConfig: config},
+			Status: cluster.ClusterStatus{
+				Phase:  cluster.ClusterPhaseNormal,
+				Master: "db1",
+			},
+		},
+		Keepers: cluster.Keepers{},
+		DBs:     cluster.DBs{},
+	}
+	for i := 1; i <= 3; i++ {
+		uid := fmt.Sprintf("db%d", i)
+		keeperUID := fmt.Sprintf("keeper%d", i)
+		cd.Keepers[keeperUID] = &cluster.Keeper{UID: keeperUID, Spec: &cluster.KeeperSpec{}, Status: cluster.KeeperStatus{Healthy: true}}
+		cd.DBs[uid] = &cluster.DB{
+			UID: uid,
+			Spec: &cluster.DBSpec{
+				KeeperUID:    keeperUID,
+				Role:         common.RoleStandby,
+				FollowConfig: &cluster.FollowConfig{Type: cluster.FollowTypeInternal, DBUID: "db1"},
+			},
+			Status: cluster.DBStatus{Healthy: true, Ready: true, XLogPos: uint64(1000 * i)},
+		}
+	}
+	cd.DBs["db1"].Spec.Role = common.RoleMaster
+	cd.DBs["db1"].Spec.FollowConfig = nil
+	return cd
+}
+
+func TestBackupDB(t *testing.T) {
+	tests := []struct {
+		name   string
+		update func(cd *cluster.ClusterData)
+		out    string
+	}{
+		{
+			name: "standby with the greatest xlog position",
+			out:  "db3",
+		},
+		{
+			name:   "not ready standby",
+			update: func(cd *cluster.ClusterData) { cd.DBs["db3"].Status.Ready = false },
+			out:    "db2",
+		},
+		{
+			name:   "drained keeper",
+			update: func(cd *cluster.ClusterData) { cd.Keepers["keeper3"].Spec.Drained = true },
+			out:    "db2",
+		},
+		{
+			name:   "keeper in maintenance",
+			update: func(cd *cluster.ClusterData) { cd.Keepers["keeper3"].Spec.Maintenance = true },
+			out:    "db2",
+		},
+		{
+			name: "no ready standbys",
+			update: func(cd *cluster.ClusterData) {
+				cd.DBs["db2"].Status.Ready = false
+				cd.Keepers["keeper3"].Status.Healthy = false
+			},
+			out: "db1",
+		},
+		{
+			name: "no healthy dbs",
+			update: func(cd *cluster.ClusterData) {
+				cd.DBs["db1"].Status.Healthy = false
+				cd.DBs["db2"].Status.Ready = false
+				cd.DBs["db3"].Status.Ready = false
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		cd := testBackupClusterData(nil)
+		if tt.update != nil {
+			tt.update(cd)
+		}
+		s := &Sentinel{}
+		var out string
+		if db := s.backupDB(cd); db != nil {
+			out = db.UID
+		}
+		if out != tt.out {
+			t.Errorf("#%d (%s): got db: %q, want: %q", i, tt.name, out, tt.out)
+		}
+	}
+}
+
+func TestUpdateBackupStatus(t *testing.T) {
+	cd := testBackupClusterData(nil)
+	cd.Cluster.Status.Backup = &cluster.Backup{UID: "backup1", KeeperUID: "keeper3", DBUID: "db3", Phase: cluster.BackupPhaseRequested}
+	startTime := time.Now()
+
+	// a report of a previous backup is ignored
+	updateBackupStatus(cd, cluster.KeepersInfo{
+		"keeper3": &cluster.KeeperInfo{Backup: &cluster.Backup{UID: "backup0", Phase: cluster.BackupPhaseCompleted}},
+	})
+	if phase := cd.Cluster.Status.Backup.Phase; phase != cluster.BackupPhaseRequested {
+		t.Errorf("got phase: %q, want: %q", phase, cluster.BackupPhaseRequested)
+	}
+
+	updateBackupStatus(cd, cluster.KeepersInfo{
+		"keeper3": &cluster.KeeperInfo{Backup: &cluster.Backup{UID: "backup1", Phase: cluster.BackupPhaseRunning, StartTime: startTime}},
+	})
+	if b := cd.Cluster.Status.Backup; b.Phase != cluster.BackupPhaseRunning || !b.StartTime.Equal(startTime) {
+		t.Errorf("got backup: %+v, wanted running backup started at %s", b, startTime)
+	}
+}
+
+func TestUpdateBackups(t *testing.T) {
+	now := time.Now()
+	config := &cluster.BackupConfig{
+		Method:   cluster.BackupMethodWalG,
+		Interval: &cluster.Duration{Duration: 24 * time.Hour},
+		Timeout:  &cluster.Duration{Duration: time.Hour},
+	}
+
+	tests := []struct {
+		name    string
+		config  *cluster.BackupConfig
+		backup  *cluster.Backup
+		history []*cluster.Backup
+		update  func(cd *cluster.ClusterData)
+		// expected backup in progress db
+		outDB string
+		// expected phase of the last backup in the history
+		outHistoryPhase cluster.BackupPhase
+		outHistoryLen   int
+	}{
+		{
+			name: "backups not scheduled",
+		},
+		{
+			name:   "first backup",
+			config: config,
+			outDB:  "db3",
+		},
+		{
+			name:            "interval not elapsed",
+			config:          config,
+			history:         []*cluster.Backup{{UID: "backup0", Phase: cluster.BackupPhaseCompleted, RequestTime: now.Add(-time.Hour)}},
+			outHistoryLen:   1,
+			outHistoryPhase: cluster.BackupPhaseCompleted,
+		},
+		{
+			name:            "interval elapsed",
+			config:          config,
+			history:         []*cluster.Backup{{UID: "backup0", Phase: cluster.BackupPhaseCompleted, RequestTime: now.Add(-25 * time.Hour)}},
+			outDB:           "db3",
+			outHistoryLen:   1,
+			outHistoryPhase: cluster.BackupPhaseCompleted,
+		},
+		{
+			name:   "backup running",
+			config: config,
+			backup: &cluster.Backup{UID: "backup1", KeeperUID: "keeper2", DBUID: "db2", Phase: cluster.BackupPhaseRunning, RequestTime: now.Add(-time.Minute)},
+			outDB:  "db2",
+		},
+		{
+			name:            "backup completed",
+			config:          config,
+			backup:          &cluster.Backup{UID: "backup1", KeeperUID: "keeper2", DBUID: "db2", Phase: cluster.BackupPhaseCompleted, RequestTime: now.Add(-time.Minute)},
+			outHistoryLen:   1,
+			outHistoryPhase: cluster.BackupPhaseCompleted,
+		},
+		{
+			name:            "backup timed out",
+			config:          config,
+			backup:          &cluster.Backup{UID: "backup1", KeeperUID: "keeper2", DBUID: "db2", Phase: cluster.BackupPhaseRunning, RequestTime: now.Add(-2 * time.Hour)},
+			outHistoryLen:   1,
+			outHistoryPhase: cluster.BackupPhaseFailed,
+		},
+		{
+			name:            "backup keeper not healthy",
+			config:          config,
+			backup:          &cluster.Backup{UID: "backup1", KeeperUID: "keeper2", DBUID: "db2", Phase: cluster.BackupPhaseRunning, RequestTime: now.Add(-time.Minute)},
+			update:          func(cd *cluster.ClusterData) { cd.Keepers["keeper2"].Status.Healthy = false },
+			outHistoryLen:   1,
+			outHistoryPhase: cluster.BackupPhaseFailed,
+		},
+		{
+			name:            "backup db removed",
+			config:          config,
+			backup:          &cluster.Backup{UID: "backup1", KeeperUID: "keeper4", DBUID: "db4", Phase: cluster.BackupPhaseRequested, RequestTime: now.Add(-time.Minute)},
+			outHistoryLen:   1,
+			outHistoryPhase: cluster.BackupPhaseFailed,
+		},
+		{
+			name:   "backups disabled with a backup running",
+			backup: &cluster.Backup{UID: "backup1", KeeperUID: "keeper2", DBUID: "db2", Phase: cluster.BackupPhaseRunning, RequestTime: now.Add(-time.Minute)},
+			outDB:  "db2",
+		},
+		{
+			name:   "history limit",
+			config: config,
+			backup: &cluster.Backup{UID: "backup1", KeeperUID: "keeper2", DBUID: "db2", Phase: cluster.BackupPhaseFailed, RequestTime: now.Add(-time.Minute)},
+			history: func() []*cluster.Backup {
+				history := []*cluster.Backup{}
+				for i := 0; i < cluster.MaxBackupHistory; i++ {
+					history = append(history, &cluster.Backup{UID: fmt.Sprintf("backup0%d", i), Phase: cluster.BackupPhaseCompleted})
+				}
+				return history
+			}(),
+			outHistoryLen:   cluster.MaxBackupHistory,
+			outHistoryPhase: cluster.BackupPhaseFailed,
+		},
+	}
+
+	for i, tt := range tests {
+		cd := testBackupClusterData(tt.config)
+		cd.Cluster.Status.Backup = tt.backup
+		cd.Cluster.Status.BackupHistory = tt.history
+		if tt.update != nil {
+			tt.update(cd)
+		}
+		s := &Sentinel{}
+		s.updateBackups(cd, now)
+
+		status := cd.Cluster.Status
+		var outDB string
+		if status.Backup != nil {
+			outDB = status.Backup.DBUID
+		}
+		if outDB != tt.outDB {
+			t.Errorf("#%d (%s): got backup db: %q, want: %q", i, tt.name, outDB, tt.outDB)
+		}
+		if len(status.BackupHistory) != tt.outHistoryLen {
+			t.Errorf("#%d (%s): got %d backups in history, want: %d", i, tt.name, len(status.BackupHistory), tt.outHistoryLen)
+			continue
+		}
+		if tt.outHistoryLen > 0 {
+			if phase := status.BackupHistory[len(status.BackupHistory)-1].Phase; phase != tt.outHistoryPhase {
+				t.Errorf("#%d (%s): got last history backup phase: %q, want: %q", i, tt.name, phase, tt.outHistoryPhase)
+			}
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/util"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	clusterResourceGroup   = "stolon.sorintlab.com"
+	clusterResourceVersion = "v1"
+	clusterResourcePlural  = "stolonclusters"
+)
+
+// clusterResource is a StolonCluster custom resource. Its spec is the cluster
+// spec and its status reports the cluster state as seen by the leader
+// sentinel.
+type clusterResource struct {
+	APIVersion string                 `json:"apiVersion,omitempty"`
+	Kind       string                 `json:"kind,omitempty"`
+	Metadata   clusterResourceMeta    `json:"metadata"`
+	Spec       *cluster.ClusterSpec   `json:"spec,omitempty"`
+	Status     *clusterResourceStatus `json:"status,omitempty"`
+}
+
+// clusterResourceMeta is the custom resource object metadata. The status is
+// written back with an update of the whole object so the metadata is kept as
+// provided by the api server (i.e. its resourceVersion).
+type clusterResourceMeta map[string]interface{}
+
+func (m clusterResourceMeta) generation() int64 {
+	// json numbers are decoded as float64
+	if g, ok := m["generation"].(float64); ok {
+		return int64(g)
+	}
+	return 0
+}
+
+type clusterResourceStatus struct {
+	// ObservedGeneration is the resource generation whose spec has been
+	// applied to the cluster
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Error reports why the resource spec couldn't be applied
+	Error string `json:"error,omitempty"`
+
+	ClusterUID          string               `json:"clusterUID,omitempty"`
+	Phase               cluster.ClusterPhase `json:"phase,omitempty"`
+	Master              string               `json:"master,omitempty"`
+	MasterKeeper        string               `json:"masterKeeper,omitempty"`
+	Healthy             bool                 `json:"healthy"`
+	Keepers             int                  `json:"keepers"`
+	HealthyKeepers      int                  `json:"healthyKeepers"`
+	SynchronousStandbys []string             `json:"synchronousStandbys,omitempty"`
+}
+
+// clusterResourceClient reads the cluster resource and updates its status
+type clusterResourceClient interface {
+	Get(ctx context.Context) (*clusterResource, error)
+	UpdateStatus(ctx context.Context, cr *clusterResource) error
+}
+
+type kubeClusterResourceClient struct {
+	rc        rest.Interface
+	namespace string
+	name      string
+}
+
+func newKubeClusterResourceClient(cfg *config) (*kubeClusterResourceClient, error) {
+	kubeClientConfig := util.NewKubeClientConfig(cfg.KubeConfig, cfg.KubeContext, cfg.KubeNamespace)
+	kubecfg, err := kubeClientConfig.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	kubecli, err := kubernetes.NewForConfig(kubecfg)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create kubernetes client: %v", err)
+	}
+	namespace, _, err := kubeClientConfig.Namespace()
+	if err != nil {
+		return nil, err
+	}
+	// the discovery rest client isn't bound to an api group and version
+	return &kubeClusterResourceClient{rc: kubecli.Discovery().RESTClient(), namespace: namespace, name: cfg.clusterResource}, nil
+}
+
+func (c *kubeClusterResourceClient) path(subresources ...string) []string {
+	return append([]string{"/apis", clusterResourceGroup, clusterResourceVersion, "namespaces", c.namespace, clusterResourcePlural, c.name}, subresources...)
+}
+
+func (c *kubeClusterResourceClient) Get(ctx context.Context) (*clusterResource, error) {
+	data, err := c.rc.Get().Context(ctx).AbsPath(c.path()...).Do().Raw()
+	if err != nil {
+		return nil, err
+	}
+	var cr *clusterResource
+	if err := json.Unmarshal(data, &cr); err != nil {
+		return nil, fmt.Errorf("cannot parse cluster resource: %v", err)
+	}
+	return cr, nil
+}
+
+func (c *kubeClusterResourceClient) UpdateStatus(ctx context.Context, cr *clusterResource) error {
+	data, err := json.Marshal(cr)
+	if err != nil {
+		return err
+	}
+	return c.rc.Put().Context(ctx).AbsPath(c.path("status")...).SetHeader("Content-Type", "application/json").Body(data).Do().Error()
+}
+
+// applyClusterResourceSpec replaces the cluster data cluster spec with the
+// cluster resource spec. It returns true if the cluster spec has changed.
+func applyClusterResourceSpec(cd *cluster.ClusterData, cr *clusterResource) (bool, error) {
+	if cr.Spec == nil {
+		return false, fmt.Errorf("missing cluster resource spec")
+	}
+	if reflect.DeepEqual(cd.Cluster.Spec, cr.Spec) {
+		return false, nil
+	}
+	if err := cd.Cluster.UpdateSpec(cr.Spec); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// newClusterResourceStatus returns the cluster resource status reporting the
+// cluster data state. specErr is the error applying the resource spec.
+func newClusterResourceStatus(cd *cluster.ClusterData, cr *clusterResource, prevStatus *clusterResourceStatus, specErr error) *clusterResourceStatus {
+	status := &clusterResourceStatus{}
+	if specErr != nil {
+		status.Error = specErr.Error()
+		// keep reporting the last applied generation
+		if prevStatus != nil {
+			status.ObservedGeneration = prevStatus.ObservedGeneration
+		}
+	} else {
+		status.ObservedGeneration = cr.Metadata.generation()
+	}
+	if cd == nil || cd.Cluster == nil {
+		return status
+	}
+
+	status.ClusterUID = cd.Cluster.UID
+	status.Phase = cd.Cluster.Status.Phase
+	status.Master = cd.Cluster.Status.Master
+	status.Healthy = masterHealthy(cd)
+	if db, ok := cd.DBs[cd.Cluster.Status.Master]; ok {
+		status.MasterKeeper = db.Spec.KeeperUID
+		status.SynchronousStandbys = db.Spec.SynchronousStandbys
+	}
+	status.Keepers = len(cd.Keepers)
+	for _, k := range cd.Keepers {
+		if k.Status.Healthy {
+			status.HealthyKeepers++
+		}
+	}
+	return status
+}
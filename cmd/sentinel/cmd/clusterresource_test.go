@@ -0,0 +1,180 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func testClusterResourceClusterData() *cluster.ClusterData {
+	return &cluster.ClusterData{
+		Cluster: &cluster.Cluster{
+			UID: "cluster1",
+			Spec: &cluster.ClusterSpec{
+				InitMode: cluster.ClusterInitModeP(cluster.ClusterInitModeNew),
+			},
+			Status: cluster.ClusterStatus{Phase: cluster.ClusterPhaseNormal, Master: "db1"},
+		},
+		Keepers: cluster.Keepers{
+			"keeper1": &cluster.Keeper{UID: "keeper1", Status: cluster.KeeperStatus{Healthy: true}},
+			"keeper2": &cluster.Keeper{UID: "keeper2"},
+		},
+		DBs: cluster.DBs{
+			"db1": &cluster.DB{UID: "db1", Spec: &cluster.DBSpec{KeeperUID: "keeper1", SynchronousStandbys: []string{"db2"}}},
+		},
+	}
+}
+
+func TestApplyClusterResourceSpec(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    *cluster.ClusterSpec
+		changed bool
+		err     error
+	}{
+		{
+			name: "missing spec",
+			err:  fmt.Errorf("missing cluster resource spec"),
+		},
+		{
+			name: "same spec",
+			spec: &cluster.ClusterSpec{InitMode: cluster.ClusterInitModeP(cluster.ClusterInitModeNew)},
+		},
+		{
+			name:    "changed spec",
+			spec:    &cluster.ClusterSpec{InitMode: cluster.ClusterInitModeP(cluster.ClusterInitModeNew), SynchronousReplication: cluster.BoolP(true)},
+			changed: true,
+		},
+		{
+			name: "changed init mode",
+			spec: &cluster.ClusterSpec{InitMode: cluster.ClusterInitModeP(cluster.ClusterInitModeExisting), ExistingConfig: &cluster.ExistingConfig{KeeperUID: "keeper1"}},
+			err:  fmt.Errorf("cannot change cluster init mode"),
+		},
+	}
+
+	for i, tt := range tests {
+		cd := testClusterResourceClusterData()
+		changed, err := applyClusterResourceSpec(cd, &clusterResource{Spec: tt.spec})
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d (%s): got no error, wanted error: %v", i, tt.name, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d (%s): got error: %v, wanted error: %v", i, tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d (%s): unexpected error: %v", i, tt.name, err)
+			continue
+		}
+		if changed != tt.changed {
+			t.Errorf("#%d (%s): got changed: %t, want: %t", i, tt.name, changed, tt.changed)
+		}
+		if !reflect.DeepEqual(cd.Cluster.Spec, tt.spec) {
+			t.Errorf("#%d (%s): cluster spec not applied", i, tt.name)
+		}
+	}
+}
+
+func TestNewClusterResourceStatus(t *testing.T) {
+	cd := testClusterResourceClusterData()
+	cr := &clusterResource{Metadata: clusterResourceMeta{"generation": float64(3)}}
+
+	status := newClusterResourceStatus(cd, cr, &clusterResourceStatus{ObservedGeneration: 2}, nil)
+	expected := &clusterResourceStatus{
+		ObservedGeneration:  3,
+		ClusterUID:          "cluster1",
+		Phase:               cluster.ClusterPhaseNormal,
+		Master:              "db1",
+		MasterKeeper:        "keeper1",
+		Healthy:             true,
+		Keepers:             2,
+		HealthyKeepers:      1,
+		SynchronousStandbys: []string{"db2"},
+	}
+	if !reflect.DeepEqual(status, expected) {
+		t.Errorf("got status: %+v, want: %+v", status, expected)
+	}
+
+	// the spec couldn't be applied, the previous observed generation is kept
+	status = newClusterResourceStatus(cd, cr, &clusterResourceStatus{ObservedGeneration: 2}, fmt.Errorf("cannot change cluster init mode"))
+	expected.ObservedGeneration = 2
+	expected.Error = "cannot change cluster init mode"
+	if !reflect.DeepEqual(status, expected) {
+		t.Errorf("got status: %+v, want: %+v", status, expected)
+	}
+}
+
+func TestKubeClusterResourceClient(t *testing.T) {
+	const resourcePath = "/apis/stolon.sorintlab.com/v1/namespaces/ns1/stolonclusters/cluster1"
+	var putData []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == resourcePath:
+			fmt.Fprintf(w, `{"apiVersion":"stolon.sorintlab.com/v1","kind":"StolonCluster","metadata":{"name":"cluster1","generation":4,"resourceVersion":"10"},"spec":{"initMode":"new"}}`)
+		case r.Method == "PUT" && r.URL.Path == resourcePath+"/status":
+			putData, _ = ioutil.ReadAll(r.Body)
+			w.Write(putData)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	kubecli, err := kubernetes.NewForConfig(&rest.Config{Host: ts.URL})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c := &kubeClusterResourceClient{rc: kubecli.Discovery().RESTClient(), namespace: "ns1", name: "cluster1"}
+
+	cr, err := c.Get(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if g := cr.Metadata.generation(); g != 4 {
+		t.Errorf("got generation: %d, want: 4", g)
+	}
+	if cr.Spec == nil || *cr.Spec.InitMode != cluster.ClusterInitModeNew {
+		t.Errorf("wrong cluster resource spec: %+v", cr.Spec)
+	}
+
+	cr.Status = &clusterResourceStatus{ObservedGeneration: 4, Phase: cluster.ClusterPhaseNormal}
+	if err := c.UpdateStatus(context.Background(), cr); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var written *clusterResource
+	if err := json.Unmarshal(putData, &written); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the metadata must be kept to update the same resource version
+	if written.Metadata["resourceVersion"] != "10" {
+		t.Errorf("got resourceVersion: %v, want: 10", written.Metadata["resourceVersion"])
+	}
+	if !reflect.DeepEqual(written.Status, cr.Status) {
+		t.Errorf("got status: %+v, want: %+v", written.Status, cr.Status)
+	}
+}
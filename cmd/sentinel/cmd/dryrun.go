@@ -0,0 +1,112 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+// dryRun reports if the sentinel must not write the cluster data, since
+// started with --dry-run or enabled by the cluster spec sentinelDryRun option
+func (s *Sentinel) dryRun(cd *cluster.ClusterData) bool {
+	if s.cfg.dryRun {
+		return true
+	}
+	return cd != nil && cd.Cluster != nil && *cd.Cluster.DefSpec().SentinelDryRun
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// dryRunActions describes the actions done updating the cluster data from cd
+// to newcd. The status only changes (i.e. keepers and dbs reported states)
+// aren't reported except the keepers health.
+func dryRunActions(cd, newcd *cluster.ClusterData) []string {
+	actions := []string{}
+	add := func(format string, a ...interface{}) {
+		actions = append(actions, fmt.Sprintf(format, a...))
+	}
+
+	if cd.Cluster.Status.Phase != newcd.Cluster.Status.Phase {
+		add("change cluster phase from %q to %q", cd.Cluster.Status.Phase, newcd.Cluster.Status.Phase)
+	}
+	master, prevMaster := newcd.Cluster.Status.Master, cd.Cluster.Status.Master
+	if master != prevMaster {
+		if db, ok := newcd.DBs[master]; ok {
+			add("elect db %s (keeper %s) as the new master in place of db %q", master, db.Spec.KeeperUID, prevMaster)
+		} else {
+			add("remove the master db %s", prevMaster)
+		}
+	}
+
+	keeperUIDs := map[string]struct{}{}
+	for uid := range cd.Keepers {
+		keeperUIDs[uid] = struct{}{}
+	}
+	for uid := range newcd.Keepers {
+		keeperUIDs[uid] = struct{}{}
+	}
+	for _, uid := range sortedKeys(keeperUIDs) {
+		k, ok := newcd.Keepers[uid]
+		prevK, prevOk := cd.Keepers[uid]
+		switch {
+		case !prevOk:
+			add("add keeper %s", uid)
+		case !ok:
+			add("remove keeper %s", uid)
+		case prevK.Status.Healthy && !k.Status.Healthy:
+			add("mark keeper %s as failed", uid)
+		case !prevK.Status.Healthy && k.Status.Healthy:
+			add("mark keeper %s as healthy", uid)
+		}
+	}
+
+	dbUIDs := map[string]struct{}{}
+	for uid := range cd.DBs {
+		dbUIDs[uid] = struct{}{}
+	}
+	for uid := range newcd.DBs {
+		dbUIDs[uid] = struct{}{}
+	}
+	for _, uid := range sortedKeys(dbUIDs) {
+		db, ok := newcd.DBs[uid]
+		prevDB, prevOk := cd.DBs[uid]
+		switch {
+		case !prevOk:
+			add("create db %s on keeper %s with role %s", uid, db.Spec.KeeperUID, db.Spec.Role)
+		case !ok:
+			add("remove db %s of keeper %s", uid, prevDB.Spec.KeeperUID)
+		case prevDB.Spec.Role != db.Spec.Role:
+			add("change db %s (keeper %s) role from %s to %s", uid, db.Spec.KeeperUID, prevDB.Spec.Role, db.Spec.Role)
+		case prevDB.Generation != db.Generation:
+			add("update db %s (keeper %s) spec to generation %d", uid, db.Spec.KeeperUID, db.Generation)
+		}
+	}
+
+	if cd.Proxy != nil && newcd.Proxy != nil && cd.Proxy.Generation != newcd.Proxy.Generation {
+		add("update proxy spec to generation %d (master db %q)", newcd.Proxy.Generation, newcd.Proxy.Spec.MasterDBUID)
+	}
+
+	return actions
+}
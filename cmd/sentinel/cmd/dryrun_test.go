@@ -0,0 +1,145 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+)
+
+func testDryRunClusterData() *cluster.ClusterData {
+	return &cluster.ClusterData{
+		Cluster: &cluster.Cluster{
+			UID:    "cluster1",
+			Spec:   &cluster.ClusterSpec{},
+			Status: cluster.ClusterStatus{Phase: cluster.ClusterPhaseNormal, Master: "db1"},
+		},
+		Keepers: cluster.Keepers{
+			"keeper1": &cluster.Keeper{UID: "keeper1", Status: cluster.KeeperStatus{Healthy: true}},
+			"keeper2": &cluster.Keeper{UID: "keeper2", Status: cluster.KeeperStatus{Healthy: true}},
+		},
+		DBs: cluster.DBs{
+			"db1": &cluster.DB{UID: "db1", Generation: 1, Spec: &cluster.DBSpec{KeeperUID: "keeper1", Role: common.RoleMaster}},
+			"db2": &cluster.DB{UID: "db2", Generation: 1, Spec: &cluster.DBSpec{KeeperUID: "keeper2", Role: common.RoleStandby}},
+		},
+		Proxy: &cluster.Proxy{Generation: 1, Spec: cluster.ProxySpec{MasterDBUID: "db1"}},
+	}
+}
+
+// testDryRunFailover returns the cluster data after a failover from db1 to
+// db2
+func testDryRunFailover(cd *cluster.ClusterData) *cluster.ClusterData {
+	newcd := cd.DeepCopy()
+	newcd.Cluster.Status.Master = "db2"
+	newcd.Keepers["keeper1"].Status.Healthy = false
+	newcd.DBs["db2"].Spec.Role = common.RoleMaster
+	newcd.DBs["db2"].Generation++
+	delete(newcd.DBs, "db1")
+	newcd.Proxy.Generation++
+	newcd.Proxy.Spec.MasterDBUID = ""
+	return newcd
+}
+
+func TestDryRunActions(t *testing.T) {
+	cd := testDryRunClusterData()
+
+	tests := []struct {
+		name    string
+		newcd   func() *cluster.ClusterData
+		actions []string
+	}{
+		{
+			name: "only status changes",
+			newcd: func() *cluster.ClusterData {
+				newcd := cd.DeepCopy()
+				newcd.DBs["db2"].Status.XLogPos = 100
+				return newcd
+			},
+			actions: []string{},
+		},
+		{
+			name:  "failover",
+			newcd: func() *cluster.ClusterData { return testDryRunFailover(cd) },
+			actions: []string{
+				`elect db db2 (keeper keeper2) as the new master in place of db "db1"`,
+				"mark keeper keeper1 as failed",
+				"remove db db1 of keeper keeper1",
+				"change db db2 (keeper keeper2) role from standby to master",
+				`update proxy spec to generation 2 (master db "")`,
+			},
+		},
+		{
+			name: "new keeper and db",
+			newcd: func() *cluster.ClusterData {
+				newcd := cd.DeepCopy()
+				newcd.Keepers["keeper3"] = &cluster.Keeper{UID: "keeper3"}
+				newcd.DBs["db3"] = &cluster.DB{UID: "db3", Generation: 1, Spec: &cluster.DBSpec{KeeperUID: "keeper3", Role: common.RoleStandby}}
+				newcd.DBs["db1"].Generation++
+				return newcd
+			},
+			actions: []string{
+				"add keeper keeper3",
+				"update db db1 (keeper keeper1) spec to generation 2",
+				"create db db3 on keeper keeper3 with role standby",
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		actions := dryRunActions(cd, tt.newcd())
+		if !reflect.DeepEqual(actions, tt.actions) {
+			t.Errorf("#%d (%s): got actions: %v, want: %v", i, tt.name, actions, tt.actions)
+		}
+	}
+}
+
+func TestSentinelDryRun(t *testing.T) {
+	cd := testDryRunClusterData()
+
+	s := &Sentinel{cfg: &config{}}
+	if s.dryRun(cd) {
+		t.Fatalf("unexpected dry run mode")
+	}
+	cd.Cluster.Spec.SentinelDryRun = cluster.BoolP(true)
+	if !s.dryRun(cd) {
+		t.Fatalf("expected dry run mode enabled by the cluster spec")
+	}
+	s.cfg.dryRun = true
+	if !s.dryRun(nil) {
+		t.Fatalf("expected dry run mode enabled by the sentinel flag")
+	}
+
+	// the same actions, computed at every check, are reported only once
+	newcd := testDryRunFailover(cd)
+	for i := 0; i < 3; i++ {
+		s.reportDryRun(cd, newcd, electionDecisionFailover)
+	}
+	if n := s.metrics.dryRunDecisions[electionDecisionFailover]; n != 1 {
+		t.Errorf("got %d dry run failover decisions, want: 1", n)
+	}
+	if s.metrics.decisions[electionDecisionFailover] != 0 || s.metrics.failovers != 0 {
+		t.Errorf("dry run decisions reported as applied")
+	}
+
+	// reported again after the actions changed
+	s.reportDryRun(cd, cd, electionDecisionNone)
+	s.reportDryRun(cd, newcd, electionDecisionFailover)
+	if n := s.metrics.dryRunDecisions[electionDecisionFailover]; n != 2 {
+		t.Errorf("got %d dry run failover decisions, want: 2", n)
+	}
+}
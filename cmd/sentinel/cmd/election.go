@@ -0,0 +1,259 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/util"
+
+	"go.uber.org/zap"
+)
+
+// maxElectionResponseSize is the max size of the master election url
+// response
+const maxElectionResponseSize = 1024 * 1024
+
+// masterElectionStrategy orders the new master candidates, the preferred
+// first. The candidates not returned won't be elected.
+type masterElectionStrategy interface {
+	order(cd *cluster.ClusterData, masterDB *cluster.DB, dbs []*cluster.DB) ([]*cluster.DB, error)
+}
+
+// priorityElectionStrategy implements the "priority" master election strategy
+type priorityElectionStrategy struct{}
+
+func (priorityElectionStrategy) order(cd *cluster.ClusterData, masterDB *cluster.DB, dbs []*cluster.DB) ([]*cluster.DB, error) {
+	// Sort by election priority and XLogPos using the master placement
+	// preferences to break ties
+	sortByMasterPlacement(cd, masterDB, dbs)
+	return preferLogicalReplSlotsSynced(cd, dbs), nil
+}
+
+// maxLSNElectionStrategy implements the "maxLSN" master election strategy
+type maxLSNElectionStrategy struct{}
+
+func (maxLSNElectionStrategy) order(cd *cluster.ClusterData, masterDB *cluster.DB, dbs []*cluster.DB) ([]*cluster.DB, error) {
+	sortByMasterPlacement(cd, masterDB, dbs)
+	sort.SliceStable(dbs, func(i, j int) bool { return dbs[i].Status.XLogPos > dbs[j].Status.XLogPos })
+	return preferLogicalReplSlotsSynced(cd, dbs), nil
+}
+
+// zoneAwareElectionStrategy implements the "zoneAware" master election
+// strategy
+type zoneAwareElectionStrategy struct{}
+
+func (zoneAwareElectionStrategy) order(cd *cluster.ClusterData, masterDB *cluster.DB, dbs []*cluster.DB) ([]*cluster.DB, error) {
+	sortByMasterPlacement(cd, masterDB, dbs)
+	scores := make(map[string]int, len(dbs))
+	for _, db := range dbs {
+		scores[db.UID] = masterPlacementScore(cd, masterDB, db)
+	}
+	sort.SliceStable(dbs, func(i, j int) bool { return scores[dbs[i].UID] > scores[dbs[j].UID] })
+	return preferLogicalReplSlotsSynced(cd, dbs), nil
+}
+
+// pluginElectionStrategy implements the "command" and "url" master election
+// strategies: the candidates, ordered with the "priority" strategy, are
+// provided to run and ordered as in its response.
+type pluginElectionStrategy struct {
+	timeout time.Duration
+	run     func(ctx context.Context, req *electionRequest) (*electionResponse, error)
+}
+
+func (st *pluginElectionStrategy) order(cd *cluster.ClusterData, masterDB *cluster.DB, dbs []*cluster.DB) ([]*cluster.DB, error) {
+	dbs, _ = priorityElectionStrategy{}.order(cd, masterDB, dbs)
+
+	ctx, cancel := context.WithTimeout(context.Background(), st.timeout)
+	defer cancel()
+	resp, err := st.run(ctx, newElectionRequest(cd, masterDB, dbs))
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("timeout after %s", st.timeout)
+		}
+		return nil, err
+	}
+	return resp.order(dbs)
+}
+
+// newMasterElectionStrategy returns the cluster spec master election strategy
+func newMasterElectionStrategy(spec *cluster.ClusterSpec) masterElectionStrategy {
+	switch *spec.MasterElectionStrategy {
+	case cluster.MasterElectionStrategyMaxLSN:
+		return maxLSNElectionStrategy{}
+	case cluster.MasterElectionStrategyZoneAware:
+		return zoneAwareElectionStrategy{}
+	case cluster.MasterElectionStrategyCommand:
+		command := *spec.MasterElectionCommand
+		return &pluginElectionStrategy{
+			timeout: spec.MasterElectionTimeout.Duration,
+			run: func(ctx context.Context, req *electionRequest) (*electionResponse, error) {
+				return runElectionCommand(ctx, command, req)
+			},
+		}
+	case cluster.MasterElectionStrategyURL:
+		url := *spec.MasterElectionURL
+		return &pluginElectionStrategy{
+			timeout: spec.MasterElectionTimeout.Duration,
+			run: func(ctx context.Context, req *electionRequest) (*electionResponse, error) {
+				return postElectionRequest(ctx, url, req)
+			},
+		}
+	}
+	return priorityElectionStrategy{}
+}
+
+// orderNewMasters orders the new master candidates with the cluster spec
+// master election strategy. When the strategy fails the "priority" one is
+// used.
+func orderNewMasters(cd *cluster.ClusterData, masterDB *cluster.DB, dbs []*cluster.DB) []*cluster.DB {
+	spec := cd.Cluster.DefSpec()
+	out, err := newMasterElectionStrategy(spec).order(cd, masterDB, dbs)
+	if err != nil {
+		log.Errorw("master election strategy failed, ordering the new master candidates with the priority strategy", "masterElectionStrategy", *spec.MasterElectionStrategy, zap.Error(err))
+		out, _ = priorityElectionStrategy{}.order(cd, masterDB, dbs)
+	}
+	return out
+}
+
+// electionRequest describes the failed master and the new master candidates.
+// It's provided, json encoded, to the master election command standard input
+// and posted to the master election url.
+type electionRequest struct {
+	ClusterUID      string       `json:"clusterUID"`
+	MasterDBUID     string       `json:"masterDBUID"`
+	MasterKeeperUID string       `json:"masterKeeperUID"`
+	MasterTags      cluster.Tags `json:"masterTags,omitempty"`
+	// last reported xlog position of the failed master
+	MasterXLogPos uint64 `json:"masterXLogPos"`
+	// Candidates are ordered with the "priority" strategy
+	Candidates []*electionCandidate `json:"candidates"`
+}
+
+type electionCandidate struct {
+	DBUID              string       `json:"dbUID"`
+	KeeperUID          string       `json:"keeperUID"`
+	Tags               cluster.Tags `json:"tags,omitempty"`
+	ElectionPriority   int          `json:"electionPriority"`
+	TimelineID         uint64       `json:"timelineID"`
+	XLogPos            uint64       `json:"xlogPos"`
+	SynchronousStandby bool         `json:"synchronousStandby"`
+}
+
+// electionResponse is the master election command output or url response
+type electionResponse struct {
+	// Candidates are the uids of the candidate dbs that can be elected, the
+	// preferred first
+	Candidates []string `json:"candidates"`
+}
+
+func newElectionRequest(cd *cluster.ClusterData, masterDB *cluster.DB, dbs []*cluster.DB) *electionRequest {
+	req := &electionRequest{
+		ClusterUID:      cd.Cluster.UID,
+		MasterDBUID:     masterDB.UID,
+		MasterKeeperUID: masterDB.Spec.KeeperUID,
+		MasterTags:      keeperTags(cd, masterDB.Spec.KeeperUID),
+		MasterXLogPos:   masterDB.Status.XLogPos,
+		Candidates:      []*electionCandidate{},
+	}
+	for _, db := range dbs {
+		req.Candidates = append(req.Candidates, &electionCandidate{
+			DBUID:              db.UID,
+			KeeperUID:          db.Spec.KeeperUID,
+			Tags:               keeperTags(cd, db.Spec.KeeperUID),
+			ElectionPriority:   keeperElectionPriority(cd, db.Spec.KeeperUID),
+			TimelineID:         db.Status.TimelineID,
+			XLogPos:            db.Status.XLogPos,
+			SynchronousStandby: util.StringInSlice(masterDB.Spec.SynchronousStandbys, db.UID),
+		})
+	}
+	return req
+}
+
+// order returns the candidate dbs in the response order
+func (r *electionResponse) order(dbs []*cluster.DB) ([]*cluster.DB, error) {
+	candidates := make(map[string]*cluster.DB, len(dbs))
+	for _, db := range dbs {
+		candidates[db.UID] = db
+	}
+	out := []*cluster.DB{}
+	for _, dbUID := range r.Candidates {
+		db, ok := candidates[dbUID]
+		if !ok {
+			return nil, fmt.Errorf("db %q isn't a new master candidate or is duplicated", dbUID)
+		}
+		delete(candidates, dbUID)
+		out = append(out, db)
+	}
+	return out, nil
+}
+
+func decodeElectionResponse(data []byte) (*electionResponse, error) {
+	resp := &electionResponse{}
+	if err := json.Unmarshal(data, resp); err != nil {
+		return nil, fmt.Errorf("failed to decode the election response: %v", err)
+	}
+	return resp, nil
+}
+
+// runElectionCommand executes the master election command using /bin/sh -c
+// writing the json encoded election request to its standard input
+func runElectionCommand(ctx context.Context, command string, req *electionRequest) (*electionResponse, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	stdout := &bytes.Buffer{}
+	if err := runCommand(ctx, command, nil, bytes.NewReader(data), stdout); err != nil {
+		return nil, fmt.Errorf("master election command failed: %v", err)
+	}
+	return decodeElectionResponse(stdout.Bytes())
+}
+
+// postElectionRequest posts the json encoded election request to the url. A
+// non 2xx response status is reported as an error.
+func postElectionRequest(ctx context.Context, url string, req *electionRequest) (*electionResponse, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	hreq, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(hreq.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("master election url request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxElectionResponseSize))
+	if err != nil {
+		return nil, fmt.Errorf("master election url request failed: %v", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("master election url request failed: unexpected response status: %s", resp.Status)
+	}
+	return decodeElectionResponse(body)
+}
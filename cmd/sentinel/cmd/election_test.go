@@ -0,0 +1,260 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+// testElectionClusterData returns a cluster data with the failed master db1
+// in zone a and the new master candidates db2 (zone a), db3 (zone b) and db4
+// (zone a, with a higher election priority)
+func testElectionClusterData(strategy cluster.MasterElectionStrategy) (*cluster.ClusterData, []*cluster.DB) {
+	cd := &cluster.ClusterData{
+		Cluster: &cluster.Cluster{
+			UID: "cluster1",
+			Spec: &cluster.ClusterSpec{
+				MasterAntiAffinityTag:  cluster.StringP("zone"),
+				MasterElectionStrategy: cluster.MasterElectionStrategyP(strategy),
+			},
+		},
+		Keepers: cluster.Keepers{
+			"keeper1": &cluster.Keeper{UID: "keeper1", Spec: &cluster.KeeperSpec{Tags: cluster.Tags{"zone": "a"}}},
+			"keeper2": &cluster.Keeper{UID: "keeper2", Spec: &cluster.KeeperSpec{Tags: cluster.Tags{"zone": "a"}}},
+			"keeper3": &cluster.Keeper{UID: "keeper3", Spec: &cluster.KeeperSpec{Tags: cluster.Tags{"zone": "b"}}},
+			"keeper4": &cluster.Keeper{UID: "keeper4", Spec: &cluster.KeeperSpec{Tags: cluster.Tags{"zone": "a"}, ElectionPriority: 1}},
+		},
+		DBs: cluster.DBs{},
+	}
+	xLogPos := map[string]uint64{"db1": 400, "db2": 300, "db3": 200, "db4": 100}
+	dbs := []*cluster.DB{}
+	for _, uid := range []string{"db1", "db2", "db3", "db4"} {
+		cd.DBs[uid] = &cluster.DB{
+			UID:    uid,
+			Spec:   &cluster.DBSpec{KeeperUID: "keeper" + uid[2:]},
+			Status: cluster.DBStatus{TimelineID: 1, XLogPos: xLogPos[uid]},
+		}
+		if uid != "db1" {
+			dbs = append(dbs, cd.DBs[uid])
+		}
+	}
+	return cd, dbs
+}
+
+func dbUIDs(dbs []*cluster.DB) []string {
+	out := []string{}
+	for _, db := range dbs {
+		out = append(out, db.UID)
+	}
+	return out
+}
+
+func TestOrderNewMasters(t *testing.T) {
+	tests := []struct {
+		strategy cluster.MasterElectionStrategy
+		command  string
+		out      []string
+	}{
+		{
+			strategy: cluster.MasterElectionStrategyPriority,
+			out:      []string{"db4", "db3", "db2"},
+		},
+		{
+			strategy: cluster.MasterElectionStrategyMaxLSN,
+			out:      []string{"db2", "db3", "db4"},
+		},
+		{
+			strategy: cluster.MasterElectionStrategyZoneAware,
+			out:      []string{"db3", "db4", "db2"},
+		},
+		{
+			strategy: cluster.MasterElectionStrategyCommand,
+			command:  `cat > /dev/null; echo '{"candidates": ["db2", "db3"]}'`,
+			out:      []string{"db2", "db3"},
+		},
+		// no candidate can be elected
+		{
+			strategy: cluster.MasterElectionStrategyCommand,
+			command:  `cat > /dev/null; echo '{"candidates": []}'`,
+			out:      []string{},
+		},
+		// a failed command falls back to the priority strategy
+		{
+			strategy: cluster.MasterElectionStrategyCommand,
+			command:  "exit 1",
+			out:      []string{"db4", "db3", "db2"},
+		},
+		{
+			strategy: cluster.MasterElectionStrategyCommand,
+			command:  `cat > /dev/null; echo '{"candidates": ["db1"]}'`,
+			out:      []string{"db4", "db3", "db2"},
+		},
+	}
+
+	for i, tt := range tests {
+		cd, dbs := testElectionClusterData(tt.strategy)
+		if tt.command != "" {
+			cd.Cluster.Spec.MasterElectionCommand = cluster.StringP(tt.command)
+		}
+		out := dbUIDs(orderNewMasters(cd, cd.DBs["db1"], dbs))
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d (%s): wrong dbs: got: %v, want: %v", i, tt.strategy, out, tt.out)
+		}
+	}
+}
+
+func TestElectionResponseOrder(t *testing.T) {
+	_, dbs := testElectionClusterData(cluster.MasterElectionStrategyPriority)
+	tests := []struct {
+		candidates []string
+		out        []string
+		err        string
+	}{
+		{
+			candidates: []string{"db4", "db2"},
+			out:        []string{"db4", "db2"},
+		},
+		{
+			candidates: []string{"db5"},
+			err:        `db "db5" isn't a new master candidate or is duplicated`,
+		},
+		{
+			candidates: []string{"db2", "db2"},
+			err:        `db "db2" isn't a new master candidate or is duplicated`,
+		},
+	}
+
+	for i, tt := range tests {
+		out, err := (&electionResponse{Candidates: tt.candidates}).order(dbs)
+		if tt.err != "" {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if err.Error() != tt.err {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		} else if uids := dbUIDs(out); !reflect.DeepEqual(uids, tt.out) {
+			t.Errorf("#%d: wrong dbs: got: %v, want: %v", i, uids, tt.out)
+		}
+	}
+}
+
+func TestPluginElectionStrategy(t *testing.T) {
+	var posted *electionRequest
+	status := http.StatusOK
+	response := `{"candidates": ["db3"]}`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted = &electionRequest{}
+		if err := json.NewDecoder(r.Body).Decode(posted); err != nil {
+			t.Errorf("failed to decode election request: %v", err)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(response))
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		url     bool
+		command string
+		status  int
+		timeout time.Duration
+		out     []string
+		err     string
+	}{
+		{
+			url: true,
+			out: []string{"db3"},
+		},
+		{
+			url:    true,
+			status: http.StatusInternalServerError,
+			err:    "master election url request failed: unexpected response status: 500 Internal Server Error",
+		},
+		{
+			command: `grep -q '"masterDBUID":"db1"' && echo '{"candidates": ["db4"]}'`,
+			out:     []string{"db4"},
+		},
+		{
+			command: "echo 'not elected' >&2; exit 1",
+			err:     "master election command failed: exit status 1: not elected",
+		},
+		{
+			command: "echo notjson",
+			err:     "failed to decode the election response",
+		},
+		{
+			command: "sleep 10",
+			timeout: 100 * time.Millisecond,
+			err:     "timeout after 100ms",
+		},
+	}
+
+	for i, tt := range tests {
+		posted = nil
+		status = http.StatusOK
+		if tt.status != 0 {
+			status = tt.status
+		}
+		cd, dbs := testElectionClusterData(cluster.MasterElectionStrategyCommand)
+		spec := cd.Cluster.Spec
+		if tt.url {
+			spec.MasterElectionStrategy = cluster.MasterElectionStrategyP(cluster.MasterElectionStrategyURL)
+			spec.MasterElectionURL = cluster.StringP(ts.URL)
+		} else {
+			spec.MasterElectionCommand = cluster.StringP(tt.command)
+		}
+		if tt.timeout != 0 {
+			spec.MasterElectionTimeout = &cluster.Duration{Duration: tt.timeout}
+		}
+		out, err := newMasterElectionStrategy(cd.Cluster.DefSpec()).order(cd, cd.DBs["db1"], dbs)
+		if tt.err != "" {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if uids := dbUIDs(out); !reflect.DeepEqual(uids, tt.out) {
+			t.Errorf("#%d: wrong dbs: got: %v, want: %v", i, uids, tt.out)
+		}
+		if tt.url {
+			// the candidates are provided ordered with the priority strategy
+			candidates := []string{}
+			for _, c := range posted.Candidates {
+				candidates = append(candidates, c.DBUID)
+			}
+			if expected := []string{"db4", "db3", "db2"}; !reflect.DeepEqual(candidates, expected) {
+				t.Errorf("#%d: got posted candidates: %v, want: %v", i, candidates, expected)
+			}
+			if posted.MasterDBUID != "db1" || posted.MasterKeeperUID != "keeper1" || posted.Candidates[0].ElectionPriority != 1 || posted.Candidates[1].Tags["zone"] != "b" {
+				t.Errorf("#%d: wrong posted election request: %+v", i, posted)
+			}
+		}
+	}
+}
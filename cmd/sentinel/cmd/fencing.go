@@ -0,0 +1,236 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/tracing"
+)
+
+// maxCommandStderrSize is the max size of the fencing and master election
+// commands standard error reported in their error
+const maxCommandStderrSize = 1024
+
+// fencingRequest describes the failed master to fence. It's provided to the
+// fencing command as environment variables and posted to the fencing url as
+// a json payload.
+type fencingRequest struct {
+	ClusterUID         string `json:"clusterUID"`
+	OldMasterDBUID     string `json:"oldMasterDBUID"`
+	OldMasterKeeperUID string `json:"oldMasterKeeperUID"`
+	// last reported listen address (host:port) of the old master db
+	OldMasterAddress   string `json:"oldMasterAddress,omitempty"`
+	NewMasterDBUID     string `json:"newMasterDBUID"`
+	NewMasterKeeperUID string `json:"newMasterKeeperUID"`
+}
+
+func newFencingRequest(cd *cluster.ClusterData, oldMasterDB, newMasterDB *cluster.DB) *fencingRequest {
+	req := &fencingRequest{
+		ClusterUID:         cd.Cluster.UID,
+		OldMasterDBUID:     oldMasterDB.UID,
+		OldMasterKeeperUID: oldMasterDB.Spec.KeeperUID,
+		NewMasterDBUID:     newMasterDB.UID,
+		NewMasterKeeperUID: newMasterDB.Spec.KeeperUID,
+	}
+	if oldMasterDB.Status.ListenAddress != "" {
+		req.OldMasterAddress = fmt.Sprintf("%s:%s", oldMasterDB.Status.ListenAddress, oldMasterDB.Status.Port)
+	}
+	return req
+}
+
+func (r *fencingRequest) env() []string {
+	return []string{
+		"STOLON_CLUSTER_UID=" + r.ClusterUID,
+		"STOLON_OLD_MASTER_DB_UID=" + r.OldMasterDBUID,
+		"STOLON_OLD_MASTER_KEEPER_UID=" + r.OldMasterKeeperUID,
+		"STOLON_OLD_MASTER_ADDRESS=" + r.OldMasterAddress,
+		"STOLON_NEW_MASTER_DB_UID=" + r.NewMasterDBUID,
+		"STOLON_NEW_MASTER_KEEPER_UID=" + r.NewMasterKeeperUID,
+	}
+}
+
+// limitedBuffer is a bytes.Buffer ignoring the data written after max bytes
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if n := b.max - b.Len(); n > 0 {
+		if len(p) > n {
+			b.Buffer.Write(p[:n])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// runFencingCommand executes the fencing command using /bin/sh -c. The
+// command, with all its children processes, is killed when ctx is done.
+func runFencingCommand(ctx context.Context, command string, req *fencingRequest) error {
+	return runCommand(ctx, command, req.env(), nil, os.Stdout)
+}
+
+// runCommand executes the command using /bin/sh -c with the additional
+// environment variables, the provided standard input and output. The
+// command, with all its children processes, is killed when ctx is done.
+func runCommand(ctx context.Context, command string, env []string, stdin io.Reader, stdout io.Writer) error {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	// Run the command in its own process group so all its children can be
+	// killed on timeout
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stderr := &limitedBuffer{max: maxCommandStderrSize}
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+	log.Debugw("execing cmd", "cmd", cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- cmd.Wait()
+	}()
+
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-errCh
+		return ctx.Err()
+	}
+	if err != nil {
+		if out := strings.TrimSpace(stderr.String()); out != "" {
+			return fmt.Errorf("%v: %s", err, out)
+		}
+	}
+	return err
+}
+
+// postFencingRequest posts the json encoded fencing request to the url. A non
+// 2xx response status is reported as an error.
+func postFencingRequest(ctx context.Context, url string, req *fencingRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	hreq, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(hreq.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return nil
+}
+
+// fencingEnabled reports if a fencing command or url is defined
+func fencingEnabled(spec *cluster.ClusterSpec) bool {
+	return (spec.FencingCommand != nil && *spec.FencingCommand != "") || (spec.FencingURL != nil && *spec.FencingURL != "")
+}
+
+// runFencing executes the cluster spec fencing command and posts the fencing
+// request to the fencing url. Both must succeed before the fencing timeout.
+func runFencing(spec *cluster.ClusterSpec, req *fencingRequest) error {
+	timeout := spec.FencingTimeout.Duration
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var err error
+	if spec.FencingCommand != nil && *spec.FencingCommand != "" {
+		if err = runFencingCommand(ctx, *spec.FencingCommand, req); err != nil {
+			err = fmt.Errorf("fencing command failed: %v", err)
+		}
+	}
+	if err == nil && spec.FencingURL != nil && *spec.FencingURL != "" {
+		if err = postFencingRequest(ctx, *spec.FencingURL, req); err != nil {
+			err = fmt.Errorf("fencing url request failed: %v", err)
+		}
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("fencing timeout after %s", timeout)
+	}
+	return err
+}
+
+// fenceOldMaster fences the failed old master before electing the new master
+// db. The result is recorded in the cluster status. It returns false when the
+// fencing failed and the fencing policy is failClosed, so the new master must
+// not be elected. In dry run mode the fencing isn't executed.
+func (s *Sentinel) fenceOldMaster(cd *cluster.ClusterData, oldMasterDB, newMasterDB *cluster.DB) bool {
+	spec := cd.Cluster.DefSpec()
+	if !fencingEnabled(spec) {
+		return true
+	}
+	if s.checkDryRun {
+		log.Infow("dry run mode, not fencing the old master", "db", oldMasterDB.UID, "keeper", oldMasterDB.Spec.KeeperUID)
+		return true
+	}
+
+	fenceFn := s.fenceFn
+	if fenceFn == nil {
+		fenceFn = runFencing
+	}
+	log.Infow("fencing the old master", "db", oldMasterDB.UID, "keeper", oldMasterDB.Spec.KeeperUID)
+	span := s.checkSpan.Child("sentinel.fencing", tracing.String("stolon.db.uid", oldMasterDB.UID), tracing.String("stolon.keeper.uid", oldMasterDB.Spec.KeeperUID))
+	err := fenceFn(spec, newFencingRequest(cd, oldMasterDB, newMasterDB))
+	span.SetError(err)
+	span.End()
+	result := &cluster.FencingResult{
+		DBUID:     oldMasterDB.UID,
+		KeeperUID: oldMasterDB.Spec.KeeperUID,
+		Time:      time.Now(),
+		Success:   err == nil,
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	cd.Cluster.Status.LastFencing = result
+
+	if err == nil {
+		log.Infow("old master fenced", "db", oldMasterDB.UID, "keeper", oldMasterDB.Spec.KeeperUID)
+		return true
+	}
+	if *spec.FencingPolicy == cluster.FencingPolicyFailOpen {
+		log.Warnw("old master fencing failed, electing the new master anyway since fencingPolicy is failOpen", "db", oldMasterDB.UID, "keeper", oldMasterDB.Spec.KeeperUID, "error", err)
+		return true
+	}
+	log.Errorw("old master fencing failed, not electing a new master", "db", oldMasterDB.UID, "keeper", oldMasterDB.Spec.KeeperUID, "error", err)
+	return false
+}
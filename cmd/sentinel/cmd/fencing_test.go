@@ -0,0 +1,189 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+func TestFenceOldMaster(t *testing.T) {
+	tests := []struct {
+		policy   cluster.FencingPolicy
+		noFence  bool
+		dryRun   bool
+		fenceErr error
+		elect    bool
+		fenced   bool
+		result   *cluster.FencingResult
+	}{
+		{
+			noFence: true,
+			elect:   true,
+		},
+		{
+			dryRun: true,
+			elect:  true,
+		},
+		{
+			elect:  true,
+			fenced: true,
+			result: &cluster.FencingResult{DBUID: "db1", KeeperUID: "keeper1", Success: true},
+		},
+		{
+			fenceErr: fmt.Errorf("power switch unreachable"),
+			fenced:   true,
+			result:   &cluster.FencingResult{DBUID: "db1", KeeperUID: "keeper1", Error: "power switch unreachable"},
+		},
+		{
+			policy:   cluster.FencingPolicyFailOpen,
+			fenceErr: fmt.Errorf("power switch unreachable"),
+			elect:    true,
+			fenced:   true,
+			result:   &cluster.FencingResult{DBUID: "db1", KeeperUID: "keeper1", Error: "power switch unreachable"},
+		},
+	}
+
+	for i, tt := range tests {
+		cd := testDryRunClusterData()
+		if !tt.noFence {
+			cd.Cluster.Spec.FencingCommand = cluster.StringP("fence")
+		}
+		if tt.policy != "" {
+			cd.Cluster.Spec.FencingPolicy = cluster.FencingPolicyP(tt.policy)
+		}
+		cd.DBs["db1"].Status.ListenAddress = "10.0.0.1"
+		cd.DBs["db1"].Status.Port = "5432"
+
+		var req *fencingRequest
+		s := &Sentinel{
+			checkDryRun: tt.dryRun,
+			fenceFn: func(spec *cluster.ClusterSpec, r *fencingRequest) error {
+				req = r
+				return tt.fenceErr
+			},
+		}
+		elect := s.fenceOldMaster(cd, cd.DBs["db1"], cd.DBs["db2"])
+		if elect != tt.elect {
+			t.Errorf("#%d: got elect: %t, want: %t", i, elect, tt.elect)
+		}
+		if (req != nil) != tt.fenced {
+			t.Errorf("#%d: got fenced: %t, want: %t", i, req != nil, tt.fenced)
+		}
+		if req != nil {
+			expected := fencingRequest{ClusterUID: "cluster1", OldMasterDBUID: "db1", OldMasterKeeperUID: "keeper1", OldMasterAddress: "10.0.0.1:5432", NewMasterDBUID: "db2", NewMasterKeeperUID: "keeper2"}
+			if *req != expected {
+				t.Errorf("#%d: got fencing request: %+v, want: %+v", i, *req, expected)
+			}
+		}
+		result := cd.Cluster.Status.LastFencing
+		if result != nil {
+			if result.Time.IsZero() {
+				t.Errorf("#%d: empty fencing result time", i)
+			}
+			result.Time = time.Time{}
+		}
+		if (result == nil) != (tt.result == nil) || (result != nil && *result != *tt.result) {
+			t.Errorf("#%d: got fencing result: %+v, want: %+v", i, result, tt.result)
+		}
+	}
+}
+
+func TestRunFencing(t *testing.T) {
+	var posted *fencingRequest
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted = &fencingRequest{}
+		if err := json.NewDecoder(r.Body).Decode(posted); err != nil {
+			t.Errorf("failed to decode fencing request: %v", err)
+		}
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	req := &fencingRequest{ClusterUID: "cluster1", OldMasterDBUID: "db1", OldMasterKeeperUID: "keeper1", NewMasterDBUID: "db2", NewMasterKeeperUID: "keeper2"}
+
+	tests := []struct {
+		command string
+		url     bool
+		status  int
+		timeout time.Duration
+		posted  bool
+		err     string
+	}{
+		{
+			command: `test "$STOLON_OLD_MASTER_KEEPER_UID" = keeper1 && test "$STOLON_NEW_MASTER_DB_UID" = db2`,
+			url:     true,
+			posted:  true,
+		},
+		{
+			command: "echo not fenced >&2; exit 1",
+			url:     true,
+			err:     "fencing command failed: exit status 1: not fenced",
+		},
+		{
+			url:    true,
+			status: http.StatusInternalServerError,
+			posted: true,
+			err:    "fencing url request failed: unexpected response status: 500 Internal Server Error",
+		},
+		{
+			command: "sleep 10",
+			timeout: 100 * time.Millisecond,
+			err:     "fencing timeout after 100ms",
+		},
+	}
+
+	for i, tt := range tests {
+		posted = nil
+		status = http.StatusOK
+		if tt.status != 0 {
+			status = tt.status
+		}
+		spec := (&cluster.ClusterSpec{}).WithDefaults()
+		if tt.command != "" {
+			spec.FencingCommand = cluster.StringP(tt.command)
+		}
+		if tt.url {
+			spec.FencingURL = cluster.StringP(ts.URL)
+		}
+		if tt.timeout != 0 {
+			spec.FencingTimeout = &cluster.Duration{Duration: tt.timeout}
+		}
+		err := runFencing(spec, req)
+		if tt.err != "" {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+		if (posted != nil) != tt.posted {
+			t.Errorf("#%d: got posted: %t, want: %t", i, posted != nil, tt.posted)
+		}
+		if posted != nil && *posted != *req {
+			t.Errorf("#%d: got posted fencing request: %+v, want: %+v", i, *posted, *req)
+		}
+	}
+}
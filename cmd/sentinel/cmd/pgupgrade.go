@@ -0,0 +1,173 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+)
+
+func endPGUpgrade(u *cluster.PGUpgrade, phase cluster.PGUpgradePhase, reason string) {
+	u.Phase = phase
+	u.Reason = reason
+	u.EndTime = time.Now()
+}
+
+// startPGUpgrade starts the requested postgres major version upgrade: the
+// cluster enters the upgrade phase and the master keeper is requested to
+// switch to the new postgres binaries upgrading its data dir. The upgrade
+// waits for the switchover or the rolling restart in progress and is aborted
+// if the master db is failed.
+func startPGUpgrade(newcd *cluster.ClusterData, curMasterDB *cluster.DB, masterOK bool) {
+	u := newcd.Cluster.Status.PGUpgrade
+	if u.Phase != cluster.PGUpgradePhaseRequested {
+		log.Warnw("aborting postgres upgrade in an unexpected phase outside the upgrade cluster phase", "phase", u.Phase)
+		endPGUpgrade(u, cluster.PGUpgradePhaseAborted, fmt.Sprintf("unexpected phase %q", u.Phase))
+		return
+	}
+	if !masterOK {
+		log.Warnw("aborting postgres upgrade since the master db is failed")
+		endPGUpgrade(u, cluster.PGUpgradePhaseAborted, "the master db is failed")
+		return
+	}
+	if newcd.Cluster.Status.Switchover != nil || newcd.Cluster.Status.RollingRestart.InProgress() {
+		log.Infow("waiting for the switchover or rolling restart in progress to complete before starting the postgres upgrade")
+		return
+	}
+	masterKeeper, ok := newcd.Keepers[curMasterDB.Spec.KeeperUID]
+	if !ok {
+		log.Warnw("aborting postgres upgrade since the master keeper doesn't exist", "keeper", curMasterDB.Spec.KeeperUID)
+		endPGUpgrade(u, cluster.PGUpgradePhaseAborted, fmt.Sprintf("master keeper %q doesn't exist", curMasterDB.Spec.KeeperUID))
+		return
+	}
+	if masterKeeper.Spec == nil {
+		masterKeeper.Spec = &cluster.KeeperSpec{}
+	}
+
+	log.Infow("starting postgres upgrade, freezing the cluster", "masterKeeper", masterKeeper.UID, "pgBinPath", u.PGBinPath)
+	u.Phase = cluster.PGUpgradePhaseMaster
+	u.StartTime = time.Now()
+	u.MasterKeeper = masterKeeper.UID
+	u.MasterKeeperPGBinPath = masterKeeper.Spec.PGBinPath
+	masterKeeper.Spec.PGBinPath = u.PGBinPath
+	newcd.DBs[curMasterDB.UID].Spec.PGUpgrade = true
+	newcd.Cluster.Status.Phase = cluster.ClusterPhaseUpgrade
+}
+
+// resumeFromPGUpgrade ends the cluster upgrade phase. When the master keeper
+// isn't using the new postgres binaries its previous ones are restored.
+func resumeFromPGUpgrade(newcd *cluster.ClusterData, masterDB *cluster.DB) {
+	u := newcd.Cluster.Status.PGUpgrade
+	if k, ok := newcd.Keepers[u.MasterKeeper]; ok && k.Spec != nil && k.Status.PGBinPath != u.PGBinPath {
+		k.Spec.PGBinPath = u.MasterKeeperPGBinPath
+	}
+	if masterDB != nil {
+		masterDB.Spec.PGUpgrade = false
+	}
+	newcd.Cluster.Status.Phase = cluster.ClusterPhaseNormal
+}
+
+// replacePGUpgradeStandbys replaces the standbys whose keepers use a postgres
+// major version different than the upgraded master one with new dbs resynced
+// from the master
+func (s *Sentinel) replacePGUpgradeStandbys(newcd *cluster.ClusterData, masterDB *cluster.DB) {
+	masterDB.Spec.Followers = []string{}
+	for _, db := range newcd.DBs {
+		if db.UID == masterDB.UID {
+			continue
+		}
+		if samePostgresMajor(newcd, db, masterDB) {
+			masterDB.Spec.Followers = append(masterDB.Spec.Followers, db.UID)
+			continue
+		}
+		delete(newcd.DBs, db.UID)
+		ndb := &cluster.DB{
+			UID:        s.UIDFn(),
+			Generation: cluster.InitialGeneration,
+			Spec: &cluster.DBSpec{
+				KeeperUID:    db.Spec.KeeperUID,
+				InitMode:     cluster.DBInitModeResync,
+				Role:         common.RoleStandby,
+				Followers:    []string{},
+				FollowConfig: &cluster.FollowConfig{Type: cluster.FollowTypeInternal, DBUID: masterDB.UID},
+			},
+		}
+		newcd.DBs[ndb.UID] = ndb
+		masterDB.Spec.Followers = append(masterDB.Spec.Followers, ndb.UID)
+		log.Infow("replacing standby db with a new db resynced from the upgraded master", "db", ndb.UID, "replacedDB", db.UID, "keeper", db.Spec.KeeperUID)
+	}
+	sort.Strings(masterDB.Spec.Followers)
+}
+
+// handlePGUpgrade handles the cluster upgrade phase. The cluster is frozen
+// (no new master is elected) while the master keeper upgrades its data dir.
+// When the master db has converged with the new postgres binaries all the
+// keepers are switched to them and the standbys are replaced by new dbs
+// resynced from the master. If the master db converged with its previous
+// binaries (the keeper failed to upgrade it) or the upgrade has been aborted
+// (by stolonctl) the cluster returns to the normal phase.
+func (s *Sentinel) handlePGUpgrade(newcd *cluster.ClusterData) {
+	u := newcd.Cluster.Status.PGUpgrade
+	masterDB := newcd.DBs[newcd.Cluster.Status.Master]
+	if !u.InProgress() {
+		log.Infow("postgres upgrade not in progress, unfreezing the cluster")
+		resumeFromPGUpgrade(newcd, masterDB)
+		return
+	}
+	abort := func(reason string) {
+		log.Warnw("aborting postgres upgrade", "reason", reason)
+		endPGUpgrade(u, cluster.PGUpgradePhaseAborted, reason)
+		resumeFromPGUpgrade(newcd, masterDB)
+	}
+
+	if masterDB == nil {
+		abort("no master db available")
+		return
+	}
+	masterKeeper, ok := newcd.Keepers[u.MasterKeeper]
+	if !ok {
+		abort(fmt.Sprintf("master keeper %q has been removed", u.MasterKeeper))
+		return
+	}
+	if masterDB.Spec.KeeperUID != masterKeeper.UID {
+		abort(fmt.Sprintf("the master db isn't assigned to keeper %q", u.MasterKeeper))
+		return
+	}
+	if masterDB.Status.CurrentGeneration != masterDB.Generation || !masterDB.Status.Healthy {
+		log.Infow("waiting for the master keeper to upgrade its db", "db", masterDB.UID, "keeper", masterKeeper.UID)
+		return
+	}
+	if masterKeeper.Status.PGBinPath != u.PGBinPath {
+		abort(fmt.Sprintf("keeper %q didn't switch to the new postgres binaries, see its logs", masterKeeper.UID))
+		return
+	}
+
+	log.Infow("master db upgraded", "db", masterDB.UID, "keeper", masterKeeper.UID, "postgresVersion", masterKeeper.Status.PostgresVersion)
+	s.replacePGUpgradeStandbys(newcd, masterDB)
+	for _, k := range newcd.Keepers {
+		if k.Spec == nil {
+			k.Spec = &cluster.KeeperSpec{}
+		}
+		k.Spec.PGBinPath = u.PGBinPath
+	}
+	masterDB.Spec.PGUpgrade = false
+	newcd.Cluster.Status.Phase = cluster.ClusterPhaseNormal
+	log.Infow("postgres upgrade completed, unfreezing the cluster")
+	endPGUpgrade(u, cluster.PGUpgradePhaseCompleted, "")
+}
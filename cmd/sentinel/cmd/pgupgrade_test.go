@@ -0,0 +1,225 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+const (
+	testOldPGBinPath = "/usr/lib/postgresql/12/bin"
+	testNewPGBinPath = "/usr/lib/postgresql/13/bin"
+)
+
+// testPGUpgradeClusterData returns a cluster data with the master db1 and
+// the standbys using postgres 12 and a requested upgrade to postgres 13
+func testPGUpgradeClusterData(standbys int) *cluster.ClusterData {
+	cd := testRollingRestartClusterData(standbys)
+	cd.Cluster.Status.RollingRestart = nil
+	cd.Cluster.Status.PGUpgrade = &cluster.PGUpgrade{Phase: cluster.PGUpgradePhaseRequested, PGBinPath: testNewPGBinPath}
+	for _, k := range cd.Keepers {
+		k.Status.PostgresBinaryVersion = cluster.PostgresBinaryVersion{Maj: 12, Min: 4}
+		k.Status.PGBinPath = testOldPGBinPath
+	}
+	return cd
+}
+
+// testPGUpgradeUIDFn returns an UIDFn generating the uids newdb1, newdb2...
+func testPGUpgradeUIDFn() func() string {
+	n := 0
+	return func() string {
+		n++
+		return fmt.Sprintf("newdb%d", n)
+	}
+}
+
+// upgradeMaster simulates the master keeper upgrading its db
+func upgradeMaster(cd *cluster.ClusterData) {
+	masterDB := cd.DBs[cd.Cluster.Status.Master]
+	masterDB.Status.CurrentGeneration = masterDB.Generation
+	k := cd.Keepers[masterDB.Spec.KeeperUID]
+	k.Status.PostgresBinaryVersion = cluster.PostgresBinaryVersion{Maj: 13, Min: 2}
+	k.Status.PGBinPath = k.Spec.PGBinPath
+}
+
+func TestPGUpgrade(t *testing.T) {
+	s := &Sentinel{uid: "sentinel01", UIDFn: testPGUpgradeUIDFn()}
+	cd := testPGUpgradeClusterData(2)
+	u := cd.Cluster.Status.PGUpgrade
+
+	startPGUpgrade(cd, cd.DBs["db1"], true)
+	if u.Phase != cluster.PGUpgradePhaseMaster {
+		t.Fatalf("got phase: %q, want: %q (reason: %q)", u.Phase, cluster.PGUpgradePhaseMaster, u.Reason)
+	}
+	if cd.Cluster.Status.Phase != cluster.ClusterPhaseUpgrade {
+		t.Fatalf("got cluster phase: %q, want: %q", cd.Cluster.Status.Phase, cluster.ClusterPhaseUpgrade)
+	}
+	if u.MasterKeeper != "keeper1" {
+		t.Fatalf("got master keeper: %q, want: %q", u.MasterKeeper, "keeper1")
+	}
+	if !cd.DBs["db1"].Spec.PGUpgrade {
+		t.Fatalf("upgrade not requested to the master db")
+	}
+	if p := cd.Keepers["keeper1"].Spec.PGBinPath; p != testNewPGBinPath {
+		t.Fatalf("got master keeper pg bin path: %q, want: %q", p, testNewPGBinPath)
+	}
+	for _, keeperUID := range []string{"keeper2", "keeper3"} {
+		if p := cd.Keepers[keeperUID].Spec.PGBinPath; p != "" {
+			t.Fatalf("got keeper %q pg bin path: %q, want: %q", keeperUID, p, "")
+		}
+	}
+
+	// the db spec change increases its generation
+	cd.DBs["db1"].Generation++
+	s.handlePGUpgrade(cd)
+	if u.Phase != cluster.PGUpgradePhaseMaster {
+		t.Fatalf("got phase: %q, want: %q (reason: %q)", u.Phase, cluster.PGUpgradePhaseMaster, u.Reason)
+	}
+
+	upgradeMaster(cd)
+	s.handlePGUpgrade(cd)
+	if u.Phase != cluster.PGUpgradePhaseCompleted {
+		t.Fatalf("got phase: %q, want: %q (reason: %q)", u.Phase, cluster.PGUpgradePhaseCompleted, u.Reason)
+	}
+	if cd.Cluster.Status.Phase != cluster.ClusterPhaseNormal {
+		t.Fatalf("got cluster phase: %q, want: %q", cd.Cluster.Status.Phase, cluster.ClusterPhaseNormal)
+	}
+	if cd.DBs["db1"].Spec.PGUpgrade {
+		t.Fatalf("upgrade still requested to the master db")
+	}
+	for _, k := range cd.Keepers {
+		if k.Spec.PGBinPath != testNewPGBinPath {
+			t.Errorf("got keeper %q pg bin path: %q, want: %q", k.UID, k.Spec.PGBinPath, testNewPGBinPath)
+		}
+	}
+
+	// the standbys are replaced by new dbs to resync
+	if len(cd.DBs) != 3 {
+		t.Fatalf("got %d dbs, want: %d", len(cd.DBs), 3)
+	}
+	for _, db := range cd.DBs {
+		if db.UID == "db1" {
+			continue
+		}
+		if db.UID == "db2" || db.UID == "db3" {
+			t.Fatalf("standby db %q not replaced", db.UID)
+		}
+		if db.Spec.InitMode != cluster.DBInitModeResync || db.Spec.FollowConfig.DBUID != "db1" {
+			t.Errorf("db %q: got init mode: %q following db %q, want resync following db1", db.UID, db.Spec.InitMode, db.Spec.FollowConfig.DBUID)
+		}
+	}
+	if !reflect.DeepEqual(cd.DBs["db1"].Spec.Followers, []string{"newdb1", "newdb2"}) {
+		t.Errorf("got master followers: %v, want: %v", cd.DBs["db1"].Spec.Followers, []string{"newdb1", "newdb2"})
+	}
+}
+
+func TestPGUpgradeAbort(t *testing.T) {
+	tests := []struct {
+		name     string
+		cd       func(cd *cluster.ClusterData)
+		masterOK bool
+		// phase is the upgrade phase after the sentinel check
+		phase        cluster.PGUpgradePhase
+		clusterPhase cluster.ClusterPhase
+		reason       string
+	}{
+		{
+			name:         "master failed",
+			phase:        cluster.PGUpgradePhaseAborted,
+			clusterPhase: cluster.ClusterPhaseNormal,
+			reason:       "the master db is failed",
+		},
+		{
+			name:     "switchover in progress",
+			masterOK: true,
+			cd: func(cd *cluster.ClusterData) {
+				cd.Cluster.Status.Switchover = &cluster.Switchover{TargetKeeper: "keeper2"}
+			},
+			phase:        cluster.PGUpgradePhaseRequested,
+			clusterPhase: cluster.ClusterPhaseNormal,
+		},
+		{
+			name:     "master keeper kept the previous binaries",
+			masterOK: true,
+			cd: func(cd *cluster.ClusterData) {
+				startPGUpgrade(cd, cd.DBs["db1"], true)
+			},
+			phase:        cluster.PGUpgradePhaseAborted,
+			clusterPhase: cluster.ClusterPhaseNormal,
+			reason:       `keeper "keeper1" didn't switch to the new postgres binaries, see its logs`,
+		},
+		{
+			name:     "aborted by the user",
+			masterOK: true,
+			cd: func(cd *cluster.ClusterData) {
+				startPGUpgrade(cd, cd.DBs["db1"], true)
+				cd.DBs["db1"].Generation++
+				cd.Cluster.Status.PGUpgrade.Phase = cluster.PGUpgradePhaseAborted
+				cd.Cluster.Status.PGUpgrade.Reason = "aborted by the user"
+			},
+			phase:        cluster.PGUpgradePhaseAborted,
+			clusterPhase: cluster.ClusterPhaseNormal,
+			reason:       "aborted by the user",
+		},
+		{
+			name:     "master keeper removed",
+			masterOK: true,
+			cd: func(cd *cluster.ClusterData) {
+				startPGUpgrade(cd, cd.DBs["db1"], true)
+				delete(cd.Keepers, "keeper1")
+			},
+			phase:        cluster.PGUpgradePhaseAborted,
+			clusterPhase: cluster.ClusterPhaseNormal,
+			reason:       `master keeper "keeper1" has been removed`,
+		},
+	}
+
+	for i, tt := range tests {
+		s := &Sentinel{uid: "sentinel01", UIDFn: testPGUpgradeUIDFn()}
+		cd := testPGUpgradeClusterData(1)
+		if tt.cd != nil {
+			tt.cd(cd)
+		}
+		if cd.Cluster.Status.Phase == cluster.ClusterPhaseUpgrade {
+			s.handlePGUpgrade(cd)
+		} else {
+			startPGUpgrade(cd, cd.DBs["db1"], tt.masterOK)
+		}
+		u := cd.Cluster.Status.PGUpgrade
+		if u.Phase != tt.phase {
+			t.Errorf("#%d (%s): got phase: %q, want: %q", i, tt.name, u.Phase, tt.phase)
+		}
+		if u.Reason != tt.reason {
+			t.Errorf("#%d (%s): got reason: %q, want: %q", i, tt.name, u.Reason, tt.reason)
+		}
+		if cd.Cluster.Status.Phase != tt.clusterPhase {
+			t.Errorf("#%d (%s): got cluster phase: %q, want: %q", i, tt.name, cd.Cluster.Status.Phase, tt.clusterPhase)
+		}
+		if cd.DBs["db1"].Spec.PGUpgrade {
+			t.Errorf("#%d (%s): upgrade still requested to the master db", i, tt.name)
+		}
+		// the master keeper previous binaries are restored
+		if k, ok := cd.Keepers["keeper1"]; ok && k.Spec.PGBinPath != "" {
+			t.Errorf("#%d (%s): got master keeper pg bin path: %q, want: %q", i, tt.name, k.Spec.PGBinPath, "")
+		}
+		if _, ok := cd.DBs["db2"]; !ok {
+			t.Errorf("#%d (%s): standby db2 replaced", i, tt.name)
+		}
+	}
+}
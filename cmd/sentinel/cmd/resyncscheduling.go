@@ -0,0 +1,53 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+// allowedResyncs returns how many of the n requested new standbys, that will
+// be fully resynced, can be added at the provided time by the cluster spec
+// resyncScheduling: none outside its windows and no more than the
+// maxConcurrentResyncs minus the converging standbys still resyncing.
+func allowedResyncs(s *cluster.ResyncScheduling, convergingStandbys map[string]*cluster.DB, n int, now time.Time) int {
+	if s == nil || n <= 0 {
+		return n
+	}
+	if !s.InWindow(now) {
+		log.Infow("not adding new standby dbs outside the resyncScheduling windows", "windows", s.Windows)
+		return 0
+	}
+	if s.MaxConcurrentResyncs == 0 {
+		return n
+	}
+	resyncing := 0
+	for _, db := range convergingStandbys {
+		if db.Spec.InitMode == cluster.DBInitModeResync {
+			resyncing++
+		}
+	}
+	allowed := int(s.MaxConcurrentResyncs) - resyncing
+	if allowed < 0 {
+		allowed = 0
+	}
+	if allowed < n {
+		log.Infow("delaying the new standby dbs since the resyncScheduling maxConcurrentResyncs has been reached", "resyncing", resyncing, "maxConcurrentResyncs", s.MaxConcurrentResyncs, "delayed", n-allowed)
+		return allowed
+	}
+	return n
+}
@@ -0,0 +1,104 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+func TestAllowedResyncs(t *testing.T) {
+	// 03:30 UTC
+	now := time.Date(2018, 6, 1, 3, 30, 0, 0, time.UTC)
+	converging := map[string]*cluster.DB{
+		"db2": {UID: "db2", Spec: &cluster.DBSpec{InitMode: cluster.DBInitModeResync}},
+		"db3": {UID: "db3", Spec: &cluster.DBSpec{InitMode: cluster.DBInitModeNone}},
+	}
+	tests := []struct {
+		name    string
+		s       *cluster.ResyncScheduling
+		n       int
+		allowed int
+	}{
+		{
+			name:    "no resync scheduling",
+			n:       3,
+			allowed: 3,
+		},
+		{
+			name:    "no limits",
+			s:       &cluster.ResyncScheduling{MaxRate: "10M"},
+			n:       3,
+			allowed: 3,
+		},
+		{
+			name:    "max concurrent resyncs",
+			s:       &cluster.ResyncScheduling{MaxConcurrentResyncs: 2},
+			n:       3,
+			allowed: 1,
+		},
+		{
+			name:    "max concurrent resyncs reached",
+			s:       &cluster.ResyncScheduling{MaxConcurrentResyncs: 1},
+			n:       3,
+			allowed: 0,
+		},
+		{
+			name:    "max concurrent resyncs not reached",
+			s:       &cluster.ResyncScheduling{MaxConcurrentResyncs: 5},
+			n:       3,
+			allowed: 3,
+		},
+		{
+			name:    "inside window",
+			s:       &cluster.ResyncScheduling{Windows: []string{"12:00-13:00", "03:00-04:00"}},
+			n:       3,
+			allowed: 3,
+		},
+		{
+			name:    "inside window spanning midnight",
+			s:       &cluster.ResyncScheduling{Windows: []string{"22:00-04:00"}},
+			n:       3,
+			allowed: 3,
+		},
+		{
+			name:    "outside window",
+			s:       &cluster.ResyncScheduling{Windows: []string{"22:00-03:30"}},
+			n:       3,
+			allowed: 0,
+		},
+		{
+			name:    "inside window with max concurrent resyncs",
+			s:       &cluster.ResyncScheduling{MaxConcurrentResyncs: 2, Windows: []string{"03:30-04:00"}},
+			n:       3,
+			allowed: 1,
+		},
+		{
+			name:    "no requested standbys",
+			s:       &cluster.ResyncScheduling{MaxConcurrentResyncs: 2},
+			n:       -1,
+			allowed: -1,
+		},
+	}
+
+	for i, tt := range tests {
+		allowed := allowedResyncs(tt.s, converging, tt.n, now)
+		if allowed != tt.allowed {
+			t.Errorf("#%d (%s): got %d allowed resyncs, want: %d", i, tt.name, allowed, tt.allowed)
+		}
+	}
+}
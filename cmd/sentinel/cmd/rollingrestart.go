@@ -0,0 +1,226 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/util"
+)
+
+// keeperDB returns the db assigned to the keeper
+func keeperDB(cd *cluster.ClusterData, keeperUID string) *cluster.DB {
+	for _, db := range cd.DBs {
+		if db.Spec.KeeperUID == keeperUID {
+			return db
+		}
+	}
+	return nil
+}
+
+// dbRestarted reports if the db has handled its restart request and, when it
+// is a synchronous standby, if it's back in sync with the master. Waiting for
+// the synchronous standbys avoids restarting the next one while the master
+// has less synchronous standbys than required.
+func dbRestarted(masterDB, db *cluster.DB) bool {
+	if db.Status.RestartRequest < db.Spec.RestartRequest || db.Status.CurrentGeneration != db.Generation || !db.Status.Healthy {
+		return false
+	}
+	if db.UID != masterDB.UID && util.StringInSlice(masterDB.Spec.SynchronousStandbys, db.UID) {
+		return util.StringInSlice(masterDB.Status.SynchronousStandbys, db.UID)
+	}
+	return true
+}
+
+// nextRollingRestartStandby returns the next standby db to restart: the
+// asynchronous standbys are restarted before the synchronous ones. The not
+// healthy standbys are skipped.
+func nextRollingRestartStandby(cd *cluster.ClusterData, masterDB *cluster.DB, rr *cluster.RollingRestart) *cluster.DB {
+	standbys := []*cluster.DB{}
+	for _, db := range cd.DBs {
+		if db.UID == masterDB.UID || util.StringInSlice(rr.RestartedKeepers, db.Spec.KeeperUID) {
+			continue
+		}
+		if !db.Status.Healthy {
+			log.Warnw("not restarting not healthy standby db", "db", db.UID, "keeper", db.Spec.KeeperUID)
+			continue
+		}
+		standbys = append(standbys, db)
+	}
+	sort.Slice(standbys, func(i, j int) bool {
+		si := util.StringInSlice(masterDB.Spec.SynchronousStandbys, standbys[i].UID)
+		sj := util.StringInSlice(masterDB.Spec.SynchronousStandbys, standbys[j].UID)
+		if si != sj {
+			return !si
+		}
+		return standbys[i].Spec.KeeperUID < standbys[j].Spec.KeeperUID
+	})
+	if len(standbys) == 0 {
+		return nil
+	}
+	return standbys[0]
+}
+
+// extensionsRestartNeeded returns the shared preload libraries required by the
+// cluster spec extensions when a rolling restart is needed to load them: a
+// healthy db doesn't have them all loaded and all the healthy dbs have
+// converged to their spec (so their keepers have configured them). The
+// rolling restart isn't requested again for the same libraries (i.e. when it
+// has been aborted since a library cannot be loaded).
+func extensionsRestartNeeded(cd *cluster.ClusterData) []string {
+	libs := cluster.ExtensionsSharedPreloadLibraries(cd.Cluster.DefSpec().Extensions)
+	if len(libs) == 0 {
+		return nil
+	}
+	if rr := cd.Cluster.Status.RollingRestart; rr != nil && util.CompareStringSlice(rr.SharedPreloadLibraries, libs) {
+		return nil
+	}
+	needed := false
+	for _, db := range cd.DBs {
+		if !db.Status.Healthy {
+			continue
+		}
+		if db.Status.CurrentGeneration != db.Generation {
+			return nil
+		}
+		if len(util.Difference(libs, db.Status.SharedPreloadLibraries)) > 0 {
+			needed = true
+		}
+	}
+	if !needed {
+		return nil
+	}
+	return libs
+}
+
+func requestDBRestart(rr *cluster.RollingRestart, db *cluster.DB) {
+	log.Infow("requesting db restart", "db", db.UID, "keeper", db.Spec.KeeperUID)
+	db.Spec.RestartRequest++
+	rr.RestartingKeeper = db.Spec.KeeperUID
+}
+
+func endRollingRestart(rr *cluster.RollingRestart, phase cluster.RollingRestartPhase, reason string) {
+	rr.Phase = phase
+	rr.Reason = reason
+	rr.RestartingKeeper = ""
+	rr.EndTime = time.Now()
+}
+
+// handleRollingRestart advances the rolling restart in progress: it restarts
+// the standbys one at a time, waiting for every restarted db to be healthy
+// (and, if a synchronous standby, back in sync), then requests a switchover
+// to a restarted standby and finally restarts the old master. Without
+// standbys the master is restarted in place. The rolling restart is aborted
+// when the master db fails, a db doesn't restart before the convergence
+// timeout or the switchover is aborted. The old master is restarted when it
+// has rejoined the cluster as a standby.
+func (s *Sentinel) handleRollingRestart(newcd *cluster.ClusterData, curMasterDB *cluster.DB, masterOK bool) {
+	rr := newcd.Cluster.Status.RollingRestart
+	abort := func(reason string) {
+		log.Warnw("aborting rolling restart", "reason", reason)
+		endRollingRestart(rr, cluster.RollingRestartPhaseAborted, reason)
+	}
+
+	if rr.Phase == cluster.RollingRestartPhaseRequested {
+		log.Infow("starting rolling restart", "masterKeeper", curMasterDB.Spec.KeeperUID)
+		rr.MasterKeeper = curMasterDB.Spec.KeeperUID
+		rr.Phase = cluster.RollingRestartPhaseStandbys
+		rr.StartTime = time.Now()
+	}
+
+	if rr.RestartingKeeper != "" {
+		db := keeperDB(newcd, rr.RestartingKeeper)
+		if db == nil {
+			abort(fmt.Sprintf("keeper %q db has been removed", rr.RestartingKeeper))
+			return
+		}
+		if !dbRestarted(curMasterDB, db) {
+			if s.dbConvergenceState(db, newcd.Cluster.DefSpec().ConvergenceTimeout.Duration) == ConvergenceFailed {
+				abort(fmt.Sprintf("keeper %q db didn't restart before the convergence timeout", rr.RestartingKeeper))
+				return
+			}
+			log.Infow("waiting for db restart", "db", db.UID, "keeper", rr.RestartingKeeper)
+			return
+		}
+		log.Infow("db restarted", "db", db.UID, "keeper", rr.RestartingKeeper)
+		rr.RestartedKeepers = append(rr.RestartedKeepers, rr.RestartingKeeper)
+		rr.RestartingKeeper = ""
+	}
+
+	// the master is restarted only in the last phase
+	if !masterOK && rr.Phase != cluster.RollingRestartPhaseOldMaster {
+		abort("the master db is failed")
+		return
+	}
+
+	switch rr.Phase {
+	case cluster.RollingRestartPhaseStandbys:
+		if db := nextRollingRestartStandby(newcd, curMasterDB, rr); db != nil {
+			requestDBRestart(rr, db)
+			return
+		}
+		if len(rr.RestartedKeepers) == 0 {
+			log.Infow("no standbys available, restarting the master db in place", "db", curMasterDB.UID, "keeper", curMasterDB.Spec.KeeperUID)
+			rr.Phase = cluster.RollingRestartPhaseOldMaster
+			requestDBRestart(rr, newcd.DBs[curMasterDB.UID])
+			return
+		}
+		var targetDB *cluster.DB
+		for _, keeperUID := range rr.RestartedKeepers {
+			if db := s.findFailoverTargetDB(newcd, curMasterDB, keeperUID, false); db != nil {
+				targetDB = db
+				break
+			}
+		}
+		if targetDB == nil {
+			abort("no restarted standby can be elected as the new master")
+			return
+		}
+		log.Infow("standbys restarted, switching over to a restarted standby", "db", targetDB.UID, "keeper", targetDB.Spec.KeeperUID)
+		newcd.Cluster.Status.Switchover = &cluster.Switchover{
+			TargetKeeper: targetDB.Spec.KeeperUID,
+			Phase:        cluster.SwitchoverPhaseRequested,
+		}
+		rr.Phase = cluster.RollingRestartPhaseSwitchover
+	case cluster.RollingRestartPhaseSwitchover:
+		if newcd.Cluster.Status.Switchover != nil {
+			log.Infow("waiting for the rolling restart switchover")
+			return
+		}
+		if curMasterDB.Spec.KeeperUID == rr.MasterKeeper {
+			abort("the switchover has been aborted")
+			return
+		}
+		oldMasterDB := keeperDB(newcd, rr.MasterKeeper)
+		if oldMasterDB == nil {
+			abort(fmt.Sprintf("old master keeper %q db has been removed", rr.MasterKeeper))
+			return
+		}
+		if !oldMasterDB.Status.Healthy || oldMasterDB.Status.CurrentGeneration != oldMasterDB.Generation {
+			log.Infow("waiting for the old master db to rejoin the cluster as a standby", "db", oldMasterDB.UID, "keeper", rr.MasterKeeper)
+			return
+		}
+		rr.Phase = cluster.RollingRestartPhaseOldMaster
+		requestDBRestart(rr, oldMasterDB)
+	case cluster.RollingRestartPhaseOldMaster:
+		log.Infow("rolling restart completed")
+		endRollingRestart(rr, cluster.RollingRestartPhaseCompleted, "")
+	default:
+		abort(fmt.Sprintf("unknown phase %q", rr.Phase))
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+)
+
+// testRollingRestartClusterData returns a cluster data with the master db1,
+// the synchronous standby db2 and the asynchronous standby db3
+func testRollingRestartClusterData(standbys int) *cluster.ClusterData {
+	cd := &cluster.ClusterData{
+		Cluster: &cluster.Cluster{
+			Spec: &cluster.ClusterSpec{SynchronousReplication: cluster.BoolP(true)},
+			Status: cluster.ClusterStatus{
+				Phase:          cluster.ClusterPhaseNormal,
+				Master:         "db1",
+				RollingRestart: &cluster.RollingRestart{Phase: cluster.RollingRestartPhaseRequested},
+			},
+		},
+		Keepers: cluster.Keepers{},
+		DBs:     cluster.DBs{},
+		Proxy: &cluster.Proxy{
+			Generation: 1,
+			Spec:       cluster.ProxySpec{MasterDBUID: "db1"},
+		},
+	}
+	for i := 1; i <= standbys+1; i++ {
+		uid := fmt.Sprintf("db%d", i)
+		keeperUID := fmt.Sprintf("keeper%d", i)
+		cd.Keepers[keeperUID] = &cluster.Keeper{UID: keeperUID, Spec: &cluster.KeeperSpec{}, Status: cluster.KeeperStatus{Healthy: true}}
+		cd.DBs[uid] = &cluster.DB{
+			UID:        uid,
+			Generation: 1,
+			Spec: &cluster.DBSpec{
+				KeeperUID:    keeperUID,
+				Role:         common.RoleStandby,
+				FollowConfig: &cluster.FollowConfig{Type: cluster.FollowTypeInternal, DBUID: "db1"},
+			},
+			Status: cluster.DBStatus{Healthy: true, CurrentGeneration: 1, XLogPos: 1000},
+		}
+	}
+	master := cd.DBs["db1"]
+	master.Spec.Role = common.RoleMaster
+	master.Spec.FollowConfig = nil
+	master.Spec.SynchronousReplication = true
+	if standbys > 0 {
+		master.Spec.SynchronousStandbys = []string{"db2"}
+		master.Status.SynchronousStandbys = []string{"db2"}
+	}
+	return cd
+}
+
+func TestHandleRollingRestart(t *testing.T) {
+	s := &Sentinel{uid: "sentinel01"}
+	cd := testRollingRestartClusterData(2)
+	rr := cd.Cluster.Status.RollingRestart
+
+	check := func(step string, phase cluster.RollingRestartPhase, restartingKeeper string) {
+		t.Helper()
+		if rr.Phase != phase {
+			t.Fatalf("%s: got phase: %q, want: %q (reason: %q)", step, rr.Phase, phase, rr.Reason)
+		}
+		if rr.RestartingKeeper != restartingKeeper {
+			t.Fatalf("%s: got restarting keeper: %q, want: %q", step, rr.RestartingKeeper, restartingKeeper)
+		}
+	}
+
+	// the asynchronous standby is restarted first
+	s.handleRollingRestart(cd, cd.DBs["db1"], true)
+	check("start", cluster.RollingRestartPhaseStandbys, "keeper3")
+	if cd.DBs["db3"].Spec.RestartRequest != 1 {
+		t.Fatalf("got db3 restart request: %d, want: %d", cd.DBs["db3"].Spec.RestartRequest, 1)
+	}
+	s.handleRollingRestart(cd, cd.DBs["db1"], true)
+	check("db3 restarting", cluster.RollingRestartPhaseStandbys, "keeper3")
+
+	cd.DBs["db3"].Status.RestartRequest = 1
+	s.handleRollingRestart(cd, cd.DBs["db1"], true)
+	check("db3 restarted", cluster.RollingRestartPhaseStandbys, "keeper2")
+
+	// the synchronous standby must be back in sync
+	cd.DBs["db2"].Status.RestartRequest = 1
+	cd.DBs["db1"].Status.SynchronousStandbys = []string{}
+	s.handleRollingRestart(cd, cd.DBs["db1"], true)
+	check("db2 not in sync", cluster.RollingRestartPhaseStandbys, "keeper2")
+
+	// the switchover target must be the synchronous standby
+	cd.DBs["db1"].Status.SynchronousStandbys = []string{"db2"}
+	s.handleRollingRestart(cd, cd.DBs["db1"], true)
+	check("standbys restarted", cluster.RollingRestartPhaseSwitchover, "")
+	if sw := cd.Cluster.Status.Switchover; sw == nil || sw.TargetKeeper != "keeper2" {
+		t.Fatalf("got switchover: %+v, want switchover to keeper2", sw)
+	}
+	s.handleRollingRestart(cd, cd.DBs["db1"], true)
+	check("switchover in progress", cluster.RollingRestartPhaseSwitchover, "")
+
+	// switchover completed, the old master is restarted when it has rejoined
+	// the cluster
+	cd.Cluster.Status.Switchover = nil
+	cd.Cluster.Status.Master = "db2"
+	cd.DBs["db2"].Spec.Role = common.RoleMaster
+	cd.DBs["db1"].Spec.Role = common.RoleStandby
+	cd.DBs["db1"].Status.Healthy = false
+	s.handleRollingRestart(cd, cd.DBs["db2"], true)
+	check("old master not rejoined", cluster.RollingRestartPhaseSwitchover, "")
+
+	cd.DBs["db1"].Status.Healthy = true
+	s.handleRollingRestart(cd, cd.DBs["db2"], true)
+	check("old master rejoined", cluster.RollingRestartPhaseOldMaster, "keeper1")
+	if cd.DBs["db1"].Spec.RestartRequest != 1 {
+		t.Fatalf("got db1 restart request: %d, want: %d", cd.DBs["db1"].Spec.RestartRequest, 1)
+	}
+
+	cd.DBs["db1"].Status.RestartRequest = 1
+	s.handleRollingRestart(cd, cd.DBs["db2"], true)
+	check("old master restarted", cluster.RollingRestartPhaseCompleted, "")
+	expected := []string{"keeper3", "keeper2", "keeper1"}
+	if fmt.Sprint(rr.RestartedKeepers) != fmt.Sprint(expected) {
+		t.Errorf("got restarted keepers: %v, want: %v", rr.RestartedKeepers, expected)
+	}
+	if rr.InProgress() {
+		t.Errorf("completed rolling restart reported in progress")
+	}
+}
+
+func TestHandleRollingRestartAbort(t *testing.T) {
+	tests := []struct {
+		name     string
+		standbys int
+		cd       func(cd *cluster.ClusterData)
+		masterOK bool
+		phase    cluster.RollingRestartPhase
+		reason   string
+	}{
+		{
+			name:     "master in place restart",
+			standbys: 0,
+			masterOK: true,
+			phase:    cluster.RollingRestartPhaseOldMaster,
+		},
+		{
+			name:     "master failed",
+			standbys: 1,
+			phase:    cluster.RollingRestartPhaseAborted,
+			reason:   "the master db is failed",
+		},
+		{
+			name:     "switchover aborted",
+			standbys: 1,
+			masterOK: true,
+			cd: func(cd *cluster.ClusterData) {
+				cd.Cluster.Status.RollingRestart = &cluster.RollingRestart{Phase: cluster.RollingRestartPhaseSwitchover, MasterKeeper: "keeper1", RestartedKeepers: []string{"keeper2"}}
+			},
+			phase:  cluster.RollingRestartPhaseAborted,
+			reason: "the switchover has been aborted",
+		},
+		{
+			name:     "restarting db removed",
+			standbys: 1,
+			masterOK: true,
+			cd: func(cd *cluster.ClusterData) {
+				cd.Cluster.Status.RollingRestart = &cluster.RollingRestart{Phase: cluster.RollingRestartPhaseStandbys, MasterKeeper: "keeper1", RestartingKeeper: "keeper9"}
+			},
+			phase:  cluster.RollingRestartPhaseAborted,
+			reason: `keeper "keeper9" db has been removed`,
+		},
+		{
+			name:     "no switchover target",
+			standbys: 1,
+			masterOK: true,
+			cd: func(cd *cluster.ClusterData) {
+				cd.DBs["db1"].Status.SynchronousStandbys = []string{}
+				cd.Cluster.Status.RollingRestart = &cluster.RollingRestart{Phase: cluster.RollingRestartPhaseStandbys, MasterKeeper: "keeper1", RestartedKeepers: []string{"keeper2"}}
+			},
+			phase:  cluster.RollingRestartPhaseAborted,
+			reason: "no restarted standby can be elected as the new master",
+		},
+	}
+
+	for i, tt := range tests {
+		s := &Sentinel{uid: "sentinel01"}
+		cd := testRollingRestartClusterData(tt.standbys)
+		if tt.cd != nil {
+			tt.cd(cd)
+		}
+		s.handleRollingRestart(cd, cd.DBs["db1"], tt.masterOK)
+		rr := cd.Cluster.Status.RollingRestart
+		if rr.Phase != tt.phase {
+			t.Errorf("#%d (%s): got phase: %q, want: %q", i, tt.name, rr.Phase, tt.phase)
+		}
+		if rr.Reason != tt.reason {
+			t.Errorf("#%d (%s): got reason: %q, want: %q", i, tt.name, rr.Reason, tt.reason)
+		}
+	}
+}
+
+func TestExtensionsRestartNeeded(t *testing.T) {
+	libs := []string{"pg_stat_statements", "pgaudit"}
+	tests := []struct {
+		name string
+		cdFn func(cd *cluster.ClusterData)
+		out  []string
+	}{
+		{
+			name: "no extensions",
+			cdFn: func(cd *cluster.ClusterData) {
+				cd.Cluster.Spec.Extensions = nil
+			},
+		},
+		{
+			name: "libraries not loaded",
+			cdFn: func(cd *cluster.ClusterData) {
+				cd.DBs["db2"].Status.SharedPreloadLibraries = []string{"pg_stat_statements"}
+			},
+			out: libs,
+		},
+		{
+			name: "libraries loaded",
+			cdFn: func(cd *cluster.ClusterData) {
+				for _, db := range cd.DBs {
+					db.Status.SharedPreloadLibraries = []string{"auto_explain", "pg_stat_statements", "pgaudit"}
+				}
+			},
+		},
+		{
+			name: "not loaded by a not healthy db",
+			cdFn: func(cd *cluster.ClusterData) {
+				for _, db := range cd.DBs {
+					db.Status.SharedPreloadLibraries = libs
+				}
+				cd.DBs["db3"].Status.SharedPreloadLibraries = nil
+				cd.DBs["db3"].Status.Healthy = false
+			},
+		},
+		{
+			name: "db not converged",
+			cdFn: func(cd *cluster.ClusterData) {
+				cd.DBs["db2"].Generation = 2
+			},
+		},
+		{
+			name: "already restarted for the same libraries",
+			cdFn: func(cd *cluster.ClusterData) {
+				cd.Cluster.Status.RollingRestart = &cluster.RollingRestart{Phase: cluster.RollingRestartPhaseAborted, SharedPreloadLibraries: libs}
+			},
+		},
+		{
+			name: "restarted for other libraries",
+			cdFn: func(cd *cluster.ClusterData) {
+				cd.Cluster.Status.RollingRestart = &cluster.RollingRestart{Phase: cluster.RollingRestartPhaseCompleted, SharedPreloadLibraries: []string{"pg_stat_statements"}}
+			},
+			out: libs,
+		},
+	}
+
+	for i, tt := range tests {
+		cd := testRollingRestartClusterData(2)
+		cd.Cluster.Status.RollingRestart = nil
+		cd.Cluster.Spec.Extensions = []cluster.Extension{
+			{Name: "pgaudit", SharedPreloadLibraries: []string{"pgaudit"}},
+			{Name: "pg_stat_statements", SharedPreloadLibraries: []string{"pg_stat_statements"}},
+		}
+		if tt.cdFn != nil {
+			tt.cdFn(cd)
+		}
+		out := extensionsRestartNeeded(cd)
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d (%s): got libraries: %v, want: %v", i, tt.name, out, tt.out)
+		}
+	}
+}
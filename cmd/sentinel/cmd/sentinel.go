@@ -15,20 +15,25 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"reflect"
 	"sort"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sorintlab/stolon/cmd"
 	"github.com/sorintlab/stolon/internal/cluster"
@@ -36,14 +41,17 @@ import (
 	"github.com/sorintlab/stolon/internal/flagutil"
 	slog "github.com/sorintlab/stolon/internal/log"
 	"github.com/sorintlab/stolon/internal/postgresql"
+	"github.com/sorintlab/stolon/internal/sentinelapi"
 	"github.com/sorintlab/stolon/internal/store"
 	"github.com/sorintlab/stolon/internal/timer"
+	"github.com/sorintlab/stolon/internal/tracing"
 	"github.com/sorintlab/stolon/internal/util"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/mitchellh/copystructure"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
 var log = slog.S()
@@ -61,6 +69,17 @@ var CmdSentinel = &cobra.Command{
 type config struct {
 	cmd.CommonConfig
 	initialClusterSpecFile string
+	storeBatchReads        bool
+	notificationURLs       []string
+	notificationTimeout    int
+	notificationRetries    int
+	eventsLogSize          int
+	clusterResource        string
+	dryRun                 bool
+	apiListenAddress       string
+	apiTokenFile           string
+	apiTLSCertFile         string
+	apiTLSKeyFile          string
 	debug                  bool
 }
 
@@ -70,6 +89,18 @@ func init() {
 	cmd.AddCommonFlags(CmdSentinel, &cfg.CommonConfig)
 
 	CmdSentinel.PersistentFlags().StringVar(&cfg.initialClusterSpecFile, "initial-cluster-spec", "", "a file providing the initial cluster specification, used only at cluster initialization, ignored if cluster is already initialized")
+	CmdSentinel.PersistentFlags().BoolVar(&cfg.storeBatchReads, "store-batch-reads", false, "read keepers and proxies info with a single store request when supported by the store backend (useful on clusters with many keepers)")
+	CmdSentinel.PersistentFlags().DurationVar(&cfg.StoreElectionTTL, "store-election-ttl", 0, "ttl of the sentinel leadership lease in the store. A lower ttl makes a new leader sentinel be elected faster when the current one fails, but increases the risk of losing the leadership on a slow store. 0 uses the default (20s for etcd and consul, 15s for kubernetes). With consul it must be at least 20s")
+	CmdSentinel.PersistentFlags().StringSliceVar(&cfg.notificationURLs, "notification-url", nil, "url where the leader sentinel POSTs a json payload for every cluster event (masterElected, keeperFailed, synchronousStandbysChanged, clusterUnhealthy and clusterHealthy). Can be specified multiple times. Failed requests (also with a non 2xx response status) are retried and then only logged")
+	CmdSentinel.PersistentFlags().IntVar(&cfg.notificationTimeout, "notification-timeout", 10, "timeout in seconds of a notification url request")
+	CmdSentinel.PersistentFlags().IntVar(&cfg.notificationRetries, "notification-retries", 3, "number of retries of a failed notification url request")
+	CmdSentinel.PersistentFlags().IntVar(&cfg.eventsLogSize, "events-log-size", 0, "number of cluster events kept in the store event log (shown by stolonctl events). 0 disables the event log")
+	CmdSentinel.PersistentFlags().StringVar(&cfg.clusterResource, "cluster-resource", "", "name of a StolonCluster kubernetes custom resource (in the sentinel namespace) defining the cluster spec. The leader sentinel applies the resource spec to the cluster (also initializing it) and reports the cluster state in the resource status")
+	CmdSentinel.PersistentFlags().BoolVar(&cfg.dryRun, "dry-run", false, "observe only mode: the leader sentinel computes and logs (and reports in its metrics and events) the cluster data changes it would do without writing them. Also enabled by the cluster spec sentinelDryRun option")
+	CmdSentinel.PersistentFlags().StringVar(&cfg.apiListenAddress, "api-listen-address", "", "listen address of the management api (used by stolonctl --api-endpoints). Only the leader sentinel serves the api requests")
+	CmdSentinel.PersistentFlags().StringVar(&cfg.apiTokenFile, "api-token-file", "", "file containing the token the management api clients must provide. Required with --api-listen-address")
+	CmdSentinel.PersistentFlags().StringVar(&cfg.apiTLSCertFile, "api-tls-cert-file", "", "certificate file used to serve the management api over https")
+	CmdSentinel.PersistentFlags().StringVar(&cfg.apiTLSKeyFile, "api-tls-key-file", "", "private key file of --api-tls-cert-file")
 	CmdSentinel.PersistentFlags().BoolVar(&cfg.debug, "debug", false, "enable debug logging (deprecated, use log-level instead)")
 
 	CmdSentinel.PersistentFlags().MarkDeprecated("debug", "use --log-level=debug instead")
@@ -119,9 +150,11 @@ func (s *Sentinel) syncRepl(spec *cluster.ClusterSpec) bool {
 	return *spec.SynchronousReplication && *spec.Role == cluster.ClusterRoleMaster
 }
 
-func (s *Sentinel) setSentinelInfo(ctx context.Context, ttl time.Duration) error {
+func (s *Sentinel) setSentinelInfo(ctx context.Context, ttl time.Duration, dbsReachability map[string]bool) error {
 	sentinelInfo := &cluster.SentinelInfo{
-		UID: s.uid,
+		UID:             s.uid,
+		DBsReachability: dbsReachability,
+		Time:            time.Now(),
 	}
 	log.Debugw("sentinelInfo dump", "sentinelInfo", sentinelInfo)
 
@@ -217,6 +250,10 @@ func (s *Sentinel) updateKeepersStatus(cd *cluster.ClusterData, keepersInfo clus
 
 	// Create new keepers from keepersInfo
 	for keeperUID, ki := range keepersInfo {
+		// a removed keeper still running must not be registered again
+		if ki.Removal != nil && ki.Removal.Completed {
+			continue
+		}
 		if _, ok := cd.Keepers[keeperUID]; !ok {
 			k := cluster.NewKeeperFromKeeperInfo(ki)
 			cd.Keepers[k.UID] = k
@@ -234,6 +271,20 @@ func (s *Sentinel) updateKeepersStatus(cd *cluster.ClusterData, keepersInfo clus
 			k.Status.BootUUID = ki.BootUUID
 			k.Status.PostgresBinaryVersion.Maj = ki.PostgresBinaryVersion.Maj
 			k.Status.PostgresBinaryVersion.Min = ki.PostgresBinaryVersion.Min
+			if ki.PostgresVersion != k.Status.PostgresVersion && k.Status.PostgresVersion != "" {
+				log.Infow("keeper postgres version changed", "keeper", keeperUID, "postgresVersion", ki.PostgresVersion, "previousPostgresVersion", k.Status.PostgresVersion)
+			}
+			k.Status.PostgresVersion = ki.PostgresVersion
+			k.Status.PGBinPath = ki.PGBinPath
+			if k.Spec == nil {
+				k.Spec = &cluster.KeeperSpec{}
+			}
+			k.Spec.Tags = ki.Tags
+			k.Spec.RecoveryMinApplyDelay = ki.RecoveryMinApplyDelay
+			if ki.Fenced != k.Status.Fenced {
+				log.Infow("keeper fenced state changed", "keeper", keeperUID, "fenced", ki.Fenced)
+			}
+			k.Status.Fenced = ki.Fenced
 		}
 	}
 
@@ -245,6 +296,9 @@ func (s *Sentinel) updateKeepersStatus(cd *cluster.ClusterData, keepersInfo clus
 			// reset ForceFail
 			k.Status.ForceFail = false
 		}
+		if k.Status.Fenced {
+			healthy = false
+		}
 		// set zero LastHealthyTime to time.Now() to avoid the keeper being
 		// removed since previous versions don't have it set
 		if k.Status.LastHealthyTime.IsZero() {
@@ -257,6 +311,7 @@ func (s *Sentinel) updateKeepersStatus(cd *cluster.ClusterData, keepersInfo clus
 	}
 
 	// Update dbs' states
+	reportedHealthyDBs := []*cluster.DB{}
 	for _, db := range cd.DBs {
 		// Mark not found DBs in DBstates in error
 		k, ok := keepersInfo[db.Spec.KeeperUID]
@@ -265,6 +320,38 @@ func (s *Sentinel) updateKeepersStatus(cd *cluster.ClusterData, keepersInfo clus
 			s.SetDBError(db.UID)
 			continue
 		}
+		// reported also when the db isn't initialized since the master role
+		// could be declined before initializing it
+		db.Status.MasterRoleDeclined = k.DeclinedMasterDBUID == db.UID
+		db.Status.PrePromotionHookResult = nil
+		if r := k.PrePromotionHookResult; r != nil && r.DBUID == db.UID {
+			db.Status.PrePromotionHookResult = r
+		}
+		// kept also when not reported (i.e. after a keeper restart) since
+		// it's recorded in the cluster init config
+		if r := k.PostInitHookResult; r != nil && r.DBUID == db.UID {
+			db.Status.PostInitHookResult = r
+		}
+		db.Status.TimelineDivergence = nil
+		if d := k.TimelineDivergence; d != nil && d.DBUID == db.UID {
+			db.Status.TimelineDivergence = d
+		}
+		db.Status.GracefulDemotion = nil
+		if d := k.GracefulDemotion; d != nil && d.DBUID == db.UID {
+			db.Status.GracefulDemotion = d
+		}
+		if v := k.ChecksumsVerification; v != nil && v.DBUID == db.UID {
+			db.Status.ChecksumsVerification = v
+		} else if v := db.Status.ChecksumsVerification; v != nil && v.Running {
+			// the keeper has been restarted during the verification
+			v.Running = false
+			v.EndTime = time.Now()
+			v.Error = "interrupted"
+		}
+		// kept also when not reported (i.e. after a keeper restart)
+		if v := k.ResyncVerification; v != nil && v.DBUID == db.UID {
+			db.Status.ResyncVerification = v
+		}
 		dbs := k.PostgresState
 		if dbs == nil {
 			log.Warnw("no db state available", "db", db.UID, "keeper", db.Spec.KeeperUID)
@@ -284,26 +371,47 @@ func (s *Sentinel) updateKeepersStatus(cd *cluster.ClusterData, keepersInfo clus
 			s.CleanDBNotIncreasingXLogPos(db.UID)
 		}
 
-		db.Status.ListenAddress = dbs.ListenAddress
+		db.Status.ListenAddress = cluster.SelectListenAddress(dbs.ListenAddress, dbs.AdditionalListenAddresses, *cd.Cluster.DefSpec().PreferredAddressFamily)
+		db.Status.ListenAddresses = nil
+		if len(dbs.AdditionalListenAddresses) > 0 {
+			db.Status.ListenAddresses = dbs.ListenAddresses()
+		}
 		db.Status.Port = dbs.Port
 		db.Status.CurrentGeneration = dbs.Generation
+		db.Status.RestartRequest = dbs.RestartRequest
 		if dbs.Healthy {
 			s.CleanDBError(db.UID)
 			db.Status.SystemID = dbs.SystemID
 			db.Status.TimelineID = dbs.TimelineID
 			db.Status.XLogPos = dbs.XLogPos
+			db.Status.ReplayXLogPos = dbs.ReplayXLogPos
+			db.Status.ReplayDelay = dbs.ReplayDelay
 			db.Status.TimelinesHistory = dbs.TimelinesHistory
 			db.Status.PGParameters = cluster.PGParameters(dbs.PGParameters)
+			db.Status.DataChecksums = dbs.DataChecksums
+			db.Status.SharedPreloadLibraries = dbs.SharedPreloadLibraries
+			db.Status.SSLCertNotAfter = dbs.SSLCertNotAfter
+			db.Status.ReplicationSlots = dbs.ReplicationSlots
+			db.Status.WalRetention = dbs.WalRetention
+			db.Status.Tablespaces = dbs.Tablespaces
+			db.Status.LogicalReplicationSlots = dbs.LogicalReplicationSlots
 
 			db.Status.CurSynchronousStandbys = dbs.SynchronousStandbys
 
 			db.Status.OlderWalFile = dbs.OlderWalFile
+
+			db.Status.PGParametersHash = dbs.PGParametersHash
+			db.Status.ExpectedPGParametersHash = dbs.ExpectedPGParametersHash
+
+			reportedHealthyDBs = append(reportedHealthyDBs, db)
 		} else {
 			s.SetDBError(db.UID)
 		}
 
 	}
 
+	s.probeDBs(cd, reportedHealthyDBs)
+
 	// Update dbs' healthy state
 	for _, db := range cd.DBs {
 		db.Status.Healthy = s.isDBHealthy(cd, db)
@@ -314,9 +422,256 @@ func (s *Sentinel) updateKeepersStatus(cd *cluster.ClusterData, keepersInfo clus
 		}
 	}
 
+	s.updateDBsReadiness(cd)
+
+	updateBackupStatus(cd, keepersInfo)
+
 	return cd, kihs
 }
 
+func probeDB(address string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeDBs, when enabled, verifies with a tcp connect to their listen address
+// that the dbs reported healthy by their keepers are really reachable. With
+// the "enforce" probe mode an unreachable db is handled like a db reported
+// unhealthy by its keeper, with the "advisory" probe mode it's only logged
+// (i.e. when the sentinel access to the dbs is blocked by a network policy).
+func (s *Sentinel) probeDBs(cd *cluster.ClusterData, dbs []*cluster.DB) {
+	clusterSpec := cd.Cluster.DefSpec()
+	mode := *clusterSpec.DBProbeMode
+	if mode == cluster.DBProbeModeNone {
+		return
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(dbs))
+	for i, db := range dbs {
+		wg.Add(1)
+		go func(i int, address string) {
+			defer wg.Done()
+			errs[i] = s.ProbeDBFn(address, clusterSpec.DBProbeTimeout.Duration)
+		}(i, net.JoinHostPort(db.Status.ListenAddress, db.Status.Port))
+	}
+	wg.Wait()
+
+	for i, db := range dbs {
+		if errs[i] == nil {
+			continue
+		}
+		if mode == cluster.DBProbeModeEnforce {
+			log.Warnw("db reported healthy by its keeper isn't reachable, marking it in error", "db", db.UID, "keeper", db.Spec.KeeperUID, "address", net.JoinHostPort(db.Status.ListenAddress, db.Status.Port), zap.Error(errs[i]))
+			s.SetDBError(db.UID)
+		} else {
+			log.Warnw("db reported healthy by its keeper isn't reachable", "db", db.UID, "keeper", db.Spec.KeeperUID, "address", net.JoinHostPort(db.Status.ListenAddress, db.Status.Port), zap.Error(errs[i]))
+		}
+	}
+}
+
+// dbsReachability probes, when the failover quorum is enabled, all the dbs with
+// a listen address and returns if they're reachable. It's done by every
+// sentinel and reported in its sentinel info.
+func (s *Sentinel) dbsReachability(cd *cluster.ClusterData) map[string]bool {
+	clusterSpec := cd.Cluster.DefSpec()
+	if *clusterSpec.FailoverQuorum == 0 {
+		return nil
+	}
+
+	dbs := []*cluster.DB{}
+	for _, db := range cd.DBs {
+		if db.Status.ListenAddress != "" && db.Status.Port != "" {
+			dbs = append(dbs, db)
+		}
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(dbs))
+	for i, db := range dbs {
+		wg.Add(1)
+		go func(i int, address string) {
+			defer wg.Done()
+			errs[i] = s.ProbeDBFn(address, clusterSpec.DBProbeTimeout.Duration)
+		}(i, net.JoinHostPort(db.Status.ListenAddress, db.Status.Port))
+	}
+	wg.Wait()
+
+	reachability := make(map[string]bool, len(dbs))
+	for i, db := range dbs {
+		reachability[db.UID] = errs[i] == nil
+	}
+	return reachability
+}
+
+// failoverQuorumReached reports if, when the failover quorum is enabled, at
+// least failoverQuorum other sentinels report the master db as unreachable
+func (s *Sentinel) failoverQuorumReached(cd *cluster.ClusterData, masterDB *cluster.DB) bool {
+	quorum := int(*cd.Cluster.DefSpec().FailoverQuorum)
+	if quorum == 0 {
+		return true
+	}
+	unreachable := 0
+	reporting := 0
+	for _, si := range s.sentinelsInfo {
+		if si.UID == s.uid {
+			continue
+		}
+		reachable, ok := si.DBsReachability[masterDB.UID]
+		if !ok {
+			continue
+		}
+		reporting++
+		if !reachable {
+			unreachable++
+		}
+	}
+	if unreachable < quorum {
+		log.Warnw("failover quorum not reached, not failing over the master db", "db", masterDB.UID, "keeper", masterDB.Spec.KeeperUID, "quorum", quorum, "unreachableReports", unreachable, "reportingSentinels", reporting)
+		return false
+	}
+	return true
+}
+
+// recoveryMinApplyDelay returns the apply delay reported by the db keeper or
+// nil if the db isn't a delayed standby
+func recoveryMinApplyDelay(cd *cluster.ClusterData, db *cluster.DB) *cluster.Duration {
+	k, ok := cd.Keepers[db.Spec.KeeperUID]
+	if !ok || k.Spec == nil || k.Spec.RecoveryMinApplyDelay == nil || k.Spec.RecoveryMinApplyDelay.Duration <= 0 {
+		return nil
+	}
+	return k.Spec.RecoveryMinApplyDelay
+}
+
+func isDelayedStandby(cd *cluster.ClusterData, db *cluster.DB) bool {
+	return recoveryMinApplyDelay(cd, db) != nil
+}
+
+// followsMaster reports if the db is a standby following the master directly
+// or, when it's a cascading standby, through other standbys
+func followsMaster(cd *cluster.ClusterData, masterDB, db *cluster.DB) bool {
+	// the followed dbs chain cannot be longer than the number of dbs
+	for i := 0; i < len(cd.DBs); i++ {
+		if db.UID == masterDB.UID || db.Spec.FollowConfig == nil || db.Spec.FollowConfig.Type != cluster.FollowTypeInternal {
+			return false
+		}
+		if db.Spec.FollowConfig.DBUID == masterDB.UID {
+			return true
+		}
+		followedDB, ok := cd.DBs[db.Spec.FollowConfig.DBUID]
+		if !ok {
+			return false
+		}
+		db = followedDB
+	}
+	return false
+}
+
+// isCascadingStandby reports if the db keeper is defined in the cluster spec
+// cascadingStandbys
+func isCascadingStandby(cd *cluster.ClusterData, db *cluster.DB) bool {
+	_, ok := cd.Cluster.DefSpec().CascadingStandbys[db.Spec.KeeperUID]
+	return ok
+}
+
+// isSyncStandbyCandidate reports if the standby db can be chosen as a
+// synchronous standby. Cascading standbys aren't directly connected to the
+// master and delayed standbys and the dbs of drained or in maintenance
+// keepers, since they aren't elected as the new master, would leave the
+// master without a synchronous standby to fail over to.
+func isSyncStandbyCandidate(cd *cluster.ClusterData, db *cluster.DB) bool {
+	return !isCascadingStandby(cd, db) && !isDelayedStandby(cd, db) && !isDrainedKeeper(cd, db.Spec.KeeperUID) && !isMaintenanceKeeper(cd, db.Spec.KeeperUID)
+}
+
+// isDrainedKeeper reports if the keeper has been drained for maintenance
+func isDrainedKeeper(cd *cluster.ClusterData, keeperUID string) bool {
+	k, ok := cd.Keepers[keeperUID]
+	return ok && k.Spec != nil && k.Spec.Drained
+}
+
+// isVerifyingChecksums reports if the keeper of the db is verifying its data
+// checksums (with the db stopped). A verification reported running for more
+// than its timeout is ignored.
+func isVerifyingChecksums(cd *cluster.ClusterData, db *cluster.DB) bool {
+	v := db.Status.ChecksumsVerification
+	if v == nil || !v.Running {
+		return false
+	}
+	spec := cd.Cluster.DefSpec()
+	timeout := cluster.DefaultChecksumsVerificationTimeout
+	if spec.ChecksumsVerificationConfig != nil {
+		timeout = spec.ChecksumsVerificationConfig.Timeout.Duration
+	}
+	return time.Since(v.StartTime) < timeout+spec.FailInterval.Duration
+}
+
+// isMaintenanceKeeper reports if the keeper is in maintenance mode
+func isMaintenanceKeeper(cd *cluster.ClusterData, keeperUID string) bool {
+	k, ok := cd.Keepers[keeperUID]
+	return ok && k.Spec != nil && k.Spec.Maintenance
+}
+
+// cascadingFollowedDB returns the db the standby db must follow: the db of
+// the keeper defined for it in the cluster spec cascadingStandbys when it's a
+// good standby, the master otherwise. Delayed standbys are never followed
+// since their followers will be delayed too, the dbs of drained or in
+// maintenance keepers since they could be stopped at any time.
+func (s *Sentinel) cascadingFollowedDB(cd *cluster.ClusterData, masterDB, db *cluster.DB) *cluster.DB {
+	followedKeeperUID, ok := cd.Cluster.DefSpec().CascadingStandbys[db.Spec.KeeperUID]
+	if !ok {
+		return masterDB
+	}
+	// a synchronous standby must keep following the master until it's
+	// removed from the synchronous standbys
+	if util.StringInSlice(masterDB.Spec.SynchronousStandbys, db.UID) {
+		return masterDB
+	}
+	for _, followedDB := range cd.DBs {
+		if followedDB.UID == db.UID || followedDB.Spec.KeeperUID != followedKeeperUID {
+			continue
+		}
+		if s.dbType(cd, followedDB.UID) != dbTypeStandby || s.dbStatus(cd, followedDB.UID) != dbStatusGood || isDelayedStandby(cd, followedDB) || isDrainedKeeper(cd, followedKeeperUID) || isMaintenanceKeeper(cd, followedKeeperUID) {
+			log.Debugw("cascading standby followed db isn't a good standby, following the master", "db", db.UID, "followedDB", followedDB.UID, "followedKeeper", followedKeeperUID)
+			return masterDB
+		}
+		return followedDB
+	}
+	return masterDB
+}
+
+// updateDBsReadiness updates the dbs' replication and replay lag and ready
+// state. A standby following the master isn't ready when its lag from the last
+// reported master xlog position is greater than MaxReadyStandbyLag. Delayed
+// standbys are expected to lag so their lag isn't checked.
+func (s *Sentinel) updateDBsReadiness(cd *cluster.ClusterData) {
+	maxLag := *cd.Cluster.DefSpec().MaxReadyStandbyLag
+	masterDB, hasMaster := cd.DBs[cd.Cluster.Status.Master]
+
+	for _, db := range cd.DBs {
+		db.Status.ReplicationLag = 0
+		db.Status.ReplayLag = 0
+		if hasMaster && followsMaster(cd, masterDB, db) {
+			if masterDB.Status.XLogPos > db.Status.XLogPos {
+				db.Status.ReplicationLag = masterDB.Status.XLogPos - db.Status.XLogPos
+			}
+			if db.Status.ReplayXLogPos != 0 && masterDB.Status.XLogPos > db.Status.ReplayXLogPos {
+				db.Status.ReplayLag = masterDB.Status.XLogPos - db.Status.ReplayXLogPos
+			}
+		}
+
+		ready := db.Status.Healthy
+		if ready && maxLag > 0 && db.Status.ReplicationLag > uint64(maxLag) && !isDelayedStandby(cd, db) {
+			ready = false
+		}
+		if db.Status.Ready && !ready && db.Status.Healthy {
+			log.Infow("db replication lag is greater than the max ready standby lag, reporting it as not ready", "db", db.UID, "keeper", db.Spec.KeeperUID, "lag", db.Status.ReplicationLag, "maxReadyStandbyLag", maxLag)
+		}
+		db.Status.Ready = ready
+	}
+}
+
 // activeProxiesInfos takes the provided proxyInfo list and returns a list of
 // proxiesInfo considered active. We also consider as active the proxies not yet
 // in the proxyInfoHistories since only after some time we'll know if they are
@@ -379,24 +734,178 @@ func (s *Sentinel) setDBSpecFromClusterSpec(cd *cluster.ClusterData) {
 		db.Spec.RequestTimeout = *clusterSpec.RequestTimeout
 		db.Spec.MaxStandbys = *clusterSpec.MaxStandbys
 		db.Spec.UsePgrewind = *clusterSpec.UsePgrewind
-		db.Spec.PGParameters = clusterSpec.PGParameters
+		db.Spec.PGParameters = keeperPGParameters(cd, db.Spec.KeeperUID, clusterSpec.PGParameters)
+		db.Spec.AllowUnsafeDurability = *clusterSpec.AllowUnsafeDurability
+		db.Spec.RequireChannelBinding = *clusterSpec.RequireChannelBinding
+		// the default strategy is left empty so the db specs (and their
+		// generations) don't change when upgrading from previous versions
+		db.Spec.WalRetentionStrategy = ""
+		if *clusterSpec.WalRetentionStrategy != cluster.DefaultWalRetentionStrategy {
+			db.Spec.WalRetentionStrategy = *clusterSpec.WalRetentionStrategy
+		}
 		db.Spec.PGHBA = clusterSpec.PGHBA
+		db.Spec.PGHBARules = clusterSpec.PGHBARules
+		db.Spec.PGIdent = clusterSpec.PGIdent
+		db.Spec.MonitoringUser = clusterSpec.MonitoringUser
+		db.Spec.Extensions = clusterSpec.Extensions
 		if db.Spec.FollowConfig != nil && db.Spec.FollowConfig.Type == cluster.FollowTypeExternal {
 			db.Spec.FollowConfig.StandbySettings = clusterSpec.StandbyConfig.StandbySettings
 			db.Spec.FollowConfig.ArchiveRecoverySettings = clusterSpec.StandbyConfig.ArchiveRecoverySettings
 		}
 		db.Spec.AdditionalWalSenders = *clusterSpec.AdditionalWalSenders
+		db.Spec.BasebackupConfig = clusterSpec.BasebackupConfig
+		db.Spec.ResyncMaxRate = ""
+		if clusterSpec.ResyncScheduling != nil {
+			db.Spec.ResyncMaxRate = clusterSpec.ResyncScheduling.MaxRate
+		}
+		db.Spec.WalRetentionLimits = clusterSpec.WalRetentionLimits
+		// like the wal retention strategy the default is left empty
+		db.Spec.ResyncMethod = ""
+		if *clusterSpec.ResyncMethod != cluster.DefaultResyncMethod {
+			db.Spec.ResyncMethod = *clusterSpec.ResyncMethod
+		}
+		db.Spec.PgBackRestConfig = clusterSpec.PgBackRestConfig
+		db.Spec.WalGConfig = clusterSpec.WalGConfig
+		db.Spec.ResyncStrategies = clusterSpec.ResyncStrategies
+		db.Spec.VerifyResync = *clusterSpec.VerifyResync
+		// the logical replication slots are also kept on the standbys
+		db.Spec.LogicalReplicationSlots = clusterSpec.LogicalReplicationSlots
 		switch s.dbType(cd, db.UID) {
 		case dbTypeMaster:
 			db.Spec.AdditionalReplicationSlots = clusterSpec.AdditionalMasterReplicationSlots
+			db.Spec.Publications = clusterSpec.Publications
+			db.Spec.RecoveryMinApplyDelay = nil
+			db.Spec.SynchronousCommit = ""
+			if clusterSpec.SynchronousCommit != nil {
+				db.Spec.SynchronousCommit = *clusterSpec.SynchronousCommit
+			}
+			db.Spec.StandbyConflicts = nil
 		case dbTypeStandby:
 			db.Spec.AdditionalReplicationSlots = nil
+			db.Spec.Publications = nil
+			db.Spec.SynchronousCommit = ""
+			db.Spec.StandbyConflicts = clusterSpec.StandbyConflicts
+			db.Spec.RecoveryMinApplyDelay = nil
+			if db.Spec.FollowConfig != nil && db.Spec.FollowConfig.Type == cluster.FollowTypeInternal {
+				db.Spec.RecoveryMinApplyDelay = recoveryMinApplyDelay(cd, db)
+			}
 			// TODO(sgotti). Update when there'll be an option to define
 			// additional replication slots on standbys
 		}
 	}
 }
 
+// keeperPGParameters returns the pg parameters of the db of the keeper: the
+// cluster spec ones merged with the keeper spec overrides. Since they're
+// taken from the keeper spec the overrides are kept also when a new db is
+// assigned to the keeper.
+func keeperPGParameters(cd *cluster.ClusterData, keeperUID string, pgParameters cluster.PGParameters) cluster.PGParameters {
+	k, ok := cd.Keepers[keeperUID]
+	if !ok || k.Spec == nil || len(k.Spec.PGParameters) == 0 {
+		return pgParameters
+	}
+	merged := cluster.PGParameters{}
+	for n, v := range pgParameters {
+		merged[n] = v
+	}
+	for n, v := range k.Spec.PGParameters {
+		merged[n] = v
+	}
+	return merged
+}
+
+// updateUnsafeDurability updates the cluster status reporting if the cluster
+// is running with some durability pg parameters disabled.
+func (s *Sentinel) updateUnsafeDurability(cd *cluster.ClusterData) {
+	clusterSpec := cd.Cluster.DefSpec()
+	disabled := []string{}
+	if *clusterSpec.AllowUnsafeDurability {
+		disabled = common.Parameters(clusterSpec.PGParameters).DisabledDurabilityParameters()
+	}
+	unsafeDurability := len(disabled) > 0
+
+	if unsafeDurability {
+		if !cd.Cluster.Status.UnsafeDurability {
+			log.Warnw("cluster is running with unsafe durability pg parameters, a crash can cause unrecoverable data corruption", "parameters", disabled)
+		}
+		// a corrupted master will be replicated to its standbys, keep
+		// warning since this should never happen on a real cluster
+		if len(cd.DBs) > 1 {
+			log.Warnw("cluster with standbys is running with unsafe durability pg parameters, a master crash can cause unrecoverable data corruption also on the standbys", "parameters", disabled)
+		}
+	}
+	cd.Cluster.Status.UnsafeDurability = unsafeDurability
+}
+
+// updateDataChecksums reports in the cluster status if data checksums are
+// enabled on the master db. Its standbys, created with pg_basebackup, have the
+// same setting.
+func (s *Sentinel) updateDataChecksums(cd *cluster.ClusterData) {
+	masterDB, ok := cd.DBs[cd.Cluster.Status.Master]
+	if !ok || !masterDB.Status.Healthy {
+		return
+	}
+	if cd.Cluster.Status.DataChecksums != masterDB.Status.DataChecksums {
+		log.Infow("master db data checksums state changed", "db", masterDB.UID, "dataChecksums", masterDB.Status.DataChecksums)
+	}
+	cd.Cluster.Status.DataChecksums = masterDB.Status.DataChecksums
+}
+
+// clearGracefulDemotion removes the drain request from the dbs that aren't
+// the master anymore or when no switchover is in progress (i.e. aborted)
+func (s *Sentinel) clearGracefulDemotion(cd *cluster.ClusterData) {
+	for _, db := range cd.DBs {
+		if db.Spec.GracefulDemotion == nil {
+			continue
+		}
+		if cd.Cluster.Status.Switchover != nil && cd.Cluster.Status.Master == db.UID {
+			continue
+		}
+		db.Spec.GracefulDemotion = nil
+	}
+}
+
+// clearDropReplicationSlots removes the replication slots drop requests
+// already handled by the keepers (their db current generation is the one with
+// the drop request).
+func (s *Sentinel) clearDropReplicationSlots(cd *cluster.ClusterData) {
+	for _, db := range cd.DBs {
+		if len(db.Spec.DropReplicationSlots) == 0 || db.Status.CurrentGeneration != db.Generation {
+			continue
+		}
+		log.Infow("replication slots drop request handled by the keeper", "db", db.UID, "keeper", db.Spec.KeeperUID, "slots", db.Spec.DropReplicationSlots)
+		db.Spec.DropReplicationSlots = nil
+	}
+}
+
+// setInitConfig records in the cluster status the init configuration used
+// to initialize the cluster with db as its first master. It must be called
+// when the cluster initialization has completed.
+func (s *Sentinel) setInitConfig(cd *cluster.ClusterData, db *cluster.DB) {
+	clusterSpec := cd.Cluster.DefSpec()
+	ic := &cluster.InitConfig{
+		InitMode:          *clusterSpec.InitMode,
+		Role:              *clusterSpec.Role,
+		MergePgParameters: *clusterSpec.MergePgParameters,
+		NewConfig:         clusterSpec.NewConfig,
+		PITRConfig:        clusterSpec.PITRConfig,
+		ExistingConfig:    clusterSpec.ExistingConfig,
+		StandbyConfig:     clusterSpec.StandbyConfig,
+		DBUID:             db.UID,
+		KeeperUID:         db.Spec.KeeperUID,
+		PGParameters:      clusterSpec.PGParameters,
+		InitTime:          time.Now(),
+
+		PostInitHookResult: db.Status.PostInitHookResult,
+	}
+	if k, ok := cd.Keepers[db.Spec.KeeperUID]; ok {
+		ic.PostgresBinaryVersion = k.Status.PostgresBinaryVersion
+	}
+	if cd.Cluster.SetInitConfig(ic) {
+		log.Infow("recorded cluster init configuration", "initMode", ic.InitMode, "db", ic.DBUID, "keeper", ic.KeeperUID)
+	}
+}
+
 func (s *Sentinel) isDifferentTimelineBranch(followedDB *cluster.DB, db *cluster.DB) bool {
 	if followedDB.Status.TimelineID < db.Status.TimelineID {
 		log.Infow("followed instance timeline < than our timeline", "followedTimeline", followedDB.Status.TimelineID, "timeline", db.Status.TimelineID)
@@ -433,6 +942,12 @@ func (s *Sentinel) isDifferentTimelineBranch(followedDB *cluster.DB, db *cluster
 	return false
 }
 
+// masterElectionEvent returns the event field of the election of masterDB as
+// the new master
+func masterElectionEvent(prevMasterDBUID string, masterDB *cluster.DB) zapcore.Field {
+	return slog.Event(slog.EventMasterElection, "db", masterDB.UID, "keeper", masterDB.Spec.KeeperUID, "previousMasterDB", prevMasterDBUID)
+}
+
 // isLagBelowMax checks if the db reported lag is below MaxStandbyLag from the
 // master reported lag
 func (s *Sentinel) isLagBelowMax(cd *cluster.ClusterData, curMasterDB, db *cluster.DB) bool {
@@ -444,11 +959,46 @@ func (s *Sentinel) isLagBelowMax(cd *cluster.ClusterData, curMasterDB, db *clust
 	return true
 }
 
+// isReplayLagBelowMax reports if the position replayed by the db and its replay
+// delay are within MaxStandbyReplayLag and MaxStandbyReplayDelay from the
+// master reported xlog position. The replay delay also increases when there're
+// no writes on the master so it's checked only when the db hasn't replayed all
+// the master wal. A db not reporting its replayed position (i.e. an older
+// keeper) isn't excluded.
+func isReplayLagBelowMax(cd *cluster.ClusterData, masterDB, db *cluster.DB) bool {
+	spec := cd.Cluster.DefSpec()
+	if db.Status.ReplayXLogPos == 0 || db.Status.ReplayXLogPos >= masterDB.Status.XLogPos {
+		return true
+	}
+	lag := masterDB.Status.XLogPos - db.Status.ReplayXLogPos
+	if maxLag := *spec.MaxStandbyReplayLag; maxLag > 0 && lag > uint64(maxLag) {
+		log.Infow("ignoring db since its replayed position is behind the master xlog position more than maxStandbyReplayLag", "db", db.UID, "replayXLogPos", db.Status.ReplayXLogPos, "masterXLogPos", masterDB.Status.XLogPos, "maxStandbyReplayLag", maxLag)
+		return false
+	}
+	if maxDelay := spec.MaxStandbyReplayDelay.Duration; maxDelay > 0 && db.Status.ReplayDelay != nil && db.Status.ReplayDelay.Duration > maxDelay {
+		log.Infow("ignoring db since its replay delay is greater than maxStandbyReplayDelay", "db", db.UID, "replayDelay", db.Status.ReplayDelay.Duration, "maxStandbyReplayDelay", maxDelay)
+		return false
+	}
+	return true
+}
+
+// excludeReplayLaggingDBs returns the provided dbs without the ones whose
+// replay lag isn't within the configured limits
+func excludeReplayLaggingDBs(cd *cluster.ClusterData, masterDB *cluster.DB, dbs []*cluster.DB) []*cluster.DB {
+	out := []*cluster.DB{}
+	for _, db := range dbs {
+		if isReplayLagBelowMax(cd, masterDB, db) {
+			out = append(out, db)
+		}
+	}
+	return out
+}
+
 func (s *Sentinel) freeKeepers(cd *cluster.ClusterData) []*cluster.Keeper {
 	freeKeepers := []*cluster.Keeper{}
 K:
 	for _, keeper := range cd.Keepers {
-		if !keeper.Status.Healthy {
+		if !keeper.Status.Healthy || isMaintenanceKeeper(cd, keeper.UID) {
 			continue
 		}
 		for _, db := range cd.DBs {
@@ -603,12 +1153,23 @@ func (s *Sentinel) dbStatus(cd *cluster.ClusterData, dbUID string) dbStatus {
 		panic(fmt.Errorf("requested unexisting db uid %q", dbUID))
 	}
 
+	// the db of a keeper in maintenance is considered good, whatever its
+	// state, to keep its current role
+	if isMaintenanceKeeper(cd, db.Spec.KeeperUID) {
+		return dbStatusGood
+	}
+
 	// if keeper failed then mark as failed
 	keeper := cd.Keepers[db.Spec.KeeperUID]
 	if !keeper.Status.Healthy {
 		return dbStatusFailed
 	}
 
+	// the db is stopped during the data checksums verification
+	if isVerifyingChecksums(cd, db) {
+		return dbStatusConverging
+	}
+
 	convergenceTimeout := cd.Cluster.DefSpec().ConvergenceTimeout.Duration
 	// check if db should be in init mode and adjust convergence timeout
 	if db.Generation == cluster.InitialGeneration {
@@ -720,64 +1281,663 @@ func (s *Sentinel) findBestStandbys(cd *cluster.ClusterData, masterDB *cluster.D
 	return bestDBs
 }
 
-func (s *Sentinel) findBestNewMasters(cd *cluster.ClusterData, masterDB *cluster.DB) []*cluster.DB {
-	bestNewMasters := s.findBestStandbys(cd, masterDB)
-	// Add the previous masters to the best standbys (if valid and in good state)
-	goodMasters, _, _ := s.validMastersByStatus(cd)
-	log.Debugf("goodMasters: %s", spew.Sdump(goodMasters))
-	for _, db := range goodMasters {
-		if db.UID == masterDB.UID {
-			log.Debugw("ignoring db since it's the current master", "db", db.UID, "keeper", db.Spec.KeeperUID)
-			continue
+// findFailoverTargetDB returns the db of the requested failover target keeper
+// if it can be safely elected as the new master, nil otherwise. When force is
+// true the target db lag isn't checked.
+func (s *Sentinel) findFailoverTargetDB(cd *cluster.ClusterData, masterDB *cluster.DB, keeperUID string, force bool) *cluster.DB {
+	var targetDB *cluster.DB
+	candidates := s.findBestStandbys(cd, masterDB)
+	if force {
+		candidates = []*cluster.DB{}
+		goodStandbys, _, _ := s.validStandbysByStatus(cd)
+		for _, db := range goodStandbys {
+			if db.Status.TimelineID == masterDB.Status.TimelineID {
+				candidates = append(candidates, db)
+			}
 		}
-		if db.Status.TimelineID != masterDB.Status.TimelineID {
-			log.Debugw("ignoring keeper since its pg timeline is different than master timeline", "db", db.UID, "dbTimeline", db.Status.TimelineID, "masterTimeline", masterDB.Status.TimelineID)
-			continue
+	}
+	for _, db := range candidates {
+		if db.Spec.KeeperUID == keeperUID {
+			targetDB = db
 		}
-		// do this only when not using synchronous replication since in sync repl we
-		// have to ignore the last reported xlogpos or valid sync standby will be
-		// skipped
-		if !s.syncRepl(cd.Cluster.DefSpec()) {
-			if !s.isLagBelowMax(cd, masterDB, db) {
-				log.Debugw("ignoring keeper since its lag is above the max configured lag", "db", db.UID, "dbXLogPos", db.Status.XLogPos, "masterXLogPos", masterDB.Status.XLogPos)
-				continue
+	}
+	if targetDB == nil {
+		log.Warnw("ignoring failover request since the target keeper db isn't a healthy standby", "keeper", keeperUID)
+		return nil
+	}
+	if isDrainedKeeper(cd, keeperUID) {
+		log.Warnw("ignoring failover request since the target keeper is drained", "keeper", keeperUID)
+		return nil
+	}
+	if isMaintenanceKeeper(cd, keeperUID) {
+		log.Warnw("ignoring failover request since the target keeper is in maintenance", "keeper", keeperUID)
+		return nil
+	}
+	if !samePostgresMajor(cd, targetDB, masterDB) {
+		log.Warnw("ignoring failover request since the target keeper postgres major version is different than the master one", "keeper", keeperUID)
+		return nil
+	}
+	if s.syncRepl(cd.Cluster.DefSpec()) {
+		// the sync standbys lag is ignored since they are in sync with the
+		// master
+		if !util.StringInSlice(util.CommonElements(masterDB.Status.SynchronousStandbys, masterDB.Spec.SynchronousStandbys), targetDB.UID) {
+			log.Warnw("ignoring failover request since the target keeper db isn't an in sync synchronous standby", "db", targetDB.UID, "keeper", keeperUID)
+			return nil
+		}
+	}
+	return targetDB
+}
+
+// automaticFailoverAllowed reports if an automatic failover can be done at
+// now based on the cluster spec failoverCooldown and maxFailovers options.
+// When maxFailovers automatic failovers have already been done in
+// maxFailoversWindow the automatic failovers are halted until resumed with
+// stolonctl.
+func automaticFailoverAllowed(newcd *cluster.ClusterData, now time.Time) bool {
+	clusterSpec := newcd.Cluster.DefSpec()
+	status := &newcd.Cluster.Status
+	if status.FailoversHalted {
+		log.Errorw("automatic failovers are halted since maxFailovers has been reached, use stolonctl resumefailovers to resume them")
+		return false
+	}
+	failovers := status.AutomaticFailovers
+	if cooldown := clusterSpec.FailoverCooldown.Duration; cooldown > 0 && len(failovers) > 0 {
+		if last := failovers[len(failovers)-1]; now.Sub(last) < cooldown {
+			log.Warnw("not doing an automatic failover since the failover cooldown since the last one hasn't expired", "lastFailover", last, "failoverCooldown", cooldown)
+			return false
+		}
+	}
+	if maxFailovers := int(*clusterSpec.MaxFailovers); maxFailovers > 0 {
+		window := clusterSpec.MaxFailoversWindow.Duration
+		n := 0
+		for _, t := range failovers {
+			if now.Sub(t) < window {
+				n++
 			}
 		}
-		bestNewMasters = append(bestNewMasters, db)
+		if n >= maxFailovers {
+			log.Errorw("halting automatic failovers since maxFailovers automatic failovers have been done in maxFailoversWindow", "maxFailovers", maxFailovers, "maxFailoversWindow", window)
+			status.FailoversHalted = true
+			return false
+		}
 	}
-	// Sort by XLogPos
-	sort.Sort(dbSlice(bestNewMasters))
-	log.Debugf("bestNewMasters: %s", spew.Sdump(bestNewMasters))
-	return bestNewMasters
+	return true
 }
 
-func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInfo) (*cluster.ClusterData, error) {
-	// take a cd deepCopy to check that the code isn't changing it (it'll be a bug)
-	origcd := cd.DeepCopy()
-	newcd := cd.DeepCopy()
-	clusterSpec := cd.Cluster.DefSpec()
+// recordAutomaticFailover records the time of an automatic failover keeping
+// only the ones needed by the failoverCooldown and maxFailovers checks
+func recordAutomaticFailover(newcd *cluster.ClusterData, now time.Time) {
+	clusterSpec := newcd.Cluster.DefSpec()
+	status := &newcd.Cluster.Status
+	cooldown := clusterSpec.FailoverCooldown.Duration
+	if cooldown <= 0 && *clusterSpec.MaxFailovers == 0 {
+		status.AutomaticFailovers = nil
+		return
+	}
+	keep := clusterSpec.MaxFailoversWindow.Duration
+	if cooldown > keep {
+		keep = cooldown
+	}
+	failovers := []time.Time{}
+	for _, t := range status.AutomaticFailovers {
+		if now.Sub(t) < keep {
+			failovers = append(failovers, t)
+		}
+	}
+	status.AutomaticFailovers = append(failovers, now)
+}
 
-	switch cd.Cluster.Status.Phase {
-	case cluster.ClusterPhaseInitializing:
-		switch *clusterSpec.InitMode {
-		case cluster.ClusterInitModeNew:
-			// Is there already a keeper choosed to be the new master?
-			if cd.Cluster.Status.Master == "" {
-				log.Infow("trying to find initial master")
-				k, err := s.findInitialKeeper(newcd)
-				if err != nil {
-					return nil, fmt.Errorf("cannot choose initial master: %v", err)
-				}
-				log.Infow("initializing cluster", "keeper", k.UID)
-				db := &cluster.DB{
-					UID:        s.UIDFn(),
-					Generation: cluster.InitialGeneration,
-					Spec: &cluster.DBSpec{
-						KeeperUID:     k.UID,
-						InitMode:      cluster.DBInitModeNew,
-						NewConfig:     clusterSpec.NewConfig,
-						Role:          common.RoleMaster,
-						Followers:     []string{},
+// handleSwitchover advances the switchover in progress: it pauses the
+// proxies, waits for them to close the connections to the master and then
+// for the target db to catch up with the master. When the cluster spec
+// defines the gracefulDemotion it then requests the master keeper to drain
+// the master and waits for the target db to receive the final master wal. It
+// returns the target db, to be elected as the new master, only when it has
+// caught up (and the master has been drained). The
+// switchover is aborted (and the proxies resumed) when the master is failed,
+// the target db cannot be elected anymore or it doesn't catch up before the
+// switchover timeout.
+func (s *Sentinel) handleSwitchover(newcd *cluster.ClusterData, curMasterDB *cluster.DB, masterOK bool, pis cluster.ProxiesInfo) *cluster.DB {
+	sw := newcd.Cluster.Status.Switchover
+	if !masterOK {
+		log.Warnw("aborting switchover since the master db is failed", "keeper", sw.TargetKeeper)
+		newcd.Cluster.Status.Switchover = nil
+		return nil
+	}
+	targetDB := s.findFailoverTargetDB(newcd, curMasterDB, sw.TargetKeeper, false)
+	if targetDB == nil {
+		log.Warnw("aborting switchover since the target keeper db cannot be elected as the new master", "keeper", sw.TargetKeeper)
+		newcd.Cluster.Status.Switchover = nil
+		return nil
+	}
+	if sw.Phase != cluster.SwitchoverPhaseRequested && time.Since(sw.StartTime) > newcd.Cluster.DefSpec().SwitchoverTimeout.Duration {
+		log.Warnw("aborting switchover since the target db didn't catch up with the master before the switchover timeout", "db", targetDB.UID, "keeper", targetDB.Spec.KeeperUID, "phase", sw.Phase)
+		newcd.Cluster.Status.Switchover = nil
+		return nil
+	}
+
+	switch sw.Phase {
+	case cluster.SwitchoverPhaseRequested:
+		log.Infow("starting switchover, pausing proxies", "db", targetDB.UID, "keeper", targetDB.Spec.KeeperUID)
+		sw.Phase = cluster.SwitchoverPhasePausingProxies
+		sw.StartTime = time.Now()
+		if newcd.Proxy.Spec.MasterDBUID != "" {
+			newcd.Proxy.Spec.MasterDBUID = ""
+			newcd.Proxy.Generation++
+		}
+	case cluster.SwitchoverPhasePausingProxies:
+		unconvergedProxiesUIDs := []string{}
+		for _, pi := range pis {
+			if pi.Generation != newcd.Proxy.Generation {
+				unconvergedProxiesUIDs = append(unconvergedProxiesUIDs, pi.UID)
+			}
+		}
+		if len(unconvergedProxiesUIDs) > 0 {
+			log.Infow("waiting for proxies to be paused", "proxies", unconvergedProxiesUIDs)
+			return nil
+		}
+		log.Infow("proxies paused, waiting for the switchover target db to catch up with the master", "db", targetDB.UID, "keeper", targetDB.Spec.KeeperUID)
+		sw.Phase = cluster.SwitchoverPhaseCatchingUp
+	case cluster.SwitchoverPhaseCatchingUp:
+		if targetDB.Status.XLogPos < curMasterDB.Status.XLogPos {
+			log.Infow("waiting for the switchover target db to catch up with the master", "db", targetDB.UID, "dbXLogPos", targetDB.Status.XLogPos, "masterXLogPos", curMasterDB.Status.XLogPos)
+			return nil
+		}
+		if gd := newcd.Cluster.DefSpec().GracefulDemotion; gd != nil {
+			log.Infow("switchover target db caught up with the master, draining the master", "db", targetDB.UID, "keeper", targetDB.Spec.KeeperUID)
+			sw.Phase = cluster.SwitchoverPhaseDemotingMaster
+			newcd.DBs[curMasterDB.UID].Spec.GracefulDemotion = &cluster.GracefulDemotionRequest{
+				TargetDBUID:       targetDB.UID,
+				RejectConnections: gd.RejectConnections,
+				DrainTimeout:      cluster.Duration{Duration: gd.DefDrainTimeout()},
+			}
+			return nil
+		}
+		newcd.Cluster.Status.Switchover = nil
+		return targetDB
+	case cluster.SwitchoverPhaseDemotingMaster:
+		gds := curMasterDB.Status.GracefulDemotion
+		if gds == nil || gds.TargetDBUID != targetDB.UID || !gds.Completed {
+			log.Infow("waiting for the master keeper to drain the master", "db", targetDB.UID, "keeper", targetDB.Spec.KeeperUID)
+			return nil
+		}
+		log.Infow("master drained, the switchover target db received the final master wal", "db", targetDB.UID, "keeper", targetDB.Spec.KeeperUID, "lsn", gds.LSN)
+		newcd.Cluster.Status.Switchover = nil
+		return targetDB
+	default:
+		log.Warnw("aborting switchover with unknown phase", "phase", sw.Phase)
+		newcd.Cluster.Status.Switchover = nil
+	}
+	return nil
+}
+
+// masterPlacementScore returns how much db is preferred as the new master
+// replacing masterDB based on the keepers tags. Avoiding the failed master
+// anti affinity tag value (i.e. its availability zone) weights more than
+// matching the preferred tags. When no anti affinity tag is defined the
+// failure domain tag is used.
+func masterPlacementScore(cd *cluster.ClusterData, masterDB, db *cluster.DB) int {
+	clusterSpec := cd.Cluster.DefSpec()
+	tags := keeperTags(cd, db.Spec.KeeperUID)
+	score := 0
+	antiAffinityTag := clusterSpec.MasterAntiAffinityTag
+	if antiAffinityTag == nil {
+		antiAffinityTag = clusterSpec.FailureDomainTag
+	}
+	if antiAffinityTag != nil {
+		key := *antiAffinityTag
+		if masterValue, ok := keeperTags(cd, masterDB.Spec.KeeperUID)[key]; ok {
+			if value, ok := tags[key]; ok && value != masterValue {
+				score += 2
+			}
+		}
+	}
+	if len(clusterSpec.MasterPreferredTags) > 0 && tags.Matches(clusterSpec.MasterPreferredTags) {
+		score++
+	}
+	return score
+}
+
+func keeperElectionPriority(cd *cluster.ClusterData, keeperUID string) int {
+	k, ok := cd.Keepers[keeperUID]
+	if !ok || k.Spec == nil {
+		return 0
+	}
+	return k.Spec.ElectionPriority
+}
+
+// failureDomain returns the failure domain of the db keeper (the value of
+// its cluster spec failureDomainTag tag). It returns false if the db keeper
+// doesn't report it.
+func failureDomain(cd *cluster.ClusterData, db *cluster.DB) (string, bool) {
+	key := cd.Cluster.DefSpec().FailureDomainTag
+	if key == nil {
+		return "", false
+	}
+	v, ok := keeperTags(cd, db.Spec.KeeperUID)[*key]
+	return v, ok
+}
+
+// spreadByFailureDomain returns the dbs ordered to spread them between the
+// failure domains: for every failure domain not used by the master or by the
+// chosen dbs, its first db is moved ahead. The provided order is kept
+// between the other dbs.
+func spreadByFailureDomain(cd *cluster.ClusterData, masterDB *cluster.DB, chosen, dbs []*cluster.DB) []*cluster.DB {
+	used := map[string]struct{}{}
+	for _, db := range append([]*cluster.DB{masterDB}, chosen...) {
+		if d, ok := failureDomain(cd, db); ok {
+			used[d] = struct{}{}
+		}
+	}
+	spread := []*cluster.DB{}
+	others := []*cluster.DB{}
+	for _, db := range dbs {
+		d, ok := failureDomain(cd, db)
+		if _, isUsed := used[d]; ok && !isUsed {
+			used[d] = struct{}{}
+			spread = append(spread, db)
+			continue
+		}
+		others = append(others, db)
+	}
+	return append(spread, others...)
+}
+
+// inOtherFailureDomain reports if the db keeper failure domain is known and
+// different from the master one
+func inOtherFailureDomain(cd *cluster.ClusterData, masterDB, db *cluster.DB) bool {
+	masterDomain, ok := failureDomain(cd, masterDB)
+	if !ok {
+		return false
+	}
+	d, ok := failureDomain(cd, db)
+	return ok && d != masterDomain
+}
+
+// syncStandbysInOtherFailureDomain reports if at least one of the
+// synchronous standbys is in a failure domain different from the master one
+func syncStandbysInOtherFailureDomain(cd *cluster.ClusterData, masterDB *cluster.DB, synchronousStandbys map[string]struct{}) bool {
+	for dbUID := range synchronousStandbys {
+		if db, ok := cd.DBs[dbUID]; ok && inOtherFailureDomain(cd, masterDB, db) {
+			return true
+		}
+	}
+	return false
+}
+
+// syncStandbyLag returns the replay lag of the db, or its replication lag if
+// its keeper doesn't report the replayed position
+func syncStandbyLag(db *cluster.DB) uint64 {
+	if db.Status.ReplayXLogPos != 0 {
+		return db.Status.ReplayLag
+	}
+	return db.Status.ReplicationLag
+}
+
+// isStreaming reports if the db is streaming from the master. It's considered
+// not streaming only when the master reports the db replication slot as not
+// active.
+func isStreaming(masterDB, db *cluster.DB) bool {
+	for _, rs := range masterDB.Status.ReplicationSlots {
+		if rs.Name == common.StolonName(db.UID) {
+			return rs.Active
+		}
+	}
+	return true
+}
+
+// lagAwareSyncCandidates returns the candidates streaming from the master
+// with a lag not greater than half maxLag, ordered by lag. Using half maxLag
+// avoids continuous changes of the synchronous standbys when a candidate lag
+// is near maxLag.
+func lagAwareSyncCandidates(masterDB *cluster.DB, candidates []*cluster.DB, maxLag uint32) []*cluster.DB {
+	out := []*cluster.DB{}
+	for _, db := range candidates {
+		if !isStreaming(masterDB, db) {
+			log.Debugw("ignoring synchronous standby candidate since it isn't streaming", "db", db.UID, "keeper", db.Spec.KeeperUID)
+			continue
+		}
+		if lag := syncStandbyLag(db); lag > uint64(maxLag/2) {
+			log.Debugw("ignoring synchronous standby candidate since its lag is greater than half syncStandbyMaxReplayLag", "db", db.UID, "keeper", db.Spec.KeeperUID, "lag", lag, "syncStandbyMaxReplayLag", maxLag)
+			continue
+		}
+		out = append(out, db)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return syncStandbyLag(out[i]) < syncStandbyLag(out[j]) })
+	return out
+}
+
+// laggingSyncStandbys returns the synchronous standbys with a lag greater than
+// maxLag, the most lagging first
+func laggingSyncStandbys(cd *cluster.ClusterData, synchronousStandbys map[string]struct{}, maxLag uint32) []*cluster.DB {
+	lagging := []*cluster.DB{}
+	for dbUID := range synchronousStandbys {
+		db, ok := cd.DBs[dbUID]
+		if !ok {
+			continue
+		}
+		if syncStandbyLag(db) > uint64(maxLag) {
+			lagging = append(lagging, db)
+		}
+	}
+	sort.Slice(lagging, func(i, j int) bool {
+		li, lj := syncStandbyLag(lagging[i]), syncStandbyLag(lagging[j])
+		if li != lj {
+			return li > lj
+		}
+		return lagging[i].UID < lagging[j].UID
+	})
+	return lagging
+}
+
+// syncStandbysReasons returns the reasons why every synchronous standby has
+// been chosen: the ones of the standbys added in this step or, for the kept
+// ones, the previous ones.
+func syncStandbysReasons(prevReasons map[string]string, synchronousStandbys map[string]struct{}, reasons map[string]string) map[string]string {
+	out := map[string]string{}
+	for dbUID := range synchronousStandbys {
+		switch {
+		case reasons[dbUID] != "":
+			out[dbUID] = reasons[dbUID]
+		case prevReasons[dbUID] != "":
+			out[dbUID] = prevReasons[dbUID]
+		default:
+			out[dbUID] = "synchronous standby"
+		}
+	}
+	return out
+}
+
+// updateSyncReplMode updates, based on the cluster spec syncReplDegradation
+// policy, the master synchronous replication mode reported in the cluster
+// status. insufficient reports that there aren't enough healthy synchronous
+// standbys to reach MinSynchronousStandbys. The status is removed when there
+// are enough healthy synchronous standbys.
+func updateSyncReplMode(newcd *cluster.ClusterData, insufficient bool, now time.Time) cluster.SyncReplMode {
+	degradation := newcd.Cluster.DefSpec().SyncReplDegradation
+	status := newcd.Cluster.Status.SyncReplDegradation
+	setMode := func(mode cluster.SyncReplMode) {
+		status = &cluster.SyncReplDegradationStatus{Mode: mode, Since: now}
+		newcd.Cluster.Status.SyncReplDegradation = status
+	}
+
+	if !insufficient {
+		if status != nil {
+			log.Infow("enough healthy synchronous standbys available, synchronous replication restored", "prevMode", status.Mode)
+			newcd.Cluster.Status.SyncReplDegradation = nil
+		}
+		return cluster.SyncReplModeSync
+	}
+
+	policy := degradation.DefPolicy()
+	if status == nil || (status.Mode == cluster.SyncReplModeDegraded && policy == cluster.SyncReplDegradationPolicyBlock) {
+		log.Warnw("not enough healthy synchronous standbys available, blocking the master writes", "syncReplDegradationPolicy", policy)
+		setMode(cluster.SyncReplModeBlocking)
+	}
+	if status.Mode != cluster.SyncReplModeBlocking {
+		return status.Mode
+	}
+	switch policy {
+	case cluster.SyncReplDegradationPolicyDegradeAfterGrace:
+		if gracePeriod := degradation.DefGracePeriod(); status.Acknowledged || now.Sub(status.Since) >= gracePeriod {
+			log.Warnw("degrading to asynchronous replication since not enough healthy synchronous standbys are available", "blockingSince", status.Since, "gracePeriod", gracePeriod, "acknowledged", status.Acknowledged)
+			setMode(cluster.SyncReplModeDegraded)
+		}
+	case cluster.SyncReplDegradationPolicyDegradeOnAck:
+		if status.Acknowledged {
+			log.Warnw("degrading to asynchronous replication as acknowledged since not enough healthy synchronous standbys are available", "blockingSince", status.Since)
+			setMode(cluster.SyncReplModeDegraded)
+		} else {
+			log.Warnw("master writes blocked since not enough healthy synchronous standbys are available, use stolonctl degradesyncrepl to degrade to asynchronous replication", "blockingSince", status.Since)
+		}
+	}
+	return status.Mode
+}
+
+func keeperTags(cd *cluster.ClusterData, keeperUID string) cluster.Tags {
+	k, ok := cd.Keepers[keeperUID]
+	if !ok || k.Spec == nil {
+		return nil
+	}
+	return k.Spec.Tags
+}
+
+// sortByMasterPlacement sorts the dbs by their keeper election priority
+// (higher first) and then by XLogPos like dbSlice. Since the provided dbs are
+// the new master candidates, their lag is already within the allowed bounds.
+// Dbs with the same priority and XLogPos are sorted by their master placement
+// score, so the placement preferences never override the XLogPos ordering.
+func sortByMasterPlacement(cd *cluster.ClusterData, masterDB *cluster.DB, dbs []*cluster.DB) {
+	scores := make(map[string]int, len(dbs))
+	priorities := make(map[string]int, len(dbs))
+	for _, db := range dbs {
+		scores[db.UID] = masterPlacementScore(cd, masterDB, db)
+		priorities[db.UID] = keeperElectionPriority(cd, db.Spec.KeeperUID)
+	}
+	sort.SliceStable(dbs, func(i, j int) bool {
+		if priorities[dbs[i].UID] != priorities[dbs[j].UID] {
+			return priorities[dbs[i].UID] > priorities[dbs[j].UID]
+		}
+		if dbs[i].Status.XLogPos != dbs[j].Status.XLogPos {
+			return dbs[i].Status.XLogPos < dbs[j].Status.XLogPos
+		}
+		return scores[dbs[i].UID] > scores[dbs[j].UID]
+	})
+}
+
+// excludeDelayedStandbys removes the delayed standbys from the new master
+// candidates. Since they're intentionally behind the master they're kept only
+// when there's no other candidate and the cluster spec
+// AllowDelayedStandbyPromotion option is true.
+func (s *Sentinel) excludeDelayedStandbys(cd *cluster.ClusterData, dbs []*cluster.DB) []*cluster.DB {
+	candidates := []*cluster.DB{}
+	delayed := []*cluster.DB{}
+	for _, db := range dbs {
+		if isDelayedStandby(cd, db) {
+			delayed = append(delayed, db)
+			continue
+		}
+		candidates = append(candidates, db)
+	}
+	if len(candidates) > 0 || len(delayed) == 0 {
+		for _, db := range delayed {
+			log.Debugw("ignoring db since it's a delayed standby", "db", db.UID, "keeper", db.Spec.KeeperUID)
+		}
+		return candidates
+	}
+	if !*cd.Cluster.DefSpec().AllowDelayedStandbyPromotion {
+		for _, db := range delayed {
+			log.Warnw("ignoring delayed standby since allowDelayedStandbyPromotion is false, even if it's the only available new master", "db", db.UID, "keeper", db.Spec.KeeperUID)
+		}
+		return candidates
+	}
+	for _, db := range delayed {
+		log.Warnw("electing a delayed standby as new master since it's the only available standby and allowDelayedStandbyPromotion is true", "db", db.UID, "keeper", db.Spec.KeeperUID, "recoveryMinApplyDelay", recoveryMinApplyDelay(cd, db).Duration)
+	}
+	return delayed
+}
+
+// excludeDrainedKeepers removes the dbs of the drained and in maintenance
+// keepers from the new master candidates
+func excludeDrainedKeepers(cd *cluster.ClusterData, dbs []*cluster.DB) []*cluster.DB {
+	candidates := []*cluster.DB{}
+	for _, db := range dbs {
+		if isDrainedKeeper(cd, db.Spec.KeeperUID) {
+			log.Infow("ignoring db since its keeper is drained", "db", db.UID, "keeper", db.Spec.KeeperUID)
+			continue
+		}
+		if isMaintenanceKeeper(cd, db.Spec.KeeperUID) {
+			log.Infow("ignoring db since its keeper is in maintenance", "db", db.UID, "keeper", db.Spec.KeeperUID)
+			continue
+		}
+		candidates = append(candidates, db)
+	}
+	return candidates
+}
+
+// samePostgresMajor reports if the keepers of the two dbs use postgres
+// binaries of the same major version. Physical replication, and so electing a
+// standby as the new master, isn't possible between different major versions.
+func samePostgresMajor(cd *cluster.ClusterData, db, masterDB *cluster.DB) bool {
+	k, ok := cd.Keepers[db.Spec.KeeperUID]
+	if !ok {
+		return true
+	}
+	masterKeeper, ok := cd.Keepers[masterDB.Spec.KeeperUID]
+	if !ok {
+		return true
+	}
+	return k.Status.PostgresBinaryVersion.SameMajor(masterKeeper.Status.PostgresBinaryVersion)
+}
+
+// excludePostgresMajorMismatch removes from the new master candidates the dbs
+// whose keeper uses a postgres major version different than the master one
+func excludePostgresMajorMismatch(cd *cluster.ClusterData, masterDB *cluster.DB, dbs []*cluster.DB) []*cluster.DB {
+	candidates := []*cluster.DB{}
+	for _, db := range dbs {
+		if !samePostgresMajor(cd, db, masterDB) {
+			log.Warnw("ignoring db since its keeper postgres major version is different than the master one", "db", db.UID, "keeper", db.Spec.KeeperUID, "postgresVersion", cd.Keepers[db.Spec.KeeperUID].Status.PostgresBinaryVersion, "masterPostgresVersion", cd.Keepers[masterDB.Spec.KeeperUID].Status.PostgresBinaryVersion)
+			continue
+		}
+		candidates = append(candidates, db)
+	}
+	return candidates
+}
+
+// hasLogicalReplSlots reports if the db has reported all the logical
+// replication slots defined in the cluster spec
+func hasLogicalReplSlots(cd *cluster.ClusterData, db *cluster.DB) bool {
+	for _, ls := range cd.Cluster.DefSpec().LogicalReplicationSlots {
+		found := false
+		for _, rs := range db.Status.LogicalReplicationSlots {
+			if rs.Name == common.StolonName(ls.Name) && rs.Database == ls.DefDatabase() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// preferLogicalReplSlotsSynced moves before the others, keeping their order,
+// the new master candidates having all the logical replication slots, so
+// their consumers can continue after the failover.
+func preferLogicalReplSlotsSynced(cd *cluster.ClusterData, dbs []*cluster.DB) []*cluster.DB {
+	synced := []*cluster.DB{}
+	others := []*cluster.DB{}
+	for _, db := range dbs {
+		if hasLogicalReplSlots(cd, db) {
+			synced = append(synced, db)
+			continue
+		}
+		log.Debugw("db doesn't have all the logical replication slots", "db", db.UID, "keeper", db.Spec.KeeperUID)
+		others = append(others, db)
+	}
+	return append(synced, others...)
+}
+
+func (s *Sentinel) findBestNewMasters(cd *cluster.ClusterData, masterDB *cluster.DB) []*cluster.DB {
+	bestNewMasters := s.findBestStandbys(cd, masterDB)
+	// Add the previous masters to the best standbys (if valid and in good state)
+	goodMasters, _, _ := s.validMastersByStatus(cd)
+	log.Debugf("goodMasters: %s", spew.Sdump(goodMasters))
+	for _, db := range goodMasters {
+		if db.UID == masterDB.UID {
+			log.Debugw("ignoring db since it's the current master", "db", db.UID, "keeper", db.Spec.KeeperUID)
+			continue
+		}
+		if db.Status.TimelineID != masterDB.Status.TimelineID {
+			log.Debugw("ignoring keeper since its pg timeline is different than master timeline", "db", db.UID, "dbTimeline", db.Status.TimelineID, "masterTimeline", masterDB.Status.TimelineID)
+			continue
+		}
+		// do this only when not using synchronous replication since in sync repl we
+		// have to ignore the last reported xlogpos or valid sync standby will be
+		// skipped
+		if !s.syncRepl(cd.Cluster.DefSpec()) {
+			if !s.isLagBelowMax(cd, masterDB, db) {
+				log.Debugw("ignoring keeper since its lag is above the max configured lag", "db", db.UID, "dbXLogPos", db.Status.XLogPos, "masterXLogPos", masterDB.Status.XLogPos)
+				continue
+			}
+		}
+		bestNewMasters = append(bestNewMasters, db)
+	}
+	bestNewMasters = excludeDrainedKeepers(cd, bestNewMasters)
+	bestNewMasters = excludePostgresMajorMismatch(cd, masterDB, bestNewMasters)
+	bestNewMasters = excludeReplayLaggingDBs(cd, masterDB, bestNewMasters)
+	bestNewMasters = s.excludeDelayedStandbys(cd, bestNewMasters)
+	bestNewMasters = orderNewMasters(cd, masterDB, bestNewMasters)
+	log.Debugf("bestNewMasters: %s", spew.Sdump(bestNewMasters))
+	return bestNewMasters
+}
+
+// quorumNewMasterDB chooses the new master, between the best new masters, when
+// the failed master uses quorum synchronous replication (ANY num_sync).
+// Since the master waited only for num_sync of its N synchronous standbys, a
+// standby having all the committed transactions is surely between any N -
+// num_sync + 1 of them. So at least N - num_sync + 1 in sync synchronous
+// standbys must be available and the one with the greatest xlog position is
+// chosen. When the xlog positions are equal the best new masters order is
+// kept.
+func quorumNewMasterDB(masterDB *cluster.DB, bestNewMasters []*cluster.DB) *cluster.DB {
+	commonSyncStandbys := util.CommonElements(masterDB.Status.SynchronousStandbys, masterDB.Spec.SynchronousStandbys)
+	n := len(masterDB.Spec.SynchronousStandbys) + len(masterDB.Spec.ExternalSynchronousStandbys)
+	required := n - int(masterDB.Spec.SynchronousStandbysQuorum) + 1
+	if required < 1 {
+		required = 1
+	}
+
+	candidates := []*cluster.DB{}
+	for _, nm := range bestNewMasters {
+		if util.StringInSlice(commonSyncStandbys, nm.UID) {
+			candidates = append(candidates, nm)
+		}
+	}
+	if len(candidates) < required {
+		log.Warnw("cannot choose synchronous standby since there aren't enough usable synchronous standbys to satisfy the quorum", "reported", masterDB.Status.SynchronousStandbys, "spec", masterDB.Spec.SynchronousStandbys, "quorum", masterDB.Spec.SynchronousStandbysQuorum, "required", required, "possibleMasters", bestNewMasters)
+		return nil
+	}
+
+	var bestNewMasterDB *cluster.DB
+	for _, nm := range candidates {
+		if bestNewMasterDB == nil || nm.Status.XLogPos > bestNewMasterDB.Status.XLogPos {
+			bestNewMasterDB = nm
+		}
+	}
+	return bestNewMasterDB
+}
+
+func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInfo) (*cluster.ClusterData, error) {
+	// take a cd deepCopy to check that the code isn't changing it (it'll be a bug)
+	origcd := cd.DeepCopy()
+	newcd := cd.DeepCopy()
+	clusterSpec := cd.Cluster.DefSpec()
+
+	s.electionDecision = electionDecisionNone
+
+	switch cd.Cluster.Status.Phase {
+	case cluster.ClusterPhaseInitializing:
+		switch *clusterSpec.InitMode {
+		case cluster.ClusterInitModeNew:
+			// Is there already a keeper choosed to be the new master?
+			if cd.Cluster.Status.Master == "" {
+				log.Infow("trying to find initial master")
+				k, err := s.findInitialKeeper(newcd)
+				if err != nil {
+					return nil, fmt.Errorf("cannot choose initial master: %v", err)
+				}
+				log.Infow("initializing cluster", "keeper", k.UID)
+				db := &cluster.DB{
+					UID:        s.UIDFn(),
+					Generation: cluster.InitialGeneration,
+					Spec: &cluster.DBSpec{
+						KeeperUID:     k.UID,
+						InitMode:      cluster.DBInitModeNew,
+						NewConfig:     clusterSpec.NewConfig,
+						Role:          common.RoleMaster,
+						Followers:     []string{},
 						IncludeConfig: *clusterSpec.MergePgParameters,
 					},
 				}
@@ -790,7 +1950,12 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 					panic(fmt.Errorf("db %q object doesn't exists. This shouldn't happen", cd.Cluster.Status.Master))
 				}
 				// Check that the choosed db for being the master has correctly initialized
-				switch s.dbConvergenceState(db, clusterSpec.InitTimeout.Duration) {
+				convergenceState := s.dbConvergenceState(db, clusterSpec.InitTimeout.Duration)
+				if db.Status.MasterRoleDeclined {
+					log.Infow("keeper declined the master role", "db", db.UID, "keeper", db.Spec.KeeperUID)
+					convergenceState = ConvergenceFailed
+				}
+				switch convergenceState {
 				case Converged:
 					if db.Status.Healthy {
 						log.Infow("db initialized", "db", db.UID, "keeper", db.Spec.KeeperUID)
@@ -805,6 +1970,7 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 						}
 						// Cluster initialized, switch to Normal state
 						newcd.Cluster.Status.Phase = cluster.ClusterPhaseNormal
+						s.setInitConfig(newcd, db)
 					}
 				case Converging:
 					log.Infow("waiting for db", "db", db.UID, "keeper", db.Spec.KeeperUID)
@@ -847,6 +2013,11 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 				if !ok {
 					panic(fmt.Errorf("db %q object doesn't exists. This shouldn't happen", cd.Cluster.Status.Master))
 				}
+				// The keeper to use is explicitly defined so just wait for
+				// it to accept the master role
+				if db.Status.MasterRoleDeclined {
+					log.Infow("keeper declined the master role, waiting for it to accept it", "db", db.UID, "keeper", db.Spec.KeeperUID)
+				}
 				// Check that the choosed db for being the master has correctly initialized
 				if db.Status.Healthy && s.dbConvergenceState(db, clusterSpec.ConvergenceTimeout.Duration) == Converged {
 					log.Infow("db initialized", "db", db.UID, "keeper", db.Spec.KeeperUID)
@@ -860,6 +2031,7 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 					}
 					// Cluster initialized, switch to Normal state
 					newcd.Cluster.Status.Phase = cluster.ClusterPhaseNormal
+					s.setInitConfig(newcd, db)
 				}
 			}
 		case cluster.ClusterInitModePITR:
@@ -904,7 +2076,12 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 				}
 				// Check that the choosed db for being the master has correctly initialized
 				// TODO(sgotti) set a timeout (the max time for a restore operation)
-				switch s.dbConvergenceState(db, 0) {
+				convergenceState := s.dbConvergenceState(db, 0)
+				if db.Status.MasterRoleDeclined {
+					log.Infow("keeper declined the master role", "db", db.UID, "keeper", db.Spec.KeeperUID)
+					convergenceState = ConvergenceFailed
+				}
+				switch convergenceState {
 				case Converged:
 					if db.Status.Healthy {
 						log.Infow("db initialized", "db", db.UID, "keeper", db.Spec.KeeperUID)
@@ -919,6 +2096,7 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 						}
 						// Cluster initialized, switch to Normal state
 						newcd.Cluster.Status.Phase = cluster.ClusterPhaseNormal
+						s.setInitConfig(newcd, db)
 					}
 				case Converging:
 					log.Infow("waiting for db to converge", "db", db.UID, "keeper", db.Spec.KeeperUID)
@@ -941,8 +2119,8 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 		for _, k := range newcd.Keepers {
 			// get db associated to the keeper
 			db := cd.FindDB(k)
-			if db != nil {
-				// skip keepers with an assigned db
+			if db != nil || isMaintenanceKeeper(cd, k.UID) {
+				// skip keepers with an assigned db or in maintenance
 				continue
 			}
 			if time.Now().After(k.Status.LastHealthyTime.Add(cd.Cluster.DefSpec().DeadKeeperRemovalInterval.Duration)) {
@@ -966,6 +2144,10 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 		wantedMasterDBUID := curMasterDBUID
 
 		masterOK := true
+		// the master is failed only since it's reported unhealthy (and not
+		// also since not converged or declining the master role), so the
+		// failover quorum applies
+		masterUnhealthy := false
 		curMasterDB := cd.DBs[curMasterDBUID]
 		if curMasterDB == nil {
 			return nil, fmt.Errorf("db for keeper %q not available. This shouldn't happen!", curMasterDBUID)
@@ -975,23 +2157,82 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 		if !curMasterDB.Status.Healthy {
 			log.Infow("master db is failed", "db", curMasterDB.UID, "keeper", curMasterDB.Spec.KeeperUID)
 			masterOK = false
+			masterUnhealthy = true
 		}
 
 		// Check that the wanted master is in master state (i.e. check that promotion from standby to master happened)
 		if s.dbConvergenceState(curMasterDB, clusterSpec.ConvergenceTimeout.Duration) == ConvergenceFailed {
 			log.Infow("db not converged", "db", curMasterDB.UID, "keeper", curMasterDB.Spec.KeeperUID)
 			masterOK = false
+			masterUnhealthy = false
+		}
+
+		// The keeper refused to promote the db since its pre master
+		// validation failed
+		if curMasterDB.Status.MasterRoleDeclined {
+			log.Infow("keeper declined the master role", "db", curMasterDB.UID, "keeper", curMasterDB.Spec.KeeperUID)
+			masterOK = false
+			masterUnhealthy = false
+		}
+
+		// Handle a requested failover to a specific keeper. It's a one shot
+		// request so always clear it.
+		if targetKeeperUID := cd.Cluster.Status.FailoverTargetKeeper; targetKeeperUID != "" {
+			force := cd.Cluster.Status.FailoverTargetForce
+			newcd.Cluster.Status.FailoverTargetKeeper = ""
+			newcd.Cluster.Status.FailoverTargetForce = false
+			if targetDB := s.findFailoverTargetDB(newcd, curMasterDB, targetKeeperUID, force); targetDB != nil {
+				log.Infow("electing the requested failover target db as the new master", "db", targetDB.UID, "keeper", targetDB.Spec.KeeperUID, masterElectionEvent(curMasterDBUID, targetDB))
+				wantedMasterDBUID = targetDB.UID
+				s.electionDecision = electionDecisionFailoverTarget
+			}
+		}
+
+		// Handle a switchover in progress
+		if newcd.Cluster.Status.Switchover != nil && curMasterDBUID == wantedMasterDBUID {
+			if targetDB := s.handleSwitchover(newcd, curMasterDB, masterOK, pis); targetDB != nil {
+				log.Infow("electing the switchover target db as the new master", "db", targetDB.UID, "keeper", targetDB.Spec.KeeperUID, masterElectionEvent(curMasterDBUID, targetDB))
+				wantedMasterDBUID = targetDB.UID
+				s.electionDecision = electionDecisionSwitchover
+			}
+		}
+
+		// Request a rolling restart to load the extensions shared preload
+		// libraries
+		if masterOK && curMasterDBUID == wantedMasterDBUID && newcd.Cluster.Status.Switchover == nil && !newcd.Cluster.Status.RollingRestart.InProgress() {
+			if libs := extensionsRestartNeeded(newcd); libs != nil {
+				log.Infow("requesting a rolling restart to load the extensions shared preload libraries", "sharedPreloadLibraries", libs)
+				newcd.Cluster.Status.RollingRestart = &cluster.RollingRestart{
+					Phase:                  cluster.RollingRestartPhaseRequested,
+					SharedPreloadLibraries: libs,
+				}
+			}
+		}
+
+		// Handle a rolling restart in progress
+		if newcd.Cluster.Status.RollingRestart.InProgress() && curMasterDBUID == wantedMasterDBUID {
+			s.handleRollingRestart(newcd, curMasterDB, masterOK)
+		}
+
+		// Start a requested postgres major version upgrade
+		if newcd.Cluster.Status.PGUpgrade.InProgress() && curMasterDBUID == wantedMasterDBUID {
+			startPGUpgrade(newcd, curMasterDB, masterOK)
 		}
 
-		if !masterOK {
+		if !masterOK && curMasterDBUID == wantedMasterDBUID && masterUnhealthy && !s.failoverQuorumReached(newcd, curMasterDB) {
+			s.electionDecision = electionDecisionNoFailoverQuorum
+		} else if !masterOK && curMasterDBUID == wantedMasterDBUID && automaticFailoverAllowed(newcd, time.Now()) {
 			log.Infow("trying to find a new master to replace failed master")
 			bestNewMasters := s.findBestNewMasters(newcd, curMasterDB)
 			if len(bestNewMasters) == 0 {
 				log.Errorw("no eligible masters")
+				s.electionDecision = electionDecisionNoEligibleMaster
 			} else {
 				// if synchronous replication is enabled, only choose new master in the synchronous replication standbys.
 				var bestNewMasterDB *cluster.DB
-				if curMasterDB.Spec.SynchronousReplication == true {
+				if curMasterDB.Spec.SynchronousReplication == true && curMasterDB.Spec.SynchronousStandbysQuorum > 0 {
+					bestNewMasterDB = quorumNewMasterDB(curMasterDB, bestNewMasters)
+				} else if curMasterDB.Spec.SynchronousReplication == true {
 					commonSyncStandbys := util.CommonElements(curMasterDB.Status.SynchronousStandbys, curMasterDB.Spec.SynchronousStandbys)
 					if len(commonSyncStandbys) == 0 {
 						log.Warnw("cannot choose synchronous standby since there are no common elements between the latest master reported synchronous standbys and the db spec ones", "reported", curMasterDB.Status.SynchronousStandbys, "spec", curMasterDB.Spec.SynchronousStandbys)
@@ -1009,11 +2250,16 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 				} else {
 					bestNewMasterDB = bestNewMasters[0]
 				}
-				if bestNewMasterDB != nil {
-					log.Infow("electing db as the new master", "db", bestNewMasterDB.UID, "keeper", bestNewMasterDB.Spec.KeeperUID)
+				if bestNewMasterDB != nil && !s.fenceOldMaster(newcd, curMasterDB, bestNewMasterDB) {
+					s.electionDecision = electionDecisionFencingFailed
+				} else if bestNewMasterDB != nil {
+					log.Infow("electing db as the new master", "db", bestNewMasterDB.UID, "keeper", bestNewMasterDB.Spec.KeeperUID, masterElectionEvent(curMasterDBUID, bestNewMasterDB))
 					wantedMasterDBUID = bestNewMasterDB.UID
+					recordAutomaticFailover(newcd, time.Now())
+					s.electionDecision = electionDecisionFailover
 				} else {
 					log.Errorw("no eligible masters")
+					s.electionDecision = electionDecisionNoEligibleMaster
 				}
 			}
 		}
@@ -1062,6 +2308,7 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 				if len(newMasterDB.Spec.SynchronousStandbys) == 0 {
 					newMasterDB.Spec.ExternalSynchronousStandbys = []string{fakeStandbyName}
 				}
+				newMasterDB.Spec.SynchronousStandbysQuorum = oldMasterdb.Spec.SynchronousStandbysQuorum
 
 				// Just sort to always have them in the same order and avoid
 				// unneeded updates to synchronous_standby_names by the keeper.
@@ -1071,6 +2318,7 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 				newMasterDB.Spec.SynchronousReplication = false
 				newMasterDB.Spec.SynchronousStandbys = nil
 				newMasterDB.Spec.ExternalSynchronousStandbys = nil
+				newMasterDB.Spec.SynchronousStandbysQuorum = 0
 			}
 		}
 
@@ -1078,7 +2326,9 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 			masterDB := newcd.DBs[curMasterDBUID]
 			masterDBKeeper := newcd.Keepers[masterDB.Spec.KeeperUID]
 
-			if newcd.Proxy.Spec.MasterDBUID == "" {
+			if newcd.Proxy.Spec.MasterDBUID == "" && newcd.Cluster.Status.Switchover != nil {
+				log.Infow("keeping proxies paused during the switchover")
+			} else if newcd.Proxy.Spec.MasterDBUID == "" {
 				// if the Proxy.Spec.MasterDBUID is empty we have to wait for all
 				// the proxies to have converged to be sure they closed connections
 				// to previous master or disappear (in this case we assume that they
@@ -1136,7 +2386,10 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 					delete(newcd.DBs, db.UID)
 				}
 
-				// Remove invalid dbs
+				// Remove invalid dbs and dbs that won't sync, following the
+				// automaticResync policy
+				automaticResyncDBs := map[string]struct{}{}
+
 				toRemove = []*cluster.DB{}
 				for _, db := range newcd.DBs {
 					if db.UID == wantedMasterDBUID {
@@ -1145,6 +2398,10 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 					if s.dbValidity(newcd, db.UID) != dbValidityInvalid {
 						continue
 					}
+					automaticResyncDBs[db.UID] = struct{}{}
+					if !automaticResync(newcd, db, cluster.AutomaticResyncReasonInvalidData, invalidDBError(newcd, db), time.Now()) {
+						continue
+					}
 					log.Infow("removing invalid db", "db", db.UID, "keeper", db.Spec.KeeperUID)
 					toRemove = append(toRemove, db)
 				}
@@ -1158,12 +2415,21 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 					if s.dbCanSync(cd, db.UID) {
 						continue
 					}
+					automaticResyncDBs[db.UID] = struct{}{}
+					if !automaticResync(newcd, db, cluster.AutomaticResyncReasonMissingWal, missingWalDBError(cd, db), time.Now()) {
+						continue
+					}
 					log.Infow("removing db that won't be able to sync due to missing wals on current master", "db", db.UID, "keeper", db.Spec.KeeperUID)
 					toRemove = append(toRemove, db)
 				}
 				for _, db := range toRemove {
 					delete(newcd.DBs, db.UID)
 				}
+				for _, db := range newcd.DBs {
+					if _, ok := automaticResyncDBs[db.UID]; !ok {
+						db.Status.AutomaticResync = nil
+					}
+				}
 
 				goodStandbys, failedStandbys, convergingStandbys := s.validStandbysByStatus(newcd)
 				goodStandbysCount := len(goodStandbys)
@@ -1199,6 +2465,23 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 						}
 					}
 
+					// With quorum synchronous replication the master waits
+					// only for MinSynchronousStandbys of the synchronous
+					// standbys. The ANY method is available only on
+					// postgres >= 10.
+					quorum := 0
+					if *clusterSpec.SynchronousReplicationMethod == cluster.SynchronousReplicationMethodAny {
+						if masterDBKeeper.Status.PostgresBinaryVersion.Maj >= 10 {
+							quorum = minSynchronousStandbys
+						} else {
+							log.Warnw("quorum synchronous replication requires postgres >= 10, waiting for all the synchronous standbys", "masterDB", masterDB.UID, "keeper", masterDBKeeper.UID)
+						}
+					}
+					if masterDB.Spec.SynchronousStandbysQuorum != uint16(quorum) {
+						log.Infow("synchronous standbys quorum changed", "masterDB", masterDB.UID, "prevQuorum", masterDB.Spec.SynchronousStandbysQuorum, "quorum", quorum)
+						masterDB.Spec.SynchronousStandbysQuorum = uint16(quorum)
+					}
+
 					// if the current known in sync syncstandbys are different than the required ones wait for them and remove non good ones
 					if !util.CompareStringSliceNoOrder(masterDB.Status.SynchronousStandbys, masterDB.Spec.SynchronousStandbys) {
 
@@ -1246,6 +2529,10 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 					} else {
 						addFakeStandby := false
 						externalSynchronousStandbys := map[string]struct{}{}
+						lagAware := *clusterSpec.SyncStandbySelection == cluster.SyncStandbySelectionLag
+						maxSyncLag := *clusterSpec.SyncStandbyMaxReplayLag
+						// reasons of the synchronous standbys added in this step
+						reasons := map[string]string{}
 
 						// make a map of synchronous standbys starting from the current ones
 						prevSynchronousStandbys := map[string]struct{}{}
@@ -1274,53 +2561,131 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 							if _, ok := goodStandbys[dbUID]; !ok {
 								log.Infow("removing failed synchronous standby", "masterDB", masterDB.UID, "db", dbUID)
 								toRemove[dbUID] = struct{}{}
+								continue
+							}
+							if isDelayedStandby(newcd, newcd.DBs[dbUID]) {
+								log.Infow("removing delayed synchronous standby", "masterDB", masterDB.UID, "db", dbUID)
+								toRemove[dbUID] = struct{}{}
+								continue
+							}
+							if isDrainedKeeper(newcd, newcd.DBs[dbUID].Spec.KeeperUID) {
+								log.Infow("removing synchronous standby of a drained keeper", "masterDB", masterDB.UID, "db", dbUID)
+								toRemove[dbUID] = struct{}{}
 							}
 						}
 						for dbUID, _ := range toRemove {
 							delete(synchronousStandbys, dbUID)
 						}
 
-						// Remove synchronous standbys in excess
-						if len(synchronousStandbys) > maxSynchronousStandbys {
-							rc := len(synchronousStandbys) - maxSynchronousStandbys
-							removedCount := 0
-							toRemove = map[string]struct{}{}
-							for dbUID, _ := range synchronousStandbys {
-								if removedCount >= rc {
-									break
-								}
-								log.Infow("removing synchronous standby in excess", "masterDB", masterDB.UID, "db", dbUID)
-								toRemove[dbUID] = struct{}{}
-								removedCount++
+						bestStandbys := s.findBestStandbys(newcd, curMasterDB)
+
+						// With the lag aware selection replace the synchronous
+						// standbys lagging more than SyncStandbyMaxReplayLag
+						// when there are enough candidates to replace them
+						if lagAware {
+							spare := len(synchronousStandbys) - maxSynchronousStandbys
+							notSync := []*cluster.DB{}
+							for _, bestStandby := range bestStandbys {
+								if _, ok := synchronousStandbys[bestStandby.UID]; ok {
+									continue
+								}
+								if isSyncStandbyCandidate(newcd, bestStandby) && isReplayLagBelowMax(newcd, curMasterDB, bestStandby) {
+									notSync = append(notSync, bestStandby)
+								}
 							}
-							for dbUID, _ := range toRemove {
-								delete(synchronousStandbys, dbUID)
+							spare += len(lagAwareSyncCandidates(curMasterDB, notSync, maxSyncLag))
+							for _, db := range laggingSyncStandbys(newcd, synchronousStandbys, maxSyncLag) {
+								if spare <= 0 {
+									break
+								}
+								log.Infow("replacing lagging synchronous standby", "masterDB", masterDB.UID, "db", db.UID, "lag", syncStandbyLag(db), "syncStandbyMaxReplayLag", maxSyncLag)
+								delete(synchronousStandbys, db.UID)
+								spare--
+							}
+						}
+
+						// Remove synchronous standbys in excess, keeping the
+						// ones spread between the failure domains
+						if len(synchronousStandbys) > maxSynchronousStandbys {
+							syncDBUIDs := []string{}
+							for dbUID, _ := range synchronousStandbys {
+								syncDBUIDs = append(syncDBUIDs, dbUID)
+							}
+							sort.Strings(syncDBUIDs)
+							syncDBs := []*cluster.DB{}
+							for _, dbUID := range syncDBUIDs {
+								syncDBs = append(syncDBs, newcd.DBs[dbUID])
+							}
+							syncDBs = spreadByFailureDomain(newcd, masterDB, nil, syncDBs)
+							for _, db := range syncDBs[maxSynchronousStandbys:] {
+								log.Infow("removing synchronous standby in excess", "masterDB", masterDB.UID, "db", db.UID)
+								delete(synchronousStandbys, db.UID)
 							}
 						}
 
 						// try to add missing standbys up to MaxSynchronousStandbys
-						bestStandbys := s.findBestStandbys(newcd, curMasterDB)
+						// preferring the ones in failure domains not already
+						// used by the master and the synchronous standbys
+						syncDBs := []*cluster.DB{}
+						candidates := []*cluster.DB{}
+						for _, bestStandby := range bestStandbys {
+							if _, ok := synchronousStandbys[bestStandby.UID]; ok {
+								syncDBs = append(syncDBs, bestStandby)
+								continue
+							}
+							if !isSyncStandbyCandidate(newcd, bestStandby) || !isReplayLagBelowMax(newcd, curMasterDB, bestStandby) {
+								continue
+							}
+							candidates = append(candidates, bestStandby)
+						}
+						if lagAware {
+							candidates = lagAwareSyncCandidates(curMasterDB, candidates, maxSyncLag)
+						}
+						candidates = spreadByFailureDomain(newcd, masterDB, syncDBs, candidates)
 
 						ac := maxSynchronousStandbys - len(synchronousStandbys)
 						addedCount := 0
-						for _, bestStandby := range bestStandbys {
+						for _, bestStandby := range candidates {
 							if addedCount >= ac {
 								break
 							}
-							if _, ok := synchronousStandbys[bestStandby.UID]; ok {
-								continue
-							}
 							log.Infow("adding new synchronous standby in good state trying to reach MaxSynchronousStandbys", "masterDB", masterDB.UID, "synchronousStandbyDB", bestStandby.UID, "keeper", bestStandby.Spec.KeeperUID)
 							synchronousStandbys[bestStandby.UID] = struct{}{}
+							reasons[bestStandby.UID] = fmt.Sprintf("chosen with replay lag %d bytes", syncStandbyLag(bestStandby))
 							addedCount++
 						}
 
+						// When all the synchronous standbys are in the master
+						// failure domain add one in another failure domain.
+						// The one in excess in the master failure domain will
+						// be removed when the new one is in sync.
+						if merge && !syncStandbysInOtherFailureDomain(newcd, masterDB, synchronousStandbys) {
+							for _, bestStandby := range candidates {
+								if inOtherFailureDomain(newcd, masterDB, bestStandby) {
+									log.Infow("adding new synchronous standby in a failure domain different from the master one", "masterDB", masterDB.UID, "synchronousStandbyDB", bestStandby.UID, "keeper", bestStandby.Spec.KeeperUID)
+									synchronousStandbys[bestStandby.UID] = struct{}{}
+									reasons[bestStandby.UID] = "chosen in a failure domain different from the master one"
+									break
+								}
+							}
+						}
+
+						// When there aren't enough healthy synchronous
+						// standbys and the syncReplDegradation policy has
+						// degraded to asynchronous replication, only the healthy
+						// synchronous standbys are kept
+						insufficient := len(synchronousStandbys)+len(externalSynchronousStandbys) < minSynchronousStandbys
+						degraded := updateSyncReplMode(newcd, insufficient, time.Now()) == cluster.SyncReplModeDegraded
+
 						// If there're some missing standbys to reach
 						// MinSynchronousStandbys, keep previous sync standbys,
 						// also if not in a good state. In this way we have more
 						// possibilities to choose a sync standby to replace a
 						// failed master if they becoe healthy again
 						ac = minSynchronousStandbys - len(synchronousStandbys)
+						if degraded {
+							ac = 0
+						}
 						addedCount = 0
 						for _, db := range newcd.DBs {
 							if addedCount >= ac {
@@ -1332,6 +2697,7 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 							if _, ok := prevSynchronousStandbys[db.UID]; ok {
 								log.Infow("adding previous synchronous standby to reach MinSynchronousStandbys", "masterDB", masterDB.UID, "synchronousStandbyDB", db.UID, "keeper", db.Spec.KeeperUID)
 								synchronousStandbys[db.UID] = struct{}{}
+								reasons[db.UID] = "previous synchronous standby kept to reach minSynchronousStandbys"
 								addedCount++
 							}
 						}
@@ -1360,6 +2726,9 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 									if _, ok := prevSynchronousStandbys[db.UID]; ok {
 										log.Infow("adding previous synchronous standby", "masterDB", masterDB.UID, "synchronousStandbyDB", db.UID, "keeper", db.Spec.KeeperUID)
 										synchronousStandbys[db.UID] = struct{}{}
+										if _, ok := reasons[db.UID]; !ok {
+											reasons[db.UID] = "previous synchronous standby merged while the new ones get in sync"
+										}
 									}
 								}
 							}
@@ -1372,7 +2741,7 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 						}
 
 						// If there're not enough real synchronous standbys add a fake synchronous standby because we have to be strict and make the master block transactions until MinSynchronousStandbys real standbys are available
-						if len(synchronousStandbys)+len(externalSynchronousStandbys) < minSynchronousStandbys {
+						if !degraded && len(synchronousStandbys)+len(externalSynchronousStandbys) < minSynchronousStandbys {
 							log.Infow("using a fake synchronous standby since there are not enough real standbys available", "masterDB", masterDB.UID, "required", minSynchronousStandbys)
 							addFakeStandby = true
 						}
@@ -1395,6 +2764,11 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 						// remove old syncstandbys from current status
 						masterDB.Status.SynchronousStandbys = util.CommonElements(masterDB.Status.SynchronousStandbys, masterDB.Spec.SynchronousStandbys)
 
+						masterDB.Status.SynchronousStandbysReasons = nil
+						if lagAware {
+							masterDB.Status.SynchronousStandbysReasons = syncStandbysReasons(curMasterDB.Status.SynchronousStandbysReasons, synchronousStandbys, reasons)
+						}
+
 						// Just sort to always have them in the same order and avoid
 						// unneeded updates to synchronous_standby_names by the keeper.
 						sort.Sort(sort.StringSlice(masterDB.Spec.SynchronousStandbys))
@@ -1404,8 +2778,12 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 					masterDB.Spec.SynchronousReplication = false
 					masterDB.Spec.SynchronousStandbys = nil
 					masterDB.Spec.ExternalSynchronousStandbys = nil
+					masterDB.Spec.SynchronousStandbysQuorum = 0
 
 					masterDB.Status.SynchronousStandbys = nil
+					masterDB.Status.SynchronousStandbysReasons = nil
+
+					newcd.Cluster.Status.SyncReplDegradation = nil
 				}
 
 				// NotFailed != Good since there can be some dbs that are converging
@@ -1426,6 +2804,16 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 						if util.StringInSlice(masterDB.Spec.SynchronousStandbys, db.UID) {
 							continue
 						}
+						// Don't remove standbys stopped to verify their
+						// data checksums
+						if isVerifyingChecksums(newcd, db) {
+							continue
+						}
+						// Don't remove standbys whose automatic resync has
+						// been halted or is waiting for the backoff
+						if db.Status.AutomaticResync != nil {
+							continue
+						}
 						if _, ok := goodStandbys[db.UID]; !ok {
 							log.Infow("removing non good standby", "db", db.UID)
 							toRemove = append(toRemove, db)
@@ -1458,7 +2846,13 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 					// Add missing DBs until MaxStandbysPerSender
 					freeKeepers := s.freeKeepers(newcd)
 					nf := len(freeKeepers)
-					for i := 0; i < nc && i < nf; i++ {
+					if nf < nc {
+						nc = nf
+					}
+					// the new standbys will be resynced, limit them by the
+					// cluster spec resyncScheduling
+					nc = allowedResyncs(clusterSpec.ResyncScheduling, convergingStandbys, nc, time.Now())
+					for i := 0; i < nc; i++ {
 						freeKeeper := freeKeepers[i]
 						db := &cluster.DB{
 							UID:        s.UIDFn(),
@@ -1491,28 +2885,48 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 					db.Spec.SynchronousStandbys = nil
 					db.Spec.ExternalSynchronousStandbys = nil
 				}
+
+				// Reconfigure the cascading standbys as followers of
+				// their followed standbys
+				for _, db := range newcd.DBs {
+					if s.dbType(newcd, db.UID) != dbTypeStandby {
+						continue
+					}
+					followedDB := s.cascadingFollowedDB(newcd, masterDB, db)
+					db.Spec.FollowConfig.DBUID = followedDB.UID
+				}
 			}
 		}
 
-		// Update followers for master DB
+		// Update followers for all the DBs
 		// Always do this since, in future, keepers and related db could be
 		// removed (currently only dead keepers without an assigned db are
 		// removed)
 		masterDB := newcd.DBs[curMasterDBUID]
 		masterDB.Spec.Followers = []string{}
+		for _, db := range newcd.DBs {
+			if db.Spec.Followers != nil {
+				db.Spec.Followers = []string{}
+			}
+		}
 		for _, db := range newcd.DBs {
 			if masterDB.UID == db.UID {
 				continue
 			}
 			fc := db.Spec.FollowConfig
-			if fc != nil {
-				if fc.Type == cluster.FollowTypeInternal && fc.DBUID == wantedMasterDBUID {
-					masterDB.Spec.Followers = append(masterDB.Spec.Followers, db.UID)
+			if fc != nil && fc.Type == cluster.FollowTypeInternal {
+				if followedDB, ok := newcd.DBs[fc.DBUID]; ok && followedDB.UID != db.UID && (followedDB.UID == wantedMasterDBUID || s.dbType(newcd, followedDB.UID) == dbTypeStandby) {
+					followedDB.Spec.Followers = append(followedDB.Spec.Followers, db.UID)
 				}
 			}
 		}
-		// Sort followers so the slice won't be considered changed due to different order of the same entries.
-		sort.Strings(masterDB.Spec.Followers)
+		// Sort followers so the slices won't be considered changed due to different order of the same entries.
+		for _, db := range newcd.DBs {
+			sort.Strings(db.Spec.Followers)
+		}
+
+	case cluster.ClusterPhaseUpgrade:
+		s.handlePGUpgrade(newcd)
 
 	default:
 		return nil, fmt.Errorf("unknown cluster phase %s", cd.Cluster.Status.Phase)
@@ -1521,6 +2935,15 @@ func (s *Sentinel) updateCluster(cd *cluster.ClusterData, pis cluster.ProxiesInf
 	// Copy the clusterSpec parameters to the dbSpec
 	s.setDBSpecFromClusterSpec(newcd)
 
+	s.updateUnsafeDurability(newcd)
+	s.updateDataChecksums(newcd)
+	s.clearDropReplicationSlots(newcd)
+	s.clearGracefulDemotion(newcd)
+
+	if newcd.Cluster.Status.Phase == cluster.ClusterPhaseNormal {
+		s.updateBackups(newcd, time.Now())
+	}
+
 	// Update generation on DBs if they have changed
 	for dbUID, db := range newcd.DBs {
 		prevDB, ok := cd.DBs[dbUID]
@@ -1716,10 +3139,16 @@ type Sentinel struct {
 	sleepInterval  time.Duration
 	requestTimeout time.Duration
 
+	// last cluster data value written by this sentinel, used to ignore the
+	// watch notifications of its own updates
+	writtenCDValue []byte
+
 	// Make UIDFn settable to ease testing with reproducible UIDs
 	UIDFn func() string
 	// Make RandFn settable to ease testing with reproducible "random" numbers
 	RandFn func(int) int
+	// Make ProbeDBFn settable to ease testing without real dbs
+	ProbeDBFn func(address string, timeout time.Duration) error
 
 	keeperErrorTimers      map[string]int64
 	dbErrorTimers          map[string]int64
@@ -1728,6 +3157,441 @@ type Sentinel struct {
 
 	keeperInfoHistories KeeperInfoHistories
 	proxyInfoHistories  ProxyInfoHistories
+
+	// master election decision taken by the last updateCluster
+	electionDecision electionDecision
+
+	// sentinels info read by the last check, when the failover quorum is
+	// enabled
+	sentinelsInfo cluster.SentinelsInfo
+
+	notifier *notifier
+
+	// client of the StolonCluster resource defining the cluster spec
+	clusterResource clusterResourceClient
+	// last written cluster resource status
+	clusterResourceStatus *clusterResourceStatus
+
+	metricsMutex sync.Mutex
+	metrics      sentinelMetrics
+
+	// last actions reported in dry run mode
+	lastDryRunActions []string
+
+	// the current check is in dry run mode
+	checkDryRun bool
+	// since when the standby cluster upstream primary is unreachable
+	upstreamUnreachableSince time.Time
+	// Make fenceFn settable to ease testing without a real fencing command
+	fenceFn func(spec *cluster.ClusterSpec, req *fencingRequest) error
+
+	tracer *tracing.Tracer
+	// span of the current check
+	checkSpan *tracing.Span
+}
+
+// electionDecision is a master election decision reported by the sentinel
+// metrics
+type electionDecision string
+
+const (
+	electionDecisionNone             electionDecision = ""
+	electionDecisionFailover         electionDecision = "failover"
+	electionDecisionFailoverTarget   electionDecision = "failover_target"
+	electionDecisionSwitchover       electionDecision = "switchover"
+	electionDecisionNoEligibleMaster electionDecision = "no_eligible_master"
+	electionDecisionFencingFailed    electionDecision = "fencing_failed"
+	electionDecisionNoFailoverQuorum electionDecision = "no_failover_quorum"
+)
+
+// sentinelMetrics is the sentinel state reported by the sentinel metrics
+type sentinelMetrics struct {
+	// last read cluster data
+	cd *cluster.ClusterData
+	// time of the last cluster data update done by this sentinel
+	lastCDUpdate time.Time
+	failovers    uint64
+	decisions    map[electionDecision]uint64
+	// the sentinel is in dry run mode
+	dryRun bool
+	// election decisions computed, but not applied, in dry run mode
+	dryRunDecisions map[electionDecision]uint64
+}
+
+func (s *Sentinel) updateMetrics(fn func(m *sentinelMetrics)) {
+	s.metricsMutex.Lock()
+	defer s.metricsMutex.Unlock()
+	fn(&s.metrics)
+}
+
+// metricsCopy returns a copy of the metrics. The cluster data isn't copied
+// since it's never changed after being read.
+func (s *Sentinel) metricsCopy() sentinelMetrics {
+	s.metricsMutex.Lock()
+	defer s.metricsMutex.Unlock()
+	m := s.metrics
+	m.decisions = map[electionDecision]uint64{}
+	for d, n := range s.metrics.decisions {
+		m.decisions[d] = n
+	}
+	m.dryRunDecisions = map[electionDecision]uint64{}
+	for d, n := range s.metrics.dryRunDecisions {
+		m.dryRunDecisions[d] = n
+	}
+	return m
+}
+
+// recordCDUpdate records in the metrics a cluster data update and the
+// election decision it applied
+func (s *Sentinel) recordCDUpdate(cd, newcd *cluster.ClusterData, decision electionDecision) {
+	s.updateMetrics(func(m *sentinelMetrics) {
+		m.cd = newcd
+		m.lastCDUpdate = time.Now()
+		if decision != electionDecisionNone {
+			if m.decisions == nil {
+				m.decisions = map[electionDecision]uint64{}
+			}
+			m.decisions[decision]++
+		}
+		if decision == electionDecisionFailover && cd.Cluster.Status.Master != newcd.Cluster.Status.Master {
+			m.failovers++
+		}
+	})
+}
+
+// reportDryRun logs, and reports in the metrics and events, the actions the
+// sentinel would do writing newcd. Since the cluster data isn't written the
+// same actions are computed at every check, so they're reported only when
+// different from the last reported ones.
+func (s *Sentinel) reportDryRun(cd, newcd *cluster.ClusterData, decision electionDecision) {
+	actions := dryRunActions(cd, newcd)
+	if len(actions) == 0 {
+		s.lastDryRunActions = nil
+		return
+	}
+	if reflect.DeepEqual(actions, s.lastDryRunActions) {
+		return
+	}
+	s.lastDryRunActions = actions
+	for _, action := range actions {
+		log.Infow("dry run: cluster data not written", "action", action)
+	}
+	if decision != electionDecisionNone {
+		s.updateMetrics(func(m *sentinelMetrics) {
+			if m.dryRunDecisions == nil {
+				m.dryRunDecisions = map[electionDecision]uint64{}
+			}
+			m.dryRunDecisions[decision]++
+		})
+	}
+	for _, ev := range clusterEvents(cd, newcd, time.Now()) {
+		ev.DryRun = true
+		s.notifier.notify(ev)
+	}
+}
+
+// sentinelCollector reports the sentinel state and the cluster health
+type sentinelCollector struct {
+	s             *Sentinel
+	nowFn         func() time.Time
+	leader        *prometheus.Desc
+	keepers       *prometheus.Desc
+	dbGeneration  *prometheus.Desc
+	proxyGen      *prometheus.Desc
+	lastUpdate    *prometheus.Desc
+	failovers     *prometheus.Desc
+	decisions     *prometheus.Desc
+	masterHealthy *prometheus.Desc
+	dryRun        *prometheus.Desc
+	dryRunDecs    *prometheus.Desc
+	syncReplMode  *prometheus.Desc
+}
+
+func newSentinelCollector(s *Sentinel) *sentinelCollector {
+	return &sentinelCollector{
+		s:             s,
+		nowFn:         time.Now,
+		leader:        prometheus.NewDesc("stolon_sentinel_leader", "Whether the sentinel is the leader sentinel (1) or not (0).", nil, nil),
+		keepers:       prometheus.NewDesc("stolon_sentinel_keepers", "Number of keepers in the cluster data by health state.", []string{"state"}, nil),
+		dbGeneration:  prometheus.NewDesc("stolon_sentinel_db_generation", "Generation of the db spec in the cluster data.", []string{"db", "keeper"}, nil),
+		proxyGen:      prometheus.NewDesc("stolon_sentinel_proxy_generation", "Generation of the proxy spec in the cluster data.", nil, nil),
+		lastUpdate:    prometheus.NewDesc("stolon_sentinel_cluster_data_last_update_seconds", "Seconds since the last successful cluster data update done by the sentinel. Not reported until the first update.", nil, nil),
+		failovers:     prometheus.NewDesc("stolon_sentinel_failovers_total", "Number of automatic failovers done by the sentinel.", nil, nil),
+		decisions:     prometheus.NewDesc("stolon_sentinel_master_election_decisions_total", "Number of master election decisions applied by the sentinel.", []string{"decision"}, nil),
+		masterHealthy: prometheus.NewDesc("stolon_sentinel_master_healthy", "Whether the cluster data master keeper is healthy (1) or not (0). Not reported without a cluster data.", nil, nil),
+		dryRun:        prometheus.NewDesc("stolon_sentinel_dry_run", "Whether the sentinel is in dry run mode (1), not writing the cluster data, or not (0).", nil, nil),
+		dryRunDecs:    prometheus.NewDesc("stolon_sentinel_dry_run_master_election_decisions_total", "Number of master election decisions computed, but not applied, by the sentinel in dry run mode.", []string{"decision"}, nil),
+		syncReplMode:  prometheus.NewDesc("stolon_sentinel_sync_repl_mode", "Whether the master synchronous replication is in the mode (1) or not (0). Reported only with synchronous replication enabled.", []string{"mode"}, nil),
+	}
+}
+
+func (sc *sentinelCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sc.leader
+	ch <- sc.keepers
+	ch <- sc.dbGeneration
+	ch <- sc.proxyGen
+	ch <- sc.lastUpdate
+	ch <- sc.failovers
+	ch <- sc.decisions
+	ch <- sc.masterHealthy
+	ch <- sc.dryRun
+	ch <- sc.dryRunDecs
+	ch <- sc.syncReplMode
+}
+
+func (sc *sentinelCollector) Collect(ch chan<- prometheus.Metric) {
+	leader, _ := sc.s.leaderInfo()
+	v := 0.0
+	if leader {
+		v = 1
+	}
+	ch <- prometheus.MustNewConstMetric(sc.leader, prometheus.GaugeValue, v)
+
+	m := sc.s.metricsCopy()
+	if !m.lastCDUpdate.IsZero() {
+		ch <- prometheus.MustNewConstMetric(sc.lastUpdate, prometheus.GaugeValue, sc.nowFn().Sub(m.lastCDUpdate).Seconds())
+	}
+	ch <- prometheus.MustNewConstMetric(sc.failovers, prometheus.CounterValue, float64(m.failovers))
+	for _, d := range []electionDecision{electionDecisionFailover, electionDecisionFailoverTarget, electionDecisionSwitchover, electionDecisionNoEligibleMaster, electionDecisionFencingFailed, electionDecisionNoFailoverQuorum} {
+		ch <- prometheus.MustNewConstMetric(sc.decisions, prometheus.CounterValue, float64(m.decisions[d]), string(d))
+		ch <- prometheus.MustNewConstMetric(sc.dryRunDecs, prometheus.CounterValue, float64(m.dryRunDecisions[d]), string(d))
+	}
+	v = 0.0
+	if m.dryRun {
+		v = 1
+	}
+	ch <- prometheus.MustNewConstMetric(sc.dryRun, prometheus.GaugeValue, v)
+
+	cd := m.cd
+	if cd == nil || cd.Cluster == nil {
+		return
+	}
+	healthy, failed := 0, 0
+	for _, k := range cd.Keepers {
+		if k.Status.Healthy {
+			healthy++
+		} else {
+			failed++
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(sc.keepers, prometheus.GaugeValue, float64(healthy), "healthy")
+	ch <- prometheus.MustNewConstMetric(sc.keepers, prometheus.GaugeValue, float64(failed), "failed")
+	for _, db := range cd.DBs {
+		ch <- prometheus.MustNewConstMetric(sc.dbGeneration, prometheus.GaugeValue, float64(db.Generation), db.UID, db.Spec.KeeperUID)
+	}
+	if cd.Proxy != nil {
+		ch <- prometheus.MustNewConstMetric(sc.proxyGen, prometheus.GaugeValue, float64(cd.Proxy.Generation))
+	}
+	v = 0.0
+	if masterHealthy(cd) {
+		v = 1
+	}
+	ch <- prometheus.MustNewConstMetric(sc.masterHealthy, prometheus.GaugeValue, v)
+	if curMode := cd.Cluster.SyncReplMode(); curMode != "" {
+		for _, mode := range []cluster.SyncReplMode{cluster.SyncReplModeSync, cluster.SyncReplModeBlocking, cluster.SyncReplModeDegraded} {
+			v = 0.0
+			if curMode == mode {
+				v = 1
+			}
+			ch <- prometheus.MustNewConstMetric(sc.syncReplMode, prometheus.GaugeValue, v, string(mode))
+		}
+	}
+}
+
+// masterHealthy reports if the cluster data master db keeper is healthy
+func masterHealthy(cd *cluster.ClusterData) bool {
+	if db, ok := cd.DBs[cd.Cluster.Status.Master]; ok {
+		if k, ok := cd.Keepers[db.Spec.KeeperUID]; ok && k.Status.Healthy {
+			return true
+		}
+	}
+	return false
+}
+
+// clusterEvents returns the cluster events happened updating the cluster
+// data from cd to newcd
+func clusterEvents(cd, newcd *cluster.ClusterData, now time.Time) []*cluster.Event {
+	if newcd == nil || newcd.Cluster == nil {
+		return nil
+	}
+	if cd == nil || cd.Cluster == nil {
+		cd = &cluster.ClusterData{Cluster: &cluster.Cluster{}}
+	}
+	events := []*cluster.Event{}
+	newEvent := func(t cluster.EventType) *cluster.Event {
+		ev := &cluster.Event{Type: t, Time: now, ClusterUID: newcd.Cluster.UID}
+		events = append(events, ev)
+		return ev
+	}
+
+	master := newcd.Cluster.Status.Master
+	prevMaster := cd.Cluster.Status.Master
+	if master != prevMaster && master != "" {
+		ev := newEvent(cluster.EventMasterElected)
+		ev.DBUID = master
+		ev.PreviousMasterDBUID = prevMaster
+		if db, ok := newcd.DBs[master]; ok {
+			ev.KeeperUID = db.Spec.KeeperUID
+		}
+	}
+
+	keeperUIDs := []string{}
+	for uid := range newcd.Keepers {
+		keeperUIDs = append(keeperUIDs, uid)
+	}
+	sort.Strings(keeperUIDs)
+	for _, uid := range keeperUIDs {
+		prevKeeper, ok := cd.Keepers[uid]
+		if ok && prevKeeper.Status.Healthy && !newcd.Keepers[uid].Status.Healthy {
+			newEvent(cluster.EventKeeperFailed).KeeperUID = uid
+		}
+	}
+
+	// a new master synchronous standbys are reported by its election event
+	if master == prevMaster {
+		db, ok := newcd.DBs[master]
+		prevDB, prevOk := cd.DBs[master]
+		if ok && prevOk && !util.CompareStringSliceNoOrder(db.Spec.SynchronousStandbys, prevDB.Spec.SynchronousStandbys) {
+			ev := newEvent(cluster.EventSynchronousStandbysChanged)
+			ev.DBUID = master
+			ev.KeeperUID = db.Spec.KeeperUID
+			ev.SynchronousStandbys = db.Spec.SynchronousStandbys
+		}
+	}
+
+	if cd.Cluster.Spec != nil && newcd.Cluster.Spec != nil && *cd.Cluster.DefSpec().Role == cluster.ClusterRoleStandby && *newcd.Cluster.DefSpec().Role == cluster.ClusterRoleMaster {
+		ev := newEvent(cluster.EventStandbyClusterPromoted)
+		ev.DBUID = master
+		if db, ok := newcd.DBs[master]; ok {
+			ev.KeeperUID = db.Spec.KeeperUID
+		}
+	}
+
+	healthy := masterHealthy(newcd)
+	prevHealthy := masterHealthy(cd)
+	if healthy != prevHealthy {
+		t := cluster.EventClusterUnhealthy
+		if healthy {
+			t = cluster.EventClusterHealthy
+		}
+		ev := newEvent(t)
+		ev.DBUID = master
+	}
+
+	return events
+}
+
+const (
+	notificationQueueSize     = 100
+	notificationRetryInterval = 1 * time.Second
+)
+
+// notifier posts the cluster events to the notification urls and appends
+// them to the store event log. The events are sent in order by a single
+// goroutine so the sentinel checks are never blocked by a slow notification
+// url.
+type notifier struct {
+	urls          []string
+	timeout       time.Duration
+	retries       int
+	retryInterval time.Duration
+	e             store.Store
+	eventsLogSize int
+
+	ch chan *cluster.Event
+}
+
+// newNotifier returns a notifier or nil if there aren't notification urls
+// and the event log is disabled
+func newNotifier(cfg *config, e store.Store) *notifier {
+	if len(cfg.notificationURLs) == 0 && cfg.eventsLogSize == 0 {
+		return nil
+	}
+	return &notifier{
+		urls:          cfg.notificationURLs,
+		timeout:       time.Duration(cfg.notificationTimeout) * time.Second,
+		retries:       cfg.notificationRetries,
+		retryInterval: notificationRetryInterval,
+		e:             e,
+		eventsLogSize: cfg.eventsLogSize,
+		ch:            make(chan *cluster.Event, notificationQueueSize),
+	}
+}
+
+// notify queues the event. When the queue is full the event is dropped.
+func (n *notifier) notify(ev *cluster.Event) {
+	if n == nil {
+		return
+	}
+	log.Infow("cluster event", "event", ev.Type, "db", ev.DBUID, "keeper", ev.KeeperUID)
+	select {
+	case n.ch <- ev:
+	default:
+		log.Warnw("notification queue full, dropping event", "event", ev.Type)
+	}
+}
+
+func (n *notifier) run(ctx context.Context) {
+	for {
+		select {
+		case ev := <-n.ch:
+			n.send(ctx, ev)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// postEvent posts the json encoded event to the url. A non 2xx response
+// status is reported as an error.
+func postEvent(url string, timeout time.Duration, data []byte) error {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return nil
+}
+
+func (n *notifier) send(ctx context.Context, ev *cluster.Event) {
+	if n.eventsLogSize > 0 {
+		sctx, cancel := context.WithTimeout(ctx, n.timeout)
+		err := n.e.AppendEvent(sctx, ev, n.eventsLogSize)
+		cancel()
+		if err != nil {
+			log.Errorw("failed to append event to the store event log", "event", ev.Type, zap.Error(err))
+		}
+	}
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		log.Errorw("failed to marshal event", "event", ev.Type, zap.Error(err))
+		return
+	}
+	for _, url := range n.urls {
+		for i := 0; ; i++ {
+			err := postEvent(url, n.timeout, data)
+			if err == nil {
+				break
+			}
+			if i >= n.retries {
+				log.Errorw("notification url request failed", "event", ev.Type, "url", url, zap.Error(err))
+				break
+			}
+			log.Warnw("notification url request failed, retrying", "event", ev.Type, "url", url, zap.Error(err))
+			// exponential backoff
+			select {
+			case <-time.After(n.retryInterval << uint(i)):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
 }
 
 func NewSentinel(uid string, cfg *config, end chan bool) (*Sentinel, error) {
@@ -1756,6 +3620,14 @@ func NewSentinel(uid string, cfg *config, end chan bool) (*Sentinel, error) {
 		return nil, fmt.Errorf("cannot create election: %v", err)
 	}
 
+	var crc clusterResourceClient
+	if cfg.clusterResource != "" {
+		crc, err = newKubeClusterResourceClient(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create cluster resource client: %v", err)
+		}
+	}
+
 	return &Sentinel{
 		uid:                uid,
 		cfg:                cfg,
@@ -1768,19 +3640,42 @@ func NewSentinel(uid string, cfg *config, end chan bool) (*Sentinel, error) {
 		// This is just to choose a pseudo random keeper so
 		// use math.rand (no need for crypto.rand) without an
 		// initial seed.
-		RandFn: rand.Intn,
+		RandFn:    rand.Intn,
+		ProbeDBFn: probeDB,
 
 		sleepInterval:  cluster.DefaultSleepInterval,
 		requestTimeout: cluster.DefaultRequestTimeout,
+
+		notifier:        newNotifier(cfg, e),
+		clusterResource: crc,
+		tracer:          cmd.NewTracer(&cfg.CommonConfig),
 	}, nil
 }
 
 func (s *Sentinel) Start(ctx context.Context) {
 	endCh := make(chan struct{})
 
-	timerCh := time.NewTimer(0).C
+	timer := time.NewTimer(0)
 
 	go s.electionLoop(ctx)
+	if s.notifier != nil {
+		go s.notifier.run(ctx)
+	}
+
+	// the cluster data watch triggers a new check without waiting for the
+	// sleep interval
+	watchCh := s.e.Watch(ctx)
+	checking := false
+	// cluster data changed during the current check
+	var changedPair *store.KVPair
+
+	check := func() {
+		checking = true
+		go func() {
+			s.clusterSentinelCheck(ctx)
+			endCh <- struct{}{}
+		}()
+	}
 
 	for true {
 		select {
@@ -1788,13 +3683,35 @@ func (s *Sentinel) Start(ctx context.Context) {
 			log.Infow("stopping stolon sentinel")
 			s.end <- true
 			return
-		case <-timerCh:
-			go func() {
-				s.clusterSentinelCheck(ctx)
-				endCh <- struct{}{}
-			}()
+		case <-timer.C:
+			check()
+		case pair, ok := <-watchCh:
+			if !ok {
+				watchCh = nil
+				continue
+			}
+			if checking {
+				changedPair = pair
+				continue
+			}
+			if bytes.Equal(pair.Value, s.writtenCDValue) {
+				continue
+			}
+			log.Debugw("cluster data changed")
+			if !timer.Stop() {
+				<-timer.C
+			}
+			check()
 		case <-endCh:
-			timerCh = time.NewTimer(s.sleepInterval).C
+			checking = false
+			if changedPair != nil && !bytes.Equal(changedPair.Value, s.writtenCDValue) {
+				log.Debugw("cluster data changed")
+				changedPair = nil
+				check()
+				continue
+			}
+			changedPair = nil
+			timer.Reset(s.sleepInterval)
 		}
 	}
 }
@@ -1805,6 +3722,35 @@ func (s *Sentinel) leaderInfo() (bool, uint) {
 	return s.leader, s.leadershipCount
 }
 
+// startAPIServer serves the management api. The requests are refused when the
+// sentinel isn't the leader.
+func (s *Sentinel) startAPIServer(cancel context.CancelFunc) error {
+	token, err := ioutil.ReadFile(cfg.apiTokenFile)
+	if err != nil {
+		return fmt.Errorf("cannot read the api token file: %v", err)
+	}
+	isLeader := func() bool {
+		leader, _ := s.leaderInfo()
+		return leader
+	}
+	apiServer, err := sentinelapi.NewServer(s.uid, strings.TrimSpace(string(token)), s.e, isLeader)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Addr: cfg.apiListenAddress, Handler: apiServer}
+	go func() {
+		var err error
+		if cfg.apiTLSCertFile != "" {
+			err = server.ListenAndServeTLS(cfg.apiTLSCertFile, cfg.apiTLSKeyFile)
+		} else {
+			err = server.ListenAndServe()
+		}
+		log.Errorw("management api http server error", zap.Error(err))
+		cancel()
+	}()
+	return nil
+}
+
 func (s *Sentinel) clusterSentinelCheck(pctx context.Context) {
 	s.updateMutex.Lock()
 	defer s.updateMutex.Unlock()
@@ -1812,7 +3758,7 @@ func (s *Sentinel) clusterSentinelCheck(pctx context.Context) {
 
 	cd, prevCDPair, err := e.GetClusterData(pctx)
 	if err != nil {
-		log.Errorw("error retrieving cluster data", zap.Error(err))
+		log.Errorw("error retrieving cluster data", zap.Error(err), slog.Event(slog.EventStoreConnectionLost))
 		return
 	}
 	if cd != nil {
@@ -1827,44 +3773,86 @@ func (s *Sentinel) clusterSentinelCheck(pctx context.Context) {
 		if cd.Cluster != nil {
 			s.sleepInterval = cd.Cluster.DefSpec().SleepInterval.Duration
 			s.requestTimeout = cd.Cluster.DefSpec().RequestTimeout.Duration
+			slog.SetClusterUID(cd.Cluster.UID)
 		}
-
+		s.updateMetrics(func(m *sentinelMetrics) { m.cd = cd })
 	}
+	dryRun := s.dryRun(cd)
+	s.updateMetrics(func(m *sentinelMetrics) { m.dryRun = dryRun })
 
 	log.Debugf("cd dump: %s", spew.Sdump(cd))
 
+	var cr *clusterResource
+	if s.clusterResource != nil {
+		cr, err = s.clusterResource.Get(pctx)
+		if err != nil {
+			log.Errorw("cannot get cluster resource", zap.Error(err))
+			return
+		}
+	}
+
 	if cd == nil {
 		// Cluster first initialization
-		if s.initialClusterSpec == nil {
+		initialClusterSpec := s.initialClusterSpec
+		if cr != nil {
+			if cr.Spec == nil {
+				log.Errorw("missing cluster resource spec")
+				return
+			}
+			if err := cr.Spec.Validate(); err != nil {
+				log.Errorw("invalid cluster resource spec", zap.Error(err))
+				return
+			}
+			initialClusterSpec = cr.Spec
+		}
+		if initialClusterSpec == nil {
 			log.Infow("no cluster data available, waiting for it to appear")
 			return
 		}
-		c := cluster.NewCluster(s.UIDFn(), s.initialClusterSpec)
+		if dryRun {
+			log.Infow("dry run: initial cluster data not written")
+			return
+		}
+		c := cluster.NewCluster(s.UIDFn(), initialClusterSpec)
 		log.Infow("writing initial cluster data")
 		newcd := cluster.NewClusterData(c)
 		log.Debugf("newcd dump: %s", spew.Sdump(newcd))
-		if _, err = e.AtomicPutClusterData(pctx, newcd, nil); err != nil {
+		pair, err := e.AtomicPutClusterData(pctx, newcd, nil)
+		if err != nil {
 			log.Errorw("error saving cluster data", zap.Error(err))
+			return
 		}
+		s.writtenCDValue = pair.Value
 		return
 	}
 
-	if err = s.setSentinelInfo(pctx, 2*s.sleepInterval); err != nil {
+	if err = s.setSentinelInfo(pctx, 2*s.sleepInterval, s.dbsReachability(cd)); err != nil {
 		log.Errorw("cannot update sentinel info", zap.Error(err))
 		return
 	}
 
-	keepersInfo, err := s.e.GetKeepersInfo(pctx)
-	if err != nil {
-		log.Errorw("cannot get keepers info", zap.Error(err))
-		return
-	}
-	log.Debugf("keepersInfo dump: %s", spew.Sdump(keepersInfo))
+	var keepersInfo cluster.KeepersInfo
+	var proxiesInfo cluster.ProxiesInfo
+	if s.cfg.storeBatchReads {
+		keepersInfo, proxiesInfo, err = s.e.GetKeepersAndProxiesInfo(pctx)
+		if err != nil {
+			log.Errorw("cannot get keepers and proxies info", zap.Error(err))
+			return
+		}
+		log.Debugf("keepersInfo dump: %s", spew.Sdump(keepersInfo))
+	} else {
+		keepersInfo, err = s.e.GetKeepersInfo(pctx)
+		if err != nil {
+			log.Errorw("cannot get keepers info", zap.Error(err))
+			return
+		}
+		log.Debugf("keepersInfo dump: %s", spew.Sdump(keepersInfo))
 
-	proxiesInfo, err := s.e.GetProxiesInfo(pctx)
-	if err != nil {
-		log.Errorw("failed to get proxies info", zap.Error(err))
-		return
+		proxiesInfo, err = s.e.GetProxiesInfo(pctx)
+		if err != nil {
+			log.Errorw("failed to get proxies info", zap.Error(err))
+			return
+		}
 	}
 
 	isLeader, leadershipCount := s.leaderInfo()
@@ -1872,6 +3860,24 @@ func (s *Sentinel) clusterSentinelCheck(pctx context.Context) {
 		return
 	}
 
+	s.sentinelsInfo = nil
+	if *cd.Cluster.DefSpec().FailoverQuorum > 0 {
+		s.sentinelsInfo, err = s.e.GetSentinelsInfo(pctx)
+		if err != nil {
+			log.Errorw("cannot get sentinels info", zap.Error(err))
+			return
+		}
+	}
+
+	// the cluster data written by the check
+	var writtenCD *cluster.ClusterData
+	span := s.tracer.Start("sentinel.check", tracing.String("stolon.sentinel.uid", s.uid))
+	s.checkSpan = span
+	defer func() {
+		s.checkSpan = nil
+		endCheckSpan(span, cd, writtenCD, s.electionDecision)
+	}()
+
 	// detect if this is the first check after (re)gaining leadership
 	firstRun := false
 	if s.lastLeadershipCount != leadershipCount {
@@ -1888,27 +3894,71 @@ func (s *Sentinel) clusterSentinelCheck(pctx context.Context) {
 		s.keeperInfoHistories = make(KeeperInfoHistories)
 		s.dbConvergenceInfos = make(map[string]*DBConvergenceInfo)
 		s.proxyInfoHistories = make(ProxyInfoHistories)
+		s.upstreamUnreachableSince = time.Time{}
 
 		// Update db convergence timers since its the first run
 		s.updateDBConvergenceInfos(cd)
+
+		s.clusterResourceStatus = nil
+		s.lastDryRunActions = nil
 	}
 
-	newcd, newKeeperInfoHistories := s.updateKeepersStatus(cd, keepersInfo, firstRun)
+	incd := cd
+	var specErr error
+	if cr != nil {
+		incd = cd.DeepCopy()
+		var changed bool
+		changed, specErr = applyClusterResourceSpec(incd, cr)
+		if specErr != nil {
+			log.Errorw("cannot apply cluster resource spec", zap.Error(specErr))
+		} else if changed {
+			log.Infow("applying cluster resource spec", "generation", cr.Metadata.generation())
+		}
+	}
+
+	statusSpan := span.Child("sentinel.updateKeepersStatus")
+	newcd, newKeeperInfoHistories := s.updateKeepersStatus(incd, keepersInfo, firstRun)
+	statusSpan.End()
 	log.Debugf("newcd dump after updateKeepersStatus: %s", spew.Sdump(newcd))
 
 	activeProxiesInfos := s.activeProxiesInfos(proxiesInfo)
 
+	s.checkStandbyAutoPromote(newcd, time.Now())
+
+	s.checkDryRun = dryRun
+	updateSpan := span.Child("sentinel.updateCluster")
 	newcd, err = s.updateCluster(newcd, activeProxiesInfos)
+	updateSpan.SetError(err)
+	updateSpan.End()
 	if err != nil {
 		log.Errorw("failed to update cluster data", zap.Error(err))
 		return
 	}
 	log.Debugf("newcd dump after updateCluster: %s", spew.Sdump(newcd))
 
-	if newcd != nil {
+	if newcd != nil && dryRun {
+		s.reportDryRun(cd, newcd, s.electionDecision)
+		// the db convergence timers must follow the not changed cluster
+		// data
+		newcd = cd
+	} else if newcd != nil {
 		s.updateChangeTimes(cd, newcd)
-		if _, err := e.AtomicPutClusterData(pctx, newcd, prevCDPair); err != nil {
+		putSpan := span.Child("store.atomicPutClusterData")
+		pair, err := e.AtomicPutClusterData(pctx, newcd, prevCDPair)
+		putSpan.SetError(err)
+		putSpan.End()
+		if err != nil {
 			log.Errorw("error saving clusterdata", zap.Error(err))
+		} else {
+			writtenCD = newcd
+			s.writtenCDValue = pair.Value
+			s.recordCDUpdate(cd, newcd, s.electionDecision)
+			for _, ev := range clusterEvents(cd, newcd, time.Now()) {
+				s.notifier.notify(ev)
+			}
+			if cr != nil {
+				s.updateClusterResourceStatus(pctx, newcd, cr, specErr)
+			}
 		}
 	}
 
@@ -1921,6 +3971,26 @@ func (s *Sentinel) clusterSentinelCheck(pctx context.Context) {
 	s.updateDBConvergenceInfos(newcd)
 }
 
+// updateClusterResourceStatus writes the cluster resource status when it has
+// changed since the last write
+func (s *Sentinel) updateClusterResourceStatus(ctx context.Context, cd *cluster.ClusterData, cr *clusterResource, specErr error) {
+	prevStatus := s.clusterResourceStatus
+	if prevStatus == nil {
+		prevStatus = cr.Status
+	}
+	status := newClusterResourceStatus(cd, cr, prevStatus, specErr)
+	if reflect.DeepEqual(status, cr.Status) {
+		s.clusterResourceStatus = status
+		return
+	}
+	cr.Status = status
+	if err := s.clusterResource.UpdateStatus(ctx, cr); err != nil {
+		log.Errorw("cannot update cluster resource status", zap.Error(err))
+		return
+	}
+	s.clusterResourceStatus = status
+}
+
 func sigHandler(sigs chan os.Signal, cancel context.CancelFunc) {
 	s := <-sigs
 	log.Debugw("got signal", "signal", s)
@@ -1949,16 +4019,50 @@ func sentinel(c *cobra.Command, args []string) {
 	if cfg.debug {
 		slog.SetDebug()
 	}
-	if cmd.IsColorLoggerEnable(c, &cfg.CommonConfig) {
-		log = slog.SColor()
+	if err := cmd.EnableSyslog(&cfg.CommonConfig, "stolon-sentinel"); err != nil {
+		log.Fatalf("%v", err)
+	}
+	switch cfg.LogFormat {
+	case "text":
+		log = slog.S()
+		if cmd.IsColorLoggerEnable(c, &cfg.CommonConfig) {
+			log = slog.SColor()
+		}
+		postgresql.SetLogger(log)
+	case "json":
+		log = slog.SJSON().With("component", "sentinel", "cluster", cfg.ClusterName)
 		postgresql.SetLogger(log)
+	default:
+		log.Fatalf("invalid log format: %v", cfg.LogFormat)
 	}
 
 	if err := cmd.CheckCommonConfig(&cfg.CommonConfig); err != nil {
 		log.Fatalf(err.Error())
 	}
+	if err := cmd.SetupVaultStoreCert(&cfg.CommonConfig, log); err != nil {
+		log.Fatalf("cannot setup the vault store certificate: %v", err)
+	}
+	if cfg.notificationTimeout <= 0 {
+		log.Fatalf("--notification-timeout must be greater than 0")
+	}
+	if cfg.notificationRetries < 0 {
+		log.Fatalf("--notification-retries must be positive")
+	}
+	if cfg.eventsLogSize < 0 {
+		log.Fatalf("--events-log-size must be positive")
+	}
+	if cfg.apiListenAddress != "" && cfg.apiTokenFile == "" {
+		log.Fatalf("--api-token-file is required with --api-listen-address")
+	}
+	if (cfg.apiTLSCertFile == "") != (cfg.apiTLSKeyFile == "") {
+		log.Fatalf("--api-tls-cert-file and --api-tls-key-file must be provided together")
+	}
 
 	uid := common.UID()
+	if cfg.LogFormat == "json" {
+		log = log.With("sentinelUID", uid)
+		postgresql.SetLogger(log)
+	}
 	log.Infow("sentinel uid", "uid", uid)
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -1982,6 +4086,14 @@ func sentinel(c *cobra.Command, args []string) {
 	if err != nil {
 		log.Fatalf("cannot create sentinel: %v", err)
 	}
+	prometheus.MustRegister(newSentinelCollector(s))
+
+	if cfg.apiListenAddress != "" {
+		if err := s.startAPIServer(cancel); err != nil {
+			log.Fatalf("cannot start the management api: %v", err)
+		}
+	}
+
 	go s.Start(ctx)
 
 	<-end
@@ -15,15 +15,22 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"reflect"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sorintlab/stolon/internal/cluster"
 	"github.com/sorintlab/stolon/internal/common"
 )
@@ -3093,9 +3100,10 @@ func TestUpdateCluster(t *testing.T) {
 						SynchronousReplication: cluster.BoolP(true),
 					},
 					Status: cluster.ClusterStatus{
-						CurrentGeneration: 1,
-						Phase:             cluster.ClusterPhaseNormal,
-						Master:            "db1",
+						CurrentGeneration:   1,
+						Phase:               cluster.ClusterPhaseNormal,
+						Master:              "db1",
+						SyncReplDegradation: &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeBlocking},
 					},
 				},
 				Keepers: cluster.Keepers{
@@ -3429,7 +3437,8 @@ func TestUpdateCluster(t *testing.T) {
 				},
 			},
 		},
-		// #20 From previous. master haven't yet reported the new sync standbys (db2, db3).
+		// #20 One master and two standbys with sync standbys (db2, db3) in the
+		// spec. master haven't yet reported the new sync standbys (db2, db3).
 		// master db is not healty. db2 is the unique in common between the
 		// reported (db2) and the required in the spec (db2, db3) but it's not
 		// healty so no master could be elected.
@@ -3685,7 +3694,7 @@ func TestUpdateCluster(t *testing.T) {
 				},
 			},
 		},
-		// #21 From #19. master have not yet reported the new sync standbys as in sync (db3).
+		// #21 From #20. master have not yet reported the new sync standbys as in sync (db3).
 		// db2 will remain the unique real in sync db in db1.Status.SynchronousStandbys
 		{
 			cd: &cluster.ClusterData{
@@ -4084,9 +4093,10 @@ func TestUpdateCluster(t *testing.T) {
 						SynchronousReplication: cluster.BoolP(true),
 					},
 					Status: cluster.ClusterStatus{
-						CurrentGeneration: 1,
-						Phase:             cluster.ClusterPhaseNormal,
-						Master:            "db1",
+						CurrentGeneration:   1,
+						Phase:               cluster.ClusterPhaseNormal,
+						Master:              "db1",
+						SyncReplDegradation: &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeBlocking},
 					},
 				},
 				Keepers: cluster.Keepers{
@@ -4199,7 +4209,7 @@ func TestUpdateCluster(t *testing.T) {
 				},
 			},
 		},
-		// #23 From #19. master have reported the new sync standbys as in sync (db2, db3).
+		// #23 From #20. master have reported the new sync standbys as in sync (db2, db3).
 		// db2 will be removed from synchronousStandbys
 		{
 			cd: &cluster.ClusterData{
@@ -4959,66 +4969,4331 @@ func TestUpdateCluster(t *testing.T) {
 				},
 			},
 		},
-	}
-
-	for i, tt := range tests {
-		s := &Sentinel{uid: "sentinel01", UIDFn: testUIDFn, RandFn: testRandFn, dbConvergenceInfos: make(map[string]*DBConvergenceInfo)}
-
-		// reset curUID func value to latest db uid
-		curUID = 0
-		for _, db := range tt.cd.DBs {
-			uid, _ := strconv.Atoi(strings.TrimPrefix(db.UID, "db"))
-			if uid > curUID {
-				curUID = uid
-			}
-		}
-
-		// Populate db convergence timers, these are populated with a negative timer to make them result like not converged.
-		for _, db := range tt.cd.DBs {
-			s.dbConvergenceInfos[db.UID] = &DBConvergenceInfo{Generation: 0, Timer: int64(-1000 * time.Hour)}
-		}
-
-		fmt.Printf("test #%d\n", i)
-		t.Logf("test #%d", i)
-
-		outcd, err := s.updateCluster(tt.cd, cluster.ProxiesInfo{})
-		if tt.err != nil {
-			if err == nil {
-				t.Errorf("got no error, wanted error: %v", tt.err)
-			} else if tt.err.Error() != err.Error() {
-				t.Errorf("got error: %v, wanted error: %v", err, tt.err)
-			}
-		} else {
-			if err != nil {
-				t.Errorf("unexpected error: %v", err)
-			} else if !testEqualCD(outcd, tt.outcd) {
-				t.Errorf("wrong outcd: got:\n%s\nwant:\n%s", spew.Sdump(outcd), spew.Sdump(tt.outcd))
-			}
-		}
-	}
-}
-
-func testUIDFn() string {
-	curUID++
-	return fmt.Sprintf("%s%d", "db", curUID)
-}
-
-func testRandFn(i int) int {
-	return 0
-}
-
-func testEqualCD(cd1, cd2 *cluster.ClusterData) bool {
-	// ignore times
-	for _, cd := range []*cluster.ClusterData{cd1, cd2} {
-		cd.Cluster.ChangeTime = time.Time{}
-		for _, k := range cd.Keepers {
-			k.ChangeTime = time.Time{}
-		}
-		for _, db := range cd.DBs {
-			db.ChangeTime = time.Time{}
-		}
-		cd.Proxy.ChangeTime = time.Time{}
-	}
-	return reflect.DeepEqual(cd1, cd2)
-
+		// #26 One master and three standbys. Synchronous replication already
+		// enabled with MinSynchronousStandbys and MaxSynchronousStandbys to 2.
+		// sync standby db3 not healthy: db4 choosed as new sync standby. The
+		// failed db3 is kept, merged with the new sync standbys, until db4 is
+		// in sync.
+		{
+			cd: &cluster.ClusterData{
+				Cluster: &cluster.Cluster{
+					UID:        "cluster1",
+					Generation: 1,
+					Spec: &cluster.ClusterSpec{
+						ConvergenceTimeout:     &cluster.Duration{Duration: cluster.DefaultConvergenceTimeout},
+						InitTimeout:            &cluster.Duration{Duration: cluster.DefaultInitTimeout},
+						SyncTimeout:            &cluster.Duration{Duration: cluster.DefaultSyncTimeout},
+						MaxStandbysPerSender:   cluster.Uint16P(cluster.DefaultMaxStandbysPerSender),
+						SynchronousReplication: cluster.BoolP(true),
+						MinSynchronousStandbys: cluster.Uint16P(2),
+						MaxSynchronousStandbys: cluster.Uint16P(2),
+					},
+					Status: cluster.ClusterStatus{
+						CurrentGeneration: 1,
+						Phase:             cluster.ClusterPhaseNormal,
+						Master:            "db1",
+					},
+				},
+				Keepers: cluster.Keepers{
+					"keeper1": &cluster.Keeper{
+						UID:  "keeper1",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper2": &cluster.Keeper{
+						UID:  "keeper2",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper3": &cluster.Keeper{
+						UID:  "keeper3",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper4": &cluster.Keeper{
+						UID:  "keeper4",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+				},
+				DBs: cluster.DBs{
+					"db1": &cluster.DB{
+						UID:        "db1",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:                   "keeper1",
+							RequestTimeout:              cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:                 cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:        cluster.DefaultAdditionalWalSenders,
+							InitMode:                    cluster.DBInitModeNone,
+							SynchronousReplication:      true,
+							Role:                        common.RoleMaster,
+							Followers:                   []string{"db2", "db3", "db4"},
+							SynchronousStandbys:         []string{"db2", "db3"},
+							ExternalSynchronousStandbys: []string{},
+						},
+						Status: cluster.DBStatus{
+							Healthy:             true,
+							CurrentGeneration:   1,
+							SynchronousStandbys: []string{"db2", "db3"},
+						},
+					},
+					"db2": &cluster.DB{
+						UID:        "db2",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper2",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           true,
+							CurrentGeneration: 1,
+						},
+					},
+					"db3": &cluster.DB{
+						UID:        "db3",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper3",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           false,
+							CurrentGeneration: 1,
+						},
+					},
+					"db4": &cluster.DB{
+						UID:        "db4",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper4",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           true,
+							CurrentGeneration: 1,
+						},
+					},
+				},
+				Proxy: &cluster.Proxy{
+					Generation: 1,
+					Spec: cluster.ProxySpec{
+						MasterDBUID:    "db1",
+						EnabledProxies: []string{},
+					},
+				},
+			},
+			outcd: &cluster.ClusterData{
+				Cluster: &cluster.Cluster{
+					UID:        "cluster1",
+					Generation: 1,
+					Spec: &cluster.ClusterSpec{
+						ConvergenceTimeout:     &cluster.Duration{Duration: cluster.DefaultConvergenceTimeout},
+						InitTimeout:            &cluster.Duration{Duration: cluster.DefaultInitTimeout},
+						SyncTimeout:            &cluster.Duration{Duration: cluster.DefaultSyncTimeout},
+						MaxStandbysPerSender:   cluster.Uint16P(cluster.DefaultMaxStandbysPerSender),
+						SynchronousReplication: cluster.BoolP(true),
+						MinSynchronousStandbys: cluster.Uint16P(2),
+						MaxSynchronousStandbys: cluster.Uint16P(2),
+					},
+					Status: cluster.ClusterStatus{
+						CurrentGeneration: 1,
+						Phase:             cluster.ClusterPhaseNormal,
+						Master:            "db1",
+					},
+				},
+				Keepers: cluster.Keepers{
+					"keeper1": &cluster.Keeper{
+						UID:  "keeper1",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper2": &cluster.Keeper{
+						UID:  "keeper2",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper3": &cluster.Keeper{
+						UID:  "keeper3",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper4": &cluster.Keeper{
+						UID:  "keeper4",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+				},
+				DBs: cluster.DBs{
+					"db1": &cluster.DB{
+						UID:        "db1",
+						Generation: 2,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:                   "keeper1",
+							RequestTimeout:              cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:                 cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:        cluster.DefaultAdditionalWalSenders,
+							InitMode:                    cluster.DBInitModeNone,
+							SynchronousReplication:      true,
+							Role:                        common.RoleMaster,
+							Followers:                   []string{"db2", "db3", "db4"},
+							SynchronousStandbys:         []string{"db2", "db3", "db4"},
+							ExternalSynchronousStandbys: []string{},
+						},
+						Status: cluster.DBStatus{
+							Healthy:             true,
+							CurrentGeneration:   1,
+							SynchronousStandbys: []string{"db2", "db3"},
+						},
+					},
+					"db2": &cluster.DB{
+						UID:        "db2",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper2",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           true,
+							CurrentGeneration: 1,
+						},
+					},
+					"db3": &cluster.DB{
+						UID:        "db3",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper3",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           false,
+							CurrentGeneration: 1,
+						},
+					},
+					"db4": &cluster.DB{
+						UID:        "db4",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper4",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           true,
+							CurrentGeneration: 1,
+						},
+					},
+				},
+				Proxy: &cluster.Proxy{
+					Generation: 1,
+					Spec: cluster.ProxySpec{
+						MasterDBUID:    "db1",
+						EnabledProxies: []string{},
+					},
+				},
+			},
+		},
+		// #27 One master and two standbys. Synchronous replication already
+		// enabled with MinSynchronousStandbys and MaxSynchronousStandbys to 2.
+		// sync standby db3 not healthy and no other standbys available: db3
+		// is kept as sync standby to not go below MinSynchronousStandbys.
+		{
+			cd: &cluster.ClusterData{
+				Cluster: &cluster.Cluster{
+					UID:        "cluster1",
+					Generation: 1,
+					Spec: &cluster.ClusterSpec{
+						ConvergenceTimeout:     &cluster.Duration{Duration: cluster.DefaultConvergenceTimeout},
+						InitTimeout:            &cluster.Duration{Duration: cluster.DefaultInitTimeout},
+						SyncTimeout:            &cluster.Duration{Duration: cluster.DefaultSyncTimeout},
+						MaxStandbysPerSender:   cluster.Uint16P(cluster.DefaultMaxStandbysPerSender),
+						SynchronousReplication: cluster.BoolP(true),
+						MinSynchronousStandbys: cluster.Uint16P(2),
+						MaxSynchronousStandbys: cluster.Uint16P(2),
+					},
+					Status: cluster.ClusterStatus{
+						CurrentGeneration: 1,
+						Phase:             cluster.ClusterPhaseNormal,
+						Master:            "db1",
+					},
+				},
+				Keepers: cluster.Keepers{
+					"keeper1": &cluster.Keeper{
+						UID:  "keeper1",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper2": &cluster.Keeper{
+						UID:  "keeper2",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper3": &cluster.Keeper{
+						UID:  "keeper3",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+				},
+				DBs: cluster.DBs{
+					"db1": &cluster.DB{
+						UID:        "db1",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:                   "keeper1",
+							RequestTimeout:              cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:                 cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:        cluster.DefaultAdditionalWalSenders,
+							InitMode:                    cluster.DBInitModeNone,
+							SynchronousReplication:      true,
+							Role:                        common.RoleMaster,
+							Followers:                   []string{"db2", "db3"},
+							SynchronousStandbys:         []string{"db2", "db3"},
+							ExternalSynchronousStandbys: []string{},
+						},
+						Status: cluster.DBStatus{
+							Healthy:             true,
+							CurrentGeneration:   1,
+							SynchronousStandbys: []string{"db2", "db3"},
+						},
+					},
+					"db2": &cluster.DB{
+						UID:        "db2",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper2",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           true,
+							CurrentGeneration: 1,
+						},
+					},
+					"db3": &cluster.DB{
+						UID:        "db3",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper3",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           false,
+							CurrentGeneration: 1,
+						},
+					},
+				},
+				Proxy: &cluster.Proxy{
+					Generation: 1,
+					Spec: cluster.ProxySpec{
+						MasterDBUID:    "db1",
+						EnabledProxies: []string{},
+					},
+				},
+			},
+			outcd: &cluster.ClusterData{
+				Cluster: &cluster.Cluster{
+					UID:        "cluster1",
+					Generation: 1,
+					Spec: &cluster.ClusterSpec{
+						ConvergenceTimeout:     &cluster.Duration{Duration: cluster.DefaultConvergenceTimeout},
+						InitTimeout:            &cluster.Duration{Duration: cluster.DefaultInitTimeout},
+						SyncTimeout:            &cluster.Duration{Duration: cluster.DefaultSyncTimeout},
+						MaxStandbysPerSender:   cluster.Uint16P(cluster.DefaultMaxStandbysPerSender),
+						SynchronousReplication: cluster.BoolP(true),
+						MinSynchronousStandbys: cluster.Uint16P(2),
+						MaxSynchronousStandbys: cluster.Uint16P(2),
+					},
+					Status: cluster.ClusterStatus{
+						CurrentGeneration:   1,
+						Phase:               cluster.ClusterPhaseNormal,
+						Master:              "db1",
+						SyncReplDegradation: &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeBlocking},
+					},
+				},
+				Keepers: cluster.Keepers{
+					"keeper1": &cluster.Keeper{
+						UID:  "keeper1",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper2": &cluster.Keeper{
+						UID:  "keeper2",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper3": &cluster.Keeper{
+						UID:  "keeper3",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+				},
+				DBs: cluster.DBs{
+					"db1": &cluster.DB{
+						UID:        "db1",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:                   "keeper1",
+							RequestTimeout:              cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:                 cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:        cluster.DefaultAdditionalWalSenders,
+							InitMode:                    cluster.DBInitModeNone,
+							SynchronousReplication:      true,
+							Role:                        common.RoleMaster,
+							Followers:                   []string{"db2", "db3"},
+							SynchronousStandbys:         []string{"db2", "db3"},
+							ExternalSynchronousStandbys: []string{},
+						},
+						Status: cluster.DBStatus{
+							Healthy:             true,
+							CurrentGeneration:   1,
+							SynchronousStandbys: []string{"db2", "db3"},
+						},
+					},
+					"db2": &cluster.DB{
+						UID:        "db2",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper2",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           true,
+							CurrentGeneration: 1,
+						},
+					},
+					"db3": &cluster.DB{
+						UID:        "db3",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper3",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           false,
+							CurrentGeneration: 1,
+						},
+					},
+				},
+				Proxy: &cluster.Proxy{
+					Generation: 1,
+					Spec: cluster.ProxySpec{
+						MasterDBUID:    "db1",
+						EnabledProxies: []string{},
+					},
+				},
+			},
+		},
+		// #28 One master and two standbys. Synchronous replication already
+		// enabled with MinSynchronousStandbys to 1 and MaxSynchronousStandbys
+		// to 2. sync standby db3 not healthy and no other standbys available:
+		// db3 is removed reducing the sync standbys to MinSynchronousStandbys.
+		{
+			cd: &cluster.ClusterData{
+				Cluster: &cluster.Cluster{
+					UID:        "cluster1",
+					Generation: 1,
+					Spec: &cluster.ClusterSpec{
+						ConvergenceTimeout:     &cluster.Duration{Duration: cluster.DefaultConvergenceTimeout},
+						InitTimeout:            &cluster.Duration{Duration: cluster.DefaultInitTimeout},
+						SyncTimeout:            &cluster.Duration{Duration: cluster.DefaultSyncTimeout},
+						MaxStandbysPerSender:   cluster.Uint16P(cluster.DefaultMaxStandbysPerSender),
+						SynchronousReplication: cluster.BoolP(true),
+						MinSynchronousStandbys: cluster.Uint16P(1),
+						MaxSynchronousStandbys: cluster.Uint16P(2),
+					},
+					Status: cluster.ClusterStatus{
+						CurrentGeneration: 1,
+						Phase:             cluster.ClusterPhaseNormal,
+						Master:            "db1",
+					},
+				},
+				Keepers: cluster.Keepers{
+					"keeper1": &cluster.Keeper{
+						UID:  "keeper1",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper2": &cluster.Keeper{
+						UID:  "keeper2",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper3": &cluster.Keeper{
+						UID:  "keeper3",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+				},
+				DBs: cluster.DBs{
+					"db1": &cluster.DB{
+						UID:        "db1",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:                   "keeper1",
+							RequestTimeout:              cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:                 cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:        cluster.DefaultAdditionalWalSenders,
+							InitMode:                    cluster.DBInitModeNone,
+							SynchronousReplication:      true,
+							Role:                        common.RoleMaster,
+							Followers:                   []string{"db2", "db3"},
+							SynchronousStandbys:         []string{"db2", "db3"},
+							ExternalSynchronousStandbys: []string{},
+						},
+						Status: cluster.DBStatus{
+							Healthy:             true,
+							CurrentGeneration:   1,
+							SynchronousStandbys: []string{"db2", "db3"},
+						},
+					},
+					"db2": &cluster.DB{
+						UID:        "db2",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper2",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           true,
+							CurrentGeneration: 1,
+						},
+					},
+					"db3": &cluster.DB{
+						UID:        "db3",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper3",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           false,
+							CurrentGeneration: 1,
+						},
+					},
+				},
+				Proxy: &cluster.Proxy{
+					Generation: 1,
+					Spec: cluster.ProxySpec{
+						MasterDBUID:    "db1",
+						EnabledProxies: []string{},
+					},
+				},
+			},
+			outcd: &cluster.ClusterData{
+				Cluster: &cluster.Cluster{
+					UID:        "cluster1",
+					Generation: 1,
+					Spec: &cluster.ClusterSpec{
+						ConvergenceTimeout:     &cluster.Duration{Duration: cluster.DefaultConvergenceTimeout},
+						InitTimeout:            &cluster.Duration{Duration: cluster.DefaultInitTimeout},
+						SyncTimeout:            &cluster.Duration{Duration: cluster.DefaultSyncTimeout},
+						MaxStandbysPerSender:   cluster.Uint16P(cluster.DefaultMaxStandbysPerSender),
+						SynchronousReplication: cluster.BoolP(true),
+						MinSynchronousStandbys: cluster.Uint16P(1),
+						MaxSynchronousStandbys: cluster.Uint16P(2),
+					},
+					Status: cluster.ClusterStatus{
+						CurrentGeneration: 1,
+						Phase:             cluster.ClusterPhaseNormal,
+						Master:            "db1",
+					},
+				},
+				Keepers: cluster.Keepers{
+					"keeper1": &cluster.Keeper{
+						UID:  "keeper1",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper2": &cluster.Keeper{
+						UID:  "keeper2",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper3": &cluster.Keeper{
+						UID:  "keeper3",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+				},
+				DBs: cluster.DBs{
+					"db1": &cluster.DB{
+						UID:        "db1",
+						Generation: 2,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:                   "keeper1",
+							RequestTimeout:              cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:                 cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:        cluster.DefaultAdditionalWalSenders,
+							InitMode:                    cluster.DBInitModeNone,
+							SynchronousReplication:      true,
+							Role:                        common.RoleMaster,
+							Followers:                   []string{"db2", "db3"},
+							SynchronousStandbys:         []string{"db2"},
+							ExternalSynchronousStandbys: []string{},
+						},
+						Status: cluster.DBStatus{
+							Healthy:             true,
+							CurrentGeneration:   1,
+							SynchronousStandbys: []string{"db2"},
+						},
+					},
+					"db2": &cluster.DB{
+						UID:        "db2",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper2",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           true,
+							CurrentGeneration: 1,
+						},
+					},
+					"db3": &cluster.DB{
+						UID:        "db3",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper3",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           false,
+							CurrentGeneration: 1,
+						},
+					},
+				},
+				Proxy: &cluster.Proxy{
+					Generation: 1,
+					Spec: cluster.ProxySpec{
+						MasterDBUID:    "db1",
+						EnabledProxies: []string{},
+					},
+				},
+			},
+		},
+		// #29 One master and one standby, both healthy. Failover to keeper2
+		// requested: db2 elected as new master and the request cleared.
+		{
+			cd: &cluster.ClusterData{
+				Cluster: &cluster.Cluster{
+					UID:        "cluster1",
+					Generation: 1,
+					Spec: &cluster.ClusterSpec{
+						ConvergenceTimeout:   &cluster.Duration{Duration: cluster.DefaultConvergenceTimeout},
+						InitTimeout:          &cluster.Duration{Duration: cluster.DefaultInitTimeout},
+						SyncTimeout:          &cluster.Duration{Duration: cluster.DefaultSyncTimeout},
+						MaxStandbysPerSender: cluster.Uint16P(cluster.DefaultMaxStandbysPerSender),
+					},
+					Status: cluster.ClusterStatus{
+						CurrentGeneration:    1,
+						Phase:                cluster.ClusterPhaseNormal,
+						Master:               "db1",
+						FailoverTargetKeeper: "keeper2",
+					},
+				},
+				Keepers: cluster.Keepers{
+					"keeper1": &cluster.Keeper{
+						UID:  "keeper1",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper2": &cluster.Keeper{
+						UID:  "keeper2",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+				},
+				DBs: cluster.DBs{
+					"db1": &cluster.DB{
+						UID:        "db1",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:                   "keeper1",
+							RequestTimeout:              cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:                 cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:        cluster.DefaultAdditionalWalSenders,
+							InitMode:                    cluster.DBInitModeNone,
+							SynchronousReplication:      false,
+							Role:                        common.RoleMaster,
+							Followers:                   []string{"db2"},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           true,
+							CurrentGeneration: 1,
+						},
+					},
+					"db2": &cluster.DB{
+						UID:        "db2",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper2",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           true,
+							CurrentGeneration: 1,
+						},
+					},
+				},
+				Proxy: &cluster.Proxy{
+					Generation: 1,
+					Spec: cluster.ProxySpec{
+						MasterDBUID:    "db1",
+						EnabledProxies: []string{},
+					},
+				},
+			},
+			outcd: &cluster.ClusterData{
+				Cluster: &cluster.Cluster{
+					UID:        "cluster1",
+					Generation: 1,
+					Spec: &cluster.ClusterSpec{
+						ConvergenceTimeout:   &cluster.Duration{Duration: cluster.DefaultConvergenceTimeout},
+						InitTimeout:          &cluster.Duration{Duration: cluster.DefaultInitTimeout},
+						SyncTimeout:          &cluster.Duration{Duration: cluster.DefaultSyncTimeout},
+						MaxStandbysPerSender: cluster.Uint16P(cluster.DefaultMaxStandbysPerSender),
+					},
+					Status: cluster.ClusterStatus{
+						CurrentGeneration: 1,
+						Phase:             cluster.ClusterPhaseNormal,
+						Master:            "db2",
+					},
+				},
+				Keepers: cluster.Keepers{
+					"keeper1": &cluster.Keeper{
+						UID:  "keeper1",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper2": &cluster.Keeper{
+						UID:  "keeper2",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+				},
+				DBs: cluster.DBs{
+					"db1": &cluster.DB{
+						UID:        "db1",
+						Generation: 2,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:                   "keeper1",
+							RequestTimeout:              cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:                 cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:        cluster.DefaultAdditionalWalSenders,
+							InitMode:                    cluster.DBInitModeNone,
+							SynchronousReplication:      false,
+							Role:                        common.RoleMaster,
+							Followers:                   []string{},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           true,
+							CurrentGeneration: 1,
+						},
+					},
+					"db2": &cluster.DB{
+						UID:        "db2",
+						Generation: 2,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:                   "keeper2",
+							RequestTimeout:              cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:                 cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:        cluster.DefaultAdditionalWalSenders,
+							InitMode:                    cluster.DBInitModeNone,
+							SynchronousReplication:      false,
+							Role:                        common.RoleMaster,
+							Followers:                   []string{},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           true,
+							CurrentGeneration: 1,
+						},
+					},
+				},
+				Proxy: &cluster.Proxy{
+					Generation: 2,
+					Spec: cluster.ProxySpec{
+						MasterDBUID:    "",
+						EnabledProxies: []string{},
+					},
+				},
+			},
+		},
+		// #30 One master and one standby. Failover to keeper2 requested but
+		// db2 isn't healthy: the request is ignored and cleared.
+		{
+			cd: &cluster.ClusterData{
+				Cluster: &cluster.Cluster{
+					UID:        "cluster1",
+					Generation: 1,
+					Spec: &cluster.ClusterSpec{
+						ConvergenceTimeout:   &cluster.Duration{Duration: cluster.DefaultConvergenceTimeout},
+						InitTimeout:          &cluster.Duration{Duration: cluster.DefaultInitTimeout},
+						SyncTimeout:          &cluster.Duration{Duration: cluster.DefaultSyncTimeout},
+						MaxStandbysPerSender: cluster.Uint16P(cluster.DefaultMaxStandbysPerSender),
+					},
+					Status: cluster.ClusterStatus{
+						CurrentGeneration:    1,
+						Phase:                cluster.ClusterPhaseNormal,
+						Master:               "db1",
+						FailoverTargetKeeper: "keeper2",
+					},
+				},
+				Keepers: cluster.Keepers{
+					"keeper1": &cluster.Keeper{
+						UID:  "keeper1",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper2": &cluster.Keeper{
+						UID:  "keeper2",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+				},
+				DBs: cluster.DBs{
+					"db1": &cluster.DB{
+						UID:        "db1",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:                   "keeper1",
+							RequestTimeout:              cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:                 cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:        cluster.DefaultAdditionalWalSenders,
+							InitMode:                    cluster.DBInitModeNone,
+							SynchronousReplication:      false,
+							Role:                        common.RoleMaster,
+							Followers:                   []string{"db2"},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           true,
+							CurrentGeneration: 1,
+						},
+					},
+					"db2": &cluster.DB{
+						UID:        "db2",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper2",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           false,
+							CurrentGeneration: 1,
+						},
+					},
+				},
+				Proxy: &cluster.Proxy{
+					Generation: 1,
+					Spec: cluster.ProxySpec{
+						MasterDBUID:    "db1",
+						EnabledProxies: []string{},
+					},
+				},
+			},
+			outcd: &cluster.ClusterData{
+				Cluster: &cluster.Cluster{
+					UID:        "cluster1",
+					Generation: 1,
+					Spec: &cluster.ClusterSpec{
+						ConvergenceTimeout:   &cluster.Duration{Duration: cluster.DefaultConvergenceTimeout},
+						InitTimeout:          &cluster.Duration{Duration: cluster.DefaultInitTimeout},
+						SyncTimeout:          &cluster.Duration{Duration: cluster.DefaultSyncTimeout},
+						MaxStandbysPerSender: cluster.Uint16P(cluster.DefaultMaxStandbysPerSender),
+					},
+					Status: cluster.ClusterStatus{
+						CurrentGeneration: 1,
+						Phase:             cluster.ClusterPhaseNormal,
+						Master:            "db1",
+					},
+				},
+				Keepers: cluster.Keepers{
+					"keeper1": &cluster.Keeper{
+						UID:  "keeper1",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper2": &cluster.Keeper{
+						UID:  "keeper2",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+				},
+				DBs: cluster.DBs{
+					"db1": &cluster.DB{
+						UID:        "db1",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:                   "keeper1",
+							RequestTimeout:              cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:                 cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:        cluster.DefaultAdditionalWalSenders,
+							InitMode:                    cluster.DBInitModeNone,
+							SynchronousReplication:      false,
+							Role:                        common.RoleMaster,
+							Followers:                   []string{"db2"},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           true,
+							CurrentGeneration: 1,
+						},
+					},
+					"db2": &cluster.DB{
+						UID:        "db2",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper2",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           false,
+							CurrentGeneration: 1,
+						},
+					},
+				},
+				Proxy: &cluster.Proxy{
+					Generation: 1,
+					Spec: cluster.ProxySpec{
+						MasterDBUID:    "db1",
+						EnabledProxies: []string{},
+					},
+				},
+			},
+		},
+		// #31 One master and one standby, both healthy. The master keeper
+		// declined the master role since its pre master validation failed:
+		// db2 elected as new master.
+		{
+			cd: &cluster.ClusterData{
+				Cluster: &cluster.Cluster{
+					UID:        "cluster1",
+					Generation: 1,
+					Spec: &cluster.ClusterSpec{
+						ConvergenceTimeout:   &cluster.Duration{Duration: cluster.DefaultConvergenceTimeout},
+						InitTimeout:          &cluster.Duration{Duration: cluster.DefaultInitTimeout},
+						SyncTimeout:          &cluster.Duration{Duration: cluster.DefaultSyncTimeout},
+						MaxStandbysPerSender: cluster.Uint16P(cluster.DefaultMaxStandbysPerSender),
+					},
+					Status: cluster.ClusterStatus{
+						CurrentGeneration: 1,
+						Phase:             cluster.ClusterPhaseNormal,
+						Master:            "db1",
+					},
+				},
+				Keepers: cluster.Keepers{
+					"keeper1": &cluster.Keeper{
+						UID:  "keeper1",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper2": &cluster.Keeper{
+						UID:  "keeper2",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+				},
+				DBs: cluster.DBs{
+					"db1": &cluster.DB{
+						UID:        "db1",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:                   "keeper1",
+							RequestTimeout:              cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:                 cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:        cluster.DefaultAdditionalWalSenders,
+							InitMode:                    cluster.DBInitModeNone,
+							SynchronousReplication:      false,
+							Role:                        common.RoleMaster,
+							Followers:                   []string{"db2"},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:            true,
+							CurrentGeneration:  1,
+							MasterRoleDeclined: true,
+						},
+					},
+					"db2": &cluster.DB{
+						UID:        "db2",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper2",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           true,
+							CurrentGeneration: 1,
+						},
+					},
+				},
+				Proxy: &cluster.Proxy{
+					Generation: 1,
+					Spec: cluster.ProxySpec{
+						MasterDBUID:    "db1",
+						EnabledProxies: []string{},
+					},
+				},
+			},
+			outcd: &cluster.ClusterData{
+				Cluster: &cluster.Cluster{
+					UID:        "cluster1",
+					Generation: 1,
+					Spec: &cluster.ClusterSpec{
+						ConvergenceTimeout:   &cluster.Duration{Duration: cluster.DefaultConvergenceTimeout},
+						InitTimeout:          &cluster.Duration{Duration: cluster.DefaultInitTimeout},
+						SyncTimeout:          &cluster.Duration{Duration: cluster.DefaultSyncTimeout},
+						MaxStandbysPerSender: cluster.Uint16P(cluster.DefaultMaxStandbysPerSender),
+					},
+					Status: cluster.ClusterStatus{
+						CurrentGeneration: 1,
+						Phase:             cluster.ClusterPhaseNormal,
+						Master:            "db2",
+					},
+				},
+				Keepers: cluster.Keepers{
+					"keeper1": &cluster.Keeper{
+						UID:  "keeper1",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper2": &cluster.Keeper{
+						UID:  "keeper2",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+				},
+				DBs: cluster.DBs{
+					"db1": &cluster.DB{
+						UID:        "db1",
+						Generation: 2,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:                   "keeper1",
+							RequestTimeout:              cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:                 cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:        cluster.DefaultAdditionalWalSenders,
+							InitMode:                    cluster.DBInitModeNone,
+							SynchronousReplication:      false,
+							Role:                        common.RoleMaster,
+							Followers:                   []string{},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:            true,
+							CurrentGeneration:  1,
+							MasterRoleDeclined: true,
+						},
+					},
+					"db2": &cluster.DB{
+						UID:        "db2",
+						Generation: 2,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:                   "keeper2",
+							RequestTimeout:              cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:                 cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:        cluster.DefaultAdditionalWalSenders,
+							InitMode:                    cluster.DBInitModeNone,
+							SynchronousReplication:      false,
+							Role:                        common.RoleMaster,
+							Followers:                   []string{},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           true,
+							CurrentGeneration: 1,
+						},
+					},
+				},
+				Proxy: &cluster.Proxy{
+					Generation: 2,
+					Spec: cluster.ProxySpec{
+						MasterDBUID:    "",
+						EnabledProxies: []string{},
+					},
+				},
+			},
+		},
+		// #32 One master and two standbys. Synchronous replication already
+		// enabled with MinSynchronousStandbys and MaxSynchronousStandbys to 2
+		// and the degradeOnAck syncReplDegradation policy. sync standby db3
+		// not healthy, no other standbys available and the degradation has
+		// been acknowledged: db3 is removed from the sync standbys without
+		// adding a fake standby.
+		{
+			cd: &cluster.ClusterData{
+				Cluster: &cluster.Cluster{
+					UID:        "cluster1",
+					Generation: 1,
+					Spec: &cluster.ClusterSpec{
+						ConvergenceTimeout:     &cluster.Duration{Duration: cluster.DefaultConvergenceTimeout},
+						InitTimeout:            &cluster.Duration{Duration: cluster.DefaultInitTimeout},
+						SyncTimeout:            &cluster.Duration{Duration: cluster.DefaultSyncTimeout},
+						MaxStandbysPerSender:   cluster.Uint16P(cluster.DefaultMaxStandbysPerSender),
+						SynchronousReplication: cluster.BoolP(true),
+						MinSynchronousStandbys: cluster.Uint16P(2),
+						MaxSynchronousStandbys: cluster.Uint16P(2),
+						SyncReplDegradation: &cluster.SyncReplDegradation{
+							Policy: cluster.SyncReplDegradationPolicyDegradeOnAck,
+						},
+					},
+					Status: cluster.ClusterStatus{
+						CurrentGeneration:   1,
+						Phase:               cluster.ClusterPhaseNormal,
+						Master:              "db1",
+						SyncReplDegradation: &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeBlocking, Acknowledged: true},
+					},
+				},
+				Keepers: cluster.Keepers{
+					"keeper1": &cluster.Keeper{
+						UID:  "keeper1",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper2": &cluster.Keeper{
+						UID:  "keeper2",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper3": &cluster.Keeper{
+						UID:  "keeper3",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+				},
+				DBs: cluster.DBs{
+					"db1": &cluster.DB{
+						UID:        "db1",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:                   "keeper1",
+							RequestTimeout:              cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:                 cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:        cluster.DefaultAdditionalWalSenders,
+							InitMode:                    cluster.DBInitModeNone,
+							SynchronousReplication:      true,
+							Role:                        common.RoleMaster,
+							Followers:                   []string{"db2", "db3"},
+							SynchronousStandbys:         []string{"db2", "db3"},
+							ExternalSynchronousStandbys: []string{},
+						},
+						Status: cluster.DBStatus{
+							Healthy:             true,
+							CurrentGeneration:   1,
+							SynchronousStandbys: []string{"db2", "db3"},
+						},
+					},
+					"db2": &cluster.DB{
+						UID:        "db2",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper2",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           true,
+							CurrentGeneration: 1,
+						},
+					},
+					"db3": &cluster.DB{
+						UID:        "db3",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper3",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           false,
+							CurrentGeneration: 1,
+						},
+					},
+				},
+				Proxy: &cluster.Proxy{
+					Generation: 1,
+					Spec: cluster.ProxySpec{
+						MasterDBUID:    "db1",
+						EnabledProxies: []string{},
+					},
+				},
+			},
+			outcd: &cluster.ClusterData{
+				Cluster: &cluster.Cluster{
+					UID:        "cluster1",
+					Generation: 1,
+					Spec: &cluster.ClusterSpec{
+						ConvergenceTimeout:     &cluster.Duration{Duration: cluster.DefaultConvergenceTimeout},
+						InitTimeout:            &cluster.Duration{Duration: cluster.DefaultInitTimeout},
+						SyncTimeout:            &cluster.Duration{Duration: cluster.DefaultSyncTimeout},
+						MaxStandbysPerSender:   cluster.Uint16P(cluster.DefaultMaxStandbysPerSender),
+						SynchronousReplication: cluster.BoolP(true),
+						MinSynchronousStandbys: cluster.Uint16P(2),
+						MaxSynchronousStandbys: cluster.Uint16P(2),
+						SyncReplDegradation: &cluster.SyncReplDegradation{
+							Policy: cluster.SyncReplDegradationPolicyDegradeOnAck,
+						},
+					},
+					Status: cluster.ClusterStatus{
+						CurrentGeneration:   1,
+						Phase:               cluster.ClusterPhaseNormal,
+						Master:              "db1",
+						SyncReplDegradation: &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeDegraded},
+					},
+				},
+				Keepers: cluster.Keepers{
+					"keeper1": &cluster.Keeper{
+						UID:  "keeper1",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper2": &cluster.Keeper{
+						UID:  "keeper2",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper3": &cluster.Keeper{
+						UID:  "keeper3",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+				},
+				DBs: cluster.DBs{
+					"db1": &cluster.DB{
+						UID:        "db1",
+						Generation: 2,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:                   "keeper1",
+							RequestTimeout:              cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:                 cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:        cluster.DefaultAdditionalWalSenders,
+							InitMode:                    cluster.DBInitModeNone,
+							SynchronousReplication:      true,
+							Role:                        common.RoleMaster,
+							Followers:                   []string{"db2", "db3"},
+							SynchronousStandbys:         []string{"db2"},
+							ExternalSynchronousStandbys: []string{},
+						},
+						Status: cluster.DBStatus{
+							Healthy:             true,
+							CurrentGeneration:   1,
+							SynchronousStandbys: []string{"db2"},
+						},
+					},
+					"db2": &cluster.DB{
+						UID:        "db2",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper2",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           true,
+							CurrentGeneration: 1,
+						},
+					},
+					"db3": &cluster.DB{
+						UID:        "db3",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper3",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           false,
+							CurrentGeneration: 1,
+						},
+					},
+				},
+				Proxy: &cluster.Proxy{
+					Generation: 1,
+					Spec: cluster.ProxySpec{
+						MasterDBUID:    "db1",
+						EnabledProxies: []string{},
+					},
+				},
+			},
+		},
+		// #33 From #26. master has reported the new sync standby db4 as in
+		// sync: the failed db3 is removed since MinSynchronousStandbys is
+		// still respected.
+		{
+			cd: &cluster.ClusterData{
+				Cluster: &cluster.Cluster{
+					UID:        "cluster1",
+					Generation: 1,
+					Spec: &cluster.ClusterSpec{
+						ConvergenceTimeout:     &cluster.Duration{Duration: cluster.DefaultConvergenceTimeout},
+						InitTimeout:            &cluster.Duration{Duration: cluster.DefaultInitTimeout},
+						SyncTimeout:            &cluster.Duration{Duration: cluster.DefaultSyncTimeout},
+						MaxStandbysPerSender:   cluster.Uint16P(cluster.DefaultMaxStandbysPerSender),
+						SynchronousReplication: cluster.BoolP(true),
+						MinSynchronousStandbys: cluster.Uint16P(2),
+						MaxSynchronousStandbys: cluster.Uint16P(2),
+					},
+					Status: cluster.ClusterStatus{
+						CurrentGeneration: 1,
+						Phase:             cluster.ClusterPhaseNormal,
+						Master:            "db1",
+					},
+				},
+				Keepers: cluster.Keepers{
+					"keeper1": &cluster.Keeper{
+						UID:  "keeper1",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper2": &cluster.Keeper{
+						UID:  "keeper2",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper3": &cluster.Keeper{
+						UID:  "keeper3",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper4": &cluster.Keeper{
+						UID:  "keeper4",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+				},
+				DBs: cluster.DBs{
+					"db1": &cluster.DB{
+						UID:        "db1",
+						Generation: 2,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:                   "keeper1",
+							RequestTimeout:              cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:                 cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:        cluster.DefaultAdditionalWalSenders,
+							InitMode:                    cluster.DBInitModeNone,
+							SynchronousReplication:      true,
+							Role:                        common.RoleMaster,
+							Followers:                   []string{"db2", "db3", "db4"},
+							SynchronousStandbys:         []string{"db2", "db3", "db4"},
+							ExternalSynchronousStandbys: []string{},
+						},
+						Status: cluster.DBStatus{
+							Healthy:                true,
+							CurrentGeneration:      2,
+							SynchronousStandbys:    []string{"db2", "db3"},
+							CurSynchronousStandbys: []string{"db2", "db4"},
+						},
+					},
+					"db2": &cluster.DB{
+						UID:        "db2",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper2",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           true,
+							CurrentGeneration: 1,
+						},
+					},
+					"db3": &cluster.DB{
+						UID:        "db3",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper3",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           false,
+							CurrentGeneration: 1,
+						},
+					},
+					"db4": &cluster.DB{
+						UID:        "db4",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper4",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           true,
+							CurrentGeneration: 1,
+						},
+					},
+				},
+				Proxy: &cluster.Proxy{
+					Generation: 1,
+					Spec: cluster.ProxySpec{
+						MasterDBUID:    "db1",
+						EnabledProxies: []string{},
+					},
+				},
+			},
+			outcd: &cluster.ClusterData{
+				Cluster: &cluster.Cluster{
+					UID:        "cluster1",
+					Generation: 1,
+					Spec: &cluster.ClusterSpec{
+						ConvergenceTimeout:     &cluster.Duration{Duration: cluster.DefaultConvergenceTimeout},
+						InitTimeout:            &cluster.Duration{Duration: cluster.DefaultInitTimeout},
+						SyncTimeout:            &cluster.Duration{Duration: cluster.DefaultSyncTimeout},
+						MaxStandbysPerSender:   cluster.Uint16P(cluster.DefaultMaxStandbysPerSender),
+						SynchronousReplication: cluster.BoolP(true),
+						MinSynchronousStandbys: cluster.Uint16P(2),
+						MaxSynchronousStandbys: cluster.Uint16P(2),
+					},
+					Status: cluster.ClusterStatus{
+						CurrentGeneration: 1,
+						Phase:             cluster.ClusterPhaseNormal,
+						Master:            "db1",
+					},
+				},
+				Keepers: cluster.Keepers{
+					"keeper1": &cluster.Keeper{
+						UID:  "keeper1",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper2": &cluster.Keeper{
+						UID:  "keeper2",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper3": &cluster.Keeper{
+						UID:  "keeper3",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+					"keeper4": &cluster.Keeper{
+						UID:  "keeper4",
+						Spec: &cluster.KeeperSpec{},
+						Status: cluster.KeeperStatus{
+							Healthy:         true,
+							LastHealthyTime: now,
+						},
+					},
+				},
+				DBs: cluster.DBs{
+					"db1": &cluster.DB{
+						UID:        "db1",
+						Generation: 3,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:                   "keeper1",
+							RequestTimeout:              cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:                 cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:        cluster.DefaultAdditionalWalSenders,
+							InitMode:                    cluster.DBInitModeNone,
+							SynchronousReplication:      true,
+							Role:                        common.RoleMaster,
+							Followers:                   []string{"db2", "db3", "db4"},
+							SynchronousStandbys:         []string{"db2", "db4"},
+							ExternalSynchronousStandbys: []string{},
+						},
+						Status: cluster.DBStatus{
+							Healthy:                true,
+							CurrentGeneration:      2,
+							SynchronousStandbys:    []string{"db2", "db4"},
+							CurSynchronousStandbys: []string{"db2", "db4"},
+						},
+					},
+					"db2": &cluster.DB{
+						UID:        "db2",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper2",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           true,
+							CurrentGeneration: 1,
+						},
+					},
+					"db3": &cluster.DB{
+						UID:        "db3",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper3",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           false,
+							CurrentGeneration: 1,
+						},
+					},
+					"db4": &cluster.DB{
+						UID:        "db4",
+						Generation: 1,
+						ChangeTime: time.Time{},
+						Spec: &cluster.DBSpec{
+							KeeperUID:              "keeper4",
+							RequestTimeout:         cluster.Duration{Duration: cluster.DefaultRequestTimeout},
+							MaxStandbys:            cluster.DefaultMaxStandbys,
+							AdditionalWalSenders:   cluster.DefaultAdditionalWalSenders,
+							InitMode:               cluster.DBInitModeNone,
+							SynchronousReplication: false,
+							Role:                   common.RoleStandby,
+							Followers:              []string{},
+							FollowConfig: &cluster.FollowConfig{
+								Type:  cluster.FollowTypeInternal,
+								DBUID: "db1",
+							},
+							SynchronousStandbys:         nil,
+							ExternalSynchronousStandbys: nil,
+						},
+						Status: cluster.DBStatus{
+							Healthy:           true,
+							CurrentGeneration: 1,
+						},
+					},
+				},
+				Proxy: &cluster.Proxy{
+					Generation: 1,
+					Spec: cluster.ProxySpec{
+						MasterDBUID:    "db1",
+						EnabledProxies: []string{},
+					},
+				},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		s := &Sentinel{uid: "sentinel01", UIDFn: testUIDFn, RandFn: testRandFn, dbConvergenceInfos: make(map[string]*DBConvergenceInfo)}
+
+		// reset curUID func value to latest db uid
+		curUID = 0
+		for _, db := range tt.cd.DBs {
+			uid, _ := strconv.Atoi(strings.TrimPrefix(db.UID, "db"))
+			if uid > curUID {
+				curUID = uid
+			}
+		}
+
+		// Populate db convergence timers, these are populated with a negative timer to make them result like not converged.
+		for _, db := range tt.cd.DBs {
+			s.dbConvergenceInfos[db.UID] = &DBConvergenceInfo{Generation: 0, Timer: int64(-1000 * time.Hour)}
+		}
+
+		fmt.Printf("test #%d\n", i)
+		t.Logf("test #%d", i)
+
+		outcd, err := s.updateCluster(tt.cd, cluster.ProxiesInfo{})
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("got no error, wanted error: %v", tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("got error: %v, wanted error: %v", err, tt.err)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if !testEqualCD(outcd, tt.outcd) {
+				t.Errorf("wrong outcd: got:\n%s\nwant:\n%s", spew.Sdump(outcd), spew.Sdump(tt.outcd))
+			}
+		}
+	}
+}
+
+func testUIDFn() string {
+	curUID++
+	return fmt.Sprintf("%s%d", "db", curUID)
+}
+
+func testRandFn(i int) int {
+	return 0
+}
+
+func testEqualCD(cd1, cd2 *cluster.ClusterData) bool {
+	// ignore times
+	for _, cd := range []*cluster.ClusterData{cd1, cd2} {
+		cd.Cluster.ChangeTime = time.Time{}
+		if cd.Cluster.Status.SyncReplDegradation != nil {
+			cd.Cluster.Status.SyncReplDegradation.Since = time.Time{}
+		}
+		for _, k := range cd.Keepers {
+			k.ChangeTime = time.Time{}
+		}
+		for _, db := range cd.DBs {
+			db.ChangeTime = time.Time{}
+		}
+		cd.Proxy.ChangeTime = time.Time{}
+	}
+	return reflect.DeepEqual(cd1, cd2)
+
+}
+
+func TestUpdateUnsafeDurability(t *testing.T) {
+	tests := []struct {
+		allowUnsafeDurability *bool
+		pgParameters          cluster.PGParameters
+		unsafeDurability      bool
+	}{
+		{
+			pgParameters: cluster.PGParameters{"max_connections": "100"},
+		},
+		{
+			pgParameters:     cluster.PGParameters{"fsync": "off"},
+			unsafeDurability: false,
+		},
+		{
+			allowUnsafeDurability: cluster.BoolP(true),
+			pgParameters:          cluster.PGParameters{"fsync": "on"},
+			unsafeDurability:      false,
+		},
+		{
+			allowUnsafeDurability: cluster.BoolP(true),
+			pgParameters:          cluster.PGParameters{"fsync": "off"},
+			unsafeDurability:      true,
+		},
+		{
+			allowUnsafeDurability: cluster.BoolP(true),
+			pgParameters:          cluster.PGParameters{"full_page_writes": "off"},
+			unsafeDurability:      true,
+		},
+	}
+
+	for i, tt := range tests {
+		s := &Sentinel{uid: "sentinel01"}
+		for _, standbys := range []int{0, 1} {
+			cd := &cluster.ClusterData{
+				Cluster: &cluster.Cluster{
+					Spec: &cluster.ClusterSpec{
+						AllowUnsafeDurability: tt.allowUnsafeDurability,
+						PGParameters:          tt.pgParameters,
+					},
+				},
+				DBs: cluster.DBs{"db1": &cluster.DB{UID: "db1"}},
+			}
+			if standbys > 0 {
+				cd.DBs["db2"] = &cluster.DB{UID: "db2"}
+			}
+			s.updateUnsafeDurability(cd)
+			if cd.Cluster.Status.UnsafeDurability != tt.unsafeDurability {
+				t.Errorf("#%d: wrong unsafeDurability status with %d standbys: got: %t, want: %t", i, standbys, cd.Cluster.Status.UnsafeDurability, tt.unsafeDurability)
+			}
+		}
+	}
+}
+
+func TestInitConfig(t *testing.T) {
+	cd := &cluster.ClusterData{
+		Cluster: &cluster.Cluster{
+			UID:        "cluster1",
+			Generation: 1,
+			Spec: &cluster.ClusterSpec{
+				ConvergenceTimeout:   &cluster.Duration{Duration: cluster.DefaultConvergenceTimeout},
+				InitTimeout:          &cluster.Duration{Duration: cluster.DefaultInitTimeout},
+				SyncTimeout:          &cluster.Duration{Duration: cluster.DefaultSyncTimeout},
+				MaxStandbysPerSender: cluster.Uint16P(cluster.DefaultMaxStandbysPerSender),
+				InitMode:             cluster.ClusterInitModeP(cluster.ClusterInitModeNew),
+				MergePgParameters:    cluster.BoolP(true),
+				NewConfig:            &cluster.NewConfig{Locale: "en_US.UTF-8", DataChecksums: true},
+			},
+			Status: cluster.ClusterStatus{
+				CurrentGeneration: 1,
+				Phase:             cluster.ClusterPhaseInitializing,
+				Master:            "db1",
+			},
+		},
+		Keepers: cluster.Keepers{
+			"keeper1": &cluster.Keeper{
+				UID:  "keeper1",
+				Spec: &cluster.KeeperSpec{},
+				Status: cluster.KeeperStatus{
+					Healthy:               true,
+					LastHealthyTime:       time.Now(),
+					PostgresBinaryVersion: cluster.PostgresBinaryVersion{Maj: 10, Min: 4},
+				},
+			},
+		},
+		DBs: cluster.DBs{
+			"db1": &cluster.DB{
+				UID:        "db1",
+				Generation: 1,
+				Spec: &cluster.DBSpec{
+					KeeperUID: "keeper1",
+					InitMode:  cluster.DBInitModeNew,
+					NewConfig: &cluster.NewConfig{Locale: "en_US.UTF-8", DataChecksums: true},
+					Role:      common.RoleMaster,
+					Followers: []string{},
+				},
+				Status: cluster.DBStatus{
+					Healthy:           true,
+					CurrentGeneration: 1,
+					PGParameters:      cluster.PGParameters{"max_connections": "100"},
+				},
+			},
+		},
+		Proxy: &cluster.Proxy{},
+	}
+
+	expectedInitConfig := &cluster.InitConfig{
+		InitMode:              cluster.ClusterInitModeNew,
+		Role:                  cluster.ClusterRoleMaster,
+		MergePgParameters:     true,
+		NewConfig:             &cluster.NewConfig{Locale: "en_US.UTF-8", DataChecksums: true},
+		DBUID:                 "db1",
+		KeeperUID:             "keeper1",
+		PostgresBinaryVersion: cluster.PostgresBinaryVersion{Maj: 10, Min: 4},
+		PGParameters:          cluster.PGParameters{"max_connections": "100"},
+	}
+
+	s := &Sentinel{uid: "sentinel01", UIDFn: testUIDFn, RandFn: testRandFn, dbConvergenceInfos: make(map[string]*DBConvergenceInfo)}
+	s.dbConvergenceInfos["db1"] = &DBConvergenceInfo{Generation: 1, Timer: 0}
+
+	// the init configuration is recorded when the initialization completes
+	cd, err := s.updateCluster(cd, cluster.ProxiesInfo{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cd.Cluster.Status.Phase != cluster.ClusterPhaseNormal {
+		t.Fatalf("expected cluster phase %q, got %q", cluster.ClusterPhaseNormal, cd.Cluster.Status.Phase)
+	}
+	ic := cd.Cluster.Status.InitConfig
+	if ic == nil {
+		t.Fatalf("expected init config recorded")
+	}
+	if ic.InitTime.IsZero() {
+		t.Errorf("expected init time set")
+	}
+	initTime := ic.InitTime
+	ic.InitTime = time.Time{}
+	if !reflect.DeepEqual(ic, expectedInitConfig) {
+		t.Fatalf("wrong init config: got:\n%s\nwant:\n%s", spew.Sdump(ic), spew.Sdump(expectedInitConfig))
+	}
+	ic.InitTime = initTime
+
+	// later spec updates and new calls must not change it
+	ns := cd.Cluster.Spec.DeepCopy()
+	ns.NewConfig = &cluster.NewConfig{Locale: "C", DataChecksums: true}
+	ns.PGParameters = cluster.PGParameters{"max_connections": "200"}
+	if err := cd.Cluster.UpdateSpec(ns); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedInitConfig.InitTime = initTime
+	for i := 0; i < 2; i++ {
+		cd, err = s.updateCluster(cd, cluster.ProxiesInfo{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		s.setInitConfig(cd, cd.DBs["db1"])
+		if !reflect.DeepEqual(cd.Cluster.Status.InitConfig, expectedInitConfig) {
+			t.Fatalf("init config changed: got:\n%s\nwant:\n%s", spew.Sdump(cd.Cluster.Status.InitConfig), spew.Sdump(expectedInitConfig))
+		}
+	}
+}
+
+func TestUpdateDBsReadiness(t *testing.T) {
+	newCD := func(maxReadyStandbyLag *uint32) *cluster.ClusterData {
+		return &cluster.ClusterData{
+			Cluster: &cluster.Cluster{
+				Spec: &cluster.ClusterSpec{
+					MaxReadyStandbyLag: maxReadyStandbyLag,
+				},
+				Status: cluster.ClusterStatus{
+					Master: "db1",
+				},
+			},
+			DBs: cluster.DBs{
+				"db1": &cluster.DB{
+					UID:    "db1",
+					Spec:   &cluster.DBSpec{Role: common.RoleMaster},
+					Status: cluster.DBStatus{Healthy: true, XLogPos: 5000},
+				},
+				"db2": &cluster.DB{
+					UID: "db2",
+					Spec: &cluster.DBSpec{
+						Role:         common.RoleStandby,
+						FollowConfig: &cluster.FollowConfig{Type: cluster.FollowTypeInternal, DBUID: "db1"},
+					},
+					Status: cluster.DBStatus{Healthy: true, XLogPos: 4900, ReplayXLogPos: 4800},
+				},
+				"db3": &cluster.DB{
+					UID: "db3",
+					Spec: &cluster.DBSpec{
+						Role:         common.RoleStandby,
+						FollowConfig: &cluster.FollowConfig{Type: cluster.FollowTypeInternal, DBUID: "db1"},
+					},
+					Status: cluster.DBStatus{Healthy: true, XLogPos: 1000},
+				},
+				// reported xlog pos after the last reported master xlog pos
+				"db4": &cluster.DB{
+					UID: "db4",
+					Spec: &cluster.DBSpec{
+						Role:         common.RoleStandby,
+						FollowConfig: &cluster.FollowConfig{Type: cluster.FollowTypeInternal, DBUID: "db1"},
+					},
+					Status: cluster.DBStatus{Healthy: true, XLogPos: 6000},
+				},
+				"db5": &cluster.DB{
+					UID: "db5",
+					Spec: &cluster.DBSpec{
+						Role:         common.RoleStandby,
+						FollowConfig: &cluster.FollowConfig{Type: cluster.FollowTypeInternal, DBUID: "db1"},
+					},
+					Status: cluster.DBStatus{Healthy: false, XLogPos: 5000},
+				},
+				// cascading standby following db2
+				"db6": &cluster.DB{
+					UID: "db6",
+					Spec: &cluster.DBSpec{
+						Role:         common.RoleStandby,
+						FollowConfig: &cluster.FollowConfig{Type: cluster.FollowTypeInternal, DBUID: "db2"},
+					},
+					Status: cluster.DBStatus{Healthy: true, XLogPos: 4500},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		maxReadyStandbyLag *uint32
+		lags               map[string]uint64
+		ready              map[string]bool
+	}{
+		// no limit
+		{
+			lags:  map[string]uint64{"db1": 0, "db2": 100, "db3": 4000, "db4": 0, "db5": 0, "db6": 500},
+			ready: map[string]bool{"db1": true, "db2": true, "db3": true, "db4": true, "db5": false, "db6": true},
+		},
+		{
+			maxReadyStandbyLag: cluster.Uint32P(100),
+			lags:               map[string]uint64{"db1": 0, "db2": 100, "db3": 4000, "db4": 0, "db5": 0, "db6": 500},
+			ready:              map[string]bool{"db1": true, "db2": true, "db3": false, "db4": true, "db5": false, "db6": false},
+		},
+		{
+			maxReadyStandbyLag: cluster.Uint32P(99),
+			lags:               map[string]uint64{"db1": 0, "db2": 100, "db3": 4000, "db4": 0, "db5": 0, "db6": 500},
+			ready:              map[string]bool{"db1": true, "db2": false, "db3": false, "db4": true, "db5": false, "db6": false},
+		},
+	}
+
+	for i, tt := range tests {
+		s := &Sentinel{uid: "sentinel01"}
+		cd := newCD(tt.maxReadyStandbyLag)
+		s.updateDBsReadiness(cd)
+		for _, db := range cd.DBs {
+			if db.Status.ReplicationLag != tt.lags[db.UID] {
+				t.Errorf("#%d: wrong replication lag for db %q: got: %d, want: %d", i, db.UID, db.Status.ReplicationLag, tt.lags[db.UID])
+			}
+			if db.Status.Ready != tt.ready[db.UID] {
+				t.Errorf("#%d: wrong ready state for db %q: got: %t, want: %t", i, db.UID, db.Status.Ready, tt.ready[db.UID])
+			}
+		}
+		// only db2 reports its replayed position
+		for _, db := range cd.DBs {
+			expected := uint64(0)
+			if db.UID == "db2" {
+				expected = 200
+			}
+			if db.Status.ReplayLag != expected {
+				t.Errorf("#%d: wrong replay lag for db %q: got: %d, want: %d", i, db.UID, db.Status.ReplayLag, expected)
+			}
+		}
+	}
+}
+
+func TestIsReplayLagBelowMax(t *testing.T) {
+	tests := []struct {
+		name          string
+		maxLag        uint32
+		maxDelay      time.Duration
+		replayXLogPos uint64
+		replayDelay   *cluster.Duration
+		out           bool
+	}{
+		{name: "no limits", replayXLogPos: 1000, replayDelay: &cluster.Duration{Duration: time.Hour}, out: true},
+		{name: "lag below max", maxLag: 4000, replayXLogPos: 1000, out: true},
+		{name: "lag above max", maxLag: 3999, replayXLogPos: 1000, out: false},
+		{name: "replayed position not reported", maxLag: 100, out: true},
+		{name: "delay below max", maxDelay: time.Minute, replayXLogPos: 4000, replayDelay: &cluster.Duration{Duration: 30 * time.Second}, out: true},
+		{name: "delay above max", maxDelay: time.Minute, replayXLogPos: 4000, replayDelay: &cluster.Duration{Duration: 2 * time.Minute}, out: false},
+		// no writes on the master
+		{name: "delay above max with all the wal replayed", maxDelay: time.Minute, replayXLogPos: 5000, replayDelay: &cluster.Duration{Duration: 2 * time.Minute}, out: true},
+		{name: "delay not reported", maxDelay: time.Minute, replayXLogPos: 4000, out: true},
+	}
+
+	for i, tt := range tests {
+		cd := &cluster.ClusterData{
+			Cluster: &cluster.Cluster{
+				Spec: &cluster.ClusterSpec{
+					MaxStandbyReplayLag:   cluster.Uint32P(tt.maxLag),
+					MaxStandbyReplayDelay: &cluster.Duration{Duration: tt.maxDelay},
+				},
+			},
+			DBs: cluster.DBs{
+				"db1": &cluster.DB{UID: "db1", Spec: &cluster.DBSpec{Role: common.RoleMaster}, Status: cluster.DBStatus{XLogPos: 5000}},
+				"db2": &cluster.DB{UID: "db2", Spec: &cluster.DBSpec{Role: common.RoleStandby}, Status: cluster.DBStatus{XLogPos: 5000, ReplayXLogPos: tt.replayXLogPos, ReplayDelay: tt.replayDelay}},
+			},
+		}
+		if out := isReplayLagBelowMax(cd, cd.DBs["db1"], cd.DBs["db2"]); out != tt.out {
+			t.Errorf("#%d (%s): got: %t, want: %t", i, tt.name, out, tt.out)
+		}
+	}
+}
+
+func TestLagAwareSyncCandidates(t *testing.T) {
+	masterDB := &cluster.DB{
+		UID: "db1",
+		Status: cluster.DBStatus{
+			ReplicationSlots: []*cluster.ReplicationSlotStatus{
+				{Name: "stolon_db2", Active: true},
+				{Name: "stolon_db3", Active: true},
+				{Name: "stolon_db4", Active: false},
+				{Name: "stolon_db5", Active: true},
+			},
+		},
+	}
+	candidates := []*cluster.DB{
+		// replay lag greater than half max lag
+		{UID: "db2", Spec: &cluster.DBSpec{}, Status: cluster.DBStatus{ReplayXLogPos: 100, ReplayLag: 600, ReplicationLag: 100}},
+		{UID: "db3", Spec: &cluster.DBSpec{}, Status: cluster.DBStatus{ReplayXLogPos: 100, ReplayLag: 300}},
+		// not streaming
+		{UID: "db4", Spec: &cluster.DBSpec{}, Status: cluster.DBStatus{ReplayXLogPos: 100}},
+		{UID: "db5", Spec: &cluster.DBSpec{}, Status: cluster.DBStatus{ReplayXLogPos: 100, ReplayLag: 100}},
+		// replayed position not reported, no slot reported
+		{UID: "db6", Spec: &cluster.DBSpec{}, Status: cluster.DBStatus{ReplicationLag: 200}},
+	}
+
+	out := []string{}
+	for _, db := range lagAwareSyncCandidates(masterDB, candidates, 1000) {
+		out = append(out, db.UID)
+	}
+	expected := []string{"db5", "db6", "db3"}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("got: %v, want: %v", out, expected)
+	}
+}
+
+func TestLaggingSyncStandbys(t *testing.T) {
+	cd := &cluster.ClusterData{
+		DBs: cluster.DBs{
+			"db2": &cluster.DB{UID: "db2", Status: cluster.DBStatus{ReplayXLogPos: 100, ReplayLag: 2000}},
+			"db3": &cluster.DB{UID: "db3", Status: cluster.DBStatus{ReplayXLogPos: 100, ReplayLag: 1000}},
+			"db4": &cluster.DB{UID: "db4", Status: cluster.DBStatus{ReplicationLag: 3000}},
+			"db5": &cluster.DB{UID: "db5", Status: cluster.DBStatus{ReplayXLogPos: 100, ReplayLag: 2000}},
+		},
+	}
+	synchronousStandbys := map[string]struct{}{"db2": {}, "db3": {}, "db4": {}, "db5": {}, "db9": {}}
+
+	out := []string{}
+	for _, db := range laggingSyncStandbys(cd, synchronousStandbys, 1000) {
+		out = append(out, db.UID)
+	}
+	expected := []string{"db4", "db2", "db5"}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("got: %v, want: %v", out, expected)
+	}
+}
+
+func TestSyncStandbysReasons(t *testing.T) {
+	prevReasons := map[string]string{"db2": "chosen with replay lag 100 bytes", "db3": "chosen with replay lag 200 bytes"}
+	synchronousStandbys := map[string]struct{}{"db2": {}, "db3": {}, "db4": {}, "db5": {}}
+	reasons := map[string]string{"db3": "previous synchronous standby kept to reach minSynchronousStandbys", "db4": "chosen with replay lag 0 bytes"}
+
+	out := syncStandbysReasons(prevReasons, synchronousStandbys, reasons)
+	expected := map[string]string{
+		"db2": "chosen with replay lag 100 bytes",
+		"db3": "previous synchronous standby kept to reach minSynchronousStandbys",
+		"db4": "chosen with replay lag 0 bytes",
+		"db5": "synchronous standby",
+	}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("got: %v, want: %v", out, expected)
+	}
+}
+
+func TestProbeDBs(t *testing.T) {
+	tests := []struct {
+		mode            *cluster.DBProbeMode
+		reportedHealthy bool
+		probeOK         bool
+		healthy         bool
+		probed          bool
+	}{
+		// probe disabled
+		{mode: nil, reportedHealthy: true, probeOK: false, healthy: true, probed: false},
+		{mode: cluster.DBProbeModeP(cluster.DBProbeModeNone), reportedHealthy: true, probeOK: false, healthy: true, probed: false},
+		{mode: cluster.DBProbeModeP(cluster.DBProbeModeNone), reportedHealthy: false, probeOK: true, healthy: false, probed: false},
+		// advisory probe: only logged
+		{mode: cluster.DBProbeModeP(cluster.DBProbeModeAdvisory), reportedHealthy: true, probeOK: true, healthy: true, probed: true},
+		{mode: cluster.DBProbeModeP(cluster.DBProbeModeAdvisory), reportedHealthy: true, probeOK: false, healthy: true, probed: true},
+		{mode: cluster.DBProbeModeP(cluster.DBProbeModeAdvisory), reportedHealthy: false, probeOK: true, healthy: false, probed: false},
+		// enforced probe
+		{mode: cluster.DBProbeModeP(cluster.DBProbeModeEnforce), reportedHealthy: true, probeOK: true, healthy: true, probed: true},
+		{mode: cluster.DBProbeModeP(cluster.DBProbeModeEnforce), reportedHealthy: true, probeOK: false, healthy: false, probed: true},
+		{mode: cluster.DBProbeModeP(cluster.DBProbeModeEnforce), reportedHealthy: false, probeOK: true, healthy: false, probed: false},
+		{mode: cluster.DBProbeModeP(cluster.DBProbeModeEnforce), reportedHealthy: false, probeOK: false, healthy: false, probed: false},
+	}
+
+	for i, tt := range tests {
+		cd := &cluster.ClusterData{
+			Cluster: &cluster.Cluster{
+				UID: "cluster1",
+				Spec: &cluster.ClusterSpec{
+					// mark dbs in error as unhealthy without waiting
+					FailInterval: &cluster.Duration{Duration: 0},
+					DBProbeMode:  tt.mode,
+				},
+			},
+			Keepers: cluster.Keepers{
+				"keeper1": &cluster.Keeper{
+					UID:    "keeper1",
+					Spec:   &cluster.KeeperSpec{},
+					Status: cluster.KeeperStatus{Healthy: true},
+				},
+			},
+			DBs: cluster.DBs{
+				"db1": &cluster.DB{
+					UID:  "db1",
+					Spec: &cluster.DBSpec{KeeperUID: "keeper1", Role: common.RoleMaster},
+				},
+			},
+		}
+		keepersInfo := cluster.KeepersInfo{
+			"keeper1": &cluster.KeeperInfo{
+				InfoUID:    "info1",
+				UID:        "keeper1",
+				ClusterUID: "cluster1",
+				PostgresState: &cluster.PostgresState{
+					UID:           "db1",
+					ListenAddress: "10.0.0.1",
+					Port:          "5432",
+					Healthy:       tt.reportedHealthy,
+				},
+			},
+		}
+
+		probed := false
+		s := &Sentinel{
+			uid:                    "sentinel01",
+			keeperErrorTimers:      make(map[string]int64),
+			dbErrorTimers:          make(map[string]int64),
+			dbNotIncreasingXLogPos: make(map[string]int64),
+			keeperInfoHistories:    make(KeeperInfoHistories),
+			ProbeDBFn: func(address string, timeout time.Duration) error {
+				probed = true
+				if address != "10.0.0.1:5432" {
+					t.Errorf("#%d: wrong probed address: %s", i, address)
+				}
+				if timeout != cluster.DefaultDBProbeTimeout {
+					t.Errorf("#%d: wrong probe timeout: %s", i, timeout)
+				}
+				if !tt.probeOK {
+					return fmt.Errorf("connection refused")
+				}
+				return nil
+			},
+		}
+
+		outcd, _ := s.updateKeepersStatus(cd, keepersInfo, false)
+		// wait some time so the db error timer will be greater than the
+		// fail interval
+		time.Sleep(time.Millisecond)
+		outcd, _ = s.updateKeepersStatus(cd, keepersInfo, false)
+
+		if probed != tt.probed {
+			t.Errorf("#%d: got probed: %t, want: %t", i, probed, tt.probed)
+		}
+		if outcd.DBs["db1"].Status.Healthy != tt.healthy {
+			t.Errorf("#%d: got healthy: %t, want: %t", i, outcd.DBs["db1"].Status.Healthy, tt.healthy)
+		}
+	}
+}
+
+func TestDBsReachability(t *testing.T) {
+	cd := &cluster.ClusterData{
+		Cluster: &cluster.Cluster{
+			Spec: &cluster.ClusterSpec{FailoverQuorum: cluster.Uint16P(1)},
+		},
+		DBs: cluster.DBs{
+			"db1": &cluster.DB{UID: "db1", Status: cluster.DBStatus{ListenAddress: "10.0.0.1", Port: "5432"}},
+			"db2": &cluster.DB{UID: "db2", Status: cluster.DBStatus{ListenAddress: "10.0.0.2", Port: "5432"}},
+			// not yet reported listen address
+			"db3": &cluster.DB{UID: "db3"},
+		},
+	}
+	s := &Sentinel{
+		ProbeDBFn: func(address string, timeout time.Duration) error {
+			if address == "10.0.0.2:5432" {
+				return fmt.Errorf("connection refused")
+			}
+			return nil
+		},
+	}
+
+	expected := map[string]bool{"db1": true, "db2": false}
+	if r := s.dbsReachability(cd); !reflect.DeepEqual(r, expected) {
+		t.Errorf("got reachability: %v, want: %v", r, expected)
+	}
+
+	cd.Cluster.Spec.FailoverQuorum = nil
+	if r := s.dbsReachability(cd); r != nil {
+		t.Errorf("got reachability: %v with the failover quorum disabled", r)
+	}
+}
+
+func TestFailoverQuorumReached(t *testing.T) {
+	masterDB := &cluster.DB{UID: "db1", Spec: &cluster.DBSpec{KeeperUID: "keeper1"}}
+	tests := []struct {
+		name          string
+		quorum        *uint16
+		sentinelsInfo cluster.SentinelsInfo
+		reached       bool
+	}{
+		{
+			name:    "quorum disabled",
+			reached: true,
+		},
+		{
+			name:   "no other sentinels",
+			quorum: cluster.Uint16P(1),
+			sentinelsInfo: cluster.SentinelsInfo{
+				{UID: "sentinel01", DBsReachability: map[string]bool{"db1": false}},
+			},
+		},
+		{
+			name:   "quorum reached",
+			quorum: cluster.Uint16P(2),
+			sentinelsInfo: cluster.SentinelsInfo{
+				{UID: "sentinel01", DBsReachability: map[string]bool{"db1": false}},
+				{UID: "sentinel02", DBsReachability: map[string]bool{"db1": false}},
+				{UID: "sentinel03", DBsReachability: map[string]bool{"db1": false, "db2": true}},
+			},
+			reached: true,
+		},
+		{
+			name:   "master reachable by another sentinel",
+			quorum: cluster.Uint16P(2),
+			sentinelsInfo: cluster.SentinelsInfo{
+				{UID: "sentinel02", DBsReachability: map[string]bool{"db1": false}},
+				{UID: "sentinel03", DBsReachability: map[string]bool{"db1": true}},
+			},
+		},
+		{
+			name:   "master not probed by other sentinels",
+			quorum: cluster.Uint16P(1),
+			sentinelsInfo: cluster.SentinelsInfo{
+				{UID: "sentinel02"},
+				{UID: "sentinel03", DBsReachability: map[string]bool{"db2": false}},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		cd := &cluster.ClusterData{
+			Cluster: &cluster.Cluster{
+				Spec: &cluster.ClusterSpec{FailoverQuorum: tt.quorum},
+			},
+			DBs: cluster.DBs{"db1": masterDB},
+		}
+		s := &Sentinel{uid: "sentinel01", sentinelsInfo: tt.sentinelsInfo}
+		if reached := s.failoverQuorumReached(cd, masterDB); reached != tt.reached {
+			t.Errorf("#%d (%s): got reached: %t, want: %t", i, tt.name, reached, tt.reached)
+		}
+	}
+}
+
+func TestSortByMasterPlacement(t *testing.T) {
+	newCD := func(preferredTags cluster.Tags, antiAffinityTag *string) *cluster.ClusterData {
+		cd := &cluster.ClusterData{
+			Cluster: &cluster.Cluster{
+				Spec: &cluster.ClusterSpec{
+					MasterPreferredTags:   preferredTags,
+					MasterAntiAffinityTag: antiAffinityTag,
+				},
+			},
+			Keepers: cluster.Keepers{
+				"keeper1": &cluster.Keeper{UID: "keeper1", Spec: &cluster.KeeperSpec{Tags: cluster.Tags{"zone": "a"}}},
+				"keeper2": &cluster.Keeper{UID: "keeper2", Spec: &cluster.KeeperSpec{Tags: cluster.Tags{"zone": "a", "disk": "ssd"}}},
+				"keeper3": &cluster.Keeper{UID: "keeper3", Spec: &cluster.KeeperSpec{Tags: cluster.Tags{"zone": "b"}}},
+				"keeper4": &cluster.Keeper{UID: "keeper4", Spec: &cluster.KeeperSpec{}},
+				"keeper5": &cluster.Keeper{UID: "keeper5", Spec: &cluster.KeeperSpec{Tags: cluster.Tags{"zone": "c", "disk": "ssd"}}},
+			},
+			DBs: cluster.DBs{},
+		}
+		for i := 1; i <= 5; i++ {
+			uid := fmt.Sprintf("db%d", i)
+			cd.DBs[uid] = &cluster.DB{
+				UID:  uid,
+				Spec: &cluster.DBSpec{KeeperUID: fmt.Sprintf("keeper%d", i)},
+			}
+		}
+		return cd
+	}
+
+	tests := []struct {
+		preferredTags    cluster.Tags
+		antiAffinityTag  *string
+		failureDomainTag *string
+		priorities       map[string]int
+		xLogPos          map[string]uint64
+		out              []string
+	}{
+		// no preferences
+		{
+			xLogPos: map[string]uint64{"db2": 100, "db3": 200, "db4": 300, "db5": 400},
+			out:     []string{"db2", "db3", "db4", "db5"},
+		},
+		// preferences don't override the xlogpos ordering
+		{
+			preferredTags:   cluster.Tags{"disk": "ssd"},
+			antiAffinityTag: cluster.StringP("zone"),
+			xLogPos:         map[string]uint64{"db2": 100, "db3": 200, "db4": 300, "db5": 400},
+			out:             []string{"db2", "db3", "db4", "db5"},
+		},
+		{
+			preferredTags: cluster.Tags{"disk": "ssd"},
+			xLogPos:       map[string]uint64{"db2": 100, "db3": 100, "db4": 100, "db5": 100},
+			out:           []string{"db2", "db5", "db3", "db4"},
+		},
+		// avoid the failed master zone (keeper1 is in zone a)
+		{
+			antiAffinityTag: cluster.StringP("zone"),
+			xLogPos:         map[string]uint64{"db2": 100, "db3": 100, "db4": 100, "db5": 100},
+			out:             []string{"db3", "db5", "db2", "db4"},
+		},
+		// without an anti affinity tag the failure domain tag is used
+		{
+			failureDomainTag: cluster.StringP("zone"),
+			xLogPos:          map[string]uint64{"db2": 100, "db3": 100, "db4": 100, "db5": 100},
+			out:              []string{"db3", "db5", "db2", "db4"},
+		},
+		// the anti affinity weights more than the preferred tags
+		{
+			preferredTags:   cluster.Tags{"disk": "ssd"},
+			antiAffinityTag: cluster.StringP("zone"),
+			xLogPos:         map[string]uint64{"db2": 100, "db3": 100, "db4": 100, "db5": 100},
+			out:             []string{"db5", "db3", "db2", "db4"},
+		},
+		// the election priority overrides the xlogpos ordering and the
+		// placement preferences
+		{
+			preferredTags: cluster.Tags{"disk": "ssd"},
+			priorities:    map[string]int{"keeper4": 10, "keeper3": 5},
+			xLogPos:       map[string]uint64{"db2": 100, "db3": 200, "db4": 300, "db5": 100},
+			out:           []string{"db4", "db3", "db2", "db5"},
+		},
+		// negative priorities are chosen last
+		{
+			priorities: map[string]int{"keeper2": -1},
+			xLogPos:    map[string]uint64{"db2": 100, "db3": 200, "db4": 300, "db5": 400},
+			out:        []string{"db3", "db4", "db5", "db2"},
+		},
+		// only one candidate: always kept
+		{
+			preferredTags:   cluster.Tags{"disk": "nvme"},
+			antiAffinityTag: cluster.StringP("zone"),
+			xLogPos:         map[string]uint64{"db2": 100},
+			out:             []string{"db2"},
+		},
+	}
+
+	for i, tt := range tests {
+		cd := newCD(tt.preferredTags, tt.antiAffinityTag)
+		cd.Cluster.Spec.FailureDomainTag = tt.failureDomainTag
+		for keeperUID, priority := range tt.priorities {
+			cd.Keepers[keeperUID].Spec.ElectionPriority = priority
+		}
+		dbs := []*cluster.DB{}
+		for _, uid := range []string{"db2", "db3", "db4", "db5"} {
+			if xLogPos, ok := tt.xLogPos[uid]; ok {
+				db := cd.DBs[uid]
+				db.Status.XLogPos = xLogPos
+				dbs = append(dbs, db)
+			}
+		}
+		sortByMasterPlacement(cd, cd.DBs["db1"], dbs)
+		out := []string{}
+		for _, db := range dbs {
+			out = append(out, db.UID)
+		}
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: wrong dbs order: got: %v, want: %v", i, out, tt.out)
+		}
+	}
+}
+
+func TestSpreadByFailureDomain(t *testing.T) {
+	newCD := func(failureDomainTag *string) *cluster.ClusterData {
+		cd := &cluster.ClusterData{
+			Cluster: &cluster.Cluster{
+				Spec: &cluster.ClusterSpec{
+					FailureDomainTag: failureDomainTag,
+				},
+			},
+			Keepers: cluster.Keepers{
+				"keeper1": &cluster.Keeper{UID: "keeper1", Spec: &cluster.KeeperSpec{Tags: cluster.Tags{"zone": "a"}}},
+				"keeper2": &cluster.Keeper{UID: "keeper2", Spec: &cluster.KeeperSpec{Tags: cluster.Tags{"zone": "a"}}},
+				"keeper3": &cluster.Keeper{UID: "keeper3", Spec: &cluster.KeeperSpec{Tags: cluster.Tags{"zone": "b"}}},
+				"keeper4": &cluster.Keeper{UID: "keeper4", Spec: &cluster.KeeperSpec{}},
+				"keeper5": &cluster.Keeper{UID: "keeper5", Spec: &cluster.KeeperSpec{Tags: cluster.Tags{"zone": "b"}}},
+				"keeper6": &cluster.Keeper{UID: "keeper6", Spec: &cluster.KeeperSpec{Tags: cluster.Tags{"zone": "c"}}},
+			},
+			DBs: cluster.DBs{},
+		}
+		for i := 1; i <= 6; i++ {
+			uid := fmt.Sprintf("db%d", i)
+			cd.DBs[uid] = &cluster.DB{
+				UID:  uid,
+				Spec: &cluster.DBSpec{KeeperUID: fmt.Sprintf("keeper%d", i)},
+			}
+		}
+		return cd
+	}
+
+	tests := []struct {
+		failureDomainTag *string
+		chosen           []string
+		in               []string
+		out              []string
+		otherDomain      bool
+	}{
+		// no failure domain tag: the order is kept
+		{
+			in:  []string{"db2", "db4", "db5", "db3", "db6"},
+			out: []string{"db2", "db4", "db5", "db3", "db6"},
+		},
+		// the master (db1) is in zone a
+		{
+			failureDomainTag: cluster.StringP("zone"),
+			in:               []string{"db2", "db4", "db5", "db3", "db6"},
+			out:              []string{"db5", "db6", "db2", "db4", "db3"},
+		},
+		{
+			failureDomainTag: cluster.StringP("zone"),
+			chosen:           []string{"db3"},
+			in:               []string{"db2", "db4", "db5", "db6"},
+			out:              []string{"db6", "db2", "db4", "db5"},
+			otherDomain:      true,
+		},
+		{
+			failureDomainTag: cluster.StringP("zone"),
+			chosen:           []string{"db2", "db4"},
+			in:               []string{"db5"},
+			out:              []string{"db5"},
+		},
+	}
+
+	for i, tt := range tests {
+		cd := newCD(tt.failureDomainTag)
+		masterDB := cd.DBs["db1"]
+		chosen := []*cluster.DB{}
+		synchronousStandbys := map[string]struct{}{}
+		for _, uid := range tt.chosen {
+			chosen = append(chosen, cd.DBs[uid])
+			synchronousStandbys[uid] = struct{}{}
+		}
+		dbs := []*cluster.DB{}
+		for _, uid := range tt.in {
+			dbs = append(dbs, cd.DBs[uid])
+		}
+		out := []string{}
+		for _, db := range spreadByFailureDomain(cd, masterDB, chosen, dbs) {
+			out = append(out, db.UID)
+		}
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: wrong dbs order: got: %v, want: %v", i, out, tt.out)
+		}
+		if otherDomain := syncStandbysInOtherFailureDomain(cd, masterDB, synchronousStandbys); otherDomain != tt.otherDomain {
+			t.Errorf("#%d: got sync standbys in other failure domain: %t, want: %t", i, otherDomain, tt.otherDomain)
+		}
+	}
+}
+
+func TestQuorumNewMasterDB(t *testing.T) {
+	tests := []struct {
+		syncStandbys     []string
+		inSyncStandbys   []string
+		externalStandbys []string
+		quorum           uint16
+		bestNewMasters   []string
+		xlogPos          map[string]uint64
+		out              string
+	}{
+		// ANY 1 (db2, db3, db4): all the synchronous standbys are needed
+		{
+			syncStandbys:   []string{"db2", "db3", "db4"},
+			inSyncStandbys: []string{"db2", "db3", "db4"},
+			quorum:         1,
+			bestNewMasters: []string{"db2", "db3"},
+			out:            "",
+		},
+		// ANY 2 (db2, db3, db4): two synchronous standbys are enough, the
+		// one with the greatest xlog position is chosen
+		{
+			syncStandbys:   []string{"db2", "db3", "db4"},
+			inSyncStandbys: []string{"db2", "db3", "db4"},
+			quorum:         2,
+			bestNewMasters: []string{"db2", "db3"},
+			xlogPos:        map[string]uint64{"db2": 100, "db3": 200},
+			out:            "db3",
+		},
+		// not in sync standbys and not synchronous standbys aren't counted
+		{
+			syncStandbys:   []string{"db2", "db3", "db4"},
+			inSyncStandbys: []string{"db2", "db4"},
+			quorum:         2,
+			bestNewMasters: []string{"db2", "db3", "db5"},
+			out:            "",
+		},
+		// external synchronous standbys are counted
+		{
+			syncStandbys:     []string{"db2", "db3"},
+			inSyncStandbys:   []string{"db2", "db3"},
+			externalStandbys: []string{"stolonfakestandby"},
+			quorum:           2,
+			bestNewMasters:   []string{"db3", "db2"},
+			out:              "db3",
+		},
+	}
+
+	for i, tt := range tests {
+		masterDB := &cluster.DB{
+			UID: "db1",
+			Spec: &cluster.DBSpec{
+				SynchronousReplication:      true,
+				SynchronousStandbys:         tt.syncStandbys,
+				ExternalSynchronousStandbys: tt.externalStandbys,
+				SynchronousStandbysQuorum:   tt.quorum,
+			},
+			Status: cluster.DBStatus{
+				SynchronousStandbys: tt.inSyncStandbys,
+			},
+		}
+		bestNewMasters := []*cluster.DB{}
+		for _, uid := range tt.bestNewMasters {
+			bestNewMasters = append(bestNewMasters, &cluster.DB{
+				UID:    uid,
+				Spec:   &cluster.DBSpec{},
+				Status: cluster.DBStatus{XLogPos: tt.xlogPos[uid]},
+			})
+		}
+		out := ""
+		if db := quorumNewMasterDB(masterDB, bestNewMasters); db != nil {
+			out = db.UID
+		}
+		if out != tt.out {
+			t.Errorf("#%d: wrong new master: got: %q, want: %q", i, out, tt.out)
+		}
+	}
+}
+
+func TestExcludeDelayedStandbys(t *testing.T) {
+	delay := &cluster.Duration{Duration: time.Hour}
+	tests := []struct {
+		allowPromotion bool
+		delayed        []string
+		in             []string
+		out            []string
+	}{
+		{
+			in:  []string{"db2", "db3"},
+			out: []string{"db2", "db3"},
+		},
+		{
+			delayed: []string{"db2"},
+			in:      []string{"db2", "db3"},
+			out:     []string{"db3"},
+		},
+		// the override doesn't elect a delayed standby when there're
+		// other candidates
+		{
+			allowPromotion: true,
+			delayed:        []string{"db2"},
+			in:             []string{"db2", "db3"},
+			out:            []string{"db3"},
+		},
+		// only delayed standbys without override
+		{
+			delayed: []string{"db2"},
+			in:      []string{"db2"},
+			out:     []string{},
+		},
+		// only delayed standbys with override
+		{
+			allowPromotion: true,
+			delayed:        []string{"db2"},
+			in:             []string{"db2"},
+			out:            []string{"db2"},
+		},
+	}
+
+	for i, tt := range tests {
+		cd := &cluster.ClusterData{
+			Cluster: &cluster.Cluster{
+				Spec: &cluster.ClusterSpec{
+					AllowDelayedStandbyPromotion: cluster.BoolP(tt.allowPromotion),
+				},
+			},
+			Keepers: cluster.Keepers{},
+			DBs:     cluster.DBs{},
+		}
+		for _, uid := range []string{"db2", "db3"} {
+			keeperUID := "keeper" + uid[2:]
+			cd.Keepers[keeperUID] = &cluster.Keeper{UID: keeperUID, Spec: &cluster.KeeperSpec{}}
+			cd.DBs[uid] = &cluster.DB{UID: uid, Spec: &cluster.DBSpec{KeeperUID: keeperUID}}
+		}
+		for _, uid := range tt.delayed {
+			cd.Keepers[cd.DBs[uid].Spec.KeeperUID].Spec.RecoveryMinApplyDelay = delay
+		}
+		dbs := []*cluster.DB{}
+		for _, uid := range tt.in {
+			dbs = append(dbs, cd.DBs[uid])
+		}
+		s := &Sentinel{uid: "sentinel01"}
+		out := []string{}
+		for _, db := range s.excludeDelayedStandbys(cd, dbs) {
+			out = append(out, db.UID)
+		}
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: wrong dbs: got: %v, want: %v", i, out, tt.out)
+		}
+	}
+}
+
+func TestExcludeDrainedKeepers(t *testing.T) {
+	cd := &cluster.ClusterData{
+		Keepers: cluster.Keepers{},
+		DBs:     cluster.DBs{},
+	}
+	dbs := []*cluster.DB{}
+	for _, uid := range []string{"db2", "db3", "db4", "db5"} {
+		keeperUID := "keeper" + uid[2:]
+		cd.Keepers[keeperUID] = &cluster.Keeper{UID: keeperUID, Spec: &cluster.KeeperSpec{}}
+		cd.DBs[uid] = &cluster.DB{UID: uid, Spec: &cluster.DBSpec{KeeperUID: keeperUID}}
+		dbs = append(dbs, cd.DBs[uid])
+	}
+	cd.Keepers["keeper3"].Spec.Drained = true
+	// a keeper without spec isn't drained
+	cd.Keepers["keeper4"].Spec = nil
+	cd.Keepers["keeper5"].Spec.Maintenance = true
+
+	out := []string{}
+	for _, db := range excludeDrainedKeepers(cd, dbs) {
+		out = append(out, db.UID)
+	}
+	if expected := []string{"db2", "db4"}; !reflect.DeepEqual(out, expected) {
+		t.Errorf("wrong dbs: got: %v, want: %v", out, expected)
+	}
+}
+
+func TestExcludePostgresMajorMismatch(t *testing.T) {
+	cd := &cluster.ClusterData{
+		Keepers: cluster.Keepers{},
+		DBs:     cluster.DBs{},
+	}
+	versions := map[string]cluster.PostgresBinaryVersion{
+		"db1": {Maj: 12, Min: 4},
+		// newer minor version
+		"db2": {Maj: 12, Min: 6},
+		"db3": {Maj: 13, Min: 2},
+		// not yet reported
+		"db4": {},
+		"db5": {Maj: 11, Min: 9},
+	}
+	dbs := []*cluster.DB{}
+	for _, uid := range []string{"db1", "db2", "db3", "db4", "db5"} {
+		keeperUID := "keeper" + uid[2:]
+		cd.Keepers[keeperUID] = &cluster.Keeper{UID: keeperUID, Status: cluster.KeeperStatus{PostgresBinaryVersion: versions[uid]}}
+		cd.DBs[uid] = &cluster.DB{UID: uid, Spec: &cluster.DBSpec{KeeperUID: keeperUID}}
+		if uid != "db1" {
+			dbs = append(dbs, cd.DBs[uid])
+		}
+	}
+
+	out := []string{}
+	for _, db := range excludePostgresMajorMismatch(cd, cd.DBs["db1"], dbs) {
+		out = append(out, db.UID)
+	}
+	if expected := []string{"db2", "db4"}; !reflect.DeepEqual(out, expected) {
+		t.Errorf("wrong dbs: got: %v, want: %v", out, expected)
+	}
+}
+
+func TestPreferLogicalReplSlotsSynced(t *testing.T) {
+	cd := &cluster.ClusterData{
+		Cluster: &cluster.Cluster{
+			Spec: &cluster.ClusterSpec{
+				LogicalReplicationSlots: []cluster.LogicalReplicationSlot{
+					{Name: "slot1"},
+					{Name: "slot2", Database: "db1"},
+				},
+			},
+		},
+		DBs: cluster.DBs{},
+	}
+	slots := []*cluster.LogicalReplicationSlotStatus{
+		{Name: "stolon_slot1", Database: "postgres", Plugin: "pgoutput"},
+		{Name: "stolon_slot2", Database: "db1", Plugin: "pgoutput"},
+	}
+	dbs := []*cluster.DB{}
+	for _, uid := range []string{"db2", "db3", "db4", "db5"} {
+		cd.DBs[uid] = &cluster.DB{UID: uid, Spec: &cluster.DBSpec{}}
+		dbs = append(dbs, cd.DBs[uid])
+	}
+	cd.DBs["db3"].Status.LogicalReplicationSlots = slots
+	cd.DBs["db5"].Status.LogicalReplicationSlots = slots
+	// only one of the slots
+	cd.DBs["db4"].Status.LogicalReplicationSlots = slots[:1]
+
+	out := []string{}
+	for _, db := range preferLogicalReplSlotsSynced(cd, dbs) {
+		out = append(out, db.UID)
+	}
+	if expected := []string{"db3", "db5", "db2", "db4"}; !reflect.DeepEqual(out, expected) {
+		t.Errorf("wrong dbs: got: %v, want: %v", out, expected)
+	}
+
+	// without logical replication slots the order is kept
+	cd.Cluster.Spec.LogicalReplicationSlots = nil
+	out = []string{}
+	for _, db := range preferLogicalReplSlotsSynced(cd, dbs) {
+		out = append(out, db.UID)
+	}
+	if expected := []string{"db2", "db3", "db4", "db5"}; !reflect.DeepEqual(out, expected) {
+		t.Errorf("wrong dbs: got: %v, want: %v", out, expected)
+	}
+}
+
+func TestCascadingFollowedDB(t *testing.T) {
+	newCD := func(cascadingStandbys map[string]string, synchronousStandbys []string) *cluster.ClusterData {
+		cd := &cluster.ClusterData{
+			Cluster: &cluster.Cluster{
+				Spec: &cluster.ClusterSpec{
+					CascadingStandbys: cascadingStandbys,
+				},
+				Status: cluster.ClusterStatus{
+					Master: "db1",
+				},
+			},
+			Keepers: cluster.Keepers{},
+			DBs:     cluster.DBs{},
+		}
+		for i := 1; i <= 5; i++ {
+			uid := fmt.Sprintf("db%d", i)
+			keeperUID := fmt.Sprintf("keeper%d", i)
+			cd.Keepers[keeperUID] = &cluster.Keeper{UID: keeperUID, Spec: &cluster.KeeperSpec{}, Status: cluster.KeeperStatus{Healthy: true}}
+			cd.DBs[uid] = &cluster.DB{
+				UID:        uid,
+				Generation: 1,
+				Spec: &cluster.DBSpec{
+					KeeperUID:    keeperUID,
+					Role:         common.RoleStandby,
+					FollowConfig: &cluster.FollowConfig{Type: cluster.FollowTypeInternal, DBUID: "db1"},
+				},
+				Status: cluster.DBStatus{Healthy: true, CurrentGeneration: 1},
+			}
+		}
+		cd.DBs["db1"].Spec.Role = common.RoleMaster
+		cd.DBs["db1"].Spec.FollowConfig = nil
+		cd.DBs["db1"].Spec.SynchronousStandbys = synchronousStandbys
+		// keeper4 is failed and keeper5 is a delayed standby
+		cd.Keepers["keeper4"].Status.Healthy = false
+		cd.Keepers["keeper5"].Spec.RecoveryMinApplyDelay = &cluster.Duration{Duration: time.Hour}
+		return cd
+	}
+
+	tests := []struct {
+		cascadingStandbys   map[string]string
+		synchronousStandbys []string
+		drained             []string
+		maintenance         []string
+		out                 string
+	}{
+		{
+			out: "db1",
+		},
+		{
+			cascadingStandbys: map[string]string{"keeper3": "keeper2"},
+			out:               "db2",
+		},
+		{
+			cascadingStandbys: map[string]string{"keeper3": "keeper4"},
+			out:               "db1",
+		},
+		{
+			cascadingStandbys: map[string]string{"keeper3": "keeper5"},
+			out:               "db1",
+		},
+		{
+			cascadingStandbys: map[string]string{"keeper3": "keeper9"},
+			out:               "db1",
+		},
+		{
+			cascadingStandbys: map[string]string{"keeper3": "keeper1"},
+			out:               "db1",
+		},
+		// a synchronous standby keeps following the master
+		{
+			cascadingStandbys:   map[string]string{"keeper3": "keeper2"},
+			synchronousStandbys: []string{"db3"},
+			out:                 "db1",
+		},
+		// the db of a drained keeper isn't followed
+		{
+			cascadingStandbys: map[string]string{"keeper3": "keeper2"},
+			drained:           []string{"keeper2"},
+			out:               "db1",
+		},
+		// the db of a keeper in maintenance isn't followed
+		{
+			cascadingStandbys: map[string]string{"keeper3": "keeper2"},
+			maintenance:       []string{"keeper2"},
+			out:               "db1",
+		},
+	}
+
+	for i, tt := range tests {
+		s := &Sentinel{uid: "sentinel01"}
+		cd := newCD(tt.cascadingStandbys, tt.synchronousStandbys)
+		for _, keeperUID := range tt.drained {
+			cd.Keepers[keeperUID].Spec.Drained = true
+		}
+		for _, keeperUID := range tt.maintenance {
+			cd.Keepers[keeperUID].Spec.Maintenance = true
+		}
+		out := s.cascadingFollowedDB(cd, cd.DBs["db1"], cd.DBs["db3"])
+		if out.UID != tt.out {
+			t.Errorf("#%d: wrong followed db: got: %q, want: %q", i, out.UID, tt.out)
+		}
+	}
+}
+
+func TestIsSyncStandbyCandidate(t *testing.T) {
+	tests := []struct {
+		cascading   bool
+		delayed     bool
+		drained     bool
+		maintenance bool
+		out         bool
+	}{
+		{
+			out: true,
+		},
+		{
+			cascading: true,
+			out:       false,
+		},
+		{
+			delayed: true,
+			out:     false,
+		},
+		{
+			drained: true,
+			out:     false,
+		},
+		{
+			maintenance: true,
+			out:         false,
+		},
+	}
+
+	for i, tt := range tests {
+		cd := &cluster.ClusterData{
+			Cluster: &cluster.Cluster{
+				Spec: &cluster.ClusterSpec{},
+			},
+			Keepers: cluster.Keepers{
+				"keeper2": &cluster.Keeper{UID: "keeper2", Spec: &cluster.KeeperSpec{}},
+			},
+			DBs: cluster.DBs{
+				"db2": &cluster.DB{UID: "db2", Spec: &cluster.DBSpec{KeeperUID: "keeper2"}},
+			},
+		}
+		if tt.cascading {
+			cd.Cluster.Spec.CascadingStandbys = map[string]string{"keeper2": "keeper3"}
+		}
+		if tt.delayed {
+			cd.Keepers["keeper2"].Spec.RecoveryMinApplyDelay = &cluster.Duration{Duration: time.Hour}
+		}
+		if tt.drained {
+			cd.Keepers["keeper2"].Spec.Drained = true
+		}
+		if tt.maintenance {
+			cd.Keepers["keeper2"].Spec.Maintenance = true
+		}
+		if out := isSyncStandbyCandidate(cd, cd.DBs["db2"]); out != tt.out {
+			t.Errorf("#%d: got: %t, want: %t", i, out, tt.out)
+		}
+	}
+}
+
+func TestMaintenanceKeeper(t *testing.T) {
+	cd := &cluster.ClusterData{
+		Cluster: &cluster.Cluster{
+			Spec: &cluster.ClusterSpec{
+				ConvergenceTimeout: &cluster.Duration{Duration: cluster.DefaultConvergenceTimeout},
+			},
+		},
+		Keepers: cluster.Keepers{
+			"keeper1": &cluster.Keeper{UID: "keeper1", Spec: &cluster.KeeperSpec{Maintenance: true}},
+			"keeper2": &cluster.Keeper{UID: "keeper2", Spec: &cluster.KeeperSpec{}},
+			"keeper3": &cluster.Keeper{UID: "keeper3", Spec: &cluster.KeeperSpec{Maintenance: true}, Status: cluster.KeeperStatus{Healthy: true}},
+			"keeper4": &cluster.Keeper{UID: "keeper4", Spec: &cluster.KeeperSpec{}, Status: cluster.KeeperStatus{Healthy: true}},
+		},
+		DBs: cluster.DBs{
+			"db1": &cluster.DB{UID: "db1", Generation: 1, Spec: &cluster.DBSpec{KeeperUID: "keeper1"}},
+			"db2": &cluster.DB{UID: "db2", Generation: 1, Spec: &cluster.DBSpec{KeeperUID: "keeper2"}},
+		},
+	}
+	s := &Sentinel{uid: "sentinel01"}
+
+	// the db of the failed keeper in maintenance is kept good
+	if status := s.dbStatus(cd, "db1"); status != dbStatusGood {
+		t.Errorf("got db1 status: %d, want: %d", status, dbStatusGood)
+	}
+	if status := s.dbStatus(cd, "db2"); status != dbStatusFailed {
+		t.Errorf("got db2 status: %d, want: %d", status, dbStatusFailed)
+	}
+
+	// a free keeper in maintenance doesn't get a db assigned
+	out := []string{}
+	for _, k := range s.freeKeepers(cd) {
+		out = append(out, k.UID)
+	}
+	if expected := []string{"keeper4"}; !reflect.DeepEqual(out, expected) {
+		t.Errorf("wrong free keepers: got: %v, want: %v", out, expected)
+	}
+}
+
+func TestIsVerifyingChecksums(t *testing.T) {
+	tests := []struct {
+		verification *cluster.ChecksumsVerification
+		out          bool
+	}{
+		{
+			out: false,
+		},
+		{
+			verification: &cluster.ChecksumsVerification{DBUID: "db1", StartTime: time.Now().Add(-time.Hour), EndTime: time.Now()},
+			out:          false,
+		},
+		{
+			verification: &cluster.ChecksumsVerification{DBUID: "db1", Running: true, StartTime: time.Now().Add(-time.Minute)},
+			out:          true,
+		},
+		// running for more than the timeout
+		{
+			verification: &cluster.ChecksumsVerification{DBUID: "db1", Running: true, StartTime: time.Now().Add(-2 * time.Hour)},
+			out:          false,
+		},
+	}
+
+	for i, tt := range tests {
+		cd := &cluster.ClusterData{
+			Cluster: &cluster.Cluster{
+				Spec: &cluster.ClusterSpec{
+					FailInterval:                &cluster.Duration{Duration: cluster.DefaultFailInterval},
+					ConvergenceTimeout:          &cluster.Duration{Duration: cluster.DefaultConvergenceTimeout},
+					ChecksumsVerificationConfig: &cluster.ChecksumsVerificationConfig{Interval: &cluster.Duration{Duration: 24 * time.Hour}},
+				},
+			},
+			Keepers: cluster.Keepers{
+				"keeper1": &cluster.Keeper{UID: "keeper1", Spec: &cluster.KeeperSpec{}, Status: cluster.KeeperStatus{Healthy: true}},
+			},
+			DBs: cluster.DBs{
+				"db1": &cluster.DB{UID: "db1", Generation: 1, Spec: &cluster.DBSpec{KeeperUID: "keeper1"}, Status: cluster.DBStatus{CurrentGeneration: 1, ChecksumsVerification: tt.verification}},
+			},
+		}
+		if out := isVerifyingChecksums(cd, cd.DBs["db1"]); out != tt.out {
+			t.Errorf("#%d: got: %t, want: %t", i, out, tt.out)
+		}
+		// the stopped db being verified is converging, not failed
+		s := &Sentinel{uid: "sentinel01"}
+		status := s.dbStatus(cd, "db1")
+		if expected := dbStatusFailed; !tt.out && status != expected {
+			t.Errorf("#%d: got db status: %d, want: %d", i, status, expected)
+		}
+		if expected := dbStatusConverging; tt.out && status != expected {
+			t.Errorf("#%d: got db status: %d, want: %d", i, status, expected)
+		}
+	}
+}
+
+func TestKeeperPGParameters(t *testing.T) {
+	pgParameters := cluster.PGParameters{"shared_buffers": "8GB", "work_mem": "16MB"}
+	tests := []struct {
+		keeperUID string
+		overrides cluster.PGParameters
+		out       cluster.PGParameters
+	}{
+		{
+			keeperUID: "keeper1",
+			out:       cluster.PGParameters{"shared_buffers": "8GB", "work_mem": "16MB"},
+		},
+		{
+			keeperUID: "keeper1",
+			overrides: cluster.PGParameters{"shared_buffers": "1GB", "effective_cache_size": "3GB"},
+			out:       cluster.PGParameters{"shared_buffers": "1GB", "work_mem": "16MB", "effective_cache_size": "3GB"},
+		},
+		// not existing keeper
+		{
+			keeperUID: "keeper9",
+			overrides: cluster.PGParameters{"shared_buffers": "1GB"},
+			out:       cluster.PGParameters{"shared_buffers": "8GB", "work_mem": "16MB"},
+		},
+	}
+
+	for i, tt := range tests {
+		cd := &cluster.ClusterData{
+			Keepers: cluster.Keepers{
+				"keeper1": &cluster.Keeper{UID: "keeper1", Spec: &cluster.KeeperSpec{PGParameters: tt.overrides}},
+			},
+		}
+		out := keeperPGParameters(cd, tt.keeperUID, pgParameters)
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: got: %v, want: %v", i, out, tt.out)
+		}
+	}
+	// the cluster spec parameters aren't changed
+	if expected := (cluster.PGParameters{"shared_buffers": "8GB", "work_mem": "16MB"}); !reflect.DeepEqual(pgParameters, expected) {
+		t.Errorf("cluster spec parameters changed: got: %v, want: %v", pgParameters, expected)
+	}
+}
+
+func TestClearDropReplicationSlots(t *testing.T) {
+	tests := []struct {
+		generation        int64
+		currentGeneration int64
+		slots             []string
+		out               []string
+	}{
+		{
+			generation:        2,
+			currentGeneration: 2,
+		},
+		// request not yet applied by the keeper
+		{
+			generation:        3,
+			currentGeneration: 2,
+			slots:             []string{"slot1"},
+			out:               []string{"slot1"},
+		},
+		{
+			generation:        3,
+			currentGeneration: 3,
+			slots:             []string{"slot1", "slot2"},
+		},
+	}
+
+	for i, tt := range tests {
+		cd := &cluster.ClusterData{
+			DBs: cluster.DBs{
+				"db1": &cluster.DB{
+					UID:        "db1",
+					Generation: tt.generation,
+					Spec:       &cluster.DBSpec{DropReplicationSlots: tt.slots},
+					Status:     cluster.DBStatus{CurrentGeneration: tt.currentGeneration},
+				},
+			},
+		}
+		s := &Sentinel{}
+		s.clearDropReplicationSlots(cd)
+		if out := cd.DBs["db1"].Spec.DropReplicationSlots; !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: wrong drop replication slots: got: %v, want: %v", i, out, tt.out)
+		}
+	}
+}
+
+func TestUpdateKeepersStatusFenced(t *testing.T) {
+	for i, fenced := range []bool{false, true} {
+		cd := &cluster.ClusterData{
+			Cluster: &cluster.Cluster{
+				UID:  "cluster1",
+				Spec: &cluster.ClusterSpec{},
+			},
+			Keepers: cluster.Keepers{
+				"keeper1": &cluster.Keeper{
+					UID:    "keeper1",
+					Spec:   &cluster.KeeperSpec{},
+					Status: cluster.KeeperStatus{Healthy: true},
+				},
+			},
+			DBs: cluster.DBs{
+				"db1": &cluster.DB{
+					UID:  "db1",
+					Spec: &cluster.DBSpec{KeeperUID: "keeper1", Role: common.RoleMaster},
+				},
+			},
+		}
+		keepersInfo := cluster.KeepersInfo{
+			"keeper1": &cluster.KeeperInfo{
+				InfoUID:    "info1",
+				UID:        "keeper1",
+				ClusterUID: "cluster1",
+				PostgresState: &cluster.PostgresState{
+					UID:     "db1",
+					Healthy: true,
+				},
+				Fenced: fenced,
+			},
+		}
+
+		s := &Sentinel{
+			uid:                    "sentinel01",
+			keeperErrorTimers:      make(map[string]int64),
+			dbErrorTimers:          make(map[string]int64),
+			dbNotIncreasingXLogPos: make(map[string]int64),
+			keeperInfoHistories:    make(KeeperInfoHistories),
+		}
+
+		// a fenced keeper is immediately considered failed
+		outcd, _ := s.updateKeepersStatus(cd, keepersInfo, false)
+		k := outcd.Keepers["keeper1"]
+		if k.Status.Fenced != fenced {
+			t.Errorf("#%d: got fenced: %t, want: %t", i, k.Status.Fenced, fenced)
+		}
+		if k.Status.Healthy == fenced {
+			t.Errorf("#%d: got keeper healthy: %t, want: %t", i, k.Status.Healthy, !fenced)
+		}
+		if outcd.DBs["db1"].Status.Healthy == fenced {
+			t.Errorf("#%d: got db healthy: %t, want: %t", i, outcd.DBs["db1"].Status.Healthy, !fenced)
+		}
+	}
+}
+
+func TestUpdateKeepersStatusListenAddresses(t *testing.T) {
+	tests := []struct {
+		family     cluster.AddressFamily
+		additional []string
+		address    string
+		addresses  []string
+	}{
+		{
+			family:  cluster.AddressFamilyIPv6,
+			address: "192.168.0.1",
+		},
+		{
+			family:     cluster.AddressFamilyAny,
+			additional: []string{"fd00::1"},
+			address:    "192.168.0.1",
+			addresses:  []string{"192.168.0.1", "fd00::1"},
+		},
+		{
+			family:     cluster.AddressFamilyIPv6,
+			additional: []string{"192.168.0.1", "fd00::1"},
+			address:    "fd00::1",
+			addresses:  []string{"192.168.0.1", "fd00::1"},
+		},
+	}
+
+	for i, tt := range tests {
+		cd := &cluster.ClusterData{
+			Cluster: &cluster.Cluster{
+				UID:  "cluster1",
+				Spec: &cluster.ClusterSpec{PreferredAddressFamily: cluster.AddressFamilyP(tt.family)},
+			},
+			Keepers: cluster.Keepers{
+				"keeper1": &cluster.Keeper{
+					UID:    "keeper1",
+					Spec:   &cluster.KeeperSpec{},
+					Status: cluster.KeeperStatus{Healthy: true},
+				},
+			},
+			DBs: cluster.DBs{
+				"db1": &cluster.DB{
+					UID:  "db1",
+					Spec: &cluster.DBSpec{KeeperUID: "keeper1", Role: common.RoleMaster},
+				},
+			},
+		}
+		keepersInfo := cluster.KeepersInfo{
+			"keeper1": &cluster.KeeperInfo{
+				InfoUID:    "info1",
+				UID:        "keeper1",
+				ClusterUID: "cluster1",
+				PostgresState: &cluster.PostgresState{
+					UID:                       "db1",
+					Healthy:                   true,
+					ListenAddress:             "192.168.0.1",
+					AdditionalListenAddresses: tt.additional,
+					Port:                      "5432",
+				},
+			},
+		}
+
+		s := &Sentinel{
+			uid:                    "sentinel01",
+			keeperErrorTimers:      make(map[string]int64),
+			dbErrorTimers:          make(map[string]int64),
+			dbNotIncreasingXLogPos: make(map[string]int64),
+			keeperInfoHistories:    make(KeeperInfoHistories),
+		}
+
+		outcd, _ := s.updateKeepersStatus(cd, keepersInfo, false)
+		status := outcd.DBs["db1"].Status
+		if status.ListenAddress != tt.address {
+			t.Errorf("#%d: got listen address: %q, want: %q", i, status.ListenAddress, tt.address)
+		}
+		if !reflect.DeepEqual(status.ListenAddresses, tt.addresses) {
+			t.Errorf("#%d: got listen addresses: %v, want: %v", i, status.ListenAddresses, tt.addresses)
+		}
+	}
+}
+
+func TestHandleSwitchover(t *testing.T) {
+	newCD := func(sw *cluster.Switchover) *cluster.ClusterData {
+		cd := &cluster.ClusterData{
+			Cluster: &cluster.Cluster{
+				Spec: &cluster.ClusterSpec{},
+				Status: cluster.ClusterStatus{
+					Phase:      cluster.ClusterPhaseNormal,
+					Master:     "db1",
+					Switchover: sw,
+				},
+			},
+			Keepers: cluster.Keepers{},
+			DBs:     cluster.DBs{},
+			Proxy: &cluster.Proxy{
+				Generation: 1,
+				Spec:       cluster.ProxySpec{MasterDBUID: "db1"},
+			},
+		}
+		for i := 1; i <= 2; i++ {
+			uid := fmt.Sprintf("db%d", i)
+			keeperUID := fmt.Sprintf("keeper%d", i)
+			cd.Keepers[keeperUID] = &cluster.Keeper{UID: keeperUID, Spec: &cluster.KeeperSpec{}, Status: cluster.KeeperStatus{Healthy: true}}
+			cd.DBs[uid] = &cluster.DB{
+				UID:        uid,
+				Generation: 1,
+				Spec: &cluster.DBSpec{
+					KeeperUID:    keeperUID,
+					Role:         common.RoleStandby,
+					FollowConfig: &cluster.FollowConfig{Type: cluster.FollowTypeInternal, DBUID: "db1"},
+				},
+				Status: cluster.DBStatus{Healthy: true, CurrentGeneration: 1, XLogPos: 1000},
+			}
+		}
+		cd.DBs["db1"].Spec.Role = common.RoleMaster
+		cd.DBs["db1"].Spec.FollowConfig = nil
+		return cd
+	}
+
+	tests := []struct {
+		sw              *cluster.Switchover
+		masterOK        bool
+		standbyXLogPos  uint64
+		proxyGeneration int64
+		// cluster spec graceful demotion and master db drain status
+		gracefulDemotion *cluster.GracefulDemotion
+		demotionStatus   *cluster.GracefulDemotionStatus
+		out              string
+		outPhase         cluster.SwitchoverPhase
+		outProxyMaster   string
+		outDemotion      *cluster.GracefulDemotionRequest
+	}{
+		// the switchover starts pausing the proxies
+		{
+			sw:              &cluster.Switchover{TargetKeeper: "keeper2", Phase: cluster.SwitchoverPhaseRequested},
+			masterOK:        true,
+			standbyXLogPos:  1000,
+			proxyGeneration: 1,
+			outPhase:        cluster.SwitchoverPhasePausingProxies,
+		},
+		// proxies not yet paused
+		{
+			sw:              &cluster.Switchover{TargetKeeper: "keeper2", Phase: cluster.SwitchoverPhasePausingProxies, StartTime: time.Now()},
+			masterOK:        true,
+			standbyXLogPos:  1000,
+			proxyGeneration: 0,
+			outPhase:        cluster.SwitchoverPhasePausingProxies,
+			outProxyMaster:  "db1",
+		},
+		{
+			sw:              &cluster.Switchover{TargetKeeper: "keeper2", Phase: cluster.SwitchoverPhasePausingProxies, StartTime: time.Now()},
+			masterOK:        true,
+			standbyXLogPos:  1000,
+			proxyGeneration: 1,
+			outPhase:        cluster.SwitchoverPhaseCatchingUp,
+			outProxyMaster:  "db1",
+		},
+		// the target db hasn't caught up with the master
+		{
+			sw:              &cluster.Switchover{TargetKeeper: "keeper2", Phase: cluster.SwitchoverPhaseCatchingUp, StartTime: time.Now()},
+			masterOK:        true,
+			standbyXLogPos:  900,
+			proxyGeneration: 1,
+			outPhase:        cluster.SwitchoverPhaseCatchingUp,
+			outProxyMaster:  "db1",
+		},
+		{
+			sw:              &cluster.Switchover{TargetKeeper: "keeper2", Phase: cluster.SwitchoverPhaseCatchingUp, StartTime: time.Now()},
+			masterOK:        true,
+			standbyXLogPos:  1000,
+			proxyGeneration: 1,
+			out:             "db2",
+			outProxyMaster:  "db1",
+		},
+		// timeout expired
+		{
+			sw:              &cluster.Switchover{TargetKeeper: "keeper2", Phase: cluster.SwitchoverPhaseCatchingUp, StartTime: time.Now().Add(-2 * cluster.DefaultSwitchoverTimeout)},
+			masterOK:        true,
+			standbyXLogPos:  900,
+			proxyGeneration: 1,
+			outProxyMaster:  "db1",
+		},
+		// master failed
+		{
+			sw:              &cluster.Switchover{TargetKeeper: "keeper2", Phase: cluster.SwitchoverPhaseCatchingUp, StartTime: time.Now()},
+			standbyXLogPos:  1000,
+			proxyGeneration: 1,
+			outProxyMaster:  "db1",
+		},
+		// not existing target keeper
+		{
+			sw:              &cluster.Switchover{TargetKeeper: "keeper3", Phase: cluster.SwitchoverPhaseRequested},
+			masterOK:        true,
+			standbyXLogPos:  1000,
+			proxyGeneration: 1,
+			outProxyMaster:  "db1",
+		},
+		// the target db has caught up, the master drain is requested
+		{
+			sw:               &cluster.Switchover{TargetKeeper: "keeper2", Phase: cluster.SwitchoverPhaseCatchingUp, StartTime: time.Now()},
+			masterOK:         true,
+			standbyXLogPos:   1000,
+			proxyGeneration:  1,
+			gracefulDemotion: &cluster.GracefulDemotion{RejectConnections: true},
+			outPhase:         cluster.SwitchoverPhaseDemotingMaster,
+			outProxyMaster:   "db1",
+			outDemotion:      &cluster.GracefulDemotionRequest{TargetDBUID: "db2", RejectConnections: true, DrainTimeout: cluster.Duration{Duration: cluster.DefaultDemotionDrainTimeout}},
+		},
+		// the master drain isn't completed
+		{
+			sw:               &cluster.Switchover{TargetKeeper: "keeper2", Phase: cluster.SwitchoverPhaseDemotingMaster, StartTime: time.Now()},
+			masterOK:         true,
+			standbyXLogPos:   1000,
+			proxyGeneration:  1,
+			gracefulDemotion: &cluster.GracefulDemotion{},
+			demotionStatus:   &cluster.GracefulDemotionStatus{DBUID: "db1", TargetDBUID: "db2", LSN: 1100},
+			outPhase:         cluster.SwitchoverPhaseDemotingMaster,
+			outProxyMaster:   "db1",
+		},
+		// the master drain has been completed for another target
+		{
+			sw:               &cluster.Switchover{TargetKeeper: "keeper2", Phase: cluster.SwitchoverPhaseDemotingMaster, StartTime: time.Now()},
+			masterOK:         true,
+			standbyXLogPos:   1000,
+			proxyGeneration:  1,
+			gracefulDemotion: &cluster.GracefulDemotion{},
+			demotionStatus:   &cluster.GracefulDemotionStatus{DBUID: "db1", TargetDBUID: "db3", LSN: 1100, Completed: true},
+			outPhase:         cluster.SwitchoverPhaseDemotingMaster,
+			outProxyMaster:   "db1",
+		},
+		{
+			sw:               &cluster.Switchover{TargetKeeper: "keeper2", Phase: cluster.SwitchoverPhaseDemotingMaster, StartTime: time.Now()},
+			masterOK:         true,
+			standbyXLogPos:   1000,
+			proxyGeneration:  1,
+			gracefulDemotion: &cluster.GracefulDemotion{},
+			demotionStatus:   &cluster.GracefulDemotionStatus{DBUID: "db1", TargetDBUID: "db2", LSN: 1100, Completed: true},
+			out:              "db2",
+			outProxyMaster:   "db1",
+		},
+		// the master drain didn't complete before the switchover timeout
+		{
+			sw:               &cluster.Switchover{TargetKeeper: "keeper2", Phase: cluster.SwitchoverPhaseDemotingMaster, StartTime: time.Now().Add(-2 * cluster.DefaultSwitchoverTimeout)},
+			masterOK:         true,
+			standbyXLogPos:   1000,
+			proxyGeneration:  1,
+			gracefulDemotion: &cluster.GracefulDemotion{},
+			demotionStatus:   &cluster.GracefulDemotionStatus{DBUID: "db1", TargetDBUID: "db2", LSN: 1100},
+			outProxyMaster:   "db1",
+		},
+	}
+
+	for i, tt := range tests {
+		s := &Sentinel{uid: "sentinel01"}
+		cd := newCD(tt.sw)
+		cd.Cluster.Spec.GracefulDemotion = tt.gracefulDemotion
+		cd.DBs["db2"].Status.XLogPos = tt.standbyXLogPos
+		cd.DBs["db1"].Status.GracefulDemotion = tt.demotionStatus
+		pis := cluster.ProxiesInfo{
+			"proxy1": &cluster.ProxyInfo{UID: "proxy1", Generation: tt.proxyGeneration},
+		}
+		out := s.handleSwitchover(cd, cd.DBs["db1"], tt.masterOK, pis)
+		outUID := ""
+		if out != nil {
+			outUID = out.UID
+		}
+		if outUID != tt.out {
+			t.Errorf("#%d: wrong new master db: got: %q, want: %q", i, outUID, tt.out)
+		}
+		var outPhase cluster.SwitchoverPhase
+		if sw := cd.Cluster.Status.Switchover; sw != nil {
+			outPhase = sw.Phase
+		}
+		if outPhase != tt.outPhase {
+			t.Errorf("#%d: wrong switchover phase: got: %q, want: %q", i, outPhase, tt.outPhase)
+		}
+		if cd.Proxy.Spec.MasterDBUID != tt.outProxyMaster {
+			t.Errorf("#%d: wrong proxy master db: got: %q, want: %q", i, cd.Proxy.Spec.MasterDBUID, tt.outProxyMaster)
+		}
+		if !reflect.DeepEqual(cd.DBs["db1"].Spec.GracefulDemotion, tt.outDemotion) {
+			t.Errorf("#%d: wrong master db graceful demotion: got: %+v, want: %+v", i, cd.DBs["db1"].Spec.GracefulDemotion, tt.outDemotion)
+		}
+	}
+}
+
+func TestClearGracefulDemotion(t *testing.T) {
+	tests := []struct {
+		name       string
+		master     string
+		switchover *cluster.Switchover
+		out        bool
+	}{
+		{
+			name:       "switchover in progress",
+			master:     "db1",
+			switchover: &cluster.Switchover{TargetKeeper: "keeper2", Phase: cluster.SwitchoverPhaseDemotingMaster},
+			out:        true,
+		},
+		{
+			name:   "switchover aborted",
+			master: "db1",
+		},
+		{
+			name:       "new master elected",
+			master:     "db2",
+			switchover: &cluster.Switchover{TargetKeeper: "keeper2", Phase: cluster.SwitchoverPhaseDemotingMaster},
+		},
+	}
+
+	for i, tt := range tests {
+		s := &Sentinel{uid: "sentinel01"}
+		cd := testRollingRestartClusterData(1)
+		cd.Cluster.Status.Master = tt.master
+		cd.Cluster.Status.Switchover = tt.switchover
+		cd.DBs["db1"].Spec.GracefulDemotion = &cluster.GracefulDemotionRequest{TargetDBUID: "db2"}
+		s.clearGracefulDemotion(cd)
+		if out := cd.DBs["db1"].Spec.GracefulDemotion != nil; out != tt.out {
+			t.Errorf("#%d (%s): got graceful demotion request: %t, want: %t", i, tt.name, out, tt.out)
+		}
+	}
+}
+
+func TestAutomaticFailoverAllowed(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		cooldown     time.Duration
+		maxFailovers uint16
+		failovers    []time.Time
+		halted       bool
+		allowed      bool
+		outHalted    bool
+	}{
+		// no limits
+		{
+			failovers: []time.Time{now.Add(-time.Second), now.Add(-time.Second)},
+			allowed:   true,
+		},
+		{
+			cooldown:  10 * time.Minute,
+			failovers: []time.Time{now.Add(-20 * time.Minute), now.Add(-5 * time.Minute)},
+			allowed:   false,
+		},
+		{
+			cooldown:  10 * time.Minute,
+			failovers: []time.Time{now.Add(-20 * time.Minute)},
+			allowed:   true,
+		},
+		// two failovers in the default one hour window
+		{
+			maxFailovers: 3,
+			failovers:    []time.Time{now.Add(-2 * time.Hour), now.Add(-30 * time.Minute), now.Add(-10 * time.Minute)},
+			allowed:      true,
+		},
+		{
+			maxFailovers: 3,
+			failovers:    []time.Time{now.Add(-50 * time.Minute), now.Add(-30 * time.Minute), now.Add(-10 * time.Minute)},
+			allowed:      false,
+			outHalted:    true,
+		},
+		{
+			halted:    true,
+			allowed:   false,
+			outHalted: true,
+		},
+	}
+
+	for i, tt := range tests {
+		cd := &cluster.ClusterData{
+			Cluster: &cluster.Cluster{
+				Spec: &cluster.ClusterSpec{
+					FailoverCooldown: &cluster.Duration{Duration: tt.cooldown},
+					MaxFailovers:     cluster.Uint16P(tt.maxFailovers),
+				},
+				Status: cluster.ClusterStatus{
+					AutomaticFailovers: tt.failovers,
+					FailoversHalted:    tt.halted,
+				},
+			},
+		}
+		if allowed := automaticFailoverAllowed(cd, now); allowed != tt.allowed {
+			t.Errorf("#%d: got allowed: %t, want: %t", i, allowed, tt.allowed)
+		}
+		if cd.Cluster.Status.FailoversHalted != tt.outHalted {
+			t.Errorf("#%d: got halted: %t, want: %t", i, cd.Cluster.Status.FailoversHalted, tt.outHalted)
+		}
+	}
+}
+
+func TestRecordAutomaticFailover(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		cooldown     time.Duration
+		maxFailovers uint16
+		failovers    []time.Time
+		out          []time.Time
+	}{
+		// nothing recorded without limits
+		{
+			failovers: []time.Time{now.Add(-time.Minute)},
+		},
+		{
+			cooldown:  10 * time.Minute,
+			failovers: []time.Time{now.Add(-20 * time.Minute)},
+			out:       []time.Time{now.Add(-20 * time.Minute), now},
+		},
+		// the failovers older than the window are removed
+		{
+			maxFailovers: 3,
+			failovers:    []time.Time{now.Add(-2 * time.Hour), now.Add(-30 * time.Minute)},
+			out:          []time.Time{now.Add(-30 * time.Minute), now},
+		},
+		{
+			cooldown:     2 * time.Hour,
+			failovers:    []time.Time{now.Add(-3 * time.Hour), now.Add(-90 * time.Minute)},
+			maxFailovers: 3,
+			out:          []time.Time{now.Add(-90 * time.Minute), now},
+		},
+	}
+
+	for i, tt := range tests {
+		cd := &cluster.ClusterData{
+			Cluster: &cluster.Cluster{
+				Spec: &cluster.ClusterSpec{
+					FailoverCooldown: &cluster.Duration{Duration: tt.cooldown},
+					MaxFailovers:     cluster.Uint16P(tt.maxFailovers),
+				},
+				Status: cluster.ClusterStatus{
+					AutomaticFailovers: tt.failovers,
+				},
+			},
+		}
+		recordAutomaticFailover(cd, now)
+		if !reflect.DeepEqual(cd.Cluster.Status.AutomaticFailovers, tt.out) {
+			t.Errorf("#%d: got failovers: %v, want: %v", i, cd.Cluster.Status.AutomaticFailovers, tt.out)
+		}
+	}
+}
+
+func TestUpdateSyncReplMode(t *testing.T) {
+	now := time.Now()
+	since := now.Add(-time.Minute)
+	tests := []struct {
+		name         string
+		degradation  *cluster.SyncReplDegradation
+		status       *cluster.SyncReplDegradationStatus
+		insufficient bool
+		out          *cluster.SyncReplDegradationStatus
+	}{
+		{
+			name: "enough standbys",
+		},
+		{
+			name:         "not enough standbys, default block policy",
+			insufficient: true,
+			out:          &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeBlocking, Since: now},
+		},
+		{
+			name:         "block policy, acknowledged",
+			status:       &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeBlocking, Since: since, Acknowledged: true},
+			insufficient: true,
+			out:          &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeBlocking, Since: since, Acknowledged: true},
+		},
+		{
+			name:         "block policy, previously degraded",
+			status:       &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeDegraded, Since: since},
+			insufficient: true,
+			out:          &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeBlocking, Since: now},
+		},
+		{
+			name:         "degradeAfterGrace policy, grace period not expired",
+			degradation:  &cluster.SyncReplDegradation{Policy: cluster.SyncReplDegradationPolicyDegradeAfterGrace, GracePeriod: &cluster.Duration{Duration: 2 * time.Minute}},
+			status:       &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeBlocking, Since: since},
+			insufficient: true,
+			out:          &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeBlocking, Since: since},
+		},
+		{
+			name:         "degradeAfterGrace policy, grace period expired",
+			degradation:  &cluster.SyncReplDegradation{Policy: cluster.SyncReplDegradationPolicyDegradeAfterGrace},
+			status:       &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeBlocking, Since: since},
+			insufficient: true,
+			out:          &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeDegraded, Since: now},
+		},
+		{
+			name:         "degradeAfterGrace policy, acknowledged",
+			degradation:  &cluster.SyncReplDegradation{Policy: cluster.SyncReplDegradationPolicyDegradeAfterGrace, GracePeriod: &cluster.Duration{Duration: 2 * time.Minute}},
+			status:       &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeBlocking, Since: since, Acknowledged: true},
+			insufficient: true,
+			out:          &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeDegraded, Since: now},
+		},
+		{
+			name:         "degradeOnAck policy, not acknowledged",
+			degradation:  &cluster.SyncReplDegradation{Policy: cluster.SyncReplDegradationPolicyDegradeOnAck},
+			insufficient: true,
+			out:          &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeBlocking, Since: now},
+		},
+		{
+			name:         "degradeOnAck policy, acknowledged",
+			degradation:  &cluster.SyncReplDegradation{Policy: cluster.SyncReplDegradationPolicyDegradeOnAck},
+			status:       &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeBlocking, Since: since, Acknowledged: true},
+			insufficient: true,
+			out:          &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeDegraded, Since: now},
+		},
+		{
+			name:         "degradeOnAck policy, already degraded",
+			degradation:  &cluster.SyncReplDegradation{Policy: cluster.SyncReplDegradationPolicyDegradeOnAck},
+			status:       &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeDegraded, Since: since},
+			insufficient: true,
+			out:          &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeDegraded, Since: since},
+		},
+		{
+			name:        "degraded, enough standbys again",
+			degradation: &cluster.SyncReplDegradation{Policy: cluster.SyncReplDegradationPolicyDegradeOnAck},
+			status:      &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeDegraded, Since: since},
+		},
+	}
+
+	for i, tt := range tests {
+		cd := &cluster.ClusterData{
+			Cluster: &cluster.Cluster{
+				Spec:   &cluster.ClusterSpec{SyncReplDegradation: tt.degradation},
+				Status: cluster.ClusterStatus{SyncReplDegradation: tt.status},
+			},
+		}
+		mode := updateSyncReplMode(cd, tt.insufficient, now)
+		if !reflect.DeepEqual(cd.Cluster.Status.SyncReplDegradation, tt.out) {
+			t.Errorf("#%d (%s): got status: %+v, want: %+v", i, tt.name, cd.Cluster.Status.SyncReplDegradation, tt.out)
+		}
+		outMode := cluster.SyncReplModeSync
+		if tt.out != nil {
+			outMode = tt.out.Mode
+		}
+		if mode != outMode {
+			t.Errorf("#%d (%s): got mode: %s, want: %s", i, tt.name, mode, outMode)
+		}
+	}
+}
+
+func TestSentinelCollector(t *testing.T) {
+	cd := &cluster.ClusterData{
+		Cluster: &cluster.Cluster{
+			Spec:   &cluster.ClusterSpec{SynchronousReplication: cluster.BoolP(true)},
+			Status: cluster.ClusterStatus{Master: "db1"},
+		},
+		Keepers: cluster.Keepers{
+			"keeper1": &cluster.Keeper{UID: "keeper1", Status: cluster.KeeperStatus{Healthy: true}},
+			"keeper2": &cluster.Keeper{UID: "keeper2", Status: cluster.KeeperStatus{Healthy: true}},
+			"keeper3": &cluster.Keeper{UID: "keeper3"},
+		},
+		DBs: cluster.DBs{
+			"db1": &cluster.DB{UID: "db1", Generation: 3, Spec: &cluster.DBSpec{KeeperUID: "keeper1"}},
+		},
+		Proxy: &cluster.Proxy{Generation: 2},
+	}
+	newcd := cd.DeepCopy()
+	newcd.Cluster.Status.Master = "db2"
+	newcd.DBs["db2"] = &cluster.DB{UID: "db2", Generation: 1, Spec: &cluster.DBSpec{KeeperUID: "keeper2"}}
+	newcd.Keepers["keeper1"].Status.Healthy = false
+	newcd.Cluster.Status.SyncReplDegradation = &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeBlocking}
+
+	s := &Sentinel{leader: true}
+	s.recordCDUpdate(cd, cd, electionDecisionNoEligibleMaster)
+	s.recordCDUpdate(cd, newcd, electionDecisionFailover)
+
+	sc := newSentinelCollector(s)
+	sc.nowFn = func() time.Time { return s.metrics.lastCDUpdate.Add(5 * time.Second) }
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(sc)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	values := map[string]float64{}
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			name := mf.GetName()
+			for _, l := range m.Label {
+				name += fmt.Sprintf("{%s=%s}", l.GetName(), l.GetValue())
+			}
+			switch {
+			case m.Gauge != nil:
+				values[name] = m.Gauge.GetValue()
+			case m.Counter != nil:
+				values[name] = m.Counter.GetValue()
+			}
+		}
+	}
+
+	expected := map[string]float64{
+		"stolon_sentinel_leader":                                                               1,
+		"stolon_sentinel_cluster_data_last_update_seconds":                                     5,
+		"stolon_sentinel_failovers_total":                                                      1,
+		"stolon_sentinel_master_election_decisions_total{decision=failover}":                   1,
+		"stolon_sentinel_master_election_decisions_total{decision=failover_target}":            0,
+		"stolon_sentinel_master_election_decisions_total{decision=switchover}":                 0,
+		"stolon_sentinel_master_election_decisions_total{decision=no_eligible_master}":         1,
+		"stolon_sentinel_master_election_decisions_total{decision=fencing_failed}":             0,
+		"stolon_sentinel_master_election_decisions_total{decision=no_failover_quorum}":         0,
+		"stolon_sentinel_keepers{state=healthy}":                                               1,
+		"stolon_sentinel_keepers{state=failed}":                                                2,
+		"stolon_sentinel_db_generation{db=db1}{keeper=keeper1}":                                3,
+		"stolon_sentinel_db_generation{db=db2}{keeper=keeper2}":                                1,
+		"stolon_sentinel_proxy_generation":                                                     2,
+		"stolon_sentinel_master_healthy":                                                       1,
+		"stolon_sentinel_dry_run":                                                              0,
+		"stolon_sentinel_dry_run_master_election_decisions_total{decision=failover}":           0,
+		"stolon_sentinel_dry_run_master_election_decisions_total{decision=failover_target}":    0,
+		"stolon_sentinel_dry_run_master_election_decisions_total{decision=switchover}":         0,
+		"stolon_sentinel_dry_run_master_election_decisions_total{decision=no_eligible_master}": 0,
+		"stolon_sentinel_dry_run_master_election_decisions_total{decision=fencing_failed}":     0,
+		"stolon_sentinel_dry_run_master_election_decisions_total{decision=no_failover_quorum}": 0,
+		"stolon_sentinel_sync_repl_mode{mode=sync}":                                            0,
+		"stolon_sentinel_sync_repl_mode{mode=blocking}":                                        1,
+		"stolon_sentinel_sync_repl_mode{mode=degraded}":                                        0,
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("got metrics: %v, want: %v", values, expected)
+	}
+}
+
+func TestClusterEvents(t *testing.T) {
+	cd := &cluster.ClusterData{
+		Cluster: &cluster.Cluster{
+			UID:    "cluster1",
+			Status: cluster.ClusterStatus{Master: "db1"},
+		},
+		Keepers: cluster.Keepers{
+			"keeper1": &cluster.Keeper{UID: "keeper1", Status: cluster.KeeperStatus{Healthy: true}},
+			"keeper2": &cluster.Keeper{UID: "keeper2", Status: cluster.KeeperStatus{Healthy: true}},
+			"keeper3": &cluster.Keeper{UID: "keeper3", Status: cluster.KeeperStatus{Healthy: true}},
+		},
+		DBs: cluster.DBs{
+			"db1": &cluster.DB{UID: "db1", Spec: &cluster.DBSpec{KeeperUID: "keeper1", SynchronousStandbys: []string{"db2"}}},
+			"db2": &cluster.DB{UID: "db2", Spec: &cluster.DBSpec{KeeperUID: "keeper2"}},
+			"db3": &cluster.DB{UID: "db3", Spec: &cluster.DBSpec{KeeperUID: "keeper3"}},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		newcd  func() *cluster.ClusterData
+		events []*cluster.Event
+	}{
+		{
+			name:   "no changes",
+			newcd:  func() *cluster.ClusterData { return cd.DeepCopy() },
+			events: []*cluster.Event{},
+		},
+		{
+			name: "master keeper failed",
+			newcd: func() *cluster.ClusterData {
+				newcd := cd.DeepCopy()
+				newcd.Keepers["keeper1"].Status.Healthy = false
+				return newcd
+			},
+			events: []*cluster.Event{
+				{Type: cluster.EventKeeperFailed, Time: now, ClusterUID: "cluster1", KeeperUID: "keeper1"},
+				{Type: cluster.EventClusterUnhealthy, Time: now, ClusterUID: "cluster1", DBUID: "db1"},
+			},
+		},
+		{
+			name: "new master elected",
+			newcd: func() *cluster.ClusterData {
+				newcd := cd.DeepCopy()
+				newcd.Keepers["keeper1"].Status.Healthy = false
+				newcd.Cluster.Status.Master = "db2"
+				newcd.DBs["db2"].Spec.SynchronousStandbys = []string{"db3"}
+				return newcd
+			},
+			events: []*cluster.Event{
+				{Type: cluster.EventMasterElected, Time: now, ClusterUID: "cluster1", DBUID: "db2", KeeperUID: "keeper2", PreviousMasterDBUID: "db1"},
+				{Type: cluster.EventKeeperFailed, Time: now, ClusterUID: "cluster1", KeeperUID: "keeper1"},
+			},
+		},
+		{
+			name: "synchronous standbys changed",
+			newcd: func() *cluster.ClusterData {
+				newcd := cd.DeepCopy()
+				newcd.Keepers["keeper2"].Status.Healthy = false
+				newcd.DBs["db1"].Spec.SynchronousStandbys = []string{"db3"}
+				return newcd
+			},
+			events: []*cluster.Event{
+				{Type: cluster.EventKeeperFailed, Time: now, ClusterUID: "cluster1", KeeperUID: "keeper2"},
+				{Type: cluster.EventSynchronousStandbysChanged, Time: now, ClusterUID: "cluster1", DBUID: "db1", KeeperUID: "keeper1", SynchronousStandbys: []string{"db3"}},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		events := clusterEvents(cd, tt.newcd(), now)
+		if !reflect.DeepEqual(events, tt.events) {
+			t.Errorf("#%d (%s): got events: %s, want: %s", i, tt.name, spew.Sdump(events), spew.Sdump(tt.events))
+		}
+	}
+
+	// the master becoming healthy again
+	unhealthycd := cd.DeepCopy()
+	unhealthycd.Keepers["keeper1"].Status.Healthy = false
+	events := clusterEvents(unhealthycd, cd, now)
+	expected := []*cluster.Event{
+		{Type: cluster.EventClusterHealthy, Time: now, ClusterUID: "cluster1", DBUID: "db1"},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("got events: %s, want: %s", spew.Sdump(events), spew.Sdump(expected))
+	}
+
+	// the standby cluster promoted to a primary cluster
+	standbycd := cd.DeepCopy()
+	standbycd.Cluster.Spec = &cluster.ClusterSpec{Role: cluster.ClusterRoleP(cluster.ClusterRoleStandby)}
+	promotedcd := cd.DeepCopy()
+	promotedcd.Cluster.Spec = &cluster.ClusterSpec{Role: cluster.ClusterRoleP(cluster.ClusterRoleMaster)}
+	events = clusterEvents(standbycd, promotedcd, now)
+	expected = []*cluster.Event{
+		{Type: cluster.EventStandbyClusterPromoted, Time: now, ClusterUID: "cluster1", DBUID: "db1", KeeperUID: "keeper1"},
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("got events: %s, want: %s", spew.Sdump(events), spew.Sdump(expected))
+	}
+}
+
+func TestNotifierSend(t *testing.T) {
+	var requests int32
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fail the first request to test the retry
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer ts.Close()
+
+	n := &notifier{urls: []string{ts.URL}, timeout: 5 * time.Second, retries: 1, retryInterval: time.Millisecond}
+	ev := &cluster.Event{Type: cluster.EventMasterElected, Time: now, ClusterUID: "cluster1", DBUID: "db1"}
+	n.send(context.Background(), ev)
+
+	if requests := atomic.LoadInt32(&requests); requests != 2 {
+		t.Fatalf("got %d requests, want: 2", requests)
+	}
+	var gotEv *cluster.Event
+	if err := json.Unmarshal(body, &gotEv); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if gotEv.Type != ev.Type || gotEv.DBUID != ev.DBUID || !gotEv.Time.Equal(ev.Time) {
+		t.Errorf("got event: %v, want: %v", gotEv, ev)
+	}
+
+	// all the requests fail
+	atomic.StoreInt32(&requests, 0)
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	n.retries = 2
+	n.send(context.Background(), ev)
+	if requests := atomic.LoadInt32(&requests); requests != 3 {
+		t.Errorf("got %d requests, want: 3", requests)
+	}
+}
+
+func TestFindFailoverTargetDB(t *testing.T) {
+	newCD := func() *cluster.ClusterData {
+		now := time.Now()
+		cd := &cluster.ClusterData{
+			Cluster: &cluster.Cluster{
+				UID:        "cluster1",
+				Generation: 1,
+				Spec: &cluster.ClusterSpec{
+					ConvergenceTimeout:   &cluster.Duration{Duration: cluster.DefaultConvergenceTimeout},
+					InitTimeout:          &cluster.Duration{Duration: cluster.DefaultInitTimeout},
+					SyncTimeout:          &cluster.Duration{Duration: cluster.DefaultSyncTimeout},
+					MaxStandbysPerSender: cluster.Uint16P(cluster.DefaultMaxStandbysPerSender),
+				},
+				Status: cluster.ClusterStatus{
+					CurrentGeneration: 1,
+					Phase:             cluster.ClusterPhaseNormal,
+					Master:            "db1",
+				},
+			},
+			Keepers: cluster.Keepers{},
+			DBs:     cluster.DBs{},
+		}
+		for i, role := range []common.Role{common.RoleMaster, common.RoleStandby} {
+			keeperUID := fmt.Sprintf("keeper%d", i+1)
+			dbUID := fmt.Sprintf("db%d", i+1)
+			cd.Keepers[keeperUID] = &cluster.Keeper{
+				UID:    keeperUID,
+				Spec:   &cluster.KeeperSpec{},
+				Status: cluster.KeeperStatus{Healthy: true, LastHealthyTime: now},
+			}
+			db := &cluster.DB{
+				UID:        dbUID,
+				Generation: 1,
+				Spec:       &cluster.DBSpec{KeeperUID: keeperUID, Role: role},
+				Status:     cluster.DBStatus{Healthy: true, CurrentGeneration: 1, XLogPos: 10 * cluster.DefaultMaxStandbyLag},
+			}
+			if role == common.RoleStandby {
+				db.Spec.FollowConfig = &cluster.FollowConfig{Type: cluster.FollowTypeInternal, DBUID: "db1"}
+			}
+			cd.DBs[dbUID] = db
+		}
+		return cd
+	}
+
+	tests := []struct {
+		name  string
+		lag   uint64
+		force bool
+		// target keeper postgres major version
+		maj int
+		out string
+	}{
+		{name: "lag below max", lag: 100, out: "db2"},
+		{name: "lag too big", lag: 5 * cluster.DefaultMaxStandbyLag, out: ""},
+		{name: "forced lag too big", lag: 5 * cluster.DefaultMaxStandbyLag, force: true, out: "db2"},
+		{name: "different postgres major version", lag: 100, maj: 13, out: ""},
+		{name: "forced different postgres major version", lag: 100, maj: 13, force: true, out: ""},
+	}
+
+	for i, tt := range tests {
+		s := &Sentinel{uid: "sentinel01", UIDFn: testUIDFn, RandFn: testRandFn, dbConvergenceInfos: make(map[string]*DBConvergenceInfo)}
+		cd := newCD()
+		cd.DBs["db2"].Status.XLogPos -= tt.lag
+		cd.Keepers["keeper1"].Status.PostgresBinaryVersion = cluster.PostgresBinaryVersion{Maj: 12, Min: 4}
+		cd.Keepers["keeper2"].Status.PostgresBinaryVersion = cluster.PostgresBinaryVersion{Maj: 12, Min: 6}
+		if tt.maj != 0 {
+			cd.Keepers["keeper2"].Status.PostgresBinaryVersion.Maj = tt.maj
+		}
+		out := ""
+		if db := s.findFailoverTargetDB(cd, cd.DBs["db1"], "keeper2", tt.force); db != nil {
+			out = db.UID
+		}
+		if out != tt.out {
+			t.Errorf("#%d (%s): got target db: %q, want: %q", i, tt.name, out, tt.out)
+		}
+	}
 }
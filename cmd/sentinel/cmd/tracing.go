@@ -0,0 +1,70 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/tracing"
+)
+
+// convergenceChanged reports if the new cluster data changes what the keepers
+// and the proxies converge to: the master, the dbs (their generations) or the
+// proxy generation.
+func convergenceChanged(cd, newcd *cluster.ClusterData) bool {
+	if cd.Cluster.Status.Master != newcd.Cluster.Status.Master {
+		return true
+	}
+	if cd.Proxy == nil || newcd.Proxy == nil {
+		return cd.Proxy != newcd.Proxy
+	}
+	if cd.Proxy.Generation != newcd.Proxy.Generation {
+		return true
+	}
+	if len(cd.DBs) != len(newcd.DBs) {
+		return true
+	}
+	for uid, db := range newcd.DBs {
+		if prevDB, ok := cd.DBs[uid]; !ok || prevDB.Generation != db.Generation {
+			return true
+		}
+	}
+	return false
+}
+
+// endCheckSpan ends the span of a sentinel check. Only the checks writing a
+// cluster data changing what the keepers and the proxies converge to are
+// logged, in the trace of the written cluster data proxy generation.
+func endCheckSpan(span *tracing.Span, cd, writtenCD *cluster.ClusterData, decision electionDecision) {
+	if span == nil {
+		return
+	}
+	if writtenCD == nil || !convergenceChanged(cd, writtenCD) {
+		span.Discard()
+		span.End()
+		return
+	}
+	var generation int64
+	if writtenCD.Proxy != nil {
+		generation = writtenCD.Proxy.Generation
+	}
+	span.SetTraceID(tracing.GenerationTraceID(writtenCD.Cluster.UID, generation))
+	span.SetAttributes(
+		tracing.String("stolon.cluster.uid", writtenCD.Cluster.UID),
+		tracing.Int64("stolon.proxy.generation", generation),
+		tracing.String("stolon.master.db", writtenCD.Cluster.Status.Master),
+		tracing.String("stolon.election.decision", string(decision)),
+	)
+	span.End()
+}
@@ -0,0 +1,77 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+func TestConvergenceChanged(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(cd *cluster.ClusterData)
+		changed bool
+	}{
+		{
+			name:   "no changes",
+			change: func(cd *cluster.ClusterData) {},
+		},
+		{
+			name: "keeper status changed",
+			change: func(cd *cluster.ClusterData) {
+				cd.Keepers["keeper2"].Status.Healthy = false
+			},
+		},
+		{
+			name: "master changed",
+			change: func(cd *cluster.ClusterData) {
+				cd.Cluster.Status.Master = "db2"
+			},
+			changed: true,
+		},
+		{
+			name: "db generation changed",
+			change: func(cd *cluster.ClusterData) {
+				cd.DBs["db2"].Generation++
+			},
+			changed: true,
+		},
+		{
+			name: "db removed",
+			change: func(cd *cluster.ClusterData) {
+				delete(cd.DBs, "db2")
+			},
+			changed: true,
+		},
+		{
+			name: "proxy generation changed",
+			change: func(cd *cluster.ClusterData) {
+				cd.Proxy.Generation++
+			},
+			changed: true,
+		},
+	}
+
+	for i, tt := range tests {
+		cd := testDryRunClusterData()
+		newcd := cd.DeepCopy()
+		tt.change(newcd)
+		if changed := convergenceChanged(cd, newcd); changed != tt.changed {
+			t.Errorf("#%d (%s): got changed: %t, want: %t", i, tt.name, changed, tt.changed)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	cmdcommon "github.com/sorintlab/stolon/cmd"
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+	"github.com/sorintlab/stolon/internal/util"
+
+	"github.com/spf13/cobra"
+)
+
+var canRemoveCmd = &cobra.Command{
+	Use:   "can-remove [keeper uid]",
+	Short: "Checks if a keeper can be removed without impacting the cluster health",
+	Run:   canRemove,
+}
+
+func init() {
+	CmdStolonCtl.AddCommand(canRemoveCmd)
+}
+
+func canRemove(cmd *cobra.Command, args []string) {
+	if len(args) > 1 {
+		die("too many arguments")
+	}
+
+	if len(args) == 0 {
+		die("keeper uid required")
+	}
+
+	keeperID := args[0]
+
+	store, err := cmdcommon.NewStore(&cfg.CommonConfig)
+	if err != nil {
+		die("%v", err)
+	}
+
+	cd, _, err := getClusterData(store)
+	if err != nil {
+		die("cannot get cluster data: %v", err)
+	}
+
+	if err := canRemoveKeeper(cd, keeperID); err != nil {
+		die("keeper %q cannot be safely removed: %v", keeperID, err)
+	}
+	stdout("keeper %q can be safely removed", keeperID)
+}
+
+// canRemoveKeeper checks if removing the provided keeper (and its db) will
+// leave the cluster healthy. It returns an error describing the reason when
+// it isn't safe to remove the keeper.
+func canRemoveKeeper(cd *cluster.ClusterData, keeperID string) error {
+	if cd.Cluster == nil || cd.Cluster.Spec == nil {
+		return fmt.Errorf("no cluster spec available")
+	}
+	if cd.Cluster.Status.Phase != cluster.ClusterPhaseNormal {
+		return fmt.Errorf("cluster is not in the %q phase", cluster.ClusterPhaseNormal)
+	}
+	if _, ok := cd.Keepers[keeperID]; !ok {
+		return fmt.Errorf("keeper doesn't exist")
+	}
+
+	keeperDb := getDbForKeeper(cd.DBs, keeperID)
+	if keeperDb == nil {
+		// no db assigned, nothing else to check
+		return nil
+	}
+
+	// don't take decisions while dbs are converging to a new spec since the
+	// current db statuses could not reflect the future cluster state
+	for _, db := range cd.DBs {
+		if db.Generation != db.Status.CurrentGeneration {
+			return fmt.Errorf("db %q of keeper %q is converging to a new spec", db.UID, db.Spec.KeeperUID)
+		}
+	}
+
+	masterUID := cd.Cluster.Status.Master
+	if masterUID == keeperDb.UID {
+		return fmt.Errorf("keeper assigned db is the current cluster master db")
+	}
+	masterDB, ok := cd.DBs[masterUID]
+	if !ok {
+		return fmt.Errorf("no master db available")
+	}
+
+	// the remaining healthy standbys following the master
+	healthyStandbys := []string{}
+	for _, db := range cd.DBs {
+		if db.UID == keeperDb.UID || db.UID == masterUID {
+			continue
+		}
+		if db.Spec.Role != common.RoleStandby || db.Spec.FollowConfig == nil || db.Spec.FollowConfig.DBUID != masterUID {
+			continue
+		}
+		if !db.Status.Healthy {
+			continue
+		}
+		healthyStandbys = append(healthyStandbys, db.UID)
+	}
+
+	if *cd.Cluster.DefSpec().SynchronousReplication {
+		if util.StringInSlice(masterDB.Spec.SynchronousStandbys, keeperDb.UID) {
+			syncStandbys := util.CommonElements(masterDB.Spec.SynchronousStandbys, healthyStandbys)
+			if len(syncStandbys) == 0 {
+				return fmt.Errorf("keeper assigned db is the last synchronous standby")
+			}
+			// the sentinel can choose a new synchronous standby only between
+			// the remaining healthy standbys
+			if uint16(len(healthyStandbys)) < *cd.Cluster.DefSpec().MinSynchronousStandbys {
+				return fmt.Errorf("removing the keeper will leave %d healthy standbys, less than minSynchronousStandbys (%d)", len(healthyStandbys), *cd.Cluster.DefSpec().MinSynchronousStandbys)
+			}
+		}
+	}
+
+	if keeperDb.Status.Healthy && len(healthyStandbys) == 0 {
+		return fmt.Errorf("removing the keeper will leave no healthy standbys")
+	}
+
+	return nil
+}
@@ -0,0 +1,212 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+)
+
+// testClusterData returns a cluster data with a master (db1) and the provided
+// number of standbys (db2, db3...) all healthy and converged.
+func testClusterData(standbys int, syncRepl bool) *cluster.ClusterData {
+	cd := &cluster.ClusterData{
+		Cluster: &cluster.Cluster{
+			UID:        "cluster1",
+			Generation: 1,
+			Spec: &cluster.ClusterSpec{
+				SynchronousReplication: cluster.BoolP(syncRepl),
+			},
+			Status: cluster.ClusterStatus{
+				CurrentGeneration: 1,
+				Phase:             cluster.ClusterPhaseNormal,
+				Master:            "db1",
+			},
+		},
+		Keepers: cluster.Keepers{},
+		DBs:     cluster.DBs{},
+		Proxy:   &cluster.Proxy{},
+	}
+	for i := 1; i <= standbys+1; i++ {
+		keeperUID := fmt.Sprintf("keeper%d", i)
+		dbUID := fmt.Sprintf("db%d", i)
+		cd.Keepers[keeperUID] = &cluster.Keeper{
+			UID:    keeperUID,
+			Spec:   &cluster.KeeperSpec{},
+			Status: cluster.KeeperStatus{Healthy: true},
+		}
+		db := &cluster.DB{
+			UID:        dbUID,
+			Generation: 1,
+			Spec: &cluster.DBSpec{
+				KeeperUID: keeperUID,
+				Role:      common.RoleStandby,
+				FollowConfig: &cluster.FollowConfig{
+					Type:  cluster.FollowTypeInternal,
+					DBUID: "db1",
+				},
+			},
+			Status: cluster.DBStatus{
+				Healthy:           true,
+				CurrentGeneration: 1,
+			},
+		}
+		if i == 1 {
+			db.Spec.Role = common.RoleMaster
+			db.Spec.FollowConfig = nil
+		}
+		cd.DBs[dbUID] = db
+	}
+	return cd
+}
+
+func TestCanRemoveKeeper(t *testing.T) {
+	tests := []struct {
+		name     string
+		cd       func() *cluster.ClusterData
+		keeperID string
+		err      error
+	}{
+		{
+			name:     "standby with other healthy standbys",
+			cd:       func() *cluster.ClusterData { return testClusterData(2, false) },
+			keeperID: "keeper2",
+		},
+		{
+			name:     "not existing keeper",
+			cd:       func() *cluster.ClusterData { return testClusterData(2, false) },
+			keeperID: "keeper9",
+			err:      fmt.Errorf("keeper doesn't exist"),
+		},
+		{
+			name:     "master",
+			cd:       func() *cluster.ClusterData { return testClusterData(2, false) },
+			keeperID: "keeper1",
+			err:      fmt.Errorf("keeper assigned db is the current cluster master db"),
+		},
+		{
+			name:     "last healthy standby",
+			cd:       func() *cluster.ClusterData { return testClusterData(1, false) },
+			keeperID: "keeper2",
+			err:      fmt.Errorf("removing the keeper will leave no healthy standbys"),
+		},
+		{
+			name: "unhealthy standby when it's the only one",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(1, false)
+				cd.DBs["db2"].Status.Healthy = false
+				return cd
+			},
+			keeperID: "keeper2",
+		},
+		{
+			name: "keeper without an assigned db",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(1, false)
+				cd.Keepers["keeper9"] = &cluster.Keeper{UID: "keeper9", Spec: &cluster.KeeperSpec{}}
+				return cd
+			},
+			keeperID: "keeper9",
+		},
+		{
+			name: "pending db convergence",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, false)
+				cd.DBs["db3"].Generation = 2
+				return cd
+			},
+			keeperID: "keeper2",
+			err:      fmt.Errorf(`db "db3" of keeper "keeper3" is converging to a new spec`),
+		},
+		{
+			name: "cluster initializing",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, false)
+				cd.Cluster.Status.Phase = cluster.ClusterPhaseInitializing
+				return cd
+			},
+			keeperID: "keeper2",
+			err:      fmt.Errorf(`cluster is not in the "normal" phase`),
+		},
+		{
+			name: "last synchronous standby",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, true)
+				cd.DBs["db1"].Spec.SynchronousStandbys = []string{"db2"}
+				return cd
+			},
+			keeperID: "keeper2",
+			err:      fmt.Errorf("keeper assigned db is the last synchronous standby"),
+		},
+		{
+			name: "synchronous standby with another synchronous standby",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, true)
+				cd.DBs["db1"].Spec.SynchronousStandbys = []string{"db2", "db3"}
+				return cd
+			},
+			keeperID: "keeper2",
+		},
+		{
+			name: "synchronous standby with the other synchronous standby unhealthy",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, true)
+				cd.DBs["db1"].Spec.SynchronousStandbys = []string{"db2", "db3"}
+				cd.DBs["db3"].Status.Healthy = false
+				return cd
+			},
+			keeperID: "keeper2",
+			err:      fmt.Errorf("keeper assigned db is the last synchronous standby"),
+		},
+		{
+			name: "synchronous standby leaving less than minSynchronousStandbys healthy standbys",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(3, true)
+				cd.Cluster.Spec.MinSynchronousStandbys = cluster.Uint16P(2)
+				cd.Cluster.Spec.MaxSynchronousStandbys = cluster.Uint16P(2)
+				cd.DBs["db1"].Spec.SynchronousStandbys = []string{"db2", "db3"}
+				cd.DBs["db4"].Status.Healthy = false
+				return cd
+			},
+			keeperID: "keeper2",
+			err:      fmt.Errorf("removing the keeper will leave 1 healthy standbys, less than minSynchronousStandbys (2)"),
+		},
+		{
+			name: "not synchronous standby with synchronous replication",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, true)
+				cd.DBs["db1"].Spec.SynchronousStandbys = []string{"db2"}
+				return cd
+			},
+			keeperID: "keeper3",
+		},
+	}
+
+	for i, tt := range tests {
+		err := canRemoveKeeper(tt.cd(), tt.keeperID)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d (%s): got no error, wanted error: %v", i, tt.name, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d (%s): got error: %v, wanted error: %v", i, tt.name, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d (%s): unexpected error: %v", i, tt.name, err)
+		}
+	}
+}
@@ -15,7 +15,7 @@
 package cmd
 
 import (
-	"encoding/json"
+	"os"
 
 	cmdcommon "github.com/sorintlab/stolon/cmd"
 
@@ -29,18 +29,24 @@ var cmdClusterData = &cobra.Command{
 }
 
 type clusterdataOptions struct {
+	outputOptions
 	pretty bool
 }
 
 var clusterdataOpts clusterdataOptions
 
 func init() {
-	cmdClusterData.PersistentFlags().BoolVar(&clusterdataOpts.pretty, "pretty", false, "pretty print")
+	cmdClusterData.Flags().BoolVar(&clusterdataOpts.pretty, "pretty", false, "pretty print (json output only)")
+	addOutputFlags(cmdClusterData, &clusterdataOpts.outputOptions, outputJSON, outputJSON, outputYAML)
 
 	CmdStolonCtl.AddCommand(cmdClusterData)
 }
 
 func clusterdata(cmd *cobra.Command, args []string) {
+	if err := clusterdataOpts.validate(outputJSON, outputYAML); err != nil {
+		die("%v", err)
+	}
+
 	e, err := cmdcommon.NewStore(&cfg.CommonConfig)
 	if err != nil {
 		die("%v", err)
@@ -53,17 +59,7 @@ func clusterdata(cmd *cobra.Command, args []string) {
 	if cd.Cluster == nil {
 		die("no cluster clusterdata available")
 	}
-	var clusterdataj []byte
-	if clusterdataOpts.pretty {
-		clusterdataj, err = json.MarshalIndent(cd, "", "\t")
-		if err != nil {
-			die("failed to marshall clusterdata: %v", err)
-		}
-	} else {
-		clusterdataj, err = json.Marshal(cd)
-		if err != nil {
-			die("failed to marshall clusterdata: %v", err)
-		}
+	if err := writeOutput(os.Stdout, cd, clusterdataOpts.outputOptions, clusterdataOpts.pretty); err != nil {
+		die("%v", err)
 	}
-	stdout("%s", clusterdataj)
 }
@@ -0,0 +1,191 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	cmdcommon "github.com/sorintlab/stolon/cmd"
+	"github.com/sorintlab/stolon/internal/cluster"
+
+	"github.com/spf13/cobra"
+)
+
+var cmdClusterDataBackup = &cobra.Command{
+	Use:   "backup",
+	Run:   clusterdataBackup,
+	Short: "Save the current cluster data to a file",
+	Long:  `Save the full current cluster data to a file (or to stdout when the file is "-"). The saved cluster data can be restored with the "clusterdata restore" command.`,
+}
+
+var cmdClusterDataRestore = &cobra.Command{
+	Use:   "restore",
+	Run:   clusterdataRestore,
+	Short: "Restore the cluster data from a file",
+	Long:  `Restore the full cluster data from a file (or from stdin when the file is "-") previously saved with the "clusterdata backup" command, replacing the current cluster data, if any.`,
+}
+
+type clusterdataBackupOptions struct {
+	file     string
+	forceYes bool
+}
+
+var clusterdataBackupOpts clusterdataBackupOptions
+
+func init() {
+	cmdClusterDataBackup.PersistentFlags().StringVarP(&clusterdataBackupOpts.file, "file", "f", "", `file where the cluster data will be saved ("-" for stdout)`)
+	cmdClusterDataRestore.PersistentFlags().StringVarP(&clusterdataBackupOpts.file, "file", "f", "", `file containing the cluster data to restore ("-" for stdin)`)
+	cmdClusterDataRestore.PersistentFlags().BoolVarP(&clusterdataBackupOpts.forceYes, "yes", "y", false, "don't ask for confirmation")
+
+	cmdClusterData.AddCommand(cmdClusterDataBackup)
+	cmdClusterData.AddCommand(cmdClusterDataRestore)
+}
+
+// checkClusterDataBackup checks that the cluster data read from a backup can
+// be restored by this stolon version
+func checkClusterDataBackup(cd *cluster.ClusterData) error {
+	if cd.FormatVersion != cluster.CurrentCDFormatVersion {
+		return fmt.Errorf("unsupported cluster data format version %d (expected %d)", cd.FormatVersion, cluster.CurrentCDFormatVersion)
+	}
+	if cd.Cluster == nil || cd.Cluster.Spec == nil {
+		return fmt.Errorf("no cluster spec available")
+	}
+	if err := cd.Cluster.Spec.Validate(); err != nil {
+		return fmt.Errorf("cluster spec validation failed: %v", err)
+	}
+	for uid, db := range cd.DBs {
+		if db.Spec == nil {
+			return fmt.Errorf("db %q has no spec", uid)
+		}
+		if _, ok := cd.Keepers[db.Spec.KeeperUID]; !ok {
+			return fmt.Errorf("db %q keeper %q doesn't exist", uid, db.Spec.KeeperUID)
+		}
+	}
+	if master := cd.Cluster.Status.Master; master != "" {
+		if _, ok := cd.DBs[master]; !ok {
+			return fmt.Errorf("master db %q doesn't exist", master)
+		}
+	}
+	return nil
+}
+
+func clusterdataBackup(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		die("too many arguments")
+	}
+	if clusterdataBackupOpts.file == "" {
+		die("--file is required")
+	}
+
+	e, err := cmdcommon.NewStore(&cfg.CommonConfig)
+	if err != nil {
+		die("%v", err)
+	}
+
+	cd, _, err := getClusterData(e)
+	if err != nil {
+		die("%v", err)
+	}
+	if cd.Cluster == nil {
+		die("no cluster clusterdata available")
+	}
+
+	data, err := json.MarshalIndent(cd, "", "\t")
+	if err != nil {
+		die("failed to marshal cluster data: %v", err)
+	}
+	data = append(data, '\n')
+
+	if clusterdataBackupOpts.file == "-" {
+		if _, err := os.Stdout.Write(data); err != nil {
+			die("cannot write to stdout: %v", err)
+		}
+		return
+	}
+	if err := ioutil.WriteFile(clusterdataBackupOpts.file, data, 0600); err != nil {
+		die("cannot write file: %v", err)
+	}
+	stdout("cluster data saved to %q", clusterdataBackupOpts.file)
+}
+
+func clusterdataRestore(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		die("too many arguments")
+	}
+	if clusterdataBackupOpts.file == "" {
+		die("--file is required")
+	}
+
+	var data []byte
+	var err error
+	if clusterdataBackupOpts.file == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			die("cannot read from stdin: %v", err)
+		}
+	} else {
+		data, err = ioutil.ReadFile(clusterdataBackupOpts.file)
+		if err != nil {
+			die("cannot read file: %v", err)
+		}
+	}
+
+	var cd *cluster.ClusterData
+	if err := json.Unmarshal(data, &cd); err != nil {
+		die("failed to unmarshal cluster data: %v", err)
+	}
+	if cd == nil {
+		die("empty cluster data")
+	}
+	if err := checkClusterDataBackup(cd); err != nil {
+		die("cannot restore cluster data: %v", err)
+	}
+
+	e, err := cmdcommon.NewStore(&cfg.CommonConfig)
+	if err != nil {
+		die("%v", err)
+	}
+
+	curcd, _, err := e.GetClusterData(context.TODO())
+	if err != nil {
+		die("cannot get cluster data: %v", err)
+	}
+	if curcd != nil {
+		stdout("WARNING: The current cluster data will be replaced")
+	}
+	stdout("WARNING: The sentinel will use the restored cluster data, if the restored master db isn't the most recent one the data written after the backup will be lost.")
+
+	accepted := true
+	if !clusterdataBackupOpts.forceYes {
+		accepted, err = askConfirmation("Are you sure you want to continue? [yes/no] ")
+		if err != nil {
+			die("%v", err)
+		}
+	}
+	if !accepted {
+		stdout("exiting")
+		os.Exit(0)
+	}
+
+	// We ignore if cd has been modified between reading and writing
+	if err := e.PutClusterData(context.TODO(), cd); err != nil {
+		die("cannot update cluster data: %v", err)
+	}
+	stdout("cluster data restored")
+}
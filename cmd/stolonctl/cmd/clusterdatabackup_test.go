@@ -0,0 +1,98 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+func TestCheckClusterDataBackup(t *testing.T) {
+	tests := []struct {
+		name string
+		cd   func(cd *cluster.ClusterData)
+		err  error
+	}{
+		{
+			name: "valid cluster data",
+		},
+		{
+			name: "wrong format version",
+			cd: func(cd *cluster.ClusterData) {
+				cd.FormatVersion = cluster.CurrentCDFormatVersion + 1
+			},
+			err: fmt.Errorf("unsupported cluster data format version %d (expected %d)", cluster.CurrentCDFormatVersion+1, cluster.CurrentCDFormatVersion),
+		},
+		{
+			name: "no cluster",
+			cd: func(cd *cluster.ClusterData) {
+				cd.Cluster = nil
+			},
+			err: fmt.Errorf("no cluster spec available"),
+		},
+		{
+			name: "invalid cluster spec",
+			cd: func(cd *cluster.ClusterData) {
+				cd.Cluster.Spec.MaxStandbys = cluster.Uint16P(0)
+			},
+			err: fmt.Errorf("cluster spec validation failed: maxStandbys must be at least 1"),
+		},
+		{
+			name: "db with not existing keeper",
+			cd: func(cd *cluster.ClusterData) {
+				delete(cd.Keepers, "keeper2")
+			},
+			err: fmt.Errorf(`db "db2" keeper "keeper2" doesn't exist`),
+		},
+		{
+			name: "not existing master db",
+			cd: func(cd *cluster.ClusterData) {
+				cd.Cluster.Status.Master = "db9"
+			},
+			err: fmt.Errorf(`master db "db9" doesn't exist`),
+		},
+	}
+
+	for i, tt := range tests {
+		cd := testClusterData(1, false)
+		cd.FormatVersion = cluster.CurrentCDFormatVersion
+		cd.Cluster.Spec.InitMode = cluster.ClusterInitModeP(cluster.ClusterInitModeNew)
+		// check the cluster data after a backup and restore roundtrip
+		data, err := json.Marshal(cd)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		cd = nil
+		if err := json.Unmarshal(data, &cd); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if tt.cd != nil {
+			tt.cd(cd)
+		}
+		err = checkClusterDataBackup(cd)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d (%s): got no error, wanted error: %v", i, tt.name, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d (%s): got error: %v, wanted error: %v", i, tt.name, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d (%s): unexpected error: %v", i, tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	cmdcommon "github.com/sorintlab/stolon/cmd"
+	"github.com/sorintlab/stolon/internal/cluster"
+
+	"github.com/spf13/cobra"
+)
+
+var degradeSyncReplCmd = &cobra.Command{
+	Use:   "degradesyncrepl",
+	Short: "Acknowledge the degradation to asynchronous replication of a master blocked waiting for its synchronous standbys",
+	Long:  `Acknowledge the degradation to asynchronous replication of the master whose writes are blocked since there aren't enough healthy synchronous standbys. It requires the cluster spec syncReplDegradation policy to be degradeOnAck (or degradeAfterGrace to degrade before the grace period expires). The sentinel restores the synchronous replication when enough synchronous standbys are healthy again.`,
+	Run:   degradeSyncRepl,
+}
+
+func init() {
+	CmdStolonCtl.AddCommand(degradeSyncReplCmd)
+}
+
+// checkDegradeSyncRepl checks if the degradation to asynchronous replication
+// can be acknowledged
+func checkDegradeSyncRepl(cd *cluster.ClusterData) error {
+	if cd.Cluster == nil {
+		return fmt.Errorf("no cluster spec available")
+	}
+	if !*cd.Cluster.DefSpec().SynchronousReplication {
+		return fmt.Errorf("synchronous replication is disabled")
+	}
+	if policy := cd.Cluster.DefSpec().SyncReplDegradation.DefPolicy(); policy == cluster.SyncReplDegradationPolicyBlock {
+		return fmt.Errorf("syncReplDegradation policy is %q, the master cannot be degraded to asynchronous replication", policy)
+	}
+	switch mode := cd.Cluster.SyncReplMode(); mode {
+	case cluster.SyncReplModeBlocking:
+	case cluster.SyncReplModeDegraded:
+		return fmt.Errorf("synchronous replication already degraded")
+	default:
+		return fmt.Errorf("master writes aren't blocked, synchronous replication mode is %q", mode)
+	}
+	if cd.Cluster.Status.SyncReplDegradation.Acknowledged {
+		return fmt.Errorf("degradation already acknowledged")
+	}
+	return nil
+}
+
+func degradeSyncRepl(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		die("too many arguments")
+	}
+
+	store, err := cmdcommon.NewStore(&cfg.CommonConfig)
+	if err != nil {
+		die("%v", err)
+	}
+
+	cd, pair, err := getClusterData(store)
+	if err != nil {
+		die("cannot get cluster data: %v", err)
+	}
+	if err := checkDegradeSyncRepl(cd); err != nil {
+		die("%v", err)
+	}
+
+	newCd := cd.DeepCopy()
+	newCd.Cluster.Status.SyncReplDegradation.Acknowledged = true
+
+	_, err = store.AtomicPutClusterData(context.TODO(), newCd, pair)
+	if err != nil {
+		die("cannot update cluster data: %v", err)
+	}
+	stdout("degradation to asynchronous replication acknowledged")
+}
@@ -0,0 +1,91 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+func TestCheckDegradeSyncRepl(t *testing.T) {
+	tests := []struct {
+		name        string
+		syncRepl    bool
+		degradation *cluster.SyncReplDegradation
+		status      *cluster.SyncReplDegradationStatus
+		err         error
+	}{
+		{
+			name:        "blocking",
+			syncRepl:    true,
+			degradation: &cluster.SyncReplDegradation{Policy: cluster.SyncReplDegradationPolicyDegradeOnAck},
+			status:      &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeBlocking},
+		},
+		{
+			name:        "blocking, degradeAfterGrace policy",
+			syncRepl:    true,
+			degradation: &cluster.SyncReplDegradation{Policy: cluster.SyncReplDegradationPolicyDegradeAfterGrace},
+			status:      &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeBlocking},
+		},
+		{
+			name: "sync repl disabled",
+			err:  fmt.Errorf("synchronous replication is disabled"),
+		},
+		{
+			name:     "block policy",
+			syncRepl: true,
+			status:   &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeBlocking},
+			err:      fmt.Errorf(`syncReplDegradation policy is "block", the master cannot be degraded to asynchronous replication`),
+		},
+		{
+			name:        "sync",
+			syncRepl:    true,
+			degradation: &cluster.SyncReplDegradation{Policy: cluster.SyncReplDegradationPolicyDegradeOnAck},
+			err:         fmt.Errorf(`master writes aren't blocked, synchronous replication mode is "sync"`),
+		},
+		{
+			name:        "already degraded",
+			syncRepl:    true,
+			degradation: &cluster.SyncReplDegradation{Policy: cluster.SyncReplDegradationPolicyDegradeOnAck},
+			status:      &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeDegraded},
+			err:         fmt.Errorf("synchronous replication already degraded"),
+		},
+		{
+			name:        "already acknowledged",
+			syncRepl:    true,
+			degradation: &cluster.SyncReplDegradation{Policy: cluster.SyncReplDegradationPolicyDegradeOnAck},
+			status:      &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeBlocking, Acknowledged: true},
+			err:         fmt.Errorf("degradation already acknowledged"),
+		},
+	}
+
+	for i, tt := range tests {
+		cd := testClusterData(1, tt.syncRepl)
+		cd.Cluster.Spec.SyncReplDegradation = tt.degradation
+		cd.Cluster.Status.SyncReplDegradation = tt.status
+		err := checkDegradeSyncRepl(cd)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d (%s): got no error, wanted error: %v", i, tt.name, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d (%s): got error: %v, wanted error: %v", i, tt.name, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d (%s): unexpected error: %v", i, tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,415 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	cmdcommon "github.com/sorintlab/stolon/cmd"
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+
+	"github.com/spf13/cobra"
+)
+
+var cmdDoctor = &cobra.Command{
+	Use:   "doctor",
+	Short: "Run diagnostic checks on the cluster and report the problems found",
+	Long: `Run diagnostic checks on the cluster: the store reachability and latency, the cluster data consistency (dangling db and keeper references, stale keepers), the clock skews between the components, the synchronous replication configuration and the proxies not converged to the current proxy generation. For every problem found it reports a finding with the action to take.
+
+The clock skews are computed from the time reported by the components in their infos, written periodically, so they're detected with the precision of the cluster spec sleepInterval. The command exits with status 1 when a finding of error severity is reported.`,
+	Run: doctor,
+}
+
+type doctorOptions struct {
+	outputOptions
+	maxStoreLatency time.Duration
+	maxTimeSkew     time.Duration
+}
+
+var doctorOpts doctorOptions
+
+func init() {
+	cmdDoctor.PersistentFlags().DurationVar(&doctorOpts.maxStoreLatency, "max-store-latency", 1*time.Second, "store reads latency reported as too high")
+	cmdDoctor.PersistentFlags().DurationVar(&doctorOpts.maxTimeSkew, "max-time-skew", 10*time.Second, "clock skew, between a component and stolonctl, reported as too high")
+	addOutputFlags(cmdDoctor, &doctorOpts.outputOptions, outputText, outputText, outputJSON, outputYAML)
+
+	CmdStolonCtl.AddCommand(cmdDoctor)
+}
+
+type doctorSeverity string
+
+const (
+	doctorSeverityWarning doctorSeverity = "warning"
+	doctorSeverityError   doctorSeverity = "error"
+)
+
+const (
+	doctorCheckStore       = "store"
+	doctorCheckClusterData = "clusterdata"
+	doctorCheckTimeSkew    = "timeskew"
+	doctorCheckSyncRepl    = "syncrepl"
+	doctorCheckProxies     = "proxies"
+)
+
+// doctorStoreReads is the number of cluster data reads done to measure the
+// store latency
+const doctorStoreReads = 3
+
+// doctorFinding is a problem found by a doctor check and the action to take
+type doctorFinding struct {
+	Check    string         `json:"check"`
+	Severity doctorSeverity `json:"severity"`
+	Message  string         `json:"message"`
+	Action   string         `json:"action,omitempty"`
+}
+
+type doctorOutput struct {
+	StoreLatency cluster.Duration `json:"storeLatency"`
+	Findings     []*doctorFinding `json:"findings"`
+}
+
+// doctorStore is the subset of store.Store used by doctor
+type doctorStore interface {
+	clusterDataStore
+	GetKeepersInfo(ctx context.Context) (cluster.KeepersInfo, error)
+	GetSentinelsInfo(ctx context.Context) (cluster.SentinelsInfo, error)
+	GetProxiesInfo(ctx context.Context) (cluster.ProxiesInfo, error)
+}
+
+// doctorState is the cluster state examined by the doctor checks
+type doctorState struct {
+	cd            *cluster.ClusterData
+	keepersInfo   cluster.KeepersInfo
+	sentinelsInfo cluster.SentinelsInfo
+	proxiesInfo   cluster.ProxiesInfo
+	storeLatency  time.Duration
+}
+
+func doctor(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		die("too many arguments")
+	}
+	if err := doctorOpts.validate(outputText, outputJSON, outputYAML); err != nil {
+		die("%v", err)
+	}
+
+	e, err := cmdcommon.NewStore(&cfg.CommonConfig)
+	if err != nil {
+		die("%v", err)
+	}
+
+	out := &doctorOutput{Findings: []*doctorFinding{}}
+	state, err := readDoctorState(e)
+	if err != nil {
+		out.Findings = append(out.Findings, &doctorFinding{
+			Check:    doctorCheckStore,
+			Severity: doctorSeverityError,
+			Message:  err.Error(),
+			Action:   "check the store endpoints, credentials and health (all the stolon components need it)",
+		})
+	} else {
+		out.StoreLatency = cluster.Duration{Duration: state.storeLatency}
+		out.Findings = doctorChecks(state, doctorOpts, time.Now())
+	}
+
+	if doctorOpts.output != outputText || doctorOpts.template != "" {
+		if err := writeOutput(os.Stdout, out, doctorOpts.outputOptions, true); err != nil {
+			die("%v", err)
+		}
+	} else {
+		printDoctorFindings(out)
+	}
+	for _, f := range out.Findings {
+		if f.Severity == doctorSeverityError {
+			os.Exit(1)
+		}
+	}
+}
+
+// readDoctorState reads the cluster data and the components infos. The store
+// latency is the max duration of the cluster data reads.
+func readDoctorState(e doctorStore) (*doctorState, error) {
+	state := &doctorState{}
+	for i := 0; i < doctorStoreReads; i++ {
+		start := time.Now()
+		cd, _, err := getClusterData(e)
+		if err != nil {
+			return nil, err
+		}
+		if latency := time.Since(start); latency > state.storeLatency {
+			state.storeLatency = latency
+		}
+		state.cd = cd
+	}
+	var err error
+	if state.keepersInfo, err = e.GetKeepersInfo(context.TODO()); err != nil {
+		return nil, fmt.Errorf("cannot get keepers info: %v", err)
+	}
+	if state.sentinelsInfo, err = e.GetSentinelsInfo(context.TODO()); err != nil {
+		return nil, fmt.Errorf("cannot get sentinels info: %v", err)
+	}
+	if state.proxiesInfo, err = e.GetProxiesInfo(context.TODO()); err != nil {
+		return nil, fmt.Errorf("cannot get proxies info: %v", err)
+	}
+	return state, nil
+}
+
+func printDoctorFindings(out *doctorOutput) {
+	stdout("Store latency: %s", out.StoreLatency.Duration)
+	stdout("")
+	if len(out.Findings) == 0 {
+		stdout("No problems found")
+		return
+	}
+	for _, f := range out.Findings {
+		stdout("[%s] %s: %s", f.Severity, f.Check, f.Message)
+		if f.Action != "" {
+			stdout("    action: %s", f.Action)
+		}
+	}
+}
+
+// doctorChecks runs all the checks on the cluster state returning the
+// findings sorted by severity (errors first) and check
+func doctorChecks(state *doctorState, opts doctorOptions, now time.Time) []*doctorFinding {
+	findings := []*doctorFinding{}
+	if state.storeLatency > opts.maxStoreLatency {
+		findings = append(findings, &doctorFinding{
+			Check:    doctorCheckStore,
+			Severity: doctorSeverityWarning,
+			Message:  fmt.Sprintf("store reads latency %s greater than %s", state.storeLatency, opts.maxStoreLatency),
+			Action:   "check the store load and the network latency, a slow store delays the failovers and can make the keepers and proxies infos expire",
+		})
+	}
+	findings = append(findings, checkDoctorClusterData(state)...)
+	findings = append(findings, checkDoctorTimeSkew(state, opts.maxTimeSkew, now)...)
+	findings = append(findings, checkDoctorSyncRepl(state.cd)...)
+	findings = append(findings, checkDoctorProxies(state)...)
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].Severity != findings[j].Severity {
+			return findings[i].Severity == doctorSeverityError
+		}
+		return findings[i].Check < findings[j].Check
+	})
+	return findings
+}
+
+// sortedDBUIDs and sortedKeeperUIDs return the uids sorted, so the findings
+// order is stable
+func sortedDBUIDs(dbs cluster.DBs) []string {
+	uids := []string{}
+	for uid := range dbs {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+	return uids
+}
+
+func sortedKeeperUIDs(keepers cluster.Keepers) []string {
+	uids := []string{}
+	for uid := range keepers {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+	return uids
+}
+
+func sortedProxiesInfo(proxiesInfo cluster.ProxiesInfo) cluster.ProxiesInfoSlice {
+	pis := proxiesInfo.ToSlice()
+	sort.Sort(pis)
+	return pis
+}
+
+// checkDoctorClusterData checks the cluster data references between the
+// cluster, the dbs, the keepers and the proxy and the keepers not reporting
+// their state
+func checkDoctorClusterData(state *doctorState) []*doctorFinding {
+	cd := state.cd
+	findings := []*doctorFinding{}
+	add := func(severity doctorSeverity, action, format string, a ...interface{}) {
+		findings = append(findings, &doctorFinding{Check: doctorCheckClusterData, Severity: severity, Message: fmt.Sprintf(format, a...), Action: action})
+	}
+
+	if cd.Cluster.Status.Phase != cluster.ClusterPhaseNormal {
+		add(doctorSeverityWarning, "check the sentinels logs for the initialization progress", "cluster is in the %q phase", cd.Cluster.Status.Phase)
+	} else if _, ok := cd.DBs[cd.Cluster.Status.Master]; !ok {
+		add(doctorSeverityError, "check the sentinels logs, the leader sentinel should elect a new master", "cluster master db %q doesn't exist", cd.Cluster.Status.Master)
+	}
+	if m := cd.Proxy.Spec.MasterDBUID; m != "" {
+		if _, ok := cd.DBs[m]; !ok {
+			add(doctorSeverityError, "check the sentinels logs, the leader sentinel should update the proxy spec", "proxy spec master db %q doesn't exist", m)
+		}
+	} else if cd.Cluster.Status.Phase == cluster.ClusterPhaseNormal && cd.Cluster.Status.Switchover == nil {
+		add(doctorSeverityWarning, "the proxies don't accept connections, check with `stolonctl status` why the master db isn't ready", "proxy spec has no master db")
+	}
+
+	keeperDBs := map[string][]string{}
+	for _, uid := range sortedDBUIDs(cd.DBs) {
+		db := cd.DBs[uid]
+		if _, ok := cd.Keepers[db.Spec.KeeperUID]; !ok {
+			add(doctorSeverityError, "check the sentinels logs, the leader sentinel should remove the db", "db %q references the missing keeper %q", db.UID, db.Spec.KeeperUID)
+		}
+		keeperDBs[db.Spec.KeeperUID] = append(keeperDBs[db.Spec.KeeperUID], db.UID)
+		if fc := db.Spec.FollowConfig; db.Spec.Role == common.RoleStandby && fc != nil && fc.Type == cluster.FollowTypeInternal {
+			if _, ok := cd.DBs[fc.DBUID]; !ok {
+				add(doctorSeverityError, "check the sentinels logs, the leader sentinel should make the standby follow the master", "standby db %q follows the missing db %q", db.UID, fc.DBUID)
+			}
+		}
+		for _, f := range db.Spec.Followers {
+			if _, ok := cd.DBs[f]; !ok {
+				add(doctorSeverityWarning, "check the sentinels logs, the leader sentinel should update the db followers", "db %q has the missing follower db %q", db.UID, f)
+			}
+		}
+		for _, s := range db.Spec.SynchronousStandbys {
+			if _, ok := cd.DBs[s]; !ok {
+				add(doctorSeverityError, "check the sentinels logs, the leader sentinel should choose another synchronous standby", "db %q has the missing synchronous standby db %q", db.UID, s)
+			}
+		}
+	}
+	for keeperUID, dbUIDs := range keeperDBs {
+		if len(dbUIDs) > 1 {
+			add(doctorSeverityError, "report it, a keeper can manage only one db", "keeper %q is assigned multiple dbs: %v", keeperUID, dbUIDs)
+		}
+	}
+
+	for _, uid := range sortedKeeperUIDs(cd.Keepers) {
+		k := cd.Keepers[uid]
+		ki, ok := state.keepersInfo[uid]
+		if !ok {
+			action := "check that the keeper is running and can reach the store"
+			if len(keeperDBs[uid]) == 0 {
+				action = "if the keeper has been decommissioned remove it with `stolonctl removekeeper`"
+			}
+			add(doctorSeverityWarning, action, "keeper %q isn't reporting its state (unhealthy since %s)", uid, k.Status.LastHealthyTime.Format(time.RFC3339))
+			continue
+		}
+		if ki.ClusterUID != cd.Cluster.UID {
+			add(doctorSeverityError, "check the keeper data dir, it belongs to another cluster", "keeper %q reports the cluster uid %q instead of %q", uid, ki.ClusterUID, cd.Cluster.UID)
+		}
+	}
+	return findings
+}
+
+// checkDoctorTimeSkew checks the difference between the components clocks,
+// as reported in their infos, and the local clock. infos are written
+// periodically so they can be older than the sleep interval.
+func checkDoctorTimeSkew(state *doctorState, maxSkew time.Duration, now time.Time) []*doctorFinding {
+	findings := []*doctorFinding{}
+	sleepInterval := state.cd.Cluster.DefSpec().SleepInterval.Duration
+	check := func(component, uid string, t time.Time, interval time.Duration) {
+		// not reported by previous versions
+		if t.IsZero() {
+			return
+		}
+		skew := now.Sub(t)
+		var message string
+		switch {
+		case skew < -maxSkew:
+			message = fmt.Sprintf("%s %q clock is %s ahead", component, uid, -skew)
+		case skew > interval+maxSkew:
+			message = fmt.Sprintf("%s %q clock is %s behind (or its info hasn't been updated)", component, uid, skew-interval)
+		default:
+			return
+		}
+		findings = append(findings, &doctorFinding{
+			Check:    doctorCheckTimeSkew,
+			Severity: doctorSeverityWarning,
+			Message:  message,
+			Action:   "synchronize the clocks of all the nodes (i.e. with ntp), the sentinels compare the times reported by the components",
+		})
+	}
+
+	keeperUIDs := []string{}
+	for uid := range state.keepersInfo {
+		keeperUIDs = append(keeperUIDs, uid)
+	}
+	sort.Strings(keeperUIDs)
+	for _, uid := range keeperUIDs {
+		check("keeper", uid, state.keepersInfo[uid].Time, sleepInterval)
+	}
+	for _, si := range state.sentinelsInfo {
+		check("sentinel", si.UID, si.Time, sleepInterval)
+	}
+	for _, pi := range sortedProxiesInfo(state.proxiesInfo) {
+		check("proxy", pi.UID, pi.Time, cluster.DefaultProxyCheckInterval)
+	}
+	return findings
+}
+
+// checkDoctorSyncRepl checks that the synchronous replication can be
+// satisfied by the standbys
+func checkDoctorSyncRepl(cd *cluster.ClusterData) []*doctorFinding {
+	findings := []*doctorFinding{}
+	spec := cd.Cluster.DefSpec()
+	if !*spec.SynchronousReplication {
+		return findings
+	}
+	add := func(severity doctorSeverity, action, format string, a ...interface{}) {
+		findings = append(findings, &doctorFinding{Check: doctorCheckSyncRepl, Severity: severity, Message: fmt.Sprintf(format, a...), Action: action})
+	}
+	if *spec.Role == cluster.ClusterRoleStandby {
+		add(doctorSeverityWarning, "disable synchronousReplication or promote the standby cluster", "synchronousReplication is ignored in a standby cluster")
+		return findings
+	}
+	masterDB, ok := cd.DBs[cd.Cluster.Status.Master]
+	if !ok {
+		return findings
+	}
+
+	standbys := 0
+	for _, db := range cd.DBs {
+		if db.UID != masterDB.UID && db.Spec.Role == common.RoleStandby {
+			standbys++
+		}
+	}
+	minSync := int(*spec.MinSynchronousStandbys)
+	if standbys < minSync {
+		add(doctorSeverityError, "add keepers or lower minSynchronousStandbys, the master blocks the commits until enough synchronous standbys are available", "%d standbys, fewer than minSynchronousStandbys (%d)", standbys, minSync)
+	}
+	syncStandbys := len(masterDB.Status.SynchronousStandbys) + len(masterDB.Spec.ExternalSynchronousStandbys)
+	if syncStandbys < minSync {
+		add(doctorSeverityError, "check the standbys health and replication lag with `stolonctl status`", "master db %q has %d in sync synchronous standbys, fewer than minSynchronousStandbys (%d)", masterDB.UID, syncStandbys, minSync)
+	}
+	for _, s := range masterDB.Spec.SynchronousStandbys {
+		if db, ok := cd.DBs[s]; ok && !db.Status.Healthy {
+			add(doctorSeverityWarning, "check the standby keeper, the sentinel should replace it", "synchronous standby db %q is unhealthy", s)
+		}
+	}
+	return findings
+}
+
+// checkDoctorProxies checks the proxies that don't see the current proxy
+// generation
+func checkDoctorProxies(state *doctorState) []*doctorFinding {
+	findings := []*doctorFinding{}
+	for _, pi := range sortedProxiesInfo(state.proxiesInfo) {
+		if pi.Generation == state.cd.Proxy.Generation {
+			continue
+		}
+		findings = append(findings, &doctorFinding{
+			Check:    doctorCheckProxies,
+			Severity: doctorSeverityWarning,
+			Message:  fmt.Sprintf("proxy %q sees the proxy generation %d instead of %d", pi.UID, pi.Generation, state.cd.Proxy.Generation),
+			Action:   "if persistent check that the proxy can read the store, it could route the connections to an old master",
+		})
+	}
+	return findings
+}
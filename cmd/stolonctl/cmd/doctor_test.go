@@ -0,0 +1,159 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+// testDoctorState returns a healthy cluster state with a master and a
+// standby, a sentinel and a proxy
+func testDoctorState(now time.Time) *doctorState {
+	cd := testClusterData(1, false)
+	cd.Proxy.Generation = 1
+	cd.Proxy.Spec.MasterDBUID = "db1"
+	cd.DBs["db1"].Spec.Followers = []string{"db2"}
+	return &doctorState{
+		cd: cd,
+		keepersInfo: cluster.KeepersInfo{
+			"keeper1": &cluster.KeeperInfo{UID: "keeper1", ClusterUID: "cluster1", Time: now},
+			"keeper2": &cluster.KeeperInfo{UID: "keeper2", ClusterUID: "cluster1", Time: now.Add(-2 * time.Second)},
+		},
+		sentinelsInfo: cluster.SentinelsInfo{
+			&cluster.SentinelInfo{UID: "sentinel1", Time: now},
+		},
+		proxiesInfo: cluster.ProxiesInfo{
+			"proxy1": &cluster.ProxyInfo{UID: "proxy1", Generation: 1, Time: now},
+		},
+		storeLatency: 10 * time.Millisecond,
+	}
+}
+
+func TestDoctorChecks(t *testing.T) {
+	now := time.Now()
+	opts := doctorOptions{maxStoreLatency: time.Second, maxTimeSkew: 10 * time.Second}
+
+	tests := []struct {
+		name   string
+		update func(s *doctorState)
+		out    []doctorFinding
+	}{
+		{
+			name:   "healthy cluster",
+			update: func(s *doctorState) {},
+			out:    []doctorFinding{},
+		},
+		{
+			name:   "slow store",
+			update: func(s *doctorState) { s.storeLatency = 2 * time.Second },
+			out: []doctorFinding{
+				{Check: doctorCheckStore, Severity: doctorSeverityWarning, Message: "store reads latency 2s greater than 1s"},
+			},
+		},
+		{
+			name: "dangling references",
+			update: func(s *doctorState) {
+				s.cd.DBs["db2"].Spec.FollowConfig.DBUID = "db9"
+				s.cd.DBs["db1"].Spec.Followers = []string{"db2", "db8"}
+				s.cd.Proxy.Spec.MasterDBUID = "db7"
+			},
+			out: []doctorFinding{
+				{Check: doctorCheckClusterData, Severity: doctorSeverityError, Message: `proxy spec master db "db7" doesn't exist`},
+				{Check: doctorCheckClusterData, Severity: doctorSeverityError, Message: `standby db "db2" follows the missing db "db9"`},
+				{Check: doctorCheckClusterData, Severity: doctorSeverityWarning, Message: `db "db1" has the missing follower db "db8"`},
+			},
+		},
+		{
+			name: "missing master and keeper",
+			update: func(s *doctorState) {
+				s.cd.Cluster.Status.Master = "db9"
+				delete(s.cd.Keepers, "keeper2")
+			},
+			out: []doctorFinding{
+				{Check: doctorCheckClusterData, Severity: doctorSeverityError, Message: `cluster master db "db9" doesn't exist`},
+				{Check: doctorCheckClusterData, Severity: doctorSeverityError, Message: `db "db2" references the missing keeper "keeper2"`},
+			},
+		},
+		{
+			name: "stale keepers",
+			update: func(s *doctorState) {
+				s.cd.Keepers["keeper3"] = &cluster.Keeper{UID: "keeper3", Spec: &cluster.KeeperSpec{}, Status: cluster.KeeperStatus{LastHealthyTime: now.Add(-time.Hour)}}
+				s.keepersInfo["keeper2"].ClusterUID = "cluster2"
+			},
+			out: []doctorFinding{
+				{Check: doctorCheckClusterData, Severity: doctorSeverityError, Message: `keeper "keeper2" reports the cluster uid "cluster2" instead of "cluster1"`},
+				{Check: doctorCheckClusterData, Severity: doctorSeverityWarning, Message: `keeper "keeper3" isn't reporting its state (unhealthy since ` + now.Add(-time.Hour).Format(time.RFC3339) + `)`},
+			},
+		},
+		{
+			name: "clock skews",
+			update: func(s *doctorState) {
+				s.keepersInfo["keeper2"].Time = now.Add(30 * time.Second)
+				s.sentinelsInfo[0].Time = now.Add(-time.Minute)
+				// not reported by previous versions
+				s.proxiesInfo["proxy1"].Time = time.Time{}
+			},
+			out: []doctorFinding{
+				{Check: doctorCheckTimeSkew, Severity: doctorSeverityWarning, Message: `keeper "keeper2" clock is 30s ahead`},
+				{Check: doctorCheckTimeSkew, Severity: doctorSeverityWarning, Message: `sentinel "sentinel1" clock is 55s behind (or its info hasn't been updated)`},
+			},
+		},
+		{
+			name: "not enough synchronous standbys",
+			update: func(s *doctorState) {
+				s.cd.Cluster.Spec.SynchronousReplication = cluster.BoolP(true)
+				s.cd.Cluster.Spec.MinSynchronousStandbys = cluster.Uint16P(2)
+				s.cd.Cluster.Spec.MaxSynchronousStandbys = cluster.Uint16P(2)
+				s.cd.DBs["db1"].Spec.SynchronousStandbys = []string{"db2"}
+				s.cd.DBs["db1"].Status.SynchronousStandbys = []string{"db2"}
+				s.cd.DBs["db2"].Status.Healthy = false
+			},
+			out: []doctorFinding{
+				{Check: doctorCheckSyncRepl, Severity: doctorSeverityError, Message: "1 standbys, fewer than minSynchronousStandbys (2)"},
+				{Check: doctorCheckSyncRepl, Severity: doctorSeverityError, Message: `master db "db1" has 1 in sync synchronous standbys, fewer than minSynchronousStandbys (2)`},
+				{Check: doctorCheckSyncRepl, Severity: doctorSeverityWarning, Message: `synchronous standby db "db2" is unhealthy`},
+			},
+		},
+		{
+			name: "proxy with an old generation",
+			update: func(s *doctorState) {
+				s.proxiesInfo["proxy2"] = &cluster.ProxyInfo{UID: "proxy2", Generation: 0, Time: now}
+			},
+			out: []doctorFinding{
+				{Check: doctorCheckProxies, Severity: doctorSeverityWarning, Message: `proxy "proxy2" sees the proxy generation 0 instead of 1`},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		s := testDoctorState(now)
+		tt.update(s)
+		findings := doctorChecks(s, opts, now)
+		out := []doctorFinding{}
+		for _, f := range findings {
+			if f.Action == "" {
+				t.Errorf("#%d (%s): finding %q without action", i, tt.name, f.Message)
+			}
+			out = append(out, doctorFinding{Check: f.Check, Severity: f.Severity, Message: f.Message})
+		}
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d (%s): got findings: %+v, want: %+v", i, tt.name, out, tt.out)
+		}
+	}
+}
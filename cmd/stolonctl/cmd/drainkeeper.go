@@ -0,0 +1,189 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+
+	"github.com/spf13/cobra"
+)
+
+var drainKeeperCmd = &cobra.Command{
+	Use:   "drainkeeper [keeper uid]",
+	Short: "Drain a keeper for maintenance",
+	Long:  `Drain a keeper for maintenance without removing it from the cluster. The sentinel won't elect its db as the new master, will replace it if it's a synchronous standby and will make the cascading standbys following it follow the master. When the keeper db is the current master it keeps its role unless --switchover is provided: then a switchover to the best standby is requested.`,
+	Run:   drainKeeper,
+}
+
+var undrainKeeperCmd = &cobra.Command{
+	Use:   "undrainkeeper [keeper uid]",
+	Short: "Make a drained keeper usable again",
+	Run:   undrainKeeper,
+}
+
+type drainKeeperOptions struct {
+	switchover bool
+}
+
+var drainKeeperOpts drainKeeperOptions
+
+func init() {
+	drainKeeperCmd.PersistentFlags().BoolVar(&drainKeeperOpts.switchover, "switchover", false, "if the keeper db is the current master, switch the master role to the best standby")
+
+	CmdStolonCtl.AddCommand(drainKeeperCmd)
+	CmdStolonCtl.AddCommand(undrainKeeperCmd)
+}
+
+// setKeeperDrained sets the drained state of the keeper in the cluster data
+func setKeeperDrained(cd *cluster.ClusterData, keeperUID string, drained bool) error {
+	k, ok := cd.Keepers[keeperUID]
+	if !ok {
+		return fmt.Errorf("keeper %q doesn't exist", keeperUID)
+	}
+	if k.Spec == nil {
+		k.Spec = &cluster.KeeperSpec{}
+	}
+	if k.Spec.Drained == drained {
+		if drained {
+			return fmt.Errorf("keeper %q is already drained", keeperUID)
+		}
+		return fmt.Errorf("keeper %q isn't drained", keeperUID)
+	}
+	k.Spec.Drained = drained
+	return nil
+}
+
+// drainSwitchoverTarget returns the keeper whose db will become the new master
+// replacing the db of the drained keeper: between the keepers that can be
+// safely promoted the one with the higher election priority and then the
+// greater xlog position.
+func drainSwitchoverTarget(cd *cluster.ClusterData, keeperUID string) (string, error) {
+	priority := func(uid string) int {
+		if k := cd.Keepers[uid]; k.Spec != nil {
+			return k.Spec.ElectionPriority
+		}
+		return 0
+	}
+	var target *cluster.DB
+	for _, uid := range cd.Keepers.SortedKeys() {
+		if uid == keeperUID || checkFailoverTarget(cd, uid, false) != nil {
+			continue
+		}
+		db := getDbForKeeper(cd.DBs, uid)
+		if target == nil {
+			target = db
+			continue
+		}
+		p, tp := priority(uid), priority(target.Spec.KeeperUID)
+		if p > tp || (p == tp && db.Status.XLogPos > target.Status.XLogPos) {
+			target = db
+		}
+	}
+	if target == nil {
+		return "", fmt.Errorf("no standby can be elected as the new master")
+	}
+	return target.Spec.KeeperUID, nil
+}
+
+func drainKeeper(cmd *cobra.Command, args []string) {
+	if len(args) > 1 {
+		die("too many arguments")
+	}
+
+	if len(args) == 0 {
+		die("keeper uid required")
+	}
+
+	keeperID := args[0]
+
+	store, err := newSpecStore()
+	if err != nil {
+		die("%v", err)
+	}
+
+	cd, pair, err := getClusterData(store)
+	if err != nil {
+		die("cannot get cluster data: %v", err)
+	}
+
+	newCd := cd.DeepCopy()
+	if err := setKeeperDrained(newCd, keeperID, true); err != nil {
+		die("cannot drain keeper: %v", err)
+	}
+
+	isMaster := false
+	if db := getDbForKeeper(cd.DBs, keeperID); db != nil && cd.Cluster != nil && db.UID == cd.Cluster.Status.Master {
+		isMaster = true
+	}
+	switchoverTarget := ""
+	if isMaster && drainKeeperOpts.switchover {
+		switchoverTarget, err = drainSwitchoverTarget(newCd, keeperID)
+		if err != nil {
+			die("cannot switchover from keeper %q: %v", keeperID, err)
+		}
+		newCd.Cluster.Status.Switchover = &cluster.Switchover{
+			TargetKeeper: switchoverTarget,
+			Phase:        cluster.SwitchoverPhaseRequested,
+		}
+	}
+
+	_, err = store.AtomicPutClusterData(context.TODO(), newCd, pair)
+	if err != nil {
+		die("cannot update cluster data: %v", err)
+	}
+	stdout("keeper %q drained", keeperID)
+	switch {
+	case switchoverTarget != "":
+		stdout("requested switchover to keeper %q", switchoverTarget)
+	case isMaster:
+		stdout("WARNING: keeper %q db is the current master, use --switchover to switch the master role to another keeper", keeperID)
+	}
+}
+
+func undrainKeeper(cmd *cobra.Command, args []string) {
+	if len(args) > 1 {
+		die("too many arguments")
+	}
+
+	if len(args) == 0 {
+		die("keeper uid required")
+	}
+
+	keeperID := args[0]
+
+	store, err := newSpecStore()
+	if err != nil {
+		die("%v", err)
+	}
+
+	cd, pair, err := getClusterData(store)
+	if err != nil {
+		die("cannot get cluster data: %v", err)
+	}
+
+	newCd := cd.DeepCopy()
+	if err := setKeeperDrained(newCd, keeperID, false); err != nil {
+		die("cannot undrain keeper: %v", err)
+	}
+
+	_, err = store.AtomicPutClusterData(context.TODO(), newCd, pair)
+	if err != nil {
+		die("cannot update cluster data: %v", err)
+	}
+	stdout("keeper %q undrained", keeperID)
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+func TestSetKeeperDrained(t *testing.T) {
+	tests := []struct {
+		keeperUID string
+		drained   bool
+		err       error
+	}{
+		{keeperUID: "keeper1", drained: true},
+		{keeperUID: "keeper2", drained: true},
+		{keeperUID: "keeper3", drained: true, err: fmt.Errorf(`keeper "keeper3" is already drained`)},
+		{keeperUID: "keeper3", drained: false},
+		{keeperUID: "keeper1", drained: false, err: fmt.Errorf(`keeper "keeper1" isn't drained`)},
+		{keeperUID: "keeper10", drained: true, err: fmt.Errorf(`keeper "keeper10" doesn't exist`)},
+	}
+
+	for i, tt := range tests {
+		cd := testClusterData(2, false)
+		// a keeper without a spec
+		cd.Keepers["keeper2"].Spec = nil
+		cd.Keepers["keeper3"].Spec.Drained = true
+		err := setKeeperDrained(cd, tt.keeperUID, tt.drained)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if d := cd.Keepers[tt.keeperUID].Spec.Drained; d != tt.drained {
+			t.Errorf("#%d: got drained: %t, want: %t", i, d, tt.drained)
+		}
+	}
+}
+
+func TestDrainSwitchoverTarget(t *testing.T) {
+	tests := []struct {
+		name   string
+		cd     func() *cluster.ClusterData
+		target string
+		err    error
+	}{
+		{
+			name: "greater xlog position",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, false)
+				cd.DBs["db3"].Status.XLogPos = 10
+				return cd
+			},
+			target: "keeper3",
+		},
+		{
+			name: "higher election priority",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, false)
+				cd.DBs["db3"].Status.XLogPos = 10
+				cd.Keepers["keeper2"].Spec.ElectionPriority = 1
+				return cd
+			},
+			target: "keeper2",
+		},
+		{
+			name: "drained standby",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, false)
+				cd.DBs["db3"].Status.XLogPos = 10
+				cd.Keepers["keeper3"].Spec.Drained = true
+				return cd
+			},
+			target: "keeper2",
+		},
+		{
+			name: "no valid standby",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(1, false)
+				cd.Keepers["keeper2"].Status.Healthy = false
+				return cd
+			},
+			err: fmt.Errorf("no standby can be elected as the new master"),
+		},
+	}
+
+	for i, tt := range tests {
+		target, err := drainSwitchoverTarget(tt.cd(), "keeper1")
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d (%s): got no error, wanted error: %v", i, tt.name, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d (%s): got error: %v, wanted error: %v", i, tt.name, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d (%s): unexpected error: %v", i, tt.name, err)
+		} else if target != tt.target {
+			t.Errorf("#%d (%s): got target: %q, want: %q", i, tt.name, target, tt.target)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	cmdcommon "github.com/sorintlab/stolon/cmd"
+	"github.com/sorintlab/stolon/internal/cluster"
+
+	"github.com/spf13/cobra"
+)
+
+var cmdEvents = &cobra.Command{
+	Use:   "events",
+	Run:   events,
+	Short: "List the cluster events saved in the store event log",
+	Long:  `List the cluster events (new master elected, keeper failed, synchronous standbys changed, cluster unhealthy and healthy) saved by the leader sentinel in the store event log, oldest first. The event log is enabled with the sentinel --events-log-size option.`,
+}
+
+type eventsOptions struct {
+	outputOptions
+}
+
+var eventsOpts eventsOptions
+
+func init() {
+	addOutputFlags(cmdEvents, &eventsOpts.outputOptions, outputText, outputText, outputJSON, outputYAML)
+
+	CmdStolonCtl.AddCommand(cmdEvents)
+}
+
+// eventDetails returns the event details reported by the text output
+func eventDetails(ev *cluster.Event) string {
+	switch ev.Type {
+	case cluster.EventMasterElected:
+		if ev.PreviousMasterDBUID != "" {
+			return fmt.Sprintf("previous master db: %s", ev.PreviousMasterDBUID)
+		}
+	case cluster.EventSynchronousStandbysChanged:
+		return fmt.Sprintf("synchronous standbys: [%s]", strings.Join(ev.SynchronousStandbys, ", "))
+	}
+	return ""
+}
+
+func writeEventsText(w io.Writer, events []*cluster.Event) {
+	if len(events) == 0 {
+		fmt.Fprintf(w, "No events\n")
+		return
+	}
+	tabOut := new(tabwriter.Writer)
+	tabOut.Init(w, 0, 8, 1, '\t', 0)
+	fmt.Fprintf(tabOut, "TIME\tEVENT\tDB\tKEEPER\tDETAILS\n")
+	for _, ev := range events {
+		fmt.Fprintf(tabOut, "%s\t%s\t%s\t%s\t%s\n", ev.Time.Format(time.RFC3339), ev.Type, ev.DBUID, ev.KeeperUID, eventDetails(ev))
+	}
+	tabOut.Flush()
+}
+
+func events(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		die("too many arguments")
+	}
+	if err := eventsOpts.validate(outputText, outputJSON, outputYAML); err != nil {
+		die("%v", err)
+	}
+
+	e, err := cmdcommon.NewStore(&cfg.CommonConfig)
+	if err != nil {
+		die("%v", err)
+	}
+
+	events, err := e.GetEvents(context.TODO())
+	if err != nil {
+		die("cannot get events: %v", err)
+	}
+
+	if eventsOpts.output != outputText || eventsOpts.template != "" {
+		if err := writeOutput(os.Stdout, events, eventsOpts.outputOptions, true); err != nil {
+			die("%v", err)
+		}
+		return
+	}
+	writeEventsText(os.Stdout, events)
+}
@@ -0,0 +1,57 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+func TestWriteEventsText(t *testing.T) {
+	now := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	events := []*cluster.Event{
+		{Type: cluster.EventKeeperFailed, Time: now, KeeperUID: "keeper1"},
+		{Type: cluster.EventMasterElected, Time: now, DBUID: "db2", KeeperUID: "keeper2", PreviousMasterDBUID: "db1"},
+		{Type: cluster.EventSynchronousStandbysChanged, Time: now, DBUID: "db2", KeeperUID: "keeper2", SynchronousStandbys: []string{"db3", "db4"}},
+	}
+
+	var buf bytes.Buffer
+	writeEventsText(&buf, events)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	expected := [][]string{
+		{"TIME", "EVENT", "DB", "KEEPER", "DETAILS"},
+		{"2018-01-02T03:04:05Z", "keeperFailed", "keeper1"},
+		{"2018-01-02T03:04:05Z", "masterElected", "db2", "keeper2", "previous", "master", "db:", "db1"},
+		{"2018-01-02T03:04:05Z", "synchronousStandbysChanged", "db2", "keeper2", "synchronous", "standbys:", "[db3,", "db4]"},
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("got %d lines, want: %d: %s", len(lines), len(expected), buf.String())
+	}
+	for i, line := range lines {
+		if got := strings.Join(strings.Fields(line), " "); got != strings.Join(expected[i], " ") {
+			t.Errorf("#%d: got line: %q, want: %q", i, got, strings.Join(expected[i], " "))
+		}
+	}
+
+	buf.Reset()
+	writeEventsText(&buf, nil)
+	if got := buf.String(); got != "No events\n" {
+		t.Errorf("got: %q, want: %q", got, "No events\n")
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	pg "github.com/sorintlab/stolon/internal/postgresql"
+
+	_ "github.com/lib/pq"
+	"github.com/spf13/cobra"
+)
+
+var cmdExec = &cobra.Command{
+	Use:   "exec",
+	Run:   execSQL,
+	Short: "Execute sql on the current master db",
+	Long:  `Execute the sql provided with --command or read from --file (- for stdin) connecting directly to the current master db (the address reported by its keeper) without going through the proxies. The returned rows are printed as a table or, with --output json or yaml, as a list of column name to value maps.`,
+}
+
+type execOptions struct {
+	outputOptions
+	command      string
+	file         string
+	username     string
+	password     string
+	passwordFile string
+	dbname       string
+	sslMode      string
+	timeout      time.Duration
+}
+
+var execOpts execOptions
+
+func init() {
+	cmdExec.PersistentFlags().StringVarP(&execOpts.command, "command", "c", "", "sql to execute")
+	cmdExec.PersistentFlags().StringVarP(&execOpts.file, "file", "f", "", "file containing the sql to execute (- for stdin)")
+	cmdExec.PersistentFlags().StringVar(&execOpts.username, "username", "", "postgres user used to connect to the master db")
+	cmdExec.PersistentFlags().StringVar(&execOpts.password, "password", "", "postgres user password. Only one of --password or --passwordfile can be provided")
+	cmdExec.PersistentFlags().StringVar(&execOpts.passwordFile, "passwordfile", "", "postgres user password file. Only one of --password or --passwordfile can be provided")
+	cmdExec.PersistentFlags().StringVar(&execOpts.dbname, "dbname", "postgres", "database to connect to")
+	cmdExec.PersistentFlags().StringVar(&execOpts.sslMode, "sslmode", "disable", "connection ssl mode (one of: disable, require, verify-ca, verify-full)")
+	cmdExec.PersistentFlags().DurationVar(&execOpts.timeout, "timeout", 0, "sql execution timeout. 0 means no timeout")
+	addOutputFlags(cmdExec, &execOpts.outputOptions, outputText, outputText, outputJSON, outputYAML)
+
+	CmdStolonCtl.AddCommand(cmdExec)
+}
+
+// execMasterDB returns the current master db checking that it can be
+// connected to
+func execMasterDB(cd *cluster.ClusterData) (*cluster.DB, error) {
+	if cd.Cluster == nil {
+		return nil, fmt.Errorf("no cluster available")
+	}
+	db, ok := cd.DBs[cd.Cluster.Status.Master]
+	if !ok {
+		return nil, fmt.Errorf("no master db available")
+	}
+	if !db.Status.Healthy {
+		return nil, fmt.Errorf("master db %q isn't healthy", db.UID)
+	}
+	if db.Status.ListenAddress == "" || db.Status.Port == "" {
+		return nil, fmt.Errorf("master db %q address not reported by its keeper", db.UID)
+	}
+	return db, nil
+}
+
+// execConnParams returns the connection parameters to the master db
+func execConnParams(db *cluster.DB, o execOptions, password string) pg.ConnParams {
+	cp := pg.ConnParams{
+		"user":             o.username,
+		"host":             db.Status.ListenAddress,
+		"port":             db.Status.Port,
+		"dbname":           o.dbname,
+		"sslmode":          o.sslMode,
+		"application_name": "stolonctl",
+	}
+	if password != "" {
+		cp.Set("password", password)
+	}
+	return cp
+}
+
+// execResult are the rows returned by the executed sql
+type execResult struct {
+	columns []string
+	rows    [][]interface{}
+}
+
+// records returns the rows as column name to value maps
+func (r *execResult) records() []map[string]interface{} {
+	records := []map[string]interface{}{}
+	for _, row := range r.rows {
+		record := map[string]interface{}{}
+		for i, c := range r.columns {
+			record[c] = row[i]
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func (r *execResult) writeText(w io.Writer) {
+	if len(r.columns) == 0 {
+		return
+	}
+	tabOut := new(tabwriter.Writer)
+	tabOut.Init(w, 0, 8, 1, '\t', 0)
+	fmt.Fprintf(tabOut, "%s\n", strings.Join(r.columns, "\t"))
+	for _, row := range r.rows {
+		values := make([]string, len(row))
+		for i, v := range row {
+			if v != nil {
+				values[i] = fmt.Sprintf("%v", v)
+			}
+		}
+		fmt.Fprintf(tabOut, "%s\n", strings.Join(values, "\t"))
+	}
+	tabOut.Flush()
+	fmt.Fprintf(w, "(%d rows)\n", len(r.rows))
+}
+
+// scanRows reads all the rows. Text and binary values are returned as strings.
+func scanRows(rows *sql.Rows) (*execResult, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	r := &execResult{columns: columns, rows: [][]interface{}{}}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		r.rows = append(r.rows, values)
+	}
+	return r, rows.Err()
+}
+
+func readExecSQL(o execOptions) (string, error) {
+	if (o.command == "") == (o.file == "") {
+		return "", fmt.Errorf("one of --command or --file must be provided")
+	}
+	if o.command != "" {
+		return o.command, nil
+	}
+	var data []byte
+	var err error
+	if o.file == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(o.file)
+	}
+	if err != nil {
+		return "", fmt.Errorf("cannot read sql file: %v", err)
+	}
+	return string(data), nil
+}
+
+func execSQL(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		die("too many arguments")
+	}
+	if err := execOpts.validate(outputText, outputJSON, outputYAML); err != nil {
+		die("%v", err)
+	}
+	if execOpts.username == "" {
+		die("--username is required")
+	}
+	if execOpts.password != "" && execOpts.passwordFile != "" {
+		die("only one of --password or --passwordfile can be provided")
+	}
+	query, err := readExecSQL(execOpts)
+	if err != nil {
+		die("%v", err)
+	}
+	password := execOpts.password
+	if execOpts.passwordFile != "" {
+		p, err := ioutil.ReadFile(execOpts.passwordFile)
+		if err != nil {
+			die("cannot read password file: %v", err)
+		}
+		password = strings.TrimSpace(string(p))
+	}
+
+	store, err := newSpecStore()
+	if err != nil {
+		die("%v", err)
+	}
+	cd, _, err := getClusterData(store)
+	if err != nil {
+		die("%v", err)
+	}
+	masterDB, err := execMasterDB(cd)
+	if err != nil {
+		die("%v", err)
+	}
+
+	db, err := sql.Open("postgres", execConnParams(masterDB, execOpts, password).ConnString())
+	if err != nil {
+		die("%v", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	if execOpts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, execOpts.timeout)
+		defer cancel()
+	}
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		die("failed to execute sql on master db %q (keeper %s): %v", masterDB.UID, masterDB.Spec.KeeperUID, err)
+	}
+	defer rows.Close()
+	r, err := scanRows(rows)
+	if err != nil {
+		die("failed to read the returned rows: %v", err)
+	}
+
+	if execOpts.output == outputText && execOpts.template == "" {
+		r.writeText(os.Stdout)
+		return
+	}
+	if err := writeOutput(os.Stdout, r.records(), execOpts.outputOptions, true); err != nil {
+		die("%v", err)
+	}
+}
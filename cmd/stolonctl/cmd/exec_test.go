@@ -0,0 +1,177 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+func TestExecMasterDB(t *testing.T) {
+	withAddress := func(cd *cluster.ClusterData) {
+		cd.DBs["db1"].Status.ListenAddress = "10.0.0.1"
+		cd.DBs["db1"].Status.Port = "5432"
+	}
+	tests := []struct {
+		name string
+		cd   func(cd *cluster.ClusterData)
+		err  error
+	}{
+		{
+			name: "healthy master",
+			cd:   withAddress,
+		},
+		{
+			name: "no master",
+			cd: func(cd *cluster.ClusterData) {
+				withAddress(cd)
+				cd.Cluster.Status.Master = ""
+			},
+			err: fmt.Errorf("no master db available"),
+		},
+		{
+			name: "unhealthy master",
+			cd: func(cd *cluster.ClusterData) {
+				withAddress(cd)
+				cd.DBs["db1"].Status.Healthy = false
+			},
+			err: fmt.Errorf(`master db "db1" isn't healthy`),
+		},
+		{
+			name: "no address",
+			cd:   func(cd *cluster.ClusterData) {},
+			err:  fmt.Errorf(`master db "db1" address not reported by its keeper`),
+		},
+	}
+
+	for i, tt := range tests {
+		cd := testClusterData(1, false)
+		tt.cd(cd)
+		db, err := execMasterDB(cd)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d (%s): got no error, wanted error: %v", i, tt.name, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d (%s): got error: %v, wanted error: %v", i, tt.name, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d (%s): unexpected error: %v", i, tt.name, err)
+		} else if db.UID != "db1" {
+			t.Errorf("#%d (%s): wrong master db: %s", i, tt.name, db.UID)
+		}
+	}
+}
+
+func TestExecConnParams(t *testing.T) {
+	db := &cluster.DB{Status: cluster.DBStatus{ListenAddress: "10.0.0.1", Port: "5433"}}
+	o := execOptions{username: "admin", dbname: "app", sslMode: "require"}
+
+	cp := execConnParams(db, o, "secret")
+	expected := map[string]string{"user": "admin", "host": "10.0.0.1", "port": "5433", "dbname": "app", "sslmode": "require", "application_name": "stolonctl", "password": "secret"}
+	if !reflect.DeepEqual(map[string]string(cp), expected) {
+		t.Errorf("got conn params: %v, want: %v", cp, expected)
+	}
+	if cp := execConnParams(db, o, ""); cp.Isset("password") {
+		t.Errorf("unexpected password in conn params: %v", cp)
+	}
+}
+
+func TestExecResult(t *testing.T) {
+	r := &execResult{
+		columns: []string{"name", "value"},
+		rows: [][]interface{}{
+			{"a", int64(1)},
+			{"b", nil},
+		},
+	}
+
+	records := r.records()
+	expected := []map[string]interface{}{
+		{"name": "a", "value": int64(1)},
+		{"name": "b", "value": nil},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("got records: %v, want: %v", records, expected)
+	}
+
+	var buf bytes.Buffer
+	r.writeText(&buf)
+	out := "name\tvalue\na\t1\nb\t\n(2 rows)\n"
+	if buf.String() != out {
+		t.Errorf("got text output:\n%q\nwant:\n%q", buf.String(), out)
+	}
+
+	// no rows returned (i.e. an update)
+	buf.Reset()
+	(&execResult{}).writeText(&buf)
+	if buf.Len() != 0 {
+		t.Errorf("got text output: %q, want no output", buf.String())
+	}
+}
+
+func TestReadExecSQL(t *testing.T) {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("select 1;\n"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f.Close()
+
+	tests := []struct {
+		o   execOptions
+		sql string
+		err error
+	}{
+		{
+			o:   execOptions{command: "select now()"},
+			sql: "select now()",
+		},
+		{
+			o:   execOptions{file: f.Name()},
+			sql: "select 1;\n",
+		},
+		{
+			err: fmt.Errorf("one of --command or --file must be provided"),
+		},
+		{
+			o:   execOptions{command: "select now()", file: f.Name()},
+			err: fmt.Errorf("one of --command or --file must be provided"),
+		},
+	}
+
+	for i, tt := range tests {
+		sql, err := readExecSQL(tt.o)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		} else if sql != tt.sql {
+			t.Errorf("#%d: got sql: %q, want: %q", i, sql, tt.sql)
+		}
+	}
+}
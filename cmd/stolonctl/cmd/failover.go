@@ -0,0 +1,162 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	cmdcommon "github.com/sorintlab/stolon/cmd"
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+	"github.com/sorintlab/stolon/internal/util"
+
+	"github.com/spf13/cobra"
+)
+
+var failoverCmd = &cobra.Command{
+	Use:   "failover",
+	Short: "Promote the db of the provided keeper as the new master",
+	Long:  `Promote the db of the provided keeper as the new master. It's just a one shot operation, the sentinel will elect the target keeper db as the new master only if it's still a healthy standby with a lag not greater than maxStandbyLag (or an in sync synchronous standby when using synchronous replication), otherwise the request will be ignored. With --force the lag isn't checked (when using synchronous replication it must be an in sync synchronous standby also when forced).`,
+	Run:   failover,
+}
+
+type failoverOptions struct {
+	targetKeeper string
+	force        bool
+}
+
+var failoverOpts failoverOptions
+
+func init() {
+	failoverCmd.PersistentFlags().StringVar(&failoverOpts.targetKeeper, "target-keeper", "", "uid of the keeper to promote as the new master")
+	failoverCmd.PersistentFlags().BoolVar(&failoverOpts.force, "force", false, "promote the keeper db also if its lag is greater than maxStandbyLag")
+
+	CmdStolonCtl.AddCommand(failoverCmd)
+}
+
+func failover(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		die("too many arguments")
+	}
+
+	if failoverOpts.targetKeeper == "" {
+		die("--target-keeper is required")
+	}
+
+	store, err := cmdcommon.NewStore(&cfg.CommonConfig)
+	if err != nil {
+		die("%v", err)
+	}
+
+	failoverToKeeper(store, failoverOpts.targetKeeper, failoverOpts.force)
+}
+
+// failoverToKeeper requests the sentinel to elect the db of the provided
+// keeper as the new master
+func failoverToKeeper(e clusterDataStore, keeperUID string, force bool) {
+	cd, pair, err := getClusterData(e)
+	if err != nil {
+		die("cannot get cluster data: %v", err)
+	}
+
+	if err := checkFailoverTarget(cd, keeperUID, force); err != nil {
+		die("cannot failover to keeper %q: %v", keeperUID, err)
+	}
+
+	newCd := cd.DeepCopy()
+	newCd.Cluster.Status.FailoverTargetKeeper = keeperUID
+	newCd.Cluster.Status.FailoverTargetForce = force
+
+	_, err = e.AtomicPutClusterData(context.TODO(), newCd, pair)
+	if err != nil {
+		die("cannot update cluster data: %v", err)
+	}
+	stdout("requested failover to keeper %q", keeperUID)
+}
+
+// checkFailoverTarget checks if the db of the provided keeper can be safely
+// promoted as the new master. It returns an error describing the reason when
+// it cannot. When force is true the db lag isn't checked.
+func checkFailoverTarget(cd *cluster.ClusterData, keeperID string, force bool) error {
+	if cd.Cluster == nil || cd.Cluster.Spec == nil {
+		return fmt.Errorf("no cluster spec available")
+	}
+	if cd.Cluster.Status.Phase != cluster.ClusterPhaseNormal {
+		return fmt.Errorf("cluster is not in the %q phase", cluster.ClusterPhaseNormal)
+	}
+	if cd.Cluster.Status.FailoverTargetKeeper != "" {
+		return fmt.Errorf("a failover to keeper %q is already requested", cd.Cluster.Status.FailoverTargetKeeper)
+	}
+	if sw := cd.Cluster.Status.Switchover; sw != nil {
+		return fmt.Errorf("a switchover to keeper %q is in progress", sw.TargetKeeper)
+	}
+	k, ok := cd.Keepers[keeperID]
+	if !ok {
+		return fmt.Errorf("keeper doesn't exist")
+	}
+	if !k.Status.Healthy {
+		return fmt.Errorf("keeper isn't healthy")
+	}
+	if k.Spec != nil && k.Spec.Drained {
+		return fmt.Errorf("keeper is drained")
+	}
+	if k.Spec != nil && k.Spec.Maintenance {
+		return fmt.Errorf("keeper is in maintenance")
+	}
+
+	db := getDbForKeeper(cd.DBs, keeperID)
+	if db == nil {
+		return fmt.Errorf("keeper doesn't have an assigned db")
+	}
+
+	masterUID := cd.Cluster.Status.Master
+	masterDB, ok := cd.DBs[masterUID]
+	if !ok {
+		return fmt.Errorf("no master db available")
+	}
+	if db.UID == masterUID {
+		return fmt.Errorf("keeper assigned db is already the current cluster master db")
+	}
+	if db.Spec.Role != common.RoleStandby || db.Spec.FollowConfig == nil || db.Spec.FollowConfig.Type != cluster.FollowTypeInternal || db.Spec.FollowConfig.DBUID != masterUID {
+		return fmt.Errorf("keeper assigned db isn't a standby of the current cluster master db")
+	}
+	if !db.Status.Healthy {
+		return fmt.Errorf("keeper assigned db isn't healthy")
+	}
+	if db.Generation != db.Status.CurrentGeneration {
+		return fmt.Errorf("keeper assigned db is converging to a new spec")
+	}
+	if db.Status.TimelineID != masterDB.Status.TimelineID {
+		return fmt.Errorf("keeper assigned db timeline %d is different than the master timeline %d", db.Status.TimelineID, masterDB.Status.TimelineID)
+	}
+
+	if *cd.Cluster.DefSpec().SynchronousReplication {
+		syncStandbys := util.CommonElements(masterDB.Status.SynchronousStandbys, masterDB.Spec.SynchronousStandbys)
+		if !util.StringInSlice(syncStandbys, db.UID) {
+			return fmt.Errorf("keeper assigned db isn't an in sync synchronous standby")
+		}
+		return nil
+	}
+
+	if force {
+		return nil
+	}
+	lag := int64(masterDB.Status.XLogPos - db.Status.XLogPos)
+	if maxLag := int64(*cd.Cluster.DefSpec().MaxStandbyLag); lag > maxLag {
+		return fmt.Errorf("keeper assigned db lag (%d bytes) is greater than maxStandbyLag (%d bytes)", lag, maxLag)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+func TestCheckFailoverTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		cd       func() *cluster.ClusterData
+		keeperID string
+		force    bool
+		err      error
+	}{
+		{
+			name:     "healthy standby",
+			cd:       func() *cluster.ClusterData { return testClusterData(2, false) },
+			keeperID: "keeper2",
+		},
+		{
+			name:     "not existing keeper",
+			cd:       func() *cluster.ClusterData { return testClusterData(2, false) },
+			keeperID: "keeper9",
+			err:      fmt.Errorf("keeper doesn't exist"),
+		},
+		{
+			name:     "master",
+			cd:       func() *cluster.ClusterData { return testClusterData(2, false) },
+			keeperID: "keeper1",
+			err:      fmt.Errorf("keeper assigned db is already the current cluster master db"),
+		},
+		{
+			name: "unhealthy keeper",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, false)
+				cd.Keepers["keeper2"].Status.Healthy = false
+				return cd
+			},
+			keeperID: "keeper2",
+			err:      fmt.Errorf("keeper isn't healthy"),
+		},
+		{
+			name: "drained keeper",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, false)
+				cd.Keepers["keeper2"].Spec.Drained = true
+				return cd
+			},
+			keeperID: "keeper2",
+			err:      fmt.Errorf("keeper is drained"),
+		},
+		{
+			name: "keeper in maintenance",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, false)
+				cd.Keepers["keeper2"].Spec.Maintenance = true
+				return cd
+			},
+			keeperID: "keeper2",
+			err:      fmt.Errorf("keeper is in maintenance"),
+		},
+		{
+			name: "unhealthy db",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, false)
+				cd.DBs["db2"].Status.Healthy = false
+				return cd
+			},
+			keeperID: "keeper2",
+			err:      fmt.Errorf("keeper assigned db isn't healthy"),
+		},
+		{
+			name: "keeper without an assigned db",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(1, false)
+				cd.Keepers["keeper9"] = &cluster.Keeper{UID: "keeper9", Spec: &cluster.KeeperSpec{}, Status: cluster.KeeperStatus{Healthy: true}}
+				return cd
+			},
+			keeperID: "keeper9",
+			err:      fmt.Errorf("keeper doesn't have an assigned db"),
+		},
+		{
+			name: "db not following the master",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, false)
+				cd.DBs["db3"].Spec.FollowConfig.DBUID = "db2"
+				return cd
+			},
+			keeperID: "keeper3",
+			err:      fmt.Errorf("keeper assigned db isn't a standby of the current cluster master db"),
+		},
+		{
+			name: "lag too big",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, false)
+				cd.DBs["db1"].Status.XLogPos = 10 * cluster.DefaultMaxStandbyLag
+				cd.DBs["db2"].Status.XLogPos = 5 * cluster.DefaultMaxStandbyLag
+				return cd
+			},
+			keeperID: "keeper2",
+			err:      fmt.Errorf("keeper assigned db lag (6164480 bytes) is greater than maxStandbyLag (1232896 bytes)"),
+		},
+		{
+			name: "forced lag too big",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, false)
+				cd.DBs["db1"].Status.XLogPos = 10 * cluster.DefaultMaxStandbyLag
+				cd.DBs["db2"].Status.XLogPos = 5 * cluster.DefaultMaxStandbyLag
+				return cd
+			},
+			keeperID: "keeper2",
+			force:    true,
+		},
+		{
+			name: "lag below max",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, false)
+				cd.DBs["db1"].Status.XLogPos = 10 * cluster.DefaultMaxStandbyLag
+				cd.DBs["db2"].Status.XLogPos = 10*cluster.DefaultMaxStandbyLag - 100
+				return cd
+			},
+			keeperID: "keeper2",
+		},
+		{
+			name: "different timeline",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, false)
+				cd.DBs["db1"].Status.TimelineID = 2
+				cd.DBs["db2"].Status.TimelineID = 1
+				return cd
+			},
+			keeperID: "keeper2",
+			err:      fmt.Errorf("keeper assigned db timeline 1 is different than the master timeline 2"),
+		},
+		{
+			name: "in sync synchronous standby",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, true)
+				cd.DBs["db1"].Spec.SynchronousStandbys = []string{"db2"}
+				cd.DBs["db1"].Status.SynchronousStandbys = []string{"db2"}
+				return cd
+			},
+			keeperID: "keeper2",
+		},
+		{
+			name: "not synchronous standby with synchronous replication",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, true)
+				cd.DBs["db1"].Spec.SynchronousStandbys = []string{"db2"}
+				cd.DBs["db1"].Status.SynchronousStandbys = []string{"db2"}
+				return cd
+			},
+			keeperID: "keeper3",
+			err:      fmt.Errorf("keeper assigned db isn't an in sync synchronous standby"),
+		},
+		{
+			name: "failover already requested",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, false)
+				cd.Cluster.Status.FailoverTargetKeeper = "keeper3"
+				return cd
+			},
+			keeperID: "keeper2",
+			err:      fmt.Errorf(`a failover to keeper "keeper3" is already requested`),
+		},
+		{
+			name: "switchover in progress",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, false)
+				cd.Cluster.Status.Switchover = &cluster.Switchover{TargetKeeper: "keeper3", Phase: cluster.SwitchoverPhaseCatchingUp}
+				return cd
+			},
+			keeperID: "keeper2",
+			err:      fmt.Errorf(`a switchover to keeper "keeper3" is in progress`),
+		},
+	}
+
+	for i, tt := range tests {
+		err := checkFailoverTarget(tt.cd(), tt.keeperID, tt.force)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d (%s): got no error, wanted error: %v", i, tt.name, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d (%s): got error: %v, wanted error: %v", i, tt.name, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d (%s): unexpected error: %v", i, tt.name, err)
+		}
+	}
+}
@@ -117,6 +117,9 @@ func initCluster(cmd *cobra.Command, args []string) {
 	if err := cs.Validate(); err != nil {
 		die("invalid cluster spec: %v", err)
 	}
+	for _, w := range standbyConflictsWarnings(cs) {
+		stdout("WARNING: %s", w)
+	}
 
 	c := cluster.NewCluster(common.UID(), cs)
 	cd = cluster.NewClusterData(c)
@@ -125,4 +128,5 @@ func initCluster(cmd *cobra.Command, args []string) {
 	if err := e.PutClusterData(context.TODO(), cd); err != nil {
 		die("cannot update cluster data: %v", err)
 	}
+	recordSpecChange(e, cd.Cluster, "init", nil)
 }
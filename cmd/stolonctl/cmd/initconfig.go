@@ -0,0 +1,84 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	cmdcommon "github.com/sorintlab/stolon/cmd"
+	"github.com/sorintlab/stolon/internal/cluster"
+
+	"github.com/spf13/cobra"
+)
+
+var cmdInitConfig = &cobra.Command{
+	Use:   "initconfig",
+	Run:   initConfig,
+	Short: "Retrieve the configuration used to initialize the cluster",
+	Long:  `Retrieve the configuration used to initialize the cluster. It's recorded when the cluster initialization completes and isn't changed by later cluster spec updates.`,
+}
+
+type initConfigOptions struct {
+	outputOptions
+}
+
+var initConfigOpts initConfigOptions
+
+func init() {
+	addOutputFlags(cmdInitConfig, &initConfigOpts.outputOptions, outputJSON, outputJSON, outputYAML)
+
+	CmdStolonCtl.AddCommand(cmdInitConfig)
+}
+
+func initConfig(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		die("too many arguments")
+	}
+	if err := initConfigOpts.validate(outputJSON, outputYAML); err != nil {
+		die("%v", err)
+	}
+
+	e, err := cmdcommon.NewStore(&cfg.CommonConfig)
+	if err != nil {
+		die("%v", err)
+	}
+
+	cd, _, err := getClusterData(e)
+	if err != nil {
+		die("%v", err)
+	}
+
+	ic, err := getInitConfig(cd)
+	if err != nil {
+		die("%v", err)
+	}
+	if err := writeOutput(os.Stdout, ic, initConfigOpts.outputOptions, true); err != nil {
+		die("%v", err)
+	}
+}
+
+func getInitConfig(cd *cluster.ClusterData) (*cluster.InitConfig, error) {
+	if cd.Cluster == nil {
+		return nil, fmt.Errorf("no cluster data available")
+	}
+	if cd.Cluster.Status.InitConfig == nil {
+		if cd.Cluster.Status.Phase == cluster.ClusterPhaseInitializing {
+			return nil, fmt.Errorf("cluster is initializing, the init configuration will be available when the initialization completes")
+		}
+		return nil, fmt.Errorf("no init configuration recorded, the cluster was initialized by a stolon version not recording it")
+	}
+	return cd.Cluster.Status.InitConfig, nil
+}
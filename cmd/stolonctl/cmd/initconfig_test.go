@@ -0,0 +1,104 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+func TestGetInitConfig(t *testing.T) {
+	initConfig := &cluster.InitConfig{
+		InitMode:  cluster.ClusterInitModeNew,
+		Role:      cluster.ClusterRoleMaster,
+		NewConfig: &cluster.NewConfig{Locale: "en_US.UTF-8", DataChecksums: true},
+		DBUID:     "db1",
+		KeeperUID: "keeper1",
+	}
+
+	tests := []struct {
+		name     string
+		cd       func() *cluster.ClusterData
+		template string
+		out      string
+		err      error
+	}{
+		{
+			name: "recorded init config",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(1, false)
+				cd.Cluster.Status.InitConfig = initConfig
+				return cd
+			},
+			template: "{{.initMode}} {{.newConfig.locale}} {{.newConfig.dataChecksums}}",
+			out:      "new en_US.UTF-8 true\n",
+		},
+		{
+			name: "init config not changed by spec updates",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(1, false)
+				cd.Cluster.Status.InitConfig = initConfig
+				cd.Cluster.Spec.InitMode = cluster.ClusterInitModeP(cluster.ClusterInitModeNew)
+				ns := cd.Cluster.Spec.DeepCopy()
+				ns.NewConfig = &cluster.NewConfig{Locale: "C"}
+				if err := cd.Cluster.UpdateSpec(ns); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return cd
+			},
+			template: "{{.newConfig.locale}}",
+			out:      "en_US.UTF-8\n",
+		},
+		{
+			name: "initializing cluster",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(1, false)
+				cd.Cluster.Status.Phase = cluster.ClusterPhaseInitializing
+				return cd
+			},
+			err: fmt.Errorf("cluster is initializing, the init configuration will be available when the initialization completes"),
+		},
+		{
+			name: "cluster initialized by an older version",
+			cd:   func() *cluster.ClusterData { return testClusterData(1, false) },
+			err:  fmt.Errorf("no init configuration recorded, the cluster was initialized by a stolon version not recording it"),
+		},
+	}
+
+	for i, tt := range tests {
+		ic, err := getInitConfig(tt.cd())
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d (%s): got no error, wanted error: %v", i, tt.name, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d (%s): got error: %v, wanted error: %v", i, tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d (%s): unexpected error: %v", i, tt.name, err)
+			continue
+		}
+		var buf bytes.Buffer
+		if err := writeOutput(&buf, ic, outputOptions{template: tt.template}, false); err != nil {
+			t.Errorf("#%d (%s): unexpected error: %v", i, tt.name, err)
+		} else if buf.String() != tt.out {
+			t.Errorf("#%d (%s): wrong output: got: %q, want: %q", i, tt.name, buf.String(), tt.out)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// jsonPatchOp is a RFC 6902 json patch operation
+type jsonPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// decodeJSON decodes data using json.Number to avoid converting integers to
+// floats
+func decodeJSON(data []byte) (interface{}, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// parseJSONPointer returns the unescaped reference tokens of a RFC 6901 json
+// pointer
+func parseJSONPointer(p string) ([]string, error) {
+	if p == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("json pointer %q doesn't start with /", p)
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// jsonArrayIndex parses the array index token. When end is true the "-"
+// token (the index after the last element) is accepted.
+func jsonArrayIndex(token string, a []interface{}, end bool) (int, error) {
+	if token == "-" && end {
+		return len(a), nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("wrong array index %q", token)
+	}
+	max := len(a) - 1
+	if end {
+		max = len(a)
+	}
+	if i > max {
+		return 0, fmt.Errorf("array index %d out of bounds", i)
+	}
+	return i, nil
+}
+
+func jsonGet(v interface{}, tokens []string) (interface{}, error) {
+	for _, t := range tokens {
+		switch c := v.(type) {
+		case map[string]interface{}:
+			cv, ok := c[t]
+			if !ok {
+				return nil, fmt.Errorf("member %q doesn't exist", t)
+			}
+			v = cv
+		case []interface{}:
+			i, err := jsonArrayIndex(t, c, false)
+			if err != nil {
+				return nil, err
+			}
+			v = c[i]
+		default:
+			return nil, fmt.Errorf("cannot reference %q in a json value that isn't an object or an array", t)
+		}
+	}
+	return v, nil
+}
+
+// jsonUpdate calls fn with the container referenced by the tokens, excluding
+// the last one, and the last token. It returns v with the container replaced
+// by the one returned by fn.
+func jsonUpdate(v interface{}, tokens []string, fn func(c interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return fn(v, tokens[0])
+	}
+	child, err := jsonGet(v, tokens[:1])
+	if err != nil {
+		return nil, err
+	}
+	newChild, err := jsonUpdate(child, tokens[1:], fn)
+	if err != nil {
+		return nil, err
+	}
+	switch c := v.(type) {
+	case map[string]interface{}:
+		c[tokens[0]] = newChild
+	case []interface{}:
+		i, _ := jsonArrayIndex(tokens[0], c, false)
+		c[i] = newChild
+	}
+	return v, nil
+}
+
+func jsonAdd(v interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return jsonUpdate(v, tokens, func(c interface{}, token string) (interface{}, error) {
+		switch c := c.(type) {
+		case map[string]interface{}:
+			c[token] = value
+			return c, nil
+		case []interface{}:
+			i, err := jsonArrayIndex(token, c, true)
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = value
+			return c, nil
+		}
+		return nil, fmt.Errorf("cannot add %q to a json value that isn't an object or an array", token)
+	})
+}
+
+func jsonRemove(v interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("cannot remove the whole document")
+	}
+	return jsonUpdate(v, tokens, func(c interface{}, token string) (interface{}, error) {
+		switch c := c.(type) {
+		case map[string]interface{}:
+			if _, ok := c[token]; !ok {
+				return nil, fmt.Errorf("member %q doesn't exist", token)
+			}
+			delete(c, token)
+			return c, nil
+		case []interface{}:
+			i, err := jsonArrayIndex(token, c, false)
+			if err != nil {
+				return nil, err
+			}
+			return append(c[:i], c[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("cannot remove %q from a json value that isn't an object or an array", token)
+	})
+}
+
+// applyJSONPatch applies the RFC 6902 json patch to the json document
+func applyJSONPatch(doc, patch []byte) ([]byte, error) {
+	var ops []jsonPatchOp
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal json patch: %v", err)
+	}
+	v, err := decodeJSON(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, op := range ops {
+		tokens, err := parseJSONPointer(op.Path)
+		if err != nil {
+			return nil, fmt.Errorf("operation #%d: %v", i, err)
+		}
+		var value interface{}
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, fmt.Errorf("operation #%d: %s without a value", i, op.Op)
+			}
+			if value, err = decodeJSON(op.Value); err != nil {
+				return nil, fmt.Errorf("operation #%d: failed to decode value: %v", i, err)
+			}
+		case "move", "copy":
+			from, err := parseJSONPointer(op.From)
+			if err != nil {
+				return nil, fmt.Errorf("operation #%d: %v", i, err)
+			}
+			if value, err = jsonGet(v, from); err != nil {
+				return nil, fmt.Errorf("operation #%d: %s from %q: %v", i, op.Op, op.From, err)
+			}
+			if op.Op == "move" {
+				if strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+					return nil, fmt.Errorf("operation #%d: cannot move %q to one of its children", i, op.From)
+				}
+				if v, err = jsonRemove(v, from); err != nil {
+					return nil, fmt.Errorf("operation #%d: %s from %q: %v", i, op.Op, op.From, err)
+				}
+			} else {
+				// copy the value so later operations don't change both
+				j, err := json.Marshal(value)
+				if err != nil {
+					return nil, err
+				}
+				if value, err = decodeJSON(j); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		switch op.Op {
+		case "add", "move", "copy":
+			v, err = jsonAdd(v, tokens, value)
+		case "remove":
+			v, err = jsonRemove(v, tokens)
+		case "replace":
+			if len(tokens) == 0 {
+				v = value
+				break
+			}
+			if _, err = jsonGet(v, tokens); err == nil {
+				if v, err = jsonRemove(v, tokens); err == nil {
+					v, err = jsonAdd(v, tokens, value)
+				}
+			}
+		case "test":
+			var cur interface{}
+			if cur, err = jsonGet(v, tokens); err == nil && !reflect.DeepEqual(cur, value) {
+				err = fmt.Errorf("test failed, current value is %s", diffValue(cur))
+			}
+		default:
+			err = fmt.Errorf("unknown operation %q", op.Op)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("operation #%d (%s %q): %v", i, op.Op, op.Path, err)
+		}
+	}
+	return json.Marshal(v)
+}
@@ -0,0 +1,116 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestApplyJSONPatch(t *testing.T) {
+	doc := `{"a":1,"b":{"c":[1,2,3],"d/e":"x"},"f":null}`
+	tests := []struct {
+		name  string
+		patch string
+		out   string
+		err   error
+	}{
+		{
+			name:  "add member",
+			patch: `[{"op":"add","path":"/b/g","value":{"h":true}}]`,
+			out:   `{"a":1,"b":{"c":[1,2,3],"d/e":"x","g":{"h":true}},"f":null}`,
+		},
+		{
+			name:  "add array element",
+			patch: `[{"op":"add","path":"/b/c/1","value":5},{"op":"add","path":"/b/c/-","value":6}]`,
+			out:   `{"a":1,"b":{"c":[1,5,2,3,6],"d/e":"x"},"f":null}`,
+		},
+		{
+			name:  "remove",
+			patch: `[{"op":"remove","path":"/b/c/0"},{"op":"remove","path":"/b/d~1e"}]`,
+			out:   `{"a":1,"b":{"c":[2,3]},"f":null}`,
+		},
+		{
+			name:  "replace",
+			patch: `[{"op":"replace","path":"/a","value":"z"},{"op":"replace","path":"/b/c/2","value":9}]`,
+			out:   `{"a":"z","b":{"c":[1,2,9],"d/e":"x"},"f":null}`,
+		},
+		{
+			name:  "move and copy",
+			patch: `[{"op":"move","from":"/a","path":"/b/a"},{"op":"copy","from":"/b/c","path":"/c"},{"op":"add","path":"/c/-","value":4}]`,
+			out:   `{"b":{"a":1,"c":[1,2,3],"d/e":"x"},"c":[1,2,3,4],"f":null}`,
+		},
+		{
+			name:  "successful test",
+			patch: `[{"op":"test","path":"/b/c","value":[1,2,3]},{"op":"test","path":"/f","value":null},{"op":"replace","path":"/a","value":2}]`,
+			out:   `{"a":2,"b":{"c":[1,2,3],"d/e":"x"},"f":null}`,
+		},
+		{
+			name:  "failed test",
+			patch: `[{"op":"replace","path":"/a","value":2},{"op":"test","path":"/a","value":1}]`,
+			err:   fmt.Errorf(`operation #1 (test "/a"): test failed, current value is 2`),
+		},
+		{
+			name:  "replace not existing member",
+			patch: `[{"op":"replace","path":"/z","value":1}]`,
+			err:   fmt.Errorf(`operation #0 (replace "/z"): member "z" doesn't exist`),
+		},
+		{
+			name:  "remove out of bounds",
+			patch: `[{"op":"remove","path":"/b/c/3"}]`,
+			err:   fmt.Errorf(`operation #0 (remove "/b/c/3"): array index 3 out of bounds`),
+		},
+		{
+			name:  "add to missing parent",
+			patch: `[{"op":"add","path":"/y/z","value":1}]`,
+			err:   fmt.Errorf(`operation #0 (add "/y/z"): member "y" doesn't exist`),
+		},
+		{
+			name:  "move to a child",
+			patch: `[{"op":"move","from":"/b","path":"/b/x"}]`,
+			err:   fmt.Errorf(`operation #0: cannot move "/b" to one of its children`),
+		},
+		{
+			name:  "missing value",
+			patch: `[{"op":"add","path":"/x"}]`,
+			err:   fmt.Errorf("operation #0: add without a value"),
+		},
+		{
+			name:  "unknown operation",
+			patch: `[{"op":"merge","path":"/x"}]`,
+			err:   fmt.Errorf(`operation #0 (merge "/x"): unknown operation "merge"`),
+		},
+		{
+			name:  "wrong pointer",
+			patch: `[{"op":"remove","path":"a"}]`,
+			err:   fmt.Errorf(`operation #0: json pointer "a" doesn't start with /`),
+		},
+	}
+
+	for i, tt := range tests {
+		out, err := applyJSONPatch([]byte(doc), []byte(tt.patch))
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d (%s): got no error, wanted error: %v", i, tt.name, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d (%s): got error: %v, wanted error: %v", i, tt.name, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d (%s): unexpected error: %v", i, tt.name, err)
+		} else if string(out) != tt.out {
+			t.Errorf("#%d (%s): got: %s, want: %s", i, tt.name, out, tt.out)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	cmdcommon "github.com/sorintlab/stolon/cmd"
+	"github.com/sorintlab/stolon/internal/cluster"
+
+	"github.com/spf13/cobra"
+)
+
+var setKeeperMaintenanceCmd = &cobra.Command{
+	Use:   "setkeepermaintenance [keeper uid] [on|off]",
+	Short: "Enable or disable the maintenance mode of a keeper",
+	Long:  `Enable or disable the maintenance mode of a keeper. While in maintenance the sentinel won't change the role of the keeper db, won't consider it failed (also if postgres is stopped) and won't elect it as the new master, choose it as a synchronous standby or assign a db to it, while the keeper won't converge its db to the cluster data, leaving postgres running as it is. In this way OS or postgres maintenance can be done without the sentinel and the keeper fighting it. When the keeper db is the master no failover will happen until the maintenance mode is disabled.`,
+	Run:   setKeeperMaintenance,
+}
+
+func init() {
+	CmdStolonCtl.AddCommand(setKeeperMaintenanceCmd)
+}
+
+// parseMaintenanceMode parses the on|off maintenance mode argument
+func parseMaintenanceMode(s string) (bool, error) {
+	switch s {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("wrong maintenance mode %q, must be on or off", s)
+}
+
+// setKeeperMaintenanceMode sets the maintenance mode of the keeper in the
+// cluster data
+func setKeeperMaintenanceMode(cd *cluster.ClusterData, keeperUID string, maintenance bool) error {
+	k, ok := cd.Keepers[keeperUID]
+	if !ok {
+		return fmt.Errorf("keeper %q doesn't exist", keeperUID)
+	}
+	if k.Spec == nil {
+		k.Spec = &cluster.KeeperSpec{}
+	}
+	if k.Spec.Maintenance == maintenance {
+		if maintenance {
+			return fmt.Errorf("keeper %q is already in maintenance", keeperUID)
+		}
+		return fmt.Errorf("keeper %q isn't in maintenance", keeperUID)
+	}
+	k.Spec.Maintenance = maintenance
+	return nil
+}
+
+func setKeeperMaintenance(cmd *cobra.Command, args []string) {
+	if len(args) > 2 {
+		die("too many arguments")
+	}
+
+	if len(args) < 2 {
+		die("keeper uid and maintenance mode (on or off) required")
+	}
+
+	keeperID := args[0]
+	maintenance, err := parseMaintenanceMode(args[1])
+	if err != nil {
+		die("%v", err)
+	}
+
+	store, err := cmdcommon.NewStore(&cfg.CommonConfig)
+	if err != nil {
+		die("%v", err)
+	}
+
+	cd, pair, err := getClusterData(store)
+	if err != nil {
+		die("cannot get cluster data: %v", err)
+	}
+
+	newCd := cd.DeepCopy()
+	if err := setKeeperMaintenanceMode(newCd, keeperID, maintenance); err != nil {
+		die("cannot set keeper maintenance mode: %v", err)
+	}
+
+	_, err = store.AtomicPutClusterData(context.TODO(), newCd, pair)
+	if err != nil {
+		die("cannot update cluster data: %v", err)
+	}
+	if !maintenance {
+		stdout("keeper %q maintenance mode disabled", keeperID)
+		return
+	}
+	stdout("keeper %q maintenance mode enabled", keeperID)
+	if db := getDbForKeeper(cd.DBs, keeperID); db != nil && cd.Cluster != nil && db.UID == cd.Cluster.Status.Master {
+		stdout("WARNING: keeper %q db is the current master, no failover will happen until the maintenance mode is disabled", keeperID)
+	}
+}
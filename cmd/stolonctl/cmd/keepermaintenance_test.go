@@ -0,0 +1,90 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseMaintenanceMode(t *testing.T) {
+	tests := []struct {
+		in  string
+		out bool
+		err error
+	}{
+		{in: "on", out: true},
+		{in: "off", out: false},
+		{in: "true", err: fmt.Errorf(`wrong maintenance mode "true", must be on or off`)},
+		{in: "", err: fmt.Errorf(`wrong maintenance mode "", must be on or off`)},
+	}
+
+	for i, tt := range tests {
+		out, err := parseMaintenanceMode(tt.in)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if out != tt.out {
+			t.Errorf("#%d: got: %t, want: %t", i, out, tt.out)
+		}
+	}
+}
+
+func TestSetKeeperMaintenanceMode(t *testing.T) {
+	tests := []struct {
+		keeperUID   string
+		maintenance bool
+		err         error
+	}{
+		{keeperUID: "keeper1", maintenance: true},
+		{keeperUID: "keeper2", maintenance: true},
+		{keeperUID: "keeper3", maintenance: true, err: fmt.Errorf(`keeper "keeper3" is already in maintenance`)},
+		{keeperUID: "keeper3", maintenance: false},
+		{keeperUID: "keeper1", maintenance: false, err: fmt.Errorf(`keeper "keeper1" isn't in maintenance`)},
+		{keeperUID: "keeper10", maintenance: true, err: fmt.Errorf(`keeper "keeper10" doesn't exist`)},
+	}
+
+	for i, tt := range tests {
+		cd := testClusterData(2, false)
+		// a keeper without a spec
+		cd.Keepers["keeper2"].Spec = nil
+		cd.Keepers["keeper3"].Spec.Maintenance = true
+		err := setKeeperMaintenanceMode(cd, tt.keeperUID, tt.maintenance)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if m := cd.Keepers[tt.keeperUID].Spec.Maintenance; m != tt.maintenance {
+			t.Errorf("#%d: got maintenance: %t, want: %t", i, m, tt.maintenance)
+		}
+	}
+}
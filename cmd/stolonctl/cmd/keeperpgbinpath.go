@@ -0,0 +1,94 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	cmdcommon "github.com/sorintlab/stolon/cmd"
+	"github.com/sorintlab/stolon/internal/cluster"
+
+	"github.com/spf13/cobra"
+)
+
+var setKeeperPGBinPathCmd = &cobra.Command{
+	Use:   "setkeeperpgbinpath [keeper uid] [path]",
+	Short: "Set the postgres binaries path of a keeper",
+	Long:  `Set the path of the postgres binaries used by the keeper, overriding its --pg-bin-path (i.e. to upgrade postgres to a new minor version one keeper at a time). The keeper restarts its instance with the new binaries, binaries with a major version different than the data dir one are refused. Without a path the keeper goes back to its --pg-bin-path.`,
+	Run:   setKeeperPGBinPath,
+}
+
+func init() {
+	CmdStolonCtl.AddCommand(setKeeperPGBinPathCmd)
+}
+
+// setKeeperPGBinPathOverride sets the postgres binaries path of the keeper in
+// the cluster data
+func setKeeperPGBinPathOverride(cd *cluster.ClusterData, keeperUID string, pgBinPath string) error {
+	k, ok := cd.Keepers[keeperUID]
+	if !ok {
+		return fmt.Errorf("keeper %q doesn't exist", keeperUID)
+	}
+	if pgBinPath != "" && !filepath.IsAbs(pgBinPath) {
+		return fmt.Errorf("postgres binaries path %q must be absolute", pgBinPath)
+	}
+	if k.Spec == nil {
+		k.Spec = &cluster.KeeperSpec{}
+	}
+	k.Spec.PGBinPath = pgBinPath
+	return nil
+}
+
+func setKeeperPGBinPath(cmd *cobra.Command, args []string) {
+	if len(args) > 2 {
+		die("too many arguments")
+	}
+	if len(args) == 0 {
+		die("keeper uid required")
+	}
+
+	keeperID := args[0]
+	pgBinPath := ""
+	if len(args) > 1 {
+		pgBinPath = args[1]
+	}
+
+	store, err := cmdcommon.NewStore(&cfg.CommonConfig)
+	if err != nil {
+		die("%v", err)
+	}
+
+	cd, pair, err := getClusterData(store)
+	if err != nil {
+		die("cannot get cluster data: %v", err)
+	}
+
+	newCd := cd.DeepCopy()
+	if err := setKeeperPGBinPathOverride(newCd, keeperID, pgBinPath); err != nil {
+		die("cannot set keeper pg bin path: %v", err)
+	}
+
+	_, err = store.AtomicPutClusterData(context.TODO(), newCd, pair)
+	if err != nil {
+		die("cannot update cluster data: %v", err)
+	}
+	if pgBinPath == "" {
+		stdout("removed keeper %q pg bin path override", keeperID)
+		return
+	}
+	stdout("set keeper %q pg bin path to %q", keeperID, pgBinPath)
+}
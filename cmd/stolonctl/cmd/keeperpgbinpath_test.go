@@ -0,0 +1,58 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSetKeeperPGBinPathOverride(t *testing.T) {
+	tests := []struct {
+		keeperUID string
+		pgBinPath string
+		err       error
+	}{
+		{keeperUID: "keeper1", pgBinPath: "/opt/postgresql-12.6/bin"},
+		{keeperUID: "keeper2", pgBinPath: "/opt/postgresql-12.6/bin"},
+		// no path removes the override
+		{keeperUID: "keeper3"},
+		{keeperUID: "keeper1", pgBinPath: "postgresql/bin", err: fmt.Errorf(`postgres binaries path "postgresql/bin" must be absolute`)},
+		{keeperUID: "keeper10", pgBinPath: "/opt/postgresql-12.6/bin", err: fmt.Errorf(`keeper "keeper10" doesn't exist`)},
+	}
+
+	for i, tt := range tests {
+		cd := testClusterData(2, false)
+		// a keeper without a spec
+		cd.Keepers["keeper2"].Spec = nil
+		cd.Keepers["keeper3"].Spec.PGBinPath = "/opt/postgresql-12.4/bin"
+		err := setKeeperPGBinPathOverride(cd, tt.keeperUID, tt.pgBinPath)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if p := cd.Keepers[tt.keeperUID].Spec.PGBinPath; p != tt.pgBinPath {
+			t.Errorf("#%d: got pg bin path: %q, want: %q", i, p, tt.pgBinPath)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	cmdcommon "github.com/sorintlab/stolon/cmd"
+	"github.com/sorintlab/stolon/internal/cluster"
+
+	"github.com/spf13/cobra"
+)
+
+var setKeeperPGParametersCmd = &cobra.Command{
+	Use:   "setkeeperpgparameters [keeper uid] [name=value...]",
+	Short: "Set the postgres parameters overrides of a keeper",
+	Long:  `Set the postgres parameters overriding, for the db of the keeper, the cluster spec pgParameters (i.e. a smaller shared_buffers on a small disaster recovery node). The provided parameters replace the current overrides of the keeper, without parameters all its overrides are removed. The overrides are kept also when a new db is assigned to the keeper.`,
+	Run:   setKeeperPGParameters,
+}
+
+func init() {
+	CmdStolonCtl.AddCommand(setKeeperPGParametersCmd)
+}
+
+// parsePGParameters parses the name=value postgres parameters
+func parsePGParameters(args []string) (cluster.PGParameters, error) {
+	pgParameters := cluster.PGParameters{}
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("wrong parameter %q, must be name=value", arg)
+		}
+		pgParameters[kv[0]] = kv[1]
+	}
+	return pgParameters, nil
+}
+
+// setKeeperPGParametersOverrides sets the pg parameters overrides of the
+// keeper in the cluster data
+func setKeeperPGParametersOverrides(cd *cluster.ClusterData, keeperUID string, pgParameters cluster.PGParameters) error {
+	k, ok := cd.Keepers[keeperUID]
+	if !ok {
+		return fmt.Errorf("keeper %q doesn't exist", keeperUID)
+	}
+	if k.Spec == nil {
+		k.Spec = &cluster.KeeperSpec{}
+	}
+	if len(pgParameters) == 0 {
+		pgParameters = nil
+	}
+	k.Spec.PGParameters = pgParameters
+	return nil
+}
+
+func setKeeperPGParameters(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		die("keeper uid required")
+	}
+
+	keeperID := args[0]
+	pgParameters, err := parsePGParameters(args[1:])
+	if err != nil {
+		die("%v", err)
+	}
+
+	store, err := cmdcommon.NewStore(&cfg.CommonConfig)
+	if err != nil {
+		die("%v", err)
+	}
+
+	cd, pair, err := getClusterData(store)
+	if err != nil {
+		die("cannot get cluster data: %v", err)
+	}
+
+	newCd := cd.DeepCopy()
+	if err := setKeeperPGParametersOverrides(newCd, keeperID, pgParameters); err != nil {
+		die("cannot set keeper pg parameters: %v", err)
+	}
+
+	_, err = store.AtomicPutClusterData(context.TODO(), newCd, pair)
+	if err != nil {
+		die("cannot update cluster data: %v", err)
+	}
+	if len(pgParameters) == 0 {
+		stdout("removed keeper %q pg parameters overrides", keeperID)
+		return
+	}
+	stdout("set keeper %q pg parameters overrides", keeperID)
+}
@@ -0,0 +1,104 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+func TestParsePGParameters(t *testing.T) {
+	tests := []struct {
+		args []string
+		out  cluster.PGParameters
+		err  error
+	}{
+		{
+			out: cluster.PGParameters{},
+		},
+		{
+			args: []string{"shared_buffers=1GB", "search_path=\"$user\", public", "log_line_prefix="},
+			out:  cluster.PGParameters{"shared_buffers": "1GB", "search_path": "\"$user\", public", "log_line_prefix": ""},
+		},
+		{
+			args: []string{"shared_buffers"},
+			err:  fmt.Errorf(`wrong parameter "shared_buffers", must be name=value`),
+		},
+		{
+			args: []string{"=1GB"},
+			err:  fmt.Errorf(`wrong parameter "=1GB", must be name=value`),
+		},
+	}
+
+	for i, tt := range tests {
+		out, err := parsePGParameters(tt.args)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: got: %v, want: %v", i, out, tt.out)
+		}
+	}
+}
+
+func TestSetKeeperPGParametersOverrides(t *testing.T) {
+	tests := []struct {
+		keeperUID    string
+		pgParameters cluster.PGParameters
+		out          cluster.PGParameters
+		err          error
+	}{
+		{keeperUID: "keeper1", pgParameters: cluster.PGParameters{"shared_buffers": "1GB"}, out: cluster.PGParameters{"shared_buffers": "1GB"}},
+		{keeperUID: "keeper2", pgParameters: cluster.PGParameters{"shared_buffers": "1GB"}, out: cluster.PGParameters{"shared_buffers": "1GB"}},
+		// no parameters remove the overrides
+		{keeperUID: "keeper3", pgParameters: cluster.PGParameters{}},
+		{keeperUID: "keeper10", err: fmt.Errorf(`keeper "keeper10" doesn't exist`)},
+	}
+
+	for i, tt := range tests {
+		cd := testClusterData(2, false)
+		// a keeper without a spec
+		cd.Keepers["keeper2"].Spec = nil
+		cd.Keepers["keeper3"].Spec.PGParameters = cluster.PGParameters{"work_mem": "8MB"}
+		err := setKeeperPGParametersOverrides(cd, tt.keeperUID, tt.pgParameters)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if p := cd.Keepers[tt.keeperUID].Spec.PGParameters; !reflect.DeepEqual(p, tt.out) {
+			t.Errorf("#%d: got pg parameters: %v, want: %v", i, p, tt.out)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	cmdcommon "github.com/sorintlab/stolon/cmd"
+	"github.com/sorintlab/stolon/internal/cluster"
+
+	"github.com/spf13/cobra"
+)
+
+var setKeeperPriorityCmd = &cobra.Command{
+	Use:   "setkeeperpriority [keeper uid] [priority]",
+	Short: "Set the election priority of a keeper",
+	Long:  `Set the election priority of a keeper. When electing a new master the sentinel prefers, between the standbys whose lag is within the allowed bounds, the ones of the keepers with the higher priority (i.e. the bigger hosts over a small disaster recovery one). The default priority is 0, negative values can be used to choose a keeper only when there's no other candidate.`,
+	Run:   setKeeperPriority,
+}
+
+func init() {
+	CmdStolonCtl.AddCommand(setKeeperPriorityCmd)
+}
+
+// setKeeperElectionPriority sets the election priority of the keeper in the
+// cluster data
+func setKeeperElectionPriority(cd *cluster.ClusterData, keeperUID string, priority int) error {
+	k, ok := cd.Keepers[keeperUID]
+	if !ok {
+		return fmt.Errorf("keeper %q doesn't exist", keeperUID)
+	}
+	if k.Spec == nil {
+		k.Spec = &cluster.KeeperSpec{}
+	}
+	k.Spec.ElectionPriority = priority
+	return nil
+}
+
+func setKeeperPriority(cmd *cobra.Command, args []string) {
+	if len(args) > 2 {
+		die("too many arguments")
+	}
+
+	if len(args) < 2 {
+		die("keeper uid and priority required")
+	}
+
+	keeperID := args[0]
+	priority, err := strconv.Atoi(args[1])
+	if err != nil {
+		die("wrong priority %q: %v", args[1], err)
+	}
+
+	store, err := cmdcommon.NewStore(&cfg.CommonConfig)
+	if err != nil {
+		die("%v", err)
+	}
+
+	cd, pair, err := getClusterData(store)
+	if err != nil {
+		die("cannot get cluster data: %v", err)
+	}
+
+	newCd := cd.DeepCopy()
+	if err := setKeeperElectionPriority(newCd, keeperID, priority); err != nil {
+		die("cannot set keeper priority: %v", err)
+	}
+
+	_, err = store.AtomicPutClusterData(context.TODO(), newCd, pair)
+	if err != nil {
+		die("cannot update cluster data: %v", err)
+	}
+	stdout("set keeper %q election priority to %d", keeperID, priority)
+}
@@ -0,0 +1,54 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSetKeeperElectionPriority(t *testing.T) {
+	tests := []struct {
+		keeperUID string
+		priority  int
+		err       error
+	}{
+		{keeperUID: "keeper1", priority: 10},
+		{keeperUID: "keeper2", priority: -1},
+		{keeperUID: "keeper10", priority: 1, err: fmt.Errorf(`keeper "keeper10" doesn't exist`)},
+	}
+
+	for i, tt := range tests {
+		cd := testClusterData(1, false)
+		// a keeper without a spec
+		cd.Keepers["keeper2"].Spec = nil
+		err := setKeeperElectionPriority(cd, tt.keeperUID, tt.priority)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if p := cd.Keepers[tt.keeperUID].Spec.ElectionPriority; p != tt.priority {
+			t.Errorf("#%d: got priority: %d, want: %d", i, p, tt.priority)
+		}
+	}
+}
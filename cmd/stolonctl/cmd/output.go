@@ -0,0 +1,111 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/template"
+
+	"github.com/ghodss/yaml"
+	"github.com/spf13/cobra"
+)
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+	outputYAML = "yaml"
+)
+
+// outputOptions are the options shared by the commands reporting the cluster
+// state in a machine readable format.
+type outputOptions struct {
+	output   string
+	template string
+}
+
+func addOutputFlags(cmd *cobra.Command, o *outputOptions, defaultOutput string, outputs ...string) {
+	cmd.Flags().StringVarP(&o.output, "output", "o", defaultOutput, fmt.Sprintf("output format (one of: %v)", outputs))
+	cmd.Flags().StringVar(&o.output, "format", defaultOutput, "alias of --output")
+	cmd.Flags().StringVar(&o.template, "template", "", "go template executed on the json output (using the json field names), i.e. '{{.cluster.status.master}}'")
+}
+
+func (o *outputOptions) validate(outputs ...string) error {
+	for _, output := range outputs {
+		if o.output == output {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown output format %q (must be one of: %v)", o.output, outputs)
+}
+
+// writeOutput writes v to w using the requested output format or, when
+// provided, executing the template. The json and yaml outputs are generated
+// from the json encoding of v so they always reflect the json field names of
+// the stored cluster data. The template is executed on the decoded json
+// encoding for the same reason.
+func writeOutput(w io.Writer, v interface{}, o outputOptions, pretty bool) error {
+	if o.template != "" {
+		t, err := template.New("output").Parse(o.template)
+		if err != nil {
+			return fmt.Errorf("failed to parse template: %v", err)
+		}
+		j, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		// use json.Number to avoid converting integers (like xlog positions) to
+		// floats
+		var data interface{}
+		dec := json.NewDecoder(bytes.NewReader(j))
+		dec.UseNumber()
+		if err := dec.Decode(&data); err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			return fmt.Errorf("failed to execute template: %v", err)
+		}
+		out := buf.Bytes()
+		if len(out) == 0 || out[len(out)-1] != '\n' {
+			out = append(out, '\n')
+		}
+		_, err = w.Write(out)
+		return err
+	}
+
+	var out []byte
+	var err error
+	switch o.output {
+	case outputJSON:
+		if pretty {
+			out, err = json.MarshalIndent(v, "", "\t")
+		} else {
+			out, err = json.Marshal(v)
+		}
+		out = append(out, '\n')
+	case outputYAML:
+		out, err = yaml.Marshal(v)
+	default:
+		return fmt.Errorf("unsupported output format %q", o.output)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to marshal output: %v", err)
+	}
+	_, err = w.Write(out)
+	return err
+}
@@ -0,0 +1,117 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+
+	"github.com/ghodss/yaml"
+)
+
+func TestWriteOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		o    outputOptions
+		out  string
+		err  error
+	}{
+		{
+			name: "master db uid",
+			o:    outputOptions{template: "{{.cluster.status.master}}"},
+			out:  "db1\n",
+		},
+		{
+			name: "master keeper uid",
+			o:    outputOptions{template: "{{with $cd := .}}{{(index $cd.dbs $cd.cluster.status.master).spec.keeperUID}}{{end}}"},
+			out:  "keeper1\n",
+		},
+		{
+			name: "integers aren't converted to floats",
+			o:    outputOptions{template: "{{.dbs.db2.status.xLogPos}}"},
+			out:  "123456789012\n",
+		},
+		{
+			// omitted empty fields, like a false healthy, must not be
+			// an error
+			name: "omitted field",
+			o:    outputOptions{template: "{{.keepers.keeper1.status.healthy}} {{.keepers.keeper1.status.notexisting}}"},
+			out:  "true <no value>\n",
+		},
+		{
+			name: "wrong template",
+			o:    outputOptions{template: "{{.cluster"},
+			err:  fmt.Errorf("failed to parse template: template: output:1: unclosed action"),
+		},
+		{
+			name: "unsupported output",
+			o:    outputOptions{output: outputText},
+			err:  fmt.Errorf(`unsupported output format "text"`),
+		},
+	}
+
+	for i, tt := range tests {
+		cd := testClusterData(1, false)
+		cd.DBs["db2"].Status.XLogPos = 123456789012
+		var buf bytes.Buffer
+		err := writeOutput(&buf, cd, tt.o, false)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d (%s): got no error, wanted error: %v", i, tt.name, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d (%s): got error: %v, wanted error: %v", i, tt.name, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d (%s): unexpected error: %v", i, tt.name, err)
+		} else if buf.String() != tt.out {
+			t.Errorf("#%d (%s): wrong output: got: %q, want: %q", i, tt.name, buf.String(), tt.out)
+		}
+	}
+}
+
+// TestWriteOutputFormats checks that the json and yaml outputs can be decoded
+// back to the same cluster data
+func TestWriteOutputFormats(t *testing.T) {
+	for _, output := range []string{outputJSON, outputYAML} {
+		for _, pretty := range []bool{false, true} {
+			cd := testClusterData(2, true)
+			var buf bytes.Buffer
+			if err := writeOutput(&buf, cd, outputOptions{output: output}, pretty); err != nil {
+				t.Fatalf("%s: unexpected error: %v", output, err)
+			}
+
+			j := buf.Bytes()
+			if output == outputYAML {
+				var err error
+				j, err = yaml.YAMLToJSON(j)
+				if err != nil {
+					t.Fatalf("%s: unexpected error: %v", output, err)
+				}
+			}
+			var ncd *cluster.ClusterData
+			if err := json.Unmarshal(j, &ncd); err != nil {
+				t.Fatalf("%s: unexpected error: %v", output, err)
+			}
+			if !reflect.DeepEqual(cd, ncd) {
+				t.Errorf("%s: decoded cluster data differs from the original one", output)
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+
+	"github.com/spf13/cobra"
+)
+
+var pgUpgradeCmd = &cobra.Command{
+	Use:   "pgupgrade [pg bin path]",
+	Short: "Upgrade the cluster to a new postgres major version",
+	Long:  `Upgrade the cluster to the postgres major version of the binaries in the provided path, that must exist on all the keepers. The upgrade is coordinated by the sentinel: the cluster enters the upgrade phase, where it's frozen (no new master is elected, also if the master fails), and the master keeper upgrades its data dir with pg_upgrade in link mode. When the master is running with the new binaries all the keepers are switched to them, the standbys are replaced by new dbs resynced from the upgraded master and the cluster returns to the normal phase. If the master keeper fails to upgrade its data dir it keeps the previous binaries and the upgrade is aborted. Its progress is reported by stolonctl status.`,
+	Run:   pgUpgrade,
+}
+
+type pgUpgradeOptions struct {
+	abort bool
+}
+
+var pgUpgradeOpts pgUpgradeOptions
+
+func init() {
+	pgUpgradeCmd.PersistentFlags().BoolVar(&pgUpgradeOpts.abort, "abort", false, "abort the postgres upgrade in progress unfreezing the cluster. The pg_upgrade already started by the master keeper isn't aborted")
+
+	CmdStolonCtl.AddCommand(pgUpgradeCmd)
+}
+
+// checkPGUpgrade checks if a postgres upgrade can be requested or, when
+// abort is true, aborted
+func checkPGUpgrade(cd *cluster.ClusterData, pgBinPath string, abort bool) error {
+	if cd.Cluster == nil {
+		return fmt.Errorf("no cluster available")
+	}
+	u := cd.Cluster.Status.PGUpgrade
+	if abort {
+		if !u.InProgress() {
+			return fmt.Errorf("no postgres upgrade in progress")
+		}
+		return nil
+	}
+	if !filepath.IsAbs(pgBinPath) {
+		return fmt.Errorf("postgres binaries path %q must be absolute", pgBinPath)
+	}
+	if cd.Cluster.Status.Phase != cluster.ClusterPhaseNormal {
+		return fmt.Errorf("cluster phase isn't %s", cluster.ClusterPhaseNormal)
+	}
+	if *cd.Cluster.DefSpec().Role != cluster.ClusterRoleMaster {
+		return fmt.Errorf("a standby cluster cannot be upgraded independently of its primary cluster")
+	}
+	if cd.Cluster.Status.Master == "" {
+		return fmt.Errorf("no master db available")
+	}
+	if u.InProgress() {
+		return fmt.Errorf("a postgres upgrade is already in progress (phase: %s)", u.Phase)
+	}
+	if sw := cd.Cluster.Status.Switchover; sw != nil {
+		return fmt.Errorf("a switchover to keeper %q is in progress", sw.TargetKeeper)
+	}
+	if rr := cd.Cluster.Status.RollingRestart; rr.InProgress() {
+		return fmt.Errorf("a rolling restart is in progress (phase: %s)", rr.Phase)
+	}
+	return nil
+}
+
+func pgUpgrade(cmd *cobra.Command, args []string) {
+	if len(args) > 1 {
+		die("too many arguments")
+	}
+	pgBinPath := ""
+	if len(args) > 0 {
+		pgBinPath = args[0]
+	}
+	if pgBinPath == "" && !pgUpgradeOpts.abort {
+		die("pg bin path required")
+	}
+
+	store, err := newSpecStore()
+	if err != nil {
+		die("%v", err)
+	}
+
+	cd, pair, err := getClusterData(store)
+	if err != nil {
+		die("cannot get cluster data: %v", err)
+	}
+
+	if err := checkPGUpgrade(cd, pgBinPath, pgUpgradeOpts.abort); err != nil {
+		if pgUpgradeOpts.abort {
+			die("cannot abort postgres upgrade: %v", err)
+		}
+		die("cannot start postgres upgrade: %v", err)
+	}
+
+	newCd := cd.DeepCopy()
+	if pgUpgradeOpts.abort {
+		u := newCd.Cluster.Status.PGUpgrade
+		u.Phase = cluster.PGUpgradePhaseAborted
+		u.Reason = "aborted by the user"
+		u.EndTime = time.Now()
+	} else {
+		newCd.Cluster.Status.PGUpgrade = &cluster.PGUpgrade{Phase: cluster.PGUpgradePhaseRequested, PGBinPath: pgBinPath}
+	}
+
+	_, err = store.AtomicPutClusterData(context.TODO(), newCd, pair)
+	if err != nil {
+		die("cannot update cluster data: %v", err)
+	}
+	if pgUpgradeOpts.abort {
+		stdout("postgres upgrade aborted")
+		return
+	}
+	stdout("requested postgres upgrade to the binaries in %q", pgBinPath)
+}
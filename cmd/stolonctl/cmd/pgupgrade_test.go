@@ -0,0 +1,131 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+func TestCheckPGUpgrade(t *testing.T) {
+	tests := []struct {
+		name      string
+		pgBinPath string
+		abort     bool
+		cd        func(cd *cluster.ClusterData)
+		err       error
+	}{
+		{
+			name:      "postgres upgrade",
+			pgBinPath: "/usr/lib/postgresql/13/bin",
+		},
+		{
+			name:      "completed postgres upgrade",
+			pgBinPath: "/usr/lib/postgresql/13/bin",
+			cd: func(cd *cluster.ClusterData) {
+				cd.Cluster.Status.PGUpgrade = &cluster.PGUpgrade{Phase: cluster.PGUpgradePhaseCompleted}
+			},
+		},
+		{
+			name:      "relative pg bin path",
+			pgBinPath: "postgresql/13/bin",
+			err:       fmt.Errorf(`postgres binaries path "postgresql/13/bin" must be absolute`),
+		},
+		{
+			name:      "postgres upgrade in progress",
+			pgBinPath: "/usr/lib/postgresql/13/bin",
+			cd: func(cd *cluster.ClusterData) {
+				cd.Cluster.Status.PGUpgrade = &cluster.PGUpgrade{Phase: cluster.PGUpgradePhaseRequested}
+			},
+			err: fmt.Errorf("a postgres upgrade is already in progress (phase: requested)"),
+		},
+		{
+			name:      "upgrading cluster",
+			pgBinPath: "/usr/lib/postgresql/13/bin",
+			cd: func(cd *cluster.ClusterData) {
+				cd.Cluster.Status.Phase = cluster.ClusterPhaseUpgrade
+			},
+			err: fmt.Errorf("cluster phase isn't normal"),
+		},
+		{
+			name:      "standby cluster",
+			pgBinPath: "/usr/lib/postgresql/13/bin",
+			cd: func(cd *cluster.ClusterData) {
+				role := cluster.ClusterRoleStandby
+				cd.Cluster.Spec.Role = &role
+			},
+			err: fmt.Errorf("a standby cluster cannot be upgraded independently of its primary cluster"),
+		},
+		{
+			name:      "no master",
+			pgBinPath: "/usr/lib/postgresql/13/bin",
+			cd: func(cd *cluster.ClusterData) {
+				cd.Cluster.Status.Master = ""
+			},
+			err: fmt.Errorf("no master db available"),
+		},
+		{
+			name:      "switchover in progress",
+			pgBinPath: "/usr/lib/postgresql/13/bin",
+			cd: func(cd *cluster.ClusterData) {
+				cd.Cluster.Status.Switchover = &cluster.Switchover{TargetKeeper: "keeper2"}
+			},
+			err: fmt.Errorf(`a switchover to keeper "keeper2" is in progress`),
+		},
+		{
+			name:      "rolling restart in progress",
+			pgBinPath: "/usr/lib/postgresql/13/bin",
+			cd: func(cd *cluster.ClusterData) {
+				cd.Cluster.Status.RollingRestart = &cluster.RollingRestart{Phase: cluster.RollingRestartPhaseStandbys}
+			},
+			err: fmt.Errorf("a rolling restart is in progress (phase: restartingStandbys)"),
+		},
+		{
+			name:  "abort",
+			abort: true,
+			cd: func(cd *cluster.ClusterData) {
+				cd.Cluster.Status.Phase = cluster.ClusterPhaseUpgrade
+				cd.Cluster.Status.PGUpgrade = &cluster.PGUpgrade{Phase: cluster.PGUpgradePhaseMaster}
+			},
+		},
+		{
+			name:  "abort without postgres upgrade",
+			abort: true,
+			cd: func(cd *cluster.ClusterData) {
+				cd.Cluster.Status.PGUpgrade = &cluster.PGUpgrade{Phase: cluster.PGUpgradePhaseAborted}
+			},
+			err: fmt.Errorf("no postgres upgrade in progress"),
+		},
+	}
+
+	for i, tt := range tests {
+		cd := testClusterData(2, false)
+		if tt.cd != nil {
+			tt.cd(cd)
+		}
+		err := checkPGUpgrade(cd, tt.pgBinPath, tt.abort)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d (%s): got no error, wanted error: %v", i, tt.name, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d (%s): got error: %v, wanted error: %v", i, tt.name, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d (%s): unexpected error: %v", i, tt.name, err)
+		}
+	}
+}
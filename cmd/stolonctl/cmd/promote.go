@@ -26,19 +26,28 @@ import (
 )
 
 var cmdPromote = &cobra.Command{
-	Use:   "promote",
+	Use:   "promote [keeper uid]",
 	Run:   promote,
-	Short: "Promotes a standby cluster to a primary cluster",
+	Short: "Promotes a standby cluster to a primary cluster or the db of the provided keeper as the new master",
+	Long:  `Without arguments promotes a standby cluster to a primary cluster. When a keeper uid is provided it's the same as "failover --target-keeper [keeper uid]".`,
 }
 
+type promoteOptions struct {
+	forceYes bool
+	force    bool
+}
+
+var promoteOpts promoteOptions
+
 func init() {
-	cmdPromote.PersistentFlags().BoolVarP(&initOpts.forceYes, "yes", "y", false, "don't ask for confirmation")
+	cmdPromote.PersistentFlags().BoolVarP(&promoteOpts.forceYes, "yes", "y", false, "don't ask for confirmation")
+	cmdPromote.PersistentFlags().BoolVar(&promoteOpts.force, "force", false, "when promoting a keeper, promote its db also if its lag is greater than maxStandbyLag")
 
 	CmdStolonCtl.AddCommand(cmdPromote)
 }
 
 func promote(cmd *cobra.Command, args []string) {
-	if len(args) > 0 {
+	if len(args) > 1 {
 		die("too many arguments")
 	}
 
@@ -47,8 +56,16 @@ func promote(cmd *cobra.Command, args []string) {
 		die("%v", err)
 	}
 
+	if len(args) == 1 {
+		failoverToKeeper(e, args[0], promoteOpts.force)
+		return
+	}
+	if promoteOpts.force {
+		die("--force can be used only when promoting a keeper")
+	}
+
 	accepted := true
-	if !initOpts.forceYes {
+	if !promoteOpts.forceYes {
 		accepted, err = askConfirmation("Are you sure you want to continue? [yes/no] ")
 		if err != nil {
 			die("%v", err)
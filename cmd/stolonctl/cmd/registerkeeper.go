@@ -0,0 +1,112 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	cmdcommon "github.com/sorintlab/stolon/cmd"
+	"github.com/sorintlab/stolon/internal/cluster"
+	pg "github.com/sorintlab/stolon/internal/postgresql"
+
+	"github.com/spf13/cobra"
+)
+
+var registerKeeperCmd = &cobra.Command{
+	Use:   "register-keeper [keeper uid]",
+	Short: "Register a keeper uid in the cluster data before starting its keeper",
+	Long:  `Register a keeper uid in the cluster data before starting a keeper process with the same uid (--uid option). The registered keeper is reported as not healthy until its keeper starts and, if it doesn't start, it'll be removed by the sentinel like any other dead keeper without an assigned db.`,
+	Run:   registerKeeper,
+}
+
+type registerKeeperOptions struct {
+	tags string
+}
+
+var registerKeeperOpts registerKeeperOptions
+
+func init() {
+	registerKeeperCmd.PersistentFlags().StringVar(&registerKeeperOpts.tags, "tags", "", "initial keeper tags (comma separated list of key=value pairs) replaced by the ones reported by the keeper when started")
+
+	CmdStolonCtl.AddCommand(registerKeeperCmd)
+}
+
+// newRegisteredKeeper returns a new keeper, not yet started, with the provided
+// uid.
+func newRegisteredKeeper(cd *cluster.ClusterData, uid string, tags cluster.Tags, now time.Time) (*cluster.Keeper, error) {
+	if !pg.IsValidReplSlotName(uid) {
+		return nil, fmt.Errorf("keeper uid %q not valid. It can contain only lower-case letters, numbers and the underscore character", uid)
+	}
+	if _, ok := cd.Keepers[uid]; ok {
+		return nil, fmt.Errorf("keeper %q already exists", uid)
+	}
+	return &cluster.Keeper{
+		UID:        uid,
+		Generation: cluster.InitialGeneration,
+		Spec: &cluster.KeeperSpec{
+			Tags: tags,
+		},
+		Status: cluster.KeeperStatus{
+			// used by the sentinel to remove the keeper if it doesn't start
+			LastHealthyTime: now,
+		},
+	}, nil
+}
+
+func registerKeeper(cmd *cobra.Command, args []string) {
+	if len(args) > 1 {
+		die("too many arguments")
+	}
+
+	if len(args) == 0 {
+		die("keeper uid required")
+	}
+
+	keeperID := args[0]
+
+	tags, err := cluster.ParseTags(registerKeeperOpts.tags)
+	if err != nil {
+		die("wrong tags: %v", err)
+	}
+
+	store, err := cmdcommon.NewStore(&cfg.CommonConfig)
+	if err != nil {
+		die("%v", err)
+	}
+
+	cd, pair, err := getClusterData(store)
+	if err != nil {
+		die("cannot get cluster data: %v", err)
+	}
+	if cd.Cluster == nil {
+		die("no cluster spec available")
+	}
+
+	k, err := newRegisteredKeeper(cd, keeperID, tags, time.Now())
+	if err != nil {
+		die("cannot register keeper: %v", err)
+	}
+
+	newCd := cd.DeepCopy()
+	newCd.Keepers[k.UID] = k
+
+	_, err = store.AtomicPutClusterData(context.TODO(), newCd, pair)
+	if err != nil {
+		die("cannot update cluster data: %v", err)
+	}
+	stdout("registered keeper %q", keeperID)
+}
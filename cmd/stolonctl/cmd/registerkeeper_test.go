@@ -0,0 +1,78 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+func TestNewRegisteredKeeper(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		uid  string
+		tags cluster.Tags
+		out  *cluster.Keeper
+		err  error
+	}{
+		{
+			uid: "keeper10",
+			out: &cluster.Keeper{
+				UID:        "keeper10",
+				Generation: cluster.InitialGeneration,
+				Spec:       &cluster.KeeperSpec{},
+				Status:     cluster.KeeperStatus{LastHealthyTime: now},
+			},
+		},
+		{
+			uid:  "keeper10",
+			tags: cluster.Tags{"zone": "a"},
+			out: &cluster.Keeper{
+				UID:        "keeper10",
+				Generation: cluster.InitialGeneration,
+				Spec:       &cluster.KeeperSpec{Tags: cluster.Tags{"zone": "a"}},
+				Status:     cluster.KeeperStatus{LastHealthyTime: now},
+			},
+		},
+		{
+			uid: "keeper1",
+			err: fmt.Errorf(`keeper "keeper1" already exists`),
+		},
+		{
+			uid: "Keeper-10",
+			err: fmt.Errorf(`keeper uid "Keeper-10" not valid. It can contain only lower-case letters, numbers and the underscore character`),
+		},
+	}
+
+	for i, tt := range tests {
+		cd := testClusterData(1, false)
+		out, err := newRegisteredKeeper(cd, tt.uid, tt.tags, now)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		} else if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: got keeper: %+v, want: %+v", i, out, tt.out)
+		}
+	}
+}
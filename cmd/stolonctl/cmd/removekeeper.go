@@ -16,22 +16,50 @@ package cmd
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"time"
 
 	cmdcommon "github.com/sorintlab/stolon/cmd"
 	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/store"
 	"github.com/spf13/cobra"
 )
 
 var removeKeeperCmd = &cobra.Command{
 	Use:   "removekeeper [keeper uid]",
 	Short: "Removes keeper from cluster data",
+	Long:  `Removes keeper from cluster data. With --graceful the keeper is first drained and, when its db isn't followed by other dbs or used as a synchronous standby anymore, the keeper (if alive) is requested to stop postgres and dispose of its data dir (see --data-dir-disposal). The removed keeper won't be registered again and won't start anymore with the same data dir.`,
 	Run:   removeKeeper,
 }
 
+type removeKeeperOptions struct {
+	graceful        bool
+	dataDirDisposal string
+	timeout         time.Duration
+}
+
+var removeKeeperOpts removeKeeperOptions
+
+// removeKeeperInterval is the interval between the checks of the graceful
+// keeper removal steps
+var removeKeeperInterval = 2 * time.Second
+
 func init() {
+	removeKeeperCmd.PersistentFlags().BoolVar(&removeKeeperOpts.graceful, "graceful", false, "drain the keeper, wait for its db to not be needed by the cluster and for the keeper to stop postgres before removing it")
+	removeKeeperCmd.PersistentFlags().StringVar(&removeKeeperOpts.dataDirDisposal, "data-dir-disposal", string(cluster.DataDirDisposalKeep), "what the keeper does with its postgres data dir with --graceful: keep, wipe (remove it) or archive (rename it inside the keeper data dir)")
+	removeKeeperCmd.PersistentFlags().DurationVar(&removeKeeperOpts.timeout, "timeout", 5*time.Minute, "max time to wait for every graceful removal step")
+
 	CmdStolonCtl.AddCommand(removeKeeperCmd)
 }
 
+// keepersInfoStore is the store used by the commands waiting for the keepers
+// to handle a request
+type keepersInfoStore interface {
+	clusterDataStore
+	GetKeepersInfo(ctx context.Context) (cluster.KeepersInfo, error)
+}
+
 func removeKeeper(cmd *cobra.Command, args []string) {
 	if len(args) > 1 {
 		die("too many arguments")
@@ -43,11 +71,30 @@ func removeKeeper(cmd *cobra.Command, args []string) {
 
 	keeperID := args[0]
 
+	disposal := cluster.DataDirDisposal(removeKeeperOpts.dataDirDisposal)
+	switch disposal {
+	case cluster.DataDirDisposalKeep:
+	case cluster.DataDirDisposalWipe, cluster.DataDirDisposalArchive:
+		if !removeKeeperOpts.graceful {
+			die("--data-dir-disposal requires --graceful")
+		}
+	default:
+		die("--data-dir-disposal must be one of: keep, wipe, archive")
+	}
+
 	store, err := cmdcommon.NewStore(&cfg.CommonConfig)
 	if err != nil {
 		die("%v", err)
 	}
 
+	if removeKeeperOpts.graceful {
+		if err := gracefulRemoveKeeper(store, keeperID, disposal, removeKeeperOpts.timeout, removeKeeperInterval); err != nil {
+			die("cannot remove keeper %q: %v", keeperID, err)
+		}
+		stdout("keeper %q removed", keeperID)
+		return
+	}
+
 	cd, pair, err := getClusterData(store)
 	if err != nil {
 		die("cannot get cluster data: %v", err)
@@ -87,6 +134,201 @@ func removeKeeper(cmd *cobra.Command, args []string) {
 	}
 }
 
+// updateClusterData applies fn to the current cluster data and writes it,
+// retrying when the cluster data has been modified in the meantime
+func updateClusterData(e clusterDataStore, fn func(cd *cluster.ClusterData) error) error {
+	for retry := 0; retry < maxRetries; retry++ {
+		cd, pair, err := getClusterData(e)
+		if err != nil {
+			return err
+		}
+		if cd.Cluster == nil || cd.Cluster.Spec == nil {
+			return fmt.Errorf("no cluster spec available")
+		}
+		newCd := cd.DeepCopy()
+		if err := fn(newCd); err != nil {
+			return err
+		}
+		if _, err := e.AtomicPutClusterData(context.TODO(), newCd, pair); err != nil {
+			if err == store.ErrKeyModified {
+				continue
+			}
+			return fmt.Errorf("cannot update cluster data: %v", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("failed to update cluster data after %d retries", maxRetries)
+}
+
+// keeperRemovalBlocker returns the reason why the keeper db is still needed
+// by the cluster, nil when it can be stopped
+func keeperRemovalBlocker(cd *cluster.ClusterData, keeperID string) error {
+	if _, ok := cd.Keepers[keeperID]; !ok {
+		return fmt.Errorf("keeper doesn't exist")
+	}
+	keeperDb := getDbForKeeper(cd.DBs, keeperID)
+	if keeperDb == nil {
+		return nil
+	}
+	if cd.Cluster.Status.Master == keeperDb.UID {
+		return fmt.Errorf("keeper assigned db is the current cluster master db")
+	}
+	uids := []string{}
+	for uid := range cd.DBs {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+	for _, uid := range uids {
+		db := cd.DBs[uid]
+		if db.Generation != db.Status.CurrentGeneration {
+			return fmt.Errorf("db %q of keeper %q is converging to a new spec", db.UID, db.Spec.KeeperUID)
+		}
+		if db.Spec.FollowConfig != nil && db.Spec.FollowConfig.Type == cluster.FollowTypeInternal && db.Spec.FollowConfig.DBUID == keeperDb.UID {
+			return fmt.Errorf("db %q of keeper %q is following the keeper db", db.UID, db.Spec.KeeperUID)
+		}
+	}
+	if masterDB, ok := cd.DBs[cd.Cluster.Status.Master]; ok {
+		for _, uid := range append(masterDB.Spec.SynchronousStandbys, masterDB.Status.SynchronousStandbys...) {
+			if uid == keeperDb.UID {
+				return fmt.Errorf("keeper assigned db is a synchronous standby")
+			}
+		}
+	}
+	return nil
+}
+
+// keeperRemovalDone reports if the keeper has completed the removal request.
+// It returns the error reported by the keeper, if any.
+func keeperRemovalDone(ki *cluster.KeeperInfo, requestTime time.Time) (bool, *cluster.KeeperRemovalStatus, error) {
+	if ki == nil || ki.Removal == nil || !ki.Removal.RequestTime.Equal(requestTime) {
+		return false, nil, nil
+	}
+	if ki.Removal.Completed {
+		return true, ki.Removal, nil
+	}
+	if ki.Removal.Error != "" {
+		return false, ki.Removal, fmt.Errorf("%s", ki.Removal.Error)
+	}
+	return false, ki.Removal, nil
+}
+
+// waitFor calls fn every interval until it returns true or the timeout
+// expires. It returns the last error returned by fn at the timeout.
+func waitFor(timeout, interval time.Duration, fn func() (bool, error)) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var lastErr error
+	for {
+		ok, err := fn()
+		if ok {
+			return nil
+		}
+		lastErr = err
+		select {
+		case <-timer.C:
+			if lastErr != nil {
+				return fmt.Errorf("timeout: %v", lastErr)
+			}
+			return fmt.Errorf("timeout")
+		case <-time.After(interval):
+		}
+	}
+}
+
+// gracefulRemoveKeeper drains the keeper, waits for its db to not be needed
+// by the cluster, requests the keeper, when alive, to stop postgres and
+// dispose of its data dir and then removes the keeper and its db from the
+// cluster data.
+func gracefulRemoveKeeper(e keepersInfoStore, keeperID string, disposal cluster.DataDirDisposal, timeout, interval time.Duration) error {
+	err := updateClusterData(e, func(cd *cluster.ClusterData) error {
+		k, ok := cd.Keepers[keeperID]
+		if !ok {
+			return fmt.Errorf("keeper doesn't exist")
+		}
+		if db := getDbForKeeper(cd.DBs, keeperID); db != nil && cd.Cluster.Status.Master == db.UID {
+			return fmt.Errorf("keeper assigned db is the current cluster master db, switchover to another keeper before")
+		}
+		if k.Spec == nil {
+			k.Spec = &cluster.KeeperSpec{}
+		}
+		k.Spec.Drained = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	stdout("keeper %q drained, waiting for its db to not be needed by the cluster", keeperID)
+
+	err = waitFor(timeout, interval, func() (bool, error) {
+		cd, _, err := getClusterData(e)
+		if err != nil {
+			return false, err
+		}
+		err = keeperRemovalBlocker(cd, keeperID)
+		return err == nil, err
+	})
+	if err != nil {
+		return err
+	}
+
+	keepersInfo, err := e.GetKeepersInfo(context.TODO())
+	if err != nil {
+		return fmt.Errorf("cannot get keepers info: %v", err)
+	}
+	if _, ok := keepersInfo[keeperID]; ok {
+		requestTime := time.Now()
+		err = updateClusterData(e, func(cd *cluster.ClusterData) error {
+			k, ok := cd.Keepers[keeperID]
+			if !ok {
+				return fmt.Errorf("keeper doesn't exist")
+			}
+			k.Spec.Removal = &cluster.KeeperRemoval{RequestTime: requestTime, DataDirDisposal: disposal}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		stdout("requested keeper %q to stop postgres (data dir disposal: %s)", keeperID, disposal)
+
+		var status *cluster.KeeperRemovalStatus
+		err = waitFor(timeout, interval, func() (bool, error) {
+			keepersInfo, err := e.GetKeepersInfo(context.TODO())
+			if err != nil {
+				return false, err
+			}
+			ki, ok := keepersInfo[keeperID]
+			if !ok {
+				return false, fmt.Errorf("keeper isn't alive anymore")
+			}
+			var done bool
+			done, status, err = keeperRemovalDone(ki, requestTime)
+			return done, err
+		})
+		if err != nil {
+			return fmt.Errorf("keeper didn't complete the removal: %v", err)
+		}
+		if status.ArchivePath != "" {
+			stdout("keeper %q stopped postgres, data dir archived to %q", keeperID, status.ArchivePath)
+		} else {
+			stdout("keeper %q stopped postgres", keeperID)
+		}
+	} else {
+		stdout("WARNING: keeper %q isn't alive, its data dir won't be disposed of", keeperID)
+	}
+
+	return updateClusterData(e, func(cd *cluster.ClusterData) error {
+		keeperDb := getDbForKeeper(cd.DBs, keeperID)
+		if keeperDb != nil && cd.Cluster.Status.Master == keeperDb.UID {
+			return fmt.Errorf("keeper assigned db is the current cluster master db")
+		}
+		delete(cd.Keepers, keeperID)
+		if keeperDb != nil {
+			delete(cd.DBs, keeperDb.UID)
+		}
+		return nil
+	})
+}
+
 func getDbForKeeper(dbs cluster.DBs, keeperID string) *cluster.DB {
 	for _, db := range dbs {
 		if db.Spec.KeeperUID == keeperID {
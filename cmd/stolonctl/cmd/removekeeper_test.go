@@ -0,0 +1,199 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+// testKeepersInfoStore is an in memory keepersInfoStore whose keepers info
+// are computed by keepersInfoFn from the current cluster data
+type testKeepersInfoStore struct {
+	*testClusterDataStore
+	keepersInfoFn func(cd *cluster.ClusterData) cluster.KeepersInfo
+}
+
+func (s *testKeepersInfoStore) GetKeepersInfo(ctx context.Context) (cluster.KeepersInfo, error) {
+	return s.keepersInfoFn(s.cd), nil
+}
+
+func TestKeeperRemovalBlocker(t *testing.T) {
+	tests := []struct {
+		name     string
+		cd       func() *cluster.ClusterData
+		keeperID string
+		err      error
+	}{
+		{
+			name:     "standby",
+			cd:       func() *cluster.ClusterData { return testClusterData(2, false) },
+			keeperID: "keeper2",
+		},
+		{
+			name:     "master",
+			cd:       func() *cluster.ClusterData { return testClusterData(2, false) },
+			keeperID: "keeper1",
+			err:      fmt.Errorf("keeper assigned db is the current cluster master db"),
+		},
+		{
+			name: "followed standby",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, false)
+				cd.DBs["db3"].Spec.FollowConfig.DBUID = "db2"
+				return cd
+			},
+			keeperID: "keeper2",
+			err:      fmt.Errorf(`db "db3" of keeper "keeper3" is following the keeper db`),
+		},
+		{
+			name: "synchronous standby",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, true)
+				cd.DBs["db1"].Status.SynchronousStandbys = []string{"db2"}
+				return cd
+			},
+			keeperID: "keeper2",
+			err:      fmt.Errorf("keeper assigned db is a synchronous standby"),
+		},
+		{
+			name: "converging db",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, false)
+				cd.DBs["db3"].Generation = 2
+				return cd
+			},
+			keeperID: "keeper2",
+			err:      fmt.Errorf(`db "db3" of keeper "keeper3" is converging to a new spec`),
+		},
+		{
+			name: "keeper without db",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(2, false)
+				delete(cd.DBs, "db2")
+				return cd
+			},
+			keeperID: "keeper2",
+		},
+	}
+
+	for i, tt := range tests {
+		err := keeperRemovalBlocker(tt.cd(), tt.keeperID)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d (%s): got no error, wanted error: %v", i, tt.name, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d (%s): got error: %v, wanted error: %v", i, tt.name, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d (%s): unexpected error: %v", i, tt.name, err)
+		}
+	}
+}
+
+func TestGracefulRemoveKeeper(t *testing.T) {
+	// the db of keeper2 is followed by the db of keeper3 until the sentinel
+	// makes it follow the master after the drain
+	newCD := func() *cluster.ClusterData {
+		cd := testClusterData(2, false)
+		cd.FormatVersion = cluster.CurrentCDFormatVersion
+		cd.Cluster.Spec.InitMode = cluster.ClusterInitModeP(cluster.ClusterInitModeNew)
+		cd.DBs["db3"].Spec.FollowConfig.DBUID = "db2"
+		return cd
+	}
+	sentinelFn := func(cd *cluster.ClusterData) {
+		if k := cd.Keepers["keeper2"]; k != nil && k.Spec.Drained {
+			cd.DBs["db3"].Spec.FollowConfig.DBUID = "db1"
+		}
+	}
+	// the keeper completes the removal request
+	aliveKeeperFn := func(cd *cluster.ClusterData) cluster.KeepersInfo {
+		ki := &cluster.KeeperInfo{UID: "keeper2"}
+		if k := cd.Keepers["keeper2"]; k != nil && k.Spec.Removal != nil {
+			ki.Removal = &cluster.KeeperRemovalStatus{RequestTime: k.Spec.Removal.RequestTime, Completed: true}
+		}
+		return cluster.KeepersInfo{"keeper2": ki}
+	}
+
+	var requested *cluster.KeeperRemoval
+	s := &testKeepersInfoStore{
+		testClusterDataStore: &testClusterDataStore{cd: newCD(), sentinelFn: sentinelFn},
+		keepersInfoFn: func(cd *cluster.ClusterData) cluster.KeepersInfo {
+			if k := cd.Keepers["keeper2"]; k != nil && k.Spec.Removal != nil {
+				requested = k.Spec.Removal
+			}
+			return aliveKeeperFn(cd)
+		},
+	}
+	if err := gracefulRemoveKeeper(s, "keeper2", cluster.DataDirDisposalWipe, 5*time.Second, 10*time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if requested == nil || requested.DataDirDisposal != cluster.DataDirDisposalWipe {
+		t.Fatalf("got removal request: %+v, want a wipe request", requested)
+	}
+	if _, ok := s.cd.Keepers["keeper2"]; ok {
+		t.Fatalf("keeper not removed")
+	}
+	if _, ok := s.cd.DBs["db2"]; ok {
+		t.Fatalf("keeper db not removed")
+	}
+
+	// a not alive keeper is removed without a removal request
+	s = &testKeepersInfoStore{
+		testClusterDataStore: &testClusterDataStore{cd: newCD(), sentinelFn: sentinelFn},
+		keepersInfoFn:        func(cd *cluster.ClusterData) cluster.KeepersInfo { return cluster.KeepersInfo{} },
+	}
+	if err := gracefulRemoveKeeper(s, "keeper2", cluster.DataDirDisposalKeep, 5*time.Second, 10*time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := s.cd.Keepers["keeper2"]; ok {
+		t.Fatalf("keeper not removed")
+	}
+
+	// the keeper reports a removal error
+	s = &testKeepersInfoStore{
+		testClusterDataStore: &testClusterDataStore{cd: newCD(), sentinelFn: sentinelFn},
+		keepersInfoFn: func(cd *cluster.ClusterData) cluster.KeepersInfo {
+			ki := &cluster.KeeperInfo{UID: "keeper2"}
+			if k := cd.Keepers["keeper2"]; k != nil && k.Spec.Removal != nil {
+				ki.Removal = &cluster.KeeperRemovalStatus{RequestTime: k.Spec.Removal.RequestTime, Error: "cannot stop postgres"}
+			}
+			return cluster.KeepersInfo{"keeper2": ki}
+		},
+	}
+	err := gracefulRemoveKeeper(s, "keeper2", cluster.DataDirDisposalKeep, 100*time.Millisecond, 10*time.Millisecond)
+	if expected := "keeper didn't complete the removal: timeout: cannot stop postgres"; err == nil || err.Error() != expected {
+		t.Fatalf("got error: %v, wanted error: %s", err, expected)
+	}
+	if _, ok := s.cd.Keepers["keeper2"]; !ok {
+		t.Fatalf("keeper removed after a removal error")
+	}
+
+	// the master keeper cannot be removed
+	s = &testKeepersInfoStore{
+		testClusterDataStore: &testClusterDataStore{cd: newCD()},
+		keepersInfoFn:        aliveKeeperFn,
+	}
+	if err := gracefulRemoveKeeper(s, "keeper1", cluster.DataDirDisposalKeep, 100*time.Millisecond, 10*time.Millisecond); err == nil {
+		t.Fatalf("got no error removing the master keeper")
+	}
+	if s.cd.Keepers["keeper1"].Spec.Drained {
+		t.Fatalf("master keeper drained")
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	cmdcommon "github.com/sorintlab/stolon/cmd"
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+
+	"github.com/spf13/cobra"
+)
+
+var replaceKeeperCmd = &cobra.Command{
+	Use:   "replace-keeper [keeper uid]",
+	Short: "Prepare a dead keeper to be replaced by a new keeper process with the same uid",
+	Long:  `Prepare a dead keeper to be replaced by a new keeper process started with the same uid (--uid option). Its standby db, with its role and follow config, will be adopted by the new keeper: a data dir taken over from the replaced keeper or an initialized data dir of the same cluster will be used as is (and resynced only if it cannot follow its master), otherwise the db will be resynced. The replaced keeper must be not healthy and its db must not be the master db.`,
+	Run:   replaceKeeper,
+}
+
+func init() {
+	CmdStolonCtl.AddCommand(replaceKeeperCmd)
+}
+
+// checkReplaceKeeper checks if the keeper can be replaced by a new keeper
+// process. It returns its db.
+func checkReplaceKeeper(cd *cluster.ClusterData, keeperUID string) (*cluster.DB, error) {
+	k, ok := cd.Keepers[keeperUID]
+	if !ok {
+		return nil, fmt.Errorf("keeper doesn't exist")
+	}
+	if k.Status.Healthy {
+		return nil, fmt.Errorf("keeper is healthy, stop its keeper process before replacing it")
+	}
+	db := getDbForKeeper(cd.DBs, keeperUID)
+	if db == nil {
+		return nil, fmt.Errorf("keeper has no assigned db, just start the new keeper process")
+	}
+	if db.UID == cd.Cluster.Status.Master || db.Spec.Role == common.RoleMaster {
+		return nil, fmt.Errorf("keeper assigned db is the current cluster master db")
+	}
+	return db, nil
+}
+
+func replaceKeeper(cmd *cobra.Command, args []string) {
+	if len(args) > 1 {
+		die("too many arguments")
+	}
+
+	if len(args) == 0 {
+		die("keeper uid required")
+	}
+
+	keeperID := args[0]
+
+	store, err := cmdcommon.NewStore(&cfg.CommonConfig)
+	if err != nil {
+		die("%v", err)
+	}
+
+	cd, pair, err := getClusterData(store)
+	if err != nil {
+		die("cannot get cluster data: %v", err)
+	}
+	if cd.Cluster == nil {
+		die("no cluster spec available")
+	}
+
+	db, err := checkReplaceKeeper(cd, keeperID)
+	if err != nil {
+		die("cannot replace keeper: %v", err)
+	}
+
+	newCd := cd.DeepCopy()
+	// a new keeper without the db local state will adopt or resync the
+	// db, a keeper with the replaced keeper data dir will keep it as is
+	ndb := newCd.DBs[db.UID]
+	ndb.Spec.InitMode = cluster.DBInitModeResync
+	ndb.Generation++
+
+	_, err = store.AtomicPutClusterData(context.TODO(), newCd, pair)
+	if err != nil {
+		die("cannot update cluster data: %v", err)
+	}
+	stdout("keeper %q ready to be replaced, start the new keeper process with the same uid", keeperID)
+}
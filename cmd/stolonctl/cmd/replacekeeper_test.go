@@ -0,0 +1,93 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+func TestCheckReplaceKeeper(t *testing.T) {
+	tests := []struct {
+		name      string
+		keeperUID string
+		cd        func() *cluster.ClusterData
+		dbUID     string
+		err       error
+	}{
+		{
+			name:      "dead standby keeper",
+			keeperUID: "keeper2",
+			dbUID:     "db2",
+		},
+		{
+			name:      "healthy keeper",
+			keeperUID: "keeper2",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(1, false)
+				cd.Keepers["keeper2"].Status.Healthy = true
+				return cd
+			},
+			err: fmt.Errorf("keeper is healthy, stop its keeper process before replacing it"),
+		},
+		{
+			name:      "master keeper",
+			keeperUID: "keeper1",
+			err:       fmt.Errorf("keeper assigned db is the current cluster master db"),
+		},
+		{
+			name:      "keeper without db",
+			keeperUID: "keeper2",
+			cd: func() *cluster.ClusterData {
+				cd := testClusterData(1, false)
+				cd.Keepers["keeper2"].Status.Healthy = false
+				delete(cd.DBs, "db2")
+				return cd
+			},
+			err: fmt.Errorf("keeper has no assigned db, just start the new keeper process"),
+		},
+		{
+			name:      "not existing keeper",
+			keeperUID: "keeper9",
+			err:       fmt.Errorf("keeper doesn't exist"),
+		},
+	}
+
+	for i, tt := range tests {
+		var cd *cluster.ClusterData
+		if tt.cd != nil {
+			cd = tt.cd()
+		} else {
+			cd = testClusterData(1, false)
+			for _, k := range cd.Keepers {
+				k.Status.Healthy = false
+			}
+		}
+		db, err := checkReplaceKeeper(cd, tt.keeperUID)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d (%s): got no error, wanted error: %v", i, tt.name, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d (%s): got error: %v, wanted error: %v", i, tt.name, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d (%s): unexpected error: %v", i, tt.name, err)
+		} else if db.UID != tt.dbUID {
+			t.Errorf("#%d (%s): wrong db: %s", i, tt.name, db.UID)
+		}
+	}
+}
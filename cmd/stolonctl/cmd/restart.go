@@ -0,0 +1,121 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+
+	"github.com/spf13/cobra"
+)
+
+var restartCmd = &cobra.Command{
+	Use:   "restart",
+	Short: "Restart the postgres instances of all the keepers",
+	Long:  `Restart the postgres instances of all the keepers (i.e. to apply pg parameters requiring a restart). With --rolling the restart is coordinated by the sentinel: the standbys are restarted one at a time (the asynchronous ones first), waiting for every restarted standby to be healthy and, if a synchronous standby, back in sync with the master. Then the master role is switched over to a restarted standby and the old master is restarted when it has rejoined the cluster as a standby. Without standbys the master is restarted in place. The rolling restart is aborted if the master db fails, a db doesn't restart before the cluster spec convergenceTimeout or the switchover is aborted. Its progress is reported by stolonctl status.`,
+	Run:   restart,
+}
+
+type restartOptions struct {
+	rolling bool
+	abort   bool
+}
+
+var restartOpts restartOptions
+
+func init() {
+	restartCmd.PersistentFlags().BoolVar(&restartOpts.rolling, "rolling", false, "restart the keepers one at a time, switching over the master role to a restarted standby")
+	restartCmd.PersistentFlags().BoolVar(&restartOpts.abort, "abort", false, "abort the rolling restart in progress. The db restart already requested, or the switchover in progress, isn't aborted")
+
+	CmdStolonCtl.AddCommand(restartCmd)
+}
+
+// checkRollingRestart checks if a rolling restart can be requested or, when
+// abort is true, aborted
+func checkRollingRestart(cd *cluster.ClusterData, abort bool) error {
+	if cd.Cluster == nil {
+		return fmt.Errorf("no cluster available")
+	}
+	rr := cd.Cluster.Status.RollingRestart
+	if abort {
+		if !rr.InProgress() {
+			return fmt.Errorf("no rolling restart in progress")
+		}
+		return nil
+	}
+	if cd.Cluster.Status.Phase != cluster.ClusterPhaseNormal {
+		return fmt.Errorf("cluster phase isn't %s", cluster.ClusterPhaseNormal)
+	}
+	if cd.Cluster.Status.Master == "" {
+		return fmt.Errorf("no master db available")
+	}
+	if rr.InProgress() {
+		return fmt.Errorf("a rolling restart is already in progress (phase: %s)", rr.Phase)
+	}
+	if sw := cd.Cluster.Status.Switchover; sw != nil {
+		return fmt.Errorf("a switchover to keeper %q is in progress", sw.TargetKeeper)
+	}
+	return nil
+}
+
+func restart(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		die("too many arguments")
+	}
+	if !restartOpts.rolling {
+		die("only rolling restarts are supported, use --rolling")
+	}
+
+	store, err := newSpecStore()
+	if err != nil {
+		die("%v", err)
+	}
+
+	cd, pair, err := getClusterData(store)
+	if err != nil {
+		die("cannot get cluster data: %v", err)
+	}
+
+	if err := checkRollingRestart(cd, restartOpts.abort); err != nil {
+		if restartOpts.abort {
+			die("cannot abort rolling restart: %v", err)
+		}
+		die("cannot start rolling restart: %v", err)
+	}
+
+	newCd := cd.DeepCopy()
+	if restartOpts.abort {
+		rr := newCd.Cluster.Status.RollingRestart
+		rr.Phase = cluster.RollingRestartPhaseAborted
+		rr.Reason = "aborted by the user"
+		rr.RestartingKeeper = ""
+		rr.EndTime = time.Now()
+	} else {
+		newCd.Cluster.Status.RollingRestart = &cluster.RollingRestart{Phase: cluster.RollingRestartPhaseRequested}
+	}
+
+	_, err = store.AtomicPutClusterData(context.TODO(), newCd, pair)
+	if err != nil {
+		die("cannot update cluster data: %v", err)
+	}
+	if restartOpts.abort {
+		stdout("rolling restart aborted")
+		return
+	}
+	stdout("requested rolling restart")
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+func TestCheckRollingRestart(t *testing.T) {
+	tests := []struct {
+		name  string
+		abort bool
+		cd    func(cd *cluster.ClusterData)
+		err   error
+	}{
+		{
+			name: "rolling restart",
+		},
+		{
+			name: "completed rolling restart",
+			cd: func(cd *cluster.ClusterData) {
+				cd.Cluster.Status.RollingRestart = &cluster.RollingRestart{Phase: cluster.RollingRestartPhaseCompleted}
+			},
+		},
+		{
+			name: "rolling restart in progress",
+			cd: func(cd *cluster.ClusterData) {
+				cd.Cluster.Status.RollingRestart = &cluster.RollingRestart{Phase: cluster.RollingRestartPhaseStandbys}
+			},
+			err: fmt.Errorf("a rolling restart is already in progress (phase: restartingStandbys)"),
+		},
+		{
+			name: "switchover in progress",
+			cd: func(cd *cluster.ClusterData) {
+				cd.Cluster.Status.Switchover = &cluster.Switchover{TargetKeeper: "keeper2"}
+			},
+			err: fmt.Errorf(`a switchover to keeper "keeper2" is in progress`),
+		},
+		{
+			name: "no master",
+			cd: func(cd *cluster.ClusterData) {
+				cd.Cluster.Status.Master = ""
+			},
+			err: fmt.Errorf("no master db available"),
+		},
+		{
+			name: "initializing cluster",
+			cd: func(cd *cluster.ClusterData) {
+				cd.Cluster.Status.Phase = cluster.ClusterPhaseInitializing
+			},
+			err: fmt.Errorf("cluster phase isn't normal"),
+		},
+		{
+			name:  "abort",
+			abort: true,
+			cd: func(cd *cluster.ClusterData) {
+				cd.Cluster.Status.RollingRestart = &cluster.RollingRestart{Phase: cluster.RollingRestartPhaseSwitchover}
+			},
+		},
+		{
+			name:  "abort without rolling restart",
+			abort: true,
+			cd: func(cd *cluster.ClusterData) {
+				cd.Cluster.Status.RollingRestart = &cluster.RollingRestart{Phase: cluster.RollingRestartPhaseAborted}
+			},
+			err: fmt.Errorf("no rolling restart in progress"),
+		},
+	}
+
+	for i, tt := range tests {
+		cd := testClusterData(2, false)
+		if tt.cd != nil {
+			tt.cd(cd)
+		}
+		err := checkRollingRestart(cd, tt.abort)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d (%s): got no error, wanted error: %v", i, tt.name, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d (%s): got error: %v, wanted error: %v", i, tt.name, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d (%s): unexpected error: %v", i, tt.name, err)
+		}
+	}
+}
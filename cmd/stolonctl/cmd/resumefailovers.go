@@ -0,0 +1,68 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+
+	cmdcommon "github.com/sorintlab/stolon/cmd"
+
+	"github.com/spf13/cobra"
+)
+
+var resumeFailoversCmd = &cobra.Command{
+	Use:   "resumefailovers",
+	Short: "Resume the automatic failovers halted by the cluster spec maxFailovers option",
+	Long:  `Resume the automatic failovers halted by the sentinel since the cluster spec maxFailovers automatic failovers have been done in maxFailoversWindow. The recorded automatic failovers are forgotten, so also the failoverCooldown is reset.`,
+	Run:   resumeFailovers,
+}
+
+func init() {
+	CmdStolonCtl.AddCommand(resumeFailoversCmd)
+}
+
+func resumeFailovers(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		die("too many arguments")
+	}
+
+	store, err := cmdcommon.NewStore(&cfg.CommonConfig)
+	if err != nil {
+		die("%v", err)
+	}
+
+	cd, pair, err := getClusterData(store)
+	if err != nil {
+		die("cannot get cluster data: %v", err)
+	}
+	if cd.Cluster == nil {
+		die("no cluster spec available")
+	}
+
+	halted := cd.Cluster.Status.FailoversHalted
+	newCd := cd.DeepCopy()
+	newCd.Cluster.Status.FailoversHalted = false
+	newCd.Cluster.Status.AutomaticFailovers = nil
+
+	_, err = store.AtomicPutClusterData(context.TODO(), newCd, pair)
+	if err != nil {
+		die("cannot update cluster data: %v", err)
+	}
+	if halted {
+		stdout("automatic failovers resumed")
+	} else {
+		stdout("automatic failovers weren't halted, recorded automatic failovers reset")
+	}
+}
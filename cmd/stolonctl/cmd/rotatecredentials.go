@@ -0,0 +1,238 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	cmdcommon "github.com/sorintlab/stolon/cmd"
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+
+	"github.com/spf13/cobra"
+)
+
+var rotateCredentialsCmd = &cobra.Command{
+	Use:   "rotatecredentials",
+	Short: "Coordinates the rotation of the superuser and replication passwords",
+	Long: `Coordinates the rotation of the superuser and replication passwords. Update the passwords in the secret source (password files or vault secrets) of all the keepers, started with --coordinated-password-rotation, then run this command: when all the keepers have read the same new passwords the master keeper changes the roles passwords and starts using them, then the standby keepers start using them.
+If the command is interrupted or times out, running it again resumes the rotation in progress.`,
+	Run: rotateCredentials,
+}
+
+type rotateCredentialsOptions struct {
+	timeout time.Duration
+}
+
+var rotateCredentialsOpts rotateCredentialsOptions
+
+// rotateCredentialsInterval is the interval between the checks of the
+// credentials rotation phases
+var rotateCredentialsInterval = 2 * time.Second
+
+func init() {
+	rotateCredentialsCmd.PersistentFlags().DurationVar(&rotateCredentialsOpts.timeout, "timeout", 5*time.Minute, "max time to wait for every credentials rotation phase")
+
+	CmdStolonCtl.AddCommand(rotateCredentialsCmd)
+}
+
+func rotateCredentials(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		die("too many arguments")
+	}
+
+	store, err := cmdcommon.NewStore(&cfg.CommonConfig)
+	if err != nil {
+		die("%v", err)
+	}
+
+	if err := rotateKeepersCredentials(store, rotateCredentialsOpts.timeout, rotateCredentialsInterval); err != nil {
+		die("cannot rotate credentials: %v", err)
+	}
+	stdout("credentials rotated")
+}
+
+// sortedKeepers returns the cluster keepers uids sorted
+func sortedKeepers(cd *cluster.ClusterData) []string {
+	keepers := []string{}
+	for uid := range cd.Keepers {
+		keepers = append(keepers, uid)
+	}
+	sort.Strings(keepers)
+	return keepers
+}
+
+// pendingPasswordsFingerprint returns the fingerprint of the pending
+// passwords when all the keepers report the same ones
+func pendingPasswordsFingerprint(cd *cluster.ClusterData, keepersInfo cluster.KeepersInfo) (string, error) {
+	keepers := sortedKeepers(cd)
+	if len(keepers) == 0 {
+		return "", fmt.Errorf("no keepers available")
+	}
+	var fingerprint string
+	for _, uid := range keepers {
+		ki, ok := keepersInfo[uid]
+		if !ok {
+			return "", fmt.Errorf("keeper %q isn't alive", uid)
+		}
+		if ki.Passwords == nil {
+			return "", fmt.Errorf("keeper %q hasn't been started with --coordinated-password-rotation", uid)
+		}
+		if ki.Passwords.PendingFingerprint == "" {
+			return "", fmt.Errorf("keeper %q hasn't read new passwords from its secret source", uid)
+		}
+		if fingerprint == "" {
+			fingerprint = ki.Passwords.PendingFingerprint
+		} else if ki.Passwords.PendingFingerprint != fingerprint {
+			return "", fmt.Errorf("keeper %q has read different new passwords than keeper %q", uid, keepers[0])
+		}
+	}
+	return fingerprint, nil
+}
+
+// keepersNotRotated returns the keepers not yet using the passwords of the
+// rotation. A keeper without pending passwords that hasn't applied the
+// rotation has been restarted reading the new passwords.
+func keepersNotRotated(cd *cluster.ClusterData, keepersInfo cluster.KeepersInfo, rotation *cluster.CredentialsRotation) []string {
+	notRotated := []string{}
+	for _, uid := range sortedKeepers(cd) {
+		ki, ok := keepersInfo[uid]
+		if ok && ki.Passwords != nil && (ki.Passwords.AppliedRotation == rotation.UID || ki.Passwords.PendingFingerprint == "") {
+			continue
+		}
+		notRotated = append(notRotated, uid)
+	}
+	return notRotated
+}
+
+// setCredentialsRotationPhase moves the credentials rotation to the phase
+func setCredentialsRotationPhase(e clusterDataStore, rotation *cluster.CredentialsRotation, phase cluster.CredentialsRotationPhase) error {
+	return updateClusterData(e, func(cd *cluster.ClusterData) error {
+		cur := cd.Cluster.Status.CredentialsRotation
+		if cur == nil || cur.UID != rotation.UID {
+			return fmt.Errorf("credentials rotation %q isn't in progress anymore", rotation.UID)
+		}
+		cur.Phase = phase
+		if phase == cluster.CredentialsRotationPhaseCompleted {
+			cur.EndTime = time.Now()
+		}
+		rotation.Phase = phase
+		return nil
+	})
+}
+
+// rotateKeepersCredentials waits for all the keepers to report the same new
+// passwords, then waits for the master keeper to change the roles passwords
+// and then for the standby keepers to use them. A credentials rotation in
+// progress is resumed.
+func rotateKeepersCredentials(e keepersInfoStore, timeout, interval time.Duration) error {
+	cd, _, err := getClusterData(e)
+	if err != nil {
+		return err
+	}
+	var rotation *cluster.CredentialsRotation
+	if cur := cd.Cluster.Status.CredentialsRotation; cur.InProgress() {
+		c := *cur
+		rotation = &c
+		stdout("resuming credentials rotation %q in phase %q", rotation.UID, rotation.Phase)
+	} else {
+		var fingerprint string
+		err := waitFor(timeout, interval, func() (bool, error) {
+			cd, _, err := getClusterData(e)
+			if err != nil {
+				return false, err
+			}
+			keepersInfo, err := e.GetKeepersInfo(context.TODO())
+			if err != nil {
+				return false, err
+			}
+			fingerprint, err = pendingPasswordsFingerprint(cd, keepersInfo)
+			return err == nil, err
+		})
+		if err != nil {
+			return fmt.Errorf("keepers not ready: %v", err)
+		}
+		rotation = &cluster.CredentialsRotation{
+			UID:         common.UID(),
+			Phase:       cluster.CredentialsRotationPhaseMaster,
+			Fingerprint: fingerprint,
+			StartTime:   time.Now(),
+		}
+		err = updateClusterData(e, func(cd *cluster.ClusterData) error {
+			if cd.Cluster.Status.CredentialsRotation.InProgress() {
+				return fmt.Errorf("credentials rotation already in progress")
+			}
+			cd.Cluster.Status.CredentialsRotation = rotation
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		stdout("credentials rotation %q started", rotation.UID)
+	}
+
+	if rotation.Phase == cluster.CredentialsRotationPhaseMaster {
+		stdout("waiting for the master keeper to change the roles passwords")
+		err := waitFor(timeout, interval, func() (bool, error) {
+			cd, _, err := getClusterData(e)
+			if err != nil {
+				return false, err
+			}
+			masterDB, ok := cd.DBs[cd.Cluster.Status.Master]
+			if !ok {
+				return false, fmt.Errorf("no master db available")
+			}
+			keepersInfo, err := e.GetKeepersInfo(context.TODO())
+			if err != nil {
+				return false, err
+			}
+			keeperUID := masterDB.Spec.KeeperUID
+			if ki, ok := keepersInfo[keeperUID]; ok && ki.Passwords != nil && ki.Passwords.AppliedRotation == rotation.UID {
+				return true, nil
+			}
+			return false, fmt.Errorf("master keeper %q hasn't changed the roles passwords", keeperUID)
+		})
+		if err != nil {
+			return fmt.Errorf("%v, run the command again to resume the rotation", err)
+		}
+		if err := setCredentialsRotationPhase(e, rotation, cluster.CredentialsRotationPhaseStandbys); err != nil {
+			return err
+		}
+	}
+
+	stdout("waiting for the standby keepers to use the new passwords")
+	err = waitFor(timeout, interval, func() (bool, error) {
+		cd, _, err := getClusterData(e)
+		if err != nil {
+			return false, err
+		}
+		keepersInfo, err := e.GetKeepersInfo(context.TODO())
+		if err != nil {
+			return false, err
+		}
+		if notRotated := keepersNotRotated(cd, keepersInfo, rotation); len(notRotated) > 0 {
+			return false, fmt.Errorf("keepers %s don't use the new passwords", strings.Join(notRotated, ", "))
+		}
+		return true, nil
+	})
+	if err != nil {
+		return fmt.Errorf("%v, run the command again to resume the rotation", err)
+	}
+	return setCredentialsRotationPhase(e, rotation, cluster.CredentialsRotationPhaseCompleted)
+}
@@ -0,0 +1,168 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+// testPasswordsKeepersInfo returns the keepers info of the cluster keepers with
+// the provided passwords status
+func testPasswordsKeepersInfo(cd *cluster.ClusterData, statusFn func(keeperUID string) *cluster.KeeperPasswordsStatus) cluster.KeepersInfo {
+	keepersInfo := cluster.KeepersInfo{}
+	for uid := range cd.Keepers {
+		keepersInfo[uid] = &cluster.KeeperInfo{UID: uid, Passwords: statusFn(uid)}
+	}
+	return keepersInfo
+}
+
+func TestPendingPasswordsFingerprint(t *testing.T) {
+	tests := []struct {
+		name     string
+		statusFn func(keeperUID string) *cluster.KeeperPasswordsStatus
+		remove   string
+		out      string
+		err      error
+	}{
+		{
+			name: "same pending passwords",
+			statusFn: func(keeperUID string) *cluster.KeeperPasswordsStatus {
+				return &cluster.KeeperPasswordsStatus{PendingFingerprint: "fp1"}
+			},
+			out: "fp1",
+		},
+		{
+			name: "different pending passwords",
+			statusFn: func(keeperUID string) *cluster.KeeperPasswordsStatus {
+				if keeperUID == "keeper3" {
+					return &cluster.KeeperPasswordsStatus{PendingFingerprint: "fp2"}
+				}
+				return &cluster.KeeperPasswordsStatus{PendingFingerprint: "fp1"}
+			},
+			err: fmt.Errorf(`keeper "keeper3" has read different new passwords than keeper "keeper1"`),
+		},
+		{
+			name: "no pending passwords",
+			statusFn: func(keeperUID string) *cluster.KeeperPasswordsStatus {
+				if keeperUID == "keeper2" {
+					return &cluster.KeeperPasswordsStatus{}
+				}
+				return &cluster.KeeperPasswordsStatus{PendingFingerprint: "fp1"}
+			},
+			err: fmt.Errorf(`keeper "keeper2" hasn't read new passwords from its secret source`),
+		},
+		{
+			name: "not coordinated keeper",
+			statusFn: func(keeperUID string) *cluster.KeeperPasswordsStatus {
+				return nil
+			},
+			err: fmt.Errorf(`keeper "keeper1" hasn't been started with --coordinated-password-rotation`),
+		},
+		{
+			name: "keeper not alive",
+			statusFn: func(keeperUID string) *cluster.KeeperPasswordsStatus {
+				return &cluster.KeeperPasswordsStatus{PendingFingerprint: "fp1"}
+			},
+			remove: "keeper2",
+			err:    fmt.Errorf(`keeper "keeper2" isn't alive`),
+		},
+	}
+
+	for i, tt := range tests {
+		cd := testClusterData(2, false)
+		keepersInfo := testPasswordsKeepersInfo(cd, tt.statusFn)
+		delete(keepersInfo, tt.remove)
+		out, err := pendingPasswordsFingerprint(cd, keepersInfo)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d (%s): got no error, wanted error: %v", i, tt.name, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d (%s): got error: %v, wanted error: %v", i, tt.name, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d (%s): unexpected error: %v", i, tt.name, err)
+		} else if out != tt.out {
+			t.Errorf("#%d (%s): got fingerprint %q, want %q", i, tt.name, out, tt.out)
+		}
+	}
+}
+
+func TestRotateKeepersCredentials(t *testing.T) {
+	cd := testClusterData(2, false)
+	cd.FormatVersion = cluster.CurrentCDFormatVersion
+	cd.Cluster.Spec.InitMode = cluster.ClusterInitModeP(cluster.ClusterInitModeNew)
+
+	// the keepers apply the passwords as the keeper state machine: the master
+	// in every phase and the standbys after the master phase
+	var masterPhaseStandbys []string
+	keepersFn := func(cd *cluster.ClusterData) cluster.KeepersInfo {
+		rotation := cd.Cluster.Status.CredentialsRotation
+		return testPasswordsKeepersInfo(cd, func(keeperUID string) *cluster.KeeperPasswordsStatus {
+			if rotation == nil {
+				return &cluster.KeeperPasswordsStatus{PendingFingerprint: "fp1"}
+			}
+			if keeperUID != "keeper1" && rotation.Phase == cluster.CredentialsRotationPhaseMaster {
+				masterPhaseStandbys = append(masterPhaseStandbys, keeperUID)
+				return &cluster.KeeperPasswordsStatus{PendingFingerprint: "fp1"}
+			}
+			return &cluster.KeeperPasswordsStatus{AppliedRotation: rotation.UID}
+		})
+	}
+	s := &testKeepersInfoStore{
+		testClusterDataStore: &testClusterDataStore{cd: cd},
+		keepersInfoFn:        keepersFn,
+	}
+	if err := rotateKeepersCredentials(s, 5*time.Second, 10*time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rotation := s.cd.Cluster.Status.CredentialsRotation
+	if rotation == nil || rotation.Phase != cluster.CredentialsRotationPhaseCompleted || rotation.Fingerprint != "fp1" {
+		t.Fatalf("got credentials rotation %+v, want a completed rotation", rotation)
+	}
+	if len(masterPhaseStandbys) == 0 {
+		t.Fatalf("the keepers info haven't been checked in the master phase")
+	}
+
+	// a standby not applying the passwords makes the rotation time out
+	// leaving it in progress, it's completed when run again
+	stuck := true
+	s.cd.Cluster.Status.CredentialsRotation = nil
+	s.keepersInfoFn = func(cd *cluster.ClusterData) cluster.KeepersInfo {
+		keepersInfo := keepersFn(cd)
+		if stuck && cd.Cluster.Status.CredentialsRotation != nil {
+			keepersInfo["keeper3"].Passwords = &cluster.KeeperPasswordsStatus{PendingFingerprint: "fp1"}
+		}
+		return keepersInfo
+	}
+	err := rotateKeepersCredentials(s, 100*time.Millisecond, 10*time.Millisecond)
+	if expected := `timeout: keepers keeper3 don't use the new passwords, run the command again to resume the rotation`; err == nil || err.Error() != expected {
+		t.Fatalf("got error: %v, wanted error: %s", err, expected)
+	}
+	rotation = s.cd.Cluster.Status.CredentialsRotation
+	if rotation == nil || rotation.Phase != cluster.CredentialsRotationPhaseStandbys {
+		t.Fatalf("got credentials rotation %+v, want a rotation in the standbys phase", rotation)
+	}
+	stuck = false
+	if err := rotateKeepersCredentials(s, 5*time.Second, 10*time.Millisecond); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cur := s.cd.Cluster.Status.CredentialsRotation; cur.UID != rotation.UID || cur.Phase != cluster.CredentialsRotationPhaseCompleted {
+		t.Fatalf("got credentials rotation %+v, want the resumed rotation completed", cur)
+	}
+}
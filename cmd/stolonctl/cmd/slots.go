@@ -0,0 +1,224 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	cmdcommon "github.com/sorintlab/stolon/cmd"
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+	"github.com/sorintlab/stolon/internal/util"
+
+	"github.com/spf13/cobra"
+)
+
+var listSlotsCmd = &cobra.Command{
+	Use:   "list-slots",
+	Short: "List the physical replication slots of the current master db",
+	Long:  `List the physical replication slots of the current master db (as last reported by its keeper) and the standby db, if any, they belong to. Slots not belonging to a standby or defined in the cluster spec additionalMasterReplicationSlots are reported as orphaned.`,
+	Run:   listSlots,
+}
+
+var dropSlotCmd = &cobra.Command{
+	Use:   "drop-slot [slot name]",
+	Short: "Drop a physical replication slot of the current master db",
+	Long:  `Request the master keeper to drop a physical replication slot. Slots belonging to a standby db are dropped only when --force is provided (the keeper will recreate them, releasing the retained wal). Slots defined in the cluster spec additionalMasterReplicationSlots and active slots cannot be dropped.`,
+	Run:   dropSlot,
+}
+
+type dropSlotOptions struct {
+	force bool
+}
+
+var dropSlotOpts dropSlotOptions
+
+func init() {
+	dropSlotCmd.PersistentFlags().BoolVar(&dropSlotOpts.force, "force", false, "drop the slot also if it belongs to a standby db")
+
+	CmdStolonCtl.AddCommand(listSlotsCmd)
+	CmdStolonCtl.AddCommand(dropSlotCmd)
+}
+
+// replSlotInfo is a master db replication slot and its owner
+type replSlotInfo struct {
+	slot *cluster.ReplicationSlotStatus
+	// standby db using the slot
+	dbUID string
+	// the slot is defined in additionalMasterReplicationSlots
+	additional bool
+	// retained wal bytes
+	retainedWal uint64
+}
+
+func (i *replSlotInfo) orphaned() bool {
+	return i.dbUID == "" && !i.additional
+}
+
+// masterReplSlots returns the replication slots of the current master db
+// sorted by name
+func masterReplSlots(cd *cluster.ClusterData) (*cluster.DB, []*replSlotInfo, error) {
+	if cd.Cluster == nil || cd.Cluster.Spec == nil {
+		return nil, nil, fmt.Errorf("no cluster spec available")
+	}
+	masterDB, ok := cd.DBs[cd.Cluster.Status.Master]
+	if !ok {
+		return nil, nil, fmt.Errorf("no master db available")
+	}
+	if masterDB.Status.ReplicationSlots == nil {
+		return nil, nil, fmt.Errorf("master db replication slots not reported by keeper %q", masterDB.Spec.KeeperUID)
+	}
+
+	additional := cd.Cluster.DefSpec().AdditionalMasterReplicationSlots
+	infos := []*replSlotInfo{}
+	for _, rs := range masterDB.Status.ReplicationSlots {
+		info := &replSlotInfo{slot: rs}
+		for _, db := range cd.DBs {
+			if db.UID != masterDB.UID && rs.Name == common.StolonName(db.UID) {
+				info.dbUID = db.UID
+			}
+		}
+		for _, slot := range additional {
+			if rs.Name == common.StolonName(slot) {
+				info.additional = true
+			}
+		}
+		if rs.RestartLSN != 0 && masterDB.Status.XLogPos > rs.RestartLSN {
+			info.retainedWal = masterDB.Status.XLogPos - rs.RestartLSN
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].slot.Name < infos[j].slot.Name })
+	return masterDB, infos, nil
+}
+
+func listSlots(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		die("too many arguments")
+	}
+
+	store, err := cmdcommon.NewStore(&cfg.CommonConfig)
+	if err != nil {
+		die("%v", err)
+	}
+
+	cd, _, err := getClusterData(store)
+	if err != nil {
+		die("%v", err)
+	}
+
+	masterDB, infos, err := masterReplSlots(cd)
+	if err != nil {
+		die("%v", err)
+	}
+
+	stdout("Master db: %s (keeper %s)", masterDB.UID, masterDB.Spec.KeeperUID)
+	stdout("")
+	if len(infos) == 0 {
+		stdout("No replication slots")
+		return
+	}
+
+	tabOut := new(tabwriter.Writer)
+	tabOut.Init(os.Stdout, 0, 8, 1, '\t', 0)
+	fmt.Fprintf(tabOut, "NAME\tACTIVE\tRETAINED WAL\tOWNER\n")
+	for _, info := range infos {
+		owner := "orphaned"
+		switch {
+		case info.dbUID != "":
+			owner = fmt.Sprintf("standby db %s", info.dbUID)
+			if db := cd.DBs[info.dbUID]; db.Spec.KeeperUID != "" {
+				owner = fmt.Sprintf("%s (keeper %s)", owner, db.Spec.KeeperUID)
+			}
+		case info.additional:
+			owner = "additionalMasterReplicationSlots"
+		}
+		fmt.Fprintf(tabOut, "%s\t%t\t%d\t%s\n", info.slot.Name, info.slot.Active, info.retainedWal, owner)
+	}
+	tabOut.Flush()
+}
+
+// checkDropSlot checks if the provided replication slot of the current master
+// db can be dropped. It returns the master db.
+func checkDropSlot(cd *cluster.ClusterData, name string, force bool) (*cluster.DB, error) {
+	masterDB, infos, err := masterReplSlots(cd)
+	if err != nil {
+		return nil, err
+	}
+	var info *replSlotInfo
+	for _, i := range infos {
+		if i.slot.Name == name {
+			info = i
+		}
+	}
+	if info == nil {
+		return nil, fmt.Errorf("replication slot doesn't exist on the master db")
+	}
+	if info.additional {
+		return nil, fmt.Errorf("replication slot is defined in the cluster spec additionalMasterReplicationSlots, remove it from there")
+	}
+	if info.slot.Active {
+		return nil, fmt.Errorf("replication slot is active")
+	}
+	if info.dbUID != "" && !force {
+		return nil, fmt.Errorf("replication slot belongs to the standby db %q, use --force to drop it", info.dbUID)
+	}
+	if util.StringInSlice(masterDB.Spec.DropReplicationSlots, name) {
+		return nil, fmt.Errorf("replication slot drop already requested")
+	}
+	return masterDB, nil
+}
+
+func dropSlot(cmd *cobra.Command, args []string) {
+	if len(args) > 1 {
+		die("too many arguments")
+	}
+
+	if len(args) == 0 {
+		die("replication slot name required")
+	}
+
+	name := args[0]
+
+	store, err := cmdcommon.NewStore(&cfg.CommonConfig)
+	if err != nil {
+		die("%v", err)
+	}
+
+	cd, pair, err := getClusterData(store)
+	if err != nil {
+		die("%v", err)
+	}
+
+	masterDB, err := checkDropSlot(cd, name, dropSlotOpts.force)
+	if err != nil {
+		die("cannot drop replication slot %q: %v", name, err)
+	}
+
+	newCd := cd.DeepCopy()
+	db := newCd.DBs[masterDB.UID]
+	db.Spec.DropReplicationSlots = append(db.Spec.DropReplicationSlots, name)
+	db.Generation++
+
+	_, err = store.AtomicPutClusterData(context.TODO(), newCd, pair)
+	if err != nil {
+		die("cannot update cluster data: %v", err)
+	}
+	stdout("requested keeper %q to drop replication slot %q", masterDB.Spec.KeeperUID, name)
+}
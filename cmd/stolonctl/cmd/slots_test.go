@@ -0,0 +1,172 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+// testSlotsClusterData returns a cluster data whose master db has a slot for
+// its standby db2, an additional slot, an orphaned slot of a removed db and an
+// active orphaned slot
+func testSlotsClusterData() *cluster.ClusterData {
+	cd := testClusterData(1, false)
+	cd.Cluster.Spec.AdditionalMasterReplicationSlots = []string{"backup"}
+	masterDB := cd.DBs["db1"]
+	masterDB.Status.XLogPos = 1000
+	masterDB.Status.ReplicationSlots = []*cluster.ReplicationSlotStatus{
+		{Name: "stolon_db2", Active: true, RestartLSN: 900},
+		{Name: "stolon_backup", RestartLSN: 500},
+		{Name: "stolon_db9", RestartLSN: 100},
+		{Name: "external"},
+		{Name: "consumer", Active: true, RestartLSN: 1000},
+	}
+	return cd
+}
+
+func TestMasterReplSlots(t *testing.T) {
+	cd := testSlotsClusterData()
+	_, infos, err := masterReplSlots(cd)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	type out struct {
+		name        string
+		dbUID       string
+		additional  bool
+		orphaned    bool
+		retainedWal uint64
+	}
+	expected := []out{
+		{name: "consumer", orphaned: true},
+		{name: "external", orphaned: true},
+		{name: "stolon_backup", additional: true, retainedWal: 500},
+		{name: "stolon_db2", dbUID: "db2", retainedWal: 100},
+		{name: "stolon_db9", orphaned: true, retainedWal: 900},
+	}
+	if len(infos) != len(expected) {
+		t.Fatalf("got %d slots, want: %d", len(infos), len(expected))
+	}
+	for i, info := range infos {
+		o := out{name: info.slot.Name, dbUID: info.dbUID, additional: info.additional, orphaned: info.orphaned(), retainedWal: info.retainedWal}
+		if o != expected[i] {
+			t.Errorf("#%d: got: %+v, want: %+v", i, o, expected[i])
+		}
+	}
+
+	cd.DBs["db1"].Status.ReplicationSlots = nil
+	if _, _, err := masterReplSlots(cd); err == nil {
+		t.Errorf("got no error for not reported replication slots")
+	}
+}
+
+func TestCheckDropSlot(t *testing.T) {
+	tests := []struct {
+		name  string
+		slot  string
+		force bool
+		cd    func() *cluster.ClusterData
+		err   error
+	}{
+		{
+			name: "orphaned slot",
+			slot: "stolon_db9",
+		},
+		{
+			name: "orphaned external slot",
+			slot: "external",
+		},
+		{
+			name: "not existing slot",
+			slot: "notexisting",
+			err:  fmt.Errorf("replication slot doesn't exist on the master db"),
+		},
+		{
+			name:  "additional slot",
+			slot:  "stolon_backup",
+			force: true,
+			err:   fmt.Errorf("replication slot is defined in the cluster spec additionalMasterReplicationSlots, remove it from there"),
+		},
+		{
+			name:  "active slot",
+			slot:  "consumer",
+			force: true,
+			err:   fmt.Errorf("replication slot is active"),
+		},
+		{
+			name: "standby slot",
+			slot: "stolon_db2",
+			cd: func() *cluster.ClusterData {
+				cd := testSlotsClusterData()
+				cd.DBs["db1"].Status.ReplicationSlots[0].Active = false
+				return cd
+			},
+			err: fmt.Errorf(`replication slot belongs to the standby db "db2", use --force to drop it`),
+		},
+		{
+			name:  "forced standby slot",
+			slot:  "stolon_db2",
+			force: true,
+			cd: func() *cluster.ClusterData {
+				cd := testSlotsClusterData()
+				cd.DBs["db1"].Status.ReplicationSlots[0].Active = false
+				return cd
+			},
+		},
+		{
+			name: "already requested",
+			slot: "stolon_db9",
+			cd: func() *cluster.ClusterData {
+				cd := testSlotsClusterData()
+				cd.DBs["db1"].Spec.DropReplicationSlots = []string{"stolon_db9"}
+				return cd
+			},
+			err: fmt.Errorf("replication slot drop already requested"),
+		},
+		{
+			name: "no master",
+			slot: "stolon_db9",
+			cd: func() *cluster.ClusterData {
+				cd := testSlotsClusterData()
+				cd.Cluster.Status.Master = ""
+				return cd
+			},
+			err: fmt.Errorf("no master db available"),
+		},
+	}
+
+	for i, tt := range tests {
+		cd := testSlotsClusterData()
+		if tt.cd != nil {
+			cd = tt.cd()
+		}
+		masterDB, err := checkDropSlot(cd, tt.slot, tt.force)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d (%s): got no error, wanted error: %v", i, tt.name, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d (%s): got error: %v, wanted error: %v", i, tt.name, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d (%s): unexpected error: %v", i, tt.name, err)
+		} else if masterDB.UID != "db1" {
+			t.Errorf("#%d (%s): wrong master db: %s", i, tt.name, masterDB.UID)
+		}
+	}
+}
@@ -15,9 +15,14 @@
 package cmd
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
 
-	cmdcommon "github.com/sorintlab/stolon/cmd"
+	"github.com/sorintlab/stolon/internal/cluster"
 	"github.com/spf13/cobra"
 )
 
@@ -27,20 +32,42 @@ var cmdSpec = &cobra.Command{
 	Short: "Retrieve the current cluster specification",
 }
 
+var cmdSpecValidate = &cobra.Command{
+	Use:   "validate",
+	Run:   specValidate,
+	Short: "Validate a cluster specification",
+	Long:  `Validate a cluster specification, or a patch to the current one, without applying it. When a cluster exists it also executes all the checks done by "stolonctl update".`,
+}
+
+var cmdSpecDiff = &cobra.Command{
+	Use:   "diff",
+	Run:   specDiff,
+	Short: "Show the differences between the current cluster specification and a new one",
+	Long:  `Validate a cluster specification, or a patch to the current one, like "spec validate" and show the fields that would be changed by "stolonctl update" (default values included).`,
+}
+
 type specOptions struct {
 	defaults bool
+	patch    bool
+	file     string
 }
 
 var specOpts specOptions
 
 func init() {
-	cmdSpec.PersistentFlags().BoolVar(&specOpts.defaults, "defaults", false, "also show default values")
+	cmdSpec.Flags().BoolVar(&specOpts.defaults, "defaults", false, "also show default values")
+
+	for _, cmd := range []*cobra.Command{cmdSpecValidate, cmdSpecDiff} {
+		cmd.PersistentFlags().BoolVarP(&specOpts.patch, "patch", "p", false, "the provided cluster specification is a patch to apply to the current cluster specification")
+		cmd.PersistentFlags().StringVarP(&specOpts.file, "file", "f", "", "file containing a complete cluster specification or a patch to apply to the current cluster specification")
+		cmdSpec.AddCommand(cmd)
+	}
 
 	CmdStolonCtl.AddCommand(cmdSpec)
 }
 
 func spec(cmd *cobra.Command, args []string) {
-	e, err := cmdcommon.NewStore(&cfg.CommonConfig)
+	e, err := newSpecStore()
 	if err != nil {
 		die("%v", err)
 	}
@@ -66,3 +93,169 @@ func spec(cmd *cobra.Command, args []string) {
 
 	stdout("%s", specj)
 }
+
+// checkNewClusterSpec executes on the provided cluster data, if any, the same
+// checks done when updating the cluster spec. It returns the new cluster spec.
+func checkNewClusterSpec(cd *cluster.ClusterData, data []byte, patch bool) (*cluster.ClusterSpec, error) {
+	if cd == nil || cd.Cluster == nil || cd.Cluster.Spec == nil {
+		if patch {
+			return nil, fmt.Errorf("no cluster spec available to patch")
+		}
+		newcs, err := newClusterSpec(nil, data, specPatchNone)
+		if err != nil {
+			return nil, err
+		}
+		if err := newcs.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid cluster spec: %v", err)
+		}
+		return newcs, nil
+	}
+	patchType := specPatchNone
+	if patch {
+		patchType = specPatchStrategic
+	}
+	newcs, err := newClusterSpec(cd.Cluster.Spec, data, patchType)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyClusterSpec(cd.DeepCopy(), newcs); err != nil {
+		return nil, err
+	}
+	return newcs, nil
+}
+
+// specFieldDiff is a cluster spec field changed between two cluster specs.
+// Old or new are nil when the field doesn't exist in the related spec.
+type specFieldDiff struct {
+	path string
+	old  interface{}
+	new  interface{}
+}
+
+func (d specFieldDiff) String() string {
+	switch {
+	case d.old == nil:
+		return fmt.Sprintf("+ %s: %s", d.path, diffValue(d.new))
+	case d.new == nil:
+		return fmt.Sprintf("- %s: %s", d.path, diffValue(d.old))
+	}
+	return fmt.Sprintf("~ %s: %s -> %s", d.path, diffValue(d.old), diffValue(d.new))
+}
+
+func diffValue(v interface{}) string {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(j)
+}
+
+// diffClusterSpecs returns the fields, sorted by path, changed between the
+// json encoding of the two cluster specs. Objects are compared field by
+// field, arrays as a whole.
+func diffClusterSpecs(a, b *cluster.ClusterSpec) ([]specFieldDiff, error) {
+	av, err := specJSONValue(a)
+	if err != nil {
+		return nil, err
+	}
+	bv, err := specJSONValue(b)
+	if err != nil {
+		return nil, err
+	}
+	diffs := []specFieldDiff{}
+	diffJSONValues("", av, bv, &diffs)
+	return diffs, nil
+}
+
+func specJSONValue(cs *cluster.ClusterSpec) (interface{}, error) {
+	j, err := json.Marshal(cs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal cluster spec: %v", err)
+	}
+	var v interface{}
+	// use json.Number to avoid converting integers to floats
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("failed to decode cluster spec: %v", err)
+	}
+	return v, nil
+}
+
+func diffJSONValues(path string, a, b interface{}, diffs *[]specFieldDiff) {
+	am, aok := a.(map[string]interface{})
+	bm, bok := b.(map[string]interface{})
+	if !aok || !bok {
+		if !reflect.DeepEqual(a, b) {
+			*diffs = append(*diffs, specFieldDiff{path: path, old: a, new: b})
+		}
+		return
+	}
+	keys := []string{}
+	for k := range am {
+		keys = append(keys, k)
+	}
+	for k := range bm {
+		if _, ok := am[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		p := k
+		if path != "" {
+			p = path + "." + k
+		}
+		diffJSONValues(p, am[k], bm[k], diffs)
+	}
+}
+
+func specValidate(cmd *cobra.Command, args []string) {
+	data := readSpecData(args, specOpts.file)
+
+	e, err := newSpecStore()
+	if err != nil {
+		die("%v", err)
+	}
+
+	cd, _, err := e.GetClusterData(context.TODO())
+	if err != nil {
+		die("cannot get cluster data: %v", err)
+	}
+	if _, err := checkNewClusterSpec(cd, data, specOpts.patch); err != nil {
+		die("cluster spec check failed: %v", err)
+	}
+	stdout("cluster spec is valid")
+}
+
+func specDiff(cmd *cobra.Command, args []string) {
+	data := readSpecData(args, specOpts.file)
+
+	e, err := newSpecStore()
+	if err != nil {
+		die("%v", err)
+	}
+
+	cd, _, err := getClusterData(e)
+	if err != nil {
+		die("%v", err)
+	}
+	if cd.Cluster == nil || cd.Cluster.Spec == nil {
+		die("no cluster spec available")
+	}
+	newcs, err := checkNewClusterSpec(cd, data, specOpts.patch)
+	if err != nil {
+		die("cluster spec check failed: %v", err)
+	}
+	diffs, err := diffClusterSpecs(cd.Cluster.Spec.WithDefaults(), newcs.WithDefaults())
+	if err != nil {
+		die("%v", err)
+	}
+	if len(diffs) == 0 {
+		stdout("no changes")
+		return
+	}
+	for _, d := range diffs {
+		stdout("%s", d)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+func TestDiffClusterSpecs(t *testing.T) {
+	tests := []struct {
+		a     *cluster.ClusterSpec
+		b     *cluster.ClusterSpec
+		diffs []string
+	}{
+		{
+			a:     &cluster.ClusterSpec{MaxStandbys: cluster.Uint16P(5)},
+			b:     &cluster.ClusterSpec{MaxStandbys: cluster.Uint16P(5)},
+			diffs: []string{},
+		},
+		{
+			a: &cluster.ClusterSpec{
+				MaxStandbys:  cluster.Uint16P(5),
+				PGParameters: cluster.PGParameters{"work_mem": "4MB", "max_connections": "100"},
+			},
+			b: &cluster.ClusterSpec{
+				MaxStandbys:            cluster.Uint16P(3),
+				SynchronousReplication: cluster.BoolP(true),
+				PGParameters:           cluster.PGParameters{"max_connections": "200"},
+			},
+			diffs: []string{
+				`~ maxStandbys: 5 -> 3`,
+				`~ pgParameters.max_connections: "100" -> "200"`,
+				`- pgParameters.work_mem: "4MB"`,
+				`+ synchronousReplication: true`,
+			},
+		},
+		{
+			a:     &cluster.ClusterSpec{AdditionalMasterReplicationSlots: []string{"slot1"}},
+			b:     &cluster.ClusterSpec{AdditionalMasterReplicationSlots: []string{"slot1", "slot2"}},
+			diffs: []string{`~ additionalMasterReplicationSlots: ["slot1"] -> ["slot1","slot2"]`},
+		},
+	}
+
+	for i, tt := range tests {
+		diffs, err := diffClusterSpecs(tt.a, tt.b)
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		out := []string{}
+		for _, d := range diffs {
+			out = append(out, d.String())
+		}
+		if !reflect.DeepEqual(out, tt.diffs) {
+			t.Errorf("#%d: got diffs: %q, want: %q", i, out, tt.diffs)
+		}
+	}
+}
+
+func TestCheckNewClusterSpec(t *testing.T) {
+	tests := []struct {
+		name  string
+		noCD  bool
+		data  string
+		patch bool
+		err   error
+	}{
+		{
+			name: "valid spec",
+			data: `{ "initMode": "new", "maxStandbys": 3 }`,
+		},
+		{
+			name:  "valid patch",
+			data:  `{ "maxStandbys": 3 }`,
+			patch: true,
+		},
+		{
+			name:  "invalid patch",
+			data:  `{ "maxStandbys": 0 }`,
+			patch: true,
+			err:   fmt.Errorf("invalid cluster spec: maxStandbys must be at least 1"),
+		},
+		{
+			name: "init mode change",
+			data: `{ "initMode": "existing", "existingConfig": { "keeperUID": "keeper1" } }`,
+			err:  fmt.Errorf("cannot change cluster init mode"),
+		},
+		{
+			name: "wrong json",
+			data: `{ "maxStandbys": 3`,
+			err:  fmt.Errorf("failed to unmarshal cluster spec: unexpected end of JSON input"),
+		},
+		{
+			name: "valid spec without cluster",
+			noCD: true,
+			data: `{ "initMode": "new" }`,
+		},
+		{
+			name: "invalid spec without cluster",
+			noCD: true,
+			data: `{ "maxStandbys": 3 }`,
+			err:  fmt.Errorf("invalid cluster spec: initMode undefined"),
+		},
+		{
+			name:  "patch without cluster",
+			noCD:  true,
+			data:  `{ "maxStandbys": 3 }`,
+			patch: true,
+			err:   fmt.Errorf("no cluster spec available to patch"),
+		},
+	}
+
+	for i, tt := range tests {
+		var cd *cluster.ClusterData
+		if !tt.noCD {
+			cd = testClusterData(1, false)
+			cd.Cluster.Spec.InitMode = cluster.ClusterInitModeP(cluster.ClusterInitModeNew)
+		}
+		_, err := checkNewClusterSpec(cd, []byte(tt.data), tt.patch)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d (%s): got no error, wanted error: %v", i, tt.name, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d (%s): got error: %v, wanted error: %v", i, tt.name, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d (%s): unexpected error: %v", i, tt.name, err)
+		}
+		if cd != nil && *cd.Cluster.Spec.InitMode != cluster.ClusterInitModeNew {
+			t.Errorf("#%d (%s): cluster data modified", i, tt.name)
+		}
+	}
+}
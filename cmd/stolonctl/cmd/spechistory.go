@@ -0,0 +1,206 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+
+	"github.com/spf13/cobra"
+)
+
+// specHistorySize is the number of cluster spec changes kept in the store
+// spec history
+const specHistorySize = 100
+
+var cmdSpecHistory = &cobra.Command{
+	Use:   "history",
+	Run:   specHistory,
+	Short: "List the cluster specification changes saved in the store spec history",
+	Long:  `List the cluster specification changes done by stolonctl (cluster generation, time, user, host, command and changed fields) saved in the store spec history, oldest first. Only the last ` + strconv.Itoa(specHistorySize) + ` changes are kept.`,
+}
+
+var cmdSpecRollback = &cobra.Command{
+	Use:   "rollback [generation]",
+	Run:   specRollback,
+	Short: "Restore the cluster specification of a previous cluster generation",
+	Long:  `Restore the cluster specification saved in the store spec history for the provided cluster generation (as reported by "stolonctl spec history"). The restore is a new cluster specification change.`,
+}
+
+type specHistoryOptions struct {
+	outputOptions
+}
+
+var specHistoryOpts specHistoryOptions
+
+func init() {
+	addOutputFlags(cmdSpecHistory, &specHistoryOpts.outputOptions, outputText, outputText, outputJSON, outputYAML)
+
+	cmdSpec.AddCommand(cmdSpecHistory)
+	cmdSpec.AddCommand(cmdSpecRollback)
+}
+
+// specStore is the subset of store.Store used to update the cluster spec and
+// record its changes
+type specStore interface {
+	clusterDataStore
+	AppendSpecChange(ctx context.Context, c *cluster.SpecChange, max int) error
+	GetSpecHistory(ctx context.Context) ([]*cluster.SpecChange, error)
+}
+
+// specChangeAuthor returns the user running stolonctl and its host
+func specChangeAuthor() (string, string) {
+	username := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	host, _ := os.Hostname()
+	return username, host
+}
+
+func newSpecChange(c *cluster.Cluster, command string, diffs []specFieldDiff) *cluster.SpecChange {
+	sc := &cluster.SpecChange{
+		Generation: c.Generation,
+		Time:       time.Now(),
+		ClusterUID: c.UID,
+		Command:    command,
+		Spec:       c.Spec,
+	}
+	sc.User, sc.Host = specChangeAuthor()
+	for _, d := range diffs {
+		sc.Changes = append(sc.Changes, d.String())
+	}
+	return sc
+}
+
+// recordSpecChange records the cluster spec change in the spec history. Since
+// the cluster spec has already been updated a failure is only reported.
+func recordSpecChange(e specStore, c *cluster.Cluster, command string, diffs []specFieldDiff) {
+	if err := e.AppendSpecChange(context.TODO(), newSpecChange(c, command, diffs), specHistorySize); err != nil {
+		stderr("warning: cannot record the cluster spec change in the spec history: %v", err)
+	}
+}
+
+// findSpecChange returns the change of the current cluster at the provided
+// generation
+func findSpecChange(history []*cluster.SpecChange, c *cluster.Cluster, generation int64) (*cluster.SpecChange, error) {
+	for _, sc := range history {
+		if sc.ClusterUID == c.UID && sc.Generation == generation {
+			if sc.Spec == nil {
+				return nil, fmt.Errorf("no cluster spec saved for generation %d", generation)
+			}
+			return sc, nil
+		}
+	}
+	return nil, fmt.Errorf("generation %d not in the spec history", generation)
+}
+
+func writeSpecHistoryText(w io.Writer, history []*cluster.SpecChange) {
+	if len(history) == 0 {
+		fmt.Fprintf(w, "No cluster spec changes\n")
+		return
+	}
+	for i, sc := range history {
+		if i > 0 {
+			fmt.Fprintf(w, "\n")
+		}
+		fmt.Fprintf(w, "generation %d, %s, %s@%s: stolonctl %s\n", sc.Generation, sc.Time.Format(time.RFC3339), sc.User, sc.Host, sc.Command)
+		for _, change := range sc.Changes {
+			fmt.Fprintf(w, "  %s\n", change)
+		}
+	}
+}
+
+func specHistory(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		die("too many arguments")
+	}
+	if err := specHistoryOpts.validate(outputText, outputJSON, outputYAML); err != nil {
+		die("%v", err)
+	}
+
+	e, err := newSpecStore()
+	if err != nil {
+		die("%v", err)
+	}
+
+	history, err := e.GetSpecHistory(context.TODO())
+	if err != nil {
+		die("cannot get the spec history: %v", err)
+	}
+
+	if specHistoryOpts.output != outputText || specHistoryOpts.template != "" {
+		if err := writeOutput(os.Stdout, history, specHistoryOpts.outputOptions, true); err != nil {
+			die("%v", err)
+		}
+		return
+	}
+	writeSpecHistoryText(os.Stdout, history)
+}
+
+// rollbackClusterSpec restores the cluster spec of the provided generation. It
+// returns the written cluster data.
+func rollbackClusterSpec(e specStore, generation int64) (*cluster.ClusterData, error) {
+	cd, _, err := getClusterData(e)
+	if err != nil {
+		return nil, err
+	}
+	if cd.Cluster == nil {
+		return nil, fmt.Errorf("no cluster available")
+	}
+	history, err := e.GetSpecHistory(context.TODO())
+	if err != nil {
+		return nil, fmt.Errorf("cannot get the spec history: %v", err)
+	}
+	sc, err := findSpecChange(history, cd.Cluster, generation)
+	if err != nil {
+		return nil, err
+	}
+	_, written, err := updateClusterSpec(e, fmt.Sprintf("spec rollback %d", generation), func(cs *cluster.ClusterSpec) (*cluster.ClusterSpec, error) {
+		return sc.Spec.DeepCopy(), nil
+	})
+	return written, err
+}
+
+func specRollback(cmd *cobra.Command, args []string) {
+	if len(args) > 1 {
+		die("too many arguments")
+	}
+	if len(args) == 0 {
+		die("cluster generation required")
+	}
+	generation, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		die("wrong cluster generation %q: %v", args[0], err)
+	}
+
+	e, err := newSpecStore()
+	if err != nil {
+		die("%v", err)
+	}
+
+	written, err := rollbackClusterSpec(e, generation)
+	if err != nil {
+		die("%v", err)
+	}
+	stdout("cluster spec of generation %d restored (current generation: %d)", generation, written.Cluster.Generation)
+}
@@ -0,0 +1,124 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+func TestSpecHistoryRecording(t *testing.T) {
+	cd := testClusterData(1, false)
+	cd.FormatVersion = cluster.CurrentCDFormatVersion
+	cd.Cluster.Spec.InitMode = cluster.ClusterInitModeP(cluster.ClusterInitModeNew)
+	e := &testClusterDataStore{cd: cd}
+
+	setMaxStandbys := func(n uint16) func(cs *cluster.ClusterSpec) (*cluster.ClusterSpec, error) {
+		return func(cs *cluster.ClusterSpec) (*cluster.ClusterSpec, error) {
+			ncs := cs.DeepCopy()
+			ncs.MaxStandbys = cluster.Uint16P(n)
+			return ncs, nil
+		}
+	}
+
+	for _, n := range []uint16{5, 5, 6} {
+		if _, _, err := updateClusterSpec(e, "update", setMaxStandbys(n)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// the update not changing the cluster spec isn't recorded
+	if len(e.history) != 2 {
+		t.Fatalf("got %d spec changes, want: 2", len(e.history))
+	}
+	if e.cd.Cluster.Generation != 3 {
+		t.Fatalf("got cluster generation %d, want: 3", e.cd.Cluster.Generation)
+	}
+	expected := [][]string{
+		{"+ maxStandbys: 5"},
+		{"~ maxStandbys: 5 -> 6"},
+	}
+	for i, sc := range e.history {
+		if sc.Generation != int64(i+2) {
+			t.Errorf("#%d: got generation %d, want: %d", i, sc.Generation, i+2)
+		}
+		if sc.ClusterUID != "cluster1" || sc.Command != "update" {
+			t.Errorf("#%d: wrong cluster uid or command: %q, %q", i, sc.ClusterUID, sc.Command)
+		}
+		if !reflect.DeepEqual(sc.Changes, expected[i]) {
+			t.Errorf("#%d: got changes: %v, want: %v", i, sc.Changes, expected[i])
+		}
+	}
+
+	written, err := rollbackClusterSpec(e, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *written.Cluster.Spec.MaxStandbys != 5 {
+		t.Errorf("got maxStandbys %d after rollback, want: 5", *written.Cluster.Spec.MaxStandbys)
+	}
+	if written.Cluster.Generation != 4 {
+		t.Errorf("got cluster generation %d after rollback, want: 4", written.Cluster.Generation)
+	}
+	last := e.history[len(e.history)-1]
+	if last.Command != "spec rollback 2" || !reflect.DeepEqual(last.Changes, []string{"~ maxStandbys: 6 -> 5"}) {
+		t.Errorf("wrong rollback spec change: %q, %v", last.Command, last.Changes)
+	}
+}
+
+func TestFindSpecChange(t *testing.T) {
+	c := &cluster.Cluster{UID: "cluster1"}
+	history := []*cluster.SpecChange{
+		{ClusterUID: "cluster0", Generation: 2, Spec: &cluster.ClusterSpec{}},
+		{ClusterUID: "cluster1", Generation: 1},
+		{ClusterUID: "cluster1", Generation: 3, Spec: &cluster.ClusterSpec{}},
+	}
+
+	tests := []struct {
+		generation int64
+		err        error
+	}{
+		{
+			generation: 3,
+		},
+		// change of a previous cluster
+		{
+			generation: 2,
+			err:        fmt.Errorf("generation 2 not in the spec history"),
+		},
+		{
+			generation: 1,
+			err:        fmt.Errorf("no cluster spec saved for generation 1"),
+		},
+	}
+
+	for i, tt := range tests {
+		sc, err := findSpecChange(history, c, tt.generation)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		} else if sc.Generation != tt.generation {
+			t.Errorf("#%d: got generation %d, want: %d", i, sc.Generation, tt.generation)
+		}
+	}
+}
@@ -19,11 +19,15 @@ import (
 	"fmt"
 	"os"
 	"sort"
+	"strings"
 	"text/tabwriter"
+	"time"
 
 	cmdcommon "github.com/sorintlab/stolon/cmd"
 	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
 	"github.com/sorintlab/stolon/internal/store"
+	"github.com/sorintlab/stolon/internal/util"
 
 	"github.com/spf13/cobra"
 )
@@ -34,10 +38,188 @@ var cmdStatus = &cobra.Command{
 	Short: "Display the current cluster status",
 }
 
+type statusOptions struct {
+	outputOptions
+}
+
+var statusOpts statusOptions
+
 func init() {
+	addOutputFlags(cmdStatus, &statusOpts.outputOptions, outputText, outputText, outputJSON, outputYAML)
+
 	CmdStolonCtl.AddCommand(cmdStatus)
 }
 
+// statusOutput is the status reported by the json and yaml outputs. Other
+// than the summary it only aggregates the types saved in the store so their
+// format is the same of the stored cluster data.
+type statusOutput struct {
+	Sentinels         cluster.SentinelsInfo    `json:"sentinels"`
+	LeaderSentinelUID string                   `json:"leaderSentinelUID"`
+	Proxies           cluster.ProxiesInfoSlice `json:"proxies"`
+	ClusterData       *cluster.ClusterData     `json:"clusterData"`
+
+	Summary *statusSummary `json:"summary"`
+}
+
+// statusSummary is a summary of the cluster state. Contrary to the cluster
+// data its format is kept stable across stolon versions (fields are only
+// added) so it can be consumed by monitoring systems.
+type statusSummary struct {
+	Phase cluster.ClusterPhase `json:"phase"`
+	// master keeper uid, empty when there's no master
+	MasterKeeper string `json:"masterKeeper"`
+	// keepers uids of the standbys currently configured as synchronous
+	SynchronousStandbyKeepers []string         `json:"synchronousStandbyKeepers"`
+	FailoversHalted           bool             `json:"failoversHalted"`
+	Keepers                   []*keeperSummary `json:"keepers"`
+	// end time of the last completed scheduled backup, null when there
+	// isn't one
+	LastBackupTime *time.Time `json:"lastBackupTime"`
+	// synchronous replication mode (sync, blocking or degraded), empty when
+	// synchronous replication is disabled
+	SyncReplMode cluster.SyncReplMode `json:"syncReplMode"`
+}
+
+type keeperSummary struct {
+	UID     string `json:"uid"`
+	Healthy bool   `json:"healthy"`
+	Fenced  bool   `json:"fenced"`
+	Drained bool   `json:"drained"`
+	// the keeper is in maintenance mode
+	Maintenance bool `json:"maintenance"`
+	// full version of the postgres binaries used by the keeper
+	PostgresVersion string `json:"postgresVersion"`
+	// the fields below are empty when the keeper has no db assigned
+	DBUID              string      `json:"dbUID"`
+	Role               common.Role `json:"role"`
+	SynchronousStandby bool        `json:"synchronousStandby"`
+	PGHealthy          bool        `json:"pgHealthy"`
+	PGReady            bool        `json:"pgReady"`
+	TimelineID         uint64      `json:"timelineID"`
+	XLogPos            uint64      `json:"xlogPos"`
+	// replication lag in bytes from the master
+	ReplicationLag uint64 `json:"replicationLag"`
+	// lag in bytes of the replayed position from the master and time since
+	// the commit on the master of the last replayed transaction
+	ReplayLag   uint64            `json:"replayLag"`
+	ReplayDelay *cluster.Duration `json:"replayDelay"`
+	// end time and result of the last completed data checksums verification
+	ChecksumsVerificationTime   *time.Time `json:"checksumsVerificationTime"`
+	ChecksumsVerificationFailed bool       `json:"checksumsVerificationFailed"`
+}
+
+// statusMasterKeeper returns the keeper of the master db, nil when there's no
+// master
+func statusMasterKeeper(cd *cluster.ClusterData) *cluster.Keeper {
+	if cd.Cluster == nil {
+		return nil
+	}
+	masterDB, ok := cd.DBs[cd.Cluster.Status.Master]
+	if !ok {
+		return nil
+	}
+	return cd.Keepers[masterDB.Spec.KeeperUID]
+}
+
+// newStatusSummary returns the summary of the cluster data
+func newStatusSummary(cd *cluster.ClusterData) *statusSummary {
+	s := &statusSummary{
+		SynchronousStandbyKeepers: []string{},
+		Keepers:                   []*keeperSummary{},
+	}
+	var masterDB *cluster.DB
+	if cd.Cluster != nil {
+		s.Phase = cd.Cluster.Status.Phase
+		s.FailoversHalted = cd.Cluster.Status.FailoversHalted
+		s.SyncReplMode = cd.Cluster.SyncReplMode()
+		masterDB = cd.DBs[cd.Cluster.Status.Master]
+		if b := lastCompletedBackup(cd.Cluster.Status.BackupHistory); b != nil {
+			s.LastBackupTime = &b.EndTime
+		}
+	}
+	syncStandbys := []string{}
+	if masterDB != nil {
+		s.MasterKeeper = masterDB.Spec.KeeperUID
+		syncStandbys = masterDB.Status.SynchronousStandbys
+		for _, dbUID := range syncStandbys {
+			if db, ok := cd.DBs[dbUID]; ok {
+				s.SynchronousStandbyKeepers = append(s.SynchronousStandbyKeepers, db.Spec.KeeperUID)
+			}
+		}
+		sort.Strings(s.SynchronousStandbyKeepers)
+	}
+	for _, kuid := range cd.Keepers.SortedKeys() {
+		k := cd.Keepers[kuid]
+		ks := &keeperSummary{
+			UID:     k.UID,
+			Healthy: k.Status.Healthy,
+			Fenced:  k.Status.Fenced,
+
+			PostgresVersion: k.Status.PostgresVersion,
+		}
+		if k.Spec != nil {
+			ks.Drained = k.Spec.Drained
+			ks.Maintenance = k.Spec.Maintenance
+		}
+		if db := cd.FindDB(k); db != nil {
+			ks.DBUID = db.UID
+			ks.Role = db.Spec.Role
+			ks.SynchronousStandby = util.StringInSlice(syncStandbys, db.UID)
+			ks.PGHealthy = db.Status.Healthy
+			ks.PGReady = db.Status.Ready
+			ks.TimelineID = db.Status.TimelineID
+			ks.XLogPos = db.Status.XLogPos
+			ks.ReplicationLag = db.Status.ReplicationLag
+			ks.ReplayLag = db.Status.ReplayLag
+			ks.ReplayDelay = db.Status.ReplayDelay
+			if v := db.Status.ChecksumsVerification; v != nil && !v.Running {
+				ks.ChecksumsVerificationTime = &v.EndTime
+				ks.ChecksumsVerificationFailed = !v.Success
+			}
+		}
+		s.Keepers = append(s.Keepers, ks)
+	}
+	return s
+}
+
+// lastCompletedBackup returns the most recent completed backup of the backup
+// history
+func lastCompletedBackup(history []*cluster.Backup) *cluster.Backup {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Phase == cluster.BackupPhaseCompleted {
+			return history[i]
+		}
+	}
+	return nil
+}
+
+// printBackups prints the scheduled backup in progress and the backup
+// history, the most recent first
+func printBackups(tabOut *tabwriter.Writer, cd *cluster.ClusterData) {
+	status := cd.Cluster.Status
+	if b := status.Backup; b != nil {
+		stdout("Backup %s in progress on keeper %s (method: %s, phase: %s, requested: %s)", b.UID, b.KeeperUID, b.Method, b.Phase, b.RequestTime.Format(time.RFC3339))
+	} else {
+		stdout("No backup in progress")
+	}
+	if len(status.BackupHistory) == 0 {
+		return
+	}
+	stdout("")
+	fmt.Fprintf(tabOut, "UID\tMETHOD\tKEEPER\tPHASE\tSTART TIME\tDURATION\tERROR\n")
+	for i := len(status.BackupHistory) - 1; i >= 0; i-- {
+		b := status.BackupHistory[i]
+		startTime, duration := "", ""
+		if !b.StartTime.IsZero() {
+			startTime = b.StartTime.Format(time.RFC3339)
+			duration = b.EndTime.Sub(b.StartTime).Round(time.Second).String()
+		}
+		fmt.Fprintf(tabOut, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", b.UID, b.Method, b.KeeperUID, b.Phase, startTime, duration, b.Error)
+	}
+	tabOut.Flush()
+}
+
 func printTree(dbuid string, cd *cluster.ClusterData, level int, prefix string, tail bool) {
 	// skip not existing db: specified as a follower but not available in the
 	// clister spec (this should happen only when doing a stolonctl
@@ -84,27 +266,82 @@ func printTree(dbuid string, cd *cluster.ClusterData, level int, prefix string,
 }
 
 func status(cmd *cobra.Command, args []string) {
+	if err := statusOpts.validate(outputText, outputJSON, outputYAML); err != nil {
+		die("%v", err)
+	}
+
 	tabOut := new(tabwriter.Writer)
 	tabOut.Init(os.Stdout, 0, 8, 1, '\t', 0)
 
-	e, err := cmdcommon.NewStore(&cfg.CommonConfig)
-	if err != nil {
-		die("%v", err)
-	}
+	var (
+		e             clusterDataStore
+		lsid          string
+		sentinelsInfo cluster.SentinelsInfo
+		proxiesInfo   cluster.ProxiesInfo
+	)
+	if apiMode() {
+		client, err := newAPIClient()
+		if err != nil {
+			die("%v", err)
+		}
+		s, err := client.Status(context.TODO())
+		if err != nil {
+			die("cannot get status: %v", err)
+		}
+		e = client
+		lsid, sentinelsInfo, proxiesInfo = s.LeaderSentinelUID, s.Sentinels, s.Proxies
+	} else {
+		st, err := cmdcommon.NewStore(&cfg.CommonConfig)
+		if err != nil {
+			die("%v", err)
+		}
+		e = st
 
-	election, err := cmdcommon.NewElection(&cfg.CommonConfig, "")
-	if err != nil {
-		die("cannot create election: %v", err)
-	}
+		election, err := cmdcommon.NewElection(&cfg.CommonConfig, "")
+		if err != nil {
+			die("cannot create election: %v", err)
+		}
 
-	lsid, err := election.Leader()
-	if err != nil && err != store.ErrElectionNoLeader {
-		die("cannot get leader sentinel info: %v", err)
+		lsid, err = election.Leader()
+		if err != nil && err != store.ErrElectionNoLeader {
+			die("cannot get leader sentinel info: %v", err)
+		}
+
+		sentinelsInfo, err = st.GetSentinelsInfo(context.TODO())
+		if err != nil {
+			die("cannot get sentinels info: %v", err)
+		}
+
+		proxiesInfo, err = st.GetProxiesInfo(context.TODO())
+		if err != nil {
+			die("cannot get proxies info: %v", err)
+		}
+	}
+	if sentinelsInfo == nil {
+		sentinelsInfo = cluster.SentinelsInfo{}
 	}
+	sort.Sort(sentinelsInfo)
+
+	proxiesInfoSlice := proxiesInfo.ToSlice()
+	sort.Sort(proxiesInfoSlice)
 
-	sentinelsInfo, err := e.GetSentinelsInfo(context.TODO())
+	cd, _, err := getClusterData(e)
 	if err != nil {
-		die("cannot create election: %v", err)
+		die("%v", err)
+	}
+
+	if statusOpts.output != outputText || statusOpts.template != "" {
+		so := &statusOutput{
+			Sentinels:         sentinelsInfo,
+			LeaderSentinelUID: lsid,
+			Proxies:           proxiesInfoSlice,
+			ClusterData:       cd,
+			Summary:           newStatusSummary(cd),
+		}
+		if err := writeOutput(os.Stdout, so, statusOpts.outputOptions, true); err != nil {
+			die("%v", err)
+		}
+		return
 	}
 
 	stdout("=== Active sentinels ===")
@@ -112,7 +349,6 @@ func status(cmd *cobra.Command, args []string) {
 	if len(sentinelsInfo) == 0 {
 		stdout("No active sentinels")
 	} else {
-		sort.Sort(sentinelsInfo)
 		fmt.Fprintf(tabOut, "ID\tLEADER\n")
 		for _, si := range sentinelsInfo {
 			leader := false
@@ -126,19 +362,12 @@ func status(cmd *cobra.Command, args []string) {
 		}
 	}
 
-	proxiesInfo, err := e.GetProxiesInfo(context.TODO())
-	if err != nil {
-		die("cannot get proxies info: %v", err)
-	}
-	proxiesInfoSlice := proxiesInfo.ToSlice()
-
 	stdout("")
 	stdout("=== Active proxies ===")
 	stdout("")
 	if len(proxiesInfo) == 0 {
 		stdout("No active proxies")
 	} else {
-		sort.Sort(proxiesInfoSlice)
 		fmt.Fprintf(tabOut, "ID\n")
 		for _, pi := range proxiesInfoSlice {
 			fmt.Fprintf(tabOut, "%s\n", pi.UID)
@@ -146,11 +375,6 @@ func status(cmd *cobra.Command, args []string) {
 		}
 	}
 
-	cd, _, err := getClusterData(e)
-	if err != nil {
-		die("%v", err)
-	}
-
 	stdout("")
 	stdout("=== Keepers ===")
 	stdout("")
@@ -159,23 +383,75 @@ func status(cmd *cobra.Command, args []string) {
 		stdout("")
 	} else {
 		kssKeys := cd.Keepers.SortedKeys()
-		fmt.Fprintf(tabOut, "UID\tHEALTHY\tPG LISTENADDRESS\tPG HEALTHY\tPG WANTEDGENERATION\tPG CURRENTGENERATION\n")
+		fmt.Fprintf(tabOut, "UID\tHEALTHY\tPG LISTENADDRESS\tPG HEALTHY\tPG WANTEDGENERATION\tPG CURRENTGENERATION\tPG READY\tPG REPLICATIONLAG\tPG APPLYDELAY\tPRIORITY\tTAGS\n")
 		for _, kuid := range kssKeys {
 			k := cd.Keepers[kuid]
 			db := cd.FindDB(k)
+			var tags cluster.Tags
+			priority := 0
+			if k.Spec != nil {
+				tags = k.Spec.Tags
+				priority = k.Spec.ElectionPriority
+			}
 			if db != nil {
 				dbListenAddress := "(unknown)"
 				if db.Status.ListenAddress != "" {
 					dbListenAddress = fmt.Sprintf("%s:%s", db.Status.ListenAddress, db.Status.Port)
 				}
-				fmt.Fprintf(tabOut, "%s\t%t\t%s\t%t\t%d\t%d\t\n", k.UID, k.Status.Healthy, dbListenAddress, db.Status.Healthy, db.Generation, db.Status.CurrentGeneration)
+				applyDelay := ""
+				if db.Spec.RecoveryMinApplyDelay != nil {
+					applyDelay = db.Spec.RecoveryMinApplyDelay.Duration.String()
+				}
+				fmt.Fprintf(tabOut, "%s\t%t\t%s\t%t\t%d\t%d\t%t\t%d\t%s\t%d\t%s\t\n", k.UID, k.Status.Healthy, dbListenAddress, db.Status.Healthy, db.Generation, db.Status.CurrentGeneration, db.Status.Ready, db.Status.ReplicationLag, applyDelay, priority, tags)
 			} else {
-				fmt.Fprintf(tabOut, "%s\t%t\t(no db assigned)\t\t\t\t\n", k.UID, k.Status.Healthy)
+				fmt.Fprintf(tabOut, "%s\t%t\t(no db assigned)\t\t\t\t\t\t\t%d\t%s\t\n", k.UID, k.Status.Healthy, priority, tags)
 			}
 		}
 	}
 	tabOut.Flush()
 
+	for _, kuid := range cd.Keepers.SortedKeys() {
+		if cd.Keepers[kuid].Status.Fenced {
+			stdout("WARNING: keeper %s is fenced", kuid)
+		}
+		if k := cd.Keepers[kuid]; k.Spec != nil && k.Spec.Drained {
+			stdout("WARNING: keeper %s is drained", kuid)
+		}
+		if k := cd.Keepers[kuid]; k.Spec != nil && k.Spec.Maintenance {
+			stdout("WARNING: keeper %s is in maintenance", kuid)
+		}
+		if masterKeeper := statusMasterKeeper(cd); masterKeeper != nil {
+			if k := cd.Keepers[kuid]; !k.Status.PostgresBinaryVersion.SameMajor(masterKeeper.Status.PostgresBinaryVersion) {
+				stdout("WARNING: keeper %s postgres version %s has a major version different than the master keeper one (%s)", kuid, k.Status.PostgresBinaryVersion, masterKeeper.Status.PostgresBinaryVersion)
+			}
+		}
+		db := cd.FindDB(cd.Keepers[kuid])
+		if db != nil && db.Status.PGParametersDrift() {
+			stdout("WARNING: keeper %s pg parameters differ from the expected ones", kuid)
+		}
+		if db != nil && db.Status.PrePromotionHookResult != nil && !db.Status.PrePromotionHookResult.Success {
+			stdout("WARNING: keeper %s pre promotion hook failed: %s", kuid, db.Status.PrePromotionHookResult.Error)
+		}
+		if db != nil && db.Status.PostInitHookResult != nil && !db.Status.PostInitHookResult.Success {
+			stdout("WARNING: keeper %s post init hook failed: %s", kuid, db.Status.PostInitHookResult.Error)
+		}
+		if db != nil && db.Status.TimelineDivergence != nil {
+			d := db.Status.TimelineDivergence
+			state := "old primary"
+			if d.Diverged {
+				state = "diverged old primary"
+			}
+			stdout("WARNING: keeper %s db is a %s (timeline %d, master db %s timeline %d), not started as master", kuid, state, d.TimelineID, d.MasterDBUID, d.MasterTimelineID)
+		}
+		if db != nil && db.Status.WalRetention != nil && db.Status.WalRetention.Exceeded() {
+			r := db.Status.WalRetention
+			stdout("WARNING: keeper %s db wal retention limits exceeded (wal size %d, exceeding slots: %s, dropped slots: %s)", kuid, r.WalSize, strings.Join(r.ExceedingSlots, ", "), strings.Join(r.DroppedSlots, ", "))
+		}
+		if db != nil && db.Status.ChecksumsVerification != nil && !db.Status.ChecksumsVerification.Running && !db.Status.ChecksumsVerification.Success {
+			stdout("WARNING: keeper %s data checksums verification failed: %s", kuid, db.Status.ChecksumsVerification.Error)
+		}
+	}
+
 	if cd.Cluster == nil || cd.DBs == nil {
 		stdout("No cluster available")
 		return
@@ -185,11 +461,53 @@ func status(cmd *cobra.Command, args []string) {
 	stdout("")
 	stdout("=== Cluster Info ===")
 	stdout("")
+	if cd.Cluster.Status.FailoversHalted {
+		stdout("WARNING: automatic failovers are halted since maxFailovers has been reached (use stolonctl resumefailovers to resume them)")
+	}
+	if d := cd.Cluster.Status.SyncReplDegradation; d != nil {
+		switch d.Mode {
+		case cluster.SyncReplModeBlocking:
+			stdout("WARNING: master writes blocked since %s since not enough healthy synchronous standbys are available (syncReplDegradation policy: %s)", d.Since.Format(time.RFC3339), cd.Cluster.DefSpec().SyncReplDegradation.DefPolicy())
+		case cluster.SyncReplModeDegraded:
+			stdout("WARNING: synchronous replication degraded to asynchronous since %s since not enough healthy synchronous standbys are available", d.Since.Format(time.RFC3339))
+		}
+	}
+	if f := cd.Cluster.Status.LastFencing; f != nil && !f.Success {
+		stdout("WARNING: fencing of failed master keeper %s (db %s) failed at %s: %s", f.KeeperUID, f.DBUID, f.Time.Format(time.RFC3339), f.Error)
+	}
+	if cd.Cluster.Status.UnsafeDurability {
+		stdout("WARNING: cluster is running with unsafe durability pg parameters (%s disabled)", strings.Join(common.Parameters(cd.Cluster.DefSpec().PGParameters).DisabledDurabilityParameters(), ", "))
+	}
 	if master != "" {
 		stdout("Master: %s", cd.Keepers[cd.DBs[master].Spec.KeeperUID].UID)
+		if cd.Cluster.Status.DataChecksums {
+			stdout("Data checksums: enabled")
+		} else {
+			stdout("Data checksums: disabled")
+		}
 	} else {
 		stdout("Master Keeper: (none)")
 	}
+	if sw := cd.Cluster.Status.Switchover; sw != nil {
+		stdout("Switchover to keeper %s in progress (phase: %s)", sw.TargetKeeper, sw.Phase)
+	}
+	if rr := cd.Cluster.Status.RollingRestart; rr.InProgress() {
+		restarting := ""
+		if rr.RestartingKeeper != "" {
+			restarting = fmt.Sprintf(", restarting keeper %s", rr.RestartingKeeper)
+		}
+		stdout("Rolling restart in progress (phase: %s%s, restarted keepers: %d)", rr.Phase, restarting, len(rr.RestartedKeepers))
+	} else if rr != nil && rr.Phase == cluster.RollingRestartPhaseAborted {
+		stdout("WARNING: last rolling restart aborted at %s: %s", rr.EndTime.Format(time.RFC3339), rr.Reason)
+	}
+	if u := cd.Cluster.Status.PGUpgrade; u.InProgress() {
+		stdout("Postgres upgrade to the binaries in %s in progress (phase: %s)", u.PGBinPath, u.Phase)
+	} else if u != nil && u.Phase == cluster.PGUpgradePhaseAborted {
+		stdout("WARNING: last postgres upgrade aborted at %s: %s", u.EndTime.Format(time.RFC3339), u.Reason)
+	}
+	if cr := cd.Cluster.Status.CredentialsRotation; cr.InProgress() {
+		stdout("Credentials rotation %s in progress (phase: %s), run stolonctl rotatecredentials to complete it", cr.UID, cr.Phase)
+	}
 
 	if master != "" {
 		stdout("")
@@ -199,5 +517,12 @@ func status(cmd *cobra.Command, args []string) {
 		printTree(masterDB.UID, cd, 0, "", true)
 	}
 
+	if cd.Cluster.Spec.BackupConfig != nil || cd.Cluster.Status.Backup != nil || len(cd.Cluster.Status.BackupHistory) > 0 {
+		stdout("")
+		stdout("===== Backups =====")
+		stdout("")
+		printBackups(tabOut, cd)
+	}
+
 	stdout("")
 }
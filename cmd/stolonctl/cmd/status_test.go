@@ -0,0 +1,96 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+)
+
+func TestNewStatusSummary(t *testing.T) {
+	cd := testClusterData(2, true)
+	cd.Keepers["keeper4"] = &cluster.Keeper{
+		UID:    "keeper4",
+		Spec:   &cluster.KeeperSpec{},
+		Status: cluster.KeeperStatus{Fenced: true},
+	}
+	cd.Keepers["keeper2"].Spec.Drained = true
+	cd.Keepers["keeper3"].Spec.Maintenance = true
+	cd.Keepers["keeper1"].Status.PostgresVersion = "12.4"
+	cd.DBs["db1"].Status.TimelineID = 2
+	cd.DBs["db1"].Status.XLogPos = 1000
+	cd.DBs["db1"].Status.Ready = true
+	cd.DBs["db1"].Status.SynchronousStandbys = []string{"db3"}
+	cd.DBs["db2"].Status.TimelineID = 2
+	cd.DBs["db2"].Status.XLogPos = 900
+	cd.DBs["db2"].Status.ReplicationLag = 100
+	cd.DBs["db2"].Status.ReplayLag = 200
+	cd.DBs["db2"].Status.ReplayDelay = &cluster.Duration{Duration: 5 * time.Second}
+	verificationTime := time.Now()
+	cd.DBs["db2"].Status.ChecksumsVerification = &cluster.ChecksumsVerification{DBUID: "db2", EndTime: verificationTime, Error: "exit status 1"}
+	cd.DBs["db3"].Status.ChecksumsVerification = &cluster.ChecksumsVerification{DBUID: "db3", Running: true}
+	cd.DBs["db3"].Status.TimelineID = 2
+	cd.DBs["db3"].Status.XLogPos = 1000
+	cd.DBs["db3"].Status.Ready = true
+
+	expected := &statusSummary{
+		Phase:                     cluster.ClusterPhaseNormal,
+		MasterKeeper:              "keeper1",
+		SynchronousStandbyKeepers: []string{"keeper3"},
+		SyncReplMode:              cluster.SyncReplModeSync,
+		Keepers: []*keeperSummary{
+			{UID: "keeper1", Healthy: true, PostgresVersion: "12.4", DBUID: "db1", Role: common.RoleMaster, PGHealthy: true, PGReady: true, TimelineID: 2, XLogPos: 1000},
+			{UID: "keeper2", Healthy: true, Drained: true, DBUID: "db2", Role: common.RoleStandby, PGHealthy: true, TimelineID: 2, XLogPos: 900, ReplicationLag: 100, ReplayLag: 200, ReplayDelay: &cluster.Duration{Duration: 5 * time.Second}, ChecksumsVerificationTime: &verificationTime, ChecksumsVerificationFailed: true},
+			{UID: "keeper3", Healthy: true, Maintenance: true, DBUID: "db3", Role: common.RoleStandby, SynchronousStandby: true, PGHealthy: true, PGReady: true, TimelineID: 2, XLogPos: 1000},
+			{UID: "keeper4", Fenced: true},
+		},
+	}
+	s := newStatusSummary(cd)
+	if !reflect.DeepEqual(s, expected) {
+		t.Errorf("got summary: %+v, want: %+v", s, expected)
+	}
+
+	cd.Cluster.Status.SyncReplDegradation = &cluster.SyncReplDegradationStatus{Mode: cluster.SyncReplModeDegraded}
+	if s := newStatusSummary(cd); s.SyncReplMode != cluster.SyncReplModeDegraded {
+		t.Errorf("got sync repl mode: %q, want: %q", s.SyncReplMode, cluster.SyncReplModeDegraded)
+	}
+
+	// no master
+	cd.Cluster.Status.Master = ""
+	s = newStatusSummary(cd)
+	if s.MasterKeeper != "" || len(s.SynchronousStandbyKeepers) != 0 {
+		t.Errorf("got master keeper %q and sync standby keepers %v without a master", s.MasterKeeper, s.SynchronousStandbyKeepers)
+	}
+	if s.Keepers[2].SynchronousStandby {
+		t.Errorf("got keeper3 reported as a synchronous standby without a master")
+	}
+
+	// the last backup time is the end time of the most recent completed
+	// backup
+	endTime := time.Now()
+	cd.Cluster.Status.BackupHistory = []*cluster.Backup{
+		{UID: "backup1", Phase: cluster.BackupPhaseCompleted, EndTime: endTime.Add(-time.Hour)},
+		{UID: "backup2", Phase: cluster.BackupPhaseCompleted, EndTime: endTime},
+		{UID: "backup3", Phase: cluster.BackupPhaseFailed, EndTime: endTime.Add(time.Hour)},
+	}
+	s = newStatusSummary(cd)
+	if s.LastBackupTime == nil || !s.LastBackupTime.Equal(endTime) {
+		t.Errorf("got last backup time: %v, want: %v", s.LastBackupTime, endTime)
+	}
+}
@@ -18,12 +18,14 @@ import (
 	"bufio"
 	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"strings"
 
 	"github.com/sorintlab/stolon/cmd"
 	"github.com/sorintlab/stolon/internal/cluster"
 	"github.com/sorintlab/stolon/internal/flagutil"
+	"github.com/sorintlab/stolon/internal/sentinelapi"
 	"github.com/sorintlab/stolon/internal/store"
 
 	"github.com/spf13/cobra"
@@ -39,9 +41,18 @@ var CmdStolonCtl = &cobra.Command{
 	Version: cmd.Version,
 	PersistentPreRun: func(c *cobra.Command, args []string) {
 		if c.Name() != "stolonctl" && c.Name() != "version" {
+			if apiMode() {
+				if !apiCommands[c] {
+					die("command %q cannot be executed using the sentinel management api", c.CommandPath())
+				}
+				return
+			}
 			if err := cmd.CheckCommonConfig(&cfg.CommonConfig); err != nil {
 				die(err.Error())
 			}
+			if err := cmd.SetupVaultStoreCert(&cfg.CommonConfig, nil); err != nil {
+				die("cannot setup the vault store certificate: %v", err)
+			}
 		}
 	},
 	// just defined to make --version work
@@ -50,13 +61,60 @@ var CmdStolonCtl = &cobra.Command{
 
 type config struct {
 	cmd.CommonConfig
+	apiEndpoints string
+	apiTokenFile string
+	apiCAFile    string
 }
 
 var cfg config
 
+// apiCommands are the commands that can be executed using the sentinel
+// management api
+var apiCommands = map[*cobra.Command]bool{}
+
 func init() {
 	cfg.IsStolonCtl = true
 	cmd.AddCommonFlags(CmdStolonCtl, &cfg.CommonConfig)
+
+	CmdStolonCtl.PersistentFlags().StringVar(&cfg.apiEndpoints, "api-endpoints", "", "a comma-delimited list of sentinels management api urls. When provided the status, top, spec, update, switchover and (un)drainkeeper commands use the api served by the leader sentinel instead of the store")
+	CmdStolonCtl.PersistentFlags().StringVar(&cfg.apiTokenFile, "api-token-file", "", "file containing the sentinels management api token")
+	CmdStolonCtl.PersistentFlags().StringVar(&cfg.apiCAFile, "api-ca-file", "", "verify the certificates of the https sentinels management api using this CA bundle")
+
+	for _, c := range []*cobra.Command{cmdStatus, cmdTop, cmdSpec, cmdSpecValidate, cmdSpecDiff, cmdSpecHistory, cmdSpecRollback, cmdUpdate, switchoverCmd, drainKeeperCmd, undrainKeeperCmd} {
+		apiCommands[c] = true
+	}
+}
+
+func apiMode() bool {
+	return cfg.apiEndpoints != ""
+}
+
+func newAPIClient() (*sentinelapi.Client, error) {
+	if cfg.apiTokenFile == "" {
+		return nil, fmt.Errorf("--api-token-file is required with --api-endpoints")
+	}
+	token, err := ioutil.ReadFile(cfg.apiTokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the api token file: %v", err)
+	}
+	return sentinelapi.NewClient(sentinelapi.ClientConfig{
+		Endpoints: strings.Split(cfg.apiEndpoints, ","),
+		Token:     strings.TrimSpace(string(token)),
+		CAFile:    cfg.apiCAFile,
+	})
+}
+
+// newSpecStore returns the sentinel management api client when --api-endpoints
+// is provided, otherwise the store
+func newSpecStore() (specStore, error) {
+	if apiMode() {
+		c, err := newAPIClient()
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	return cmd.NewStore(&cfg.CommonConfig)
 }
 
 var cmdVersion = &cobra.Command{
@@ -93,7 +151,14 @@ func die(format string, a ...interface{}) {
 	os.Exit(1)
 }
 
-func getClusterData(e store.Store) (*cluster.ClusterData, *store.KVPair, error) {
+// clusterDataStore is the subset of store.Store used to get and update the
+// cluster data
+type clusterDataStore interface {
+	GetClusterData(ctx context.Context) (*cluster.ClusterData, *store.KVPair, error)
+	AtomicPutClusterData(ctx context.Context, cd *cluster.ClusterData, previous *store.KVPair) (*store.KVPair, error)
+}
+
+func getClusterData(e clusterDataStore) (*cluster.ClusterData, *store.KVPair, error) {
 	cd, pair, err := e.GetClusterData(context.TODO())
 	if err != nil {
 		return nil, nil, fmt.Errorf("cannot get cluster data: %v", err)
@@ -0,0 +1,78 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+
+	"github.com/spf13/cobra"
+)
+
+var switchoverCmd = &cobra.Command{
+	Use:   "switchover",
+	Short: "Switch the master role to the db of the provided keeper without losing data",
+	Long:  `Switch the master role to the db of the provided keeper without losing data. The switchover is coordinated by the sentinel: it pauses the proxies (closing the client connections), waits for the target standby to catch up with the master and then elects it as the new master. The old master will rejoin the cluster as a standby and the proxies will be resumed when the new master is ready. If the target standby doesn't catch up before the cluster spec switchoverTimeout, or it isn't a valid new master anymore, the switchover is aborted and the proxies resumed.`,
+	Run:   switchover,
+}
+
+type switchoverOptions struct {
+	to string
+}
+
+var switchoverOpts switchoverOptions
+
+func init() {
+	switchoverCmd.PersistentFlags().StringVar(&switchoverOpts.to, "to", "", "uid of the keeper whose db will become the new master")
+
+	CmdStolonCtl.AddCommand(switchoverCmd)
+}
+
+func switchover(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		die("too many arguments")
+	}
+
+	if switchoverOpts.to == "" {
+		die("--to is required")
+	}
+
+	store, err := newSpecStore()
+	if err != nil {
+		die("%v", err)
+	}
+
+	cd, pair, err := getClusterData(store)
+	if err != nil {
+		die("cannot get cluster data: %v", err)
+	}
+
+	if err := checkFailoverTarget(cd, switchoverOpts.to, false); err != nil {
+		die("cannot switchover to keeper %q: %v", switchoverOpts.to, err)
+	}
+
+	newCd := cd.DeepCopy()
+	newCd.Cluster.Status.Switchover = &cluster.Switchover{
+		TargetKeeper: switchoverOpts.to,
+		Phase:        cluster.SwitchoverPhaseRequested,
+	}
+
+	_, err = store.AtomicPutClusterData(context.TODO(), newCd, pair)
+	if err != nil {
+		die("cannot update cluster data: %v", err)
+	}
+	stdout("requested switchover to keeper %q", switchoverOpts.to)
+}
@@ -0,0 +1,174 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	cmdcommon "github.com/sorintlab/stolon/cmd"
+	"github.com/sorintlab/stolon/internal/cluster"
+
+	"github.com/mattn/go-isatty"
+	"github.com/spf13/cobra"
+)
+
+var cmdTop = &cobra.Command{
+	Use:   "top",
+	Run:   top,
+	Short: "Display a continuously refreshed view of the cluster status",
+	Long:  `Display the keepers (role, timeline, replication lag and synchronous standby state) and the proxies of the cluster, refreshing the view every --interval until interrupted. When the output isn't a terminal the views are printed one after the other.`,
+}
+
+type topOptions struct {
+	interval time.Duration
+	count    int
+}
+
+var topOpts topOptions
+
+func init() {
+	cmdTop.PersistentFlags().DurationVar(&topOpts.interval, "interval", 2*time.Second, "refresh interval")
+	cmdTop.PersistentFlags().IntVar(&topOpts.count, "count", 0, "number of refreshes before exiting. 0 refreshes until interrupted")
+
+	CmdStolonCtl.AddCommand(cmdTop)
+}
+
+// topStore is the subset of store.Store used by top
+type topStore interface {
+	clusterDataStore
+	GetProxiesInfo(ctx context.Context) (cluster.ProxiesInfo, error)
+}
+
+func newTopStore() (topStore, error) {
+	if apiMode() {
+		c, err := newAPIClient()
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	return cmdcommon.NewStore(&cfg.CommonConfig)
+}
+
+// printTop writes the top view of the cluster
+func printTop(w io.Writer, cd *cluster.ClusterData, proxiesInfo cluster.ProxiesInfo, now time.Time) {
+	s := newStatusSummary(cd)
+
+	master := s.MasterKeeper
+	if master == "" {
+		master = "(none)"
+	}
+	fmt.Fprintf(w, "stolonctl top - %s\n", now.Format(time.RFC3339))
+	fmt.Fprintf(w, "Cluster phase: %s, master: %s, synchronous standbys: %d\n", s.Phase, master, len(s.SynchronousStandbyKeepers))
+	if s.FailoversHalted {
+		fmt.Fprintf(w, "WARNING: automatic failovers are halted\n")
+	}
+	if cd.Cluster != nil && cd.Cluster.Status.Switchover != nil {
+		fmt.Fprintf(w, "Switchover to keeper %s in progress (phase: %s)\n", cd.Cluster.Status.Switchover.TargetKeeper, cd.Cluster.Status.Switchover.Phase)
+	}
+
+	// the proxies reporting the current proxy generation are proxying to
+	// the current master (or closing the connections when there's no master)
+	var proxyGeneration int64
+	if cd.Proxy != nil {
+		proxyGeneration = cd.Proxy.Generation
+	}
+	updated := 0
+	for _, pi := range proxiesInfo {
+		if pi.Generation == proxyGeneration {
+			updated++
+		}
+	}
+	fmt.Fprintf(w, "Proxies: %d, up to date: %d\n", len(proxiesInfo), updated)
+	fmt.Fprintf(w, "\n")
+
+	tabOut := new(tabwriter.Writer)
+	tabOut.Init(w, 0, 8, 1, '\t', 0)
+	fmt.Fprintf(tabOut, "KEEPER\tHEALTHY\tROLE\tSYNC\tPG HEALTHY\tPG READY\tTIMELINE\tXLOGPOS\tREPL LAG\tREPLAY LAG\tREPLAY DELAY\tSTATE\n")
+	for _, ks := range s.Keepers {
+		state := []string{}
+		if ks.Fenced {
+			state = append(state, "fenced")
+		}
+		if ks.Drained {
+			state = append(state, "drained")
+		}
+		if ks.Maintenance {
+			state = append(state, "maintenance")
+		}
+		if ks.DBUID == "" {
+			fmt.Fprintf(tabOut, "%s\t%t\t(no db assigned)\t\t\t\t\t\t\t\t\t%s\n", ks.UID, ks.Healthy, strings.Join(state, ","))
+			continue
+		}
+		replayDelay := ""
+		if ks.ReplayDelay != nil {
+			replayDelay = ks.ReplayDelay.Duration.String()
+		}
+		fmt.Fprintf(tabOut, "%s\t%t\t%s\t%t\t%t\t%t\t%d\t%d\t%d\t%d\t%s\t%s\n", ks.UID, ks.Healthy, ks.Role, ks.SynchronousStandby, ks.PGHealthy, ks.PGReady, ks.TimelineID, ks.XLogPos, ks.ReplicationLag, ks.ReplayLag, replayDelay, strings.Join(state, ","))
+	}
+	tabOut.Flush()
+}
+
+func top(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		die("too many arguments")
+	}
+	if topOpts.interval <= 0 {
+		die("--interval must be greater than 0")
+	}
+	if topOpts.count < 0 {
+		die("--count must be positive")
+	}
+
+	e, err := newTopStore()
+	if err != nil {
+		die("%v", err)
+	}
+
+	clearScreen := isatty.IsTerminal(os.Stdout.Fd())
+	for i := 0; topOpts.count == 0 || i < topOpts.count; i++ {
+		if i > 0 {
+			time.Sleep(topOpts.interval)
+		}
+		// the errors are reported in the view, since they can be
+		// transient (i.e. during a store leader election)
+		var buf bytes.Buffer
+		cd, _, err := getClusterData(e)
+		if err == nil {
+			var proxiesInfo cluster.ProxiesInfo
+			proxiesInfo, err = e.GetProxiesInfo(context.TODO())
+			if err == nil {
+				printTop(&buf, cd, proxiesInfo, time.Now())
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(&buf, "stolonctl top - %s\n", time.Now().Format(time.RFC3339))
+			fmt.Fprintf(&buf, "cannot get the cluster status: %v\n", err)
+		}
+		if clearScreen {
+			os.Stdout.WriteString("\033[H\033[2J")
+		} else if i > 0 {
+			os.Stdout.WriteString("\n")
+		}
+		os.Stdout.Write(buf.Bytes())
+	}
+}
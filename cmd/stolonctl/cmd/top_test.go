@@ -0,0 +1,74 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+func TestPrintTop(t *testing.T) {
+	cd := testClusterData(2, true)
+	cd.Proxy.Generation = 3
+	cd.DBs["db1"].Status.SynchronousStandbys = []string{"db2"}
+	cd.DBs["db1"].Status.TimelineID = 2
+	cd.DBs["db3"].Status.ReplicationLag = 1024
+	cd.Keepers["keeper3"].Spec.Drained = true
+	cd.Keepers["keeper4"] = &cluster.Keeper{UID: "keeper4", Spec: &cluster.KeeperSpec{}}
+	proxiesInfo := cluster.ProxiesInfo{
+		"proxy1": {UID: "proxy1", Generation: 3},
+		"proxy2": {UID: "proxy2", Generation: 2},
+	}
+
+	var buf bytes.Buffer
+	printTop(&buf, cd, proxiesInfo, time.Date(2018, 6, 11, 10, 0, 0, 0, time.UTC))
+	lines := strings.Split(buf.String(), "\n")
+
+	expected := []string{
+		"stolonctl top - 2018-06-11T10:00:00Z",
+		"Cluster phase: normal, master: keeper1, synchronous standbys: 1",
+		"Proxies: 2, up to date: 1",
+	}
+	for i, e := range expected {
+		if lines[i] != e {
+			t.Errorf("#%d: got line %q, want: %q", i, lines[i], e)
+		}
+	}
+
+	rows := map[string][]string{}
+	for _, l := range lines[len(expected)+2:] {
+		if fields := strings.Fields(l); len(fields) > 0 {
+			rows[fields[0]] = fields
+		}
+	}
+	tests := []struct {
+		keeper string
+		fields []string
+	}{
+		{keeper: "keeper1", fields: []string{"keeper1", "true", "master", "false", "true", "false", "2", "0", "0", "0"}},
+		{keeper: "keeper2", fields: []string{"keeper2", "true", "standby", "true", "true", "false", "0", "0", "0", "0"}},
+		{keeper: "keeper3", fields: []string{"keeper3", "true", "standby", "false", "true", "false", "0", "0", "1024", "0", "drained"}},
+		{keeper: "keeper4", fields: []string{"keeper4", "false", "(no", "db", "assigned)"}},
+	}
+	for i, tt := range tests {
+		if got := strings.Join(rows[tt.keeper], " "); got != strings.Join(tt.fields, " ") {
+			t.Errorf("#%d: got row %q, want: %q", i, got, strings.Join(tt.fields, " "))
+		}
+	}
+}
@@ -15,13 +15,16 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sort"
+	"strings"
+	"time"
 
-	cmdcommon "github.com/sorintlab/stolon/cmd"
 	"github.com/sorintlab/stolon/internal/cluster"
 	"github.com/sorintlab/stolon/internal/store"
 
@@ -36,28 +39,66 @@ var cmdUpdate = &cobra.Command{
 }
 
 type updateOptions struct {
-	patch bool
-	file  string
+	patch         bool
+	file          string
+	patchFile     string
+	patchType     string
+	dryRun        bool
+	verify        string
+	verifyTimeout time.Duration
+	withRollback  bool
 }
 
+// specPatchType is the type of a patch to the cluster spec
+type specPatchType string
+
+const (
+	// specPatchNone means that a complete cluster spec is provided
+	specPatchNone specPatchType = ""
+	// specPatchStrategic is a strategic merge patch
+	specPatchStrategic specPatchType = "strategic"
+	// specPatchJSON is a RFC 6902 json patch
+	specPatchJSON specPatchType = "json"
+)
+
 var updateOpts updateOptions
 
+// verifyInterval is the interval between the checks of the verify conditions
+var verifyInterval = 2 * time.Second
+
 func init() {
 	cmdUpdate.PersistentFlags().BoolVarP(&updateOpts.patch, "patch", "p", false, "patch the current cluster specification instead of replacing it")
 	cmdUpdate.PersistentFlags().StringVarP(&updateOpts.file, "file", "f", "", "file containing a complete cluster specification or a patch to apply to the current cluster specification")
+	cmdUpdate.PersistentFlags().StringVar(&updateOpts.patchFile, "patch-file", "", "file containing a patch to apply to the current cluster specification (stdin when \"-\")")
+	cmdUpdate.PersistentFlags().StringVar(&updateOpts.patchType, "patch-type", string(specPatchStrategic), "type of the patch: strategic (strategic merge patch) or json (RFC 6902 json patch)")
+	cmdUpdate.PersistentFlags().BoolVar(&updateOpts.dryRun, "dry-run", false, "validate the cluster specification update (also by the leader sentinel when using the api) and show the resulting cluster specification without applying it")
+	cmdUpdate.PersistentFlags().StringVar(&updateOpts.verify, "verify", "", "comma separated list of conditions that must be met after the update, i.e. \"master-available,standbys>=1,keepers>=3\"")
+	cmdUpdate.PersistentFlags().DurationVar(&updateOpts.verifyTimeout, "verify-timeout", 60*time.Second, "max time to wait for the verify conditions to be met")
+	cmdUpdate.PersistentFlags().BoolVar(&updateOpts.withRollback, "with-rollback", false, "restore the previous cluster specification if the verify conditions aren't met before the verify timeout")
 
 	CmdStolonCtl.AddCommand(cmdUpdate)
 }
 
-func patchClusterSpec(cs *cluster.ClusterSpec, p []byte) (*cluster.ClusterSpec, error) {
+func patchClusterSpec(cs *cluster.ClusterSpec, p []byte, patchType specPatchType) (*cluster.ClusterSpec, error) {
 	csj, err := json.Marshal(cs)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal cluster spec: %v", err)
 	}
 
-	newcsj, err := strategicpatch.StrategicMergePatch(csj, p, &cluster.ClusterSpec{})
-	if err != nil {
-		return nil, fmt.Errorf("failed to merge patch cluster spec: %v", err)
+	var newcsj []byte
+	switch patchType {
+	case specPatchStrategic:
+		newcsj, err = strategicpatch.StrategicMergePatch(csj, p, &cluster.ClusterSpec{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to merge patch cluster spec: %v", err)
+		}
+	case specPatchJSON:
+		newcsj, err = applyJSONPatch(csj, p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to json patch cluster spec: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown patch type %q", patchType)
 	}
 	var newcs *cluster.ClusterSpec
 	if err := json.Unmarshal(newcsj, &newcs); err != nil {
@@ -66,80 +107,411 @@ func patchClusterSpec(cs *cluster.ClusterSpec, p []byte) (*cluster.ClusterSpec,
 	return newcs, nil
 }
 
-func update(cmd *cobra.Command, args []string) {
+// newClusterSpec returns the cluster spec provided in data or, with a patch
+// type, the current cluster spec cs patched with data
+func newClusterSpec(cs *cluster.ClusterSpec, data []byte, patchType specPatchType) (*cluster.ClusterSpec, error) {
+	var newcs *cluster.ClusterSpec
+	if patchType != specPatchNone {
+		var err error
+		newcs, err = patchClusterSpec(cs, data, patchType)
+		if err != nil {
+			return nil, fmt.Errorf("failed to patch cluster spec: %v", err)
+		}
+	} else {
+		if err := json.Unmarshal(data, &newcs); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal cluster spec: %v", err)
+		}
+	}
+	return newcs, nil
+}
+
+// updateClusterSpec replaces the cluster spec with the one returned by
+// newSpecFn (called with the current spec). When the cluster spec changes the
+// cluster generation is increased and the change, made by the provided
+// stolonctl command, is recorded in the spec history. It returns the previous
+// cluster spec and the written cluster data.
+func updateClusterSpec(e specStore, command string, newSpecFn func(cs *cluster.ClusterSpec) (*cluster.ClusterSpec, error)) (*cluster.ClusterSpec, *cluster.ClusterData, error) {
+	for retry := 0; retry < maxRetries; retry++ {
+		cd, pair, err := getClusterData(e)
+		if err != nil {
+			return nil, nil, err
+		}
+		if cd.Cluster == nil || cd.Cluster.Spec == nil {
+			return nil, nil, fmt.Errorf("no cluster spec available")
+		}
+
+		prevcs := cd.Cluster.Spec
+		newcs, err := newSpecFn(prevcs)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = applyClusterSpec(cd, newcs); err != nil {
+			return nil, nil, fmt.Errorf("Cannot update cluster spec: %v", err)
+		}
+		diffs, err := diffClusterSpecs(prevcs, newcs)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(diffs) > 0 {
+			cd.Cluster.Generation++
+		}
+
+		// retry if cd has been modified between reading and writing
+		_, err = e.AtomicPutClusterData(context.TODO(), cd, pair)
+		if err != nil {
+			if err == store.ErrKeyModified {
+				continue
+			}
+			return nil, nil, fmt.Errorf("cannot update cluster data: %v", err)
+		}
+		if len(diffs) > 0 {
+			recordSpecChange(e, cd.Cluster, command, diffs)
+		}
+		return prevcs, cd, nil
+	}
+	return nil, nil, fmt.Errorf("failed to update cluster data after %d retries", maxRetries)
+}
+
+// clusterDataValidator is implemented by the spec stores (the sentinel
+// management api client) that can validate a cluster data update without
+// writing it
+type clusterDataValidator interface {
+	ValidateClusterData(ctx context.Context, cd *cluster.ClusterData, previous *store.KVPair) error
+}
+
+// dryRunClusterSpec computes the cluster spec returned by newSpecFn and
+// executes the same checks done by updateClusterSpec without writing it.
+// When e is a clusterDataValidator the new cluster data is also validated by
+// it.
+func dryRunClusterSpec(e specStore, newSpecFn func(cs *cluster.ClusterSpec) (*cluster.ClusterSpec, error)) (*cluster.ClusterSpec, error) {
+	cd, pair, err := getClusterData(e)
+	if err != nil {
+		return nil, err
+	}
+	if cd.Cluster == nil || cd.Cluster.Spec == nil {
+		return nil, fmt.Errorf("no cluster spec available")
+	}
+
+	newcs, err := newSpecFn(cd.Cluster.Spec)
+	if err != nil {
+		return nil, err
+	}
+	diffs, err := diffClusterSpecs(cd.Cluster.Spec, newcs)
+	if err != nil {
+		return nil, err
+	}
+	if err = applyClusterSpec(cd, newcs); err != nil {
+		return nil, fmt.Errorf("Cannot update cluster spec: %v", err)
+	}
+	if len(diffs) > 0 {
+		cd.Cluster.Generation++
+	}
+	if v, ok := e.(clusterDataValidator); ok {
+		if err := v.ValidateClusterData(context.TODO(), cd, pair); err != nil {
+			return nil, fmt.Errorf("cluster spec update refused by the leader sentinel: %v", err)
+		}
+	}
+	return newcs, nil
+}
+
+// applyClusterSpec replaces the cluster data cluster spec with newcs after
+// checking that the update is valid and supported by the keepers
+func applyClusterSpec(cd *cluster.ClusterData, newcs *cluster.ClusterSpec) error {
+	if err := cd.Cluster.UpdateSpec(newcs); err != nil {
+		return err
+	}
+	if err := checkChannelBindingSupport(cd, newcs); err != nil {
+		return err
+	}
+	return checkWalRetentionSupport(cd, newcs)
+}
+
+// checkChannelBindingSupport checks that, when the cluster spec requires
+// channel binding, all the keepers have a postgres version supporting it
+// (13 or later). Keepers that haven't reported their version are ignored.
+func checkChannelBindingSupport(cd *cluster.ClusterData, cs *cluster.ClusterSpec) error {
+	if !*cs.WithDefaults().RequireChannelBinding {
+		return nil
+	}
+	return checkKeepersPostgresVersion(cd, func(v cluster.PostgresBinaryVersion) error {
+		if v.Maj < 13 {
+			return fmt.Errorf("requireChannelBinding requires postgres 13 or later")
+		}
+		return nil
+	})
+}
+
+// checkWalRetentionSupport checks that the wal retention strategy and the wal
+// keep pgParameters are supported by the keepers postgres version.
+// Keepers that haven't reported their version are ignored.
+func checkWalRetentionSupport(cd *cluster.ClusterData, cs *cluster.ClusterSpec) error {
+	s := cs.WithDefaults()
+	return checkKeepersPostgresVersion(cd, func(v cluster.PostgresBinaryVersion) error {
+		if s.WalRetentionStrategy.UseSlots() && v.Maj == 9 && v.Min < 4 {
+			return fmt.Errorf("walRetentionStrategy %q requires replication slots, available from postgres 9.4", *s.WalRetentionStrategy)
+		}
+		for _, name := range []string{"wal_keep_segments", "wal_keep_size"} {
+			if _, ok := s.PGParameters[name]; ok && name != cluster.WalKeepParameterName(v.Maj) {
+				return fmt.Errorf("pgParameter %s isn't supported, use %s", name, cluster.WalKeepParameterName(v.Maj))
+			}
+		}
+		return nil
+	})
+}
+
+// standbyConflictsWarnings returns the warnings about the cluster spec
+// standbyConflicts options overriding the pgParameters or conflicting with
+// the synchronous replication settings
+func standbyConflictsWarnings(cs *cluster.ClusterSpec) []string {
+	s := cs.WithDefaults()
+	c := s.StandbyConflicts
+	if c == nil {
+		return nil
+	}
+	warnings := []string{}
+	names := []string{}
+	for name := range c.Parameters() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := s.PGParameters[name]; ok {
+			warnings = append(warnings, fmt.Sprintf("pgParameter %s is overridden on the standbys by standbyConflicts", name))
+		}
+	}
+	if d := c.MaxStandbyStreamingDelay; d != nil && *s.SynchronousReplication {
+		if s.SynchronousCommit != nil && *s.SynchronousCommit == cluster.SynchronousCommitRemoteApply {
+			if d.Duration < 0 {
+				warnings = append(warnings, "with synchronousCommit remote_apply and a negative standbyConflicts maxStandbyStreamingDelay the master commits can block forever waiting for the synchronous standbys replay stopped by conflicting queries")
+			} else if d.Duration > 0 {
+				warnings = append(warnings, fmt.Sprintf("with synchronousCommit remote_apply the master commits can wait up to standbyConflicts maxStandbyStreamingDelay (%s) for the synchronous standbys replay stopped by conflicting queries", d.Duration))
+			}
+		}
+		if *s.SyncStandbySelection == cluster.SyncStandbySelectionLag && d.Duration < 0 {
+			warnings = append(warnings, "with syncStandbySelection lag and a negative standbyConflicts maxStandbyStreamingDelay the synchronous standbys replay stopped by conflicting queries makes them lag and be replaced")
+		}
+	}
+	if c.HotStandbyFeedback != nil && !*c.HotStandbyFeedback && len(s.LogicalReplicationSlots) > 0 {
+		warnings = append(warnings, "with standbyConflicts hotStandbyFeedback disabled the logical replication slots on the standbys (postgres >= 16) can be invalidated")
+	}
+	return warnings
+}
+
+// checkKeepersPostgresVersion calls checkFn with the postgres version of every
+// keeper that has reported it
+func checkKeepersPostgresVersion(cd *cluster.ClusterData, checkFn func(v cluster.PostgresBinaryVersion) error) error {
+	keeperUIDs := []string{}
+	for uid := range cd.Keepers {
+		keeperUIDs = append(keeperUIDs, uid)
+	}
+	sort.Strings(keeperUIDs)
+	for _, uid := range keeperUIDs {
+		v := cd.Keepers[uid].Status.PostgresBinaryVersion
+		if v.Maj == 0 {
+			continue
+		}
+		if err := checkFn(v); err != nil {
+			return fmt.Errorf("%v but keeper %q has postgres %d.%d", err, uid, v.Maj, v.Min)
+		}
+	}
+	return nil
+}
+
+// waitVerifyConditions waits for the conditions to be met by a cluster data
+// updated by the sentinel after the written one (so the sentinel has acted
+// on the new spec). It returns the conditions still not met at the timeout.
+func waitVerifyConditions(e clusterDataStore, written *cluster.ClusterData, conds []verifyCondition, timeout, interval time.Duration) ([]verifyCondition, error) {
+	failed := conds
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		cd, _, err := getClusterData(e)
+		if err != nil {
+			return nil, err
+		}
+		// the sentinel updates the cluster data change time at every
+		// cluster data update
+		if !cd.ChangeTime.Equal(written.ChangeTime) {
+			failed = failedVerifyConditions(cd, conds)
+			if len(failed) == 0 {
+				return nil, nil
+			}
+		}
+		select {
+		case <-timer.C:
+			return failed, nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// updateWithVerify updates the cluster spec and waits for the verify
+// conditions. If they aren't met before the timeout and rollback is true the
+// previous cluster spec is restored, if it wasn't changed in the meantime,
+// and the conditions are verified again.
+func updateWithVerify(e specStore, command string, newSpecFn func(cs *cluster.ClusterSpec) (*cluster.ClusterSpec, error), conds []verifyCondition, timeout, interval time.Duration, rollback bool) error {
+	prevcs, written, err := updateClusterSpec(e, command, newSpecFn)
+	if err != nil {
+		return err
+	}
+	if len(conds) == 0 {
+		return nil
+	}
+
+	stdout("cluster spec updated, waiting for conditions: %s", conditionsString(conds))
+	failed, err := waitVerifyConditions(e, written, conds, timeout, interval)
+	if err != nil {
+		return err
+	}
+	if len(failed) == 0 {
+		stdout("all conditions met")
+		return nil
+	}
+	if !rollback {
+		return fmt.Errorf("conditions not met after %s: %s", timeout, conditionsString(failed))
+	}
+
+	stdout("conditions not met after %s: %s. Restoring the previous cluster spec", timeout, conditionsString(failed))
+	appliedcsj, err := json.Marshal(written.Cluster.Spec)
+	if err != nil {
+		return err
+	}
+	_, rolledBack, err := updateClusterSpec(e, command+" (rollback)", func(cs *cluster.ClusterSpec) (*cluster.ClusterSpec, error) {
+		// don't overwrite a cluster spec changed by someone else
+		csj, err := json.Marshal(cs)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(csj, appliedcsj) {
+			return nil, fmt.Errorf("cluster spec changed during the verification")
+		}
+		return prevcs, nil
+	})
+	if err != nil {
+		return fmt.Errorf("conditions not met and failed to restore the previous cluster spec: %v", err)
+	}
+
+	stdout("previous cluster spec restored, waiting for conditions: %s", conditionsString(conds))
+	rfailed, err := waitVerifyConditions(e, rolledBack, conds, timeout, interval)
+	if err != nil {
+		return err
+	}
+	if len(rfailed) > 0 {
+		return fmt.Errorf("cluster spec update rolled back but conditions still not met after %s: %s", timeout, conditionsString(rfailed))
+	}
+	return fmt.Errorf("cluster spec update rolled back since the conditions weren't met after %s: %s", timeout, conditionsString(failed))
+}
+
+func conditionsString(conds []verifyCondition) string {
+	s := make([]string, len(conds))
+	for i, c := range conds {
+		s[i] = c.String()
+	}
+	return strings.Join(s, ",")
+}
+
+// readSpecData returns the cluster spec (or patch) provided as the only
+// argument or in the file (stdin when it's "-")
+func readSpecData(args []string, file string) []byte {
 	if len(args) > 1 {
 		die("too many arguments")
 	}
-	if updateOpts.file == "" && len(args) < 1 {
+	if file == "" && len(args) < 1 {
 		die("no cluster spec provided as argument and no file provided (--file/-f option)")
 	}
-	if updateOpts.file != "" && len(args) == 1 {
+	if file != "" && len(args) == 1 {
 		die("only one of cluster spec provided as argument or file must provided (--file/-f option)")
 	}
 
-	data := []byte{}
 	if len(args) == 1 {
-		data = []byte(args[0])
+		return []byte(args[0])
+	}
+	var data []byte
+	var err error
+	if file == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			die("cannot read from stdin: %v", err)
+		}
 	} else {
+		data, err = ioutil.ReadFile(file)
+		if err != nil {
+			die("cannot read file: %v", err)
+		}
+	}
+	return data
+}
+
+func update(cmd *cobra.Command, args []string) {
+	patchType := specPatchNone
+	if updateOpts.patch || updateOpts.patchFile != "" {
+		patchType = specPatchType(updateOpts.patchType)
+		if patchType != specPatchStrategic && patchType != specPatchJSON {
+			die("wrong --patch-type %q, must be strategic or json", updateOpts.patchType)
+		}
+	} else if updateOpts.patchType != string(specPatchStrategic) {
+		die("--patch-type requires --patch or --patch-file")
+	}
+
+	var data []byte
+	if updateOpts.patchFile != "" {
+		if updateOpts.file != "" {
+			die("only one of --file/-f and --patch-file must be provided")
+		}
+		data = readSpecData(args, updateOpts.patchFile)
+	} else {
+		data = readSpecData(args, updateOpts.file)
+	}
+
+	if updateOpts.dryRun && (updateOpts.verify != "" || updateOpts.withRollback) {
+		die("--dry-run cannot be used with --verify or --with-rollback")
+	}
+
+	var conds []verifyCondition
+	if updateOpts.verify != "" {
 		var err error
-		if updateOpts.file == "-" {
-			data, err = ioutil.ReadAll(os.Stdin)
-			if err != nil {
-				die("cannot read from stdin: %v", err)
-			}
-		} else {
-			data, err = ioutil.ReadFile(updateOpts.file)
-			if err != nil {
-				die("cannot read file: %v", err)
-			}
+		conds, err = parseVerifyConditions(updateOpts.verify)
+		if err != nil {
+			die("wrong --verify: %v", err)
 		}
+		if updateOpts.verifyTimeout <= 0 {
+			die("--verify-timeout must be greater than 0")
+		}
+	} else if updateOpts.withRollback {
+		die("--with-rollback requires the --verify conditions")
 	}
 
-	e, err := cmdcommon.NewStore(&cfg.CommonConfig)
+	e, err := newSpecStore()
 	if err != nil {
 		die("%v", err)
 	}
 
-	retry := 0
-	for retry < maxRetries {
-		cd, pair, err := getClusterData(e)
+	var newcs *cluster.ClusterSpec
+	newSpecFn := func(cs *cluster.ClusterSpec) (*cluster.ClusterSpec, error) {
+		var err error
+		newcs, err = newClusterSpec(cs, data, patchType)
+		return newcs, err
+	}
+
+	if updateOpts.dryRun {
+		newcs, err := dryRunClusterSpec(e, newSpecFn)
 		if err != nil {
 			die("%v", err)
 		}
-		if cd.Cluster == nil {
-			die("no cluster spec available")
-		}
-		if cd.Cluster.Spec == nil {
-			die("no cluster spec available")
-		}
-
-		var newcs *cluster.ClusterSpec
-		if updateOpts.patch {
-			newcs, err = patchClusterSpec(cd.Cluster.Spec, data)
-			if err != nil {
-				die("failed to patch cluster spec: %v", err)
-			}
-		} else {
-			if err = json.Unmarshal(data, &newcs); err != nil {
-				die("failed to unmarshal cluster spec: %v", err)
-			}
-		}
-		if err = cd.Cluster.UpdateSpec(newcs); err != nil {
-			die("Cannot update cluster spec: %v", err)
-		}
-
-		// retry if cd has been modified between reading and writing
-		_, err = e.AtomicPutClusterData(context.TODO(), cd, pair)
+		specj, err := json.MarshalIndent(newcs, "", "\t")
 		if err != nil {
-			if err == store.ErrKeyModified {
-				retry++
-				continue
-			}
-			die("cannot update cluster data: %v", err)
+			die("failed to marshall spec: %v", err)
+		}
+		stdout("%s", specj)
+		for _, w := range standbyConflictsWarnings(newcs) {
+			stderr("WARNING: %s", w)
 		}
-		break
+		return
+	}
+	if err := updateWithVerify(e, "update", newSpecFn, conds, updateOpts.verifyTimeout, verifyInterval, updateOpts.withRollback); err != nil {
+		die("%v", err)
 	}
-	if retry == maxRetries {
-		die("failed to update cluster data after %d retries", maxRetries)
+	for _, w := range standbyConflictsWarnings(newcs) {
+		stdout("WARNING: %s", w)
 	}
 }
@@ -0,0 +1,482 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/store"
+)
+
+// testClusterDataStore is an in memory clusterDataStore. When sentinelFn is
+// defined it's called at every cluster data read after a write to simulate
+// the sentinel updating the cluster data.
+type testClusterDataStore struct {
+	cd         *cluster.ClusterData
+	puts       int
+	updated    bool
+	sentinelFn func(cd *cluster.ClusterData)
+	history    []*cluster.SpecChange
+}
+
+func (s *testClusterDataStore) GetClusterData(ctx context.Context) (*cluster.ClusterData, *store.KVPair, error) {
+	if s.updated && s.sentinelFn != nil {
+		s.sentinelFn(s.cd)
+		s.cd.ChangeTime = time.Now()
+	}
+	return s.cd.DeepCopy(), &store.KVPair{}, nil
+}
+
+func (s *testClusterDataStore) AtomicPutClusterData(ctx context.Context, cd *cluster.ClusterData, previous *store.KVPair) (*store.KVPair, error) {
+	s.cd = cd.DeepCopy()
+	s.puts++
+	s.updated = true
+	return &store.KVPair{}, nil
+}
+
+func (s *testClusterDataStore) AppendSpecChange(ctx context.Context, c *cluster.SpecChange, max int) error {
+	s.history = append(s.history, c)
+	return nil
+}
+
+func (s *testClusterDataStore) GetSpecHistory(ctx context.Context) ([]*cluster.SpecChange, error) {
+	return s.history, nil
+}
+
+// badSpecSentinel simulates a sentinel whose standbys become unhealthy when
+// usePgrewind is enabled
+func badSpecSentinel(cd *cluster.ClusterData) {
+	healthy := !*cd.Cluster.DefSpec().UsePgrewind
+	for _, db := range cd.DBs {
+		if db.UID != cd.Cluster.Status.Master {
+			db.Status.Healthy = healthy
+		}
+	}
+}
+
+func TestUpdateWithVerify(t *testing.T) {
+	goodSpecFn := func(cs *cluster.ClusterSpec) (*cluster.ClusterSpec, error) {
+		ncs := cs.DeepCopy()
+		ncs.MaxStandbys = cluster.Uint16P(5)
+		return ncs, nil
+	}
+	badSpecFn := func(cs *cluster.ClusterSpec) (*cluster.ClusterSpec, error) {
+		ncs := cs.DeepCopy()
+		ncs.UsePgrewind = cluster.BoolP(true)
+		return ncs, nil
+	}
+
+	tests := []struct {
+		specFn      func(cs *cluster.ClusterSpec) (*cluster.ClusterSpec, error)
+		sentinelFn  func(cd *cluster.ClusterData)
+		rollback    bool
+		puts        int
+		usePgrewind bool
+		maxStandbys uint16
+		err         error
+	}{
+		{
+			specFn:      goodSpecFn,
+			sentinelFn:  badSpecSentinel,
+			rollback:    true,
+			puts:        1,
+			maxStandbys: 5,
+		},
+		// conditions not met, no rollback
+		{
+			specFn:      badSpecFn,
+			sentinelFn:  badSpecSentinel,
+			puts:        1,
+			usePgrewind: true,
+			maxStandbys: cluster.DefaultMaxStandbys,
+			err:         fmt.Errorf("conditions not met after 100ms: standbys>=1"),
+		},
+		{
+			specFn:      badSpecFn,
+			sentinelFn:  badSpecSentinel,
+			rollback:    true,
+			puts:        2,
+			maxStandbys: cluster.DefaultMaxStandbys,
+			err:         fmt.Errorf("cluster spec update rolled back since the conditions weren't met after 100ms: standbys>=1"),
+		},
+		// the sentinel never updates the cluster data: the conditions
+		// cannot be verified
+		{
+			specFn:      goodSpecFn,
+			rollback:    true,
+			puts:        2,
+			maxStandbys: cluster.DefaultMaxStandbys,
+			err:         fmt.Errorf("cluster spec update rolled back but conditions still not met after 100ms: master-available,standbys>=1"),
+		},
+		// the cluster spec is changed during the verification: it must not
+		// be overwritten by the rollback
+		{
+			specFn: badSpecFn,
+			sentinelFn: func(cd *cluster.ClusterData) {
+				badSpecSentinel(cd)
+				cd.Cluster.Spec.MaxStandbys = cluster.Uint16P(10)
+			},
+			rollback:    true,
+			puts:        1,
+			usePgrewind: true,
+			maxStandbys: 10,
+			err:         fmt.Errorf("conditions not met and failed to restore the previous cluster spec: cluster spec changed during the verification"),
+		},
+		// invalid spec
+		{
+			specFn: func(cs *cluster.ClusterSpec) (*cluster.ClusterSpec, error) {
+				ncs := cs.DeepCopy()
+				ncs.MaxStandbys = cluster.Uint16P(0)
+				return ncs, nil
+			},
+			rollback:    true,
+			puts:        0,
+			maxStandbys: cluster.DefaultMaxStandbys,
+			err:         fmt.Errorf("Cannot update cluster spec: invalid cluster spec: maxStandbys must be at least 1"),
+		},
+	}
+
+	conds, err := parseVerifyConditions("master-available,standbys>=1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, tt := range tests {
+		cd := testClusterData(1, false)
+		cd.FormatVersion = cluster.CurrentCDFormatVersion
+		cd.Cluster.Spec.InitMode = cluster.ClusterInitModeP(cluster.ClusterInitModeNew)
+		e := &testClusterDataStore{cd: cd, sentinelFn: tt.sentinelFn}
+
+		err := updateWithVerify(e, "update", tt.specFn, conds, 100*time.Millisecond, 10*time.Millisecond, tt.rollback)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+		if e.puts != tt.puts {
+			t.Errorf("#%d: got %d cluster data writes, want: %d", i, e.puts, tt.puts)
+		}
+		spec := e.cd.Cluster.DefSpec()
+		if *spec.UsePgrewind != tt.usePgrewind {
+			t.Errorf("#%d: got usePgrewind: %t, want: %t", i, *spec.UsePgrewind, tt.usePgrewind)
+		}
+		if *spec.MaxStandbys != tt.maxStandbys {
+			t.Errorf("#%d: got maxStandbys: %d, want: %d", i, *spec.MaxStandbys, tt.maxStandbys)
+		}
+	}
+}
+
+// testValidatorStore is a testClusterDataStore validating the cluster data
+// like the sentinel management api
+type testValidatorStore struct {
+	testClusterDataStore
+	validated int
+	err       error
+}
+
+func (s *testValidatorStore) ValidateClusterData(ctx context.Context, cd *cluster.ClusterData, previous *store.KVPair) error {
+	s.validated++
+	return s.err
+}
+
+func TestDryRunClusterSpec(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		patchType   specPatchType
+		validateErr error
+		maxStandbys uint16
+		err         error
+	}{
+		{
+			name:        "strategic patch",
+			data:        `{ "maxStandbys": 5 }`,
+			patchType:   specPatchStrategic,
+			maxStandbys: 5,
+		},
+		{
+			name:        "json patch",
+			data:        `[{ "op": "add", "path": "/maxStandbys", "value": 4 }]`,
+			patchType:   specPatchJSON,
+			maxStandbys: 4,
+		},
+		{
+			name:      "failed json patch test",
+			data:      `[{ "op": "test", "path": "/maxStandbys", "value": 3 }, { "op": "replace", "path": "/maxStandbys", "value": 4 }]`,
+			patchType: specPatchJSON,
+			err:       fmt.Errorf(`failed to patch cluster spec: failed to json patch cluster spec: operation #0 (test "/maxStandbys"): member "maxStandbys" doesn't exist`),
+		},
+		{
+			name:      "invalid spec",
+			data:      `{ "maxStandbys": 0 }`,
+			patchType: specPatchStrategic,
+			err:       fmt.Errorf("Cannot update cluster spec: invalid cluster spec: maxStandbys must be at least 1"),
+		},
+		{
+			name:        "refused by the sentinel",
+			data:        `{ "maxStandbys": 5 }`,
+			patchType:   specPatchStrategic,
+			validateErr: fmt.Errorf("refused"),
+			err:         fmt.Errorf("cluster spec update refused by the leader sentinel: refused"),
+		},
+	}
+
+	for i, tt := range tests {
+		cd := testClusterData(1, false)
+		cd.FormatVersion = cluster.CurrentCDFormatVersion
+		cd.Cluster.Spec.InitMode = cluster.ClusterInitModeP(cluster.ClusterInitModeNew)
+		e := &testValidatorStore{testClusterDataStore: testClusterDataStore{cd: cd}, err: tt.validateErr}
+		newcs, err := dryRunClusterSpec(e, func(cs *cluster.ClusterSpec) (*cluster.ClusterSpec, error) {
+			return newClusterSpec(cs, []byte(tt.data), tt.patchType)
+		})
+		if e.puts != 0 {
+			t.Errorf("#%d (%s): cluster data written by a dry run", i, tt.name)
+		}
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d (%s): got no error, wanted error: %v", i, tt.name, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d (%s): got error: %v, wanted error: %v", i, tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d (%s): unexpected error: %v", i, tt.name, err)
+			continue
+		}
+		if e.validated != 1 {
+			t.Errorf("#%d (%s): cluster data not validated", i, tt.name)
+		}
+		if *newcs.MaxStandbys != tt.maxStandbys {
+			t.Errorf("#%d (%s): got maxStandbys: %d, want: %d", i, tt.name, *newcs.MaxStandbys, tt.maxStandbys)
+		}
+	}
+}
+
+func TestCheckChannelBindingSupport(t *testing.T) {
+	tests := []struct {
+		requireChannelBinding bool
+		versions              map[string]cluster.PostgresBinaryVersion
+		err                   error
+	}{
+		{
+			versions: map[string]cluster.PostgresBinaryVersion{
+				"keeper1": {Maj: 12, Min: 4},
+			},
+		},
+		{
+			requireChannelBinding: true,
+			versions: map[string]cluster.PostgresBinaryVersion{
+				"keeper1": {Maj: 13, Min: 1},
+				"keeper2": {Maj: 14, Min: 0},
+			},
+		},
+		// keepers without a reported version are ignored
+		{
+			requireChannelBinding: true,
+			versions: map[string]cluster.PostgresBinaryVersion{
+				"keeper1": {Maj: 13, Min: 1},
+			},
+		},
+		{
+			requireChannelBinding: true,
+			versions: map[string]cluster.PostgresBinaryVersion{
+				"keeper1": {Maj: 13, Min: 1},
+				"keeper2": {Maj: 12, Min: 4},
+			},
+			err: fmt.Errorf(`requireChannelBinding requires postgres 13 or later but keeper "keeper2" has postgres 12.4`),
+		},
+	}
+
+	for i, tt := range tests {
+		cd := testClusterData(1, false)
+		for uid, v := range tt.versions {
+			cd.Keepers[uid].Status.PostgresBinaryVersion = v
+		}
+		cs := cd.Cluster.Spec.DeepCopy()
+		cs.RequireChannelBinding = cluster.BoolP(tt.requireChannelBinding)
+
+		err := checkChannelBindingSupport(cd, cs)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestCheckWalRetentionSupport(t *testing.T) {
+	tests := []struct {
+		strategy     cluster.WalRetentionStrategy
+		pgParameters cluster.PGParameters
+		versions     map[string]cluster.PostgresBinaryVersion
+		err          error
+	}{
+		{
+			strategy: cluster.WalRetentionStrategyBoth,
+			versions: map[string]cluster.PostgresBinaryVersion{
+				"keeper1": {Maj: 12, Min: 4},
+				"keeper2": {Maj: 9, Min: 6},
+			},
+		},
+		{
+			strategy: cluster.WalRetentionStrategyWalKeep,
+			versions: map[string]cluster.PostgresBinaryVersion{
+				"keeper1": {Maj: 9, Min: 3},
+			},
+		},
+		{
+			strategy: cluster.WalRetentionStrategySlots,
+			versions: map[string]cluster.PostgresBinaryVersion{
+				"keeper1": {Maj: 9, Min: 3},
+			},
+			err: fmt.Errorf(`walRetentionStrategy "slots" requires replication slots, available from postgres 9.4 but keeper "keeper1" has postgres 9.3`),
+		},
+		{
+			strategy:     cluster.WalRetentionStrategyBoth,
+			pgParameters: cluster.PGParameters{"wal_keep_size": "1GB"},
+			versions: map[string]cluster.PostgresBinaryVersion{
+				"keeper1": {Maj: 13, Min: 1},
+			},
+		},
+		{
+			strategy:     cluster.WalRetentionStrategyBoth,
+			pgParameters: cluster.PGParameters{"wal_keep_size": "1GB"},
+			versions: map[string]cluster.PostgresBinaryVersion{
+				"keeper1": {Maj: 13, Min: 1},
+				"keeper2": {Maj: 12, Min: 4},
+			},
+			err: fmt.Errorf(`pgParameter wal_keep_size isn't supported, use wal_keep_segments but keeper "keeper2" has postgres 12.4`),
+		},
+		{
+			strategy:     cluster.WalRetentionStrategyWalKeep,
+			pgParameters: cluster.PGParameters{"wal_keep_segments": "64"},
+			versions: map[string]cluster.PostgresBinaryVersion{
+				"keeper1": {Maj: 13, Min: 1},
+			},
+			err: fmt.Errorf(`pgParameter wal_keep_segments isn't supported, use wal_keep_size but keeper "keeper1" has postgres 13.1`),
+		},
+	}
+
+	for i, tt := range tests {
+		cd := testClusterData(1, false)
+		for uid, v := range tt.versions {
+			cd.Keepers[uid].Status.PostgresBinaryVersion = v
+		}
+		cs := cd.Cluster.Spec.DeepCopy()
+		cs.WalRetentionStrategy = cluster.WalRetentionStrategyP(tt.strategy)
+		cs.PGParameters = tt.pgParameters
+
+		err := checkWalRetentionSupport(cd, cs)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestStandbyConflictsWarnings(t *testing.T) {
+	tests := []struct {
+		name string
+		cs   *cluster.ClusterSpec
+		out  []string
+	}{
+		{
+			name: "no standby conflicts",
+			cs:   &cluster.ClusterSpec{PGParameters: cluster.PGParameters{"hot_standby_feedback": "on"}},
+		},
+		{
+			name: "overridden pgParameters",
+			cs: &cluster.ClusterSpec{
+				StandbyConflicts: &cluster.StandbyConflicts{HotStandbyFeedback: cluster.BoolP(true), MaxStandbyStreamingDelay: &cluster.Duration{Duration: time.Minute}},
+				PGParameters:     cluster.PGParameters{"max_standby_streaming_delay": "10s", "hot_standby_feedback": "off", "work_mem": "4MB"},
+			},
+			out: []string{
+				"pgParameter hot_standby_feedback is overridden on the standbys by standbyConflicts",
+				"pgParameter max_standby_streaming_delay is overridden on the standbys by standbyConflicts",
+			},
+		},
+		{
+			name: "remote_apply with a negative streaming delay",
+			cs: &cluster.ClusterSpec{
+				SynchronousReplication: cluster.BoolP(true),
+				SynchronousCommit:      cluster.SynchronousCommitLevelP(cluster.SynchronousCommitRemoteApply),
+				SyncStandbySelection:   cluster.SyncStandbySelectionP(cluster.SyncStandbySelectionLag),
+				StandbyConflicts:       &cluster.StandbyConflicts{MaxStandbyStreamingDelay: &cluster.Duration{Duration: -1}},
+			},
+			out: []string{
+				"with synchronousCommit remote_apply and a negative standbyConflicts maxStandbyStreamingDelay the master commits can block forever waiting for the synchronous standbys replay stopped by conflicting queries",
+				"with syncStandbySelection lag and a negative standbyConflicts maxStandbyStreamingDelay the synchronous standbys replay stopped by conflicting queries makes them lag and be replaced",
+			},
+		},
+		{
+			name: "remote_apply with a streaming delay",
+			cs: &cluster.ClusterSpec{
+				SynchronousReplication: cluster.BoolP(true),
+				SynchronousCommit:      cluster.SynchronousCommitLevelP(cluster.SynchronousCommitRemoteApply),
+				StandbyConflicts:       &cluster.StandbyConflicts{MaxStandbyStreamingDelay: &cluster.Duration{Duration: time.Minute}},
+			},
+			out: []string{
+				"with synchronousCommit remote_apply the master commits can wait up to standbyConflicts maxStandbyStreamingDelay (1m0s) for the synchronous standbys replay stopped by conflicting queries",
+			},
+		},
+		{
+			name: "negative streaming delay without synchronous replication",
+			cs: &cluster.ClusterSpec{
+				SyncStandbySelection: cluster.SyncStandbySelectionP(cluster.SyncStandbySelectionLag),
+				StandbyConflicts:     &cluster.StandbyConflicts{MaxStandbyStreamingDelay: &cluster.Duration{Duration: -1}},
+			},
+		},
+		{
+			name: "hot standby feedback disabled with logical replication slots",
+			cs: &cluster.ClusterSpec{
+				StandbyConflicts:        &cluster.StandbyConflicts{HotStandbyFeedback: cluster.BoolP(false)},
+				LogicalReplicationSlots: []cluster.LogicalReplicationSlot{{Name: "slot1"}},
+			},
+			out: []string{
+				"with standbyConflicts hotStandbyFeedback disabled the logical replication slots on the standbys (postgres >= 16) can be invalidated",
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		out := standbyConflictsWarnings(tt.cs)
+		if len(out) != len(tt.out) {
+			t.Errorf("#%d (%s): got warnings: %v, want: %v", i, tt.name, out, tt.out)
+			continue
+		}
+		for j := range out {
+			if out[j] != tt.out[j] {
+				t.Errorf("#%d (%s): got warning: %q, want: %q", i, tt.name, out[j], tt.out[j])
+			}
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+)
+
+const (
+	verifyMasterAvailable = "master-available"
+	verifyStandbys        = "standbys"
+	verifyKeepers         = "keepers"
+)
+
+var verifyConditionRegexp = regexp.MustCompile(`^([a-z-]+)\s*(?:(>=|<=|==|=|>|<)\s*([0-9]+))?$`)
+
+// verifyCondition is a condition on the cluster state that must be met after
+// a cluster spec update. Count conditions (standbys, keepers) require an
+// operator and a value.
+type verifyCondition struct {
+	name  string
+	op    string
+	value int
+}
+
+func (c verifyCondition) String() string {
+	if c.op == "" {
+		return c.name
+	}
+	return fmt.Sprintf("%s%s%d", c.name, c.op, c.value)
+}
+
+// parseVerifyConditions parses a comma separated list of conditions like
+// "master-available,standbys>=1,keepers>=3"
+func parseVerifyConditions(s string) ([]verifyCondition, error) {
+	conds := []verifyCondition{}
+	for _, cs := range strings.Split(s, ",") {
+		cs = strings.TrimSpace(cs)
+		if cs == "" {
+			continue
+		}
+		m := verifyConditionRegexp.FindStringSubmatch(cs)
+		if m == nil {
+			return nil, fmt.Errorf("wrong condition %q", cs)
+		}
+		c := verifyCondition{name: m[1], op: m[2]}
+		if c.op == "==" {
+			c.op = "="
+		}
+		if m[3] != "" {
+			var err error
+			if c.value, err = strconv.Atoi(m[3]); err != nil {
+				return nil, fmt.Errorf("wrong condition %q: %v", cs, err)
+			}
+		}
+		switch c.name {
+		case verifyMasterAvailable:
+			if c.op != "" {
+				return nil, fmt.Errorf("wrong condition %q: %s doesn't accept a value", cs, c.name)
+			}
+		case verifyStandbys, verifyKeepers:
+			if c.op == "" {
+				return nil, fmt.Errorf("wrong condition %q: %s requires a value (i.e. %s>=1)", cs, c.name, c.name)
+			}
+		default:
+			return nil, fmt.Errorf("unknown condition %q (must be one of: %s, %s, %s)", cs, verifyMasterAvailable, verifyStandbys, verifyKeepers)
+		}
+		conds = append(conds, c)
+	}
+	if len(conds) == 0 {
+		return nil, fmt.Errorf("no conditions provided")
+	}
+	return conds, nil
+}
+
+func compare(a int, op string, b int) bool {
+	switch op {
+	case ">=":
+		return a >= b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case "<":
+		return a < b
+	case "=":
+		return a == b
+	}
+	return false
+}
+
+// dbConverged reports if the db is healthy and its keeper has applied the
+// current db spec
+func dbConverged(cd *cluster.ClusterData, db *cluster.DB) bool {
+	k, ok := cd.Keepers[db.Spec.KeeperUID]
+	if !ok || !k.Status.Healthy {
+		return false
+	}
+	return db.Status.Healthy && db.Status.CurrentGeneration == db.Generation
+}
+
+// check returns true if the condition is met by the cluster data
+func (c verifyCondition) check(cd *cluster.ClusterData) bool {
+	switch c.name {
+	case verifyMasterAvailable:
+		if cd.Cluster == nil || cd.Cluster.Status.Phase != cluster.ClusterPhaseNormal {
+			return false
+		}
+		db, ok := cd.DBs[cd.Cluster.Status.Master]
+		if !ok {
+			return false
+		}
+		return dbConverged(cd, db)
+	case verifyStandbys:
+		n := 0
+		for _, db := range cd.DBs {
+			if cd.Cluster != nil && db.UID == cd.Cluster.Status.Master {
+				continue
+			}
+			if db.Spec.Role == common.RoleStandby && dbConverged(cd, db) {
+				n++
+			}
+		}
+		return compare(n, c.op, c.value)
+	case verifyKeepers:
+		n := 0
+		for _, k := range cd.Keepers {
+			if k.Status.Healthy {
+				n++
+			}
+		}
+		return compare(n, c.op, c.value)
+	}
+	return false
+}
+
+// failedVerifyConditions returns the conditions not met by the cluster data
+func failedVerifyConditions(cd *cluster.ClusterData, conds []verifyCondition) []verifyCondition {
+	failed := []verifyCondition{}
+	for _, c := range conds {
+		if !c.check(cd) {
+			failed = append(failed, c)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,138 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+func TestParseVerifyConditions(t *testing.T) {
+	tests := []struct {
+		in    string
+		conds []verifyCondition
+		err   error
+	}{
+		{
+			in: "master-available,standbys>=1",
+			conds: []verifyCondition{
+				{name: verifyMasterAvailable},
+				{name: verifyStandbys, op: ">=", value: 1},
+			},
+		},
+		{
+			in: " keepers == 3 , standbys<2,",
+			conds: []verifyCondition{
+				{name: verifyKeepers, op: "=", value: 3},
+				{name: verifyStandbys, op: "<", value: 2},
+			},
+		},
+		{
+			in:  "",
+			err: fmt.Errorf("no conditions provided"),
+		},
+		{
+			in:  "standbys",
+			err: fmt.Errorf(`wrong condition "standbys": standbys requires a value (i.e. standbys>=1)`),
+		},
+		{
+			in:  "master-available>=1",
+			err: fmt.Errorf(`wrong condition "master-available>=1": master-available doesn't accept a value`),
+		},
+		{
+			in:  "standbys>=-1",
+			err: fmt.Errorf(`wrong condition "standbys>=-1"`),
+		},
+		{
+			in:  "proxies>=1",
+			err: fmt.Errorf(`unknown condition "proxies>=1" (must be one of: master-available, standbys, keepers)`),
+		},
+	}
+
+	for i, tt := range tests {
+		conds, err := parseVerifyConditions(tt.in)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		} else if !reflect.DeepEqual(conds, tt.conds) {
+			t.Errorf("#%d: wrong conditions: got: %v, want: %v", i, conds, tt.conds)
+		}
+	}
+}
+
+func TestFailedVerifyConditions(t *testing.T) {
+	conds, err := parseVerifyConditions("master-available,standbys>=2,keepers=3")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		cdFn   func(cd *cluster.ClusterData)
+		failed string
+	}{
+		{
+			cdFn:   func(cd *cluster.ClusterData) {},
+			failed: "",
+		},
+		{
+			cdFn: func(cd *cluster.ClusterData) {
+				cd.DBs["db1"].Status.Healthy = false
+			},
+			failed: "master-available",
+		},
+		// master not converged to the current db spec
+		{
+			cdFn: func(cd *cluster.ClusterData) {
+				cd.DBs["db1"].Generation = 2
+			},
+			failed: "master-available",
+		},
+		{
+			cdFn: func(cd *cluster.ClusterData) {
+				cd.Cluster.Status.Phase = cluster.ClusterPhaseInitializing
+			},
+			failed: "master-available",
+		},
+		{
+			cdFn: func(cd *cluster.ClusterData) {
+				cd.Keepers["keeper3"].Status.Healthy = false
+			},
+			failed: "standbys>=2,keepers=3",
+		},
+		{
+			cdFn: func(cd *cluster.ClusterData) {
+				cd.DBs["db2"].Status.Healthy = false
+			},
+			failed: "standbys>=2",
+		},
+	}
+
+	for i, tt := range tests {
+		cd := testClusterData(2, false)
+		tt.cdFn(cd)
+		failed := conditionsString(failedVerifyConditions(cd, conds))
+		if failed != tt.failed {
+			t.Errorf("#%d: wrong failed conditions: got: %q, want: %q", i, failed, tt.failed)
+		}
+	}
+}
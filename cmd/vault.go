@@ -0,0 +1,198 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/vault"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+const (
+	vaultCertFileName = "store-cert.pem"
+	vaultKeyFileName  = "store-key.pem"
+	vaultCAFileName   = "store-ca.pem"
+
+	// min interval between the renewal attempts of the store certificate
+	vaultCertMinRenewInterval = 10 * time.Second
+)
+
+func addVaultFlags(cmd *cobra.Command, cfg *CommonConfig) {
+	cmd.PersistentFlags().StringVar(&cfg.VaultAddress, "vault-address", "", "vault server address (i.e. https://vault:8200). Required by the vault options")
+	cmd.PersistentFlags().StringVar(&cfg.VaultCAFile, "vault-ca-file", "", "verify the vault server certificate using this CA bundle")
+	cmd.PersistentFlags().StringVar(&cfg.VaultTokenFile, "vault-token-file", "", "file containing the vault token. Defaults to the VAULT_TOKEN environment variable")
+	cmd.PersistentFlags().StringVar(&cfg.VaultKubeAuthRole, "vault-kube-auth-role", "", "when running inside kubernetes, vault kubernetes auth method role used to login with the pod service account token (instead of using a vault token)")
+	cmd.PersistentFlags().StringVar(&cfg.VaultKubeAuthMount, "vault-kube-auth-mount", vault.DefaultKubeAuthMount, "vault kubernetes auth method mount path")
+	cmd.PersistentFlags().StringVar(&cfg.VaultStorePKIPath, "vault-store-pki-path", "", "vault pki secrets engine issue path (i.e. pki/issue/stolon) used to issue the client certificate for the store. The certificate is renewed before its expiration. Cannot be used with --store-cert-file and --store-key")
+	cmd.PersistentFlags().StringVar(&cfg.VaultStoreCertCommonName, "vault-store-cert-common-name", "", "common name of the store client certificate issued by vault")
+	cmd.PersistentFlags().DurationVar(&cfg.VaultStoreCertTTL, "vault-store-cert-ttl", 0, "ttl of the store client certificate issued by vault. 0 uses the vault pki role default")
+}
+
+func checkVaultConfig(cfg *CommonConfig) error {
+	if cfg.VaultAddress == "" {
+		if cfg.VaultTokenFile != "" || cfg.VaultKubeAuthRole != "" || cfg.VaultStorePKIPath != "" {
+			return fmt.Errorf("the vault options require --vault-address")
+		}
+		return nil
+	}
+	if cfg.VaultTokenFile != "" && cfg.VaultKubeAuthRole != "" {
+		return fmt.Errorf("only one of --vault-token-file or --vault-kube-auth-role must be provided")
+	}
+	if cfg.VaultStorePKIPath != "" {
+		if cfg.StoreCertFile != "" || cfg.StoreKeyFile != "" {
+			return fmt.Errorf("--vault-store-pki-path cannot be used with --store-cert-file and --store-key")
+		}
+		if cfg.VaultStoreCertCommonName == "" {
+			return fmt.Errorf("--vault-store-pki-path requires --vault-store-cert-common-name")
+		}
+		if cfg.StoreBackend == "kubernetes" || cfg.StoreBackend == "zookeeper" {
+			return fmt.Errorf("--vault-store-pki-path isn't supported with the %s store", cfg.StoreBackend)
+		}
+	}
+	if cfg.VaultStoreCertTTL < 0 {
+		return fmt.Errorf("--vault-store-cert-ttl must be positive")
+	}
+	return nil
+}
+
+// NewVaultClient returns a vault client or nil if vault isn't configured
+func NewVaultClient(cfg *CommonConfig) (*vault.Client, error) {
+	if cfg.VaultAddress == "" {
+		return nil, nil
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if cfg.VaultTokenFile != "" {
+		data, err := ioutil.ReadFile(cfg.VaultTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read vault token file: %v", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if cfg.VaultKubeAuthRole != "" {
+		token = ""
+	}
+	return vault.NewClient(vault.Config{
+		Address:        cfg.VaultAddress,
+		CAFile:         cfg.VaultCAFile,
+		Token:          token,
+		KubeAuthRole:   cfg.VaultKubeAuthRole,
+		KubeAuthMount:  cfg.VaultKubeAuthMount,
+		RequestTimeout: cfg.StoreTimeout,
+	})
+}
+
+// writeFileAtomic writes the file using a temporary file renamed to the
+// destination, so it's never read partially written
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func writeVaultStoreCert(dir string, cert *vault.Certificate) error {
+	// write the key before the certificate, the certificate modification
+	// triggers its reload
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{vaultKeyFileName, cert.PrivateKey},
+		{vaultCAFileName, cert.IssuingCA},
+		{vaultCertFileName, cert.Certificate},
+	} {
+		if err := writeFileAtomic(filepath.Join(dir, f.name), f.data); err != nil {
+			return fmt.Errorf("cannot write store certificate file: %v", err)
+		}
+	}
+	return nil
+}
+
+// certRenewInterval returns the interval before renewing a certificate, at
+// two thirds of its remaining validity
+func certRenewInterval(expiration, now time.Time) time.Duration {
+	d := expiration.Sub(now) * 2 / 3
+	if d < vaultCertMinRenewInterval {
+		d = vaultCertMinRenewInterval
+	}
+	return d
+}
+
+// SetupVaultStoreCert issues, when requested, the store client certificate
+// with vault and sets the store certificate options to its files. Except for
+// stolonctl the certificate is renewed in background before its expiration,
+// logging the renewals with log.
+func SetupVaultStoreCert(cfg *CommonConfig, log *zap.SugaredLogger) error {
+	if cfg.VaultStorePKIPath == "" {
+		return nil
+	}
+	vc, err := NewVaultClient(cfg)
+	if err != nil {
+		return fmt.Errorf("cannot create vault client: %v", err)
+	}
+	issue := func() (*vault.Certificate, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		return vc.IssueCertificate(ctx, cfg.VaultStorePKIPath, cfg.VaultStoreCertCommonName, cfg.VaultStoreCertTTL)
+	}
+	cert, err := issue()
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "stolon-vault")
+	if err != nil {
+		return err
+	}
+	if err := writeVaultStoreCert(dir, cert); err != nil {
+		return err
+	}
+	cfg.StoreCertFile = filepath.Join(dir, vaultCertFileName)
+	cfg.StoreKeyFile = filepath.Join(dir, vaultKeyFileName)
+	if cfg.StoreCAFile == "" {
+		cfg.StoreCAFile = filepath.Join(dir, vaultCAFileName)
+	}
+	if cfg.IsStolonCtl || cert.Expiration.IsZero() {
+		return nil
+	}
+
+	go func() {
+		expiration := cert.Expiration
+		for {
+			time.Sleep(certRenewInterval(expiration, time.Now()))
+			cert, err := issue()
+			if err != nil {
+				log.Errorw("failed to renew the vault store certificate", "expiration", expiration, zap.Error(err))
+				continue
+			}
+			if err := writeVaultStoreCert(dir, cert); err != nil {
+				log.Errorw("failed to renew the vault store certificate", "expiration", expiration, zap.Error(err))
+				continue
+			}
+			log.Infow("vault store certificate renewed", "expiration", cert.Expiration)
+			expiration = cert.Expiration
+		}
+	}()
+	return nil
+}
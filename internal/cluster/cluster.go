@@ -17,8 +17,14 @@ package cluster
 import (
 	"encoding/json"
 	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"path/filepath"
 	"reflect"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -38,6 +44,10 @@ func BoolP(b bool) *bool {
 	return &b
 }
 
+func StringP(s string) *string {
+	return &s
+}
+
 const (
 	CurrentCDFormatVersion uint64 = 1
 )
@@ -51,24 +61,67 @@ const (
 
 	DefaultDBNotIncreasingXLogPosTimes = 10
 
-	DefaultSleepInterval                              = 5 * time.Second
-	DefaultRequestTimeout                             = 10 * time.Second
-	DefaultConvergenceTimeout                         = 30 * time.Second
-	DefaultInitTimeout                                = 5 * time.Minute
-	DefaultSyncTimeout                                = 30 * time.Minute
-	DefaultFailInterval                               = 20 * time.Second
-	DefaultDeadKeeperRemovalInterval                  = 48 * time.Hour
-	DefaultMaxStandbys               uint16           = 20
-	DefaultMaxStandbysPerSender      uint16           = 3
-	DefaultMaxStandbyLag                              = 1024 * 1204
-	DefaultSynchronousReplication                     = false
-	DefaultMinSynchronousStandbys    uint16           = 1
-	DefaultMaxSynchronousStandbys    uint16           = 1
-	DefaultAdditionalWalSenders                       = 5
-	DefaultUsePgrewind                                = false
-	DefaultMergePGParameter                           = true
-	DefaultRole                      ClusterRole      = ClusterRoleMaster
-	DefaultSUReplAccess              SUReplAccessMode = SUReplAccessAll
+	DefaultSleepInterval                                 = 5 * time.Second
+	DefaultRequestTimeout                                = 10 * time.Second
+	DefaultConvergenceTimeout                            = 30 * time.Second
+	DefaultInitTimeout                                   = 5 * time.Minute
+	DefaultSyncTimeout                                   = 30 * time.Minute
+	DefaultFailInterval                                  = 20 * time.Second
+	DefaultDeadKeeperRemovalInterval                     = 48 * time.Hour
+	DefaultMaxStandbys                  uint16           = 20
+	DefaultMaxStandbysPerSender         uint16           = 3
+	DefaultMaxStandbyLag                                 = 1024 * 1204
+	DefaultMaxReadyStandbyLag                            = 0
+	DefaultMaxStandbyReplayLag                           = 0
+	DefaultMaxStandbyReplayDelay                         = 0
+	DefaultSynchronousReplication                        = false
+	DefaultMinSynchronousStandbys       uint16           = 1
+	DefaultMaxSynchronousStandbys       uint16           = 1
+	DefaultAdditionalWalSenders                          = 5
+	DefaultUsePgrewind                                   = false
+	DefaultVerifyResync                                  = false
+	DefaultAllowUnsafeDurability                         = false
+	DefaultAllowDelayedPromotion                         = false
+	DefaultRequireChannelBinding                         = false
+	DefaultMergePGParameter                              = true
+	DefaultRole                         ClusterRole      = ClusterRoleMaster
+	DefaultSUReplAccess                 SUReplAccessMode = SUReplAccessAll
+	DefaultDBProbeMode                  DBProbeMode      = DBProbeModeNone
+	DefaultDBProbeTimeout                                = 5 * time.Second
+	DefaultFailoverQuorum               uint16           = 0
+	DefaultPreferredAddressFamily       AddressFamily    = AddressFamilyAny
+	DefaultPrePromotionHookTimeout                       = 30 * time.Second
+	DefaultFencingTimeout                                = 30 * time.Second
+	DefaultFencingPolicy                FencingPolicy    = FencingPolicyFailClosed
+	DefaultStandbyAutoPromote                            = false
+	DefaultStandbyAutoPromoteTimeout                     = 5 * time.Minute
+	DefaultSwitchoverTimeout                             = 60 * time.Second
+	DefaultDemotionDrainTimeout                          = 30 * time.Second
+	DefaultFailoverCooldown                              = 0
+	DefaultMaxFailovers                 uint16           = 0
+	DefaultMaxFailoversWindow                            = 1 * time.Hour
+	DefaultSentinelDryRun                                = false
+	DefaultPublicationDatabase                           = "postgres"
+	DefaultResyncInitialBackoff                          = 5 * time.Minute
+	DefaultResyncMaxBackoff                              = 1 * time.Hour
+	DefaultWalRetentionStrategy                          = WalRetentionStrategyBoth
+	DefaultResyncMethod                                  = ResyncMethodBasebackup
+	DefaultBackupTimeout                                 = 6 * time.Hour
+	DefaultChecksumsVerificationTimeout                  = 1 * time.Hour
+	DefaultPGStopMode                                    = PGStopModeFast
+	DefaultPGStopTimeout                                 = 60 * time.Second
+	DefaultPGPromoteTimeout                              = 60 * time.Second
+
+	DefaultSynchronousReplicationMethod = SynchronousReplicationMethodFirst
+	DefaultSyncStandbySelection         = SyncStandbySelectionAny
+	DefaultSyncStandbyMaxReplayLag      = 16 * 1024 * 1024
+	DefaultSyncDegradationGracePeriod   = 30 * time.Second
+
+	DefaultMasterElectionStrategy = MasterElectionStrategyPriority
+	DefaultMasterElectionTimeout  = 10 * time.Second
+
+	DefaultLogicalReplicationSlotDatabase = "postgres"
+	DefaultLogicalReplicationSlotPlugin   = "pgoutput"
 )
 
 const (
@@ -78,6 +131,307 @@ const (
 
 type PGParameters map[string]string
 
+// HBARule is a structured pg_hba.conf entry
+type HBARule struct {
+	// Type is the connection type: local, host, hostssl, hostnossl,
+	// hostgssenc or hostnogssenc
+	Type string `json:"type"`
+	// Database is the matched database (or a comma separated list of them)
+	Database string `json:"database"`
+	// User is the matched user (or a comma separated list of them)
+	User string `json:"user"`
+	// Address is the matched client address. It must be empty for local
+	// rules and defined for the other types.
+	Address string `json:"address,omitempty"`
+	// Method is the authentication method
+	Method string `json:"method"`
+	// Options are the authentication method options
+	Options map[string]string `json:"options,omitempty"`
+}
+
+var (
+	hbaRuleTypes   = stringSet("local", "host", "hostssl", "hostnossl", "hostgssenc", "hostnogssenc")
+	hbaRuleMethods = stringSet("trust", "reject", "md5", "password", "scram-sha-256", "gss", "sspi", "ident", "peer", "ldap", "radius", "cert", "pam", "bsd")
+)
+
+func stringSet(values ...string) map[string]struct{} {
+	set := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		set[v] = struct{}{}
+	}
+	return set
+}
+
+// Validate checks that the rule renders to a valid pg_hba.conf entry
+func (r *HBARule) Validate() error {
+	if _, ok := hbaRuleTypes[r.Type]; !ok {
+		return fmt.Errorf("unknown type %q", r.Type)
+	}
+	for name, v := range map[string]string{"database": r.Database, "user": r.User} {
+		if v == "" {
+			return fmt.Errorf("%s must be defined", name)
+		}
+		if strings.ContainsAny(v, " \t\n#") {
+			return fmt.Errorf("wrong %s %q", name, v)
+		}
+	}
+	if r.Type == "local" {
+		if r.Address != "" {
+			return fmt.Errorf("address cannot be defined with type local")
+		}
+	} else {
+		if r.Address == "" {
+			return fmt.Errorf("address must be defined with type %s", r.Type)
+		}
+		if strings.Contains(r.Address, "/") {
+			if _, _, err := net.ParseCIDR(r.Address); err != nil {
+				return fmt.Errorf("wrong address %q: %v", r.Address, err)
+			}
+		} else if net.ParseIP(r.Address) == nil && !hbaHostNameRegexp.MatchString(r.Address) {
+			return fmt.Errorf("wrong address %q", r.Address)
+		}
+	}
+	if _, ok := hbaRuleMethods[r.Method]; !ok {
+		return fmt.Errorf("unknown method %q", r.Method)
+	}
+	for k, v := range r.Options {
+		if k == "" || strings.ContainsAny(k, "= \t\n#\"") {
+			return fmt.Errorf("wrong option name %q", k)
+		}
+		if strings.ContainsAny(v, "\n\"") {
+			return fmt.Errorf("wrong option %q value %q", k, v)
+		}
+	}
+	return nil
+}
+
+// host names, optionally starting with a dot to match a domain suffix. It
+// also matches the all, samehost and samenet keywords.
+var hbaHostNameRegexp = regexp.MustCompile(`^\.?[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*$`)
+
+// String returns the rule rendered as a pg_hba.conf entry. Options are
+// sorted by name and their values are quoted when containing spaces.
+func (r *HBARule) String() string {
+	fields := []string{r.Type, r.Database, r.User}
+	if r.Address != "" {
+		fields = append(fields, r.Address)
+	}
+	fields = append(fields, r.Method)
+	keys := make([]string, 0, len(r.Options))
+	for k := range r.Options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := r.Options[k]
+		if strings.ContainsAny(v, " \t") {
+			v = `"` + v + `"`
+		}
+		fields = append(fields, k+"="+v)
+	}
+	return strings.Join(fields, " ")
+}
+
+// IdentMapping is a structured pg_ident.conf user name map entry
+type IdentMapping struct {
+	// MapName is the map name referenced by the pg_hba.conf map option
+	MapName string `json:"mapName"`
+	// SystemUsername is the matched system user name. When starting with
+	// a slash it's a regular expression.
+	SystemUsername string `json:"systemUsername"`
+	// PGUsername is the postgres user name the system user can connect as
+	PGUsername string `json:"pgUsername"`
+}
+
+// Validate checks that the mapping renders to a valid pg_ident.conf entry
+func (m *IdentMapping) Validate() error {
+	for _, f := range []struct{ name, v string }{
+		{"mapName", m.MapName},
+		{"systemUsername", m.SystemUsername},
+		{"pgUsername", m.PGUsername},
+	} {
+		if f.v == "" {
+			return fmt.Errorf("%s must be defined", f.name)
+		}
+		if strings.ContainsAny(f.v, "\n\"") {
+			return fmt.Errorf("wrong %s %q", f.name, f.v)
+		}
+	}
+	if strings.ContainsAny(m.MapName, " \t#") {
+		return fmt.Errorf("wrong mapName %q", m.MapName)
+	}
+	return nil
+}
+
+// String returns the mapping rendered as a pg_ident.conf entry. The user
+// names are quoted when containing spaces or a "#".
+func (m *IdentMapping) String() string {
+	quote := func(v string) string {
+		if strings.ContainsAny(v, " \t#") {
+			return `"` + v + `"`
+		}
+		return v
+	}
+	return strings.Join([]string{m.MapName, quote(m.SystemUsername), quote(m.PGUsername)}, " ")
+}
+
+// MonitoringUser defines a role for the monitoring tools
+type MonitoringUser struct {
+	// Username is the monitoring role name
+	Username string `json:"username"`
+	// Addresses are the addresses (in CIDR notation) from where the
+	// monitoring role can connect to all the databases. Defaults to all
+	// the ipv4 and ipv6 addresses.
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// monitoringUsernameRegexp matches the role names that don't need quoting
+var monitoringUsernameRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// DefAddresses returns the monitoring user addresses or the default ones
+func (m *MonitoringUser) DefAddresses() []string {
+	if len(m.Addresses) == 0 {
+		return []string{"0.0.0.0/0", "::0/0"}
+	}
+	return m.Addresses
+}
+
+func (m *MonitoringUser) Validate() error {
+	if m.Username == "" {
+		return fmt.Errorf("username must be defined")
+	}
+	if !monitoringUsernameRegexp.MatchString(m.Username) || len(m.Username) > 63 {
+		return fmt.Errorf("wrong username %q", m.Username)
+	}
+	if strings.HasPrefix(m.Username, "pg_") {
+		return fmt.Errorf("wrong username %q: the pg_ prefix is reserved", m.Username)
+	}
+	for _, a := range m.Addresses {
+		if _, _, err := net.ParseCIDR(a); err != nil {
+			return fmt.Errorf("wrong address %q: %v", a, err)
+		}
+	}
+	return nil
+}
+
+// Extension defines a postgres extension that must be installed in the
+// cluster
+type Extension struct {
+	// Name is the extension name (i.e. pg_stat_statements)
+	Name string `json:"name"`
+	// Version is the extension version to install or update to. When empty
+	// the default version is installed and never updated.
+	Version string `json:"version,omitempty"`
+	// Schema is the schema where the extension objects are created. When
+	// empty the default creation schema is used.
+	Schema string `json:"schema,omitempty"`
+	// Databases are the databases where the extension is created. Defaults
+	// to all the databases accepting connections.
+	Databases []string `json:"databases,omitempty"`
+	// SharedPreloadLibraries are the libraries the extension requires in
+	// shared_preload_libraries (i.e. pg_stat_statements).
+	SharedPreloadLibraries []string `json:"sharedPreloadLibraries,omitempty"`
+}
+
+func (e *Extension) Validate() error {
+	if e.Name == "" {
+		return fmt.Errorf("name must be defined")
+	}
+	for _, d := range e.Databases {
+		if d == "" {
+			return fmt.Errorf("empty database name")
+		}
+	}
+	for _, l := range e.SharedPreloadLibraries {
+		if l == "" || strings.ContainsAny(l, ", '\"") {
+			return fmt.Errorf("wrong shared preload library %q", l)
+		}
+	}
+	return nil
+}
+
+// ExtensionsSharedPreloadLibraries returns, sorted and without duplicates, the
+// shared preload libraries required by the extensions
+func ExtensionsSharedPreloadLibraries(extensions []Extension) []string {
+	libs := []string{}
+	seen := map[string]struct{}{}
+	for _, e := range extensions {
+		for _, l := range e.SharedPreloadLibraries {
+			if _, ok := seen[l]; !ok {
+				seen[l] = struct{}{}
+				libs = append(libs, l)
+			}
+		}
+	}
+	sort.Strings(libs)
+	return libs
+}
+
+// Tags are arbitrary key/value pairs assigned to a keeper (i.e. its
+// availability zone)
+type Tags map[string]string
+
+// ParseTags parses a comma separated list of key=value tags
+func ParseTags(s string) (Tags, error) {
+	tags := Tags{}
+	if strings.TrimSpace(s) == "" {
+		return tags, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("wrong tag %q, must be in the form key=value", kv)
+		}
+		k := strings.TrimSpace(parts[0])
+		v := strings.TrimSpace(parts[1])
+		if _, ok := tags[k]; ok {
+			return nil, fmt.Errorf("duplicated tag %q", k)
+		}
+		tags[k] = v
+	}
+	if err := tags.Validate(); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// Validate checks that the tag keys aren't empty and that keys and values
+// don't contain the characters used by ParseTags
+func (t Tags) Validate() error {
+	for k, v := range t {
+		if k == "" {
+			return fmt.Errorf("empty tag key")
+		}
+		if strings.ContainsAny(k, "=, \t\n") {
+			return fmt.Errorf("wrong tag key %q", k)
+		}
+		if strings.ContainsAny(v, ",\n") {
+			return fmt.Errorf("wrong value %q for tag %q", v, k)
+		}
+	}
+	return nil
+}
+
+// Matches returns true if t contains all the tags in o with the same values
+func (t Tags) Matches(o Tags) bool {
+	for k, v := range o {
+		if tv, ok := t[k]; !ok || tv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the tags as a sorted comma separated list of key=value
+func (t Tags) String() string {
+	kvs := make([]string, 0, len(t))
+	for k, v := range t {
+		kvs = append(kvs, k+"="+v)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
 type FollowType string
 
 const (
@@ -101,11 +455,31 @@ type PostgresBinaryVersion struct {
 	Min int
 }
 
+// SameMajor reports if the two versions have the same postgres major version.
+// Before postgres 10 the major version is made of the first two numbers. An
+// unknown (zero) version is considered equal to any other one.
+func (v PostgresBinaryVersion) SameMajor(o PostgresBinaryVersion) bool {
+	if v.Maj == 0 || o.Maj == 0 {
+		return true
+	}
+	if v.Maj >= 10 {
+		return v.Maj == o.Maj
+	}
+	return v.Maj == o.Maj && v.Min == o.Min
+}
+
+func (v PostgresBinaryVersion) String() string {
+	return fmt.Sprintf("%d.%d", v.Maj, v.Min)
+}
+
 type ClusterPhase string
 
 const (
 	ClusterPhaseInitializing ClusterPhase = "initializing"
 	ClusterPhaseNormal       ClusterPhase = "normal"
+	// The master db is being upgraded to a new postgres major version (see
+	// PGUpgrade): the cluster is frozen, no new master is elected
+	ClusterPhaseUpgrade ClusterPhase = "upgrade"
 )
 
 type ClusterRole string
@@ -152,6 +526,28 @@ type NewConfig struct {
 	Locale        string `json:"locale,omitempty"`
 	Encoding      string `json:"encoding,omitempty"`
 	DataChecksums bool   `json:"dataChecksums,omitempty"`
+	// WalDir is the absolute path of the directory where initdb places the
+	// wal of the initial master db
+	WalDir string `json:"walDir,omitempty"`
+	// PostInitSQL are statements executed in order, every one in its own
+	// transaction, by the superuser on the postgres database after the
+	// initial master db has been initialized
+	PostInitSQL []string `json:"postInitSQL,omitempty"`
+	// PostInitCommand is a command executed (using /bin/sh -c) after the
+	// PostInitSQL statements. The PGHOST, PGPORT, PGUSER, PGPASSWORD and
+	// PGDATABASE environment variables are set to connect to the db as the
+	// superuser.
+	PostInitCommand string `json:"postInitCommand,omitempty"`
+}
+
+func (nc *NewConfig) dataChecksums() bool {
+	return nc != nil && nc.DataChecksums
+}
+
+// HasPostInitHook reports if post init statements or a post init command are
+// defined
+func (nc *NewConfig) HasPostInitHook() bool {
+	return nc != nil && (len(nc.PostInitSQL) > 0 || nc.PostInitCommand != "")
 }
 
 type PITRConfig struct {
@@ -167,6 +563,367 @@ type ExistingConfig struct {
 	KeeperUID string `json:"keeperUID,omitempty"`
 }
 
+// BasebackupCheckpointMode is the pg_basebackup checkpoint mode
+type BasebackupCheckpointMode string
+
+const (
+	BasebackupCheckpointFast   BasebackupCheckpointMode = "fast"
+	BasebackupCheckpointSpread BasebackupCheckpointMode = "spread"
+)
+
+// BasebackupWalMethod is the pg_basebackup method used to include the wal
+// needed by the backup
+type BasebackupWalMethod string
+
+const (
+	BasebackupWalMethodStream BasebackupWalMethod = "stream"
+	BasebackupWalMethodFetch  BasebackupWalMethod = "fetch"
+)
+
+// BasebackupCompression is the pg_basebackup server side compression method
+type BasebackupCompression string
+
+const (
+	BasebackupCompressionGzip BasebackupCompression = "gzip"
+	BasebackupCompressionLZ4  BasebackupCompression = "lz4"
+	BasebackupCompressionZstd BasebackupCompression = "zstd"
+)
+
+// maxLevel returns the max compression level of the compression method
+func (c BasebackupCompression) maxLevel() uint16 {
+	switch c {
+	case BasebackupCompressionGzip:
+		return 9
+	case BasebackupCompressionLZ4:
+		return 12
+	case BasebackupCompressionZstd:
+		return 22
+	}
+	return 0
+}
+
+// BasebackupConfig defines the pg_basebackup options used when syncing a
+// standby from its followed db (at its initialization and on every resync)
+type BasebackupConfig struct {
+	// MaxRate is the max transfer rate (pg_basebackup --max-rate). It's in
+	// kilobytes per second or, with the k or M suffix, in kilobytes or
+	// megabytes per second (i.e. "100M").
+	MaxRate string `json:"maxRate,omitempty"`
+	// ParallelWorkers is the number of parallel transfer workers. It's
+	// used only when the installed pg_basebackup supports parallel
+	// transfers, otherwise a single worker is used.
+	ParallelWorkers uint16 `json:"parallelWorkers,omitempty"`
+	// CheckpointMode is the checkpoint mode ("fast" or "spread") used at
+	// the backup start. If empty the pg_basebackup default is used.
+	CheckpointMode BasebackupCheckpointMode `json:"checkpointMode,omitempty"`
+	// WalMethod is the method ("stream" or "fetch") used to include the
+	// wal needed by the backup (pg_basebackup --wal-method). If empty
+	// "stream" is used.
+	WalMethod BasebackupWalMethod `json:"walMethod,omitempty"`
+	// Compression is the method ("gzip", "lz4" or "zstd") used to compress
+	// the backup on the followed db server, reducing the transferred data.
+	// It's used only when the installed pg_basebackup supports server side
+	// compression (postgres 15 or later).
+	Compression BasebackupCompression `json:"compression,omitempty"`
+	// CompressionLevel is the compression level. If 0 the compression
+	// method default is used.
+	CompressionLevel uint16 `json:"compressionLevel,omitempty"`
+}
+
+// ResyncMethod defines how a standby is resynced from its followed db
+type ResyncMethod string
+
+const (
+	// Resync with pg_basebackup
+	ResyncMethodBasebackup ResyncMethod = "basebackup"
+	// Resync with a pgBackRest delta restore, falling back to pg_basebackup
+	// when it fails
+	ResyncMethodPgBackRest ResyncMethod = "pgbackrest"
+	// Resync fetching a WAL-G (or wal-e) backup from the object storage,
+	// falling back to pg_basebackup when it fails. The standbys also restore
+	// the wal, not available from their followed db, from the WAL-G archive.
+	ResyncMethodWalG ResyncMethod = "walg"
+)
+
+func ResyncMethodP(m ResyncMethod) *ResyncMethod {
+	return &m
+}
+
+// SynchronousReplicationMethod defines how the master waits for its
+// synchronous standbys
+type SynchronousReplicationMethod string
+
+const (
+	// Wait for all the synchronous standbys (synchronous_standby_names
+	// "FIRST n (...)" with n the number of synchronous standbys)
+	SynchronousReplicationMethodFirst SynchronousReplicationMethod = "first"
+	// Wait for a quorum of minSynchronousStandbys synchronous standbys
+	// (synchronous_standby_names "ANY n (...)", postgres >= 10 only)
+	SynchronousReplicationMethodAny SynchronousReplicationMethod = "any"
+)
+
+func SynchronousReplicationMethodP(m SynchronousReplicationMethod) *SynchronousReplicationMethod {
+	return &m
+}
+
+// SynchronousCommitLevel is the synchronous_commit level enforced on the
+// master
+type SynchronousCommitLevel string
+
+const (
+	// Wait for the commit to be flushed on the synchronous standbys
+	SynchronousCommitOn SynchronousCommitLevel = "on"
+	// Wait for the commit to be written (not flushed) on the synchronous
+	// standbys
+	SynchronousCommitRemoteWrite SynchronousCommitLevel = "remote_write"
+	// Wait for the commit to be applied on the synchronous standbys, so it's
+	// visible to their queries (postgres >= 9.6 only)
+	SynchronousCommitRemoteApply SynchronousCommitLevel = "remote_apply"
+)
+
+func SynchronousCommitLevelP(l SynchronousCommitLevel) *SynchronousCommitLevel {
+	return &l
+}
+
+// maxStandbyDelay is the max value of the max_standby_streaming_delay and
+// max_standby_archive_delay postgres parameters
+const maxStandbyDelay = math.MaxInt32 * time.Millisecond
+
+// StandbyConflicts defines the postgres parameters controlling the conflicts
+// between the queries executed on the standbys and the replay of the master
+// wal. They're applied by the keepers only on the standbys (on the master the
+// pgParameters values, if any, are used) and override the same pgParameters.
+type StandbyConflicts struct {
+	// HotStandbyFeedback makes the standbys report to the master the
+	// oldest transaction they're executing, so the rows they still need
+	// aren't removed by vacuum (hot_standby_feedback)
+	HotStandbyFeedback *bool `json:"hotStandbyFeedback,omitempty"`
+	// MaxStandbyStreamingDelay is the max time the replay of the streamed
+	// wal waits for the conflicting queries before canceling them
+	// (max_standby_streaming_delay). A negative value waits forever.
+	MaxStandbyStreamingDelay *Duration `json:"maxStandbyStreamingDelay,omitempty"`
+	// MaxStandbyArchiveDelay is the max time the replay of the wal restored
+	// from the archive waits for the conflicting queries before canceling
+	// them (max_standby_archive_delay). A negative value waits forever.
+	MaxStandbyArchiveDelay *Duration `json:"maxStandbyArchiveDelay,omitempty"`
+}
+
+// standbyDelayParameter returns the postgres parameter value of a max
+// standby delay
+func standbyDelayParameter(d time.Duration) string {
+	if d < 0 {
+		return "-1"
+	}
+	return fmt.Sprintf("%dms", int64(d/time.Millisecond))
+}
+
+// Parameters returns the postgres parameters defined by the standby conflicts
+// options
+func (c *StandbyConflicts) Parameters() map[string]string {
+	parameters := map[string]string{}
+	if c == nil {
+		return parameters
+	}
+	if c.HotStandbyFeedback != nil {
+		parameters["hot_standby_feedback"] = "off"
+		if *c.HotStandbyFeedback {
+			parameters["hot_standby_feedback"] = "on"
+		}
+	}
+	if c.MaxStandbyStreamingDelay != nil {
+		parameters["max_standby_streaming_delay"] = standbyDelayParameter(c.MaxStandbyStreamingDelay.Duration)
+	}
+	if c.MaxStandbyArchiveDelay != nil {
+		parameters["max_standby_archive_delay"] = standbyDelayParameter(c.MaxStandbyArchiveDelay.Duration)
+	}
+	return parameters
+}
+
+// PgBackRestConfig defines the pgBackRest options used when resyncing a
+// standby with the pgbackrest resync method
+type PgBackRestConfig struct {
+	// Stanza is the pgBackRest stanza of the cluster
+	Stanza string `json:"stanza,omitempty"`
+	// ConfigPath is the pgBackRest configuration file. If empty the
+	// pgBackRest default is used.
+	ConfigPath string `json:"configPath,omitempty"`
+}
+
+// WalGConfig defines the WAL-G options used with the walg resync method.
+// wal-e, having the same backup-fetch and wal-fetch commands, can be used
+// too. The WAL-G storage configuration is provided by the keeper environment.
+type WalGConfig struct {
+	// Command is the WAL-G command, optionally with its arguments (i.e.
+	// "envdir /etc/wal-e.d/env wal-e"). If empty "wal-g" is used.
+	Command string `json:"command,omitempty"`
+	// BackupName is the backup to fetch. If empty "LATEST" is used.
+	BackupName string `json:"backupName,omitempty"`
+}
+
+// ResyncStrategyType is the type of a resync strategy
+type ResyncStrategyType string
+
+const (
+	// Resync with pg_rewind. It must be the first strategy since it needs
+	// the current data dir and requires usePgrewind
+	ResyncStrategyPgRewind ResyncStrategyType = "pgrewind"
+	// Resync with a pgBackRest delta restore
+	ResyncStrategyPgBackRest ResyncStrategyType = "pgbackrest"
+	// Resync fetching a WAL-G (or wal-e) backup
+	ResyncStrategyWalG ResyncStrategyType = "walg"
+	// Resync executing a custom command
+	ResyncStrategyCommand ResyncStrategyType = "command"
+	// Resync with pg_basebackup
+	ResyncStrategyBasebackup ResyncStrategyType = "basebackup"
+	// Resync copying with rsync only the changed files of the followed db
+	// data dir inside a non exclusive backup
+	ResyncStrategyRsync ResyncStrategyType = "rsync"
+)
+
+// ResyncStrategy defines a method used to resync a standby from its followed
+// db
+type ResyncStrategy struct {
+	// Type is the strategy type
+	Type ResyncStrategyType `json:"type"`
+	// Timeout is the max time the strategy can take. When expired the
+	// strategy is considered failed and the next one is tried. If empty
+	// there's no timeout.
+	Timeout *Duration `json:"timeout,omitempty"`
+	// Command is the command executed (using /bin/sh -c) by the "command"
+	// strategy type. It must fill the keeper data dir (provided in the
+	// STOLON_DATA_DIR environment variable).
+	Command string `json:"command,omitempty"`
+	// RsyncSource is the rsync source of the followed db data dir used by
+	// the "rsync" strategy type (i.e.
+	// rsync://${STOLON_FOLLOWED_HOST}/pgdata/). The resync strategies
+	// environment variables are expanded.
+	RsyncSource string `json:"rsyncSource,omitempty"`
+}
+
+// BackupMethod is the method used to take the scheduled base backups
+type BackupMethod string
+
+const (
+	// Backup with pgBackRest (pgbackrest backup) using the
+	// PgBackRestConfig stanza
+	BackupMethodPgBackRest BackupMethod = "pgbackrest"
+	// Backup with WAL-G (wal-g backup-push) using the WalGConfig command
+	BackupMethodWalG BackupMethod = "walg"
+	// Backup executing a custom command
+	BackupMethodCommand BackupMethod = "command"
+)
+
+// BackupConfig defines the scheduled base backups. Every Interval the
+// sentinel requests a base backup to the keeper of a healthy standby (or of
+// the master when no standby is available).
+type BackupConfig struct {
+	// Method is the backup method
+	Method BackupMethod `json:"method,omitempty"`
+	// Command is the command executed (using /bin/sh -c) by the "command"
+	// backup method. The keeper data dir is provided in the
+	// STOLON_DATA_DIR environment variable.
+	Command string `json:"command,omitempty"`
+	// Interval is the time between the requests of two backups
+	Interval *Duration `json:"interval,omitempty"`
+	// Timeout is the max time a backup can take. When expired the backup
+	// is considered failed.
+	Timeout *Duration `json:"timeout,omitempty"`
+}
+
+// MaxBackupHistory is the number of completed or failed backups recorded in
+// the cluster status
+const MaxBackupHistory = 10
+
+type BackupPhase string
+
+const (
+	// The backup has been requested by the sentinel
+	BackupPhaseRequested BackupPhase = "requested"
+	// The backup is running
+	BackupPhaseRunning BackupPhase = "running"
+	// The backup has completed
+	BackupPhaseCompleted BackupPhase = "completed"
+	// The backup has failed
+	BackupPhaseFailed BackupPhase = "failed"
+)
+
+// Backup is a scheduled base backup taken by a keeper
+type Backup struct {
+	UID       string       `json:"uid,omitempty"`
+	Method    BackupMethod `json:"method,omitempty"`
+	KeeperUID string       `json:"keeperUID,omitempty"`
+	DBUID     string       `json:"dbUID,omitempty"`
+	Phase     BackupPhase  `json:"phase,omitempty"`
+	// RequestTime is the time the backup has been requested by the
+	// sentinel
+	RequestTime time.Time `json:"requestTime,omitempty"`
+	// StartTime and EndTime are the times the keeper started and
+	// completed (or failed) the backup
+	StartTime time.Time `json:"startTime,omitempty"`
+	EndTime   time.Time `json:"endTime,omitempty"`
+	// Error is the backup error when failed
+	Error string `json:"error,omitempty"`
+}
+
+// Finished reports if the backup has completed or failed
+func (b *Backup) Finished() bool {
+	return b.Phase == BackupPhaseCompleted || b.Phase == BackupPhaseFailed
+}
+
+// ChecksumsVerificationConfig defines the periodic data checksums
+// verification of the standby dbs. Every Interval the keeper of an
+// asynchronous standby stops its db and verifies its data checksums with
+// pg_checksums (pg_verify_checksums on postgres 11), one standby at a time.
+type ChecksumsVerificationConfig struct {
+	// Interval is the time between two verifications of a standby db
+	Interval *Duration `json:"interval,omitempty"`
+	// Timeout is the max time a verification can take. When expired the
+	// verification is considered failed.
+	Timeout *Duration `json:"timeout,omitempty"`
+}
+
+// ChecksumsVerification reports a data checksums verification of a db
+type ChecksumsVerification struct {
+	DBUID string `json:"dbUID,omitempty"`
+	// Running reports that the verification is in progress, with the db
+	// stopped
+	Running   bool      `json:"running,omitempty"`
+	StartTime time.Time `json:"startTime,omitempty"`
+	EndTime   time.Time `json:"endTime,omitempty"`
+	// Success reports that the verification completed without finding
+	// checksum failures
+	Success bool `json:"success,omitempty"`
+	// Error is the verification error (i.e. the pg_checksums exit status
+	// when checksum failures have been found or the timeout)
+	Error string `json:"error,omitempty"`
+	// Output contains the (truncated) pg_checksums standard error with the
+	// details of the checksum failures
+	Output string `json:"output,omitempty"`
+}
+
+// ResyncVerification reports the verification of a db resync
+type ResyncVerification struct {
+	DBUID string `json:"dbUID,omitempty"`
+	// Strategy is the resync strategy whose result has been verified
+	Strategy ResyncStrategyType `json:"strategy,omitempty"`
+	Time     time.Time          `json:"time,omitempty"`
+	// ManifestVerified reports that the backup manifest has been verified
+	// with pg_verifybackup
+	ManifestVerified bool `json:"manifestVerified,omitempty"`
+	// WalFile is the first wal file required to start the db
+	WalFile string `json:"walFile,omitempty"`
+	// WalAvailable reports that the required wal file is in the data dir or
+	// in the followed db wal directory
+	WalAvailable bool `json:"walAvailable,omitempty"`
+	// Success reports that the verification didn't find problems
+	Success bool `json:"success,omitempty"`
+	// Error is the verification error
+	Error string `json:"error,omitempty"`
+	// Output contains the (truncated) pg_verifybackup standard error with
+	// the details of the problems found
+	Output string `json:"output,omitempty"`
+}
+
 // Standby config when role is standby
 type StandbyConfig struct {
 	StandbySettings         *StandbySettings         `json:"standbySettings,omitempty"`
@@ -196,6 +953,141 @@ type StandbySettings struct {
 	RecoveryMinApplyDelay string `json:"recoveryMinApplyDelay,omitempty"`
 }
 
+// ReplicationSlotStatus is the status of a db physical replication slot
+type ReplicationSlotStatus struct {
+	Name   string `json:"name,omitempty"`
+	Active bool   `json:"active,omitempty"`
+	// RestartLSN is the oldest wal position still required by the slot
+	// consumer
+	RestartLSN uint64 `json:"restartLSN,omitempty"`
+}
+
+// WalRetentionStatus is the wal retention status of a db checked against the
+// WalRetentionLimits
+type WalRetentionStatus struct {
+	// WalSize is the size of the wal directory
+	WalSize uint64 `json:"walSize,omitempty"`
+	// MaxWalSizeExceeded reports if the wal directory size is greater than
+	// the limit
+	MaxWalSizeExceeded bool `json:"maxWalSizeExceeded,omitempty"`
+	// ExceedingSlots are the inactive replication slots exceeding the
+	// limits
+	ExceedingSlots []string `json:"exceedingSlots,omitempty"`
+	// DroppedSlots are the exceeding replication slots dropped by the
+	// dropSlot policy
+	DroppedSlots []string `json:"droppedSlots,omitempty"`
+}
+
+// Exceeded reports if the wal retention limits are exceeded
+func (s *WalRetentionStatus) Exceeded() bool {
+	return s.MaxWalSizeExceeded || len(s.ExceedingSlots) > 0
+}
+
+// AutomaticResyncReason is the reason a standby db requires an automatic full
+// resync
+type AutomaticResyncReason string
+
+const (
+	// The wal required by the db are missing on the master
+	AutomaticResyncReasonMissingWal AutomaticResyncReason = "missingWal"
+	// The db has a different postgres system id or a diverged timeline
+	// history
+	AutomaticResyncReasonInvalidData AutomaticResyncReason = "invalidData"
+)
+
+// AutomaticResyncDecision is the decision taken by the sentinel, following
+// the AutomaticResyncPolicy, for a db requiring an automatic full resync
+type AutomaticResyncDecision string
+
+const (
+	// The db has been resynced
+	AutomaticResyncDecisionResync AutomaticResyncDecision = "resync"
+	// The db won't be resynced
+	AutomaticResyncDecisionHalted AutomaticResyncDecision = "halted"
+	// The db will be resynced when the backoff expires
+	AutomaticResyncDecisionWaitingBackoff AutomaticResyncDecision = "waitingBackoff"
+)
+
+// AutomaticResyncStatus reports the decision taken by the sentinel for a db
+// requiring an automatic full resync
+type AutomaticResyncStatus struct {
+	Reason   AutomaticResyncReason   `json:"reason,omitempty"`
+	Decision AutomaticResyncDecision `json:"decision,omitempty"`
+	// Error contains the details of the detected failure
+	Error string `json:"error,omitempty"`
+	// Time is when the decision has been taken
+	Time time.Time `json:"time,omitempty"`
+	// Attempts is the number of consecutive automatic resyncs done, with
+	// the retryWithBackoff policy, on the db keeper
+	Attempts int `json:"attempts,omitempty"`
+	// NextResyncTime is when, with the retryWithBackoff policy, the db will
+	// be resynced
+	NextResyncTime *time.Time `json:"nextResyncTime,omitempty"`
+}
+
+// TablespaceStatus is the status of a db tablespace
+type TablespaceStatus struct {
+	Name     string `json:"name,omitempty"`
+	Location string `json:"location,omitempty"`
+}
+
+// Publication defines a logical replication publication
+type Publication struct {
+	// Publication name
+	Name string `json:"name,omitempty"`
+	// Database where the publication will be created. Defaults to "postgres"
+	Database string `json:"database,omitempty"`
+	// AllTables defines a publication for all the database tables
+	AllTables bool `json:"allTables,omitempty"`
+	// Tables to be published in the "table" or "schema.table" format (the
+	// "public" schema is used when not provided). Names are case sensitive.
+	Tables []string `json:"tables,omitempty"`
+}
+
+// DefDatabase returns the publication database or the default one
+func (p *Publication) DefDatabase() string {
+	if p.Database == "" {
+		return DefaultPublicationDatabase
+	}
+	return p.Database
+}
+
+// LogicalReplicationSlot defines a logical replication slot
+type LogicalReplicationSlot struct {
+	// Slot name. The slot will be created prefixed with "stolon_"
+	Name string `json:"name,omitempty"`
+	// Database of the slot. Defaults to "postgres"
+	Database string `json:"database,omitempty"`
+	// Output plugin of the slot. Defaults to "pgoutput"
+	Plugin string `json:"plugin,omitempty"`
+}
+
+// DefDatabase returns the slot database or the default one
+func (s *LogicalReplicationSlot) DefDatabase() string {
+	if s.Database == "" {
+		return DefaultLogicalReplicationSlotDatabase
+	}
+	return s.Database
+}
+
+// DefPlugin returns the slot output plugin or the default one
+func (s *LogicalReplicationSlot) DefPlugin() string {
+	if s.Plugin == "" {
+		return DefaultLogicalReplicationSlotPlugin
+	}
+	return s.Plugin
+}
+
+// LogicalReplicationSlotStatus is the status of a logical replication slot
+type LogicalReplicationSlotStatus struct {
+	Name     string `json:"name,omitempty"`
+	Database string `json:"database,omitempty"`
+	Plugin   string `json:"plugin,omitempty"`
+	// ConfirmedFlushLSN is the position up to which the slot consumer has
+	// confirmed receiving data
+	ConfirmedFlushLSN uint64 `json:"confirmedFlushLSN,omitempty"`
+}
+
 type SUReplAccessMode string
 
 const (
@@ -209,6 +1101,423 @@ func SUReplAccessModeP(s SUReplAccessMode) *SUReplAccessMode {
 	return &s
 }
 
+// DBProbeMode defines if and how the sentinel probes the dbs reported healthy
+// by their keepers
+type DBProbeMode string
+
+const (
+	// Don't probe the dbs
+	DBProbeModeNone DBProbeMode = "none"
+	// Probe the dbs and only log a failed probe
+	DBProbeModeAdvisory DBProbeMode = "advisory"
+	// Probe the dbs and mark a db with a failed probe as unhealthy
+	DBProbeModeEnforce DBProbeMode = "enforce"
+)
+
+func DBProbeModeP(m DBProbeMode) *DBProbeMode {
+	return &m
+}
+
+// AddressFamily is the ip family of the addresses advertised by the keepers
+type AddressFamily string
+
+const (
+	// Every address, the main advertised address is used
+	AddressFamilyAny AddressFamily = "any"
+	// IPv4 addresses
+	AddressFamilyIPv4 AddressFamily = "ipv4"
+	// IPv6 addresses
+	AddressFamilyIPv6 AddressFamily = "ipv6"
+)
+
+func AddressFamilyP(f AddressFamily) *AddressFamily {
+	return &f
+}
+
+// Matches reports if the address is an ip of the family. Every address
+// matches AddressFamilyAny, a host name matches only AddressFamilyAny.
+func (f AddressFamily) Matches(address string) bool {
+	if f == AddressFamilyAny {
+		return true
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	if ip.To4() != nil {
+		return f == AddressFamilyIPv4
+	}
+	return f == AddressFamilyIPv6
+}
+
+// SelectListenAddress returns, between the main and the additional addresses
+// advertised by a keeper, the first one of the family. When no address is of
+// the family the main address is returned.
+func SelectListenAddress(main string, additional []string, family AddressFamily) string {
+	if family.Matches(main) {
+		return main
+	}
+	for _, address := range additional {
+		if family.Matches(address) {
+			return address
+		}
+	}
+	return main
+}
+
+// PGStopMode is the pg_ctl mode used by the keeper to stop postgres
+type PGStopMode string
+
+const (
+	// Wait for all the clients to disconnect
+	PGStopModeSmart PGStopMode = "smart"
+	// Abort the client connections and do a clean shutdown
+	PGStopModeFast PGStopMode = "fast"
+	// Abort all the processes without a clean shutdown, a crash recovery
+	// will be done at the next start
+	PGStopModeImmediate PGStopMode = "immediate"
+)
+
+func PGStopModeP(m PGStopMode) *PGStopMode {
+	return &m
+}
+
+// FencingPolicy defines what the sentinel does when the fencing of a failed
+// master fails
+type FencingPolicy string
+
+const (
+	// Don't elect a new master, the fencing is retried at the next sentinel
+	// check
+	FencingPolicyFailClosed FencingPolicy = "failClosed"
+	// Elect the new master anyway
+	FencingPolicyFailOpen FencingPolicy = "failOpen"
+)
+
+func FencingPolicyP(p FencingPolicy) *FencingPolicy {
+	return &p
+}
+
+// MasterElectionStrategy defines how the sentinel orders the new master
+// candidates (the standbys, whose lag is within the allowed bounds, that can
+// replace a failed master). The first one is elected.
+type MasterElectionStrategy string
+
+const (
+	// Prefer the keepers with the higher election priority, then the dbs by
+	// xlog position and then by the master placement preferences
+	MasterElectionStrategyPriority MasterElectionStrategy = "priority"
+	// Prefer the dbs with the greater xlog position, then like "priority"
+	MasterElectionStrategyMaxLSN MasterElectionStrategy = "maxLSN"
+	// Prefer the dbs matching the master placement preferences
+	// (masterAntiAffinityTag or failureDomainTag and masterPreferredTags),
+	// then like "priority"
+	MasterElectionStrategyZoneAware MasterElectionStrategy = "zoneAware"
+	// Order the candidates with the output of MasterElectionCommand
+	MasterElectionStrategyCommand MasterElectionStrategy = "command"
+	// Order the candidates with the response of MasterElectionURL
+	MasterElectionStrategyURL MasterElectionStrategy = "url"
+)
+
+func MasterElectionStrategyP(s MasterElectionStrategy) *MasterElectionStrategy {
+	return &s
+}
+
+// SyncStandbySelection defines how the sentinel chooses the synchronous
+// standbys
+type SyncStandbySelection string
+
+const (
+	// Choose the synchronous standbys between the good standbys without
+	// considering their lag
+	SyncStandbySelectionAny SyncStandbySelection = "any"
+	// Prefer the streaming standbys with the lowest replay lag and replace
+	// the synchronous standbys lagging more than SyncStandbyMaxReplayLag
+	SyncStandbySelectionLag SyncStandbySelection = "lag"
+)
+
+func SyncStandbySelectionP(s SyncStandbySelection) *SyncStandbySelection {
+	return &s
+}
+
+// SyncReplDegradationPolicy defines what the sentinel does when there aren't
+// enough healthy synchronous standbys to reach MinSynchronousStandbys
+type SyncReplDegradationPolicy string
+
+const (
+	// Keep blocking the master writes until enough synchronous standbys are
+	// healthy again
+	SyncReplDegradationPolicyBlock SyncReplDegradationPolicy = "block"
+	// Degrade to asynchronous replication after the grace period
+	SyncReplDegradationPolicyDegradeAfterGrace SyncReplDegradationPolicy = "degradeAfterGrace"
+	// Degrade to asynchronous replication only when acknowledged by the
+	// operator (with `stolonctl degradesyncrepl`)
+	SyncReplDegradationPolicyDegradeOnAck SyncReplDegradationPolicy = "degradeOnAck"
+)
+
+// SyncReplDegradation defines what the sentinel does, with synchronous
+// replication enabled, when there aren't enough healthy synchronous standbys
+// to reach MinSynchronousStandbys.
+type SyncReplDegradation struct {
+	// Policy defines what the sentinel does. If empty "block" is used.
+	Policy SyncReplDegradationPolicy `json:"policy,omitempty"`
+	// GracePeriod is the time the master writes are blocked, with the
+	// degradeAfterGrace policy, before degrading to asynchronous
+	// replication. Default 30s.
+	GracePeriod *Duration `json:"gracePeriod,omitempty"`
+}
+
+// DefPolicy returns the policy or the default one
+func (d *SyncReplDegradation) DefPolicy() SyncReplDegradationPolicy {
+	if d == nil || d.Policy == "" {
+		return SyncReplDegradationPolicyBlock
+	}
+	return d.Policy
+}
+
+// DefGracePeriod returns the grace period or the default one
+func (d *SyncReplDegradation) DefGracePeriod() time.Duration {
+	if d == nil || d.GracePeriod == nil {
+		return DefaultSyncDegradationGracePeriod
+	}
+	return d.GracePeriod.Duration
+}
+
+// SyncReplMode is the current synchronous replication mode of the master
+type SyncReplMode string
+
+const (
+	// There are enough healthy synchronous standbys. It's never reported in
+	// the cluster status since the status is removed in this mode.
+	SyncReplModeSync SyncReplMode = "sync"
+	// There aren't enough healthy synchronous standbys and the master
+	// writes are blocked
+	SyncReplModeBlocking SyncReplMode = "blocking"
+	// There aren't enough healthy synchronous standbys and the master has
+	// been degraded to asynchronous replication (only the healthy
+	// synchronous standbys, if any, are waited for)
+	SyncReplModeDegraded SyncReplMode = "degraded"
+)
+
+// SyncReplDegradationStatus reports the synchronous replication mode of the
+// master when there aren't enough healthy synchronous standbys
+type SyncReplDegradationStatus struct {
+	Mode SyncReplMode `json:"mode,omitempty"`
+	// Since is when the current mode has been entered
+	Since time.Time `json:"since,omitempty"`
+	// Acknowledged reports that the degradation to asynchronous replication
+	// has been acknowledged by the operator. It's cleared when there are
+	// enough healthy synchronous standbys again.
+	Acknowledged bool `json:"acknowledged,omitempty"`
+}
+
+// WalRetentionStrategy defines how the master retains the wal needed by its
+// standbys
+type WalRetentionStrategy string
+
+const (
+	// Retain the wal using a replication slot for every standby
+	WalRetentionStrategySlots WalRetentionStrategy = "slots"
+	// Retain a fixed amount of wal (wal_keep_segments or wal_keep_size)
+	WalRetentionStrategyWalKeep WalRetentionStrategy = "wal_keep"
+	// Use both replication slots and a fixed amount of retained wal
+	WalRetentionStrategyBoth WalRetentionStrategy = "both"
+)
+
+func WalRetentionStrategyP(s WalRetentionStrategy) *WalRetentionStrategy {
+	return &s
+}
+
+// UseSlots reports if the standbys replication slots must be used. An empty
+// strategy is the default one.
+func (s WalRetentionStrategy) UseSlots() bool {
+	return s != WalRetentionStrategyWalKeep
+}
+
+// UseWalKeep reports if a fixed amount of wal must be retained. An empty
+// strategy is the default one.
+func (s WalRetentionStrategy) UseWalKeep() bool {
+	return s != WalRetentionStrategySlots
+}
+
+// WalKeepParameterName returns the name of the parameter defining the wal
+// retained for the standbys. wal_keep_segments has been replaced by
+// wal_keep_size in postgres 13.
+func WalKeepParameterName(maj int) string {
+	if maj >= 13 {
+		return "wal_keep_size"
+	}
+	return "wal_keep_segments"
+}
+
+// WalRetentionLimitPolicy defines what the keeper does when the wal retention
+// limits are exceeded
+type WalRetentionLimitPolicy string
+
+const (
+	// Only report the exceeded limits in the db status
+	WalRetentionLimitPolicyAlert WalRetentionLimitPolicy = "alert"
+	// Drop the inactive replication slots exceeding the limits
+	WalRetentionLimitPolicyDropSlot WalRetentionLimitPolicy = "dropSlot"
+	// Don't resync the standbys from the db while the limits are exceeded
+	WalRetentionLimitPolicyBlockResync WalRetentionLimitPolicy = "blockResync"
+)
+
+// WalRetentionLimits defines the limits of the wal retained by a db and what
+// the keeper does when they're exceeded
+type WalRetentionLimits struct {
+	// MaxWalSize is the max size, in bytes, of the wal directory. When
+	// exceeded the inactive replication slot retaining the most wal is
+	// considered exceeding. 0 means no limit.
+	MaxWalSize uint64 `json:"maxWalSize,omitempty"`
+	// MaxSlotRetainedWal is the max wal, in bytes, retained by an inactive
+	// replication slot. 0 means no limit.
+	MaxSlotRetainedWal uint64 `json:"maxSlotRetainedWal,omitempty"`
+	// Policy defines what the keeper does when the limits are exceeded. If
+	// empty "alert" is used.
+	Policy WalRetentionLimitPolicy `json:"policy,omitempty"`
+}
+
+// DefPolicy returns the policy or the default one
+func (l *WalRetentionLimits) DefPolicy() WalRetentionLimitPolicy {
+	if l.Policy == "" {
+		return WalRetentionLimitPolicyAlert
+	}
+	return l.Policy
+}
+
+// AutomaticResyncPolicy defines what the sentinel does when a standby db
+// requires an automatic full resync
+type AutomaticResyncPolicy string
+
+const (
+	// Immediately resync the db
+	AutomaticResyncPolicyResync AutomaticResyncPolicy = "resync"
+	// Don't resync the db, only report the failure in the db status
+	AutomaticResyncPolicyHalt AutomaticResyncPolicy = "halt"
+	// Resync the db waiting an exponentially increasing backoff between
+	// consecutive resyncs of the same keeper
+	AutomaticResyncPolicyRetryWithBackoff AutomaticResyncPolicy = "retryWithBackoff"
+)
+
+// AutomaticResyncConfig defines what the sentinel does when a standby db
+// requires an automatic full resync since it cannot recover: the wal it
+// requires are missing on the master or its data is invalid (a different
+// postgres system id or a diverged timeline history).
+type AutomaticResyncConfig struct {
+	// Policy defines what the sentinel does. If empty "resync" is used.
+	Policy AutomaticResyncPolicy `json:"policy,omitempty"`
+	// InitialBackoff is the time waited, with the retryWithBackoff policy,
+	// after the first resync before resyncing again the db of the same
+	// keeper. It's doubled at every consecutive resync. Default 5m.
+	InitialBackoff *Duration `json:"initialBackoff,omitempty"`
+	// MaxBackoff is the max time waited, with the retryWithBackoff policy,
+	// between consecutive resyncs. Default 1h.
+	MaxBackoff *Duration `json:"maxBackoff,omitempty"`
+}
+
+// DefPolicy returns the policy or the default one
+func (c *AutomaticResyncConfig) DefPolicy() AutomaticResyncPolicy {
+	if c == nil || c.Policy == "" {
+		return AutomaticResyncPolicyResync
+	}
+	return c.Policy
+}
+
+// DefInitialBackoff returns the initial backoff or the default one
+func (c *AutomaticResyncConfig) DefInitialBackoff() time.Duration {
+	if c == nil || c.InitialBackoff == nil {
+		return DefaultResyncInitialBackoff
+	}
+	return c.InitialBackoff.Duration
+}
+
+// DefMaxBackoff returns the max backoff or the default one
+func (c *AutomaticResyncConfig) DefMaxBackoff() time.Duration {
+	if c == nil || c.MaxBackoff == nil {
+		return DefaultResyncMaxBackoff
+	}
+	return c.MaxBackoff.Duration
+}
+
+// Backoff returns the time to wait before the next resync after the provided
+// number of consecutive resyncs
+func (c *AutomaticResyncConfig) Backoff(attempts int) time.Duration {
+	max := c.DefMaxBackoff()
+	backoff := c.DefInitialBackoff()
+	for i := 1; i < attempts && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+// ResyncScheduling defines how the sentinel schedules the full resyncs of
+// the new standbys and how the keepers limit them, so many standbys resynced
+// at the same time (i.e. after a node failure) won't saturate the master
+// network and disk.
+type ResyncScheduling struct {
+	// MaxConcurrentResyncs is the max number of standbys resyncing at the
+	// same time. The sentinel waits for the running resyncs to complete
+	// before starting new ones. 0 means no limit.
+	MaxConcurrentResyncs uint16 `json:"maxConcurrentResyncs,omitempty"`
+	// MaxRate is the max transfer rate of every resync, in kilobytes per
+	// second or with a k or M suffix (like the basebackupConfig maxRate).
+	// It's applied by the keepers to the pg_basebackup and rsync resyncs
+	// when the basebackupConfig maxRate isn't defined.
+	MaxRate string `json:"maxRate,omitempty"`
+	// Windows are the time windows, in the "HH:MM-HH:MM" UTC format, when
+	// new resyncs can be started. A window ending before its start spans
+	// midnight. When empty the resyncs can be started at any time.
+	Windows []string `json:"windows,omitempty"`
+}
+
+// parseResyncWindow parses a resync window returning its start and end
+// minutes since midnight
+func parseResyncWindow(w string) (int, int, error) {
+	parts := strings.Split(w, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("wrong resync window %q, must be in the HH:MM-HH:MM format", w)
+	}
+	var minutes [2]int
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return 0, 0, fmt.Errorf("wrong resync window %q, must be in the HH:MM-HH:MM format", w)
+		}
+		minutes[i] = t.Hour()*60 + t.Minute()
+	}
+	if minutes[0] == minutes[1] {
+		return 0, 0, fmt.Errorf("resync window %q start and end must differ", w)
+	}
+	return minutes[0], minutes[1], nil
+}
+
+// InWindow reports if new resyncs can be started at the provided time
+func (s *ResyncScheduling) InWindow(t time.Time) bool {
+	if s == nil || len(s.Windows) == 0 {
+		return true
+	}
+	t = t.UTC()
+	m := t.Hour()*60 + t.Minute()
+	for _, w := range s.Windows {
+		start, end, err := parseResyncWindow(w)
+		if err != nil {
+			continue
+		}
+		if start < end {
+			if m >= start && m < end {
+				return true
+			}
+		} else if m >= start || m < end {
+			return true
+		}
+	}
+	return false
+}
+
 type ClusterSpec struct {
 	// Interval to wait before next check
 	SleepInterval *Duration `json:"sleepInterval,omitempty"`
@@ -240,6 +1549,31 @@ type ClusterSpec struct {
 	// Max lag in bytes that an asynchronous standy can have to be elected in
 	// place of a failed master
 	MaxStandbyLag *uint32 `json:"maxStandbyLag,omitempty"`
+	// FailoverCooldown is the minimum interval between two automatic
+	// failovers. 0 means no limit.
+	FailoverCooldown *Duration `json:"failoverCooldown,omitempty"`
+	// MaxFailovers is the max number of automatic failovers in
+	// MaxFailoversWindow. When reached the automatic failovers are halted
+	// until resumed with `stolonctl resumefailovers`. 0 means no limit.
+	MaxFailovers *uint16 `json:"maxFailovers,omitempty"`
+	// MaxFailoversWindow is the time window of MaxFailovers
+	MaxFailoversWindow *Duration `json:"maxFailoversWindow,omitempty"`
+	// SentinelDryRun makes the leader sentinel only log (and report in its
+	// metrics and events) the cluster data changes it would do, without
+	// writing them
+	SentinelDryRun *bool `json:"sentinelDryRun,omitempty"`
+	// Max lag in bytes that a standby can have to be reported as ready. 0
+	// means no limit.
+	MaxReadyStandbyLag *uint32 `json:"maxReadyStandbyLag,omitempty"`
+	// Max lag in bytes of the replayed position of a standby from the
+	// master xlog position to be elected as the new master or chosen as a
+	// synchronous standby. 0 means no limit.
+	MaxStandbyReplayLag *uint32 `json:"maxStandbyReplayLag,omitempty"`
+	// Max replay delay (the time since the commit on the master of the last
+	// replayed transaction) of a standby, that hasn't replayed all the
+	// master wal, to be elected as the new master or chosen as a synchronous
+	// standby. 0 means no limit.
+	MaxStandbyReplayDelay *Duration `json:"maxStandbyReplayDelay,omitempty"`
 	// Use Synchronous replication between master and its standbys
 	SynchronousReplication *bool `json:"synchronousReplication,omitempty"`
 	// MinSynchronousStandbys is the mininum number if synchronous standbys
@@ -248,6 +1582,33 @@ type ClusterSpec struct {
 	// MaxSynchronousStandbys is the maximum number if synchronous standbys
 	// to be configured when SynchronousReplication is true
 	MaxSynchronousStandbys *uint16 `json:"maxSynchronousStandbys,omitempty"`
+	// SynchronousReplicationMethod defines if the master waits for all the
+	// synchronous standbys ("first") or only for a quorum of
+	// MinSynchronousStandbys of them ("any")
+	SynchronousReplicationMethod *SynchronousReplicationMethod `json:"synchronousReplicationMethod,omitempty"`
+	// SyncStandbySelection defines how the synchronous standbys are chosen
+	SyncStandbySelection *SyncStandbySelection `json:"syncStandbySelection,omitempty"`
+	// SyncStandbyMaxReplayLag is the max replay lag in bytes of a
+	// synchronous standby with the "lag" SyncStandbySelection. A lagging
+	// synchronous standby is replaced when there's another candidate, only
+	// the standbys with a replay lag lower than its half are candidates.
+	SyncStandbyMaxReplayLag *uint32 `json:"syncStandbyMaxReplayLag,omitempty"`
+	// SyncReplDegradation defines what the sentinel does when there aren't
+	// enough healthy synchronous standbys: keep blocking the master writes
+	// ("block", the default), degrade to asynchronous replication after a
+	// grace period ("degradeAfterGrace") or only when acknowledged by the
+	// operator ("degradeOnAck").
+	SyncReplDegradation *SyncReplDegradation `json:"syncReplDegradation,omitempty"`
+	// SynchronousCommit defines the synchronous_commit level enforced on the
+	// master: on, remote_write or remote_apply. The remote_write and
+	// remote_apply levels require SynchronousReplication. When not defined
+	// the synchronous_commit pgParameters value (if any) is used.
+	SynchronousCommit *SynchronousCommitLevel `json:"synchronousCommit,omitempty"`
+	// StandbyConflicts defines the hot_standby_feedback,
+	// max_standby_streaming_delay and max_standby_archive_delay parameters
+	// applied by the keepers on the standbys, overriding the same
+	// pgParameters
+	StandbyConflicts *StandbyConflicts `json:"standbyConflicts,omitempty"`
 	// AdditionalWalSenders defines the number of additional wal_senders in
 	// addition to the ones internally defined by stolon
 	AdditionalWalSenders *uint16 `json:"additionalWalSenders"`
@@ -256,6 +1617,38 @@ type ClusterSpec struct {
 	// here will be dropped from the master instance (i.e. manually created
 	// replication slots will be removed).
 	AdditionalMasterReplicationSlots []string `json:"additionalMasterReplicationSlots"`
+	// WalRetentionStrategy defines how the master retains the wal needed by
+	// its standbys: with a replication slot for every standby ("slots"),
+	// retaining a fixed amount of wal defined by the wal_keep_segments (pg <
+	// 13) or wal_keep_size (pg >= 13) pgParameters ("wal_keep") or both
+	// ("both").
+	WalRetentionStrategy *WalRetentionStrategy `json:"walRetentionStrategy,omitempty"`
+	// WalRetentionLimits defines the limits of the wal retained by the dbs
+	// (the wal directory size and the wal retained by the inactive
+	// replication slots) and what the keepers do when they're exceeded.
+	WalRetentionLimits *WalRetentionLimits `json:"walRetentionLimits,omitempty"`
+	// AutomaticResync defines what the sentinel does when a standby db
+	// cannot recover since the wal it requires are missing on the master or
+	// its data is invalid: resync it ("resync", the default), report the
+	// failure without resyncing it ("halt") or resync it waiting an
+	// increasing backoff between consecutive resyncs ("retryWithBackoff").
+	AutomaticResync *AutomaticResyncConfig `json:"automaticResync,omitempty"`
+	// ResyncScheduling limits the number of standbys resyncing at the same
+	// time, their transfer rate and the time windows when they can be
+	// started.
+	ResyncScheduling *ResyncScheduling `json:"resyncScheduling,omitempty"`
+	// Publications defines the logical replication publications to be
+	// created on the master instance. Publications created by stolon and not
+	// defined here will be dropped from the master instance while
+	// publications manually created will be kept.
+	Publications []Publication `json:"publications,omitempty"`
+	// LogicalReplicationSlots defines the logical replication slots to be
+	// created on the master instance. On PostgreSQL >= 16 they're also
+	// created on the standbys and advanced to the position confirmed on the
+	// master, so their consumers can continue after a failover. Logical
+	// replication slots starting with "stolon_" and not defined here will
+	// be dropped.
+	LogicalReplicationSlots []LogicalReplicationSlot `json:"logicalReplicationSlots,omitempty"`
 	// Whether to use pg_rewind
 	UsePgrewind *bool `json:"usePgrewind,omitempty"`
 	// InitMode defines the cluster initialization mode. Current modes are: new, existing, pitr
@@ -274,15 +1667,194 @@ type ClusterSpec struct {
 	ExistingConfig *ExistingConfig `json:"existingConfig,omitempty"`
 	// Standby config when role is standby
 	StandbyConfig *StandbyConfig `json:"standbyConfig,omitempty"`
+	// StandbyAutoPromote enables the automatic promotion of a standby
+	// cluster to a primary cluster when its upstream primary (defined in
+	// the standbyConfig primaryConninfo) isn't reachable by the leader
+	// sentinel for StandbyAutoPromoteTimeout
+	StandbyAutoPromote *bool `json:"standbyAutoPromote,omitempty"`
+	// StandbyAutoPromoteTimeout is the time the upstream primary must be
+	// continuously unreachable before automatically promoting the standby
+	// cluster
+	StandbyAutoPromoteTimeout *Duration `json:"standbyAutoPromoteTimeout,omitempty"`
+	// BasebackupConfig defines the pg_basebackup options used to sync the
+	// standbys
+	BasebackupConfig *BasebackupConfig `json:"basebackupConfig,omitempty"`
+	// ResyncMethod defines how a standby is resynced from its followed db.
+	// Values can be "basebackup", "pgbackrest" (a pgBackRest delta
+	// restore, falling back to pg_basebackup) or "walg" (a WAL-G backup
+	// fetch, falling back to pg_basebackup).
+	// Default is "basebackup"
+	ResyncMethod *ResyncMethod `json:"resyncMethod,omitempty"`
+	// PgBackRestConfig defines the pgBackRest options used when
+	// ResyncMethod is "pgbackrest"
+	PgBackRestConfig *PgBackRestConfig `json:"pgBackRestConfig,omitempty"`
+	// WalGConfig defines the WAL-G options used when ResyncMethod is
+	// "walg"
+	WalGConfig *WalGConfig `json:"walgConfig,omitempty"`
+	// ResyncStrategies are the strategies, tried in order until one
+	// succeeds, used to resync a standby from its followed db. When
+	// defined ResyncMethod is ignored.
+	// If empty the strategies are pg_rewind (when UsePgrewind is true),
+	// the ResyncMethod one and pg_basebackup
+	ResyncStrategies []ResyncStrategy `json:"resyncStrategies,omitempty"`
+	// VerifyResync enables the verification of the resynced data dir before
+	// starting a standby: its backup manifest is verified with
+	// pg_verifybackup (after a pg_basebackup resync with postgres >= 13)
+	// and the wal required to start the db must be in the data dir or on
+	// the followed db (not checked after a pgBackRest or WAL-G resync,
+	// since their wals are fetched from the archive). When the
+	// verification fails the next resync strategy is tried.
+	VerifyResync *bool `json:"verifyResync,omitempty"`
+	// BackupConfig defines the scheduled base backups. If empty no
+	// backups are scheduled.
+	BackupConfig *BackupConfig `json:"backupConfig,omitempty"`
+	// ChecksumsVerificationConfig defines the periodic data checksums
+	// verification of the standby dbs. If empty no verification is done.
+	ChecksumsVerificationConfig *ChecksumsVerificationConfig `json:"checksumsVerificationConfig,omitempty"`
 	// Define the mode of the default hba rules needed for replication by standby keepers (the su and repl auth methods will be the one provided in the keeper command line options)
 	// Values can be "all" or "strict", "all" allow access from all ips, "strict" restrict master access to standby servers ips.
 	// Default is "all"
 	DefaultSUReplAccessMode *SUReplAccessMode `json:"defaultSUReplAccessMode,omitempty"`
+	// DBProbeMode defines if the sentinel should verify, with a tcp connect
+	// to the db listen address and port, that a db reported healthy by its
+	// keeper is really reachable. Values can be "none", "advisory" (a failed
+	// probe is only logged) or "enforce" (a failed probe marks the db as
+	// unhealthy).
+	// Default is "none"
+	DBProbeMode *DBProbeMode `json:"dbProbeMode,omitempty"`
+	// Timeout of the sentinel db probe
+	DBProbeTimeout *Duration `json:"dbProbeTimeout,omitempty"`
+	// FailoverQuorum is the number of other sentinels that must report the
+	// master db as unreachable (with a tcp connect to its listen address
+	// and port, using the DBProbeTimeout) before the leader sentinel fails
+	// over a master db it considers unhealthy. It avoids failovers caused
+	// by a leader sentinel partitioned from the master. When enabled all
+	// the sentinels probe the dbs and report the results in their
+	// sentinel info.
+	// Default is 0 (disabled)
+	FailoverQuorum *uint16 `json:"failoverQuorum,omitempty"`
+	// PreferredAddressFamily is the family ("any", "ipv4" or "ipv6") of
+	// the address, between the ones advertised by a keeper, reported as
+	// the db listen address and used by the other keepers, the sentinels
+	// and the proxies to connect to the db. With "any" (or when the keeper
+	// doesn't advertise an address of the family) the keeper main
+	// advertised address is used.
+	// Default is "any"
+	PreferredAddressFamily *AddressFamily `json:"preferredAddressFamily,omitempty"`
+	// MasterPreferredTags are the keeper tags preferred when electing a new
+	// master. It's only a preference used to choose between equally good
+	// standbys.
+	MasterPreferredTags Tags `json:"masterPreferredTags,omitempty"`
+	// MasterAntiAffinityTag is the keeper tag key (i.e. the availability
+	// zone) whose value should differ from the one of the failed master
+	// when electing a new master. Like MasterPreferredTags it's only a
+	// preference used to choose between equally good standbys.
+	MasterAntiAffinityTag *string `json:"masterAntiAffinityTag,omitempty"`
+	// FailureDomainTag is the keeper tag key (i.e. the availability zone)
+	// whose value is the keeper failure domain. When defined the sentinel
+	// prefers synchronous standbys in failure domains different from the
+	// master one and, when MasterAntiAffinityTag isn't defined, a new
+	// master in a failure domain different from the failed master one.
+	FailureDomainTag *string `json:"failureDomainTag,omitempty"`
+	// MasterElectionStrategy defines how the new master is chosen between
+	// the new master candidates. Default is "priority"
+	MasterElectionStrategy *MasterElectionStrategy `json:"masterElectionStrategy,omitempty"`
+	// MasterElectionCommand is a command executed (using /bin/sh -c) by the
+	// leader sentinel with the "command" masterElectionStrategy. It receives
+	// the json encoded election request on its standard input and must
+	// write the json encoded election response on its standard output.
+	MasterElectionCommand *string `json:"masterElectionCommand,omitempty"`
+	// MasterElectionURL is an url where the leader sentinel POSTs the
+	// election request with the "url" masterElectionStrategy. It must
+	// reply with the election response.
+	MasterElectionURL *string `json:"masterElectionURL,omitempty"`
+	// MasterElectionTimeout is the max time the masterElectionCommand or
+	// masterElectionURL can take. When expired, or when they fail, the
+	// candidates are ordered with the "priority" strategy.
+	MasterElectionTimeout *Duration `json:"masterElectionTimeout,omitempty"`
+	// AllowDelayedStandbyPromotion permits electing a delayed standby as the
+	// new master when it's the only available standby. Delayed standbys
+	// are intentionally behind the master so they're never elected when
+	// this is false.
+	AllowDelayedStandbyPromotion *bool `json:"allowDelayedStandbyPromotion,omitempty"`
+	// CascadingStandbys defines the standbys following another standby
+	// instead of the master. The keys are the keeper UIDs of the cascading
+	// standbys and the values the keeper UIDs of the standbys they follow.
+	// When the followed standby isn't in a good state the cascading standby
+	// follows the master. Cascading standbys are never chosen as
+	// synchronous standbys.
+	CascadingStandbys map[string]string `json:"cascadingStandbys,omitempty"`
+	// PrePromotionHook is a command executed (using /bin/sh -c) by the
+	// keeper before promoting its standby to master. If it fails or
+	// doesn't complete before PrePromotionHookTimeout the keeper declines the
+	// master role and the sentinel will choose another standby.
+	PrePromotionHook *string `json:"prePromotionHook,omitempty"`
+	// Timeout of the pre promotion hook
+	PrePromotionHookTimeout *Duration `json:"prePromotionHookTimeout,omitempty"`
+	// FencingCommand is a command executed (using /bin/sh -c) by the leader
+	// sentinel, before electing a new master replacing a failed one, to
+	// fence the old master (i.e. powering off its host)
+	FencingCommand *string `json:"fencingCommand,omitempty"`
+	// FencingURL is an url where the leader sentinel POSTs the fencing
+	// request, after executing FencingCommand when also defined
+	FencingURL *string `json:"fencingURL,omitempty"`
+	// Timeout of the fencing command and url request
+	FencingTimeout *Duration `json:"fencingTimeout,omitempty"`
+	// FencingPolicy defines if the new master is elected also when the
+	// fencing fails
+	FencingPolicy *FencingPolicy `json:"fencingPolicy,omitempty"`
+	// SwitchoverTimeout is the max time a switchover (requested with
+	// `stolonctl switchover`) can keep the proxies paused waiting for the
+	// target standby to catch up with the master. When expired the
+	// switchover is aborted and the proxies resumed.
+	SwitchoverTimeout *Duration `json:"switchoverTimeout,omitempty"`
+	// GracefulDemotion, when defined, makes the master keeper drain the
+	// master during a switchover, after the target standby has caught up,
+	// and the sentinel elects the new master only when the target standby
+	// has received the final master wal
+	GracefulDemotion *GracefulDemotion `json:"gracefulDemotion,omitempty"`
+	// PGStopMode is the pg_ctl stop mode used by the keeper when stopping
+	// postgres (i.e. when demoting, restarting or shutting down the db)
+	PGStopMode *PGStopMode `json:"pgStopMode,omitempty"`
+	// PGStopTimeout is the max time to wait for postgres to stop. When
+	// expired the stop is considered failed and retried at the next keeper
+	// check.
+	PGStopTimeout *Duration `json:"pgStopTimeout,omitempty"`
+	// PGPromoteTimeout is the max time to wait for postgres to complete a
+	// promotion
+	PGPromoteTimeout *Duration `json:"pgPromoteTimeout,omitempty"`
 	// Map of postgres parameters
 	PGParameters PGParameters `json:"pgParameters,omitempty"`
+	// AllowUnsafeDurability permits disabling the fsync and
+	// full_page_writes postgres parameters. When false these parameters
+	// defined in pgParameters will be ignored.
+	AllowUnsafeDurability *bool `json:"allowUnsafeDurability,omitempty"`
+	// RequireChannelBinding makes the superuser and replication connections
+	// between the keepers (and the related pg_hba.conf entries) use
+	// scram-sha-256 authentication with the channel binding required. It
+	// requires ssl enabled and postgres 13 or later.
+	RequireChannelBinding *bool `json:"requireChannelBinding,omitempty"`
 	// Additional pg_hba.conf entries
 	// we don't set omitempty since we want to distinguish between null or empty slice
 	PGHBA []string `json:"pgHBA"`
+	// Additional structured pg_hba.conf entries, validated and added before
+	// the pgHBA ones
+	PGHBARules []HBARule `json:"pgHBARules,omitempty"`
+	// pg_ident.conf user name maps. When null pg_ident.conf isn't managed
+	// by the keepers.
+	// we don't set omitempty since we want to distinguish between null or empty slice
+	PGIdent []IdentMapping `json:"pgIdent"`
+	// MonitoringUser defines a role, granted pg_monitor, that the master
+	// keeper creates and maintains for the monitoring tools, with its
+	// pg_hba.conf entries on every keeper. Its password is read by the
+	// keepers from their --pg-monitoring-passwordfile.
+	MonitoringUser *MonitoringUser `json:"monitoringUser,omitempty"`
+	// Extensions are the extensions the master keeper creates (or updates
+	// to the defined version). Their shared preload libraries are added by
+	// every keeper to the shared_preload_libraries pg parameter and, when
+	// changed, the sentinel executes a rolling restart to load them. The
+	// extensions removed from the spec aren't dropped.
+	Extensions []Extension `json:"extensions,omitempty"`
 }
 
 type ClusterStatus struct {
@@ -290,6 +1862,297 @@ type ClusterStatus struct {
 	Phase             ClusterPhase `json:"phase,omitempty"`
 	// Master DB UID
 	Master string `json:"master,omitempty"`
+	// FailoverTargetKeeper is the keeper requested (i.e. by `stolonctl
+	// failover`) to become the new master. It's a one shot request cleared
+	// by the sentinel after acting.
+	FailoverTargetKeeper string `json:"failoverTargetKeeper,omitempty"`
+	// FailoverTargetForce requests to elect the FailoverTargetKeeper db also
+	// if its lag is greater than maxStandbyLag (i.e. requested by `stolonctl
+	// promote --force`)
+	FailoverTargetForce bool `json:"failoverTargetForce,omitempty"`
+	// AutomaticFailovers are the times of the last automatic failovers,
+	// recorded when failoverCooldown or maxFailovers are defined
+	AutomaticFailovers []time.Time `json:"automaticFailovers,omitempty"`
+	// FailoversHalted reports that the automatic failovers have been halted
+	// since maxFailovers has been reached. They're resumed with `stolonctl
+	// resumefailovers`.
+	FailoversHalted bool `json:"failoversHalted,omitempty"`
+	// SyncReplDegradation reports, with synchronous replication enabled and
+	// not enough healthy synchronous standbys, if the master writes are
+	// blocked or it has been degraded to asynchronous replication. When nil
+	// the master is in "sync" mode.
+	SyncReplDegradation *SyncReplDegradationStatus `json:"syncReplDegradation,omitempty"`
+	// Switchover is the switchover in progress (requested by `stolonctl
+	// switchover`). It's cleared by the sentinel when completed or aborted.
+	Switchover *Switchover `json:"switchover,omitempty"`
+	// UnsafeDurability reports that the cluster is running with some
+	// durability pg parameters (fsync, full_page_writes) disabled
+	UnsafeDurability bool `json:"unsafeDurability,omitempty"`
+	// DataChecksums reports if data checksums are enabled on the master db
+	DataChecksums bool `json:"dataChecksums,omitempty"`
+	// InitConfig is the configuration used to initialize the cluster. It's
+	// recorded once when the cluster initialization completes and never
+	// changed later.
+	InitConfig *InitConfig `json:"initConfig,omitempty"`
+	// Backup is the scheduled backup in progress
+	Backup *Backup `json:"backup,omitempty"`
+	// BackupHistory are the last completed or failed scheduled backups,
+	// the most recent last
+	BackupHistory []*Backup `json:"backupHistory,omitempty"`
+	// LastFencing is the result of the last fencing of a failed master
+	LastFencing *FencingResult `json:"lastFencing,omitempty"`
+	// RollingRestart is the rolling restart in progress (requested by
+	// `stolonctl restart --rolling`) or the last one completed or
+	// aborted
+	RollingRestart *RollingRestart `json:"rollingRestart,omitempty"`
+	// PGUpgrade is the postgres major version upgrade in progress
+	// (requested by `stolonctl pgupgrade`) or the last one completed or
+	// aborted
+	PGUpgrade *PGUpgrade `json:"pgUpgrade,omitempty"`
+	// CredentialsRotation is the superuser and replication passwords
+	// rotation in progress (requested by `stolonctl rotatecredentials`) or
+	// the last one completed
+	CredentialsRotation *CredentialsRotation `json:"credentialsRotation,omitempty"`
+}
+
+type RollingRestartPhase string
+
+const (
+	// The rolling restart has been requested
+	RollingRestartPhaseRequested RollingRestartPhase = "requested"
+	// The standbys are restarted one at a time
+	RollingRestartPhaseStandbys RollingRestartPhase = "restartingStandbys"
+	// The master role is being switched over to a restarted standby
+	RollingRestartPhaseSwitchover RollingRestartPhase = "switchingOver"
+	// The old master is being restarted
+	RollingRestartPhaseOldMaster RollingRestartPhase = "restartingOldMaster"
+	// The rolling restart has completed
+	RollingRestartPhaseCompleted RollingRestartPhase = "completed"
+	// The rolling restart has been aborted
+	RollingRestartPhaseAborted RollingRestartPhase = "aborted"
+)
+
+// RollingRestart is a restart of the postgres instances of all the keepers,
+// coordinated by the sentinel: the standbys are restarted one at a time, then
+// the master role is switched over to a restarted standby and then the old
+// master is restarted.
+type RollingRestart struct {
+	Phase     RollingRestartPhase `json:"phase,omitempty"`
+	StartTime time.Time           `json:"startTime,omitempty"`
+	EndTime   time.Time           `json:"endTime,omitempty"`
+	// MasterKeeper is the keeper of the master db when the rolling restart
+	// started
+	MasterKeeper string `json:"masterKeeper,omitempty"`
+	// RestartingKeeper is the keeper whose db restart has been requested
+	// and isn't completed
+	RestartingKeeper string `json:"restartingKeeper,omitempty"`
+	// RestartedKeepers are the keepers whose db has been restarted
+	RestartedKeepers []string `json:"restartedKeepers,omitempty"`
+	// Reason is why the rolling restart has been aborted
+	Reason string `json:"reason,omitempty"`
+	// SharedPreloadLibraries are, when the rolling restart has been
+	// requested by the sentinel to load the shared preload libraries of the
+	// cluster spec extensions, the libraries to load
+	SharedPreloadLibraries []string `json:"sharedPreloadLibraries,omitempty"`
+}
+
+// InProgress reports if the rolling restart hasn't completed or been aborted
+func (r *RollingRestart) InProgress() bool {
+	return r != nil && r.Phase != RollingRestartPhaseCompleted && r.Phase != RollingRestartPhaseAborted
+}
+
+type PGUpgradePhase string
+
+const (
+	// The postgres major version upgrade has been requested
+	PGUpgradePhaseRequested PGUpgradePhase = "requested"
+	// The master keeper is upgrading its data dir with pg_upgrade
+	PGUpgradePhaseMaster PGUpgradePhase = "upgradingMaster"
+	// The postgres major version upgrade has completed
+	PGUpgradePhaseCompleted PGUpgradePhase = "completed"
+	// The postgres major version upgrade has been aborted
+	PGUpgradePhaseAborted PGUpgradePhase = "aborted"
+)
+
+// PGUpgrade is an upgrade of the cluster to a new postgres major version,
+// coordinated by the sentinel: the cluster enters the upgrade phase, the
+// master keeper switches to the new binaries upgrading its data dir with
+// pg_upgrade in link mode and then the standbys are replaced by new dbs
+// resynced from the upgraded master.
+type PGUpgrade struct {
+	Phase     PGUpgradePhase `json:"phase,omitempty"`
+	StartTime time.Time      `json:"startTime,omitempty"`
+	EndTime   time.Time      `json:"endTime,omitempty"`
+	// PGBinPath is the path, on all the keepers, of the postgres binaries
+	// of the new major version
+	PGBinPath string `json:"pgBinPath,omitempty"`
+	// MasterKeeper is the keeper of the master db when the upgrade started
+	MasterKeeper string `json:"masterKeeper,omitempty"`
+	// MasterKeeperPGBinPath is the master keeper spec pgBinPath before
+	// the upgrade, restored when the upgrade is aborted
+	MasterKeeperPGBinPath string `json:"masterKeeperPGBinPath,omitempty"`
+	// Reason is why the upgrade has been aborted
+	Reason string `json:"reason,omitempty"`
+}
+
+// InProgress reports if the upgrade hasn't completed or been aborted
+func (u *PGUpgrade) InProgress() bool {
+	return u != nil && u.Phase != PGUpgradePhaseCompleted && u.Phase != PGUpgradePhaseAborted
+}
+
+type CredentialsRotationPhase string
+
+const (
+	// The master keeper changes the roles passwords and starts using them
+	CredentialsRotationPhaseMaster CredentialsRotationPhase = "master"
+	// The standby keepers start using the new passwords
+	CredentialsRotationPhaseStandbys CredentialsRotationPhase = "standbys"
+	// The credentials rotation has completed
+	CredentialsRotationPhaseCompleted CredentialsRotationPhase = "completed"
+)
+
+// CredentialsRotation is a rotation of the superuser and replication
+// passwords coordinated by stolonctl: the keepers, started with
+// --coordinated-password-rotation, read the new passwords from their secret
+// source but keep using the current ones until the master keeper has changed
+// the roles passwords. Then the standby keepers start using them.
+type CredentialsRotation struct {
+	UID   string                   `json:"uid,omitempty"`
+	Phase CredentialsRotationPhase `json:"phase,omitempty"`
+	// Fingerprint identifies the new passwords, it's the pending passwords
+	// fingerprint reported by all the keepers
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	StartTime   time.Time `json:"startTime,omitempty"`
+	EndTime     time.Time `json:"endTime,omitempty"`
+}
+
+// InProgress reports if the credentials rotation hasn't completed
+func (r *CredentialsRotation) InProgress() bool {
+	return r != nil && r.Phase != CredentialsRotationPhaseCompleted
+}
+
+// KeeperPasswordsStatus reports, for a keeper started with
+// --coordinated-password-rotation, the state of its passwords rotation
+type KeeperPasswordsStatus struct {
+	// PendingFingerprint identifies the new passwords read from the keeper
+	// secret source and not yet used. It's an hmac of the new passwords
+	// keyed by the current ones, so it's the same on all the keepers using
+	// the same passwords. Empty when there're no pending passwords.
+	PendingFingerprint string `json:"pendingFingerprint,omitempty"`
+	// AppliedRotation is the uid of the last credentials rotation whose
+	// passwords are used by the keeper
+	AppliedRotation string `json:"appliedRotation,omitempty"`
+}
+
+// FencingResult reports the result of the fencing of a failed master
+type FencingResult struct {
+	// The fenced master db and its keeper
+	DBUID     string    `json:"dbUID,omitempty"`
+	KeeperUID string    `json:"keeperUID,omitempty"`
+	Time      time.Time `json:"time,omitempty"`
+	Success   bool      `json:"success,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type SwitchoverPhase string
+
+const (
+	// The switchover has been requested, the proxies will be paused
+	SwitchoverPhaseRequested SwitchoverPhase = "requested"
+	// The proxies have been paused, waiting for them to close the
+	// connections to the master
+	SwitchoverPhasePausingProxies SwitchoverPhase = "pausingProxies"
+	// The proxies are paused, waiting for the target standby to catch up
+	// with the master
+	SwitchoverPhaseCatchingUp SwitchoverPhase = "catchingUp"
+	// The target standby has caught up, waiting for the master keeper to
+	// drain the master and for the target standby to receive the final
+	// master wal (see the cluster spec gracefulDemotion)
+	SwitchoverPhaseDemotingMaster SwitchoverPhase = "demotingMaster"
+)
+
+// Switchover is a coordinated master switch to a standby: the sentinel pauses
+// the proxies, waits for the target standby to catch up with the master and
+// then elects it as the new master. The proxies are resumed, like after a
+// failover, when the new master is ready.
+type Switchover struct {
+	TargetKeeper string          `json:"targetKeeper,omitempty"`
+	Phase        SwitchoverPhase `json:"phase,omitempty"`
+	StartTime    time.Time       `json:"startTime,omitempty"`
+}
+
+// GracefulDemotion defines how the master keeper drains the master before a
+// switchover: it optionally rejects the new client connections, waits for
+// the active transactions up to the drain timeout, terminates the remaining
+// client connections, issues a checkpoint and waits for the switchover target
+// standby to flush the final master wal position.
+type GracefulDemotion struct {
+	// RejectConnections makes the master keeper accept, while draining, only
+	// the connections of the stolon superuser and replication users
+	RejectConnections bool `json:"rejectConnections,omitempty"`
+	// DrainTimeout is the max time to wait for the active transactions to
+	// complete. If not defined 30s is used.
+	DrainTimeout *Duration `json:"drainTimeout,omitempty"`
+}
+
+// DefDrainTimeout returns the drain timeout or the default one
+func (g *GracefulDemotion) DefDrainTimeout() time.Duration {
+	if g.DrainTimeout == nil {
+		return DefaultDemotionDrainTimeout
+	}
+	return g.DrainTimeout.Duration
+}
+
+// GracefulDemotionRequest is the master db drain requested by the sentinel
+// to the master keeper during a switchover
+type GracefulDemotionRequest struct {
+	// TargetDBUID is the switchover target db
+	TargetDBUID       string   `json:"targetDBUID,omitempty"`
+	RejectConnections bool     `json:"rejectConnections,omitempty"`
+	DrainTimeout      Duration `json:"drainTimeout,omitempty"`
+}
+
+// GracefulDemotionStatus is the status of the master db drain done by the
+// master keeper
+type GracefulDemotionStatus struct {
+	DBUID       string    `json:"dbUID,omitempty"`
+	TargetDBUID string    `json:"targetDBUID,omitempty"`
+	StartTime   time.Time `json:"startTime,omitempty"`
+	// TerminatedBackends is the number of client connections terminated
+	// after the drain
+	TerminatedBackends int `json:"terminatedBackends,omitempty"`
+	// LSN is the master wal position, after the final checkpoint, that the
+	// target standby must flush
+	LSN uint64 `json:"lsn,omitempty"`
+	// Completed reports that the target standby has flushed the final wal
+	// position
+	Completed bool   `json:"completed,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// InitConfig records how the cluster has been initialized
+type InitConfig struct {
+	InitMode          ClusterInitMode `json:"initMode,omitempty"`
+	Role              ClusterRole     `json:"role,omitempty"`
+	MergePgParameters bool            `json:"mergePgParameters,omitempty"`
+	NewConfig         *NewConfig      `json:"newConfig,omitempty"`
+	PITRConfig        *PITRConfig     `json:"pitrConfig,omitempty"`
+	ExistingConfig    *ExistingConfig `json:"existingConfig,omitempty"`
+	StandbyConfig     *StandbyConfig  `json:"standbyConfig,omitempty"`
+	// The initial master db and its keeper
+	DBUID     string `json:"dbUID,omitempty"`
+	KeeperUID string `json:"keeperUID,omitempty"`
+	// The postgres binary version of the keeper that initialized the db
+	PostgresBinaryVersion PostgresBinaryVersion `json:"postgresBinaryVersion,omitempty"`
+	// PGParameters are the postgres parameters of the initialized db. When
+	// mergePgParameters is true they're the ones reported by the db,
+	// otherwise the ones defined in the cluster spec.
+	PGParameters PGParameters `json:"pgParameters,omitempty"`
+	InitTime     time.Time    `json:"initTime,omitempty"`
+	// PostInitHookResult is the result of the post init hook executed when
+	// initializing the initial master db. Once recorded the hook is never
+	// executed again.
+	PostInitHookResult *PostInitHookResult `json:"postInitHookResult,omitempty"`
 }
 
 type Cluster struct {
@@ -330,6 +2193,18 @@ func (c *Cluster) DefSpec() *ClusterSpec {
 	return c.Spec.WithDefaults()
 }
 
+// SyncReplMode returns the master synchronous replication mode, empty when
+// synchronous replication is disabled
+func (c *Cluster) SyncReplMode() SyncReplMode {
+	if c.Spec == nil || !*c.DefSpec().SynchronousReplication {
+		return ""
+	}
+	if c.Status.SyncReplDegradation == nil {
+		return SyncReplModeSync
+	}
+	return c.Status.SyncReplDegradation.Mode
+}
+
 // WithDefaults returns a new ClusterSpec with unspecified values populated with
 // their defaults
 func (os *ClusterSpec) WithDefaults() *ClusterSpec {
@@ -362,21 +2237,63 @@ func (os *ClusterSpec) WithDefaults() *ClusterSpec {
 	if s.MaxStandbysPerSender == nil {
 		s.MaxStandbysPerSender = Uint16P(DefaultMaxStandbysPerSender)
 	}
+	if s.FailoverCooldown == nil {
+		s.FailoverCooldown = &Duration{Duration: DefaultFailoverCooldown}
+	}
+	if s.MaxFailovers == nil {
+		s.MaxFailovers = Uint16P(DefaultMaxFailovers)
+	}
+	if s.MaxFailoversWindow == nil {
+		s.MaxFailoversWindow = &Duration{Duration: DefaultMaxFailoversWindow}
+	}
+	if s.SentinelDryRun == nil {
+		s.SentinelDryRun = BoolP(DefaultSentinelDryRun)
+	}
 	if s.MaxStandbyLag == nil {
 		s.MaxStandbyLag = Uint32P(DefaultMaxStandbyLag)
 	}
+	if s.MaxReadyStandbyLag == nil {
+		s.MaxReadyStandbyLag = Uint32P(DefaultMaxReadyStandbyLag)
+	}
+	if s.MaxStandbyReplayLag == nil {
+		s.MaxStandbyReplayLag = Uint32P(DefaultMaxStandbyReplayLag)
+	}
+	if s.MaxStandbyReplayDelay == nil {
+		s.MaxStandbyReplayDelay = &Duration{Duration: DefaultMaxStandbyReplayDelay}
+	}
 	if s.SynchronousReplication == nil {
 		s.SynchronousReplication = BoolP(DefaultSynchronousReplication)
 	}
 	if s.UsePgrewind == nil {
 		s.UsePgrewind = BoolP(DefaultUsePgrewind)
 	}
+	if s.VerifyResync == nil {
+		s.VerifyResync = BoolP(DefaultVerifyResync)
+	}
+	if s.AllowUnsafeDurability == nil {
+		s.AllowUnsafeDurability = BoolP(DefaultAllowUnsafeDurability)
+	}
+	if s.AllowDelayedStandbyPromotion == nil {
+		s.AllowDelayedStandbyPromotion = BoolP(DefaultAllowDelayedPromotion)
+	}
+	if s.RequireChannelBinding == nil {
+		s.RequireChannelBinding = BoolP(DefaultRequireChannelBinding)
+	}
 	if s.MinSynchronousStandbys == nil {
 		s.MinSynchronousStandbys = Uint16P(DefaultMinSynchronousStandbys)
 	}
 	if s.MaxSynchronousStandbys == nil {
 		s.MaxSynchronousStandbys = Uint16P(DefaultMaxSynchronousStandbys)
 	}
+	if s.SynchronousReplicationMethod == nil {
+		s.SynchronousReplicationMethod = SynchronousReplicationMethodP(DefaultSynchronousReplicationMethod)
+	}
+	if s.SyncStandbySelection == nil {
+		s.SyncStandbySelection = SyncStandbySelectionP(DefaultSyncStandbySelection)
+	}
+	if s.SyncStandbyMaxReplayLag == nil {
+		s.SyncStandbyMaxReplayLag = Uint32P(DefaultSyncStandbyMaxReplayLag)
+	}
 	if s.AdditionalWalSenders == nil {
 		s.AdditionalWalSenders = Uint16P(DefaultAdditionalWalSenders)
 	}
@@ -387,10 +2304,67 @@ func (os *ClusterSpec) WithDefaults() *ClusterSpec {
 		v := DefaultSUReplAccess
 		s.DefaultSUReplAccessMode = &v
 	}
+	if s.DBProbeMode == nil {
+		s.DBProbeMode = DBProbeModeP(DefaultDBProbeMode)
+	}
+	if s.DBProbeTimeout == nil {
+		s.DBProbeTimeout = &Duration{Duration: DefaultDBProbeTimeout}
+	}
+	if s.PreferredAddressFamily == nil {
+		s.PreferredAddressFamily = AddressFamilyP(DefaultPreferredAddressFamily)
+	}
+	if s.FailoverQuorum == nil {
+		s.FailoverQuorum = Uint16P(DefaultFailoverQuorum)
+	}
+	if s.PrePromotionHookTimeout == nil {
+		s.PrePromotionHookTimeout = &Duration{Duration: DefaultPrePromotionHookTimeout}
+	}
+	if s.StandbyAutoPromote == nil {
+		s.StandbyAutoPromote = BoolP(DefaultStandbyAutoPromote)
+	}
+	if s.StandbyAutoPromoteTimeout == nil {
+		s.StandbyAutoPromoteTimeout = &Duration{Duration: DefaultStandbyAutoPromoteTimeout}
+	}
+	if s.FencingTimeout == nil {
+		s.FencingTimeout = &Duration{Duration: DefaultFencingTimeout}
+	}
+	if s.FencingPolicy == nil {
+		s.FencingPolicy = FencingPolicyP(DefaultFencingPolicy)
+	}
+	if s.MasterElectionStrategy == nil {
+		s.MasterElectionStrategy = MasterElectionStrategyP(DefaultMasterElectionStrategy)
+	}
+	if s.MasterElectionTimeout == nil {
+		s.MasterElectionTimeout = &Duration{Duration: DefaultMasterElectionTimeout}
+	}
+	if s.SwitchoverTimeout == nil {
+		s.SwitchoverTimeout = &Duration{Duration: DefaultSwitchoverTimeout}
+	}
+	if s.PGStopMode == nil {
+		s.PGStopMode = PGStopModeP(DefaultPGStopMode)
+	}
+	if s.PGStopTimeout == nil {
+		s.PGStopTimeout = &Duration{Duration: DefaultPGStopTimeout}
+	}
+	if s.PGPromoteTimeout == nil {
+		s.PGPromoteTimeout = &Duration{Duration: DefaultPGPromoteTimeout}
+	}
+	if s.BackupConfig != nil && s.BackupConfig.Timeout == nil {
+		s.BackupConfig.Timeout = &Duration{Duration: DefaultBackupTimeout}
+	}
+	if s.ChecksumsVerificationConfig != nil && s.ChecksumsVerificationConfig.Timeout == nil {
+		s.ChecksumsVerificationConfig.Timeout = &Duration{Duration: DefaultChecksumsVerificationTimeout}
+	}
 	if s.Role == nil {
 		v := DefaultRole
 		s.Role = &v
 	}
+	if s.WalRetentionStrategy == nil {
+		s.WalRetentionStrategy = WalRetentionStrategyP(DefaultWalRetentionStrategy)
+	}
+	if s.ResyncMethod == nil {
+		s.ResyncMethod = ResyncMethodP(DefaultResyncMethod)
+	}
 	return s
 }
 
@@ -424,6 +2398,15 @@ func (os *ClusterSpec) Validate() error {
 	if *s.MaxStandbysPerSender < 1 {
 		return fmt.Errorf("maxStandbysPerSender must be at least 1")
 	}
+	if s.FailoverCooldown.Duration < 0 {
+		return fmt.Errorf("failoverCooldown must be positive")
+	}
+	if s.MaxStandbyReplayDelay.Duration < 0 {
+		return fmt.Errorf("maxStandbyReplayDelay must be greater or equal to 0")
+	}
+	if s.MaxFailoversWindow.Duration <= 0 {
+		return fmt.Errorf("maxFailoversWindow must be greater than 0")
+	}
 	if *s.MinSynchronousStandbys < 1 {
 		return fmt.Errorf("minSynchronousStandbys must be at least 1")
 	}
@@ -433,6 +2416,38 @@ func (os *ClusterSpec) Validate() error {
 	if *s.MaxSynchronousStandbys < *s.MinSynchronousStandbys {
 		return fmt.Errorf("maxSynchronousStandbys must be greater or equal to minSynchronousStandbys")
 	}
+	switch *s.SynchronousReplicationMethod {
+	case SynchronousReplicationMethodFirst:
+	case SynchronousReplicationMethodAny:
+	default:
+		return fmt.Errorf("unknown synchronousReplicationMethod: %q", *s.SynchronousReplicationMethod)
+	}
+	switch *s.SyncStandbySelection {
+	case SyncStandbySelectionAny:
+	case SyncStandbySelectionLag:
+		if *s.SyncStandbyMaxReplayLag == 0 {
+			return fmt.Errorf("syncStandbyMaxReplayLag must be greater than 0")
+		}
+	default:
+		return fmt.Errorf("unknown syncStandbySelection: %q", *s.SyncStandbySelection)
+	}
+	if s.SynchronousCommit != nil {
+		switch *s.SynchronousCommit {
+		case SynchronousCommitOn:
+		case SynchronousCommitRemoteWrite, SynchronousCommitRemoteApply:
+			if !*s.SynchronousReplication {
+				return fmt.Errorf("synchronousCommit %q requires synchronousReplication", *s.SynchronousCommit)
+			}
+		default:
+			return fmt.Errorf("unknown synchronousCommit: %q", *s.SynchronousCommit)
+		}
+		if _, ok := s.PGParameters["synchronous_commit"]; ok {
+			return fmt.Errorf("synchronousCommit and the synchronous_commit pgParameter are mutually exclusive")
+		}
+	}
+	if err := validateStandbyConflicts(s.StandbyConflicts); err != nil {
+		return err
+	}
 	if s.InitMode == nil {
 		return fmt.Errorf("initMode undefined")
 	}
@@ -441,6 +2456,54 @@ func (os *ClusterSpec) Validate() error {
 			return err
 		}
 	}
+	if err := validatePublications(s.Publications); err != nil {
+		return err
+	}
+	if err := validateLogicalReplicationSlots(s.LogicalReplicationSlots, s.AdditionalMasterReplicationSlots); err != nil {
+		return err
+	}
+	if err := validateWalRetention(*s.WalRetentionStrategy, s.PGParameters); err != nil {
+		return err
+	}
+	if err := validateBasebackupConfig(s.BasebackupConfig); err != nil {
+		return err
+	}
+	if err := validateWalRetentionLimits(s.WalRetentionLimits); err != nil {
+		return err
+	}
+	if err := validateAutomaticResync(s.AutomaticResync); err != nil {
+		return err
+	}
+	if err := validateResyncScheduling(s.ResyncScheduling); err != nil {
+		return err
+	}
+	if err := validateSyncReplDegradation(s.SyncReplDegradation); err != nil {
+		return err
+	}
+	switch *s.ResyncMethod {
+	case ResyncMethodBasebackup:
+	case ResyncMethodPgBackRest:
+		if s.PgBackRestConfig == nil || s.PgBackRestConfig.Stanza == "" {
+			return fmt.Errorf("pgBackRestConfig.stanza must be defined when resyncMethod is %q", ResyncMethodPgBackRest)
+		}
+	case ResyncMethodWalG:
+	default:
+		return fmt.Errorf("unknown resyncMethod: %q", *s.ResyncMethod)
+	}
+	if err := validateResyncStrategies(s.ResyncStrategies, *s.UsePgrewind, s.PgBackRestConfig); err != nil {
+		return err
+	}
+	if err := validateBackupConfig(s.BackupConfig, s.PgBackRestConfig); err != nil {
+		return err
+	}
+	if c := s.ChecksumsVerificationConfig; c != nil {
+		if c.Interval == nil || c.Interval.Duration <= 0 {
+			return fmt.Errorf("checksumsVerificationConfig.interval must be greater than 0")
+		}
+		if c.Timeout.Duration <= 0 {
+			return fmt.Errorf("checksumsVerificationConfig.timeout must be greater than 0")
+		}
+	}
 
 	// The unique validation we're doing on pgHBA entries is that they don't contain a newline character
 	for _, e := range s.PGHBA {
@@ -448,12 +2511,52 @@ func (os *ClusterSpec) Validate() error {
 			return fmt.Errorf("pgHBA entries cannot contain newline characters")
 		}
 	}
+	for i, r := range s.PGHBARules {
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("wrong pgHBARules entry #%d: %v", i, err)
+		}
+	}
+	for i, m := range s.PGIdent {
+		if err := m.Validate(); err != nil {
+			return fmt.Errorf("wrong pgIdent entry #%d: %v", i, err)
+		}
+	}
+	if s.MonitoringUser != nil {
+		if err := s.MonitoringUser.Validate(); err != nil {
+			return fmt.Errorf("wrong monitoringUser: %v", err)
+		}
+	}
+	extensions := map[string]struct{}{}
+	for i, e := range s.Extensions {
+		if err := e.Validate(); err != nil {
+			return fmt.Errorf("wrong extensions entry #%d: %v", i, err)
+		}
+		if _, ok := extensions[e.Name]; ok {
+			return fmt.Errorf("duplicate extension %q", e.Name)
+		}
+		extensions[e.Name] = struct{}{}
+	}
+
+	// channel binding is only available over ssl connections
+	if *s.RequireChannelBinding && s.PGParameters["ssl"] != "on" {
+		return fmt.Errorf("requireChannelBinding requires ssl enabled (pgParameters ssl must be \"on\")")
+	}
 
 	switch *s.InitMode {
 	case ClusterInitModeNew:
 		if *s.Role == ClusterRoleStandby {
 			return fmt.Errorf("invalid cluster role standby when initMode is \"new\"")
 		}
+		if s.NewConfig != nil {
+			if s.NewConfig.WalDir != "" && !filepath.IsAbs(s.NewConfig.WalDir) {
+				return fmt.Errorf("newConfig walDir must be an absolute path")
+			}
+			for i, stmt := range s.NewConfig.PostInitSQL {
+				if strings.TrimSpace(stmt) == "" {
+					return fmt.Errorf("newConfig postInitSQL entry #%d is empty", i)
+				}
+			}
+		}
 	case ClusterInitModeExisting:
 		if s.ExistingConfig == nil {
 			return fmt.Errorf("existingConfig undefined. Required when initMode is \"existing\"")
@@ -482,6 +2585,81 @@ func (os *ClusterSpec) Validate() error {
 	default:
 		return fmt.Errorf("unknown defaultSUReplAccessMode: %q", *s.DefaultSUReplAccessMode)
 	}
+	switch *s.DBProbeMode {
+	case DBProbeModeNone:
+	case DBProbeModeAdvisory:
+	case DBProbeModeEnforce:
+	default:
+		return fmt.Errorf("unknown dbProbeMode: %q", *s.DBProbeMode)
+	}
+	switch *s.PreferredAddressFamily {
+	case AddressFamilyAny:
+	case AddressFamilyIPv4:
+	case AddressFamilyIPv6:
+	default:
+		return fmt.Errorf("unknown preferredAddressFamily: %q", *s.PreferredAddressFamily)
+	}
+	if s.DBProbeTimeout.Duration <= 0 {
+		return fmt.Errorf("dbProbeTimeout must be greater than 0")
+	}
+	if err := s.MasterPreferredTags.Validate(); err != nil {
+		return fmt.Errorf("wrong masterPreferredTags: %v", err)
+	}
+	if err := validateCascadingStandbys(s.CascadingStandbys); err != nil {
+		return fmt.Errorf("wrong cascadingStandbys: %v", err)
+	}
+	if s.PrePromotionHookTimeout.Duration <= 0 {
+		return fmt.Errorf("prePromotionHookTimeout must be greater than 0")
+	}
+	if s.StandbyAutoPromoteTimeout.Duration <= 0 {
+		return fmt.Errorf("standbyAutoPromoteTimeout must be greater than 0")
+	}
+	if s.FencingTimeout.Duration <= 0 {
+		return fmt.Errorf("fencingTimeout must be greater than 0")
+	}
+	switch *s.FencingPolicy {
+	case FencingPolicyFailClosed:
+	case FencingPolicyFailOpen:
+	default:
+		return fmt.Errorf("unknown fencingPolicy: %q", *s.FencingPolicy)
+	}
+	if s.FencingURL != nil && *s.FencingURL != "" {
+		if u, err := url.Parse(*s.FencingURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("fencingURL must be an http or https url")
+		}
+	}
+	if s.SwitchoverTimeout.Duration <= 0 {
+		return fmt.Errorf("switchoverTimeout must be greater than 0")
+	}
+	if err := validateGracefulDemotion(s.GracefulDemotion, s.SwitchoverTimeout.Duration); err != nil {
+		return err
+	}
+	switch *s.PGStopMode {
+	case PGStopModeSmart:
+	case PGStopModeFast:
+	case PGStopModeImmediate:
+	default:
+		return fmt.Errorf("unknown pgStopMode: %q", *s.PGStopMode)
+	}
+	if s.PGStopTimeout.Duration <= 0 {
+		return fmt.Errorf("pgStopTimeout must be greater than 0")
+	}
+	if s.PGPromoteTimeout.Duration <= 0 {
+		return fmt.Errorf("pgPromoteTimeout must be greater than 0")
+	}
+	if s.MasterAntiAffinityTag != nil {
+		if err := (Tags{*s.MasterAntiAffinityTag: ""}).Validate(); err != nil {
+			return fmt.Errorf("wrong masterAntiAffinityTag: %v", err)
+		}
+	}
+	if s.FailureDomainTag != nil {
+		if err := (Tags{*s.FailureDomainTag: ""}).Validate(); err != nil {
+			return fmt.Errorf("wrong failureDomainTag: %v", err)
+		}
+	}
+	if err := validateMasterElection(*s.MasterElectionStrategy, s.MasterElectionCommand, s.MasterElectionURL, s.MasterElectionTimeout); err != nil {
+		return err
+	}
 
 	switch *s.Role {
 	case ClusterRoleMaster:
@@ -489,12 +2667,58 @@ func (os *ClusterSpec) Validate() error {
 		if s.StandbyConfig == nil {
 			return fmt.Errorf("standbyConfig undefined. Required when cluster role is \"standby\"")
 		}
+		if *s.StandbyAutoPromote && (s.StandbyConfig.StandbySettings == nil || s.StandbyConfig.StandbySettings.PrimaryConninfo == "") {
+			return fmt.Errorf("standbyAutoPromote requires the standbyConfig standbySettings primaryConninfo")
+		}
 	default:
 		return fmt.Errorf("unknown role: %q", *s.InitMode)
 	}
 	return nil
 }
 
+// validateCascadingStandbys checks that the cascading standbys don't follow
+// themselves, directly or through other standbys
+func validateCascadingStandbys(cascadingStandbys map[string]string) error {
+	keeperUIDs := make([]string, 0, len(cascadingStandbys))
+	for keeperUID := range cascadingStandbys {
+		keeperUIDs = append(keeperUIDs, keeperUID)
+	}
+	sort.Strings(keeperUIDs)
+	for _, keeperUID := range keeperUIDs {
+		followedKeeperUID := cascadingStandbys[keeperUID]
+		if keeperUID == "" || followedKeeperUID == "" {
+			return fmt.Errorf("empty keeper uid")
+		}
+		visited := map[string]struct{}{keeperUID: {}}
+		for cur, ok := followedKeeperUID, true; ok; cur, ok = cascadingStandbys[cur] {
+			if _, found := visited[cur]; found {
+				return fmt.Errorf("keeper %q follows itself", keeperUID)
+			}
+			visited[cur] = struct{}{}
+		}
+	}
+	return nil
+}
+
+func validateWalRetention(strategy WalRetentionStrategy, pgParameters PGParameters) error {
+	switch strategy {
+	case WalRetentionStrategySlots:
+	case WalRetentionStrategyWalKeep:
+	case WalRetentionStrategyBoth:
+	default:
+		return fmt.Errorf("unknown walRetentionStrategy: %q", strategy)
+	}
+	_, segmentsOK := pgParameters["wal_keep_segments"]
+	_, sizeOK := pgParameters["wal_keep_size"]
+	if segmentsOK && sizeOK {
+		return fmt.Errorf("only one of the wal_keep_segments and wal_keep_size pgParameters can be defined")
+	}
+	if (segmentsOK || sizeOK) && !strategy.UseWalKeep() {
+		return fmt.Errorf("the wal_keep_segments and wal_keep_size pgParameters cannot be defined when walRetentionStrategy is %q", strategy)
+	}
+	return nil
+}
+
 func validateReplicationSlot(replicationSlot string) error {
 	if !util.IsValidReplSlotName(replicationSlot) {
 		return fmt.Errorf("wrong replication slot name: %q", replicationSlot)
@@ -505,6 +2729,341 @@ func validateReplicationSlot(replicationSlot string) error {
 	return nil
 }
 
+var basebackupMaxRateRegexp = regexp.MustCompile(`^([0-9]+)([kM]?)$`)
+
+// ParseMaxRate parses a max transfer rate, in the pg_basebackup max rate
+// format, returning it in kilobytes per second
+func ParseMaxRate(maxRate string) (uint64, error) {
+	m := basebackupMaxRateRegexp.FindStringSubmatch(maxRate)
+	if m == nil {
+		return 0, fmt.Errorf("wrong max rate %q", maxRate)
+	}
+	rate, err := strconv.ParseUint(m[1], 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	if m[2] == "M" {
+		rate *= 1024
+	}
+	return rate, nil
+}
+
+func validateMaxRate(name, maxRate string) error {
+	if !basebackupMaxRateRegexp.MatchString(maxRate) {
+		return fmt.Errorf("wrong %s %q", name, maxRate)
+	}
+	rate, err := ParseMaxRate(maxRate)
+	if err != nil {
+		return fmt.Errorf("wrong %s %q: %v", name, maxRate, err)
+	}
+	// pg_basebackup accepted range
+	if rate < 32 || rate > 1024*1024 {
+		return fmt.Errorf("%s must be between 32k and 1024M", name)
+	}
+	return nil
+}
+
+func validateResyncStrategies(strategies []ResyncStrategy, usePgrewind bool, pgBackRestConfig *PgBackRestConfig) error {
+	types := map[ResyncStrategyType]struct{}{}
+	for i, rs := range strategies {
+		switch rs.Type {
+		case ResyncStrategyPgRewind:
+			if i != 0 {
+				return fmt.Errorf("wrong resyncStrategies entry #%d: %q must be the first strategy", i, rs.Type)
+			}
+			if !usePgrewind {
+				return fmt.Errorf("wrong resyncStrategies entry #%d: %q requires usePgrewind", i, rs.Type)
+			}
+		case ResyncStrategyPgBackRest:
+			if pgBackRestConfig == nil || pgBackRestConfig.Stanza == "" {
+				return fmt.Errorf("wrong resyncStrategies entry #%d: pgBackRestConfig.stanza must be defined", i)
+			}
+		case ResyncStrategyWalG:
+		case ResyncStrategyCommand:
+		case ResyncStrategyBasebackup:
+		case ResyncStrategyRsync:
+		default:
+			return fmt.Errorf("wrong resyncStrategies entry #%d: unknown type %q", i, rs.Type)
+		}
+		if rs.Type == ResyncStrategyCommand && rs.Command == "" {
+			return fmt.Errorf("wrong resyncStrategies entry #%d: command must be defined", i)
+		}
+		if rs.Type != ResyncStrategyCommand && rs.Command != "" {
+			return fmt.Errorf("wrong resyncStrategies entry #%d: command can be defined only with type %q", i, ResyncStrategyCommand)
+		}
+		if rs.Type == ResyncStrategyRsync && rs.RsyncSource == "" {
+			return fmt.Errorf("wrong resyncStrategies entry #%d: rsyncSource must be defined", i)
+		}
+		if rs.Type != ResyncStrategyRsync && rs.RsyncSource != "" {
+			return fmt.Errorf("wrong resyncStrategies entry #%d: rsyncSource can be defined only with type %q", i, ResyncStrategyRsync)
+		}
+		if rs.Timeout != nil && rs.Timeout.Duration < 0 {
+			return fmt.Errorf("wrong resyncStrategies entry #%d: timeout must be positive", i)
+		}
+		if _, ok := types[rs.Type]; ok {
+			return fmt.Errorf("wrong resyncStrategies entry #%d: duplicated type %q", i, rs.Type)
+		}
+		types[rs.Type] = struct{}{}
+	}
+	return nil
+}
+
+func validateBackupConfig(c *BackupConfig, pgBackRestConfig *PgBackRestConfig) error {
+	if c == nil {
+		return nil
+	}
+	switch c.Method {
+	case BackupMethodPgBackRest:
+		if pgBackRestConfig == nil || pgBackRestConfig.Stanza == "" {
+			return fmt.Errorf("pgBackRestConfig.stanza must be defined when backupConfig.method is %q", BackupMethodPgBackRest)
+		}
+	case BackupMethodWalG:
+	case BackupMethodCommand:
+		if c.Command == "" {
+			return fmt.Errorf("backupConfig.command must be defined when backupConfig.method is %q", BackupMethodCommand)
+		}
+	case "":
+		return fmt.Errorf("backupConfig.method must be defined")
+	default:
+		return fmt.Errorf("unknown backupConfig.method: %q", c.Method)
+	}
+	if c.Method != BackupMethodCommand && c.Command != "" {
+		return fmt.Errorf("backupConfig.command can be defined only when backupConfig.method is %q", BackupMethodCommand)
+	}
+	if c.Interval == nil || c.Interval.Duration <= 0 {
+		return fmt.Errorf("backupConfig.interval must be greater than 0")
+	}
+	if c.Timeout != nil && c.Timeout.Duration <= 0 {
+		return fmt.Errorf("backupConfig.timeout must be greater than 0")
+	}
+	return nil
+}
+
+func validateMasterElection(strategy MasterElectionStrategy, command, electionURL *string, timeout *Duration) error {
+	hasCommand := command != nil && *command != ""
+	hasURL := electionURL != nil && *electionURL != ""
+	switch strategy {
+	case MasterElectionStrategyPriority:
+	case MasterElectionStrategyMaxLSN:
+	case MasterElectionStrategyZoneAware:
+	case MasterElectionStrategyCommand:
+		if !hasCommand {
+			return fmt.Errorf("masterElectionCommand must be defined when masterElectionStrategy is %q", MasterElectionStrategyCommand)
+		}
+	case MasterElectionStrategyURL:
+		if !hasURL {
+			return fmt.Errorf("masterElectionURL must be defined when masterElectionStrategy is %q", MasterElectionStrategyURL)
+		}
+	default:
+		return fmt.Errorf("unknown masterElectionStrategy: %q", strategy)
+	}
+	if hasCommand && strategy != MasterElectionStrategyCommand {
+		return fmt.Errorf("masterElectionCommand can be defined only when masterElectionStrategy is %q", MasterElectionStrategyCommand)
+	}
+	if hasURL {
+		if strategy != MasterElectionStrategyURL {
+			return fmt.Errorf("masterElectionURL can be defined only when masterElectionStrategy is %q", MasterElectionStrategyURL)
+		}
+		if u, err := url.Parse(*electionURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("masterElectionURL must be an http or https url")
+		}
+	}
+	if timeout.Duration <= 0 {
+		return fmt.Errorf("masterElectionTimeout must be greater than 0")
+	}
+	return nil
+}
+
+func validateAutomaticResync(c *AutomaticResyncConfig) error {
+	if c == nil {
+		return nil
+	}
+	switch c.Policy {
+	case "":
+	case AutomaticResyncPolicyResync:
+	case AutomaticResyncPolicyHalt:
+	case AutomaticResyncPolicyRetryWithBackoff:
+	default:
+		return fmt.Errorf("unknown automaticResync policy: %q", c.Policy)
+	}
+	if c.InitialBackoff != nil && c.InitialBackoff.Duration <= 0 {
+		return fmt.Errorf("automaticResync initialBackoff must be positive")
+	}
+	if c.MaxBackoff != nil && c.MaxBackoff.Duration <= 0 {
+		return fmt.Errorf("automaticResync maxBackoff must be positive")
+	}
+	return nil
+}
+
+func validateResyncScheduling(s *ResyncScheduling) error {
+	if s == nil {
+		return nil
+	}
+	if s.MaxRate != "" {
+		if err := validateMaxRate("resyncScheduling.maxRate", s.MaxRate); err != nil {
+			return err
+		}
+	}
+	for _, w := range s.Windows {
+		if _, _, err := parseResyncWindow(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateStandbyConflicts(c *StandbyConflicts) error {
+	if c == nil {
+		return nil
+	}
+	if c.MaxStandbyStreamingDelay != nil && c.MaxStandbyStreamingDelay.Duration > maxStandbyDelay {
+		return fmt.Errorf("standbyConflicts maxStandbyStreamingDelay must not exceed %dms", math.MaxInt32)
+	}
+	if c.MaxStandbyArchiveDelay != nil && c.MaxStandbyArchiveDelay.Duration > maxStandbyDelay {
+		return fmt.Errorf("standbyConflicts maxStandbyArchiveDelay must not exceed %dms", math.MaxInt32)
+	}
+	return nil
+}
+
+func validateSyncReplDegradation(d *SyncReplDegradation) error {
+	if d == nil {
+		return nil
+	}
+	switch d.Policy {
+	case "":
+	case SyncReplDegradationPolicyBlock:
+	case SyncReplDegradationPolicyDegradeAfterGrace:
+	case SyncReplDegradationPolicyDegradeOnAck:
+	default:
+		return fmt.Errorf("unknown syncReplDegradation policy: %q", d.Policy)
+	}
+	if d.GracePeriod != nil && d.GracePeriod.Duration <= 0 {
+		return fmt.Errorf("syncReplDegradation gracePeriod must be positive")
+	}
+	return nil
+}
+
+func validateGracefulDemotion(g *GracefulDemotion, switchoverTimeout time.Duration) error {
+	if g == nil {
+		return nil
+	}
+	if g.DrainTimeout != nil && g.DrainTimeout.Duration <= 0 {
+		return fmt.Errorf("gracefulDemotion drainTimeout must be positive")
+	}
+	// the drain happens during the switchover
+	if g.DefDrainTimeout() >= switchoverTimeout {
+		return fmt.Errorf("gracefulDemotion drainTimeout must be lower than switchoverTimeout")
+	}
+	return nil
+}
+
+func validateWalRetentionLimits(l *WalRetentionLimits) error {
+	if l == nil {
+		return nil
+	}
+	if l.MaxWalSize == 0 && l.MaxSlotRetainedWal == 0 {
+		return fmt.Errorf("walRetentionLimits requires maxWalSize or maxSlotRetainedWal")
+	}
+	switch l.Policy {
+	case "":
+	case WalRetentionLimitPolicyAlert:
+	case WalRetentionLimitPolicyDropSlot:
+	case WalRetentionLimitPolicyBlockResync:
+	default:
+		return fmt.Errorf("unknown walRetentionLimits policy: %q", l.Policy)
+	}
+	return nil
+}
+
+func validateBasebackupConfig(c *BasebackupConfig) error {
+	if c == nil {
+		return nil
+	}
+	if c.MaxRate != "" {
+		if err := validateMaxRate("basebackupConfig.maxRate", c.MaxRate); err != nil {
+			return err
+		}
+	}
+	switch c.CheckpointMode {
+	case "":
+	case BasebackupCheckpointFast:
+	case BasebackupCheckpointSpread:
+	default:
+		return fmt.Errorf("unknown basebackupConfig.checkpointMode: %q", c.CheckpointMode)
+	}
+	switch c.WalMethod {
+	case "":
+	case BasebackupWalMethodStream:
+	case BasebackupWalMethodFetch:
+	default:
+		return fmt.Errorf("unknown basebackupConfig.walMethod: %q", c.WalMethod)
+	}
+	switch c.Compression {
+	case "":
+		if c.CompressionLevel != 0 {
+			return fmt.Errorf("basebackupConfig.compressionLevel requires basebackupConfig.compression")
+		}
+	case BasebackupCompressionGzip, BasebackupCompressionLZ4, BasebackupCompressionZstd:
+		if c.CompressionLevel > c.Compression.maxLevel() {
+			return fmt.Errorf("basebackupConfig.compressionLevel must be between 1 and %d for %q compression", c.Compression.maxLevel(), c.Compression)
+		}
+	default:
+		return fmt.Errorf("unknown basebackupConfig.compression: %q", c.Compression)
+	}
+	return nil
+}
+
+func validatePublications(publications []Publication) error {
+	names := map[string]struct{}{}
+	for _, p := range publications {
+		if p.Name == "" {
+			return fmt.Errorf("publication name undefined")
+		}
+		key := p.DefDatabase() + "/" + p.Name
+		if _, ok := names[key]; ok {
+			return fmt.Errorf("duplicate publication %q in database %q", p.Name, p.DefDatabase())
+		}
+		names[key] = struct{}{}
+		if p.AllTables && len(p.Tables) > 0 {
+			return fmt.Errorf("publication %q: allTables and tables are mutually exclusive", p.Name)
+		}
+		if !p.AllTables && len(p.Tables) == 0 {
+			return fmt.Errorf("publication %q: one of allTables or tables must be defined", p.Name)
+		}
+		for _, t := range p.Tables {
+			if t == "" || strings.Count(t, ".") > 1 {
+				return fmt.Errorf("publication %q: wrong table name %q", p.Name, t)
+			}
+		}
+	}
+	return nil
+}
+
+// validateLogicalReplicationSlots validates the logical replication slots.
+// Since the slot names are unique in the instance they cannot be repeated in
+// different databases or be also additional physical replication slots.
+func validateLogicalReplicationSlots(slots []LogicalReplicationSlot, additionalReplSlots []string) error {
+	names := map[string]struct{}{}
+	for _, s := range slots {
+		if s.Name == "" {
+			return fmt.Errorf("logical replication slot name undefined")
+		}
+		if err := validateReplicationSlot(s.Name); err != nil {
+			return err
+		}
+		if _, ok := names[s.Name]; ok {
+			return fmt.Errorf("duplicate logical replication slot %q", s.Name)
+		}
+		names[s.Name] = struct{}{}
+		for _, slot := range additionalReplSlots {
+			if slot == s.Name {
+				return fmt.Errorf("logical replication slot %q is also defined in additionalMasterReplicationSlots", s.Name)
+			}
+		}
+	}
+	return nil
+}
+
 func (c *Cluster) UpdateSpec(ns *ClusterSpec) error {
 	s := c.Spec
 	if err := ns.Validate(); err != nil {
@@ -518,10 +3077,26 @@ func (c *Cluster) UpdateSpec(ns *ClusterSpec) error {
 	if *ds.Role == ClusterRoleMaster && *dns.Role == ClusterRoleStandby {
 		return fmt.Errorf("cannot update a cluster from master role to standby role")
 	}
+	// data checksums are enabled by initdb, they cannot be enabled or
+	// disabled on the existing db data
+	if c.Status.Phase != ClusterPhaseInitializing && ds.NewConfig.dataChecksums() != dns.NewConfig.dataChecksums() {
+		return fmt.Errorf("cannot change newConfig dataChecksums after the cluster initialization")
+	}
 	c.Spec = ns
 	return nil
 }
 
+// SetInitConfig records the cluster init configuration. Since it must reflect
+// how the cluster was initialized it's set only once, later calls are no-op.
+// It returns true if the init configuration has been recorded.
+func (c *Cluster) SetInitConfig(ic *InitConfig) bool {
+	if c.Status.InitConfig != nil {
+		return false
+	}
+	c.Status.InitConfig = ic
+	return true
+}
+
 func NewCluster(uid string, cs *ClusterSpec) *Cluster {
 	c := &Cluster{
 		UID:        uid,
@@ -535,7 +3110,72 @@ func NewCluster(uid string, cs *ClusterSpec) *Cluster {
 	return c
 }
 
-type KeeperSpec struct{}
+type KeeperSpec struct {
+	// Tags are the tags reported by the keeper
+	Tags Tags `json:"tags,omitempty"`
+	// RecoveryMinApplyDelay is the apply delay, reported by the keeper, of
+	// its db when it's a standby. When defined the db is a delayed standby.
+	RecoveryMinApplyDelay *Duration `json:"recoveryMinApplyDelay,omitempty"`
+	// ElectionPriority is the keeper priority (set with stolonctl) used to
+	// choose the new master between the standbys whose lag is within the
+	// allowed bounds. Higher values are preferred, the default is 0.
+	ElectionPriority int `json:"electionPriority,omitempty"`
+	// Drained reports that the keeper has been drained (with stolonctl) for
+	// maintenance: its db won't be elected as the new master, chosen as a
+	// synchronous standby or followed by cascading standbys.
+	Drained bool `json:"drained,omitempty"`
+	// Maintenance reports that the keeper has been put (with stolonctl) in
+	// maintenance mode: the sentinel won't change the role of its db or
+	// consider it failed and the keeper won't converge its db to the
+	// cluster data, leaving postgres as it is.
+	Maintenance bool `json:"maintenance,omitempty"`
+	// PGParameters are the postgres parameters (set with stolonctl)
+	// overriding, for the db of this keeper, the cluster spec pgParameters
+	// (i.e. a smaller shared_buffers on a small disaster recovery node).
+	PGParameters PGParameters `json:"pgParameters,omitempty"`
+	// PGBinPath is the path of the postgres binaries (set with stolonctl)
+	// overriding the keeper --pg-bin-path (i.e. to upgrade postgres to a new
+	// minor version one keeper at a time).
+	PGBinPath string `json:"pgBinPath,omitempty"`
+	// Removal is a request (set with stolonctl removekeeper --graceful) to
+	// the keeper to stop postgres and dispose of its data directory before
+	// being removed from the cluster
+	Removal *KeeperRemoval `json:"removal,omitempty"`
+}
+
+// DataDirDisposal defines what a removed keeper does with its postgres data
+// directory
+type DataDirDisposal string
+
+const (
+	// Keep the data directory
+	DataDirDisposalKeep DataDirDisposal = "keep"
+	// Remove the data directory
+	DataDirDisposalWipe DataDirDisposal = "wipe"
+	// Rename the data directory, inside the keeper data dir, adding the
+	// removal time
+	DataDirDisposalArchive DataDirDisposal = "archive"
+)
+
+// KeeperRemoval is a keeper removal request
+type KeeperRemoval struct {
+	// RequestTime identifies the request
+	RequestTime     time.Time       `json:"requestTime,omitempty"`
+	DataDirDisposal DataDirDisposal `json:"dataDirDisposal,omitempty"`
+}
+
+// KeeperRemovalStatus is the status, reported by the keeper, of a removal
+// request
+type KeeperRemovalStatus struct {
+	// RequestTime is the handled request time
+	RequestTime time.Time `json:"requestTime,omitempty"`
+	// Completed reports that postgres has been stopped and the data
+	// directory disposed of. The keeper won't manage a db anymore.
+	Completed bool `json:"completed,omitempty"`
+	// ArchivePath is the path of the archived data directory
+	ArchivePath string `json:"archivePath,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
 
 type KeeperStatus struct {
 	Healthy         bool      `json:"healthy,omitempty"`
@@ -544,8 +3184,21 @@ type KeeperStatus struct {
 	BootUUID string `json:"bootUUID,omitempty"`
 
 	PostgresBinaryVersion PostgresBinaryVersion `json:"postgresBinaryVersion,omitempty"`
+	// PostgresVersion is the full version (i.e. 12.4) of the postgres
+	// binaries used by the keeper
+	PostgresVersion string `json:"postgresVersion,omitempty"`
+	// PGBinPath is the path of the postgres binaries used by the keeper
+	PGBinPath string `json:"pgBinPath,omitempty"`
 
 	ForceFail bool `json:"forceFail,omitempty"`
+
+	// Fenced reports that the keeper has been fenced. A fenced keeper is
+	// considered failed.
+	Fenced bool `json:"fenced,omitempty"`
+
+	// LastAutomaticResync is the last automatic resync of the keeper db done
+	// with the retryWithBackoff automaticResync policy
+	LastAutomaticResync *AutomaticResyncStatus `json:"lastAutomaticResync,omitempty"`
 }
 
 type Keeper struct {
@@ -564,7 +3217,10 @@ func NewKeeperFromKeeperInfo(ki *KeeperInfo) *Keeper {
 		UID:        ki.UID,
 		Generation: InitialGeneration,
 		ChangeTime: time.Time{},
-		Spec:       &KeeperSpec{},
+		Spec: &KeeperSpec{
+			Tags:                  ki.Tags,
+			RecoveryMinApplyDelay: ki.RecoveryMinApplyDelay,
+		},
 		Status: KeeperStatus{
 			Healthy:         true,
 			LastHealthyTime: time.Now(),
@@ -600,6 +3256,48 @@ type DBSpec struct {
 	// Replication slots not defined here will be dropped from the instance
 	// (i.e. manually created replication slots will be removed).
 	AdditionalReplicationSlots []string `json:"additionalReplicationSlots"`
+	// See ClusterSpec WalRetentionStrategy description
+	WalRetentionStrategy WalRetentionStrategy `json:"walRetentionStrategy,omitempty"`
+	// See ClusterSpec WalRetentionLimits description
+	WalRetentionLimits *WalRetentionLimits `json:"walRetentionLimits,omitempty"`
+	// DropReplicationSlots are the replication slots that the keeper has
+	// been requested (by stolonctl drop-slot) to drop. They're removed by
+	// the sentinel when the keeper has applied the db spec.
+	DropReplicationSlots []string `json:"dropReplicationSlots,omitempty"`
+	// RestartRequest is increased to request the keeper to restart the
+	// instance (i.e. by a rolling restart)
+	RestartRequest int64 `json:"restartRequest,omitempty"`
+	// PGUpgrade is set by the sentinel on the master db during a postgres
+	// major version upgrade to request the keeper to upgrade the data dir,
+	// with pg_upgrade, to its new postgres binaries
+	PGUpgrade bool `json:"pgUpgrade,omitempty"`
+	// GracefulDemotion is set by the sentinel on the master db during a
+	// switchover to request the keeper to drain it before its demotion
+	GracefulDemotion *GracefulDemotionRequest `json:"gracefulDemotion,omitempty"`
+	// Publications are the logical replication publications to be created
+	// on the instance
+	Publications []Publication `json:"publications,omitempty"`
+	// LogicalReplicationSlots are the logical replication slots to be
+	// created on the instance
+	LogicalReplicationSlots []LogicalReplicationSlot `json:"logicalReplicationSlots,omitempty"`
+	// See ClusterSpec BasebackupConfig description
+	BasebackupConfig *BasebackupConfig `json:"basebackupConfig,omitempty"`
+	// ResyncMaxRate is the resyncScheduling max transfer rate of a
+	// standby resync
+	ResyncMaxRate string `json:"resyncMaxRate,omitempty"`
+	// See ClusterSpec ResyncMethod description
+	ResyncMethod ResyncMethod `json:"resyncMethod,omitempty"`
+	// See ClusterSpec PgBackRestConfig description
+	PgBackRestConfig *PgBackRestConfig `json:"pgBackRestConfig,omitempty"`
+	// See ClusterSpec WalGConfig description
+	WalGConfig *WalGConfig `json:"walgConfig,omitempty"`
+	// See ClusterSpec ResyncStrategies description
+	ResyncStrategies []ResyncStrategy `json:"resyncStrategies,omitempty"`
+	// See ClusterSpec VerifyResync description
+	VerifyResync bool `json:"verifyResync,omitempty"`
+	// RecoveryMinApplyDelay is the recovery_min_apply_delay of a delayed
+	// standby following another db in the cluster
+	RecoveryMinApplyDelay *Duration `json:"recoveryMinApplyDelay,omitempty"`
 	// InitMode defines the db initialization mode. Current modes are: none, new
 	InitMode DBInitMode `json:"initMode,omitempty"`
 	// Init configuration used when InitMode is "new"
@@ -608,9 +3306,22 @@ type DBSpec struct {
 	PITRConfig *PITRConfig `json:"pitrConfig,omitempty"`
 	// Map of postgres parameters
 	PGParameters PGParameters `json:"pgParameters,omitempty"`
+	// See ClusterSpec AllowUnsafeDurability description
+	AllowUnsafeDurability bool `json:"allowUnsafeDurability,omitempty"`
+	// See ClusterSpec RequireChannelBinding description
+	RequireChannelBinding bool `json:"requireChannelBinding,omitempty"`
 	// Additional pg_hba.conf entries
 	// We don't set omitempty since we want to distinguish between null or empty slice
 	PGHBA []string `json:"pgHBA"`
+	// See ClusterSpec PGHBARules description
+	PGHBARules []HBARule `json:"pgHBARules,omitempty"`
+	// See ClusterSpec PGIdent description
+	// We don't set omitempty since we want to distinguish between null or empty slice
+	PGIdent []IdentMapping `json:"pgIdent"`
+	// See ClusterSpec MonitoringUser description
+	MonitoringUser *MonitoringUser `json:"monitoringUser,omitempty"`
+	// See ClusterSpec Extensions description
+	Extensions []Extension `json:"extensions,omitempty"`
 	// DB Role (master or standby)
 	Role common.Role `json:"role,omitempty"`
 	// FollowConfig when Role is "standby"
@@ -623,15 +3334,32 @@ type DBSpec struct {
 	SynchronousStandbys []string `json:"synchronousStandbys"`
 	// External SynchronousStandbys are external standbys names to be configured as synchronous
 	ExternalSynchronousStandbys []string `json:"externalSynchronousStandbys"`
+	// SynchronousCommit is the synchronous_commit level to be enforced on
+	// the master
+	SynchronousCommit SynchronousCommitLevel `json:"synchronousCommit,omitempty"`
+	// StandbyConflicts are the standby conflicts parameters to be applied
+	// on a standby
+	StandbyConflicts *StandbyConflicts `json:"standbyConflicts,omitempty"`
+	// SynchronousStandbysQuorum, when greater than 0, is the number of
+	// synchronous standbys the master waits for (quorum synchronous
+	// replication). When 0 the master waits for all of them.
+	SynchronousStandbysQuorum uint16 `json:"synchronousStandbysQuorum,omitempty"`
 }
 
 type DBStatus struct {
 	Healthy bool `json:"healthy,omitempty"`
 
 	CurrentGeneration int64 `json:"currentGeneration,omitempty"`
+	// RestartRequest is the last db spec restart request handled by the
+	// keeper
+	RestartRequest int64 `json:"restartRequest,omitempty"`
 
-	ListenAddress string `json:"listenAddress,omitempty"`
-	Port          string `json:"port,omitempty"`
+	// ListenAddress is the advertised address of the preferred address
+	// family, ListenAddresses are all the addresses advertised by the
+	// keeper, the main one first
+	ListenAddress   string   `json:"listenAddress,omitempty"`
+	ListenAddresses []string `json:"listenAddresses,omitempty"`
+	Port            string   `json:"port,omitempty"`
 
 	SystemID         string                   `json:"systemdID,omitempty"`
 	TimelineID       uint64                   `json:"timelineID,omitempty"`
@@ -640,6 +3368,38 @@ type DBStatus struct {
 
 	PGParameters PGParameters `json:"pgParameters,omitempty"`
 
+	// DataChecksums reports if the db has data checksums enabled
+	DataChecksums bool `json:"dataChecksums,omitempty"`
+	// SharedPreloadLibraries are the libraries loaded by the running
+	// instance
+	SharedPreloadLibraries []string `json:"sharedPreloadLibraries,omitempty"`
+	// SSLCertNotAfter is the expiration time of the db server certificate,
+	// reported when ssl is enabled
+	SSLCertNotAfter *time.Time `json:"sslCertNotAfter,omitempty"`
+
+	// ReplicationSlots are the physical replication slots of the db
+	ReplicationSlots []*ReplicationSlotStatus `json:"replicationSlots,omitempty"`
+
+	// WalRetention is the db wal retention status, reported only when the
+	// cluster spec defines the walRetentionLimits
+	WalRetention *WalRetentionStatus `json:"walRetention,omitempty"`
+
+	// AutomaticResync reports, when the db requires an automatic full resync
+	// that hasn't been done (see the cluster spec automaticResync), the
+	// sentinel decision and the failure details
+	AutomaticResync *AutomaticResyncStatus `json:"automaticResync,omitempty"`
+
+	// GracefulDemotion is the status of the drain of the master db
+	// requested during a switchover
+	GracefulDemotion *GracefulDemotionStatus `json:"gracefulDemotion,omitempty"`
+
+	// Tablespaces are the db tablespaces, excluding the default ones, and
+	// their locations
+	Tablespaces []*TablespaceStatus `json:"tablespaces,omitempty"`
+
+	// LogicalReplicationSlots are the logical replication slots of the db
+	LogicalReplicationSlots []*LogicalReplicationSlotStatus `json:"logicalReplicationSlots,omitempty"`
+
 	// DBUIDs of the internal standbys currently reported as in sync by the instance
 	CurSynchronousStandbys []string `json:"-"`
 
@@ -653,6 +3413,119 @@ type DBStatus struct {
 	// If/when needed lets add a new ExternalSynchronousStandbys field
 
 	OlderWalFile string `json:"olderWalFile,omitempty"`
+
+	// Hashes of the pg parameters currently configured in the instance and
+	// of the ones the keeper expects to be configured. Reported only if
+	// enabled in the keeper.
+	PGParametersHash         string `json:"pgParametersHash,omitempty"`
+	ExpectedPGParametersHash string `json:"expectedPGParametersHash,omitempty"`
+
+	// ReplicationLag is the lag in bytes of a standby from the last reported
+	// master xlog position
+	ReplicationLag uint64 `json:"replicationLag,omitempty"`
+	// SynchronousStandbysReasons are, for a master db with the "lag"
+	// syncStandbySelection, the reasons why every synchronous standby has
+	// been chosen
+	SynchronousStandbysReasons map[string]string `json:"synchronousStandbysReasons,omitempty"`
+	// ReplayXLogPos is the last wal position replayed by a standby
+	ReplayXLogPos uint64 `json:"replayXLogPos,omitempty"`
+	// ReplayLag is the lag in bytes of the position replayed by a standby
+	// from the last reported master xlog position
+	ReplayLag uint64 `json:"replayLag,omitempty"`
+	// ReplayDelay is the time since the commit on the master of the last
+	// transaction replayed by a standby. It also increases when there're no
+	// writes on the master.
+	ReplayDelay *Duration `json:"replayDelay,omitempty"`
+	// Ready reports if the db is healthy and, when a standby, its replication
+	// lag isn't greater than maxReadyStandbyLag. The master is ready when
+	// healthy.
+	Ready bool `json:"ready,omitempty"`
+
+	// MasterRoleDeclined reports that the keeper declined to make the db the
+	// master since its pre master validation failed
+	MasterRoleDeclined bool `json:"masterRoleDeclined,omitempty"`
+
+	// PrePromotionHookResult is the result of the last pre promotion hook
+	// executed by the keeper for this db
+	PrePromotionHookResult *PrePromotionHookResult `json:"prePromotionHookResult,omitempty"`
+
+	// ChecksumsVerification is the last data checksums verification done
+	// by the keeper for this db
+	ChecksumsVerification *ChecksumsVerification `json:"checksumsVerification,omitempty"`
+
+	// ResyncVerification is the verification of the last resync done by
+	// the keeper for this db
+	ResyncVerification *ResyncVerification `json:"resyncVerification,omitempty"`
+
+	// PostInitHookResult is the result of the post init hook executed by
+	// the keeper when initializing this db
+	PostInitHookResult *PostInitHookResult `json:"postInitHookResult,omitempty"`
+
+	// TimelineDivergence reports that the keeper refused to start the db as
+	// master since it's an old primary
+	TimelineDivergence *TimelineDivergence `json:"timelineDivergence,omitempty"`
+}
+
+// TimelineDivergence reports that a db requested as master isn't the
+// cluster master and the cluster master is on a newer timeline: the db is an
+// old primary (i.e. restarted after a failover) that must not accept writes.
+type TimelineDivergence struct {
+	DBUID string    `json:"dbUID,omitempty"`
+	Time  time.Time `json:"time,omitempty"`
+
+	MasterDBUID      string `json:"masterDBUID,omitempty"`
+	MasterTimelineID uint64 `json:"masterTimelineID,omitempty"`
+	TimelineID       uint64 `json:"timelineID,omitempty"`
+	XLogPos          uint64 `json:"xLogPos,omitempty"`
+	// Diverged reports that the db has wal not available on the master
+	// since the master timeline forked before the db xlog position or from
+	// another timeline
+	Diverged bool `json:"diverged,omitempty"`
+}
+
+// PostInitHookResult reports the result of the newConfig post init statements
+// and command execution
+type PostInitHookResult struct {
+	DBUID   string    `json:"dbUID,omitempty"`
+	Time    time.Time `json:"time,omitempty"`
+	Success bool      `json:"success,omitempty"`
+	// Error is the failed statement or command execution error
+	Error string `json:"error,omitempty"`
+	// Stderr contains the (truncated) command standard error
+	Stderr string `json:"stderr,omitempty"`
+}
+
+// PrePromotionHookResult reports the result of a pre promotion hook execution
+type PrePromotionHookResult struct {
+	DBUID   string    `json:"dbUID,omitempty"`
+	Time    time.Time `json:"time,omitempty"`
+	Success bool      `json:"success,omitempty"`
+	// Error is the command execution error (i.e. the exit status or the
+	// timeout)
+	Error string `json:"error,omitempty"`
+	// Stderr contains the (truncated) command standard error
+	Stderr string `json:"stderr,omitempty"`
+}
+
+// AdvertisedAddresses returns all the addresses advertised by the db keeper
+func (s *DBStatus) AdvertisedAddresses() []string {
+	if len(s.ListenAddresses) > 0 {
+		return s.ListenAddresses
+	}
+	if s.ListenAddress != "" {
+		return []string{s.ListenAddress}
+	}
+	return nil
+}
+
+// PGParametersDrift reports if the pg parameters configured in the instance
+// differ from the ones the keeper expects. It always returns false if the
+// hashes aren't reported.
+func (s *DBStatus) PGParametersDrift() bool {
+	if s.PGParametersHash == "" || s.ExpectedPGParametersHash == "" {
+		return false
+	}
+	return s.PGParametersHash != s.ExpectedPGParametersHash
 }
 
 type DB struct {
@@ -16,7 +16,9 @@ package cluster
 
 import (
 	"errors"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestValidateReplicationSlots(t *testing.T) {
@@ -65,3 +67,1688 @@ func TestValidateReplicationSlots(t *testing.T) {
 		}
 	}
 }
+
+func TestValidateLogicalReplicationSlots(t *testing.T) {
+	tests := []struct {
+		in         []LogicalReplicationSlot
+		additional []string
+		err        error
+	}{
+		{
+			in: []LogicalReplicationSlot{
+				{Name: "slot1"},
+				{Name: "slot2", Database: "db1", Plugin: "wal2json"},
+			},
+			additional: []string{"slot3"},
+		},
+		{
+			in:  []LogicalReplicationSlot{{Database: "db1"}},
+			err: errors.New(`logical replication slot name undefined`),
+		},
+		{
+			in:  []LogicalReplicationSlot{{Name: "Slot1"}},
+			err: errors.New(`wrong replication slot name: "Slot1"`),
+		},
+		{
+			in:  []LogicalReplicationSlot{{Name: "stolon_slot1"}},
+			err: errors.New(`replication slot name is reserved: "stolon_slot1"`),
+		},
+		{
+			in: []LogicalReplicationSlot{
+				{Name: "slot1"},
+				{Name: "slot1", Database: "db1"},
+			},
+			err: errors.New(`duplicate logical replication slot "slot1"`),
+		},
+		{
+			in:         []LogicalReplicationSlot{{Name: "slot1"}},
+			additional: []string{"slot1"},
+			err:        errors.New(`logical replication slot "slot1" is also defined in additionalMasterReplicationSlots`),
+		},
+	}
+
+	for i, tt := range tests {
+		err := validateLogicalReplicationSlots(tt.in, tt.additional)
+
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("#%d: unexpected error: %v", i, err)
+			}
+		}
+	}
+}
+
+func TestValidatePublications(t *testing.T) {
+	tests := []struct {
+		in  []Publication
+		err error
+	}{
+		{
+			in: []Publication{
+				{Name: "pub1", AllTables: true},
+				{Name: "pub2", Tables: []string{"t1", "s1.t2"}},
+				{Name: "pub1", Database: "db1", AllTables: true},
+			},
+		},
+		{
+			in:  []Publication{{AllTables: true}},
+			err: errors.New(`publication name undefined`),
+		},
+		{
+			in: []Publication{
+				{Name: "pub1", AllTables: true},
+				{Name: "pub1", Database: "postgres", Tables: []string{"t1"}},
+			},
+			err: errors.New(`duplicate publication "pub1" in database "postgres"`),
+		},
+		{
+			in:  []Publication{{Name: "pub1", AllTables: true, Tables: []string{"t1"}}},
+			err: errors.New(`publication "pub1": allTables and tables are mutually exclusive`),
+		},
+		{
+			in:  []Publication{{Name: "pub1"}},
+			err: errors.New(`publication "pub1": one of allTables or tables must be defined`),
+		},
+		{
+			in:  []Publication{{Name: "pub1", Tables: []string{"a.b.c"}}},
+			err: errors.New(`publication "pub1": wrong table name "a.b.c"`),
+		},
+	}
+
+	for i, tt := range tests {
+		err := validatePublications(tt.in)
+
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("#%d: unexpected error: %v", i, err)
+			}
+		}
+	}
+}
+
+func TestSetInitConfig(t *testing.T) {
+	c := NewCluster("cluster1", &ClusterSpec{InitMode: ClusterInitModeP(ClusterInitModeNew)})
+	ic1 := &InitConfig{InitMode: ClusterInitModeNew, DBUID: "db1"}
+	ic2 := &InitConfig{InitMode: ClusterInitModeNew, DBUID: "db2"}
+	if !c.SetInitConfig(ic1) {
+		t.Fatalf("expected init config recorded")
+	}
+	if c.SetInitConfig(ic2) {
+		t.Fatalf("expected init config not overwritten")
+	}
+	if err := c.UpdateSpec(&ClusterSpec{InitMode: ClusterInitModeP(ClusterInitModeNew), NewConfig: &NewConfig{Locale: "C"}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.Status.InitConfig != ic1 {
+		t.Fatalf("expected init config of db1, got init config of %s", c.Status.InitConfig.DBUID)
+	}
+}
+
+func TestUpdateSpecDataChecksums(t *testing.T) {
+	newSpec := func(nc *NewConfig) *ClusterSpec {
+		return &ClusterSpec{InitMode: ClusterInitModeP(ClusterInitModeNew), NewConfig: nc}
+	}
+	tests := []struct {
+		phase ClusterPhase
+		nc    *NewConfig
+		nnc   *NewConfig
+		err   error
+	}{
+		{
+			phase: ClusterPhaseInitializing,
+			nnc:   &NewConfig{DataChecksums: true},
+		},
+		{
+			phase: ClusterPhaseNormal,
+			nc:    &NewConfig{DataChecksums: true},
+			nnc:   &NewConfig{DataChecksums: true, Locale: "C"},
+		},
+		{
+			phase: ClusterPhaseNormal,
+			nnc:   &NewConfig{},
+		},
+		{
+			phase: ClusterPhaseNormal,
+			nnc:   &NewConfig{DataChecksums: true},
+			err:   errors.New("cannot change newConfig dataChecksums after the cluster initialization"),
+		},
+		{
+			phase: ClusterPhaseNormal,
+			nc:    &NewConfig{DataChecksums: true},
+			err:   errors.New("cannot change newConfig dataChecksums after the cluster initialization"),
+		},
+	}
+
+	for i, tt := range tests {
+		c := NewCluster("cluster1", newSpec(tt.nc))
+		c.Status.Phase = tt.phase
+		err := c.UpdateSpec(newSpec(tt.nnc))
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestValidateNewConfig(t *testing.T) {
+	tests := []struct {
+		nc  *NewConfig
+		err error
+	}{
+		{
+			nc: &NewConfig{WalDir: "/stolon-wal", PostInitSQL: []string{"create role app", "create database app owner app"}, PostInitCommand: "psql -f /bootstrap.sql"},
+		},
+		{
+			nc:  &NewConfig{WalDir: "stolon-wal"},
+			err: errors.New("newConfig walDir must be an absolute path"),
+		},
+		{
+			nc:  &NewConfig{PostInitSQL: []string{"create role app", " "}},
+			err: errors.New("newConfig postInitSQL entry #1 is empty"),
+		},
+	}
+
+	for i, tt := range tests {
+		s := &ClusterSpec{
+			InitMode:  ClusterInitModeP(ClusterInitModeNew),
+			NewConfig: tt.nc,
+		}
+		err := s.Validate()
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestValidateRequireChannelBinding(t *testing.T) {
+	tests := []struct {
+		requireChannelBinding bool
+		pgParameters          PGParameters
+		err                   error
+	}{
+		{},
+		{
+			requireChannelBinding: true,
+			pgParameters:          PGParameters{"ssl": "on"},
+		},
+		{
+			requireChannelBinding: true,
+			err:                   errors.New(`requireChannelBinding requires ssl enabled (pgParameters ssl must be "on")`),
+		},
+		{
+			requireChannelBinding: true,
+			pgParameters:          PGParameters{"ssl": "off"},
+			err:                   errors.New(`requireChannelBinding requires ssl enabled (pgParameters ssl must be "on")`),
+		},
+	}
+
+	for i, tt := range tests {
+		s := &ClusterSpec{
+			InitMode:              ClusterInitModeP(ClusterInitModeNew),
+			RequireChannelBinding: BoolP(tt.requireChannelBinding),
+			PGParameters:          tt.pgParameters,
+		}
+		err := s.Validate()
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestValidateSynchronousCommit(t *testing.T) {
+	tests := []struct {
+		synchronousCommit      *SynchronousCommitLevel
+		synchronousReplication bool
+		pgParameters           PGParameters
+		err                    error
+	}{
+		{},
+		{
+			pgParameters: PGParameters{"synchronous_commit": "local"},
+		},
+		{
+			synchronousCommit: SynchronousCommitLevelP(SynchronousCommitOn),
+		},
+		{
+			synchronousCommit:      SynchronousCommitLevelP(SynchronousCommitRemoteApply),
+			synchronousReplication: true,
+		},
+		{
+			synchronousCommit: SynchronousCommitLevelP(SynchronousCommitRemoteWrite),
+			err:               errors.New(`synchronousCommit "remote_write" requires synchronousReplication`),
+		},
+		{
+			synchronousCommit:      SynchronousCommitLevelP("local"),
+			synchronousReplication: true,
+			err:                    errors.New(`unknown synchronousCommit: "local"`),
+		},
+		{
+			synchronousCommit: SynchronousCommitLevelP(SynchronousCommitOn),
+			pgParameters:      PGParameters{"synchronous_commit": "local"},
+			err:               errors.New(`synchronousCommit and the synchronous_commit pgParameter are mutually exclusive`),
+		},
+	}
+
+	for i, tt := range tests {
+		s := &ClusterSpec{
+			InitMode:               ClusterInitModeP(ClusterInitModeNew),
+			SynchronousCommit:      tt.synchronousCommit,
+			SynchronousReplication: BoolP(tt.synchronousReplication),
+			PGParameters:           tt.pgParameters,
+		}
+		err := s.Validate()
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestValidateStandbyConflicts(t *testing.T) {
+	tests := []struct {
+		c   *StandbyConflicts
+		err error
+	}{
+		{},
+		{
+			c: &StandbyConflicts{HotStandbyFeedback: BoolP(true), MaxStandbyStreamingDelay: &Duration{Duration: -1}, MaxStandbyArchiveDelay: &Duration{Duration: time.Hour}},
+		},
+		{
+			c:   &StandbyConflicts{MaxStandbyStreamingDelay: &Duration{Duration: 30 * 24 * time.Hour}},
+			err: errors.New("standbyConflicts maxStandbyStreamingDelay must not exceed 2147483647ms"),
+		},
+		{
+			c:   &StandbyConflicts{MaxStandbyArchiveDelay: &Duration{Duration: 30 * 24 * time.Hour}},
+			err: errors.New("standbyConflicts maxStandbyArchiveDelay must not exceed 2147483647ms"),
+		},
+	}
+
+	for i, tt := range tests {
+		s := &ClusterSpec{
+			InitMode:         ClusterInitModeP(ClusterInitModeNew),
+			StandbyConflicts: tt.c,
+		}
+		err := s.Validate()
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestStandbyConflictsParameters(t *testing.T) {
+	tests := []struct {
+		c   *StandbyConflicts
+		out map[string]string
+	}{
+		{
+			out: map[string]string{},
+		},
+		{
+			c:   &StandbyConflicts{HotStandbyFeedback: BoolP(false)},
+			out: map[string]string{"hot_standby_feedback": "off"},
+		},
+		{
+			c: &StandbyConflicts{HotStandbyFeedback: BoolP(true), MaxStandbyStreamingDelay: &Duration{Duration: 90 * time.Second}, MaxStandbyArchiveDelay: &Duration{Duration: -time.Second}},
+			out: map[string]string{
+				"hot_standby_feedback":        "on",
+				"max_standby_streaming_delay": "90000ms",
+				"max_standby_archive_delay":   "-1",
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		out := tt.c.Parameters()
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: wrong parameters: got: %v, want: %v", i, out, tt.out)
+		}
+	}
+}
+
+func TestValidateResyncScheduling(t *testing.T) {
+	tests := []struct {
+		s   *ResyncScheduling
+		err error
+	}{
+		{},
+		{
+			s: &ResyncScheduling{MaxConcurrentResyncs: 1, MaxRate: "10M", Windows: []string{"01:00-05:00", "22:30-00:30"}},
+		},
+		{
+			s:   &ResyncScheduling{MaxRate: "10"},
+			err: errors.New("resyncScheduling.maxRate must be between 32k and 1024M"),
+		},
+		{
+			s:   &ResyncScheduling{MaxRate: "10MB"},
+			err: errors.New(`wrong resyncScheduling.maxRate "10MB"`),
+		},
+		{
+			s:   &ResyncScheduling{Windows: []string{"01:00"}},
+			err: errors.New(`wrong resync window "01:00", must be in the HH:MM-HH:MM format`),
+		},
+		{
+			s:   &ResyncScheduling{Windows: []string{"01:00-25:00"}},
+			err: errors.New(`wrong resync window "01:00-25:00", must be in the HH:MM-HH:MM format`),
+		},
+		{
+			s:   &ResyncScheduling{Windows: []string{"01:00-01:00"}},
+			err: errors.New(`resync window "01:00-01:00" start and end must differ`),
+		},
+	}
+
+	for i, tt := range tests {
+		s := &ClusterSpec{
+			InitMode:         ClusterInitModeP(ClusterInitModeNew),
+			ResyncScheduling: tt.s,
+		}
+		err := s.Validate()
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestResyncSchedulingInWindow(t *testing.T) {
+	at := func(hour, min int) time.Time {
+		return time.Date(2018, 6, 1, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		s   *ResyncScheduling
+		t   time.Time
+		out bool
+	}{
+		{s: nil, t: at(12, 0), out: true},
+		{s: &ResyncScheduling{}, t: at(12, 0), out: true},
+		{s: &ResyncScheduling{Windows: []string{"01:00-05:00"}}, t: at(1, 0), out: true},
+		{s: &ResyncScheduling{Windows: []string{"01:00-05:00"}}, t: at(4, 59), out: true},
+		{s: &ResyncScheduling{Windows: []string{"01:00-05:00"}}, t: at(5, 0), out: false},
+		{s: &ResyncScheduling{Windows: []string{"01:00-05:00", "12:00-13:00"}}, t: at(12, 30), out: true},
+		{s: &ResyncScheduling{Windows: []string{"22:00-02:00"}}, t: at(23, 0), out: true},
+		{s: &ResyncScheduling{Windows: []string{"22:00-02:00"}}, t: at(1, 0), out: true},
+		{s: &ResyncScheduling{Windows: []string{"22:00-02:00"}}, t: at(12, 0), out: false},
+		// the windows are in UTC
+		{s: &ResyncScheduling{Windows: []string{"01:00-05:00"}}, t: at(3, 0).In(time.FixedZone("UTC+8", 8*3600)), out: true},
+	}
+
+	for i, tt := range tests {
+		if out := tt.s.InWindow(tt.t); out != tt.out {
+			t.Errorf("#%d: got: %t, want: %t", i, out, tt.out)
+		}
+	}
+}
+
+func TestValidateWalRetention(t *testing.T) {
+	tests := []struct {
+		strategy     WalRetentionStrategy
+		pgParameters PGParameters
+		err          error
+	}{
+		{
+			strategy: WalRetentionStrategyBoth,
+		},
+		{
+			strategy:     WalRetentionStrategyWalKeep,
+			pgParameters: PGParameters{"wal_keep_size": "1GB"},
+		},
+		{
+			strategy:     WalRetentionStrategyBoth,
+			pgParameters: PGParameters{"wal_keep_segments": "64"},
+		},
+		{
+			strategy: WalRetentionStrategySlots,
+		},
+		{
+			strategy: "unknown",
+			err:      errors.New(`unknown walRetentionStrategy: "unknown"`),
+		},
+		{
+			strategy:     WalRetentionStrategyBoth,
+			pgParameters: PGParameters{"wal_keep_segments": "64", "wal_keep_size": "1GB"},
+			err:          errors.New("only one of the wal_keep_segments and wal_keep_size pgParameters can be defined"),
+		},
+		{
+			strategy:     WalRetentionStrategySlots,
+			pgParameters: PGParameters{"wal_keep_size": "1GB"},
+			err:          errors.New(`the wal_keep_segments and wal_keep_size pgParameters cannot be defined when walRetentionStrategy is "slots"`),
+		},
+	}
+
+	for i, tt := range tests {
+		s := &ClusterSpec{
+			InitMode:             ClusterInitModeP(ClusterInitModeNew),
+			WalRetentionStrategy: WalRetentionStrategyP(tt.strategy),
+			PGParameters:         tt.pgParameters,
+		}
+		err := s.Validate()
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestValidateWalRetentionLimits(t *testing.T) {
+	tests := []struct {
+		limits *WalRetentionLimits
+		err    error
+	}{
+		{},
+		{
+			limits: &WalRetentionLimits{MaxWalSize: 10 * 1024 * 1024 * 1024},
+		},
+		{
+			limits: &WalRetentionLimits{MaxSlotRetainedWal: 1024 * 1024 * 1024, Policy: WalRetentionLimitPolicyDropSlot},
+		},
+		{
+			limits: &WalRetentionLimits{MaxWalSize: 1024, Policy: WalRetentionLimitPolicyBlockResync},
+		},
+		{
+			limits: &WalRetentionLimits{Policy: WalRetentionLimitPolicyAlert},
+			err:    errors.New("walRetentionLimits requires maxWalSize or maxSlotRetainedWal"),
+		},
+		{
+			limits: &WalRetentionLimits{MaxWalSize: 1024, Policy: "unknown"},
+			err:    errors.New(`unknown walRetentionLimits policy: "unknown"`),
+		},
+	}
+
+	for i, tt := range tests {
+		s := &ClusterSpec{
+			InitMode:           ClusterInitModeP(ClusterInitModeNew),
+			WalRetentionLimits: tt.limits,
+		}
+		err := s.Validate()
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestValidateAutomaticResync(t *testing.T) {
+	tests := []struct {
+		c   *AutomaticResyncConfig
+		err error
+	}{
+		{},
+		{
+			c: &AutomaticResyncConfig{Policy: AutomaticResyncPolicyHalt},
+		},
+		{
+			c: &AutomaticResyncConfig{Policy: AutomaticResyncPolicyRetryWithBackoff, InitialBackoff: &Duration{Duration: time.Minute}, MaxBackoff: &Duration{Duration: time.Hour}},
+		},
+		{
+			c:   &AutomaticResyncConfig{Policy: "unknown"},
+			err: errors.New(`unknown automaticResync policy: "unknown"`),
+		},
+		{
+			c:   &AutomaticResyncConfig{Policy: AutomaticResyncPolicyRetryWithBackoff, InitialBackoff: &Duration{}},
+			err: errors.New("automaticResync initialBackoff must be positive"),
+		},
+	}
+
+	for i, tt := range tests {
+		s := &ClusterSpec{
+			InitMode:        ClusterInitModeP(ClusterInitModeNew),
+			AutomaticResync: tt.c,
+		}
+		err := s.Validate()
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestValidateSyncReplDegradation(t *testing.T) {
+	tests := []struct {
+		d   *SyncReplDegradation
+		err error
+	}{
+		{},
+		{
+			d: &SyncReplDegradation{Policy: SyncReplDegradationPolicyDegradeOnAck},
+		},
+		{
+			d: &SyncReplDegradation{Policy: SyncReplDegradationPolicyDegradeAfterGrace, GracePeriod: &Duration{Duration: time.Minute}},
+		},
+		{
+			d:   &SyncReplDegradation{Policy: "unknown"},
+			err: errors.New(`unknown syncReplDegradation policy: "unknown"`),
+		},
+		{
+			d:   &SyncReplDegradation{Policy: SyncReplDegradationPolicyDegradeAfterGrace, GracePeriod: &Duration{}},
+			err: errors.New("syncReplDegradation gracePeriod must be positive"),
+		},
+	}
+
+	for i, tt := range tests {
+		s := &ClusterSpec{
+			InitMode:            ClusterInitModeP(ClusterInitModeNew),
+			SyncReplDegradation: tt.d,
+		}
+		err := s.Validate()
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestValidateGracefulDemotion(t *testing.T) {
+	tests := []struct {
+		g                 *GracefulDemotion
+		switchoverTimeout *Duration
+		err               error
+	}{
+		{},
+		{
+			g: &GracefulDemotion{RejectConnections: true},
+		},
+		{
+			g: &GracefulDemotion{DrainTimeout: &Duration{Duration: 10 * time.Second}},
+		},
+		{
+			g:   &GracefulDemotion{DrainTimeout: &Duration{}},
+			err: errors.New("gracefulDemotion drainTimeout must be positive"),
+		},
+		{
+			g:                 &GracefulDemotion{},
+			switchoverTimeout: &Duration{Duration: 20 * time.Second},
+			err:               errors.New("gracefulDemotion drainTimeout must be lower than switchoverTimeout"),
+		},
+	}
+
+	for i, tt := range tests {
+		s := &ClusterSpec{
+			InitMode:          ClusterInitModeP(ClusterInitModeNew),
+			SwitchoverTimeout: tt.switchoverTimeout,
+			GracefulDemotion:  tt.g,
+		}
+		err := s.Validate()
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestAutomaticResyncBackoff(t *testing.T) {
+	c := &AutomaticResyncConfig{InitialBackoff: &Duration{Duration: time.Minute}, MaxBackoff: &Duration{Duration: 10 * time.Minute}}
+	tests := []struct {
+		c        *AutomaticResyncConfig
+		attempts int
+		out      time.Duration
+	}{
+		{c: nil, attempts: 1, out: DefaultResyncInitialBackoff},
+		{c: nil, attempts: 20, out: DefaultResyncMaxBackoff},
+		{c: c, attempts: 1, out: time.Minute},
+		{c: c, attempts: 2, out: 2 * time.Minute},
+		{c: c, attempts: 4, out: 8 * time.Minute},
+		{c: c, attempts: 5, out: 10 * time.Minute},
+		{c: c, attempts: 100, out: 10 * time.Minute},
+	}
+
+	for i, tt := range tests {
+		if out := tt.c.Backoff(tt.attempts); out != tt.out {
+			t.Errorf("#%d: got backoff: %s, want: %s", i, out, tt.out)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		in  string
+		out Tags
+		err error
+	}{
+		{
+			in:  "",
+			out: Tags{},
+		},
+		{
+			in:  "zone=zone1",
+			out: Tags{"zone": "zone1"},
+		},
+		{
+			in:  " zone = zone1 , rack=rack1,empty=",
+			out: Tags{"zone": "zone1", "rack": "rack1", "empty": ""},
+		},
+		{
+			in:  "zone",
+			err: errors.New(`wrong tag "zone", must be in the form key=value`),
+		},
+		{
+			in:  "=zone1",
+			err: errors.New("empty tag key"),
+		},
+		{
+			in:  "zone=zone1,zone=zone2",
+			err: errors.New(`duplicated tag "zone"`),
+		},
+		{
+			in:  "zone=zone1,",
+			err: errors.New(`wrong tag "", must be in the form key=value`),
+		},
+	}
+
+	for i, tt := range tests {
+		out, err := ParseTags(tt.in)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("#%d: unexpected error: %v", i, err)
+			} else if !reflect.DeepEqual(out, tt.out) {
+				t.Errorf("#%d: wrong tags: got: %v, want: %v", i, out, tt.out)
+			}
+			// the string representation must be parsed back to the same tags
+			if nout, err := ParseTags(out.String()); err != nil || !reflect.DeepEqual(nout, out) {
+				t.Errorf("#%d: tags string %q not parsed back to the same tags", i, out.String())
+			}
+		}
+	}
+}
+
+func TestValidateBasebackupConfig(t *testing.T) {
+	tests := []struct {
+		in  *BasebackupConfig
+		err error
+	}{
+		{
+			in: nil,
+		},
+		{
+			in: &BasebackupConfig{MaxRate: "100M", ParallelWorkers: 4, CheckpointMode: BasebackupCheckpointFast},
+		},
+		{
+			in: &BasebackupConfig{MaxRate: "32"},
+		},
+		{
+			in: &BasebackupConfig{MaxRate: "1024M"},
+		},
+		{
+			in:  &BasebackupConfig{MaxRate: "31k"},
+			err: errors.New("basebackupConfig.maxRate must be between 32k and 1024M"),
+		},
+		{
+			in:  &BasebackupConfig{MaxRate: "1025M"},
+			err: errors.New("basebackupConfig.maxRate must be between 32k and 1024M"),
+		},
+		{
+			in:  &BasebackupConfig{MaxRate: "100MB"},
+			err: errors.New(`wrong basebackupConfig.maxRate "100MB"`),
+		},
+		{
+			in:  &BasebackupConfig{CheckpointMode: "slow"},
+			err: errors.New(`unknown basebackupConfig.checkpointMode: "slow"`),
+		},
+		{
+			in: &BasebackupConfig{WalMethod: BasebackupWalMethodFetch, Compression: BasebackupCompressionZstd, CompressionLevel: 22},
+		},
+		{
+			in: &BasebackupConfig{Compression: BasebackupCompressionLZ4},
+		},
+		{
+			in:  &BasebackupConfig{WalMethod: "none"},
+			err: errors.New(`unknown basebackupConfig.walMethod: "none"`),
+		},
+		{
+			in:  &BasebackupConfig{Compression: "bzip2"},
+			err: errors.New(`unknown basebackupConfig.compression: "bzip2"`),
+		},
+		{
+			in:  &BasebackupConfig{Compression: BasebackupCompressionGzip, CompressionLevel: 10},
+			err: errors.New(`basebackupConfig.compressionLevel must be between 1 and 9 for "gzip" compression`),
+		},
+		{
+			in:  &BasebackupConfig{CompressionLevel: 5},
+			err: errors.New("basebackupConfig.compressionLevel requires basebackupConfig.compression"),
+		},
+	}
+
+	for i, tt := range tests {
+		err := validateBasebackupConfig(tt.in)
+
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else {
+			if err != nil {
+				t.Errorf("#%d: unexpected error: %v", i, err)
+			}
+		}
+	}
+}
+
+func TestValidateResyncMethod(t *testing.T) {
+	tests := []struct {
+		resyncMethod     ResyncMethod
+		pgBackRestConfig *PgBackRestConfig
+		err              error
+	}{
+		{
+			resyncMethod: ResyncMethodBasebackup,
+		},
+		{
+			resyncMethod:     ResyncMethodPgBackRest,
+			pgBackRestConfig: &PgBackRestConfig{Stanza: "main"},
+		},
+		{
+			resyncMethod: ResyncMethodPgBackRest,
+			err:          errors.New(`pgBackRestConfig.stanza must be defined when resyncMethod is "pgbackrest"`),
+		},
+		{
+			resyncMethod:     ResyncMethodPgBackRest,
+			pgBackRestConfig: &PgBackRestConfig{ConfigPath: "/etc/pgbackrest.conf"},
+			err:              errors.New(`pgBackRestConfig.stanza must be defined when resyncMethod is "pgbackrest"`),
+		},
+		{
+			resyncMethod: ResyncMethodWalG,
+		},
+		{
+			resyncMethod: "rsync",
+			err:          errors.New(`unknown resyncMethod: "rsync"`),
+		},
+	}
+
+	for i, tt := range tests {
+		s := &ClusterSpec{
+			InitMode:         ClusterInitModeP(ClusterInitModeNew),
+			ResyncMethod:     ResyncMethodP(tt.resyncMethod),
+			PgBackRestConfig: tt.pgBackRestConfig,
+		}
+		err := s.Validate()
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestValidatePGCtlOptions(t *testing.T) {
+	tests := []struct {
+		stopMode       *PGStopMode
+		stopTimeout    *Duration
+		promoteTimeout *Duration
+		err            error
+	}{
+		{},
+		{
+			stopMode:       PGStopModeP(PGStopModeSmart),
+			stopTimeout:    &Duration{Duration: 5 * time.Minute},
+			promoteTimeout: &Duration{Duration: 10 * time.Second},
+		},
+		{
+			stopMode: PGStopModeP(PGStopModeImmediate),
+		},
+		{
+			stopMode: PGStopModeP("abort"),
+			err:      errors.New(`unknown pgStopMode: "abort"`),
+		},
+		{
+			stopTimeout: &Duration{Duration: 0},
+			err:         errors.New("pgStopTimeout must be greater than 0"),
+		},
+		{
+			promoteTimeout: &Duration{Duration: -time.Second},
+			err:            errors.New("pgPromoteTimeout must be greater than 0"),
+		},
+	}
+
+	for i, tt := range tests {
+		s := &ClusterSpec{
+			InitMode:         ClusterInitModeP(ClusterInitModeNew),
+			PGStopMode:       tt.stopMode,
+			PGStopTimeout:    tt.stopTimeout,
+			PGPromoteTimeout: tt.promoteTimeout,
+		}
+		err := s.Validate()
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestValidateSyncStandbySelection(t *testing.T) {
+	tests := []struct {
+		selection *SyncStandbySelection
+		maxLag    *uint32
+		err       error
+	}{
+		{},
+		{
+			selection: SyncStandbySelectionP(SyncStandbySelectionLag),
+		},
+		{
+			selection: SyncStandbySelectionP(SyncStandbySelectionLag),
+			maxLag:    Uint32P(1024),
+		},
+		{
+			selection: SyncStandbySelectionP(SyncStandbySelectionLag),
+			maxLag:    Uint32P(0),
+			err:       errors.New("syncStandbyMaxReplayLag must be greater than 0"),
+		},
+		// the max replay lag is used only with the lag selection
+		{
+			selection: SyncStandbySelectionP(SyncStandbySelectionAny),
+			maxLag:    Uint32P(0),
+		},
+		{
+			selection: SyncStandbySelectionP("random"),
+			err:       errors.New(`unknown syncStandbySelection: "random"`),
+		},
+	}
+
+	for i, tt := range tests {
+		s := &ClusterSpec{
+			InitMode:                ClusterInitModeP(ClusterInitModeNew),
+			SyncStandbySelection:    tt.selection,
+			SyncStandbyMaxReplayLag: tt.maxLag,
+		}
+		err := s.Validate()
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestValidateResyncStrategies(t *testing.T) {
+	tests := []struct {
+		strategies       []ResyncStrategy
+		usePgrewind      bool
+		pgBackRestConfig *PgBackRestConfig
+		err              error
+	}{
+		{},
+		{
+			strategies: []ResyncStrategy{
+				{Type: ResyncStrategyPgRewind, Timeout: &Duration{Duration: 5 * time.Minute}},
+				{Type: ResyncStrategyPgBackRest},
+				{Type: ResyncStrategyWalG},
+				{Type: ResyncStrategyCommand, Command: "restore.sh"},
+				{Type: ResyncStrategyRsync, RsyncSource: "rsync://${STOLON_FOLLOWED_HOST}/pgdata/"},
+				{Type: ResyncStrategyBasebackup},
+			},
+			usePgrewind:      true,
+			pgBackRestConfig: &PgBackRestConfig{Stanza: "main"},
+		},
+		{
+			strategies: []ResyncStrategy{{Type: ResyncStrategyPgRewind}},
+			err:        errors.New(`wrong resyncStrategies entry #0: "pgrewind" requires usePgrewind`),
+		},
+		{
+			strategies:  []ResyncStrategy{{Type: ResyncStrategyBasebackup}, {Type: ResyncStrategyPgRewind}},
+			usePgrewind: true,
+			err:         errors.New(`wrong resyncStrategies entry #1: "pgrewind" must be the first strategy`),
+		},
+		{
+			strategies: []ResyncStrategy{{Type: ResyncStrategyPgBackRest}},
+			err:        errors.New(`wrong resyncStrategies entry #0: pgBackRestConfig.stanza must be defined`),
+		},
+		{
+			strategies: []ResyncStrategy{{Type: ResyncStrategyCommand}},
+			err:        errors.New(`wrong resyncStrategies entry #0: command must be defined`),
+		},
+		{
+			strategies: []ResyncStrategy{{Type: ResyncStrategyBasebackup, Command: "restore.sh"}},
+			err:        errors.New(`wrong resyncStrategies entry #0: command can be defined only with type "command"`),
+		},
+		{
+			strategies: []ResyncStrategy{{Type: ResyncStrategyWalG, Timeout: &Duration{Duration: -1}}},
+			err:        errors.New(`wrong resyncStrategies entry #0: timeout must be positive`),
+		},
+		{
+			strategies: []ResyncStrategy{{Type: ResyncStrategyBasebackup}, {Type: ResyncStrategyBasebackup}},
+			err:        errors.New(`wrong resyncStrategies entry #1: duplicated type "basebackup"`),
+		},
+		{
+			strategies: []ResyncStrategy{{Type: ResyncStrategyRsync}},
+			err:        errors.New(`wrong resyncStrategies entry #0: rsyncSource must be defined`),
+		},
+		{
+			strategies: []ResyncStrategy{{Type: ResyncStrategyBasebackup, RsyncSource: "rsync://host/pgdata/"}},
+			err:        errors.New(`wrong resyncStrategies entry #0: rsyncSource can be defined only with type "rsync"`),
+		},
+		{
+			strategies: []ResyncStrategy{{Type: "barman"}},
+			err:        errors.New(`wrong resyncStrategies entry #0: unknown type "barman"`),
+		},
+	}
+
+	for i, tt := range tests {
+		s := &ClusterSpec{
+			InitMode:         ClusterInitModeP(ClusterInitModeNew),
+			UsePgrewind:      BoolP(tt.usePgrewind),
+			PgBackRestConfig: tt.pgBackRestConfig,
+			ResyncStrategies: tt.strategies,
+		}
+		err := s.Validate()
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestValidateBackupConfig(t *testing.T) {
+	interval := &Duration{Duration: 24 * time.Hour}
+	tests := []struct {
+		config           *BackupConfig
+		pgBackRestConfig *PgBackRestConfig
+		err              error
+	}{
+		{},
+		{
+			config:           &BackupConfig{Method: BackupMethodPgBackRest, Interval: interval},
+			pgBackRestConfig: &PgBackRestConfig{Stanza: "main"},
+		},
+		{
+			config: &BackupConfig{Method: BackupMethodWalG, Interval: interval, Timeout: &Duration{Duration: time.Hour}},
+		},
+		{
+			config: &BackupConfig{Method: BackupMethodCommand, Command: "backup.sh", Interval: interval},
+		},
+		{
+			config: &BackupConfig{Method: BackupMethodPgBackRest, Interval: interval},
+			err:    errors.New(`pgBackRestConfig.stanza must be defined when backupConfig.method is "pgbackrest"`),
+		},
+		{
+			config: &BackupConfig{Method: BackupMethodCommand, Interval: interval},
+			err:    errors.New(`backupConfig.command must be defined when backupConfig.method is "command"`),
+		},
+		{
+			config: &BackupConfig{Method: BackupMethodWalG, Command: "backup.sh", Interval: interval},
+			err:    errors.New(`backupConfig.command can be defined only when backupConfig.method is "command"`),
+		},
+		{
+			config: &BackupConfig{Interval: interval},
+			err:    errors.New(`backupConfig.method must be defined`),
+		},
+		{
+			config: &BackupConfig{Method: "barman", Interval: interval},
+			err:    errors.New(`unknown backupConfig.method: "barman"`),
+		},
+		{
+			config: &BackupConfig{Method: BackupMethodWalG},
+			err:    errors.New(`backupConfig.interval must be greater than 0`),
+		},
+		{
+			config: &BackupConfig{Method: BackupMethodWalG, Interval: interval, Timeout: &Duration{}},
+			err:    errors.New(`backupConfig.timeout must be greater than 0`),
+		},
+	}
+
+	for i, tt := range tests {
+		s := &ClusterSpec{
+			InitMode:         ClusterInitModeP(ClusterInitModeNew),
+			PgBackRestConfig: tt.pgBackRestConfig,
+			BackupConfig:     tt.config,
+		}
+		err := s.Validate()
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestValidateChecksumsVerificationConfig(t *testing.T) {
+	interval := &Duration{Duration: 24 * time.Hour}
+	tests := []struct {
+		config *ChecksumsVerificationConfig
+		err    error
+	}{
+		{},
+		{
+			config: &ChecksumsVerificationConfig{Interval: interval},
+		},
+		{
+			config: &ChecksumsVerificationConfig{Interval: interval, Timeout: &Duration{Duration: 3 * time.Hour}},
+		},
+		{
+			config: &ChecksumsVerificationConfig{},
+			err:    errors.New(`checksumsVerificationConfig.interval must be greater than 0`),
+		},
+		{
+			config: &ChecksumsVerificationConfig{Interval: interval, Timeout: &Duration{}},
+			err:    errors.New(`checksumsVerificationConfig.timeout must be greater than 0`),
+		},
+	}
+
+	for i, tt := range tests {
+		s := &ClusterSpec{
+			InitMode:                    ClusterInitModeP(ClusterInitModeNew),
+			ChecksumsVerificationConfig: tt.config,
+		}
+		err := s.Validate()
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestHBARuleValidate(t *testing.T) {
+	tests := []struct {
+		rule HBARule
+		err  error
+	}{
+		{
+			rule: HBARule{Type: "host", Database: "all", User: "all", Address: "10.0.0.0/8", Method: "md5"},
+		},
+		{
+			rule: HBARule{Type: "hostssl", Database: "app,other", User: "+appgroup", Address: "::1/128", Method: "scram-sha-256"},
+		},
+		{
+			rule: HBARule{Type: "host", Database: "all", User: "all", Address: ".example.com", Method: "ldap", Options: map[string]string{"ldapserver": "ldap.example.com"}},
+		},
+		{
+			rule: HBARule{Type: "host", Database: "all", User: "all", Address: "samenet", Method: "trust"},
+		},
+		{
+			rule: HBARule{Type: "local", Database: "all", User: "all", Method: "peer"},
+		},
+		{
+			rule: HBARule{Type: "hostx", Database: "all", User: "all", Address: "10.0.0.0/8", Method: "md5"},
+			err:  errors.New(`unknown type "hostx"`),
+		},
+		{
+			rule: HBARule{Type: "host", User: "all", Address: "10.0.0.0/8", Method: "md5"},
+			err:  errors.New(`database must be defined`),
+		},
+		{
+			rule: HBARule{Type: "host", Database: "all", User: "all users", Address: "10.0.0.0/8", Method: "md5"},
+			err:  errors.New(`wrong user "all users"`),
+		},
+		{
+			rule: HBARule{Type: "local", Database: "all", User: "all", Address: "10.0.0.0/8", Method: "peer"},
+			err:  errors.New(`address cannot be defined with type local`),
+		},
+		{
+			rule: HBARule{Type: "host", Database: "all", User: "all", Method: "md5"},
+			err:  errors.New(`address must be defined with type host`),
+		},
+		{
+			rule: HBARule{Type: "host", Database: "all", User: "all", Address: "10.0.0.0/33", Method: "md5"},
+			err:  errors.New(`wrong address "10.0.0.0/33": invalid CIDR address: 10.0.0.0/33`),
+		},
+		{
+			rule: HBARule{Type: "host", Database: "all", User: "all", Address: "10.0.0.0 255.0.0.0", Method: "md5"},
+			err:  errors.New(`wrong address "10.0.0.0 255.0.0.0"`),
+		},
+		{
+			rule: HBARule{Type: "host", Database: "all", User: "all", Address: "10.0.0.0/8", Method: "md6"},
+			err:  errors.New(`unknown method "md6"`),
+		},
+		{
+			rule: HBARule{Type: "host", Database: "all", User: "all", Address: "10.0.0.0/8", Method: "ldap", Options: map[string]string{"ldapserver": "ldap\"server"}},
+			err:  errors.New(`wrong option "ldapserver" value "ldap\"server"`),
+		},
+	}
+
+	for i, tt := range tests {
+		err := tt.rule.Validate()
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestIdentMappingValidate(t *testing.T) {
+	tests := []struct {
+		mapping IdentMapping
+		err     error
+	}{
+		{
+			mapping: IdentMapping{MapName: "certmap", SystemUsername: "app.example.com", PGUsername: "app"},
+		},
+		{
+			mapping: IdentMapping{MapName: "krb", SystemUsername: `/^(.*)@EXAMPLE\.COM$`, PGUsername: `\1`},
+		},
+		{
+			mapping: IdentMapping{MapName: "certmap", SystemUsername: "CN=App User", PGUsername: "app"},
+		},
+		{
+			mapping: IdentMapping{SystemUsername: "app", PGUsername: "app"},
+			err:     errors.New("mapName must be defined"),
+		},
+		{
+			mapping: IdentMapping{MapName: "certmap", PGUsername: "app"},
+			err:     errors.New("systemUsername must be defined"),
+		},
+		{
+			mapping: IdentMapping{MapName: "cert map", SystemUsername: "app", PGUsername: "app"},
+			err:     errors.New(`wrong mapName "cert map"`),
+		},
+		{
+			mapping: IdentMapping{MapName: "certmap", SystemUsername: "app", PGUsername: "app\nother"},
+			err:     errors.New(`wrong pgUsername "app\nother"`),
+		},
+		{
+			mapping: IdentMapping{MapName: "certmap", SystemUsername: `app"`, PGUsername: "app"},
+			err:     errors.New(`wrong systemUsername "app\""`),
+		},
+	}
+
+	for i, tt := range tests {
+		err := tt.mapping.Validate()
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestMonitoringUserValidate(t *testing.T) {
+	tests := []struct {
+		user MonitoringUser
+		err  error
+	}{
+		{
+			user: MonitoringUser{Username: "monitor"},
+		},
+		{
+			user: MonitoringUser{Username: "stolon_monitor", Addresses: []string{"10.0.0.0/8", "fd00::/8"}},
+		},
+		{
+			user: MonitoringUser{},
+			err:  errors.New("username must be defined"),
+		},
+		{
+			user: MonitoringUser{Username: "Monitor"},
+			err:  errors.New(`wrong username "Monitor"`),
+		},
+		{
+			user: MonitoringUser{Username: "monitor\"; drop role app; --"},
+			err:  errors.New(`wrong username "monitor\"; drop role app; --"`),
+		},
+		{
+			user: MonitoringUser{Username: "pg_monitor"},
+			err:  errors.New(`wrong username "pg_monitor": the pg_ prefix is reserved`),
+		},
+		{
+			user: MonitoringUser{Username: "monitor", Addresses: []string{"10.0.0.1"}},
+			err:  errors.New(`wrong address "10.0.0.1": invalid CIDR address: 10.0.0.1`),
+		},
+	}
+
+	for i, tt := range tests {
+		err := tt.user.Validate()
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestExtensionValidate(t *testing.T) {
+	tests := []struct {
+		ext Extension
+		err error
+	}{
+		{
+			ext: Extension{Name: "pg_stat_statements", SharedPreloadLibraries: []string{"pg_stat_statements"}},
+		},
+		{
+			ext: Extension{Name: "postgis", Version: "3.1.0", Schema: "gis", Databases: []string{"app"}},
+		},
+		{
+			ext: Extension{},
+			err: errors.New("name must be defined"),
+		},
+		{
+			ext: Extension{Name: "pgaudit", Databases: []string{""}},
+			err: errors.New("empty database name"),
+		},
+		{
+			ext: Extension{Name: "pgaudit", SharedPreloadLibraries: []string{"pgaudit,auto_explain"}},
+			err: errors.New(`wrong shared preload library "pgaudit,auto_explain"`),
+		},
+	}
+
+	for i, tt := range tests {
+		err := tt.ext.Validate()
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestExtensionsSharedPreloadLibraries(t *testing.T) {
+	extensions := []Extension{
+		{Name: "pgaudit", SharedPreloadLibraries: []string{"pgaudit"}},
+		{Name: "postgis"},
+		{Name: "pg_stat_statements", SharedPreloadLibraries: []string{"pg_stat_statements", "pgaudit"}},
+	}
+	libs := ExtensionsSharedPreloadLibraries(extensions)
+	if expected := []string{"pg_stat_statements", "pgaudit"}; !reflect.DeepEqual(libs, expected) {
+		t.Errorf("got libraries: %v, want: %v", libs, expected)
+	}
+}
+
+func TestIdentMappingString(t *testing.T) {
+	tests := []struct {
+		mapping IdentMapping
+		out     string
+	}{
+		{
+			mapping: IdentMapping{MapName: "certmap", SystemUsername: "app.example.com", PGUsername: "app"},
+			out:     "certmap app.example.com app",
+		},
+		{
+			mapping: IdentMapping{MapName: "certmap", SystemUsername: "CN=App User", PGUsername: "app#1"},
+			out:     `certmap "CN=App User" "app#1"`,
+		},
+	}
+
+	for i, tt := range tests {
+		if out := tt.mapping.String(); out != tt.out {
+			t.Errorf("#%d: got: %q, want: %q", i, out, tt.out)
+		}
+	}
+}
+
+func TestValidateCascadingStandbys(t *testing.T) {
+	tests := []struct {
+		cascadingStandbys map[string]string
+		err               error
+	}{
+		{},
+		{
+			cascadingStandbys: map[string]string{"keeper3": "keeper2", "keeper4": "keeper3"},
+		},
+		{
+			cascadingStandbys: map[string]string{"keeper3": "keeper3"},
+			err:               errors.New(`keeper "keeper3" follows itself`),
+		},
+		{
+			cascadingStandbys: map[string]string{"keeper3": "keeper2", "keeper2": "keeper3"},
+			err:               errors.New(`keeper "keeper2" follows itself`),
+		},
+		{
+			cascadingStandbys: map[string]string{"keeper3": ""},
+			err:               errors.New(`empty keeper uid`),
+		},
+	}
+
+	for i, tt := range tests {
+		err := validateCascadingStandbys(tt.cascadingStandbys)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestValidateFencing(t *testing.T) {
+	tests := []struct {
+		s   *ClusterSpec
+		err error
+	}{
+		{
+			s: &ClusterSpec{FencingCommand: StringP("/usr/local/bin/fence"), FencingURL: StringP("https://fencer:8443/fence"), FencingPolicy: FencingPolicyP(FencingPolicyFailOpen)},
+		},
+		{
+			s:   &ClusterSpec{FencingTimeout: &Duration{Duration: 0}},
+			err: errors.New("fencingTimeout must be greater than 0"),
+		},
+		{
+			s:   &ClusterSpec{FencingPolicy: FencingPolicyP("ignore")},
+			err: errors.New(`unknown fencingPolicy: "ignore"`),
+		},
+		{
+			s:   &ClusterSpec{FencingURL: StringP("fencer:8443/fence")},
+			err: errors.New("fencingURL must be an http or https url"),
+		},
+	}
+
+	for i, tt := range tests {
+		s := tt.s
+		s.InitMode = ClusterInitModeP(ClusterInitModeNew)
+		err := s.Validate()
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestValidateStandbyAutoPromote(t *testing.T) {
+	tests := []struct {
+		s   *ClusterSpec
+		err error
+	}{
+		{
+			s: &ClusterSpec{StandbyConfig: &StandbyConfig{StandbySettings: &StandbySettings{PrimaryConninfo: "host=primary"}}, StandbyAutoPromote: BoolP(true)},
+		},
+		{
+			s:   &ClusterSpec{StandbyConfig: &StandbyConfig{ArchiveRecoverySettings: &ArchiveRecoverySettings{RestoreCommand: "cp /archive/%f %p"}}, StandbyAutoPromote: BoolP(true)},
+			err: errors.New("standbyAutoPromote requires the standbyConfig standbySettings primaryConninfo"),
+		},
+		{
+			s:   &ClusterSpec{StandbyConfig: &StandbyConfig{StandbySettings: &StandbySettings{PrimaryConninfo: "host=primary"}}, StandbyAutoPromote: BoolP(true), StandbyAutoPromoteTimeout: &Duration{Duration: 0}},
+			err: errors.New("standbyAutoPromoteTimeout must be greater than 0"),
+		},
+	}
+
+	for i, tt := range tests {
+		s := tt.s
+		s.InitMode = ClusterInitModeP(ClusterInitModeExisting)
+		s.ExistingConfig = &ExistingConfig{KeeperUID: "keeper1"}
+		s.Role = ClusterRoleP(ClusterRoleStandby)
+		err := s.Validate()
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestPostgresBinaryVersionSameMajor(t *testing.T) {
+	tests := []struct {
+		v    PostgresBinaryVersion
+		o    PostgresBinaryVersion
+		same bool
+	}{
+		{v: PostgresBinaryVersion{Maj: 12, Min: 4}, o: PostgresBinaryVersion{Maj: 12, Min: 6}, same: true},
+		{v: PostgresBinaryVersion{Maj: 12, Min: 4}, o: PostgresBinaryVersion{Maj: 13, Min: 4}, same: false},
+		{v: PostgresBinaryVersion{Maj: 9, Min: 6}, o: PostgresBinaryVersion{Maj: 9, Min: 6}, same: true},
+		{v: PostgresBinaryVersion{Maj: 9, Min: 5}, o: PostgresBinaryVersion{Maj: 9, Min: 6}, same: false},
+		{v: PostgresBinaryVersion{Maj: 9, Min: 6}, o: PostgresBinaryVersion{Maj: 10, Min: 0}, same: false},
+		// unknown version
+		{v: PostgresBinaryVersion{}, o: PostgresBinaryVersion{Maj: 12, Min: 4}, same: true},
+	}
+
+	for i, tt := range tests {
+		if same := tt.v.SameMajor(tt.o); same != tt.same {
+			t.Errorf("#%d: got: %t, want: %t", i, same, tt.same)
+		}
+		if same := tt.o.SameMajor(tt.v); same != tt.same {
+			t.Errorf("#%d: got: %t for the reversed versions, want: %t", i, same, tt.same)
+		}
+	}
+}
+
+func TestValidateMasterElection(t *testing.T) {
+	tests := []struct {
+		strategy *MasterElectionStrategy
+		command  *string
+		url      *string
+		timeout  *Duration
+		err      error
+	}{
+		{},
+		{
+			strategy: MasterElectionStrategyP(MasterElectionStrategyMaxLSN),
+		},
+		{
+			strategy: MasterElectionStrategyP(MasterElectionStrategyZoneAware),
+		},
+		{
+			strategy: MasterElectionStrategyP(MasterElectionStrategyCommand),
+			command:  StringP("/usr/local/bin/elect"),
+		},
+		{
+			strategy: MasterElectionStrategyP(MasterElectionStrategyURL),
+			url:      StringP("https://election.example.com/elect"),
+			timeout:  &Duration{Duration: 2 * time.Second},
+		},
+		{
+			strategy: MasterElectionStrategyP("unknown"),
+			err:      errors.New(`unknown masterElectionStrategy: "unknown"`),
+		},
+		{
+			strategy: MasterElectionStrategyP(MasterElectionStrategyCommand),
+			err:      errors.New(`masterElectionCommand must be defined when masterElectionStrategy is "command"`),
+		},
+		{
+			strategy: MasterElectionStrategyP(MasterElectionStrategyURL),
+			err:      errors.New(`masterElectionURL must be defined when masterElectionStrategy is "url"`),
+		},
+		{
+			command: StringP("/usr/local/bin/elect"),
+			err:     errors.New(`masterElectionCommand can be defined only when masterElectionStrategy is "command"`),
+		},
+		{
+			strategy: MasterElectionStrategyP(MasterElectionStrategyCommand),
+			command:  StringP("/usr/local/bin/elect"),
+			url:      StringP("https://election.example.com/elect"),
+			err:      errors.New(`masterElectionURL can be defined only when masterElectionStrategy is "url"`),
+		},
+		{
+			strategy: MasterElectionStrategyP(MasterElectionStrategyURL),
+			url:      StringP("election.example.com"),
+			err:      errors.New("masterElectionURL must be an http or https url"),
+		},
+		{
+			timeout: &Duration{Duration: 0},
+			err:     errors.New("masterElectionTimeout must be greater than 0"),
+		},
+	}
+
+	for i, tt := range tests {
+		s := &ClusterSpec{
+			InitMode:               ClusterInitModeP(ClusterInitModeNew),
+			MasterElectionStrategy: tt.strategy,
+			MasterElectionCommand:  tt.command,
+			MasterElectionURL:      tt.url,
+			MasterElectionTimeout:  tt.timeout,
+		}
+		err := s.Validate()
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestSelectListenAddress(t *testing.T) {
+	tests := []struct {
+		main       string
+		additional []string
+		family     AddressFamily
+		out        string
+	}{
+		{main: "192.168.0.1", additional: []string{"fd00::1"}, family: AddressFamilyAny, out: "192.168.0.1"},
+		{main: "192.168.0.1", additional: []string{"fd00::1"}, family: AddressFamilyIPv4, out: "192.168.0.1"},
+		{main: "192.168.0.1", additional: []string{"fd00::1"}, family: AddressFamilyIPv6, out: "fd00::1"},
+		{main: "fd00::1", additional: []string{"db1.example.com", "192.168.0.1", "192.168.0.2"}, family: AddressFamilyIPv4, out: "192.168.0.1"},
+		// IPv4-mapped IPv6 addresses are IPv4 addresses
+		{main: "::ffff:192.168.0.1", additional: []string{"fd00::1"}, family: AddressFamilyIPv4, out: "::ffff:192.168.0.1"},
+		// no address of the family
+		{main: "192.168.0.1", family: AddressFamilyIPv6, out: "192.168.0.1"},
+		{main: "db1.example.com", additional: []string{"db1.internal"}, family: AddressFamilyIPv4, out: "db1.example.com"},
+	}
+
+	for i, tt := range tests {
+		if out := SelectListenAddress(tt.main, tt.additional, tt.family); out != tt.out {
+			t.Errorf("#%d: got address: %q, want: %q", i, out, tt.out)
+		}
+	}
+}
+
+func TestValidatePreferredAddressFamily(t *testing.T) {
+	tests := []struct {
+		s   *ClusterSpec
+		err error
+	}{
+		{
+			s: &ClusterSpec{},
+		},
+		{
+			s: &ClusterSpec{PreferredAddressFamily: AddressFamilyP(AddressFamilyIPv6)},
+		},
+		{
+			s:   &ClusterSpec{PreferredAddressFamily: AddressFamilyP("inet6")},
+			err: errors.New(`unknown preferredAddressFamily: "inet6"`),
+		},
+	}
+
+	for i, tt := range tests {
+		s := tt.s
+		s.InitMode = ClusterInitModeP(ClusterInitModeNew)
+		err := s.Validate()
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+	}
+}
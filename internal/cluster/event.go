@@ -0,0 +1,56 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"time"
+)
+
+// EventType is the type of a cluster event notified by the sentinel
+type EventType string
+
+const (
+	// A new master db has been elected
+	EventMasterElected EventType = "masterElected"
+	// A keeper has been marked as failed
+	EventKeeperFailed EventType = "keeperFailed"
+	// The synchronous standbys of the master db have changed
+	EventSynchronousStandbysChanged EventType = "synchronousStandbysChanged"
+	// The cluster has no master db or its keeper has failed
+	EventClusterUnhealthy EventType = "clusterUnhealthy"
+	// The cluster has an healthy master db again
+	EventClusterHealthy EventType = "clusterHealthy"
+	// The standby cluster has been promoted to a primary cluster
+	EventStandbyClusterPromoted EventType = "standbyClusterPromoted"
+)
+
+// Event is a cluster event notified by the sentinel
+type Event struct {
+	Type       EventType `json:"type"`
+	Time       time.Time `json:"time"`
+	ClusterUID string    `json:"clusterUID"`
+
+	DBUID     string `json:"dbUID,omitempty"`
+	KeeperUID string `json:"keeperUID,omitempty"`
+	// PreviousMasterDBUID is the previous master db of a masterElected
+	// event
+	PreviousMasterDBUID string `json:"previousMasterDBUID,omitempty"`
+	// SynchronousStandbys are the new synchronous standbys of a
+	// synchronousStandbysChanged event
+	SynchronousStandbys []string `json:"synchronousStandbys,omitempty"`
+	// DryRun reports that the event hasn't really happened since the
+	// sentinel, in dry run mode, didn't write the cluster data
+	DryRun bool `json:"dryRun,omitempty"`
+}
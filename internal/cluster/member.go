@@ -16,8 +16,10 @@ package cluster
 
 import (
 	"reflect"
+	"time"
 
 	"github.com/sorintlab/stolon/internal/common"
+	"github.com/sorintlab/stolon/internal/util"
 
 	"github.com/mitchellh/copystructure"
 )
@@ -48,8 +50,64 @@ type KeeperInfo struct {
 	BootUUID   string `json:"bootUUID,omitempty"`
 
 	PostgresBinaryVersion PostgresBinaryVersion `json:"postgresBinaryVersion,omitempty"`
+	// PostgresVersion is the full version of the postgres binaries
+	PostgresVersion string `json:"postgresVersion,omitempty"`
+	// PGBinPath is the path of the postgres binaries in use
+	PGBinPath string `json:"pgBinPath,omitempty"`
 
 	PostgresState *PostgresState `json:"postgresState,omitempty"`
+
+	// DeclinedMasterDBUID is the uid of the db for which the keeper declined
+	// the master role since its pre master validation failed
+	DeclinedMasterDBUID string `json:"declinedMasterDBUID,omitempty"`
+
+	// PrePromotionHookResult is the result of the last pre promotion hook
+	// execution
+	PrePromotionHookResult *PrePromotionHookResult `json:"prePromotionHookResult,omitempty"`
+
+	// PostInitHookResult is the result of the last post init hook execution
+	PostInitHookResult *PostInitHookResult `json:"postInitHookResult,omitempty"`
+
+	// TimelineDivergence is reported when the keeper refuses to start its
+	// db as master since it's an old primary
+	TimelineDivergence *TimelineDivergence `json:"timelineDivergence,omitempty"`
+
+	// Backup is the last scheduled backup requested to the keeper
+	Backup *Backup `json:"backup,omitempty"`
+
+	// ChecksumsVerification is the last data checksums verification done by
+	// the keeper
+	ChecksumsVerification *ChecksumsVerification `json:"checksumsVerification,omitempty"`
+
+	// ResyncVerification is the verification of the last resync done by
+	// the keeper
+	ResyncVerification *ResyncVerification `json:"resyncVerification,omitempty"`
+
+	// Tags are the keeper tags
+	Tags Tags `json:"tags,omitempty"`
+
+	// RecoveryMinApplyDelay is the apply delay of the keeper db when it's a
+	// delayed standby
+	RecoveryMinApplyDelay *Duration `json:"recoveryMinApplyDelay,omitempty"`
+
+	// Fenced reports that the keeper has been fenced and its postgres
+	// instance stopped
+	Fenced bool `json:"fenced,omitempty"`
+
+	// Removal is the status of the last removal request handled
+	Removal *KeeperRemovalStatus `json:"removal,omitempty"`
+
+	// GracefulDemotion is the status of the master db drain requested
+	// during a switchover
+	GracefulDemotion *GracefulDemotionStatus `json:"gracefulDemotion,omitempty"`
+
+	// Passwords is the passwords rotation state, reported when the keeper
+	// has been started with --coordinated-password-rotation
+	Passwords *KeeperPasswordsStatus `json:"passwords,omitempty"`
+
+	// Time is the keeper clock time when the info has been written, used to
+	// detect the clock skews between the components
+	Time time.Time `json:"time,omitempty"`
 }
 
 func (k *KeeperInfo) DeepCopy() *KeeperInfo {
@@ -86,9 +144,14 @@ func (tlsh PostgresTimelinesHistory) GetTimelineHistory(id uint64) *PostgresTime
 type PostgresState struct {
 	UID        string `json:"uid,omitempty"`
 	Generation int64  `json:"generation,omitempty"`
+	// RestartRequest is the last db spec restart request handled
+	RestartRequest int64 `json:"restartRequest,omitempty"`
 
 	ListenAddress string `json:"listenAddress,omitempty"`
-	Port          string `json:"port,omitempty"`
+	// AdditionalListenAddresses are the addresses advertised in addition
+	// to ListenAddress (i.e. the address of another ip family)
+	AdditionalListenAddresses []string `json:"additionalListenAddresses,omitempty"`
+	Port                      string   `json:"port,omitempty"`
 
 	Healthy bool `json:"healthy,omitempty"`
 
@@ -97,9 +160,45 @@ type PostgresState struct {
 	XLogPos          uint64                   `json:"xLogPos,omitempty"`
 	TimelinesHistory PostgresTimelinesHistory `json:"timelinesHistory,omitempty"`
 
+	// ReplayXLogPos and ReplayDelay are the last replayed wal position and
+	// the time since the commit on the master of the last replayed
+	// transaction. Reported only by standbys.
+	ReplayXLogPos uint64    `json:"replayXLogPos,omitempty"`
+	ReplayDelay   *Duration `json:"replayDelay,omitempty"`
+
 	PGParameters        common.Parameters `json:"pgParameters,omitempty"`
 	SynchronousStandbys []string          `json:"synchronousStandbys"`
 	OlderWalFile        string            `json:"olderWalFile,omitempty"`
+	DataChecksums       bool              `json:"dataChecksums,omitempty"`
+	// SharedPreloadLibraries are the libraries loaded by the running
+	// instance
+	SharedPreloadLibraries []string `json:"sharedPreloadLibraries,omitempty"`
+	// SSLCertNotAfter is the expiration time of the postgres server
+	// certificate, when ssl is enabled
+	SSLCertNotAfter *time.Time `json:"sslCertNotAfter,omitempty"`
+
+	ReplicationSlots        []*ReplicationSlotStatus        `json:"replicationSlots,omitempty"`
+	WalRetention            *WalRetentionStatus             `json:"walRetention,omitempty"`
+	Tablespaces             []*TablespaceStatus             `json:"tablespaces,omitempty"`
+	LogicalReplicationSlots []*LogicalReplicationSlotStatus `json:"logicalReplicationSlots,omitempty"`
+
+	// PGParametersHash is the hash of the parameters currently configured in
+	// the instance, ExpectedPGParametersHash is the hash of the parameters the
+	// keeper last applied to the instance.
+	PGParametersHash         string `json:"pgParametersHash,omitempty"`
+	ExpectedPGParametersHash string `json:"expectedPGParametersHash,omitempty"`
+}
+
+// ListenAddresses returns all the advertised addresses, the main one first,
+// without duplicates
+func (p *PostgresState) ListenAddresses() []string {
+	addresses := []string{}
+	for _, address := range append([]string{p.ListenAddress}, p.AdditionalListenAddresses...) {
+		if address != "" && !util.StringInSlice(addresses, address) {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
 }
 
 func (p *PostgresState) DeepCopy() *PostgresState {
@@ -124,6 +223,14 @@ func (s SentinelsInfo) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 
 type SentinelInfo struct {
 	UID string
+
+	// DBsReachability reports, for every db with a listen address, if the
+	// sentinel reached it with a tcp connect. It's reported only when the
+	// cluster spec failoverQuorum is enabled.
+	DBsReachability map[string]bool `json:"dbsReachability,omitempty"`
+
+	// Time is the sentinel clock time when the info has been written
+	Time time.Time `json:"time,omitempty"`
 }
 
 type ProxyInfo struct {
@@ -133,6 +240,9 @@ type ProxyInfo struct {
 
 	UID        string
 	Generation int64
+
+	// Time is the proxy clock time when the info has been written
+	Time time.Time `json:"time,omitempty"`
 }
 
 type ProxiesInfo map[string]*ProxyInfo
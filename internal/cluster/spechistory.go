@@ -0,0 +1,39 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cluster
+
+import (
+	"time"
+)
+
+// SpecChange is a cluster spec change recorded by stolonctl in the store spec
+// history
+type SpecChange struct {
+	// Generation is the cluster generation after the change
+	Generation int64     `json:"generation"`
+	Time       time.Time `json:"time"`
+	ClusterUID string    `json:"clusterUID"`
+
+	// User and Host are the user running stolonctl and its host
+	User string `json:"user,omitempty"`
+	Host string `json:"host,omitempty"`
+	// Command is the stolonctl command that changed the cluster spec
+	Command string `json:"command,omitempty"`
+	// Changes are the changed cluster spec fields
+	Changes []string `json:"changes,omitempty"`
+
+	// Spec is the cluster spec after the change
+	Spec *ClusterSpec `json:"spec,omitempty"`
+}
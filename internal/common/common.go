@@ -15,12 +15,15 @@
 package common
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"reflect"
+	"sort"
 	"strings"
 
 	"github.com/satori/go.uuid"
@@ -73,6 +76,55 @@ func (s Parameters) Equals(is Parameters) bool {
 	return reflect.DeepEqual(s, is)
 }
 
+// Hash returns an hex encoded sha256 hash of the parameters. The hash doesn't
+// depend on the parameters ordering.
+func (s Parameters) Hash() string {
+	keys := make([]string, 0, len(s))
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		// prefix name and value with their length to avoid ambiguities
+		fmt.Fprintf(h, "%d:%s%d:%s", len(k), k, len(s[k]), s[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// DurabilityParameters are the postgres parameters that, when disabled, can
+// cause unrecoverable data corruption after a crash.
+var DurabilityParameters = []string{"fsync", "full_page_writes"}
+
+// DisabledDurabilityParameters returns the sorted names of the
+// DurabilityParameters disabled in the parameters.
+func (s Parameters) DisabledDurabilityParameters() []string {
+	disabled := []string{}
+	for _, k := range DurabilityParameters {
+		if v, ok := s[k]; ok && isPGBoolOff(v) {
+			disabled = append(disabled, k)
+		}
+	}
+	sort.Strings(disabled)
+	return disabled
+}
+
+// isPGBoolOff reports if the provided value is a postgres boolean false value.
+// Like postgres it accepts case insensitive unique prefixes of "off", "false"
+// and "no" and "0".
+func isPGBoolOff(v string) bool {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if v == "" {
+		return false
+	}
+	// "o" is ambiguous between "on" and "off"
+	if len(v) >= 2 && strings.HasPrefix("off", v) {
+		return true
+	}
+	return strings.HasPrefix("false", v) || strings.HasPrefix("no", v) || v == "0"
+}
+
 // WriteFileAtomicFunc atomically writes a file, it achieves this by creating a
 // temporary file and then moving it. writeFunc is the func that will write
 // data to the file.
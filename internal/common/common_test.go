@@ -0,0 +1,118 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParametersHash(t *testing.T) {
+	tests := []struct {
+		a     Parameters
+		b     Parameters
+		equal bool
+	}{
+		{
+			a:     nil,
+			b:     Parameters{},
+			equal: true,
+		},
+		{
+			a:     Parameters{"max_connections": "100", "port": "5432"},
+			b:     Parameters{"port": "5432", "max_connections": "100"},
+			equal: true,
+		},
+		{
+			a:     Parameters{"max_connections": "100"},
+			b:     Parameters{"max_connections": "200"},
+			equal: false,
+		},
+		{
+			a:     Parameters{"max_connections": "100"},
+			b:     Parameters{"max_connections": "100", "port": "5432"},
+			equal: false,
+		},
+		// the same concatenation of names and values must give different hashes
+		{
+			a:     Parameters{"ab": "c"},
+			b:     Parameters{"a": "bc"},
+			equal: false,
+		},
+		{
+			a:     Parameters{"a": "b", "c": "d"},
+			b:     Parameters{"a": "bc", "": "d"},
+			equal: false,
+		},
+	}
+
+	for i, tt := range tests {
+		ha := tt.a.Hash()
+		hb := tt.b.Hash()
+		if tt.equal && ha != hb {
+			t.Errorf("#%d: expected equal hashes, got %q and %q", i, ha, hb)
+		}
+		if !tt.equal && ha == hb {
+			t.Errorf("#%d: expected different hashes, got %q", i, ha)
+		}
+		// the hash must be stable between calls
+		if ha != tt.a.Hash() {
+			t.Errorf("#%d: hash isn't stable", i)
+		}
+	}
+}
+
+func TestDisabledDurabilityParameters(t *testing.T) {
+	tests := []struct {
+		in  Parameters
+		out []string
+	}{
+		{
+			in:  nil,
+			out: []string{},
+		},
+		{
+			in:  Parameters{"fsync": "on", "full_page_writes": "true", "max_connections": "0"},
+			out: []string{},
+		},
+		{
+			in:  Parameters{"fsync": "off"},
+			out: []string{"fsync"},
+		},
+		{
+			in:  Parameters{"fsync": "o"},
+			out: []string{},
+		},
+		{
+			in:  Parameters{"fsync": "OF", "full_page_writes": "0"},
+			out: []string{"fsync", "full_page_writes"},
+		},
+		{
+			in:  Parameters{"fsync": "yes", "full_page_writes": " False "},
+			out: []string{"full_page_writes"},
+		},
+		{
+			in:  Parameters{"fsync": "n", "full_page_writes": "f"},
+			out: []string{"fsync", "full_page_writes"},
+		},
+	}
+
+	for i, tt := range tests {
+		out := tt.in.DisabledDurabilityParameters()
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: wrong output: got: %v, want: %v", i, out, tt.out)
+		}
+	}
+}
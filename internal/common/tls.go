@@ -18,7 +18,11 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"sync"
+	"time"
 )
 
 func NewTLSConfig(certFile, keyFile, caFile string, insecureSkipVerify bool) (*tls.Config, error) {
@@ -26,25 +30,10 @@ func NewTLSConfig(certFile, keyFile, caFile string, insecureSkipVerify bool) (*t
 
 	// Populate root CA certs
 	if caFile != "" {
-		pemBytes, err := ioutil.ReadFile(caFile)
+		roots, err := loadCertPool(caFile)
 		if err != nil {
 			return nil, err
 		}
-		roots := x509.NewCertPool()
-
-		for {
-			var block *pem.Block
-			block, pemBytes = pem.Decode(pemBytes)
-			if block == nil {
-				break
-			}
-			cert, err := x509.ParseCertificate(block.Bytes)
-			if err != nil {
-				return nil, err
-			}
-			roots.AddCert(cert)
-		}
-
 		tlsConfig.RootCAs = roots
 	}
 
@@ -62,3 +51,174 @@ func NewTLSConfig(certFile, keyFile, caFile string, insecureSkipVerify bool) (*t
 
 	return &tlsConfig, nil
 }
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pemBytes, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+
+	for {
+		var block *pem.Block
+		block, pemBytes = pem.Decode(pemBytes)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		roots.AddCert(cert)
+	}
+	return roots, nil
+}
+
+// CertReloader provides a client certificate reloaded when its files are
+// modified, so short lived certificates can be renewed (i.e. by vault)
+// without restarting the process. The new certificate is used by the new
+// connections.
+type CertReloader struct {
+	certFile, keyFile string
+
+	mutex   sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.certificate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *CertReloader) certificate() (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var modTime time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			if r.cert != nil {
+				return r.cert, nil
+			}
+			return nil, err
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	if r.cert != nil && !modTime.After(r.modTime) {
+		return r.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		// keep the current certificate, the files could be updated in
+		// the meantime (the certificate and the key don't match)
+		if r.cert != nil {
+			return r.cert, nil
+		}
+		return nil, err
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return r.cert, nil
+}
+
+// GetClientCertificate implements tls.Config GetClientCertificate
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.certificate()
+}
+
+// CAReloader provides the root CAs reloaded when the CA file is modified, so
+// the CA can be rotated without restarting the process. Since the tls.Config
+// RootCAs cannot be changed it must be used as the VerifyPeerCertificate of a
+// tls.Config with InsecureSkipVerify.
+type CAReloader struct {
+	caFile string
+
+	mutex   sync.Mutex
+	pool    *x509.CertPool
+	modTime time.Time
+}
+
+func NewCAReloader(caFile string) (*CAReloader, error) {
+	r := &CAReloader{caFile: caFile}
+	if _, err := r.certPool(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *CAReloader) certPool() (*x509.CertPool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	fi, err := os.Stat(r.caFile)
+	if err != nil {
+		if r.pool != nil {
+			return r.pool, nil
+		}
+		return nil, err
+	}
+	if r.pool != nil && !fi.ModTime().After(r.modTime) {
+		return r.pool, nil
+	}
+	pool, err := loadCertPool(r.caFile)
+	if err != nil {
+		// keep the current CAs, the file could be partially written
+		if r.pool != nil {
+			return r.pool, nil
+		}
+		return nil, err
+	}
+	r.pool = pool
+	r.modTime = fi.ModTime()
+	return r.pool, nil
+}
+
+// VerifyPeerCertificate returns a tls.Config VerifyPeerCertificate verifying
+// the server certificate chain with the current root CAs and, if serverNames
+// returns some names, that the certificate is valid for one of them.
+func (r *CAReloader) VerifyPeerCertificate(serverNames func() []string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("no server certificate")
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("cannot parse server certificate: %v", err)
+			}
+			certs[i] = cert
+		}
+		pool, err := r.certPool()
+		if err != nil {
+			return err
+		}
+		opts := x509.VerifyOptions{
+			Roots:         pool,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		var names []string
+		if serverNames != nil {
+			names = serverNames()
+		}
+		if len(names) == 0 {
+			_, err := certs[0].Verify(opts)
+			return err
+		}
+		for _, name := range names {
+			opts.DNSName = name
+			if _, err = certs[0].Verify(opts); err == nil {
+				return nil
+			}
+		}
+		return err
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self signed certificate and its key
+func writeTestCert(t *testing.T, certFile, keyFile, cn string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, f := range []string{certFile, keyFile} {
+		if err := os.Chtimes(f, modTime, modTime); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stolon-tls")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	commonName := func(r *CertReloader) string {
+		cert, err := r.GetClientCertificate(nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		c, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return c.Subject.CommonName
+	}
+
+	now := time.Now()
+	writeTestCert(t, certFile, keyFile, "cert1", now.Add(-time.Minute))
+	r, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cn := commonName(r); cn != "cert1" {
+		t.Errorf("got certificate: %s, want: cert1", cn)
+	}
+
+	writeTestCert(t, certFile, keyFile, "cert2", now)
+	if cn := commonName(r); cn != "cert2" {
+		t.Errorf("got certificate: %s, want: cert2", cn)
+	}
+
+	// a wrong certificate is ignored
+	if err := ioutil.WriteFile(certFile, []byte("wrong"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	os.Chtimes(certFile, now.Add(time.Minute), now.Add(time.Minute))
+	if cn := commonName(r); cn != "cert2" {
+		t.Errorf("got certificate: %s, want: cert2", cn)
+	}
+
+	if _, err := NewCertReloader(filepath.Join(dir, "notexisting"), keyFile); err == nil {
+		t.Errorf("got no error for a not existing certificate file")
+	}
+}
+
+// testCA is a CA able to sign server certificates
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, cn string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// serverCert returns a server certificate, valid for dnsName, signed by the
+// CA
+func (ca *testCA) serverCert(t *testing.T, dnsName string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: dnsName},
+		DNSNames:     []string{dnsName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return der
+}
+
+func TestCAReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stolon-tls")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+
+	now := time.Now()
+	writeCA := func(ca *testCA, modTime time.Time) {
+		if err := ioutil.WriteFile(caFile, ca.pem, 0600); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := os.Chtimes(caFile, modTime, modTime); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	ca1 := newTestCA(t, "ca1")
+	ca2 := newTestCA(t, "ca2")
+	cert1 := ca1.serverCert(t, "store1")
+	cert2 := ca2.serverCert(t, "store1")
+
+	writeCA(ca1, now.Add(-time.Minute))
+	r, err := NewCAReloader(caFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		cert  []byte
+		names []string
+		ok    bool
+	}{
+		{cert: cert1, names: []string{"store1"}, ok: true},
+		{cert: cert1, names: []string{"store0", "store1"}, ok: true},
+		{cert: cert1, names: []string{"store2"}, ok: false},
+		{cert: cert1, ok: true},
+		{cert: cert2, names: []string{"store1"}, ok: false},
+	}
+	for i, tt := range tests {
+		names := tt.names
+		err := r.VerifyPeerCertificate(func() []string { return names })([][]byte{tt.cert}, nil)
+		if tt.ok && err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("#%d: got no error", i)
+		}
+	}
+
+	// rotate the CA
+	writeCA(ca2, now)
+	verify := r.VerifyPeerCertificate(func() []string { return []string{"store1"} })
+	if err := verify([][]byte{cert2}, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := verify([][]byte{cert1}, nil); err == nil {
+		t.Errorf("got no error for a certificate signed by the old CA")
+	}
+
+	// a wrong CA file is ignored
+	if err := ioutil.WriteFile(caFile, []byte("-----BEGIN CERTIFICATE-----\nd3Jvbmc=\n-----END CERTIFICATE-----\n"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	os.Chtimes(caFile, now.Add(time.Minute), now.Add(time.Minute))
+	if err := verify([][]byte{cert2}, nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err := NewCAReloader(filepath.Join(dir, "notexisting")); err == nil {
+		t.Errorf("got no error for a not existing CA file")
+	}
+}
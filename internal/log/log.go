@@ -17,6 +17,7 @@ package log
 import (
 	"fmt"
 	"log"
+	"sync/atomic"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -25,12 +26,43 @@ import (
 var (
 	s      *zap.SugaredLogger
 	sColor *zap.SugaredLogger
+	sJSON  *zap.SugaredLogger
 )
 
+// EventKey is the key of the field describing a lifecycle event. It's
+// reported only by the json logger, the text loggers drop it to keep their
+// output unchanged.
+const EventKey = "event"
+
+// Lifecycle events types
+const (
+	EventRoleChange          = "roleChange"
+	EventPromotion           = "promotion"
+	EventMasterElection      = "masterElection"
+	EventProxyMasterSwitch   = "proxyMasterSwitch"
+	EventStoreConnectionLost = "storeConnectionLost"
+)
+
+// ClusterUIDKey is the key of the field reporting the cluster uid. It's
+// reported only by the json logger.
+const ClusterUIDKey = "clusterUID"
+
 // default info level
 var level = zap.NewAtomicLevelAt(zapcore.InfoLevel)
 
+// clusterUID is the cluster uid reported by the json logger
+var clusterUID atomic.Value
+
 func init() {
+	var err error
+	if s, sColor, sJSON, err = newLoggers(nil); err != nil {
+		panic(err)
+	}
+}
+
+// newLoggers builds the text, color and json loggers. When sw isn't nil the
+// entries are also sent to syslog.
+func newLoggers(sw syslogWriter) (text, color, jsonl *zap.SugaredLogger, err error) {
 	config := zap.Config{
 		Level:             level,
 		Development:       false,
@@ -41,19 +73,132 @@ func init() {
 		ErrorOutputPaths:  []string{"stderr"},
 	}
 
-	logger, err := config.Build()
+	// syslog adds its own timestamp to the text entries
+	syslogEncoderConfig := zap.NewDevelopmentEncoderConfig()
+	syslogEncoderConfig.TimeKey = ""
+	textSyslogCore := func(c zapcore.Core) zapcore.Core {
+		return newTextCore(withSyslog(c, sw, zapcore.NewConsoleEncoder(syslogEncoderConfig)))
+	}
+
+	logger, err := config.Build(zap.WrapCore(textSyslogCore))
 	if err != nil {
-		panic(fmt.Errorf("failed to initialize logger: %v", err))
+		return nil, nil, nil, fmt.Errorf("failed to initialize logger: %v", err)
 	}
-	s = logger.Sugar()
+	text = logger.Sugar()
 
 	config.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
 
-	logger, err = config.Build()
+	logger, err = config.Build(zap.WrapCore(textSyslogCore))
 	if err != nil {
-		panic(fmt.Errorf("failed to initialize color logger: %v", err))
+		return nil, nil, nil, fmt.Errorf("failed to initialize color logger: %v", err)
 	}
-	sColor = logger.Sugar()
+	color = logger.Sugar()
+
+	config.Encoding = "json"
+	config.EncoderConfig = zap.NewProductionEncoderConfig()
+	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+
+	logger, err = config.Build(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return newClusterUIDCore(withSyslog(c, sw, zapcore.NewJSONEncoder(config.EncoderConfig)))
+	}))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to initialize json logger: %v", err)
+	}
+	jsonl = logger.Sugar()
+
+	return text, color, jsonl, nil
+}
+
+// EnableSyslog sends the log entries also to syslog. An empty network uses
+// the local syslog daemon. The loggers must be retrieved again after enabling
+// it.
+func EnableSyslog(network, raddr, tag string) error {
+	sw, err := dialSyslog(network, raddr, tag)
+	if err != nil {
+		return err
+	}
+	text, color, jsonl, err := newLoggers(sw)
+	if err != nil {
+		return err
+	}
+	s, sColor, sJSON = text, color, jsonl
+	return nil
+}
+
+// SetClusterUID sets the cluster uid reported by the json logger
+func SetClusterUID(uid string) {
+	clusterUID.Store(uid)
+}
+
+// clusterUIDCore is a core adding the cluster uid field, when set
+type clusterUIDCore struct {
+	zapcore.Core
+}
+
+func newClusterUIDCore(c zapcore.Core) zapcore.Core {
+	return &clusterUIDCore{c}
+}
+
+func (c *clusterUIDCore) With(fields []zapcore.Field) zapcore.Core {
+	return &clusterUIDCore{c.Core.With(fields)}
+}
+
+func (c *clusterUIDCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *clusterUIDCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	if uid, _ := clusterUID.Load().(string); uid != "" {
+		fields = append(fields, zap.String(ClusterUIDKey, uid))
+	}
+	return c.Core.Write(ent, fields)
+}
+
+// textCore is a core that drops the event fields
+type textCore struct {
+	zapcore.Core
+}
+
+func newTextCore(c zapcore.Core) zapcore.Core {
+	return &textCore{c}
+}
+
+func dropEventFields(fields []zapcore.Field) []zapcore.Field {
+	var out []zapcore.Field
+	for _, f := range fields {
+		if f.Key != EventKey {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func (c *textCore) With(fields []zapcore.Field) zapcore.Core {
+	return &textCore{c.Core.With(dropEventFields(fields))}
+}
+
+func (c *textCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *textCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	return c.Core.Write(ent, dropEventFields(fields))
+}
+
+// Event returns a field describing a lifecycle event of the provided type
+// (i.e. EventPromotion) with the provided key value pairs as details.
+func Event(eventType string, keysAndValues ...interface{}) zapcore.Field {
+	event := map[string]interface{}{"type": eventType}
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		event[fmt.Sprint(keysAndValues[i])] = keysAndValues[i+1]
+	}
+	return zap.Any(EventKey, event)
 }
 
 func SetDebug() {
@@ -80,6 +225,11 @@ func SColor() *zap.SugaredLogger {
 	return sColor
 }
 
+// SJSON returns the logger emitting every entry as a json object
+func SJSON() *zap.SugaredLogger {
+	return sJSON
+}
+
 func StdLogColor() *log.Logger {
 	return zap.NewStdLog(sColor.Desugar())
 }
@@ -0,0 +1,130 @@
+// Copyright 2017 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestEventFields(t *testing.T) {
+	var textBuf, jsonBuf bytes.Buffer
+	encoderConfig := zap.NewDevelopmentEncoderConfig()
+	encoderConfig.TimeKey = ""
+	text := zap.New(newTextCore(zapcore.NewCore(zapcore.NewConsoleEncoder(encoderConfig), zapcore.AddSync(&textBuf), zapcore.InfoLevel))).Sugar()
+	jsonl := zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(&jsonBuf), zapcore.InfoLevel)).Sugar()
+
+	for _, l := range []*zap.SugaredLogger{text, jsonl} {
+		l.With("component", "keeper", Event(EventRoleChange, "role", "master")).Infow("promoting to master", "db", "db1", Event(EventPromotion, "db", "db1"))
+	}
+
+	// the text output doesn't contain the event fields
+	expected := "INFO\tpromoting to master\t{\"component\": \"keeper\", \"db\": \"db1\"}\n"
+	if textBuf.String() != expected {
+		t.Errorf("wrong text output: got: %q, want: %q", textBuf.String(), expected)
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(jsonBuf.Bytes(), &entry); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if entry["msg"] != "promoting to master" || entry["component"] != "keeper" || entry["db"] != "db1" {
+		t.Errorf("wrong json output: %s", jsonBuf.String())
+	}
+	event, ok := entry[EventKey].(map[string]interface{})
+	if !ok {
+		t.Fatalf("missing event field in json output: %s", jsonBuf.String())
+	}
+	if event["type"] != EventPromotion || event["db"] != "db1" {
+		t.Errorf("wrong event: %v", event)
+	}
+}
+
+func TestClusterUIDField(t *testing.T) {
+	var jsonBuf bytes.Buffer
+	jsonl := zap.New(newClusterUIDCore(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(&jsonBuf), zapcore.InfoLevel))).Sugar()
+	defer SetClusterUID("")
+
+	SetClusterUID("")
+	jsonl.Infow("no cluster uid")
+	SetClusterUID("cluster1")
+	jsonl.With("component", "keeper").Infow("cluster uid")
+
+	dec := json.NewDecoder(&jsonBuf)
+	for _, expected := range []interface{}{nil, "cluster1"} {
+		var entry map[string]interface{}
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if entry[ClusterUIDKey] != expected {
+			t.Errorf("wrong cluster uid: got: %v, want: %v", entry[ClusterUIDKey], expected)
+		}
+	}
+}
+
+type fakeSyslogWriter struct {
+	messages []string
+}
+
+func (w *fakeSyslogWriter) write(severity, m string) error {
+	w.messages = append(w.messages, severity+" "+m)
+	return nil
+}
+
+func (w *fakeSyslogWriter) Debug(m string) error   { return w.write("debug", m) }
+func (w *fakeSyslogWriter) Info(m string) error    { return w.write("info", m) }
+func (w *fakeSyslogWriter) Warning(m string) error { return w.write("warning", m) }
+func (w *fakeSyslogWriter) Err(m string) error     { return w.write("err", m) }
+func (w *fakeSyslogWriter) Crit(m string) error    { return w.write("crit", m) }
+
+func TestSyslogCore(t *testing.T) {
+	var textBuf bytes.Buffer
+	sw := &fakeSyslogWriter{}
+	encoderConfig := zap.NewDevelopmentEncoderConfig()
+	encoderConfig.TimeKey = ""
+	c := zapcore.NewCore(zapcore.NewConsoleEncoder(encoderConfig), zapcore.AddSync(&textBuf), zapcore.DebugLevel)
+	sc := &syslogCore{LevelEnabler: zapcore.DebugLevel, enc: zapcore.NewConsoleEncoder(encoderConfig), w: sw}
+	l := zap.New(newTextCore(zapcore.NewTee(c, sc))).Sugar().With("component", "keeper")
+
+	l.Debugw("debug message")
+	l.Infow("info message", Event(EventPromotion, "db", "db1"))
+	l.Warnw("warn message")
+	l.Errorw("error message", "db", "db1")
+	l.DPanicw("dpanic message")
+
+	expected := []string{
+		"debug DEBUG\tdebug message\t{\"component\": \"keeper\"}",
+		"info INFO\tinfo message\t{\"component\": \"keeper\"}",
+		"warning WARN\twarn message\t{\"component\": \"keeper\"}",
+		"err ERROR\terror message\t{\"component\": \"keeper\", \"db\": \"db1\"}",
+		"crit DPANIC\tdpanic message\t{\"component\": \"keeper\"}",
+	}
+	if len(sw.messages) != len(expected) {
+		t.Fatalf("got %d syslog messages, want: %d: %q", len(sw.messages), len(expected), sw.messages)
+	}
+	for i, m := range sw.messages {
+		if m != expected[i] {
+			t.Errorf("#%d: wrong syslog message: got: %q, want: %q", i, m, expected[i])
+		}
+	}
+	// the entries are also written to the primary core
+	if n := bytes.Count(textBuf.Bytes(), []byte("\n")); n != len(expected) {
+		t.Errorf("got %d text entries, want: %d", n, len(expected))
+	}
+}
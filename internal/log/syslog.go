@@ -0,0 +1,98 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package log
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// syslogWriter writes a message with a syslog severity
+type syslogWriter interface {
+	Debug(m string) error
+	Info(m string) error
+	Warning(m string) error
+	Err(m string) error
+	Crit(m string) error
+}
+
+func dialSyslog(network, raddr, tag string) (syslogWriter, error) {
+	sw, err := syslog.Dial(network, raddr, syslog.LOG_DAEMON|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %v", err)
+	}
+	return sw, nil
+}
+
+// withSyslog returns a core writing the entries to both c and, if not nil,
+// sw using the provided encoder
+func withSyslog(c zapcore.Core, sw syslogWriter, enc zapcore.Encoder) zapcore.Core {
+	if sw == nil {
+		return c
+	}
+	return zapcore.NewTee(c, &syslogCore{LevelEnabler: level, enc: enc, w: sw})
+}
+
+// syslogCore is a core writing every entry as a syslog message with the
+// severity of the entry level
+type syslogCore struct {
+	zapcore.LevelEnabler
+	enc zapcore.Encoder
+	w   syslogWriter
+}
+
+func (c *syslogCore) With(fields []zapcore.Field) zapcore.Core {
+	enc := c.enc.Clone()
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	return &syslogCore{LevelEnabler: c.LevelEnabler, enc: enc, w: c.w}
+}
+
+func (c *syslogCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *syslogCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := c.enc.EncodeEntry(ent, fields)
+	if err != nil {
+		return err
+	}
+	m := strings.TrimSuffix(buf.String(), "\n")
+	buf.Free()
+
+	switch ent.Level {
+	case zapcore.DebugLevel:
+		return c.w.Debug(m)
+	case zapcore.InfoLevel:
+		return c.w.Info(m)
+	case zapcore.WarnLevel:
+		return c.w.Warning(m)
+	case zapcore.ErrorLevel:
+		return c.w.Err(m)
+	default:
+		return c.w.Crit(m)
+	}
+}
+
+func (c *syslogCore) Sync() error {
+	return nil
+}
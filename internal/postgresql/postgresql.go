@@ -17,6 +17,7 @@ package postgresql
 import (
 	"bufio"
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"io"
@@ -27,6 +28,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -54,14 +56,19 @@ var (
 var log = slog.S()
 
 type Manager struct {
+	// pgBinPath can be changed (with SetBinPath) while other goroutines are
+	// using the manager
+	pgBinPathMutex        sync.Mutex
 	pgBinPath             string
 	dataDir               string
 	parameters            common.Parameters
 	recoveryParameters    common.Parameters
 	hba                   []string
+	ident                 []string
 	curParameters         common.Parameters
 	curRecoveryParameters common.Parameters
 	curHba                []string
+	curIdent              []string
 	localConnParams       ConnParams
 	replConnParams        ConnParams
 	suAuthMethod          string
@@ -71,6 +78,11 @@ type Manager struct {
 	replUsername          string
 	replPassword          string
 	requestTimeout        time.Duration
+	// pg_ctl stop mode and timeout and promote timeout. A zero timeout
+	// uses the pg_ctl default.
+	stopMode       string
+	stopTimeout    time.Duration
+	promoteTimeout time.Duration
 }
 
 type SystemData struct {
@@ -85,10 +97,33 @@ type TimelineHistory struct {
 	Reason      string
 }
 
+// ControlData contains the pg_controldata reported state of a (stopped)
+// instance
+type ControlData struct {
+	// TimelineID is the latest checkpoint timeline
+	TimelineID uint64
+	// CheckpointXLogPos is the latest checkpoint location
+	CheckpointXLogPos uint64
+	// RedoWalFile is the wal file of the latest checkpoint redo location
+	// (reported since postgres 9.6)
+	RedoWalFile string
+}
+
 type InitConfig struct {
 	Locale        string
 	Encoding      string
 	DataChecksums bool
+	WalDir        string
+}
+
+// UpgradeConfig is the configuration, read from the instance to upgrade, of
+// the new data dir initialized for pg_upgrade since it must match the current
+// one
+type UpgradeConfig struct {
+	Encoding      string
+	LCCollate     string
+	LCCtype       string
+	DataChecksums bool
 }
 
 func SetLogger(l *zap.SugaredLogger) {
@@ -112,9 +147,33 @@ func NewManager(pgBinPath string, dataDir string, localConnParams, replConnParam
 		replUsername:          replUsername,
 		replPassword:          replPassword,
 		requestTimeout:        requestTimeout,
+		stopMode:              "fast",
 	}
 }
 
+// SetPGCtlOptions sets the pg_ctl mode (smart, fast or immediate) and timeout
+// used when stopping the instance and the timeout used when promoting it
+func (p *Manager) SetPGCtlOptions(stopMode string, stopTimeout, promoteTimeout time.Duration) {
+	p.stopMode = stopMode
+	p.stopTimeout = stopTimeout
+	p.promoteTimeout = promoteTimeout
+}
+
+// SetBinPath sets the path of the postgres binaries. The instance should be
+// stopped before changing it.
+func (p *Manager) SetBinPath(pgBinPath string) {
+	p.pgBinPathMutex.Lock()
+	defer p.pgBinPathMutex.Unlock()
+	p.pgBinPath = pgBinPath
+}
+
+// BinPath returns the path of the postgres binaries
+func (p *Manager) BinPath() string {
+	p.pgBinPathMutex.Lock()
+	defer p.pgBinPathMutex.Unlock()
+	return p.pgBinPath
+}
+
 func (p *Manager) SetParameters(parameters common.Parameters) {
 	p.parameters = parameters
 }
@@ -139,6 +198,16 @@ func (p *Manager) CurHba() []string {
 	return p.curHba
 }
 
+// SetIdent sets the pg_ident.conf entries. When nil pg_ident.conf isn't
+// written.
+func (p *Manager) SetIdent(ident []string) {
+	p.ident = ident
+}
+
+func (p *Manager) CurIdent() []string {
+	return p.curIdent
+}
+
 func (p *Manager) UpdateCurParameters() {
 	n, err := copystructure.Copy(p.parameters)
 	if err != nil {
@@ -163,6 +232,14 @@ func (p *Manager) UpdateCurHba() {
 	p.curHba = n.([]string)
 }
 
+func (p *Manager) UpdateCurIdent() {
+	n, err := copystructure.Copy(p.ident)
+	if err != nil {
+		panic(err)
+	}
+	p.curIdent = n.([]string)
+}
+
 func (p *Manager) Init(initConfig *InitConfig) error {
 	// ioutil.Tempfile already creates files with 0600 permissions
 	pwfile, err := ioutil.TempFile("", "pwfile")
@@ -174,9 +251,9 @@ func (p *Manager) Init(initConfig *InitConfig) error {
 
 	pwfile.WriteString(p.suPassword)
 
-	name := filepath.Join(p.pgBinPath, "initdb")
+	name := filepath.Join(p.BinPath(), "initdb")
 	cmd := exec.Command(name, "-D", p.dataDir, "-U", p.suUsername)
-	if p.suAuthMethod == "md5" {
+	if p.suAuthMethod == "md5" || p.suAuthMethod == "scram-sha-256" {
 		cmd.Args = append(cmd.Args, "--pwfile", pwfile.Name())
 	}
 	log.Debugw("execing cmd", "cmd", cmd)
@@ -190,6 +267,18 @@ func (p *Manager) Init(initConfig *InitConfig) error {
 	if initConfig.DataChecksums {
 		cmd.Args = append(cmd.Args, "--data-checksums")
 	}
+	if initConfig.WalDir != "" {
+		maj, _, err := p.BinaryVersion()
+		if err != nil {
+			return fmt.Errorf("cannot get the postgres binary version: %v", err)
+		}
+		// the wal dir of a previous failed initialization must be emptied
+		// since initdb requires an empty or not existing directory
+		if err := removeDirContents(initConfig.WalDir); err != nil {
+			return fmt.Errorf("cannot empty the wal dir: %v", err)
+		}
+		cmd.Args = append(cmd.Args, walDirFlag(maj), initConfig.WalDir)
+	}
 
 	// Pipe command's std[err|out] to parent.
 	cmd.Stdout = os.Stdout
@@ -267,6 +356,9 @@ func (p *Manager) StartTmpMerged() error {
 	if err := p.writePgHba(); err != nil {
 		return fmt.Errorf("error writing pg_hba.conf file: %v", err)
 	}
+	if err := p.writePgIdent(); err != nil {
+		return fmt.Errorf("error writing pg_ident.conf file: %v", err)
+	}
 	if err := p.writeRecoveryConf(); err != nil {
 		return fmt.Errorf("error writing %s file: %v", postgresRecoveryConf, err)
 	}
@@ -305,7 +397,7 @@ func (p *Manager) start(args ...string) error {
 	}
 
 	log.Infow("starting database")
-	name := filepath.Join(p.pgBinPath, "postgres")
+	name := filepath.Join(p.BinPath(), "postgres")
 	args = append([]string{"-D", p.dataDir, "-c", "unix_socket_directories=" + common.PgUnixSocketDirectories}, args...)
 	cmd := exec.Command(name, args...)
 	log.Debugw("execing cmd", "cmd", cmd)
@@ -362,19 +454,23 @@ func (p *Manager) start(args ...string) error {
 	p.UpdateCurParameters()
 	p.UpdateCurRecoveryParameters()
 	p.UpdateCurHba()
+	p.UpdateCurIdent()
 
 	return nil
 }
 
 // Stop tries to stop an instance. An error will be returned if the instance isn't started, stop fails or
-// times out (60 second).
+// times out (the stop timeout, 60 seconds by default).
+// When fast the configured stop mode (fast by default) is used, otherwise the
+// pg_ctl default one.
 func (p *Manager) Stop(fast bool) error {
-	log.Infow("stopping database")
-	name := filepath.Join(p.pgBinPath, "pg_ctl")
-	cmd := exec.Command(name, "stop", "-w", "-D", p.dataDir, "-o", "-c unix_socket_directories="+common.PgUnixSocketDirectories)
+	mode := ""
 	if fast {
-		cmd.Args = append(cmd.Args, "-m", "fast")
+		mode = p.stopMode
 	}
+	log.Infow("stopping database", "mode", mode)
+	name := filepath.Join(p.BinPath(), "pg_ctl")
+	cmd := exec.Command(name, pgCtlStopArgs(p.dataDir, mode, p.stopTimeout)...)
 	log.Debugw("execing cmd", "cmd", cmd)
 
 	// Pipe command's std[err|out] to parent.
@@ -387,7 +483,7 @@ func (p *Manager) Stop(fast bool) error {
 }
 
 func (p *Manager) IsStarted() (bool, error) {
-	name := filepath.Join(p.pgBinPath, "pg_ctl")
+	name := filepath.Join(p.BinPath(), "pg_ctl")
 	cmd := exec.Command(name, "status", "-D", p.dataDir, "-o", "-c unix_socket_directories="+common.PgUnixSocketDirectories)
 	_, err := cmd.CombinedOutput()
 	if err != nil {
@@ -412,7 +508,7 @@ func (p *Manager) Reload() error {
 		return err
 	}
 
-	name := filepath.Join(p.pgBinPath, "pg_ctl")
+	name := filepath.Join(p.BinPath(), "pg_ctl")
 	cmd := exec.Command(name, "reload", "-D", p.dataDir, "-o", "-c unix_socket_directories="+common.PgUnixSocketDirectories)
 	log.Debugw("execing cmd", "cmd", cmd)
 
@@ -426,6 +522,7 @@ func (p *Manager) Reload() error {
 	p.UpdateCurParameters()
 	p.UpdateCurRecoveryParameters()
 	p.UpdateCurHba()
+	p.UpdateCurIdent()
 
 	return nil
 }
@@ -499,8 +596,8 @@ func (p *Manager) WaitRecoveryDone(timeout time.Duration) error {
 
 func (p *Manager) Promote() error {
 	log.Infow("promoting database")
-	name := filepath.Join(p.pgBinPath, "pg_ctl")
-	cmd := exec.Command(name, "promote", "-w", "-D", p.dataDir)
+	name := filepath.Join(p.BinPath(), "pg_ctl")
+	cmd := exec.Command(name, pgCtlPromoteArgs(p.dataDir, p.promoteTimeout)...)
 	log.Debugw("execing cmd", "cmd", cmd)
 
 	// Pipe command's std[err|out] to parent.
@@ -550,9 +647,213 @@ func (p *Manager) SetupRoles() error {
 		}
 		log.Infow("replication role created", "role", p.replUsername)
 	}
+
+	// store the passwords of the roles using the scram-sha-256 auth method
+	// as scram-sha-256 hashes regardless of the password_encryption used
+	// by initdb
+	scramRoles := []pgRole{}
+	for _, r := range p.passwordRoles() {
+		if r.authMethod == "scram-sha-256" {
+			scramRoles = append(scramRoles, r)
+		}
+	}
+	return setupScramPasswords(ctx, p.localConnParams, scramRoles)
+}
+
+// pgRole is a role managed by the keeper
+type pgRole struct {
+	username, password, authMethod string
+}
+
+// passwordRoles returns the superuser and replication roles using a password
+// based auth method
+func (p *Manager) passwordRoles() []pgRole {
+	roles := []pgRole{{p.suUsername, p.suPassword, p.suAuthMethod}}
+	if p.replUsername != p.suUsername {
+		roles = append(roles, pgRole{p.replUsername, p.replPassword, p.replAuthMethod})
+	}
+	passwordRoles := []pgRole{}
+	for _, r := range roles {
+		if r.authMethod == "trust" || r.password == "" {
+			continue
+		}
+		passwordRoles = append(passwordRoles, r)
+	}
+	return passwordRoles
+}
+
+// AlterRolesPasswords changes the superuser and replication roles passwords
+// (for the roles using a password based auth method). The current
+// credentials are used to connect to the instance.
+func (p *Manager) AlterRolesPasswords(suPassword, replPassword string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	roles := []pgRole{{p.suUsername, suPassword, p.suAuthMethod}}
+	if p.replUsername != p.suUsername {
+		roles = append(roles, pgRole{p.replUsername, replPassword, p.replAuthMethod})
+	}
+	for _, r := range roles {
+		if r.authMethod == "trust" || r.password == "" {
+			continue
+		}
+		if err := setPassword(ctx, p.localConnParams, r.username, r.password); err != nil {
+			return fmt.Errorf("error setting role %q password: %v", r.username, err)
+		}
+	}
+	return nil
+}
+
+// SetCredentials replaces the superuser and replication passwords and the
+// connection parameters using them
+func (p *Manager) SetCredentials(suPassword, replPassword string, localConnParams, replConnParams ConnParams) {
+	p.suPassword = suPassword
+	p.replPassword = replPassword
+	p.localConnParams = localConnParams
+	p.replConnParams = replConnParams
+}
+
+// SetupScramPasswords stores the superuser and replication passwords as
+// scram-sha-256 hashes when they're stored in a different way (i.e. as md5
+// hashes of a cluster initialized with md5 password_encryption) since the
+// scram channel binding and the scram-sha-256 auth method require them.
+func (p *Manager) SetupScramPasswords() error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	return setupScramPasswords(ctx, p.localConnParams, p.passwordRoles())
+}
+
+func setupScramPasswords(ctx context.Context, connParams ConnParams, roles []pgRole) error {
+	for _, r := range roles {
+		scram, err := isScramPassword(ctx, connParams, r.username)
+		if err != nil {
+			return fmt.Errorf("error checking role %q password: %v", r.username, err)
+		}
+		if scram {
+			continue
+		}
+		log.Infow("storing role password as scram-sha-256 hash", "role", r.username)
+		if err := setScramPassword(ctx, connParams, r.username, r.password); err != nil {
+			return fmt.Errorf("error setting role %q scram password: %v", r.username, err)
+		}
+	}
 	return nil
 }
 
+// SetupMonitoringRole creates, or updates, a login role with the provided
+// password. When grantMonitor is true the role is granted pg_monitor. When
+// scram is true the password is stored as a scram-sha-256 hash.
+func (p *Manager) SetupMonitoringRole(username, password string, grantMonitor, scram bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	if err := setupMonitoringRole(ctx, p.localConnParams, username, password, grantMonitor, scram); err != nil {
+		return fmt.Errorf("error setting up monitoring role %q: %v", username, err)
+	}
+	return nil
+}
+
+// GetDataChecksums reports if the instance has data checksums enabled
+func (p *Manager) GetDataChecksums() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	return getDataChecksums(ctx, p.localConnParams)
+}
+
+// GetSharedPreloadLibraries returns the libraries loaded by the running
+// instance
+func (p *Manager) GetSharedPreloadLibraries() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	return getSharedPreloadLibraries(ctx, p.localConnParams)
+}
+
+// SetupExtension creates the extension in the database or updates it to the
+// required version. It reports if the extension has been changed.
+func (p *Manager) SetupExtension(database string, ext *Extension) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	changed, err := setupExtension(ctx, p.databaseConnParams(database), ext)
+	if err != nil {
+		return false, fmt.Errorf("error setting up extension %q in database %q: %v", ext.Name, database, err)
+	}
+	return changed, nil
+}
+
+// GetReplayLag returns, for a standby instance, the seconds since the commit
+// on the master of the last replayed transaction. It returns false if the
+// instance isn't a standby or it hasn't yet replayed any transaction.
+func (p *Manager) GetReplayLag() (float64, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	return getReplayLag(ctx, p.localConnParams)
+}
+
+// GetReplayXLogPos returns, for a standby instance, the last replayed wal
+// position. It returns false if the instance isn't a standby.
+func (p *Manager) GetReplayXLogPos() (uint64, bool, error) {
+	maj, _, err := p.PGDataVersion()
+	if err != nil {
+		return 0, false, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	return getReplayXLogPos(ctx, p.localConnParams, maj)
+}
+
+// GetCurrentWalLsn returns, for a primary instance, the current wal write
+// position
+func (p *Manager) GetCurrentWalLsn() (uint64, error) {
+	maj, _, err := p.PGDataVersion()
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	return getCurrentWalLsn(ctx, p.localConnParams, maj)
+}
+
+// GetStandbyFlushLsn returns the wal position flushed by the connected
+// standby with the provided application name. It returns false if the
+// standby isn't connected.
+func (p *Manager) GetStandbyFlushLsn(applicationName string) (uint64, bool, error) {
+	maj, _, err := p.PGDataVersion()
+	if err != nil {
+		return 0, false, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	return getStandbyFlushLsn(ctx, p.localConnParams, maj, applicationName)
+}
+
+// GetClientBackends returns the number of backends of the client
+// connections, excluding the ones of the superuser and replication users,
+// and how many of them are in a transaction
+func (p *Manager) GetClientBackends() (int, int, error) {
+	maj, _, err := p.PGDataVersion()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	return getClientBackends(ctx, p.localConnParams, maj, []string{p.suUsername, p.replUsername})
+}
+
+// TerminateClientBackends terminates the backends of the client connections,
+// excluding the ones of the superuser and replication users
+func (p *Manager) TerminateClientBackends() (int, error) {
+	maj, _, err := p.PGDataVersion()
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	return terminateClientBackends(ctx, p.localConnParams, maj, []string{p.suUsername, p.replUsername})
+}
+
 func (p *Manager) GetSyncStandbys() ([]string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
 	defer cancel()
@@ -570,10 +871,38 @@ func (p *Manager) GetReplicationSlots() ([]string, error) {
 	return getReplicationSlots(ctx, p.localConnParams, maj)
 }
 
-func (p *Manager) CreateReplicationSlot(name string) error {
+// GetTablespaces returns the instance user defined tablespaces
+func (p *Manager) GetTablespaces() ([]*Tablespace, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
 	defer cancel()
-	return createReplicationSlot(ctx, p.localConnParams, name)
+	return getTablespaces(ctx, p.localConnParams)
+}
+
+// GetPhysicalReplicationSlots returns the status of the instance physical
+// replication slots
+func (p *Manager) GetPhysicalReplicationSlots() ([]*ReplicationSlotStatus, error) {
+	maj, _, err := p.PGDataVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	return getPhysicalReplicationSlots(ctx, p.localConnParams, maj)
+}
+
+// CreateReplicationSlot creates a physical replication slot. When reserveWal
+// is true (and on PostgreSQL >= 9.6) the slot immediately reserves the wal
+// instead of waiting for its first consumer connection.
+func (p *Manager) CreateReplicationSlot(name string, reserveWal bool) error {
+	maj, min, err := p.PGDataVersion()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	return createReplicationSlot(ctx, p.localConnParams, name, reserveWal && (maj > 9 || (maj == 9 && min >= 6)))
 }
 
 func (p *Manager) DropReplicationSlot(name string) error {
@@ -582,16 +911,129 @@ func (p *Manager) DropReplicationSlot(name string) error {
 	return dropReplicationSlot(ctx, p.localConnParams, name)
 }
 
-func (p *Manager) BinaryVersion() (int, int, error) {
-	name := filepath.Join(p.pgBinPath, "postgres")
+// GetLogicalReplicationSlots returns the status of the instance logical
+// replication slots
+func (p *Manager) GetLogicalReplicationSlots() ([]*LogicalReplicationSlotStatus, error) {
+	maj, min, err := p.PGDataVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	return getLogicalReplicationSlots(ctx, p.localConnParams, maj, min)
+}
+
+func (p *Manager) CreateLogicalReplicationSlot(database, name, plugin string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	return createLogicalReplicationSlot(ctx, p.databaseConnParams(database), name, plugin)
+}
+
+func (p *Manager) AdvanceReplicationSlot(database, name string, lsn uint64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	return advanceReplicationSlot(ctx, p.databaseConnParams(database), name, lsn)
+}
+
+// DropLogicalReplicationSlot drops a logical replication slot connecting to
+// its database
+func (p *Manager) DropLogicalReplicationSlot(database, name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	return dropReplicationSlot(ctx, p.databaseConnParams(database), name)
+}
+
+// ExecStatements executes the statements in order, every one in its own
+// transaction, as the superuser on the postgres database
+func (p *Manager) ExecStatements(ctx context.Context, statements []string) error {
+	return execStatements(ctx, p.localConnParams, statements)
+}
+
+func (p *Manager) GetDatabases() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	return getDatabases(ctx, p.localConnParams)
+}
+
+// databaseConnParams returns the local connection parameters to connect to
+// the provided database
+func (p *Manager) databaseConnParams(database string) ConnParams {
+	cp := p.localConnParams.Copy()
+	cp.Set("dbname", database)
+	return cp
+}
+
+func (p *Manager) GetPublications(database string) ([]*Publication, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	return getPublications(ctx, p.databaseConnParams(database))
+}
+
+func (p *Manager) CreatePublication(database string, pub *Publication) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	return createPublication(ctx, p.databaseConnParams(database), pub)
+}
+
+func (p *Manager) DropPublication(database string, name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	return dropPublication(ctx, p.databaseConnParams(database), name)
+}
+
+func (p *Manager) SetPublicationTables(database string, name string, tables []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	return setPublicationTables(ctx, p.databaseConnParams(database), name, tables)
+}
+
+// BinPathServerVersion returns the server version (i.e. 12.4) of the postgres
+// binaries in pgBinPath
+func BinPathServerVersion(pgBinPath string) (string, error) {
+	name := filepath.Join(pgBinPath, "postgres")
 	cmd := exec.Command(name, "-V")
 	log.Debugw("execing cmd", "cmd", cmd)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		return 0, 0, fmt.Errorf("error: %v, output: %s", err, string(out))
+		return "", fmt.Errorf("error: %v, output: %s", err, string(out))
 	}
 
-	return ParseBinaryVersion(string(out))
+	return ParseServerVersion(string(out))
+}
+
+// BinPathVersion returns the major and minor version of the postgres
+// binaries in pgBinPath
+func BinPathVersion(pgBinPath string) (int, int, error) {
+	v, err := BinPathServerVersion(pgBinPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	return ParseVersion(v)
+}
+
+// ServerVersion returns the server version of the postgres binaries
+func (p *Manager) ServerVersion() (string, error) {
+	return BinPathServerVersion(p.BinPath())
+}
+
+func (p *Manager) BinaryVersion() (int, int, error) {
+	return BinPathVersion(p.BinPath())
+}
+
+// GetControlData returns the instance control data reported by
+// pg_controldata. It doesn't need a running instance.
+func (p *Manager) GetControlData() (*ControlData, error) {
+	name := filepath.Join(p.BinPath(), "pg_controldata")
+	cmd := exec.Command(name, "-D", p.dataDir)
+	// the output labels are translated
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	log.Debugw("execing cmd", "cmd", cmd)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("error: %v", err)
+	}
+	return parseControlData(string(out))
 }
 
 func (p *Manager) PGDataVersion() (int, int, error) {
@@ -690,6 +1132,9 @@ func (p *Manager) writeConfs() error {
 	if err := p.writePgHba(); err != nil {
 		return fmt.Errorf("error writing pg_hba.conf file: %v", err)
 	}
+	if err := p.writePgIdent(); err != nil {
+		return fmt.Errorf("error writing pg_ident.conf file: %v", err)
+	}
 	if err := p.writeRecoveryConf(); err != nil {
 		return fmt.Errorf("error writing %s file: %v", postgresRecoveryConf, err)
 	}
@@ -741,6 +1186,23 @@ func (p *Manager) writePgHba() error {
 		})
 }
 
+// writePgIdent writes pg_ident.conf, only when its entries are defined so a
+// not managed pg_ident.conf is left untouched
+func (p *Manager) writePgIdent() error {
+	if p.ident == nil {
+		return nil
+	}
+	return common.WriteFileAtomicFunc(filepath.Join(p.dataDir, "pg_ident.conf"), 0600,
+		func(f io.Writer) error {
+			for _, e := range p.ident {
+				if _, err := f.Write([]byte(e + "\n")); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+}
+
 // createPostgresqlAutoConf creates postgresql.auto.conf as a symlink to
 // /dev/null to block alter systems commands (they'll return an error)
 func (p *Manager) createPostgresqlAutoConf() error {
@@ -754,7 +1216,7 @@ func (p *Manager) createPostgresqlAutoConf() error {
 	return nil
 }
 
-func (p *Manager) SyncFromFollowedPGRewind(followedConnParams ConnParams, password string) error {
+func (p *Manager) SyncFromFollowedPGRewind(ctx context.Context, followedConnParams ConnParams, password string) error {
 	// Remove postgresql.auto.conf since pg_rewind will error if it's a symlink to /dev/null
 	pgAutoConfPath := filepath.Join(p.dataDir, postgresAutoConf)
 	if err := os.Remove(pgAutoConfPath); err != nil && !os.IsNotExist(err) {
@@ -781,8 +1243,8 @@ func (p *Manager) SyncFromFollowedPGRewind(followedConnParams ConnParams, passwo
 	followedConnString := followedConnParams.ConnString()
 
 	log.Infow("running pg_rewind")
-	name := filepath.Join(p.pgBinPath, "pg_rewind")
-	cmd := exec.Command(name, "--debug", "-D", p.dataDir, "--source-server="+followedConnString)
+	name := filepath.Join(p.BinPath(), "pg_rewind")
+	cmd := exec.CommandContext(ctx, name, "--debug", "-D", p.dataDir, "--source-server="+followedConnString)
 	cmd.Env = append(os.Environ(), fmt.Sprintf("PGPASSFILE=%s", pgpass.Name()))
 	log.Debugw("execing cmd", "cmd", cmd)
 
@@ -795,7 +1257,69 @@ func (p *Manager) SyncFromFollowedPGRewind(followedConnParams ConnParams, passwo
 	return nil
 }
 
-func (p *Manager) SyncFromFollowed(followedConnParams ConnParams, replSlot string) error {
+// BasebackupFeatures returns the optional features supported by the
+// installed pg_basebackup
+func (p *Manager) BasebackupFeatures() (BasebackupFeatures, error) {
+	name := filepath.Join(p.BinPath(), "pg_basebackup")
+	cmd := exec.Command(name, "--help")
+	log.Debugw("execing cmd", "cmd", cmd)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return BasebackupFeatures{}, fmt.Errorf("error: %v, output: %s", err, string(out))
+	}
+	return basebackupFeatures(string(out)), nil
+}
+
+// SyncFromPgBackRest restores the data dir with a pgBackRest delta restore.
+// The pgbackrest executable must be in the PATH.
+func (p *Manager) SyncFromPgBackRest(ctx context.Context, opts *PgBackRestOptions) error {
+	name, err := exec.LookPath("pgbackrest")
+	if err != nil {
+		return fmt.Errorf("pgbackrest not available: %v", err)
+	}
+	if err := os.MkdirAll(p.dataDir, 0700); err != nil {
+		return fmt.Errorf("cannot create data dir: %v", err)
+	}
+
+	log.Infow("running pgbackrest restore")
+	cmd := exec.CommandContext(ctx, name, pgBackRestRestoreArgs(p.dataDir, opts)...)
+	log.Debugw("execing cmd", "cmd", cmd)
+
+	// Pipe command's std[err|out] to parent.
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error: %v", err)
+	}
+	return nil
+}
+
+// SyncFromWalG fetches the provided backup in the data dir with WAL-G.
+// command is the WAL-G command with its arguments.
+func (p *Manager) SyncFromWalG(ctx context.Context, command []string, backupName string) error {
+	if len(command) == 0 {
+		return fmt.Errorf("empty wal-g command")
+	}
+	name, err := exec.LookPath(command[0])
+	if err != nil {
+		return fmt.Errorf("%s not available: %v", command[0], err)
+	}
+
+	log.Infow("running wal-g backup-fetch", "backup", backupName)
+	args := append(command[1:len(command):len(command)], walgBackupFetchArgs(p.dataDir, backupName)...)
+	cmd := exec.CommandContext(ctx, name, args...)
+	log.Debugw("execing cmd", "cmd", cmd)
+
+	// Pipe command's std[err|out] to parent.
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error: %v", err)
+	}
+	return nil
+}
+
+func (p *Manager) SyncFromFollowed(ctx context.Context, followedConnParams ConnParams, replSlot string, opts *BasebackupOptions) error {
 	fcp := followedConnParams.Copy()
 
 	// ioutil.Tempfile already creates files with 0600 permissions
@@ -815,6 +1339,16 @@ func (p *Manager) SyncFromFollowed(followedConnParams ConnParams, replSlot strin
 	// Remove password from the params passed to pg_basebackup
 	fcp.Del("password")
 
+	// pg_basebackup requires the relocated tablespaces directories to be
+	// empty
+	if opts != nil {
+		for _, dir := range opts.TablespaceMap {
+			if err := removeDirContents(dir); err != nil {
+				return fmt.Errorf("failed to remove the tablespace directory %q contents: %v", dir, err)
+			}
+		}
+	}
+
 	// Disable synchronous commits. pg_basebackup calls
 	// pg_start_backup()/pg_stop_backup() on the master but if synchronous
 	// replication is enabled and there're no active standbys they will hang.
@@ -822,12 +1356,9 @@ func (p *Manager) SyncFromFollowed(followedConnParams ConnParams, replSlot strin
 	followedConnString := fcp.ConnString()
 
 	log.Infow("running pg_basebackup")
-	name := filepath.Join(p.pgBinPath, "pg_basebackup")
-	args := []string{"-R", "-Xs", "-D", p.dataDir, "-d", followedConnString}
-	if replSlot != "" {
-		args = append(args, "--slot", replSlot)
-	}
-	cmd := exec.Command(name, args...)
+	name := filepath.Join(p.BinPath(), "pg_basebackup")
+	args := basebackupArgs(p.dataDir, followedConnString, replSlot, opts)
+	cmd := exec.CommandContext(ctx, name, args...)
 
 	cmd.Env = append(os.Environ(), fmt.Sprintf("PGPASSFILE=%s", pgpass.Name()))
 	log.Debugw("execing cmd", "cmd", cmd)
@@ -841,6 +1372,163 @@ func (p *Manager) SyncFromFollowed(followedConnParams ConnParams, replSlot strin
 	return nil
 }
 
+// SyncFromFollowedRsync updates the data dir copying with rsync, from the
+// provided source, the followed db data dir files changed or missing inside
+// a non exclusive backup. The backup label is written in the data dir so the
+// instance will start recovering from the backup start point. The rsync
+// executable must be in the PATH and the followed db mustn't have
+// tablespaces. When bwLimit is not empty the rsync bandwidth is limited to it
+// (in kilobytes per second).
+func (p *Manager) SyncFromFollowedRsync(ctx context.Context, followedConnParams ConnParams, source, bwLimit string) error {
+	name, err := exec.LookPath("rsync")
+	if err != nil {
+		return fmt.Errorf("rsync not available: %v", err)
+	}
+	if err := os.MkdirAll(p.dataDir, 0700); err != nil {
+		return fmt.Errorf("cannot create data dir: %v", err)
+	}
+
+	fcp := followedConnParams.Copy()
+	// Disable synchronous commits or, if synchronous replication is enabled
+	// and there're no active standbys, the backup start and stop will hang.
+	fcp.Set("options", "-c synchronous_commit=off")
+	db, err := sql.Open("postgres", fcp.ConnString())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// a non exclusive backup must be started and stopped in the same
+	// session. If the session is closed before stopping it the backup is
+	// aborted.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var versionNum string
+	if err := conn.QueryRowContext(ctx, "show server_version_num").Scan(&versionNum); err != nil {
+		return fmt.Errorf("failed to get the followed db version: %v", err)
+	}
+	maj, min, err := parseServerVersionNum(versionNum)
+	if err != nil {
+		return err
+	}
+	startQuery, stopQuery, err := backupQueries(maj, min)
+	if err != nil {
+		return err
+	}
+
+	log.Infow("starting backup on the followed db")
+	if _, err := conn.ExecContext(ctx, startQuery, "stolon rsync resync"); err != nil {
+		return fmt.Errorf("failed to start the backup: %v", err)
+	}
+
+	log.Infow("running rsync", "source", source, "bwLimit", bwLimit)
+	cmd := exec.CommandContext(ctx, name, rsyncArgs(source, p.dataDir, bwLimit)...)
+	log.Debugw("execing cmd", "cmd", cmd)
+
+	// Pipe command's std[err|out] to parent.
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error: %v", err)
+	}
+
+	var labelFile, spcMapFile sql.NullString
+	if err := conn.QueryRowContext(ctx, stopQuery).Scan(&labelFile, &spcMapFile); err != nil {
+		return fmt.Errorf("failed to stop the backup: %v", err)
+	}
+	if spcMapFile.String != "" {
+		return fmt.Errorf("the followed db has tablespaces, they aren't supported by the rsync resync")
+	}
+
+	// remove the local wal and replication slots, the excluded files
+	// aren't deleted by rsync
+	walDir := "pg_wal"
+	if maj < 10 {
+		walDir = "pg_xlog"
+	}
+	for _, dir := range []string{walDir, "pg_replslot"} {
+		if err := removeDirContents(filepath.Join(p.dataDir, dir)); err != nil {
+			return fmt.Errorf("failed to remove the %s directory contents: %v", dir, err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(p.dataDir, walDir, "archive_status"), 0700); err != nil {
+		return fmt.Errorf("cannot create the wal archive status dir: %v", err)
+	}
+
+	return common.WriteFileAtomicFunc(filepath.Join(p.dataDir, "backup_label"), 0600,
+		func(f io.Writer) error {
+			_, err := f.Write([]byte(labelFile.String))
+			return err
+		})
+}
+
+// RequiredWalFile returns the first wal file required to start the (stopped)
+// instance: the backup_label start wal file or, without a backup_label, the
+// latest checkpoint redo wal file.
+func (p *Manager) RequiredWalFile() (string, error) {
+	label, err := ioutil.ReadFile(filepath.Join(p.dataDir, "backup_label"))
+	if err == nil {
+		return parseBackupLabelWalFile(string(label))
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	cd, err := p.GetControlData()
+	if err != nil {
+		return "", err
+	}
+	if cd.RedoWalFile == "" {
+		return "", fmt.Errorf("latest checkpoint redo wal file not reported by pg_controldata")
+	}
+	return cd.RedoWalFile, nil
+}
+
+// HasWalFile reports if the wal file is in the instance wal directory
+func (p *Manager) HasWalFile(name string) (bool, error) {
+	maj, _, err := p.PGDataVersion()
+	if err != nil {
+		return false, err
+	}
+	return fileExists(filepath.Join(p.dataDir, walDirName(maj), name))
+}
+
+// HasRemoteWalFile reports if the wal file is in the wal directory of the
+// instance, with the same major version, reachable with the provided
+// connection parameters
+func (p *Manager) HasRemoteWalFile(connParams ConnParams, name string) (bool, error) {
+	maj, _, err := p.PGDataVersion()
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	return hasRemoteWalFile(ctx, connParams, walDirName(maj), name)
+}
+
+// WalSize returns the size of the instance wal directory
+func (p *Manager) WalSize() (uint64, error) {
+	maj, _, err := p.PGDataVersion()
+	if err != nil {
+		return 0, err
+	}
+	walDir := "pg_wal"
+	if maj < 10 {
+		walDir = "pg_xlog"
+	}
+	return dirSize(filepath.Join(p.dataDir, walDir))
+}
+
+// Checkpoint forces a checkpoint on the instance
+func (p *Manager) Checkpoint() error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	return checkpoint(ctx, p.localConnParams)
+}
+
 func (p *Manager) RemoveAll() error {
 	initialized, err := p.IsInitialized()
 	if err != nil {
@@ -860,6 +1548,113 @@ func (p *Manager) RemoveAll() error {
 	return os.RemoveAll(p.dataDir)
 }
 
+// GetUpgradeConfig reads from the running instance the configuration of the
+// new data dir needed by Upgrade
+func (p *Manager) GetUpgradeConfig() (*UpgradeConfig, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
+	defer cancel()
+	return getUpgradeConfig(ctx, p.localConnParams)
+}
+
+// Upgrade upgrades the data dir of the stopped instance to the postgres major
+// version of the binaries in newPGBinPath with pg_upgrade in link mode. The
+// new data dir is initialized beside the current one, since the linked files
+// must be on the same file system, and replaces it only when pg_upgrade
+// succeeds. On failure the current data dir can still be used with the
+// current binaries.
+func (p *Manager) Upgrade(ctx context.Context, newPGBinPath string, cfg *UpgradeConfig) error {
+	maj, _, err := p.PGDataVersion()
+	if err != nil {
+		return err
+	}
+	walDir := walDirName(maj)
+	fi, err := os.Lstat(filepath.Join(p.dataDir, walDir))
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("upgrading a data dir with a separate %s directory isn't supported", walDir)
+	}
+
+	newDataDir := upgradeDataDir(p.dataDir)
+	if err := os.RemoveAll(newDataDir); err != nil {
+		return fmt.Errorf("cannot remove the previous upgrade data dir: %v", err)
+	}
+	if err := p.upgrade(ctx, newPGBinPath, newDataDir, cfg); err != nil {
+		if cerr := p.CleanupUpgrade(); cerr != nil {
+			log.Errorw("failed to clean up the failed upgrade", zap.Error(cerr))
+		}
+		return err
+	}
+
+	// replace the data dir with the upgraded one. CleanupUpgrade completes
+	// the replacement if interrupted.
+	oldDataDir := upgradeOldDataDir(p.dataDir)
+	if err := os.Rename(p.dataDir, oldDataDir); err != nil {
+		return fmt.Errorf("cannot rename the data dir: %v", err)
+	}
+	if err := os.Rename(newDataDir, p.dataDir); err != nil {
+		return fmt.Errorf("cannot rename the upgraded data dir: %v", err)
+	}
+	return os.RemoveAll(oldDataDir)
+}
+
+func (p *Manager) upgrade(ctx context.Context, newPGBinPath, newDataDir string, cfg *UpgradeConfig) error {
+	// ioutil.Tempfile already creates files with 0600 permissions
+	pwfile, err := ioutil.TempFile("", "pwfile")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(pwfile.Name())
+	defer pwfile.Close()
+	pwfile.WriteString(p.suPassword)
+
+	pgpass, err := ioutil.TempFile("", "pgpass")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(pgpass.Name())
+	defer pgpass.Close()
+	pgpass.WriteString(fmt.Sprintf("*:*:*:%s:%s\n", p.suUsername, p.suPassword))
+
+	log.Infow("initializing the upgrade data dir", "dataDir", newDataDir)
+	args := upgradeInitdbArgs(newDataDir, p.suUsername, cfg)
+	if p.suAuthMethod == "md5" || p.suAuthMethod == "scram-sha-256" {
+		args = append(args, "--pwfile", pwfile.Name())
+	}
+	cmd := exec.CommandContext(ctx, filepath.Join(newPGBinPath, "initdb"), args...)
+	log.Debugw("execing cmd", "cmd", cmd)
+	// Pipe command's std[err|out] to parent.
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("initdb error: %v", err)
+	}
+
+	log.Infow("running pg_upgrade")
+	cmd = exec.CommandContext(ctx, filepath.Join(newPGBinPath, "pg_upgrade"), pgUpgradeArgs(p.BinPath(), newPGBinPath, p.dataDir, newDataDir, p.suUsername)...)
+	// pg_upgrade writes its logs and creates its unix sockets in the
+	// current directory
+	cmd.Dir = filepath.Dir(p.dataDir)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("PGPASSFILE=%s", pgpass.Name()))
+	log.Debugw("execing cmd", "cmd", cmd)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pg_upgrade error: %v", err)
+	}
+	return nil
+}
+
+// CleanupUpgrade cleans up an Upgrade that failed or has been interrupted
+// (i.e. by a keeper crash): when the upgraded data dir was replacing the
+// current one the replacement is completed, otherwise the upgrade data dir is
+// removed and the current data dir control file, renamed by pg_upgrade in link
+// mode, is restored.
+func (p *Manager) CleanupUpgrade() error {
+	return cleanupUpgrade(p.dataDir)
+}
+
 func (p *Manager) GetSystemData() (*SystemData, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), p.requestTimeout)
 	defer cancel()
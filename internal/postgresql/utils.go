@@ -19,15 +19,20 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/sorintlab/stolon/internal/common"
 
 	"os"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 const (
@@ -39,6 +44,55 @@ var (
 	ValidReplSlotName = regexp.MustCompile("^[a-z0-9_]+$")
 )
 
+// managedPublicationComment is the comment set on the publications created
+// by stolon. Only publications with this comment will be dropped.
+const managedPublicationComment = "managed by stolon"
+
+// Publication is a logical replication publication
+type Publication struct {
+	Name      string
+	AllTables bool
+	// Tables are the published tables in the schema.table format
+	Tables []string
+	// Managed reports if the publication was created by stolon
+	Managed bool
+}
+
+// Extension is an extension to create in a database
+type Extension struct {
+	Name string
+	// Schema is the schema where the extension objects are created, when
+	// empty the default creation schema is used
+	Schema string
+	// Version is the version to create or update to, when empty the
+	// default version is created and the extension is never updated
+	Version string
+}
+
+// ReplicationSlotStatus is the status of a physical replication slot
+type ReplicationSlotStatus struct {
+	Name   string
+	Active bool
+	// RestartLSN is the oldest wal position still required by the slot
+	// consumer. It's 0 when the slot has never been used.
+	RestartLSN uint64
+}
+
+// LogicalReplicationSlotStatus is the status of a logical replication slot
+type LogicalReplicationSlotStatus struct {
+	Name     string
+	Database string
+	Plugin   string
+	// ConfirmedFlushLSN is the position up to which the slot consumer has
+	// confirmed receiving data
+	ConfirmedFlushLSN uint64
+}
+
+type Tablespace struct {
+	Name     string
+	Location string
+}
+
 func dbExec(ctx context.Context, db *sql.DB, query string, args ...interface{}) (sql.Result, error) {
 	ch := make(chan struct {
 		res sql.Result
@@ -73,137 +127,1012 @@ func query(ctx context.Context, db *sql.DB, query string, args ...interface{}) (
 		}{rows, err}
 	}()
 
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case out := <-ch:
-		return out.rows, out.err
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case out := <-ch:
+		return out.rows, out.err
+	}
+}
+
+func ping(ctx context.Context, connParams ConnParams) error {
+	db, err := sql.Open("postgres", connParams.ConnString())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = dbExec(ctx, db, "select 1")
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func setPassword(ctx context.Context, connParams ConnParams, username, password string) error {
+	db, err := sql.Open("postgres", connParams.ConnString())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = dbExec(ctx, db, fmt.Sprintf(`alter role %s with password '%s';`, username, password))
+	return err
+}
+
+// isScramPassword reports if the role password is stored as a scram-sha-256
+// hash
+func isScramPassword(ctx context.Context, connParams ConnParams, username string) (bool, error) {
+	db, err := sql.Open("postgres", connParams.ConnString())
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	rows, err := query(ctx, db, "select coalesce(rolpassword like 'SCRAM-SHA-256$%', false) from pg_authid where rolname = $1", username)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var scram bool
+	for rows.Next() {
+		if err := rows.Scan(&scram); err != nil {
+			return false, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	return scram, nil
+}
+
+// setScramPassword sets the role password storing it as a scram-sha-256
+// hash regardless of the instance password_encryption
+func setScramPassword(ctx context.Context, connParams ConnParams, username, password string) error {
+	db, err := sql.Open("postgres", connParams.ConnString())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "set local password_encryption = 'scram-sha-256'"); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`alter role "%s" with password '%s';`, username, password)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// quoteLiteral quotes a string as a sql string literal
+func quoteLiteral(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// hasRemoteWalFile reports if the wal file is in the instance wal directory
+func hasRemoteWalFile(ctx context.Context, connParams ConnParams, walDir, name string) (bool, error) {
+	db, err := sql.Open("postgres", connParams.ConnString())
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	rows, err := query(ctx, db, "select exists(select 1 from pg_ls_dir($1) as f where f = $2)", walDir, name)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var exists bool
+	for rows.Next() {
+		if err := rows.Scan(&exists); err != nil {
+			return false, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+func setupMonitoringRole(ctx context.Context, connParams ConnParams, username, password string, grantMonitor, scram bool) error {
+	db, err := sql.Open("postgres", connParams.ConnString())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var exists bool
+	if err := tx.QueryRowContext(ctx, "select exists(select 1 from pg_roles where rolname = $1)", username).Scan(&exists); err != nil {
+		return err
+	}
+	if scram {
+		if _, err := tx.ExecContext(ctx, "set local password_encryption = 'scram-sha-256'"); err != nil {
+			return err
+		}
+	}
+	action := "create"
+	if exists {
+		action = "alter"
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("%s role %s with login nosuperuser password %s", action, pq.QuoteIdentifier(username), quoteLiteral(password))); err != nil {
+		return err
+	}
+	if grantMonitor {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("grant pg_monitor to %s", pq.QuoteIdentifier(username))); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func createRole(ctx context.Context, connParams ConnParams, roles []string, username, password string) error {
+	db, err := sql.Open("postgres", connParams.ConnString())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = dbExec(ctx, db, fmt.Sprintf(`create role "%s" with login replication encrypted password '%s';`, username, password))
+	return err
+}
+
+func createPasswordlessRole(ctx context.Context, connParams ConnParams, roles []string, username string) error {
+	db, err := sql.Open("postgres", connParams.ConnString())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = dbExec(ctx, db, fmt.Sprintf(`create role "%s" with login replication;`, username))
+	return err
+}
+
+func alterRole(ctx context.Context, connParams ConnParams, roles []string, username, password string) error {
+	db, err := sql.Open("postgres", connParams.ConnString())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = dbExec(ctx, db, fmt.Sprintf(`alter role "%s" with login replication encrypted password '%s';`, username, password))
+	return err
+}
+
+func alterPasswordlessRole(ctx context.Context, connParams ConnParams, roles []string, username string) error {
+	db, err := sql.Open("postgres", connParams.ConnString())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = dbExec(ctx, db, fmt.Sprintf(`alter role "%s" with login replication;`, username))
+	return err
+}
+
+// getReplicatinSlots return existing physical replication slots. On
+// PostgreSQL > 10 we skip temporary slots.
+func getReplicationSlots(ctx context.Context, connParams ConnParams, maj int) ([]string, error) {
+	var q string
+	if maj < 10 {
+		q = "select slot_name from pg_replication_slots where slot_type = 'physical'"
+	} else {
+		q = "select slot_name from pg_replication_slots where slot_type = 'physical' and temporary is false"
+	}
+
+	db, err := sql.Open("postgres", connParams.ConnString())
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	replSlots := []string{}
+
+	rows, err := query(ctx, db, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var slotName string
+		if err := rows.Scan(&slotName); err != nil {
+			return nil, err
+		}
+		replSlots = append(replSlots, slotName)
+	}
+
+	return replSlots, nil
+}
+
+// getTablespaces returns the tablespaces, excluding the default ones, and
+// their locations
+func getTablespaces(ctx context.Context, connParams ConnParams) ([]*Tablespace, error) {
+	db, err := sql.Open("postgres", connParams.ConnString())
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	tablespaces := []*Tablespace{}
+
+	rows, err := query(ctx, db, "select spcname, pg_tablespace_location(oid) from pg_tablespace where spcname not in ('pg_default', 'pg_global') order by spcname")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		ts := &Tablespace{}
+		if err := rows.Scan(&ts.Name, &ts.Location); err != nil {
+			return nil, err
+		}
+		tablespaces = append(tablespaces, ts)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return tablespaces, nil
+}
+
+// getPhysicalReplicationSlots returns the status of the existing physical
+// replication slots. On PostgreSQL > 10 we skip temporary slots.
+func getPhysicalReplicationSlots(ctx context.Context, connParams ConnParams, maj int) ([]*ReplicationSlotStatus, error) {
+	q := "select slot_name, active, coalesce(restart_lsn::text, '') from pg_replication_slots where slot_type = 'physical'"
+	if maj >= 10 {
+		q += " and temporary is false"
+	}
+
+	db, err := sql.Open("postgres", connParams.ConnString())
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	replSlots := []*ReplicationSlotStatus{}
+
+	rows, err := query(ctx, db, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var restartLSN string
+		rs := &ReplicationSlotStatus{}
+		if err := rows.Scan(&rs.Name, &rs.Active, &restartLSN); err != nil {
+			return nil, err
+		}
+		if restartLSN != "" {
+			if rs.RestartLSN, err = PGLsnToInt(restartLSN); err != nil {
+				return nil, err
+			}
+		}
+		replSlots = append(replSlots, rs)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return replSlots, nil
+}
+
+func createReplicationSlot(ctx context.Context, connParams ConnParams, name string, immediatelyReserve bool) error {
+	db, err := sql.Open("postgres", connParams.ConnString())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	q := fmt.Sprintf("select pg_create_physical_replication_slot('%s')", name)
+	if immediatelyReserve {
+		q = fmt.Sprintf("select pg_create_physical_replication_slot('%s', true)", name)
+	}
+	_, err = dbExec(ctx, db, q)
+	return err
+}
+
+// logicalReplicationSlotsQuery returns the query of the existing logical
+// replication slots. The confirmed_flush_lsn column has been added in
+// PostgreSQL 9.6 and the temporary slots in PostgreSQL 10.
+func logicalReplicationSlotsQuery(maj, min int) string {
+	q := "select slot_name, database, plugin, '' from pg_replication_slots where slot_type = 'logical'"
+	if maj > 9 || (maj == 9 && min >= 6) {
+		q = "select slot_name, database, plugin, coalesce(confirmed_flush_lsn::text, '') from pg_replication_slots where slot_type = 'logical'"
+	}
+	if maj >= 10 {
+		q += " and temporary is false"
+	}
+	return q
+}
+
+// getLogicalReplicationSlots returns the status of the existing logical
+// replication slots. On PostgreSQL >= 10 we skip temporary slots.
+func getLogicalReplicationSlots(ctx context.Context, connParams ConnParams, maj, min int) ([]*LogicalReplicationSlotStatus, error) {
+	db, err := sql.Open("postgres", connParams.ConnString())
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	replSlots := []*LogicalReplicationSlotStatus{}
+
+	rows, err := query(ctx, db, logicalReplicationSlotsQuery(maj, min))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var confirmedFlushLSN string
+		rs := &LogicalReplicationSlotStatus{}
+		if err := rows.Scan(&rs.Name, &rs.Database, &rs.Plugin, &confirmedFlushLSN); err != nil {
+			return nil, err
+		}
+		if confirmedFlushLSN != "" {
+			if rs.ConfirmedFlushLSN, err = PGLsnToInt(confirmedFlushLSN); err != nil {
+				return nil, err
+			}
+		}
+		replSlots = append(replSlots, rs)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return replSlots, nil
+}
+
+func createLogicalReplicationSlot(ctx context.Context, connParams ConnParams, name, plugin string) error {
+	db, err := sql.Open("postgres", connParams.ConnString())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = dbExec(ctx, db, "select pg_create_logical_replication_slot($1, $2)", name, plugin)
+	return err
+}
+
+// advanceReplicationSlot advances the slot up to the provided position. A
+// slot is never moved backwards and, on a standby, isn't moved beyond the
+// replayed position.
+func advanceReplicationSlot(ctx context.Context, connParams ConnParams, name string, lsn uint64) error {
+	db, err := sql.Open("postgres", connParams.ConnString())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = dbExec(ctx, db, "select pg_replication_slot_advance($1, $2::pg_lsn)", name, PGLsn(lsn))
+	return err
+}
+
+// LogStandbySnapshot writes a snapshot of the running transactions on the
+// master (PostgreSQL >= 16). It's needed by a standby to create a logical
+// replication slot without waiting for the next snapshot written by the
+// master.
+func LogStandbySnapshot(ctx context.Context, connParams ConnParams) error {
+	db, err := sql.Open("postgres", connParams.ConnString())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = dbExec(ctx, db, "select pg_log_standby_snapshot()")
+	return err
+}
+
+func dropReplicationSlot(ctx context.Context, connParams ConnParams, name string) error {
+	db, err := sql.Open("postgres", connParams.ConnString())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = dbExec(ctx, db, fmt.Sprintf("select pg_drop_replication_slot('%s')", name))
+	return err
+}
+
+// checkpoint forces a checkpoint (a restartpoint on a standby), recycling the
+// wal files not needed anymore
+func checkpoint(ctx context.Context, connParams ConnParams) error {
+	db, err := sql.Open("postgres", connParams.ConnString())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = dbExec(ctx, db, "checkpoint")
+	return err
+}
+
+// dirSize returns the total size of the regular files in dir and in its
+// subdirectories. If dir is a symlink (i.e. a wal dir outside the data dir)
+// its target is used.
+func dirSize(dir string) (uint64, error) {
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return 0, err
+	}
+	var size uint64
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// a file removed (i.e. a recycled wal file) while walking
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+	return size, err
+}
+
+func execStatements(ctx context.Context, connParams ConnParams, statements []string) error {
+	db, err := sql.Open("postgres", connParams.ConnString())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for i, stmt := range statements {
+		if _, err := dbExec(ctx, db, stmt); err != nil {
+			return fmt.Errorf("statement #%d failed: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// walDirName returns the name of the data dir wal directory, renamed to
+// pg_wal in postgres 10
+func walDirName(maj int) string {
+	if maj < 10 {
+		return "pg_xlog"
+	}
+	return "pg_wal"
+}
+
+// upgradeDataDir returns the data dir initialized by Upgrade for pg_upgrade
+func upgradeDataDir(dataDir string) string {
+	return dataDir + "-upgrade"
+}
+
+// upgradeOldDataDir returns the directory where Upgrade moves the data dir
+// replaced by the upgraded one
+func upgradeOldDataDir(dataDir string) string {
+	return dataDir + "-old"
+}
+
+// upgradeInitdbArgs returns the initdb arguments to initialize the pg_upgrade
+// new data dir with the same configuration of the data dir to upgrade
+func upgradeInitdbArgs(dataDir, username string, cfg *UpgradeConfig) []string {
+	args := []string{"-D", dataDir, "-U", username, "--encoding", cfg.Encoding, "--lc-collate", cfg.LCCollate, "--lc-ctype", cfg.LCCtype}
+	if cfg.DataChecksums {
+		args = append(args, "--data-checksums")
+	}
+	return args
+}
+
+// pgUpgradeArgs returns the arguments of a pg_upgrade in link mode
+func pgUpgradeArgs(oldBinPath, newBinPath, oldDataDir, newDataDir, username string) []string {
+	return []string{"--link", "-b", oldBinPath, "-B", newBinPath, "-d", oldDataDir, "-D", newDataDir, "-U", username}
+}
+
+// cleanupUpgrade recovers the data dir from an interrupted Upgrade: a
+// completed pg_upgrade replaces the data dir with the upgraded one, a failed
+// one is removed restoring the control file disabled by pg_upgrade
+func cleanupUpgrade(dataDir string) error {
+	newDataDir := upgradeDataDir(dataDir)
+	oldDataDir := upgradeOldDataDir(dataDir)
+
+	oldExists, err := fileExists(oldDataDir)
+	if err != nil {
+		return err
+	}
+	if oldExists {
+		exists, err := fileExists(dataDir)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			log.Infow("completing the replacement of the data dir with the upgraded one")
+			if err := os.Rename(newDataDir, dataDir); err != nil {
+				return fmt.Errorf("cannot rename the upgraded data dir: %v", err)
+			}
+		}
+		return os.RemoveAll(oldDataDir)
+	}
+
+	newExists, err := fileExists(newDataDir)
+	if err != nil {
+		return err
+	}
+	if !newExists {
+		return nil
+	}
+	log.Infow("removing the data dir of a failed upgrade", "dataDir", newDataDir)
+	if err := os.RemoveAll(newDataDir); err != nil {
+		return err
+	}
+	controlFile := filepath.Join(dataDir, "global", "pg_control")
+	exists, err := fileExists(controlFile)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	if exists, err := fileExists(controlFile + ".old"); err != nil || !exists {
+		return err
+	}
+	log.Infow("restoring the data dir control file renamed by pg_upgrade")
+	return os.Rename(controlFile+".old", controlFile)
+}
+
+// getUpgradeConfig reads the template0 encoding and locale, used by initdb
+// for all the template databases, and the data checksums state
+func getUpgradeConfig(ctx context.Context, connParams ConnParams) (*UpgradeConfig, error) {
+	db, err := sql.Open("postgres", connParams.ConnString())
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	cfg := &UpgradeConfig{}
+	rows, err := query(ctx, db, "select pg_encoding_to_char(encoding), datcollate, datctype from pg_database where datname = 'template0'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("database template0 not found")
+	}
+	if err := rows.Scan(&cfg.Encoding, &cfg.LCCollate, &cfg.LCCtype); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	cfg.DataChecksums, err = getDataChecksums(ctx, connParams)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// walDirFlag returns the initdb wal directory flag for the postgres major
+// version, renamed from --xlogdir to --waldir in postgres 10
+func walDirFlag(maj int) string {
+	if maj >= 10 {
+		return "--waldir"
+	}
+	return "--xlogdir"
+}
+
+// getDatabases returns the names of the databases that accept connections
+func getDatabases(ctx context.Context, connParams ConnParams) ([]string, error) {
+	db, err := sql.Open("postgres", connParams.ConnString())
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := query(ctx, db, "select datname from pg_database where datallowconn and not datistemplate")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	databases := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		databases = append(databases, name)
+	}
+	return databases, nil
+}
+
+func getPublications(ctx context.Context, connParams ConnParams) ([]*Publication, error) {
+	db, err := sql.Open("postgres", connParams.ConnString())
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := query(ctx, db, "select oid, pubname, puballtables, coalesce(obj_description(oid, 'pg_publication'), '') from pg_publication")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	publications := []*Publication{}
+	pubsByName := map[string]*Publication{}
+	for rows.Next() {
+		var oid int64
+		var comment string
+		pub := &Publication{}
+		if err := rows.Scan(&oid, &pub.Name, &pub.AllTables, &comment); err != nil {
+			return nil, err
+		}
+		pub.Managed = comment == managedPublicationComment
+		publications = append(publications, pub)
+		pubsByName[pub.Name] = pub
+	}
+
+	trows, err := query(ctx, db, "select pubname, schemaname, tablename from pg_publication_tables order by schemaname, tablename")
+	if err != nil {
+		return nil, err
+	}
+	defer trows.Close()
+
+	for trows.Next() {
+		var pubName, schemaName, tableName string
+		if err := trows.Scan(&pubName, &schemaName, &tableName); err != nil {
+			return nil, err
+		}
+		// tables of all tables publications aren't needed
+		if pub, ok := pubsByName[pubName]; ok && !pub.AllTables {
+			pub.Tables = append(pub.Tables, schemaName+"."+tableName)
+		}
+	}
+	return publications, nil
+}
+
+// quoteTableName quotes a table name in the "table" or "schema.table" format
+func quoteTableName(name string) string {
+	parts := strings.SplitN(name, ".", 2)
+	for i, p := range parts {
+		parts[i] = pq.QuoteIdentifier(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+func quoteTableNames(names []string) string {
+	qnames := make([]string, len(names))
+	for i, n := range names {
+		qnames[i] = quoteTableName(n)
 	}
+	return strings.Join(qnames, ", ")
 }
 
-func ping(ctx context.Context, connParams ConnParams) error {
+func createPublicationQuery(pub *Publication) string {
+	if pub.AllTables {
+		return fmt.Sprintf("create publication %s for all tables", pq.QuoteIdentifier(pub.Name))
+	}
+	return fmt.Sprintf("create publication %s for table %s", pq.QuoteIdentifier(pub.Name), quoteTableNames(pub.Tables))
+}
+
+func createPublication(ctx context.Context, connParams ConnParams, pub *Publication) error {
 	db, err := sql.Open("postgres", connParams.ConnString())
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
-	_, err = dbExec(ctx, db, "select 1")
-	if err != nil {
+	if _, err := dbExec(ctx, db, createPublicationQuery(pub)); err != nil {
 		return err
 	}
-	return nil
+	// mark the publication as managed by stolon
+	_, err = dbExec(ctx, db, fmt.Sprintf("comment on publication %s is '%s'", pq.QuoteIdentifier(pub.Name), managedPublicationComment))
+	return err
 }
 
-func setPassword(ctx context.Context, connParams ConnParams, username, password string) error {
+func dropPublication(ctx context.Context, connParams ConnParams, name string) error {
 	db, err := sql.Open("postgres", connParams.ConnString())
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
-	_, err = dbExec(ctx, db, fmt.Sprintf(`alter role %s with password '%s';`, username, password))
+	_, err = dbExec(ctx, db, fmt.Sprintf("drop publication %s", pq.QuoteIdentifier(name)))
 	return err
 }
 
-func createRole(ctx context.Context, connParams ConnParams, roles []string, username, password string) error {
+func setPublicationTables(ctx context.Context, connParams ConnParams, name string, tables []string) error {
 	db, err := sql.Open("postgres", connParams.ConnString())
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
-	_, err = dbExec(ctx, db, fmt.Sprintf(`create role "%s" with login replication encrypted password '%s';`, username, password))
+	_, err = dbExec(ctx, db, fmt.Sprintf("alter publication %s set table %s", pq.QuoteIdentifier(name), quoteTableNames(tables)))
 	return err
 }
 
-func createPasswordlessRole(ctx context.Context, connParams ConnParams, roles []string, username string) error {
+// extensionQuery returns the query creating the extension, or updating it
+// when installed with another version than the required one. It returns an
+// empty query if nothing has to be done.
+func extensionQuery(ext *Extension, installed bool, installedVersion string) string {
+	if installed {
+		if ext.Version == "" || ext.Version == installedVersion {
+			return ""
+		}
+		return fmt.Sprintf("alter extension %s update to %s", pq.QuoteIdentifier(ext.Name), quoteLiteral(ext.Version))
+	}
+	q := fmt.Sprintf("create extension if not exists %s", pq.QuoteIdentifier(ext.Name))
+	if ext.Schema != "" {
+		q += fmt.Sprintf(" schema %s", pq.QuoteIdentifier(ext.Schema))
+	}
+	if ext.Version != "" {
+		q += fmt.Sprintf(" version %s", quoteLiteral(ext.Version))
+	}
+	// also create the extensions it depends on
+	return q + " cascade"
+}
+
+// setupExtension creates or updates the extension. It reports if the
+// extension has been changed.
+func setupExtension(ctx context.Context, connParams ConnParams, ext *Extension) (bool, error) {
 	db, err := sql.Open("postgres", connParams.ConnString())
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer db.Close()
 
-	_, err = dbExec(ctx, db, fmt.Sprintf(`create role "%s" with login replication;`, username))
-	return err
+	rows, err := query(ctx, db, "select extversion from pg_extension where extname = $1", ext.Name)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	installed := false
+	var installedVersion string
+	for rows.Next() {
+		installed = true
+		if err := rows.Scan(&installedVersion); err != nil {
+			return false, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	q := extensionQuery(ext, installed, installedVersion)
+	if q == "" {
+		return false, nil
+	}
+	if _, err := dbExec(ctx, db, q); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-func alterRole(ctx context.Context, connParams ConnParams, roles []string, username, password string) error {
+// ParseSharedPreloadLibraries parses the shared_preload_libraries value
+func ParseSharedPreloadLibraries(v string) []string {
+	libs := []string{}
+	for _, l := range strings.Split(v, ",") {
+		l = strings.Trim(strings.TrimSpace(l), `"`)
+		if l != "" {
+			libs = append(libs, l)
+		}
+	}
+	return libs
+}
+
+func getSharedPreloadLibraries(ctx context.Context, connParams ConnParams) ([]string, error) {
 	db, err := sql.Open("postgres", connParams.ConnString())
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer db.Close()
 
-	_, err = dbExec(ctx, db, fmt.Sprintf(`alter role "%s" with login replication encrypted password '%s';`, username, password))
-	return err
+	rows, err := query(ctx, db, "show shared_preload_libraries")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var v string
+	for rows.Next() {
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return ParseSharedPreloadLibraries(v), nil
 }
 
-func alterPasswordlessRole(ctx context.Context, connParams ConnParams, roles []string, username string) error {
+func getDataChecksums(ctx context.Context, connParams ConnParams) (bool, error) {
 	db, err := sql.Open("postgres", connParams.ConnString())
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer db.Close()
 
-	_, err = dbExec(ctx, db, fmt.Sprintf(`alter role "%s" with login replication;`, username))
-	return err
+	rows, err := query(ctx, db, "show data_checksums")
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var dataChecksums string
+	for rows.Next() {
+		if err := rows.Scan(&dataChecksums); err != nil {
+			return false, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	return dataChecksums == "on", nil
 }
 
-// getReplicatinSlots return existing replication slots. On PostgreSQL > 10 we
-// skip temporary slots.
-func getReplicationSlots(ctx context.Context, connParams ConnParams, maj int) ([]string, error) {
-	var q string
+func getReplayLag(ctx context.Context, connParams ConnParams) (float64, bool, error) {
+	db, err := sql.Open("postgres", connParams.ConnString())
+	if err != nil {
+		return 0, false, err
+	}
+	defer db.Close()
+
+	// pg_last_xact_replay_timestamp is null on a primary instance
+	rows, err := query(ctx, db, "select extract(epoch from now() - pg_last_xact_replay_timestamp())")
+	if err != nil {
+		return 0, false, err
+	}
+	defer rows.Close()
+
+	var lag sql.NullFloat64
+	for rows.Next() {
+		if err := rows.Scan(&lag); err != nil {
+			return 0, false, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, false, err
+	}
+	return lag.Float64, lag.Valid, nil
+}
+
+// replayXLogPosQuery returns the query reporting the last replayed wal
+// position, renamed in PostgreSQL 10
+func replayXLogPosQuery(maj int) string {
 	if maj < 10 {
-		q = "select slot_name from pg_replication_slots"
-	} else {
-		q = "select slot_name from pg_replication_slots where temporary is false"
+		return "select pg_last_xlog_replay_location()"
+	}
+	return "select pg_last_wal_replay_lsn()"
+}
+
+func getReplayXLogPos(ctx context.Context, connParams ConnParams, maj int) (uint64, bool, error) {
+	// the replayed position is null on a primary instance
+	return queryLsn(ctx, connParams, replayXLogPosQuery(maj))
+}
+
+// currentWalLsnQuery returns the query reporting the current wal write
+// position of a primary instance, renamed in PostgreSQL 10
+func currentWalLsnQuery(maj int) string {
+	if maj < 10 {
+		return "select pg_current_xlog_location()"
+	}
+	return "select pg_current_wal_lsn()"
+}
+
+func getCurrentWalLsn(ctx context.Context, connParams ConnParams, maj int) (uint64, error) {
+	pos, _, err := queryLsn(ctx, connParams, currentWalLsnQuery(maj))
+	return pos, err
+}
+
+// standbyFlushLsnQuery returns the query reporting the wal position flushed
+// by the standby with the application name $1, renamed in PostgreSQL 10
+func standbyFlushLsnQuery(maj int) string {
+	if maj < 10 {
+		return "select flush_location from pg_stat_replication where application_name = $1"
+	}
+	return "select flush_lsn from pg_stat_replication where application_name = $1"
+}
+
+func getStandbyFlushLsn(ctx context.Context, connParams ConnParams, maj int, applicationName string) (uint64, bool, error) {
+	// the standby isn't reported when not connected
+	return queryLsn(ctx, connParams, standbyFlushLsnQuery(maj), applicationName)
+}
+
+// clientBackendsQuery returns the query selecting the columns of the
+// backends of the client connections, excluding the ones of the users in
+// $1. The backend_type has been added in PostgreSQL 10, before the wal
+// senders are the backends without a database.
+func clientBackendsQuery(maj int, columns string) string {
+	cond := "backend_type = 'client backend'"
+	if maj < 10 {
+		cond = "datname is not null"
 	}
+	return fmt.Sprintf("select %s from pg_stat_activity where %s and pid <> pg_backend_pid() and usename <> all($1)", columns, cond)
+}
 
+// getClientBackends returns the number of client backends and of the ones in
+// a transaction
+func getClientBackends(ctx context.Context, connParams ConnParams, maj int, excludedUsers []string) (int, int, error) {
 	db, err := sql.Open("postgres", connParams.ConnString())
 	if err != nil {
-		return nil, err
+		return 0, 0, err
 	}
 	defer db.Close()
 
-	replSlots := []string{}
-
-	rows, err := query(ctx, db, q)
+	rows, err := query(ctx, db, clientBackendsQuery(maj, "count(*), count(xact_start)"), pq.Array(excludedUsers))
 	if err != nil {
-		return nil, err
+		return 0, 0, err
 	}
 	defer rows.Close()
+
+	var backends, transactions int
 	for rows.Next() {
-		var slotName string
-		if err := rows.Scan(&slotName); err != nil {
-			return nil, err
+		if err := rows.Scan(&backends, &transactions); err != nil {
+			return 0, 0, err
 		}
-		replSlots = append(replSlots, slotName)
 	}
-
-	return replSlots, nil
+	return backends, transactions, rows.Err()
 }
 
-func createReplicationSlot(ctx context.Context, connParams ConnParams, name string) error {
+// terminateClientBackends terminates the client backends, returning how many
+// have been terminated
+func terminateClientBackends(ctx context.Context, connParams ConnParams, maj int, excludedUsers []string) (int, error) {
 	db, err := sql.Open("postgres", connParams.ConnString())
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer db.Close()
 
-	_, err = dbExec(ctx, db, fmt.Sprintf("select pg_create_physical_replication_slot('%s')", name))
-	return err
+	rows, err := query(ctx, db, clientBackendsQuery(maj, "count(pg_terminate_backend(pid))"), pq.Array(excludedUsers))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var terminated int
+	for rows.Next() {
+		if err := rows.Scan(&terminated); err != nil {
+			return 0, err
+		}
+	}
+	return terminated, rows.Err()
 }
 
-func dropReplicationSlot(ctx context.Context, connParams ConnParams, name string) error {
+// queryLsn executes a query returning a single, nullable, wal position. It
+// returns false if the position is null.
+func queryLsn(ctx context.Context, connParams ConnParams, q string, args ...interface{}) (uint64, bool, error) {
 	db, err := sql.Open("postgres", connParams.ConnString())
 	if err != nil {
-		return err
+		return 0, false, err
 	}
 	defer db.Close()
 
-	_, err = dbExec(ctx, db, fmt.Sprintf("select pg_drop_replication_slot('%s')", name))
-	return err
+	rows, err := query(ctx, db, q, args...)
+	if err != nil {
+		return 0, false, err
+	}
+	defer rows.Close()
+
+	var lsn sql.NullString
+	for rows.Next() {
+		if err := rows.Scan(&lsn); err != nil {
+			return 0, false, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return 0, false, err
+	}
+	if !lsn.Valid {
+		return 0, false, nil
+	}
+	pos, err := PGLsnToInt(lsn.String)
+	if err != nil {
+		return 0, false, err
+	}
+	return pos, true, nil
 }
 
 func getSyncStandbys(ctx context.Context, connParams ConnParams) ([]string, error) {
@@ -226,7 +1155,9 @@ func getSyncStandbys(ctx context.Context, connParams ConnParams) ([]string, erro
 			return nil, err
 		}
 
-		if syncState == "sync" {
+		// with quorum synchronous replication (ANY num_sync) all the
+		// synchronous standbys are reported as "quorum"
+		if syncState == "sync" || syncState == "quorum" {
 			syncStandbys = append(syncStandbys, applicationName)
 		}
 	}
@@ -251,6 +1182,11 @@ func PGLsnToInt(lsn string) (uint64, error) {
 	return v, nil
 }
 
+// PGLsn returns the pg_lsn text representation of the provided position
+func PGLsn(lsn uint64) string {
+	return fmt.Sprintf("%X/%X", lsn>>32, uint32(lsn))
+}
+
 func GetSystemData(ctx context.Context, replConnParams ConnParams) (*SystemData, error) {
 	// Add "replication=1" connection option
 	replConnParams["replication"] = "1"
@@ -281,6 +1217,53 @@ func GetSystemData(ctx context.Context, replConnParams ConnParams) (*SystemData,
 	return nil, fmt.Errorf("query returned 0 rows")
 }
 
+func parseControlData(out string) (*ControlData, error) {
+	var cd ControlData
+	var foundTimeline, foundCheckpoint bool
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(parts[1])
+		var err error
+		switch strings.TrimSpace(parts[0]) {
+		case "Latest checkpoint's TimeLineID":
+			if cd.TimelineID, err = strconv.ParseUint(value, 10, 64); err != nil {
+				return nil, fmt.Errorf("cannot parse latest checkpoint timeline %q: %v", value, err)
+			}
+			foundTimeline = true
+		case "Latest checkpoint location":
+			if cd.CheckpointXLogPos, err = PGLsnToInt(value); err != nil {
+				return nil, fmt.Errorf("cannot parse latest checkpoint location %q: %v", value, err)
+			}
+			foundCheckpoint = true
+		case "Latest checkpoint's REDO WAL file":
+			cd.RedoWalFile = value
+		}
+	}
+	if !foundTimeline || !foundCheckpoint {
+		return nil, fmt.Errorf("latest checkpoint timeline or location not reported by pg_controldata")
+	}
+	return &cd, nil
+}
+
+// backupLabelStartWalFileRegexp matches the backup_label start wal location
+// line, i.e. "START WAL LOCATION: 0/2000028 (file 000000010000000000000002)"
+var backupLabelStartWalFileRegexp = regexp.MustCompile(`^START WAL LOCATION: \S+ \(file ([0-9A-F]{24})\)$`)
+
+// parseBackupLabelWalFile returns the start wal file of a backup_label
+func parseBackupLabelWalFile(contents string) (string, error) {
+	scanner := bufio.NewScanner(strings.NewReader(contents))
+	for scanner.Scan() {
+		if m := backupLabelStartWalFileRegexp.FindStringSubmatch(scanner.Text()); m != nil {
+			return m[1], nil
+		}
+	}
+	return "", fmt.Errorf("start wal file not reported in backup_label")
+}
+
 func parseTimelinesHistory(contents string) ([]*TimelineHistory, error) {
 	tlsh := []*TimelineHistory{}
 	regex, err := regexp.Compile(`(\S+)\s+(\S+)\s+(.*)$`)
@@ -351,6 +1334,47 @@ func fileExists(path string) (bool, error) {
 	return true, nil
 }
 
+// parseSocketLockFile returns the postmaster pid and data dir written in the
+// first two lines of a unix socket lock file
+func parseSocketLockFile(contents string) (int, string, error) {
+	lines := strings.SplitN(contents, "\n", 3)
+	if len(lines) < 2 {
+		return 0, "", fmt.Errorf("bad socket lock file contents: %q", contents)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(lines[0]))
+	if err != nil {
+		return 0, "", fmt.Errorf("bad socket lock file pid %q: %v", lines[0], err)
+	}
+	// a negative pid is written by a standalone backend
+	if pid < 0 {
+		pid = -pid
+	}
+	return pid, strings.TrimSpace(lines[1]), nil
+}
+
+// SocketOwner returns the data dir of the running postgres instance using the
+// unix socket of the provided port in socketDir. An empty data dir is
+// returned when there's no such instance.
+func SocketOwner(socketDir, port string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(socketDir, fmt.Sprintf(".s.PGSQL.%s.lock", port)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	pid, dataDir, err := parseSocketLockFile(string(data))
+	if err != nil {
+		return "", err
+	}
+	// a stale lock file of a not running instance is removed by postgres
+	// at start
+	if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+		return "", nil
+	}
+	return dataDir, nil
+}
+
 func expand(s, dataDir string) string {
 	buf := make([]byte, 0, 2*len(s))
 	// %d %% are all ASCII, so bytes are fine for this operation.
@@ -436,17 +1460,27 @@ func getConfigFilePGParameters(ctx context.Context, connParams ConnParams) (comm
 	return pgParameters, nil
 }
 
-func ParseBinaryVersion(v string) (int, int, error) {
+// ParseServerVersion extracts the server version from the postgres binary
+// version output
+func ParseServerVersion(v string) (string, error) {
 	// extact version (removing beta*, rc* etc...)
 	regex, err := regexp.Compile(`.* \(PostgreSQL\) ([0-9\.]+).*`)
 	if err != nil {
-		return 0, 0, err
+		return "", err
 	}
 	m := regex.FindStringSubmatch(v)
 	if len(m) != 2 {
-		return 0, 0, fmt.Errorf("failed to parse postgres binary version: %q", v)
+		return "", fmt.Errorf("failed to parse postgres binary version: %q", v)
+	}
+	return m[1], nil
+}
+
+func ParseBinaryVersion(v string) (int, int, error) {
+	sv, err := ParseServerVersion(v)
+	if err != nil {
+		return 0, 0, err
 	}
-	return ParseVersion(m[1])
+	return ParseVersion(sv)
 }
 
 func ParseVersion(v string) (int, int, error) {
@@ -502,3 +1536,241 @@ func WalFileNameNoTimeLine(name string) (string, error) {
 	}
 	return name[8:24], nil
 }
+
+// BasebackupOptions are the pg_basebackup tuning options
+type BasebackupOptions struct {
+	// MaxRate is the max transfer rate (--max-rate)
+	MaxRate string
+	// CheckpointMode is the checkpoint mode (--checkpoint)
+	CheckpointMode string
+	// Jobs is the number of parallel transfer workers (--jobs). It must
+	// be set only when supported by pg_basebackup.
+	Jobs uint16
+	// WalMethod is the wal method (--wal-method). If empty "stream" is
+	// used.
+	WalMethod string
+	// Compression is the server side compression method (--compress). It
+	// must be set only when supported by pg_basebackup.
+	Compression string
+	// CompressionLevel is the compression level. If 0 the compression
+	// method default is used.
+	CompressionLevel uint16
+	// TablespaceMap relocates the tablespaces from the followed db
+	// locations (the keys) to the local ones (--tablespace-mapping)
+	TablespaceMap map[string]string
+}
+
+func basebackupArgs(dataDir, connString, replSlot string, opts *BasebackupOptions) []string {
+	walMethod := "s"
+	if opts != nil && opts.WalMethod == "fetch" {
+		walMethod = "f"
+	}
+	args := []string{"-R", "-X" + walMethod, "-D", dataDir, "-d", connString}
+	if replSlot != "" {
+		args = append(args, "--slot", replSlot)
+	}
+	if opts == nil {
+		return args
+	}
+	if opts.MaxRate != "" {
+		args = append(args, "--max-rate", opts.MaxRate)
+	}
+	if opts.CheckpointMode != "" {
+		args = append(args, "--checkpoint", opts.CheckpointMode)
+	}
+	if opts.Jobs > 1 {
+		args = append(args, "--jobs", strconv.Itoa(int(opts.Jobs)))
+	}
+	if opts.Compression != "" {
+		// with the plain format the backup is decompressed by
+		// pg_basebackup, so only the transferred data is compressed
+		compress := "server-" + opts.Compression
+		if opts.CompressionLevel > 0 {
+			compress += ":level=" + strconv.Itoa(int(opts.CompressionLevel))
+		}
+		args = append(args, "--compress="+compress)
+	}
+	oldDirs := make([]string, 0, len(opts.TablespaceMap))
+	for oldDir := range opts.TablespaceMap {
+		oldDirs = append(oldDirs, oldDir)
+	}
+	sort.Strings(oldDirs)
+	for _, oldDir := range oldDirs {
+		args = append(args, "--tablespace-mapping="+oldDir+"="+opts.TablespaceMap[oldDir])
+	}
+	return args
+}
+
+// removeDirContents removes all the contents of dir, keeping it (it could be
+// a mount point). A not existing dir is ignored.
+func removeDirContents(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PgBackRestOptions are the pgBackRest options used to restore the data dir
+type PgBackRestOptions struct {
+	// Stanza is the pgBackRest stanza (--stanza)
+	Stanza string
+	// ConfigPath is the pgBackRest configuration file (--config)
+	ConfigPath string
+}
+
+// pgBackRestRestoreArgs returns the arguments of a pgBackRest delta restore
+// of the data dir as a standby
+func pgBackRestRestoreArgs(dataDir string, opts *PgBackRestOptions) []string {
+	args := []string{"--stanza=" + opts.Stanza}
+	if opts.ConfigPath != "" {
+		args = append(args, "--config="+opts.ConfigPath)
+	}
+	args = append(args, "--pg1-path="+dataDir, "--delta", "--type=standby", "restore")
+	return args
+}
+
+// walgBackupFetchArgs returns the arguments, after the WAL-G command, of a
+// WAL-G backup fetch in the data dir
+func walgBackupFetchArgs(dataDir, backupName string) []string {
+	return []string{"backup-fetch", dataDir, backupName}
+}
+
+// rsyncExcludes are the data dir paths not copied by the rsync resync. They
+// are the ones excluded by pg_basebackup and the files managed by the keeper.
+// Since the excluded files aren't deleted from the destination the wal and
+// replication slots directories contents are removed after the copy.
+var rsyncExcludes = []string{
+	"/postmaster.pid",
+	"/postmaster.opts",
+	"/backup_label",
+	"/backup_label.old",
+	"/tablespace_map",
+	"/recovery.conf",
+	"/recovery.done",
+	"/recovery.signal",
+	"/standby.signal",
+	"/" + postgresConf,
+	"/" + postgresAutoConf,
+	"/" + tmpPostgresConf,
+	"/pg_hba.conf",
+	"/pg_ident.conf",
+	"/pg_wal/*",
+	"/pg_xlog/*",
+	"/pg_replslot/*",
+	"/pg_dynshmem/*",
+	"/pg_notify/*",
+	"/pg_serial/*",
+	"/pg_snapshots/*",
+	"/pg_stat_tmp/*",
+	"/pg_subtrans/*",
+	"pgsql_tmp*",
+	"pg_internal.init",
+}
+
+// rsyncArgs returns the arguments of the rsync copy of the source data dir
+// in the data dir. The files are compared by checksum since the size and
+// modification time of a diverged relation file could be the same of the
+// source one.
+func rsyncArgs(source, dataDir, bwLimit string) []string {
+	args := []string{"--archive", "--delete", "--checksum"}
+	for _, e := range rsyncExcludes {
+		args = append(args, "--exclude="+e)
+	}
+	if bwLimit != "" {
+		args = append(args, "--bwlimit="+bwLimit)
+	}
+	// copy the source directory contents, not the directory itself
+	if !strings.HasSuffix(source, "/") {
+		source += "/"
+	}
+	return append(args, source, dataDir+"/")
+}
+
+// parseServerVersionNum parses the server_version_num setting
+func parseServerVersionNum(v string) (int, int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse server version num %q: %v", v, err)
+	}
+	// starting from postgres 10 the version has only the major and minor
+	// numbers
+	if n >= 100000 {
+		return n / 10000, n % 10000, nil
+	}
+	return n / 10000, (n / 100) % 100, nil
+}
+
+// backupQueries returns the queries starting and stopping a non exclusive
+// backup for the provided server version. The stop query returns the backup
+// label and tablespace map files contents and doesn't wait for the wal
+// archiving.
+func backupQueries(maj, min int) (string, string, error) {
+	switch {
+	case maj >= 15:
+		return "select pg_backup_start($1, true)", "select labelfile, spcmapfile from pg_backup_stop(false)", nil
+	case maj >= 10:
+		return "select pg_start_backup($1, true, false)", "select labelfile, spcmapfile from pg_stop_backup(false, false)", nil
+	case maj == 9 && min >= 6:
+		return "select pg_start_backup($1, true, false)", "select labelfile, spcmapfile from pg_stop_backup(false)", nil
+	}
+	return "", "", fmt.Errorf("non exclusive backups not supported by postgres %d.%d", maj, min)
+}
+
+// BasebackupFeatures are the optional features supported by pg_basebackup
+type BasebackupFeatures struct {
+	// Jobs reports if parallel transfers (--jobs) are supported
+	Jobs bool
+	// ServerCompression reports if the server side compression
+	// (--compress=server-method) is supported
+	ServerCompression bool
+}
+
+// basebackupFeatures returns the features shown by the pg_basebackup help
+// output
+func basebackupFeatures(helpOutput string) BasebackupFeatures {
+	return BasebackupFeatures{
+		Jobs:              strings.Contains(helpOutput, "--jobs"),
+		ServerCompression: strings.Contains(helpOutput, "{client|server}-"),
+	}
+}
+
+// pgCtlTimeout returns the pg_ctl timeout (--timeout) in seconds, rounded up
+func pgCtlTimeout(d time.Duration) string {
+	secs := int((d + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.Itoa(secs)
+}
+
+// pgCtlStopArgs returns the arguments of a pg_ctl stop with the provided
+// mode and timeout. An empty mode or a zero timeout use the pg_ctl defaults.
+func pgCtlStopArgs(dataDir, mode string, timeout time.Duration) []string {
+	args := []string{"stop", "-w", "-D", dataDir, "-o", "-c unix_socket_directories=" + common.PgUnixSocketDirectories}
+	if mode != "" {
+		args = append(args, "-m", mode)
+	}
+	if timeout > 0 {
+		args = append(args, "-t", pgCtlTimeout(timeout))
+	}
+	return args
+}
+
+// pgCtlPromoteArgs returns the arguments of a pg_ctl promote waiting for its
+// completion up to timeout. A zero timeout uses the pg_ctl default.
+func pgCtlPromoteArgs(dataDir string, timeout time.Duration) []string {
+	args := []string{"promote", "-w", "-D", dataDir}
+	if timeout > 0 {
+		args = append(args, "-t", pgCtlTimeout(timeout))
+	}
+	return args
+}
@@ -15,8 +15,13 @@
 package postgresql
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 )
@@ -177,6 +182,46 @@ func TestParseBinaryVersion(t *testing.T) {
 	}
 }
 
+func TestParseServerVersion(t *testing.T) {
+	tests := []struct {
+		in      string
+		version string
+		err     error
+	}{
+		{
+			in:      "postgres (PostgreSQL) 9.6.7\n",
+			version: "9.6.7",
+		},
+		{
+			in:      "postgres (PostgreSQL) 12.4 (Debian 12.4-1.pgdg100+1)\n",
+			version: "12.4",
+		},
+		{
+			in:      "postgres (PostgreSQL) 13beta2",
+			version: "13",
+		},
+		{
+			in:  "postgres 12.4",
+			err: fmt.Errorf(`failed to parse postgres binary version: "postgres 12.4"`),
+		},
+	}
+
+	for i, tt := range tests {
+		version, err := ParseServerVersion(tt.in)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		} else if version != tt.version {
+			t.Errorf("#%d: got version: %q, want: %q", i, version, tt.version)
+		}
+	}
+}
+
 func TestParseVersion(t *testing.T) {
 	tests := []struct {
 		in  string
@@ -247,3 +292,695 @@ func TestWalFileNameNoTimeLine(t *testing.T) {
 		}
 	}
 }
+
+func TestCreatePublicationQuery(t *testing.T) {
+	tests := []struct {
+		pub *Publication
+		out string
+	}{
+		{
+			pub: &Publication{Name: "pub1", AllTables: true},
+			out: `create publication "pub1" for all tables`,
+		},
+		{
+			pub: &Publication{Name: "pub1", Tables: []string{"public.t1", "s1.T2"}},
+			out: `create publication "pub1" for table "public"."t1", "s1"."T2"`,
+		},
+		{
+			pub: &Publication{Name: `pub"1`, Tables: []string{"t1"}},
+			out: `create publication "pub""1" for table "t1"`,
+		},
+	}
+
+	for i, tt := range tests {
+		out := createPublicationQuery(tt.pub)
+		if out != tt.out {
+			t.Errorf("#%d: wrong query: got: %q, want: %q", i, out, tt.out)
+		}
+	}
+}
+
+func TestExtensionQuery(t *testing.T) {
+	tests := []struct {
+		ext              *Extension
+		installed        bool
+		installedVersion string
+		out              string
+	}{
+		{
+			ext: &Extension{Name: "pg_stat_statements"},
+			out: `create extension if not exists "pg_stat_statements" cascade`,
+		},
+		{
+			ext: &Extension{Name: "postgis", Schema: "gis", Version: "3.1.0"},
+			out: `create extension if not exists "postgis" schema "gis" version '3.1.0' cascade`,
+		},
+		{
+			ext:              &Extension{Name: "pg_stat_statements"},
+			installed:        true,
+			installedVersion: "1.8",
+		},
+		{
+			ext:              &Extension{Name: "postgis", Version: "3.1.0"},
+			installed:        true,
+			installedVersion: "3.1.0",
+		},
+		{
+			ext:              &Extension{Name: "postgis", Version: "3.1.1"},
+			installed:        true,
+			installedVersion: "3.1.0",
+			out:              `alter extension "postgis" update to '3.1.1'`,
+		},
+	}
+
+	for i, tt := range tests {
+		out := extensionQuery(tt.ext, tt.installed, tt.installedVersion)
+		if out != tt.out {
+			t.Errorf("#%d: wrong query: got: %q, want: %q", i, out, tt.out)
+		}
+	}
+}
+
+func TestParseSharedPreloadLibraries(t *testing.T) {
+	tests := []struct {
+		in  string
+		out []string
+	}{
+		{in: "", out: []string{}},
+		{in: "pg_stat_statements", out: []string{"pg_stat_statements"}},
+		{in: `pg_stat_statements, "pgaudit",auto_explain`, out: []string{"pg_stat_statements", "pgaudit", "auto_explain"}},
+	}
+
+	for i, tt := range tests {
+		out := ParseSharedPreloadLibraries(tt.in)
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: got: %v, want: %v", i, out, tt.out)
+		}
+	}
+}
+
+func TestBasebackupArgs(t *testing.T) {
+	tests := []struct {
+		replSlot string
+		opts     *BasebackupOptions
+		out      []string
+	}{
+		{
+			out: []string{"-R", "-Xs", "-D", "/data", "-d", "conn"},
+		},
+		{
+			replSlot: "slot1",
+			opts:     &BasebackupOptions{},
+			out:      []string{"-R", "-Xs", "-D", "/data", "-d", "conn", "--slot", "slot1"},
+		},
+		{
+			replSlot: "slot1",
+			opts:     &BasebackupOptions{MaxRate: "100M", CheckpointMode: "spread", Jobs: 4},
+			out:      []string{"-R", "-Xs", "-D", "/data", "-d", "conn", "--slot", "slot1", "--max-rate", "100M", "--checkpoint", "spread", "--jobs", "4"},
+		},
+		// a single worker is the pg_basebackup default
+		{
+			opts: &BasebackupOptions{CheckpointMode: "fast", Jobs: 1},
+			out:  []string{"-R", "-Xs", "-D", "/data", "-d", "conn", "--checkpoint", "fast"},
+		},
+		{
+			opts: &BasebackupOptions{WalMethod: "fetch", Compression: "zstd", CompressionLevel: 3},
+			out:  []string{"-R", "-Xf", "-D", "/data", "-d", "conn", "--compress=server-zstd:level=3"},
+		},
+		{
+			opts: &BasebackupOptions{WalMethod: "stream", Compression: "lz4"},
+			out:  []string{"-R", "-Xs", "-D", "/data", "-d", "conn", "--compress=server-lz4"},
+		},
+		// tablespace relocations are sorted by old directory
+		{
+			opts: &BasebackupOptions{TablespaceMap: map[string]string{"/pg/ts2": "/data/ts2", "/pg/ts1": "/data/ts1"}},
+			out:  []string{"-R", "-Xs", "-D", "/data", "-d", "conn", "--tablespace-mapping=/pg/ts1=/data/ts1", "--tablespace-mapping=/pg/ts2=/data/ts2"},
+		},
+	}
+
+	for i, tt := range tests {
+		out := basebackupArgs("/data", "conn", tt.replSlot, tt.opts)
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: wrong args: got: %v, want: %v", i, out, tt.out)
+		}
+	}
+}
+
+func TestBasebackupFeatures(t *testing.T) {
+	tests := []struct {
+		help string
+		out  BasebackupFeatures
+	}{
+		{
+			help: "  -z, --gzip             compress tar output\n  -Z, --compress=0-9     compress tar output with given compression level\n",
+			out:  BasebackupFeatures{},
+		},
+		{
+			help: "  -Z, --compress=[{client|server}-]METHOD[:DETAIL]\n                         compress on client or server as specified\n",
+			out:  BasebackupFeatures{ServerCompression: true},
+		},
+		{
+			help: "  -j, --jobs=NUM         use this many parallel jobs\n",
+			out:  BasebackupFeatures{Jobs: true},
+		},
+	}
+
+	for i, tt := range tests {
+		if out := basebackupFeatures(tt.help); out != tt.out {
+			t.Errorf("#%d: got: %+v, want: %+v", i, out, tt.out)
+		}
+	}
+}
+
+func TestPgBackRestRestoreArgs(t *testing.T) {
+	tests := []struct {
+		opts *PgBackRestOptions
+		out  []string
+	}{
+		{
+			opts: &PgBackRestOptions{Stanza: "main"},
+			out:  []string{"--stanza=main", "--pg1-path=/data", "--delta", "--type=standby", "restore"},
+		},
+		{
+			opts: &PgBackRestOptions{Stanza: "main", ConfigPath: "/etc/pgbackrest/pgbackrest.conf"},
+			out:  []string{"--stanza=main", "--config=/etc/pgbackrest/pgbackrest.conf", "--pg1-path=/data", "--delta", "--type=standby", "restore"},
+		},
+	}
+
+	for i, tt := range tests {
+		out := pgBackRestRestoreArgs("/data", tt.opts)
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: wrong args: got: %v, want: %v", i, out, tt.out)
+		}
+	}
+}
+
+func TestWalgBackupFetchArgs(t *testing.T) {
+	out := walgBackupFetchArgs("/data", "LATEST")
+	expected := []string{"backup-fetch", "/data", "LATEST"}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("wrong args: got: %v, want: %v", out, expected)
+	}
+}
+
+func TestRsyncArgs(t *testing.T) {
+	for i, source := range []string{"rsync://db1/pgdata", "rsync://db1/pgdata/"} {
+		out := rsyncArgs(source, "/data", "")
+		if !reflect.DeepEqual(out[:3], []string{"--archive", "--delete", "--checksum"}) {
+			t.Errorf("#%d: wrong args: %v", i, out)
+		}
+		if len(out) != 3+len(rsyncExcludes)+2 {
+			t.Fatalf("#%d: got %d args, want: %d", i, len(out), 3+len(rsyncExcludes)+2)
+		}
+		if out[3] != "--exclude=/postmaster.pid" {
+			t.Errorf("#%d: got first exclude %q, want: %q", i, out[3], "--exclude=/postmaster.pid")
+		}
+		paths := out[len(out)-2:]
+		if !reflect.DeepEqual(paths, []string{"rsync://db1/pgdata/", "/data/"}) {
+			t.Errorf("#%d: wrong source and destination: got: %v", i, paths)
+		}
+	}
+
+	out := rsyncArgs("rsync://db1/pgdata", "/data", "10240")
+	if len(out) != 3+len(rsyncExcludes)+3 {
+		t.Fatalf("got %d args, want: %d", len(out), 3+len(rsyncExcludes)+3)
+	}
+	if out[len(out)-3] != "--bwlimit=10240" {
+		t.Errorf("got bandwidth limit arg %q, want: %q", out[len(out)-3], "--bwlimit=10240")
+	}
+}
+
+func TestParseServerVersionNum(t *testing.T) {
+	tests := []struct {
+		in  string
+		maj int
+		min int
+		err bool
+	}{
+		{in: "90624", maj: 9, min: 6},
+		{in: "100023", maj: 10, min: 23},
+		{in: "170002", maj: 17, min: 2},
+		{in: "17beta1", err: true},
+	}
+
+	for i, tt := range tests {
+		maj, min, err := parseServerVersionNum(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("#%d: got no error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		} else if maj != tt.maj || min != tt.min {
+			t.Errorf("#%d: got: %d.%d, want: %d.%d", i, maj, min, tt.maj, tt.min)
+		}
+	}
+}
+
+func TestBackupQueries(t *testing.T) {
+	tests := []struct {
+		maj   int
+		min   int
+		start string
+		stop  string
+		err   bool
+	}{
+		{maj: 9, min: 5, err: true},
+		{maj: 9, min: 6, start: "select pg_start_backup($1, true, false)", stop: "select labelfile, spcmapfile from pg_stop_backup(false)"},
+		{maj: 14, start: "select pg_start_backup($1, true, false)", stop: "select labelfile, spcmapfile from pg_stop_backup(false, false)"},
+		{maj: 15, start: "select pg_backup_start($1, true)", stop: "select labelfile, spcmapfile from pg_backup_stop(false)"},
+	}
+
+	for i, tt := range tests {
+		start, stop, err := backupQueries(tt.maj, tt.min)
+		if tt.err {
+			if err == nil {
+				t.Errorf("#%d: got no error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		} else if start != tt.start || stop != tt.stop {
+			t.Errorf("#%d: got: %q, %q, want: %q, %q", i, start, stop, tt.start, tt.stop)
+		}
+	}
+}
+
+func TestGracefulDemotionQueries(t *testing.T) {
+	tests := []struct {
+		maj             int
+		currentWalLsn   string
+		standbyFlushLsn string
+		clientBackends  string
+	}{
+		{
+			maj:             9,
+			currentWalLsn:   "select pg_current_xlog_location()",
+			standbyFlushLsn: "select flush_location from pg_stat_replication where application_name = $1",
+			clientBackends:  "select count(*) from pg_stat_activity where datname is not null and pid <> pg_backend_pid() and usename <> all($1)",
+		},
+		{
+			maj:             12,
+			currentWalLsn:   "select pg_current_wal_lsn()",
+			standbyFlushLsn: "select flush_lsn from pg_stat_replication where application_name = $1",
+			clientBackends:  "select count(*) from pg_stat_activity where backend_type = 'client backend' and pid <> pg_backend_pid() and usename <> all($1)",
+		},
+	}
+
+	for i, tt := range tests {
+		if q := currentWalLsnQuery(tt.maj); q != tt.currentWalLsn {
+			t.Errorf("#%d: got: %q, want: %q", i, q, tt.currentWalLsn)
+		}
+		if q := standbyFlushLsnQuery(tt.maj); q != tt.standbyFlushLsn {
+			t.Errorf("#%d: got: %q, want: %q", i, q, tt.standbyFlushLsn)
+		}
+		if q := clientBackendsQuery(tt.maj, "count(*)"); q != tt.clientBackends {
+			t.Errorf("#%d: got: %q, want: %q", i, q, tt.clientBackends)
+		}
+	}
+}
+
+func TestLogicalReplicationSlotsQuery(t *testing.T) {
+	tests := []struct {
+		maj int
+		min int
+		out string
+	}{
+		{
+			maj: 9, min: 4,
+			out: "select slot_name, database, plugin, '' from pg_replication_slots where slot_type = 'logical'",
+		},
+		{
+			maj: 9, min: 5,
+			out: "select slot_name, database, plugin, '' from pg_replication_slots where slot_type = 'logical'",
+		},
+		{
+			maj: 9, min: 6,
+			out: "select slot_name, database, plugin, coalesce(confirmed_flush_lsn::text, '') from pg_replication_slots where slot_type = 'logical'",
+		},
+		{
+			maj: 10,
+			out: "select slot_name, database, plugin, coalesce(confirmed_flush_lsn::text, '') from pg_replication_slots where slot_type = 'logical' and temporary is false",
+		},
+		{
+			maj: 16,
+			out: "select slot_name, database, plugin, coalesce(confirmed_flush_lsn::text, '') from pg_replication_slots where slot_type = 'logical' and temporary is false",
+		},
+	}
+
+	for i, tt := range tests {
+		if q := logicalReplicationSlotsQuery(tt.maj, tt.min); q != tt.out {
+			t.Errorf("#%d: got: %q, want: %q", i, q, tt.out)
+		}
+	}
+}
+
+func TestPGLsn(t *testing.T) {
+	tests := []struct {
+		lsn uint64
+		out string
+	}{
+		{0, "0/0"},
+		{0x16B3748, "0/16B3748"},
+		{0x1F00000000 | 0xAB, "1F/AB"},
+	}
+	for i, tt := range tests {
+		out := PGLsn(tt.lsn)
+		if out != tt.out {
+			t.Errorf("#%d: got: %s, want: %s", i, out, tt.out)
+		}
+		lsn, err := PGLsnToInt(out)
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if lsn != tt.lsn {
+			t.Errorf("#%d: got: %d, want: %d", i, lsn, tt.lsn)
+		}
+	}
+}
+
+func TestPGCtlStopArgs(t *testing.T) {
+	tests := []struct {
+		mode    string
+		timeout time.Duration
+		out     []string
+	}{
+		{
+			out: []string{"stop", "-w", "-D", "/data", "-o", "-c unix_socket_directories=/tmp"},
+		},
+		{
+			mode:    "fast",
+			timeout: 30 * time.Second,
+			out:     []string{"stop", "-w", "-D", "/data", "-o", "-c unix_socket_directories=/tmp", "-m", "fast", "-t", "30"},
+		},
+		// the timeout is rounded up to seconds
+		{
+			mode:    "smart",
+			timeout: 1500 * time.Millisecond,
+			out:     []string{"stop", "-w", "-D", "/data", "-o", "-c unix_socket_directories=/tmp", "-m", "smart", "-t", "2"},
+		},
+		{
+			mode:    "immediate",
+			timeout: time.Millisecond,
+			out:     []string{"stop", "-w", "-D", "/data", "-o", "-c unix_socket_directories=/tmp", "-m", "immediate", "-t", "1"},
+		},
+	}
+
+	for i, tt := range tests {
+		out := pgCtlStopArgs("/data", tt.mode, tt.timeout)
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: wrong args: got: %v, want: %v", i, out, tt.out)
+		}
+	}
+}
+
+func TestPGCtlPromoteArgs(t *testing.T) {
+	out := pgCtlPromoteArgs("/data", 0)
+	expected := []string{"promote", "-w", "-D", "/data"}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("wrong args: got: %v, want: %v", out, expected)
+	}
+	out = pgCtlPromoteArgs("/data", 2*time.Minute)
+	expected = []string{"promote", "-w", "-D", "/data", "-t", "120"}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("wrong args: got: %v, want: %v", out, expected)
+	}
+}
+
+func TestParseSocketLockFile(t *testing.T) {
+	tests := []struct {
+		in      string
+		pid     int
+		dataDir string
+		err     bool
+	}{
+		{in: "1234\n/stolon-data/postgres\n1528712541\n5432\n/tmp\n*\n  5432001   1867776\nready   \n", pid: 1234, dataDir: "/stolon-data/postgres"},
+		{in: "-1234\n/stolon-data/postgres\n", pid: 1234, dataDir: "/stolon-data/postgres"},
+		{in: "1234", err: true},
+		{in: "pid\n/stolon-data/postgres\n", err: true},
+	}
+
+	for i, tt := range tests {
+		pid, dataDir, err := parseSocketLockFile(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("#%d: got no error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		} else if pid != tt.pid || dataDir != tt.dataDir {
+			t.Errorf("#%d: got: %d, %q, want: %d, %q", i, pid, dataDir, tt.pid, tt.dataDir)
+		}
+	}
+}
+
+func TestWalDirFlag(t *testing.T) {
+	tests := []struct {
+		maj  int
+		flag string
+	}{
+		{maj: 9, flag: "--xlogdir"},
+		{maj: 10, flag: "--waldir"},
+		{maj: 15, flag: "--waldir"},
+	}
+
+	for i, tt := range tests {
+		if flag := walDirFlag(tt.maj); flag != tt.flag {
+			t.Errorf("#%d: got flag %q, want: %q", i, flag, tt.flag)
+		}
+	}
+}
+
+func TestParseControlData(t *testing.T) {
+	tests := []struct {
+		out string
+		cd  *ControlData
+		err error
+	}{
+		{
+			out: `pg_control version number:            1100
+Database cluster state:               shut down
+Latest checkpoint location:           0/5000098
+Latest checkpoint's REDO location:    0/5000098
+Latest checkpoint's TimeLineID:       2
+Latest checkpoint's PrevTimeLineID:   2
+`,
+			cd: &ControlData{TimelineID: 2, CheckpointXLogPos: 83886232},
+		},
+		{
+			out: `pg_control version number:            1300
+Latest checkpoint location:           0/5000098
+Latest checkpoint's REDO location:    0/5000060
+Latest checkpoint's REDO WAL file:    000000020000000000000005
+Latest checkpoint's TimeLineID:       2
+`,
+			cd: &ControlData{TimelineID: 2, CheckpointXLogPos: 83886232, RedoWalFile: "000000020000000000000005"},
+		},
+		{
+			out: `pg_control version number:            1100
+Latest checkpoint location:           0/5000098
+`,
+			err: fmt.Errorf("latest checkpoint timeline or location not reported by pg_controldata"),
+		},
+		{
+			out: `Latest checkpoint location:           bad
+Latest checkpoint's TimeLineID:       2
+`,
+			err: fmt.Errorf(`cannot parse latest checkpoint location "bad": bad pg_lsn: bad`),
+		},
+	}
+
+	for i, tt := range tests {
+		cd, err := parseControlData(tt.out)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		} else if !reflect.DeepEqual(cd, tt.cd) {
+			t.Errorf("#%d: got control data: %+v, want: %+v", i, cd, tt.cd)
+		}
+	}
+}
+
+func TestParseBackupLabelWalFile(t *testing.T) {
+	tests := []struct {
+		label   string
+		walFile string
+		err     error
+	}{
+		{
+			label: `START WAL LOCATION: 0/2000028 (file 000000010000000000000002)
+CHECKPOINT LOCATION: 0/2000060
+BACKUP METHOD: streamed
+BACKUP FROM: primary
+START TIME: 2020-10-14 10:00:00 UTC
+LABEL: pg_basebackup base backup
+START TIMELINE: 1
+`,
+			walFile: "000000010000000000000002",
+		},
+		{
+			label: `CHECKPOINT LOCATION: 0/2000060
+`,
+			err: fmt.Errorf("start wal file not reported in backup_label"),
+		},
+	}
+
+	for i, tt := range tests {
+		walFile, err := parseBackupLabelWalFile(tt.label)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		} else if walFile != tt.walFile {
+			t.Errorf("#%d: got wal file %q, want: %q", i, walFile, tt.walFile)
+		}
+	}
+}
+
+func TestDirSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	walDir := filepath.Join(dir, "wal")
+	if err := os.MkdirAll(filepath.Join(walDir, "archive_status"), 0700); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	files := map[string]int{
+		"000000010000000000000001":                     1024,
+		"000000010000000000000002":                     2048,
+		"archive_status/000000010000000000000001.done": 0,
+	}
+	for name, size := range files {
+		if err := ioutil.WriteFile(filepath.Join(walDir, name), make([]byte, size), 0600); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// a wal dir outside the data dir
+	if err := os.Symlink(walDir, filepath.Join(dir, "pg_wal")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, d := range []string{walDir, filepath.Join(dir, "pg_wal")} {
+		size, err := dirSize(d)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if size != 3072 {
+			t.Errorf("%s: got size %d, want: %d", d, size, 3072)
+		}
+	}
+
+	if _, err := dirSize(filepath.Join(dir, "notexisting")); err == nil {
+		t.Errorf("got no error for a not existing dir")
+	}
+}
+
+func TestUpgradeArgs(t *testing.T) {
+	cfg := &UpgradeConfig{Encoding: "UTF8", LCCollate: "en_US.UTF-8", LCCtype: "en_US.UTF-8"}
+	out := upgradeInitdbArgs("/data-upgrade", "postgres", cfg)
+	want := []string{"-D", "/data-upgrade", "-U", "postgres", "--encoding", "UTF8", "--lc-collate", "en_US.UTF-8", "--lc-ctype", "en_US.UTF-8"}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("wrong initdb args: got: %v, want: %v", out, want)
+	}
+	cfg.DataChecksums = true
+	out = upgradeInitdbArgs("/data-upgrade", "postgres", cfg)
+	want = append(want, "--data-checksums")
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("wrong initdb args: got: %v, want: %v", out, want)
+	}
+
+	out = pgUpgradeArgs("/pg12/bin", "/pg13/bin", "/data", "/data-upgrade", "postgres")
+	want = []string{"--link", "-b", "/pg12/bin", "-B", "/pg13/bin", "-d", "/data", "-D", "/data-upgrade", "-U", "postgres"}
+	if !reflect.DeepEqual(out, want) {
+		t.Errorf("wrong pg_upgrade args: got: %v, want: %v", out, want)
+	}
+}
+
+func TestCleanupUpgrade(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		out   []string
+	}{
+		{
+			name:  "no upgrade",
+			files: []string{"data/global/pg_control"},
+			out:   []string{"data/global/pg_control"},
+		},
+		{
+			name:  "failed initdb",
+			files: []string{"data/global/pg_control", "data-upgrade/global/pg_control"},
+			out:   []string{"data/global/pg_control"},
+		},
+		{
+			name:  "failed pg_upgrade",
+			files: []string{"data/global/pg_control.old", "data-upgrade/global/pg_control"},
+			out:   []string{"data/global/pg_control"},
+		},
+		{
+			name:  "data dir moved",
+			files: []string{"data-old/global/pg_control.old", "data-upgrade/global/pg_control"},
+			out:   []string{"data/global/pg_control"},
+		},
+		{
+			name:  "data dir replaced",
+			files: []string{"data-old/global/pg_control.old", "data/global/pg_control"},
+			out:   []string{"data/global/pg_control"},
+		},
+	}
+
+	for i, tt := range tests {
+		dir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		for _, f := range tt.files {
+			p := filepath.Join(dir, f)
+			if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := ioutil.WriteFile(p, []byte(f), 0600); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+
+		if err := cleanupUpgrade(filepath.Join(dir, "data")); err != nil {
+			t.Errorf("#%d (%s): unexpected error: %v", i, tt.name, err)
+			continue
+		}
+		out := []string{}
+		err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(dir, path)
+			out = append(out, rel)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d (%s): got files: %v, want: %v", i, tt.name, out, tt.out)
+		}
+	}
+}
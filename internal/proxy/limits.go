@@ -0,0 +1,87 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+var (
+	errMaxConns       = errors.New("too many connections")
+	errMaxSourceConns = errors.New("too many connections from the same source")
+)
+
+// postgres too_many_connections error code
+const pgTooManyConnectionsCode = "53300"
+
+// sourceIP returns the ip of a client address, used to account the
+// connections per source
+func sourceIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	return addr.String()
+}
+
+// acquireClientConn registers a client connection from the source. It returns
+// an error when the max connections or the max connections per source limit
+// is reached.
+func (p *Proxy) acquireClientConn(source string) error {
+	p.connMutex.Lock()
+	defer p.connMutex.Unlock()
+	if p.maxConns > 0 && p.clientConns >= p.maxConns {
+		return errMaxConns
+	}
+	if p.maxSourceConns > 0 && p.sourceConns[source] >= p.maxSourceConns {
+		return errMaxSourceConns
+	}
+	p.clientConns++
+	p.sourceConns[source]++
+	return nil
+}
+
+func (p *Proxy) releaseClientConn(source string) {
+	p.connMutex.Lock()
+	defer p.connMutex.Unlock()
+	p.clientConns--
+	p.sourceConns[source]--
+	if p.sourceConns[source] <= 0 {
+		delete(p.sourceConns, source)
+	}
+}
+
+// pgErrorResponse returns a postgres protocol FATAL ErrorResponse message
+// with the provided error code and message. It's understood by the clients
+// also when sent in place of the reply to their first message (the startup
+// message or an SSLRequest).
+func pgErrorResponse(code, message string) []byte {
+	fields := []byte{}
+	for _, f := range []struct {
+		t byte
+		v string
+	}{{'S', "FATAL"}, {'V', "FATAL"}, {'C', code}, {'M', message}} {
+		fields = append(fields, f.t)
+		fields = append(fields, f.v...)
+		fields = append(fields, 0)
+	}
+	fields = append(fields, 0)
+
+	msg := make([]byte, 5, 5+len(fields))
+	msg[0] = 'E'
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+len(fields)))
+	return append(msg, fields...)
+}
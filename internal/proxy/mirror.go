@@ -0,0 +1,178 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultMirrorBufferSize is the default max client data queued for a
+	// mirror connection
+	DefaultMirrorBufferSize = 4 * 1024 * 1024
+
+	mirrorDialTimeout = 5 * time.Second
+)
+
+// MirrorConfig defines the mirroring of the client traffic to a shadow
+// destination (i.e. a standby or an external instance running a new postgres
+// version). The data sent by the mirrored clients is duplicated to a new
+// connection to the mirror destination without waiting for it: its responses
+// are discarded and its failures don't affect the client connection.
+type MirrorConfig struct {
+	// SampleRate is the fraction, between 0 and 1, of the client
+	// connections mirrored
+	SampleRate float64
+	// BufferSize is the max client data, in bytes, queued for a mirror
+	// connection. When exceeded the mirror connection is closed since the
+	// mirrored stream would be incomplete.
+	BufferSize int
+}
+
+// mirrorConn writes the client data to the mirror destination without
+// blocking the client, discarding the mirror responses
+type mirrorConn struct {
+	conn  net.Conn
+	ch    chan []byte
+	stats *ConnStats
+
+	mutex      sync.Mutex
+	queued     int
+	bufferSize int
+	started    bool
+	closed     bool
+	done       chan struct{}
+}
+
+func newMirrorConn(conn net.Conn, bufferSize int, stats *ConnStats) *mirrorConn {
+	m := &mirrorConn{
+		conn:       conn,
+		stats:      stats,
+		ch:         make(chan []byte, 1024),
+		bufferSize: bufferSize,
+		done:       make(chan struct{}),
+	}
+	go m.writer()
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		m.Close()
+	}()
+	return m
+}
+
+func (m *mirrorConn) writer() {
+	for {
+		select {
+		case b := <-m.ch:
+			if _, err := m.conn.Write(b); err != nil {
+				log.Debugw("failed to write to the mirror connection", "conn", m.conn.RemoteAddr(), zap.Error(err))
+				m.Close()
+				return
+			}
+			m.mutex.Lock()
+			m.queued -= len(b)
+			m.mutex.Unlock()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// Write queues the client data for the mirror destination. It never blocks
+// and never fails, so it can be used to tee the client stream.
+func (m *mirrorConn) Write(b []byte) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return len(b), nil
+	}
+	if !m.started {
+		m.started = true
+		// the client encrypted stream cannot be mirrored since it's
+		// negotiated with the destination
+		if len(b) >= 8 && pgEncryptionRequest(b) != 0 {
+			log.Debugw("not mirroring a client connection requesting encryption", "conn", m.conn.RemoteAddr())
+			m.close()
+			return len(b), nil
+		}
+	}
+	if m.queued+len(b) > m.bufferSize {
+		m.overflow()
+		return len(b), nil
+	}
+	data := make([]byte, len(b))
+	copy(data, b)
+	select {
+	case m.ch <- data:
+		m.queued += len(b)
+	default:
+		m.overflow()
+	}
+	return len(b), nil
+}
+
+func (m *mirrorConn) overflow() {
+	log.Infow("closing the mirror connection since its buffer is full", "conn", m.conn.RemoteAddr(), "bufferSize", m.bufferSize)
+	m.stats.mirrorFailed()
+	m.close()
+}
+
+// Close closes the mirror connection
+func (m *mirrorConn) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.close()
+	return nil
+}
+
+func (m *mirrorConn) close() {
+	if m.closed {
+		return
+	}
+	m.closed = true
+	close(m.done)
+	m.conn.Close()
+}
+
+// dialMirror opens, for a sampled client connection, a connection to the
+// mirror destination. It returns nil when the connection isn't mirrored.
+func (p *Proxy) dialMirror(conn clientConn) *mirrorConn {
+	p.connMutex.Lock()
+	config := p.mirrorConfig
+	addr := p.mirrorAddr
+	sampled := config != nil && p.randFn() < config.SampleRate
+	p.connMutex.Unlock()
+	if addr == nil || !sampled {
+		return nil
+	}
+	mconn, err := net.DialTimeout("tcp", addr.String(), mirrorDialTimeout)
+	if err != nil {
+		log.Infow("failed to connect to the mirror destination", "conn", conn.RemoteAddr(), "mirror", addr, zap.Error(err))
+		p.stats.mirrorFailed()
+		return nil
+	}
+	p.stats.mirrored()
+	bufferSize := config.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = DefaultMirrorBufferSize
+	}
+	return newMirrorConn(mconn, bufferSize, p.stats)
+}
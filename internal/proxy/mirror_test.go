@@ -0,0 +1,167 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMirrorConnWrite(t *testing.T) {
+	sslRequest := make([]byte, 8)
+	binary.BigEndian.PutUint32(sslRequest[:4], 8)
+	binary.BigEndian.PutUint32(sslRequest[4:], pgSSLRequestCode)
+
+	tests := []struct {
+		name       string
+		bufferSize int
+		data       [][]byte
+		closed     bool
+		failures   uint64
+	}{
+		{
+			name:       "queued data",
+			bufferSize: 1024,
+			data:       [][]byte{[]byte("startup"), []byte("query")},
+		},
+		{
+			name:       "encryption request",
+			bufferSize: 1024,
+			data:       [][]byte{sslRequest},
+			closed:     true,
+		},
+		{
+			name:       "buffer full",
+			bufferSize: 8,
+			data:       [][]byte{[]byte("startup"), []byte("query")},
+			closed:     true,
+			failures:   1,
+		},
+	}
+
+	for i, tt := range tests {
+		// nobody reads the other side of the pipe so the data remains
+		// queued
+		c1, c2 := net.Pipe()
+		stats := NewConnStats()
+		m := newMirrorConn(c1, tt.bufferSize, stats)
+		for _, b := range tt.data {
+			if n, err := m.Write(b); err != nil || n != len(b) {
+				t.Errorf("#%d (%s): got n: %d, error: %v", i, tt.name, n, err)
+			}
+		}
+		m.mutex.Lock()
+		closed := m.closed
+		m.mutex.Unlock()
+		if closed != tt.closed {
+			t.Errorf("#%d (%s): got closed: %t, want: %t", i, tt.name, closed, tt.closed)
+		}
+		if n := stats.Snapshot().MirrorFailures; n != tt.failures {
+			t.Errorf("#%d (%s): got %d mirror failures, want: %d", i, tt.name, n, tt.failures)
+		}
+		m.Close()
+		c2.Close()
+	}
+}
+
+func TestProxyMirror(t *testing.T) {
+	dest := newTestDest(t)
+	defer dest.listener.Close()
+	// the mirror replies are discarded
+	mirror := newTestDestReply(t, "mm")
+	defer mirror.listener.Close()
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer listener.Close()
+	proxyAddr := listener.Addr().String()
+
+	p, err := NewProxy(listener)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p.SetMirror(&MirrorConfig{SampleRate: 0.5, BufferSize: 1024})
+	p.SetMirrorAddr(mirror.addr())
+	go p.Start()
+	defer p.Stop()
+
+	p.C <- ConfData{DestAddr: dest.addr()}
+	p.C <- ConfData{DestAddr: dest.addr()}
+
+	// not sampled connection
+	p.connMutex.Lock()
+	p.randFn = func() float64 { return 0.7 }
+	p.connMutex.Unlock()
+	conn, reply := testConnectReply(t, proxyAddr)
+	if reply != "ok" {
+		t.Fatalf("connection not proxied")
+	}
+	conn.Close()
+
+	// sampled connection
+	p.connMutex.Lock()
+	p.randFn = func() float64 { return 0.2 }
+	p.connMutex.Unlock()
+	conn, reply = testConnectReply(t, proxyAddr)
+	if reply != "ok" {
+		t.Fatalf("connection not proxied")
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "select 1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var mirrorConn net.Conn
+	for i := 0; i < 50 && mirrorConn == nil; i++ {
+		mirror.connsMutex.Lock()
+		if len(mirror.conns) > 0 {
+			mirrorConn = mirror.conns[0]
+		}
+		mirror.connsMutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if mirrorConn == nil {
+		t.Fatalf("no mirror connection")
+	}
+	mirrorConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(mirrorConn, buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(buf) != "select 1" {
+		t.Fatalf("got mirrored data %q, want: %q", buf, "select 1")
+	}
+
+	// the client doesn't receive the mirror reply
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _ := conn.Read(make([]byte, 2)); n != 0 {
+		t.Fatalf("got unexpected data from the mirror")
+	}
+
+	mirror.connsMutex.Lock()
+	mirrorConns := len(mirror.conns)
+	mirror.connsMutex.Unlock()
+	if mirrorConns != 1 {
+		t.Fatalf("got %d mirror connections, want: 1", mirrorConns)
+	}
+	if n := p.ConnStats().Snapshot().Mirrors; n != 1 {
+		t.Fatalf("got %d mirrored connections, want: 1", n)
+	}
+}
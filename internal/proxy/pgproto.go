@@ -0,0 +1,201 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// postgres protocol constants used by the transaction pooling
+const (
+	pgProtocolVersion3  = 196608
+	pgCancelRequestCode = 80877102
+
+	// max size of a startup packet, like the postgres one
+	pgMaxStartupPacketSize = 10000
+	// max size of a protocol message
+	pgMaxMessageSize = 1 << 30
+)
+
+// postgres authentication request codes
+const (
+	pgAuthOk                = 0
+	pgAuthCleartextPassword = 3
+	pgAuthMD5Password       = 5
+	pgAuthSASL              = 10
+	pgAuthSASLContinue      = 11
+	pgAuthSASLFinal         = 12
+)
+
+// postgres error codes sent by the transaction pooling
+const (
+	pgInvalidPasswordCode     = "28P01"
+	pgProtocolViolationCode   = "08P01"
+	pgConnectionFailureCode   = "08006"
+	pgFeatureNotSupportedCode = "0A000"
+)
+
+// readPgMessage reads a postgres protocol message returning its type and
+// body
+func readPgMessage(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size < 4 || size > pgMaxMessageSize {
+		return 0, nil, fmt.Errorf("invalid message size %d", size)
+	}
+	body := make([]byte, size-4)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header[0], body, nil
+}
+
+// pgMessage returns a postgres protocol message with the provided type and
+// body
+func pgMessage(t byte, body []byte) []byte {
+	msg := make([]byte, 5, 5+len(body))
+	msg[0] = t
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+len(body)))
+	return append(msg, body...)
+}
+
+// readStartupPacket reads a startup packet (a startup message, an
+// SSLRequest or a CancelRequest) returning its content after the length
+func readStartupPacket(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size < 8 || size > pgMaxStartupPacketSize {
+		return nil, fmt.Errorf("invalid startup packet size %d", size)
+	}
+	packet := make([]byte, size-4)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// parseStartupParams parses the parameters of a startup message
+func parseStartupParams(b []byte) (map[string]string, error) {
+	params := map[string]string{}
+	fields := bytes.Split(b, []byte{0})
+	// the parameters are terminated by an empty name
+	if len(fields) < 2 || len(fields[len(fields)-1]) != 0 || len(fields[len(fields)-2]) != 0 {
+		return nil, fmt.Errorf("malformed startup parameters")
+	}
+	fields = fields[:len(fields)-2]
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("malformed startup parameters")
+	}
+	for i := 0; i < len(fields); i += 2 {
+		params[string(fields[i])] = string(fields[i+1])
+	}
+	return params, nil
+}
+
+// pgStartupMessage returns a protocol version 3 startup message with the
+// provided parameters
+func pgStartupMessage(params map[string]string) []byte {
+	names := []string{}
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	body := make([]byte, 4)
+	binary.BigEndian.PutUint32(body, pgProtocolVersion3)
+	for _, name := range names {
+		body = append(body, name...)
+		body = append(body, 0)
+		body = append(body, params[name]...)
+		body = append(body, 0)
+	}
+	body = append(body, 0)
+
+	msg := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(msg, uint32(4+len(body)))
+	return append(msg, body...)
+}
+
+// pgAuthRequest returns an authentication request message
+func pgAuthRequest(code uint32, data []byte) []byte {
+	body := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(body, code)
+	return pgMessage('R', append(body, data...))
+}
+
+// pgPasswordMessage returns a password message with a null terminated
+// password
+func pgPasswordMessage(password string) []byte {
+	return pgMessage('p', append([]byte(password), 0))
+}
+
+// pgCString returns the null terminated string at the start of b
+func pgCString(b []byte) (string, error) {
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		return "", fmt.Errorf("missing string terminator")
+	}
+	return string(b[:i]), nil
+}
+
+// pgMD5Password returns the md5 password response for the provided salt.
+// The password can be already an md5 hash ("md5" followed by the hex
+// md5(password + user)).
+func pgMD5Password(user, password string, salt []byte) string {
+	hash := password
+	if !isMD5Password(password) {
+		sum := md5.Sum([]byte(password + user))
+		hash = hex.EncodeToString(sum[:])
+	} else {
+		hash = password[3:]
+	}
+	sum := md5.Sum(append([]byte(hash), salt...))
+	return "md5" + hex.EncodeToString(sum[:])
+}
+
+func isMD5Password(password string) bool {
+	if len(password) != 35 || password[:3] != "md5" {
+		return false
+	}
+	_, err := hex.DecodeString(password[3:])
+	return err == nil
+}
+
+// pgErrorMessageText returns the message field of an ErrorResponse body
+func pgErrorMessageText(body []byte) string {
+	for len(body) > 1 {
+		t := body[0]
+		v, err := pgCString(body[1:])
+		if err != nil {
+			break
+		}
+		if t == 'M' {
+			return v
+		}
+		body = body[2+len(v):]
+	}
+	return "unknown error"
+}
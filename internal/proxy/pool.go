@@ -0,0 +1,479 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// serverConnectTimeout is the max time to open and authenticate a pooled
+// server connection
+const serverConnectTimeout = 10 * time.Second
+
+var errPoolWaitTimeout = errors.New("no server connection available before the pool wait timeout")
+
+// PoolConfig is the transaction pooling configuration
+type PoolConfig struct {
+	// Users are the passwords, by user name, of the users allowed to
+	// connect. They're used to authenticate the clients (with the md5 auth
+	// method) and the server connections. A password can also be an md5
+	// hash ("md5" followed by the hex md5(password + user)), usable only
+	// when the server auth method is md5.
+	Users map[string]string
+	// DefaultSize is the max number of server connections of every database
+	// and user
+	DefaultSize int
+	// Sizes are the max number of server connections of specific databases
+	// and users, keyed by "database/user"
+	Sizes map[string]int
+	// WaitTimeout is the max time a transaction waits for a server
+	// connection (i.e. when all the pool connections are used or during a
+	// failover)
+	WaitTimeout time.Duration
+}
+
+func (c *PoolConfig) size(key poolKey) int {
+	if size, ok := c.Sizes[key.String()]; ok {
+		return size
+	}
+	return c.DefaultSize
+}
+
+// ReadPoolUsers reads a pgbouncer like auth file: every line contains the
+// user name and its password in double quotes (a double quote inside them
+// is written as two double quotes). Empty lines and lines starting with ";"
+// or "#" are ignored.
+func ReadPoolUsers(r io.Reader) (map[string]string, error) {
+	users := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+		fields := []string{}
+		for len(fields) < 2 {
+			line = strings.TrimLeft(line, " \t")
+			field, rest, err := readQuotedField(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			fields = append(fields, field)
+			line = rest
+		}
+		if fields[0] == "" {
+			return nil, fmt.Errorf("line %d: empty user name", n)
+		}
+		users[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// readQuotedField reads a double quoted field at the start of s returning
+// its unquoted value and the rest of s
+func readQuotedField(s string) (string, string, error) {
+	if len(s) == 0 || s[0] != '"' {
+		return "", "", fmt.Errorf("missing quoted field")
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		if s[i] != '"' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '"' {
+			b.WriteByte('"')
+			i++
+			continue
+		}
+		return b.String(), s[i+1:], nil
+	}
+	return "", "", fmt.Errorf("unterminated quoted field")
+}
+
+// poolKey identifies the server connections pool of a database and user
+type poolKey struct {
+	database string
+	user     string
+}
+
+func (k poolKey) String() string {
+	return k.database + "/" + k.user
+}
+
+// serverConn is a pooled connection to the destination
+type serverConn struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	destAddr string
+	// ParameterStatus messages bodies sent by the server at the startup
+	params [][]byte
+	// BackendKeyData message body
+	backendKey []byte
+}
+
+func (sc *serverConn) close() {
+	sc.conn.Close()
+}
+
+// serverPool are the server connections of a database and user
+type serverPool struct {
+	size int
+	open int
+	idle []*serverConn
+	// params are the ParameterStatus messages of the last opened
+	// connection, sent to the clients at their startup
+	params [][]byte
+	active map[*serverConn]struct{}
+}
+
+// txPool multiplexes the client connections over a limited number of server
+// connections to the destination. A server connection is assigned to a
+// client only for the duration of a transaction.
+type txPool struct {
+	cfg           *PoolConfig
+	destTLSConfig *tls.Config
+	stats         *ConnStats
+	// setupDestConn, when defined, sets the tcp options of the server
+	// connections
+	setupDestConn func(*net.TCPConn) error
+
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	destAddr *net.TCPAddr
+	pools    map[poolKey]*serverPool
+	clients  map[*poolClient]struct{}
+	// clients by their (fake) backend key data, used to forward the cancel
+	// requests
+	cancelKeys map[uint64]*poolClient
+	closed     bool
+}
+
+func newTxPool(cfg *PoolConfig, destTLSConfig *tls.Config, stats *ConnStats) *txPool {
+	pl := &txPool{
+		cfg:           cfg,
+		destTLSConfig: destTLSConfig,
+		stats:         stats,
+		pools:         map[poolKey]*serverPool{},
+		clients:       map[*poolClient]struct{}{},
+		cancelKeys:    map[uint64]*poolClient{},
+	}
+	pl.cond = sync.NewCond(&pl.mutex)
+	return pl
+}
+
+func (pl *txPool) serverPool(key poolKey) *serverPool {
+	sp, ok := pl.pools[key]
+	if !ok {
+		sp = &serverPool{size: pl.cfg.size(key), active: map[*serverConn]struct{}{}}
+		pl.pools[key] = sp
+	}
+	return sp
+}
+
+// setDestAddr changes the destination of the server connections. The server
+// connections to the previous destination are closed, also the ones used by
+// a client transaction. The clients not in a transaction are kept and their
+// next transaction will use the new destination.
+func (pl *txPool) setDestAddr(addr *net.TCPAddr) {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	if addr.String() == pl.destAddr.String() {
+		return
+	}
+	pl.destAddr = addr
+	for _, sp := range pl.pools {
+		for _, sc := range sp.idle {
+			sc.close()
+			sp.open--
+			pl.stats.addActive(sc.destAddr, -1)
+		}
+		sp.idle = nil
+		// the active connections are removed when released by their
+		// clients
+		for sc := range sp.active {
+			sc.close()
+		}
+	}
+	pl.cond.Broadcast()
+}
+
+// close closes all the server and client connections
+func (pl *txPool) close() {
+	pl.setDestAddr(nil)
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	pl.closed = true
+	for c := range pl.clients {
+		c.conn.Close()
+	}
+	pl.cond.Broadcast()
+}
+
+// acquire returns a server connection for the database and user waiting, up
+// to the pool wait timeout, for one to be available
+func (pl *txPool) acquire(key poolKey) (*serverConn, error) {
+	deadline := time.Now().Add(pl.cfg.WaitTimeout)
+	timer := time.AfterFunc(pl.cfg.WaitTimeout, func() {
+		pl.mutex.Lock()
+		pl.cond.Broadcast()
+		pl.mutex.Unlock()
+	})
+	defer timer.Stop()
+
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	sp := pl.serverPool(key)
+	for {
+		if pl.closed {
+			return nil, fmt.Errorf("proxy stopped")
+		}
+		if pl.destAddr != nil {
+			if n := len(sp.idle); n > 0 {
+				sc := sp.idle[n-1]
+				sp.idle = sp.idle[:n-1]
+				sp.active[sc] = struct{}{}
+				return sc, nil
+			}
+			if sp.open < sp.size {
+				sp.open++
+				destAddr := pl.destAddr
+				pl.mutex.Unlock()
+				sc, err := pl.connect(destAddr, key)
+				pl.mutex.Lock()
+				if err != nil {
+					sp.open--
+					pl.cond.Broadcast()
+					return nil, err
+				}
+				if destAddr.String() != pl.destAddr.String() {
+					// the destination changed while connecting
+					sc.close()
+					sp.open--
+					pl.stats.addActive(sc.destAddr, -1)
+					continue
+				}
+				sp.params = sc.params
+				sp.active[sc] = struct{}{}
+				return sc, nil
+			}
+		}
+		if !time.Now().Before(deadline) {
+			return nil, errPoolWaitTimeout
+		}
+		pl.cond.Wait()
+	}
+}
+
+// release returns a server connection to the pool. When reusable is false
+// (the connection isn't at the end of a transaction) or the destination has
+// changed it's closed.
+func (pl *txPool) release(key poolKey, sc *serverConn, reusable bool) {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	sp := pl.serverPool(key)
+	delete(sp.active, sc)
+	if reusable && !pl.closed && sc.destAddr == pl.destAddr.String() {
+		sp.idle = append(sp.idle, sc)
+	} else {
+		sc.close()
+		sp.open--
+		pl.stats.addActive(sc.destAddr, -1)
+	}
+	pl.cond.Broadcast()
+}
+
+// startupParams returns the server ParameterStatus messages bodies sent to
+// a client at its startup. When not known a server connection is opened to
+// get them.
+func (pl *txPool) startupParams(key poolKey) ([][]byte, error) {
+	pl.mutex.Lock()
+	params := pl.serverPool(key).params
+	pl.mutex.Unlock()
+	if params != nil {
+		return params, nil
+	}
+	sc, err := pl.acquire(key)
+	if err != nil {
+		return nil, err
+	}
+	pl.release(key, sc, true)
+	return sc.params, nil
+}
+
+// pgServerError is an ErrorResponse received from the server while opening a
+// server connection
+type pgServerError struct {
+	body []byte
+}
+
+func (e *pgServerError) Error() string {
+	return "server error: " + pgErrorMessageText(e.body)
+}
+
+// connect opens and authenticates a server connection
+func (pl *txPool) connect(destAddr *net.TCPAddr, key poolKey) (*serverConn, error) {
+	d := net.Dialer{Timeout: serverConnectTimeout}
+	tcpConn, err := d.Dial("tcp", destAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	if pl.setupDestConn != nil {
+		if err := pl.setupDestConn(tcpConn.(*net.TCPConn)); err != nil {
+			tcpConn.Close()
+			return nil, err
+		}
+	}
+	conn := tcpConn
+	conn.SetDeadline(time.Now().Add(serverConnectTimeout))
+	if pl.destTLSConfig != nil {
+		if conn, err = destNegotiateTLS(tcpConn, pl.destTLSConfig); err != nil {
+			tcpConn.Close()
+			return nil, err
+		}
+	}
+	sc := &serverConn{conn: conn, r: bufio.NewReader(conn), destAddr: destAddr.String()}
+	if err := pl.startup(sc, key); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	pl.stats.addActive(sc.destAddr, 1)
+	log.Debugw("opened pooled server connection", "destination", sc.destAddr, "pool", key.String())
+	return sc, nil
+}
+
+// startup sends the startup message and authenticates a server connection
+func (pl *txPool) startup(sc *serverConn, key poolKey) error {
+	password := pl.cfg.Users[key.user]
+	if _, err := sc.conn.Write(pgStartupMessage(map[string]string{"user": key.user, "database": key.database})); err != nil {
+		return err
+	}
+	var scram *scramClient
+	for {
+		t, body, err := readPgMessage(sc.r)
+		if err != nil {
+			return err
+		}
+		switch t {
+		case 'R':
+			if len(body) < 4 {
+				return fmt.Errorf("malformed authentication request")
+			}
+			code := binary.BigEndian.Uint32(body)
+			data := body[4:]
+			var resp []byte
+			switch code {
+			case pgAuthOk:
+			case pgAuthCleartextPassword:
+				resp = pgPasswordMessage(password)
+			case pgAuthMD5Password:
+				if len(data) != 4 {
+					return fmt.Errorf("malformed md5 authentication request")
+				}
+				resp = pgPasswordMessage(pgMD5Password(key.user, password, data))
+			case pgAuthSASL:
+				if !bytes.Contains(data, []byte(scramSHA256Mechanism+"\x00")) {
+					return fmt.Errorf("server doesn't support the %s authentication", scramSHA256Mechanism)
+				}
+				if scram, err = newScramClient("", password); err != nil {
+					return err
+				}
+				first := scram.clientFirst()
+				msg := append([]byte(scramSHA256Mechanism), 0, 0, 0, 0, 0)
+				binary.BigEndian.PutUint32(msg[len(msg)-4:], uint32(len(first)))
+				resp = pgMessage('p', append(msg, first...))
+			case pgAuthSASLContinue:
+				if scram == nil {
+					return fmt.Errorf("unexpected SASL continue message")
+				}
+				final, err := scram.clientFinal(data)
+				if err != nil {
+					return err
+				}
+				resp = pgMessage('p', final)
+			case pgAuthSASLFinal:
+				if scram == nil {
+					return fmt.Errorf("unexpected SASL final message")
+				}
+				if err := scram.verifyServerFinal(data); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("unsupported server authentication method %d", code)
+			}
+			if resp != nil {
+				if _, err := sc.conn.Write(resp); err != nil {
+					return err
+				}
+			}
+		case 'S':
+			sc.params = append(sc.params, body)
+		case 'K':
+			sc.backendKey = body
+		case 'E':
+			return &pgServerError{body: body}
+		case 'N':
+		case 'Z':
+			return nil
+		default:
+			return fmt.Errorf("unexpected message %q during the server connection startup", t)
+		}
+	}
+}
+
+// cancel forwards a client cancel request to the server connection
+// currently used by the client
+func (pl *txPool) cancel(cancelKey uint64) {
+	pl.mutex.Lock()
+	c, ok := pl.cancelKeys[cancelKey]
+	pl.mutex.Unlock()
+	if !ok {
+		return
+	}
+	c.mutex.Lock()
+	sc := c.server
+	c.mutex.Unlock()
+	if sc == nil || len(sc.backendKey) != 8 {
+		return
+	}
+	conn, err := net.DialTimeout("tcp", sc.destAddr, serverConnectTimeout)
+	if err != nil {
+		log.Infow("failed to forward cancel request", "destination", sc.destAddr, zap.Error(err))
+		return
+	}
+	defer conn.Close()
+	msg := make([]byte, 8, 16)
+	binary.BigEndian.PutUint32(msg, 16)
+	binary.BigEndian.PutUint32(msg[4:], pgCancelRequestCode)
+	conn.Write(append(msg, sc.backendKey...))
+}
@@ -0,0 +1,359 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadPoolUsers(t *testing.T) {
+	tests := []struct {
+		in    string
+		users map[string]string
+		err   error
+	}{
+		{
+			in: `
+; comment
+# comment
+"user1" "password1"
+  "user2"	"md59f1f8339b8d9a5d4f9e6c0f5b6ce9e28" ""
+"us""er3" "pass word"
+`,
+			users: map[string]string{
+				"user1":  "password1",
+				"user2":  "md59f1f8339b8d9a5d4f9e6c0f5b6ce9e28",
+				`us"er3`: "pass word",
+			},
+		},
+		{
+			in:  `user1 "password1"`,
+			err: errors.New("line 1: missing quoted field"),
+		},
+		{
+			in:  `"user1" "password1`,
+			err: errors.New("line 1: unterminated quoted field"),
+		},
+		{
+			in:  `"" "password1"`,
+			err: errors.New("line 1: empty user name"),
+		},
+	}
+
+	for i, tt := range tests {
+		users, err := ReadPoolUsers(strings.NewReader(tt.in))
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+		} else if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		} else if !reflect.DeepEqual(users, tt.users) {
+			t.Errorf("#%d: got users: %v, want: %v", i, users, tt.users)
+		}
+	}
+}
+
+func TestPgMD5Password(t *testing.T) {
+	salt := []byte{1, 2, 3, 4}
+	// md5 hash of "secret" + "user"
+	hash := "md5" + "20eb1b22a92b5c573dc1eb4331fc49ee"
+	if !isMD5Password(hash) {
+		t.Fatalf("%q not detected as an md5 hash", hash)
+	}
+	if pgMD5Password("user", "secret", salt) != pgMD5Password("user", hash, salt) {
+		t.Errorf("different md5 responses for the password and its hash")
+	}
+}
+
+// testPgServer is a fake postgres server authenticating the clients with md5
+// and replying to every simple query with its command tag. "begin" and
+// "commit" change the transaction status.
+type testPgServer struct {
+	l        net.Listener
+	password string
+
+	mutex sync.Mutex
+	conns int
+}
+
+func newTestPgServer(t *testing.T, password string) *testPgServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	s := &testPgServer{l: l, password: password}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mutex.Lock()
+			s.conns++
+			s.mutex.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testPgServer) addr() *net.TCPAddr {
+	return s.l.Addr().(*net.TCPAddr)
+}
+
+func (s *testPgServer) connCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.conns
+}
+
+func (s *testPgServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	packet, err := readStartupPacket(r)
+	if err != nil {
+		return
+	}
+	params, err := parseStartupParams(packet[4:])
+	if err != nil {
+		return
+	}
+	salt := []byte{1, 2, 3, 4}
+	conn.Write(pgAuthRequest(pgAuthMD5Password, salt))
+	_, body, err := readPgMessage(r)
+	if err != nil {
+		return
+	}
+	if resp, _ := pgCString(body); resp != pgMD5Password(params["user"], s.password, salt) {
+		conn.Write(pgErrorResponse(pgInvalidPasswordCode, "password authentication failed"))
+		return
+	}
+	msg := pgAuthRequest(pgAuthOk, nil)
+	msg = append(msg, pgMessage('S', []byte("server_version\x0012.0\x00"))...)
+	msg = append(msg, pgMessage('K', []byte{0, 0, 0, 1, 0, 0, 0, 2})...)
+	msg = append(msg, pgMessage('Z', []byte{'I'})...)
+	conn.Write(msg)
+
+	status := byte('I')
+	for {
+		t, body, err := readPgMessage(r)
+		if err != nil || t == 'X' {
+			return
+		}
+		if t != 'Q' {
+			continue
+		}
+		q, _ := pgCString(body)
+		switch q {
+		case "begin":
+			status = 'T'
+		case "commit":
+			status = 'I'
+		}
+		msg := pgMessage('C', append([]byte(q), 0))
+		conn.Write(append(msg, pgMessage('Z', []byte{status})...))
+	}
+}
+
+type testPgClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// readUntilReady reads the server messages until a ReadyForQuery returning
+// the last command tag
+func (c *testPgClient) readUntilReady() (string, error) {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	tag := ""
+	for {
+		t, body, err := readPgMessage(c.r)
+		if err != nil {
+			return "", err
+		}
+		switch t {
+		case 'E':
+			return "", errors.New(pgErrorMessageText(body))
+		case 'C':
+			tag, _ = pgCString(body)
+		case 'Z':
+			return tag, nil
+		}
+	}
+}
+
+func testPgConnect(addr, user, password string) (*testPgClient, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &testPgClient{conn: conn, r: bufio.NewReader(conn)}
+	conn.Write(pgStartupMessage(map[string]string{"user": user, "database": "db"}))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	t, body, err := readPgMessage(c.r)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if t != 'R' || len(body) != 8 {
+		conn.Close()
+		return nil, errors.New("unexpected auth request")
+	}
+	conn.Write(pgPasswordMessage(pgMD5Password(user, password, body[4:])))
+	if _, err := c.readUntilReady(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *testPgClient) query(q string) (string, error) {
+	if _, err := c.conn.Write(pgMessage('Q', append([]byte(q), 0))); err != nil {
+		return "", err
+	}
+	return c.readUntilReady()
+}
+
+func newTestPoolProxy(t *testing.T, cfg *PoolConfig, dest *net.TCPAddr) (*Proxy, string) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p, err := NewProxy(listener)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p.SetTransactionPool(cfg)
+	go p.Start()
+	p.C <- ConfData{DestAddr: dest}
+	return p, listener.Addr().String()
+}
+
+func TestTransactionPool(t *testing.T) {
+	srv := newTestPgServer(t, "secret")
+	defer srv.l.Close()
+
+	cfg := &PoolConfig{Users: map[string]string{"user": "secret"}, DefaultSize: 1, WaitTimeout: 5 * time.Second}
+	p, addr := newTestPoolProxy(t, cfg, srv.addr())
+	defer p.Stop()
+
+	if _, err := testPgConnect(addr, "user", "wrong"); err == nil || err.Error() != `password authentication failed for user "user"` {
+		t.Fatalf("wrong error for a wrong password: %v", err)
+	}
+	if _, err := testPgConnect(addr, "unknown", "secret"); err == nil {
+		t.Fatalf("got no error for an unknown user")
+	}
+
+	c1, err := testPgConnect(addr, "user", "secret")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer c1.conn.Close()
+	c2, err := testPgConnect(addr, "user", "secret")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer c2.conn.Close()
+
+	// c2 must wait for the c1 transaction to finish since the pool has a
+	// single server connection
+	if _, err := c1.query("begin"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	type result struct {
+		tag string
+		err error
+	}
+	resCh := make(chan result)
+	go func() {
+		tag, err := c2.query("select 1")
+		resCh <- result{tag, err}
+	}()
+	select {
+	case res := <-resCh:
+		t.Fatalf("query completed while the server connection is used by another transaction: %v", res)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if _, err := c1.query("commit"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	res := <-resCh
+	if res.err != nil || res.tag != "select 1" {
+		t.Fatalf("wrong query result: %v", res)
+	}
+	if n := srv.connCount(); n != 1 {
+		t.Errorf("got %d server connections, want: 1", n)
+	}
+
+	// the idle clients are kept when the destination changes
+	srv2 := newTestPgServer(t, "secret")
+	defer srv2.l.Close()
+	p.C <- ConfData{DestAddr: srv2.addr()}
+	if tag, err := c1.query("select 2"); err != nil || tag != "select 2" {
+		t.Fatalf("wrong query result after the destination change: %q, %v", tag, err)
+	}
+	if n := srv2.connCount(); n != 1 {
+		t.Errorf("got %d server connections to the new destination, want: 1", n)
+	}
+
+	// a client in a transaction when the destination changes loses its
+	// connection
+	if _, err := c1.query("begin"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p.C <- ConfData{DestAddr: srv.addr()}
+	if _, err := c1.query("select 3"); err == nil {
+		t.Errorf("got no error for a transaction interrupted by a destination change")
+	}
+	if tag, err := c2.query("select 4"); err != nil || tag != "select 4" {
+		t.Fatalf("wrong query result: %q, %v", tag, err)
+	}
+}
+
+func TestTransactionPoolWaitTimeout(t *testing.T) {
+	srv := newTestPgServer(t, "secret")
+	defer srv.l.Close()
+
+	cfg := &PoolConfig{Users: map[string]string{"user": "secret"}, DefaultSize: 1, WaitTimeout: 100 * time.Millisecond}
+	p, addr := newTestPoolProxy(t, cfg, srv.addr())
+	defer p.Stop()
+
+	c1, err := testPgConnect(addr, "user", "secret")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer c1.conn.Close()
+	c2, err := testPgConnect(addr, "user", "secret")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer c2.conn.Close()
+
+	if _, err := c1.query("begin"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := c2.query("select 1"); err == nil || err.Error() != errPoolWaitTimeout.Error() {
+		t.Errorf("wrong error: got: %v, want: %v", err, errPoolWaitTimeout)
+	}
+}
@@ -0,0 +1,375 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// clientAuthTimeout is the max time to wait for the client startup and
+// authentication
+const clientAuthTimeout = 10 * time.Second
+
+// maxClientBatchSize is the max size of the client messages, already received,
+// sent together to the server
+const maxClientBatchSize = 64 * 1024
+
+// poolClient is a client connection served by the transaction pool
+type poolClient struct {
+	pool *txPool
+	key  poolKey
+	conn net.Conn
+	r    *bufio.Reader
+
+	writeMutex sync.Mutex
+	w          *bufio.Writer
+
+	mutex sync.Mutex
+	// server is the server connection assigned to the client in the
+	// current transaction
+	server *serverConn
+	// pending is the number of queries and syncs sent to the server
+	// waiting for their ReadyForQuery
+	pending int
+	// batch reports if extended query protocol messages have been sent
+	// after the last sync
+	batch bool
+}
+
+// serveClient serves a client connection. stream is the client data stream
+// (starting with the startup message) and conn the client connection.
+func (pl *txPool) serveClient(conn net.Conn, stream io.ReadWriter) {
+	c := &poolClient{pool: pl, conn: conn, r: bufio.NewReader(stream), w: bufio.NewWriter(stream)}
+
+	conn.SetDeadline(time.Now().Add(clientAuthTimeout))
+	if !c.startup() {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	cancelKey, ok := pl.addClient(c)
+	if !ok {
+		return
+	}
+	defer pl.removeClient(c, cancelKey)
+
+	params, err := pl.startupParams(c.key)
+	if err != nil {
+		log.Infow("cannot get a server connection for the client startup", "conn", conn.RemoteAddr(), "pool", c.key.String(), zap.Error(err))
+		c.fatalErr(err)
+		return
+	}
+	msg := pgAuthRequest(pgAuthOk, nil)
+	for _, p := range params {
+		msg = append(msg, pgMessage('S', p)...)
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, cancelKey)
+	msg = append(msg, pgMessage('K', key)...)
+	msg = append(msg, pgMessage('Z', []byte{'I'})...)
+	if err := c.writeClient(msg, true); err != nil {
+		return
+	}
+
+	c.run()
+}
+
+// startup reads the client startup message and authenticates the client. It
+// returns false when the client connection must be closed.
+func (c *poolClient) startup() bool {
+	packet, err := readStartupPacket(c.r)
+	if err != nil {
+		log.Debugw("failed to read the client startup message", "conn", c.conn.RemoteAddr(), zap.Error(err))
+		return false
+	}
+	switch code := binary.BigEndian.Uint32(packet); code {
+	case pgCancelRequestCode:
+		if len(packet) == 12 {
+			c.pool.cancel(binary.BigEndian.Uint64(packet[4:]))
+		}
+		return false
+	case pgProtocolVersion3:
+	default:
+		c.fatal(pgFeatureNotSupportedCode, fmt.Sprintf("unsupported frontend protocol %d.%d", code>>16, code&0xffff))
+		return false
+	}
+	params, err := parseStartupParams(packet[4:])
+	if err != nil {
+		c.fatal(pgProtocolViolationCode, err.Error())
+		return false
+	}
+	if r, ok := params["replication"]; ok && r != "false" && r != "off" && r != "no" && r != "0" {
+		c.fatal(pgFeatureNotSupportedCode, "replication connections aren't supported in transaction pooling mode")
+		return false
+	}
+	user := params["user"]
+	if user == "" {
+		c.fatal(pgProtocolViolationCode, "no user name specified in the startup message")
+		return false
+	}
+	database := params["database"]
+	if database == "" {
+		database = user
+	}
+	c.key = poolKey{database: database, user: user}
+
+	// authenticate the client with md5 also when the password is stored
+	// as md5 hash
+	salt := make([]byte, 4)
+	if _, err := rand.Read(salt); err != nil {
+		return false
+	}
+	if err := c.writeClient(pgAuthRequest(pgAuthMD5Password, salt), true); err != nil {
+		return false
+	}
+	t, body, err := readPgMessage(c.r)
+	if err != nil {
+		return false
+	}
+	if t != 'p' {
+		c.fatal(pgProtocolViolationCode, fmt.Sprintf("expected password response, got message type %q", t))
+		return false
+	}
+	resp, err := pgCString(body)
+	if err != nil {
+		c.fatal(pgProtocolViolationCode, err.Error())
+		return false
+	}
+	password, ok := c.pool.cfg.Users[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(resp), []byte(pgMD5Password(user, password, salt))) != 1 {
+		log.Infow("client authentication failed", "conn", c.conn.RemoteAddr(), "user", user)
+		c.fatal(pgInvalidPasswordCode, fmt.Sprintf("password authentication failed for user %q", user))
+		return false
+	}
+	return true
+}
+
+// addClient registers the client returning its cancel key. It returns
+// false if the pool is closed.
+func (pl *txPool) addClient(c *poolClient) (uint64, bool) {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	if pl.closed {
+		return 0, false
+	}
+	var cancelKey uint64
+	for {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return 0, false
+		}
+		cancelKey = binary.BigEndian.Uint64(b)
+		if _, ok := pl.cancelKeys[cancelKey]; !ok {
+			break
+		}
+	}
+	pl.clients[c] = struct{}{}
+	pl.cancelKeys[cancelKey] = c
+	return cancelKey, true
+}
+
+func (pl *txPool) removeClient(c *poolClient, cancelKey uint64) {
+	pl.mutex.Lock()
+	defer pl.mutex.Unlock()
+	delete(pl.clients, c)
+	delete(pl.cancelKeys, cancelKey)
+}
+
+// run forwards the client messages to the server connection assigned to the
+// client, assigning one at the start of every transaction
+func (c *poolClient) run() {
+	defer func() {
+		c.mutex.Lock()
+		sc := c.server
+		c.server = nil
+		c.mutex.Unlock()
+		// the client has closed the connection in the middle of a
+		// transaction
+		if sc != nil {
+			c.pool.release(c.key, sc, false)
+		}
+	}()
+
+	out := []byte{}
+	for {
+		t, body, err := readPgMessage(c.r)
+		if err != nil {
+			return
+		}
+		if t == 'X' {
+			return
+		}
+		sc, err := c.serverFor(t)
+		if err != nil {
+			log.Infow("cannot assign a server connection to the client", "conn", c.conn.RemoteAddr(), "pool", c.key.String(), zap.Error(err))
+			c.fatalErr(err)
+			return
+		}
+		// the server connection cannot be released until the messages
+		// are sent so they can be sent together
+		out = append(out, pgMessage(t, body)...)
+		if c.r.Buffered() > 0 && len(out) < maxClientBatchSize {
+			continue
+		}
+		if _, err := sc.conn.Write(out); err != nil {
+			c.serverLost(sc, true)
+			return
+		}
+		out = out[:0]
+	}
+}
+
+// serverFor returns the server connection where the client message of type
+// t must be sent, acquiring one if the client isn't in a transaction
+func (c *poolClient) serverFor(t byte) (*serverConn, error) {
+	c.mutex.Lock()
+	sc := c.server
+	if sc != nil {
+		c.addMessage(t)
+		c.mutex.Unlock()
+		return sc, nil
+	}
+	c.mutex.Unlock()
+
+	sc, err := c.pool.acquire(c.key)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	c.server = sc
+	c.pending = 0
+	c.batch = false
+	c.addMessage(t)
+	c.mutex.Unlock()
+	go c.relay(sc)
+	return sc, nil
+}
+
+// addMessage accounts a client message sent to the server. It must be called
+// with the client mutex locked.
+func (c *poolClient) addMessage(t byte) {
+	switch t {
+	case 'Q', 'F':
+		c.pending++
+	case 'S':
+		c.pending++
+		c.batch = false
+	case 'd', 'c', 'f':
+		// copy messages
+	default:
+		c.batch = true
+	}
+}
+
+// relay forwards the server messages to the client until the server
+// connection is released at the end of the transaction
+func (c *poolClient) relay(sc *serverConn) {
+	for {
+		t, body, err := readPgMessage(sc.r)
+		if err != nil {
+			c.serverLost(sc, true)
+			return
+		}
+		flush := t == 'Z' || sc.r.Buffered() == 0
+		if err := c.writeClient(pgMessage(t, body), flush); err != nil {
+			c.serverLost(sc, false)
+			return
+		}
+		if t == 'Z' && len(body) == 1 && c.readyForQuery(sc, body[0]) {
+			return
+		}
+	}
+}
+
+// readyForQuery accounts a ReadyForQuery message received from the server
+// and releases the server connection when the transaction has finished. It
+// returns true when the server connection isn't assigned to the client
+// anymore.
+func (c *poolClient) readyForQuery(sc *serverConn, status byte) bool {
+	c.mutex.Lock()
+	if c.server != sc {
+		c.mutex.Unlock()
+		return true
+	}
+	if c.pending > 0 {
+		c.pending--
+	}
+	release := c.pending == 0 && !c.batch && status == 'I'
+	if release {
+		c.server = nil
+	}
+	c.mutex.Unlock()
+	if release {
+		c.pool.release(c.key, sc, true)
+	}
+	return release
+}
+
+// serverLost closes a broken server connection and the client connection
+// since its transaction cannot continue. When notify is true the client
+// receives an error.
+func (c *poolClient) serverLost(sc *serverConn, notify bool) {
+	c.mutex.Lock()
+	current := c.server == sc
+	if current {
+		c.server = nil
+	}
+	c.mutex.Unlock()
+	// the server connection has already been released closing the client
+	if !current {
+		return
+	}
+	c.pool.release(c.key, sc, false)
+	if notify {
+		c.fatal(pgConnectionFailureCode, "server connection lost")
+	}
+	c.conn.Close()
+}
+
+func (c *poolClient) writeClient(msg []byte, flush bool) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if _, err := c.w.Write(msg); err != nil {
+		return err
+	}
+	if flush {
+		return c.w.Flush()
+	}
+	return nil
+}
+
+func (c *poolClient) fatal(code, message string) {
+	c.writeClient(pgErrorResponse(code, message), true)
+}
+
+// fatalErr sends the error to the client. The server errors are sent as
+// received.
+func (c *poolClient) fatalErr(err error) {
+	if serr, ok := err.(*pgServerError); ok {
+		c.writeClient(pgMessage('E', serr.body), true)
+		return
+	}
+	c.fatal(pgConnectionFailureCode, err.Error())
+}
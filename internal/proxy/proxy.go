@@ -0,0 +1,763 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package proxy implements the tcp proxy used by the stolon proxy to forward
+// client connections to the current master.
+// It's derived from github.com/sorintlab/pollon, extended with the features
+// needed by the stolon proxy.
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	slog "github.com/sorintlab/stolon/internal/log"
+
+	"github.com/sorintlab/tcpkeepalive"
+	"go.uber.org/zap"
+)
+
+var log = slog.S()
+
+// proxyProtocolHeaderTimeout is the max time to wait for the PROXY protocol
+// header when accepting it from the clients
+const proxyProtocolHeaderTimeout = 10 * time.Second
+
+// tlsNegotiationTimeout is the max time to wait for the client tls
+// negotiation
+const tlsNegotiationTimeout = 10 * time.Second
+
+func SetLogger(l *zap.SugaredLogger) {
+	log = l
+}
+
+// ConfData is the proxy configuration. DestAddr is the destination of the
+// proxied connections, when it changes all the connections to the previous
+// destination are closed.
+// When DestAddrs is provided the proxied connections are instead balanced
+// between them choosing the destination with fewer active connections.
+// Changing DestAddrs doesn't close the connections to the previous
+// destinations, they're closed only when no destination is provided.
+type ConfData struct {
+	DestAddr  *net.TCPAddr
+	DestAddrs []*net.TCPAddr
+}
+
+type Proxy struct {
+	C          chan ConfData
+	listener   net.Listener
+	destAddr   *net.TCPAddr
+	destAddrs  []*net.TCPAddr
+	closeConns chan struct{}
+	stop       chan struct{}
+	endCh      chan error
+	connMutex  sync.Mutex
+
+	keepAlive         bool
+	keepAliveIdle     time.Duration
+	keepAliveCount    int
+	keepAliveInterval time.Duration
+	userTimeout       time.Duration
+
+	// destination connections tcp options
+	destKeepAlive         bool
+	destKeepAliveIdle     time.Duration
+	destKeepAliveCount    int
+	destKeepAliveInterval time.Duration
+	destUserTimeout       time.Duration
+
+	idleTimeout time.Duration
+
+	proxyProtocol        bool
+	proxyProtocolVersion int
+	acceptProxyProtocol  bool
+
+	clientTLSConfig *tls.Config
+	destTLSConfig   *tls.Config
+
+	warmupInterval time.Duration
+	warmupMaxConns int
+	warmupStart    time.Time
+	lastDestAddr   *net.TCPAddr
+	activeConns    int
+	nowFn          func() time.Time
+
+	drainTimeout time.Duration
+
+	// client connections limits
+	maxConns       int
+	maxSourceConns int
+	clientConns    int
+	sourceConns    map[string]int
+	// conns are the connections started since the last drain
+	conns *sync.WaitGroup
+
+	// per destination active and total chosen connections when balancing
+	// between multiple destinations
+	destActiveConns map[string]int
+	destChosenConns map[string]uint64
+	nextDest        int
+
+	stats *ConnStats
+
+	// transaction pooling
+	poolConfig *PoolConfig
+	pool       *txPool
+
+	// traffic mirroring
+	mirrorConfig *MirrorConfig
+	mirrorAddr   *net.TCPAddr
+	randFn       func() float64
+}
+
+// clientConn is an accepted client connection: a tcp or a unix socket
+// connection
+type clientConn interface {
+	net.Conn
+	CloseRead() error
+}
+
+// NewProxy creates a proxy accepting the client connections from the tcp or
+// unix socket listener.
+func NewProxy(listener net.Listener) (*Proxy, error) {
+	return &Proxy{
+		C:          make(chan ConfData),
+		listener:   listener,
+		closeConns: make(chan struct{}),
+		conns:      &sync.WaitGroup{},
+		stop:       make(chan struct{}),
+		endCh:      make(chan error),
+		connMutex:  sync.Mutex{},
+		nowFn:      time.Now,
+		randFn:     rand.Float64,
+
+		proxyProtocolVersion: 1,
+
+		sourceConns:     make(map[string]int),
+		destActiveConns: make(map[string]int),
+		destChosenConns: make(map[string]uint64),
+
+		stats: NewConnStats(),
+	}, nil
+}
+
+// chooseDestAddr chooses, between the balanced destinations, the one with
+// fewer active connections. Ties are broken in round robin. It must be called
+// with connMutex locked.
+func (p *Proxy) chooseDestAddr() *net.TCPAddr {
+	if len(p.destAddrs) == 0 {
+		return nil
+	}
+	var chosen *net.TCPAddr
+	for i := 0; i < len(p.destAddrs); i++ {
+		addr := p.destAddrs[(p.nextDest+i)%len(p.destAddrs)]
+		if chosen == nil || p.destActiveConns[addr.String()] < p.destActiveConns[chosen.String()] {
+			chosen = addr
+		}
+	}
+	p.nextDest = (p.nextDest + 1) % len(p.destAddrs)
+	p.destActiveConns[chosen.String()]++
+	p.destChosenConns[chosen.String()]++
+	return chosen
+}
+
+func (p *Proxy) releaseDestAddr(addr *net.TCPAddr) {
+	p.connMutex.Lock()
+	defer p.connMutex.Unlock()
+	p.destActiveConns[addr.String()]--
+	if p.destActiveConns[addr.String()] <= 0 {
+		delete(p.destActiveConns, addr.String())
+	}
+}
+
+// ChosenConns returns, for every destination, the number of connections
+// balanced to it since the proxy start.
+func (p *Proxy) ChosenConns() map[string]uint64 {
+	p.connMutex.Lock()
+	defer p.connMutex.Unlock()
+	chosenConns := make(map[string]uint64, len(p.destChosenConns))
+	for addr, n := range p.destChosenConns {
+		chosenConns[addr] = n
+	}
+	return chosenConns
+}
+
+// warmupConnLimit returns the maximum number of concurrent proxied
+// connections after elapsed time from the start of the warm up. The limit is
+// linearly increased from 1 to maxConns during the warm up interval. After it
+// 0 (no limit) is returned.
+func warmupConnLimit(elapsed, interval time.Duration, maxConns int) int {
+	if interval <= 0 || maxConns <= 0 || elapsed >= interval {
+		return 0
+	}
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return 1 + int(int64(maxConns-1)*int64(elapsed)/int64(interval))
+}
+
+// acquireConn registers a new proxied connection. It returns false when the
+// connection must be refused since the warm up connections limit is reached.
+func (p *Proxy) acquireConn() bool {
+	p.connMutex.Lock()
+	defer p.connMutex.Unlock()
+	if !p.warmupStart.IsZero() {
+		limit := warmupConnLimit(p.nowFn().Sub(p.warmupStart), p.warmupInterval, p.warmupMaxConns)
+		if limit == 0 {
+			// warm up finished
+			p.warmupStart = time.Time{}
+		} else if p.activeConns >= limit {
+			return false
+		}
+	}
+	p.activeConns++
+	return true
+}
+
+func (p *Proxy) releaseConn() {
+	p.connMutex.Lock()
+	p.activeConns--
+	p.connMutex.Unlock()
+}
+
+func (p *Proxy) proxyConn(conn clientConn) {
+	p.stats.connAccepted()
+	p.connMutex.Lock()
+	closeConns := p.closeConns
+	conns := p.conns
+	conns.Add(1)
+	destAddr := p.destAddr
+	balanced := len(p.destAddrs) > 0
+	if balanced {
+		destAddr = p.chooseDestAddr()
+	}
+	p.connMutex.Unlock()
+	defer func() {
+		log.Debugw("closing source connection", "conn", conn.RemoteAddr())
+		conn.Close()
+		p.stats.connClosed()
+		conns.Done()
+	}()
+
+	if destAddr == nil {
+		return
+	}
+	if balanced {
+		defer p.releaseDestAddr(destAddr)
+	}
+
+	if !p.acquireConn() {
+		log.Debugw("refusing connection since the warm up connections limit has been reached", "conn", conn.RemoteAddr())
+		return
+	}
+	defer p.releaseConn()
+
+	// the client addresses sent in the PROXY protocol header
+	src, dst := conn.RemoteAddr(), conn.LocalAddr()
+	// the client data stream, decrypted when terminating the client tls
+	// connection
+	var clientStream io.ReadWriter = conn
+	if p.acceptProxyProtocol {
+		r := bufio.NewReader(conn)
+		conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout))
+		hsrc, hdst, err := readProxyProtocolHeader(r)
+		if err != nil {
+			log.Infow("closing connection with a wrong PROXY protocol header", "conn", conn.RemoteAddr(), zap.Error(err))
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		if hsrc != nil {
+			src, dst = hsrc, hdst
+		}
+		// the reader can contain already buffered client data
+		clientStream = struct {
+			io.Reader
+			io.Writer
+		}{r, conn}
+	}
+
+	if p.maxConns > 0 || p.maxSourceConns > 0 {
+		source := sourceIP(src)
+		if err := p.acquireClientConn(source); err != nil {
+			log.Debugw("refusing connection", "conn", conn.RemoteAddr(), "source", source, zap.Error(err))
+			p.stats.connRefused(err)
+			conn.Write(pgErrorResponse(pgTooManyConnectionsCode, err.Error()))
+			return
+		}
+		defer p.releaseClientConn(source)
+	}
+
+	// the transaction pool handles the client startup so it also denies
+	// the encryption requests when not terminating the client tls
+	if p.poolConfig != nil || p.clientTLSConfig != nil || p.destTLSConfig != nil {
+		var err error
+		conn.SetDeadline(time.Now().Add(tlsNegotiationTimeout))
+		clientStream, err = clientNegotiateTLS(conn, clientStream, p.clientTLSConfig)
+		if err != nil {
+			log.Infow("closing connection since the tls negotiation failed", "conn", conn.RemoteAddr(), zap.Error(err))
+			return
+		}
+		conn.SetDeadline(time.Time{})
+	}
+
+	if p.pool != nil {
+		p.pool.serveClient(conn, clientStream)
+		return
+	}
+
+	var d net.Dialer
+	d.Cancel = closeConns
+	destConnInterface, err := d.Dial("tcp", destAddr.String())
+	if err != nil {
+		return
+	}
+	destConn := destConnInterface.(*net.TCPConn)
+	p.stats.addActive(destAddr.String(), 1)
+	defer func() {
+		log.Debugw("closing destination connection", "conn", destConn.RemoteAddr())
+		destConn.Close()
+		p.stats.addActive(destAddr.String(), -1)
+	}()
+	if err := p.setupDestConn(destConn); err != nil {
+		log.Infow("failed to set the destination connection tcp options", "conn", destConn.RemoteAddr(), zap.Error(err))
+		return
+	}
+
+	if p.proxyProtocol {
+		// The header must be the first thing received by the destination
+		header := proxyProtocolHeader(src, dst)
+		if p.proxyProtocolVersion == 2 {
+			header = proxyProtocolV2Header(src, dst)
+		}
+		if _, err := destConn.Write(header); err != nil {
+			log.Debugw("failed to send proxy protocol header", "conn", destConn.RemoteAddr(), zap.Error(err))
+			return
+		}
+	}
+
+	var destStream io.ReadWriter = destConn
+	if p.destTLSConfig != nil {
+		destConn.SetDeadline(time.Now().Add(tlsNegotiationTimeout))
+		destStream, err = destNegotiateTLS(destConn, p.destTLSConfig)
+		if err != nil {
+			log.Infow("failed to open a tls connection to the destination", "conn", destConn.RemoteAddr(), zap.Error(err))
+			return
+		}
+		destConn.SetDeadline(time.Time{})
+	}
+
+	// the client data is also sent to the mirror destination
+	var clientReader io.Reader = clientStream
+	if mirror := p.dialMirror(conn); mirror != nil {
+		defer mirror.Close()
+		clientReader = io.TeeReader(clientStream, mirror)
+	}
+
+	// the last time data has been received from the client or the
+	// destination
+	var lastActivity int64
+	var idleTimer <-chan time.Time
+	if p.idleTimeout > 0 {
+		lastActivity = time.Now().UnixNano()
+		clientReader = &activityReader{r: clientReader, last: &lastActivity}
+		destStream = struct {
+			io.Reader
+			io.Writer
+		}{&activityReader{r: destStream, last: &lastActivity}, destStream}
+		t := time.NewTimer(p.idleTimeout)
+		defer t.Stop()
+		idleTimer = t.C
+	}
+
+	var wg sync.WaitGroup
+	end := make(chan bool)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		n, _ := io.Copy(destStream, clientReader)
+		conn.Close()
+		destConn.CloseRead()
+		log.Debugw("ending. copied bytes from source to dest", "bytes", n)
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		n, _ := io.Copy(clientStream, destStream)
+		destConn.Close()
+		conn.CloseRead()
+		log.Debugw("ending. copied bytes from dest to source", "bytes", n)
+	}()
+
+	go func() {
+		wg.Wait()
+		end <- true
+	}()
+
+	for {
+		select {
+		case <-end:
+			log.Debugw("all io copy goroutines done")
+			return
+		case <-closeConns:
+			log.Debugw("closing all connections")
+			return
+		case <-idleTimer:
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&lastActivity)))
+			if idle >= p.idleTimeout {
+				log.Infow("closing idle connection", "conn", conn.RemoteAddr(), "idle", idle)
+				p.stats.idleTimeout()
+				return
+			}
+			idleTimer = time.After(p.idleTimeout - idle)
+		}
+	}
+}
+
+// activityReader records in last the time of the reads returning some data
+type activityReader struct {
+	r    io.Reader
+	last *int64
+}
+
+func (r *activityReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(r.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (p *Proxy) confCheck() {
+	for {
+		select {
+		case <-p.stop:
+			return
+		case confData := <-p.C:
+			if len(confData.DestAddrs) > 0 {
+				// keep the connections to the previous destinations
+				p.connMutex.Lock()
+				p.destAddr = nil
+				p.destAddrs = confData.DestAddrs
+				p.connMutex.Unlock()
+				continue
+			}
+			if confData.DestAddr.String() != p.destAddr.String() || len(p.destAddrs) > 0 {
+				p.connMutex.Lock()
+				if p.destAddr != nil || len(p.destAddrs) > 0 {
+					p.stats.teardown()
+				}
+				if p.drainTimeout > 0 && p.destAddr != nil {
+					// stop proxying new connections and give the
+					// current ones the time to finish
+					p.destAddr = nil
+					conns := p.conns
+					p.conns = &sync.WaitGroup{}
+					p.connMutex.Unlock()
+					p.drainConns(conns)
+					p.connMutex.Lock()
+				}
+				close(p.closeConns)
+				p.closeConns = make(chan struct{})
+				p.destAddr = confData.DestAddr
+				p.destAddrs = nil
+				if p.pool != nil {
+					p.pool.setDestAddr(confData.DestAddr)
+				}
+				if confData.DestAddr != nil {
+					// start the warm up when proxying to a new
+					// destination (i.e. a new master), not when
+					// starting proxying to the first destination
+					if p.warmupInterval > 0 && p.lastDestAddr != nil && p.lastDestAddr.String() != confData.DestAddr.String() {
+						log.Infow("starting connections warm up", "destination", confData.DestAddr, "interval", p.warmupInterval, "maxConnections", p.warmupMaxConns)
+						p.warmupStart = p.nowFn()
+					}
+					p.lastDestAddr = confData.DestAddr
+				}
+				p.connMutex.Unlock()
+			}
+		}
+	}
+}
+
+// drainConns waits for the provided connections to be closed by the clients,
+// up to the drain timeout
+func (p *Proxy) drainConns(conns *sync.WaitGroup) {
+	log.Infow("draining connections", "timeout", p.drainTimeout)
+	done := make(chan struct{})
+	go func() {
+		conns.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(p.drainTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		log.Infow("all the connections have been closed by the clients")
+	case <-timer.C:
+		log.Infow("drain timeout expired, closing the remaining connections")
+	case <-p.stop:
+	}
+}
+
+func (p *Proxy) accepter() {
+	for {
+		c, err := p.listener.Accept()
+		if err != nil {
+			p.endCh <- fmt.Errorf("accept error: %v", err)
+			return
+		}
+		conn, ok := c.(clientConn)
+		if !ok {
+			c.Close()
+			p.endCh <- fmt.Errorf("unsupported connection type %T", c)
+			return
+		}
+		// the tcp options don't apply to unix socket connections
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			if p.keepAlive {
+				if err := p.SetupKeepAlive(tcpConn); err != nil {
+					p.endCh <- fmt.Errorf("setKeepAlive error: %v", err)
+					return
+				}
+			}
+			if p.userTimeout > 0 {
+				if err := setUserTimeout(tcpConn, p.userTimeout); err != nil {
+					p.endCh <- fmt.Errorf("setUserTimeout error: %v", err)
+					return
+				}
+			}
+		}
+		go p.proxyConn(conn)
+	}
+}
+
+func (p *Proxy) Stop() {
+	p.endCh <- nil
+}
+
+func (p *Proxy) Start() error {
+	if p.poolConfig != nil {
+		p.pool = newTxPool(p.poolConfig, p.destTLSConfig, p.stats)
+		p.pool.setupDestConn = p.setupDestConn
+	}
+	go p.confCheck()
+	go p.accepter()
+	err := <-p.endCh
+	close(p.stop)
+	if p.pool != nil {
+		p.pool.close()
+	}
+	if err != nil {
+		return fmt.Errorf("proxy error: %v", err)
+	}
+	return nil
+}
+
+func (p *Proxy) SetKeepAlive(keepalive bool) {
+	p.keepAlive = keepalive
+}
+
+func (p *Proxy) SetKeepAliveIdle(d time.Duration) {
+	p.keepAliveIdle = d
+}
+
+func (p *Proxy) SetKeepAliveCount(n int) {
+	p.keepAliveCount = n
+}
+
+func (p *Proxy) SetKeepAliveInterval(d time.Duration) {
+	p.keepAliveInterval = d
+}
+
+// SetUserTimeout sets the TCP_USER_TIMEOUT of the client connections: the
+// max time the transmitted data can remain unacknowledged before the
+// connection is closed. 0 keeps the system default. It's supported only on
+// linux.
+func (p *Proxy) SetUserTimeout(d time.Duration) {
+	p.userTimeout = d
+}
+
+// SetDestKeepAlive enables the tcp keepalive of the destination connections
+// with the provided idle, probes count and interval. 0 values keep the
+// system defaults.
+func (p *Proxy) SetDestKeepAlive(idle time.Duration, count int, interval time.Duration) {
+	p.destKeepAlive = true
+	p.destKeepAliveIdle = idle
+	p.destKeepAliveCount = count
+	p.destKeepAliveInterval = interval
+}
+
+// SetDestUserTimeout sets the TCP_USER_TIMEOUT of the destination
+// connections. 0 keeps the system default. It's supported only on linux.
+func (p *Proxy) SetDestUserTimeout(d time.Duration) {
+	p.destUserTimeout = d
+}
+
+// SetIdleTimeout enables closing the proxied connections when no data has
+// been received from both the client and the destination for the idle
+// timeout. It doesn't apply to the transaction pool client connections.
+func (p *Proxy) SetIdleTimeout(d time.Duration) {
+	p.idleTimeout = d
+}
+
+// SetProxyProtocol enables sending a PROXY protocol header to the destination
+// at the start of every proxied connection. Enable it only when the
+// destination accepts the PROXY protocol or the header will be received as
+// part of the client data.
+func (p *Proxy) SetProxyProtocol(proxyProtocol bool) {
+	p.proxyProtocol = proxyProtocol
+}
+
+// SetProxyProtocolVersion sets the version (1 or 2) of the sent PROXY protocol
+// headers. Defaults to 1.
+func (p *Proxy) SetProxyProtocolVersion(version int) {
+	p.proxyProtocolVersion = version
+}
+
+// SetAcceptProxyProtocol enables reading a PROXY protocol (version 1 or 2)
+// header at the start of every client connection (i.e. when the proxy is
+// behind a load balancer sending it). The client address it contains is the
+// one sent to the destination when SetProxyProtocol is enabled. Connections
+// without a valid header are closed.
+func (p *Proxy) SetAcceptProxyProtocol(accept bool) {
+	p.acceptProxyProtocol = accept
+}
+
+// SetWarmup enables limiting the concurrent proxied connections after the
+// destination changes (i.e. after a new master has been promoted). During
+// the warm up interval the limit is linearly increased from 1 to maxConns,
+// exceeding connections are closed.
+func (p *Proxy) SetWarmup(interval time.Duration, maxConns int) {
+	p.warmupInterval = interval
+	p.warmupMaxConns = maxConns
+}
+
+// SetClientTLSConfig enables terminating the client tls connections with the
+// provided config. The proxy handles the postgres SSLRequest negotiation and
+// refuses the clients not requesting tls.
+func (p *Proxy) SetClientTLSConfig(config *tls.Config) {
+	p.clientTLSConfig = config
+}
+
+// SetDestTLSConfig enables opening tls connections to the destinations with
+// the provided config, negotiating them with a postgres SSLRequest. The
+// client requests of a tls connection are denied when not terminating the
+// client tls connections.
+func (p *Proxy) SetDestTLSConfig(config *tls.Config) {
+	p.destTLSConfig = config
+}
+
+// SetDrainTimeout enables draining the connections when the destination
+// changes (i.e. the master has changed): the new connections aren't proxied
+// anymore while the current ones are given up to the drain timeout to finish
+// before being closed. Updating the destination blocks until the drain ends.
+// It doesn't apply to the balanced destinations.
+func (p *Proxy) SetDrainTimeout(d time.Duration) {
+	p.drainTimeout = d
+}
+
+// SetConnLimits sets the max number of client connections and the max number
+// of client connections from the same source ip (the one provided by the
+// PROXY protocol header when accepted). 0 means no limit. The exceeding
+// connections receive a postgres "too many connections" error and are closed.
+func (p *Proxy) SetConnLimits(maxConns, maxSourceConns int) {
+	p.maxConns = maxConns
+	p.maxSourceConns = maxSourceConns
+}
+
+// SetTransactionPool enables the transaction pooling: the client connections
+// are authenticated by the proxy and multiplexed over a limited number of
+// connections to the destination, assigned to a client only for the duration
+// of a transaction. The clients not in a transaction are kept connected when
+// the destination changes. It doesn't apply to the balanced destinations and
+// must be called before starting the proxy.
+func (p *Proxy) SetTransactionPool(config *PoolConfig) {
+	p.poolConfig = config
+}
+
+// SetMirror enables the mirroring of the client traffic with the provided
+// config. The mirror destination is set with SetMirrorAddr. The connections
+// handled by the transaction pool aren't mirrored.
+func (p *Proxy) SetMirror(config *MirrorConfig) {
+	p.connMutex.Lock()
+	defer p.connMutex.Unlock()
+	p.mirrorConfig = config
+}
+
+// SetMirrorAddr sets the mirror destination of the new client connections. A
+// nil addr disables the mirroring.
+func (p *Proxy) SetMirrorAddr(addr *net.TCPAddr) {
+	p.connMutex.Lock()
+	defer p.connMutex.Unlock()
+	p.mirrorAddr = addr
+}
+
+// SetConnStats sets the statistics updated by the proxy. It must be called
+// before starting the proxy.
+func (p *Proxy) SetConnStats(stats *ConnStats) {
+	p.stats = stats
+}
+
+// ConnStats returns the statistics updated by the proxy
+func (p *Proxy) ConnStats() *ConnStats {
+	return p.stats
+}
+
+func (p *Proxy) SetupKeepAlive(conn *net.TCPConn) error {
+	return setupKeepAlive(conn, p.keepAliveIdle, p.keepAliveCount, p.keepAliveInterval)
+}
+
+// setupDestConn sets the tcp options of a destination connection
+func (p *Proxy) setupDestConn(conn *net.TCPConn) error {
+	if p.destKeepAlive {
+		if err := setupKeepAlive(conn, p.destKeepAliveIdle, p.destKeepAliveCount, p.destKeepAliveInterval); err != nil {
+			return err
+		}
+	}
+	if p.destUserTimeout > 0 {
+		if err := setUserTimeout(conn, p.destUserTimeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setupKeepAlive(conn *net.TCPConn, idle time.Duration, count int, interval time.Duration) error {
+	if err := conn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	if idle != 0 {
+		if err := tcpkeepalive.SetKeepAliveIdle(conn, idle); err != nil {
+			return err
+		}
+	}
+	if count != 0 {
+		if err := tcpkeepalive.SetKeepAliveCount(conn, count); err != nil {
+			return err
+		}
+	}
+	if interval != 0 {
+		if err := tcpkeepalive.SetKeepAliveInterval(conn, interval); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,1002 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProxyProtocolHeader(t *testing.T) {
+	tests := []struct {
+		src net.Addr
+		dst net.Addr
+		out string
+	}{
+		{
+			src: &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 45678},
+			dst: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5432},
+			out: "PROXY TCP4 192.168.1.10 10.0.0.1 45678 5432\r\n",
+		},
+		{
+			src: &net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 45678},
+			dst: &net.TCPAddr{IP: net.ParseIP("::1"), Port: 5432},
+			out: "PROXY TCP6 2001:db8::10 ::1 45678 5432\r\n",
+		},
+		// mixed address families
+		{
+			src: &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 45678},
+			dst: &net.TCPAddr{IP: net.ParseIP("::1"), Port: 5432},
+			out: "PROXY UNKNOWN\r\n",
+		},
+		{
+			src: &net.UnixAddr{Name: "/tmp/sock", Net: "unix"},
+			dst: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5432},
+			out: "PROXY UNKNOWN\r\n",
+		},
+	}
+
+	for i, tt := range tests {
+		out := string(proxyProtocolHeader(tt.src, tt.dst))
+		if out != tt.out {
+			t.Errorf("#%d: wrong header: got: %q, want: %q", i, out, tt.out)
+		}
+	}
+}
+
+// testProxyConn starts a proxy to a destination listener, sends some data
+// from a client and returns what the destination received.
+func testProxyConn(t *testing.T, proxyProtocol bool, data string) (string, net.Conn) {
+	destListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer destListener.Close()
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer listener.Close()
+
+	p, err := NewProxy(listener)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p.SetProxyProtocol(proxyProtocol)
+	go p.Start()
+	defer p.Stop()
+	p.C <- ConfData{DestAddr: destListener.Addr().(*net.TCPAddr)}
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, data); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	destConn, err := destListener.Accept()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer destConn.Close()
+	destConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	r := bufio.NewReader(destConn)
+	received := ""
+	if proxyProtocol {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		received += header
+	}
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	received += string(buf)
+	return received, conn
+}
+
+func TestProxyConnProxyProtocol(t *testing.T) {
+	data := "client data"
+
+	received, _ := testProxyConn(t, false, data)
+	if received != data {
+		t.Errorf("wrong data received: got: %q, want: %q", received, data)
+	}
+
+	received, conn := testProxyConn(t, true, data)
+	clientAddr := conn.LocalAddr().(*net.TCPAddr)
+	proxyAddr := conn.RemoteAddr().(*net.TCPAddr)
+	expected := fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n%s", clientAddr.IP, proxyAddr.IP, clientAddr.Port, proxyAddr.Port, data)
+	if received != expected {
+		t.Errorf("wrong data received: got: %q, want: %q", received, expected)
+	}
+}
+
+func TestProxyProtocolV2Header(t *testing.T) {
+	sig := "\r\n\r\n\x00\r\nQUIT\n"
+	tests := []struct {
+		src net.Addr
+		dst net.Addr
+		out string
+	}{
+		{
+			src: &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 45678},
+			dst: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5432},
+			out: sig + "\x21\x11\x00\x0c" + "\xc0\xa8\x01\x0a" + "\x0a\x00\x00\x01" + "\xb2\x6e\x15\x38",
+		},
+		{
+			src: &net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 45678},
+			dst: &net.TCPAddr{IP: net.ParseIP("::1"), Port: 5432},
+			out: sig + "\x21\x21\x00\x24" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x10" +
+				"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\xb2\x6e\x15\x38",
+		},
+		// mixed address families
+		{
+			src: &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 45678},
+			dst: &net.TCPAddr{IP: net.ParseIP("::1"), Port: 5432},
+			out: sig + "\x21\x00\x00\x00",
+		},
+	}
+
+	for i, tt := range tests {
+		out := string(proxyProtocolV2Header(tt.src, tt.dst))
+		if out != tt.out {
+			t.Errorf("#%d: wrong header: got: %q, want: %q", i, out, tt.out)
+		}
+	}
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	src4 := &net.TCPAddr{IP: net.ParseIP("192.168.1.10").To4(), Port: 45678}
+	dst4 := &net.TCPAddr{IP: net.ParseIP("10.0.0.1").To4(), Port: 5432}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 45678}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("::1"), Port: 5432}
+	sig := "\r\n\r\n\x00\r\nQUIT\n"
+
+	tests := []struct {
+		in  string
+		src net.Addr
+		dst net.Addr
+		err error
+	}{
+		{
+			in:  "PROXY TCP4 192.168.1.10 10.0.0.1 45678 5432\r\ndata",
+			src: &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 45678},
+			dst: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5432},
+		},
+		{
+			in:  "PROXY TCP6 2001:db8::10 ::1 45678 5432\r\ndata",
+			src: src6,
+			dst: dst6,
+		},
+		{
+			in: "PROXY UNKNOWN\r\ndata",
+		},
+		{
+			in:  string(proxyProtocolV2Header(src4, dst4)) + "data",
+			src: src4,
+			dst: dst4,
+		},
+		{
+			in:  string(proxyProtocolV2Header(src6, dst6)) + "data",
+			src: src6,
+			dst: dst6,
+		},
+		// v2 header with a TLV
+		{
+			in:  sig + "\x21\x11\x00\x10" + "\xc0\xa8\x01\x0a" + "\x0a\x00\x00\x01" + "\xb2\x6e\x15\x38" + "\x04\x00\x01\x00" + "data",
+			src: src4,
+			dst: dst4,
+		},
+		// v2 LOCAL command
+		{
+			in: sig + "\x20\x00\x00\x00" + "data",
+		},
+		{
+			in:  "PROXY TCP4 192.168.1.10 10.0.0.1 45678\r\ndata",
+			err: fmt.Errorf("wrong PROXY protocol header %q", "PROXY TCP4 192.168.1.10 10.0.0.1 45678\r\n"),
+		},
+		{
+			in:  "PROXY TCP4 2001:db8::10 10.0.0.1 45678 5432\r\ndata",
+			err: fmt.Errorf("wrong PROXY protocol header addresses %q", "PROXY TCP4 2001:db8::10 10.0.0.1 45678 5432\r\n"),
+		},
+		{
+			in:  "PROXY TCP4 192.168.1.10 10.0.0.1 45678 5432\ndata",
+			err: fmt.Errorf("PROXY protocol header doesn't end with CRLF"),
+		},
+		{
+			in:  sig + "\x22\x11\x00\x00" + "data",
+			err: fmt.Errorf("wrong PROXY protocol version or command: 0x22"),
+		},
+		{
+			in:  "client data without header",
+			err: fmt.Errorf("missing PROXY protocol header"),
+		},
+	}
+
+	for i, tt := range tests {
+		r := bufio.NewReader(strings.NewReader(tt.in))
+		src, dst, err := readProxyProtocolHeader(r)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if fmt.Sprint(src) != fmt.Sprint(tt.src) || fmt.Sprint(dst) != fmt.Sprint(tt.dst) {
+			t.Errorf("#%d: wrong addresses: got: %v %v, want: %v %v", i, src, dst, tt.src, tt.dst)
+		}
+		// the client data after the header must be kept
+		rest, _ := ioutil.ReadAll(r)
+		if string(rest) != "data" {
+			t.Errorf("#%d: wrong remaining data: got: %q, want: %q", i, rest, "data")
+		}
+	}
+}
+
+func TestProxyConnAcceptProxyProtocol(t *testing.T) {
+	destListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer destListener.Close()
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer listener.Close()
+
+	p, err := NewProxy(listener)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p.SetAcceptProxyProtocol(true)
+	p.SetProxyProtocol(true)
+	p.SetProxyProtocolVersion(2)
+	go p.Start()
+	defer p.Stop()
+	p.C <- ConfData{DestAddr: destListener.Addr().(*net.TCPAddr)}
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	data := "client data"
+	if _, err := io.WriteString(conn, "PROXY TCP4 192.168.1.10 10.0.0.1 45678 5432\r\n"+data); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	destConn, err := destListener.Accept()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer destConn.Close()
+	destConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// the upstream client address must be sent to the destination
+	expected := string(proxyProtocolV2Header(&net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 45678}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5432})) + data
+	buf := make([]byte, len(expected))
+	if _, err := io.ReadFull(destConn, buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(buf) != expected {
+		t.Errorf("wrong data received: got: %q, want: %q", buf, expected)
+	}
+}
+
+func TestWarmupConnLimit(t *testing.T) {
+	tests := []struct {
+		elapsed  time.Duration
+		interval time.Duration
+		maxConns int
+		limit    int
+	}{
+		// warm up disabled
+		{elapsed: 0, interval: 0, maxConns: 100, limit: 0},
+		{elapsed: 0, interval: time.Minute, maxConns: 0, limit: 0},
+		{elapsed: 0, interval: time.Minute, maxConns: 100, limit: 1},
+		{elapsed: -time.Second, interval: time.Minute, maxConns: 100, limit: 1},
+		{elapsed: 30 * time.Second, interval: time.Minute, maxConns: 101, limit: 51},
+		{elapsed: 59 * time.Second, interval: time.Minute, maxConns: 61, limit: 60},
+		// warm up finished
+		{elapsed: time.Minute, interval: time.Minute, maxConns: 100, limit: 0},
+		{elapsed: time.Hour, interval: time.Minute, maxConns: 100, limit: 0},
+	}
+
+	for i, tt := range tests {
+		limit := warmupConnLimit(tt.elapsed, tt.interval, tt.maxConns)
+		if limit != tt.limit {
+			t.Errorf("#%d: wrong limit: got: %d, want: %d", i, limit, tt.limit)
+		}
+	}
+}
+
+// testDest is a destination that writes its reply ("ok" by default) to every
+// accepted connection
+type testDest struct {
+	listener net.Listener
+
+	// the accepted connections are kept referenced or they'll be closed
+	// when garbage collected
+	connsMutex sync.Mutex
+	conns      []net.Conn
+}
+
+func newTestDest(t *testing.T) *testDest {
+	return newTestDestReply(t, "ok")
+}
+
+func newTestDestReply(t *testing.T, reply string) *testDest {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	d := &testDest{listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			d.connsMutex.Lock()
+			d.conns = append(d.conns, conn)
+			d.connsMutex.Unlock()
+			io.WriteString(conn, reply)
+		}
+	}()
+	return d
+}
+
+func (d *testDest) addr() *net.TCPAddr {
+	return d.listener.Addr().(*net.TCPAddr)
+}
+
+// testConnectReply opens a new connection through the proxy and returns the
+// connection and the two bytes reply of the destination (empty if the
+// connection wasn't proxied). The connection is kept open to count as an
+// active connection.
+func testConnectReply(t *testing.T, proxyAddr string) (net.Conn, string) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		if err == io.EOF {
+			return conn, ""
+		}
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return conn, string(buf)
+}
+
+// testConnect opens a new connection through the proxy and reports if it was
+// proxied to the destination.
+func testConnect(t *testing.T, proxyAddr string) bool {
+	_, reply := testConnectReply(t, proxyAddr)
+	return reply == "ok"
+}
+
+func TestProxyWarmup(t *testing.T) {
+	destA := newTestDest(t)
+	defer destA.listener.Close()
+	destB := newTestDest(t)
+	defer destB.listener.Close()
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer listener.Close()
+	proxyAddr := listener.Addr().String()
+
+	var nowMutex sync.Mutex
+	now := time.Now()
+	setNow := func(n time.Time) {
+		nowMutex.Lock()
+		now = n
+		nowMutex.Unlock()
+	}
+
+	p, err := NewProxy(listener)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p.nowFn = func() time.Time {
+		nowMutex.Lock()
+		defer nowMutex.Unlock()
+		return now
+	}
+	p.SetWarmup(time.Hour, 11)
+	go p.Start()
+	defer p.Stop()
+
+	// sending the same conf data twice ensures that the first one has been
+	// applied
+	setDest := func(addr *net.TCPAddr) {
+		p.C <- ConfData{DestAddr: addr}
+		p.C <- ConfData{DestAddr: addr}
+	}
+
+	// no warm up when starting proxying to the first destination
+	setDest(destA.addr())
+	for i := 0; i < 20; i++ {
+		if !testConnect(t, proxyAddr) {
+			t.Fatalf("connection %d not proxied", i)
+		}
+	}
+
+	// new master: connections to the previous one are closed and the warm
+	// up starts
+	start := now
+	setDest(nil)
+	setDest(destB.addr())
+
+	if !testConnect(t, proxyAddr) {
+		t.Fatalf("first connection after promotion not proxied")
+	}
+	if testConnect(t, proxyAddr) {
+		t.Fatalf("expected connection refused at warm up start")
+	}
+
+	// at half of the warm up up to 6 concurrent connections are accepted
+	setNow(start.Add(30 * time.Minute))
+	for i := 1; i < 6; i++ {
+		if !testConnect(t, proxyAddr) {
+			t.Fatalf("connection %d not proxied", i)
+		}
+	}
+	if testConnect(t, proxyAddr) {
+		t.Fatalf("expected connection refused after reaching the warm up limit")
+	}
+
+	// warm up finished
+	setNow(start.Add(time.Hour))
+	for i := 6; i < 20; i++ {
+		if !testConnect(t, proxyAddr) {
+			t.Fatalf("connection %d not proxied after warm up", i)
+		}
+	}
+}
+
+func TestProxyBalance(t *testing.T) {
+	destA := newTestDestReply(t, "aa")
+	defer destA.listener.Close()
+	destB := newTestDestReply(t, "bb")
+	defer destB.listener.Close()
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer listener.Close()
+	proxyAddr := listener.Addr().String()
+
+	p, err := NewProxy(listener)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	go p.Start()
+	defer p.Stop()
+
+	// sending the same conf data twice ensures that the first one has been
+	// applied
+	setDests := func(addrs ...*net.TCPAddr) {
+		p.C <- ConfData{DestAddrs: addrs}
+		p.C <- ConfData{DestAddrs: addrs}
+	}
+
+	// connections are balanced to the destination with fewer active
+	// connections
+	setDests(destA.addr(), destB.addr())
+	aConns := []net.Conn{}
+	replies := map[string]int{}
+	for i := 0; i < 4; i++ {
+		conn, reply := testConnectReply(t, proxyAddr)
+		if reply == "aa" {
+			aConns = append(aConns, conn)
+		}
+		replies[reply]++
+	}
+	if replies["aa"] != 2 || replies["bb"] != 2 {
+		t.Fatalf("wrong connections balancing: %v", replies)
+	}
+
+	// closing some connections to destA, the next ones will be balanced to it
+	aConns[0].Close()
+	aConns = aConns[1:]
+	// wait for the proxy to release the closed connection
+	time.Sleep(100 * time.Millisecond)
+	conn, reply := testConnectReply(t, proxyAddr)
+	if reply != "aa" {
+		t.Fatalf("expected connection balanced to destA, got reply %q", reply)
+	}
+	aConns = append(aConns, conn)
+
+	// removing destA keeps the connections to it
+	setDests(destB.addr())
+	for i := 0; i < 3; i++ {
+		if _, reply := testConnectReply(t, proxyAddr); reply != "bb" {
+			t.Fatalf("expected connection balanced to destB, got reply %q", reply)
+		}
+	}
+	for _, conn := range aConns {
+		if _, err := conn.Write([]byte("data")); err != nil {
+			t.Fatalf("expected connection to destA still open: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := conn.Read(make([]byte, 1)); err == io.EOF {
+			t.Fatalf("expected connection to destA still open")
+		}
+	}
+
+	chosenConns := p.ChosenConns()
+	expectedChosenConns := map[string]uint64{destA.addr().String(): 3, destB.addr().String(): 5}
+	if !reflect.DeepEqual(chosenConns, expectedChosenConns) {
+		t.Fatalf("wrong chosen connections: got: %v, want: %v", chosenConns, expectedChosenConns)
+	}
+
+	// no destinations: all the connections are closed
+	p.C <- ConfData{}
+	p.C <- ConfData{}
+	for _, conn := range aConns {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("expected connection to destA closed, got error: %v", err)
+		}
+	}
+}
+
+func TestProxyConnStats(t *testing.T) {
+	destA := newTestDest(t)
+	defer destA.listener.Close()
+	destB := newTestDest(t)
+	defer destB.listener.Close()
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer listener.Close()
+	proxyAddr := listener.Addr().String()
+
+	p, err := NewProxy(listener)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	stats := NewConnStats()
+	p.SetConnStats(stats)
+	go p.Start()
+	defer p.Stop()
+
+	// sending the same conf data twice ensures that the first one has been
+	// applied
+	setDest := func(addr *net.TCPAddr) {
+		p.C <- ConfData{DestAddr: addr}
+		p.C <- ConfData{DestAddr: addr}
+	}
+
+	// the stats are updated by the connections goroutines, wait for them
+	checkStats := func(expected ConnStatsSnapshot) {
+		var s ConnStatsSnapshot
+		for i := 0; i < 50; i++ {
+			s = stats.Snapshot()
+			if reflect.DeepEqual(s, expected) {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("wrong stats: got: %+v, want: %+v", s, expected)
+	}
+
+	// no destination: the connection is accepted and closed
+	if testConnect(t, proxyAddr) {
+		t.Fatalf("expected connection not proxied")
+	}
+	checkStats(ConnStatsSnapshot{Accepted: 1, Closed: 1, Active: map[string]int{}})
+
+	setDest(destA.addr())
+	conns := []net.Conn{}
+	for i := 0; i < 3; i++ {
+		conn, reply := testConnectReply(t, proxyAddr)
+		if reply != "ok" {
+			t.Fatalf("connection %d not proxied", i)
+		}
+		conns = append(conns, conn)
+	}
+	checkStats(ConnStatsSnapshot{Accepted: 4, Closed: 1, Active: map[string]int{destA.addr().String(): 3}})
+
+	// connection closed by the client
+	conns[0].Close()
+	checkStats(ConnStatsSnapshot{Accepted: 4, Closed: 2, Active: map[string]int{destA.addr().String(): 2}})
+
+	// new master: the connections to the previous one are closed
+	setDest(destB.addr())
+	if !testConnect(t, proxyAddr) {
+		t.Fatalf("connection not proxied")
+	}
+	checkStats(ConnStatsSnapshot{Accepted: 5, Closed: 4, Teardowns: 1, Active: map[string]int{destB.addr().String(): 1}})
+}
+
+func TestProxyDrain(t *testing.T) {
+	// the destination keeps the accepted connections referenced or they'll
+	// be closed when garbage collected
+	destListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer destListener.Close()
+	destConnsCh := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := destListener.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, "ok")
+			destConnsCh <- conn
+		}
+	}()
+	destAddr := destListener.Addr().(*net.TCPAddr)
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer listener.Close()
+	proxyAddr := listener.Addr().String()
+
+	p, err := NewProxy(listener)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	go p.Start()
+	defer p.Stop()
+
+	// setDestAsync updates the destination and returns a channel closed
+	// when the update (and the drain) has finished
+	setDestAsync := func(addr *net.TCPAddr) chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			p.C <- ConfData{DestAddr: addr}
+			p.C <- ConfData{DestAddr: addr}
+			close(done)
+		}()
+		return done
+	}
+	waitDone := func(done chan struct{}, timeout time.Duration) bool {
+		select {
+		case <-done:
+			return true
+		case <-time.After(timeout):
+			return false
+		}
+	}
+	// waitNoDest waits for the proxy to stop proxying new connections
+	waitNoDest := func() {
+		for i := 0; i < 50; i++ {
+			p.connMutex.Lock()
+			destAddr := p.destAddr
+			p.connMutex.Unlock()
+			if destAddr == nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("proxy still proxying new connections")
+	}
+	connOpen := func(conn net.Conn) bool {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err := conn.Read(make([]byte, 1))
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			return true
+		}
+		return false
+	}
+
+	// the drain ends when the clients close their connections
+	p.SetDrainTimeout(time.Hour)
+	waitDone(setDestAsync(destAddr), 5*time.Second)
+	conn, reply := testConnectReply(t, proxyAddr)
+	if reply != "ok" {
+		t.Fatalf("connection not proxied")
+	}
+	done := setDestAsync(nil)
+	waitNoDest()
+	if testConnect(t, proxyAddr) {
+		t.Fatalf("expected new connection not proxied while draining")
+	}
+	if !connOpen(conn) {
+		t.Fatalf("expected connection kept open while draining")
+	}
+	if waitDone(done, 200*time.Millisecond) {
+		t.Fatalf("expected drain in progress")
+	}
+	conn.Close()
+	if !waitDone(done, 5*time.Second) {
+		t.Fatalf("expected drain finished after the connection has been closed")
+	}
+
+	// the remaining connections are closed at the drain timeout
+	p.SetDrainTimeout(200 * time.Millisecond)
+	waitDone(setDestAsync(destAddr), 5*time.Second)
+	conn, reply = testConnectReply(t, proxyAddr)
+	if reply != "ok" {
+		t.Fatalf("connection not proxied")
+	}
+	defer conn.Close()
+	if !waitDone(setDestAsync(nil), 5*time.Second) {
+		t.Fatalf("expected drain finished at the drain timeout")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected connection closed at the drain timeout")
+	}
+}
+
+func TestPgErrorResponse(t *testing.T) {
+	out := pgErrorResponse("53300", "too many connections")
+	expected := "E\x00\x00\x00\x30SFATAL\x00VFATAL\x00C53300\x00Mtoo many connections\x00\x00"
+	if string(out) != expected {
+		t.Errorf("wrong error response: got: %q, want: %q", out, expected)
+	}
+}
+
+func TestProxyConnLimits(t *testing.T) {
+	dest := newTestDest(t)
+	defer dest.listener.Close()
+
+	tests := []struct {
+		maxConns       int
+		maxSourceConns int
+		// the proxied connections before the limit is reached
+		proxied int
+		stats   ConnStatsSnapshot
+	}{
+		{
+			maxConns: 2,
+			proxied:  2,
+			stats:    ConnStatsSnapshot{RefusedMaxConns: 1},
+		},
+		{
+			maxConns:       3,
+			maxSourceConns: 1,
+			proxied:        1,
+			stats:          ConnStatsSnapshot{RefusedMaxSourceConns: 1},
+		},
+	}
+
+	for i, tt := range tests {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		proxyAddr := listener.Addr().String()
+
+		p, err := NewProxy(listener)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		p.SetConnLimits(tt.maxConns, tt.maxSourceConns)
+		go p.Start()
+		p.C <- ConfData{DestAddr: dest.addr()}
+
+		conns := []net.Conn{}
+		for j := 0; j < tt.proxied; j++ {
+			conn, reply := testConnectReply(t, proxyAddr)
+			if reply != "ok" {
+				t.Fatalf("#%d: connection %d not proxied", i, j)
+			}
+			conns = append(conns, conn)
+		}
+
+		// the exceeding connection receives a postgres error
+		conn, err := net.Dial("tcp", proxyAddr)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reply, err := ioutil.ReadAll(conn)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(reply) == 0 || reply[0] != 'E' || !strings.Contains(string(reply), "C53300") {
+			t.Errorf("#%d: expected too many connections error, got: %q", i, reply)
+		}
+		conn.Close()
+		snapshot := p.ConnStats().Snapshot()
+		if snapshot.RefusedMaxConns != tt.stats.RefusedMaxConns || snapshot.RefusedMaxSourceConns != tt.stats.RefusedMaxSourceConns {
+			t.Errorf("#%d: wrong refused connections stats: got: %+v, want: %+v", i, snapshot, tt.stats)
+		}
+
+		// closing a connection frees a slot
+		conns[0].Close()
+		proxied := false
+		for j := 0; j < 50 && !proxied; j++ {
+			time.Sleep(10 * time.Millisecond)
+			c, reply := testConnectReply(t, proxyAddr)
+			if reply == "ok" {
+				proxied = true
+				conns = append(conns, c)
+			} else {
+				c.Close()
+			}
+		}
+		if !proxied {
+			t.Errorf("#%d: expected connection proxied after closing a connection", i)
+		}
+
+		for _, c := range conns {
+			c.Close()
+		}
+		p.Stop()
+		listener.Close()
+	}
+}
+
+func TestProxyIdleTimeout(t *testing.T) {
+	dest := newTestDest(t)
+	defer dest.listener.Close()
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer listener.Close()
+	proxyAddr := listener.Addr().String()
+
+	p, err := NewProxy(listener)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p.SetKeepAlive(true)
+	p.SetUserTimeout(10 * time.Second)
+	p.SetDestKeepAlive(10*time.Second, 3, 5*time.Second)
+	p.SetDestUserTimeout(10 * time.Second)
+	p.SetIdleTimeout(500 * time.Millisecond)
+	go p.Start()
+	defer p.Stop()
+
+	p.C <- ConfData{DestAddr: dest.addr()}
+	p.C <- ConfData{DestAddr: dest.addr()}
+
+	idleConn, reply := testConnectReply(t, proxyAddr)
+	if reply != "ok" {
+		t.Fatalf("connection not proxied")
+	}
+	activeConn, reply := testConnectReply(t, proxyAddr)
+	if reply != "ok" {
+		t.Fatalf("connection not proxied")
+	}
+
+	// the active connection sends data more often than the idle timeout
+	for i := 0; i < 10; i++ {
+		if _, err := activeConn.Write([]byte("a")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	idleConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := idleConn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected idle connection closed, got error: %v", err)
+	}
+	activeConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := activeConn.Read(make([]byte, 1)); err == io.EOF {
+		t.Fatalf("expected active connection not closed")
+	}
+	if n := p.ConnStats().Snapshot().IdleTimeouts; n != 1 {
+		t.Fatalf("got %d idle timeouts, want: 1", n)
+	}
+}
+
+func TestProxyUnixSocket(t *testing.T) {
+	dest := newTestDest(t)
+	defer dest.listener.Close()
+
+	dir, err := ioutil.TempDir("", "stolon-proxy")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, ".s.PGSQL.5432")
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer listener.Close()
+
+	p, err := NewProxy(listener)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the tcp options are ignored for the unix socket connections
+	p.SetKeepAlive(true)
+	p.SetUserTimeout(10 * time.Second)
+	p.SetProxyProtocol(true)
+	go p.Start()
+	defer p.Stop()
+
+	p.C <- ConfData{DestAddr: dest.addr()}
+	p.C <- ConfData{DestAddr: dest.addr()}
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(buf) != "ok" {
+		t.Fatalf("got reply %q, want: %q", buf, "ok")
+	}
+
+	// the unix socket client has no address to send in the PROXY protocol
+	// header
+	var destConn net.Conn
+	for i := 0; i < 50 && destConn == nil; i++ {
+		dest.connsMutex.Lock()
+		if len(dest.conns) > 0 {
+			destConn = dest.conns[0]
+		}
+		dest.connsMutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if destConn == nil {
+		t.Fatalf("no destination connection")
+	}
+	destConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header, err := bufio.NewReader(destConn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if header != "PROXY UNKNOWN\r\n" {
+		t.Fatalf("got header %q, want: %q", header, "PROXY UNKNOWN\r\n")
+	}
+	if n := p.ConnStats().Snapshot().Accepted; n != 1 {
+		t.Fatalf("got %d accepted connections, want: 1", n)
+	}
+}
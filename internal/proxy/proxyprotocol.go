@@ -0,0 +1,204 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// proxyProtocolHeader returns a PROXY protocol version 1 header
+// (http://www.haproxy.org/download/1.8/doc/proxy-protocol.txt) for a
+// connection from the src address to the dst address.
+// When the addresses aren't tcp addresses of the same family the "UNKNOWN"
+// protocol is used.
+func proxyProtocolHeader(src, dst net.Addr) []byte {
+	srcAddr, srcOk := src.(*net.TCPAddr)
+	dstAddr, dstOk := dst.(*net.TCPAddr)
+	if !srcOk || !dstOk {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	srcIP4 := srcAddr.IP.To4()
+	dstIP4 := dstAddr.IP.To4()
+	switch {
+	case srcIP4 != nil && dstIP4 != nil:
+		return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcIP4, dstIP4, srcAddr.Port, dstAddr.Port))
+	case srcIP4 == nil && dstIP4 == nil && srcAddr.IP.To16() != nil && dstAddr.IP.To16() != nil:
+		return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", srcAddr.IP, dstAddr.IP, srcAddr.Port, dstAddr.Port))
+	default:
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+}
+
+// proxyProtocolV2Signature is the signature starting a PROXY protocol version
+// 2 header
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// max length of a PROXY protocol version 1 header, including the
+	// ending CRLF
+	proxyProtocolV1MaxLen = 107
+
+	proxyProtocolV2CmdLocal = 0x20
+	proxyProtocolV2CmdProxy = 0x21
+
+	proxyProtocolV2FamUnspec = 0x00
+	proxyProtocolV2FamTCP4   = 0x11
+	proxyProtocolV2FamTCP6   = 0x21
+)
+
+// proxyProtocolV2Header returns a PROXY protocol version 2 (binary) header for
+// a connection from the src address to the dst address.
+// When the addresses aren't tcp addresses of the same family the UNSPEC
+// address family is used.
+func proxyProtocolV2Header(src, dst net.Addr) []byte {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, proxyProtocolV2CmdProxy)
+
+	fam := byte(proxyProtocolV2FamUnspec)
+	var srcIP, dstIP net.IP
+	var srcPort, dstPort int
+	srcAddr, srcOk := src.(*net.TCPAddr)
+	dstAddr, dstOk := dst.(*net.TCPAddr)
+	if srcOk && dstOk {
+		srcPort, dstPort = srcAddr.Port, dstAddr.Port
+		switch {
+		case srcAddr.IP.To4() != nil && dstAddr.IP.To4() != nil:
+			fam = proxyProtocolV2FamTCP4
+			srcIP, dstIP = srcAddr.IP.To4(), dstAddr.IP.To4()
+		case srcAddr.IP.To4() == nil && dstAddr.IP.To4() == nil && srcAddr.IP.To16() != nil && dstAddr.IP.To16() != nil:
+			fam = proxyProtocolV2FamTCP6
+			srcIP, dstIP = srcAddr.IP.To16(), dstAddr.IP.To16()
+		}
+	}
+	header = append(header, fam)
+
+	if fam == proxyProtocolV2FamUnspec {
+		return append(header, 0, 0)
+	}
+	addrs := make([]byte, 0, 2*len(srcIP)+4)
+	addrs = append(addrs, srcIP...)
+	addrs = append(addrs, dstIP...)
+	addrs = append(addrs, byte(srcPort>>8), byte(srcPort), byte(dstPort>>8), byte(dstPort))
+	header = append(header, byte(len(addrs)>>8), byte(len(addrs)))
+	return append(header, addrs...)
+}
+
+// readProxyProtocolHeader reads a PROXY protocol version 1 or version 2
+// header from r and returns the source and destination addresses it
+// contains. The returned addresses are nil when the header doesn't provide
+// them (the v1 "UNKNOWN" protocol, the v2 LOCAL command or the v2 UNSPEC or
+// unix address families).
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	sig, err := r.Peek(len(proxyProtocolV2Signature))
+	if err == nil && bytes.Equal(sig, proxyProtocolV2Signature) {
+		return readProxyProtocolV2Header(r)
+	}
+	if p, perr := r.Peek(6); perr == nil && string(p) == "PROXY " {
+		return readProxyProtocolV1Header(r)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read PROXY protocol header: %v", err)
+	}
+	return nil, nil, fmt.Errorf("missing PROXY protocol header")
+}
+
+func readProxyProtocolV1Header(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	line := []byte{}
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read PROXY protocol header: %v", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyProtocolV1MaxLen {
+			return nil, nil, fmt.Errorf("PROXY protocol header too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("PROXY protocol header doesn't end with CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("wrong PROXY protocol header %q", line)
+	}
+	srcIP := net.ParseIP(fields[2])
+	dstIP := net.ParseIP(fields[3])
+	if srcIP == nil || dstIP == nil || (fields[1] == "TCP4") != (srcIP.To4() != nil) || (fields[1] == "TCP4") != (dstIP.To4() != nil) {
+		return nil, nil, fmt.Errorf("wrong PROXY protocol header addresses %q", line)
+	}
+	srcPort, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, nil, fmt.Errorf("wrong PROXY protocol header source port %q", fields[4])
+	}
+	dstPort, err := strconv.ParseUint(fields[5], 10, 16)
+	if err != nil {
+		return nil, nil, fmt.Errorf("wrong PROXY protocol header destination port %q", fields[5])
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+func readProxyProtocolV2Header(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, fmt.Errorf("failed to read PROXY protocol header: %v", err)
+	}
+	cmd := header[12]
+	fam := header[13]
+	l := int(binary.BigEndian.Uint16(header[14:]))
+	// the addresses and the optional TLVs
+	data := make([]byte, l)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, nil, fmt.Errorf("failed to read PROXY protocol header: %v", err)
+	}
+	switch cmd {
+	case proxyProtocolV2CmdLocal:
+		return nil, nil, nil
+	case proxyProtocolV2CmdProxy:
+	default:
+		return nil, nil, fmt.Errorf("wrong PROXY protocol version or command: %#x", cmd)
+	}
+	var ipLen int
+	switch fam {
+	case proxyProtocolV2FamTCP4:
+		ipLen = net.IPv4len
+	case proxyProtocolV2FamTCP6:
+		ipLen = net.IPv6len
+	default:
+		// unspecified, udp or unix addresses
+		return nil, nil, nil
+	}
+	if l < 2*ipLen+4 {
+		return nil, nil, fmt.Errorf("PROXY protocol header addresses too short")
+	}
+	srcIP := net.IP(data[:ipLen])
+	dstIP := net.IP(data[ipLen : 2*ipLen])
+	srcPort := binary.BigEndian.Uint16(data[2*ipLen:])
+	dstPort := binary.BigEndian.Uint16(data[2*ipLen+2:])
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const scramSHA256Mechanism = "SCRAM-SHA-256"
+
+// scramClient implements the client side of the SCRAM-SHA-256
+// authentication (RFC 7677) without channel binding, used to authenticate
+// the pooled server connections. The password isn't normalized with SASLprep
+// so it must be ASCII.
+type scramClient struct {
+	user     string
+	password string
+	nonce    string
+
+	clientFirstBare string
+	serverSignature []byte
+}
+
+// newScramClient returns a scram client. The user is empty for postgres
+// since it uses the startup message one.
+func newScramClient(user, password string) (*scramClient, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return &scramClient{user: user, password: password, nonce: base64.StdEncoding.EncodeToString(b)}, nil
+}
+
+// clientFirst returns the client-first-message
+func (c *scramClient) clientFirst() []byte {
+	c.clientFirstBare = "n=" + c.user + ",r=" + c.nonce
+	return []byte("n,," + c.clientFirstBare)
+}
+
+// clientFinal returns the client-final-message for the provided
+// server-first-message
+func (c *scramClient) clientFinal(serverFirst []byte) ([]byte, error) {
+	var nonce, salt string
+	iterations := 0
+	for _, attr := range strings.Split(string(serverFirst), ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			return nil, fmt.Errorf("malformed scram server first message")
+		}
+		switch attr[0] {
+		case 'r':
+			nonce = attr[2:]
+		case 's':
+			salt = attr[2:]
+		case 'i':
+			var err error
+			if iterations, err = strconv.Atoi(attr[2:]); err != nil {
+				return nil, fmt.Errorf("malformed scram iteration count: %v", err)
+			}
+		}
+	}
+	if !strings.HasPrefix(nonce, c.nonce) || len(nonce) == len(c.nonce) {
+		return nil, fmt.Errorf("invalid scram server nonce")
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		return nil, fmt.Errorf("malformed scram salt: %v", err)
+	}
+	if iterations < 1 {
+		return nil, fmt.Errorf("invalid scram iteration count %d", iterations)
+	}
+
+	saltedPassword := scramSaltedPassword(c.password, saltBytes, iterations)
+	clientKey := scramHMAC(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	serverKey := scramHMAC(saltedPassword, "Server Key")
+
+	// "biws" is the base64 encoded gs2 header "n,,"
+	clientFinalWithoutProof := "c=biws,r=" + nonce
+	authMessage := c.clientFirstBare + "," + string(serverFirst) + "," + clientFinalWithoutProof
+	clientSignature := scramHMAC(storedKey[:], authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	c.serverSignature = scramHMAC(serverKey, authMessage)
+
+	return []byte(clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verifyServerFinal verifies the server signature in the
+// server-final-message
+func (c *scramClient) verifyServerFinal(serverFinal []byte) error {
+	s := string(serverFinal)
+	if strings.HasPrefix(s, "e=") {
+		return fmt.Errorf("scram authentication failed: %s", s[2:])
+	}
+	if !strings.HasPrefix(s, "v=") {
+		return fmt.Errorf("malformed scram server final message")
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.SplitN(s[2:], ",", 2)[0])
+	if err != nil {
+		return fmt.Errorf("malformed scram server signature: %v", err)
+	}
+	if !hmac.Equal(signature, c.serverSignature) {
+		return fmt.Errorf("invalid scram server signature")
+	}
+	return nil
+}
+
+func scramHMAC(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// scramSaltedPassword is the PBKDF2 (with HMAC-SHA-256) of the password
+func scramSaltedPassword(password string, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := make([]byte, len(u))
+	copy(result, u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
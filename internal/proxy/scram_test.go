@@ -0,0 +1,47 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import "testing"
+
+func TestScramClient(t *testing.T) {
+	// RFC 7677 test vector
+	c := &scramClient{user: "user", password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+	if out := string(c.clientFirst()); out != "n,,n=user,r=rOprNGfwEbeRWgbNEkqO" {
+		t.Fatalf("wrong client first message: %q", out)
+	}
+	out, err := c.clientFinal([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	if string(out) != expected {
+		t.Fatalf("wrong client final message: got: %q, want: %q", out, expected)
+	}
+	if err := c.verifyServerFinal([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := c.verifyServerFinal([]byte("v=AAAATRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")); err == nil {
+		t.Errorf("got no error for a wrong server signature")
+	}
+	if err := c.verifyServerFinal([]byte("e=invalid-proof")); err == nil {
+		t.Errorf("got no error for a server error")
+	}
+
+	// the server nonce must start with the client one
+	if _, err := c.clientFinal([]byte("r=otherNonce,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")); err == nil {
+		t.Errorf("got no error for a wrong server nonce")
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"sync"
+)
+
+// ConnStats collects the statistics of the connections handled by a proxy.
+// It can be shared by multiple proxy instances (i.e. when the proxy is
+// stopped and restarted) so the statistics aren't lost and the connections
+// still handled by a stopped proxy are accounted.
+type ConnStats struct {
+	mutex sync.Mutex
+
+	accepted  uint64
+	closed    uint64
+	teardowns uint64
+	// connections closed since idle for the idle timeout
+	idleTimeouts uint64
+	// connections refused for the connections limits
+	refusedMaxConns       uint64
+	refusedMaxSourceConns uint64
+	// mirrored connections and mirror connections failures
+	mirrors        uint64
+	mirrorFailures uint64
+	// active proxied connections per destination
+	active map[string]int
+}
+
+// ConnStatsSnapshot is a point in time copy of the ConnStats
+type ConnStatsSnapshot struct {
+	// Accepted is the number of accepted client connections
+	Accepted uint64
+	// Closed is the number of closed client connections
+	Closed uint64
+	// Teardowns is the number of times all the connections to a
+	// destination have been closed since the destination changed (i.e. a
+	// new master has been elected or there's no master)
+	Teardowns uint64
+	// IdleTimeouts is the number of proxied connections closed since no
+	// data has been exchanged for the idle timeout
+	IdleTimeouts uint64
+	// RefusedMaxConns is the number of client connections refused since
+	// the max connections limit was reached
+	RefusedMaxConns uint64
+	// RefusedMaxSourceConns is the number of client connections refused
+	// since the max connections per source limit was reached
+	RefusedMaxSourceConns uint64
+	// Mirrors is the number of client connections mirrored to the mirror
+	// destination
+	Mirrors uint64
+	// MirrorFailures is the number of mirror connections that couldn't be
+	// opened or have been closed since their buffer was full
+	MirrorFailures uint64
+	// Active are the proxied connections, for every destination, currently
+	// established
+	Active map[string]int
+}
+
+func NewConnStats() *ConnStats {
+	return &ConnStats{active: make(map[string]int)}
+}
+
+func (s *ConnStats) connAccepted() {
+	s.mutex.Lock()
+	s.accepted++
+	s.mutex.Unlock()
+}
+
+func (s *ConnStats) connClosed() {
+	s.mutex.Lock()
+	s.closed++
+	s.mutex.Unlock()
+}
+
+func (s *ConnStats) teardown() {
+	s.mutex.Lock()
+	s.teardowns++
+	s.mutex.Unlock()
+}
+
+func (s *ConnStats) idleTimeout() {
+	s.mutex.Lock()
+	s.idleTimeouts++
+	s.mutex.Unlock()
+}
+
+func (s *ConnStats) connRefused(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch err {
+	case errMaxConns:
+		s.refusedMaxConns++
+	case errMaxSourceConns:
+		s.refusedMaxSourceConns++
+	}
+}
+
+func (s *ConnStats) mirrored() {
+	s.mutex.Lock()
+	s.mirrors++
+	s.mutex.Unlock()
+}
+
+func (s *ConnStats) mirrorFailed() {
+	s.mutex.Lock()
+	s.mirrorFailures++
+	s.mutex.Unlock()
+}
+
+func (s *ConnStats) addActive(dest string, delta int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.active[dest] += delta
+	if s.active[dest] <= 0 {
+		delete(s.active, dest)
+	}
+}
+
+// Snapshot returns a copy of the current statistics
+func (s *ConnStats) Snapshot() ConnStatsSnapshot {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	active := make(map[string]int, len(s.active))
+	for dest, n := range s.active {
+		active[dest] = n
+	}
+	return ConnStatsSnapshot{
+		Accepted:     s.accepted,
+		Closed:       s.closed,
+		Teardowns:    s.teardowns,
+		IdleTimeouts: s.idleTimeouts,
+		Active:       active,
+
+		RefusedMaxConns:       s.refusedMaxConns,
+		RefusedMaxSourceConns: s.refusedMaxSourceConns,
+
+		Mirrors:        s.mirrors,
+		MirrorFailures: s.mirrorFailures,
+	}
+}
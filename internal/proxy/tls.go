@@ -0,0 +1,125 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// postgres protocol request codes sent by the clients, instead of the
+// protocol version, to negotiate the connection encryption
+const (
+	pgSSLRequestCode    = 80877103
+	pgGSSENCRequestCode = 80877104
+)
+
+// readerConn is a net.Conn reading from the provided reader, used to not lose
+// the client data already buffered while reading the connection start
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// pgEncryptionRequest returns the negotiation request code if the postgres
+// protocol packet header is an SSLRequest or a GSSENCRequest, otherwise 0
+func pgEncryptionRequest(header []byte) uint32 {
+	if binary.BigEndian.Uint32(header[:4]) != 8 {
+		return 0
+	}
+	code := binary.BigEndian.Uint32(header[4:8])
+	if code == pgSSLRequestCode || code == pgGSSENCRequestCode {
+		return code
+	}
+	return 0
+}
+
+// clientNegotiateTLS handles the postgres connection encryption negotiation
+// with a client. When config is not nil the TLS connection requested by the
+// client is terminated and the returned stream is the decrypted one, clients
+// not requesting TLS are refused. When config is nil the encryption requests
+// are denied and the client continues with an unencrypted connection.
+// The returned stream starts with the client startup message.
+func clientNegotiateTLS(conn net.Conn, r io.Reader, config *tls.Config) (io.ReadWriter, error) {
+	for {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, fmt.Errorf("failed to read startup packet: %v", err)
+		}
+		switch pgEncryptionRequest(header) {
+		case pgSSLRequestCode:
+			if config == nil {
+				if _, err := conn.Write([]byte{'N'}); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if _, err := conn.Write([]byte{'S'}); err != nil {
+				return nil, err
+			}
+			tlsConn := tls.Server(&readerConn{Conn: conn, r: r}, config)
+			if err := tlsConn.Handshake(); err != nil {
+				return nil, fmt.Errorf("tls handshake failed: %v", err)
+			}
+			return tlsConn, nil
+		case pgGSSENCRequestCode:
+			// GSSAPI encryption isn't supported, the client can
+			// continue with an SSLRequest or a startup message
+			if _, err := conn.Write([]byte{'N'}); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if config != nil {
+			return nil, fmt.Errorf("client didn't request a tls connection")
+		}
+		// keep the already read startup packet header
+		return struct {
+			io.Reader
+			io.Writer
+		}{io.MultiReader(bytes.NewReader(header), r), conn}, nil
+	}
+}
+
+// destNegotiateTLS requests a TLS connection to a postgres destination and
+// returns the encrypted connection
+func destNegotiateTLS(conn net.Conn, config *tls.Config) (net.Conn, error) {
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request[:4], 8)
+	binary.BigEndian.PutUint32(request[4:], pgSSLRequestCode)
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, 1)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, fmt.Errorf("failed to read SSLRequest response: %v", err)
+	}
+	if resp[0] != 'S' {
+		return nil, fmt.Errorf("destination doesn't accept tls connections")
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("tls handshake failed: %v", err)
+	}
+	return tlsConn, nil
+}
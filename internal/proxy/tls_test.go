@@ -0,0 +1,192 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testTLSConfig returns a tls config with a self signed certificate
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "stolon-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func testSSLRequest() []byte {
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request[:4], 8)
+	binary.BigEndian.PutUint32(request[4:], pgSSLRequestCode)
+	return request
+}
+
+// testStartTLSProxy starts a proxy to a destination listener with the
+// provided tls configs
+func testStartTLSProxy(t *testing.T, clientTLSConfig, destTLSConfig *tls.Config) (*Proxy, net.Listener, *net.TCPListener) {
+	destListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p, err := NewProxy(listener)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p.SetClientTLSConfig(clientTLSConfig)
+	p.SetDestTLSConfig(destTLSConfig)
+	go p.Start()
+	p.C <- ConfData{DestAddr: destListener.Addr().(*net.TCPAddr)}
+	return p, destListener, listener
+}
+
+func TestProxyConnClientTLS(t *testing.T) {
+	p, destListener, listener := testStartTLSProxy(t, testTLSConfig(t), nil)
+	defer destListener.Close()
+	defer listener.Close()
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(testSSLRequest()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp := make([]byte, 1)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp[0] != 'S' {
+		t.Fatalf("wrong SSLRequest response: got: %q, want: %q", resp[0], 'S')
+	}
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	data := "client data"
+	if _, err := io.WriteString(tlsConn, data); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	destConn, err := destListener.Accept()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer destConn.Close()
+	destConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// the destination must receive the decrypted data
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(destConn, buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(buf) != data {
+		t.Errorf("wrong data received: got: %q, want: %q", buf, data)
+	}
+
+	// clients not requesting tls are refused
+	plainConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer plainConn.Close()
+	plainConn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(plainConn, "startup message"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := plainConn.Read(make([]byte, 1)); err == nil {
+		t.Errorf("expected connection closed")
+	}
+}
+
+func TestProxyConnDestTLS(t *testing.T) {
+	destTLSConfig := testTLSConfig(t)
+	p, destListener, listener := testStartTLSProxy(t, nil, &tls.Config{InsecureSkipVerify: true})
+	defer destListener.Close()
+	defer listener.Close()
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// the client tls request must be denied
+	if _, err := conn.Write(testSSLRequest()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp := make([]byte, 1)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resp[0] != 'N' {
+		t.Fatalf("wrong SSLRequest response: got: %q, want: %q", resp[0], 'N')
+	}
+	data := "client data"
+	if _, err := io.WriteString(conn, data); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	destConn, err := destListener.Accept()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer destConn.Close()
+	destConn.SetDeadline(time.Now().Add(5 * time.Second))
+	request := make([]byte, 8)
+	if _, err := io.ReadFull(destConn, request); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pgEncryptionRequest(request) != pgSSLRequestCode {
+		t.Fatalf("expected an SSLRequest, got: %q", request)
+	}
+	if _, err := destConn.Write([]byte{'S'}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tlsConn := tls.Server(destConn, destTLSConfig)
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(tlsConn, buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(buf) != data {
+		t.Errorf("wrong data received: got: %q, want: %q", buf, data)
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package proxy
+
+import (
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// setUserTimeout sets the connection TCP_USER_TIMEOUT: the max time the
+// transmitted data can remain unacknowledged before the connection is closed
+func setUserTimeout(conn *net.TCPConn, d time.Duration) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var operr error
+	err = rc.Control(func(fd uintptr) {
+		// the kernel expects milliseconds
+		operr = os.NewSyscallError("setsockopt", unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(d/time.Millisecond)))
+	})
+	if err != nil {
+		return err
+	}
+	return operr
+}
@@ -0,0 +1,466 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sentinelapi implements the management api served by the leader
+// sentinel and its client. The api gives access to the cluster data, the
+// cluster spec history and the cluster components status so the clients
+// (like stolonctl) can manage the cluster without the store credentials.
+package sentinelapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+	"github.com/sorintlab/stolon/internal/store"
+)
+
+const (
+	apiPrefix = "/api/v1/"
+
+	// DefaultRequestTimeout is the default client request timeout
+	DefaultRequestTimeout = 10 * time.Second
+)
+
+// Store is the subset of store.Store used by the api server
+type Store interface {
+	GetClusterData(ctx context.Context) (*cluster.ClusterData, *store.KVPair, error)
+	AtomicPutClusterData(ctx context.Context, cd *cluster.ClusterData, previous *store.KVPair) (*store.KVPair, error)
+	GetSentinelsInfo(ctx context.Context) (cluster.SentinelsInfo, error)
+	GetProxiesInfo(ctx context.Context) (cluster.ProxiesInfo, error)
+	AppendSpecChange(ctx context.Context, c *cluster.SpecChange, max int) error
+	GetSpecHistory(ctx context.Context) ([]*cluster.SpecChange, error)
+}
+
+// Status is the status of the cluster components
+type Status struct {
+	LeaderSentinelUID string                `json:"leaderSentinelUID"`
+	Sentinels         cluster.SentinelsInfo `json:"sentinels"`
+	Proxies           cluster.ProxiesInfo   `json:"proxies"`
+}
+
+// errorResponse is the api error response
+type errorResponse struct {
+	Error string `json:"error"`
+	// NotLeader reports that the request has been refused since the
+	// sentinel isn't the leader sentinel
+	NotLeader bool `json:"notLeader,omitempty"`
+}
+
+// revision returns the revision of the cluster data pair. It's used to detect
+// the cluster data changes between a read and a write also with the stores
+// not providing a modification index.
+func revision(pair *store.KVPair) string {
+	if pair == nil {
+		return ""
+	}
+	sum := sha256.Sum256(pair.Value)
+	return hex.EncodeToString(sum[:])
+}
+
+// Server serves the api. Only the leader sentinel serves the requests, the
+// other sentinels refuse them so the clients can try another endpoint.
+type Server struct {
+	uid      string
+	token    string
+	e        Store
+	isLeader func() bool
+}
+
+// NewServer returns an api server of the sentinel with the provided uid. The
+// requests must provide the token as a bearer token.
+func NewServer(uid, token string, e Store, isLeader func() bool) (*Server, error) {
+	if token == "" {
+		return nil, fmt.Errorf("empty api token")
+	}
+	return &Server{uid: uid, token: token, e: e, isLeader: isLeader}, nil
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&errorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(s.token)) == 1
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		writeError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+		return
+	}
+	if !s.isLeader() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(&errorResponse{Error: "not the leader sentinel", NotLeader: true})
+		return
+	}
+
+	var handler func(w http.ResponseWriter, r *http.Request) error
+	switch strings.TrimPrefix(r.URL.Path, apiPrefix) + " " + r.Method {
+	case "status GET":
+		handler = s.status
+	case "clusterdata GET":
+		handler = s.getClusterData
+	case "clusterdata PUT":
+		handler = s.putClusterData
+	case "spechistory GET":
+		handler = s.getSpecHistory
+	case "spechistory POST":
+		handler = s.appendSpecChange
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown api request %s %s", r.Method, r.URL.Path))
+		return
+	}
+	if err := handler(w, r); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func (s *Server) status(w http.ResponseWriter, r *http.Request) error {
+	sentinelsInfo, err := s.e.GetSentinelsInfo(r.Context())
+	if err != nil {
+		return fmt.Errorf("cannot get sentinels info: %v", err)
+	}
+	proxiesInfo, err := s.e.GetProxiesInfo(r.Context())
+	if err != nil {
+		return fmt.Errorf("cannot get proxies info: %v", err)
+	}
+	writeJSON(w, &Status{LeaderSentinelUID: s.uid, Sentinels: sentinelsInfo, Proxies: proxiesInfo})
+	return nil
+}
+
+// getClusterData returns the cluster data as saved in the store, so the
+// client can compute its revision
+func (s *Server) getClusterData(w http.ResponseWriter, r *http.Request) error {
+	_, pair, err := s.e.GetClusterData(r.Context())
+	if err != nil {
+		return fmt.Errorf("cannot get cluster data: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if pair == nil {
+		w.Write([]byte("null"))
+		return nil
+	}
+	w.Write(pair.Value)
+	return nil
+}
+
+// putClusterData replaces the cluster data if its current revision is the one
+// provided in the If-Match header. It returns the written cluster data. With
+// the dryRun query parameter the cluster data is only validated.
+func (s *Server) putClusterData(w http.ResponseWriter, r *http.Request) error {
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+	prevRevision := r.Header.Get("If-Match")
+	if prevRevision == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing If-Match header"))
+		return nil
+	}
+	var cd *cluster.ClusterData
+	if err := json.NewDecoder(r.Body).Decode(&cd); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("cannot decode cluster data: %v", err))
+		return nil
+	}
+	if err := validateClusterData(cd); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return nil
+	}
+
+	_, pair, err := s.e.GetClusterData(r.Context())
+	if err != nil {
+		return fmt.Errorf("cannot get cluster data: %v", err)
+	}
+	if pair == nil {
+		writeError(w, http.StatusConflict, fmt.Errorf("cluster data not initialized"))
+		return nil
+	}
+	if revision(pair) != prevRevision {
+		writeError(w, http.StatusPreconditionFailed, store.ErrKeyModified)
+		return nil
+	}
+	if dryRun {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	if _, err := s.e.AtomicPutClusterData(r.Context(), cd, pair); err != nil {
+		if err == store.ErrKeyModified {
+			writeError(w, http.StatusPreconditionFailed, err)
+			return nil
+		}
+		return fmt.Errorf("cannot update cluster data: %v", err)
+	}
+	// the stores save the cluster data json encoding
+	cdj, err := json.Marshal(cd)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(cdj)
+	return nil
+}
+
+func validateClusterData(cd *cluster.ClusterData) error {
+	if cd == nil || cd.Cluster == nil || cd.Cluster.Spec == nil {
+		return fmt.Errorf("no cluster spec provided")
+	}
+	if cd.FormatVersion != cluster.CurrentCDFormatVersion {
+		return fmt.Errorf("unsupported cluster data format version %d", cd.FormatVersion)
+	}
+	if err := cd.Cluster.Spec.Validate(); err != nil {
+		return fmt.Errorf("cluster spec validation failed: %v", err)
+	}
+	return nil
+}
+
+func (s *Server) getSpecHistory(w http.ResponseWriter, r *http.Request) error {
+	history, err := s.e.GetSpecHistory(r.Context())
+	if err != nil {
+		return fmt.Errorf("cannot get the spec history: %v", err)
+	}
+	writeJSON(w, history)
+	return nil
+}
+
+func (s *Server) appendSpecChange(w http.ResponseWriter, r *http.Request) error {
+	max, err := strconv.Atoi(r.URL.Query().Get("max"))
+	if err != nil || max <= 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("wrong max spec history size %q", r.URL.Query().Get("max")))
+		return nil
+	}
+	var c *cluster.SpecChange
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil || c == nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("cannot decode the spec change: %v", err))
+		return nil
+	}
+	if err := s.e.AppendSpecChange(r.Context(), c, max); err != nil {
+		return fmt.Errorf("cannot append the spec change: %v", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type ClientConfig struct {
+	// Endpoints are the sentinels api urls. They're tried in order until
+	// the leader sentinel is found.
+	Endpoints []string
+	Token     string
+	CAFile    string
+
+	RequestTimeout time.Duration
+}
+
+// Client is an api client. It implements the cluster data and spec history
+// methods of store.Store.
+type Client struct {
+	cfg    ClientConfig
+	client *http.Client
+}
+
+func NewClient(cfg ClientConfig) (*Client, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, fmt.Errorf("no api endpoints provided")
+	}
+	if cfg.Token == "" {
+		return nil, fmt.Errorf("api token required")
+	}
+	if cfg.RequestTimeout == 0 {
+		cfg.RequestTimeout = DefaultRequestTimeout
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if cfg.CAFile != "" {
+		tlsConfig, err := common.NewTLSConfig("", "", cfg.CAFile, false)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create api tls config: %v", err)
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	return &Client{
+		cfg:    cfg,
+		client: &http.Client{Transport: transport, Timeout: cfg.RequestTimeout},
+	}, nil
+}
+
+// apiError is an error response of the api
+type apiError struct {
+	status    int
+	err       string
+	notLeader bool
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("api response status %d: %s", e.status, e.err)
+}
+
+// do executes the request on the endpoints in order until one of them is the
+// leader sentinel. It returns the response body.
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, body []byte) ([]byte, error) {
+	var lastErr error
+	for _, endpoint := range c.cfg.Endpoints {
+		req, err := http.NewRequest(method, strings.TrimSuffix(endpoint, "/")+apiPrefix+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		req.Header.Set("Authorization", "Bearer "+c.cfg.Token)
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			aerr := &apiError{status: resp.StatusCode, err: strings.TrimSpace(string(data))}
+			var errResp errorResponse
+			if err := json.Unmarshal(data, &errResp); err == nil {
+				aerr.err = errResp.Error
+				aerr.notLeader = errResp.NotLeader
+			}
+			if aerr.notLeader {
+				lastErr = fmt.Errorf("%s: %v", endpoint, aerr)
+				continue
+			}
+			return nil, aerr
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("no leader sentinel api endpoint available: %v", lastErr)
+}
+
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	data, err := c.do(ctx, "GET", "status", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var s *Status
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("cannot parse api response: %v", err)
+	}
+	return s, nil
+}
+
+// GetProxiesInfo returns the proxies info reported by the api status
+func (c *Client) GetProxiesInfo(ctx context.Context) (cluster.ProxiesInfo, error) {
+	s, err := c.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.Proxies, nil
+}
+
+func (c *Client) GetClusterData(ctx context.Context) (*cluster.ClusterData, *store.KVPair, error) {
+	data, err := c.do(ctx, "GET", "clusterdata", nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	var cd *cluster.ClusterData
+	if err := json.Unmarshal(data, &cd); err != nil {
+		return nil, nil, fmt.Errorf("cannot parse api response: %v", err)
+	}
+	if cd == nil {
+		return nil, nil, nil
+	}
+	return cd, &store.KVPair{Value: data}, nil
+}
+
+// AtomicPutClusterData replaces the cluster data if it isn't changed since
+// previous has been read, otherwise store.ErrKeyModified is returned. The
+// cluster data cannot be initialized using the api.
+func (c *Client) AtomicPutClusterData(ctx context.Context, cd *cluster.ClusterData, previous *store.KVPair) (*store.KVPair, error) {
+	if previous == nil {
+		return nil, fmt.Errorf("the cluster data cannot be initialized using the api")
+	}
+	cdj, err := json.Marshal(cd)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.do(ctx, "PUT", "clusterdata", http.Header{"If-Match": []string{revision(previous)}}, cdj)
+	if err != nil {
+		if aerr, ok := err.(*apiError); ok && aerr.status == http.StatusPreconditionFailed {
+			return nil, store.ErrKeyModified
+		}
+		return nil, err
+	}
+	return &store.KVPair{Value: data}, nil
+}
+
+// ValidateClusterData asks the leader sentinel to validate the cluster data
+// like AtomicPutClusterData does, without writing it
+func (c *Client) ValidateClusterData(ctx context.Context, cd *cluster.ClusterData, previous *store.KVPair) error {
+	if previous == nil {
+		return fmt.Errorf("the cluster data cannot be initialized using the api")
+	}
+	cdj, err := json.Marshal(cd)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, "PUT", "clusterdata?dryRun=true", http.Header{"If-Match": []string{revision(previous)}}, cdj)
+	if aerr, ok := err.(*apiError); ok && aerr.status == http.StatusPreconditionFailed {
+		return store.ErrKeyModified
+	}
+	return err
+}
+
+func (c *Client) GetSpecHistory(ctx context.Context) ([]*cluster.SpecChange, error) {
+	data, err := c.do(ctx, "GET", "spechistory", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var history []*cluster.SpecChange
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, fmt.Errorf("cannot parse api response: %v", err)
+	}
+	return history, nil
+}
+
+func (c *Client) AppendSpecChange(ctx context.Context, sc *cluster.SpecChange, max int) error {
+	scj, err := json.Marshal(sc)
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, "POST", "spechistory?max="+strconv.Itoa(max), nil, scj)
+	return err
+}
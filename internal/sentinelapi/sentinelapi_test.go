@@ -0,0 +1,271 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sentinelapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/store"
+)
+
+const testToken = "secret"
+
+// testStore is an in memory Store saving the cluster data json encoding like
+// the real stores
+type testStore struct {
+	cdj     []byte
+	history []*cluster.SpecChange
+}
+
+func (s *testStore) GetClusterData(ctx context.Context) (*cluster.ClusterData, *store.KVPair, error) {
+	if s.cdj == nil {
+		return nil, nil, nil
+	}
+	var cd *cluster.ClusterData
+	if err := json.Unmarshal(s.cdj, &cd); err != nil {
+		return nil, nil, err
+	}
+	return cd, &store.KVPair{Value: s.cdj}, nil
+}
+
+func (s *testStore) AtomicPutClusterData(ctx context.Context, cd *cluster.ClusterData, previous *store.KVPair) (*store.KVPair, error) {
+	if previous == nil || string(previous.Value) != string(s.cdj) {
+		return nil, store.ErrKeyModified
+	}
+	cdj, err := json.Marshal(cd)
+	if err != nil {
+		return nil, err
+	}
+	s.cdj = cdj
+	return &store.KVPair{Value: cdj}, nil
+}
+
+func (s *testStore) GetSentinelsInfo(ctx context.Context) (cluster.SentinelsInfo, error) {
+	return cluster.SentinelsInfo{{UID: "sentinel1"}}, nil
+}
+
+func (s *testStore) GetProxiesInfo(ctx context.Context) (cluster.ProxiesInfo, error) {
+	return cluster.ProxiesInfo{"proxy1": {UID: "proxy1"}}, nil
+}
+
+func (s *testStore) AppendSpecChange(ctx context.Context, c *cluster.SpecChange, max int) error {
+	s.history = append(s.history, c)
+	if len(s.history) > max {
+		s.history = s.history[len(s.history)-max:]
+	}
+	return nil
+}
+
+func (s *testStore) GetSpecHistory(ctx context.Context) ([]*cluster.SpecChange, error) {
+	return s.history, nil
+}
+
+func newTestStore(t *testing.T) *testStore {
+	cd := cluster.NewClusterData(cluster.NewCluster("cluster1", &cluster.ClusterSpec{InitMode: cluster.ClusterInitModeP(cluster.ClusterInitModeNew)}))
+	cdj, err := json.Marshal(cd)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return &testStore{cdj: cdj}
+}
+
+func newTestServer(t *testing.T, e Store, leader bool) *httptest.Server {
+	s, err := NewServer("sentinel1", testToken, e, func() bool { return leader })
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return httptest.NewServer(s)
+}
+
+func newTestClient(t *testing.T, token string, endpoints ...string) *Client {
+	c, err := NewClient(ClientConfig{Endpoints: endpoints, Token: token})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return c
+}
+
+func TestAuthorization(t *testing.T) {
+	ts := newTestServer(t, newTestStore(t), true)
+	defer ts.Close()
+
+	tests := []struct {
+		auth   string
+		status int
+	}{
+		{auth: "", status: http.StatusUnauthorized},
+		{auth: "Bearer wrong", status: http.StatusUnauthorized},
+		{auth: testToken, status: http.StatusUnauthorized},
+		{auth: "Bearer " + testToken, status: http.StatusOK},
+	}
+
+	for i, tt := range tests {
+		req, err := http.NewRequest("GET", ts.URL+apiPrefix+"status", nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("#%d: got status %d, want: %d", i, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+func TestLeaderEndpoint(t *testing.T) {
+	e := newTestStore(t)
+	follower := newTestServer(t, e, false)
+	defer follower.Close()
+	leader := newTestServer(t, e, true)
+	defer leader.Close()
+
+	c := newTestClient(t, testToken, "http://127.0.0.1:1", follower.URL, leader.URL)
+	s, err := c.Status(context.TODO())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.LeaderSentinelUID != "sentinel1" || len(s.Sentinels) != 1 || len(s.Proxies) != 1 {
+		t.Errorf("wrong status: %+v", s)
+	}
+
+	c = newTestClient(t, testToken, follower.URL)
+	if _, err := c.Status(context.TODO()); err == nil {
+		t.Errorf("got no error without a leader sentinel endpoint")
+	}
+
+	c = newTestClient(t, "wrong", leader.URL)
+	if _, err := c.Status(context.TODO()); err == nil {
+		t.Errorf("got no error with a wrong token")
+	}
+}
+
+func TestClusterData(t *testing.T) {
+	e := newTestStore(t)
+	ts := newTestServer(t, e, true)
+	defer ts.Close()
+	c := newTestClient(t, testToken, ts.URL)
+
+	cd, pair, err := c.GetClusterData(context.TODO())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cd.Cluster.UID != "cluster1" {
+		t.Fatalf("wrong cluster uid: %s", cd.Cluster.UID)
+	}
+
+	newCd := cd.DeepCopy()
+	newCd.Cluster.Spec.MaxStandbys = cluster.Uint16P(5)
+	newPair, err := c.AtomicPutClusterData(context.TODO(), newCd, pair)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cd, _, err = e.GetClusterData(context.TODO())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *cd.Cluster.Spec.MaxStandbys != 5 {
+		t.Errorf("cluster data not updated")
+	}
+
+	// the first pair is stale
+	if _, err := c.AtomicPutClusterData(context.TODO(), newCd, pair); err != store.ErrKeyModified {
+		t.Errorf("got error: %v, want: %v", err, store.ErrKeyModified)
+	}
+	// the pair returned by the update is the current one
+	newCd.Cluster.Spec.MaxStandbys = cluster.Uint16P(6)
+	if _, err := c.AtomicPutClusterData(context.TODO(), newCd, newPair); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	badCd := newCd.DeepCopy()
+	badCd.Cluster.Spec.MaxStandbys = cluster.Uint16P(0)
+	_, pair, err = c.GetClusterData(context.TODO())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := c.AtomicPutClusterData(context.TODO(), badCd, pair); err == nil {
+		t.Errorf("got no error for an invalid cluster spec")
+	}
+	if _, err := c.AtomicPutClusterData(context.TODO(), newCd, nil); err == nil {
+		t.Errorf("got no error initializing the cluster data")
+	}
+}
+
+func TestValidateClusterData(t *testing.T) {
+	e := newTestStore(t)
+	ts := newTestServer(t, e, true)
+	defer ts.Close()
+	c := newTestClient(t, testToken, ts.URL)
+
+	cd, pair, err := c.GetClusterData(context.TODO())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	prevcdj := string(e.cdj)
+
+	newCd := cd.DeepCopy()
+	newCd.Cluster.Spec.MaxStandbys = cluster.Uint16P(5)
+	if err := c.ValidateClusterData(context.TODO(), newCd, pair); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(e.cdj) != prevcdj {
+		t.Errorf("cluster data written by a dry run")
+	}
+
+	badCd := newCd.DeepCopy()
+	badCd.Cluster.Spec.MaxStandbys = cluster.Uint16P(0)
+	if err := c.ValidateClusterData(context.TODO(), badCd, pair); err == nil {
+		t.Errorf("got no error for an invalid cluster spec")
+	}
+
+	// make the pair stale
+	if _, err := c.AtomicPutClusterData(context.TODO(), newCd, pair); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.ValidateClusterData(context.TODO(), newCd, pair); err != store.ErrKeyModified {
+		t.Errorf("got error: %v, want: %v", err, store.ErrKeyModified)
+	}
+}
+
+func TestSpecHistory(t *testing.T) {
+	e := newTestStore(t)
+	ts := newTestServer(t, e, true)
+	defer ts.Close()
+	c := newTestClient(t, testToken, ts.URL)
+
+	for i := int64(1); i <= 3; i++ {
+		if err := c.AppendSpecChange(context.TODO(), &cluster.SpecChange{Generation: i, Command: "update"}, 2); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	history, err := c.GetSpecHistory(context.TODO())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(history) != 2 || history[0].Generation != 2 || history[1].Generation != 3 {
+		t.Errorf("wrong spec history: %+v", history)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	clusterDataChunksDir = "clusterdata-chunks"
+
+	// chunkedClusterDataPrefix is the prefix of a cluster data value
+	// referencing the chunks containing the cluster data
+	chunkedClusterDataPrefix = "stolon-chunked-clusterdata:"
+
+	// max times the cluster data is read again when its chunks have been
+	// replaced by a concurrent write
+	maxChunkedClusterDataReads = 3
+)
+
+// gzipMagic are the first bytes of a gzip stream, a compressed cluster data
+// value cannot be confused with an uncompressed json one
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// ClusterDataEncoding defines how the cluster data is written in a kv store.
+// The cluster data is always read in all the encodings (also the plain json
+// one), so the encoding can be changed at any time, but all the components
+// must be able to read it.
+type ClusterDataEncoding struct {
+	// Compress writes the cluster data gzip compressed
+	Compress bool
+	// ChunkSize is the max size, in bytes, of the cluster data value.
+	// Bigger cluster data is split in multiple chunk keys, written before
+	// atomically replacing the cluster data key with a reference to them.
+	// 0 disables chunking.
+	ChunkSize int
+}
+
+// chunkedClusterData is the reference to the chunks of a cluster data,
+// written, after the chunks, in the cluster data key
+type chunkedClusterData struct {
+	// Generation tags the chunks of this cluster data write
+	Generation string `json:"generation"`
+	Chunks     int    `json:"chunks"`
+	// SHA256 is the checksum of the chunks content
+	SHA256 string `json:"sha256"`
+}
+
+// newChunksGeneration returns a new chunks generation. Generations are
+// ordered by creation time.
+func newChunksGeneration() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%016x%s", time.Now().UnixNano(), hex.EncodeToString(b)), nil
+}
+
+func (s *KVBackedStore) chunkPath(generation string, i int) string {
+	return filepath.Join(s.clusterPath, clusterDataChunksDir, fmt.Sprintf("%s-%04d", generation, i))
+}
+
+// chunkGeneration returns the generation of a chunk key
+func chunkGeneration(key string) string {
+	name := path.Base(key)
+	if i := strings.LastIndex(name, "-"); i > 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// SetClusterDataEncoding sets the encoding of the written cluster data
+func (s *KVBackedStore) SetClusterDataEncoding(encoding ClusterDataEncoding) {
+	s.cdEncoding = encoding
+}
+
+// putClusterData encodes and writes the cluster data with the provided put
+// function, writing before its chunks when chunked. The chunks of the
+// previous generations are removed after a successful write.
+func (s *KVBackedStore) putClusterData(ctx context.Context, cdj []byte, putFn func(value []byte) (*KVPair, error)) (*KVPair, error) {
+	value := cdj
+	if s.cdEncoding.Compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(cdj); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		value = buf.Bytes()
+	}
+
+	chunkSize := s.cdEncoding.ChunkSize
+	if chunkSize <= 0 || len(value) <= chunkSize {
+		pair, err := putFn(value)
+		if err != nil {
+			return nil, err
+		}
+		// remove the chunks of a previous chunked cluster data
+		if atomic.LoadInt32(&s.chunksMayExist) == 1 {
+			if err := s.removeChunks(ctx, ""); err != nil {
+				return nil, err
+			}
+			atomic.StoreInt32(&s.chunksMayExist, 0)
+		}
+		return pair, nil
+	}
+
+	generation, err := newChunksGeneration()
+	if err != nil {
+		return nil, err
+	}
+	chunks := 0
+	for i := 0; i < len(value); i += chunkSize {
+		end := i + chunkSize
+		if end > len(value) {
+			end = len(value)
+		}
+		if err := s.store.Put(ctx, s.chunkPath(generation, chunks), value[i:end], nil); err != nil {
+			return nil, err
+		}
+		chunks++
+	}
+	sum := sha256.Sum256(value)
+	ref, err := json.Marshal(&chunkedClusterData{Generation: generation, Chunks: chunks, SHA256: hex.EncodeToString(sum[:])})
+	if err != nil {
+		return nil, err
+	}
+	pair, err := putFn(append([]byte(chunkedClusterDataPrefix), ref...))
+	if err != nil {
+		// ignore the errors removing the chunks of the failed write, they'll
+		// be removed by the next successful one
+		for i := 0; i < chunks; i++ {
+			s.store.Delete(ctx, s.chunkPath(generation, i))
+		}
+		return nil, err
+	}
+	atomic.StoreInt32(&s.chunksMayExist, 1)
+	if err := s.removeChunks(ctx, generation); err != nil {
+		return nil, err
+	}
+	return pair, nil
+}
+
+// removeChunks removes the chunks of the generations older than the provided
+// one (all the chunks if empty)
+func (s *KVBackedStore) removeChunks(ctx context.Context, generation string) error {
+	pairs, err := s.store.List(ctx, filepath.Join(s.clusterPath, clusterDataChunksDir))
+	if err != nil {
+		if err == ErrKeyNotFound {
+			return nil
+		}
+		return err
+	}
+	for _, pair := range pairs {
+		if generation != "" && chunkGeneration(pair.Key) >= generation {
+			continue
+		}
+		if err := s.store.Delete(ctx, pair.Key); err != nil && err != ErrKeyNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeClusterData returns the cluster data json from a cluster data value,
+// reading its chunks when chunked. It returns ErrKeyNotFound if a chunk
+// doesn't exist (i.e. removed by a concurrent write).
+func (s *KVBackedStore) decodeClusterData(ctx context.Context, value []byte) ([]byte, error) {
+	if bytes.HasPrefix(value, []byte(chunkedClusterDataPrefix)) {
+		var ref chunkedClusterData
+		if err := json.Unmarshal(value[len(chunkedClusterDataPrefix):], &ref); err != nil {
+			return nil, fmt.Errorf("wrong chunked cluster data reference: %v", err)
+		}
+		var data []byte
+		for i := 0; i < ref.Chunks; i++ {
+			pair, err := s.store.Get(ctx, s.chunkPath(ref.Generation, i))
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, pair.Value...)
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != ref.SHA256 {
+			return nil, fmt.Errorf("wrong cluster data chunks checksum")
+		}
+		atomic.StoreInt32(&s.chunksMayExist, 1)
+		value = data
+	}
+	if bytes.HasPrefix(value, gzipMagic) {
+		zr, err := gzip.NewReader(bytes.NewReader(value))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return ioutil.ReadAll(zr)
+	}
+	return value, nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+const testClusterPath = "/stolon/cluster/cluster1"
+
+func testClusterDataChunks(s *memKVStore) []string {
+	chunks := []string{}
+	for _, pair := range s.list(filepath.Join(testClusterPath, clusterDataChunksDir)) {
+		chunks = append(chunks, pair.Key)
+	}
+	return chunks
+}
+
+func TestClusterDataEncoding(t *testing.T) {
+	cd := cluster.NewClusterData(&cluster.Cluster{UID: "cluster1", Spec: &cluster.ClusterSpec{}})
+	for i := 0; i < 20; i++ {
+		uid := fmt.Sprintf("keeper%d", i)
+		cd.Keepers[uid] = &cluster.Keeper{UID: uid, Spec: &cluster.KeeperSpec{}}
+	}
+	cdj, err := json.Marshal(cd)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		encoding ClusterDataEncoding
+		chunked  bool
+	}{
+		{
+			name: "plain json",
+		},
+		{
+			name:     "compressed",
+			encoding: ClusterDataEncoding{Compress: true},
+		},
+		{
+			name:     "chunked",
+			encoding: ClusterDataEncoding{ChunkSize: 100},
+			chunked:  true,
+		},
+		{
+			name:     "compressed and chunked",
+			encoding: ClusterDataEncoding{Compress: true, ChunkSize: 100},
+			chunked:  true,
+		},
+		{
+			name:     "smaller than the chunk size",
+			encoding: ClusterDataEncoding{ChunkSize: len(cdj) + 1},
+		},
+	}
+
+	for i, tt := range tests {
+		kv := newMemKVStore()
+		s := NewKVBackedStore(kv, testClusterPath)
+		s.SetClusterDataEncoding(tt.encoding)
+		if _, err := s.AtomicPutClusterData(context.TODO(), cd, nil); err != nil {
+			t.Fatalf("#%d (%s): unexpected error: %v", i, tt.name, err)
+		}
+
+		value := kv.kvs[filepath.Join(testClusterPath, clusterDataFile)]
+		if tt.encoding == (ClusterDataEncoding{}) && !bytes.Equal(value, cdj) {
+			t.Errorf("#%d (%s): cluster data not written as plain json", i, tt.name)
+		}
+		if tt.encoding.Compress && !tt.chunked && !bytes.HasPrefix(value, gzipMagic) {
+			t.Errorf("#%d (%s): cluster data not compressed", i, tt.name)
+		}
+		if chunked := strings.HasPrefix(string(value), chunkedClusterDataPrefix); chunked != tt.chunked {
+			t.Errorf("#%d (%s): got chunked: %t, want: %t", i, tt.name, chunked, tt.chunked)
+		}
+		if chunks := testClusterDataChunks(kv); tt.chunked != (len(chunks) > 0) {
+			t.Errorf("#%d (%s): wrong chunks: %v", i, tt.name, chunks)
+		}
+
+		// the cluster data is read with any encoding
+		rcd, _, err := NewKVBackedStore(kv, testClusterPath).GetClusterData(context.TODO())
+		if err != nil {
+			t.Fatalf("#%d (%s): unexpected error: %v", i, tt.name, err)
+		}
+		if !reflect.DeepEqual(rcd, cd) {
+			t.Errorf("#%d (%s): wrong cluster data: got: %+v, want: %+v", i, tt.name, rcd, cd)
+		}
+	}
+}
+
+func TestChunkedClusterDataGenerations(t *testing.T) {
+	cd := cluster.NewClusterData(&cluster.Cluster{UID: "cluster1", Spec: &cluster.ClusterSpec{}})
+	kv := newMemKVStore()
+	s := NewKVBackedStore(kv, testClusterPath)
+	s.SetClusterDataEncoding(ClusterDataEncoding{ChunkSize: 50})
+
+	if err := s.PutClusterData(context.TODO(), cd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	firstChunks := testClusterDataChunks(kv)
+	if len(firstChunks) == 0 {
+		t.Fatalf("no chunks written")
+	}
+
+	// the chunks of the previous generation are removed
+	cd.Cluster.UID = "cluster2"
+	if err := s.PutClusterData(context.TODO(), cd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	chunks := testClusterDataChunks(kv)
+	for _, c := range chunks {
+		if chunkGeneration(c) == chunkGeneration(firstChunks[0]) {
+			t.Fatalf("chunk %q of the previous generation not removed", c)
+		}
+	}
+
+	// a missing chunk is reported
+	delete(kv.kvs, chunks[0])
+	if _, _, err := s.GetClusterData(context.TODO()); err == nil || err.Error() != "missing cluster data chunk" {
+		t.Fatalf("got error: %v, wanted error: missing cluster data chunk", err)
+	}
+
+	// a wrong chunk is detected
+	if err := s.PutClusterData(context.TODO(), cd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	chunks = testClusterDataChunks(kv)
+	kv.kvs[chunks[0]] = []byte("wrong")
+	if _, _, err := s.GetClusterData(context.TODO()); err == nil || err.Error() != "wrong cluster data chunks checksum" {
+		t.Fatalf("got error: %v, wanted error: wrong cluster data chunks checksum", err)
+	}
+
+	// writing a not chunked cluster data removes the chunks
+	s.SetClusterDataEncoding(ClusterDataEncoding{})
+	if err := s.PutClusterData(context.TODO(), cd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if chunks := testClusterDataChunks(kv); len(chunks) != 0 {
+		t.Fatalf("chunks not removed: %v", chunks)
+	}
+	rcd, _, err := s.GetClusterData(context.TODO())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rcd.Cluster.UID != "cluster2" {
+		t.Fatalf("wrong cluster data cluster uid: %q", rcd.Cluster.UID)
+	}
+}
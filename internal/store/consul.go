@@ -0,0 +1,167 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	slog "github.com/sorintlab/stolon/internal/log"
+	"github.com/sorintlab/stolon/internal/store/consul"
+
+	libkvstore "github.com/docker/libkv/store"
+	"github.com/hashicorp/go-cleanhttp"
+	"go.uber.org/zap"
+)
+
+var log = slog.S()
+
+// ConsulToken is a consul acl token read from a file. It's reloaded from the
+// file on SIGHUP and, if defined, at every reload interval so tokens with a
+// ttl can be rotated without restarting the process.
+type ConsulToken struct {
+	path string
+
+	mutex sync.RWMutex
+	token string
+}
+
+func NewConsulToken(path string) (*ConsulToken, error) {
+	t := &ConsulToken{path: path}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Token returns the last read token
+func (t *ConsulToken) Token() string {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.token
+}
+
+// Reload reads the token from the file. On error the previous token is kept.
+func (t *ConsulToken) Reload() error {
+	data, err := ioutil.ReadFile(t.path)
+	if err != nil {
+		return fmt.Errorf("cannot read consul token file: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return fmt.Errorf("empty consul token file %q", t.path)
+	}
+	t.mutex.Lock()
+	t.token = token
+	t.mutex.Unlock()
+	return nil
+}
+
+// run reloads the token on SIGHUP and at every interval (when greater than 0)
+// until the context is done
+func (t *ConsulToken) run(ctx context.Context, interval time.Duration) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	defer signal.Stop(sigCh)
+
+	var tickCh <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tickCh = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigCh:
+		case <-tickCh:
+		}
+		if err := t.Reload(); err != nil {
+			log.Errorw("failed to reload the consul token, keeping the previous one", zap.Error(err))
+		}
+	}
+}
+
+// consulTransport adds the namespace and the current acl token to the
+// requests to consul
+type consulTransport struct {
+	base      http.RoundTripper
+	namespace string
+	token     *ConsulToken
+}
+
+func (t *consulTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the provided request
+	r := new(http.Request)
+	*r = *req
+	u := *req.URL
+	r.URL = &u
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+
+	if t.namespace != "" {
+		q := r.URL.Query()
+		q.Set("ns", t.namespace)
+		r.URL.RawQuery = q.Encode()
+	}
+	if t.token != nil {
+		r.Header.Set("X-Consul-Token", t.token.Token())
+	}
+	return t.base.RoundTrip(r)
+}
+
+// newConsulStore returns a libkv consul store with its own http client. When
+// defined, the client adds the consul namespace and the acl token read from
+// the token file to the requests.
+func newConsulStore(addrs []string, config *libkvstore.Config, cfg Config) (*libKVStore, error) {
+	transport := cleanhttp.DefaultPooledTransport()
+	transport.TLSClientConfig = config.TLS
+	var rt http.RoundTripper = transport
+
+	var token *ConsulToken
+	if cfg.ConsulTokenFile != "" {
+		var err error
+		token, err = NewConsulToken(cfg.ConsulTokenFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ConsulNamespace != "" || token != nil {
+		rt = &consulTransport{base: transport, namespace: cfg.ConsulNamespace, token: token}
+	}
+
+	store, err := consul.New(addrs, config, &http.Client{Transport: rt})
+	if err != nil {
+		return nil, err
+	}
+	s := &libKVStore{store: store}
+	if token != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.cancel = cancel
+		go token.run(ctx, cfg.ConsulTokenReloadInterval)
+	}
+	return s, nil
+}
@@ -1,3 +1,22 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package consul implements the libkv store for consul.
+// It's derived from github.com/docker/libkv/store/consul, changed to use its
+// own http client instead of http.DefaultClient. All the store and lock
+// operations are the libkv ones, so it's compatible with the keys and the
+// locks (i.e. the sentinel election) of the libkv consul store.
 package consul
 
 import (
@@ -8,7 +27,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/docker/libkv"
 	"github.com/docker/libkv/store"
 	api "github.com/hashicorp/consul/api"
 )
@@ -55,14 +73,10 @@ type consulLock struct {
 	renewCh chan struct{}
 }
 
-// Register registers consul to libkv
-func Register() {
-	libkv.AddStore(store.CONSUL, New)
-}
-
-// New creates a new Consul client given a list
-// of endpoints and optional tls config
-func New(endpoints []string, options *store.Config) (store.Store, error) {
+// New creates a new Consul client given a list of endpoints, optional tls
+// config and the http client to use. When using tls the client transport
+// must be configured with the options tls config.
+func New(endpoints []string, options *store.Config, httpClient *http.Client) (store.Store, error) {
 	if len(endpoints) > 1 {
 		return nil, ErrMultipleEndpointsUnsupported
 	}
@@ -72,7 +86,7 @@ func New(endpoints []string, options *store.Config) (store.Store, error) {
 	// Create Consul client
 	config := api.DefaultConfig()
 	s.config = config
-	config.HttpClient = http.DefaultClient
+	config.HttpClient = httpClient
 	config.Address = endpoints[0]
 	config.Scheme = "http"
 
@@ -96,11 +110,9 @@ func New(endpoints []string, options *store.Config) (store.Store, error) {
 	return s, nil
 }
 
-// SetTLS sets Consul TLS options
+// SetTLS sets Consul TLS options. The tls config is set by the http client
+// transport
 func (s *Consul) setTLS(tls *tls.Config) {
-	s.config.HttpClient.Transport = &http.Transport{
-		TLSClientConfig: tls,
-	}
 	s.config.Scheme = "https"
 }
 
@@ -0,0 +1,185 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConsulToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stolon")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+
+	if _, err := NewConsulToken(path); err == nil {
+		t.Fatalf("got no error for a not existing token file")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("token1\n"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	token, err := NewConsulToken(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if token.Token() != "token1" {
+		t.Errorf("got token: %q, want: %q", token.Token(), "token1")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("token2"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := token.Reload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if token.Token() != "token2" {
+		t.Errorf("got token: %q, want: %q", token.Token(), "token2")
+	}
+
+	// the previous token is kept when the new one cannot be read
+	if err := ioutil.WriteFile(path, []byte(""), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := token.Reload(); err == nil {
+		t.Errorf("got no error for an empty token file")
+	}
+	if token.Token() != "token2" {
+		t.Errorf("got token: %q, want: %q", token.Token(), "token2")
+	}
+}
+
+func TestConsulTransport(t *testing.T) {
+	var gotNamespace, gotToken string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotNamespace = r.URL.Query().Get("ns")
+		gotToken = r.Header.Get("X-Consul-Token")
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "stolon")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(path, []byte("token1"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	token, err := NewConsulToken(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		namespace string
+		token     *ConsulToken
+		// token set by the consul client (i.e. from CONSUL_HTTP_TOKEN)
+		clientToken string
+		outToken    string
+	}{
+		{},
+		{namespace: "ns1", clientToken: "envtoken", outToken: "envtoken"},
+		{namespace: "ns1", token: token, clientToken: "envtoken", outToken: "token1"},
+	}
+	for i, tt := range tests {
+		c := &http.Client{Transport: &consulTransport{base: http.DefaultTransport, namespace: tt.namespace, token: tt.token}}
+		req, err := http.NewRequest("GET", ts.URL+"/v1/kv/stolon?index=10", nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if tt.clientToken != "" {
+			req.Header.Set("X-Consul-Token", tt.clientToken)
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		resp.Body.Close()
+		if gotNamespace != tt.namespace {
+			t.Errorf("#%d: got namespace: %q, want: %q", i, gotNamespace, tt.namespace)
+		}
+		if gotToken != tt.outToken {
+			t.Errorf("#%d: got token: %q, want: %q", i, gotToken, tt.outToken)
+		}
+		// the request must not be modified
+		if req.URL.Query().Get("ns") != "" || req.Header.Get("X-Consul-Token") != tt.clientToken {
+			t.Errorf("#%d: request modified", i)
+		}
+	}
+}
+
+func TestConsulStoreNamespaceToken(t *testing.T) {
+	defaultTransport := http.DefaultClient.Transport
+
+	var gotPath, gotNamespace, gotToken string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotNamespace = r.URL.Query().Get("ns")
+		gotToken = r.Header.Get("X-Consul-Token")
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "stolon")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(path, []byte("token1"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cfg := Config{
+		Backend:         CONSUL,
+		Endpoints:       ts.URL,
+		ConsulNamespace: "ns1",
+		ConsulTokenFile: path,
+	}
+	s, err := NewKVStore(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer s.Close()
+	if _, ok := s.(*libKVStore); !ok {
+		t.Fatalf("got store %T, want a libkv store", s)
+	}
+	if _, err := s.Get(context.TODO(), "/stolon/cluster/c1/clusterdata"); err != ErrKeyNotFound {
+		t.Fatalf("got error: %v, want: %v", err, ErrKeyNotFound)
+	}
+
+	if gotPath != "/v1/kv/stolon/cluster/c1/clusterdata" {
+		t.Errorf("got path: %q", gotPath)
+	}
+	if gotNamespace != "ns1" {
+		t.Errorf("got namespace: %q, want: %q", gotNamespace, "ns1")
+	}
+	if gotToken != "token1" {
+		t.Errorf("got token: %q, want: %q", gotToken, "token1")
+	}
+	// the consul store uses its own http client
+	if http.DefaultClient.Transport != defaultTransport {
+		t.Errorf("http.DefaultClient transport modified")
+	}
+}
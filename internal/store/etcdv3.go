@@ -36,6 +36,8 @@ func fromEtcV3Error(err error) error {
 type etcdV3Store struct {
 	c              *etcdclientv3.Client
 	requestTimeout time.Duration
+	// cancel stops the SRV endpoints resolution
+	cancel context.CancelFunc
 }
 
 func (s *etcdV3Store) Put(pctx context.Context, key string, value []byte, options *WriteOptions) error {
@@ -85,6 +87,31 @@ func (s *etcdV3Store) List(pctx context.Context, directory string) ([]*KVPair, e
 	return kvPairs, nil
 }
 
+// ListMulti lists all the provided prefixes inside a single transaction so
+// they are all read at the same store revision.
+func (s *etcdV3Store) ListMulti(pctx context.Context, directories []string) ([][]*KVPair, error) {
+	ops := make([]etcdclientv3.Op, len(directories))
+	for i, directory := range directories {
+		ops[i] = etcdclientv3.OpGet(directory, etcdclientv3.WithPrefix())
+	}
+	ctx, cancel := context.WithTimeout(pctx, s.requestTimeout)
+	tresp, err := s.c.Txn(ctx).Then(ops...).Commit()
+	cancel()
+	if err != nil {
+		return nil, fromEtcV3Error(err)
+	}
+	res := make([][]*KVPair, len(directories))
+	for i, r := range tresp.Responses {
+		rr := r.GetResponseRange()
+		kvPairs := make([]*KVPair, len(rr.Kvs))
+		for j, kv := range rr.Kvs {
+			kvPairs[j] = &KVPair{Key: string(kv.Key), Value: kv.Value, LastIndex: uint64(kv.ModRevision)}
+		}
+		res[i] = kvPairs
+	}
+	return res, nil
+}
+
 func (s *etcdV3Store) AtomicPut(pctx context.Context, key string, value []byte, previous *KVPair, options *WriteOptions) (*KVPair, error) {
 	etcdv3Options := []etcdclientv3.OpOption{}
 	if options != nil {
@@ -127,7 +154,38 @@ func (s *etcdV3Store) Delete(pctx context.Context, key string) error {
 	return fromEtcV3Error(err)
 }
 
+func (s *etcdV3Store) Watch(pctx context.Context, key string) (<-chan *KVPair, error) {
+	// require a leader so the watch fails when the etcd member is partitioned
+	ctx, cancel := context.WithCancel(etcdclientv3.WithRequireLeader(pctx))
+	wch := s.c.Watch(ctx, key)
+	ch := make(chan *KVPair)
+	go func() {
+		defer close(ch)
+		defer cancel()
+		for resp := range wch {
+			if resp.Err() != nil {
+				return
+			}
+			for _, ev := range resp.Events {
+				pair := &KVPair{Key: key, LastIndex: uint64(ev.Kv.ModRevision)}
+				if ev.Type == etcdclientv3.EventTypePut {
+					pair.Value = ev.Kv.Value
+				}
+				select {
+				case ch <- pair:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
 func (s *etcdV3Store) Close() error {
+	if s.cancel != nil {
+		s.cancel()
+	}
 	return s.c.Close()
 }
 
@@ -18,6 +18,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/sorintlab/stolon/internal/cluster"
@@ -26,7 +27,9 @@ import (
 	"k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
 	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
@@ -52,24 +55,44 @@ type KubeStore struct {
 	namespace    string
 	clusterName  string
 	resourceName string
+
+	// leases is non nil when the components liveness is reported using
+	// leases
+	leases *kubeLeases
+
+	infoMutex sync.Mutex
+	// lease is the last written component lease
+	lease *kubeLease
+	// lastInfo is the last written component info, without its uid
+	lastInfo string
 }
 
-func NewKubeStore(kubecli *kubernetes.Clientset, podName, namespace, clusterName string) (*KubeStore, error) {
-	return &KubeStore{
+// NewKubeStore creates a kubernetes store. When useLeases is true every
+// component reports its liveness renewing a lease named after its pod,
+// updating its pod status annotation only when its info changes.
+func NewKubeStore(kubecli *kubernetes.Clientset, podName, namespace, clusterName string, useLeases bool) (*KubeStore, error) {
+	s := &KubeStore{
 		client:       kubecli,
 		podName:      podName,
 		namespace:    namespace,
 		clusterName:  clusterName,
 		resourceName: fmt.Sprintf("%s-%s", util.KubeResourcePrefix, clusterName),
-	}, nil
+	}
+	if useLeases {
+		s.leases = newKubeLeases(kubecli.CoreV1().RESTClient(), namespace)
+	}
+	return s, nil
 }
 
-func (s *KubeStore) labelSelector(componentLabel ComponentLabelValue) labels.Selector {
-	selector := map[string]string{
+func (s *KubeStore) componentLabels(componentLabel ComponentLabelValue) map[string]string {
+	return map[string]string{
 		DefaultComponentLabel: string(componentLabel),
 		util.KubeClusterLabel: s.clusterName,
 	}
-	return labels.SelectorFromSet(selector)
+}
+
+func (s *KubeStore) labelSelector(componentLabel ComponentLabelValue) labels.Selector {
+	return labels.SelectorFromSet(s.componentLabels(componentLabel))
 }
 
 func (s *KubeStore) AtomicPutClusterData(ctx context.Context, cd *cluster.ClusterData, previous *KVPair) (*KVPair, error) {
@@ -205,22 +228,26 @@ func (s *KubeStore) GetClusterData(ctx context.Context) (*cluster.ClusterData, *
 	return cd, &KVPair{Value: []byte(cdj)}, nil
 }
 
-func (s *KubeStore) SetKeeperInfo(ctx context.Context, id string, ms *cluster.KeeperInfo, ttl time.Duration) error {
-	msj, err := json.Marshal(ms)
-	if err != nil {
-		return err
-	}
-	podsClient := s.client.CoreV1().Pods(s.namespace)
+// updateAnnotation replaces the value of the configmap annotation with the one
+// returned by updateFn (called with the current value)
+func (s *KubeStore) updateAnnotation(annotation string, updateFn func(data []byte) ([]byte, error)) error {
+	epsClient := s.client.CoreV1().ConfigMaps(s.namespace)
+
 	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		result, err := podsClient.Get(s.podName, metav1.GetOptions{})
+		result, err := epsClient.Get(s.resourceName, metav1.GetOptions{})
 		if err != nil {
-			return fmt.Errorf("failed to get latest version of pod: %v", err)
+			// the configmap is created with the cluster data
+			return fmt.Errorf("failed to get latest version of configmap: %v", err)
+		}
+		data, err := updateFn([]byte(result.Annotations[annotation]))
+		if err != nil {
+			return err
 		}
 		if result.Annotations == nil {
 			result.Annotations = map[string]string{}
 		}
-		result.Annotations[util.KubeStatusAnnnotation] = string(msj)
-		_, err = podsClient.Update(result)
+		result.Annotations[annotation] = string(data)
+		_, err = epsClient.Update(result)
 		return err
 	})
 	if retryErr != nil {
@@ -229,38 +256,45 @@ func (s *KubeStore) SetKeeperInfo(ctx context.Context, id string, ms *cluster.Ke
 	return nil
 }
 
-func (s *KubeStore) GetKeepersInfo(ctx context.Context) (cluster.KeepersInfo, error) {
-	keepers := cluster.KeepersInfo{}
-
-	podsClient := s.client.CoreV1().Pods(s.namespace)
+func (s *KubeStore) AppendEvent(ctx context.Context, ev *cluster.Event, max int) error {
+	return s.updateAnnotation(util.KubeEventsAnnotation, func(data []byte) ([]byte, error) {
+		return appendEvent(data, ev, max)
+	})
+}
 
-	listOpts := metav1.ListOptions{
-		LabelSelector: s.labelSelector(KeeperLabelValue).String(),
-	}
-	result, err := podsClient.List(listOpts)
+func (s *KubeStore) GetEvents(ctx context.Context) ([]*cluster.Event, error) {
+	epsClient := s.client.CoreV1().ConfigMaps(s.namespace)
+	result, err := epsClient.Get(s.resourceName, metav1.GetOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get latest version of pod: %v", err)
-	}
-
-	pods := result.Items
-	for _, pod := range pods {
-		var ki cluster.KeeperInfo
-		if kij, ok := pod.Annotations[util.KubeStatusAnnnotation]; ok {
-			err = json.Unmarshal([]byte(kij), &ki)
-			if err != nil {
-				return nil, err
-			}
-			keepers[ki.UID] = &ki
+		if apierrors.IsNotFound(err) {
+			return []*cluster.Event{}, nil
 		}
+		return nil, fmt.Errorf("failed to get latest version of configmap: %v", err)
 	}
-	return keepers, nil
+	return parseEvents([]byte(result.Annotations[util.KubeEventsAnnotation]))
 }
 
-func (s *KubeStore) SetSentinelInfo(ctx context.Context, si *cluster.SentinelInfo, ttl time.Duration) error {
-	sij, err := json.Marshal(si)
+func (s *KubeStore) AppendSpecChange(ctx context.Context, c *cluster.SpecChange, max int) error {
+	return s.updateAnnotation(util.KubeSpecHistoryAnnotation, func(data []byte) ([]byte, error) {
+		return appendSpecChange(data, c, max)
+	})
+}
+
+func (s *KubeStore) GetSpecHistory(ctx context.Context) ([]*cluster.SpecChange, error) {
+	epsClient := s.client.CoreV1().ConfigMaps(s.namespace)
+	result, err := epsClient.Get(s.resourceName, metav1.GetOptions{})
 	if err != nil {
-		return err
+		if apierrors.IsNotFound(err) {
+			return []*cluster.SpecChange{}, nil
+		}
+		return nil, fmt.Errorf("failed to get latest version of configmap: %v", err)
 	}
+	return parseSpecHistory([]byte(result.Annotations[util.KubeSpecHistoryAnnotation]))
+}
+
+// setPodStatusAnnotation writes the component info in its pod status
+// annotation
+func (s *KubeStore) setPodStatusAnnotation(info []byte) error {
 	podsClient := s.client.CoreV1().Pods(s.namespace)
 	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
 		result, err := podsClient.Get(s.podName, metav1.GetOptions{})
@@ -270,7 +304,7 @@ func (s *KubeStore) SetSentinelInfo(ctx context.Context, si *cluster.SentinelInf
 		if result.Annotations == nil {
 			result.Annotations = map[string]string{}
 		}
-		result.Annotations[util.KubeStatusAnnnotation] = string(sij)
+		result.Annotations[util.KubeStatusAnnnotation] = string(info)
 		_, err = podsClient.Update(result)
 		return err
 	})
@@ -280,25 +314,190 @@ func (s *KubeStore) SetSentinelInfo(ctx context.Context, si *cluster.SentinelInf
 	return nil
 }
 
-func (s *KubeStore) GetSentinelsInfo(ctx context.Context) (cluster.SentinelsInfo, error) {
-	ssi := cluster.SentinelsInfo{}
+// componentLeaseName returns the name of the lease of the component pod
+func (s *KubeStore) componentLeaseName() string {
+	return fmt.Sprintf("%s-%s", s.resourceName, s.podName)
+}
+
+// renewLease renews the component lease, creating it (owned by the component
+// pod, so it's removed with it) when missing.
+func (s *KubeStore) renewLease(component ComponentLabelValue, ttl time.Duration) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		now := metav1.NowMicro()
+		if s.lease != nil {
+			l := *s.lease
+			l.Spec.LeaseDurationSeconds = leaseDurationSeconds(ttl)
+			l.Spec.RenewTime = now
+			nl, err := s.leases.update(&l)
+			if err != nil {
+				// read it again at the next retry
+				s.lease = nil
+				if apierrors.IsNotFound(err) {
+					return apierrors.NewConflict(kubeLeasesResource, l.Name, err)
+				}
+				return err
+			}
+			s.lease = nl
+			return nil
+		}
+		l, err := s.leases.get(s.componentLeaseName())
+		if err == nil {
+			s.lease = l
+			return apierrors.NewConflict(kubeLeasesResource, l.Name, fmt.Errorf("renewing existing lease"))
+		}
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		pod, err := s.client.CoreV1().Pods(s.namespace).Get(s.podName, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get pod: %v", err)
+		}
+		nl, err := s.leases.create(&kubeLease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   s.componentLeaseName(),
+				Labels: s.componentLabels(component),
+				OwnerReferences: []metav1.OwnerReference{
+					{APIVersion: "v1", Kind: "Pod", Name: pod.Name, UID: pod.UID},
+				},
+			},
+			Spec: kubeLeaseSpec{
+				HolderIdentity:       s.podName,
+				LeaseDurationSeconds: leaseDurationSeconds(ttl),
+				AcquireTime:          now,
+				RenewTime:            now,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		s.lease = nl
+		return nil
+	})
+}
+
+// setInfo writes the component info. When using leases the pod status
+// annotation is written only when the info content (the info without its uid)
+// changes and the component liveness is reported renewing its lease.
+func (s *KubeStore) setInfo(component ComponentLabelValue, info, content []byte, ttl time.Duration) error {
+	if s.leases == nil {
+		return s.setPodStatusAnnotation(info)
+	}
+
+	s.infoMutex.Lock()
+	defer s.infoMutex.Unlock()
+	// write the annotation before renewing the lease so a new lease version
+	// is observed with the current info
+	if string(content) != s.lastInfo {
+		if err := s.setPodStatusAnnotation(info); err != nil {
+			return err
+		}
+		s.lastInfo = string(content)
+	}
+	if err := s.renewLease(component, ttl); err != nil {
+		return fmt.Errorf("failed to renew lease: %v", err)
+	}
+	return nil
+}
 
+// kubePodStatus is the status annotation of a component pod
+type kubePodStatus struct {
+	// data is nil when the pod has no status annotation
+	data []byte
+	// infoUID, when using leases, is the version of the pod lease. It
+	// replaces the info uid since the annotation is written only when the
+	// info changes.
+	infoUID string
+}
+
+func (s *KubeStore) podsStatus(component ComponentLabelValue) ([]*kubePodStatus, error) {
 	podsClient := s.client.CoreV1().Pods(s.namespace)
 
 	listOpts := metav1.ListOptions{
-		LabelSelector: s.labelSelector(SentinelLabelValue).String(),
+		LabelSelector: s.labelSelector(component).String(),
 	}
 	result, err := podsClient.List(listOpts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get latest version of pod: %v", err)
 	}
 
-	pods := result.Items
-	for _, pod := range pods {
+	leaseVersions := map[string]string{}
+	if s.leases != nil {
+		leases, err := s.leases.list(listOpts.LabelSelector)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list leases: %v", err)
+		}
+		for _, l := range leases {
+			leaseVersions[l.Spec.HolderIdentity] = l.ResourceVersion
+		}
+	}
+
+	statuses := []*kubePodStatus{}
+	for _, pod := range result.Items {
+		ps := &kubePodStatus{infoUID: leaseVersions[pod.Name]}
+		if data, ok := pod.Annotations[util.KubeStatusAnnnotation]; ok {
+			ps.data = []byte(data)
+		}
+		statuses = append(statuses, ps)
+	}
+	return statuses, nil
+}
+
+func (s *KubeStore) SetKeeperInfo(ctx context.Context, id string, ms *cluster.KeeperInfo, ttl time.Duration) error {
+	msj, err := json.Marshal(ms)
+	if err != nil {
+		return err
+	}
+	c := *ms
+	c.InfoUID = ""
+	cj, err := json.Marshal(&c)
+	if err != nil {
+		return err
+	}
+	return s.setInfo(KeeperLabelValue, msj, cj, ttl)
+}
+
+func (s *KubeStore) GetKeepersInfo(ctx context.Context) (cluster.KeepersInfo, error) {
+	keepers := cluster.KeepersInfo{}
+
+	statuses, err := s.podsStatus(KeeperLabelValue)
+	if err != nil {
+		return nil, err
+	}
+	for _, ps := range statuses {
+		if ps.data == nil {
+			continue
+		}
+		var ki cluster.KeeperInfo
+		if err := json.Unmarshal(ps.data, &ki); err != nil {
+			return nil, err
+		}
+		if ps.infoUID != "" {
+			ki.InfoUID = ps.infoUID
+		}
+		keepers[ki.UID] = &ki
+	}
+	return keepers, nil
+}
+
+func (s *KubeStore) SetSentinelInfo(ctx context.Context, si *cluster.SentinelInfo, ttl time.Duration) error {
+	sij, err := json.Marshal(si)
+	if err != nil {
+		return err
+	}
+	return s.setInfo(SentinelLabelValue, sij, sij, ttl)
+}
+
+func (s *KubeStore) GetSentinelsInfo(ctx context.Context) (cluster.SentinelsInfo, error) {
+	ssi := cluster.SentinelsInfo{}
+
+	statuses, err := s.podsStatus(SentinelLabelValue)
+	if err != nil {
+		return nil, err
+	}
+	for _, ps := range statuses {
 		var si cluster.SentinelInfo
-		if sij, ok := pod.Annotations[util.KubeStatusAnnnotation]; ok {
-			err = json.Unmarshal([]byte(sij), &si)
-			if err != nil {
+		if ps.data != nil {
+			if err := json.Unmarshal(ps.data, &si); err != nil {
 				return nil, err
 			}
 		}
@@ -312,50 +511,120 @@ func (s *KubeStore) SetProxyInfo(ctx context.Context, pi *cluster.ProxyInfo, ttl
 	if err != nil {
 		return err
 	}
-	podsClient := s.client.CoreV1().Pods(s.namespace)
-	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		result, err := podsClient.Get(s.podName, metav1.GetOptions{})
-		if err != nil {
-			return fmt.Errorf("failed to get latest version of pod: %v", err)
-		}
-		if result.Annotations == nil {
-			result.Annotations = map[string]string{}
-		}
-		result.Annotations[util.KubeStatusAnnnotation] = string(pij)
-		_, err = podsClient.Update(result)
+	c := *pi
+	c.InfoUID = ""
+	cj, err := json.Marshal(&c)
+	if err != nil {
 		return err
-	})
-	if retryErr != nil {
-		return fmt.Errorf("update failed: %v", retryErr)
 	}
-	return nil
+	return s.setInfo(ProxyLabelValue, pij, cj, ttl)
 }
 
 func (s *KubeStore) GetProxiesInfo(ctx context.Context) (cluster.ProxiesInfo, error) {
 	psi := cluster.ProxiesInfo{}
 
-	podsClient := s.client.CoreV1().Pods(s.namespace)
+	statuses, err := s.podsStatus(ProxyLabelValue)
+	if err != nil {
+		return nil, err
+	}
+	for _, ps := range statuses {
+		if ps.data == nil {
+			continue
+		}
+		var pi cluster.ProxyInfo
+		if err := json.Unmarshal(ps.data, &pi); err != nil {
+			return nil, err
+		}
+		if ps.infoUID != "" {
+			pi.InfoUID = ps.infoUID
+		}
+		psi[pi.UID] = &pi
+	}
+	return psi, nil
+}
 
-	listOpts := metav1.ListOptions{
-		LabelSelector: s.labelSelector(ProxyLabelValue).String(),
+func (s *KubeStore) GetKeepersAndProxiesInfo(ctx context.Context) (cluster.KeepersInfo, cluster.ProxiesInfo, error) {
+	keepersInfo, err := s.GetKeepersInfo(ctx)
+	if err != nil {
+		return nil, nil, err
 	}
-	result, err := podsClient.List(listOpts)
+	proxiesInfo, err := s.GetProxiesInfo(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get latest version of pod: %v", err)
+		return nil, nil, err
 	}
+	return keepersInfo, proxiesInfo, nil
+}
 
-	pods := result.Items
-	for _, pod := range pods {
-		var pi cluster.ProxyInfo
-		if pij, ok := pod.Annotations[util.KubeStatusAnnnotation]; ok {
-			err = json.Unmarshal([]byte(pij), &pi)
-			if err != nil {
-				return nil, err
+func (s *KubeStore) Watch(ctx context.Context) <-chan *KVPair {
+	return watchLoop(ctx, s.watchClusterData)
+}
+
+// watchClusterData watches the configmap holding the cluster data, sending
+// the cluster data annotation only when it changes since the configmap is
+// also updated by the sentinel leader election (when not using a lease) and
+// with the events and spec history.
+func (s *KubeStore) watchClusterData(ctx context.Context) (<-chan *KVPair, error) {
+	epsClient := s.client.CoreV1().ConfigMaps(s.namespace)
+	// get the current configmap to start watching from its version
+	var resourceVersion, cdj string
+	result, err := epsClient.Get(s.resourceName, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to get latest version of configmap: %v", err)
+	}
+	if err == nil {
+		resourceVersion = result.ResourceVersion
+		cdj = result.Annotations[util.KubeClusterDataAnnotation]
+	}
+	w, err := epsClient.Watch(metav1.ListOptions{
+		FieldSelector:   fields.OneTermEqualSelector("metadata.name", s.resourceName).String(),
+		ResourceVersion: resourceVersion,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch configmap: %v", err)
+	}
+	ch := make(chan *KVPair)
+	go func() {
+		defer close(ch)
+		defer w.Stop()
+		for {
+			var ev watch.Event
+			var ok bool
+			select {
+			case ev, ok = <-w.ResultChan():
+				if !ok {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+			var newcdj string
+			switch ev.Type {
+			case watch.Added, watch.Modified:
+				cm, ok := ev.Object.(*v1.ConfigMap)
+				if !ok {
+					return
+				}
+				newcdj = cm.Annotations[util.KubeClusterDataAnnotation]
+			case watch.Deleted:
+			default:
+				return
+			}
+			if newcdj == cdj {
+				continue
+			}
+			cdj = newcdj
+			pair := &KVPair{}
+			if cdj != "" {
+				pair.Value = []byte(cdj)
+			}
+			select {
+			case ch <- pair:
+			case <-ctx.Done():
+				return
 			}
-			psi[pi.UID] = &pi
 		}
-	}
-	return psi, nil
+	}()
+	return ch, nil
 }
 
 type KubeElection struct {
@@ -380,19 +649,38 @@ type KubeElection struct {
 	rl resourcelock.Interface
 }
 
-func NewKubeElection(kubecli *kubernetes.Clientset, podName, namespace, clusterName, candidateUID string) (*KubeElection, error) {
+// DefaultKubeElectionTTL is the default leader election lease duration
+const DefaultKubeElectionTTL = 15 * time.Second
+
+// NewKubeElection creates an election using the provided ttl as the leader
+// election lease duration. When ttl is 0 DefaultKubeElectionTTL is used.
+// When useLease is true the leader election record is kept in a
+// coordination.k8s.io lease instead of the cluster data configmap, so the
+// leadership renewals don't update the configmap.
+func NewKubeElection(kubecli *kubernetes.Clientset, podName, namespace, clusterName, candidateUID string, ttl time.Duration, useLease bool) (*KubeElection, error) {
+	if ttl == 0 {
+		ttl = DefaultKubeElectionTTL
+	}
 	resourceName := fmt.Sprintf("%s-%s", util.KubeResourcePrefix, clusterName)
-
-	rl, err := resourcelock.New(resourcelock.ConfigMapsResourceLock,
-		namespace,
-		resourceName,
-		kubecli.CoreV1(),
-		resourcelock.ResourceLockConfig{
-			Identity:      candidateUID,
-			EventRecorder: createRecorder(kubecli, "stolon-sentinel", namespace),
-		})
-	if err != nil {
-		return nil, fmt.Errorf("error creating lock: %v", err)
+	recorder := createRecorder(kubecli, "stolon-sentinel", namespace)
+
+	var rl resourcelock.Interface
+	if useLease {
+		leases := newKubeLeases(kubecli.CoreV1().RESTClient(), namespace)
+		rl = newKubeLeaseLock(leases, KubeElectionLeaseName(clusterName), candidateUID, recorder)
+	} else {
+		var err error
+		rl, err = resourcelock.New(resourcelock.ConfigMapsResourceLock,
+			namespace,
+			resourceName,
+			kubecli.CoreV1(),
+			resourcelock.ResourceLockConfig{
+				Identity:      candidateUID,
+				EventRecorder: recorder,
+			})
+		if err != nil {
+			return nil, fmt.Errorf("error creating lock: %v", err)
+		}
 	}
 
 	return &KubeElection{
@@ -400,10 +688,17 @@ func NewKubeElection(kubecli *kubernetes.Clientset, podName, namespace, clusterN
 		podName:      podName,
 		namespace:    namespace,
 		resourceName: resourceName,
+		ttl:          ttl,
 		rl:           rl,
 	}, nil
 }
 
+// KubeElectionLeaseName returns the name of the lease used for the sentinel
+// leader election
+func KubeElectionLeaseName(clusterName string) string {
+	return fmt.Sprintf("%s-%s-sentinel-leader", util.KubeResourcePrefix, clusterName)
+}
+
 func (e *KubeElection) RunForElection() (<-chan bool, <-chan error) {
 	if e.running {
 		panic("already running")
@@ -430,6 +725,9 @@ func (e *KubeElection) Stop() {
 func (e *KubeElection) Leader() (string, error) {
 	ler, err := e.rl.Get()
 	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return "", ErrElectionNoLeader
+		}
 		return "", fmt.Errorf("failed to get leader election record: %v", err)
 	}
 	if ler == nil {
@@ -446,11 +744,13 @@ func (e *KubeElection) campaign() {
 	for {
 		e.electedCh <- false
 
+		// with the default ttl the lease duration, renew deadline and
+		// retry period are 15s, 10s and 2s
 		leaderelection.RunOrDie(leaderelection.LeaderElectionConfig{
 			Lock:          e.rl,
-			LeaseDuration: 15 * time.Second,
-			RenewDeadline: 10 * time.Second,
-			RetryPeriod:   2 * time.Second,
+			LeaseDuration: e.ttl,
+			RenewDeadline: e.ttl * 2 / 3,
+			RetryPeriod:   e.ttl * 2 / 15,
 			Callbacks: leaderelection.LeaderCallbacks{
 				OnStartedLeading: func(stop <-chan struct{}) {
 					e.electedCh <- true
@@ -0,0 +1,241 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+)
+
+const kubeLeasesAPIPath = "/apis/coordination.k8s.io/v1"
+
+var (
+	kubeLeasesResource = schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}
+	kubeLeaseTypeMeta  = metav1.TypeMeta{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+)
+
+// kubeLease is a coordination.k8s.io/v1 Lease. The vendored client-go doesn't
+// provide the coordination api types and clients so they're defined here.
+type kubeLease struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec kubeLeaseSpec `json:"spec,omitempty"`
+}
+
+type kubeLeaseSpec struct {
+	HolderIdentity       string           `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int32            `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          metav1.MicroTime `json:"acquireTime,omitempty"`
+	RenewTime            metav1.MicroTime `json:"renewTime,omitempty"`
+	LeaseTransitions     int32            `json:"leaseTransitions,omitempty"`
+}
+
+func (l *kubeLease) DeepCopyObject() runtime.Object {
+	out := *l
+	l.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	return &out
+}
+
+type kubeLeaseList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []kubeLease `json:"items"`
+}
+
+// leaseDurationSeconds converts the ttl to the lease duration seconds
+// (rounded up, at least 1)
+func leaseDurationSeconds(ttl time.Duration) int32 {
+	s := int32(math.Ceil(ttl.Seconds()))
+	if s < 1 {
+		s = 1
+	}
+	return s
+}
+
+// kubeLeases is a client of the leases of a namespace
+type kubeLeases struct {
+	client    rest.Interface
+	namespace string
+}
+
+func newKubeLeases(client rest.Interface, namespace string) *kubeLeases {
+	return &kubeLeases{client: client, namespace: namespace}
+}
+
+func (c *kubeLeases) path(name ...string) []string {
+	return append([]string{kubeLeasesAPIPath, "namespaces", c.namespace, "leases"}, name...)
+}
+
+// do executes the request decoding the response in out. Not found and
+// conflict responses are returned as the related api errors.
+func (c *kubeLeases) do(req *rest.Request, name string, out interface{}) error {
+	var statusCode int
+	data, err := req.Do().StatusCode(&statusCode).Raw()
+	switch statusCode {
+	case http.StatusNotFound:
+		return apierrors.NewNotFound(kubeLeasesResource, name)
+	case http.StatusConflict:
+		return apierrors.NewConflict(kubeLeasesResource, name, err)
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (c *kubeLeases) get(name string) (*kubeLease, error) {
+	var l *kubeLease
+	if err := c.do(c.client.Get().AbsPath(c.path(name)...), name, &l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (c *kubeLeases) list(selector string) ([]kubeLease, error) {
+	var ll *kubeLeaseList
+	if err := c.do(c.client.Get().AbsPath(c.path()...).Param("labelSelector", selector), "", &ll); err != nil {
+		return nil, err
+	}
+	return ll.Items, nil
+}
+
+func (c *kubeLeases) write(req *rest.Request, l *kubeLease) (*kubeLease, error) {
+	nl := *l
+	nl.TypeMeta = kubeLeaseTypeMeta
+	nl.Namespace = c.namespace
+	data, err := json.Marshal(&nl)
+	if err != nil {
+		return nil, err
+	}
+	var out *kubeLease
+	if err := c.do(req.SetHeader("Content-Type", "application/json").Body(data), l.Name, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *kubeLeases) create(l *kubeLease) (*kubeLease, error) {
+	return c.write(c.client.Post().AbsPath(c.path()...), l)
+}
+
+// update updates the lease. It fails with a conflict error if the lease has
+// been updated after l has been read.
+func (c *kubeLeases) update(l *kubeLease) (*kubeLease, error) {
+	return c.write(c.client.Put().AbsPath(c.path(l.Name)...), l)
+}
+
+// kubeLeaseLock is a leader election resource lock using a lease
+type kubeLeaseLock struct {
+	leases   *kubeLeases
+	name     string
+	identity string
+	recorder record.EventRecorder
+
+	// lease is the last read or written lease
+	lease *kubeLease
+}
+
+func newKubeLeaseLock(leases *kubeLeases, name, identity string, recorder record.EventRecorder) *kubeLeaseLock {
+	return &kubeLeaseLock{
+		leases:   leases,
+		name:     name,
+		identity: identity,
+		recorder: recorder,
+	}
+}
+
+func leaseToRecord(spec *kubeLeaseSpec) *resourcelock.LeaderElectionRecord {
+	return &resourcelock.LeaderElectionRecord{
+		HolderIdentity:       spec.HolderIdentity,
+		LeaseDurationSeconds: int(spec.LeaseDurationSeconds),
+		AcquireTime:          metav1.NewTime(spec.AcquireTime.Time),
+		RenewTime:            metav1.NewTime(spec.RenewTime.Time),
+		LeaderTransitions:    int(spec.LeaseTransitions),
+	}
+}
+
+func recordToLease(ler *resourcelock.LeaderElectionRecord) kubeLeaseSpec {
+	return kubeLeaseSpec{
+		HolderIdentity:       ler.HolderIdentity,
+		LeaseDurationSeconds: int32(ler.LeaseDurationSeconds),
+		AcquireTime:          metav1.NewMicroTime(ler.AcquireTime.Time),
+		RenewTime:            metav1.NewMicroTime(ler.RenewTime.Time),
+		LeaseTransitions:     int32(ler.LeaderTransitions),
+	}
+}
+
+func (l *kubeLeaseLock) Get() (*resourcelock.LeaderElectionRecord, error) {
+	lease, err := l.leases.get(l.name)
+	if err != nil {
+		return nil, err
+	}
+	l.lease = lease
+	return leaseToRecord(&lease.Spec), nil
+}
+
+func (l *kubeLeaseLock) Create(ler resourcelock.LeaderElectionRecord) error {
+	lease, err := l.leases.create(&kubeLease{
+		ObjectMeta: metav1.ObjectMeta{Name: l.name},
+		Spec:       recordToLease(&ler),
+	})
+	if err != nil {
+		return err
+	}
+	l.lease = lease
+	return nil
+}
+
+func (l *kubeLeaseLock) Update(ler resourcelock.LeaderElectionRecord) error {
+	if l.lease == nil {
+		return fmt.Errorf("lease not initialized, call get or create first")
+	}
+	nl := *l.lease
+	nl.Spec = recordToLease(&ler)
+	lease, err := l.leases.update(&nl)
+	if err != nil {
+		return err
+	}
+	l.lease = lease
+	return nil
+}
+
+func (l *kubeLeaseLock) RecordEvent(s string) {
+	if l.recorder == nil || l.lease == nil {
+		return
+	}
+	l.recorder.Eventf(&kubeLease{TypeMeta: kubeLeaseTypeMeta, ObjectMeta: l.lease.ObjectMeta}, v1.EventTypeNormal, "LeaderElection", "%v %v", l.identity, s)
+}
+
+func (l *kubeLeaseLock) Identity() string {
+	return l.identity
+}
+
+func (l *kubeLeaseLock) Describe() string {
+	return fmt.Sprintf("%v/%v", l.leases.namespace, l.name)
+}
@@ -0,0 +1,239 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// testLeasesServer is a fake api server handling the leases of a namespace
+type testLeasesServer struct {
+	mutex   sync.Mutex
+	leases  map[string]*kubeLease
+	version int
+}
+
+func (s *testLeasesServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	prefix := kubeLeasesAPIPath + "/namespaces/ns1/leases"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+
+	var in *kubeLease
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	var out interface{}
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		selector, err := labels.Parse(r.URL.Query().Get("labelSelector"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		ll := &kubeLeaseList{TypeMeta: metav1.TypeMeta{APIVersion: "coordination.k8s.io/v1", Kind: "LeaseList"}, Items: []kubeLease{}}
+		for _, l := range s.leases {
+			if selector.Matches(labels.Set(l.Labels)) {
+				ll.Items = append(ll.Items, *l)
+			}
+		}
+		out = ll
+	case r.Method == http.MethodGet:
+		l, ok := s.leases[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		out = l
+	case r.Method == http.MethodPost:
+		if _, ok := s.leases[in.Name]; ok {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		s.version++
+		in.ResourceVersion = strconv.Itoa(s.version)
+		s.leases[in.Name] = in
+		out = in
+	case r.Method == http.MethodPut:
+		l, ok := s.leases[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if l.ResourceVersion != in.ResourceVersion {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		s.version++
+		in.ResourceVersion = strconv.Itoa(s.version)
+		s.leases[name] = in
+		out = in
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+func newTestKubeLeases(t *testing.T) (*kubeLeases, func()) {
+	ts := httptest.NewServer(&testLeasesServer{leases: map[string]*kubeLease{}})
+	client, err := rest.RESTClientFor(&rest.Config{
+		Host: ts.URL,
+		ContentConfig: rest.ContentConfig{
+			GroupVersion:         &v1.SchemeGroupVersion,
+			NegotiatedSerializer: scheme.Codecs,
+		},
+	})
+	if err != nil {
+		ts.Close()
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return newKubeLeases(client, "ns1"), ts.Close
+}
+
+func TestKubeLeaseLock(t *testing.T) {
+	leases, closeFn := newTestKubeLeases(t)
+	defer closeFn()
+
+	l1 := newKubeLeaseLock(leases, "lease1", "sentinel1", nil)
+	l2 := newKubeLeaseLock(leases, "lease1", "sentinel2", nil)
+
+	if _, err := l1.Get(); !apierrors.IsNotFound(err) {
+		t.Fatalf("got error: %v, want a not found error", err)
+	}
+
+	now := time.Now()
+	ler := resourcelock.LeaderElectionRecord{
+		HolderIdentity:       "sentinel1",
+		LeaseDurationSeconds: 15,
+		AcquireTime:          metav1.NewTime(now),
+		RenewTime:            metav1.NewTime(now),
+	}
+	if err := l1.Create(ler); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := l2.Create(ler); err == nil {
+		t.Fatalf("got no error creating an existing lease")
+	}
+
+	got, err := l2.Get()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.HolderIdentity != "sentinel1" || got.LeaseDurationSeconds != 15 || got.LeaderTransitions != 0 {
+		t.Errorf("got record: %+v, want: %+v", got, ler)
+	}
+	// the lease times have microseconds precision
+	if !got.RenewTime.Time.Equal(now.Truncate(time.Microsecond)) {
+		t.Errorf("got renew time: %v, want: %v", got.RenewTime, now.Truncate(time.Microsecond))
+	}
+
+	// renew the lease with the first lock, the update of the second one
+	// (based on the previous lease version) must fail
+	ler.RenewTime = metav1.NewTime(now.Add(2 * time.Second))
+	if err := l1.Update(ler); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ler2 := ler
+	ler2.HolderIdentity = "sentinel2"
+	ler2.LeaderTransitions = 1
+	if err := l2.Update(ler2); !apierrors.IsConflict(err) {
+		t.Fatalf("got error: %v, want a conflict error", err)
+	}
+	if _, err := l2.Get(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := l2.Update(ler2); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, err = l1.Get()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.HolderIdentity != "sentinel2" || got.LeaderTransitions != 1 {
+		t.Errorf("got record: %+v, want: %+v", got, ler2)
+	}
+}
+
+func TestKubeLeasesList(t *testing.T) {
+	leases, closeFn := newTestKubeLeases(t)
+	defer closeFn()
+
+	s := &KubeStore{clusterName: "cluster1"}
+	for _, l := range []*kubeLease{
+		{ObjectMeta: metav1.ObjectMeta{Name: "keeper0", Labels: s.componentLabels(KeeperLabelValue)}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "keeper1", Labels: s.componentLabels(KeeperLabelValue)}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "proxy0", Labels: s.componentLabels(ProxyLabelValue)}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "other"}},
+	} {
+		if _, err := leases.create(l); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	ll, err := leases.list(s.labelSelector(KeeperLabelValue).String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	names := map[string]bool{}
+	for _, l := range ll {
+		names[l.Name] = true
+	}
+	if len(names) != 2 || !names["keeper0"] || !names["keeper1"] {
+		t.Errorf("got leases: %v, want: [keeper0 keeper1]", names)
+	}
+}
+
+func TestLeaseDurationSeconds(t *testing.T) {
+	tests := []struct {
+		ttl time.Duration
+		s   int32
+	}{
+		{ttl: 0, s: 1},
+		{ttl: 500 * time.Millisecond, s: 1},
+		{ttl: 20 * time.Second, s: 20},
+		{ttl: 20*time.Second + time.Millisecond, s: 21},
+	}
+	for i, tt := range tests {
+		if s := leaseDurationSeconds(tt.ttl); s != tt.s {
+			t.Errorf("#%d: got %d, want: %d", i, s, tt.s)
+		}
+	}
+}
@@ -40,6 +40,8 @@ const (
 	CONSUL Backend = "consul"
 	ETCDV2 Backend = "etcdv2"
 	ETCDV3 Backend = "etcdv3"
+
+	ZOOKEEPER Backend = "zookeeper"
 )
 
 const (
@@ -47,6 +49,8 @@ const (
 
 	keepersInfoDir         = "/keepers/info/"
 	clusterDataFile        = "clusterdata"
+	eventsFile             = "events"
+	specHistoryFile        = "spechistory"
 	leaderSentinelInfoFile = "/sentinels/leaderinfo"
 	sentinelsInfoDir       = "/sentinels/info/"
 	proxiesInfoDir         = "/proxies/info/"
@@ -55,6 +59,8 @@ const (
 const (
 	DefaultEtcdEndpoints   = "http://127.0.0.1:2379"
 	DefaultConsulEndpoints = "http://127.0.0.1:8500"
+
+	DefaultZookeeperEndpoints = "127.0.0.1:2181"
 )
 
 const (
@@ -73,6 +79,20 @@ type Config struct {
 	KeyFile       string
 	CAFile        string
 	SkipTLSVerify bool
+	// RequestTimeout is the timeout of a store request. When 0
+	// cluster.DefaultStoreTimeout is used.
+	RequestTimeout time.Duration
+	// DialTimeout is the timeout for establishing a connection to the
+	// store (only used by etcdv3). When 0 there's no timeout.
+	DialTimeout time.Duration
+	// ConsulNamespace is the consul namespace (consul enterprise) of the
+	// keys
+	ConsulNamespace string
+	// ConsulTokenFile is a file containing the consul acl token. It's
+	// reloaded on SIGHUP and every ConsulTokenReloadInterval (when greater
+	// than 0).
+	ConsulTokenFile           string
+	ConsulTokenReloadInterval time.Duration
 }
 
 // KVPair represents {Key, Value, Lastindex} tuple
@@ -106,14 +126,35 @@ type KVStore interface {
 	Close() error
 }
 
+// BatchKVStore is a KVStore that is able to execute multiple list
+// operations in a single store request.
+type BatchKVStore interface {
+	KVStore
+
+	// ListMulti lists the content of the given prefixes in a single request.
+	// All the returned pairs are read from the same store revision so they
+	// report a consistent snapshot of the store.
+	ListMulti(ctx context.Context, directories []string) ([][]*KVPair, error)
+}
+
+// WatchKVStore is a KVStore that is able to watch a key for changes.
+type WatchKVStore interface {
+	KVStore
+
+	// Watch sends the pair at the provided key every time it changes (a
+	// pair with a nil value when the key is deleted). The returned channel
+	// is closed when the context is done or the watch fails.
+	Watch(ctx context.Context, key string) (<-chan *KVPair, error)
+}
+
 func NewKVStore(cfg Config) (KVStore, error) {
 	var kvBackend libkvstore.Backend
 	switch cfg.Backend {
 	case CONSUL:
-		kvBackend = libkvstore.CONSUL
 	case ETCDV2:
 		kvBackend = libkvstore.ETCD
 	case ETCDV3:
+	case ZOOKEEPER:
 	default:
 		return nil, fmt.Errorf("Unknown store backend: %q", cfg.Backend)
 	}
@@ -125,57 +166,88 @@ func NewKVStore(cfg Config) (KVStore, error) {
 			endpointsStr = DefaultConsulEndpoints
 		case ETCDV2, ETCDV3:
 			endpointsStr = DefaultEtcdEndpoints
+		case ZOOKEEPER:
+			endpointsStr = DefaultZookeeperEndpoints
+		}
+	}
+	srv, err := parseSRVEndpoints(endpointsStr)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []string
+	if srv != nil {
+		endpoints, err = srv.resolve()
+		if err != nil {
+			return nil, err
 		}
+	} else {
+		endpoints = strings.Split(endpointsStr, ",")
 	}
-	endpoints := strings.Split(endpointsStr, ",")
 
-	// 1) since libkv wants endpoints as a list of IP and not URLs but we
-	// want to also support them then parse and strip them
-	// 2) since libkv will enable TLS for all endpoints when config.TLS
-	// isn't nil we have to check that all the endpoints have the same
-	// scheme
-	addrs := []string{}
-	var scheme string
-	for _, e := range endpoints {
-		var curscheme, addr string
-		if URLSchemeRegexp.Match([]byte(e)) {
-			u, err := url.Parse(e)
-			if err != nil {
-				return nil, fmt.Errorf("cannot parse endpoint %q: %v", e, err)
+	requestTimeout := cfg.RequestTimeout
+	if requestTimeout == 0 {
+		requestTimeout = cluster.DefaultStoreTimeout
+	}
+
+	// zookeeper endpoints are host:port addresses without a scheme
+	if cfg.Backend == ZOOKEEPER {
+		for _, e := range endpoints {
+			if URLSchemeRegexp.Match([]byte(e)) {
+				return nil, fmt.Errorf("zookeeper endpoint %q must be an address without a scheme", e)
 			}
-			curscheme = u.Scheme
-			addr = u.Host
-		} else {
-			// Assume it's a schemeless endpoint
-			curscheme = "http"
-			addr = e
 		}
-		if scheme == "" {
-			scheme = curscheme
-		}
-		if scheme != curscheme {
-			return nil, fmt.Errorf("all the endpoints must have the same scheme")
+		store, err := newZookeeperStore(endpoints, requestTimeout)
+		if err != nil {
+			return nil, err
 		}
-		addrs = append(addrs, addr)
+		return store, nil
 	}
 
-	var tlsConfig *tls.Config
-	if scheme != "http" && scheme != "https" {
-		return nil, fmt.Errorf("endpoints scheme must be http or https")
+	scheme, addrs, err := parseEndpoints(endpoints)
+	if err != nil {
+		return nil, err
 	}
+
+	var tlsConfig *tls.Config
+	var serverNames *tlsServerNames
 	if scheme == "https" {
 		var err error
-		tlsConfig, err = common.NewTLSConfig(cfg.CertFile, cfg.KeyFile, cfg.CAFile, cfg.SkipTLSVerify)
+		tlsConfig, err = common.NewTLSConfig("", "", "", cfg.SkipTLSVerify)
 		if err != nil {
 			return nil, fmt.Errorf("cannot create store tls config: %v", err)
 		}
+		// reload the CA when rotated
+		if cfg.CAFile != "" && !cfg.SkipTLSVerify {
+			r, err := common.NewCAReloader(cfg.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("cannot create store tls config: %v", err)
+			}
+			serverNames = newTLSServerNames(addrs)
+			// the server certificate is verified by VerifyPeerCertificate
+			tlsConfig.InsecureSkipVerify = true
+			tlsConfig.VerifyPeerCertificate = r.VerifyPeerCertificate(serverNames.get)
+		}
+		// reload the client certificate when renewed
+		if cfg.CertFile != "" && cfg.KeyFile != "" {
+			r, err := common.NewCertReloader(cfg.CertFile, cfg.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("cannot create store tls config: %v", err)
+			}
+			tlsConfig.GetClientCertificate = r.GetClientCertificate
+		}
 	}
 
 	switch cfg.Backend {
-	case CONSUL, ETCDV2:
+	case CONSUL:
+		config := &libkvstore.Config{
+			TLS:               tlsConfig,
+			ConnectionTimeout: requestTimeout,
+		}
+		return newConsulStore(addrs, config, cfg)
+	case ETCDV2:
 		config := &libkvstore.Config{
 			TLS:               tlsConfig,
-			ConnectionTimeout: cluster.DefaultStoreTimeout,
+			ConnectionTimeout: requestTimeout,
 		}
 
 		store, err := libkv.NewStore(kvBackend, addrs, config)
@@ -185,23 +257,79 @@ func NewKVStore(cfg Config) (KVStore, error) {
 		return &libKVStore{store: store}, nil
 	case ETCDV3:
 		config := etcdclientv3.Config{
-			Endpoints: addrs,
-			TLS:       tlsConfig,
+			Endpoints:   addrs,
+			TLS:         tlsConfig,
+			DialTimeout: cfg.DialTimeout,
 		}
 
 		c, err := etcdclientv3.New(config)
 		if err != nil {
 			return nil, err
 		}
-		return &etcdV3Store{c: c, requestTimeout: cluster.DefaultStoreTimeout}, nil
+		s := &etcdV3Store{c: c, requestTimeout: requestTimeout}
+		// update the client endpoints when the SRV record targets change
+		if srv != nil {
+			ctx, cancel := context.WithCancel(context.Background())
+			s.cancel = cancel
+			go srv.watch(ctx, srvResolveInterval, addrs, func(addrs []string) {
+				if serverNames != nil {
+					serverNames.set(addrs)
+				}
+				c.SetEndpoints(addrs...)
+			})
+		}
+		return s, nil
 	default:
 		return nil, fmt.Errorf("Unknown store backend: %q", cfg.Backend)
 	}
 }
 
+// parseEndpoints returns the scheme and the addresses of the endpoints.
+//
+// 1) since libkv wants endpoints as a list of IP and not URLs but we
+// want to also support them then parse and strip them
+// 2) since libkv will enable TLS for all endpoints when config.TLS
+// isn't nil we have to check that all the endpoints have the same
+// scheme
+func parseEndpoints(endpoints []string) (string, []string, error) {
+	addrs := []string{}
+	var scheme string
+	for _, e := range endpoints {
+		var curscheme, addr string
+		if URLSchemeRegexp.Match([]byte(e)) {
+			u, err := url.Parse(e)
+			if err != nil {
+				return "", nil, fmt.Errorf("cannot parse endpoint %q: %v", e, err)
+			}
+			curscheme = u.Scheme
+			addr = u.Host
+		} else {
+			// Assume it's a schemeless endpoint
+			curscheme = "http"
+			addr = e
+		}
+		if scheme == "" {
+			scheme = curscheme
+		}
+		if scheme != curscheme {
+			return "", nil, fmt.Errorf("all the endpoints must have the same scheme")
+		}
+		addrs = append(addrs, addr)
+	}
+	if scheme != "http" && scheme != "https" {
+		return "", nil, fmt.Errorf("endpoints scheme must be http or https")
+	}
+	return scheme, addrs, nil
+}
+
 type KVBackedStore struct {
 	clusterPath string
 	store       KVStore
+
+	cdEncoding ClusterDataEncoding
+	// chunksMayExist is 1 when a chunked cluster data has been read or
+	// written, so its chunks must be removed when writing a not chunked one
+	chunksMayExist int32
 }
 
 func NewKVBackedStore(kvStore KVStore, path string) *KVBackedStore {
@@ -211,6 +339,12 @@ func NewKVBackedStore(kvStore KVStore, path string) *KVBackedStore {
 	}
 }
 
+// Close closes the kv store. It must be called only when the kv store isn't
+// shared with other stores.
+func (s *KVBackedStore) Close() error {
+	return s.store.Close()
+}
+
 func (s *KVBackedStore) AtomicPutClusterData(ctx context.Context, cd *cluster.ClusterData, previous *KVPair) (*KVPair, error) {
 	cdj, err := json.Marshal(cd)
 	if err != nil {
@@ -226,7 +360,9 @@ func (s *KVBackedStore) AtomicPutClusterData(ctx context.Context, cd *cluster.Cl
 			LastIndex: previous.LastIndex,
 		}
 	}
-	return s.store.AtomicPut(ctx, path, cdj, prev, nil)
+	return s.putClusterData(ctx, cdj, func(value []byte) (*KVPair, error) {
+		return s.store.AtomicPut(ctx, path, value, prev, nil)
+	})
 }
 
 func (s *KVBackedStore) PutClusterData(ctx context.Context, cd *cluster.ClusterData) error {
@@ -235,23 +371,119 @@ func (s *KVBackedStore) PutClusterData(ctx context.Context, cd *cluster.ClusterD
 		return err
 	}
 	path := filepath.Join(s.clusterPath, clusterDataFile)
-	return s.store.Put(ctx, path, cdj, nil)
+	_, err = s.putClusterData(ctx, cdj, func(value []byte) (*KVPair, error) {
+		return nil, s.store.Put(ctx, path, value, nil)
+	})
+	return err
 }
 
 func (s *KVBackedStore) GetClusterData(ctx context.Context) (*cluster.ClusterData, *KVPair, error) {
 	var cd *cluster.ClusterData
 	path := filepath.Join(s.clusterPath, clusterDataFile)
-	pair, err := s.store.Get(ctx, path)
+	for i := 0; ; i++ {
+		pair, err := s.store.Get(ctx, path)
+		if err != nil {
+			if err != ErrKeyNotFound {
+				return nil, nil, err
+			}
+			return nil, nil, nil
+		}
+		cdj, err := s.decodeClusterData(ctx, pair.Value)
+		if err != nil {
+			// the chunks have been replaced by a concurrent write, read
+			// again the cluster data
+			if err == ErrKeyNotFound && i < maxChunkedClusterDataReads {
+				continue
+			}
+			if err == ErrKeyNotFound {
+				return nil, nil, fmt.Errorf("missing cluster data chunk")
+			}
+			return nil, nil, err
+		}
+		if err := json.Unmarshal(cdj, &cd); err != nil {
+			return nil, nil, err
+		}
+		return cd, pair, nil
+	}
+}
+
+func (s *KVBackedStore) Watch(ctx context.Context) <-chan *KVPair {
+	ws, ok := s.store.(WatchKVStore)
+	if !ok {
+		// the store cannot watch the cluster data, just close the channel
+		// when done
+		ch := make(chan *KVPair)
+		go func() {
+			<-ctx.Done()
+			close(ch)
+		}()
+		return ch
+	}
+	path := filepath.Join(s.clusterPath, clusterDataFile)
+	return watchLoop(ctx, func(ctx context.Context) (<-chan *KVPair, error) {
+		return ws.Watch(ctx, path)
+	})
+}
+
+// atomicUpdate replaces the value of the key with the one returned by
+// updateFn (called with the current value, nil if the key doesn't exist),
+// retrying if the key has been modified in the meantime
+func (s *KVBackedStore) atomicUpdate(ctx context.Context, path string, updateFn func(data []byte) ([]byte, error)) error {
+	for {
+		var data []byte
+		var prev *KVPair
+		pair, err := s.store.Get(ctx, path)
+		if err != nil && err != ErrKeyNotFound {
+			return err
+		}
+		if pair != nil {
+			data = pair.Value
+			prev = &KVPair{Key: pair.Key, LastIndex: pair.LastIndex}
+		}
+		newData, err := updateFn(data)
+		if err != nil {
+			return err
+		}
+		if _, err := s.store.AtomicPut(ctx, path, newData, prev, nil); err != ErrKeyModified {
+			return err
+		}
+	}
+}
+
+func (s *KVBackedStore) AppendEvent(ctx context.Context, ev *cluster.Event, max int) error {
+	// the events could be appended also by a previous leader sentinel
+	return s.atomicUpdate(ctx, filepath.Join(s.clusterPath, eventsFile), func(data []byte) ([]byte, error) {
+		return appendEvent(data, ev, max)
+	})
+}
+
+func (s *KVBackedStore) GetEvents(ctx context.Context) ([]*cluster.Event, error) {
+	pair, err := s.store.Get(ctx, filepath.Join(s.clusterPath, eventsFile))
 	if err != nil {
 		if err != ErrKeyNotFound {
-			return nil, nil, err
+			return nil, err
 		}
-		return nil, nil, nil
+		return []*cluster.Event{}, nil
 	}
-	if err := json.Unmarshal(pair.Value, &cd); err != nil {
-		return nil, nil, err
+	return parseEvents(pair.Value)
+}
+
+func (s *KVBackedStore) AppendSpecChange(ctx context.Context, c *cluster.SpecChange, max int) error {
+	// the cluster spec could be changed concurrently by multiple stolonctl
+	return s.atomicUpdate(ctx, filepath.Join(s.clusterPath, specHistoryFile), func(data []byte) ([]byte, error) {
+		return appendSpecChange(data, c, max)
+	})
+}
+
+func (s *KVBackedStore) GetSpecHistory(ctx context.Context) ([]*cluster.SpecChange, error) {
+	pair, err := s.store.Get(ctx, filepath.Join(s.clusterPath, specHistoryFile))
+	if err != nil {
+		if err != ErrKeyNotFound {
+			return nil, err
+		}
+		return []*cluster.SpecChange{}, nil
 	}
-	return cd, pair, nil
+	return parseSpecHistory(pair.Value)
 }
 
 func (s *KVBackedStore) SetKeeperInfo(ctx context.Context, id string, ms *cluster.KeeperInfo, ttl time.Duration) error {
@@ -266,17 +498,21 @@ func (s *KVBackedStore) SetKeeperInfo(ctx context.Context, id string, ms *cluste
 }
 
 func (s *KVBackedStore) GetKeepersInfo(ctx context.Context) (cluster.KeepersInfo, error) {
-	keepers := cluster.KeepersInfo{}
 	pairs, err := s.store.List(ctx, filepath.Join(s.clusterPath, keepersInfoDir))
 	if err != nil {
 		if err != ErrKeyNotFound {
 			return nil, err
 		}
-		return keepers, nil
+		return cluster.KeepersInfo{}, nil
 	}
+	return keepersInfoFromPairs(pairs)
+}
+
+func keepersInfoFromPairs(pairs []*KVPair) (cluster.KeepersInfo, error) {
+	keepers := cluster.KeepersInfo{}
 	for _, pair := range pairs {
 		var ki cluster.KeeperInfo
-		err = json.Unmarshal(pair.Value, &ki)
+		err := json.Unmarshal(pair.Value, &ki)
 		if err != nil {
 			return nil, err
 		}
@@ -328,17 +564,21 @@ func (s *KVBackedStore) SetProxyInfo(ctx context.Context, pi *cluster.ProxyInfo,
 }
 
 func (s *KVBackedStore) GetProxiesInfo(ctx context.Context) (cluster.ProxiesInfo, error) {
-	psi := cluster.ProxiesInfo{}
 	pairs, err := s.store.List(ctx, filepath.Join(s.clusterPath, proxiesInfoDir))
 	if err != nil {
 		if err != ErrKeyNotFound {
 			return nil, err
 		}
-		return psi, nil
+		return cluster.ProxiesInfo{}, nil
 	}
+	return proxiesInfoFromPairs(pairs)
+}
+
+func proxiesInfoFromPairs(pairs []*KVPair) (cluster.ProxiesInfo, error) {
+	psi := cluster.ProxiesInfo{}
 	for _, pair := range pairs {
 		var pi cluster.ProxyInfo
-		err = json.Unmarshal(pair.Value, &pi)
+		err := json.Unmarshal(pair.Value, &pi)
 		if err != nil {
 			return nil, err
 		}
@@ -347,11 +587,55 @@ func (s *KVBackedStore) GetProxiesInfo(ctx context.Context) (cluster.ProxiesInfo
 	return psi, nil
 }
 
-func NewKVBackedElection(kvStore KVStore, path, candidateUID string) Election {
+// GetKeepersAndProxiesInfo returns both the keepers and the proxies info. If
+// the underlying kv store supports batched operations they are read with a
+// single store request from the same store revision, otherwise it falls back
+// to reading them separately.
+func (s *KVBackedStore) GetKeepersAndProxiesInfo(ctx context.Context) (cluster.KeepersInfo, cluster.ProxiesInfo, error) {
+	bs, ok := s.store.(BatchKVStore)
+	if !ok {
+		keepersInfo, err := s.GetKeepersInfo(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		proxiesInfo, err := s.GetProxiesInfo(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		return keepersInfo, proxiesInfo, nil
+	}
+
+	res, err := bs.ListMulti(ctx, []string{
+		filepath.Join(s.clusterPath, keepersInfoDir),
+		filepath.Join(s.clusterPath, proxiesInfoDir),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(res) != 2 {
+		return nil, nil, fmt.Errorf("wrong number of batched list results: %d", len(res))
+	}
+	keepersInfo, err := keepersInfoFromPairs(res[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	proxiesInfo, err := proxiesInfoFromPairs(res[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	return keepersInfo, proxiesInfo, nil
+}
+
+// NewKVBackedElection creates an election using the provided ttl as the
+// leadership lease. When ttl is 0 MinTTL is used.
+func NewKVBackedElection(kvStore KVStore, path, candidateUID string, ttl time.Duration) Election {
+	if ttl == 0 {
+		ttl = MinTTL
+	}
 	switch kvStore.(type) {
 	case *libKVStore:
 		s := kvStore.(*libKVStore)
-		candidate := leadership.NewCandidate(s.store, path, candidateUID, MinTTL)
+		candidate := leadership.NewCandidate(s.store, path, candidateUID, ttl)
 		return &libkvElection{store: s, path: path, candidate: candidate}
 	case *etcdV3Store:
 		etcdV3Store := kvStore.(*etcdV3Store)
@@ -359,8 +643,15 @@ func NewKVBackedElection(kvStore KVStore, path, candidateUID string) Election {
 			c:              etcdV3Store.c,
 			path:           path,
 			candidateUID:   candidateUID,
-			ttl:            MinTTL,
-			requestTimeout: cluster.DefaultStoreTimeout,
+			ttl:            ttl,
+			requestTimeout: etcdV3Store.requestTimeout,
+		}
+	case *zookeeperStore:
+		// the election lease is the zookeeper session so ttl isn't used
+		return &zookeeperElection{
+			s:            kvStore.(*zookeeperStore),
+			path:         path,
+			candidateUID: candidateUID,
 		}
 	default:
 		panic("unknown kvstore")
@@ -0,0 +1,344 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+)
+
+// memKVStore is a simple in memory KVStore used for tests. It counts the
+// number of requests done to the store.
+type memKVStore struct {
+	kvs      map[string][]byte
+	requests int
+}
+
+func newMemKVStore() *memKVStore {
+	return &memKVStore{kvs: map[string][]byte{}}
+}
+
+func (s *memKVStore) Put(ctx context.Context, key string, value []byte, options *WriteOptions) error {
+	s.requests++
+	s.kvs[key] = value
+	return nil
+}
+
+func (s *memKVStore) Get(ctx context.Context, key string) (*KVPair, error) {
+	s.requests++
+	v, ok := s.kvs[key]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return &KVPair{Key: key, Value: v}, nil
+}
+
+func (s *memKVStore) list(directory string) []*KVPair {
+	keys := []string{}
+	for k := range s.kvs {
+		if strings.HasPrefix(k, directory) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	pairs := []*KVPair{}
+	for _, k := range keys {
+		pairs = append(pairs, &KVPair{Key: k, Value: s.kvs[k]})
+	}
+	return pairs
+}
+
+func (s *memKVStore) List(ctx context.Context, directory string) ([]*KVPair, error) {
+	s.requests++
+	return s.list(directory), nil
+}
+
+func (s *memKVStore) AtomicPut(ctx context.Context, key string, value []byte, previous *KVPair, options *WriteOptions) (*KVPair, error) {
+	s.requests++
+	s.kvs[key] = value
+	return &KVPair{Key: key, Value: value}, nil
+}
+
+func (s *memKVStore) Delete(ctx context.Context, key string) error {
+	s.requests++
+	delete(s.kvs, key)
+	return nil
+}
+
+func (s *memKVStore) Close() error {
+	return nil
+}
+
+// memBatchKVStore is a memKVStore also implementing BatchKVStore
+type memBatchKVStore struct {
+	*memKVStore
+}
+
+func (s *memBatchKVStore) ListMulti(ctx context.Context, directories []string) ([][]*KVPair, error) {
+	s.requests++
+	res := make([][]*KVPair, len(directories))
+	for i, d := range directories {
+		res[i] = s.list(d)
+	}
+	return res, nil
+}
+
+func populateKVBackedStore(t testing.TB, s *KVBackedStore, keepers, proxies int) (cluster.KeepersInfo, cluster.ProxiesInfo) {
+	keepersInfo := cluster.KeepersInfo{}
+	proxiesInfo := cluster.ProxiesInfo{}
+	for i := 0; i < keepers; i++ {
+		ki := &cluster.KeeperInfo{UID: fmt.Sprintf("keeper%03d", i), ClusterUID: "cluster1"}
+		if err := s.SetKeeperInfo(context.TODO(), ki.UID, ki, MinTTL); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		keepersInfo[ki.UID] = ki
+	}
+	for i := 0; i < proxies; i++ {
+		pi := &cluster.ProxyInfo{UID: fmt.Sprintf("proxy%03d", i), Generation: 1}
+		if err := s.SetProxyInfo(context.TODO(), pi, MinTTL); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		proxiesInfo[pi.UID] = pi
+	}
+	return keepersInfo, proxiesInfo
+}
+
+// memWatchKVStore is a memKVStore also implementing WatchKVStore. The
+// watches receive the pairs sent to watchCh.
+type memWatchKVStore struct {
+	*memKVStore
+	watchCh chan *KVPair
+	keys    chan string
+}
+
+func (s *memWatchKVStore) Watch(ctx context.Context, key string) (<-chan *KVPair, error) {
+	s.keys <- key
+	return s.watchCh, nil
+}
+
+func TestWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &memWatchKVStore{memKVStore: newMemKVStore(), watchCh: make(chan *KVPair), keys: make(chan string, 1)}
+	kvs := NewKVBackedStore(s, "/stolon/cluster/c1")
+	ch := kvs.Watch(ctx)
+
+	if key := <-s.keys; key != "/stolon/cluster/c1/clusterdata" {
+		t.Fatalf("watching wrong key: %s", key)
+	}
+	s.watchCh <- &KVPair{Value: []byte("cd1")}
+	s.watchCh <- &KVPair{Value: []byte("cd2")}
+	// a pair is kept in the channel until received
+	time.Sleep(10 * time.Millisecond)
+	pair := <-ch
+	if string(pair.Value) != "cd2" {
+		t.Errorf("got pair value %q, want: %q", pair.Value, "cd2")
+	}
+	cancel()
+	close(s.watchCh)
+	for range ch {
+	}
+
+	// without a watching store the channel is only closed
+	ctx, cancel = context.WithCancel(context.Background())
+	ch = NewKVBackedStore(newMemKVStore(), "/stolon/cluster/c1").Watch(ctx)
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Errorf("got a pair from a not watching store")
+	}
+}
+
+func TestGetKeepersAndProxiesInfo(t *testing.T) {
+	tests := []struct {
+		batch            bool
+		keepers          int
+		proxies          int
+		expectedRequests int
+	}{
+		{batch: false, keepers: 0, proxies: 0, expectedRequests: 2},
+		{batch: false, keepers: 10, proxies: 2, expectedRequests: 2},
+		{batch: true, keepers: 0, proxies: 0, expectedRequests: 1},
+		{batch: true, keepers: 10, proxies: 2, expectedRequests: 1},
+		{batch: true, keepers: 200, proxies: 0, expectedRequests: 1},
+	}
+
+	for i, tt := range tests {
+		mkv := newMemKVStore()
+		var kvStore KVStore = mkv
+		if tt.batch {
+			kvStore = &memBatchKVStore{mkv}
+		}
+		s := NewKVBackedStore(kvStore, "stolon/cluster/test")
+		expectedKeepersInfo, expectedProxiesInfo := populateKVBackedStore(t, s, tt.keepers, tt.proxies)
+		// add a sentinel info that must be ignored
+		if err := s.SetSentinelInfo(context.TODO(), &cluster.SentinelInfo{UID: "sentinel01"}, MinTTL); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		mkv.requests = 0
+		keepersInfo, proxiesInfo, err := s.GetKeepersAndProxiesInfo(context.TODO())
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if mkv.requests != tt.expectedRequests {
+			t.Errorf("#%d: wrong number of store requests: got: %d, want: %d", i, mkv.requests, tt.expectedRequests)
+		}
+		if !reflect.DeepEqual(keepersInfo, expectedKeepersInfo) {
+			t.Errorf("#%d: wrong keepers info: got: %v, want: %v", i, keepersInfo, expectedKeepersInfo)
+		}
+		if !reflect.DeepEqual(proxiesInfo, expectedProxiesInfo) {
+			t.Errorf("#%d: wrong proxies info: got: %v, want: %v", i, proxiesInfo, expectedProxiesInfo)
+		}
+	}
+}
+
+func benchmarkGetKeepersAndProxiesInfo(b *testing.B, batch bool) {
+	mkv := newMemKVStore()
+	var kvStore KVStore = mkv
+	if batch {
+		kvStore = &memBatchKVStore{mkv}
+	}
+	s := NewKVBackedStore(kvStore, "stolon/cluster/test")
+	populateKVBackedStore(b, s, 500, 10)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := s.GetKeepersAndProxiesInfo(context.TODO()); err != nil {
+			b.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func BenchmarkGetKeepersAndProxiesInfo(b *testing.B) {
+	benchmarkGetKeepersAndProxiesInfo(b, false)
+}
+
+func BenchmarkGetKeepersAndProxiesInfoBatched(b *testing.B) {
+	benchmarkGetKeepersAndProxiesInfo(b, true)
+}
+
+func TestEtcdV3Timeouts(t *testing.T) {
+	tests := []struct {
+		requestTimeout time.Duration
+		electionTTL    time.Duration
+
+		expectedRequestTimeout time.Duration
+		expectedElectionTTL    time.Duration
+	}{
+		// defaults
+		{
+			expectedRequestTimeout: cluster.DefaultStoreTimeout,
+			expectedElectionTTL:    MinTTL,
+		},
+		{
+			requestTimeout:         2 * time.Second,
+			electionTTL:            10 * time.Second,
+			expectedRequestTimeout: 2 * time.Second,
+			expectedElectionTTL:    10 * time.Second,
+		},
+	}
+
+	for i, tt := range tests {
+		kvStore, err := NewKVStore(Config{Backend: ETCDV3, Endpoints: "http://127.0.0.1:2379", RequestTimeout: tt.requestTimeout})
+		if err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		s := kvStore.(*etcdV3Store)
+		if s.requestTimeout != tt.expectedRequestTimeout {
+			t.Errorf("#%d: wrong request timeout: got: %s, want: %s", i, s.requestTimeout, tt.expectedRequestTimeout)
+		}
+		e := NewKVBackedElection(kvStore, "leader", "sentinel01", tt.electionTTL).(*etcdv3Election)
+		if e.ttl != tt.expectedElectionTTL {
+			t.Errorf("#%d: wrong election ttl: got: %s, want: %s", i, e.ttl, tt.expectedElectionTTL)
+		}
+		if e.requestTimeout != tt.expectedRequestTimeout {
+			t.Errorf("#%d: wrong election request timeout: got: %s, want: %s", i, e.requestTimeout, tt.expectedRequestTimeout)
+		}
+		kvStore.Close()
+	}
+}
+
+func TestEvents(t *testing.T) {
+	s := NewKVBackedStore(newMemKVStore(), "/stolon/cluster/cluster1")
+
+	events, err := s.GetEvents(context.TODO())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("got %d events, want: 0", len(events))
+	}
+
+	for i := 0; i < 5; i++ {
+		ev := &cluster.Event{Type: cluster.EventKeeperFailed, KeeperUID: fmt.Sprintf("keeper%d", i)}
+		if err := s.AppendEvent(context.TODO(), ev, 3); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	events, err = s.GetEvents(context.TODO())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out := []string{}
+	for _, ev := range events {
+		out = append(out, ev.KeeperUID)
+	}
+	// only the last events are kept
+	if expected := []string{"keeper2", "keeper3", "keeper4"}; !reflect.DeepEqual(out, expected) {
+		t.Errorf("wrong events: got: %v, want: %v", out, expected)
+	}
+}
+
+func TestSpecHistory(t *testing.T) {
+	s := NewKVBackedStore(newMemKVStore(), "/stolon/cluster/cluster1")
+
+	changes, err := s.GetSpecHistory(context.TODO())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(changes) != 0 {
+		t.Fatalf("got %d spec changes, want: 0", len(changes))
+	}
+
+	for i := 1; i <= 5; i++ {
+		c := &cluster.SpecChange{Generation: int64(i), Spec: &cluster.ClusterSpec{MaxStandbys: cluster.Uint16P(uint16(i))}}
+		if err := s.AppendSpecChange(context.TODO(), c, 3); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	changes, err = s.GetSpecHistory(context.TODO())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out := []int64{}
+	for _, c := range changes {
+		out = append(out, c.Generation)
+		if int64(*c.Spec.MaxStandbys) != c.Generation {
+			t.Errorf("generation %d: wrong spec maxStandbys: %d", c.Generation, *c.Spec.MaxStandbys)
+		}
+	}
+	// only the last changes are kept
+	if expected := []int64{3, 4, 5}; !reflect.DeepEqual(out, expected) {
+		t.Errorf("wrong spec history: got: %v, want: %v", out, expected)
+	}
+}
@@ -19,13 +19,11 @@ import (
 
 	"github.com/docker/leadership"
 	libkvstore "github.com/docker/libkv/store"
-	"github.com/docker/libkv/store/consul"
 	"github.com/docker/libkv/store/etcd"
 )
 
 func init() {
 	etcd.Register()
-	consul.Register()
 }
 
 func fromLibKVStoreErr(err error) error {
@@ -40,6 +38,9 @@ func fromLibKVStoreErr(err error) error {
 
 type libKVStore struct {
 	store libkvstore.Store
+
+	// cancel stops the consul token reload
+	cancel context.CancelFunc
 }
 
 func (s *libKVStore) Put(ctx context.Context, key string, value []byte, options *WriteOptions) error {
@@ -91,7 +92,59 @@ func (s *libKVStore) Delete(ctx context.Context, key string) error {
 	return fromLibKVStoreErr(s.store.Delete(key))
 }
 
+func (s *libKVStore) Watch(ctx context.Context, key string) (<-chan *KVPair, error) {
+	// the libkv watch first sends the current value, if any, so skip it
+	var lastIndex uint64
+	pair, err := s.store.Get(key)
+	if err != nil && err != libkvstore.ErrKeyNotFound {
+		return nil, fromLibKVStoreErr(err)
+	}
+	if pair != nil {
+		lastIndex = pair.LastIndex
+	}
+	stopCh := make(chan struct{})
+	lch, err := s.store.Watch(key, stopCh)
+	if err != nil {
+		close(stopCh)
+		return nil, fromLibKVStoreErr(err)
+	}
+	ch := make(chan *KVPair)
+	go func() {
+		defer close(ch)
+		defer func() {
+			close(stopCh)
+			// let the libkv watch goroutine exit
+			go func() {
+				for range lch {
+				}
+			}()
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case p, ok := <-lch:
+				if !ok {
+					return
+				}
+				if p.LastIndex == lastIndex {
+					continue
+				}
+				select {
+				case ch <- &KVPair{Key: key, Value: p.Value, LastIndex: p.LastIndex}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
 func (s *libKVStore) Close() error {
+	if s.cancel != nil {
+		s.cancel()
+	}
 	s.store.Close()
 	return nil
 }
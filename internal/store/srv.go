@@ -0,0 +1,110 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SRVEndpointsPrefix is the prefix of the store endpoints defined by
+	// a dns SRV record (i.e. srv:_etcd-client._tcp.example.com)
+	SRVEndpointsPrefix = "srv:"
+
+	// srvResolveInterval is the interval between the SRV record
+	// resolutions
+	srvResolveInterval = 1 * time.Minute
+)
+
+// lookupSRV is replaced in the tests
+var lookupSRV = net.LookupSRV
+
+// srvEndpoints is a dns SRV record whose targets are the store endpoints
+type srvEndpoints struct {
+	// scheme of the endpoints, empty for schemeless endpoints
+	scheme string
+	name   string
+}
+
+// parseSRVEndpoints parses the store endpoints in the form
+// srv:[scheme://]name. It returns nil when the endpoints aren't defined by a
+// SRV record.
+func parseSRVEndpoints(s string) (*srvEndpoints, error) {
+	if !strings.HasPrefix(s, SRVEndpointsPrefix) {
+		return nil, nil
+	}
+	e := &srvEndpoints{name: strings.TrimPrefix(s, SRVEndpointsPrefix)}
+	if m := URLSchemeRegexp.FindStringSubmatch(e.name); m != nil {
+		e.scheme = m[1]
+		e.name = strings.TrimPrefix(e.name, m[0])
+	}
+	if e.name == "" || strings.ContainsAny(e.name, ",/") {
+		return nil, fmt.Errorf("wrong SRV store endpoints %q, must be in the form %s[scheme://]name", s, SRVEndpointsPrefix)
+	}
+	return e, nil
+}
+
+// resolve returns the endpoints, sorted, of the SRV record targets
+func (e *srvEndpoints) resolve() ([]string, error) {
+	_, srvs, err := lookupSRV("", "", e.name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve SRV record %q: %v", e.name, err)
+	}
+	if len(srvs) == 0 {
+		return nil, fmt.Errorf("SRV record %q has no targets", e.name)
+	}
+	endpoints := []string{}
+	for _, srv := range srvs {
+		endpoint := net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+		if e.scheme != "" {
+			endpoint = e.scheme + "://" + endpoint
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	return endpoints, nil
+}
+
+// watch resolves the SRV record every interval and calls fn with the new
+// addresses when they change. Resolution errors are ignored, keeping the
+// current addresses, since the store could still be reachable.
+func (e *srvEndpoints) watch(ctx context.Context, interval time.Duration, addrs []string, fn func(addrs []string)) {
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+		endpoints, err := e.resolve()
+		if err != nil {
+			continue
+		}
+		_, newAddrs, err := parseEndpoints(endpoints)
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(newAddrs, addrs) {
+			addrs = newAddrs
+			fn(addrs)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseSRVEndpoints(t *testing.T) {
+	tests := []struct {
+		in  string
+		out *srvEndpoints
+		err bool
+	}{
+		{in: "http://127.0.0.1:2379"},
+		{in: "srv:_etcd-client._tcp.example.com", out: &srvEndpoints{name: "_etcd-client._tcp.example.com"}},
+		{in: "srv:https://_etcd-client-ssl._tcp.example.com", out: &srvEndpoints{scheme: "https", name: "_etcd-client-ssl._tcp.example.com"}},
+		{in: "srv:", err: true},
+		{in: "srv:https://", err: true},
+		{in: "srv:_etcd-client._tcp.example.com,_etcd-client._tcp.example.org", err: true},
+	}
+	for i, tt := range tests {
+		out, err := parseSRVEndpoints(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(out, tt.out) {
+			t.Errorf("#%d: got: %+v, want: %+v", i, out, tt.out)
+		}
+	}
+}
+
+// fakeSRV replaces the SRV lookups with the returned records
+type fakeSRV struct {
+	mutex sync.Mutex
+	srvs  map[string][]*net.SRV
+}
+
+func newFakeSRV() *fakeSRV {
+	f := &fakeSRV{srvs: map[string][]*net.SRV{}}
+	lookupSRV = f.lookup
+	return f
+}
+
+func (f *fakeSRV) set(name string, srvs []*net.SRV) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.srvs[name] = srvs
+}
+
+func (f *fakeSRV) lookup(service, proto, name string) (string, []*net.SRV, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	srvs, ok := f.srvs[name]
+	if !ok {
+		return "", nil, fmt.Errorf("no such host")
+	}
+	return name, srvs, nil
+}
+
+func TestSRVEndpointsResolve(t *testing.T) {
+	f := newFakeSRV()
+	defer func() { lookupSRV = net.LookupSRV }()
+
+	f.set("_etcd-client._tcp.example.com", []*net.SRV{
+		{Target: "etcd1.example.com.", Port: 2379},
+		{Target: "etcd0.example.com.", Port: 2379},
+	})
+	f.set("_empty._tcp.example.com", []*net.SRV{})
+
+	tests := []struct {
+		e         *srvEndpoints
+		endpoints []string
+		err       bool
+	}{
+		{
+			e:         &srvEndpoints{name: "_etcd-client._tcp.example.com"},
+			endpoints: []string{"etcd0.example.com:2379", "etcd1.example.com:2379"},
+		},
+		{
+			e:         &srvEndpoints{scheme: "https", name: "_etcd-client._tcp.example.com"},
+			endpoints: []string{"https://etcd0.example.com:2379", "https://etcd1.example.com:2379"},
+		},
+		{e: &srvEndpoints{name: "_empty._tcp.example.com"}, err: true},
+		{e: &srvEndpoints{name: "_notexisting._tcp.example.com"}, err: true},
+	}
+	for i, tt := range tests {
+		endpoints, err := tt.e.resolve()
+		if tt.err {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(endpoints, tt.endpoints) {
+			t.Errorf("#%d: got endpoints: %v, want: %v", i, endpoints, tt.endpoints)
+		}
+	}
+}
+
+func TestSRVEndpointsWatch(t *testing.T) {
+	f := newFakeSRV()
+	defer func() { lookupSRV = net.LookupSRV }()
+
+	const name = "_etcd-client._tcp.example.com"
+	f.set(name, []*net.SRV{{Target: "etcd0.example.com.", Port: 2379}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	addrsCh := make(chan []string, 10)
+	done := make(chan struct{})
+	e := &srvEndpoints{name: name}
+	go func() {
+		e.watch(ctx, 10*time.Millisecond, []string{"etcd0.example.com:2379"}, func(addrs []string) { addrsCh <- addrs })
+		close(done)
+	}()
+
+	// a failed resolution keeps the current addresses
+	f.set(name, nil)
+	time.Sleep(50 * time.Millisecond)
+	f.set(name, []*net.SRV{{Target: "etcd1.example.com.", Port: 2379}, {Target: "etcd0.example.com.", Port: 2379}})
+
+	select {
+	case addrs := <-addrsCh:
+		expected := []string{"etcd0.example.com:2379", "etcd1.example.com:2379"}
+		if !reflect.DeepEqual(addrs, expected) {
+			t.Errorf("got addrs: %v, want: %v", addrs, expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("addresses change not notified")
+	}
+	if len(addrsCh) != 0 {
+		t.Errorf("unexpected addresses notification: %v", <-addrsCh)
+	}
+
+	cancel()
+	<-done
+}
@@ -16,6 +16,7 @@ package store
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"time"
 
@@ -39,6 +40,22 @@ type Store interface {
 	GetSentinelsInfo(ctx context.Context) (cluster.SentinelsInfo, error)
 	SetProxyInfo(ctx context.Context, pi *cluster.ProxyInfo, ttl time.Duration) error
 	GetProxiesInfo(ctx context.Context) (cluster.ProxiesInfo, error)
+	GetKeepersAndProxiesInfo(ctx context.Context) (cluster.KeepersInfo, cluster.ProxiesInfo, error)
+	// AppendEvent appends the event to the cluster event log keeping only
+	// the last max events
+	AppendEvent(ctx context.Context, ev *cluster.Event, max int) error
+	// GetEvents returns the cluster event log, from the oldest event
+	GetEvents(ctx context.Context) ([]*cluster.Event, error)
+	// AppendSpecChange appends the cluster spec change to the spec history
+	// keeping only the last max changes
+	AppendSpecChange(ctx context.Context, c *cluster.SpecChange, max int) error
+	// GetSpecHistory returns the cluster spec history, from the oldest change
+	GetSpecHistory(ctx context.Context) ([]*cluster.SpecChange, error)
+	// Watch returns a channel receiving the cluster data pair every time the
+	// cluster data changes (a pair with a nil value when it's removed). If
+	// the receiver is slow only the last pair is kept. A failed watch is
+	// reestablished and the channel is closed when the context is done.
+	Watch(ctx context.Context) <-chan *KVPair
 }
 
 type Election interface {
@@ -49,3 +66,88 @@ type Election interface {
 	Leader() (string, error)
 	Stop()
 }
+
+// watchRetryInterval is the interval before reestablishing a failed watch
+const watchRetryInterval = 2 * time.Second
+
+// appendEvent appends the event to the json encoded events log returning the
+// new log with only the last max events
+func appendEvent(data []byte, ev *cluster.Event, max int) ([]byte, error) {
+	events := []*cluster.Event{}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &events); err != nil {
+			return nil, err
+		}
+	}
+	events = append(events, ev)
+	if len(events) > max {
+		events = events[len(events)-max:]
+	}
+	return json.Marshal(events)
+}
+
+func parseEvents(data []byte) ([]*cluster.Event, error) {
+	events := []*cluster.Event{}
+	if len(data) == 0 {
+		return events, nil
+	}
+	if err := json.Unmarshal(data, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// appendSpecChange appends the spec change to the json encoded spec history
+// returning the new history with only the last max changes
+func appendSpecChange(data []byte, c *cluster.SpecChange, max int) ([]byte, error) {
+	changes := []*cluster.SpecChange{}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &changes); err != nil {
+			return nil, err
+		}
+	}
+	changes = append(changes, c)
+	if len(changes) > max {
+		changes = changes[len(changes)-max:]
+	}
+	return json.Marshal(changes)
+}
+
+func parseSpecHistory(data []byte) ([]*cluster.SpecChange, error) {
+	changes := []*cluster.SpecChange{}
+	if len(data) == 0 {
+		return changes, nil
+	}
+	if err := json.Unmarshal(data, &changes); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// watchLoop forwards the pairs received by the watch created by watchFn,
+// creating a new one when it fails, until the context is done.
+func watchLoop(ctx context.Context, watchFn func(ctx context.Context) (<-chan *KVPair, error)) <-chan *KVPair {
+	ch := make(chan *KVPair, 1)
+	go func() {
+		defer close(ch)
+		for {
+			wch, err := watchFn(ctx)
+			if err == nil {
+				for pair := range wch {
+					// replace the pair not yet received
+					select {
+					case <-ch:
+					default:
+					}
+					ch <- pair
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(watchRetryInterval):
+			}
+		}
+	}()
+	return ch
+}
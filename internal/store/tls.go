@@ -0,0 +1,57 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"net"
+	"sync"
+)
+
+// tlsServerNames are the hosts of the store endpoints used to verify the
+// store server certificates when the CA file is reloaded. Since the
+// verification doesn't know the endpoint of the connection, a certificate
+// valid for any of the store endpoints is accepted. They're updated when the
+// endpoints change (i.e. the SRV record targets).
+type tlsServerNames struct {
+	mutex sync.Mutex
+	names []string
+}
+
+func newTLSServerNames(addrs []string) *tlsServerNames {
+	n := &tlsServerNames{}
+	n.set(addrs)
+	return n
+}
+
+func (n *tlsServerNames) set(addrs []string) {
+	names := []string{}
+	for _, addr := range addrs {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			// address without a port
+			host = addr
+		}
+		names = append(names, host)
+	}
+	n.mutex.Lock()
+	n.names = names
+	n.mutex.Unlock()
+}
+
+func (n *tlsServerNames) get() []string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.names
+}
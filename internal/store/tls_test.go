@@ -0,0 +1,34 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTLSServerNames(t *testing.T) {
+	n := newTLSServerNames([]string{"etcd1:2379", "10.0.0.1:2379", "etcd3"})
+	expected := []string{"etcd1", "10.0.0.1", "etcd3"}
+	if names := n.get(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("got names: %v, want: %v", names, expected)
+	}
+
+	n.set([]string{"etcd4:2379"})
+	expected = []string{"etcd4"}
+	if names := n.get(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("got names: %v, want: %v", names, expected)
+	}
+}
@@ -0,0 +1,439 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+const (
+	// ZookeeperSessionTimeout is the zookeeper session timeout. Since
+	// zookeeper doesn't support keys ttl (on the commonly deployed
+	// versions) the keys written with a ttl are ephemeral nodes, removed
+	// when the session of their writer expires, and the election lease is
+	// the session of the leader.
+	ZookeeperSessionTimeout = MinTTL
+
+	zookeeperElectionNodePrefix = "candidate-"
+)
+
+func fromZookeeperError(err error) error {
+	switch err {
+	case zk.ErrNoNode:
+		return ErrKeyNotFound
+	}
+	return err
+}
+
+// zookeeperPath converts a store key to a zookeeper node path
+func zookeeperPath(key string) string {
+	return "/" + strings.Trim(key, "/")
+}
+
+type zookeeperStore struct {
+	c              *zk.Conn
+	requestTimeout time.Duration
+}
+
+func newZookeeperStore(addrs []string, requestTimeout time.Duration) (*zookeeperStore, error) {
+	c, _, err := zk.Connect(addrs, ZookeeperSessionTimeout, zk.WithLogInfo(false))
+	if err != nil {
+		return nil, err
+	}
+	return &zookeeperStore{c: c, requestTimeout: requestTimeout}, nil
+}
+
+// do executes fn, since the zookeeper client requests don't accept a context,
+// returning when the request timeout expires or the context is done.
+func (s *zookeeperStore) do(pctx context.Context, fn func() error) error {
+	ctx, cancel := context.WithTimeout(pctx, s.requestTimeout)
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- fn()
+	}()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// create creates the node, and its missing parents as persistent nodes. It
+// returns the created node path (different from the requested one for
+// sequential nodes).
+func (s *zookeeperStore) create(p string, value []byte, flags int32) (string, error) {
+	for {
+		np, err := s.c.Create(p, value, flags, zk.WorldACL(zk.PermAll))
+		if err != zk.ErrNoNode {
+			return np, err
+		}
+		// create the parents
+		parts := strings.Split(strings.Trim(path.Dir(p), "/"), "/")
+		for i := range parts {
+			pp := "/" + strings.Join(parts[:i+1], "/")
+			if _, err := s.c.Create(pp, []byte{}, 0, zk.WorldACL(zk.PermAll)); err != nil && err != zk.ErrNodeExists {
+				return "", err
+			}
+		}
+	}
+}
+
+func (s *zookeeperStore) Put(pctx context.Context, key string, value []byte, options *WriteOptions) error {
+	ephemeral := options != nil && options.TTL > 0
+	p := zookeeperPath(key)
+	return s.do(pctx, func() error {
+		for {
+			exists, stat, err := s.c.Exists(p)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				var flags int32
+				if ephemeral {
+					flags = zk.FlagEphemeral
+				}
+				_, err := s.create(p, value, flags)
+				if err == zk.ErrNodeExists {
+					continue
+				}
+				return err
+			}
+			// an ephemeral node of another session (i.e. of a previous
+			// instance of the writer) would be removed when that session
+			// expires, so recreate it. Recreate it also when changing
+			// between a persistent and an ephemeral node.
+			isEphemeral := stat.EphemeralOwner != 0
+			if isEphemeral != ephemeral || (ephemeral && stat.EphemeralOwner != s.c.SessionID()) {
+				if err := s.c.Delete(p, stat.Version); err != nil && err != zk.ErrNoNode && err != zk.ErrBadVersion {
+					return err
+				}
+				continue
+			}
+			_, err = s.c.Set(p, value, -1)
+			if err == zk.ErrNoNode {
+				continue
+			}
+			return err
+		}
+	})
+}
+
+func (s *zookeeperStore) Get(pctx context.Context, key string) (*KVPair, error) {
+	var pair *KVPair
+	err := s.do(pctx, func() error {
+		value, stat, err := s.c.Get(zookeeperPath(key))
+		if err != nil {
+			return fromZookeeperError(err)
+		}
+		pair = &KVPair{Key: key, Value: value, LastIndex: uint64(stat.Version)}
+		return nil
+	})
+	return pair, err
+}
+
+func (s *zookeeperStore) List(pctx context.Context, directory string) ([]*KVPair, error) {
+	var kvPairs []*KVPair
+	err := s.do(pctx, func() error {
+		p := zookeeperPath(directory)
+		children, _, err := s.c.Children(p)
+		if err != nil {
+			return fromZookeeperError(err)
+		}
+		sort.Strings(children)
+		kvPairs = []*KVPair{}
+		for _, child := range children {
+			value, stat, err := s.c.Get(path.Join(p, child))
+			if err != nil {
+				// the node has been removed after listing the children
+				if err == zk.ErrNoNode {
+					continue
+				}
+				return err
+			}
+			key := path.Join(strings.TrimSuffix(directory, "/"), child)
+			kvPairs = append(kvPairs, &KVPair{Key: key, Value: value, LastIndex: uint64(stat.Version)})
+		}
+		return nil
+	})
+	return kvPairs, err
+}
+
+func (s *zookeeperStore) AtomicPut(pctx context.Context, key string, value []byte, previous *KVPair, options *WriteOptions) (*KVPair, error) {
+	p := zookeeperPath(key)
+	var pair *KVPair
+	err := s.do(pctx, func() error {
+		if previous != nil {
+			stat, err := s.c.Set(p, value, int32(previous.LastIndex))
+			if err != nil {
+				if err == zk.ErrBadVersion || err == zk.ErrNoNode {
+					return ErrKeyModified
+				}
+				return err
+			}
+			pair = &KVPair{Key: key, Value: value, LastIndex: uint64(stat.Version)}
+			return nil
+		}
+		var flags int32
+		if options != nil && options.TTL > 0 {
+			flags = zk.FlagEphemeral
+		}
+		if _, err := s.create(p, value, flags); err != nil {
+			if err == zk.ErrNodeExists {
+				return ErrKeyModified
+			}
+			return err
+		}
+		// a new node has version 0
+		pair = &KVPair{Key: key, Value: value, LastIndex: 0}
+		return nil
+	})
+	return pair, err
+}
+
+func (s *zookeeperStore) Delete(pctx context.Context, key string) error {
+	return s.do(pctx, func() error {
+		return fromZookeeperError(s.c.Delete(zookeeperPath(key), -1))
+	})
+}
+
+func (s *zookeeperStore) Watch(ctx context.Context, key string) (<-chan *KVPair, error) {
+	p := zookeeperPath(key)
+	ch := make(chan *KVPair)
+	go func() {
+		defer close(ch)
+		first := true
+		for {
+			var pair *KVPair
+			var evCh <-chan zk.Event
+			value, stat, wch, err := s.c.GetW(p)
+			switch err {
+			case nil:
+				pair = &KVPair{Key: key, Value: value, LastIndex: uint64(stat.Version)}
+				evCh = wch
+			case zk.ErrNoNode:
+				exists, _, wch, err := s.c.ExistsW(p)
+				if err != nil {
+					return
+				}
+				// the node has been created in the meantime
+				if exists {
+					continue
+				}
+				pair = &KVPair{Key: key}
+				evCh = wch
+			default:
+				return
+			}
+			// the first pair is the current value
+			if !first {
+				select {
+				case ch <- pair:
+				case <-ctx.Done():
+					return
+				}
+			}
+			first = false
+			// zookeeper watches are one time triggers, so a new one is set
+			// at every loop
+			select {
+			case ev := <-evCh:
+				if ev.Err != nil || ev.Type == zk.EventNotWatching {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (s *zookeeperStore) Close() error {
+	s.c.Close()
+	return nil
+}
+
+// zookeeperElection implements the zookeeper leader election recipe: every
+// candidate creates an ephemeral sequential node under the election path and
+// the candidate with the lowest sequence number is the leader. Every other
+// candidate watches the node preceding its own one.
+type zookeeperElection struct {
+	s            *zookeeperStore
+	path         string
+	candidateUID string
+
+	running bool
+
+	electedCh chan bool
+	errCh     chan error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (e *zookeeperElection) RunForElection() (<-chan bool, <-chan error) {
+	if e.running {
+		panic("already running")
+	}
+
+	e.electedCh = make(chan bool)
+	e.errCh = make(chan error)
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+
+	e.running = true
+	go e.campaign()
+
+	return e.electedCh, e.errCh
+}
+
+func (e *zookeeperElection) Stop() {
+	if !e.running {
+		panic("not running")
+	}
+	e.cancel()
+	e.running = false
+}
+
+// candidates returns the names of the candidates nodes sorted by sequence
+// number
+func (e *zookeeperElection) candidates() ([]string, error) {
+	children, _, err := e.s.c.Children(zookeeperPath(e.path))
+	if err != nil {
+		if err == zk.ErrNoNode {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	candidates := []string{}
+	for _, child := range children {
+		if strings.HasPrefix(child, zookeeperElectionNodePrefix) {
+			candidates = append(candidates, child)
+		}
+	}
+	// the sequence numbers have a fixed length
+	sort.Strings(candidates)
+	return candidates, nil
+}
+
+func (e *zookeeperElection) Leader() (string, error) {
+	var leader string
+	err := e.s.do(context.Background(), func() error {
+		for {
+			candidates, err := e.candidates()
+			if err != nil {
+				return err
+			}
+			if len(candidates) == 0 {
+				return ErrElectionNoLeader
+			}
+			value, _, err := e.s.c.Get(path.Join(zookeeperPath(e.path), candidates[0]))
+			if err != nil {
+				// the leader node has been removed after listing the
+				// candidates
+				if err == zk.ErrNoNode {
+					continue
+				}
+				return err
+			}
+			leader = string(value)
+			return nil
+		}
+	})
+	return leader, err
+}
+
+// waitLeadership blocks until the candidate node is the one with the lowest
+// sequence number. It returns false if the context is done.
+func (e *zookeeperElection) waitLeadership(node string) (bool, error) {
+	name := path.Base(node)
+	for {
+		candidates, err := e.candidates()
+		if err != nil {
+			return false, err
+		}
+		i := sort.SearchStrings(candidates, name)
+		if i == len(candidates) || candidates[i] != name {
+			return false, zk.ErrNoNode
+		}
+		if i == 0 {
+			return true, nil
+		}
+		exists, _, ch, err := e.s.c.ExistsW(path.Join(zookeeperPath(e.path), candidates[i-1]))
+		if err != nil {
+			return false, err
+		}
+		if !exists {
+			continue
+		}
+		select {
+		case <-ch:
+		case <-e.ctx.Done():
+			return false, nil
+		}
+	}
+}
+
+func (e *zookeeperElection) campaign() {
+	defer close(e.electedCh)
+	defer close(e.errCh)
+
+	for {
+		e.electedCh <- false
+		node, err := e.s.create(path.Join(zookeeperPath(e.path), zookeeperElectionNodePrefix), []byte(e.candidateUID), zk.FlagEphemeral|zk.FlagSequence)
+		if err != nil {
+			e.running = false
+			e.errCh <- err
+			return
+		}
+
+		elected, err := e.waitLeadership(node)
+		if err != nil {
+			e.s.c.Delete(node, -1)
+			e.running = false
+			e.errCh <- err
+			return
+		}
+		if !elected {
+			e.s.c.Delete(node, -1)
+			e.running = false
+			return
+		}
+
+		e.electedCh <- true
+
+		// the leadership is lost when the candidate node is removed (i.e.
+		// its session has expired)
+		exists, _, ch, err := e.s.c.ExistsW(node)
+		if err == nil && exists {
+			select {
+			case <-e.ctx.Done():
+				e.s.c.Delete(node, -1)
+				e.running = false
+				return
+			case <-ch:
+			}
+		}
+		e.s.c.Delete(node, -1)
+		e.electedCh <- false
+	}
+}
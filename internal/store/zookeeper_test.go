@@ -0,0 +1,33 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import "testing"
+
+func TestZookeeperPath(t *testing.T) {
+	tests := []struct {
+		key  string
+		path string
+	}{
+		{key: "stolon/cluster/c1/clusterdata", path: "/stolon/cluster/c1/clusterdata"},
+		{key: "/stolon/cluster/c1/keepers/info/", path: "/stolon/cluster/c1/keepers/info"},
+		{key: "/", path: "/"},
+	}
+	for i, tt := range tests {
+		if p := zookeeperPath(tt.key); p != tt.path {
+			t.Errorf("#%d: got path: %q, want: %q", i, p, tt.path)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing implements the spans of the stolon convergence and failover
+// flows. The ended spans are logged as structured log entries with their
+// trace id, span id, parent span id, start time and duration. The spans of
+// the stolon components related to the same cluster data generation share
+// the same trace id, so a failover (from the sentinel election to the keepers
+// convergence and the proxies routing change) can be followed searching its
+// trace id in the components logs.
+package tracing
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	slog "github.com/sorintlab/stolon/internal/log"
+)
+
+var log = slog.S()
+
+// Attr is a span attribute. The value is a string, an int64 or a bool.
+type Attr struct {
+	Key   string
+	Value interface{}
+}
+
+func String(key, value string) Attr {
+	return Attr{Key: key, Value: value}
+}
+
+func Int64(key string, value int64) Attr {
+	return Attr{Key: key, Value: value}
+}
+
+func Bool(key string, value bool) Attr {
+	return Attr{Key: key, Value: value}
+}
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+// GenerationTraceID returns the trace id of the spans related to the cluster
+// data generation. It's computed from the cluster uid and the generation so
+// every stolon component uses the same trace id.
+func GenerationTraceID(clusterUID string, generation int64) TraceID {
+	h := sha256.Sum256([]byte(fmt.Sprintf("stolon/%s/%d", clusterUID, generation)))
+	var id TraceID
+	copy(id[:], h[:])
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	rand.Read(id[:])
+	return id
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	rand.Read(id[:])
+	return id
+}
+
+// Span is an operation of a trace. A root span is logged, with all its
+// children, when it ends. All the methods can be called on a nil span (when
+// tracing is disabled).
+type Span struct {
+	tracer *Tracer
+	root   *Span
+	parent *Span
+
+	id    SpanID
+	name  string
+	start time.Time
+	end   time.Time
+	attrs []Attr
+	err   error
+
+	// root span only fields
+	traceID   TraceID
+	children  []*Span
+	discarded bool
+}
+
+// Child starts a child span
+func (s *Span) Child(name string, attrs ...Attr) *Span {
+	if s == nil {
+		return nil
+	}
+	c := &Span{
+		tracer: s.tracer,
+		root:   s.root,
+		parent: s,
+		id:     newSpanID(),
+		name:   name,
+		start:  s.tracer.now(),
+		attrs:  attrs,
+	}
+	s.tracer.mutex.Lock()
+	s.root.children = append(s.root.children, c)
+	s.tracer.mutex.Unlock()
+	return c
+}
+
+func (s *Span) SetAttributes(attrs ...Attr) {
+	if s == nil {
+		return
+	}
+	s.tracer.mutex.Lock()
+	s.attrs = append(s.attrs, attrs...)
+	s.tracer.mutex.Unlock()
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.tracer.mutex.Lock()
+	s.err = err
+	s.tracer.mutex.Unlock()
+}
+
+// SetTraceID sets the trace id of the span trace. It can be called until the
+// root span is ended (i.e. when the cluster data generation is known only at
+// the end of the operation).
+func (s *Span) SetTraceID(id TraceID) {
+	if s == nil {
+		return
+	}
+	s.tracer.mutex.Lock()
+	s.root.traceID = id
+	s.tracer.mutex.Unlock()
+}
+
+// Discard discards the span trace: it won't be logged (i.e. an operation
+// that didn't change anything).
+func (s *Span) Discard() {
+	if s == nil {
+		return
+	}
+	s.tracer.mutex.Lock()
+	s.root.discarded = true
+	s.tracer.mutex.Unlock()
+}
+
+// End ends the span. When it's a root span it's logged with its children.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	t := s.tracer
+	t.mutex.Lock()
+	if !s.end.IsZero() {
+		t.mutex.Unlock()
+		return
+	}
+	s.end = t.now()
+	if s.root != s || s.discarded {
+		t.mutex.Unlock()
+		return
+	}
+	entries := t.spanEntries(s)
+	t.mutex.Unlock()
+
+	for _, e := range entries {
+		t.logSpan(e)
+	}
+}
+
+// Tracer creates the spans and logs them when ended. A nil tracer (when
+// tracing is disabled) creates nil spans.
+type Tracer struct {
+	now func() time.Time
+	// logSpan logs the key value pairs of a span
+	logSpan func(keysAndValues []interface{})
+
+	mutex sync.Mutex
+}
+
+// NewTracer returns a tracer logging the ended spans
+func NewTracer() *Tracer {
+	return &Tracer{
+		now: time.Now,
+		logSpan: func(keysAndValues []interface{}) {
+			log.Infow("span", keysAndValues...)
+		},
+	}
+}
+
+// Start starts a root span of a new trace
+func (t *Tracer) Start(name string, attrs ...Attr) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{
+		tracer:  t,
+		id:      newSpanID(),
+		name:    name,
+		start:   t.now(),
+		attrs:   attrs,
+		traceID: newTraceID(),
+	}
+	s.root = s
+	return s
+}
+
+// spanEntries returns the log key value pairs of the root span and its
+// children. Children not ended are reported as ended with their root span.
+// It must be called with the mutex held.
+func (t *Tracer) spanEntries(root *Span) [][]interface{} {
+	entries := [][]interface{}{}
+	for _, s := range append([]*Span{root}, root.children...) {
+		end := s.end
+		if end.IsZero() {
+			end = root.end
+		}
+		kvs := []interface{}{
+			"name", s.name,
+			"traceID", hex.EncodeToString(root.traceID[:]),
+			"spanID", hex.EncodeToString(s.id[:]),
+		}
+		if s.parent != nil {
+			kvs = append(kvs, "parentSpanID", hex.EncodeToString(s.parent.id[:]))
+		}
+		kvs = append(kvs, "start", s.start, "duration", end.Sub(s.start))
+		for _, a := range s.attrs {
+			kvs = append(kvs, a.Key, a.Value)
+		}
+		if s.err != nil {
+			kvs = append(kvs, "error", s.err.Error())
+		}
+		entries = append(entries, kvs)
+	}
+	return entries
+}
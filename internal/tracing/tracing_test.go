@@ -0,0 +1,112 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testTracer returns a tracer saving the logged spans in entries
+func testTracer(entries *[][]interface{}) *Tracer {
+	now := time.Unix(1000, 0)
+	return &Tracer{
+		now: func() time.Time {
+			now = now.Add(time.Second)
+			return now
+		},
+		logSpan: func(keysAndValues []interface{}) {
+			*entries = append(*entries, keysAndValues)
+		},
+	}
+}
+
+func TestGenerationTraceID(t *testing.T) {
+	id := GenerationTraceID("cluster1", 5)
+	if id != GenerationTraceID("cluster1", 5) {
+		t.Errorf("got different trace ids for the same generation")
+	}
+	if id == GenerationTraceID("cluster1", 6) || id == GenerationTraceID("cluster2", 5) {
+		t.Errorf("got the same trace id for different generations")
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	var tr *Tracer
+	s := tr.Start("check")
+	if s != nil {
+		t.Fatalf("got a span from a nil tracer")
+	}
+	// all the span methods must be callable on a nil span
+	c := s.Child("child", String("k", "v"))
+	c.SetAttributes(Bool("b", true))
+	c.SetError(fmt.Errorf("error"))
+	c.End()
+	s.SetTraceID(GenerationTraceID("cluster1", 1))
+	s.Discard()
+	s.End()
+}
+
+func TestSpans(t *testing.T) {
+	entries := [][]interface{}{}
+	tr := testTracer(&entries)
+
+	s := tr.Start("sentinel.check", String("cluster", "cluster1"))
+	c := s.Child("sentinel.updateCluster")
+	cc := c.Child("sentinel.fencing")
+	cc.SetError(fmt.Errorf("fencing failed"))
+	cc.End()
+	c.SetAttributes(Int64("generation", 3), Bool("changed", true))
+	c.End()
+	// a not ended child
+	nc := s.Child("store.put")
+	traceID := GenerationTraceID("cluster1", 3)
+	s.SetTraceID(traceID)
+
+	// children are logged with their root span
+	if len(entries) != 0 {
+		t.Fatalf("got %d logged spans, want: 0", len(entries))
+	}
+	s.End()
+	// ending again is a no op
+	s.End()
+
+	// a discarded trace
+	d := tr.Start("sentinel.check")
+	d.Child("sentinel.updateCluster").End()
+	d.Discard()
+	d.End()
+
+	hexID := func(id []byte) string { return hex.EncodeToString(id) }
+	tid := hexID(traceID[:])
+	expected := [][]interface{}{
+		{"name", "sentinel.check", "traceID", tid, "spanID", hexID(s.id[:]), "start", s.start, "duration", s.end.Sub(s.start), "cluster", "cluster1"},
+		{"name", "sentinel.updateCluster", "traceID", tid, "spanID", hexID(c.id[:]), "parentSpanID", hexID(s.id[:]), "start", c.start, "duration", c.end.Sub(c.start), "generation", int64(3), "changed", true},
+		{"name", "sentinel.fencing", "traceID", tid, "spanID", hexID(cc.id[:]), "parentSpanID", hexID(c.id[:]), "start", cc.start, "duration", cc.end.Sub(cc.start), "error", "fencing failed"},
+		// not ended children end with the root span
+		{"name", "store.put", "traceID", tid, "spanID", hexID(nc.id[:]), "parentSpanID", hexID(s.id[:]), "start", nc.start, "duration", s.end.Sub(nc.start)},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("got %d logged spans, want: %d", len(entries), len(expected))
+	}
+	for i, e := range entries {
+		if !reflect.DeepEqual(e, expected[i]) {
+			t.Errorf("#%d: got span: %v, want: %v", i, e, expected[i])
+		}
+	}
+}
@@ -30,6 +30,8 @@ const (
 
 	KubeClusterDataAnnotation = "stolon-clusterdata"
 	KubeStatusAnnnotation     = "stolon-status"
+	KubeEventsAnnotation      = "stolon-events"
+	KubeSpecHistoryAnnotation = "stolon-spechistory"
 )
 
 func PodName() (string, error) {
@@ -0,0 +1,293 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package vault implements a minimal HashiCorp Vault client used to read the
+// stolon credentials from the kv secrets engine and to issue the store
+// client certificates with the pki secrets engine.
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/common"
+)
+
+const (
+	// DefaultKubeAuthMount is the default mount path of the vault kubernetes
+	// auth method
+	DefaultKubeAuthMount = "kubernetes"
+	// DefaultKubeJWTFile is the service account token file of a kubernetes
+	// pod
+	DefaultKubeJWTFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	// DefaultSecretField is the secret field read when not specified
+	DefaultSecretField = "password"
+)
+
+type Config struct {
+	Address string
+	CAFile  string
+	// Token is the vault token. When empty, and KubeAuthRole is defined,
+	// the token is obtained logging in with the kubernetes auth method.
+	Token string
+	// KubeAuthRole is the vault kubernetes auth method role
+	KubeAuthRole  string
+	KubeAuthMount string
+	KubeJWTFile   string
+
+	RequestTimeout time.Duration
+}
+
+type Client struct {
+	cfg    Config
+	client *http.Client
+
+	tokenMutex sync.Mutex
+	token      string
+}
+
+func NewClient(cfg Config) (*Client, error) {
+	if cfg.Address == "" {
+		return nil, fmt.Errorf("vault address required")
+	}
+	if cfg.Token == "" && cfg.KubeAuthRole == "" {
+		return nil, fmt.Errorf("a vault token or a vault kubernetes auth role is required")
+	}
+	if cfg.KubeAuthMount == "" {
+		cfg.KubeAuthMount = DefaultKubeAuthMount
+	}
+	if cfg.KubeJWTFile == "" {
+		cfg.KubeJWTFile = DefaultKubeJWTFile
+	}
+	if cfg.RequestTimeout == 0 {
+		cfg.RequestTimeout = 10 * time.Second
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if cfg.CAFile != "" {
+		tlsConfig, err := common.NewTLSConfig("", "", cfg.CAFile, false)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create vault tls config: %v", err)
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	return &Client{
+		cfg:    cfg,
+		client: &http.Client{Transport: transport, Timeout: cfg.RequestTimeout},
+		token:  cfg.Token,
+	}, nil
+}
+
+// vaultError is an error response of the vault api
+type vaultError struct {
+	status int
+	errors []string
+}
+
+func (e *vaultError) Error() string {
+	return fmt.Sprintf("vault response status %d: %s", e.status, strings.Join(e.errors, ", "))
+}
+
+// secret is a vault api response
+type secret struct {
+	Data          map[string]interface{} `json:"data"`
+	LeaseDuration int                    `json:"lease_duration"`
+	Auth          *struct {
+		ClientToken string `json:"client_token"`
+	} `json:"auth"`
+}
+
+func (c *Client) do(ctx context.Context, method, path, token string, body interface{}) (*secret, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.cfg.Address, "/")+"/v1/"+strings.TrimPrefix(path, "/"), r)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		verr := &vaultError{status: resp.StatusCode}
+		var errResp struct {
+			Errors []string `json:"errors"`
+		}
+		if err := json.Unmarshal(data, &errResp); err == nil {
+			verr.errors = errResp.Errors
+		}
+		return nil, verr
+	}
+	var s *secret
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("cannot parse vault response: %v", err)
+	}
+	return s, nil
+}
+
+// login obtains a new token with the kubernetes auth method
+func (c *Client) login(ctx context.Context) (string, error) {
+	jwt, err := ioutil.ReadFile(c.cfg.KubeJWTFile)
+	if err != nil {
+		return "", fmt.Errorf("cannot read kubernetes service account token: %v", err)
+	}
+	s, err := c.do(ctx, "POST", "auth/"+c.cfg.KubeAuthMount+"/login", "", map[string]string{
+		"role": c.cfg.KubeAuthRole,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("vault kubernetes login failed: %v", err)
+	}
+	if s.Auth == nil || s.Auth.ClientToken == "" {
+		return "", fmt.Errorf("vault kubernetes login returned no token")
+	}
+	return s.Auth.ClientToken, nil
+}
+
+// request executes the request with the client token. When using the
+// kubernetes auth method a new token is obtained if there's no token or the
+// current one has been refused (i.e. it's expired).
+func (c *Client) request(ctx context.Context, method, path string, body interface{}) (*secret, error) {
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+	kubeAuth := c.cfg.Token == "" && c.cfg.KubeAuthRole != ""
+	if c.token == "" && kubeAuth {
+		token, err := c.login(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.token = token
+	}
+	s, err := c.do(ctx, method, path, c.token, body)
+	if verr, ok := err.(*vaultError); ok && verr.status == http.StatusForbidden && kubeAuth {
+		token, err := c.login(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.token = token
+		return c.do(ctx, method, path, c.token, body)
+	}
+	return s, err
+}
+
+// ParseSecretRef parses a secret reference in the form path#field. The field
+// defaults to DefaultSecretField.
+func ParseSecretRef(ref string) (string, string, error) {
+	parts := strings.SplitN(ref, "#", 2)
+	path := strings.Trim(parts[0], "/")
+	if path == "" {
+		return "", "", fmt.Errorf("empty secret path in %q", ref)
+	}
+	field := DefaultSecretField
+	if len(parts) == 2 {
+		field = parts[1]
+		if field == "" {
+			return "", "", fmt.Errorf("empty secret field in %q", ref)
+		}
+	}
+	return path, field, nil
+}
+
+// secretField returns the field of the secret data. The kv version 2 secrets
+// engine returns the secret data inside a data field, together with its
+// metadata.
+func secretField(data map[string]interface{}, field string) (string, error) {
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	v, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("secret field %q not found", field)
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("secret field %q isn't a string", field)
+	}
+	return s, nil
+}
+
+// ReadSecret reads the field of the secret referenced as path#field (i.e.
+// secret/data/stolon#password with the kv version 2 secrets engine)
+func (c *Client) ReadSecret(ctx context.Context, ref string) (string, error) {
+	path, field, err := ParseSecretRef(ref)
+	if err != nil {
+		return "", err
+	}
+	s, err := c.request(ctx, "GET", path, nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot read secret %q: %v", path, err)
+	}
+	v, err := secretField(s.Data, field)
+	if err != nil {
+		return "", fmt.Errorf("cannot read secret %q: %v", path, err)
+	}
+	return v, nil
+}
+
+// Certificate is a certificate issued by the pki secrets engine
+type Certificate struct {
+	Certificate []byte
+	PrivateKey  []byte
+	IssuingCA   []byte
+	Expiration  time.Time
+}
+
+// IssueCertificate issues a certificate using the pki secrets engine issue
+// path (i.e. pki/issue/stolon)
+func (c *Client) IssueCertificate(ctx context.Context, path, commonName string, ttl time.Duration) (*Certificate, error) {
+	req := map[string]string{"common_name": commonName}
+	if ttl > 0 {
+		req["ttl"] = ttl.String()
+	}
+	s, err := c.request(ctx, "POST", path, req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot issue certificate: %v", err)
+	}
+	cert := &Certificate{}
+	for field, dest := range map[string]*[]byte{"certificate": &cert.Certificate, "private_key": &cert.PrivateKey, "issuing_ca": &cert.IssuingCA} {
+		v, err := secretField(s.Data, field)
+		if err != nil {
+			return nil, fmt.Errorf("cannot issue certificate: %v", err)
+		}
+		*dest = []byte(v)
+	}
+	if exp, ok := s.Data["expiration"].(float64); ok {
+		cert.Expiration = time.Unix(int64(exp), 0)
+	}
+	return cert, nil
+}
@@ -0,0 +1,175 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseSecretRef(t *testing.T) {
+	tests := []struct {
+		ref   string
+		path  string
+		field string
+		err   error
+	}{
+		{ref: "secret/stolon", path: "secret/stolon", field: "password"},
+		{ref: "/secret/data/stolon#su-password", path: "secret/data/stolon", field: "su-password"},
+		{ref: "#password", err: fmt.Errorf(`empty secret path in "#password"`)},
+		{ref: "secret/stolon#", err: fmt.Errorf(`empty secret field in "secret/stolon#"`)},
+	}
+
+	for i, tt := range tests {
+		path, field, err := ParseSecretRef(tt.ref)
+		if tt.err != nil {
+			if err == nil {
+				t.Errorf("#%d: got no error, wanted error: %v", i, tt.err)
+			} else if tt.err.Error() != err.Error() {
+				t.Errorf("#%d: got error: %v, wanted error: %v", i, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		} else if path != tt.path || field != tt.field {
+			t.Errorf("#%d: got path: %q, field: %q, want path: %q, field: %q", i, path, field, tt.path, tt.field)
+		}
+	}
+}
+
+func TestReadSecret(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token1" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, `{"errors":["permission denied"]}`)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/stolon":
+			// kv version 1
+			fmt.Fprintf(w, `{"data":{"password":"pass1"}}`)
+		case "/v1/secret/data/stolon":
+			// kv version 2
+			fmt.Fprintf(w, `{"data":{"data":{"password":"pass2","repl":"pass3"},"metadata":{"version":2}}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"errors":[]}`)
+		}
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(Config{Address: ts.URL, Token: "token1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for ref, expected := range map[string]string{
+		"secret/stolon":           "pass1",
+		"secret/data/stolon":      "pass2",
+		"secret/data/stolon#repl": "pass3",
+	} {
+		v, err := c.ReadSecret(context.Background(), ref)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", ref, err)
+		} else if v != expected {
+			t.Errorf("%s: got: %q, want: %q", ref, v, expected)
+		}
+	}
+
+	if _, err := c.ReadSecret(context.Background(), "secret/data/stolon#notexisting"); err == nil {
+		t.Errorf("got no error for a not existing field")
+	}
+	if _, err := c.ReadSecret(context.Background(), "secret/notexisting"); err == nil {
+		t.Errorf("got no error for a not existing secret")
+	}
+
+	c, err = NewClient(Config{Address: ts.URL, Token: "wrongtoken"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := c.ReadSecret(context.Background(), "secret/stolon"); err == nil {
+		t.Errorf("got no error with a wrong token")
+	}
+}
+
+func TestKubeAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stolon-vault")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	jwtFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(jwtFile, []byte("jwt1\n"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	logins := 0
+	validToken := ""
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth/kubernetes/login":
+			var req map[string]string
+			json.NewDecoder(r.Body).Decode(&req)
+			if req["role"] != "stolon" || req["jwt"] != "jwt1" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			logins++
+			validToken = fmt.Sprintf("token%d", logins)
+			fmt.Fprintf(w, `{"auth":{"client_token":%q}}`, validToken)
+		case "/v1/pki/issue/stolon":
+			if r.Header.Get("X-Vault-Token") != validToken {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fmt.Fprintf(w, `{"data":{"certificate":"cert","private_key":"key","issuing_ca":"ca","expiration":1500000000}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(Config{Address: ts.URL, KubeAuthRole: "stolon", KubeJWTFile: jwtFile})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cert, err := c.IssueCertificate(context.Background(), "pki/issue/stolon", "keeper1", time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(cert.Certificate) != "cert" || string(cert.PrivateKey) != "key" || string(cert.IssuingCA) != "ca" || !cert.Expiration.Equal(time.Unix(1500000000, 0)) {
+		t.Errorf("wrong certificate: %+v", cert)
+	}
+	if logins != 1 {
+		t.Errorf("got %d logins, want: 1", logins)
+	}
+
+	// the token has expired, a new login is done
+	validToken = "newtoken"
+	if _, err := c.IssueCertificate(context.Background(), "pki/issue/stolon", "keeper1", 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if logins != 2 {
+		t.Errorf("got %d logins, want: 2", logins)
+	}
+}
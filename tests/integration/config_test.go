@@ -462,3 +462,47 @@ func TestAdditionalReplicationSlots(t *testing.T) {
 		t.Fatalf("unexpected err: %v", err)
 	}
 }
+
+func TestExtensionsAppDatabase(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "stolon")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	clusterName := uuid.NewV4().String()
+
+	tks, tss, tp, tstore := setupServers(t, clusterName, dir, 1, 1, false, false, nil)
+	defer shutdown(tks, tss, tp, tstore)
+
+	storeEndpoints := fmt.Sprintf("%s:%s", tstore.listenAddress, tstore.port)
+	storePath := filepath.Join(common.StorePrefix, clusterName)
+	sm := store.NewKVBackedStore(tstore.store, storePath)
+
+	master, _ := waitMasterStandbysReady(t, sm, tks)
+
+	if _, err := master.Exec("create database app"); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	appDB, err := master.OpenDatabase("app")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer appDB.Close()
+
+	const extQuery = "select extname from pg_extension where extname = 'pgcrypto'"
+
+	err = StolonCtl(clusterName, tstore.storeBackend, storeEndpoints, "update", "--patch", `{ "extensions" : [ { "name": "pgcrypto", "databases": [ "app" ] } ] }`)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if err := waitQueryValues(appDB, extQuery, []string{"pgcrypto"}, 30*time.Second); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	// the extension is created only in the defined databases
+	if err := waitQueryValues(master.db, extQuery, []string{}, 30*time.Second); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+}
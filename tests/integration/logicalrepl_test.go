@@ -0,0 +1,162 @@
+// Copyright 2018 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package integration
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sorintlab/stolon/internal/cluster"
+	"github.com/sorintlab/stolon/internal/common"
+	"github.com/sorintlab/stolon/internal/store"
+
+	"github.com/satori/go.uuid"
+)
+
+func TestPublicationsAppDatabase(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "stolon")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	clusterName := uuid.NewV4().String()
+
+	tks, tss, tp, tstore := setupServers(t, clusterName, dir, 1, 1, false, false, nil)
+	defer shutdown(tks, tss, tp, tstore)
+
+	storeEndpoints := fmt.Sprintf("%s:%s", tstore.listenAddress, tstore.port)
+	storePath := filepath.Join(common.StorePrefix, clusterName)
+	sm := store.NewKVBackedStore(tstore.store, storePath)
+
+	master, _ := waitMasterStandbysReady(t, sm, tks)
+
+	maj, _, err := master.PGDataVersion()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if maj < 10 {
+		t.Skipf("publications aren't supported on postgres < 10")
+	}
+
+	if _, err := master.Exec("create database app"); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	appDB, err := master.OpenDatabase("app")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer appDB.Close()
+	if _, err := appDB.Exec("create table table01 (id integer primary key)"); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	const pubsQuery = "select pubname from pg_publication"
+
+	err = StolonCtl(clusterName, tstore.storeBackend, storeEndpoints, "update", "--patch", `{ "publications" : [ { "name": "pub01", "database": "app", "tables": [ "table01" ] } ] }`)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if err := waitQueryValues(appDB, pubsQuery, []string{"pub01"}, 30*time.Second); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if err := waitQueryValues(appDB, "select tablename from pg_publication_tables where pubname = 'pub01'", []string{"table01"}, 30*time.Second); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	// no publication in the postgres database
+	if err := waitQueryValues(master.db, pubsQuery, []string{}, 30*time.Second); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// remove the publication from the spec, it should be dropped
+	err = StolonCtl(clusterName, tstore.storeBackend, storeEndpoints, "update", "--patch", `{ "publications" : null }`)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if err := waitQueryValues(appDB, pubsQuery, []string{}, 30*time.Second); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+}
+
+func TestLogicalReplicationSlotsAppDatabase(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "stolon")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	clusterName := uuid.NewV4().String()
+
+	// start with the logical wal level so the instance isn't restarted
+	// when adding the slot
+	pgParameters := cluster.PGParameters{"wal_level": "logical"}
+	for k, v := range defaultPGParameters {
+		pgParameters[k] = v
+	}
+	initialClusterSpec := &cluster.ClusterSpec{
+		InitMode:           cluster.ClusterInitModeP(cluster.ClusterInitModeNew),
+		SleepInterval:      &cluster.Duration{Duration: 2 * time.Second},
+		FailInterval:       &cluster.Duration{Duration: 5 * time.Second},
+		ConvergenceTimeout: &cluster.Duration{Duration: 30 * time.Second},
+		PGParameters:       pgParameters,
+	}
+	tks, tss, tp, tstore := setupServersCustom(t, clusterName, dir, 1, 1, initialClusterSpec)
+	defer shutdown(tks, tss, tp, tstore)
+
+	storeEndpoints := fmt.Sprintf("%s:%s", tstore.listenAddress, tstore.port)
+	storePath := filepath.Join(common.StorePrefix, clusterName)
+	sm := store.NewKVBackedStore(tstore.store, storePath)
+
+	master, _ := waitMasterStandbysReady(t, sm, tks)
+
+	maj, _, err := master.PGDataVersion()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if maj < 10 {
+		t.Skipf("logical replication slots aren't supported on postgres < 10")
+	}
+
+	if _, err := master.Exec("create database app"); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	const slotsQuery = "select slot_name from pg_replication_slots where slot_type = 'logical' and database = 'app'"
+
+	err = StolonCtl(clusterName, tstore.storeBackend, storeEndpoints, "update", "--patch", `{ "logicalReplicationSlots" : [ { "name": "slot01", "database": "app" } ] }`)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if err := waitQueryValues(master.db, slotsQuery, []string{common.StolonName("slot01")}, 30*time.Second); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// remove the slot from the spec, it should be dropped
+	err = StolonCtl(clusterName, tstore.storeBackend, storeEndpoints, "update", "--patch", `{ "logicalReplicationSlots" : null }`)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if err := waitQueryValues(master.db, slotsQuery, []string{}, 30*time.Second); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+}
@@ -483,6 +483,56 @@ func (tk *TestKeeper) ReplQuery(query string, args ...interface{}) (*sql.Rows, e
 	return res, nil
 }
 
+// OpenDatabase opens a connection to the provided database of the keeper
+// instance
+func (tk *TestKeeper) OpenDatabase(database string) (*sql.DB, error) {
+	connParams := pg.ConnParams{
+		"user":     tk.pgSUUsername,
+		"password": tk.pgSUPassword,
+		"host":     tk.pgListenAddress,
+		"port":     tk.pgPort,
+		"dbname":   database,
+		"sslmode":  "disable",
+	}
+	return sql.Open("postgres", connParams.ConnString())
+}
+
+// waitQueryValues waits for the query, returning a single text column, to
+// return the provided values
+func waitQueryValues(db *sql.DB, query string, values []string, timeout time.Duration) error {
+	sort.Strings(values)
+
+	start := time.Now()
+	var curValues []string
+	var err error
+	for time.Now().Add(-timeout).Before(start) {
+		var rows *sql.Rows
+		rows, err = db.Query(query)
+		if err != nil {
+			goto end
+		}
+		curValues = []string{}
+		for rows.Next() {
+			var v string
+			if err = rows.Scan(&v); err != nil {
+				break
+			}
+			curValues = append(curValues, v)
+		}
+		rows.Close()
+		if err != nil {
+			goto end
+		}
+		sort.Strings(curValues)
+		if reflect.DeepEqual(values, curValues) {
+			return nil
+		}
+	end:
+		time.Sleep(2 * time.Second)
+	}
+	return fmt.Errorf("timeout waiting for values %v, got: %v, last err: %v", values, curValues, err)
+}
+
 func (tk *TestKeeper) SwitchWals(times int) error {
 	maj, _, err := tk.PGDataVersion()
 	if err != nil {